@@ -15,6 +15,7 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/glowlabs-org/gca-backend/glow"
 )
@@ -228,13 +229,16 @@ func main() {
 		return
 	}
 
-	// Create an authorization for the equipment
+	// Create an authorization for the equipment, using the clock as the
+	// nonce.
 	sid := rand.Intn(400) + 15
 	ea := glow.EquipmentAuthorization{
+		Version:   glow.EquipmentAuthorizationVersion,
 		ShortID:   uint32(sid),
 		PublicKey: devPub,
 		Capacity:  2520e3,   // milliwatt hours
 		Debt:      165680e6, // milligrams
+		Nonce:     uint64(time.Now().UnixNano()),
 	}
 	// Submit the authorization to the gca server.
 	sb := ea.SigningBytes()
@@ -15,6 +15,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/glowlabs-org/gca-backend/client"
 	"github.com/glowlabs-org/gca-backend/glow"
@@ -252,8 +253,10 @@ func newEquipmentCmd(gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, serve
 		return fmt.Errorf("unable to write history file header: %v", err)
 	}
 
-	// Create the authorization and submit it to all of the servers.
+	// Create the authorization and submit it to all of the servers. The
+	// clock is good enough as a source of increasing nonces for testing.
 	ea := glow.EquipmentAuthorization{
+		Version:    glow.EquipmentAuthorizationVersion,
 		ShortID:    nextShortID,
 		PublicKey:  clientPubKey,
 		Latitude:   latitude,
@@ -261,6 +264,7 @@ func newEquipmentCmd(gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, serve
 		Capacity:   uint64(capacity),
 		Debt:       uint64(debt),
 		Expiration: uint32(expiration),
+		Nonce:      uint64(time.Now().UnixNano()),
 	}
 	sb := ea.SigningBytes()
 	ea.Signature = glow.Sign(sb, gcaPrivKey)
@@ -270,7 +274,7 @@ func newEquipmentCmd(gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, serve
 	}
 	fmt.Println()
 	for _, server := range serversMap {
-		url := fmt.Sprintf("http://%v:%v/api/v1/authorize-equipment", server.Location, server.HttpPort)
+		url := "http://" + glow.HostPort(server.Location, server.HttpPort) + "/api/v1/authorize-equipment"
 		resp, err := http.Post(url, "application/json", bytes.NewBuffer(j))
 		if err != nil || resp.StatusCode != http.StatusOK || resp.Body.Close() != nil {
 			fmt.Printf("Had difficulties submitting auth to %v: %v\n", server.Location, err)
@@ -27,7 +27,10 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -57,6 +60,15 @@ new-equipment
 
 resubmit
 	Submits an existing GCA equipment to the server
+
+renew [shortID] [years]
+	Extends the lifetime of an existing GCA equipment by the
+	provided number of years, and submits the renewal to the
+	servers
+
+backup [server-url] [output-file]
+	Downloads a backup of a GCA server. The server only hands
+	out backups over https or to a loopback address.
 `)
 }
 
@@ -87,6 +99,7 @@ func main() {
 	gcaTempPubKeyPath := filepath.Join(gcaDir, "gcaTempPubKey.dat")
 	serversPath := filepath.Join(gcaDir, "gcaServers.dat")
 	shortIDPath := filepath.Join(gcaDir, "latestShortID.dat")
+	noncePath := filepath.Join(gcaDir, "latestNonce.dat")
 	clientsPath := filepath.Join(gcaDir, "clients")
 
 	// Create the temp keys if they don't already exist. The idea behind
@@ -195,7 +208,7 @@ func main() {
 
 	// Check if the user wants to authorize a new device.
 	if os.Args[1] == "new-equipment" {
-		err := newEquipmentCmd(gcaPubKey, gcaPrivKey, serversMap, shortIDPath, clientsPath)
+		err := newEquipmentCmd(gcaPubKey, gcaPrivKey, serversMap, shortIDPath, noncePath, clientsPath)
 		if err != nil {
 			fmt.Println("Unable to create and authorize new equipment:", err)
 			return
@@ -203,6 +216,16 @@ func main() {
 		return
 	}
 
+	// Check if the user wants to take a backup of a server.
+	if os.Args[1] == "backup" {
+		err := backupCmd(gcaPrivKey)
+		if err != nil {
+			fmt.Println("Unable to take backup:", err)
+			return
+		}
+		return
+	}
+
 	// Check if the user wants to resubmit an authorization
 	if os.Args[1] == "resubmit" {
 		err := resubmitCmd(gcaPubKey, gcaPrivKey, serversMap, clientsPath)
@@ -212,6 +235,16 @@ func main() {
 		}
 		return
 	}
+
+	// Check if the user wants to renew an authorization
+	if os.Args[1] == "renew" {
+		err := renewCmd(gcaPrivKey, serversMap, noncePath, clientsPath)
+		if err != nil {
+			fmt.Println("Unable to renew equipment:", err)
+			return
+		}
+		return
+	}
 }
 
 // newGCA will create keys for a new GCA. It will refuse to generate new keys
@@ -258,7 +291,7 @@ func authorizeServer(gcaPubKey glow.PublicKey, gcaTempPrivKey glow.PrivateKey, s
 		fmt.Println("Unable to create GCARegistration:", err)
 		return
 	}
-	req, err := http.NewRequest("POST", fmt.Sprintf("http://%v:%v/api/v1/register-gca", os.Args[2], os.Args[3]), bytes.NewBuffer(payload))
+	req, err := http.NewRequest("POST", "http://"+net.JoinHostPort(glow.TrimBrackets(os.Args[2]), os.Args[3])+"/api/v1/register-gca", bytes.NewBuffer(payload))
 	if err != nil {
 		fmt.Println("Unable to create GCARegistration request:", err)
 		return
@@ -335,8 +368,36 @@ func initEquipmentCmd(shortIDPath string) error {
 	return nil
 }
 
+// nextNonce increments the nonce counter on disk and returns the new value,
+// which gives every authorization from this GCA a unique nonce. A missing
+// counter file starts the count at zero.
+func nextNonce(noncePath string) (uint64, error) {
+	var nonce uint64
+	data, err := ioutil.ReadFile(noncePath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("unable to read the nonce file: %v", err)
+	}
+	if err == nil {
+		if len(data) != 8 {
+			return 0, fmt.Errorf("nonce file is corrupt")
+		}
+		nonce = binary.LittleEndian.Uint64(data)
+	}
+
+	// Write out the new value before it gets used, so that a crash can
+	// never cause a nonce to be handed out twice.
+	nonce++
+	var newData [8]byte
+	binary.LittleEndian.PutUint64(newData[:], nonce)
+	err = ioutil.WriteFile(noncePath, newData[:], 0600)
+	if err != nil {
+		return 0, fmt.Errorf("unable to write the nonce file: %v", err)
+	}
+	return nonce, nil
+}
+
 // newEquipmentCmd will create a new device and submit it to the remote server.
-func newEquipmentCmd(gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, serversMap map[glow.PublicKey]client.GCAServer, shortIDPath string, clientsPath string) error {
+func newEquipmentCmd(gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, serversMap map[glow.PublicKey]client.GCAServer, shortIDPath string, noncePath string, clientsPath string) error {
 	// Check that there are servers, since this command makes network
 	// calls.
 	if len(serversMap) == 0 {
@@ -532,7 +593,12 @@ func newEquipmentCmd(gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, serve
 	}
 
 	// Create the authorization.
+	nonce, err := nextNonce(noncePath)
+	if err != nil {
+		return fmt.Errorf("unable to get a nonce for the authorization: %v", err)
+	}
 	ea := glow.EquipmentAuthorization{
+		Version:   glow.EquipmentAuthorizationVersionExpiring,
 		ShortID:   nextShortID,
 		PublicKey: clientPubKey,
 
@@ -545,6 +611,7 @@ func newEquipmentCmd(gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, serve
 
 		Initialization: initTimeslot,
 		ProtocolFee:    uint64(protocolFee),
+		Nonce:          nonce,
 	}
 	sb := ea.SigningBytes()
 	ea.Signature = glow.Sign(sb, gcaPrivKey)
@@ -563,7 +630,7 @@ func newEquipmentCmd(gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, serve
 	// Submit the authorization to all servers.
 	fmt.Println()
 	for _, server := range serversMap {
-		url := fmt.Sprintf("http://%v:%v/api/v1/authorize-equipment", server.Location, server.HttpPort)
+		url := "http://" + glow.HostPort(server.Location, server.HttpPort) + "/api/v1/authorize-equipment"
 		resp, err := http.Post(url, "application/json", bytes.NewBuffer(j))
 		if err != nil || resp.StatusCode != http.StatusOK || resp.Body.Close() != nil {
 			fmt.Printf("Had difficulties submitting auth to %v: %v\n", server.Location, err)
@@ -621,7 +688,7 @@ func resubmitCmd(gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, serversMa
 	fmt.Println("Data confirmed. Proceeding...")
 
 	for _, server := range serversMap {
-		url := fmt.Sprintf("http://%v:%v/api/v1/authorize-equipment", server.Location, server.HttpPort)
+		url := "http://" + glow.HostPort(server.Location, server.HttpPort) + "/api/v1/authorize-equipment"
 		resp, err := http.Post(url, "application/json", bytes.NewBuffer(b))
 		if err != nil || resp.StatusCode != http.StatusOK || resp.Body.Close() != nil {
 			fmt.Printf("Had difficulties submitting auth to %v: %v\n", server.Location, err)
@@ -631,3 +698,129 @@ func resubmitCmd(gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, serversMa
 	}
 	return nil
 }
+
+// renewCmd signs a renewal of an authorized solar farm that pushes its
+// expiration back, and submits the renewal to the GCA servers. The ShortID of
+// the solar farm stays the same.
+func renewCmd(gcaPrivKey glow.PrivateKey, serversMap map[glow.PublicKey]client.GCAServer, noncePath string, clientsPath string) error {
+	// Check that there are servers, since this command makes network
+	// calls.
+	if len(serversMap) == 0 {
+		return fmt.Errorf("no servers provided")
+	}
+	if len(os.Args) != 4 {
+		return fmt.Errorf("Usage: ./gca-admin renew [shortID] [years]")
+	}
+	shortID, err := strconv.ParseUint(os.Args[2], 10, 32)
+	if err != nil {
+		return fmt.Errorf("Provided shortID must be an integer")
+	}
+	years, err := strconv.ParseUint(os.Args[3], 10, 8)
+	if err != nil || years == 0 {
+		return fmt.Errorf("Provided number of years must be a positive integer")
+	}
+
+	// Load the client authorization from disk.
+	dir := filepath.Join(clientsPath, "client_"+strconv.Itoa(int(shortID)))
+	filePath := filepath.Join(dir, client.AuthorizationFile)
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("Unable to load the path for this ShortID")
+	}
+	var ea glow.EquipmentAuthorization
+	if err := json.Unmarshal(b, &ea); err != nil {
+		return fmt.Errorf("unable to decode the authorization: %v", err)
+	}
+	if _, expires := ea.ExpiresAt(); !expires {
+		return fmt.Errorf("the authorization of this ShortID never expires")
+	}
+
+	// Push the expiration back by the provided number of glow years.
+	timeslotsPerGlowYear := uint64(288 * 7 * 52)
+	expiration := uint64(ea.Expiration) + years*timeslotsPerGlowYear
+	if expiration > math.MaxUint32 {
+		return fmt.Errorf("expiration date for solar farm is out of bounds")
+	}
+	fmt.Printf("Renewing equipment %v, which expires at %v, until %v\n", ea.ShortID, time.Unix(glow.TimeslotToUnix(ea.Expiration), 0).UTC(), time.Unix(glow.TimeslotToUnix(uint32(expiration)), 0).UTC())
+	var confirmation string
+	fmt.Print("\nIs this information correct? (yes/no): ")
+	if _, err := fmt.Scanln(&confirmation); err != nil {
+		fmt.Println("Error reading confirmation:", err)
+		os.Exit(1)
+	}
+	if confirmation != "yes" {
+		fmt.Println("Data entry aborted.")
+		os.Exit(0)
+	}
+
+	// Sign the renewal with a fresh nonce.
+	nonce, err := nextNonce(noncePath)
+	if err != nil {
+		return fmt.Errorf("unable to get a nonce for the renewal: %v", err)
+	}
+	ea.Expiration = uint32(expiration)
+	ea.Nonce = nonce
+	ea.Signature = glow.Sign(ea.SigningBytes(), gcaPrivKey)
+	j, err := json.Marshal(ea)
+	if err != nil {
+		return fmt.Errorf("unable to marshal equipment authorization: %v", err)
+	}
+	err = ioutil.WriteFile(filePath, j, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write authorization file to disk: %v", err)
+	}
+
+	for _, server := range serversMap {
+		url := "http://" + glow.HostPort(server.Location, server.HttpPort) + "/api/v1/authorize-equipment"
+		resp, err := http.Post(url, "application/json", bytes.NewBuffer(j))
+		if err != nil || resp.StatusCode != http.StatusOK || resp.Body.Close() != nil {
+			fmt.Printf("Had difficulties submitting renewal to %v: %v\n", server.Location, err)
+		} else {
+			fmt.Println("Equipment successfully renewed on", server.Location)
+		}
+	}
+	return nil
+}
+
+// backupCmd downloads a backup of the server at the provided url and writes it
+// to the provided file.
+func backupCmd(gcaPrivKey glow.PrivateKey) error {
+	if len(os.Args) != 4 {
+		return fmt.Errorf("Usage: ./gca-admin backup [server-url] [output-file]")
+	}
+	serverURL, outputPath := os.Args[2], os.Args[3]
+	if _, err := os.Stat(outputPath); err == nil {
+		return fmt.Errorf("%v already exists", outputPath)
+	}
+
+	request := server.BackupRequest{Timestamp: time.Now().Unix()}
+	request.Signature = glow.Sign(request.SigningBytes(), gcaPrivKey)
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("unable to encode backup request: %v", err)
+	}
+	resp, err := http.Post(serverURL+"/api/v1/admin/backup", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to reach server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server refused the backup: %v", client.ReadAPIError(resp))
+	}
+
+	f, err := os.OpenFile(outputPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create output file: %v", err)
+	}
+	n, err := io.Copy(f, resp.Body)
+	if err != nil {
+		f.Close()
+		os.Remove(outputPath)
+		return fmt.Errorf("unable to download backup: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to save backup: %v", err)
+	}
+	fmt.Printf("Saved a backup of %v bytes to %v\n", n, outputPath)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+// gca-demo walks a GCA server that runs with --internal-test through the whole
+// lifecycle of a GCA: it registers a GCA key, authorizes two synthetic
+// devices, streams their reports for a few simulated hours by moving the clock
+// of the server, and then prints the stats and the summary of each device,
+// checking every signature along the way. It exits with 1 if anything didn't
+// check out, which makes it a smoke test for a fresh server.
+//
+// Without --gca-keys, the demo uses the test GCA key that a server in internal
+// test mode generates when it wasn't provisioned. The synthetic devices stay
+// authorized after the run, and the clock of the server stays where the demo
+// left it.
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/glowlabs-org/gca-backend/testing/demo"
+)
+
+func main() {
+	keysFlag := flag.String("gca-keys", "", "file with the public and private key of a GCA that is already registered, defaults to the test key of the server")
+	serverKeyFlag := flag.String("server-key", "", "hex encoded public key of the server, required with --gca-keys")
+	hostFlag := flag.String("server", "127.0.0.1", "address of the server")
+	httpPortFlag := flag.Uint("http-port", 35015, "http port of the server")
+	udpPortFlag := flag.Uint("udp-port", 35045, "udp port of the server")
+	hoursFlag := flag.Int("hours", 3, "simulated hours of reports")
+	firstShortIDFlag := flag.Uint("first-short-id", 0, "ShortID of the first synthetic device, random if zero")
+	flag.Parse()
+
+	cfg := demo.Config{
+		Host:         *hostFlag,
+		HttpPort:     uint16(*httpPortFlag),
+		UdpPort:      uint16(*udpPortFlag),
+		Hours:        *hoursFlag,
+		FirstShortID: uint32(*firstShortIDFlag),
+		Output:       os.Stdout,
+	}
+	if *keysFlag != "" {
+		keyData, err := ioutil.ReadFile(*keysFlag)
+		if err != nil {
+			fmt.Println("unable to load gca keys:", err)
+			os.Exit(1)
+		}
+		if len(keyData) != 64 {
+			fmt.Println("gca key file has the wrong size:", len(keyData))
+			os.Exit(1)
+		}
+		copy(cfg.GCAKey[:], keyData[32:])
+
+		serverKeyBytes, err := hex.DecodeString(*serverKeyFlag)
+		if err != nil || len(serverKeyBytes) != len(cfg.ServerKey) {
+			fmt.Println("a valid --server-key is required with --gca-keys")
+			os.Exit(1)
+		}
+		copy(cfg.ServerKey[:], serverKeyBytes)
+	}
+
+	if _, err := demo.Run(cfg); err != nil {
+		fmt.Println("demo failed:", err)
+		os.Exit(1)
+	}
+}
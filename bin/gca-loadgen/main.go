@@ -0,0 +1,78 @@
+package main
+
+// gca-loadgen authorizes a set of synthetic devices against a GCA server and
+// then floods the server with signed reports from those devices, printing
+// the throughput and what the server did with the reports. It is meant for
+// test servers: the synthetic devices stay authorized after the run.
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/testing/loadgen"
+)
+
+func main() {
+	keysFlag := flag.String("gca-keys", "gcaKeys.dat", "file with the public and private key of the GCA")
+	serverKeyFlag := flag.String("server-key", "", "hex encoded public key of the server, used to verify acks")
+	hostFlag := flag.String("server", "127.0.0.1", "address of the server")
+	httpPortFlag := flag.Uint("http-port", 35015, "http port of the server")
+	udpPortFlag := flag.Uint("udp-port", 35045, "udp port of the server")
+	devicesFlag := flag.Int("devices", 100, "number of synthetic devices")
+	firstShortIDFlag := flag.Uint("first-short-id", 1<<30, "ShortID of the first synthetic device")
+	rateFlag := flag.Float64("rate", 100, "reports per second across all devices")
+	durationFlag := flag.Duration("duration", 0, "how long to send reports for, defaults to 10s")
+	duplicatesFlag := flag.Float64("duplicates", 0, "probability that a report gets sent twice")
+	jitterFlag := flag.Duration("jitter", 0, "largest random delay added to every send")
+	seedFlag := flag.String("seed", "", "derive the device keys and the reports from this seed, for reproducible runs against test servers only")
+	flag.Parse()
+
+	keyData, err := ioutil.ReadFile(*keysFlag)
+	if err != nil {
+		fmt.Println("unable to load gca keys:", err)
+		os.Exit(1)
+	}
+	if len(keyData) != 64 {
+		fmt.Println("gca key file has the wrong size:", len(keyData))
+		os.Exit(1)
+	}
+	var gcaPrivKey glow.PrivateKey
+	copy(gcaPrivKey[:], keyData[32:])
+
+	var serverKey glow.PublicKey
+	serverKeyBytes, err := hex.DecodeString(*serverKeyFlag)
+	if err != nil || len(serverKeyBytes) != len(serverKey) {
+		fmt.Println("a valid --server-key is required")
+		os.Exit(1)
+	}
+	copy(serverKey[:], serverKeyBytes)
+
+	var seed []byte
+	if *seedFlag != "" {
+		seed = []byte(*seedFlag)
+	}
+
+	res, err := loadgen.Run(loadgen.Config{
+		GCAKey:        gcaPrivKey,
+		ServerKey:     serverKey,
+		Host:          *hostFlag,
+		HttpPort:      uint16(*httpPortFlag),
+		UdpPort:       uint16(*udpPortFlag),
+		Devices:       *devicesFlag,
+		FirstShortID:  uint32(*firstShortIDFlag),
+		Rate:          *rateFlag,
+		Duration:      *durationFlag,
+		DuplicateRate: *duplicatesFlag,
+		Jitter:        *jitterFlag,
+		Seed:          seed,
+	})
+	if err != nil {
+		fmt.Println("load generation failed:", err)
+		os.Exit(1)
+	}
+	fmt.Print(res)
+}
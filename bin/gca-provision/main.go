@@ -0,0 +1,278 @@
+package main
+
+// gca-provision onboards a new device. It generates the keypair of the device,
+// gets the authorization of the device signed by the GCA, submits the
+// authorization to every GCA server, checks with each server that the
+// authorization landed, and leaves a directory with everything the device
+// needs, ready to be copied onto the device.
+//
+// The authorization can be signed in two ways. If the tool is given the keys of
+// the GCA, it signs the authorization itself. Otherwise it writes the unsigned
+// authorization to authorization-request.json in the device directory and
+// stops, the GCA signs the signing_bytes of the request, and the tool is run
+// again with the signature.
+//
+// The tool can be run again for the same device directory at any point, for
+// example after a server was unreachable. The keys of the device are never
+// replaced, and once the authorization is signed it is the one that gets
+// submitted again. With --encrypt-keys, the keys of the device are encrypted
+// with a passphrase, see client/key_encryption.go.
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/client"
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// main parses the flags and runs the provisioning. The exit code is 0 once the
+// device is authorized on every server, 2 if the authorization still needs the
+// signature of the GCA, and 1 for everything else.
+func main() {
+	homeDir, _ := os.UserHomeDir()
+	gcaDir := filepath.Join(homeDir, ".config", "gca-data")
+
+	dirFlag := flag.String("dir", "", "directory that the device bundle gets written to, required")
+	serversFlag := flag.String("servers", filepath.Join(gcaDir, "gcaServers.dat"), "server list of the GCA, as written by gca-admin")
+	gcaKeysFlag := flag.String("gca-keys", "", "keys of the GCA, as written by gca-admin, to sign the authorization directly")
+	gcaPubKeyFlag := flag.String("gca-pubkey", "", "hex encoded public key of the GCA, needed unless --gca-keys is provided or the bundle already has the key")
+	signatureFlag := flag.String("signature", "", "hex encoded signature of the GCA over the signing_bytes of the authorization request")
+	tlsFlag := flag.Bool("tls", false, "talk https to the servers")
+	shortIDFlag := flag.Uint("short-id", 0, "ShortID of the device, required the first time")
+	latitudeFlag := flag.Float64("latitude", 0, "latitude of the device")
+	longitudeFlag := flag.Float64("longitude", 0, "longitude of the device")
+	capacityFlag := flag.Uint64("capacity", 0, "capacity of the device in watts")
+	debtFlag := flag.Uint64("debt", 0, "carbon debt of the device in kilograms of CO2")
+	lifetimeFlag := flag.Uint("lifetime", 10, "lifetime of the authorization in years")
+	protocolFeeFlag := flag.Uint64("protocol-fee", 0, "protocol fee of the device in cents")
+	initFlag := flag.String("init", time.Now().UTC().Format("2006-01-02"), "initialization date of the device, as YYYY-MM-DD")
+	encryptKeysFlag := flag.Bool("encrypt-keys", false, "encrypt the keys of the device with a passphrase from --passphrase-file, "+client.PassphraseEnv+", or the terminal")
+	passphraseFileFlag := flag.String("passphrase-file", "", "file with the passphrase of the device keys")
+	flag.Parse()
+	if *dirFlag == "" {
+		fmt.Println("--dir is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Load the servers and the key of the GCA.
+	serversData, err := os.ReadFile(*serversFlag)
+	if err != nil {
+		fmt.Println("Unable to load the list of GCA servers:", err)
+		os.Exit(1)
+	}
+	servers, err := client.UntrustedDeserializeGCAServerMap(serversData)
+	if err != nil {
+		fmt.Println("List of GCA servers appears corrupt:", err)
+		os.Exit(1)
+	}
+	gcaPubKey, gcaPrivKey, canSign, err := loadGCAKey(*dirFlag, *gcaKeysFlag, *gcaPubKeyFlag)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Get the keys and the signed authorization of the device. The
+	// passphrase is needed to encrypt the keys, and to load keys that
+	// were encrypted by an earlier run.
+	keyPath := filepath.Join(*dirFlag, client.ClientKeyFile)
+	encrypted, err := client.IsClientKeyFileEncrypted(keyPath)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("Unable to read the device keys:", err)
+		os.Exit(1)
+	}
+	var passphrase []byte
+	if *encryptKeysFlag || encrypted {
+		source := client.DefaultPassphraseSource(*passphraseFileFlag)
+		if !encrypted && *passphraseFileFlag == "" && os.Getenv(client.PassphraseEnv) == "" {
+			source = client.PromptPassphrase(true)
+		}
+		passphrase, err = source()
+		if err != nil {
+			fmt.Println("Unable to get the passphrase of the device keys:", err)
+			os.Exit(1)
+		}
+	}
+	pub, _, err := client.LoadOrCreateClientKeys(*dirFlag, passphrase)
+	if err != nil {
+		fmt.Println("Unable to set up the device keys:", err)
+		os.Exit(1)
+	}
+	if encrypted, _ := client.IsClientKeyFileEncrypted(keyPath); *encryptKeysFlag && !encrypted {
+		backupPath, err := client.EncryptClientKeyFile(keyPath, passphrase)
+		if err != nil {
+			fmt.Println("Unable to encrypt the device keys:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Encrypted the device keys, remove the plaintext backup before shipping the bundle:", backupPath)
+	}
+	ea, signed, err := client.LoadAuthorization(*dirFlag, gcaPubKey)
+	if err != nil {
+		fmt.Println("Unable to load the authorization of the device:", err)
+		os.Exit(1)
+	}
+	if signed && ea.PublicKey != pub {
+		fmt.Println("The authorization in the bundle is for a different device")
+		os.Exit(1)
+	}
+	if !signed {
+		ar, exists, err := client.LoadAuthorizationRequest(*dirFlag)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if !exists {
+			unsigned, err := newAuthorization(pub, uint32(*shortIDFlag), *latitudeFlag, *longitudeFlag, *capacityFlag, *debtFlag, *lifetimeFlag, *protocolFeeFlag, *initFlag)
+			if err != nil {
+				fmt.Println("Invalid device:", err)
+				os.Exit(1)
+			}
+			ar = client.NewAuthorizationRequest(unsigned)
+			if err := client.SaveAuthorizationRequest(*dirFlag, ar); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		if ar.Authorization.PublicKey != pub {
+			fmt.Println("The authorization request in the bundle is for a different device")
+			os.Exit(1)
+		}
+		switch {
+		case canSign:
+			ea = ar.Authorization
+			ea.Signature = glow.Sign(ea.SigningBytes(), gcaPrivKey)
+		case *signatureFlag != "":
+			var sig glow.Signature
+			sigBytes, err := hex.DecodeString(*signatureFlag)
+			if err != nil || len(sigBytes) != len(sig) {
+				fmt.Println("The signature must be 64 hex encoded bytes")
+				os.Exit(1)
+			}
+			copy(sig[:], sigBytes)
+			ea, err = ar.Sign(sig, gcaPubKey)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		default:
+			fmt.Println("The authorization request was written to", filepath.Join(*dirFlag, client.AuthorizationRequestFile))
+			fmt.Println("Have the GCA sign these bytes, then run gca-provision again with --signature:")
+			fmt.Println(ar.SigningBytes)
+			os.Exit(2)
+		}
+	}
+	if *shortIDFlag != 0 && uint32(*shortIDFlag) != ea.ShortID {
+		fmt.Printf("The bundle is already provisioned as ShortID %v\n", ea.ShortID)
+		os.Exit(1)
+	}
+
+	// Write the bundle, then submit the authorization and check that every
+	// server has it.
+	if err := client.WriteDeviceBundle(*dirFlag, ea, gcaPubKey, servers, glow.CurrentTimeslot()); err != nil {
+		fmt.Println("Unable to write the device bundle:", err)
+		os.Exit(1)
+	}
+	failed := 0
+	for key, server := range servers {
+		if server.Banned {
+			continue
+		}
+		api := client.NewAPIClient(key, server, client.APIClientOptions{UseTLS: *tlsFlag})
+		if err := api.SubmitAuthorization(ea); err != nil {
+			fmt.Printf("Unable to submit the authorization to %v: %v\n", server.Location, err)
+			failed++
+			continue
+		}
+		if err := api.VerifyAuthorization(ea); err != nil {
+			fmt.Printf("The authorization did not land on %v: %v\n", server.Location, err)
+			failed++
+			continue
+		}
+		fmt.Println("Equipment successfully authorized on", server.Location)
+	}
+	if failed > 0 {
+		fmt.Printf("The authorization is missing on %v servers, run gca-provision again to retry\n", failed)
+		os.Exit(1)
+	}
+	fmt.Printf("Device %v is provisioned, copy %v onto the device\n", ea.ShortID, *dirFlag)
+}
+
+// loadGCAKey returns the public key of the GCA, along with the private key if
+// the keys of the GCA were provided. Without either flag, the key gets taken
+// from a bundle that was provisioned before.
+func loadGCAKey(dir, keysPath, pubKeyHex string) (glow.PublicKey, glow.PrivateKey, bool, error) {
+	var pub glow.PublicKey
+	var priv glow.PrivateKey
+	switch {
+	case keysPath != "":
+		data, err := os.ReadFile(keysPath)
+		if err != nil || len(data) < 64 {
+			return pub, priv, false, fmt.Errorf("unable to load the gca keys: %v", err)
+		}
+		copy(pub[:], data[:32])
+		copy(priv[:], data[32:])
+		return pub, priv, true, nil
+	case pubKeyHex != "":
+		data, err := hex.DecodeString(pubKeyHex)
+		if err != nil || len(data) != len(pub) {
+			return pub, priv, false, fmt.Errorf("the gca public key must be 32 hex encoded bytes")
+		}
+		copy(pub[:], data)
+		return pub, priv, false, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, client.GCAPubKeyFile))
+	if err != nil || len(data) != len(pub) {
+		return pub, priv, false, fmt.Errorf("either --gca-keys or --gca-pubkey is required")
+	}
+	copy(pub[:], data)
+	return pub, priv, false, nil
+}
+
+// newAuthorization builds the authorization of a new device from the provided
+// settings, using the same units as gca-admin. The nonce is random, which
+// keeps it unique without a counter.
+func newAuthorization(pub glow.PublicKey, shortID uint32, latitude, longitude float64, capacity, debt uint64, lifetime uint, protocolFee uint64, initDate string) (glow.EquipmentAuthorization, error) {
+	if shortID == 0 {
+		return glow.EquipmentAuthorization{}, fmt.Errorf("--short-id is required")
+	}
+	initTime, err := time.Parse("2006-01-02", initDate)
+	if err != nil {
+		return glow.EquipmentAuthorization{}, fmt.Errorf("invalid initialization date: %v", err)
+	}
+	initTimeslot, err := glow.UnixToTimeslot(initTime.Unix())
+	if err != nil {
+		return glow.EquipmentAuthorization{}, fmt.Errorf("invalid initialization date: %v", err)
+	}
+	secondsPerGlowYear := int64(3600 * 24 * 7 * 52)
+	expiration, err := glow.UnixToTimeslot(initTime.Unix() + int64(lifetime)*secondsPerGlowYear)
+	if err != nil {
+		return glow.EquipmentAuthorization{}, fmt.Errorf("expiration date for solar farm is out of bounds")
+	}
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return glow.EquipmentAuthorization{}, fmt.Errorf("unable to generate a nonce: %v", err)
+	}
+	return glow.EquipmentAuthorization{
+		Version:   glow.EquipmentAuthorizationVersionExpiring,
+		ShortID:   shortID,
+		PublicKey: pub,
+
+		Latitude:  latitude,
+		Longitude: longitude,
+
+		Capacity:   capacity * 1000 / 12, // watts to milliwatthours per 5 minutes
+		Debt:       debt * 1000,          // kilograms to grams
+		Expiration: expiration,
+
+		Initialization: initTimeslot,
+		ProtocolFee:    protocolFee,
+		Nonce:          binary.LittleEndian.Uint64(nonce[:]),
+	}, nil
+}
@@ -6,36 +6,220 @@ package main
 // signals from the OS.
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/glowlabs-org/gca-backend/glow"
 	"github.com/glowlabs-org/gca-backend/server"
+	"github.com/glowlabs-org/gca-backend/watttime/mock"
+)
+
+// The build of the binary, injected at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 // main is the entry point of the application.
 func main() {
-	// Get the user's home directory in an OS-agnostic manner.
-	homeDir, err := os.UserHomeDir()
+	server.Build = server.BuildInfo{Version: version, Commit: commit, BuildDate: buildDate}
+
+	// Every setting can also be provided as an environment variable, see
+	// server.LoadEnvConfig. The environment is loaded first and becomes
+	// the defaults of the flags, so a flag beats the environment and the
+	// environment beats the built in default.
+	env, err := server.LoadEnvConfig(os.Getenv)
 	if err != nil {
-		fmt.Println("Error obtaining user's home directory:", err)
+		fmt.Println("Invalid environment:", err)
 		os.Exit(1)
 	}
+	defaults := env.Options
 
-	// Create the server directory path within the user's home directory.
-	serverDir := filepath.Join(homeDir, "gca-server")
+	// Internal test mode enables internal APIs, and sets the logging level
+	// to Info. The dir flag overrides the location of the server data,
+	// which makes it possible to run multiple servers on one machine or to
+	// place the data on a mounted volume.
+	internalTestFlag := flag.Bool("internal-test", env.InternalTest, "enable internal APIs and verbose logging, not for production use")
+	dirFlag := flag.String("dir", env.Dir, "directory for server data, defaults to $GCA_DATA_DIR or ~/gca-server")
+	httpPortFlag := flag.Uint("http-port", uint(defaults.HttpPort), "port for the HTTP API")
+	tcpPortFlag := flag.Uint("tcp-port", uint(defaults.TcpPort), "port for the TCP sync listener")
+	udpPortFlag := flag.Uint("udp-port", uint(defaults.UdpPort), "port for the UDP report listener")
+	capacityToleranceFlag := flag.Uint64("capacity-tolerance", defaults.CapacityTolerance, "percentage that reports may exceed the equipment capacity by before being flagged for review")
+	validationModesFlag := flag.String("validation-modes", server.FormatValidationModes(defaults.ValidationModes), "comma separated rule=mode pairs that set the validation rules 'timeslot_window' and 'capacity' to 'enforce', the default, 'warn' or 'off'")
+	logFormatFlag := flag.String("log-format", defaults.LogFormat.String(), "format of the server log, either 'text' or 'json'")
+	logStdoutFlag := flag.Bool("log-stdout", defaults.LogStdout, "write the server log to stdout instead of server.log")
+	logMaxSizeFlag := flag.Int64("log-max-size", defaults.LogMaxSize, "size in bytes after which the server log gets rotated, negative to disable rotation")
+	logMaxFilesFlag := flag.Int("log-max-files", defaults.LogMaxFiles, "number of rotated server logs to keep")
+	tlsCertFlag := flag.String("tls-cert", defaults.TLSCertFile, "path of the TLS certificate for the HTTP API, defaults to cert.pem in the server directory if it exists")
+	tlsKeyFlag := flag.String("tls-key", defaults.TLSKeyFile, "path of the TLS key for the HTTP API, defaults to key.pem in the server directory if it exists")
+	localOnlyFlag := flag.Bool("local-only", env.LocalOnly, "bind every listener to 127.0.0.1 and only serve internal APIs to loopback callers")
+	httpAddrFlag := flag.String("http-addr", defaults.HttpAddr, "IP address that the HTTP API binds to")
+	tcpAddrFlag := flag.String("tcp-addr", defaults.TcpAddr, "IP address that the TCP sync listener binds to")
+	udpAddrFlag := flag.String("udp-addr", defaults.UdpAddr, "IP address that the UDP report listener binds to")
+	loopbackInternalFlag := flag.Bool("loopback-internal-apis", defaults.LoopbackInternalAPIs, "only serve the internal test mode APIs to loopback callers")
+	reportWorkersFlag := flag.Int("report-workers", defaults.ReportWorkers, "number of workers that verify the reports received over UDP")
+	defaultRegionFlag := flag.String("default-region", defaults.DefaultRegion, "WattTime region of the equipment that the GCA did not assign a region to, defaults to looking the region up from the coordinates of the equipment")
+	privateLocationsFlag := flag.Bool("private-locations", defaults.PrivateLocations, "redact the coordinates of every device whose location privacy the GCA didn't set from the public endpoints")
+	locationRedactionFlag := flag.String("location-redaction", defaults.LocationRedaction.String(), "how the coordinates of private devices get redacted, either 'truncate' to one decimal or 'omit'")
+	wattTimeURLFlag := flag.String("watttime-url", defaults.WattTimeURL, "base URL of the WattTime API, defaults to the real API")
+	reportPastWindowFlag := flag.Uint("report-past-window", uint(defaults.ReportPastWindow), "number of timeslots that a report may be behind the current timeslot")
+	reportFutureWindowFlag := flag.Uint("report-future-window", uint(defaults.ReportFutureWindow), "number of timeslots that a report may be ahead of the current timeslot")
+	finalizationDelayFlag := flag.Uint("finalization-delay", uint(defaults.FinalizationDelay), "number of timeslots after the end of a week at which the week is finalized, defaults to the report past window")
+	keyRotationOverlapFlag := flag.Uint("key-rotation-overlap", uint(defaults.KeyRotationOverlap), "number of timeslots past the activation of a device key rotation in which the old key is still accepted, defaults to 12")
+	minFreeDiskFlag := flag.Int64("min-free-disk", defaults.MinFreeDisk, "free bytes in the server directory below which reports are refused, 0 for the default of 64 MiB, negative to disable the check")
+	retainedPeriodsFlag := flag.Int("retained-periods", defaults.RetainedPeriods, "number of weeks before the current one whose signed reports stay queryable through the period parameter, 0 to keep none")
+	stateChangeBufferFlag := flag.Int("state-change-buffer", defaults.StateChangeBuffer, "number of recent state changes that the stats-delta endpoint can return, 0 for the default")
+	disableReportReceiptsFlag := flag.Bool("disable-report-receipts", defaults.DisableReportReceipts, "don't record when each report was received")
+	lateReportThresholdFlag := flag.Uint("late-report-threshold", uint(defaults.LateReportThreshold), "number of timeslots after the end of its timeslot at which a report counts as late, defaults to 12")
+	retryQueueMaxEntriesFlag := flag.Int("retry-queue-max-entries", defaults.RetryQueueMaxEntries, "number of deliveries that each webhook and alert queue holds before the oldest get dropped, 0 for the default of 1000")
+	retryQueueMaxAgeFlag := flag.Duration("retry-queue-max-age", defaults.RetryQueueMaxAge, "how long a webhook or alert delivery is retried before it gets dropped, 0 for the default of 8 days")
+	wattTimeMockFlag := flag.Bool("watttime-mock", false, "serve impact rates from a mock WattTime API, requires --internal-test")
+	storageFlag := flag.String("storage", defaults.StorageBackend.String(), "where the server keeps its persist files, either 'file' for files in the server directory or 'sqlite' for a SQLite database")
+	restoreFlag := flag.String("restore", "", "unpack the provided backup into the empty server directory and exit")
+	migrateSQLiteFlag := flag.Bool("migrate-sqlite", false, "copy the persist files of the server directory into a SQLite database, verify it, and exit")
+	tenantsFlag := flag.String("tenants", strings.Join(defaults.Tenants, ","), "comma separated ids of the other GCAs that the server hosts, each of which keeps its files in tenants/<id> in the server directory")
+	debugFlag := flag.Bool("debug", defaults.Debug, "serve pprof, expvar, and a state summary under /debug/ to loopback callers")
+	versionFlag := flag.Bool("version", false, "print the version of the server and exit")
+	restorePubkeyFlag := flag.String("restore-pubkey", "", "public key of the server that the backup passed to --restore must belong to")
+	selfTestFlag := flag.Bool("self-test", false, "check the data directory, key files, ports, WattTime credentials, peers, and clock without starting the server, and exit")
+	flag.Parse()
+	if *versionFlag {
+		fmt.Println("gca-server", server.Build)
+		return
+	}
+	internalTestMode := *internalTestFlag
 
-	// Internal test mode enables internal APIs, and sets the logging level to Info.
-	var internalTestMode bool
-	if len(os.Args) == 2 && os.Args[1] == "--internal-test" {
-		internalTestMode = true
+	// Determine the server directory. The flag and the environment take
+	// precedence over the default location within the user's home
+	// directory, which is only looked up if neither is set.
+	serverDir := *dirFlag
+	if serverDir == "" {
+		// Get the user's home directory in an OS-agnostic manner.
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Println("Error obtaining user's home directory:", err)
+			os.Exit(1)
+		}
+		serverDir = filepath.Join(homeDir, "gca-server")
+	}
+
+	// A restore unpacks a backup into the server directory before the
+	// server is started for the first time.
+	if *restoreFlag != "" {
+		restore(*restoreFlag, *restorePubkeyFlag, serverDir)
+		return
+	}
+
+	// A migration converts the files of a stopped server into the
+	// database of the SQLite storage.
+	if *migrateSQLiteFlag {
+		migrateSQLite(serverDir)
+		for _, id := range server.ParseTenantList(*tenantsFlag) {
+			migrateSQLite(filepath.Join(serverDir, server.TenantsDir, id))
+		}
+		return
+	}
+
+	// Build the server options from the flags.
+	opts := defaults
+	for _, p := range []struct {
+		name  string
+		value uint
+		dest  *uint16
+	}{
+		{"http-port", *httpPortFlag, &opts.HttpPort},
+		{"tcp-port", *tcpPortFlag, &opts.TcpPort},
+		{"udp-port", *udpPortFlag, &opts.UdpPort},
+	} {
+		if p.value > 65535 {
+			fmt.Printf("Invalid value for --%v: %v\n", p.name, p.value)
+			os.Exit(1)
+		}
+		*p.dest = uint16(p.value)
+	}
+	opts.CapacityTolerance = *capacityToleranceFlag
+	validationModes, err := server.ParseValidationModes(*validationModesFlag)
+	if err != nil {
+		fmt.Println("Invalid value for --validation-modes:", err)
+		os.Exit(1)
+	}
+	opts.ValidationModes = validationModes
+	logFormat, err := server.ParseLogFormat(*logFormatFlag)
+	if err != nil {
+		fmt.Println("Invalid value for --log-format:", err)
+		os.Exit(1)
+	}
+	opts.LogFormat = logFormat
+	opts.LogStdout = *logStdoutFlag
+	opts.LogMaxSize = *logMaxSizeFlag
+	opts.LogMaxFiles = *logMaxFilesFlag
+	opts.TLSCertFile = *tlsCertFlag
+	opts.TLSKeyFile = *tlsKeyFlag
+	opts.HttpAddr = *httpAddrFlag
+	opts.TcpAddr = *tcpAddrFlag
+	opts.UdpAddr = *udpAddrFlag
+	opts.LoopbackInternalAPIs = *loopbackInternalFlag
+	opts.ReportWorkers = *reportWorkersFlag
+	opts.DefaultRegion = *defaultRegionFlag
+	opts.PrivateLocations = *privateLocationsFlag
+	locationRedaction, err := server.ParseLocationRedaction(*locationRedactionFlag)
+	if err != nil {
+		fmt.Println("Invalid value for --location-redaction:", err)
+		os.Exit(1)
+	}
+	opts.LocationRedaction = locationRedaction
+	opts.WattTimeURL = *wattTimeURLFlag
+	opts.ReportPastWindow = uint32(*reportPastWindowFlag)
+	opts.ReportFutureWindow = uint32(*reportFutureWindowFlag)
+	opts.FinalizationDelay = uint32(*finalizationDelayFlag)
+	opts.KeyRotationOverlap = uint32(*keyRotationOverlapFlag)
+	opts.MinFreeDisk = *minFreeDiskFlag
+	opts.RetainedPeriods = *retainedPeriodsFlag
+	opts.StateChangeBuffer = *stateChangeBufferFlag
+	opts.DisableReportReceipts = *disableReportReceiptsFlag
+	opts.LateReportThreshold = uint32(*lateReportThresholdFlag)
+	opts.RetryQueueMaxEntries = *retryQueueMaxEntriesFlag
+	opts.RetryQueueMaxAge = *retryQueueMaxAgeFlag
+	opts.Debug = *debugFlag
+	opts.Tenants = server.ParseTenantList(*tenantsFlag)
+	storageBackend, err := server.ParseStorageBackend(*storageFlag)
+	if err != nil {
+		fmt.Println("Invalid value for --storage:", err)
+		os.Exit(1)
+	}
+	opts.StorageBackend = storageBackend
+	if *wattTimeMockFlag {
+		if !internalTestMode {
+			fmt.Println("--watttime-mock can only be used together with --internal-test")
+			os.Exit(1)
+		}
+		opts.WattTimeURL = mock.NewServer().URL()
+		// The mock accepts any credentials, so a fresh test server
+		// doesn't need the credential files.
+		if opts.WattTimeUsername == "" && opts.WattTimePassword == "" {
+			opts.WattTimeUsername, opts.WattTimePassword = "mock", "mock"
+		}
+		fmt.Println("Using a mock WattTime API at", opts.WattTimeURL)
+	}
+	if *localOnlyFlag {
+		opts.LocalOnly()
+	}
+	if *selfTestFlag {
+		selfTest(serverDir, opts)
+		return
 	}
 
 	// Initialize a new GCAServer instance with the server directory.
-	gcaServer, err := server.NewGCAServer(serverDir, internalTestMode)
+	gcaServer, err := server.NewGCAServerWithOptions(serverDir, internalTestMode, opts)
 	if err != nil {
 		fmt.Println("Unable to launch GCA server:", err)
 		os.Exit(1)
@@ -63,7 +247,7 @@ func main() {
 		// taking. The goroutine that counts how long shutdown is
 		// taking will automatically be killed when os.Exit is called,
 		// there's no need to clean up that loop.
-		fmt.Println("Close signal received, shutting down server. ETA 90 seconds.")
+		fmt.Println("Close signal received, shutting down server. This should take a few seconds.")
 		go func() {
 			times := 0
 			for {
@@ -77,7 +261,94 @@ func main() {
 		os.Exit(0)        // Exit the program with a successful status code.
 	}()
 
+	// Reload the runtime settings and the TLS certificate on SIGHUP, which
+	// lets config changes and certificate renewals happen without a
+	// restart.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			res, err := gcaServer.Reload()
+			if err != nil {
+				fmt.Println("Unable to reload config:", err)
+			} else {
+				fmt.Printf("Reloaded config, changed: %v, ignored: %v\n", res.Changed, res.Ignored)
+			}
+			if !gcaServer.TLSEnabled() {
+				continue
+			}
+			if err := gcaServer.ReloadTLSCertificate(); err != nil {
+				fmt.Println("Unable to reload TLS certificate:", err)
+			} else {
+				fmt.Println("Reloaded TLS certificate.")
+			}
+		}
+	}()
+
 	// An empty select block is used to keep the main function alive indefinitely.
 	// This is necessary because the main function would exit otherwise, killing any child goroutines.
 	select {} // Block forever.
 }
+
+// restore unpacks a backup into the server directory, and exits if the backup
+// can't be restored.
+func restore(backupPath, pubkeyStr, serverDir string) {
+	var expected glow.PublicKey
+	if pubkeyStr != "" {
+		var err error
+		expected, err = glow.ParsePublicKey(pubkeyStr)
+		if err != nil {
+			fmt.Println("Invalid value for --restore-pubkey:", err)
+			os.Exit(1)
+		}
+	}
+	f, err := os.Open(backupPath)
+	if err != nil {
+		fmt.Println("Unable to open backup:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	manifest, err := server.RestoreBackup(f, serverDir, expected)
+	if err != nil {
+		fmt.Println("Unable to restore backup:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restored %v files of server %v, taken at timeslot %v, into %v.\n", len(manifest.Files), manifest.ServerPublicKey, manifest.CreatedTimeslot, serverDir)
+	fmt.Println("Start the server without --restore to bring it online.")
+}
+
+// migrateSQLite copies the persist files of the server directory into a
+// SQLite database, and exits if the migration fails.
+func migrateSQLite(serverDir string) {
+	m, err := server.MigrateToSQLite(serverDir)
+	if err != nil {
+		fmt.Println("Unable to migrate to SQLite:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Migrated %v files (%v bytes) into %v.\n", m.Files, m.Bytes, filepath.Join(serverDir, server.SQLiteDatabaseFile))
+	fmt.Printf("Verified %v devices, %v reports, %v bans, and %v audit log entries.\n", m.Devices, m.Reports, m.Bans, m.AuditEntries)
+	fmt.Println("Start the server with --storage=sqlite to use the database.")
+}
+
+// selfTest runs the self test of the server, and exits if a hard check
+// failed.
+func selfTest(serverDir string, opts server.ServerOptions) {
+	checks := server.SelfTest(serverDir, opts)
+	for _, check := range checks {
+		status := "PASS"
+		if !check.Passed && check.Hard {
+			status = "FAIL"
+		} else if !check.Passed {
+			status = "WARN"
+		}
+		fmt.Printf("%v %v: %v\n", status, check.Name, check.Detail)
+		if check.Remedy != "" {
+			fmt.Printf("     %v\n", check.Remedy)
+		}
+	}
+	if !server.SelfTestPassed(checks) {
+		fmt.Println("The self test failed.")
+		os.Exit(1)
+	}
+	fmt.Println("The self test passed.")
+}
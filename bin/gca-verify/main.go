@@ -0,0 +1,364 @@
+package main
+
+// gca-verify checks data that was downloaded from a GCA server, without
+// trusting the server or whoever relayed the data. Every subcommand reads the
+// response of one endpoint from a file, or from stdin if the file is "-":
+//
+//	stats     /api/v1/all-device-stats, plain or wrapped in a signed response
+//	audit-log a page of /api/v1/audit-log
+//	proof     /api/v1/report-proof
+//	report    a report of /api/v1/historical-reports or /api/v1/report-proof
+//	response  any signed response, such as /api/v1/period-summary
+//	export    /api/v1/device-export
+//
+// The exit code is 0 if everything verified, 1 if something did not, with the
+// reason on stderr, and 2 if the tool was used wrong. The checks themselves
+// are in the glow package, see glow/verify.go.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// errUsage is returned by a subcommand that was called with bad arguments.
+var errUsage = errors.New("usage")
+
+// subcommands maps the name of every subcommand to its implementation and a
+// short description.
+var subcommands = map[string]struct {
+	run  func(args []string) error
+	help string
+}{
+	"stats":     {verifyStats, "verify the signature of the device stats of a week"},
+	"audit-log": {verifyAuditLog, "verify the hash chain and the signatures of an audit log page"},
+	"proof":     {verifyProof, "verify that a report is part of a signed report root"},
+	"report":    {verifyReport, "verify the signature of a device on a report"},
+	"response":  {verifyResponse, "verify a signed response and print its body"},
+	"export":    {verifyExport, "verify every record of a device export"},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	sc, exists := subcommands[os.Args[1]]
+	if !exists {
+		usage()
+		os.Exit(2)
+	}
+	err := sc.run(os.Args[2:])
+	if errors.Is(err, errUsage) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "FAIL:", err)
+		os.Exit(1)
+	}
+}
+
+// usage prints the list of subcommands.
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gca-verify <subcommand> [flags] <file>")
+	for _, name := range []string{"stats", "audit-log", "proof", "report", "response", "export"} {
+		fmt.Fprintf(os.Stderr, "  %-10v %v\n", name, subcommands[name].help)
+	}
+}
+
+// parseArgs parses the flags of a subcommand and reads the file that follows
+// them.
+func parseArgs(fs *flag.FlagSet, args []string) ([]byte, error) {
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gca-verify %v [flags] <file>\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return nil, errUsage
+	}
+	if fs.Arg(0) == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(fs.Arg(0))
+}
+
+// parseKey parses a required hex or base64 public key flag.
+func parseKey(name, value string) (glow.PublicKey, error) {
+	if value == "" {
+		fmt.Fprintf(os.Stderr, "--%v is required\n", name)
+		return glow.PublicKey{}, errUsage
+	}
+	pk, err := glow.ParsePublicKey(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --%v: %v\n", name, err)
+		return glow.PublicKey{}, errUsage
+	}
+	return pk, nil
+}
+
+// parseHash parses a hex encoded hash.
+func parseHash(s string) ([32]byte, error) {
+	var h [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(h) {
+		return h, fmt.Errorf("%q is not a hex encoded hash", s)
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// verifyStats checks the signature of the device stats of a week.
+func verifyStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	serverKeyFlag := fs.String("server-key", "", "hex encoded public key of the server, required")
+	data, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	serverKey, err := parseKey("server-key", *serverKeyFlag)
+	if err != nil {
+		return err
+	}
+
+	// Stats that were requested with ?signed=true are wrapped in a signed
+	// response as well.
+	var wrapper struct{ Body *string }
+	if json.Unmarshal(data, &wrapper) == nil && wrapper.Body != nil {
+		if data, err = glow.VerifySignedResponse(data, serverKey); err != nil {
+			return err
+		}
+	}
+	stats, err := glow.VerifyAllDeviceStats(data, serverKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("OK: stats of %v devices for timeslot offset %v\n", len(stats.Devices), stats.TimeslotOffset)
+	return nil
+}
+
+// verifyAuditLog checks the hash chain and the signatures of a page of the
+// audit log.
+func verifyAuditLog(args []string) error {
+	fs := flag.NewFlagSet("audit-log", flag.ContinueOnError)
+	prevFlag := fs.String("prev-hash", "", "hex encoded hash of the entry before the page, defaults to the start of the log")
+	headFlag := fs.String("head", "", "hex encoded hash that the last entry of the page must have")
+	data, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	var prev [32]byte
+	if *prevFlag != "" {
+		if prev, err = parseHash(*prevFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid --prev-hash:", err)
+			return errUsage
+		}
+	}
+	var page server.AuditLogResponse
+	if err := json.Unmarshal(data, &page); err != nil {
+		return fmt.Errorf("unable to decode audit log: %v", err)
+	}
+	if *prevFlag == "" && page.Offset != 0 {
+		return fmt.Errorf("page starts at entry %v, --prev-hash is needed", page.Offset)
+	}
+	head, err := glow.VerifyAuditLog(prev, page.Entries)
+	if err != nil {
+		return err
+	}
+	if *headFlag != "" {
+		want, err := parseHash(*headFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid --head:", err)
+			return errUsage
+		}
+		if head != want {
+			return fmt.Errorf("last entry has hash %x, expected %x", head, want)
+		}
+	}
+	fmt.Printf("OK: %v entries from entry %v, head %x\n", len(page.Entries), page.Offset, head)
+	return nil
+}
+
+// verifyProof checks that a report is part of the signed root of its week.
+func verifyProof(args []string) error {
+	fs := flag.NewFlagSet("proof", flag.ContinueOnError)
+	serverKeyFlag := fs.String("server-key", "", "hex encoded public key of the server that signed the root, required")
+	rootFlag := fs.String("root", "", "hex encoded root that was published for the week, defaults to the root in the proof")
+	data, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	serverKey, err := parseKey("server-key", *serverKeyFlag)
+	if err != nil {
+		return err
+	}
+	var resp server.ReportProofResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return fmt.Errorf("unable to decode report proof: %v", err)
+	}
+
+	// Check the root.
+	root, err := parseHash(resp.Root.Root)
+	if err != nil {
+		return fmt.Errorf("invalid root: %v", err)
+	}
+	if *rootFlag != "" {
+		want, err := parseHash(*rootFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid --root:", err)
+			return errUsage
+		}
+		if root != want {
+			return fmt.Errorf("proof is for root %x, expected %x", root, want)
+		}
+	}
+	sig, err := parseSignature(resp.Root.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid root signature: %v", err)
+	}
+	if err := glow.VerifyReportRoot(serverKey, resp.Root.PeriodStart, resp.Root.NumReports, root, sig); err != nil {
+		return err
+	}
+
+	// Check the path from the leaf to the root.
+	leaf, err := hex.DecodeString(resp.Leaf)
+	if err != nil {
+		return fmt.Errorf("invalid leaf: %v", err)
+	}
+	proof := make([][32]byte, len(resp.Proof))
+	for i, p := range resp.Proof {
+		if proof[i], err = parseHash(p); err != nil {
+			return fmt.Errorf("invalid proof hash %v: %v", i, err)
+		}
+	}
+	if err := glow.CheckReportProof(root, leaf, resp.Index, resp.Root.NumReports, proof); err != nil {
+		return err
+	}
+
+	// Check that the leaf is the report, and that the device signed it.
+	pk, er, err := glow.DecodeReportLeaf(leaf, resp.Report.ShortID)
+	if err != nil {
+		return err
+	}
+	if er.Timeslot < resp.Root.PeriodStart || er.Timeslot >= resp.Root.PeriodStart+2016 {
+		return fmt.Errorf("leaf is for timeslot %v, which is outside of the week of the root", er.Timeslot)
+	}
+	reported, err := historicalReport(resp.Report)
+	if err != nil {
+		return err
+	}
+	if reported != er {
+		return errors.New("report does not match the leaf")
+	}
+	if err := glow.VerifyEquipmentReport(pk, er); err != nil {
+		return err
+	}
+	fmt.Printf("OK: report of %x for timeslot %v is leaf %v of the %v reports of period start %v\n", pk, er.Timeslot, resp.Index, resp.Root.NumReports, resp.Root.PeriodStart)
+	return nil
+}
+
+// verifyReport checks the signature of a device on one report.
+func verifyReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	pubkeyFlag := fs.String("pubkey", "", "hex encoded public key of the device, required")
+	data, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	pk, err := parseKey("pubkey", *pubkeyFlag)
+	if err != nil {
+		return err
+	}
+	var hr server.HistoricalReport
+	if err := json.Unmarshal(data, &hr); err != nil {
+		return fmt.Errorf("unable to decode report: %v", err)
+	}
+	er, err := historicalReport(hr)
+	if err != nil {
+		return err
+	}
+	if err := glow.VerifyEquipmentReport(pk, er); err != nil {
+		return err
+	}
+	fmt.Printf("OK: report of ShortID %v for timeslot %v with power output %v\n", er.ShortID, er.Timeslot, er.PowerOutput)
+	return nil
+}
+
+// verifyResponse checks a signed response and prints its body.
+func verifyResponse(args []string) error {
+	fs := flag.NewFlagSet("response", flag.ContinueOnError)
+	serverKeyFlag := fs.String("server-key", "", "hex encoded public key of the server, required")
+	data, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	serverKey, err := parseKey("server-key", *serverKeyFlag)
+	if err != nil {
+		return err
+	}
+	body, err := glow.VerifySignedResponse(data, serverKey)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+// verifyExport checks a device export against the keys of the GCA and of the
+// server that made it.
+func verifyExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	gcaKeyFlag := fs.String("gca-key", "", "hex encoded public key of the GCA, required")
+	serverKeyFlag := fs.String("server-key", "", "hex encoded public key of the server, required")
+	data, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	gcaKey, err := parseKey("gca-key", *gcaKeyFlag)
+	if err != nil {
+		return err
+	}
+	serverKey, err := parseKey("server-key", *serverKeyFlag)
+	if err != nil {
+		return err
+	}
+	de, err := glow.VerifyDeviceExport(bytes.NewReader(data), gcaKey, serverKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("OK: %v reports, %v overrides and %v key rotations of ShortID %v, banned: %v\n", len(de.Reports), len(de.Overrides), len(de.KeyRotations), de.Authorization.ShortID, de.Manifest.Banned)
+	return nil
+}
+
+// parseSignature parses a hex encoded signature.
+func parseSignature(s string) (glow.Signature, error) {
+	var sig glow.Signature
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(sig) {
+		return sig, fmt.Errorf("%q is not a hex encoded signature", s)
+	}
+	copy(sig[:], b)
+	return sig, nil
+}
+
+// historicalReport converts the JSON form of a report back into the report.
+func historicalReport(hr server.HistoricalReport) (glow.EquipmentReport, error) {
+	er := glow.EquipmentReport{ShortID: hr.ShortID, Timeslot: hr.Timeslot, PowerOutput: hr.PowerOutput}
+	sig, err := parseSignature(hr.Signature)
+	if err != nil {
+		return er, fmt.Errorf("invalid report signature: %v", err)
+	}
+	er.Signature = sig
+	return er, nil
+}
@@ -0,0 +1,113 @@
+package client
+
+// api_binary.go fetches the high volume endpoints of a GCA server in their
+// binary encoding, which is far smaller and cheaper to decode than the JSON.
+// Binary responses aren't wrapped in a signed response, so the decoders check
+// the signatures inside of the data instead: the server signature on the
+// device stats, and the device signature on every historical report.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// DecodeAllDeviceStats decodes the binary encoding of the all-device-stats
+// endpoint, and checks that the stats were signed by the provided server
+// key.
+func DecodeAllDeviceStats(data []byte, serverKey glow.PublicKey) (server.AllDeviceStats, error) {
+	var ads server.AllDeviceStats
+	if err := ads.UnmarshalBinary(data); err != nil {
+		return server.AllDeviceStats{}, err
+	}
+	if !glow.Verify(serverKey, ads.SigningBytes(), ads.Signature) {
+		return server.AllDeviceStats{}, fmt.Errorf("device stats are not signed by the gca server")
+	}
+	return ads, nil
+}
+
+// DecodeHistoricalReports decodes the binary encoding of the
+// historical-reports endpoint, and checks that every report was signed by the
+// device that the response is for.
+func DecodeHistoricalReports(data []byte) (server.HistoricalReportsResponse, error) {
+	var hr server.HistoricalReportsResponse
+	if err := hr.UnmarshalBinary(data); err != nil {
+		return server.HistoricalReportsResponse{}, err
+	}
+	pk, err := glow.ParsePublicKey(hr.PublicKey)
+	if err != nil {
+		return server.HistoricalReportsResponse{}, err
+	}
+	for _, report := range hr.Reports {
+		er := glow.EquipmentReport{ShortID: report.ShortID, Timeslot: report.Timeslot, PowerOutput: report.PowerOutput}
+		sig, _ := hex.DecodeString(report.Signature)
+		copy(er.Signature[:], sig)
+		if !glow.Verify(pk, er.SigningBytes(), er.Signature) {
+			return server.HistoricalReportsResponse{}, fmt.Errorf("report for timeslot %v is not signed by the device", report.Timeslot)
+		}
+	}
+	return hr, nil
+}
+
+// GetBinary fetches the provided route in its binary encoding. Errors
+// returned by the server surface as an *APIError.
+func (c *APIClient) GetBinary(route string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.URL(route), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route: %w", err)
+	}
+	req.Header.Set("Accept", glow.BinaryContentType)
+	resp, err := c.staticHTTP.Do(req)
+	if err != nil {
+		return nil, unreachable(err)
+	}
+	defer resp.Body.Close()
+	if err := ReadAPIError(resp); err != nil {
+		return nil, err
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != glow.BinaryContentType {
+		return nil, fmt.Errorf("gca server responded with %q instead of the binary encoding", ct)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAPIResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response: %w", err)
+	}
+	return data, nil
+}
+
+// AllDeviceStats fetches the stats of every device for the week that starts
+// at the provided timeslot offset.
+func (c *APIClient) AllDeviceStats(timeslotOffset uint32) (server.AllDeviceStats, error) {
+	data, err := c.GetBinary("/api/v1/all-device-stats?timeslot_offset=" + strconv.FormatUint(uint64(timeslotOffset), 10))
+	if err != nil {
+		return server.AllDeviceStats{}, err
+	}
+	return DecodeAllDeviceStats(data, c.staticServerKey)
+}
+
+// HistoricalReports fetches the signed reports of a device for the unix time
+// range [start, end).
+func (c *APIClient) HistoricalReports(pk glow.PublicKey, start, end int64) (server.HistoricalReportsResponse, error) {
+	q := url.Values{}
+	q.Set("pubkey", hex.EncodeToString(pk[:]))
+	q.Set("start", strconv.FormatInt(start, 10))
+	q.Set("end", strconv.FormatInt(end, 10))
+	data, err := c.GetBinary("/api/v1/historical-reports?" + q.Encode())
+	if err != nil {
+		return server.HistoricalReportsResponse{}, err
+	}
+	hr, err := DecodeHistoricalReports(data)
+	if err != nil {
+		return server.HistoricalReportsResponse{}, err
+	}
+	if hr.PublicKey != hex.EncodeToString(pk[:]) {
+		return server.HistoricalReportsResponse{}, fmt.Errorf("gca server returned the reports of a different device")
+	}
+	return hr, nil
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestAPIClientBinary checks that the client fetches and verifies the binary
+// encodings of the stats and the historical reports.
+func TestAPIClientBinary(t *testing.T) {
+	gcas, _, _, gcaPrivKey, err := server.SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	ea, _, err := gcas.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpPort, _, _ := gcas.Ports()
+	location := GCAServer{Location: "127.0.0.1", HttpPort: httpPort}
+
+	c := NewAPIClient(gcas.PublicKey(), location, APIClientOptions{})
+	stats, err := c.AllDeviceStats(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Devices) != 1 || stats.Devices[0].PublicKey != ea.PublicKey {
+		t.Fatalf("unexpected stats: %+v", stats.Devices)
+	}
+	hr, err := c.HistoricalReports(ea.PublicKey, 0, glow.TimeslotToUnix(4032))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hr.Reports) != 0 || len(hr.Gaps) != 0 {
+		t.Fatalf("unexpected reports: %+v", hr)
+	}
+
+	// Stats from a different server key are refused.
+	otherKey, _ := glow.GenerateKeyPair()
+	c = NewAPIClient(otherKey, location, APIClientOptions{})
+	if _, err := c.AllDeviceStats(0); err == nil {
+		t.Error("stats from an unpinned key were accepted")
+	}
+
+	// Reports that weren't signed by the device are refused.
+	pk, priv := glow.GenerateKeyPair()
+	er := glow.EquipmentReport{ShortID: 1, Timeslot: 5, PowerOutput: 9}
+	er.Signature = glow.Sign(er.SigningBytes(), priv)
+	response := server.HistoricalReportsResponse{
+		PublicKey: hex.EncodeToString(ea.PublicKey[:]),
+		Reports:   []server.HistoricalReport{{ShortID: 1, Timeslot: 5, PowerOutput: 9, Signature: hex.EncodeToString(er.Signature[:])}},
+	}
+	data, err := response.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeHistoricalReports(data); err == nil {
+		t.Error("report with the wrong signer was accepted")
+	}
+	response.PublicKey = hex.EncodeToString(pk[:])
+	data, _ = response.MarshalBinary()
+	if _, err := DecodeHistoricalReports(data); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,183 @@
+package client
+
+// api_errors.go turns the error responses of the GCA server HTTP API into Go
+// errors. The server returns errors as {"code": ..., "message": ...}, and the
+// code is surfaced as an *APIError so that callers can check what went wrong
+// with errors.Is against the sentinels below, or with errors.As to get at the
+// message and the HTTP status.
+//
+// Servers that were launched with legacy errors return the message as plain
+// text. Those errors are still surfaced as an *APIError, but without a code.
+//
+// A report that the server authenticated but did not accept gets a signed ack
+// with a status instead of an error, over UDP and over HTTP alike. AckError
+// turns such an ack into a *ReportAckError, which matches the same sentinels
+// as the *APIError for the same problem, so that callers don't need to care
+// which transport a report took. Failures to talk to the server at all wrap
+// ErrServerUnreachable.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// maxAPIErrorSize is the largest error body that gets read from a server.
+const maxAPIErrorSize = 64e3
+
+// APIError is an error that was returned by the HTTP API of a GCA server.
+type APIError struct {
+	StatusCode int    // The HTTP status of the response
+	Code       string // One of the server.ErrCode constants, empty for legacy errors
+	Message    string // The human readable message
+
+	// RetryAfter is how long the server asked the caller to wait before
+	// trying again, zero if the response had no Retry-After header.
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("gca server returned status %v: %v", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("gca server returned %v (status %v): %v", e.Code, e.StatusCode, e.Message)
+}
+
+// Is reports whether the target is an APIError with the same code, which
+// allows errors.Is to be used with the sentinels.
+func (e *APIError) Is(target error) bool {
+	if target == ErrUnauthorizedDevice {
+		switch e.Code {
+		case server.ErrCodeUnknownDevice, server.ErrCodeDeviceDeauthorized, server.ErrCodeDeviceExpired:
+			return true
+		}
+		return false
+	}
+	t, ok := target.(*APIError)
+	return ok && t.Code != "" && t.Code == e.Code
+}
+
+// The sentinels for each of the error codes that the server can return.
+var (
+	ErrInvalidSignature     = &APIError{Code: server.ErrCodeInvalidSignature}
+	ErrUnknownDevice        = &APIError{Code: server.ErrCodeUnknownDevice}
+	ErrDeviceBanned         = &APIError{Code: server.ErrCodeDeviceBanned}
+	ErrDeviceDeauthorized   = &APIError{Code: server.ErrCodeDeviceDeauthorized}
+	ErrDeviceExpired        = &APIError{Code: server.ErrCodeDeviceExpired}
+	ErrOutsideAuthorization = &APIError{Code: server.ErrCodeOutsideAuthorization}
+	ErrStaleTimeslot        = &APIError{Code: server.ErrCodeStaleTimeslot}
+	ErrReportFlagged        = &APIError{Code: server.ErrCodeReportFlagged}
+	ErrPeriodFinalized      = &APIError{Code: server.ErrCodePeriodFinalized}
+	ErrMalformedRequest     = &APIError{Code: server.ErrCodeMalformedRequest}
+	ErrRequestTooLarge      = &APIError{Code: server.ErrCodeRequestTooLarge}
+	ErrMethodNotAllowed     = &APIError{Code: server.ErrCodeMethodNotAllowed}
+	ErrNotFound             = &APIError{Code: server.ErrCodeNotFound}
+	ErrConflict             = &APIError{Code: server.ErrCodeConflict}
+	ErrNotInitialized       = &APIError{Code: server.ErrCodeNotInitialized}
+	ErrGCAKeyMismatch       = &APIError{Code: server.ErrCodeGCAKeyMismatch}
+	ErrRateLimited          = &APIError{Code: server.ErrCodeRateLimited}
+	ErrServerBusy           = &APIError{Code: server.ErrCodeServerBusy}
+	ErrServerShuttingDown   = &APIError{Code: server.ErrCodeServerShuttingDown}
+	ErrLoading              = &APIError{Code: server.ErrCodeLoading}
+	ErrCursorExpired        = &APIError{Code: server.ErrCodeCursorExpired}
+	ErrStorageUnavailable   = &APIError{Code: server.ErrCodeStorageUnavailable}
+	ErrUpstreamError        = &APIError{Code: server.ErrCodeUpstreamError}
+	ErrInternalError        = &APIError{Code: server.ErrCodeInternalError}
+)
+
+var (
+	// ErrUnauthorizedDevice matches every error that means the server
+	// doesn't take reports from the device at all: the device is unknown,
+	// deauthorized, or its authorization expired.
+	ErrUnauthorizedDevice = errors.New("device is not authorized by the gca server")
+
+	// ErrServerUnreachable is wrapped by every error that comes from not
+	// being able to talk to the server, as opposed to the server refusing
+	// a request.
+	ErrServerUnreachable = errors.New("unable to reach gca server")
+)
+
+// ackStatusCodes maps the statuses of acks for reports that were not
+// accepted to the error code that the server uses for the same outcome.
+var ackStatusCodes = map[byte]string{
+	glow.ReportAckBanned:               server.ErrCodeDeviceBanned,
+	glow.ReportAckStale:                server.ErrCodeStaleTimeslot,
+	glow.ReportAckInvalidPower:         server.ErrCodeMalformedRequest,
+	glow.ReportAckDeauthorized:         server.ErrCodeDeviceDeauthorized,
+	glow.ReportAckFlagged:              server.ErrCodeReportFlagged,
+	glow.ReportAckExpired:              server.ErrCodeDeviceExpired,
+	glow.ReportAckFinalized:            server.ErrCodePeriodFinalized,
+	glow.ReportAckRetryLater:           server.ErrCodeStorageUnavailable,
+	glow.ReportAckOutsideAuthorization: server.ErrCodeOutsideAuthorization,
+}
+
+// ReportAckError is the error for a report that the server acked without
+// accepting it.
+type ReportAckError struct {
+	Ack  glow.ReportAck
+	Code string // One of the server.ErrCode constants
+}
+
+// Error implements the error interface.
+func (e *ReportAckError) Error() string {
+	return fmt.Sprintf("gca server acked the report for timeslot %v with %v", e.Ack.Timeslot, e.Code)
+}
+
+// Is reports whether the target is a sentinel that matches the code of the
+// ack.
+func (e *ReportAckError) Is(target error) bool {
+	return (&APIError{Code: e.Code}).Is(target)
+}
+
+// AckError returns nil if the ack says that the report was accepted, or that
+// the server already had it, and a *ReportAckError otherwise.
+func AckError(ack glow.ReportAck) error {
+	if ack.Status == glow.ReportAckAccepted || ack.Status == glow.ReportAckDuplicate {
+		return nil
+	}
+	code, exists := ackStatusCodes[ack.Status]
+	if !exists {
+		code = server.ErrCodeInternalError
+	}
+	return &ReportAckError{Ack: ack, Code: code}
+}
+
+// unreachable wraps an error that came from not being able to talk to the
+// server.
+func unreachable(err error) error {
+	return fmt.Errorf("%w: %w", ErrServerUnreachable, err)
+}
+
+// ReadAPIError returns nil if the response has a 2xx status, and otherwise
+// reads the body of the response and returns it as an *APIError. The caller
+// is still responsible for closing the body.
+func ReadAPIError(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAPIErrorSize))
+	if err != nil {
+		return fmt.Errorf("unable to read error response with status %v: %v", resp.StatusCode, err)
+	}
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		apiErr.RetryAfter = time.Duration(secs) * time.Second
+	}
+	var structured server.APIError
+	if err := json.Unmarshal(body, &structured); err == nil && structured.Code != "" {
+		apiErr.Code = structured.Code
+		apiErr.Message = structured.Message
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
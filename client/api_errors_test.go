@@ -0,0 +1,132 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestReadAPIError checks that the structured errors of the server surface as
+// typed errors, and that legacy plain text errors are still readable.
+func TestReadAPIError(t *testing.T) {
+	gcas, _, _, _, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	legacy, _, _, _, err := server.SetupTestEnvironmentWithOptions(t.Name()+"_server2", server.ServerOptions{LegacyErrors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+
+	post := func(gcas *server.GCAServer) error {
+		t.Helper()
+		httpPort, _, _ := gcas.Ports()
+		resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/authorize-equipment", httpPort), "application/json", strings.NewReader("{"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return ReadAPIError(resp)
+	}
+
+	err = post(gcas)
+	if !errors.Is(err, ErrMalformedRequest) || errors.Is(err, ErrInvalidSignature) {
+		t.Fatal("unexpected error:", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Message != "Invalid request body" {
+		t.Fatalf("unexpected api error: %+v", apiErr)
+	}
+	wrapped := fmt.Errorf("unable to authorize: %w", err)
+	if !errors.Is(wrapped, ErrMalformedRequest) {
+		t.Error("wrapped error lost its code")
+	}
+
+	// Legacy errors have no code and match none of the sentinels.
+	err = post(legacy)
+	if !errors.As(err, &apiErr) || apiErr.Code != "" || apiErr.Message != "Invalid request body" || errors.Is(err, ErrMalformedRequest) {
+		t.Fatalf("unexpected legacy error: %+v", err)
+	}
+}
+
+// TestReportErrors checks that the same problem with a report matches the
+// same sentinel whether it arrived as an ack over UDP, as an ack over HTTP, or
+// as an error response, and that a server that can't be reached matches
+// ErrServerUnreachable.
+func TestReportErrors(t *testing.T) {
+	glow.SetCurrentTimeslot(5000)
+	defer glow.SetCurrentTimeslot(0)
+	gcas, _, _, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	_, priv, err := gcas.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpPort, _, udpPort := gcas.Ports()
+	api := NewAPIClient(gcas.PublicKey(), GCAServer{Location: "127.0.0.1", HttpPort: httpPort}, APIClientOptions{})
+	location := glow.HostPort("127.0.0.1", udpPort)
+
+	// A stale report gets an ack over both transports.
+	stale := glow.EquipmentReport{ShortID: 1, Timeslot: 10, PowerOutput: 50}
+	stale.Signature = glow.Sign(stale.SigningBytes(), priv)
+	ack, acked, err := SendReportPacketWithAck(stale, glow.ReportPacketLegacy, location, gcas.PublicKey(), time.Second)
+	if err != nil || !acked {
+		t.Fatal("no ack over udp:", err)
+	}
+	udpErr := AckError(ack)
+	ack, err = api.SubmitReport(stale, glow.ReportPacketLegacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpErr := AckError(ack)
+	for _, err := range []error{udpErr, httpErr, fmt.Errorf("report failed: %w", udpErr)} {
+		var ackErr *ReportAckError
+		if !errors.Is(err, ErrStaleTimeslot) || errors.Is(err, ErrDeviceBanned) || errors.Is(err, ErrUnauthorizedDevice) || !errors.As(err, &ackErr) || ackErr.Ack.Timeslot != 10 {
+			t.Fatal("unexpected ack error:", err)
+		}
+	}
+
+	// An accepted report has no error.
+	fresh := glow.EquipmentReport{ShortID: 1, Timeslot: 4999, PowerOutput: 50}
+	fresh.Signature = glow.Sign(fresh.SigningBytes(), priv)
+	if ack, err = api.SubmitReport(fresh, glow.ReportPacketLegacy); err != nil || AckError(ack) != nil {
+		t.Fatal("unexpected error for an accepted report:", err, AckError(ack))
+	}
+
+	// Reports that the server can't authenticate get an error response.
+	_, wrongKey := glow.GenerateKeyPair()
+	forged := fresh
+	forged.Timeslot--
+	forged.Signature = glow.Sign(forged.SigningBytes(), wrongKey)
+	if _, err := api.SubmitReport(forged, glow.ReportPacketLegacy); !errors.Is(err, ErrInvalidSignature) || errors.Is(err, ErrServerUnreachable) {
+		t.Fatal("unexpected error for a forged report:", err)
+	}
+	unknown := forged
+	unknown.ShortID = 2
+	if _, err := api.SubmitReport(unknown, glow.ReportPacketLegacy); !errors.Is(err, ErrUnknownDevice) || !errors.Is(err, ErrUnauthorizedDevice) {
+		t.Fatal("unexpected error for an unknown device:", err)
+	}
+	if !errors.Is(&ReportAckError{Code: server.ErrCodeDeviceExpired}, ErrUnauthorizedDevice) || !errors.Is(AckError(glow.ReportAck{Status: glow.ReportAckDeauthorized}), ErrUnauthorizedDevice) {
+		t.Fatal("expired and deauthorized devices are not unauthorized")
+	}
+
+	// A server that is gone is unreachable over every transport.
+	gcas.Close()
+	if _, err := api.SubmitReport(fresh, glow.ReportPacketLegacy); !errors.Is(err, ErrServerUnreachable) || errors.Is(err, ErrInternalError) {
+		t.Fatal("unexpected error for a closed server:", err)
+	}
+	if _, err := CheckClockDrift(location, gcas.PublicKey(), 100*time.Millisecond); !errors.Is(err, ErrServerUnreachable) {
+		t.Fatal("unexpected error for a closed server:", err)
+	}
+}
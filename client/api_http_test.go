@@ -0,0 +1,72 @@
+package client
+
+import (
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestAPIClient checks that the API client can talk https to a server, and
+// that it only accepts responses signed by the pinned key.
+func TestAPIClient(t *testing.T) {
+	gcas, dir, _, _, err := server.SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gcas.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := server.GenerateTestCertificate(filepath.Join(dir, server.TLSCertFile), filepath.Join(dir, server.TLSKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcas, err = server.NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	httpPort, _, _ := gcas.Ports()
+	location := GCAServer{Location: "127.0.0.1", HttpPort: httpPort}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	var stats server.AllDeviceStats
+	c := NewAPIClient(gcas.PublicKey(), location, APIClientOptions{UseTLS: true, RootCAs: roots})
+	if err := c.GetSigned("/api/v1/all-device-stats?timeslot_offset=0", &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Signature == (glow.Signature{}) {
+		t.Error("stats were not decoded")
+	}
+
+	// Errors from the server are still typed.
+	if err := c.GetSigned("/api/v1/device-summary?short_id=9", &stats); !errors.Is(err, ErrUnknownDevice) {
+		t.Error("unexpected error:", err)
+	}
+
+	// A valid certificate doesn't help a server with the wrong key.
+	otherKey, _ := glow.GenerateKeyPair()
+	c = NewAPIClient(otherKey, location, APIClientOptions{UseTLS: true, RootCAs: roots})
+	if err := c.GetSigned("/api/v1/all-device-stats?timeslot_offset=0", &stats); err == nil {
+		t.Error("response from an unpinned key was accepted")
+	}
+
+	// The self-signed certificate is rejected unless verification is
+	// skipped, in which case the pinned key still protects the data.
+	c = NewAPIClient(gcas.PublicKey(), location, APIClientOptions{UseTLS: true})
+	if err := c.GetSigned("/api/v1/all-device-stats?timeslot_offset=0", &stats); err == nil {
+		t.Error("untrusted certificate was accepted")
+	}
+	c = NewAPIClient(gcas.PublicKey(), location, APIClientOptions{UseTLS: true, SkipCertVerify: true})
+	if err := c.GetSigned("/api/v1/all-device-stats?timeslot_offset=0", &stats); err != nil {
+		t.Error(err)
+	}
+	c = NewAPIClient(gcas.PublicKey(), location, APIClientOptions{})
+	if err := c.GetSigned("/api/v1/all-device-stats?timeslot_offset=0", &stats); err == nil {
+		t.Error("plain http request to a tls server succeeded")
+	}
+}
@@ -0,0 +1,133 @@
+package client
+
+// authorized_servers.go fetches the list of servers that the GCA has
+// authorized. Every entry of the list carries its own signature from the GCA,
+// so the list can be fetched from any server, and doesn't need to be signed by
+// the server it came from.
+//
+// The client refreshes its list of servers from the primary server in the
+// background, so that the failover servers are known even if a sync hasn't
+// succeeded in a while.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// VerifyAuthorizedServers checks that every server in the list was signed by
+// the provided GCA key, and that no server appears twice.
+func VerifyAuthorizedServers(servers []server.AuthorizedServer, gcaKey glow.PublicKey) error {
+	seen := make(map[glow.PublicKey]struct{}, len(servers))
+	for i, as := range servers {
+		if !glow.Verify(gcaKey, as.SigningBytes(), as.GCAAuthorization) {
+			return fmt.Errorf("server %v (%x) is not signed by the gca", i, as.PublicKey)
+		}
+		if _, exists := seen[as.PublicKey]; exists {
+			return fmt.Errorf("server %x appears more than once", as.PublicKey)
+		}
+		seen[as.PublicKey] = struct{}{}
+	}
+	return nil
+}
+
+// AuthorizedServers fetches the list of authorized servers, including the
+// ones that were removed, and verifies every entry against the provided GCA
+// key. The whole list is refused if any entry can't be verified.
+func (c *APIClient) AuthorizedServers(gcaKey glow.PublicKey) ([]server.AuthorizedServer, error) {
+	resp, err := c.staticHTTP.Get(c.URL("/api/v1/authorized-servers"))
+	if err != nil {
+		return nil, unreachable(err)
+	}
+	defer resp.Body.Close()
+	if err := ReadAPIError(resp); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAPIResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response: %w", err)
+	}
+	var asr server.AuthorizedServersResponse
+	if err := json.Unmarshal(data, &asr); err != nil {
+		return nil, fmt.Errorf("unable to decode response: %w", err)
+	}
+	if err := VerifyAuthorizedServers(asr.AuthorizedServers, gcaKey); err != nil {
+		return nil, fmt.Errorf("refusing the list of authorized servers: %w", err)
+	}
+	return asr.AuthorizedServers, nil
+}
+
+// mergeAuthorizedServers will update the server map of the client based on a
+// verified list of authorized servers. Specifically we want to look for new
+// servers, as well as servers that are now banned. It returns whether the
+// server map changed. The mutex must be held.
+func (c *Client) mergeAuthorizedServers(servers []server.AuthorizedServer) bool {
+	changed := false
+	for _, s := range servers {
+		current, exists := c.gcaServers[s.PublicKey]
+		if !exists || (s.Banned && !current.Banned) {
+			c.gcaServers[s.PublicKey] = GCAServer{
+				Banned:   s.Banned,
+				Location: s.Location,
+				HttpPort: s.HttpPort,
+				TcpPort:  s.TcpPort,
+				UdpPort:  s.UdpPort,
+			}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// managedRefreshServers will fetch the list of authorized servers from the
+// primary server, and merge it into the server map of the client.
+func (c *Client) managedRefreshServers() error {
+	c.mu.Lock()
+	gcasKey := c.primaryServer
+	gcas := c.gcaServers[gcasKey]
+	gcaKey := c.gcaPubKey
+	c.mu.Unlock()
+
+	servers, err := NewAPIClient(gcasKey, gcas, c.managedAPIClientOptions(gcasKey)).AuthorizedServers(gcaKey)
+	if err != nil {
+		return fmt.Errorf("unable to fetch the authorized servers from %v: %v", gcas.Location, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The GCA may have changed while the list was being fetched, in
+	// which case the list is no longer verified.
+	if c.gcaPubKey != gcaKey || !c.mergeAuthorizedServers(servers) {
+		return nil
+	}
+	raw, err := SerializeGCAServerMap(c.gcaServers)
+	if err != nil {
+		return fmt.Errorf("unable to serialize the server map: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(c.staticBaseDir, GCAServerMapFile), raw, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to save the server map: %w", err)
+	}
+	return nil
+}
+
+// threadedRefreshServers will fetch the server info of the authorized servers
+// at startup, and then periodically refresh the list of authorized servers
+// along with their server info.
+func (c *Client) threadedRefreshServers() {
+	c.managedRefreshServerInfo()
+	for {
+		if !c.tg.Sleep(serverRefreshInterval) {
+			return
+		}
+		if err := c.managedRefreshServers(); err != nil {
+			c.EventLog.Printf("server refresh failed: %v", err)
+		}
+		c.managedRefreshServerInfo()
+	}
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestAuthorizedServers registers a server, and checks that the list of
+// authorized servers only gets accepted with the right GCA key.
+func TestAuthorizedServers(t *testing.T) {
+	gcas, _, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	httpPort, _, _ := gcas.Ports()
+
+	pubkey, _ := glow.GenerateKeyPair()
+	as := server.AuthorizedServer{PublicKey: pubkey, Location: "127.0.0.1", HttpPort: 1, TcpPort: 2, UdpPort: 3}
+	as.GCAAuthorization = glow.Sign(as.SigningBytes(), gcaPrivKey)
+	j, _ := json.Marshal(as)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/register-server", httpPort), "application/json", bytes.NewBuffer(j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("registration failed:", resp.StatusCode)
+	}
+
+	c := NewAPIClient(gcas.PublicKey(), GCAServer{Location: "127.0.0.1", HttpPort: httpPort}, APIClientOptions{})
+	servers, err := c.AuthorizedServers(gcaPubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0] != as {
+		t.Fatalf("unexpected servers: %+v", servers)
+	}
+	otherKey, _ := glow.GenerateKeyPair()
+	if _, err := c.AuthorizedServers(otherKey); err == nil {
+		t.Fatal("servers signed by a different gca were accepted")
+	}
+
+	// A modified entry or a duplicate entry taints the whole list.
+	tampered := as
+	tampered.Location = "10.0.0.1"
+	if err := VerifyAuthorizedServers([]server.AuthorizedServer{tampered}, gcaPubKey); err == nil {
+		t.Fatal("tampered server was accepted")
+	}
+	if err := VerifyAuthorizedServers([]server.AuthorizedServer{as, as}, gcaPubKey); err == nil {
+		t.Fatal("duplicate server was accepted")
+	}
+}
+
+// TestAuthorizedServersHotReload adds a server to the authorized servers file
+// of a running server, and checks that both the server and a client pick it
+// up without a restart.
+func TestAuthorizedServersHotReload(t *testing.T) {
+	gcas, dir, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	httpPort, _, _ := gcas.Ports()
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	err = SetupTestEnvironment(clientDir, gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(clientDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	pubkey, _ := glow.GenerateKeyPair()
+	as := server.AuthorizedServer{PublicKey: pubkey, Location: "127.0.0.1", HttpPort: 1, TcpPort: 2, UdpPort: 3}
+	as.GCAAuthorization = glow.Sign(as.SigningBytes(), gcaPrivKey)
+	f, err := os.OpenFile(filepath.Join(dir, server.AuthorizedServersFile), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(as.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewAPIClient(gcas.PublicKey(), GCAServer{Location: "127.0.0.1", HttpPort: httpPort}, APIClientOptions{})
+	served := func() bool {
+		servers, err := api.AuthorizedServers(gcaPubKey)
+		return err == nil && len(servers) == 1 && servers[0] == as
+	}
+	known := func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		_, exists := c.gcaServers[pubkey]
+		return exists
+	}
+	for start := time.Now(); !served() || !known(); time.Sleep(20 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the new server was not picked up:", served(), known())
+		}
+	}
+}
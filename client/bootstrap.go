@@ -0,0 +1,139 @@
+package client
+
+// bootstrap.go provisions a device without touching it, see
+// server/api_device_bootstrap.go. The device is shipped with nothing but its
+// keypair and the address of one GCA server. Once the GCA has authorized the
+// public key of the device, Bootstrap fetches the bootstrap document from the
+// server, checks every signature in it, and writes the same files that
+// gca-provision would have written, after which the client starts as usual.
+//
+// The device doesn't know the key of the server it asks, so the signature on
+// the response is checked against the key that the response claims, and that
+// key has to belong to one of the servers that the GCA authorized. The key of
+// the GCA is the root of all of that. A device that was shipped with the key
+// of the GCA only accepts documents that chain to it, a device that wasn't
+// trusts the key in the first document that it gets.
+//
+// The server redacts the coordinates of private devices from the public API,
+// and a redacted authorization no longer verifies against the GCA key. Private
+// devices can't be bootstrapped for that reason, and need to be provisioned
+// with gca-provision.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// BootstrapOptions configures how a device bootstraps itself.
+type BootstrapOptions struct {
+	// GCAPublicKey is the key of the GCA that the device was shipped
+	// with. The zero key trusts the key in the bootstrap document.
+	GCAPublicKey glow.PublicKey
+
+	// Passphrase encrypts the keys of the device if Bootstrap has to
+	// generate them, and decrypts them otherwise, see key_encryption.go.
+	Passphrase []byte
+
+	// API configures how the server is reached.
+	API APIClientOptions
+}
+
+// DeviceBootstrap fetches the bootstrap document of the device with the
+// provided public key. The server that signed the response is returned along
+// with the document, neither is checked against the GCA.
+func (c *APIClient) DeviceBootstrap(pk glow.PublicKey) (server.DeviceBootstrapResponse, glow.PublicKey, error) {
+	var dbr server.DeviceBootstrapResponse
+	data, err := c.getSignedResponse("/api/v1/device-bootstrap?pubkey=" + hex.EncodeToString(pk[:]))
+	if err != nil {
+		return dbr, glow.PublicKey{}, err
+	}
+	var sr glow.SignedResponse
+	if err := json.Unmarshal(data, &sr); err != nil {
+		return dbr, glow.PublicKey{}, fmt.Errorf("unable to decode signed response: %w", err)
+	}
+	body, err := glow.VerifySignedResponse(data, sr.PublicKey)
+	if err != nil {
+		return dbr, glow.PublicKey{}, fmt.Errorf("unable to verify response of gca server: %w", err)
+	}
+	if err := json.Unmarshal(body, &dbr); err != nil {
+		return dbr, glow.PublicKey{}, fmt.Errorf("unable to decode response: %w", err)
+	}
+	return dbr, sr.PublicKey, nil
+}
+
+// VerifyDeviceBootstrap checks that the bootstrap document belongs to the
+// device with the provided public key, and that everything in it chains back
+// to the provided GCA key: the authorization of the device, every authorized
+// server, and the server that signed the document.
+func VerifyDeviceBootstrap(dbr server.DeviceBootstrapResponse, signer glow.PublicKey, devicePubKey glow.PublicKey, gcaKey glow.PublicKey) error {
+	if dbr.GCAPublicKey != gcaKey {
+		return fmt.Errorf("the document is for a different gca")
+	}
+	ea := dbr.Authorization
+	if ea.PublicKey != devicePubKey || ea.ShortID != dbr.ShortID {
+		return fmt.Errorf("the document is for a different device")
+	}
+	if !glow.Verify(gcaKey, ea.SigningBytes(), ea.Signature) {
+		return fmt.Errorf("the authorization was not signed by the gca, the location of a private device may have been redacted")
+	}
+	if err := VerifyAuthorizedServers(dbr.AuthorizedServers, gcaKey); err != nil {
+		return fmt.Errorf("refusing the list of authorized servers: %w", err)
+	}
+	for _, as := range dbr.AuthorizedServers {
+		if as.PublicKey == signer && !as.Banned {
+			return nil
+		}
+	}
+	return fmt.Errorf("the document was signed by %x, which is not an authorized server", signer)
+}
+
+// Bootstrap provisions the device in the provided directory from the
+// bootstrap document of the provided server, generating the keys of the
+// device first if the directory doesn't have them yet. A device that the GCA
+// hasn't authorized yet gets an error that matches ErrUnknownDevice, and its
+// *APIError has the RetryAfter that the server asked for, so callers can
+// poll until the device is authorized.
+func Bootstrap(dir string, gcas GCAServer, opts BootstrapOptions) (glow.EquipmentAuthorization, error) {
+	pub, _, err := LoadOrCreateClientKeys(dir, opts.Passphrase)
+	if err != nil {
+		return glow.EquipmentAuthorization{}, fmt.Errorf("unable to load the device keys: %w", err)
+	}
+	dbr, signer, err := NewAPIClient(glow.PublicKey{}, gcas, opts.API).DeviceBootstrap(pub)
+	if err != nil {
+		return glow.EquipmentAuthorization{}, err
+	}
+	gcaKey := opts.GCAPublicKey
+	if gcaKey == (glow.PublicKey{}) {
+		gcaKey = dbr.GCAPublicKey
+	}
+	if err := VerifyDeviceBootstrap(dbr, signer, pub, gcaKey); err != nil {
+		return glow.EquipmentAuthorization{}, fmt.Errorf("refusing the bootstrap document: %w", err)
+	}
+
+	servers := make(map[glow.PublicKey]GCAServer, len(dbr.AuthorizedServers))
+	for _, as := range dbr.AuthorizedServers {
+		servers[as.PublicKey] = GCAServer{
+			Banned:   as.Banned,
+			Location: as.Location,
+			HttpPort: as.HttpPort,
+			TcpPort:  as.TcpPort,
+			UdpPort:  as.UdpPort,
+		}
+	}
+	if err := WriteDeviceBundle(dir, dbr.Authorization, gcaKey, servers, dbr.CurrentTimeslot); err != nil {
+		return glow.EquipmentAuthorization{}, fmt.Errorf("unable to write the device files: %w", err)
+	}
+	return dbr.Authorization, nil
+}
+
+// IsBootstrapPending returns whether the error from Bootstrap means that the
+// GCA hasn't authorized the device yet, as opposed to the bootstrap having
+// failed for good.
+func IsBootstrapPending(err error) bool {
+	return errors.Is(err, ErrUnknownDevice) || errors.Is(err, ErrServerUnreachable)
+}
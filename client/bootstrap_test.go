@@ -0,0 +1,109 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestBootstrap starts a device with nothing but its keypair and the address
+// of a server, pre-authorizes it, and checks that the device bootstraps
+// itself, refuses documents that don't chain to its GCA, and then reports.
+func TestBootstrap(t *testing.T) {
+	gcas, _, gcaPub, gcaPriv, err := server.SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	httpPort, tcpPort, udpPort := gcas.Ports()
+	location := GCAServer{Location: "127.0.0.1", HttpPort: httpPort}
+
+	// The device polls until the GCA authorizes it.
+	deviceDir := glow.GenerateTestDir(t.Name() + "_device")
+	_, err = Bootstrap(deviceDir, location, BootstrapOptions{GCAPublicKey: gcaPub})
+	var apiErr *APIError
+	if !IsBootstrapPending(err) || !errors.As(err, &apiErr) || apiErr.RetryAfter != time.Minute {
+		t.Fatal("expected the bootstrap to be pending:", err)
+	}
+
+	// The GCA authorizes the server and the device.
+	as := server.AuthorizedServer{PublicKey: gcas.PublicKey(), Location: "127.0.0.1", HttpPort: httpPort, TcpPort: tcpPort, UdpPort: udpPort}
+	as.GCAAuthorization = glow.Sign(as.SigningBytes(), gcaPriv)
+	j, _ := json.Marshal(as)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/register-server", httpPort), "application/json", bytes.NewBuffer(j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("registration failed:", resp.StatusCode)
+	}
+	pub, _, err := LoadOrCreateClientKeys(deviceDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea := server.SignEquipmentAuthorization(glow.EquipmentAuthorization{
+		ShortID:    7,
+		PublicKey:  pub,
+		Capacity:   1000,
+		Debt:       500,
+		Expiration: 100e6 + glow.CurrentTimeslot(),
+	}, gcaPriv)
+	if err := NewAPIClient(gcas.PublicKey(), location, APIClientOptions{}).SubmitAuthorization(ea); err != nil {
+		t.Fatal(err)
+	}
+
+	// A device that was shipped with a different GCA key refuses the
+	// document, and so does a device that gets a document which was
+	// tampered with.
+	otherKey, _ := glow.GenerateKeyPair()
+	if _, err := Bootstrap(deviceDir, location, BootstrapOptions{GCAPublicKey: otherKey}); err == nil || IsBootstrapPending(err) {
+		t.Fatal("a document for a different gca was accepted:", err)
+	}
+	dbr, signer, err := NewAPIClient(glow.PublicKey{}, location, APIClientOptions{}).DeviceBootstrap(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDeviceBootstrap(dbr, signer, pub, gcaPub); err != nil {
+		t.Fatal(err)
+	}
+	if dbr.ShortID != 7 || dbr.TimeslotSeconds != 300 || len(dbr.ReportPacketVersions) == 0 || dbr.ReportWindow.PastTimeslots == 0 {
+		t.Fatalf("unexpected document: %+v", dbr)
+	}
+	if err := VerifyDeviceBootstrap(dbr, otherKey, pub, gcaPub); err == nil {
+		t.Fatal("a document signed by an unknown server was accepted")
+	}
+	tampered := dbr
+	tampered.Authorization.Capacity++
+	if err := VerifyDeviceBootstrap(tampered, signer, pub, gcaPub); err == nil {
+		t.Fatal("a tampered authorization was accepted")
+	}
+	if err := VerifyDeviceBootstrap(dbr, signer, otherKey, gcaPub); err == nil {
+		t.Fatal("a document for a different device was accepted")
+	}
+
+	// The device bootstraps and reports without any other setup.
+	if got, err := Bootstrap(deviceDir, location, BootstrapOptions{}); err != nil || got != ea {
+		t.Fatal("the bootstrap failed:", err)
+	}
+	meter := &fakeMeter{}
+	c, err := NewClientWithOptions(deviceDir, ClientOptions{Meter: meter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.staticPubKey != pub || c.shortID != 7 {
+		t.Fatal("the client did not pick up the bootstrapped device")
+	}
+	meter.setReadings([]uint32{1, 2, 3}, []float64{100, 200, 300})
+	if !waitForReports(gcas, pub, map[uint32]uint64{1: 100, 2: 200, 3: 300}) {
+		t.Fatal("the server did not get the reports")
+	}
+}
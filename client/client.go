@@ -54,6 +54,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/big"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -62,6 +63,7 @@ import (
 	"time"
 
 	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
 	"github.com/glowlabs-org/threadgroup"
 )
 
@@ -72,14 +74,47 @@ type Client struct {
 	gcaServers    map[glow.PublicKey]GCAServer
 	primaryServer glow.PublicKey
 	shortID       uint32
+	outbox        []uint32 // Timeslots of the reports that didn't get an ack
+	outboxBusy    bool     // Whether an attempt to empty the outbox is running
+	acks          map[glow.PublicKey]map[uint32]struct{}
+
+	// The server info of each server and the version of the report packet
+	// that it accepts, see server_info.go. Servers that are missing get
+	// the legacy layout.
+	serverInfo           map[glow.PublicKey]server.ServerInfoResponse
+	reportPacketVersions map[glow.PublicKey]byte
+	reportTransports     map[glow.PublicKey]reportTransport
+
+	// Status of the client, shown on the local status endpoint. The times
+	// are zero until the first ack, reading, and clock skew measurement.
+	lastAckTimeslot uint32
+	lastAckServer   glow.PublicKey
+	lastAckTime     time.Time
+	lastReading     EnergyRecord
+	lastReadingTime time.Time
+	clockSkew       time.Duration
+	clockSkewTime   time.Time
+	meterError      string // Why the last read of the meter failed, empty if it succeeded
+	statusAddr      string // The address that the status endpoint is listening on
 
 	// Setup parameters
 	staticBaseDir       string
+	staticKeyPath       string
 	staticHistoryFile   *os.File
 	staticHistoryOffset uint32
 	staticPubKey        glow.PublicKey
 	staticPrivKey       glow.PrivateKey
 
+	// The meter that the readings come from.
+	staticMeter PowerMeter
+
+	// The transmit schedule, see schedule.go.
+	staticSchedule TransmitSchedule
+
+	// The HTTP proxy from the options, nil uses the environment, see
+	// proxy.go.
+	staticProxy *url.URL
+
 	// Energy multiplier
 	energyMultiplier float64
 	energyDivider    float64
@@ -92,11 +127,59 @@ type Client struct {
 	tg threadgroup.ThreadGroup
 }
 
-// NewClient will return a new client that is running smoothly.
+// NewClient will return a new client that is running smoothly, using the
+// default options.
 func NewClient(baseDir string) (*Client, error) {
+	return NewClientWithOptions(baseDir, ClientOptions{})
+}
+
+// NewClientWithOptions will return a new client that is running smoothly,
+// using the provided options.
+func NewClientWithOptions(baseDir string, opts ClientOptions) (*Client, error) {
+	c, err := newClient(baseDir, "", "", opts.Meter, opts.passphrase())
+	if err != nil {
+		return nil, err
+	}
+	if opts.Schedule != nil {
+		if err := opts.Schedule.validate(); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("invalid transmit schedule: %w", err)
+		}
+		c.staticSchedule = *opts.Schedule
+	}
+	if c.staticProxy, err = opts.proxy(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Launch the loop that will send UDP reports to the GCA server. The
+	// regular synchronzation checks also happen inside this loop.
+	c.launchSendReports()
+	c.tg.Launch(c.threadedRetryOutbox)
+	c.tg.Launch(c.threadedRefreshServers)
+	c.launchStatusServer(opts)
+
+	return c, nil
+}
+
+// newClient will load the client in the provided directory without launching
+// any of its loops, so that the caller decides who runs them. An empty key
+// path loads the keys from the directory, and a nil meter reads the provided
+// energy file, which defaults to the monitoring file. The passphrase is only
+// used if the keys are encrypted.
+func newClient(baseDir string, keyPath string, energyFile string, meter PowerMeter, passphrase PassphraseSource) (*Client, error) {
 	// Create an empty client.
+	if keyPath == "" {
+		keyPath = filepath.Join(baseDir, ClientKeyFile)
+	}
 	c := &Client{
-		staticBaseDir: baseDir,
+		acks:                 make(map[glow.PublicKey]map[uint32]struct{}),
+		serverInfo:           make(map[glow.PublicKey]server.ServerInfoResponse),
+		reportPacketVersions: make(map[glow.PublicKey]byte),
+		reportTransports:     make(map[glow.PublicKey]reportTransport),
+		staticBaseDir:        baseDir,
+		staticKeyPath:        keyPath,
+		staticMeter:          meter,
 	}
 	if testMode {
 		// Create a background thread that will panic if the client is
@@ -120,30 +203,54 @@ func NewClient(baseDir string) (*Client, error) {
 	}
 	c.EventLog = glow.NewEventLogger(EventLogExpiry, EventLogLimitBytes, EventLogLineLimitBytes)
 
+	// Use the monitoring file if no meter was provided. In prod the
+	// monitoring file is located in an absolute location rather than
+	// being part of the energy monitor directory, but in testing the
+	// location is in the energy monitor directory so that multiple
+	// clients can use different energy monitor files during testing.
+	if c.staticMeter == nil {
+		path := energyFile
+		if path == "" {
+			path = EnergyFile
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(c.staticBaseDir, path)
+		}
+		c.staticMeter = NewMonitorFileMeter(path, c.EventLog)
+	}
+
 	// Load the persist data for the client.
-	err := c.loadKeypair()
+	err := c.loadKeypair(passphrase)
 	if err != nil {
-		return nil, fmt.Errorf("unable to load client keypair: %v", err)
+		return nil, fmt.Errorf("unable to load client keypair: %w", err)
 	}
 	err = c.loadGCAPub()
 	if err != nil {
-		return nil, fmt.Errorf("unable to load GCA public key: %v", err)
+		return nil, fmt.Errorf("unable to load GCA public key: %w", err)
 	}
 	err = c.loadGCAServers()
 	if err != nil {
-		return nil, fmt.Errorf("unable to load GCA server list: %v", err)
+		return nil, fmt.Errorf("unable to load GCA server list: %w", err)
 	}
 	err = c.loadHistory()
 	if err != nil {
-		return nil, fmt.Errorf("unable to open the history file: %v", err)
+		return nil, fmt.Errorf("unable to open the history file: %w", err)
 	}
 	err = c.loadShortID()
 	if err != nil {
-		return nil, fmt.Errorf("unable to load the short id: %v", err)
+		return nil, fmt.Errorf("unable to load the short id: %w", err)
 	}
 	err = c.readCTSettingsFile()
 	if err != nil {
-		return nil, fmt.Errorf("error reading CT file: %v", err)
+		return nil, fmt.Errorf("error reading CT file: %w", err)
+	}
+	err = c.loadOutbox()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the outbox: %w", err)
+	}
+	err = c.loadTransmitSchedule()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the transmit schedule: %w", err)
 	}
 
 	// Create the sync file if it does not exist.
@@ -152,21 +259,16 @@ func NewClient(baseDir string) (*Client, error) {
 	if os.IsNotExist(err) {
 		err := c.updateSyncFile()
 		if err != nil {
-			return nil, fmt.Errorf("error creating the sync file at startup: %v", err)
+			return nil, fmt.Errorf("error creating the sync file at startup: %w", err)
 		}
 	} else if err != nil {
-		return nil, fmt.Errorf("error reading the sync file at startup: %v", err)
+		return nil, fmt.Errorf("error reading the sync file at startup: %w", err)
 	}
 
 	// Create the initial report file.
 	if err := c.updateReportFile(); err != nil {
-		return nil, fmt.Errorf("could not create sync file: %v", err)
+		return nil, fmt.Errorf("could not create sync file: %w", err)
 	}
-
-	// Launch the loop that will send UDP reports to the GCA server. The
-	// regular synchronzation checks also happen inside this loop.
-	c.launchSendReports()
-
 	return c, nil
 }
 
@@ -255,17 +357,26 @@ func (c *Client) DumpEventLogs() string {
 // This does mean that everyone is trusting the GCA not to retain the keys, on
 // the other hand the GCA is pretty much the unilaterally trusted authority in
 // this case anyway.
-func (c *Client) loadKeypair() error {
-	path := filepath.Join(c.staticBaseDir, ClientKeyFile)
-	data, err := os.ReadFile(path)
+//
+// Encrypted keys are decrypted into memory with the provided passphrase, see
+// key_encryption.go. Plaintext keys still load, with a warning.
+func (c *Client) loadKeypair(passphrase PassphraseSource) error {
+	data, err := os.ReadFile(c.staticKeyPath)
 	if os.IsNotExist(err) {
 		return fmt.Errorf("client keys not found, the client was configured incorrectly")
 	}
 	if err != nil {
-		return fmt.Errorf("unable to read keyfile: %v", err)
+		return fmt.Errorf("unable to read keyfile: %w", err)
+	}
+	pub, priv, encrypted, err := ParseClientKeys(data, passphrase)
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		c.EventLog.Printf("the client keys in %v are not encrypted, run 'glow-monitor encrypt-keys' to encrypt them", c.staticKeyPath)
 	}
-	copy(c.staticPubKey[:], data[:32])
-	copy(c.staticPrivKey[:], data[32:])
+	c.staticPubKey = pub
+	c.staticPrivKey = priv
 	return nil
 }
 
@@ -279,7 +390,7 @@ func (c *Client) loadGCAPub() error {
 		return fmt.Errorf("client keys not found, the client was configured incorrectly")
 	}
 	if err != nil {
-		return fmt.Errorf("unable to read keyfile: %v", err)
+		return fmt.Errorf("unable to read keyfile: %w", err)
 	}
 	copy(c.gcaPubKey[:], data[:32])
 	return nil
@@ -292,15 +403,15 @@ func (c *Client) loadGCAServers() error {
 	path := filepath.Join(c.staticBaseDir, GCAServerMapFile)
 	data, err := os.ReadFile(path)
 	if os.IsNotExist(err) {
-		return fmt.Errorf("GCA server file not found, client was configured incorrectly: %v", err)
+		return fmt.Errorf("GCA server file not found, client was configured incorrectly: %w", err)
 	}
 	if err != nil {
-		return fmt.Errorf("unable to read gca server file: %v", err)
+		return fmt.Errorf("unable to read gca server file: %w", err)
 	}
 
 	c.gcaServers, err = UntrustedDeserializeGCAServerMap(data)
 	if err != nil {
-		return fmt.Errorf("unable to decode the data in the gac server file: %v", err)
+		return fmt.Errorf("unable to decode the data in the gac server file: %w", err)
 	}
 	if len(c.gcaServers) == 0 {
 		return fmt.Errorf("no GCA servers found, client was configured incorrectly")
@@ -316,7 +427,7 @@ func (c *Client) loadGCAServers() error {
 	for i := range servers {
 		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
 		if err != nil {
-			return fmt.Errorf("unable to randomize the array: %v", err)
+			return fmt.Errorf("unable to randomize the array: %w", err)
 		}
 		servers[i], servers[j.Int64()] = servers[j.Int64()], servers[i]
 	}
@@ -341,7 +452,7 @@ func (c *Client) loadShortID() error {
 		return fmt.Errorf("client shortID not found, the client was configured incorrectly")
 	}
 	if err != nil {
-		return fmt.Errorf("unable to read short id file: %v", err)
+		return fmt.Errorf("unable to read short id file: %w", err)
 	}
 	c.shortID = binary.LittleEndian.Uint32(data)
 	return nil
@@ -359,7 +470,7 @@ func (c *Client) readCTSettingsFile() error {
 		return nil
 	}
 	if err != nil {
-		return fmt.Errorf("error opening ct settings file: %v", err)
+		return fmt.Errorf("error opening ct settings file: %w", err)
 	}
 	buf := bytes.NewReader(data)
 	scanner := bufio.NewScanner(buf)
@@ -368,14 +479,14 @@ func (c *Client) readCTSettingsFile() error {
 	}
 	mult, err := strconv.ParseFloat(scanner.Text(), 64)
 	if err != nil {
-		return fmt.Errorf("could not parse 1st ct settings line: %v", err)
+		return fmt.Errorf("could not parse 1st ct settings line: %w", err)
 	}
 	if !scanner.Scan() {
 		return fmt.Errorf("ct settings file has no 2nd line")
 	}
 	div, err := strconv.ParseFloat(scanner.Text(), 64)
 	if err != nil {
-		return fmt.Errorf("could not parse 2nd ct settings line: %v", err)
+		return fmt.Errorf("could not parse 2nd ct settings line: %w", err)
 	}
 	c.energyMultiplier = mult
 	c.energyDivider = div
@@ -398,11 +509,11 @@ func (c *Client) isRecentSync() (bool, error) {
 	path := filepath.Join(c.staticBaseDir, LastSyncFile)
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return false, fmt.Errorf("error reading from sync file: %v", err)
+		return false, fmt.Errorf("error reading from sync file: %w", err)
 	}
 	lastSync, err := strconv.ParseInt(string(data), 10, 64)
 	if err != nil {
-		return false, fmt.Errorf("sync file appears to be corrupt: %v", err)
+		return false, fmt.Errorf("sync file appears to be corrupt: %w", err)
 	}
 
 	// Return true if that time is less than 6 hours ago, false otherwise.
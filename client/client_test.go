@@ -24,6 +24,12 @@ import (
 //
 // The public key and private key of the GCA is what gets returned.
 func SetupTestEnvironment(baseDir string, gcaPubkey glow.PublicKey, gcaPrivKey glow.PrivateKey, gcaServers []*server.GCAServer) error {
+	return setupTestEnvironmentAt(baseDir, "127.0.0.1", gcaPubkey, gcaPrivKey, gcaServers)
+}
+
+// setupTestEnvironmentAt is the same as SetupTestEnvironment, except that the
+// servers are reached at the provided location.
+func setupTestEnvironmentAt(baseDir string, location string, gcaPubkey glow.PublicKey, gcaPrivKey glow.PrivateKey, gcaServers []*server.GCAServer) error {
 	// Create the public key and private key for the hardware.
 	pub, priv := glow.GenerateKeyPair()
 
@@ -70,7 +76,7 @@ func SetupTestEnvironment(baseDir string, gcaPubkey glow.PublicKey, gcaPrivKey g
 		http, tcp, udp := server.Ports()
 		serverMap[server.PublicKey()] = GCAServer{
 			Banned:   false,
-			Location: "127.0.0.1",
+			Location: location,
 			HttpPort: http,
 			TcpPort:  tcp,
 			UdpPort:  udp,
@@ -122,16 +128,14 @@ func SetupTestEnvironment(baseDir string, gcaPubkey glow.PublicKey, gcaPrivKey g
 		Debt:       11223344,
 		Expiration: 100e6 + glow.CurrentTimeslot(),
 	}
-	sb := ea.SigningBytes()
-	sig := glow.Sign(sb, gcaPrivKey)
-	ea.Signature = sig
+	ea = server.SignEquipmentAuthorization(ea, gcaPrivKey)
 	jsonEA, err := json.Marshal(ea)
 	if err != nil {
 		return fmt.Errorf("unable to marshal the auth request")
 	}
 	for _, server := range gcaServers {
 		httpX, _, _ := server.Ports()
-		resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/authorize-equipment", httpX), "application/json", bytes.NewBuffer(jsonEA))
+		resp, err := http.Post("http://"+glow.HostPort(location, httpX)+"/api/v1/authorize-equipment", "application/json", bytes.NewBuffer(jsonEA))
 		if err != nil {
 			return fmt.Errorf("unable to authorize device on GCA server: %v", err)
 		}
@@ -5,6 +5,11 @@ const (
 	// the GCA.
 	AuthorizationFile = "authorization.dat"
 
+	// AuthorizationRequestFile contains the authorization of a device that is
+	// being provisioned while it waits for the signature of the GCA, see
+	// provision.go. It is removed once the authorization is signed.
+	AuthorizationRequestFile = "authorization-request.json"
+
 	// The file that contains the keypair for the client, authorized by the GCA.
 	ClientKeyFile = "clientKeys.dat"
 
@@ -31,4 +36,12 @@ const (
 
 	// LastReportFile is a file that contains the last successful udp report sent time.
 	LastReportFile = "last-udp.txt"
+
+	// OutboxFile contains the timeslots of the reports that were sent
+	// without getting an ack, and still need to be retried.
+	OutboxFile = "outbox.dat"
+
+	// TransmitScheduleFile contains the transmit schedule of the device, see
+	// schedule.go. Without it, every report is sent right away.
+	TransmitScheduleFile = "transmit-schedule.json"
 )
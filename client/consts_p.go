@@ -19,6 +19,14 @@ const (
 	// them both at once.
 	sendReportTime = 270 * time.Second
 
+	// The loop that sends reports wakes up at the start of every
+	// timeslot, and then waits sendReportDelay plus the random time
+	// extension for the monitoring box to write the reading of the
+	// timeslot that just ended. sendReportMaxWait is the longest that the
+	// loop waits for a timeslot, which only matters if the clock jumps.
+	sendReportDelay   = 15 * time.Second
+	sendReportMaxWait = 6 * time.Minute
+
 	// EnergyFile is the file used by the monitoring equipment to write the total
 	// amount of energy that was measured in each timeslot.
 	EnergyFile = "/opt/halki/energy_data.csv"
@@ -37,6 +45,39 @@ const (
 	// operation is all but guaranteed to get them dropped.
 	UDPSleepSyncTime = time.Second
 
+	// clockProbeTimeout is how long the client waits for the response to a
+	// time probe. The cell network can be slow.
+	clockProbeTimeout = 30 * time.Second
+
+	// reportAckTimeout is how long the client waits for the server to ack
+	// a report before putting the report in the outbox.
+	reportAckTimeout = 10 * time.Second
+
+	// The delay between two attempts to empty the outbox starts at
+	// outboxRetryMin and doubles after every failed attempt, up to
+	// outboxRetryMax.
+	outboxRetryMin = time.Minute
+	outboxRetryMax = time.Hour
+
+	// maxOutboxReports is the largest number of reports that the outbox
+	// holds. That is a week of reports, which is 8 kB on disk.
+	maxOutboxReports = 2016
+
+	// serverRefreshInterval is how often the client refreshes the list of
+	// authorized servers.
+	serverRefreshInterval = 6 * time.Hour
+
+	// statusPortDefault is the port of the local status endpoint.
+	statusPortDefault = 35035
+
+	// The argon2id parameters that new encrypted keyfiles get, see
+	// key_encryption.go. The memory is in KiB, 64 MiB fits on every
+	// gateway, and deriving the key takes about a second on a Raspberry
+	// Pi.
+	keyKDFTime    = 3
+	keyKDFMemory  = 64 * 1024
+	keyKDFThreads = 2
+
 	// Event log constants. These values limit the in-memory footprint
 	// of the event logging system.
 	EventLogExpiry         = 30 * 24 * time.Hour
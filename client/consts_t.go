@@ -16,6 +16,13 @@ const (
 	// was seen at 50ms - seen only one time out of at least 50 trials.
 	sendReportTime = 60 * time.Millisecond
 
+	// The loop that sends reports waits for the start of a timeslot, or
+	// for sendReportMaxWait, and then for sendReportDelay. The timeslots of
+	// the test build are set by hand, so the loop runs every
+	// sendReportTime.
+	sendReportDelay   = 0
+	sendReportMaxWait = sendReportTime
+
 	// EnergyFile is the file used by the monitoring equipment to write the total
 	// amount of energy that was measured in each timeslot.
 	EnergyFile = "energy_data.csv"
@@ -34,6 +41,39 @@ const (
 	// operation is all but guaranteed to get them dropped.
 	UDPSleepSyncTime = time.Millisecond
 
+	// clockProbeTimeout is how long the client waits for the response to a
+	// time probe.
+	clockProbeTimeout = time.Second
+
+	// reportAckTimeout is how long the client waits for the server to ack
+	// a report before putting the report in the outbox.
+	reportAckTimeout = 50 * time.Millisecond
+
+	// The delay between two attempts to empty the outbox starts at
+	// outboxRetryMin and doubles after every failed attempt, up to
+	// outboxRetryMax.
+	outboxRetryMin = 20 * time.Millisecond
+	outboxRetryMax = 320 * time.Millisecond
+
+	// maxOutboxReports is the largest number of reports that the outbox
+	// holds.
+	maxOutboxReports = 20
+
+	// serverRefreshInterval is how often the client refreshes the list of
+	// authorized servers.
+	serverRefreshInterval = 200 * time.Millisecond
+
+	// statusPortDefault is the port of the local status endpoint. Zero
+	// lets the operating system pick, so that the tests can run many
+	// clients at once.
+	statusPortDefault = 0
+
+	// The argon2id parameters that new encrypted keyfiles get, kept cheap
+	// for the tests.
+	keyKDFTime    = 1
+	keyKDFMemory  = 64
+	keyKDFThreads = 1
+
 	// Event log constants. These values limit the in-memory footprint
 	// of the event logging system.
 	EventLogExpiry         = 20 * time.Second // enough time for the tests to complete
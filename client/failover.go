@@ -0,0 +1,98 @@
+package client
+
+// failover.go contains the code for delivering a report when the primary
+// server is unavailable. Every report goes to the primary server first. If the
+// primary doesn't ack the report, the report goes to the other servers that
+// the GCA has authorized, one at a time in random order, until one of them
+// acks it. Only when no server acks the report does it go into the outbox.
+//
+// The client remembers which servers acked which timeslots, so reports that a
+// server already has don't get sent to it again, whether by the outbox or by a
+// sync. The memory only covers the timeslots that servers still accept
+// reports for, which keeps it small.
+
+import (
+	"crypto/rand"
+	"math/big"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// staticDeliverReport will send the report for the provided energy record to
+// the provided server, and then to the failover servers until one of them
+// acks it. It returns whether any server has the report.
+func (c *Client) staticDeliverReport(gcas GCAServer, gcasKey glow.PublicKey, er EnergyRecord) bool {
+	if c.managedHasAck(gcasKey, er.Timeslot) || c.staticSubmitReport(gcas, gcasKey, er) {
+		return true
+	}
+	for _, key := range c.managedFailoverServers(gcasKey) {
+		if c.tg.IsStopped() {
+			return false
+		}
+		c.mu.Lock()
+		failover := c.gcaServers[key]
+		c.mu.Unlock()
+		if c.managedHasAck(key, er.Timeslot) || c.staticSubmitReport(failover, key, er) {
+			c.EventLog.Printf("report for timeslot %v was delivered to failover server %v", er.Timeslot, failover.Location)
+			return true
+		}
+	}
+	return false
+}
+
+// managedFailoverServers returns the keys of all the servers that are not
+// banned, other than the provided server, in random order.
+func (c *Client) managedFailoverServers(exclude glow.PublicKey) []glow.PublicKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	servers := make([]glow.PublicKey, 0, len(c.gcaServers))
+	for key, gcas := range c.gcaServers {
+		if key != exclude && !gcas.Banned {
+			servers = append(servers, key)
+		}
+	}
+	for i := range servers {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			continue
+		}
+		servers[i], servers[j.Int64()] = servers[j.Int64()], servers[i]
+	}
+	return servers
+}
+
+// managedRecordAck will remember that the provided server acked the report for
+// the provided timeslot, and make it the last ack in the status of the
+// client. Timeslots that are too old for the server to accept get forgotten.
+func (c *Client) managedRecordAck(gcasKey glow.PublicKey, timeslot uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current := glow.CurrentTimeslot()
+	for key, timeslots := range c.acks {
+		for ts := range timeslots {
+			if ts+outboxWindow < current {
+				delete(timeslots, ts)
+			}
+		}
+		if len(timeslots) == 0 {
+			delete(c.acks, key)
+		}
+	}
+	if c.acks[gcasKey] == nil {
+		c.acks[gcasKey] = make(map[uint32]struct{})
+	}
+	c.acks[gcasKey][timeslot] = struct{}{}
+	c.lastAckTimeslot = timeslot
+	c.lastAckServer = gcasKey
+	c.lastAckTime = time.Now()
+}
+
+// managedHasAck returns whether the provided server has acked the report for
+// the provided timeslot.
+func (c *Client) managedHasAck(gcasKey glow.PublicKey, timeslot uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, exists := c.acks[gcasKey][timeslot]
+	return exists
+}
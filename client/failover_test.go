@@ -0,0 +1,158 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// serverHasReports checks whether the server has the provided readings for the
+// provided device.
+func serverHasReports(gcas *server.GCAServer, pubKey glow.PublicKey, readings map[uint32]uint64) (bool, error) {
+	httpPort, _, _ := gcas.Ports()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/recent-reports?publicKey=%x", httpPort, pubKey))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var response server.RecentReportsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return false, err
+	}
+	for timeslot, reading := range readings {
+		if response.Reports[timeslot].PowerOutput != reading {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// waitForReports waits until the server has the provided readings for the
+// provided device.
+func waitForReports(gcas *server.GCAServer, pubKey glow.PublicKey, readings map[uint32]uint64) bool {
+	for i := 0; i < 200; i++ {
+		if has, err := serverHasReports(gcas, pubKey, readings); err == nil && has {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// TestFailover runs a client against two servers and takes the primary server
+// down for part of the run. The reports that the primary misses should land
+// on the other server, and the client should pick up new servers from the
+// list of authorized servers.
+func TestFailover(t *testing.T) {
+	gcas1, dir1, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcas2, dir2, err := server.SetupTestEnvironmentKnownGCA(t.Name()+"_server2", gcaPubKey, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	err = SetupTestEnvironment(clientDir, gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas1, gcas2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meter := &fakeMeter{}
+	c, err := NewClientWithOptions(clientDir, ClientOptions{Meter: meter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := c.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Figure out which server is the primary.
+	c.mu.Lock()
+	primaryKey := c.primaryServer
+	c.mu.Unlock()
+	primary, primaryDir, failover := gcas1, dir1, gcas2
+	if primaryKey != gcas1.PublicKey() {
+		primary, primaryDir, failover = gcas2, dir2, gcas1
+	}
+	defer func() {
+		if err := failover.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// While the primary is up, the reports go to the primary.
+	timeslots := []uint32{1, 2, 3}
+	readings := []float64{100, 200, 300}
+	meter.setReadings(timeslots, readings)
+	if !waitForReports(primary, c.staticPubKey, map[uint32]uint64{1: 100, 2: 200, 3: 300}) {
+		t.Fatal("primary did not get the reports")
+	}
+
+	// While the primary is down, the reports go to the failover.
+	httpPort, tcpPort, udpPort := primary.Ports()
+	if err := primary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	timeslots = append(timeslots, 4, 5, 6)
+	readings = append(readings, 400, 500, 600)
+	meter.setReadings(timeslots, readings)
+	if !waitForReports(failover, c.staticPubKey, map[uint32]uint64{4: 400, 5: 500, 6: 600}) {
+		t.Fatal("failover did not get the reports")
+	}
+	if n := c.outboxLen(); n != 0 {
+		t.Fatal("reports delivered to the failover were queued:", n)
+	}
+	if !c.managedHasAck(failover.PublicKey(), 4) || c.managedHasAck(primaryKey, 4) {
+		t.Fatal("acks were not tracked per server")
+	}
+
+	// Once the primary is back, the reports go to the primary again.
+	primary, err = server.NewGCAServerWithOptions(primaryDir, false, server.ServerOptions{HttpPort: httpPort, TcpPort: tcpPort, UdpPort: udpPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := primary.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	timeslots = append(timeslots, 7)
+	readings = append(readings, 700)
+	meter.setReadings(timeslots, readings)
+	if !waitForReports(primary, c.staticPubKey, map[uint32]uint64{1: 100, 2: 200, 3: 300, 7: 700}) {
+		t.Fatal("primary did not get the reports after coming back")
+	}
+
+	// A server that the GCA authorizes later gets picked up by the
+	// refresh of the server list.
+	newKey, _ := glow.GenerateKeyPair()
+	as := server.AuthorizedServer{PublicKey: newKey, Location: "127.0.0.1", HttpPort: 1, TcpPort: 2, UdpPort: 3}
+	as.GCAAuthorization = glow.Sign(as.SigningBytes(), gcaPrivKey)
+	j, _ := json.Marshal(as)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/register-server", httpPort), "application/json", bytes.NewBuffer(j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("registration failed:", resp.StatusCode)
+	}
+	found := false
+	for i := 0; i < 200 && !found; i++ {
+		c.mu.Lock()
+		_, found = c.gcaServers[newKey]
+		c.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !found {
+		t.Fatal("the new server was not picked up")
+	}
+}
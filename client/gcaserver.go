@@ -25,7 +25,7 @@ func SerializeGCAServerMap(gcaMap map[glow.PublicKey]GCAServer) ([]byte, error)
 	for key, server := range gcaMap {
 		// Serialize the key (PublicKey)
 		if _, err := buffer.Write(key[:]); err != nil {
-			return nil, fmt.Errorf("unable to write key to buffer: %v", err)
+			return nil, fmt.Errorf("unable to write key to buffer: %w", err)
 		}
 
 		// Serialize the 'Banned' bool as a single byte
@@ -41,23 +41,23 @@ func SerializeGCAServerMap(gcaMap map[glow.PublicKey]GCAServer) ([]byte, error)
 		}
 		locationLength := uint16(len(server.Location))
 		if err := binary.Write(&buffer, binary.LittleEndian, locationLength); err != nil {
-			return nil, fmt.Errorf("unable to write location length to buffer: %v", err)
+			return nil, fmt.Errorf("unable to write location length to buffer: %w", err)
 		}
 
 		// Serialize the 'Location' string
 		if _, err := buffer.WriteString(server.Location); err != nil {
-			return nil, fmt.Errorf("unable to write location to buffer: %v", err)
+			return nil, fmt.Errorf("unable to write location to buffer: %w", err)
 		}
 
 		// Serialize the ports (HttpPort, TcpPort, UdpPort) as uint16
 		if err := binary.Write(&buffer, binary.LittleEndian, server.HttpPort); err != nil {
-			return nil, fmt.Errorf("unable to write HttpPort to buffer: %v", err)
+			return nil, fmt.Errorf("unable to write HttpPort to buffer: %w", err)
 		}
 		if err := binary.Write(&buffer, binary.LittleEndian, server.TcpPort); err != nil {
-			return nil, fmt.Errorf("unable to write TcpPort to buffer: %v", err)
+			return nil, fmt.Errorf("unable to write TcpPort to buffer: %w", err)
 		}
 		if err := binary.Write(&buffer, binary.LittleEndian, server.UdpPort); err != nil {
-			return nil, fmt.Errorf("unable to write UdpPort to buffer: %v", err)
+			return nil, fmt.Errorf("unable to write UdpPort to buffer: %w", err)
 		}
 	}
 
@@ -77,7 +77,7 @@ func UntrustedDeserializeGCAServerMap(data []byte) (map[glow.PublicKey]GCAServer
 		}
 		var key glow.PublicKey
 		if err := binary.Read(reader, binary.LittleEndian, &key); err != nil {
-			return nil, fmt.Errorf("error reading PublicKey: %v", err)
+			return nil, fmt.Errorf("error reading PublicKey: %w", err)
 		}
 
 		// Deserialize the 'Banned' bool
@@ -86,7 +86,7 @@ func UntrustedDeserializeGCAServerMap(data []byte) (map[glow.PublicKey]GCAServer
 		}
 		bannedByte, err := reader.ReadByte()
 		if err != nil {
-			return nil, fmt.Errorf("error reading Banned flag: %v", err)
+			return nil, fmt.Errorf("error reading Banned flag: %w", err)
 		}
 		banned := bannedByte != 0
 
@@ -96,7 +96,7 @@ func UntrustedDeserializeGCAServerMap(data []byte) (map[glow.PublicKey]GCAServer
 			return nil, fmt.Errorf("not enough data to read Location length")
 		}
 		if err := binary.Read(reader, binary.LittleEndian, &locationLength); err != nil {
-			return nil, fmt.Errorf("error reading Location length: %v", err)
+			return nil, fmt.Errorf("error reading Location length: %w", err)
 		}
 
 		// Deserialize the 'Location' string
@@ -105,7 +105,7 @@ func UntrustedDeserializeGCAServerMap(data []byte) (map[glow.PublicKey]GCAServer
 			return nil, fmt.Errorf("not enough data to read Location string")
 		}
 		if _, err := reader.Read(location); err != nil {
-			return nil, fmt.Errorf("error reading Location string: %v", err)
+			return nil, fmt.Errorf("error reading Location string: %w", err)
 		}
 
 		// Deserialize the ports (HttpPort, TcpPort, UdpPort)
@@ -114,13 +114,13 @@ func UntrustedDeserializeGCAServerMap(data []byte) (map[glow.PublicKey]GCAServer
 			return nil, fmt.Errorf("not enough data to read ports")
 		}
 		if err := binary.Read(reader, binary.LittleEndian, &httpPort); err != nil {
-			return nil, fmt.Errorf("error reading HttpPort: %v", err)
+			return nil, fmt.Errorf("error reading HttpPort: %w", err)
 		}
 		if err := binary.Read(reader, binary.LittleEndian, &tcpPort); err != nil {
-			return nil, fmt.Errorf("error reading TcpPort: %v", err)
+			return nil, fmt.Errorf("error reading TcpPort: %w", err)
 		}
 		if err := binary.Read(reader, binary.LittleEndian, &udpPort); err != nil {
-			return nil, fmt.Errorf("error reading UdpPort: %v", err)
+			return nil, fmt.Errorf("error reading UdpPort: %w", err)
 		}
 
 		// Add the deserialized key-value pair to the map
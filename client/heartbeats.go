@@ -0,0 +1,84 @@
+package client
+
+// heartbeats.go sends a heartbeat alongside the report of every timeslot that
+// the meter had no production for, so that the server can tell a device that
+// is alive at night or under snow apart from one that is dead, and a meter
+// that reads zero apart from one that failed to read. Heartbeats are only sent
+// to servers that advertise server.FeatureHeartbeats, and they go over the
+// transport that the reports to the server last took. They don't get acks and
+// they are never retried, a lost heartbeat only costs a bit of uptime.
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// heartbeatStatus returns the heartbeat status for the energy of a record,
+// false if the record has production to report. See staticReadMeter for the
+// sentinel values.
+func heartbeatStatus(energy uint64) (byte, bool) {
+	switch energy {
+	case glow.PowerOutputIdle:
+		return glow.HeartbeatIdle, true
+	case glow.PowerOutputMeterFault:
+		return glow.HeartbeatMeterFault, true
+	}
+	return 0, false
+}
+
+// SendHeartbeat sends a heartbeat to the UDP port at the provided location.
+func SendHeartbeat(hb glow.Heartbeat, location string) error {
+	conn, err := net.Dial("udp", location)
+	if err != nil {
+		return unreachable(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(hb.Serialize()); err != nil {
+		return fmt.Errorf("unable to send heartbeat: %w", unreachable(err))
+	}
+	return nil
+}
+
+// SubmitHeartbeat sends a heartbeat to the server over HTTP. Heartbeats that
+// the server refuses surface as an *APIError.
+func (c *APIClient) SubmitHeartbeat(hb glow.Heartbeat) error {
+	resp, err := c.staticHTTP.Post(c.URL("/api/v1/equipment-report"), "application/octet-stream", bytes.NewReader(hb.Serialize()))
+	if err != nil {
+		return unreachable(err)
+	}
+	defer resp.Body.Close()
+	return ReadAPIError(resp)
+}
+
+// staticSendHeartbeat signs a heartbeat for the provided record and sends it
+// to the server, if the record has no production to report and the server
+// accepts heartbeats.
+func (c *Client) staticSendHeartbeat(gcas GCAServer, gcasKey glow.PublicKey, er EnergyRecord) {
+	status, ok := heartbeatStatus(er.Energy)
+	if !ok {
+		return
+	}
+	info, exists := c.managedServerInfo(gcasKey)
+	if !exists || !info.Capabilities.HasFeature(server.FeatureHeartbeats) {
+		return
+	}
+	hb := glow.Heartbeat{
+		ShortID:  c.shortID,
+		Timeslot: er.Timeslot,
+		Status:   status,
+	}
+	hb.Signature = glow.Sign(hb.SigningBytes(), c.staticPrivKey)
+	var err error
+	if rt := c.managedReportTransports(gcasKey)[0]; rt == reportTransportHTTP {
+		err = NewAPIClient(gcasKey, gcas, c.managedAPIClientOptions(gcasKey)).SubmitHeartbeat(hb)
+	} else {
+		err = SendHeartbeat(hb, glow.HostPort(gcas.Location, gcas.UdpPort))
+	}
+	if err != nil {
+		c.EventLog.Printf("heartbeat for timeslot %v to %v failed: %v", er.Timeslot, gcas.Location, err)
+	}
+}
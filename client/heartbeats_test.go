@@ -0,0 +1,82 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestHeartbeats checks that the client sends a heartbeat for the records
+// without production, over the transport that the server last took reports
+// on, and none for the records with production.
+func TestHeartbeats(t *testing.T) {
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+	gcas, _, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	httpPort, _, _ := gcas.Ports()
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	err = SetupTestEnvironment(clientDir, gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(clientDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := gcas.PublicKey()
+	for i := 0; i < 100; i++ {
+		if _, exists := c.managedServerInfo(key); exists {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if info, _ := c.managedServerInfo(key); !info.Capabilities.HasFeature(server.FeatureHeartbeats) {
+		t.Fatal("server does not advertise heartbeats")
+	}
+	c.mu.Lock()
+	gcasInfo := c.gcaServers[key]
+	c.mu.Unlock()
+
+	// An idle timeslot over UDP, a meter fault over HTTP, and a timeslot
+	// with production, which gets no heartbeat.
+	c.staticSendHeartbeat(gcasInfo, key, EnergyRecord{Timeslot: 5, Energy: 2})
+	c.staticSendHeartbeat(gcasInfo, key, EnergyRecord{Timeslot: 6, Energy: 500})
+	c.managedSetReportTransport(key, reportTransportHTTP)
+	c.staticSendHeartbeat(gcasInfo, key, EnergyRecord{Timeslot: 7, Energy: 3})
+
+	var uptime server.V2DeviceUptime
+	for start := time.Now(); uptime.IdleTimeslots != 1 || uptime.MeterFaultTimeslots != 1; time.Sleep(20 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the heartbeats never arrived: %+v", uptime)
+		}
+		resp, err := http.Get("http://" + glow.HostPort("127.0.0.1", httpPort) + "/api/v2/all-device-stats?timeslot_offset=0&fields=uptime")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stats struct {
+			Devices []struct {
+				Uptime server.V2DeviceUptime `json:"uptime"`
+			} `json:"devices"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&stats)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.Devices) == 1 {
+			uptime = stats.Devices[0].Uptime
+		}
+	}
+	if uptime.ReportedTimeslots != 0 || uptime.Percent != 20 {
+		t.Fatalf("unexpected uptime: %+v", uptime)
+	}
+}
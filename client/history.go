@@ -23,7 +23,7 @@ func (c *Client) loadHistory() error {
 	path := filepath.Join(c.staticBaseDir, HistoryFile)
 	f, err := os.OpenFile(path, os.O_RDWR, 0644)
 	if err != nil {
-		return fmt.Errorf("unable to open history file: %v", err)
+		return fmt.Errorf("unable to open history file: %w", err)
 	}
 	c.staticHistoryFile = f
 	c.tg.AfterStop(func() error {
@@ -34,7 +34,7 @@ func (c *Client) loadHistory() error {
 	var offsetBytes [4]byte
 	_, err = f.ReadAt(offsetBytes[:], 0)
 	if err != nil {
-		return fmt.Errorf("unable to read offset bytes: %v", err)
+		return fmt.Errorf("unable to read offset bytes: %w", err)
 	}
 
 	// Convert to uint32
@@ -55,7 +55,7 @@ func (c *Client) staticSaveReading(timeslot uint32, reading uint32) error {
 	// Load the reading from this offset.
 	current, err := c.staticLoadReading(timeslot)
 	if err != nil {
-		return fmt.Errorf("unable to load reading for this timeslot: %v", err)
+		return fmt.Errorf("unable to load reading for this timeslot: %w", err)
 	}
 	// If the reading has already been saved, this is a no-op.
 	if current == reading {
@@ -70,7 +70,7 @@ func (c *Client) staticSaveReading(timeslot uint32, reading uint32) error {
 	binary.LittleEndian.PutUint32(data[:], reading)
 	_, err = c.staticHistoryFile.WriteAt(data[:], int64(byteOffset))
 	if err != nil {
-		return fmt.Errorf("unable to write the reading: %v", err)
+		return fmt.Errorf("unable to write the reading: %w", err)
 	}
 	return nil
 }
@@ -94,7 +94,7 @@ func (c *Client) staticLoadReading(timeslot uint32) (uint32, error) {
 		return 0, nil
 	}
 	if err != nil {
-		return 0, fmt.Errorf("cannot load a reading: %v", err)
+		return 0, fmt.Errorf("cannot load a reading: %w", err)
 	}
 
 	return binary.LittleEndian.Uint32(data[:]), nil
@@ -0,0 +1,359 @@
+package client
+
+// key_encryption.go keeps the keys of a device encrypted at rest, so that a
+// stolen SD card doesn't hand out the identity of the device. The keyfile is
+// encrypted with AES-GCM under a key that is derived with argon2id from a
+// passphrase, and the client decrypts the keys into memory at startup. The
+// plaintext keys never get written back to disk.
+//
+// The passphrase comes from a PassphraseSource, which is only asked for it if
+// the keyfile is encrypted. DefaultPassphraseSource reads it from a file, from
+// the GLOW_KEY_PASSPHRASE environment variable, or from the terminal.
+//
+// Keyfiles that are not encrypted keep working, so that the devices that are
+// already in the field don't stop reporting, but the client logs a warning
+// for them. EncryptClientKeyFile encrypts an existing keyfile in place, which
+// is what 'glow-monitor encrypt-keys' runs, and gca-provision can write the
+// keys of a new device encrypted right away.
+//
+// An encrypted keyfile starts with keyFileMagic, followed by the argon2id
+// parameters, the salt, a check value of the derived key, the nonce, and the
+// sealed keys. The check value tells a wrong passphrase apart from a keyfile
+// that was corrupted, and the header is authenticated along with the keys.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"golang.org/x/crypto/argon2"
+)
+
+// PassphraseEnv is the environment variable that DefaultPassphraseSource
+// reads the passphrase from.
+const PassphraseEnv = "GLOW_KEY_PASSPHRASE"
+
+// keyFileMagic is the start of every encrypted keyfile. A plaintext keyfile
+// starts with the public key of the device instead.
+const keyFileMagic = "glowkey1"
+
+// The layout of an encrypted keyfile.
+const (
+	keyFileSaltSize   = 16
+	keyFileCheckSize  = 8
+	keyFileNonceSize  = 12
+	keyFileHeaderSize = len(keyFileMagic) + 4 + 4 + 1 + keyFileSaltSize + keyFileCheckSize + keyFileNonceSize
+	keyFileSize       = keyFileHeaderSize + 64 + 16
+)
+
+// The limits on the argon2id parameters of a keyfile, so that a corrupted
+// header can't make the client allocate all of the memory of the device.
+const (
+	maxKeyKDFTime   = 64
+	maxKeyKDFMemory = 1 << 20 // in KiB
+)
+
+var (
+	// ErrWrongPassphrase is returned if the passphrase doesn't match the
+	// encrypted keyfile.
+	ErrWrongPassphrase = errors.New("wrong passphrase for the client keys")
+
+	// ErrCorruptKeyFile is returned if the keyfile can't be decoded, or if
+	// the encrypted keys don't match their authentication tag.
+	ErrCorruptKeyFile = errors.New("client keyfile is corrupt")
+
+	// ErrNoPassphrase is returned if the keyfile is encrypted and no
+	// passphrase was provided.
+	ErrNoPassphrase = fmt.Errorf("the client keys are encrypted, but no passphrase was provided, set %v or pass a passphrase file", PassphraseEnv)
+)
+
+// PassphraseSource returns the passphrase that the keys of a device are
+// encrypted with. It is only called for an encrypted keyfile.
+type PassphraseSource func() ([]byte, error)
+
+// StaticPassphrase returns a PassphraseSource that always returns the
+// provided passphrase.
+func StaticPassphrase(passphrase []byte) PassphraseSource {
+	return func() ([]byte, error) { return passphrase, nil }
+}
+
+// FilePassphrase returns a PassphraseSource that reads the passphrase from
+// the provided file, without the trailing newline.
+func FilePassphrase(path string) PassphraseSource {
+	return func() ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the passphrase file: %w", err)
+		}
+		passphrase := bytes.TrimRight(data, "\r\n")
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("the passphrase file %v is empty", path)
+		}
+		return passphrase, nil
+	}
+}
+
+// PromptPassphrase returns a PassphraseSource that asks for the passphrase on
+// the terminal, without echoing it. With confirm, the passphrase has to be
+// entered twice, which is meant for a passphrase that is being set. It
+// returns ErrNoPassphrase if stdin is not a terminal.
+func PromptPassphrase(confirm bool) PassphraseSource {
+	return func() ([]byte, error) {
+		fi, err := os.Stdin.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return nil, ErrNoPassphrase
+		}
+		r := bufio.NewReader(os.Stdin)
+		read := func(prompt string) ([]byte, error) {
+			fmt.Fprint(os.Stderr, prompt)
+			if err := stty("-echo"); err == nil {
+				defer stty("echo")
+			}
+			line, err := r.ReadString('\n')
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the passphrase: %w", err)
+			}
+			return []byte(strings.TrimRight(line, "\r\n")), nil
+		}
+		passphrase, err := read("Passphrase for the device keys: ")
+		if err != nil {
+			return nil, err
+		}
+		if len(passphrase) == 0 {
+			return nil, ErrNoPassphrase
+		}
+		if confirm {
+			again, err := read("Repeat the passphrase: ")
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(passphrase, again) {
+				return nil, fmt.Errorf("the passphrases don't match")
+			}
+		}
+		return passphrase, nil
+	}
+}
+
+// stty runs stty on the terminal of stdin.
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// DefaultPassphraseSource returns a PassphraseSource that reads the
+// passphrase from the provided file if it is not empty, and otherwise from
+// PassphraseEnv, falling back to the terminal if the variable isn't set.
+func DefaultPassphraseSource(file string) PassphraseSource {
+	if file != "" {
+		return FilePassphrase(file)
+	}
+	return func() ([]byte, error) {
+		if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+			return []byte(passphrase), nil
+		}
+		return PromptPassphrase(false)()
+	}
+}
+
+// isEncryptedKeyFile returns whether the provided keyfile is encrypted.
+func isEncryptedKeyFile(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(keyFileMagic))
+}
+
+// deriveKeyFileKey derives the encryption key and the check value of a
+// keyfile from the passphrase.
+func deriveKeyFileKey(passphrase []byte, salt []byte, time uint32, memory uint32, threads uint8) (key []byte, check []byte) {
+	key = argon2.IDKey(passphrase, salt, time, memory, threads, 32)
+	sum := sha256.Sum256(append([]byte(keyFileMagic+" check"), key...))
+	return key, sum[:keyFileCheckSize]
+}
+
+// EncryptClientKeys returns the encrypted keyfile for the provided keys.
+func EncryptClientKeys(pub glow.PublicKey, priv glow.PrivateKey, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrNoPassphrase
+	}
+	header := make([]byte, 0, keyFileHeaderSize)
+	header = append(header, keyFileMagic...)
+	header = binary.LittleEndian.AppendUint32(header, keyKDFTime)
+	header = binary.LittleEndian.AppendUint32(header, keyKDFMemory)
+	header = append(header, keyKDFThreads)
+	salt := make([]byte, keyFileSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("unable to generate a salt: %w", err)
+	}
+	header = append(header, salt...)
+	key, check := deriveKeyFileKey(passphrase, salt, keyKDFTime, keyKDFMemory, keyKDFThreads)
+	header = append(header, check...)
+	nonce := make([]byte, keyFileNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate a nonce: %w", err)
+	}
+	header = append(header, nonce...)
+
+	aead, err := newKeyFileAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, 64)
+	copy(plaintext[:32], pub[:])
+	copy(plaintext[32:], priv[:])
+	return aead.Seal(header, nonce, plaintext, header), nil
+}
+
+// newKeyFileAEAD returns the cipher that the keys are sealed with.
+func newKeyFileAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// ParseClientKeys returns the keys in the provided keyfile, along with
+// whether the keyfile was encrypted. The passphrase is only requested for an
+// encrypted keyfile.
+func ParseClientKeys(data []byte, passphrase PassphraseSource) (glow.PublicKey, glow.PrivateKey, bool, error) {
+	var pub glow.PublicKey
+	var priv glow.PrivateKey
+	if !isEncryptedKeyFile(data) {
+		if len(data) < 64 {
+			return pub, priv, false, ErrCorruptKeyFile
+		}
+		copy(pub[:], data[:32])
+		copy(priv[:], data[32:64])
+		return pub, priv, false, nil
+	}
+
+	if len(data) != keyFileSize {
+		return pub, priv, true, ErrCorruptKeyFile
+	}
+	header := data[:keyFileHeaderSize]
+	params := header[len(keyFileMagic):]
+	time := binary.LittleEndian.Uint32(params[0:4])
+	memory := binary.LittleEndian.Uint32(params[4:8])
+	threads := params[8]
+	salt := params[9 : 9+keyFileSaltSize]
+	check := params[9+keyFileSaltSize : 9+keyFileSaltSize+keyFileCheckSize]
+	nonce := params[9+keyFileSaltSize+keyFileCheckSize:]
+	if time == 0 || time > maxKeyKDFTime || threads == 0 || memory < 8*uint32(threads) || memory > maxKeyKDFMemory {
+		return pub, priv, true, ErrCorruptKeyFile
+	}
+	if passphrase == nil {
+		return pub, priv, true, ErrNoPassphrase
+	}
+	pass, err := passphrase()
+	if err != nil {
+		return pub, priv, true, err
+	}
+	if len(pass) == 0 {
+		return pub, priv, true, ErrNoPassphrase
+	}
+	key, wantCheck := deriveKeyFileKey(pass, salt, time, memory, threads)
+	if subtle.ConstantTimeCompare(check, wantCheck) != 1 {
+		return pub, priv, true, ErrWrongPassphrase
+	}
+	aead, err := newKeyFileAEAD(key)
+	if err != nil {
+		return pub, priv, true, err
+	}
+	plaintext, err := aead.Open(nil, nonce, data[keyFileHeaderSize:], header)
+	if err != nil {
+		return pub, priv, true, ErrCorruptKeyFile
+	}
+	copy(pub[:], plaintext[:32])
+	copy(priv[:], plaintext[32:])
+	return pub, priv, true, nil
+}
+
+// IsClientKeyFileEncrypted returns whether the keyfile at the provided path
+// is encrypted.
+func IsClientKeyFileEncrypted(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return isEncryptedKeyFile(data), nil
+}
+
+// writeKeyFile writes a keyfile through a temp file, so that a crash can't
+// leave the keys of a device half written. The keyfile is only readable by
+// its owner.
+func writeKeyFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create the keyfile: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to write the keyfile: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("unable to rename the keyfile: %w", err)
+	}
+	return nil
+}
+
+// EncryptClientKeyFile encrypts the plaintext keyfile at the provided path in
+// place. The plaintext keyfile is kept as a backup next to it, and the path
+// of the backup is returned. An existing backup is never overwritten, and a
+// keyfile that is already encrypted is left alone.
+func EncryptClientKeyFile(path string, passphrase []byte) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the keyfile: %w", err)
+	}
+	if isEncryptedKeyFile(data) {
+		return "", fmt.Errorf("the keyfile %v is already encrypted", path)
+	}
+	pub, priv, _, err := ParseClientKeys(data, nil)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := EncryptClientKeys(pub, priv, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	backupPath := path + ".plaintext.bak"
+	f, err := os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("unable to create the backup of the keyfile: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to write the backup of the keyfile: %w", err)
+	}
+	if err := writeKeyFile(path, encrypted); err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestKeyEncryption checks that encrypted keys only decrypt with the right
+// passphrase, and that a wrong passphrase and a corrupted keyfile are told
+// apart.
+func TestKeyEncryption(t *testing.T) {
+	pub, priv := glow.GenerateKeyPair()
+	pass := []byte("correct horse battery staple")
+	data, err := EncryptClientKeys(pub, priv, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != keyFileSize || bytes.Contains(data, priv[:32]) || bytes.Contains(data, pub[:]) {
+		t.Fatal("the keyfile is not encrypted")
+	}
+	pub2, priv2, encrypted, err := ParseClientKeys(data, StaticPassphrase(pass))
+	if err != nil || !encrypted || pub2 != pub || priv2 != priv {
+		t.Fatal("the keys did not round trip:", encrypted, err)
+	}
+	if _, _, _, err := ParseClientKeys(data, StaticPassphrase([]byte("correct horse battery stapler"))); err != ErrWrongPassphrase {
+		t.Fatal("a wrong passphrase was not detected:", err)
+	}
+	if _, _, _, err := ParseClientKeys(data, nil); err != ErrNoPassphrase {
+		t.Fatal("expected a missing passphrase:", err)
+	}
+
+	// Flipping any bit of the nonce or the sealed keys is corruption, and
+	// so is a keyfile of the wrong size or with absurd parameters. A
+	// flipped salt or check value derives a different key, which looks
+	// like a wrong passphrase.
+	nonceStart := keyFileHeaderSize - keyFileNonceSize
+	for i := nonceStart; i < len(data); i++ {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 1
+		if _, _, _, err := ParseClientKeys(corrupt, StaticPassphrase(pass)); err != ErrCorruptKeyFile {
+			t.Fatal("corruption at byte", i, "was not detected:", err)
+		}
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(keyFileMagic)+9] ^= 1
+	if _, _, _, err := ParseClientKeys(corrupt, StaticPassphrase(pass)); err != ErrWrongPassphrase {
+		t.Fatal("a flipped salt was not detected:", err)
+	}
+	corrupt = append([]byte(nil), data...)
+	corrupt[len(keyFileMagic)+7] = 0xff
+	if _, _, _, err := ParseClientKeys(corrupt, StaticPassphrase(pass)); err != ErrCorruptKeyFile {
+		t.Fatal("absurd parameters were accepted:", err)
+	}
+	if _, _, _, err := ParseClientKeys(data[:len(data)-1], StaticPassphrase(pass)); err != ErrCorruptKeyFile {
+		t.Fatal("a truncated keyfile was accepted:", err)
+	}
+
+	// Plaintext keyfiles still parse, without asking for a passphrase.
+	plain := append(append([]byte(nil), pub[:]...), priv[:]...)
+	pub2, priv2, encrypted, err = ParseClientKeys(plain, func() ([]byte, error) {
+		t.Fatal("the passphrase was requested for a plaintext keyfile")
+		return nil, nil
+	})
+	if err != nil || encrypted || pub2 != pub || priv2 != priv {
+		t.Fatal("the plaintext keys did not parse:", encrypted, err)
+	}
+	if _, _, _, err := ParseClientKeys(plain[:63], nil); err != ErrCorruptKeyFile {
+		t.Fatal("a short plaintext keyfile was accepted:", err)
+	}
+}
+
+// TestEncryptClientKeyFile migrates the plaintext keys of a client to an
+// encrypted keyfile, and checks that the client starts with the passphrase
+// and refuses to start without it.
+func TestEncryptClientKeyFile(t *testing.T) {
+	gcas, _, gcaPub, gcaPriv, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	dir := glow.GenerateTestDir(t.Name() + "_client1")
+	if err := SetupTestEnvironment(dir, gcaPub, gcaPriv, []*server.GCAServer{gcas}); err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, ClientKeyFile)
+	plain, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Plaintext keys keep working, with a warning.
+	c, err := NewClient(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := c.staticPubKey
+	if !strings.Contains(c.DumpEventLogs(), "not encrypted") {
+		t.Fatal("no warning for the plaintext keys")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The migration keeps the plaintext keys as a backup, and can't be
+	// run twice.
+	pass := []byte("hunter2")
+	backupPath, err := EncryptClientKeyFile(keyPath, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := os.ReadFile(backupPath)
+	if err != nil || !bytes.Equal(backup, plain) {
+		t.Fatal("the backup does not match the plaintext keys:", err)
+	}
+	if encrypted, err := IsClientKeyFileEncrypted(keyPath); err != nil || !encrypted {
+		t.Fatal("the keyfile was not encrypted:", err)
+	}
+	if fi, err := os.Stat(keyPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatal("the keyfile is readable by others:", err)
+	}
+	if _, err := EncryptClientKeyFile(keyPath, pass); err == nil {
+		t.Fatal("an encrypted keyfile was encrypted again")
+	}
+	if err := os.Remove(backupPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client needs the right passphrase, the default source reads it
+	// from the environment.
+	if _, err := NewClientWithOptions(dir, ClientOptions{Passphrase: StaticPassphrase([]byte("hunter3"))}); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatal("the client started with the wrong passphrase:", err)
+	}
+	t.Setenv(PassphraseEnv, string(pass))
+	c, err = NewClient(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.staticPubKey != pub || strings.Contains(c.DumpEventLogs(), "not encrypted") {
+		t.Fatal("the encrypted keys did not load")
+	}
+	after, err := os.ReadFile(keyPath)
+	if err != nil || bytes.Contains(after, plain[:64]) {
+		t.Fatal("the plaintext keys were written back:", err)
+	}
+
+	// Provisioning can write encrypted keys right away.
+	deviceDir := filepath.Join(dir, "device")
+	pub2, priv2, err := LoadOrCreateClientKeys(deviceDir, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadOrCreateClientKeys(deviceDir, nil); err != ErrNoPassphrase {
+		t.Fatal("encrypted keys loaded without a passphrase:", err)
+	}
+	pub3, priv3, err := LoadOrCreateClientKeys(deviceDir, pass)
+	if err != nil || pub3 != pub2 || priv3 != priv2 {
+		t.Fatal("the encrypted keys changed:", err)
+	}
+}
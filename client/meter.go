@@ -0,0 +1,218 @@
+package client
+
+// meter.go contains the PowerMeter interface, which is where the client gets
+// its energy readings from, along with the meters that ship with the client.
+//
+// The MonitorFileMeter reads the CSV file that the monitoring equipment on the
+// GCA devices writes, and is the default. The JSONFileMeter reads a simple
+// JSON file, so that integrators can feed the client readings from any
+// hardware by writing that file.
+//
+// A meter only reports what it measured. The client takes care of the
+// sentinel values that the servers expect, and applies the CT settings if the
+// meter asks for them.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// PowerMeter is a source of energy readings for the client.
+type PowerMeter interface {
+	// Readings returns every reading that the meter currently has. The
+	// client polls the meter every few minutes, and only sends the
+	// readings that it hasn't seen before.
+	Readings() ([]MeterReading, error)
+
+	// Capabilities describes the readings of the meter, so that the
+	// client knows how to treat them.
+	Capabilities() MeterCapabilities
+}
+
+// MeterReading is the energy that a meter measured during one timeslot.
+type MeterReading struct {
+	Timeslot uint32
+	Energy   float64 // mWh, negative if energy flowed the other way
+
+	// Invalid means that the meter has an entry for the timeslot but was
+	// unable to read it, for example because the firmware wrote an error
+	// message instead of a number.
+	Invalid bool
+}
+
+// MeterCapabilities describes the readings of a meter.
+type MeterCapabilities struct {
+	// CTScaling means that the readings come straight from a current
+	// transformer, and need the multiplier and divider from the CT
+	// settings applied.
+	CTScaling bool
+
+	// Bidirectional means that the meter can measure energy flowing in
+	// both directions. Negative readings from a meter that can't are
+	// treated as invalid.
+	Bidirectional bool
+}
+
+// MonitorFileMeter reads the CSV file that the monitoring equipment writes.
+// Every line of the file is a unix timestamp followed by the energy in mWh,
+// as measured by the current transformer.
+type MonitorFileMeter struct {
+	staticPath string
+	staticLog  *glow.EventLogger
+}
+
+// NewMonitorFileMeter returns a meter that reads the monitoring file at the
+// provided path. Problems with individual lines of the file get logged to
+// 'log', which may be nil.
+func NewMonitorFileMeter(path string, log *glow.EventLogger) *MonitorFileMeter {
+	return &MonitorFileMeter{
+		staticPath: path,
+		staticLog:  log,
+	}
+}
+
+// logf logs a problem with the monitoring file, if the meter has a log.
+func (m *MonitorFileMeter) logf(format string, v ...interface{}) {
+	if m.staticLog != nil {
+		m.staticLog.Printf(format, v...)
+	}
+}
+
+// Capabilities implements PowerMeter. The readings of the monitoring
+// equipment need the CT settings applied.
+func (m *MonitorFileMeter) Capabilities() MeterCapabilities {
+	return MeterCapabilities{
+		CTScaling:     true,
+		Bidirectional: true,
+	}
+}
+
+// Readings implements PowerMeter.
+func (m *MonitorFileMeter) Readings() ([]MeterReading, error) {
+	// Read the file all at once, to avoid any potential issues if it
+	// is modified while being parsed.
+	data, err := os.ReadFile(m.staticPath)
+	if err != nil {
+		m.logf("unable to read monitoring file: %v", err)
+		return nil, fmt.Errorf("unable to read monitoring file: %w", err)
+	}
+
+	// Iterate over the CSV records
+	reader := csv.NewReader(strings.NewReader(string(data)))
+	var readings []MeterReading
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			// Stop at EOF or on error. An error here means we
+			// couldn't read a timestamp, which means we don't know
+			// what timestamp to tell the server for having errors.
+			// Whether it's an EOF or a real error, the best move
+			// is to break.
+			if err != io.EOF {
+				m.logf("unexpected error on energy file record read: %v", err)
+			}
+			break
+		}
+
+		timestamp, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			// If the timestamp can't be read, we don't know what
+			// timestamp to submit to the server as having an
+			// error, we just ignore the read in this case.
+
+			// Reading the header line is an expected error here.
+			if record[0] != "timestamp" {
+				m.logf("invalid timestamp in energy file: %v", record[0])
+			}
+			continue
+		}
+		timeslot, err := glow.UnixToTimeslot(timestamp)
+		if err != nil {
+			// If the timeslot can't be determined, we don't know
+			// what timeslot to submit to the server as having an
+			// error, we just ignore the read in this case.
+			m.logf("invalid timeslot conversion in energy file: %v", record[0])
+			continue
+		}
+
+		// Parse the value. If the value is not parsed correctly, it's
+		// probably because the firmware version is wrong or because
+		// the file has a text error instead of a number.
+		energy, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			m.logf("invalid energy value in energy file: %v", record[1])
+			readings = append(readings, MeterReading{Timeslot: timeslot, Invalid: true})
+			continue
+		}
+		readings = append(readings, MeterReading{Timeslot: timeslot, Energy: energy})
+	}
+	return readings, nil
+}
+
+// JSONFileMeter reads readings from a JSON file, which holds a list of objects
+// with a unix "timestamp" and the "energy_mwh" that was produced in the
+// timeslot of that timestamp. An energy of null marks a reading that the
+// hardware was unable to take. The readings are used as they are, the CT
+// settings don't apply to them.
+//
+//	[{"timestamp": 1700000100, "energy_mwh": 1520.5}, {"timestamp": 1700000400, "energy_mwh": null}]
+type JSONFileMeter struct {
+	staticPath          string
+	staticBidirectional bool
+}
+
+// jsonMeterEntry is a single entry of the file of a JSONFileMeter.
+type jsonMeterEntry struct {
+	Timestamp int64    `json:"timestamp"`
+	Energy    *float64 `json:"energy_mwh"`
+}
+
+// NewJSONFileMeter returns a meter that reads the JSON file at the provided
+// path. 'bidirectional' says whether the hardware behind the file can measure
+// energy flowing in both directions.
+func NewJSONFileMeter(path string, bidirectional bool) *JSONFileMeter {
+	return &JSONFileMeter{
+		staticPath:          path,
+		staticBidirectional: bidirectional,
+	}
+}
+
+// Capabilities implements PowerMeter.
+func (m *JSONFileMeter) Capabilities() MeterCapabilities {
+	return MeterCapabilities{
+		Bidirectional: m.staticBidirectional,
+	}
+}
+
+// Readings implements PowerMeter. Entries with a timestamp that doesn't map to
+// a timeslot are skipped.
+func (m *JSONFileMeter) Readings() ([]MeterReading, error) {
+	data, err := os.ReadFile(m.staticPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read meter file: %w", err)
+	}
+	var entries []jsonMeterEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("unable to decode meter file: %w", err)
+	}
+	readings := make([]MeterReading, 0, len(entries))
+	for _, entry := range entries {
+		timeslot, err := glow.UnixToTimeslot(entry.Timestamp)
+		if err != nil {
+			continue
+		}
+		if entry.Energy == nil {
+			readings = append(readings, MeterReading{Timeslot: timeslot, Invalid: true})
+			continue
+		}
+		readings = append(readings, MeterReading{Timeslot: timeslot, Energy: *entry.Energy})
+	}
+	return readings, nil
+}
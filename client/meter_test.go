@@ -0,0 +1,124 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// fakeMeter is a PowerMeter with readings that the tests control.
+type fakeMeter struct {
+	readings []MeterReading
+	caps     MeterCapabilities
+	mu       sync.Mutex
+}
+
+// Capabilities implements PowerMeter.
+func (m *fakeMeter) Capabilities() MeterCapabilities {
+	return m.caps
+}
+
+// Readings implements PowerMeter.
+func (m *fakeMeter) Readings() ([]MeterReading, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MeterReading(nil), m.readings...), nil
+}
+
+// setReadings replaces the readings of the meter, simulating new readings
+// being taken.
+func (m *fakeMeter) setReadings(timeslots []uint32, energies []float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readings = m.readings[:0]
+	for i := range timeslots {
+		m.readings = append(m.readings, MeterReading{Timeslot: timeslots[i], Energy: energies[i]})
+	}
+}
+
+// TestMeters checks that the meters that ship with the client parse their
+// files, and that the client turns readings into the values that get
+// reported.
+func TestMeters(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	ts := func(timeslot uint32) string { return strconv.FormatInt(glow.TimeslotToUnix(timeslot), 10) }
+
+	// The monitoring file.
+	csvPath := filepath.Join(dir, "energy.csv")
+	csvData := "timestamp,energy (mWh)\n" +
+		ts(1) + ",500\n" +
+		ts(2) + ",random error here\n" +
+		"garbage,700\n" +
+		ts(3) + ",-12.5\n"
+	if err := os.WriteFile(csvPath, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	readings, err := NewMonitorFileMeter(csvPath, nil).Readings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []MeterReading{{Timeslot: 1, Energy: 500}, {Timeslot: 2, Invalid: true}, {Timeslot: 3, Energy: -12.5}}
+	if !reflect.DeepEqual(readings, expected) {
+		t.Fatalf("unexpected readings from the monitoring file: %+v", readings)
+	}
+	if _, err := NewMonitorFileMeter(filepath.Join(dir, "missing.csv"), nil).Readings(); err == nil {
+		t.Fatal("expected an error for a missing monitoring file")
+	}
+
+	// The JSON file.
+	jsonPath := filepath.Join(dir, "energy.json")
+	jsonData := `[{"timestamp": ` + ts(4) + `, "energy_mwh": 1520.5}, {"timestamp": ` + ts(5) + `, "energy_mwh": null}, {"timestamp": -5, "energy_mwh": 1}]`
+	if err := os.WriteFile(jsonPath, []byte(jsonData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	readings, err = NewJSONFileMeter(jsonPath, false).Readings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []MeterReading{{Timeslot: 4, Energy: 1520.5}, {Timeslot: 5, Invalid: true}}
+	if !reflect.DeepEqual(readings, expected) {
+		t.Fatalf("unexpected readings from the json file: %+v", readings)
+	}
+	if err := os.WriteFile(jsonPath, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewJSONFileMeter(jsonPath, false).Readings(); err == nil {
+		t.Fatal("expected an error for a malformed json file")
+	}
+
+	// The client applies the sentinels, and the CT settings only if the
+	// meter asks for them. A reading that the CT settings push beyond
+	// glow.MaxPowerOutput is a meter fault.
+	m := &fakeMeter{readings: []MeterReading{
+		{Timeslot: 1, Energy: 500},
+		{Timeslot: 2, Energy: 10},
+		{Timeslot: 3, Energy: -500},
+		{Timeslot: 4, Invalid: true},
+		{Timeslot: 5, Energy: 6e11},
+	}}
+	c := &Client{staticMeter: m, energyMultiplier: 2, energyDivider: 1}
+	check := func(want []uint64) {
+		t.Helper()
+		records, err := c.staticReadMeter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != len(want) {
+			t.Fatal("unexpected number of records:", len(records))
+		}
+		for i, record := range records {
+			if record.Energy != want[i] {
+				t.Fatalf("unexpected energy for timeslot %v: %v", record.Timeslot, int64(record.Energy))
+			}
+		}
+	}
+	check([]uint64{500, 2, 3, 3, 6e11})
+	m.caps = MeterCapabilities{CTScaling: true, Bidirectional: true}
+	negative := int64(-1000)
+	check([]uint64{1000, 2, uint64(negative), 3, 3})
+}
@@ -0,0 +1,304 @@
+package client
+
+// multi.go contains the MultiClient, which runs several devices in one
+// process. Some installations have one gateway computer reading several
+// meters, and running a client per meter wastes memory and has the clients
+// fight over the port of the status endpoint.
+//
+// Every device keeps its own directory with its history, outbox, sync file
+// and server list, exactly like a device that runs its own client, so a
+// device can be moved between a MultiClient and a Client without losing
+// anything. The MultiClient shares the loops instead: one loop reads the
+// meters and sends the reports of every device, signed with the key of the
+// device, one loop retries the outboxes of every device, and one status
+// endpoint reports on every device.
+//
+// The meter of each device gets read in its own goroutine, and the loop never
+// waits for it. A meter that errors or hangs only delays the reports of its
+// own device, the loop skips the device until its previous read returns.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/threadgroup"
+)
+
+// DeviceConfig is a device in the config of a MultiClient.
+type DeviceConfig struct {
+	// Dir is the directory of the device, with the same files as the
+	// directory of a Client.
+	Dir string `json:"dir"`
+
+	// KeyFile is the keypair of the device. Empty uses the keypair in
+	// Dir.
+	KeyFile string `json:"key_file,omitempty"`
+
+	// ShortID is the ShortID that the device is expected to have. A
+	// mismatch with the ShortID in Dir gets logged, since a GCA migration
+	// changes the ShortID of a device. Zero skips the check.
+	ShortID uint32 `json:"short_id,omitempty"`
+
+	// EnergyFile is the monitoring file that the device reads. Empty uses
+	// the monitoring file of the GCA devices. Relative paths are relative
+	// to Dir.
+	EnergyFile string `json:"energy_file,omitempty"`
+
+	// JSONMeter is a JSON file with the readings of the device, which is
+	// used instead of the monitoring file, see NewJSONFileMeter.
+	JSONMeter              string `json:"json_meter,omitempty"`
+	JSONMeterBidirectional bool   `json:"json_meter_bidirectional,omitempty"`
+
+	// Meter is where the device gets its readings from. It can only be set
+	// by programs that embed the client, and takes precedence over the
+	// files.
+	Meter PowerMeter `json:"-"`
+}
+
+// MultiClientConfig is the config of a MultiClient.
+type MultiClientConfig struct {
+	Devices []DeviceConfig `json:"devices"`
+}
+
+// MultiStatusResponse is the response of /status on a MultiClient.
+type MultiStatusResponse struct {
+	Devices []StatusResponse `json:"devices"`
+}
+
+// multiDevice is a device of a MultiClient, along with the state of its
+// report loop.
+type multiDevice struct {
+	client *Client
+	send   *sendState
+}
+
+// MultiClient runs a set of devices in one process.
+type MultiClient struct {
+	devices    []multiDevice
+	statusAddr string // The address that the status endpoint is listening on
+
+	EventLog *glow.EventLogger
+
+	tg threadgroup.ThreadGroup
+}
+
+// LoadMultiClientConfig will load the config of a MultiClient from a JSON
+// file. Relative device directories are relative to the config file.
+func LoadMultiClientConfig(path string) (MultiClientConfig, error) {
+	var config MultiClientConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("unable to read the device config: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("unable to decode the device config: %w", err)
+	}
+	for i := range config.Devices {
+		dir := config.Devices[i].Dir
+		if dir != "" && !filepath.IsAbs(dir) {
+			config.Devices[i].Dir = filepath.Join(filepath.Dir(path), dir)
+		}
+	}
+	return config, nil
+}
+
+// NewMultiClient will return a MultiClient that is running every device in
+// the config. The meter option is ignored, the meters come from the config.
+func NewMultiClient(config MultiClientConfig, opts ClientOptions) (*MultiClient, error) {
+	if len(config.Devices) == 0 {
+		return nil, fmt.Errorf("the config has no devices")
+	}
+	if EventLogExpiry == time.Duration(0) || EventLogLimitBytes <= 0 || EventLogLineLimitBytes <= 0 {
+		return nil, fmt.Errorf("LogEntry log settings do not allow log collection.")
+	}
+	proxy, err := opts.proxy()
+	if err != nil {
+		return nil, err
+	}
+	m := &MultiClient{
+		EventLog: glow.NewEventLogger(EventLogExpiry, EventLogLimitBytes, EventLogLineLimitBytes),
+	}
+
+	// Load every device before launching anything, so that a bad config
+	// doesn't leave half of the devices running.
+	pubKeys := make(map[glow.PublicKey]string)
+	closeAll := func() {
+		for _, d := range m.devices {
+			d.client.Close()
+		}
+	}
+	for _, dc := range config.Devices {
+		if dc.Dir == "" {
+			closeAll()
+			return nil, fmt.Errorf("a device in the config has no directory")
+		}
+		meter := dc.Meter
+		if meter == nil && dc.JSONMeter != "" {
+			meter = NewJSONFileMeter(dc.JSONMeter, dc.JSONMeterBidirectional)
+		}
+		keyFile := dc.KeyFile
+		if keyFile != "" && !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(dc.Dir, keyFile)
+		}
+		c, err := newClient(dc.Dir, keyFile, dc.EnergyFile, meter, opts.passphrase())
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("unable to load the device in %v: %v", dc.Dir, err)
+		}
+		if other, exists := pubKeys[c.staticPubKey]; exists {
+			c.Close()
+			closeAll()
+			return nil, fmt.Errorf("the devices in %v and %v have the same keys", other, dc.Dir)
+		}
+		pubKeys[c.staticPubKey] = dc.Dir
+		c.staticProxy = proxy
+		if dc.ShortID != 0 && dc.ShortID != c.shortID {
+			m.EventLog.Printf("the device in %v is ShortID %v, the config expects %v", dc.Dir, c.shortID, dc.ShortID)
+		}
+		m.devices = append(m.devices, multiDevice{client: c, send: new(sendState)})
+	}
+
+	// The devices keep refreshing their own servers, everything else is
+	// shared.
+	for _, d := range m.devices {
+		d.client.tg.Launch(d.client.threadedRefreshServers)
+	}
+	m.tg.Launch(m.threadedSendReports)
+	m.tg.Launch(m.threadedRetryOutboxes)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", m.statusHandler)
+	mux.HandleFunc("/recent", m.recentHandler)
+	m.statusAddr = launchStatusEndpoint(&m.tg, m.EventLog, opts, mux)
+	return m, nil
+}
+
+// Close will stop the shared loops, and then every device.
+func (m *MultiClient) Close() error {
+	err := m.tg.Stop()
+	for _, d := range m.devices {
+		if cerr := d.client.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// DumpEventLogs returns the event log of the MultiClient, followed by the
+// status and the event log of every device.
+func (m *MultiClient) DumpEventLogs() string {
+	var sb strings.Builder
+	sb.WriteString("MultiClient\n----------\n")
+	_, entryOrder := m.EventLog.DumpLogEntries()
+	for _, line := range entryOrder {
+		sb.WriteString(line + "\n")
+	}
+	for _, d := range m.devices {
+		sb.WriteString("\n\n")
+		sb.WriteString(d.client.DumpEventLogs())
+	}
+	return sb.String()
+}
+
+// threadedSendReports is the loop that reads the meters and sends the reports
+// of every device. It runs an iteration of the report loop of a Client for
+// every device at the pace of a Client, each in its own goroutine.
+func (m *MultiClient) threadedSendReports() {
+	ticker := glow.NewTimeslotTicker(nil, sendReportMaxWait)
+	for {
+		for _, d := range m.devices {
+			d := d
+			if !atomic.CompareAndSwapUint32(&d.send.busy, 0, 1) {
+				d.client.EventLog.Printf("skipping the meter, the previous read has not returned")
+				continue
+			}
+			err := m.tg.Launch(func() {
+				defer atomic.StoreUint32(&d.send.busy, 0)
+				d.client.managedSendIteration(d.send)
+			})
+			if err != nil {
+				return
+			}
+		}
+		if _, ok := ticker.Next(m.tg.StopChan()); !ok {
+			return
+		}
+		if !m.tg.Sleep(sendReportDelay + randomTimeExtension()) {
+			return
+		}
+	}
+}
+
+// threadedRetryOutboxes is the loop that retries the outboxes of every
+// device. Each device backs off on its own, so a device that can't reach its
+// servers doesn't slow down the retries of the others.
+func (m *MultiClient) threadedRetryOutboxes() {
+	delays := make([]time.Duration, len(m.devices))
+	waited := make([]time.Duration, len(m.devices))
+	for i := range delays {
+		delays[i] = outboxRetryMin
+	}
+	for {
+		if !m.tg.Sleep(outboxRetryMin) {
+			return
+		}
+		for i, d := range m.devices {
+			waited[i] += outboxRetryMin
+			if waited[i] < delays[i] {
+				continue
+			}
+			waited[i] = 0
+			delays[i] = d.client.managedAttemptOutbox(delays[i])
+		}
+	}
+}
+
+// statusHandler returns the status of every device.
+func (m *MultiClient) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := MultiStatusResponse{Devices: make([]StatusResponse, 0, len(m.devices))}
+	for _, d := range m.devices {
+		resp.Devices = append(resp.Devices, d.client.managedStatus())
+	}
+	writeStatusJSON(w, resp)
+}
+
+// recentHandler returns the readings of the last 24 hours of the device with
+// the ShortID in the short_id query parameter.
+func (m *MultiClient) recentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	shortID, err := strconv.ParseUint(r.URL.Query().Get("short_id"), 10, 32)
+	if err != nil {
+		http.Error(w, "short_id is required", http.StatusBadRequest)
+		return
+	}
+	for _, d := range m.devices {
+		d.client.mu.Lock()
+		match := d.client.shortID == uint32(shortID)
+		d.client.mu.Unlock()
+		if !match {
+			continue
+		}
+		resp, err := d.client.staticRecent()
+		if err != nil {
+			http.Error(w, "unable to read the history file", http.StatusInternalServerError)
+			return
+		}
+		writeStatusJSON(w, resp)
+		return
+	}
+	http.Error(w, "unknown short_id", http.StatusNotFound)
+}
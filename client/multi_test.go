@@ -0,0 +1,230 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// stuckMeter is a PowerMeter that hangs until it gets released, and then
+// fails until it gets fixed.
+type stuckMeter struct {
+	fakeMeter
+	release chan struct{}
+	fixed   bool
+}
+
+// Readings implements PowerMeter.
+func (m *stuckMeter) Readings() ([]MeterReading, error) {
+	<-m.release
+	m.mu.Lock()
+	fixed := m.fixed
+	m.mu.Unlock()
+	if !fixed {
+		return nil, fmt.Errorf("meter unplugged")
+	}
+	return m.fakeMeter.Readings()
+}
+
+// started returns whether the report loop of the device saved the readings
+// that existed at startup. It takes the busy flag of the loop so that it
+// doesn't race with an iteration.
+func (d multiDevice) started() bool {
+	if !atomic.CompareAndSwapUint32(&d.send.busy, 0, 1) {
+		return false
+	}
+	defer atomic.StoreUint32(&d.send.busy, 0)
+	return d.send.started
+}
+
+// provisionTestDevice provisions a device with the provided ShortID into the
+// provided directory, and authorizes it on the provided server.
+func provisionTestDevice(dir string, shortID uint32, gcas *server.GCAServer, gcaPub glow.PublicKey, gcaPriv glow.PrivateKey) (glow.PublicKey, error) {
+	pub, _, err := LoadOrCreateClientKeys(dir, nil)
+	if err != nil {
+		return pub, err
+	}
+	ea := glow.EquipmentAuthorization{
+		Version:    glow.EquipmentAuthorizationVersionExpiring,
+		ShortID:    shortID,
+		PublicKey:  pub,
+		Capacity:   123412341234,
+		Debt:       11223344,
+		Expiration: 100e6 + glow.CurrentTimeslot(),
+	}
+	ea = server.SignEquipmentAuthorization(ea, gcaPriv)
+	httpPort, tcpPort, udpPort := gcas.Ports()
+	location := GCAServer{Location: "127.0.0.1", HttpPort: httpPort, TcpPort: tcpPort, UdpPort: udpPort}
+	servers := map[glow.PublicKey]GCAServer{gcas.PublicKey(): location}
+	if err := WriteDeviceBundle(dir, ea, gcaPub, servers, glow.CurrentTimeslot()); err != nil {
+		return pub, err
+	}
+	return pub, NewAPIClient(gcas.PublicKey(), location, APIClientOptions{}).SubmitAuthorization(ea)
+}
+
+// TestMultiClient runs three devices in one MultiClient against a server, and
+// checks that the reports of every device arrive signed by the right device,
+// even while the meter of one of them hangs or fails.
+func TestMultiClient(t *testing.T) {
+	gcas, _, gcaPub, gcaPriv, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+
+	// The second device has a meter that hangs.
+	stuck := &stuckMeter{release: make(chan struct{})}
+	meters := []*fakeMeter{{}, &stuck.fakeMeter, {}}
+	var config MultiClientConfig
+	var pubKeys []glow.PublicKey
+	for i := range meters {
+		dir := glow.GenerateTestDir(t.Name() + "_device" + strconv.Itoa(i+1))
+		pub, err := provisionTestDevice(dir, uint32(i+1), gcas, gcaPub, gcaPriv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeys = append(pubKeys, pub)
+		dc := DeviceConfig{Dir: dir, ShortID: uint32(i + 1), Meter: meters[i]}
+		if i == 1 {
+			dc.Meter = stuck
+		}
+		config.Devices = append(config.Devices, dc)
+	}
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(func() { close(stuck.release) }) }
+	defer release()
+
+	// The config has to point at distinct devices.
+	dup := MultiClientConfig{Devices: []DeviceConfig{config.Devices[0], config.Devices[0]}}
+	if _, err := NewMultiClient(dup, ClientOptions{}); err == nil {
+		t.Fatal("a config with the same device twice was accepted")
+	}
+
+	m, err := NewMultiClient(config, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		release()
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Readings that exist before the report loop starts are not sent, so
+	// wait for the healthy devices to start.
+	for _, i := range []int{0, 2} {
+		for j := 0; j < 200 && !m.devices[i].started(); j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The readings of every device have their own energies, so a report
+	// that lands under the wrong device would not match.
+	expected := func(i int, timeslots []uint32) map[uint32]uint64 {
+		readings := make(map[uint32]uint64)
+		energies := make([]float64, len(timeslots))
+		for j, ts := range timeslots {
+			readings[ts] = uint64((i+1)*1000 + int(ts))
+			energies[j] = float64(readings[ts])
+		}
+		meters[i].setReadings(timeslots, energies)
+		return readings
+	}
+	timeslots := []uint32{1, 2, 3}
+	for _, i := range []int{0, 2} {
+		if !waitForReports(gcas, pubKeys[i], expected(i, timeslots)) {
+			t.Fatalf("device %v did not report while another meter hung", i+1)
+		}
+	}
+
+	// Once the meter stops hanging and fails instead, the failure shows up
+	// in the status of its device, and the other devices keep reporting.
+	release()
+	timeslots = append(timeslots, 4)
+	for _, i := range []int{0, 2} {
+		if !waitForReports(gcas, pubKeys[i], expected(i, timeslots)) {
+			t.Fatalf("device %v did not report while another meter failed", i+1)
+		}
+	}
+	var status MultiStatusResponse
+	for j := 0; j < 200; j++ {
+		resp, err := http.Get("http://" + m.statusAddr + "/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Devices[1].MeterError != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(status.Devices) != 3 || status.Devices[1].MeterError == "" || status.Devices[0].MeterError != "" {
+		t.Fatal("unexpected status:", status)
+	}
+	for i, ds := range status.Devices {
+		if ds.ShortID != uint32(i+1) || ds.PublicKey != fmt.Sprintf("%x", pubKeys[i]) {
+			t.Fatal("status is not per device:", i, ds)
+		}
+	}
+
+	// Once the meter is fixed, its device reports as well.
+	stuck.mu.Lock()
+	stuck.fixed = true
+	stuck.mu.Unlock()
+	if !waitForReports(gcas, pubKeys[1], expected(1, timeslots)) {
+		t.Fatal("the fixed device did not report")
+	}
+	for i := range meters {
+		if has, err := serverHasReports(gcas, pubKeys[i], expected(i, timeslots)); err != nil || !has {
+			t.Fatalf("reports of device %v are missing: %v", i+1, err)
+		}
+	}
+
+	// /recent is per device.
+	for query, code := range map[string]int{"short_id=3": http.StatusOK, "short_id=9": http.StatusNotFound, "": http.StatusBadRequest} {
+		resp, err := http.Get("http://" + m.statusAddr + "/recent?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Fatalf("unexpected status for %v: %v", query, resp.StatusCode)
+		}
+	}
+}
+
+// TestLoadMultiClientConfig checks that relative directories in the config
+// are relative to the config file.
+func TestLoadMultiClientConfig(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	path := filepath.Join(dir, "devices.json")
+	data := `{"devices": [{"dir": "meter1", "short_id": 5, "json_meter": "/tmp/readings.json"}, {"dir": "/abs/meter2"}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadMultiClientConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Devices) != 2 || config.Devices[0].Dir != filepath.Join(dir, "meter1") || config.Devices[0].ShortID != 5 || config.Devices[0].JSONMeter != "/tmp/readings.json" || config.Devices[1].Dir != "/abs/meter2" {
+		t.Fatal("unexpected config:", config)
+	}
+	if _, err := NewMultiClient(MultiClientConfig{}, ClientOptions{}); err == nil {
+		t.Fatal("a config without devices was accepted")
+	}
+}
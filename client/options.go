@@ -0,0 +1,55 @@
+package client
+
+// options.go contains the settings that can be adjusted when launching a
+// Client. The defaults match the constants in consts_p.go and consts_t.go, so
+// a client launched with NewClient behaves the same as it always has.
+
+import "net/url"
+
+// ClientOptions contains the configurable settings of a Client.
+type ClientOptions struct {
+	// Meter is where the client gets its energy readings from. Nil reads
+	// the monitoring file of the GCA devices.
+	Meter PowerMeter
+
+	// StatusAddr is the IP address that the local status endpoint binds
+	// to, and StatusPort is its port. An empty address binds to loopback,
+	// so the status is only visible from the device itself, and a zero
+	// port uses the default port.
+	StatusAddr string
+	StatusPort uint16
+
+	// DisableStatus turns off the local status endpoint.
+	DisableStatus bool
+
+	// Schedule is the transmit schedule of the client, see schedule.go.
+	// Nil uses the schedule in TransmitScheduleFile, if there is one.
+	Schedule *TransmitSchedule
+
+	// Passphrase is where the client gets the passphrase of encrypted
+	// keys from, see key_encryption.go. Nil uses
+	// DefaultPassphraseSource without a file.
+	Passphrase PassphraseSource
+
+	// Proxy is the URL of the HTTP proxy that the client reaches the
+	// HTTP API of its servers through, see proxy.go. Empty uses the proxy
+	// from HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+	Proxy string
+}
+
+// proxy returns the parsed proxy, nil if there is none.
+func (opts ClientOptions) proxy() (*url.URL, error) {
+	if opts.Proxy == "" {
+		return nil, nil
+	}
+	return ParseProxyURL(opts.Proxy)
+}
+
+// passphrase returns the source of the passphrase for encrypted keys, filling
+// in the default.
+func (opts ClientOptions) passphrase() PassphraseSource {
+	if opts.Passphrase == nil {
+		return DefaultPassphraseSource("")
+	}
+	return opts.Passphrase
+}
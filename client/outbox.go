@@ -0,0 +1,230 @@
+package client
+
+// outbox.go contains the outbox, which holds the reports that were sent to the
+// server without getting an ack back. A background loop retries them, oldest
+// first, with exponential backoff. Without the outbox, a report that gets lost
+// while the network is down only reaches the server at the next sync, and sync
+// can only repair the reports that the server still has in memory.
+//
+// The outbox only stores the timeslots of the reports. The readings come from
+// the history file, and the reports get signed again at every attempt, so a
+// report that is retried after a GCA migration carries the new ShortID.
+//
+// The outbox is persisted to disk so that it survives a restart. The file is
+// a list of little endian uint32 timeslots in ascending order. It is small,
+// so the whole file gets rewritten every time the outbox changes.
+//
+// A report leaves the outbox once the server acks it with any status, because
+// a report that the server rejected will be rejected again. A report also
+// leaves the outbox once it falls outside the acceptance window of the
+// server, and the oldest report is dropped when the outbox is full, so that a
+// long time offline can't fill the SD card.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// outboxWindow is the number of timeslots in the past that the server accepts
+// reports for by default. Reports in the outbox that are older than that
+// can't be delivered anymore.
+const outboxWindow = 432
+
+// loadOutbox will load the outbox from disk. A missing file means that the
+// outbox is empty.
+func (c *Client) loadOutbox() error {
+	path := filepath.Join(c.staticBaseDir, OutboxFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read outbox file: %w", err)
+	}
+	// A partial timeslot at the end of the file can only come from a
+	// torn write, and gets ignored.
+	for i := 0; i+4 <= len(data); i += 4 {
+		c.outbox = append(c.outbox, binary.LittleEndian.Uint32(data[i:]))
+	}
+	return nil
+}
+
+// saveOutbox will write the outbox to disk. The file is written to a temp file
+// first and then renamed, so a crash can't leave it half written. The mutex
+// must be held.
+func (c *Client) saveOutbox() error {
+	data := make([]byte, 4*len(c.outbox))
+	for i, timeslot := range c.outbox {
+		binary.LittleEndian.PutUint32(data[4*i:], timeslot)
+	}
+	path := filepath.Join(c.staticBaseDir, OutboxFile)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("unable to write outbox file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("unable to rename outbox file: %w", err)
+	}
+	return nil
+}
+
+// managedQueueReport will add the report for the provided timeslot to the
+// outbox. If the outbox is full, the oldest report gets dropped.
+func (c *Client) managedQueueReport(timeslot uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Find where the timeslot belongs, keeping the outbox sorted.
+	i := len(c.outbox)
+	for i > 0 && c.outbox[i-1] >= timeslot {
+		i--
+	}
+	if i < len(c.outbox) && c.outbox[i] == timeslot {
+		return
+	}
+	c.outbox = append(c.outbox, 0)
+	copy(c.outbox[i+1:], c.outbox[i:])
+	c.outbox[i] = timeslot
+	if len(c.outbox) > maxOutboxReports {
+		c.EventLog.Printf("outbox is full, dropping the report for timeslot %v", c.outbox[0])
+		c.outbox = c.outbox[1:]
+	}
+	if err := c.saveOutbox(); err != nil {
+		c.EventLog.Printf("unable to save outbox: %v", err)
+	}
+}
+
+// managedRemoveReport will remove the report for the provided timeslot from
+// the outbox.
+func (c *Client) managedRemoveReport(timeslot uint32) {
+	c.managedRemoveReports([]uint32{timeslot})
+}
+
+// managedRemoveReports will remove the reports for the provided timeslots from
+// the outbox, saving the outbox only once.
+func (c *Client) managedRemoveReports(timeslots []uint32) {
+	remove := make(map[uint32]bool, len(timeslots))
+	for _, timeslot := range timeslots {
+		remove[timeslot] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := c.outbox[:0]
+	for _, ts := range c.outbox {
+		if !remove[ts] {
+			kept = append(kept, ts)
+		}
+	}
+	if len(kept) == len(c.outbox) {
+		return
+	}
+	c.outbox = kept
+	if err := c.saveOutbox(); err != nil {
+		c.EventLog.Printf("unable to save outbox: %v", err)
+	}
+}
+
+// managedRetryOutbox will send every report in the outbox to the primary
+// server or a failover server, oldest first, and return whether the outbox
+// was emptied. The reports go in batches if the primary server takes them,
+// and the rest one at a time. The attempt stops at the first report that
+// doesn't get an ack from any server, because the network is most likely
+// down. Only one attempt runs at a time, a second one returns false.
+func (c *Client) managedRetryOutbox() bool {
+	// Drop the reports that the server won't accept anymore, and grab
+	// what is left.
+	c.mu.Lock()
+	if c.outboxBusy {
+		c.mu.Unlock()
+		return false
+	}
+	c.outboxBusy = true
+	defer func() {
+		c.mu.Lock()
+		c.outboxBusy = false
+		c.mu.Unlock()
+	}()
+	current := glow.CurrentTimeslot()
+	expired := 0
+	for expired < len(c.outbox) && c.outbox[expired]+outboxWindow < current {
+		expired++
+	}
+	if expired > 0 {
+		c.EventLog.Printf("dropping %v reports from the outbox that are too old to be accepted", expired)
+		c.outbox = c.outbox[expired:]
+		if err := c.saveOutbox(); err != nil {
+			c.EventLog.Printf("unable to save outbox: %v", err)
+		}
+	}
+	timeslots := append([]uint32(nil), c.outbox...)
+	gcasKey := c.primaryServer
+	gcas := c.gcaServers[gcasKey]
+	c.mu.Unlock()
+
+	// The server ignores power outputs below 2, so those don't need to be
+	// sent. Because we now handle negative numbers, the uint32 needs to be
+	// cast to an int32 before being upscaled to a uint64.
+	var records []EnergyRecord
+	var skipped []uint32
+	for _, timeslot := range timeslots {
+		powerOutput, err := c.staticLoadReading(timeslot)
+		if err != nil || powerOutput < 2 {
+			skipped = append(skipped, timeslot)
+			continue
+		}
+		records = append(records, EnergyRecord{
+			Timeslot: timeslot,
+			Energy:   uint64(int32(powerOutput)),
+		})
+	}
+	c.managedRemoveReports(skipped)
+
+	for _, record := range c.staticDeliverBatch(gcas, gcasKey, records) {
+		if c.tg.IsStopped() {
+			return false
+		}
+		if !c.staticDeliverReport(gcas, gcasKey, record) {
+			return false
+		}
+		c.managedRemoveReport(record.Timeslot)
+	}
+	return true
+}
+
+// threadedRetryOutbox will periodically retry the reports in the outbox. The
+// delay between attempts doubles every time an attempt fails, up to
+// outboxRetryMax, and resets once the outbox has been emptied.
+func (c *Client) threadedRetryOutbox() {
+	delay := outboxRetryMin
+	for {
+		if !c.tg.Sleep(delay) {
+			return
+		}
+		delay = c.managedAttemptOutbox(delay)
+	}
+}
+
+// managedAttemptOutbox will make one attempt to empty the outbox, and return
+// the delay before the next attempt given the delay before this one. While the
+// transmit schedule holds the reports back, no attempt is made.
+func (c *Client) managedAttemptOutbox(delay time.Duration) time.Duration {
+	c.mu.Lock()
+	empty := len(c.outbox) == 0
+	c.mu.Unlock()
+	if !empty && c.managedHoldReports() {
+		return delay
+	}
+	if empty || c.managedRetryOutbox() {
+		return outboxRetryMin
+	}
+	delay *= 2
+	if delay > outboxRetryMax {
+		delay = outboxRetryMax
+	}
+	return delay
+}
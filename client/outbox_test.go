@@ -0,0 +1,152 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// outboxLen returns the number of reports in the outbox of the client.
+func (c *Client) outboxLen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.outbox)
+}
+
+// waitForOutboxLen waits until the outbox of the client holds n reports.
+func (c *Client) waitForOutboxLen(n int) bool {
+	for i := 0; i < 200; i++ {
+		if c.outboxLen() == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// waitForOutboxNewest waits until the newest report in the outbox of the
+// client is for the provided timeslot.
+func (c *Client) waitForOutboxNewest(timeslot uint32) bool {
+	for i := 0; i < 200; i++ {
+		c.mu.Lock()
+		newest := len(c.outbox) > 0 && c.outbox[len(c.outbox)-1] == timeslot
+		c.mu.Unlock()
+		if newest {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// TestOutbox checks that reports which don't get an ack are kept in the
+// outbox across a restart of the client, and are delivered once the server
+// is back. It also checks that the outbox is capped, and that reports which
+// are too old for the server get dropped.
+func TestOutbox(t *testing.T) {
+	gcas, serverDir, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	err = SetupTestEnvironment(clientDir, gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpPort, tcpPort, udpPort := gcas.Ports()
+	if err := gcas.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take readings while the server is down. The outbox only has room
+	// for the newest maxOutboxReports reports.
+	meter := &fakeMeter{}
+	c, err := NewClientWithOptions(clientDir, ClientOptions{Meter: meter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeslots []uint32
+	var readings []float64
+	for i := uint32(1); i <= maxOutboxReports+5; i++ {
+		timeslots = append(timeslots, i)
+		readings = append(readings, float64(100*i))
+	}
+	meter.setReadings(timeslots, readings)
+	if !c.waitForOutboxNewest(maxOutboxReports + 5) {
+		t.Fatal("reports were not queued")
+	}
+	c.mu.Lock()
+	n, oldest := len(c.outbox), c.outbox[0]
+	c.mu.Unlock()
+	if n != maxOutboxReports || oldest != 6 {
+		t.Fatal("expected the oldest reports to be dropped:", n, oldest)
+	}
+
+	// The outbox survives a restart of the client.
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewClientWithOptions(clientDir, ClientOptions{Meter: meter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := c.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if n := c.outboxLen(); n != maxOutboxReports {
+		t.Fatal("outbox was not loaded:", n)
+	}
+
+	// Bring the server back on the same ports. The outbox gets emptied,
+	// and the server has every report that was in it.
+	gcas, err = server.NewGCAServerWithOptions(serverDir, false, server.ServerOptions{HttpPort: httpPort, TcpPort: tcpPort, UdpPort: udpPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.waitForOutboxLen(0) {
+		t.Fatal("outbox was not emptied:", c.outboxLen())
+	}
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/recent-reports?publicKey=%x", httpPort, c.staticPubKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response server.RecentReportsResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i <= maxOutboxReports+5; i++ {
+		want := uint64(100 * i)
+		if i < 6 {
+			want = 0
+		}
+		if response.Reports[i].PowerOutput != want {
+			t.Fatal("unexpected report at", i, response.Reports[i].PowerOutput)
+		}
+	}
+	if err := gcas.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A report that is too old for the server to accept gets dropped
+	// while the server is still down.
+	timeslots = append(timeslots, 30)
+	readings = append(readings, 3000)
+	meter.setReadings(timeslots, readings)
+	if !c.waitForOutboxNewest(30) {
+		t.Fatal("report was not queued")
+	}
+	glow.SetCurrentTimeslot(30 + outboxWindow + 1)
+	defer glow.SetCurrentTimeslot(0)
+	if !c.waitForOutboxLen(0) {
+		t.Fatal("expired report was not dropped:", c.outboxLen())
+	}
+}
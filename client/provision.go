@@ -0,0 +1,262 @@
+package client
+
+// provision.go contains the steps of onboarding a new device, which
+// bin/gca-provision strings together. The device gets a fresh keypair, the GCA
+// signs an authorization for the public key, the authorization gets submitted
+// to the GCA servers, and the files that the client needs get written into a
+// directory that is copied onto the device as is.
+//
+// Every step can be repeated. The keys and the history file are only created
+// if they don't exist yet, and the other files are written with the same
+// content again, so provisioning the same device twice never changes its keys
+// or loses its history.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// historyLeadTimeslots is how far before the current timeslot the history of
+// a newly provisioned device starts. The files are transferred to a device
+// which may have a different clock, 3 days is generous but inexpensive.
+const historyLeadTimeslots = 3 * 288
+
+// AuthorizationRequest is an authorization that still needs the signature of
+// the GCA, along with the bytes that the GCA has to sign.
+type AuthorizationRequest struct {
+	Authorization glow.EquipmentAuthorization `json:"authorization"`
+	SigningBytes  string                      `json:"signing_bytes"` // hex encoded
+}
+
+// NewAuthorizationRequest returns the request for the GCA to sign the
+// provided authorization. Any signature already on the authorization is
+// dropped.
+func NewAuthorizationRequest(ea glow.EquipmentAuthorization) AuthorizationRequest {
+	ea.Signature = glow.Signature{}
+	return AuthorizationRequest{
+		Authorization: ea,
+		SigningBytes:  hex.EncodeToString(ea.SigningBytes()),
+	}
+}
+
+// Sign attaches the signature of the GCA to the requested authorization, and
+// checks that the signature is valid for the provided GCA key.
+func (ar AuthorizationRequest) Sign(sig glow.Signature, gcaKey glow.PublicKey) (glow.EquipmentAuthorization, error) {
+	ea := ar.Authorization
+	ea.Signature = sig
+	if !glow.Verify(gcaKey, ea.SigningBytes(), ea.Signature) {
+		return glow.EquipmentAuthorization{}, fmt.Errorf("the signature does not match the authorization and the GCA key")
+	}
+	return ea, nil
+}
+
+// SaveAuthorizationRequest writes the request into the provided directory,
+// where it waits for the signature of the GCA.
+func SaveAuthorizationRequest(dir string, ar AuthorizationRequest) error {
+	data, err := json.MarshalIndent(ar, "", "\t")
+	if err != nil {
+		return fmt.Errorf("unable to marshal authorization request: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, AuthorizationRequestFile), data, 0644); err != nil {
+		return fmt.Errorf("unable to write authorization request: %w", err)
+	}
+	return nil
+}
+
+// LoadAuthorizationRequest loads the request in the provided directory, and
+// returns whether there is one.
+func LoadAuthorizationRequest(dir string) (AuthorizationRequest, bool, error) {
+	var ar AuthorizationRequest
+	data, err := os.ReadFile(filepath.Join(dir, AuthorizationRequestFile))
+	if os.IsNotExist(err) {
+		return ar, false, nil
+	}
+	if err != nil {
+		return ar, false, fmt.Errorf("unable to read authorization request: %w", err)
+	}
+	if err := json.Unmarshal(data, &ar); err != nil {
+		return ar, false, fmt.Errorf("unable to decode authorization request: %w", err)
+	}
+	return ar, true, nil
+}
+
+// LoadAuthorization loads the signed authorization in the provided directory,
+// and returns whether there is one. The signature is checked against the
+// provided GCA key.
+func LoadAuthorization(dir string, gcaKey glow.PublicKey) (glow.EquipmentAuthorization, bool, error) {
+	var ea glow.EquipmentAuthorization
+	data, err := os.ReadFile(filepath.Join(dir, AuthorizationFile))
+	if os.IsNotExist(err) {
+		return ea, false, nil
+	}
+	if err != nil {
+		return ea, false, fmt.Errorf("unable to read authorization: %w", err)
+	}
+	if err := json.Unmarshal(data, &ea); err != nil {
+		return ea, false, fmt.Errorf("unable to decode authorization: %w", err)
+	}
+	if !glow.Verify(gcaKey, ea.SigningBytes(), ea.Signature) {
+		return ea, false, fmt.Errorf("the authorization was not signed by the GCA")
+	}
+	return ea, true, nil
+}
+
+// LoadOrCreateClientKeys loads the keypair of the device in the provided
+// directory, and generates and saves a keypair if the directory does not
+// have one yet. A new keypair is encrypted with the passphrase unless it is
+// empty, and the passphrase is needed to load keys that are encrypted, see
+// key_encryption.go.
+func LoadOrCreateClientKeys(dir string, passphrase []byte) (glow.PublicKey, glow.PrivateKey, error) {
+	path := filepath.Join(dir, ClientKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var source PassphraseSource
+		if len(passphrase) > 0 {
+			source = StaticPassphrase(passphrase)
+		}
+		pub, priv, _, err := ParseClientKeys(data, source)
+		return pub, priv, err
+	}
+	if !os.IsNotExist(err) {
+		return glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to read client keyfile: %w", err)
+	}
+
+	pub, priv := glow.GenerateKeyPair()
+	keyData := make([]byte, 64)
+	copy(keyData[:32], pub[:])
+	copy(keyData[32:], priv[:])
+	if len(passphrase) > 0 {
+		keyData, err = EncryptClientKeys(pub, priv, passphrase)
+		if err != nil {
+			return glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to encrypt client keys: %w", err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0744); err != nil {
+		return glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to create device directory: %w", err)
+	}
+	if err := writeKeyFile(path, keyData); err != nil {
+		return glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to write client keys: %w", err)
+	}
+	return pub, priv, nil
+}
+
+// WriteDeviceBundle writes everything that the client needs besides its keys
+// into the provided directory: the authorization, the public key of the GCA,
+// the servers, the ShortID, and the history file. An existing history file is
+// left alone, and the authorization request is removed since the signed
+// authorization replaces it.
+func WriteDeviceBundle(dir string, ea glow.EquipmentAuthorization, gcaKey glow.PublicKey, servers map[glow.PublicKey]GCAServer, currentTimeslot uint32) error {
+	if len(servers) == 0 {
+		return fmt.Errorf("no servers provided")
+	}
+	authData, err := json.Marshal(ea)
+	if err != nil {
+		return fmt.Errorf("unable to marshal equipment authorization: %w", err)
+	}
+	serversData, err := SerializeGCAServerMap(servers)
+	if err != nil {
+		return fmt.Errorf("unable to serialize client server map: %w", err)
+	}
+	var shortIDData [4]byte
+	binary.LittleEndian.PutUint32(shortIDData[:], ea.ShortID)
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{AuthorizationFile, authData},
+		{GCAPubKeyFile, gcaKey[:]},
+		{GCAServerMapFile, serversData},
+		{ShortIDFile, shortIDData[:]},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(dir, f.name), f.data, 0644); err != nil {
+			return fmt.Errorf("unable to write %v: %v", f.name, err)
+		}
+	}
+
+	err = os.Remove(filepath.Join(dir, AuthorizationRequestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove the authorization request: %w", err)
+	}
+
+	historyPath := filepath.Join(dir, HistoryFile)
+	if _, err := os.Stat(historyPath); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("unable to check the history file: %w", err)
+	}
+	var historyStart uint32
+	if currentTimeslot > historyLeadTimeslots {
+		historyStart = currentTimeslot - historyLeadTimeslots
+	}
+	var historyData [4]byte
+	binary.LittleEndian.PutUint32(historyData[:], historyStart)
+	if err := os.WriteFile(historyPath, historyData[:], 0644); err != nil {
+		return fmt.Errorf("unable to write history file header: %w", err)
+	}
+	return nil
+}
+
+// SubmitAuthorization submits a signed equipment authorization to the
+// server. Submitting an authorization that the server already has succeeds.
+func (c *APIClient) SubmitAuthorization(ea glow.EquipmentAuthorization) error {
+	body, err := json.Marshal(ea)
+	if err != nil {
+		return fmt.Errorf("unable to marshal equipment authorization: %w", err)
+	}
+	resp, err := c.staticHTTP.Post(c.URL("/api/v1/authorize-equipment"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return unreachable(err)
+	}
+	defer resp.Body.Close()
+	return ReadAPIError(resp)
+}
+
+// ShortID looks up the device that the provided ShortID was allocated to.
+func (c *APIClient) ShortID(shortID uint32) (server.ShortIDLookup, error) {
+	var lookup server.ShortIDLookup
+	err := c.GetSigned("/api/v1/short-id/"+strconv.FormatUint(uint64(shortID), 10), &lookup)
+	return lookup, err
+}
+
+// sameAuthorization returns whether the server returned the provided
+// authorization. The server redacts the coordinates of a private device, by
+// truncating them to one decimal or by leaving them out, so those count as the
+// same coordinates.
+func sameAuthorization(got, ea glow.EquipmentAuthorization) bool {
+	redacted := got.Latitude == server.RedactCoordinate(ea.Latitude) && got.Longitude == server.RedactCoordinate(ea.Longitude)
+	omitted := got.Latitude == 0 && got.Longitude == 0
+	if redacted || omitted {
+		got.Latitude, got.Longitude = ea.Latitude, ea.Longitude
+	}
+	return got == ea
+}
+
+// VerifyAuthorization checks that the server has the provided authorization,
+// and that the device is active.
+func (c *APIClient) VerifyAuthorization(ea glow.EquipmentAuthorization) error {
+	lookup, err := c.ShortID(ea.ShortID)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("the server does not know ShortID %v", ea.ShortID)
+	} else if err != nil {
+		return err
+	}
+	if lookup.Authorization == nil || !sameAuthorization(*lookup.Authorization, ea) {
+		return fmt.Errorf("ShortID %v belongs to a different authorization on the server", ea.ShortID)
+	}
+	if lookup.Status != "active" {
+		return fmt.Errorf("ShortID %v is %v on the server", ea.ShortID, lookup.Status)
+	}
+	return nil
+}
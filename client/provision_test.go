@@ -0,0 +1,111 @@
+package client
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestProvision walks through the provisioning of a device, and checks that
+// every step can be repeated without changing the keys or the history of the
+// device.
+func TestProvision(t *testing.T) {
+	gcas, dir, gcaPub, gcaPriv, err := server.SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	httpPort, tcpPort, udpPort := gcas.Ports()
+	location := GCAServer{Location: "127.0.0.1", HttpPort: httpPort, TcpPort: tcpPort, UdpPort: udpPort}
+	servers := map[glow.PublicKey]GCAServer{gcas.PublicKey(): location}
+	deviceDir := filepath.Join(dir, "device")
+
+	// The keys are only generated once.
+	pub, priv, err := LoadOrCreateClientKeys(deviceDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub2, priv2, err := LoadOrCreateClientKeys(deviceDir, nil)
+	if err != nil || pub2 != pub || priv2 != priv {
+		t.Fatal("the keys changed:", err)
+	}
+	if _, signed, err := LoadAuthorization(deviceDir, gcaPub); err != nil || signed {
+		t.Fatal("unexpected authorization:", signed, err)
+	}
+
+	// The request survives a round trip through the directory, and only
+	// accepts the signature of the GCA.
+	ar := NewAuthorizationRequest(glow.EquipmentAuthorization{
+		Version:    glow.EquipmentAuthorizationVersionExpiring,
+		ShortID:    1,
+		PublicKey:  pub,
+		Capacity:   1000,
+		Debt:       500,
+		Expiration: 100e6 + glow.CurrentTimeslot(),
+	})
+	if err := SaveAuthorizationRequest(deviceDir, ar); err != nil {
+		t.Fatal(err)
+	}
+	loaded, exists, err := LoadAuthorizationRequest(deviceDir)
+	if err != nil || !exists || loaded != ar {
+		t.Fatal("the request did not round trip:", exists, err)
+	}
+	_, otherPriv := glow.GenerateKeyPair()
+	if _, err := ar.Sign(glow.Sign(ar.Authorization.SigningBytes(), otherPriv), gcaPub); err == nil {
+		t.Fatal("a signature from the wrong key was accepted")
+	}
+	ea, err := ar.Sign(glow.Sign(ar.Authorization.SigningBytes(), gcaPriv), gcaPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server doesn't have the device until it is submitted, and
+	// submitting it again succeeds.
+	api := NewAPIClient(gcas.PublicKey(), location, APIClientOptions{})
+	if err := api.VerifyAuthorization(ea); err == nil {
+		t.Fatal("the authorization was verified before it was submitted")
+	}
+	for i := 0; i < 2; i++ {
+		if err := api.SubmitAuthorization(ea); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := api.VerifyAuthorization(ea); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bundle replaces the request, and keeps an existing history file.
+	if err := WriteDeviceBundle(deviceDir, ea, gcaPub, servers, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, err := LoadAuthorizationRequest(deviceDir); err != nil || exists {
+		t.Fatal("the request was not removed:", exists, err)
+	}
+	loadedEA, signed, err := LoadAuthorization(deviceDir, gcaPub)
+	if err != nil || !signed || loadedEA != ea {
+		t.Fatal("the authorization did not round trip:", signed, err)
+	}
+	history, err := os.ReadFile(filepath.Join(deviceDir, HistoryFile))
+	if err != nil || binary.LittleEndian.Uint32(history) != 1000-historyLeadTimeslots {
+		t.Fatal("unexpected history file:", history, err)
+	}
+	if err := WriteDeviceBundle(deviceDir, ea, gcaPub, servers, 5000); err != nil {
+		t.Fatal(err)
+	}
+	history, err = os.ReadFile(filepath.Join(deviceDir, HistoryFile))
+	if err != nil || binary.LittleEndian.Uint32(history) != 1000-historyLeadTimeslots {
+		t.Fatal("the history file was replaced:", history, err)
+	}
+	serversData, err := os.ReadFile(filepath.Join(deviceDir, GCAServerMapFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedServers, err := UntrustedDeserializeGCAServerMap(serversData)
+	if err != nil || len(loadedServers) != 1 || loadedServers[gcas.PublicKey()] != location {
+		t.Fatal("the servers did not round trip:", err)
+	}
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// connectProxy is an in-process HTTP proxy that only tunnels CONNECT requests
+// which carry its credentials, like the proxies of the sites that don't let
+// anything else out.
+type connectProxy struct {
+	*httptest.Server
+	auth string
+
+	tunnels map[string]int // The number of tunnels by target
+	refused int
+	mu      sync.Mutex
+}
+
+// newConnectProxy starts a proxy that expects the provided credentials.
+func newConnectProxy(user, password string) *connectProxy {
+	p := &connectProxy{
+		auth:    "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)),
+		tunnels: make(map[string]int),
+	}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serveHTTP))
+	return p
+}
+
+// serveHTTP tunnels a CONNECT request to its target.
+func (p *connectProxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		p.mu.Lock()
+		p.refused++
+		p.mu.Unlock()
+		http.Error(w, "only CONNECT is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Proxy-Authorization") != p.auth {
+		p.mu.Lock()
+		p.refused++
+		p.mu.Unlock()
+		w.Header().Set("Proxy-Authenticate", `Basic realm="site"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	p.mu.Lock()
+	p.tunnels[r.Host]++
+	p.mu.Unlock()
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// stats returns the number of tunnels to the target, and the number of
+// requests that got refused.
+func (p *connectProxy) stats(target string) (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tunnels[target], p.refused
+}
+
+// TestReportsThroughProxy checks that a client with a proxy in its options
+// learns the server info of a TLS server through a CONNECT proxy, sends its
+// reports over HTTP first while UDP never got an ack, and that the reports
+// arrive at the server through the proxy.
+func TestReportsThroughProxy(t *testing.T) {
+	if _, err := ParseProxyURL("socks5://127.0.0.1:1080"); err == nil {
+		t.Fatal("a socks proxy was accepted")
+	}
+	if _, err := ParseProxyURL("http://"); err == nil {
+		t.Fatal("a proxy without a host was accepted")
+	}
+
+	// The server serves its API over TLS. The setup of the client
+	// authorizes the device over plain HTTP, so the server only gets its
+	// certificate afterwards.
+	gcas, dir, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	if err := SetupTestEnvironment(clientDir, gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gcas.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.GenerateTestCertificate(filepath.Join(dir, server.TLSCertFile), filepath.Join(dir, server.TLSKeyFile)); err != nil {
+		t.Fatal(err)
+	}
+	gcas, err = server.NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	key := gcas.PublicKey()
+
+	// Nothing listens on the UDP port of the server in the map of the
+	// client, so no report ever gets acked over UDP.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+	pc.Close()
+	httpPort, tcpPort, udpPort := gcas.Ports()
+	blocked := GCAServer{Location: "127.0.0.1", HttpPort: httpPort, TcpPort: tcpPort, UdpPort: deadPort}
+	mapData, err := SerializeGCAServerMap(map[glow.PublicKey]GCAServer{key: blocked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(clientDir, GCAServerMapFile), mapData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := newConnectProxy("glow", "secret")
+	defer proxy.Close()
+	proxyURL := "http://glow:secret@" + proxy.Listener.Addr().String()
+	c, err := NewClientWithOptions(clientDir, ClientOptions{DisableStatus: true, Proxy: proxyURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 100; i++ {
+		if _, exists := c.managedServerInfo(key); exists {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if info, _ := c.managedServerInfo(key); !info.Capabilities.HasFeature(server.FeatureTLS) || !info.Capabilities.HasFeature(server.FeatureHTTPReports) {
+		t.Fatal("the server info was not fetched through the proxy:", info.Capabilities)
+	}
+	target := glow.HostPort("127.0.0.1", httpPort)
+	if tunnels, refused := proxy.stats(target); tunnels == 0 || refused == 0 {
+		t.Fatal("the client did not fall back to a tunnel:", tunnels, refused)
+	}
+	if ts := c.managedReportTransports(key); ts[0] != reportTransportHTTP {
+		t.Fatal("http does not go first behind a proxy:", ts)
+	}
+
+	// The report gets acked through the proxy, and the server has it.
+	eqr := glow.EquipmentReport{ShortID: c.shortID, Timeslot: glow.CurrentTimeslot(), PowerOutput: 500}
+	eqr.Signature = glow.Sign(eqr.SigningBytes(), c.staticPrivKey)
+	before, _ := proxy.stats(target)
+	ack, acked, err := c.staticSendSignedReport(blocked, key, eqr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acked || ack.Status != glow.ReportAckAccepted {
+		t.Fatal("report was not acked through the proxy:", acked, ack)
+	}
+	if after, _ := proxy.stats(target); after <= before {
+		t.Fatal("the report did not go through the proxy:", before, after)
+	}
+	ack, acked, err = SendReportPacketWithAck(eqr, glow.ReportPacketLegacy, glow.HostPort("127.0.0.1", udpPort), key, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acked || ack.Status != glow.ReportAckDuplicate {
+		t.Fatal("the server does not have the report:", acked, ack)
+	}
+
+	// The status shows the transport and the proxy, without the
+	// password.
+	status := c.managedStatus()
+	if len(status.Servers) != 1 || status.Servers[0].Transport != "http" || status.Servers[0].Proxy != "http://glow:xxxxx@"+proxy.Listener.Addr().String() {
+		t.Fatalf("unexpected status: %+v", status.Servers)
+	}
+
+	// The proxy refuses the wrong credentials.
+	wrong, err := ParseProxyURL("http://glow:wrong@" + proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, refusedBefore := proxy.stats(target)
+	if _, err := NewAPIClient(key, blocked, APIClientOptions{UseTLS: true, SkipCertVerify: true, Proxy: wrong}).ServerInfo(); err == nil {
+		t.Fatal("the proxy let the wrong credentials through")
+	}
+	if _, refused := proxy.stats(target); refused != refusedBefore+1 {
+		t.Fatal("the request did not reach the proxy:", refused, refusedBefore)
+	}
+}
@@ -0,0 +1,162 @@
+package client
+
+// report_transport.go lets the client send its reports over HTTP when UDP
+// doesn't get through. Some networks drop UDP traffic outright, and a device
+// behind one of them would otherwise send every report into the void. Servers
+// that advertise server.FeatureHTTPReports accept the exact same packet on
+// /api/v1/equipment-report and answer with the exact same signed ack, so the
+// rest of the client doesn't care which transport a report took.
+//
+// UDP is tried first, because it's much cheaper for the device and for the
+// server. If a report doesn't get acked over UDP, it's sent again over HTTP,
+// and if that gets acked, HTTP is tried first for that server from then on.
+// Sending a report twice is harmless, the second copy is a duplicate.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// reportTransport is a way of getting a report to a server.
+type reportTransport int
+
+const (
+	reportTransportUDP reportTransport = iota
+	reportTransportHTTP
+)
+
+// String implements fmt.Stringer.
+func (rt reportTransport) String() string {
+	if rt == reportTransportHTTP {
+		return "http"
+	}
+	return "udp"
+}
+
+// SubmitReport sends a report to the server over HTTP, in the provided version
+// of the report packet, and returns the ack of the server. Reports that the
+// server refuses to ack surface as an *APIError, and AckError tells whether
+// the ack accepted the report.
+func (c *APIClient) SubmitReport(eqr glow.EquipmentReport, version byte) (glow.ReportAck, error) {
+	packet, err := glow.EncodeReportPacket(eqr, version)
+	if err != nil {
+		return glow.ReportAck{}, err
+	}
+	resp, err := c.staticHTTP.Post(c.URL("/api/v1/equipment-report"), "application/octet-stream", bytes.NewReader(packet))
+	if err != nil {
+		return glow.ReportAck{}, unreachable(err)
+	}
+	defer resp.Body.Close()
+	if err := ReadAPIError(resp); err != nil {
+		return glow.ReportAck{}, err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, glow.ReportAckSize+1))
+	if err != nil {
+		return glow.ReportAck{}, fmt.Errorf("unable to read response: %w", err)
+	}
+	untrustedAck, err := glow.DeserializeReportAck(data)
+	if err != nil {
+		return glow.ReportAck{}, fmt.Errorf("unable to decode ack: %w", err)
+	}
+	if untrustedAck.ShortID != eqr.ShortID || untrustedAck.Timeslot != eqr.Timeslot {
+		return glow.ReportAck{}, errors.New("ack does not match the report")
+	}
+	if !glow.Verify(c.staticServerKey, untrustedAck.SigningBytes(), untrustedAck.Signature) {
+		return glow.ReportAck{}, errors.New("ack is not signed by the gca server")
+	}
+	return untrustedAck, nil
+}
+
+// managedReportTransports returns the transports to try for the provided
+// server, in order.
+func (c *Client) managedReportTransports(gcasKey glow.PublicKey) []reportTransport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reportTransportsOf(gcasKey)
+}
+
+// reportTransportsOf returns the transports to try for the provided server, in
+// order. The transport that last got an ack goes first, and HTTP is only on
+// the list if the server is known to accept reports over HTTP. Before any
+// transport got an ack, HTTP goes first if it goes through a proxy, see
+// proxy.go. The mutex must be held.
+func (c *Client) reportTransportsOf(gcasKey glow.PublicKey) []reportTransport {
+	info, exists := c.serverInfo[gcasKey]
+	if !exists || !info.Capabilities.HasFeature(server.FeatureHTTPReports) {
+		return []reportTransport{reportTransportUDP}
+	}
+	rt, acked := c.reportTransports[gcasKey]
+	if rt == reportTransportHTTP || (!acked && c.proxy(gcasKey) != nil) {
+		return []reportTransport{reportTransportHTTP, reportTransportUDP}
+	}
+	return []reportTransport{reportTransportUDP, reportTransportHTTP}
+}
+
+// managedSetReportTransport remembers the transport that got an ack from the
+// provided server.
+func (c *Client) managedSetReportTransport(gcasKey glow.PublicKey, rt reportTransport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reportTransports[gcasKey] = rt
+}
+
+// managedAPIClientOptions returns the options for talking to the HTTP API of
+// the provided server.
+func (c *Client) managedAPIClientOptions(gcasKey glow.PublicKey) APIClientOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.apiClientOptions(gcasKey)
+}
+
+// apiClientOptions returns the options for talking to the HTTP API of the
+// provided server. The client has no certificate to pin the server to, but
+// everything that it reads from the API is signed by the server anyway. The
+// mutex must be held.
+func (c *Client) apiClientOptions(gcasKey glow.PublicKey) APIClientOptions {
+	opts := APIClientOptions{Proxy: c.staticProxy}
+	if info, exists := c.serverInfo[gcasKey]; exists && info.Capabilities.HasFeature(server.FeatureTLS) {
+		opts.UseTLS, opts.SkipCertVerify = true, true
+	}
+	return opts
+}
+
+// staticSendSignedReport sends a signed report to the provided server over each of
+// its transports in turn, until one of them gets an ack. A report that was
+// sent but never acked returns false with no error, and an error is only
+// returned if the report couldn't be sent at all.
+func (c *Client) staticSendSignedReport(gcas GCAServer, gcasKey glow.PublicKey, eqr glow.EquipmentReport) (glow.ReportAck, bool, error) {
+	version := c.managedReportPacketVersion(gcasKey)
+	var sent bool
+	var sendErr error
+	for _, rt := range c.managedReportTransports(gcasKey) {
+		var ack glow.ReportAck
+		var acked bool
+		var err error
+		if rt == reportTransportHTTP {
+			ack, err = NewAPIClient(gcasKey, gcas, c.managedAPIClientOptions(gcasKey)).SubmitReport(eqr, version)
+			acked = err == nil
+		} else {
+			location := glow.HostPort(gcas.Location, gcas.UdpPort)
+			ack, acked, err = SendReportPacketWithAck(eqr, version, location, gcasKey, c.managedReportAckTimeout(gcasKey))
+		}
+		if err != nil {
+			c.EventLog.Printf("%v report to %v failed: %v", rt, gcas.Location, err)
+			sendErr = err
+			continue
+		}
+		sent = true
+		if acked {
+			c.managedSetReportTransport(gcasKey, rt)
+			return ack, true, nil
+		}
+	}
+	if !sent {
+		return glow.ReportAck{}, false, sendErr
+	}
+	return glow.ReportAck{}, false, nil
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestReportTransportFallback checks that the client falls back to HTTP for a
+// server that it can't reach over UDP, remembers that HTTP worked, and goes
+// back to UDP once HTTP stops working.
+func TestReportTransportFallback(t *testing.T) {
+	gcas, _, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	httpPort, _, udpPort := gcas.Ports()
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	err = SetupTestEnvironment(clientDir, gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(clientDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := gcas.PublicKey()
+	for i := 0; i < 100; i++ {
+		if _, exists := c.managedServerInfo(key); exists {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if info, _ := c.managedServerInfo(key); !info.Capabilities.HasFeature(server.FeatureHTTPReports) {
+		t.Fatal("server does not advertise http reports")
+	}
+
+	ePub, ePriv := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{ShortID: 11, PublicKey: ePub, Capacity: 1e9}
+	if err := gcas.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	newReport := func(timeslot uint32) glow.EquipmentReport {
+		eqr := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: timeslot, PowerOutput: 500}
+		eqr.Signature = glow.Sign(eqr.SigningBytes(), ePriv)
+		return eqr
+	}
+
+	// Nothing listens on the UDP port, so the report has to go over HTTP.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+	pc.Close()
+	blocked := GCAServer{Location: "127.0.0.1", HttpPort: httpPort, UdpPort: deadPort}
+	eqr := newReport(2)
+	ack, acked, err := c.staticSendSignedReport(blocked, key, eqr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acked || ack.Status != glow.ReportAckAccepted {
+		t.Fatal("report was not acked over http:", acked, ack)
+	}
+	if ts := c.managedReportTransports(key); ts[0] != reportTransportHTTP {
+		t.Fatal("http was not remembered:", ts)
+	}
+
+	// The same report over UDP is a duplicate.
+	location := glow.HostPort("127.0.0.1", udpPort)
+	ack, acked, err = SendReportPacketWithAck(eqr, glow.ReportPacketLegacy, location, key, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acked || ack.Status != glow.ReportAckDuplicate {
+		t.Fatal("report was not a duplicate over udp:", acked, ack)
+	}
+
+	// Once HTTP stops working, the client goes back to UDP.
+	noHTTP := GCAServer{Location: "127.0.0.1", HttpPort: 1, UdpPort: udpPort}
+	ack, acked, err = c.staticSendSignedReport(noHTTP, key, newReport(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acked || ack.Status != glow.ReportAckAccepted {
+		t.Fatal("report was not acked over udp:", acked, ack)
+	}
+	if ts := c.managedReportTransports(key); ts[0] != reportTransportUDP {
+		t.Fatal("udp was not remembered:", ts)
+	}
+
+	// A server that doesn't accept reports over HTTP is only ever sent
+	// reports over UDP.
+	oldKey, _ := glow.GenerateKeyPair()
+	c.mu.Lock()
+	c.serverInfo[oldKey] = server.ServerInfoResponse{Capabilities: server.ServerCapabilities{Features: []string{server.FeatureReportAcks}}}
+	c.mu.Unlock()
+	if ts := c.managedReportTransports(oldKey); len(ts) != 1 || ts[0] != reportTransportUDP {
+		t.Fatal("unexpected transports:", ts)
+	}
+}
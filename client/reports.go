@@ -8,16 +8,14 @@ package client
 import (
 	"crypto/rand"
 	"encoding/binary"
-	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"net"
 	"os"
-	"path"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"sync/atomic"
 	"time"
 
@@ -31,8 +29,19 @@ type EnergyRecord struct {
 	Energy   uint64
 }
 
-// Create an energy report from the provided energy record.
-func (c *Client) staticSendReport(gcas GCAServer, er EnergyRecord) {
+// Create an energy report from the provided energy record and send it to the
+// server, falling back to the failover servers. If no server acks the report,
+// it goes into the outbox to be retried later.
+func (c *Client) staticSendReport(gcas GCAServer, gcasKey glow.PublicKey, er EnergyRecord) {
+	if !c.staticDeliverReport(gcas, gcasKey, er) {
+		c.managedQueueReport(er.Timeslot)
+	}
+}
+
+// staticSubmitReport will sign a report for the provided energy record, send it
+// to the server, and return whether the server acked it. Acks get recorded, so
+// that the report doesn't get sent to the same server again.
+func (c *Client) staticSubmitReport(gcas GCAServer, gcasKey glow.PublicKey, er EnergyRecord) bool {
 	eqr := glow.EquipmentReport{
 		ShortID:     c.shortID,
 		Timeslot:    er.Timeslot,
@@ -40,91 +49,188 @@ func (c *Client) staticSendReport(gcas GCAServer, er EnergyRecord) {
 	}
 	sb := eqr.SigningBytes()
 	eqr.Signature = glow.Sign(sb, c.staticPrivKey)
-	data := eqr.Serialize()
-	location := fmt.Sprintf("%v:%v", gcas.Location, gcas.UdpPort)
-	if err := glow.SendUDPReport(data, location); err != nil {
-		c.EventLog.Printf("udp report to %v failed: %v", gcas.Location, err)
-		return
+	ack, acked, err := c.staticSendSignedReport(gcas, gcasKey, eqr)
+	if err != nil {
+		return false
 	}
 	// Report file is updated on a successful send, in order to validate that the networking
 	// is working correctly.
-	err := c.updateReportFile()
+	err = c.updateReportFile()
 	if err != nil {
 		c.EventLog.Printf("unable to update report file: %v", err)
 	}
+	// A server that can't store the report asks for it to be sent again
+	// later, so the report is treated as if it was never acked.
+	ackErr := AckError(ack)
+	if acked && errors.Is(ackErr, ErrStorageUnavailable) {
+		c.EventLog.Printf("server %v can't store reports right now, keeping the report for timeslot %v", gcas.Location, er.Timeslot)
+		return false
+	}
+	if acked && ackErr != nil {
+		c.EventLog.Printf("server %v did not accept the report for timeslot %v: %v", gcas.Location, er.Timeslot, ackErr)
+	}
+	if acked {
+		c.managedRecordAck(gcasKey, er.Timeslot)
+	}
+	return acked
+}
+
+// SendReportWithAck sends an equipment report to the provided location and
+// then waits up to 'timeout' for the server to send back a signed ack. If no
+// valid ack arrives in time, the report has still been sent and the call
+// falls back to fire-and-forget behavior by returning false with no error.
+// Packets that don't carry a valid signature from 'serverKey' or that don't
+// match the report are ignored. AckError tells whether the ack accepted the
+// report.
+//
+// The report is sent in the legacy packet layout, which every server accepts.
+func SendReportWithAck(eqr glow.EquipmentReport, location string, serverKey glow.PublicKey, timeout time.Duration) (glow.ReportAck, bool, error) {
+	return SendReportPacketWithAck(eqr, glow.ReportPacketLegacy, location, serverKey, timeout)
 }
 
-// staticReadEnergyFile will read the data from the energy file and return an array
-// that contains all of the values.
-func (c *Client) staticReadEnergyFile() ([]EnergyRecord, error) {
-	// Open the CSV file. We do a quick conditional check because in prod
-	// the energy file is located in an absolute location rather than being
-	// part of the energy monitor directory, but in testing the location is
-	// in the energy monitor directory so that multiple clients can use
-	// different energy monitor files during testing.
-	filePath := EnergyFile
-	if EnergyFile[0] != '/' {
-		filePath = path.Join(c.staticBaseDir, EnergyFile)
-	}
-
-	// Read the file all at once, to avoid any potential issues if it
-	// is modified while being parsed.
-	data, err := os.ReadFile(filePath)
+// SendReportPacketWithAck is the same as SendReportWithAck, but sends the
+// report in the provided version of the report packet.
+func SendReportPacketWithAck(eqr glow.EquipmentReport, version byte, location string, serverKey glow.PublicKey, timeout time.Duration) (glow.ReportAck, bool, error) {
+	packet, err := glow.EncodeReportPacket(eqr, version)
+	if err != nil {
+		return glow.ReportAck{}, false, err
+	}
+	conn, err := net.Dial("udp", location)
+	if err != nil {
+		return glow.ReportAck{}, false, unreachable(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
 	if err != nil {
-		c.EventLog.Printf("unable to read monitoring file: %v", err)
-		return nil, fmt.Errorf("unable to read monitoring file: %v", err)
+		return glow.ReportAck{}, false, fmt.Errorf("unable to send report: %w", unreachable(err))
 	}
 
-	// Iterate over the CSV records
-	reader := csv.NewReader(strings.NewReader(string(data)))
-	var records []EnergyRecord
+	err = conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return glow.ReportAck{}, false, fmt.Errorf("unable to set read deadline: %w", err)
+	}
+	buf := make([]byte, glow.ReportAckSize+1)
 	for {
-		record, err := reader.Read()
+		n, err := conn.Read(buf)
 		if err != nil {
-			// Stop at EOF or on error. An error here means we
-			// couldn't read a timestamp, which means we don't know
-			// what timestamp to tell the server for having errors.
-			// Whether it's an EOF or a real error, the best move
-			// is to break.
-			if err != io.EOF {
-				c.EventLog.Printf("unexpected error on energy file record read: %v", err)
-			}
-			break
+			// Nothing usable arrived before the deadline, the
+			// report was sent without an ack.
+			return glow.ReportAck{}, false, nil
 		}
-
-		timestamp, err := strconv.ParseInt(record[0], 10, 64)
+		untrustedAck, err := glow.DeserializeReportAck(buf[:n])
 		if err != nil {
-			// If the timestamp can't be read, we don't know what
-			// timestamp to submit to the server as having an
-			// error, we just ignore the read in this case.
-
-			// Reading the header line is an expected error here.
-			if record[0] != "timestamp" {
-				c.EventLog.Printf("invalid timestamp in energy file: %v", record[0])
-			}
 			continue
 		}
-		timeslot, err := glow.UnixToTimeslot(timestamp)
+		if untrustedAck.ShortID != eqr.ShortID || untrustedAck.Timeslot != eqr.Timeslot {
+			continue
+		}
+		if !glow.Verify(serverKey, untrustedAck.SigningBytes(), untrustedAck.Signature) {
+			continue
+		}
+		return untrustedAck, true, nil
+	}
+}
+
+// maxClockSkew is the largest difference between the clock of the device and
+// the clock of the server that the client tolerates without a warning. Beyond
+// half a timeslot, readings start to get signed for the wrong timeslot.
+const maxClockSkew = 150 * time.Second
+
+// CheckClockDrift sends a time probe to the provided location and returns how
+// far the local clock is ahead of the clock of the server. A negative skew
+// means that the local clock is behind. The local time is taken at the middle
+// of the round trip, so the error of the measurement is at most half of the
+// round trip time. Packets that don't carry a valid signature from 'serverKey'
+// or that don't match the probe are ignored.
+func CheckClockDrift(location string, serverKey glow.PublicKey, timeout time.Duration) (time.Duration, error) {
+	var nonceBytes [8]byte
+	if _, err := rand.Read(nonceBytes[:]); err != nil {
+		return 0, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+	tp := glow.TimeProbe{Nonce: binary.LittleEndian.Uint64(nonceBytes[:])}
+
+	conn, err := net.Dial("udp", location)
+	if err != nil {
+		return 0, unreachable(err)
+	}
+	defer conn.Close()
+	sent := time.Now()
+	_, err = conn.Write(tp.Serialize())
+	if err != nil {
+		return 0, fmt.Errorf("unable to send time probe: %w", unreachable(err))
+	}
+
+	err = conn.SetReadDeadline(sent.Add(timeout))
+	if err != nil {
+		return 0, fmt.Errorf("unable to set read deadline: %w", err)
+	}
+	buf := make([]byte, glow.TimeProbeResponseSize+1)
+	for {
+		n, err := conn.Read(buf)
 		if err != nil {
-			// If the timeslot can't be determined, we don't know
-			// what timeslot to submit to the server as having an
-			// error, we just ignore the read in this case.
-			c.EventLog.Printf("invalid timeslot conversion in energy file: %v", record[0])
+			return 0, fmt.Errorf("no response to the time probe: %w", unreachable(err))
+		}
+		received := time.Now()
+		untrustedResp, err := glow.DeserializeTimeProbeResponse(buf[:n])
+		if err != nil || untrustedResp.Nonce != tp.Nonce {
+			continue
+		}
+		if !glow.Verify(serverKey, untrustedResp.SigningBytes(), untrustedResp.Signature) {
 			continue
 		}
+		local := sent.Add(received.Sub(sent) / 2)
+		return local.Sub(time.UnixMilli(untrustedResp.UnixMilli)), nil
+	}
+}
+
+// staticCheckClockDrift measures the clock drift against the provided server
+// and logs a warning if the drift is large enough to put readings into the
+// wrong timeslot.
+func (c *Client) staticCheckClockDrift(gcas GCAServer, gcasKey glow.PublicKey) {
+	location := glow.HostPort(gcas.Location, gcas.UdpPort)
+	skew, err := CheckClockDrift(location, gcasKey, clockProbeTimeout)
+	if err != nil {
+		c.EventLog.Printf("unable to check clock drift against %v: %v", gcas.Location, err)
+		return
+	}
+	c.mu.Lock()
+	c.clockSkew = skew
+	c.clockSkewTime = time.Now()
+	c.mu.Unlock()
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		c.EventLog.Printf("WARNING: the local clock is off by %v compared to %v", skew, gcas.Location)
+	}
+}
+
+// staticReadMeter will read the readings from the meter and return an array
+// that contains all of the values, converted to the energy values that get
+// reported to the server.
+func (c *Client) staticReadMeter() ([]EnergyRecord, error) {
+	readings, err := c.staticMeter.Readings()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read meter: %w", err)
+	}
+	caps := c.staticMeter.Capabilities()
+
+	var records []EnergyRecord
+	for _, reading := range readings {
+		// The EnergyMultiplier needs to be applied in advance of the
+		// conversion, otherwise the multiplier would be multiplying a
+		// giant uint64 by 4 rather than a negative number by 4.
+		scaled := reading.Energy
+		if caps.CTScaling {
+			scaled = c.energyMultiplier * reading.Energy / c.energyDivider
+		}
 
-		// Parse the value. If the value is not parsed correctly, it's
-		// probably because the firmware version is wrong or because
-		// the file has a text error instead of a number.
 		var energy uint64
-		energyF64, err := strconv.ParseFloat(record[1], 64)
-		if err != nil {
-			// In the event of a parse error for the energy reading
-			// for this timestamp, set the value to '3' to indicate
-			// that there was a parse error.
-			c.EventLog.Printf("invalid energy value in energy file: %v", record[1])
-			energy = 3
-		} else if energyF64 > -24 && energyF64 < 24 {
+		if reading.Invalid || (!caps.Bidirectional && reading.Energy < 0) || math.Abs(scaled) > glow.MaxPowerOutput {
+			// In the event of a bad reading for this timestamp,
+			// set the value to '3' to indicate that there was a
+			// parse error. A reading that is too large for any
+			// equipment is just as bad, the server would only
+			// flag it as garbage.
+			energy = glow.PowerOutputMeterFault
+		} else if reading.Energy > -24 && reading.Energy < 24 {
 			// If the energy value read successfully but it read
 			// below an absolute value of 24, set the value to '2'
 			// to indicate that there was a reading that
@@ -137,24 +243,18 @@ func (c *Client) staticReadEnergyFile() ([]EnergyRecord, error) {
 			// Note that the sentinel value '1' is already reserve
 			// to indicate that the gca server has banned a
 			// timeslot.
-			energy = 2
+			energy = glow.PowerOutputIdle
 		} else {
-			// NOTE: 'energy' might be a negative number, which will cast
-			// as an underflowed uint64. To the best of my knowledge, there
-			// is nothing wrong with that, but all downstream applications
-			// will have to accept the numbers and know to convert them to
-			// their respective negative values.
-			//
-			// The EnergyMultiplier needs to be applied in advance
-			// of performing the underflow conversion, otherwise
-			// the multiplier will be multiplying a giant uint64 by
-			// 4 rather than multiplying a negative number by 4.
-			energy = uint64(c.energyMultiplier * energyF64 / c.energyDivider)
+			// NOTE: 'energy' might be a negative number, which is
+			// sent in two's complement by way of an int64. Going
+			// straight from a negative float64 to a uint64 is not
+			// defined, see glow.PowerReading.
+			energy = uint64(int64(scaled))
 		}
 
 		// Append the data to the records slice
 		records = append(records, EnergyRecord{
-			Timeslot: timeslot,
+			Timeslot: reading.Timeslot,
 			Energy:   energy,
 		})
 	}
@@ -181,17 +281,17 @@ func (c *Client) staticServerSync(gcas GCAServer, gcasKey glow.PublicKey, gcaKey
 	// Open a TCP connection and send our shortID as the request. The
 	// server will respond with a bunch of information that will allow the
 	// client to remain synchronized with the GCA server.
-	location := fmt.Sprintf("%v:%v", gcas.Location, gcas.TcpPort)
+	location := glow.HostPort(gcas.Location, gcas.TcpPort)
 	conn, err := net.Dial("tcp", location)
 	if err != nil {
-		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("unable to dial the gca server: %v", err)
+		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, unreachable(err)
 	}
 	defer conn.Close()
 	var buf [4]byte
 	binary.LittleEndian.PutUint32(buf[:], c.shortID)
 	_, err = conn.Write(buf[:])
 	if err != nil {
-		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("unable to send reqeust to gca server: %v", err)
+		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("unable to send reqeust to gca server: %w", unreachable(err))
 	}
 
 	// Receive the response length, which is a two byte prefix to the
@@ -200,7 +300,7 @@ func (c *Client) staticServerSync(gcas GCAServer, gcasKey glow.PublicKey, gcaKey
 	var respLenBuf [2]byte
 	_, err = io.ReadFull(conn, respLenBuf[:])
 	if err != nil {
-		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("unable to read the response length: %v", err)
+		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("unable to read the response length: %w", unreachable(err))
 	}
 	respLen := binary.LittleEndian.Uint16(respLenBuf[:])
 
@@ -208,10 +308,10 @@ func (c *Client) staticServerSync(gcas GCAServer, gcasKey glow.PublicKey, gcaKey
 	respBuf := make([]byte, respLen)
 	n, err := io.ReadFull(conn, respBuf)
 	if err != nil {
-		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("unable to read response from gca server: %v", err)
+		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("unable to read response from gca server: %w", unreachable(err))
 	}
 	if n != int(respLen) {
-		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("server did not send enough data: %v", err)
+		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("server did not send enough data: %w", err)
 	}
 
 	// Verify the signature. No safety checks are needed here, as any
@@ -225,7 +325,7 @@ func (c *Client) staticServerSync(gcas GCAServer, gcasKey glow.PublicKey, gcaKey
 	var sig glow.Signature
 	copy(sig[:], respBuf[respLen-64:])
 	if !glow.Verify(gcasKey, respBuf[:respLen-64], sig) {
-		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("received response from server with invalid signature: %v", err)
+		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("received response from server with invalid signature: %w", err)
 	}
 
 	// Extract the constant length fields. No safety checks are needed, as
@@ -247,54 +347,33 @@ func (c *Client) staticServerSync(gcas GCAServer, gcasKey glow.PublicKey, gcaKey
 		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("equipment appears to have the wrong short id, expected %x and got %x", c.staticPubKey, equipmentKey)
 	}
 
-	// Ensure that if there's a new GCA, the signature authorizing the GCA
-	// migration for the device is valid and comes from the current GCA. No
-	// safety checks are needed, as all values are binary values with no
-	// invariants.
-	var blank glow.PublicKey
-	migrationBytes := append(equipmentKey[:], respBuf[540:respLen-(64+72)]...)
-	newGCASigningBytes := append([]byte("EquipmentMigration"), migrationBytes...)
-	if newGCA != blank && !glow.Verify(gcaKey, newGCASigningBytes, newGCASignature) {
-		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("received new GCA from server with invalid signature")
-	}
-
-	// Extract the variable length fields. Safety checks are needed for
-	// each iteration to ensure that the respLen is long enough to hold the
-	// next pieces of data. The respLen needs to be checked once for
-	// reading all of the fields up to the locationLen, and then again for
-	// reading all of the fields after the locationLen. Can't do it in one
-	// go because we don't know the locationLen until after it is read.
+	// Extract the variable length fields. The servers are decoded from a
+	// slice that ends before the migration signature, so a server can't
+	// run into the fields that follow it.
 	i := 576
 	end := int(respLen) - (72 + 64)
 	for i < end {
-		// Check that there are enough bytes to read up to the
-		// locationLen.
-		if i+34 > end {
-			return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("unable to decode authorized servers due to length mismatches: %v > %v", i+34, end)
-		}
-		var as server.AuthorizedServer
-		copy(as.PublicKey[:], respBuf[i:i+32])
-		i += 32
-		as.Banned = respBuf[i] != 0
-		i += 1
-		locationLen := int(respBuf[i])
-		i += 1
-		if i+locationLen+70 > end {
-			return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("unable to decode authorized servers due to length mismatches: %v > %v", i+locationLen+70, end)
-		}
-		as.Location = string(respBuf[i : i+locationLen])
-		i += locationLen
-		as.HttpPort = binary.LittleEndian.Uint16(respBuf[i : i+2])
-		i += 2
-		as.TcpPort = binary.LittleEndian.Uint16(respBuf[i : i+2])
-		i += 2
-		as.UdpPort = binary.LittleEndian.Uint16(respBuf[i : i+2])
-		i += 2
-		copy(as.GCAAuthorization[:], respBuf[i:])
-		i += 64
+		as, n, err := server.DeserializeAuthorizedServer(respBuf[i:end])
+		if err != nil {
+			return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("unable to decode authorized servers: %w", err)
+		}
+		i += n
 		gcaServers = append(gcaServers, as)
 	}
 
+	// Ensure that if there's a new GCA, the signature authorizing the GCA
+	// migration for the device is valid and comes from the current GCA.
+	var blank glow.PublicKey
+	migration := server.EquipmentMigration{
+		Equipment:  equipmentKey,
+		NewGCA:     newGCA,
+		NewShortID: newShortID,
+		NewServers: gcaServers,
+	}
+	if newGCA != blank && !glow.Verify(gcaKey, migration.SigningBytes(), newGCASignature) {
+		return 0, [504]byte{}, glow.PublicKey{}, 0, nil, fmt.Errorf("received new GCA from server with invalid signature")
+	}
+
 	// Verify all of the signatures on the authorized servers. If there's a
 	// new GCA, it's assumed that all of the new servers being presented
 	// are related to the migration.
@@ -487,22 +566,9 @@ func (c *Client) threadedSyncWithServer(latestReading uint32) bool {
 		c.gcaServers = newServers
 	} else {
 		// Update the server map based on the new list of gca servers.
-		// Specifcially we want to look for new servers, as well as
-		// servers that are now banned. This code runs conditionally
-		// because other code handles updating the gcaServers if
-		// there's a gca migration.
-		for _, s := range gcaServers {
-			_, exists := c.gcaServers[s.PublicKey]
-			if !exists || s.Banned {
-				c.gcaServers[s.PublicKey] = GCAServer{
-					Banned:   s.Banned,
-					Location: s.Location,
-					HttpPort: s.HttpPort,
-					TcpPort:  s.TcpPort,
-					UdpPort:  s.UdpPort,
-				}
-			}
-		}
+		// This code runs conditionally because other code handles
+		// updating the gcaServers if there's a gca migration.
+		c.mergeAuthorizedServers(gcaServers)
 	}
 	raw, err := SerializeGCAServerMap(c.gcaServers)
 	if err != nil {
@@ -534,6 +600,12 @@ func (c *Client) threadedSyncWithServer(latestReading uint32) bool {
 			if err != nil || powerOutput < 2 {
 				continue
 			}
+			// A server that acked a report but still lists it
+			// as missing has rejected it, and would only
+			// reject it again.
+			if c.managedHasAck(gcasKey, i+timeslotOffset) {
+				continue
+			}
 			// Because we now handle negative numbers, the uint32
 			// needs to be cast to an int32 before being upscaled
 			// to a uint64.
@@ -542,7 +614,7 @@ func (c *Client) threadedSyncWithServer(latestReading uint32) bool {
 				Energy:   uint64(int32(powerOutput)),
 			}
 			time.Sleep(UDPSleepSyncTime)
-			c.staticSendReport(gcas, record)
+			c.staticSendReport(gcas, gcasKey, record)
 			reportsSent++
 		}
 	}
@@ -564,15 +636,34 @@ func (c *Client) threadedSyncWithServer(latestReading uint32) bool {
 	return true
 }
 
+// sendState is the state of the loop that sends the reports of a device. It
+// is only used by one iteration of the loop at a time.
+type sendState struct {
+	started      bool
+	latestRecord uint32
+	syncStatus   uint64 // 1 if the most recent sync succeeded, accessed atomically
+	ticks        int
+	busy         uint32 // 1 while an iteration runs, accessed atomically
+}
+
 // launchSendReports will create the infinite loop that sends reports to the
 // server.
 func (c *Client) launchSendReports() {
+	s := new(sendState)
+	c.managedSendIteration(s)
+	c.tg.Launch(func() {
+		c.threadedSendReports(s)
+	})
+}
+
+// managedSaveExistingReadings is the first iteration of the loop that sends
+// reports. It saves the existing readings and checks whether a sync is due.
+func (c *Client) managedSaveExistingReadings(s *sendState) {
 	// Right at startup, we save all of the existing records. We don't
 	// bother sending them because we assume we already sent them, and if
 	// we haven't already sent them, the periodic synchronization will fix
 	// everything up.
-	latestRecord := uint32(0)
-	records, err := c.staticReadEnergyFile()
+	records, err := c.staticReadMeter()
 	// We'll no-op if there's an error. One error that gets caught is if
 	// the monitoring equipment saves a duplicate reading. The monitoring
 	// equipment shouldn't have this issue, because it should be doing
@@ -600,14 +691,23 @@ func (c *Client) launchSendReports() {
 			if err != nil {
 				continue
 			}
-			if record.Timeslot > latestRecord {
-				latestRecord = record.Timeslot
+			if record.Timeslot > s.latestRecord {
+				s.latestRecord = record.Timeslot
 			}
 		}
 	}
-	c.tg.Launch(func() {
-		c.threadedSendReports(latestRecord)
-	})
+	c.managedSetMeterError(err)
+
+	// The device has a file on it which tracks the time of the most recent
+	// successful sync. If the file indicates that the most recent
+	// successful sync was more than 4.5 hours ago, the syncStatus is set
+	// to indicate that the most recent sync failed, which will trigger a
+	// new sync attempt within 18 minutes of startup.
+	isRecent, err := c.isRecentSync()
+	if isRecent && err == nil {
+		atomic.StoreUint64(&s.syncStatus, 1)
+	}
+	s.ticks = 30
 }
 
 // threadedSendReports will periodically check for new readings in the energy
@@ -616,121 +716,163 @@ func (c *Client) launchSendReports() {
 // is made to confirm that the report reached its destination. There is a
 // separate synchronization process that occurs at much larger intervals, which
 // will re-send any reports that failed to be delivered on their first attempt.
-func (c *Client) threadedSendReports(latestRecord uint32) {
+func (c *Client) threadedSendReports(s *sendState) {
 	// Create an infinite loop to send reports to the server. Reports are
-	// sent roughly every 4.5 minutes, which is slightly faster than the
-	// pace at which the monitoring box creates energy readings.
+	// sent once per timeslot, shortly after the start of the timeslot, which
+	// is when the monitoring box has written the reading of the timeslot
+	// that just ended. The loop follows the timeslot boundaries rather than
+	// sleeping a fixed interval, so the reports don't drift through the
+	// timeslot.
 	//
 	// The monitoring box uses a cellular network, which has very expensive
 	// bandwidth. To minimize total bandwidth use, udp is used for sending
 	// reports rather than TCP. Logging has shown that the success rate is
 	// usually >95%, though at times it has dropped as low as 60%.
-	//
-	// Roughly every 4.5 hours, a sync operation is performed with the
-	// server. The frequency of the sync operation is managed with a value
-	// called 'ticks'. The sync operation will check wih the server to
-	// identify any reports that got lost while sending over UDP, and it
-	// will resend them. The sync operation itself uses tcp.
-	//
-	// If the sync operation fails, another sync opertaion is attempted
-	// roughly 18 minutes later.
-	//
-	// The device has a file on it which tracks the time of the most recent
-	// successful sync. Right as the loop starts, that file is checked. If
-	// the file indicates that the most recent successful sync was more
-	// than 4.5 hours ago, the syncStatus is set to indicate that the most
-	// recent sync failed, which will trigger a new sync attempt within 18
-	// minutes of startup.
-	var syncStatus uint64
-	isRecent, err := c.isRecentSync()
-	if !isRecent || err != nil {
-		syncStatus = 0
-	} else {
-		syncStatus = 1
-	}
-	ticks := 30
+	ticker := glow.NewTimeslotTicker(nil, sendReportMaxWait)
 	for {
 		// Check if the server has shut down.
 		if c.tg.IsStopped() {
 			return
 		}
 
-		// Grab the gca server for use when sending the report.
-		c.mu.Lock()
-		gcas := c.gcaServers[c.primaryServer]
-		c.mu.Unlock()
-
-		// Read the energy file. No-op if there's an error. Can't
-		// continue because we still want to sleep.
-		records, err := c.staticReadEnergyFile()
-		if err == nil {
-			for _, record := range records {
-				// We try saving the reading first, which can
-				// produce an error. The main error that we are
-				// looking for is a double report error, which
-				// means the same timeslot has multiple
-				// different energy readings. That's a problem
-				// that will cause the timeslot to get banned,
-				// so we don't send the report if that happens.
-				//
-				// Even if the error is not a double report
-				// error, we don't want to send the server a
-				// reading that we aren't able to persist
-				// ourselves, because that could indicate other
-				// issues such as faulty hardware, and
-				// therefore the readings may not be accurate.
-				err := c.staticSaveReading(record.Timeslot, uint32(record.Energy))
-				if err != nil {
-					continue
-				}
-				if record.Timeslot > latestRecord {
-					c.staticSendReport(gcas, record)
-				}
-			}
-			// The above loop doesn't update the latestRecord
-			// because if there are multiple new records we want to
-			// send all of them, and then update the latest record
-			// after all outstanding readings have been sent.
-			for _, record := range records {
-				if record.Timeslot > latestRecord {
-					latestRecord = record.Timeslot
-				}
-			}
+		// Wait for the next timeslot, and then sleep before checking
+		// the file again. The sleep includes both a standard delay and
+		// a random extra amount of time. The randomization helps
+		// multiple devices to spread out over a larger interval when
+		// sending information to the server, hopefully preventing the
+		// server from being in a situation where all of the hardware
+		// is sending it data in the same 3 seconds followed by 5
+		// minutes of absolutely no activity.
+		if _, ok := ticker.Next(c.tg.StopChan()); !ok {
+			return
 		}
-
-		// Sleep before checking the file again. The sleep includes
-		// both a standard time and a random extra amount of time. The
-		// randomization helps multiple devices to spread out over a
-		// larger interval when sending information to the server,
-		// hopefully preventing the server from being in a situation
-		// where all of the hardware is sending it data in the same 3
-		// seconds followed by 5 minutes of absolutely no activity.
-		if !c.tg.Sleep(sendReportTime + randomTimeExtension()) {
+		if !c.tg.Sleep(sendReportDelay + randomTimeExtension()) {
 			return
 		}
+		c.managedSendIteration(s)
+	}
+}
+
+// managedSendIteration runs one iteration of the loop that sends reports. The
+// first iteration saves the readings that exist at startup, every later
+// iteration advances the sync schedule and then sends the new readings.
+func (c *Client) managedSendIteration(s *sendState) {
+	if !s.started {
+		s.started = true
+		c.managedSaveExistingReadings(s)
+		return
+	}
+	c.managedTickSync(s)
+	c.managedSendNewReadings(s)
+}
+
+// managedSendNewReadings will read the meter and send a report for every
+// reading that is newer than the latest record.
+func (c *Client) managedSendNewReadings(s *sendState) {
+	// Grab the gca server for use when sending the report.
+	c.mu.Lock()
+	gcasKey := c.primaryServer
+	gcas := c.gcaServers[gcasKey]
+	c.mu.Unlock()
 
-		// Once every 60 iterations a server sync is performed. That's
-		// about 4.5 hours per sync operation. The syncStatus variable
-		// tracks whether the previous sync operation was successful.
-		// If the previous sync was unsuccessful, another sync is
-		// attempted quickly.
+	// Read the energy file. No-op if there's an error.
+	records, err := c.staticReadMeter()
+	c.managedSetMeterError(err)
+	if err != nil {
+		return
+	}
+	var held []EnergyRecord
+	for _, record := range records {
+		// We try saving the reading first, which can produce an
+		// error. The main error that we are looking for is a double
+		// report error, which means the same timeslot has multiple
+		// different energy readings. That's a problem that will cause
+		// the timeslot to get banned, so we don't send the report if
+		// that happens.
 		//
-		// The modulus means that a re-attempt of a sync will have to
-		// wait at least 4 ticks, which is about 18 minutes. This gives
-		// the previous sync attempt a generous amount of time to
-		// complete. The cell network for the monitoring devices can be
-		// quite slow, 18 minutes should be ample time though.
-		ticks++
-		if ticks >= 60 || (atomic.LoadUint64(&syncStatus) == 0 && ticks % 4 == 3) {
-			ticks = 0
-			c.tg.Launch(func() {
-				success := c.threadedSyncWithServer(latestRecord)
-				if success {
-					atomic.StoreUint64(&syncStatus, 1)
-				} else {
-					atomic.StoreUint64(&syncStatus, 0)
-				}
-			})
+		// Even if the error is not a double report error, we don't
+		// want to send the server a reading that we aren't able to
+		// persist ourselves, because that could indicate other issues
+		// such as faulty hardware, and therefore the readings may not
+		// be accurate.
+		err := c.staticSaveReading(record.Timeslot, uint32(record.Energy))
+		if err != nil {
+			continue
+		}
+		if record.Timeslot > s.latestRecord && c.staticSchedule.active() {
+			c.managedQueueReport(record.Timeslot)
+			held = append(held, record)
+		} else if record.Timeslot > s.latestRecord {
+			c.staticSendReport(gcas, gcasKey, record)
+			c.staticSendHeartbeat(gcas, gcasKey, record)
 		}
 	}
+	// With a transmit schedule, the new readings wait in the outbox until
+	// the schedule transmits, and only the readings of a transmission get
+	// heartbeats.
+	if len(held) > 0 && !c.managedHoldReports() {
+		c.managedRetryOutbox()
+		for _, record := range held {
+			c.staticSendHeartbeat(gcas, gcasKey, record)
+		}
+	}
+	// The above loop doesn't update the latestRecord because if there are
+	// multiple new records we want to send all of them, and then update
+	// the latest record after all outstanding readings have been sent.
+	for _, record := range records {
+		if record.Timeslot > s.latestRecord {
+			s.latestRecord = record.Timeslot
+		}
+	}
+	c.managedSetLastReading(records)
+}
+
+// managedTickSync advances the sync schedule by one iteration of the loop that
+// sends reports, and launches a sync when one is due.
+//
+// Roughly every 4.5 hours, a sync operation is performed with the server. The
+// sync operation will check wih the server to identify any reports that got
+// lost while sending over UDP, and it will resend them. The sync operation
+// itself uses tcp. If the sync operation fails, another sync opertaion is
+// attempted roughly 18 minutes later.
+func (c *Client) managedTickSync(s *sendState) {
+	// Once every 60 iterations a server sync is performed. That's about
+	// 4.5 hours per sync operation. The syncStatus variable tracks whether
+	// the previous sync operation was successful. If the previous sync was
+	// unsuccessful, another sync is attempted quickly.
+	//
+	// The modulus means that a re-attempt of a sync will have to wait at
+	// least 4 ticks, which is about 18 minutes. This gives the previous
+	// sync attempt a generous amount of time to complete. The cell network
+	// for the monitoring devices can be quite slow, 18 minutes should be
+	// ample time though.
+	//
+	// A sync that comes due while the transmit schedule holds the reports
+	// back waits for the next transmission.
+	s.ticks++
+	if s.ticks < 60 && !(atomic.LoadUint64(&s.syncStatus) == 0 && s.ticks%4 == 3) {
+		return
+	}
+	if c.managedHoldReports() {
+		return
+	}
+	s.ticks = 0
+	latestRecord := s.latestRecord
+	// The clock drift gets checked as often as the server gets synced
+	// with, the probe costs less than two reports.
+	c.mu.Lock()
+	gcasKey := c.primaryServer
+	gcas := c.gcaServers[gcasKey]
+	c.mu.Unlock()
+	c.tg.Launch(func() {
+		c.staticCheckClockDrift(gcas, gcasKey)
+	})
+	c.tg.Launch(func() {
+		success := c.threadedSyncWithServer(latestRecord)
+		if success {
+			atomic.StoreUint64(&s.syncStatus, 1)
+		} else {
+			atomic.StoreUint64(&s.syncStatus, 0)
+		}
+	})
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"path/filepath"
 	"testing"
@@ -532,9 +533,7 @@ func TestAddingServers(t *testing.T) {
 		Debt:       11223344,
 		Expiration: 100e6 + glow.CurrentTimeslot(),
 	}
-	sb = ea.SigningBytes()
-	sig = glow.Sign(sb, ngcaPrivKey)
-	ea.Signature = sig
+	ea = server.SignEquipmentAuthorization(ea, ngcaPrivKey)
 	jsonEA, err := json.Marshal(ea)
 	if err != nil {
 		t.Fatal("unable to marshal the auth request")
@@ -727,3 +726,147 @@ func TestAddingServers(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestSendReportWithAck checks that SendReportWithAck receives and verifies
+// the ack from the server, and that it falls back to fire-and-forget when no
+// valid ack arrives.
+func TestSendReportWithAck(t *testing.T) {
+	gcas, _, _, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+
+	// Authorize a device on the server.
+	ePub, ePriv := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{
+		ShortID:   11,
+		PublicKey: ePub,
+		Capacity:  1e9,
+	}
+	err = gcas.AuthorizeEquipment(ea, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, udpPort := gcas.Ports()
+	location := fmt.Sprintf("127.0.0.1:%v", udpPort)
+
+	// Send a report and check the ack.
+	eqr := glow.EquipmentReport{
+		ShortID:     ea.ShortID,
+		Timeslot:    2,
+		PowerOutput: 500,
+	}
+	eqr.Signature = glow.Sign(eqr.SigningBytes(), ePriv)
+	ack, acked, err := SendReportWithAck(eqr, location, gcas.PublicKey(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acked || ack.Status != glow.ReportAckAccepted || ack.ShortID != ea.ShortID || ack.Timeslot != 2 {
+		t.Fatal("unexpected ack:", acked, ack)
+	}
+
+	// Expecting the wrong server key means the ack can't be verified, so
+	// the helper should fall back to fire-and-forget once the timeout
+	// passes.
+	wrongKey, _ := glow.GenerateKeyPair()
+	eqr.Timeslot = 3
+	eqr.Signature = glow.Sign(eqr.SigningBytes(), ePriv)
+	start := time.Now()
+	_, acked, err = SendReportWithAck(eqr, location, wrongKey, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acked {
+		t.Fatal("ack should not verify against the wrong key")
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("helper returned before the timeout")
+	}
+}
+
+// TestCheckClockDrift checks that CheckClockDrift measures a small skew
+// against a server on the same machine, and that it refuses a response that
+// isn't signed by the expected server.
+func TestCheckClockDrift(t *testing.T) {
+	gcas, _, _, _, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	_, _, udpPort := gcas.Ports()
+	location := fmt.Sprintf("127.0.0.1:%v", udpPort)
+
+	skew, err := CheckClockDrift(location, gcas.PublicKey(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skew > time.Second || skew < -time.Second {
+		t.Fatal("unexpected skew against a local server:", skew)
+	}
+
+	wrongKey, _ := glow.GenerateKeyPair()
+	if _, err := CheckClockDrift(location, wrongKey, 100*time.Millisecond); err == nil {
+		t.Fatal("response should not verify against the wrong key")
+	}
+}
+
+// TestClientIPv6 checks that the client can reach a server that is only
+// listening on the IPv6 loopback address, using a bracketed location.
+func TestClientIPv6(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("ipv6 loopback is not available:", err)
+	} else {
+		l.Close()
+	}
+	gcas, _, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironmentWithOptions(t.Name()+"_server1", server.ServerOptions{HttpAddr: "::1", TcpAddr: "::1", UdpAddr: "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	err = setupTestEnvironmentAt(clientDir, "[::1]", gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(clientDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Reports should reach the server over UDP.
+	err = updateMonitorFile(client.staticBaseDir, []uint32{1}, []uint64{500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * sendReportTime)
+	httpPort, _, _ := gcas.Ports()
+	resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/recent-reports?publicKey=%x", glow.HostPort("::1", httpPort), client.staticPubKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response server.RecentReportsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Reports) < 2 || response.Reports[1].PowerOutput != 500 {
+		t.Fatal("server does not have the report")
+	}
+
+	// The sync over TCP and the api calls over HTTP should work as well.
+	client.mu.Lock()
+	gcasInfo := client.gcaServers[gcas.PublicKey()]
+	client.mu.Unlock()
+	_, bitfield, _, _, _, err := client.staticServerSync(gcasInfo, gcas.PublicKey(), gcaPubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bitfield[0]&(1<<1) == 0 {
+		t.Fatal("sync does not include the report")
+	}
+	if _, err := NewAPIClient(gcas.PublicKey(), gcasInfo, APIClientOptions{}).ServerInfo(); err != nil {
+		t.Fatal(err)
+	}
+}
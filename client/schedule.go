@@ -0,0 +1,258 @@
+package client
+
+// schedule.go contains the transmit schedule, which lets a device hold its
+// reports back and send them in bulk rather than one packet per timeslot.
+// Devices on a metered cellular plan pay for every transmission, and a site
+// that produces nothing at night has nothing urgent to say during the night.
+//
+// Without a schedule every report is sent as soon as it's read, the same as
+// always. With one, new readings go straight into the outbox, and the outbox
+// is only emptied on the timeslots that the schedule transmits on: every
+// Interval timeslots, and never during the quiet hours. Servers that accept
+// batches get everything that piled up in one request, every report still
+// signed on its own. Once the oldest report has waited MaxQueueAge timeslots
+// the outbox gets sent no matter what, so that a long quiet window can't push
+// the reports out of the acceptance window of the server.
+//
+// The periodic sync and the heartbeats are held back along with the reports,
+// the sync runs at the next transmission instead and the heartbeats of held
+// timeslots are never sent.
+//
+// The schedule is read from TransmitScheduleFile in the client directory, and
+// ClientOptions.Schedule takes precedence over the file.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+const (
+	// defaultMaxQueueAge is the number of timeslots that a report can wait
+	// in the outbox before a transmission is forced, if the schedule
+	// doesn't set one. That's 12 hours, which covers any reasonable night.
+	defaultMaxQueueAge = 144
+
+	// maxReportBatch is the largest number of reports that the server
+	// takes in a single batch request.
+	maxReportBatch = 288
+)
+
+// TransmitSchedule decides on which timeslots the device sends its reports.
+// The zero value sends every report right away.
+type TransmitSchedule struct {
+	Interval    uint32 `json:"interval"`      // Transmit on every Nth timeslot, 0 and 1 transmit on every timeslot
+	QuietStart  string `json:"quiet_start"`   // Start of the quiet hours as "HH:MM" in UTC, empty for no quiet hours
+	QuietEnd    string `json:"quiet_end"`     // End of the quiet hours as "HH:MM" in UTC, can be before the start to wrap past midnight
+	MaxQueueAge uint32 `json:"max_queue_age"` // Timeslots that a report can wait before a transmission is forced, 0 for the default
+}
+
+// active returns whether the schedule holds reports back at all.
+func (ts TransmitSchedule) active() bool {
+	return ts.Interval > 1 || ts.QuietStart != ""
+}
+
+// maxQueueAge returns the number of timeslots that a report can wait.
+func (ts TransmitSchedule) maxQueueAge() uint32 {
+	if ts.MaxQueueAge == 0 {
+		return defaultMaxQueueAge
+	}
+	return ts.MaxQueueAge
+}
+
+// parseClockTime parses an "HH:MM" time of day into minutes since midnight.
+func parseClockTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// validate checks that the schedule makes sense.
+func (ts TransmitSchedule) validate() error {
+	if (ts.QuietStart == "") != (ts.QuietEnd == "") {
+		return fmt.Errorf("quiet hours need both a start and an end")
+	}
+	if ts.QuietStart != "" {
+		start, err := parseClockTime(ts.QuietStart)
+		if err != nil {
+			return fmt.Errorf("bad quiet_start: %w", err)
+		}
+		end, err := parseClockTime(ts.QuietEnd)
+		if err != nil {
+			return fmt.Errorf("bad quiet_end: %w", err)
+		}
+		if start == end {
+			return fmt.Errorf("quiet hours start and end at the same time")
+		}
+	}
+	if ts.maxQueueAge() >= outboxWindow {
+		return fmt.Errorf("max_queue_age of %v timeslots is not below the %v timeslots that the server accepts reports for", ts.maxQueueAge(), outboxWindow)
+	}
+	if ts.Interval > ts.maxQueueAge() {
+		return fmt.Errorf("interval of %v timeslots is longer than the max_queue_age of %v", ts.Interval, ts.maxQueueAge())
+	}
+	return nil
+}
+
+// quiet returns whether the provided timeslot starts during the quiet hours.
+// The schedule must be valid.
+func (ts TransmitSchedule) quiet(timeslot uint32) bool {
+	if ts.QuietStart == "" {
+		return false
+	}
+	start, _ := parseClockTime(ts.QuietStart)
+	end, _ := parseClockTime(ts.QuietEnd)
+	t := time.Unix(glow.TimeslotToUnix(timeslot), 0).UTC()
+	minute := t.Hour()*60 + t.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// holds returns whether the reports should be held back at the provided
+// timeslot, given the timeslot of the oldest report in the outbox, if there is
+// one. The schedule must be valid.
+func (ts TransmitSchedule) holds(timeslot uint32, oldest uint32, waiting bool) bool {
+	if !ts.active() {
+		return false
+	}
+	if waiting && timeslot >= oldest+ts.maxQueueAge() {
+		return false
+	}
+	return ts.quiet(timeslot) || (ts.Interval > 1 && timeslot%ts.Interval != 0)
+}
+
+// loadTransmitSchedule will load the transmit schedule from disk. A missing
+// file means that reports are sent right away.
+func (c *Client) loadTransmitSchedule() error {
+	path := filepath.Join(c.staticBaseDir, TransmitScheduleFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read transmit schedule file: %w", err)
+	}
+	var ts TransmitSchedule
+	if err := json.Unmarshal(data, &ts); err != nil {
+		return fmt.Errorf("unable to decode transmit schedule file: %w", err)
+	}
+	if err := ts.validate(); err != nil {
+		return fmt.Errorf("invalid transmit schedule: %w", err)
+	}
+	c.staticSchedule = ts
+	return nil
+}
+
+// managedHoldReports returns whether the schedule holds the reports back right
+// now.
+func (c *Client) managedHoldReports() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var oldest uint32
+	if len(c.outbox) > 0 {
+		oldest = c.outbox[0]
+	}
+	return c.staticSchedule.holds(glow.CurrentTimeslot(), oldest, len(c.outbox) > 0)
+}
+
+// SubmitReportBatch sends reports to the server in a single request, and
+// returns the result of every report, in the same order as the reports. The
+// results are only returned if the server signed them.
+func (c *APIClient) SubmitReportBatch(reports []glow.EquipmentReport) ([]server.BatchReportResult, error) {
+	var body []byte
+	for _, eqr := range reports {
+		body = append(body, eqr.Serialize()...)
+	}
+	resp, err := c.staticHTTP.Post(c.URL("/api/v1/equipment-reports/batch"), "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		return nil, unreachable(err)
+	}
+	defer resp.Body.Close()
+	if err := ReadAPIError(resp); err != nil {
+		return nil, err
+	}
+	var untrustedResp server.BatchReportsResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&untrustedResp); err != nil {
+		return nil, fmt.Errorf("unable to decode batch response: %w", err)
+	}
+	if len(untrustedResp.Results) != len(reports) {
+		return nil, fmt.Errorf("batch response has %v results for %v reports", len(untrustedResp.Results), len(reports))
+	}
+	for i, result := range untrustedResp.Results {
+		if result.ShortID != reports[i].ShortID || result.Timeslot != reports[i].Timeslot {
+			return nil, errors.New("batch response does not match the reports")
+		}
+	}
+	if !glow.Verify(c.staticServerKey, untrustedResp.SigningBytes(), untrustedResp.Signature) {
+		return nil, errors.New("batch response is not signed by the gca server")
+	}
+	return untrustedResp.Results, nil
+}
+
+// staticDeliverBatch will send the provided records to the server in batches,
+// if the server takes batches, and return the records that still need to be
+// delivered one at a time. Every report that the server dealt with leaves the
+// outbox, the same as if it had been acked.
+func (c *Client) staticDeliverBatch(gcas GCAServer, gcasKey glow.PublicKey, records []EnergyRecord) []EnergyRecord {
+	info, exists := c.managedServerInfo(gcasKey)
+	if len(records) < 2 || !exists || !info.Capabilities.HasFeature(server.FeatureBatchReports) {
+		return records
+	}
+	for len(records) > 0 {
+		n := len(records)
+		if n > maxReportBatch {
+			n = maxReportBatch
+		}
+		reports := make([]glow.EquipmentReport, n)
+		for i, record := range records[:n] {
+			reports[i] = glow.EquipmentReport{
+				ShortID:     c.shortID,
+				Timeslot:    record.Timeslot,
+				PowerOutput: record.Energy,
+			}
+			reports[i].Signature = glow.Sign(reports[i].SigningBytes(), c.staticPrivKey)
+		}
+		results, err := NewAPIClient(gcasKey, gcas, c.managedAPIClientOptions(gcasKey)).SubmitReportBatch(reports)
+		if err != nil {
+			c.EventLog.Printf("batch of %v reports to %v failed: %v", n, gcas.Location, err)
+			return records
+		}
+		if err := c.updateReportFile(); err != nil {
+			c.EventLog.Printf("unable to update report file: %v", err)
+		}
+
+		// Reports that the server can't store right now get sent again
+		// one at a time, like reports that never got an ack.
+		var retry []EnergyRecord
+		var done []uint32
+		for i, result := range results {
+			if result.Code == server.ErrCodeStorageUnavailable {
+				retry = append(retry, records[i])
+				continue
+			}
+			if result.Status == "rejected" {
+				c.EventLog.Printf("server %v did not accept the report for timeslot %v: %v", gcas.Location, result.Timeslot, result.Reason)
+			}
+			c.managedRecordAck(gcasKey, result.Timeslot)
+			done = append(done, result.Timeslot)
+		}
+		c.managedRemoveReports(done)
+		records = append(retry, records[n:]...)
+		if len(retry) > 0 {
+			return records
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestTransmitSchedule checks that a client with a transmit schedule holds
+// its reports back between transmissions and during the quiet hours, sends
+// them as one batch when the schedule transmits, and is forced to send them
+// once they have waited too long.
+func TestTransmitSchedule(t *testing.T) {
+	defer glow.SetCurrentTimeslot(0)
+	gcas, _, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	httpPort, _, _ := gcas.Ports()
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	err = SetupTestEnvironment(clientDir, gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meter := &fakeMeter{}
+	c, err := newClient(clientDir, "", "", meter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The server only takes batches as far as the client knows, and its
+	// UDP port goes nowhere, so a report can only arrive in a batch.
+	key := gcas.PublicKey()
+	c.mu.Lock()
+	c.serverInfo[key] = server.ServerInfoResponse{Capabilities: server.ServerCapabilities{Features: []string{server.FeatureBatchReports}}}
+	gcasInfo := c.gcaServers[key]
+	gcasInfo.UdpPort = 1
+	c.gcaServers[key] = gcasInfo
+	c.mu.Unlock()
+
+	// The meter has a reading for every timeslot before the current one.
+	var timeslots []uint32
+	var readings []float64
+	s := new(sendState)
+	advance := func(current uint32) {
+		t.Helper()
+		glow.SetCurrentTimeslot(current)
+		timeslots = append(timeslots, current-1)
+		readings = append(readings, float64(100*(current-1)))
+		meter.setReadings(timeslots, readings)
+		c.managedSendIteration(s)
+	}
+	reported := func(timeslot uint32) bool {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/recent-reports?publicKey=%x", httpPort, c.staticPubKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var response server.RecentReportsResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Reports[timeslot].PowerOutput == uint64(100*timeslot)
+	}
+	glow.SetCurrentTimeslot(100)
+	c.managedSendIteration(s)
+
+	// Every 4th timeslot, everything that piled up goes out at once.
+	c.staticSchedule = TransmitSchedule{Interval: 4, MaxQueueAge: 100}
+	for current := uint32(101); current < 104; current++ {
+		advance(current)
+		if n := c.outboxLen(); n != int(current-100) {
+			t.Fatal("the report was not held back:", current, n)
+		}
+	}
+	if reported(101) {
+		t.Fatal("a held report reached the server")
+	}
+	advance(104)
+	if n := c.outboxLen(); n != 0 {
+		t.Fatal("the reports were not sent:", n)
+	}
+	for timeslot := uint32(100); timeslot < 104; timeslot++ {
+		if !reported(timeslot) {
+			t.Fatal("the server is missing the report for", timeslot)
+		}
+	}
+
+	// Nothing goes out during the quiet hours, not even from the outbox
+	// loop, until the oldest report has waited for MaxQueueAge timeslots.
+	quietStart := time.Unix(glow.TimeslotToUnix(200), 0).UTC()
+	c.staticSchedule = TransmitSchedule{
+		QuietStart:  quietStart.Format("15:04"),
+		QuietEnd:    quietStart.Add(30 * time.Minute).Format("15:04"),
+		MaxQueueAge: 4,
+	}
+	for current := uint32(200); current < 203; current++ {
+		advance(current)
+	}
+	if delay := c.managedAttemptOutbox(outboxRetryMin); delay != outboxRetryMin || c.outboxLen() != 3 {
+		t.Fatal("the reports were not held during the quiet hours:", delay, c.outboxLen())
+	}
+	advance(203)
+	if n := c.outboxLen(); n != 0 {
+		t.Fatal("the old reports were not forced out:", n)
+	}
+	for timeslot := uint32(199); timeslot < 203; timeslot++ {
+		if !reported(timeslot) {
+			t.Fatal("the server is missing the report for", timeslot)
+		}
+	}
+	advance(204)
+	if n := c.outboxLen(); n != 1 {
+		t.Fatal("the quiet hours ended early:", n)
+	}
+}
+
+// TestTransmitScheduleConfig checks which transmit schedules are valid, and
+// that the schedule is read from the client directory.
+func TestTransmitScheduleConfig(t *testing.T) {
+	for _, ts := range []TransmitSchedule{
+		{},
+		{Interval: 12},
+		{QuietStart: "22:00", QuietEnd: "06:00", MaxQueueAge: 200},
+	} {
+		if err := ts.validate(); err != nil {
+			t.Fatalf("%+v was refused: %v", ts, err)
+		}
+	}
+	for _, ts := range []TransmitSchedule{
+		{QuietStart: "22:00"},
+		{QuietStart: "25:00", QuietEnd: "06:00"},
+		{QuietStart: "06:00", QuietEnd: "06:00"},
+		{MaxQueueAge: outboxWindow},
+		{Interval: 200},
+	} {
+		if err := ts.validate(); err == nil {
+			t.Fatalf("%+v was accepted", ts)
+		}
+	}
+	// The genesis time isn't aligned to the minute in testing, so the
+	// timeslots are looked up a few minutes into the hour.
+	ts := TransmitSchedule{QuietStart: "22:00", QuietEnd: "06:00"}
+	day := time.Unix(glow.TimeslotToUnix(0), 0).UTC().Add(48 * time.Hour).Truncate(24 * time.Hour)
+	for hour, quiet := range map[int]bool{21: false, 22: true, 3: true, 6: false} {
+		timeslot, err := glow.UnixToTimeslot(day.Add(time.Duration(hour)*time.Hour + 5*time.Minute).Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts.quiet(timeslot) != quiet {
+			t.Fatal("wrong quiet hours at", hour)
+		}
+	}
+
+	gcas, _, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	if err := SetupTestEnvironment(clientDir, gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(clientDir, TransmitScheduleFile)
+	if err := os.WriteFile(path, []byte(`{"interval": 6, "quiet_start": "22:00", "quiet_end": "06:00"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newClient(clientDir, "", "", &fakeMeter{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.staticSchedule != (TransmitSchedule{Interval: 6, QuietStart: "22:00", QuietEnd: "06:00"}) {
+		t.Fatalf("unexpected schedule: %+v", c.staticSchedule)
+	}
+	if err := os.WriteFile(path, []byte(`{"interval": 6, "quiet_start": "22:00"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.loadTransmitSchedule(); err == nil {
+		t.Fatal("a bad schedule was loaded")
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+// server_info.go fetches and caches the server info of every GCA server, see
+// server/api_server_info.go. The client uses it to pick the version of the UDP
+// report packet, sending its reports in the newest version that both sides
+// support, and to decide whether it's worth waiting for an ack. Servers that
+// don't have the server info endpoint predate the versioned packets, so they
+// get the legacy layout, which is also what a server gets until the client
+// has heard from it.
+//
+// The server info is fetched in the background when the client starts, and
+// again with every refresh of the server list, so sending a report never
+// waits on an HTTP request. The server info is always requested signed, and
+// only cached if the signature matches the key of the server.
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// ServerInfo fetches the identity, build and capabilities of the server.
+func (c *APIClient) ServerInfo() (server.ServerInfoResponse, error) {
+	var info server.ServerInfoResponse
+	err := c.GetSigned("/api/v1/server-info", &info)
+	return info, err
+}
+
+// managedServerInfo returns the cached server info of the provided server,
+// and whether there is any.
+func (c *Client) managedServerInfo(gcasKey glow.PublicKey) (server.ServerInfoResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, exists := c.serverInfo[gcasKey]
+	return info, exists
+}
+
+// managedReportPacketVersion returns the version of the report packet that
+// should be used for the provided server.
+func (c *Client) managedReportPacketVersion(gcasKey glow.PublicKey) byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reportPacketVersions[gcasKey]
+}
+
+// managedReportAckTimeout returns how long to wait for the provided server to
+// ack a report. Servers that are known not to send acks aren't waited on.
+// Servers that the client hasn't heard from yet might, so they get the full
+// timeout.
+func (c *Client) managedReportAckTimeout(gcasKey glow.PublicKey) time.Duration {
+	info, exists := c.managedServerInfo(gcasKey)
+	if exists && !info.Capabilities.HasFeature(server.FeatureReportAcks) {
+		return 0
+	}
+	return reportAckTimeout
+}
+
+// managedRefreshServerInfo fetches the server info of every server that isn't
+// banned, and negotiates the version of the report packet with it. A server
+// that can't be reached keeps what was cached for it before.
+func (c *Client) managedRefreshServerInfo() {
+	c.mu.Lock()
+	servers := make(map[glow.PublicKey]GCAServer, len(c.gcaServers))
+	for key, gcas := range c.gcaServers {
+		if !gcas.Banned {
+			servers[key] = gcas
+		}
+	}
+	c.mu.Unlock()
+
+	for key, gcas := range servers {
+		if c.tg.IsStopped() {
+			return
+		}
+		opts := c.managedAPIClientOptions(key)
+		info, err := NewAPIClient(key, gcas, opts).ServerInfo()
+		var apiErr *APIError
+		if err != nil && !opts.UseTLS && !(errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound) {
+			// A server with TLS refuses plain HTTP, and so do proxies
+			// that only accept CONNECT, but the client only learns
+			// that the server has TLS from the server info.
+			opts.UseTLS, opts.SkipCertVerify = true, true
+			if tlsInfo, tlsErr := NewAPIClient(key, gcas, opts).ServerInfo(); tlsErr == nil {
+				info, err = tlsInfo, nil
+			}
+		}
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			// The server predates the server info endpoint.
+			c.mu.Lock()
+			delete(c.serverInfo, key)
+			c.reportPacketVersions[key] = glow.ReportPacketLegacy
+			c.mu.Unlock()
+			continue
+		} else if err != nil {
+			c.EventLog.Printf("unable to fetch the server info of %v: %v", gcas.Location, err)
+			continue
+		}
+		c.mu.Lock()
+		c.serverInfo[key] = info
+		c.reportPacketVersions[key] = glow.NegotiateReportPacketVersion(info.Capabilities.ReportPacketVersions)
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// TestReportPacketNegotiation checks that the client picks the newest report
+// packet version that a server advertises, and falls back to the legacy
+// layout for servers that don't advertise anything.
+func TestReportPacketNegotiation(t *testing.T) {
+	gcas, _, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	httpPort, _, udpPort := gcas.Ports()
+
+	// The server advertises every version that glow knows about.
+	info, err := NewAPIClient(gcas.PublicKey(), GCAServer{Location: "127.0.0.1", HttpPort: httpPort}, APIClientOptions{}).ServerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(info.Capabilities.ReportPacketVersions) != fmt.Sprint(glow.ReportPacketVersions()) {
+		t.Fatal("unexpected versions:", info.Capabilities.ReportPacketVersions)
+	}
+
+	// The client should negotiate version 1 in the background.
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	err = SetupTestEnvironment(clientDir, gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(clientDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 100 && c.managedReportPacketVersion(gcas.PublicKey()) != glow.ReportPacketVersion1; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if c.managedReportPacketVersion(gcas.PublicKey()) != glow.ReportPacketVersion1 {
+		t.Fatal("client did not negotiate version 1")
+	}
+	cached, exists := c.managedServerInfo(gcas.PublicKey())
+	if !exists || cached.UdpPort != udpPort || !cached.Capabilities.HasFeature(server.FeatureReportAcks) {
+		t.Fatalf("server info was not cached: %+v", cached)
+	}
+	if c.managedReportAckTimeout(gcas.PublicKey()) != reportAckTimeout {
+		t.Fatal("client does not wait for the acks of the server")
+	}
+
+	// A version 1 report gets acked by the server.
+	ePub, ePriv := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{ShortID: 11, PublicKey: ePub, Capacity: 1e9}
+	if err := gcas.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	eqr := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 2, PowerOutput: 500}
+	eqr.Signature = glow.Sign(eqr.SigningBytes(), ePriv)
+	ack, acked, err := SendReportPacketWithAck(eqr, glow.ReportPacketVersion1, fmt.Sprintf("127.0.0.1:%v", udpPort), gcas.PublicKey(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acked || ack.Status != glow.ReportAckAccepted {
+		t.Fatal("version 1 report was not acked:", acked, ack)
+	}
+
+	// A server without the server info endpoint gets the legacy layout,
+	// and a server that can't be reached isn't negotiated with at all.
+	old := httptest.NewServer(http.NotFoundHandler())
+	defer old.Close()
+	_, portStr, _ := net.SplitHostPort(old.Listener.Addr().String())
+	oldPort, _ := strconv.Atoi(portStr)
+	oldKey, _ := glow.GenerateKeyPair()
+	downKey, _ := glow.GenerateKeyPair()
+	c.mu.Lock()
+	c.gcaServers[oldKey] = GCAServer{Location: "127.0.0.1", HttpPort: uint16(oldPort)}
+	c.gcaServers[downKey] = GCAServer{Location: "127.0.0.1", HttpPort: 1}
+	c.mu.Unlock()
+	c.managedRefreshServerInfo()
+	c.mu.Lock()
+	oldVersion, oldKnown := c.reportPacketVersions[oldKey]
+	_, downKnown := c.reportPacketVersions[downKey]
+	c.mu.Unlock()
+	if !oldKnown || oldVersion != glow.ReportPacketLegacy {
+		t.Fatal("server without the endpoint was not given the legacy layout:", oldKnown, oldVersion)
+	}
+	if downKnown {
+		t.Fatal("unreachable server was negotiated with")
+	}
+
+	// Servers that don't advertise acks aren't waited on, servers that the
+	// client knows nothing about are.
+	noAcksKey, _ := glow.GenerateKeyPair()
+	c.mu.Lock()
+	c.serverInfo[noAcksKey] = server.ServerInfoResponse{Capabilities: server.ServerCapabilities{Features: []string{server.FeatureBatchReports}}}
+	c.mu.Unlock()
+	if c.managedReportAckTimeout(noAcksKey) != 0 || c.managedReportAckTimeout(oldKey) != reportAckTimeout {
+		t.Fatal("wrong ack timeouts")
+	}
+}
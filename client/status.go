@@ -0,0 +1,293 @@
+package client
+
+// status.go contains the local status endpoint of the client, which lets a
+// field technician check on an installation without reading the logs. It
+// listens on loopback by default, so the status is only visible from the
+// device itself, e.g. over SSH with 'curl localhost:<port>/status'.
+//
+// /status returns the identity of the device, the servers that it reports
+// to, and how reporting is going. /recent returns the readings of the last 24
+// hours from the history file.
+//
+// The status endpoint is a debugging aid. If it can't start, the failure is
+// logged and the client keeps running.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/threadgroup"
+)
+
+// recentTimeslots is the number of timeslots that /recent covers, which is 24
+// hours.
+const recentTimeslots = 288
+
+// StatusServer is a GCA server that the client is configured for.
+type StatusServer struct {
+	PublicKey string `json:"pubkey"` // hex encoded
+	Location  string `json:"location"`
+	HttpPort  uint16 `json:"http_port"`
+	TcpPort   uint16 `json:"tcp_port"`
+	UdpPort   uint16 `json:"udp_port"`
+	Banned    bool   `json:"banned"`
+	Primary   bool   `json:"primary"`
+
+	// Transport is the transport that the next report to the server
+	// goes over first, and Proxy is the proxy that its HTTP API is
+	// reached through, without the password, see proxy.go.
+	Transport string `json:"transport"`
+	Proxy     string `json:"proxy,omitempty"`
+}
+
+// StatusResponse is the response of /status. The fields about acks, readings,
+// and the clock skew are null until the client has one to show.
+type StatusResponse struct {
+	PublicKey string         `json:"pubkey"` // hex encoded
+	ShortID   uint32         `json:"short_id"`
+	GCAKey    string         `json:"gca_pubkey"` // hex encoded
+	Servers   []StatusServer `json:"servers"`
+
+	LastAckTimeslot *uint32 `json:"last_ack_timeslot"`
+	LastAckServer   string  `json:"last_ack_server,omitempty"` // hex encoded
+	LastAckUnix     *int64  `json:"last_ack_unix"`
+
+	OutboxDepth int `json:"outbox_depth"`
+
+	LastReadingTimeslot *uint32 `json:"last_reading_timeslot"`
+	LastReadingEnergy   *int64  `json:"last_reading_energy"` // mWh, or a sentinel below 4
+	LastReadingUnix     *int64  `json:"last_reading_unix"`   // When the meter was read
+
+	ClockSkewMillis *int64 `json:"clock_skew_ms"` // Positive if the local clock is ahead
+	ClockSkewUnix   *int64 `json:"clock_skew_unix"`
+
+	MeterError string `json:"meter_error,omitempty"` // Why the last read of the meter failed
+}
+
+// RecentReading is a reading from the history file.
+type RecentReading struct {
+	Timeslot uint32 `json:"timeslot"`
+	Unix     int64  `json:"unix"`   // The start of the timeslot
+	Energy   int64  `json:"energy"` // mWh, or a sentinel below 4
+}
+
+// RecentResponse is the response of /recent. It contains the readings for
+// the timeslots [Start, End], leaving out the timeslots without a reading.
+type RecentResponse struct {
+	Start    uint32          `json:"start"`
+	End      uint32          `json:"end"`
+	Readings []RecentReading `json:"readings"`
+}
+
+// managedSetLastReading will make the newest of the provided records the last
+// reading in the status of the client.
+func (c *Client) managedSetLastReading(records []EnergyRecord) {
+	if len(records) == 0 {
+		return
+	}
+	newest := records[0]
+	for _, record := range records {
+		if record.Timeslot > newest.Timeslot {
+			newest = record
+		}
+	}
+	c.mu.Lock()
+	c.lastReading = newest
+	c.lastReadingTime = time.Now()
+	c.mu.Unlock()
+}
+
+// managedSetMeterError will record the result of the last read of the meter
+// in the status of the client. A nil error clears the previous failure.
+func (c *Client) managedSetMeterError(err error) {
+	c.mu.Lock()
+	if err != nil {
+		c.meterError = err.Error()
+	} else {
+		c.meterError = ""
+	}
+	c.mu.Unlock()
+}
+
+// launchStatusServer will start the local status endpoint. A failure gets
+// logged rather than returned, because the client can do its job without the
+// status endpoint.
+func (c *Client) launchStatusServer(opts ClientOptions) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.statusHandler)
+	mux.HandleFunc("/recent", c.recentHandler)
+	addr := launchStatusEndpoint(&c.tg, c.EventLog, opts, mux)
+	c.mu.Lock()
+	c.statusAddr = addr
+	c.mu.Unlock()
+}
+
+// launchStatusEndpoint will serve the provided routes on the status endpoint
+// that the options ask for, until the thread group stops. It returns the
+// address that the endpoint listens on, which is empty if the endpoint is
+// disabled or could not start.
+func launchStatusEndpoint(tg *threadgroup.ThreadGroup, log *glow.EventLogger, opts ClientOptions, mux *http.ServeMux) string {
+	if opts.DisableStatus {
+		return ""
+	}
+	addr := opts.StatusAddr
+	if addr == "" {
+		addr = "127.0.0.1"
+	}
+	port := opts.StatusPort
+	if port == 0 {
+		port = statusPortDefault
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(int(port))))
+	if err != nil {
+		log.Printf("unable to start the status endpoint: %v", err)
+		return ""
+	}
+
+	srv := &http.Server{
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+	}
+	tg.OnStop(func() error {
+		return srv.Close()
+	})
+	// The server takes ownership of the listener, unless the thread
+	// can't be launched because the client is already shutting down.
+	err = tg.Launch(func() {
+		err := srv.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("status endpoint stopped: %v", err)
+		}
+	})
+	if err != nil {
+		listener.Close()
+		return ""
+	}
+	return listener.Addr().String()
+}
+
+// writeStatusJSON will write a JSON response for the status endpoint.
+func writeStatusJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// statusHandler returns the status of the client.
+func (c *Client) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	writeStatusJSON(w, c.managedStatus())
+}
+
+// managedStatus returns the status of the client.
+func (c *Client) managedStatus() StatusResponse {
+	unix := func(t time.Time) *int64 {
+		u := t.Unix()
+		return &u
+	}
+
+	c.mu.Lock()
+	resp := StatusResponse{
+		PublicKey:   hex.EncodeToString(c.staticPubKey[:]),
+		ShortID:     c.shortID,
+		GCAKey:      hex.EncodeToString(c.gcaPubKey[:]),
+		Servers:     make([]StatusServer, 0, len(c.gcaServers)),
+		OutboxDepth: len(c.outbox),
+	}
+	for key, gcas := range c.gcaServers {
+		ss := StatusServer{
+			PublicKey: hex.EncodeToString(key[:]),
+			Location:  gcas.Location,
+			HttpPort:  gcas.HttpPort,
+			TcpPort:   gcas.TcpPort,
+			UdpPort:   gcas.UdpPort,
+			Banned:    gcas.Banned,
+			Primary:   key == c.primaryServer,
+			Transport: c.reportTransportsOf(key)[0].String(),
+		}
+		if proxy := c.proxy(key); proxy != nil {
+			ss.Proxy = proxy.Redacted()
+		}
+		resp.Servers = append(resp.Servers, ss)
+	}
+	if !c.lastAckTime.IsZero() {
+		timeslot := c.lastAckTimeslot
+		resp.LastAckTimeslot = &timeslot
+		resp.LastAckServer = hex.EncodeToString(c.lastAckServer[:])
+		resp.LastAckUnix = unix(c.lastAckTime)
+	}
+	if !c.lastReadingTime.IsZero() {
+		// Negative readings are underflowed uint64s.
+		timeslot := c.lastReading.Timeslot
+		energy := int64(c.lastReading.Energy)
+		resp.LastReadingTimeslot = &timeslot
+		resp.LastReadingEnergy = &energy
+		resp.LastReadingUnix = unix(c.lastReadingTime)
+	}
+	if !c.clockSkewTime.IsZero() {
+		skew := c.clockSkew.Milliseconds()
+		resp.ClockSkewMillis = &skew
+		resp.ClockSkewUnix = unix(c.clockSkewTime)
+	}
+	resp.MeterError = c.meterError
+	c.mu.Unlock()
+
+	sort.Slice(resp.Servers, func(i, j int) bool {
+		return resp.Servers[i].PublicKey < resp.Servers[j].PublicKey
+	})
+	return resp
+}
+
+// recentHandler returns the readings of the last 24 hours.
+func (c *Client) recentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	resp, err := c.staticRecent()
+	if err != nil {
+		http.Error(w, "unable to read the history file", http.StatusInternalServerError)
+		return
+	}
+	writeStatusJSON(w, resp)
+}
+
+// staticRecent returns the readings of the last 24 hours from the history
+// file.
+func (c *Client) staticRecent() (RecentResponse, error) {
+	end := glow.CurrentTimeslot()
+	start := uint32(0)
+	if end >= recentTimeslots {
+		start = end - recentTimeslots + 1
+	}
+	resp := RecentResponse{
+		Start:    start,
+		End:      end,
+		Readings: []RecentReading{},
+	}
+	for timeslot := start; timeslot <= end; timeslot++ {
+		reading, err := c.staticLoadReading(timeslot)
+		if err != nil {
+			return RecentResponse{}, err
+		}
+		if reading == 0 {
+			continue
+		}
+		// The history file stores negative readings as underflowed
+		// uint32s.
+		resp.Readings = append(resp.Readings, RecentReading{
+			Timeslot: timeslot,
+			Unix:     glow.TimeslotToUnix(timeslot),
+			Energy:   int64(int32(reading)),
+		})
+	}
+	return resp, nil
+}
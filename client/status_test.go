@@ -0,0 +1,120 @@
+package client
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// getStatus fetches a route of the status endpoint of the client and decodes
+// the response into v.
+func (c *Client) getStatus(route string, v interface{}) error {
+	c.mu.Lock()
+	addr := c.statusAddr
+	c.mu.Unlock()
+	resp, err := http.Get(fmt.Sprintf("http://%v%v", addr, route))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %v", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// TestStatus checks the local status endpoint of the client.
+func TestStatus(t *testing.T) {
+	gcas, _, gcaPubKey, gcaPrivKey, err := server.SetupTestEnvironment(t.Name() + "_server1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	clientDir := glow.GenerateTestDir(t.Name() + "_client1")
+	err = SetupTestEnvironment(clientDir, gcaPubKey, gcaPrivKey, []*server.GCAServer{gcas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meter := &fakeMeter{caps: MeterCapabilities{Bidirectional: true}}
+	c, err := NewClientWithOptions(clientDir, ClientOptions{Meter: meter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := c.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Before anything happens, the status only has the identity of the
+	// device and its servers.
+	var sr StatusResponse
+	if err := c.getStatus("/status", &sr); err != nil {
+		t.Fatal(err)
+	}
+	gcasKey := gcas.PublicKey()
+	if sr.PublicKey != hex.EncodeToString(c.staticPubKey[:]) || sr.ShortID != 1 || sr.GCAKey != hex.EncodeToString(gcaPubKey[:]) {
+		t.Fatalf("unexpected identity: %+v", sr)
+	}
+	if len(sr.Servers) != 1 || sr.Servers[0].PublicKey != hex.EncodeToString(gcasKey[:]) || !sr.Servers[0].Primary {
+		t.Fatalf("unexpected servers: %+v", sr.Servers)
+	}
+	if sr.LastAckTimeslot != nil || sr.LastReadingTimeslot != nil || sr.ClockSkewMillis != nil {
+		t.Fatalf("expected an empty status: %+v", sr)
+	}
+
+	// After a few reports and a clock drift check, the status shows how
+	// reporting is going.
+	meter.setReadings([]uint32{1, 2}, []float64{100, -200})
+	acked := false
+	for i := 0; i < 200 && !acked; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if err := c.getStatus("/status", &sr); err != nil {
+			t.Fatal(err)
+		}
+		acked = sr.LastAckTimeslot != nil && *sr.LastAckTimeslot == 2
+	}
+	if !acked {
+		t.Fatalf("the status does not show the last ack: %+v", sr)
+	}
+	c.mu.Lock()
+	primary := c.gcaServers[gcasKey]
+	c.mu.Unlock()
+	c.staticCheckClockDrift(primary, gcasKey)
+	if err := c.getStatus("/status", &sr); err != nil {
+		t.Fatal(err)
+	}
+	if sr.LastAckServer != hex.EncodeToString(gcasKey[:]) || sr.OutboxDepth != 0 {
+		t.Fatalf("unexpected status: %+v", sr)
+	}
+	if sr.LastReadingTimeslot == nil || *sr.LastReadingTimeslot != 2 || *sr.LastReadingEnergy != -200 {
+		t.Fatalf("unexpected last reading: %+v", sr)
+	}
+	if sr.ClockSkewMillis == nil || *sr.ClockSkewMillis > 1000 || *sr.ClockSkewMillis < -1000 {
+		t.Fatalf("unexpected clock skew: %+v", sr)
+	}
+
+	// The recent readings cover the last 24 hours.
+	glow.SetCurrentTimeslot(2)
+	defer glow.SetCurrentTimeslot(0)
+	var rr RecentResponse
+	if err := c.getStatus("/recent", &rr); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Start != 0 || rr.End != 2 || len(rr.Readings) != 2 || rr.Readings[0].Energy != 100 || rr.Readings[1].Energy != -200 || rr.Readings[1].Unix != glow.TimeslotToUnix(2) {
+		t.Fatalf("unexpected recent readings: %+v", rr)
+	}
+	glow.SetCurrentTimeslot(2 + recentTimeslots)
+	if err := c.getStatus("/recent", &rr); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Start != 3 || len(rr.Readings) != 0 {
+		t.Fatalf("expected old readings to be left out: %+v", rr)
+	}
+}
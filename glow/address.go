@@ -0,0 +1,27 @@
+package glow
+
+// address.go formats the network addresses of GCA servers. The location of a
+// server is either a host name or an IP address literal, and operators may
+// write IPv6 literals with or without the brackets that URLs use, so every
+// address is built through HostPort instead of pasting the location and the
+// port together.
+
+import (
+	"net"
+	"strconv"
+)
+
+// TrimBrackets removes the brackets around an IPv6 literal, so that both
+// "[::1]" and "::1" can be passed to net.ParseIP.
+func TrimBrackets(location string) string {
+	if len(location) >= 2 && location[0] == '[' && location[len(location)-1] == ']' {
+		return location[1 : len(location)-1]
+	}
+	return location
+}
+
+// HostPort joins a location and a port into an address that can be dialed,
+// or used as the host of a URL. IPv6 literals get wrapped in brackets.
+func HostPort(location string, port uint16) string {
+	return net.JoinHostPort(TrimBrackets(location), strconv.Itoa(int(port)))
+}
@@ -0,0 +1,28 @@
+package glow
+
+import (
+	"testing"
+)
+
+// TestHostPort checks that locations are joined with their ports, with and
+// without brackets around IPv6 literals.
+func TestHostPort(t *testing.T) {
+	tests := []struct {
+		location string
+		expected string
+	}{
+		{"127.0.0.1", "127.0.0.1:35045"},
+		{"example.com", "example.com:35045"},
+		{"::1", "[::1]:35045"},
+		{"[::1]", "[::1]:35045"},
+		{"[2001:db8::1]", "[2001:db8::1]:35045"},
+	}
+	for _, test := range tests {
+		if addr := HostPort(test.location, 35045); addr != test.expected {
+			t.Errorf("HostPort(%q) = %q, expected %q", test.location, addr, test.expected)
+		}
+	}
+	if TrimBrackets("[") != "[" || TrimBrackets("") != "" {
+		t.Error("TrimBrackets changed a location without brackets")
+	}
+}
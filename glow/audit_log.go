@@ -0,0 +1,195 @@
+package glow
+
+// audit_log.go defines the audit log that GCA servers keep of every
+// privileged action they accepted, like equipment authorizations, bans, and
+// key rotations. Every entry holds the full request and every signature that
+// the server checked before accepting it, along with the key that verified
+// each signature, so an auditor can check the entries without knowing the
+// formats of the requests.
+//
+// Every entry also commits to the hash of the entry before it, which chains
+// the whole log together. Changing, dropping, or reordering any entry breaks
+// the chain from that point onward. The first entry commits to a zero hash.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// AuditAction identifies the kind of action that an audit entry records.
+type AuditAction uint8
+
+// The actions that get recorded in the audit log.
+const (
+	AuditEquipmentAuthorization   AuditAction = iota + 1 // glow.EquipmentAuthorization
+	AuditEquipmentDeauthorization                        // server.EquipmentDeauthorization
+	AuditEquipmentBan                                    // server.EquivocationProof
+	AuditServerRegistration                              // server.AuthorizedServer
+	AuditGCAKeyRotation                                  // server.GCAKeyRotation
+	AuditEquipmentMigration                              // server.EquipmentMigration
+	AuditEquipmentRegion                                 // server.EquipmentRegion
+	AuditEquipmentImport                                 // The equipment import, see server/api_equipment_transfer.go
+	AuditFlaggedReportReview                             // server.FlaggedReportReview
+	AuditOperatorDelegation                              // server.OperatorDelegation
+	AuditReportOverride                                  // server.ReportOverride
+	AuditAnomalyDismissal                                // server.AnomalyDismissal
+	AuditDeviceKeyRotation                               // server.DeviceKeyRotation
+	AuditDeviceNote                                      // server.DeviceNote
+)
+
+// auditActionNames are the names of the actions, as used in JSON.
+var auditActionNames = map[AuditAction]string{
+	AuditEquipmentAuthorization:   "equipment_authorization",
+	AuditEquipmentDeauthorization: "equipment_deauthorization",
+	AuditEquipmentBan:             "equipment_ban",
+	AuditServerRegistration:       "server_registration",
+	AuditGCAKeyRotation:           "gca_key_rotation",
+	AuditEquipmentMigration:       "equipment_migration",
+	AuditEquipmentRegion:          "equipment_region",
+	AuditEquipmentImport:          "equipment_import",
+	AuditFlaggedReportReview:      "flagged_report_review",
+	AuditOperatorDelegation:       "operator_delegation",
+	AuditReportOverride:           "report_override",
+	AuditAnomalyDismissal:         "anomaly_dismissal",
+	AuditDeviceKeyRotation:        "device_key_rotation",
+	AuditDeviceNote:               "device_note",
+}
+
+// String returns the name of the action.
+func (a AuditAction) String() string {
+	if name, exists := auditActionNames[a]; exists {
+		return name
+	}
+	return fmt.Sprintf("AuditAction(%d)", uint8(a))
+}
+
+// MarshalText encodes the action as its name.
+func (a AuditAction) MarshalText() ([]byte, error) {
+	if _, exists := auditActionNames[a]; !exists {
+		return nil, fmt.Errorf("unknown audit action %d", uint8(a))
+	}
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText decodes the name of an action.
+func (a *AuditAction) UnmarshalText(text []byte) error {
+	for action, name := range auditActionNames {
+		if name == string(text) {
+			*a = action
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown audit action %q", text)
+}
+
+// AuditSignature is one of the signatures that a server verified before it
+// accepted an action.
+type AuditSignature struct {
+	PublicKey    PublicKey `json:"public_key"`    // The key that verified the signature
+	SigningBytes []byte    `json:"signing_bytes"` // The bytes that were signed
+	Signature    Signature `json:"signature"`
+}
+
+// AuditEntry is a single entry of the audit log.
+type AuditEntry struct {
+	PrevHash   [32]byte         `json:"prev_hash"` // The hash of the previous entry, zero for the first entry
+	Action     AuditAction      `json:"action"`    // The kind of action
+	Timeslot   uint32           `json:"timeslot"`  // The timeslot in which the server accepted the action
+	Request    []byte           `json:"request"`   // The serialized request, including its signatures
+	Signatures []AuditSignature `json:"signatures"`
+}
+
+// Serialize returns the binary representation of the entry, which is also
+// what the hash of the entry covers. Variable length fields are prefixed with
+// their length.
+func (e AuditEntry) Serialize() []byte {
+	b := make([]byte, 0, 32+1+4+4+len(e.Request)+1+len(e.Signatures)*(32+4+64))
+	b = append(b, e.PrevHash[:]...)
+	b = append(b, byte(e.Action))
+	b = binary.LittleEndian.AppendUint32(b, e.Timeslot)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(e.Request)))
+	b = append(b, e.Request...)
+	b = append(b, byte(len(e.Signatures)))
+	for _, s := range e.Signatures {
+		b = append(b, s.PublicKey[:]...)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(s.SigningBytes)))
+		b = append(b, s.SigningBytes...)
+		b = append(b, s.Signature[:]...)
+	}
+	return b
+}
+
+// DeserializeAuditEntry decodes the entry at the start of b, and returns the
+// entry along with the number of bytes that it took up.
+func DeserializeAuditEntry(b []byte) (AuditEntry, int, error) {
+	var e AuditEntry
+	errShort := errors.New("audit entry is truncated")
+	if len(b) < 32+1+4+4 {
+		return e, 0, errShort
+	}
+	copy(e.PrevHash[:], b)
+	e.Action = AuditAction(b[32])
+	e.Timeslot = binary.LittleEndian.Uint32(b[33:])
+	n := int(binary.LittleEndian.Uint32(b[37:]))
+	i := 41
+	if len(b)-i < n+1 {
+		return e, 0, errShort
+	}
+	e.Request = append([]byte(nil), b[i:i+n]...)
+	i += n
+	numSigs := int(b[i])
+	i++
+	for j := 0; j < numSigs; j++ {
+		var s AuditSignature
+		if len(b)-i < 32+4 {
+			return e, 0, errShort
+		}
+		copy(s.PublicKey[:], b[i:])
+		n := int(binary.LittleEndian.Uint32(b[i+32:]))
+		i += 36
+		if len(b)-i < n+64 {
+			return e, 0, errShort
+		}
+		s.SigningBytes = append([]byte(nil), b[i:i+n]...)
+		copy(s.Signature[:], b[i+n:])
+		i += n + 64
+		e.Signatures = append(e.Signatures, s)
+	}
+	return e, i, nil
+}
+
+// Hash returns the hash of the entry, which the next entry commits to.
+func (e AuditEntry) Hash() [32]byte {
+	return sha256.Sum256(e.Serialize())
+}
+
+// VerifyAuditLog checks that the entries form a chain that starts at the
+// provided hash, and that every signature in every entry is valid for the key
+// that the entry names. The hash of a full log starts at zero. The return
+// value is the hash of the last entry, so a log that was downloaded in pages
+// can be verified one page at a time.
+//
+// VerifyAuditLog does not check which keys signed the entries. Auditors
+// should compare the keys with the key history of the GCA.
+func VerifyAuditLog(prevHash [32]byte, entries []AuditEntry) ([32]byte, error) {
+	for i, e := range entries {
+		if e.PrevHash != prevHash {
+			return prevHash, fmt.Errorf("entry %v does not follow the previous entry", i)
+		}
+		if _, exists := auditActionNames[e.Action]; !exists {
+			return prevHash, fmt.Errorf("entry %v has unknown action %d", i, uint8(e.Action))
+		}
+		if len(e.Signatures) == 0 {
+			return prevHash, fmt.Errorf("entry %v has no signatures", i)
+		}
+		for j, s := range e.Signatures {
+			if !Verify(s.PublicKey, s.SigningBytes, s.Signature) {
+				return prevHash, fmt.Errorf("entry %v has an invalid signature at index %v", i, j)
+			}
+		}
+		prevHash = e.Hash()
+	}
+	return prevHash, nil
+}
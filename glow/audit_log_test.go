@@ -0,0 +1,152 @@
+package glow
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// testAuditLog builds a valid audit log with the provided number of entries.
+func testAuditLog(n int) []AuditEntry {
+	pub, priv := GenerateKeyPair()
+	var entries []AuditEntry
+	var prev [32]byte
+	for i := 0; i < n; i++ {
+		sb := []byte{byte(i), 1, 2, 3}
+		sig := Sign(sb, priv)
+		e := AuditEntry{
+			PrevHash:   prev,
+			Action:     AuditAction(i%int(AuditAnomalyDismissal) + 1),
+			Timeslot:   uint32(100 + i),
+			Request:    append(append([]byte{}, sb...), sig[:]...),
+			Signatures: []AuditSignature{{PublicKey: pub, SigningBytes: sb, Signature: sig}},
+		}
+		entries = append(entries, e)
+		prev = e.Hash()
+	}
+	return entries
+}
+
+// TestAuditEntrySerialization checks that entries survive a round trip
+// through the binary and the JSON encoding.
+func TestAuditEntrySerialization(t *testing.T) {
+	entries := testAuditLog(3)
+	entries[1].Signatures = append(entries[1].Signatures, entries[2].Signatures[0])
+	entries[2].Request = nil
+	var data []byte
+	for _, e := range entries {
+		data = append(data, e.Serialize()...)
+	}
+	for i := range entries {
+		e, n, err := DeserializeAuditEntry(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Hash() != entries[i].Hash() {
+			t.Fatal("entry changed in the round trip:", i)
+		}
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		t.Fatal("leftover data:", len(data))
+	}
+
+	// Every truncation is detected.
+	full := entries[1].Serialize()
+	for i := 0; i < len(full); i++ {
+		if _, _, err := DeserializeAuditEntry(full[:i]); err == nil {
+			t.Fatal("truncated entry was accepted at length", i)
+		}
+	}
+
+	b, err := json.Marshal(entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded AuditEntry
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Hash() != entries[0].Hash() {
+		t.Fatal("entry changed in the JSON round trip")
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(b, &raw)
+	if raw["action"] != "equipment_authorization" {
+		t.Fatal("unexpected action in the JSON:", raw["action"])
+	}
+}
+
+// TestVerifyAuditLog checks that a valid log verifies, in one go and page
+// by page, and that tampering is detected.
+func TestVerifyAuditLog(t *testing.T) {
+	entries := testAuditLog(10)
+	last, err := VerifyAuditLog([32]byte{}, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != entries[9].Hash() {
+		t.Fatal("wrong hash for the last entry")
+	}
+	var prev [32]byte
+	for i := 0; i < 10; i += 4 {
+		end := i + 4
+		if end > 10 {
+			end = 10
+		}
+		prev, err = VerifyAuditLog(prev, entries[i:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prev != last {
+		t.Fatal("paged verification ended at a different hash")
+	}
+
+	// copyLog returns a deep enough copy of the entries to tamper with.
+	copyLog := func() []AuditEntry {
+		c := testAuditLog(0)
+		for _, e := range entries {
+			e.Request = append([]byte{}, e.Request...)
+			e.Signatures = append([]AuditSignature{}, e.Signatures...)
+			c = append(c, e)
+		}
+		return c
+	}
+	tampered := map[string]func([]AuditEntry) []AuditEntry{
+		"changed request": func(l []AuditEntry) []AuditEntry {
+			l[3].Request[0]++
+			return l
+		},
+		"changed timeslot": func(l []AuditEntry) []AuditEntry {
+			l[3].Timeslot++
+			return l
+		},
+		"dropped entry": func(l []AuditEntry) []AuditEntry {
+			return append(l[:4], l[5:]...)
+		},
+		"reordered entries": func(l []AuditEntry) []AuditEntry {
+			l[4], l[5] = l[5], l[4]
+			return l
+		},
+		"bad signature": func(l []AuditEntry) []AuditEntry {
+			l[9].Signatures[0].Signature[10]++
+			return l
+		},
+		"unsigned entry": func(l []AuditEntry) []AuditEntry {
+			l[9].Signatures = nil
+			return l
+		},
+		"unknown action": func(l []AuditEntry) []AuditEntry {
+			l[9].Action = 200
+			return l
+		},
+	}
+	for name, tamper := range tampered {
+		if _, err := VerifyAuditLog([32]byte{}, tamper(copyLog())); err == nil {
+			t.Error("tampering was not detected:", name)
+		}
+	}
+	if _, err := VerifyAuditLog([32]byte{}, entries[1:]); err == nil {
+		t.Error("a log that starts in the middle was accepted")
+	}
+}
@@ -0,0 +1,191 @@
+package glow
+
+// binary_encoding.go contains the building blocks of the compact binary
+// encodings that servers offer as an alternative to JSON on their high volume
+// endpoints. Like the serialization of reports, the encodings are
+// deterministic and little endian. Counters and other small numbers are
+// varints to keep the payloads small, and strings and byte slices are length
+// prefixed.
+//
+// A BinaryDecoder remembers the first error that it runs into, and returns
+// zero values from then on, so a decoder can read a whole structure and only
+// check Err at the end.
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// BinaryContentType is the media type that selects the binary encoding of an
+// endpoint, using the Accept header of the request.
+const BinaryContentType = "application/octet-stream"
+
+// errBinaryTruncated is returned by a BinaryDecoder that ran out of data.
+var errBinaryTruncated = errors.New("binary data is truncated")
+
+// BinaryEncoder builds a binary encoding.
+type BinaryEncoder struct {
+	buf []byte
+}
+
+// Bytes returns the encoding so far.
+func (e *BinaryEncoder) Bytes() []byte {
+	return e.buf
+}
+
+// Reset empties the encoder, keeping its buffer.
+func (e *BinaryEncoder) Reset() {
+	e.buf = e.buf[:0]
+}
+
+// Uint32 appends a fixed size uint32.
+func (e *BinaryEncoder) Uint32(v uint32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+// Uvarint appends a varint encoded unsigned number.
+func (e *BinaryEncoder) Uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+// Varint appends a varint encoded signed number.
+func (e *BinaryEncoder) Varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+// Float64 appends the bits of a float64.
+func (e *BinaryEncoder) Float64(v float64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+}
+
+// Fixed appends bytes without a length prefix, for fields that always have
+// the same size, like keys and signatures.
+func (e *BinaryEncoder) Fixed(b []byte) {
+	e.buf = append(e.buf, b...)
+}
+
+// String appends a length prefixed string.
+func (e *BinaryEncoder) String(s string) {
+	e.Uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// BinaryDecoder reads a binary encoding.
+type BinaryDecoder struct {
+	buf []byte
+	err error
+}
+
+// NewBinaryDecoder returns a decoder that reads from b.
+func NewBinaryDecoder(b []byte) *BinaryDecoder {
+	return &BinaryDecoder{buf: b}
+}
+
+// Err returns the first error that the decoder ran into.
+func (d *BinaryDecoder) Err() error {
+	return d.err
+}
+
+// Fail records an error, for checks that the caller does on the decoded
+// values. Only the first error is kept.
+func (d *BinaryDecoder) Fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// Remaining returns the number of bytes that have not been read yet.
+func (d *BinaryDecoder) Remaining() int {
+	return len(d.buf)
+}
+
+// Uint32 reads a fixed size uint32.
+func (d *BinaryDecoder) Uint32() uint32 {
+	if d.err != nil || len(d.buf) < 4 {
+		d.Fail(errBinaryTruncated)
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return v
+}
+
+// Uvarint reads a varint encoded unsigned number.
+func (d *BinaryDecoder) Uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.Fail(errors.New("invalid varint"))
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// Varint reads a varint encoded signed number.
+func (d *BinaryDecoder) Varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.Fail(errors.New("invalid varint"))
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// Float64 reads the bits of a float64.
+func (d *BinaryDecoder) Float64() float64 {
+	if d.err != nil || len(d.buf) < 8 {
+		d.Fail(errBinaryTruncated)
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.buf))
+	d.buf = d.buf[8:]
+	return v
+}
+
+// Fixed reads len(b) bytes into b.
+func (d *BinaryDecoder) Fixed(b []byte) {
+	if d.err != nil || len(d.buf) < len(b) {
+		d.Fail(errBinaryTruncated)
+		return
+	}
+	copy(b, d.buf)
+	d.buf = d.buf[len(b):]
+}
+
+// String reads a length prefixed string.
+func (d *BinaryDecoder) String() string {
+	n := d.Uvarint()
+	if d.err != nil || uint64(len(d.buf)) < n {
+		d.Fail(errBinaryTruncated)
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+// Count reads a varint that counts items which each take up at least
+// minSize bytes, and fails if the remaining data can't hold that many items.
+// This keeps corrupt counts from causing huge allocations.
+func (d *BinaryDecoder) Count(minSize int) int {
+	n := d.Uvarint()
+	if d.err != nil {
+		return 0
+	}
+	if minSize < 1 {
+		minSize = 1
+	}
+	if n > uint64(len(d.buf)/minSize) {
+		d.Fail(errBinaryTruncated)
+		return 0
+	}
+	return int(n)
+}
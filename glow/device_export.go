@@ -0,0 +1,542 @@
+package glow
+
+// device_export.go defines the device export, a bundle with the full history
+// of a single device that anyone can verify without trusting the server that
+// produced it. A device owner downloads it from /api/v1/device-export and can
+// hand it to a third party, who checks it with VerifyDeviceExport against the
+// key of the GCA and the key of the server.
+//
+// An export is a header followed by a sequence of records:
+//
+//	"GlowDeviceExport" (16 bytes)
+//	version (1 byte)
+//	key rotation overlap (4 bytes)
+//	records, each of them:
+//		kind (1 byte)
+//		length of the payload (4 bytes)
+//		payload
+//
+// The records come in the order of their kinds. The first record is the
+// authorization of the device, signed by the GCA. It is followed by the key
+// rotations of the device, signed by the device and the GCA, the signed
+// reports of the device in order of timeslot, the overrides of the GCA, the
+// proof of the equivocation that got the device banned if there is one, and
+// the timeslots that were banned for the device. The last record is the
+// manifest, which counts the records, contains the sha256 hash of everything
+// before it, and is signed by the server. Nothing may follow the manifest.
+//
+// The signatures of the device and the GCA prove every record except for the
+// banned timeslots and the banned flag of the manifest, which the server
+// attests to with its signature. The server streams the export, so the
+// manifest has to come last, after the hash of the records is known.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+const (
+	// deviceExportMagic starts every device export.
+	deviceExportMagic = "GlowDeviceExport"
+
+	// DeviceExportVersion is the version of the export format.
+	DeviceExportVersion = 1
+
+	// deviceExportHeaderSize is the size of the header of an export.
+	deviceExportHeaderSize = len(deviceExportMagic) + 1 + 4
+
+	// deviceExportManifestSize is the size of the payload of the manifest.
+	deviceExportManifestSize = 32 + 32 + 4 + 8 + 1 + 5*4 + 32 + 64
+
+	// maxDeviceExportRecord is the largest payload of a record, which is
+	// the payload of an override with the longest possible reason.
+	maxDeviceExportRecord = 4 + 8 + 1 + 1 + 255 + 8 + 64
+)
+
+// The kinds of the records of a device export, in the order that they appear.
+const (
+	exportRecordAuthorization byte = iota + 1
+	exportRecordKeyRotation
+	exportRecordReport
+	exportRecordOverride
+	exportRecordEquivocation
+	exportRecordBannedTimeslot
+	exportRecordManifest
+)
+
+// ExportedKeyRotation is a key rotation of the device of an export. The
+// device is the device of the export, so the ShortID is left out.
+type ExportedKeyRotation struct {
+	OldKey             PublicKey
+	NewKey             PublicKey
+	ActivationTimeslot uint32
+	DeviceSignature    Signature // A signature from the old key
+	GCASignature       Signature // A signature from the GCA over the rotation and the device signature
+}
+
+// ExportedOverride is a correction from the GCA to the power output of the
+// device of an export at a single timeslot.
+type ExportedOverride struct {
+	Timeslot    uint32
+	PowerOutput uint64
+	Outage      bool
+	Reason      string
+	Timestamp   int64
+	Signature   Signature
+}
+
+// ExportedEquivocation is a pair of different reports that the device of an
+// export signed for the same timeslot, for which it was banned.
+type ExportedEquivocation struct {
+	First  EquipmentReport
+	Second EquipmentReport
+}
+
+// DeviceExportManifest is the last record of an export, which the server
+// signs.
+type DeviceExportManifest struct {
+	ServerKey PublicKey // The server that produced the export
+	DeviceKey PublicKey // The authorization key of the device
+	ShortID   uint32
+	Timestamp int64 // Unix time of the export
+	Banned    bool  // Whether the server has banned the device
+
+	// The number of records of every kind.
+	KeyRotations    uint32
+	Reports         uint32
+	Overrides       uint32
+	Equivocations   uint32
+	BannedTimeslots uint32
+
+	Digest    [32]byte // The sha256 hash of the export up to the manifest
+	Signature Signature
+}
+
+// SigningBytes returns the bytes that the server signs for the manifest.
+func (m DeviceExportManifest) SigningBytes() []byte {
+	return SerializeDeviceExportForSigning(m)
+}
+
+// DeviceExport is a verified device export.
+type DeviceExport struct {
+	KeyRotationOverlap uint32 // The timeslots that an old key stays valid for after a rotation
+	Authorization      EquipmentAuthorization
+	KeyRotations       []ExportedKeyRotation
+	Reports            []EquipmentReport
+	Overrides          []ExportedOverride
+	Equivocations      []ExportedEquivocation
+	BannedTimeslots    []uint32
+	Manifest           DeviceExportManifest
+}
+
+// DeviceExportWriter streams a device export. The records have to be written
+// in the order of the export format, and Finish has to be called at the end to
+// write the manifest.
+type DeviceExportWriter struct {
+	w        io.Writer
+	hash     hash.Hash
+	manifest DeviceExportManifest
+	last     byte
+	err      error
+}
+
+// NewDeviceExportWriter writes the header and the authorization of an export
+// to w. The overlap is the number of timeslots that the server accepts the
+// old key of a device for after a rotation.
+func NewDeviceExportWriter(w io.Writer, ea EquipmentAuthorization, keyRotationOverlap uint32) *DeviceExportWriter {
+	dw := &DeviceExportWriter{
+		w:    w,
+		hash: sha256.New(),
+		manifest: DeviceExportManifest{
+			DeviceKey: ea.PublicKey,
+			ShortID:   ea.ShortID,
+		},
+	}
+	header := make([]byte, 0, deviceExportHeaderSize)
+	header = append(header, deviceExportMagic...)
+	header = append(header, DeviceExportVersion)
+	header = binary.LittleEndian.AppendUint32(header, keyRotationOverlap)
+	dw.write(header)
+	dw.writeRecord(exportRecordAuthorization, ea.Serialize())
+	return dw
+}
+
+// write writes data to the export, adding it to the hash. The first error
+// sticks.
+func (dw *DeviceExportWriter) write(data []byte) {
+	if dw.err != nil {
+		return
+	}
+	dw.hash.Write(data)
+	_, dw.err = dw.w.Write(data)
+}
+
+// writeRecord writes a record to the export, checking that it comes in order.
+func (dw *DeviceExportWriter) writeRecord(kind byte, payload []byte) error {
+	if dw.err == nil && kind < dw.last {
+		dw.err = fmt.Errorf("record of kind %v written after a record of kind %v", kind, dw.last)
+	}
+	dw.last = kind
+	b := make([]byte, 0, 5+len(payload))
+	b = append(b, kind)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(payload)))
+	dw.write(append(b, payload...))
+	return dw.err
+}
+
+// WriteKeyRotation adds a key rotation to the export.
+func (dw *DeviceExportWriter) WriteKeyRotation(rot ExportedKeyRotation) error {
+	dw.manifest.KeyRotations++
+	return dw.writeRecord(exportRecordKeyRotation, rot.serialize())
+}
+
+// WriteReport adds a signed report to the export.
+func (dw *DeviceExportWriter) WriteReport(er EquipmentReport) error {
+	dw.manifest.Reports++
+	return dw.writeRecord(exportRecordReport, er.Serialize())
+}
+
+// WriteOverride adds an override of the GCA to the export.
+func (dw *DeviceExportWriter) WriteOverride(o ExportedOverride) error {
+	if len(o.Reason) > 255 {
+		return errors.New("override reason is longer than 255 bytes")
+	}
+	dw.manifest.Overrides++
+	return dw.writeRecord(exportRecordOverride, o.serialize())
+}
+
+// WriteEquivocation adds the proof of an equivocation to the export.
+func (dw *DeviceExportWriter) WriteEquivocation(e ExportedEquivocation) error {
+	dw.manifest.Equivocations++
+	return dw.writeRecord(exportRecordEquivocation, append(e.First.Serialize(), e.Second.Serialize()...))
+}
+
+// WriteBannedTimeslot adds a timeslot that was banned for the device to the
+// export.
+func (dw *DeviceExportWriter) WriteBannedTimeslot(timeslot uint32) error {
+	dw.manifest.BannedTimeslots++
+	return dw.writeRecord(exportRecordBannedTimeslot, binary.LittleEndian.AppendUint32(nil, timeslot))
+}
+
+// Finish signs the manifest with the key of the server and writes it, which
+// completes the export.
+func (dw *DeviceExportWriter) Finish(timestamp int64, banned bool, serverKey PublicKey, serverPrivKey PrivateKey) error {
+	if dw.err != nil {
+		return dw.err
+	}
+	m := dw.manifest
+	m.ServerKey = serverKey
+	m.Timestamp = timestamp
+	m.Banned = banned
+	copy(m.Digest[:], dw.hash.Sum(nil))
+	m.Signature = Sign(m.SigningBytes(), serverPrivKey)
+	return dw.writeRecord(exportRecordManifest, m.serialize())
+}
+
+// serialize returns the payload of the record of a key rotation.
+func (rot ExportedKeyRotation) serialize() []byte {
+	b := make([]byte, 0, 32+32+4+64+64)
+	b = append(b, rot.OldKey[:]...)
+	b = append(b, rot.NewKey[:]...)
+	b = binary.LittleEndian.AppendUint32(b, rot.ActivationTimeslot)
+	b = append(b, rot.DeviceSignature[:]...)
+	return append(b, rot.GCASignature[:]...)
+}
+
+// serialize returns the payload of the record of an override.
+func (o ExportedOverride) serialize() []byte {
+	b := make([]byte, 0, 4+8+1+1+len(o.Reason)+8+64)
+	b = binary.LittleEndian.AppendUint32(b, o.Timeslot)
+	b = binary.LittleEndian.AppendUint64(b, o.PowerOutput)
+	if o.Outage {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = append(b, byte(len(o.Reason)))
+	b = append(b, o.Reason...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(o.Timestamp))
+	return append(b, o.Signature[:]...)
+}
+
+// serialize returns the payload of the manifest record, which is the signing
+// bytes without their prefix, followed by the signature.
+func (m DeviceExportManifest) serialize() []byte {
+	return append(m.SigningBytes()[len(SigningPrefixDeviceExport):], m.Signature[:]...)
+}
+
+// deserializeExportedOverride decodes the payload of the record of an
+// override.
+func deserializeExportedOverride(b []byte) (ExportedOverride, error) {
+	var o ExportedOverride
+	if len(b) < 14 || len(b) != 14+int(b[13])+8+64 {
+		return o, fmt.Errorf("override has length %v", len(b))
+	}
+	o.Timeslot = binary.LittleEndian.Uint32(b)
+	o.PowerOutput = binary.LittleEndian.Uint64(b[4:])
+	if b[12] > 1 {
+		return o, errors.New("override has an invalid outage flag")
+	}
+	o.Outage = b[12] == 1
+	i := 14 + int(b[13])
+	o.Reason = string(b[14:i])
+	o.Timestamp = int64(binary.LittleEndian.Uint64(b[i:]))
+	copy(o.Signature[:], b[i+8:])
+	return o, nil
+}
+
+// deserializeDeviceExportManifest decodes the payload of the manifest record.
+func deserializeDeviceExportManifest(b []byte) (DeviceExportManifest, error) {
+	var m DeviceExportManifest
+	if len(b) != deviceExportManifestSize {
+		return m, fmt.Errorf("manifest has length %v, expected %v", len(b), deviceExportManifestSize)
+	}
+	copy(m.ServerKey[:], b)
+	copy(m.DeviceKey[:], b[32:])
+	m.ShortID = binary.LittleEndian.Uint32(b[64:])
+	m.Timestamp = int64(binary.LittleEndian.Uint64(b[68:]))
+	if b[76] > 1 {
+		return m, errors.New("manifest has an invalid banned flag")
+	}
+	m.Banned = b[76] == 1
+	counts := []*uint32{&m.KeyRotations, &m.Reports, &m.Overrides, &m.Equivocations, &m.BannedTimeslots}
+	for i, c := range counts {
+		*c = binary.LittleEndian.Uint32(b[77+4*i:])
+	}
+	copy(m.Digest[:], b[97:129])
+	copy(m.Signature[:], b[129:])
+	return m, nil
+}
+
+// keysAt returns the keys that may sign the reports of the device of the
+// export for the provided timeslot, which is the same rule that the server
+// applies to the reports that it accepts.
+func (de *DeviceExport) keysAt(timeslot uint32) []PublicKey {
+	var keys []PublicKey
+	key, start := de.Authorization.PublicKey, uint32(0)
+	for _, rot := range de.KeyRotations {
+		if timeslot >= start && int64(timeslot) < int64(rot.ActivationTimeslot)+int64(de.KeyRotationOverlap) {
+			keys = append(keys, key)
+		}
+		key, start = rot.NewKey, rot.ActivationTimeslot
+	}
+	if timeslot >= start {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// verifyReport checks that a report belongs to the device of the export and is
+// signed by a key that the device could sign with at its timeslot.
+func (de *DeviceExport) verifyReport(er EquipmentReport) error {
+	if er.ShortID != de.Authorization.ShortID {
+		return fmt.Errorf("report of timeslot %v has ShortID %v, the device has ShortID %v", er.Timeslot, er.ShortID, de.Authorization.ShortID)
+	}
+	for _, key := range de.keysAt(er.Timeslot) {
+		if Verify(key, er.SigningBytes(), er.Signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid signature on the report of ShortID %v for timeslot %v", er.ShortID, er.Timeslot)
+}
+
+// VerifyDeviceExport reads a device export from r and checks every record: the
+// authorization and the overrides against the key of the GCA, the rotations
+// against the keys of the device and the GCA, the reports and the
+// equivocation against the keys of the device, and the manifest against the
+// key of the server. The export is returned if everything verifies.
+func VerifyDeviceExport(r io.Reader, gcaKey PublicKey, serverKey PublicKey) (DeviceExport, error) {
+	var de DeviceExport
+	br := bufio.NewReader(r)
+	h := sha256.New()
+
+	header := make([]byte, deviceExportHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return de, fmt.Errorf("unable to read the header: %v", err)
+	}
+	if string(header[:len(deviceExportMagic)]) != deviceExportMagic {
+		return de, errors.New("not a device export")
+	}
+	if v := header[len(deviceExportMagic)]; v != DeviceExportVersion {
+		return de, fmt.Errorf("unsupported device export version %v", v)
+	}
+	de.KeyRotationOverlap = binary.LittleEndian.Uint32(header[len(deviceExportMagic)+1:])
+	h.Write(header)
+
+	var last byte
+	var lastTimeslot int64 = -1
+	var digest [32]byte
+	for {
+		var rh [5]byte
+		if _, err := io.ReadFull(br, rh[:]); err != nil {
+			return de, fmt.Errorf("export ends without a manifest: %v", err)
+		}
+		kind, size := rh[0], binary.LittleEndian.Uint32(rh[1:])
+		if size > maxDeviceExportRecord {
+			return de, fmt.Errorf("record of kind %v has length %v, which is too long", kind, size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return de, fmt.Errorf("record of kind %v is truncated: %v", kind, err)
+		}
+		if kind != exportRecordManifest {
+			h.Write(rh[:])
+			h.Write(payload)
+		} else {
+			copy(digest[:], h.Sum(nil))
+		}
+		if (last == 0) != (kind == exportRecordAuthorization) || kind < last {
+			return de, fmt.Errorf("record of kind %v is out of order", kind)
+		}
+		if kind != last {
+			lastTimeslot = -1
+		}
+		last = kind
+
+		// Every kind except for the rotations lists its timeslots in
+		// ascending order.
+		timeslot := func(ts uint32) error {
+			if int64(ts) <= lastTimeslot {
+				return fmt.Errorf("record of kind %v for timeslot %v is out of order", kind, ts)
+			}
+			lastTimeslot = int64(ts)
+			return nil
+		}
+
+		switch kind {
+		case exportRecordAuthorization:
+			ea, err := DeserializeEquipmentAuthorization(payload)
+			if err != nil {
+				return de, fmt.Errorf("unable to decode the authorization: %v", err)
+			}
+			if !Verify(gcaKey, ea.SigningBytes(), ea.Signature) {
+				return de, errors.New("invalid signature on the authorization")
+			}
+			de.Authorization = ea
+
+		case exportRecordKeyRotation:
+			if len(payload) != 32+32+4+64+64 {
+				return de, fmt.Errorf("key rotation has length %v", len(payload))
+			}
+			var rot ExportedKeyRotation
+			copy(rot.OldKey[:], payload)
+			copy(rot.NewKey[:], payload[32:])
+			rot.ActivationTimeslot = binary.LittleEndian.Uint32(payload[64:])
+			copy(rot.DeviceSignature[:], payload[68:])
+			copy(rot.GCASignature[:], payload[132:])
+			latest := de.Authorization.PublicKey
+			if n := len(de.KeyRotations); n > 0 {
+				latest = de.KeyRotations[n-1].NewKey
+				if rot.ActivationTimeslot < de.KeyRotations[n-1].ActivationTimeslot {
+					return de, fmt.Errorf("key rotation %v activates before the previous rotation", n)
+				}
+			}
+			sb := SerializeDeviceKeyRotationForSigning(de.Authorization.ShortID, rot.OldKey, rot.NewKey, rot.ActivationTimeslot)
+			if rot.OldKey != latest || !Verify(rot.OldKey, sb, rot.DeviceSignature) {
+				return de, fmt.Errorf("key rotation %v is not signed by the latest key of the device", len(de.KeyRotations))
+			}
+			if !Verify(gcaKey, append(sb, rot.DeviceSignature[:]...), rot.GCASignature) {
+				return de, fmt.Errorf("invalid GCA signature on key rotation %v", len(de.KeyRotations))
+			}
+			de.KeyRotations = append(de.KeyRotations, rot)
+
+		case exportRecordReport:
+			er, err := DeserializeReport(payload)
+			if err != nil {
+				return de, fmt.Errorf("unable to decode report %v: %v", len(de.Reports), err)
+			}
+			if err := timeslot(er.Timeslot); err != nil {
+				return de, err
+			}
+			if err := de.verifyReport(er); err != nil {
+				return de, err
+			}
+			de.Reports = append(de.Reports, er)
+
+		case exportRecordOverride:
+			o, err := deserializeExportedOverride(payload)
+			if err != nil {
+				return de, fmt.Errorf("unable to decode override %v: %v", len(de.Overrides), err)
+			}
+			if err := timeslot(o.Timeslot); err != nil {
+				return de, err
+			}
+			sb := SerializeReportOverrideForSigning(de.Authorization.PublicKey, o.Timeslot, o.PowerOutput, o.Outage, o.Reason, o.Timestamp)
+			if !Verify(gcaKey, sb, o.Signature) {
+				return de, fmt.Errorf("invalid signature on the override of timeslot %v", o.Timeslot)
+			}
+			de.Overrides = append(de.Overrides, o)
+
+		case exportRecordEquivocation:
+			if len(payload) != 2*80 {
+				return de, fmt.Errorf("equivocation has length %v", len(payload))
+			}
+			var e ExportedEquivocation
+			e.First, _ = DeserializeReport(payload[:80])
+			e.Second, _ = DeserializeReport(payload[80:])
+			if e.First.Timeslot != e.Second.Timeslot || e.First.PowerOutput == e.Second.PowerOutput {
+				return de, errors.New("the reports of the equivocation do not conflict")
+			}
+			if err := timeslot(e.First.Timeslot); err != nil {
+				return de, err
+			}
+			for _, er := range []EquipmentReport{e.First, e.Second} {
+				if err := de.verifyReport(er); err != nil {
+					return de, fmt.Errorf("equivocation: %v", err)
+				}
+			}
+			de.Equivocations = append(de.Equivocations, e)
+
+		case exportRecordBannedTimeslot:
+			if len(payload) != 4 {
+				return de, fmt.Errorf("banned timeslot has length %v", len(payload))
+			}
+			ts := binary.LittleEndian.Uint32(payload)
+			if err := timeslot(ts); err != nil {
+				return de, err
+			}
+			de.BannedTimeslots = append(de.BannedTimeslots, ts)
+
+		case exportRecordManifest:
+			m, err := deserializeDeviceExportManifest(payload)
+			if err != nil {
+				return de, err
+			}
+			if _, err := br.ReadByte(); err != io.EOF {
+				return de, errors.New("export continues after the manifest")
+			}
+			return de, de.verifyManifest(m, digest, serverKey)
+
+		default:
+			return de, fmt.Errorf("unknown record kind %v", kind)
+		}
+	}
+}
+
+// verifyManifest checks that the manifest describes the records of the export
+// and was signed by the server.
+func (de *DeviceExport) verifyManifest(m DeviceExportManifest, digest [32]byte, serverKey PublicKey) error {
+	de.Manifest = m
+	if m.ServerKey != serverKey {
+		return fmt.Errorf("export was made by server %x, expected %x", m.ServerKey, serverKey)
+	}
+	if m.DeviceKey != de.Authorization.PublicKey || m.ShortID != de.Authorization.ShortID {
+		return errors.New("manifest names a different device than the authorization")
+	}
+	if m.KeyRotations != uint32(len(de.KeyRotations)) || m.Reports != uint32(len(de.Reports)) || m.Overrides != uint32(len(de.Overrides)) ||
+		m.Equivocations != uint32(len(de.Equivocations)) || m.BannedTimeslots != uint32(len(de.BannedTimeslots)) {
+		return errors.New("manifest does not count the records of the export")
+	}
+	if m.Digest != digest {
+		return errors.New("manifest does not match the hash of the export")
+	}
+	if !Verify(serverKey, m.SigningBytes(), m.Signature) {
+		return errors.New("invalid signature on the manifest")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package glow
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testDeviceExport writes an export with a record of every kind. The device
+// rotates its key at timeslot 100, and the overlap is 10 timeslots.
+func testDeviceExport(t *testing.T) (data []byte, gcaPub PublicKey, serverPub PublicKey) {
+	gcaPub, gcaPriv := GenerateKeyPair()
+	serverPub, serverPriv := GenerateKeyPair()
+	oldPub, oldPriv := GenerateKeyPair()
+	newPub, newPriv := GenerateKeyPair()
+
+	ea := EquipmentAuthorization{Version: EquipmentAuthorizationVersion, ShortID: 7, PublicKey: oldPub, Capacity: 5000, Nonce: 9}
+	ea.Signature = Sign(ea.SigningBytes(), gcaPriv)
+	rot := ExportedKeyRotation{OldKey: oldPub, NewKey: newPub, ActivationTimeslot: 100}
+	sb := SerializeDeviceKeyRotationForSigning(ea.ShortID, oldPub, newPub, 100)
+	rot.DeviceSignature = Sign(sb, oldPriv)
+	rot.GCASignature = Sign(append(sb, rot.DeviceSignature[:]...), gcaPriv)
+	report := func(timeslot uint32, power uint64, priv PrivateKey) EquipmentReport {
+		er := EquipmentReport{ShortID: ea.ShortID, Timeslot: timeslot, PowerOutput: power}
+		er.Signature = Sign(er.SigningBytes(), priv)
+		return er
+	}
+	o := ExportedOverride{Timeslot: 50, PowerOutput: 20, Reason: "meter reset", Timestamp: 1700000000}
+	o.Signature = Sign(SerializeReportOverrideForSigning(oldPub, o.Timeslot, o.PowerOutput, o.Outage, o.Reason, o.Timestamp), gcaPriv)
+
+	var buf bytes.Buffer
+	dw := NewDeviceExportWriter(&buf, ea, 10)
+	steps := []error{
+		dw.WriteKeyRotation(rot),
+		dw.WriteReport(report(50, 10, oldPriv)),
+		dw.WriteReport(report(105, 11, oldPriv)), // The old key during the overlap
+		dw.WriteReport(report(120, 12, newPriv)),
+		dw.WriteOverride(o),
+		dw.WriteEquivocation(ExportedEquivocation{First: report(130, 5, newPriv), Second: report(130, 6, newPriv)}),
+		dw.WriteBannedTimeslot(130),
+		dw.Finish(1700000000, true, serverPub, serverPriv),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	return buf.Bytes(), gcaPub, serverPub
+}
+
+// TestDeviceExport checks that an export verifies, and that it stops
+// verifying when any byte changes, when it is cut short, or when it is checked
+// against the wrong keys.
+func TestDeviceExport(t *testing.T) {
+	data, gcaPub, serverPub := testDeviceExport(t)
+	de, err := VerifyDeviceExport(bytes.NewReader(data), gcaPub, serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(de.KeyRotations) != 1 || len(de.Reports) != 3 || len(de.Overrides) != 1 || len(de.Equivocations) != 1 || len(de.BannedTimeslots) != 1 {
+		t.Fatal("unexpected export:", de)
+	}
+	if !de.Manifest.Banned || de.Manifest.ShortID != 7 || de.KeyRotationOverlap != 10 || de.Overrides[0].Reason != "meter reset" {
+		t.Fatal("unexpected export:", de.Manifest, de.KeyRotationOverlap)
+	}
+
+	verify := func(b []byte) bool {
+		_, err := VerifyDeviceExport(bytes.NewReader(b), gcaPub, serverPub)
+		return err == nil
+	}
+	checkMutations(t, data, 0x40, verify)
+	for _, n := range []int{0, deviceExportHeaderSize, len(data) / 2, len(data) - 1} {
+		if verify(data[:n]) {
+			t.Fatal("truncated export verified:", n)
+		}
+	}
+	if verify(append(data[:len(data):len(data)], 0)) {
+		t.Fatal("export with trailing data verified")
+	}
+	otherPub, _ := GenerateKeyPair()
+	if _, err := VerifyDeviceExport(bytes.NewReader(data), otherPub, serverPub); err == nil || !strings.Contains(err.Error(), "authorization") {
+		t.Fatal("export verified against the wrong GCA key:", err)
+	}
+	if _, err := VerifyDeviceExport(bytes.NewReader(data), gcaPub, otherPub); err == nil {
+		t.Fatal("export verified against the wrong server key")
+	}
+}
+
+// TestDeviceExportOrder checks that the writer refuses records that are out of
+// order.
+func TestDeviceExportOrder(t *testing.T) {
+	_, gcaPriv := GenerateKeyPair()
+	devPub, devPriv := GenerateKeyPair()
+	ea := EquipmentAuthorization{Version: EquipmentAuthorizationVersion, ShortID: 1, PublicKey: devPub}
+	ea.Signature = Sign(ea.SigningBytes(), gcaPriv)
+	er := EquipmentReport{ShortID: 1, Timeslot: 3, PowerOutput: 4}
+	er.Signature = Sign(er.SigningBytes(), devPriv)
+
+	var buf bytes.Buffer
+	dw := NewDeviceExportWriter(&buf, ea, 0)
+	if err := dw.WriteBannedTimeslot(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := dw.WriteReport(er); err == nil {
+		t.Fatal("report was written after a banned timeslot")
+	}
+}
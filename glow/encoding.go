@@ -0,0 +1,293 @@
+package glow
+
+// encoding.go holds the canonical byte layout of every message that is signed
+// by one party and verified by another. Devices, GCA servers and the GCA all
+// have to produce exactly the same bytes for a message, so each layout lives
+// in exactly one function here, and the SigningBytes methods throughout the
+// repo delegate to these functions rather than packing bytes by hand.
+//
+// Every layout starts with the name of its message type, which keeps a
+// signature on one type of message from being replayed as another. The rest
+// of the layout is the serialization of the message without its signature.
+// All integers are little endian. The layouts are pinned by golden vectors in
+// encoding_test.go, and must never change, as changing them breaks every
+// signature that has already been made.
+
+import (
+	"encoding/binary"
+)
+
+// The prefixes of the signed messages.
+const (
+	SigningPrefixEquipmentReport        = "EquipmentReport"
+	SigningPrefixEquipmentAuthorization = "EquipmentAuthorization"
+	SigningPrefixReportAck              = "ReportAck"
+	SigningPrefixTimeProbeResponse      = "TimeProbeResponse"
+	SigningPrefixSignedResponse         = "SignedResponse"
+	SigningPrefixAuthorizedServer       = "AuthorizedServer"
+	SigningPrefixEquipmentMigration     = "EquipmentMigration"
+	SigningPrefixRequestAuth            = "RequestAuth"
+	SigningPrefixOperatorDelegation     = "OperatorDelegation"
+	SigningPrefixReportOverride         = "ReportOverride"
+	SigningPrefixWebhookEvent           = "WebhookEvent"
+	SigningPrefixAnomalyDismissal       = "AnomalyDismissal"
+	SigningPrefixDeviceKeyRotation      = "DeviceKeyRotation"
+	SigningPrefixDeviceExport           = "DeviceExport"
+	SigningPrefixHeartbeat              = "Heartbeat"
+)
+
+// SerializeReportForSigning returns the bytes that a device signs for an
+// equipment report:
+//
+//	"EquipmentReport" || ShortID (4) || Timeslot (4) || PowerOutput (8)
+func SerializeReportForSigning(er EquipmentReport) []byte {
+	b := make([]byte, 0, len(SigningPrefixEquipmentReport)+16)
+	b = append(b, SigningPrefixEquipmentReport...)
+	b = binary.LittleEndian.AppendUint32(b, er.ShortID)
+	b = binary.LittleEndian.AppendUint32(b, er.Timeslot)
+	b = binary.LittleEndian.AppendUint64(b, er.PowerOutput)
+	return b
+}
+
+// SerializeEquipmentAuthorizationForSigning returns the bytes that the GCA
+// signs for an equipment authorization. They are the prefix followed by the
+// serialization of the authorization in its own format, minus the signature,
+// so the legacy format has no version and no nonce.
+func SerializeEquipmentAuthorizationForSigning(ea EquipmentAuthorization) []byte {
+	serialization := ea.Serialize()
+	b := make([]byte, 0, len(SigningPrefixEquipmentAuthorization)+len(serialization)-64)
+	b = append(b, SigningPrefixEquipmentAuthorization...)
+	return append(b, serialization[:len(serialization)-64]...)
+}
+
+// SerializeReportAckForSigning returns the bytes that a GCA server signs for a
+// report ack:
+//
+//	"ReportAck" || ShortID (4) || Timeslot (4) || Status (1)
+func SerializeReportAckForSigning(ra ReportAck) []byte {
+	b := make([]byte, 0, len(SigningPrefixReportAck)+9)
+	b = append(b, SigningPrefixReportAck...)
+	b = binary.LittleEndian.AppendUint32(b, ra.ShortID)
+	b = binary.LittleEndian.AppendUint32(b, ra.Timeslot)
+	return append(b, ra.Status)
+}
+
+// SerializeHeartbeatForSigning returns the bytes that a device signs for a
+// heartbeat:
+//
+//	"Heartbeat" || ShortID (4) || Timeslot (4) || Status (1)
+func SerializeHeartbeatForSigning(hb Heartbeat) []byte {
+	b := make([]byte, 0, len(SigningPrefixHeartbeat)+9)
+	b = append(b, SigningPrefixHeartbeat...)
+	b = binary.LittleEndian.AppendUint32(b, hb.ShortID)
+	b = binary.LittleEndian.AppendUint32(b, hb.Timeslot)
+	return append(b, hb.Status)
+}
+
+// SerializeTimeProbeResponseForSigning returns the bytes that a GCA server
+// signs when answering a time probe:
+//
+//	"TimeProbeResponse" || Nonce (8) || UnixMilli (8) || Timeslot (4)
+func SerializeTimeProbeResponseForSigning(tpr TimeProbeResponse) []byte {
+	b := make([]byte, 0, len(SigningPrefixTimeProbeResponse)+20)
+	b = append(b, SigningPrefixTimeProbeResponse...)
+	b = binary.LittleEndian.AppendUint64(b, tpr.Nonce)
+	b = binary.LittleEndian.AppendUint64(b, uint64(tpr.UnixMilli))
+	return binary.LittleEndian.AppendUint32(b, tpr.Timeslot)
+}
+
+// SerializeSignedResponseForSigning returns the bytes that a GCA server signs
+// for a signed API response:
+//
+//	"SignedResponse" || PublicKey (32) || Timestamp (8) || Body
+func SerializeSignedResponseForSigning(sr SignedResponse) []byte {
+	b := make([]byte, 0, len(SigningPrefixSignedResponse)+40+len(sr.Body))
+	b = append(b, SigningPrefixSignedResponse...)
+	b = append(b, sr.PublicKey[:]...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(sr.Timestamp))
+	return append(b, sr.Body...)
+}
+
+// AppendAuthorizedServer appends the serialization of a GCA server
+// authorization, minus the signature of the GCA, to b:
+//
+//	PublicKey (32) || Banned (1) || len(Location) (1) || Location ||
+//	HttpPort (2) || TcpPort (2) || UdpPort (2)
+//
+// The location must be shorter than 256 bytes.
+func AppendAuthorizedServer(b []byte, pk PublicKey, banned bool, location string, httpPort, tcpPort, udpPort uint16) []byte {
+	b = append(b, pk[:]...)
+	if banned {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = append(b, byte(len(location)))
+	b = append(b, location...)
+	b = binary.LittleEndian.AppendUint16(b, httpPort)
+	b = binary.LittleEndian.AppendUint16(b, tcpPort)
+	return binary.LittleEndian.AppendUint16(b, udpPort)
+}
+
+// SerializeAuthorizedServerForSigning returns the bytes that the GCA signs to
+// authorize or ban a GCA server.
+func SerializeAuthorizedServerForSigning(pk PublicKey, banned bool, location string, httpPort, tcpPort, udpPort uint16) []byte {
+	b := make([]byte, 0, len(SigningPrefixAuthorizedServer)+40+len(location))
+	b = append(b, SigningPrefixAuthorizedServer...)
+	return AppendAuthorizedServer(b, pk, banned, location, httpPort, tcpPort, udpPort)
+}
+
+// SerializeRequestAuthForSigning returns the bytes that an operator signs to
+// authenticate an HTTP request:
+//
+//	"RequestAuth" || len(Method) (1) || Method || len(Path) (2) || Path ||
+//	BodyHash (32) || Timestamp (8)
+//
+// The path includes the query string. The method must be shorter than 256
+// bytes and the path shorter than 65536 bytes.
+func SerializeRequestAuthForSigning(method, path string, bodyHash [32]byte, timestamp int64) []byte {
+	b := make([]byte, 0, len(SigningPrefixRequestAuth)+43+len(method)+len(path))
+	b = append(b, SigningPrefixRequestAuth...)
+	b = append(b, byte(len(method)))
+	b = append(b, method...)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(path)))
+	b = append(b, path...)
+	b = append(b, bodyHash[:]...)
+	return binary.LittleEndian.AppendUint64(b, uint64(timestamp))
+}
+
+// SerializeOperatorDelegationForSigning returns the bytes that the GCA signs
+// to delegate scopes to an operator key, or to revoke them:
+//
+//	"OperatorDelegation" || PublicKey (32) || len(Name) (1) || Name ||
+//	Scopes (4) || Revoked (1) || Timestamp (8)
+//
+// The name must be shorter than 256 bytes.
+func SerializeOperatorDelegationForSigning(pk PublicKey, name string, scopes uint32, revoked bool, timestamp int64) []byte {
+	b := make([]byte, 0, len(SigningPrefixOperatorDelegation)+46+len(name))
+	b = append(b, SigningPrefixOperatorDelegation...)
+	b = append(b, pk[:]...)
+	b = append(b, byte(len(name)))
+	b = append(b, name...)
+	b = binary.LittleEndian.AppendUint32(b, scopes)
+	if revoked {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	return binary.LittleEndian.AppendUint64(b, uint64(timestamp))
+}
+
+// SerializeReportOverrideForSigning returns the bytes that the GCA signs to
+// replace the power output of a device at a timeslot:
+//
+//	"ReportOverride" || PublicKey (32) || Timeslot (4) || PowerOutput (8) ||
+//	Outage (1) || len(Reason) (1) || Reason || Timestamp (8)
+//
+// The reason must be shorter than 256 bytes.
+func SerializeReportOverrideForSigning(pk PublicKey, timeslot uint32, powerOutput uint64, outage bool, reason string, timestamp int64) []byte {
+	b := make([]byte, 0, len(SigningPrefixReportOverride)+54+len(reason))
+	b = append(b, SigningPrefixReportOverride...)
+	b = append(b, pk[:]...)
+	b = binary.LittleEndian.AppendUint32(b, timeslot)
+	b = binary.LittleEndian.AppendUint64(b, powerOutput)
+	if outage {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = append(b, byte(len(reason)))
+	b = append(b, reason...)
+	return binary.LittleEndian.AppendUint64(b, uint64(timestamp))
+}
+
+// SerializeAnomalyDismissalForSigning returns the bytes that the GCA signs to
+// dismiss an anomaly that was flagged for a device:
+//
+//	"AnomalyDismissal" || PublicKey (32) || len(Kind) (1) || Kind ||
+//	StartTimeslot (4)
+//
+// The kind must be shorter than 256 bytes.
+func SerializeAnomalyDismissalForSigning(pk PublicKey, kind string, startTimeslot uint32) []byte {
+	b := make([]byte, 0, len(SigningPrefixAnomalyDismissal)+37+len(kind))
+	b = append(b, SigningPrefixAnomalyDismissal...)
+	b = append(b, pk[:]...)
+	b = append(b, byte(len(kind)))
+	b = append(b, kind...)
+	return binary.LittleEndian.AppendUint32(b, startTimeslot)
+}
+
+// SerializeWebhookEventForSigning returns the bytes that a GCA server signs
+// for an event that it posts to a webhook:
+//
+//	"WebhookEvent" || Body
+func SerializeWebhookEventForSigning(body []byte) []byte {
+	b := make([]byte, 0, len(SigningPrefixWebhookEvent)+len(body))
+	b = append(b, SigningPrefixWebhookEvent...)
+	return append(b, body...)
+}
+
+// SerializeEquipmentMigrationForSigning returns the bytes that the GCA signs
+// to move a device to a new GCA:
+//
+//	"EquipmentMigration" || Equipment (32) || NewGCA (32) || NewShortID (4) ||
+//	servers
+//
+// where each of the servers is the full serialization of a server
+// authorization from the new GCA, including its signature.
+func SerializeEquipmentMigrationForSigning(equipment, newGCA PublicKey, newShortID uint32, servers [][]byte) []byte {
+	b := make([]byte, 0, len(SigningPrefixEquipmentMigration)+68)
+	b = append(b, SigningPrefixEquipmentMigration...)
+	b = append(b, equipment[:]...)
+	b = append(b, newGCA[:]...)
+	b = binary.LittleEndian.AppendUint32(b, newShortID)
+	for _, s := range servers {
+		b = append(b, s...)
+	}
+	return b
+}
+
+// SerializeDeviceKeyRotationForSigning returns the bytes that the old key of a
+// device signs to hand off to a new key:
+//
+//	"DeviceKeyRotation" || ShortID (4) || OldKey (32) || NewKey (32) ||
+//	ActivationTimeslot (4)
+//
+// The GCA counter-signs these bytes followed by the signature of the device.
+func SerializeDeviceKeyRotationForSigning(shortID uint32, oldKey, newKey PublicKey, activationTimeslot uint32) []byte {
+	b := make([]byte, 0, len(SigningPrefixDeviceKeyRotation)+72)
+	b = append(b, SigningPrefixDeviceKeyRotation...)
+	b = binary.LittleEndian.AppendUint32(b, shortID)
+	b = append(b, oldKey[:]...)
+	b = append(b, newKey[:]...)
+	return binary.LittleEndian.AppendUint32(b, activationTimeslot)
+}
+
+// SerializeDeviceExportForSigning returns the bytes that a GCA server signs
+// for the manifest of a device export:
+//
+//	"DeviceExport" || ServerKey (32) || DeviceKey (32) || ShortID (4) ||
+//	Timestamp (8) || Banned (1) || KeyRotations (4) || Reports (4) ||
+//	Overrides (4) || Equivocations (4) || BannedTimeslots (4) || Digest (32)
+//
+// The manifest record of the export is the same layout without the prefix,
+// followed by the signature.
+func SerializeDeviceExportForSigning(m DeviceExportManifest) []byte {
+	b := make([]byte, 0, len(SigningPrefixDeviceExport)+deviceExportManifestSize-64)
+	b = append(b, SigningPrefixDeviceExport...)
+	b = append(b, m.ServerKey[:]...)
+	b = append(b, m.DeviceKey[:]...)
+	b = binary.LittleEndian.AppendUint32(b, m.ShortID)
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.Timestamp))
+	if m.Banned {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = binary.LittleEndian.AppendUint32(b, m.KeyRotations)
+	b = binary.LittleEndian.AppendUint32(b, m.Reports)
+	b = binary.LittleEndian.AppendUint32(b, m.Overrides)
+	b = binary.LittleEndian.AppendUint32(b, m.Equivocations)
+	b = binary.LittleEndian.AppendUint32(b, m.BannedTimeslots)
+	return append(b, m.Digest[:]...)
+}
@@ -0,0 +1,216 @@
+package glow
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+// goldenKeys returns the two fixed public keys used by the golden vectors.
+func goldenKeys() (PublicKey, PublicKey) {
+	var pk, pk2 PublicKey
+	for i := range pk {
+		pk[i] = byte(i)
+		pk2[i] = byte(0xa0 + i)
+	}
+	return pk, pk2
+}
+
+// TestSigningGoldenVectors pins the exact bytes that are signed for every
+// message type. A failure means that the layout of a message changed, which
+// would invalidate every signature that was already made.
+func TestSigningGoldenVectors(t *testing.T) {
+	pk, pk2 := goldenKeys()
+	ea := EquipmentAuthorization{
+		Version:        EquipmentAuthorizationVersionLegacy,
+		ShortID:        7,
+		PublicKey:      pk,
+		Latitude:       38.5,
+		Longitude:      -121.25,
+		Capacity:       5000,
+		Debt:           12,
+		Expiration:     100000,
+		Initialization: 2016,
+		ProtocolFee:    999,
+	}
+	legacy := SerializeEquipmentAuthorizationForSigning(ea)
+	ea.Version = EquipmentAuthorizationVersion
+	ea.Nonce = 0x0102030405060708
+	server := AppendAuthorizedServer(nil, pk2, true, "nyc", 35015, 35030, 35045)
+	server = append(server, make([]byte, 64)...)
+	var bodyHash [32]byte
+	for i := range bodyHash {
+		bodyHash[i] = byte(0xc0 + i)
+	}
+	exportManifest := DeviceExportManifest{
+		ServerKey:       pk2,
+		DeviceKey:       pk,
+		ShortID:         7,
+		Timestamp:       1700000000,
+		Banned:          true,
+		KeyRotations:    1,
+		Reports:         2016,
+		Overrides:       3,
+		Equivocations:   1,
+		BannedTimeslots: 2,
+		Digest:          bodyHash,
+	}
+
+	tests := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"EquipmentReport", SerializeReportForSigning(EquipmentReport{ShortID: 0x01020304, Timeslot: 0x0a0b0c0d, PowerOutput: 0x1122334455667788}), "45717569706d656e745265706f7274040302010d0c0b0a8877665544332211"},
+		{"EquipmentAuthorizationLegacy", legacy, "45717569706d656e74417574686f72697a6174696f6e07000000000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f00000000004043400000000000505ec088130000000000000c00000000000000a0860100e0070000e703000000000000"},
+		{"EquipmentAuthorization", SerializeEquipmentAuthorizationForSigning(ea), "45717569706d656e74417574686f72697a6174696f6e0107000000000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f00000000004043400000000000505ec088130000000000000c00000000000000a0860100e0070000e7030000000000000807060504030201"},
+		{"ReportAck", SerializeReportAckForSigning(ReportAck{ShortID: 9, Timeslot: 4032, Status: ReportAckFlagged}), "5265706f727441636b09000000c00f000006"},
+		{"TimeProbeResponse", SerializeTimeProbeResponseForSigning(TimeProbeResponse{Nonce: 0xdeadbeef, UnixMilli: -5, Timeslot: 77}), "54696d6550726f6265526573706f6e7365efbeadde00000000fbffffffffffffff4d000000"},
+		{"SignedResponse", SerializeSignedResponseForSigning(SignedResponse{Body: `{"a":1}`, Timestamp: 1700000000, PublicKey: pk}), "5369676e6564526573706f6e7365000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f00f15365000000007b2261223a317d"},
+		{"AuthorizedServer", SerializeAuthorizedServerForSigning(pk2, true, "nyc", 35015, 35030, 35045), "417574686f72697a6564536572766572a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebf01036e7963c788d688e588"},
+		{"EquipmentMigration", SerializeEquipmentMigrationForSigning(pk, pk2, 42, [][]byte{server}), "45717569706d656e744d6967726174696f6e000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1fa0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebf2a000000a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebf01036e7963c788d688e58800000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"},
+		{"OperatorDelegation", SerializeOperatorDelegationForSigning(pk, "ops", 0x0f, true, 1700000000), "4f70657261746f7244656c65676174696f6e000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f036f70730f0000000100f1536500000000"},
+		{"ReportOverride", SerializeReportOverrideForSigning(pk, 4032, 0x1122334455667788, true, "outage", 1700000000), "5265706f72744f76657272696465000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1fc00f0000887766554433221101066f757461676500f1536500000000"},
+		{"AnomalyDismissal", SerializeAnomalyDismissalForSigning(pk, "night_output", 4032), "416e6f6d616c794469736d697373616c000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f0c6e696768745f6f7574707574c00f0000"},
+		{"WebhookEvent", SerializeWebhookEventForSigning([]byte(`{"a":1}`)), "576562686f6f6b4576656e747b2261223a317d"},
+		{"RequestAuth", SerializeRequestAuthForSigning("GET", "/api/v1/audit-log?limit=5", bodyHash, 1700000000), "52657175657374417574680347455419002f6170692f76312f61756469742d6c6f673f6c696d69743d35c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedf00f1536500000000"},
+		{"DeviceKeyRotation", SerializeDeviceKeyRotationForSigning(7, pk, pk2, 4032), "4465766963654b6579526f746174696f6e07000000000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1fa0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebfc00f0000"},
+		{"DeviceExport", SerializeDeviceExportForSigning(exportManifest), "4465766963654578706f7274a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebf000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f0700000000f15365000000000101000000e0070000030000000100000002000000c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedf"},
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(test.got); got != test.want {
+			t.Errorf("%v: signing bytes changed\ngot:  %v\nwant: %v", test.name, got, test.want)
+		}
+	}
+}
+
+// checkMutations flips every byte of a signed serialization in turn, and
+// checks that the mutated data either fails to decode or fails to verify.
+func checkMutations(t *testing.T, data []byte, delta byte, verify func([]byte) bool) {
+	if delta == 0 {
+		delta = 1
+	}
+	mutated := make([]byte, len(data))
+	for i := range data {
+		copy(mutated, data)
+		mutated[i] ^= delta
+		if verify(mutated) {
+			t.Fatalf("signature still verifies after byte %v was changed", i)
+		}
+	}
+}
+
+// FuzzEquipmentReportEncoding checks that reports survive a round trip, and
+// that changing any byte of a signed report breaks its signature.
+func FuzzEquipmentReportEncoding(f *testing.F) {
+	pub, priv := GenerateKeyPair()
+	f.Add(uint32(1), uint32(2016), uint64(5), byte(1))
+	f.Add(uint32(math.MaxUint32), uint32(0), uint64(math.MaxUint64), byte(0x80))
+	f.Fuzz(func(t *testing.T, shortID, timeslot uint32, power uint64, delta byte) {
+		er := EquipmentReport{ShortID: shortID, Timeslot: timeslot, PowerOutput: power}
+		er.Signature = Sign(er.SigningBytes(), priv)
+		data := er.Serialize()
+		decoded, err := DeserializeReport(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != er {
+			t.Fatal("report changed in the round trip")
+		}
+		checkMutations(t, data, delta, func(b []byte) bool {
+			er, err := DeserializeReport(b)
+			return err == nil && Verify(pub, er.SigningBytes(), er.Signature)
+		})
+	})
+}
+
+// FuzzEquipmentAuthorizationEncoding checks that authorizations in both
+// formats survive a round trip, and that changing any byte of a signed
+// authorization breaks its signature.
+func FuzzEquipmentAuthorizationEncoding(f *testing.F) {
+	pub, priv := GenerateKeyPair()
+	f.Add(false, uint32(1), 38.5, -121.25, uint64(5000), uint64(0), uint32(100000), uint32(2016), uint64(10), uint64(1), byte(1))
+	f.Add(true, uint32(0), 0.0, 0.0, uint64(0), uint64(0), uint32(0), uint32(0), uint64(0), uint64(0), byte(0xff))
+	f.Fuzz(func(t *testing.T, legacy bool, shortID uint32, lat, lon float64, capacity, debt uint64, expiration, initialization uint32, fee, nonce uint64, delta byte) {
+		if math.IsNaN(lat) || math.IsNaN(lon) {
+			t.Skip("NaN coordinates never compare equal")
+		}
+		ea := EquipmentAuthorization{
+			Version:        EquipmentAuthorizationVersion,
+			ShortID:        shortID,
+			PublicKey:      pub,
+			Latitude:       lat,
+			Longitude:      lon,
+			Capacity:       capacity,
+			Debt:           debt,
+			Expiration:     expiration,
+			Initialization: initialization,
+			ProtocolFee:    fee,
+			Nonce:          nonce,
+		}
+		if legacy {
+			ea.Version = EquipmentAuthorizationVersionLegacy
+			ea.Nonce = 0
+		}
+		ea.Signature = Sign(ea.SigningBytes(), priv)
+		data := ea.Serialize()
+		decoded, err := DeserializeEquipmentAuthorization(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != ea {
+			t.Fatal("authorization changed in the round trip")
+		}
+		checkMutations(t, data, delta, func(b []byte) bool {
+			ea, err := DeserializeEquipmentAuthorization(b)
+			return err == nil && Verify(pub, ea.SigningBytes(), ea.Signature)
+		})
+	})
+}
+
+// FuzzReportAckEncoding checks that acks survive a round trip, and that
+// changing any byte of a signed ack breaks its signature.
+func FuzzReportAckEncoding(f *testing.F) {
+	pub, priv := GenerateKeyPair()
+	f.Add(uint32(1), uint32(2016), ReportAckAccepted, byte(1))
+	f.Fuzz(func(t *testing.T, shortID, timeslot uint32, status byte, delta byte) {
+		ra := ReportAck{ShortID: shortID, Timeslot: timeslot, Status: status}
+		ra.Signature = Sign(ra.SigningBytes(), priv)
+		data := ra.Serialize()
+		decoded, err := DeserializeReportAck(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != ra {
+			t.Fatal("ack changed in the round trip")
+		}
+		checkMutations(t, data, delta, func(b []byte) bool {
+			ra, err := DeserializeReportAck(b)
+			return err == nil && Verify(pub, ra.SigningBytes(), ra.Signature)
+		})
+	})
+}
+
+// FuzzTimeProbeResponseEncoding checks that time probe responses survive a
+// round trip, and that changing any byte of a signed response breaks its
+// signature.
+func FuzzTimeProbeResponseEncoding(f *testing.F) {
+	pub, priv := GenerateKeyPair()
+	f.Add(uint64(7), int64(1700000000000), uint32(2016), byte(1))
+	f.Fuzz(func(t *testing.T, nonce uint64, unixMilli int64, timeslot uint32, delta byte) {
+		tpr := TimeProbeResponse{Nonce: nonce, UnixMilli: unixMilli, Timeslot: timeslot}
+		tpr.Signature = Sign(tpr.SigningBytes(), priv)
+		data := tpr.Serialize()
+		decoded, err := DeserializeTimeProbeResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != tpr {
+			t.Fatal("response changed in the round trip")
+		}
+		checkMutations(t, data, delta, func(b []byte) bool {
+			tpr, err := DeserializeTimeProbeResponse(b)
+			return err == nil && Verify(pub, tpr.SigningBytes(), tpr.Signature)
+		})
+	})
+}
@@ -9,11 +9,32 @@ import (
 	"math"
 )
 
+// The formats of an EquipmentAuthorization. The legacy format is the original
+// format, which has no version byte and no nonce. Every other format starts
+// with its version byte. The expiring format has the same layout as the
+// current format, but is the only format where the Expiration is enforced,
+// authorizations in the older formats never expire.
+const (
+	EquipmentAuthorizationVersionLegacy   = 0
+	EquipmentAuthorizationVersion         = 1
+	EquipmentAuthorizationVersionExpiring = 2
+)
+
+// The serialized sizes of each EquipmentAuthorization format.
+const (
+	EquipmentAuthorizationLegacySize = 4 + 32 + 8 + 8 + 8 + 8 + 4 + 4 + 8 + 64
+	EquipmentAuthorizationSize       = 1 + EquipmentAuthorizationLegacySize + 8
+)
+
 // EquipmentAuthorization struct defines an authorization for a piece of
 // equipment. It contains all of the genesis information for the equipment that
 // a GCA will need to know when submitting reports for the corresponding solar
 // farm.
 type EquipmentAuthorization struct {
+	// Version is the format of the authorization, and determines how it
+	// gets serialized and signed.
+	Version uint8
+
 	// The equipment will refer to itself using its own ShortID to save
 	// bandwidth when submitting reports to GCA servers.
 	ShortID   uint32
@@ -28,7 +49,9 @@ type EquipmentAuthorization struct {
 	// milliwatthours per timeslot. A timeslot is 5 minutes. Debt is the
 	// number of grams of CO2 debt that must be paid off every week by a
 	// solar farm. Expiration is the timeslot where power reports are no
-	// longer valid for this solar farm.
+	// longer valid for this solar farm. It is only enforced in the
+	// expiring format, where 0 means that the authorization never
+	// expires.
 	Capacity   uint64
 	Debt       uint64
 	Expiration uint32
@@ -39,15 +62,38 @@ type EquipmentAuthorization struct {
 	Initialization uint32
 	ProtocolFee    uint64
 
+	// Nonce is chosen by the GCA and must never be reused by the GCA for a
+	// different authorization, which allows GCA servers to reject replayed
+	// authorizations. GCAs should use a counter that increases with every
+	// authorization. The legacy format does not have a nonce.
+	Nonce uint64
+
 	// The Signature is a signature from the GCA which confirms that a
 	// device with the above properties is allowed to submit power reports
 	// to the Glow protocol.
 	Signature Signature
 }
 
-// Serialize serializes the EquipmentAuthorization into a byte slice.
+// Serialize serializes the EquipmentAuthorization into a byte slice. The
+// legacy format is serialized without a version byte or a nonce.
 func (ea *EquipmentAuthorization) Serialize() []byte {
-	data := make([]byte, 4+32+8+8+8+8+4+4+8+64)
+	if ea.Version == EquipmentAuthorizationVersionLegacy {
+		data := make([]byte, EquipmentAuthorizationLegacySize)
+		ea.serializeFields(data)
+		copy(data[84:], ea.Signature[:])
+		return data
+	}
+	data := make([]byte, EquipmentAuthorizationSize)
+	data[0] = ea.Version
+	ea.serializeFields(data[1:])
+	binary.LittleEndian.PutUint64(data[85:93], ea.Nonce)
+	copy(data[93:], ea.Signature[:])
+	return data
+}
+
+// serializeFields writes the fields that are shared by every format into the
+// first 84 bytes of the provided slice.
+func (ea *EquipmentAuthorization) serializeFields(data []byte) {
 	binary.LittleEndian.PutUint32(data[0:4], ea.ShortID)
 	copy(data[4:36], ea.PublicKey[:])
 	binary.LittleEndian.PutUint64(data[36:44], math.Float64bits(ea.Latitude))
@@ -57,35 +103,62 @@ func (ea *EquipmentAuthorization) Serialize() []byte {
 	binary.LittleEndian.PutUint32(data[68:72], ea.Expiration)
 	binary.LittleEndian.PutUint32(data[72:76], ea.Initialization)
 	binary.LittleEndian.PutUint64(data[76:84], ea.ProtocolFee)
-	copy(data[84:], ea.Signature[:])
-	return data
+}
+
+// ExpiresAt returns the timeslot from which on the authorization no longer
+// allows power reports, and false if the authorization never expires.
+func (ea *EquipmentAuthorization) ExpiresAt() (uint32, bool) {
+	if ea.Version != EquipmentAuthorizationVersionExpiring || ea.Expiration == 0 {
+		return 0, false
+	}
+	return ea.Expiration, true
+}
+
+// ExpiredAt returns whether the authorization has expired by the provided
+// timeslot.
+func (ea *EquipmentAuthorization) ExpiredAt(timeslot uint32) bool {
+	expiration, expires := ea.ExpiresAt()
+	return expires && timeslot >= expiration
 }
 
 // SigningBytes generates the byte slice that needs to be signed to validate
 // the object. It's almost the same as the serialization, except that a signing
 // prefix has been added, and the signature has been stripped off.
 func (ea *EquipmentAuthorization) SigningBytes() []byte {
-	prefix := "EquipmentAuthorization"
-	prefixBytes := []byte(prefix)
-	serialization := ea.Serialize()
-	noSig := serialization[:len(serialization)-64]
-	data := make([]byte, len(prefixBytes)+len(noSig))
-	copy(data[0:len(prefixBytes)], prefixBytes)
-	copy(data[len(prefixBytes):], noSig)
-	return data
+	return SerializeEquipmentAuthorizationForSigning(*ea)
 }
 
 // DeserializeEquipmentAuthorization deserializes a byte slice into an
 // EquipmentAuthorization.
 //
 // This function takes a byte slice and deserializes it directly into an EquipmentAuthorization struct.
-// The byte slice should be serialized in the same order as the fields in the EquipmentAuthorization struct.
+// The format is determined by the length of the slice, and the version byte
+// must match the current or the expiring version if the slice is not in the
+// legacy format.
 // It returns the deserialized EquipmentAuthorization and any error encountered.
 func DeserializeEquipmentAuthorization(data []byte) (ea EquipmentAuthorization, err error) {
-	if len(data) != 148 {
-		return ea, fmt.Errorf("input is not the correct length to be an EquipmentAuthorization: %v vs %v", len(data), 148)
+	switch len(data) {
+	case EquipmentAuthorizationLegacySize:
+		ea.deserializeFields(data)
+		copy(ea.Signature[:], data[84:])
+		return ea, nil
+	case EquipmentAuthorizationSize:
+		if data[0] != EquipmentAuthorizationVersion && data[0] != EquipmentAuthorizationVersionExpiring {
+			return ea, fmt.Errorf("unsupported EquipmentAuthorization version: %v", data[0])
+		}
+		ea.Version = data[0]
+		ea.deserializeFields(data[1:])
+		ea.Nonce = binary.LittleEndian.Uint64(data[85:93])
+		copy(ea.Signature[:], data[93:])
+		return ea, nil
+	default:
+		return ea, fmt.Errorf("input is not the correct length to be an EquipmentAuthorization: %v vs %v", len(data), EquipmentAuthorizationSize)
 	}
+}
 
+// deserializeFields reads the fields that are shared by every format from the
+// first 84 bytes of the provided slice.
+func (ea *EquipmentAuthorization) deserializeFields(data []byte) {
 	ea.ShortID = binary.LittleEndian.Uint32(data[0:4])
 	copy(ea.PublicKey[:], data[4:36])
 	ea.Latitude = math.Float64frombits(binary.LittleEndian.Uint64(data[36:44]))
@@ -95,6 +168,4 @@ func DeserializeEquipmentAuthorization(data []byte) (ea EquipmentAuthorization,
 	ea.Expiration = binary.LittleEndian.Uint32(data[68:72])
 	ea.Initialization = binary.LittleEndian.Uint32(data[72:76])
 	ea.ProtocolFee = binary.LittleEndian.Uint64(data[76:84])
-	copy(ea.Signature[:], data[84:])
-	return ea, nil
 }
@@ -1,6 +1,7 @@
 package glow
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -34,3 +35,56 @@ func TestEquipmentAuthSerialization(t *testing.T) {
 		t.Fatal("Serialization and deserialization failed.")
 	}
 }
+
+// TestEquipmentAuthVersions checks the serialization of the current format,
+// and that the version and nonce are covered by the signature.
+func TestEquipmentAuthVersions(t *testing.T) {
+	ea := EquipmentAuthorization{
+		Version:    EquipmentAuthorizationVersion,
+		ShortID:    12345,
+		PublicKey:  [32]byte{1, 2, 3, 4, 5},
+		Capacity:   67890,
+		Expiration: 141516,
+		Nonce:      42,
+		Signature:  [64]byte{17, 18, 19, 20},
+	}
+	serialized := ea.Serialize()
+	if len(serialized) != EquipmentAuthorizationSize || serialized[0] != EquipmentAuthorizationVersion {
+		t.Fatal("current format was not serialized with a version byte")
+	}
+	deserialized, err := DeserializeEquipmentAuthorization(serialized)
+	if err != nil {
+		t.Fatal("Error deserializing:", err)
+	}
+	if ea != deserialized {
+		t.Fatal("Serialization and deserialization failed.")
+	}
+
+	// The expiring format has the same layout.
+	expiring := ea
+	expiring.Version = EquipmentAuthorizationVersionExpiring
+	deserialized, err = DeserializeEquipmentAuthorization(expiring.Serialize())
+	if err != nil || deserialized != expiring {
+		t.Fatal("expiring format did not round trip:", err)
+	}
+
+	// Unknown versions are rejected.
+	serialized[0] = EquipmentAuthorizationVersionExpiring + 1
+	if _, err := DeserializeEquipmentAuthorization(serialized); err == nil {
+		t.Fatal("expected an unknown version to be rejected")
+	}
+
+	// Changing the nonce or dropping back to the legacy format changes the
+	// signing bytes.
+	renonced := ea
+	renonced.Nonce++
+	legacy := ea
+	legacy.Version = EquipmentAuthorizationVersionLegacy
+	legacy.Nonce = 0
+	if bytes.Equal(ea.SigningBytes(), renonced.SigningBytes()) || bytes.Equal(ea.SigningBytes(), legacy.SigningBytes()) {
+		t.Fatal("signing bytes do not cover the version and nonce")
+	}
+	if len(legacy.Serialize()) != EquipmentAuthorizationLegacySize {
+		t.Fatal("legacy format has the wrong size")
+	}
+}
@@ -0,0 +1,79 @@
+package glow
+
+// This file contains the heartbeat, which a device sends for a timeslot that
+// it has no production to report for. A device that produced nothing at
+// night or under snow would otherwise look exactly like a device that is
+// dead, and a report of zero looks exactly like a stuck meter. The heartbeat
+// says that the device is alive and why it isn't reporting any production.
+//
+// Heartbeats travel on the same UDP port and HTTP endpoint as reports. Like a
+// report, a heartbeat names the device by its ShortID and is signed by the
+// key of the device. It is recognized by its size, which is different from
+// the size of every report packet and of the time probe, and by its prefix.
+// Heartbeats never count as production.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// heartbeatPrefix marks a packet as a heartbeat.
+var heartbeatPrefix = []byte("Heartbeat")
+
+// HeartbeatSize is the size of a serialized Heartbeat.
+const HeartbeatSize = 9 + 4 + 4 + 1 + 64
+
+// The status values that can appear in a Heartbeat.
+const (
+	HeartbeatIdle       byte = 1 // The device is alive and the meter reads no production
+	HeartbeatMeterFault byte = 2 // The device is alive but the meter failed to produce a reading
+)
+
+// Heartbeat tells a GCA server that a device was alive during a timeslot.
+type Heartbeat struct {
+	ShortID   uint32    // The ShortID of the device
+	Timeslot  uint32    // The timeslot that the device was alive in
+	Status    byte      // One of the Heartbeat status values
+	Signature Signature // The signature of the device
+}
+
+// SigningBytes returns the bytes that should be signed by the device when
+// sending a heartbeat.
+func (hb Heartbeat) SigningBytes() []byte {
+	return SerializeHeartbeatForSigning(hb)
+}
+
+// Serialize creates the binary representation of the heartbeat, which is
+// also the packet that gets sent to the server.
+func (hb Heartbeat) Serialize() []byte {
+	bytes := make([]byte, HeartbeatSize)
+	copy(bytes, heartbeatPrefix)
+	i := len(heartbeatPrefix)
+	binary.LittleEndian.PutUint32(bytes[i:], hb.ShortID)
+	binary.LittleEndian.PutUint32(bytes[i+4:], hb.Timeslot)
+	bytes[i+8] = hb.Status
+	copy(bytes[i+9:], hb.Signature[:])
+	return bytes
+}
+
+// DeserializeHeartbeat takes a byte slice and attempts to convert it back into
+// a Heartbeat. The signature is not checked.
+func DeserializeHeartbeat(i []byte) (Heartbeat, error) {
+	if len(i) != HeartbeatSize {
+		return Heartbeat{}, errors.New("input byte slice has incorrect length")
+	}
+	if !bytes.HasPrefix(i, heartbeatPrefix) {
+		return Heartbeat{}, errors.New("input byte slice is not a heartbeat")
+	}
+	i = i[len(heartbeatPrefix):]
+	var hb Heartbeat
+	hb.ShortID = binary.LittleEndian.Uint32(i[0:4])
+	hb.Timeslot = binary.LittleEndian.Uint32(i[4:8])
+	hb.Status = i[8]
+	copy(hb.Signature[:], i[9:])
+	if hb.Status != HeartbeatIdle && hb.Status != HeartbeatMeterFault {
+		return Heartbeat{}, errors.New("heartbeat has an unknown status")
+	}
+	return hb, nil
+}
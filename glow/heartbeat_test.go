@@ -0,0 +1,50 @@
+package glow
+
+import (
+	"testing"
+)
+
+// TestHeartbeatSerialization checks that a Heartbeat survives a round trip,
+// and that it can't be mistaken for any other packet.
+func TestHeartbeatSerialization(t *testing.T) {
+	pub, priv := GenerateKeyPair()
+	hb := Heartbeat{
+		ShortID:  12,
+		Timeslot: 4000,
+		Status:   HeartbeatMeterFault,
+	}
+	hb.Signature = Sign(hb.SigningBytes(), priv)
+
+	data := hb.Serialize()
+	if len(data) == ReportPacketLegacySize || len(data) <= MaxReportPacketSize || len(data) == TimeProbeSize {
+		t.Fatal("heartbeat has the size of another packet:", len(data))
+	}
+	decoded, err := DeserializeHeartbeat(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != hb {
+		t.Fatal("heartbeat did not survive the round trip")
+	}
+	if !Verify(pub, decoded.SigningBytes(), decoded.Signature) {
+		t.Fatal("signature does not verify")
+	}
+
+	// Changing the status should invalidate the signature.
+	decoded.Status = HeartbeatIdle
+	if Verify(pub, decoded.SigningBytes(), decoded.Signature) {
+		t.Fatal("signature verified after the status was changed")
+	}
+	if _, err := DeserializeHeartbeat(data[:HeartbeatSize-1]); err == nil {
+		t.Fatal("expected an error for a short heartbeat")
+	}
+	bad := append([]byte(nil), data...)
+	bad[0] = 'X'
+	if _, err := DeserializeHeartbeat(bad); err == nil {
+		t.Fatal("expected an error for a packet without the prefix")
+	}
+	bad = Heartbeat{ShortID: 12, Timeslot: 4000, Status: 7}.Serialize()
+	if _, err := DeserializeHeartbeat(bad); err == nil {
+		t.Fatal("expected an error for an unknown status")
+	}
+}
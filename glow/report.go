@@ -8,34 +8,81 @@ import (
 	"errors"
 )
 
+// The power output of a report is the energy in milliwatt hours that went
+// through the meter over the timeslot. Bidirectional meters read negative
+// numbers when the equipment draws energy, which are stored in two's
+// complement, so converting the power output to an int64 recovers the
+// reading. The smallest power outputs are sentinels rather than readings.
+const (
+	PowerOutputNone       = 0 // There is no report for the timeslot
+	PowerOutputBanned     = 1 // The GCA server banned the timeslot
+	PowerOutputIdle       = 2 // The meter read close enough to zero to count as no production
+	PowerOutputMeterFault = 3 // The meter could not be read
+)
+
+// MaxPowerOutput is the largest reading in either direction that a power
+// output can hold, about 12 GW over a timeslot. Anything beyond it is garbage,
+// usually a small negative number that wrapped around as an unsigned one
+// somewhere between the meter and the report.
+const MaxPowerOutput = 1e12
+
 // EquipmentReport defines the structure for a report received from a piece of equipment.
 type EquipmentReport struct {
 	ShortID     uint32    // A unique identifier for the equipment
 	Timeslot    uint32    // A field denoting the time of the report
-	PowerOutput uint64    // The power output from the equipment
+	PowerOutput uint64    // The power output from the equipment, see PowerReading
 	Signature   Signature // A digital signature for the report's authenticity
 }
 
+// PowerReading returns the reading of a power output, which is negative if
+// the equipment drew energy. It is only meaningful if the power output is not
+// a sentinel.
+func PowerReading(powerOutput uint64) int64 {
+	return int64(powerOutput)
+}
+
+// PowerOutputIsSentinel returns whether a power output is one of the
+// sentinels rather than a reading.
+func PowerOutputIsSentinel(powerOutput uint64) bool {
+	return powerOutput <= PowerOutputMeterFault
+}
+
+// PowerOutputIsGarbage returns whether a power output is a reading beyond
+// MaxPowerOutput in either direction.
+func PowerOutputIsGarbage(powerOutput uint64) bool {
+	reading := PowerReading(powerOutput)
+	return reading > MaxPowerOutput || reading < -MaxPowerOutput
+}
+
+// CreditedPowerOutput returns the production that a power output counts for.
+// Sentinels, negative readings and garbage count as no production, the raw
+// power output is what gets kept for auditing.
+func CreditedPowerOutput(powerOutput uint64) uint64 {
+	if PowerOutputIsSentinel(powerOutput) || PowerOutputIsGarbage(powerOutput) || PowerReading(powerOutput) < 0 {
+		return 0
+	}
+	return powerOutput
+}
+
 // SigningBytes returns the bytes that should be signed when sending an
 // equipment report.
 func (er EquipmentReport) SigningBytes() []byte {
-	prefix := []byte("EquipmentReport")
-	bytes := make([]byte, len(prefix)+16)
-	copy(bytes, prefix)
-	binary.LittleEndian.PutUint32(bytes[15:], er.ShortID)
-	binary.LittleEndian.PutUint32(bytes[19:], er.Timeslot)
-	binary.LittleEndian.PutUint64(bytes[23:], er.PowerOutput)
-	return bytes
+	return SerializeReportForSigning(er)
 }
 
 // Serialize creates a compact binary representation of the data structure.
 func (er EquipmentReport) Serialize() []byte {
-	bytes := make([]byte, 80)
-	binary.LittleEndian.PutUint32(bytes[0:], er.ShortID)
-	binary.LittleEndian.PutUint32(bytes[4:], er.Timeslot)
-	binary.LittleEndian.PutUint64(bytes[8:], er.PowerOutput)
-	copy(bytes[16:], er.Signature[:])
-	return bytes
+	return er.AppendSerialization(make([]byte, 0, 80))
+}
+
+// AppendSerialization appends the serialization of the report to b, which
+// lets a caller that already has a buffer serialize the report without
+// allocating.
+func (er EquipmentReport) AppendSerialization(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, er.ShortID)
+	b = binary.LittleEndian.AppendUint32(b, er.Timeslot)
+	b = binary.LittleEndian.AppendUint64(b, er.PowerOutput)
+	return append(b, er.Signature[:]...)
 }
 
 // DeserializeReport takes a byte slice and attempts to convert it back into an
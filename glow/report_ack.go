@@ -0,0 +1,72 @@
+package glow
+
+// This file contains the acknowledgement that a GCA server sends back to a
+// device after it receives an equipment report over UDP. The ack is signed by
+// the server so that a device can't be tricked into believing that a report
+// was accepted when it was not.
+//
+// The ack is deliberately smaller than the report that triggers it, which
+// prevents the report listener from being used as an amplification vector.
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ReportAckSize is the size of a serialized ReportAck. It must never exceed
+// the size of an equipment report.
+const ReportAckSize = 73
+
+// The status values that can appear in a ReportAck.
+const (
+	ReportAckAccepted             byte = iota // The report was integrated by the server
+	ReportAckDuplicate                        // The server already had this exact report
+	ReportAckBanned                           // The timeslot is banned, or this report caused a ban
+	ReportAckStale                            // The timeslot is outside of the window the server accepts
+	ReportAckInvalidPower                     // The report contained a sentinel power value
+	ReportAckDeauthorized                     // The equipment was deauthorized before the timeslot of the report
+	ReportAckFlagged                          // The report exceeded the capacity of the equipment and awaits review by the GCA
+	ReportAckExpired                          // The authorization of the equipment expired before the timeslot of the report
+	ReportAckFinalized                        // The week of the timeslot has been finalized, see the period summary
+	ReportAckRetryLater                       // The server could not store the report, it should be sent again later
+	ReportAckOutsideAuthorization             // The timeslot of the report is outside of the authorization of the key that signed it
+)
+
+// ReportAck is the response that a GCA server sends after receiving an
+// equipment report.
+type ReportAck struct {
+	ShortID   uint32    // The ShortID of the report being acknowledged
+	Timeslot  uint32    // The timeslot of the report being acknowledged
+	Status    byte      // One of the ReportAck status values
+	Signature Signature // The signature of the GCA server
+}
+
+// SigningBytes returns the bytes that should be signed by the server when
+// sending a report ack.
+func (ra ReportAck) SigningBytes() []byte {
+	return SerializeReportAckForSigning(ra)
+}
+
+// Serialize creates a compact binary representation of the report ack.
+func (ra ReportAck) Serialize() []byte {
+	bytes := make([]byte, ReportAckSize)
+	binary.LittleEndian.PutUint32(bytes[0:], ra.ShortID)
+	binary.LittleEndian.PutUint32(bytes[4:], ra.Timeslot)
+	bytes[8] = ra.Status
+	copy(bytes[9:], ra.Signature[:])
+	return bytes
+}
+
+// DeserializeReportAck takes a byte slice and attempts to convert it back into
+// a ReportAck. The signature is not checked.
+func DeserializeReportAck(i []byte) (ReportAck, error) {
+	if len(i) != ReportAckSize {
+		return ReportAck{}, errors.New("input byte slice has incorrect length")
+	}
+	var ra ReportAck
+	ra.ShortID = binary.LittleEndian.Uint32(i[0:4])
+	ra.Timeslot = binary.LittleEndian.Uint32(i[4:8])
+	ra.Status = i[8]
+	copy(ra.Signature[:], i[9:])
+	return ra, nil
+}
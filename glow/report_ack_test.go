@@ -0,0 +1,46 @@
+package glow
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestReportAckSerialization checks that a ReportAck survives a round trip,
+// and that the serialized ack is never larger than a report. The signature of
+// the seeded key is pinned, which catches any change to the signing bytes.
+func TestReportAckSerialization(t *testing.T) {
+	pub, priv := TestDeviceKey(0)
+	ra := ReportAck{
+		ShortID:  12,
+		Timeslot: 4000,
+		Status:   ReportAckDuplicate,
+	}
+	ra.Signature = Sign(ra.SigningBytes(), priv)
+	if sig := hex.EncodeToString(ra.Signature[:]); sig != "6f5a7339a7a4f126b56bee312a7962259174940d9cf8613b67e23a3e6e45b8046a2a12f0553f689ced17124007586b132463d0e4d24ae1947a684404e0d3c52a" {
+		t.Fatal("unexpected signature:", sig)
+	}
+
+	data := ra.Serialize()
+	if len(data) > len(EquipmentReport{}.Serialize()) {
+		t.Fatal("report ack is larger than a report")
+	}
+	decoded, err := DeserializeReportAck(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != ra {
+		t.Fatal("ack did not survive the round trip")
+	}
+	if !Verify(pub, decoded.SigningBytes(), decoded.Signature) {
+		t.Fatal("signature does not verify")
+	}
+
+	// Changing the status should invalidate the signature.
+	decoded.Status = ReportAckAccepted
+	if Verify(pub, decoded.SigningBytes(), decoded.Signature) {
+		t.Fatal("signature verified after the status was changed")
+	}
+	if _, err := DeserializeReportAck(data[:ReportAckSize-1]); err == nil {
+		t.Fatal("expected an error for a short ack")
+	}
+}
@@ -0,0 +1,111 @@
+package glow
+
+// report_merkle.go defines the Merkle tree that GCA servers use to commit to
+// the set of reports that they accepted for a week. The server publishes a
+// signed root for every week, and can hand out a proof for any single report,
+// so that a light verifier only needs the root and the proof to check that a
+// report was part of the week.
+//
+// A leaf is the canonical encoding of a report:
+//
+//	public key of the device (32 bytes)
+//	timeslot (4 bytes)
+//	power output (8 bytes)
+//	signature of the device (64 bytes)
+//
+// Leaves and interior nodes are hashed with different prefixes, so a leaf can
+// never be passed off as a node. When a level has an odd number of nodes, the
+// last node is carried up to the next level unchanged.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// ReportLeafSize is the size of the canonical encoding of a report.
+const ReportLeafSize = 32 + 4 + 8 + 64
+
+// ReportLeaf returns the canonical encoding of a report from the device with
+// the provided public key.
+func ReportLeaf(pk PublicKey, er EquipmentReport) []byte {
+	leaf := make([]byte, ReportLeafSize)
+	copy(leaf, pk[:])
+	binary.LittleEndian.PutUint32(leaf[32:], er.Timeslot)
+	binary.LittleEndian.PutUint64(leaf[36:], er.PowerOutput)
+	copy(leaf[44:], er.Signature[:])
+	return leaf
+}
+
+// hashReportLeaf returns the hash of a leaf.
+func hashReportLeaf(leaf []byte) [32]byte {
+	return sha256.Sum256(append([]byte{0}, leaf...))
+}
+
+// hashReportNode returns the hash of an interior node.
+func hashReportNode(left, right [32]byte) [32]byte {
+	b := make([]byte, 0, 65)
+	b = append(b, 1)
+	b = append(b, left[:]...)
+	b = append(b, right[:]...)
+	return sha256.Sum256(b)
+}
+
+// reportMerkleLevels returns every level of the tree, starting with the leaf
+// hashes and ending with the root.
+func reportMerkleLevels(leaves [][]byte) [][][32]byte {
+	level := make([][32]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = hashReportLeaf(leaf)
+	}
+	levels := [][][32]byte{level}
+	for len(level) > 1 {
+		next := make([][32]byte, 0, (len(level)+1)/2)
+		for i := 0; i+1 < len(level); i += 2 {
+			next = append(next, hashReportNode(level[i], level[i+1]))
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// ReportMerkleRoot returns the root of the tree over the leaves. The root of
+// an empty set of leaves is zero.
+func ReportMerkleRoot(leaves [][]byte) [32]byte {
+	if len(leaves) == 0 {
+		return [32]byte{}
+	}
+	levels := reportMerkleLevels(leaves)
+	return levels[len(levels)-1][0]
+}
+
+// ReportMerkleProof returns the sibling hashes that connect the leaf at the
+// provided index to the root, starting from the bottom of the tree. Levels
+// where the node is carried up unchanged have no sibling, and add nothing to
+// the proof.
+func ReportMerkleProof(leaves [][]byte, index int) ([][32]byte, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("leaf %v is out of range for %v leaves", index, len(leaves))
+	}
+	var proof [][32]byte
+	levels := reportMerkleLevels(leaves)
+	for _, level := range levels[:len(levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyReportProof checks that the leaf sits at the provided index of a tree
+// with numLeaves leaves and the provided root. CheckReportProof returns the
+// reason that a proof fails.
+func VerifyReportProof(root [32]byte, leaf []byte, index, numLeaves uint32, proof [][32]byte) bool {
+	return CheckReportProof(root, leaf, index, numLeaves, proof) == nil
+}
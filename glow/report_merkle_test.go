@@ -0,0 +1,68 @@
+package glow
+
+import (
+	"testing"
+)
+
+// testReportLeaves returns n leaves of reports from a single device.
+func testReportLeaves(n int) [][]byte {
+	pk, priv := GenerateKeyPair()
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		er := EquipmentReport{ShortID: 1, Timeslot: uint32(i), PowerOutput: uint64(i * 7)}
+		er.Signature = Sign(er.SigningBytes(), priv)
+		leaves[i] = ReportLeaf(pk, er)
+	}
+	return leaves
+}
+
+// TestReportMerkleProof checks that every leaf of trees of many shapes has
+// a proof that verifies, and that the wrong leaf, index, or path are
+// rejected.
+func TestReportMerkleProof(t *testing.T) {
+	if ReportMerkleRoot(nil) != ([32]byte{}) {
+		t.Error("empty tree has a non zero root")
+	}
+	for n := 1; n <= 17; n++ {
+		leaves := testReportLeaves(n)
+		root := ReportMerkleRoot(leaves)
+		for i := range leaves {
+			proof, err := ReportMerkleProof(leaves, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyReportProof(root, leaves[i], uint32(i), uint32(n), proof) {
+				t.Fatalf("proof for leaf %v of %v does not verify", i, n)
+			}
+			if n == 1 {
+				continue
+			}
+			other := (i + 1) % n
+			if VerifyReportProof(root, leaves[other], uint32(i), uint32(n), proof) {
+				t.Fatalf("proof for leaf %v of %v accepted a different leaf", i, n)
+			}
+			if VerifyReportProof(root, leaves[i], uint32(other), uint32(n), proof) {
+				t.Fatalf("proof for leaf %v of %v accepted a different index", i, n)
+			}
+			tampered := append([][32]byte{}, proof...)
+			tampered[0][0] ^= 1
+			if VerifyReportProof(root, leaves[i], uint32(i), uint32(n), tampered) {
+				t.Fatalf("tampered proof for leaf %v of %v was accepted", i, n)
+			}
+			if VerifyReportProof(root, leaves[i], uint32(i), uint32(n), proof[1:]) {
+				t.Fatalf("short proof for leaf %v of %v was accepted", i, n)
+			}
+		}
+		if _, err := ReportMerkleProof(leaves, n); err == nil {
+			t.Fatal("built a proof for a leaf that doesn't exist")
+		}
+	}
+
+	// A changed report changes the root.
+	leaves := testReportLeaves(5)
+	root := ReportMerkleRoot(leaves)
+	leaves[3][40] ^= 1
+	if ReportMerkleRoot(leaves) == root {
+		t.Error("a tampered report did not change the root")
+	}
+}
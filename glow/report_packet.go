@@ -0,0 +1,127 @@
+package glow
+
+// report_packet.go contains the envelope that equipment reports travel in
+// over UDP. The first devices sent the bare 80 byte serialization of a report,
+// which leaves no room to ever change the layout. Every newer packet starts
+// with a version byte, followed by a body whose layout depends on the version:
+//
+//	legacy:    report (80 bytes)
+//	version 1: 0x01 || report (80 bytes)
+//
+// A legacy packet is recognized by its size alone, as its first byte is part
+// of the ShortID and can be anything. Versioned packets must therefore never
+// be 80 bytes long, and they must not be TimeProbeSize or HeartbeatSize bytes
+// long either, which is how the listener tells time probes and heartbeats
+// apart from reports.
+//
+// Each version has its own encoder and decoder in reportPacketFormats, so
+// adding a version only means adding an entry. GCA servers advertise the
+// versions that they accept, and devices send the newest version that both
+// sides support, falling back to the legacy layout for servers that don't
+// advertise anything. The signature of the report is the same in every
+// version, so the version is only a matter of layout.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The versions of the report packet. ReportPacketLegacy never appears on the
+// wire, it stands for the unversioned layout when servers advertise the
+// versions that they accept.
+const (
+	ReportPacketLegacy   byte = 0
+	ReportPacketVersion1 byte = 1
+)
+
+const (
+	// ReportPacketLegacySize is the size of a legacy report packet.
+	ReportPacketLegacySize = 80
+
+	// MaxReportPacketSize is the size of the largest report packet of any
+	// version.
+	MaxReportPacketSize = 81
+)
+
+// reportPacketFormat encodes and decodes the body of one version of the
+// report packet, which is everything after the version byte.
+type reportPacketFormat struct {
+	encode func(er EquipmentReport) []byte
+	decode func(body []byte) (EquipmentReport, error)
+}
+
+// reportPacketFormats maps every version of the report packet to its format.
+var reportPacketFormats = map[byte]reportPacketFormat{
+	ReportPacketLegacy:   {encode: EquipmentReport.Serialize, decode: DeserializeReport},
+	ReportPacketVersion1: {encode: EquipmentReport.Serialize, decode: DeserializeReport},
+}
+
+// errReportPacketTruncated is returned for packets that are too short to hold
+// a version byte and a body.
+var errReportPacketTruncated = errors.New("report packet is truncated")
+
+// ReportPacketVersions returns the versions of the report packet that this
+// build can encode and decode, in increasing order. The list includes
+// ReportPacketLegacy.
+func ReportPacketVersions() []int {
+	versions := make([]int, 0, len(reportPacketFormats))
+	for v := range reportPacketFormats {
+		versions = append(versions, int(v))
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// NegotiateReportPacketVersion returns the newest version of the report
+// packet that is in the provided list of versions, which is typically the
+// list that a server advertises. Versions that this build doesn't know are
+// skipped, and an empty list results in ReportPacketLegacy.
+func NegotiateReportPacketVersion(advertised []int) byte {
+	best := ReportPacketLegacy
+	for _, v := range advertised {
+		if v < 0 || v > 255 {
+			continue
+		}
+		if _, known := reportPacketFormats[byte(v)]; known && byte(v) > best {
+			best = byte(v)
+		}
+	}
+	return best
+}
+
+// EncodeReportPacket returns the UDP packet that carries the report in the
+// provided version.
+func EncodeReportPacket(er EquipmentReport, version byte) ([]byte, error) {
+	format, known := reportPacketFormats[version]
+	if !known {
+		return nil, fmt.Errorf("unknown report packet version %v", version)
+	}
+	body := format.encode(er)
+	if version == ReportPacketLegacy {
+		return body, nil
+	}
+	return append([]byte{version}, body...), nil
+}
+
+// DecodeReportPacket decodes a UDP packet of any known version, returning the
+// report and the version of the packet. The signature is not checked.
+func DecodeReportPacket(packet []byte) (EquipmentReport, byte, error) {
+	if len(packet) == ReportPacketLegacySize {
+		er, err := reportPacketFormats[ReportPacketLegacy].decode(packet)
+		return er, ReportPacketLegacy, err
+	}
+	if len(packet) < 2 {
+		return EquipmentReport{}, 0, errReportPacketTruncated
+	}
+	version := packet[0]
+	format, known := reportPacketFormats[version]
+	if !known || version == ReportPacketLegacy {
+		return EquipmentReport{}, version, fmt.Errorf("unknown report packet version %v", version)
+	}
+	er, err := format.decode(packet[1:])
+	if err != nil {
+		return EquipmentReport{}, version, fmt.Errorf("invalid version %v report packet: %v", version, err)
+	}
+	return er, version, nil
+}
@@ -35,3 +35,39 @@ func TestSerializationAndDeserialization(t *testing.T) {
 		t.Errorf("Original and deserialized EquipmentReports are not identical")
 	}
 }
+
+// TestCreditedPowerOutput checks the credit of the boundary values of the
+// power output.
+func TestCreditedPowerOutput(t *testing.T) {
+	negative := func(reading int64) uint64 { return uint64(reading) }
+	tests := []struct {
+		powerOutput uint64
+		credited    uint64
+		garbage     bool
+	}{
+		{PowerOutputNone, 0, false},
+		{PowerOutputBanned, 0, false},
+		{PowerOutputIdle, 0, false},
+		{PowerOutputMeterFault, 0, false},
+		{4, 4, false},
+		{MaxPowerOutput, MaxPowerOutput, false},
+		{MaxPowerOutput + 1, 0, true},
+		{negative(-500), 0, false},
+		{negative(-MaxPowerOutput), 0, false},
+		{negative(-MaxPowerOutput - 1), 0, true},
+		{1<<63 - 1, 0, true},
+		{1 << 63, 0, true},
+		{1<<64 - 1, 0, false},
+	}
+	for _, test := range tests {
+		if credited := CreditedPowerOutput(test.powerOutput); credited != test.credited {
+			t.Errorf("%v is credited as %v, expected %v", test.powerOutput, credited, test.credited)
+		}
+		if garbage := PowerOutputIsGarbage(test.powerOutput); garbage != test.garbage {
+			t.Errorf("%v has garbage %v", test.powerOutput, garbage)
+		}
+	}
+	if PowerReading(negative(-500)) != -500 {
+		t.Error("the sign of a negative reading was lost")
+	}
+}
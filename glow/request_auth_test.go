@@ -0,0 +1,64 @@
+package glow
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestRequestAuthHeader checks that a header survives the round trip through
+// ParseRequestAuth, and that malformed headers are refused.
+func TestRequestAuthHeader(t *testing.T) {
+	pub, priv := GenerateKeyPair()
+	ra := NewRequestAuth("POST", "/api/v1/flagged-reports/review", []byte("{}"), 1700000000, pub, priv)
+	parsed, err := ParseRequestAuth(ra.Header())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != ra {
+		t.Fatal("header did not survive the round trip")
+	}
+	if !Verify(pub, parsed.SigningBytes("POST", "/api/v1/flagged-reports/review", sha256.Sum256([]byte("{}"))), parsed.Signature) {
+		t.Fatal("signature does not verify")
+	}
+	for _, bad := range []string{
+		"",
+		"Bearer abc",
+		strings.Replace(ra.Header(), "timestamp=", "time=", 1),
+		strings.Replace(ra.Header(), "pubkey=", "pubkey=00", 1),
+		strings.Replace(ra.Header(), ", signature=", ", ignored=1, signature=", 1),
+		ra.Header()[:strings.Index(ra.Header(), ", signature=")],
+	} {
+		if _, err := ParseRequestAuth(bad); err == nil {
+			t.Errorf("malformed header was accepted: %q", bad)
+		}
+	}
+}
+
+// TestSignRequest checks that SignRequest signs the path, the query and the
+// body of a request, and leaves the body readable.
+func TestSignRequest(t *testing.T) {
+	pub, priv := GenerateKeyPair()
+	body := []byte(`{"Timestamp":5}`)
+	req, err := http.NewRequest("POST", "https://gca.example.com:35015/api/v1/admin/backup?x=1", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SignRequest(req, pub, priv); err != nil {
+		t.Fatal(err)
+	}
+	ra, err := ParseRequestAuth(req.Header.Get("Authorization"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra.PublicKey != pub || !Verify(pub, ra.SigningBytes("POST", "/api/v1/admin/backup?x=1", sha256.Sum256(body)), ra.Signature) {
+		t.Fatal("request was not signed correctly")
+	}
+	got, err := io.ReadAll(req.Body)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatal("request body was not restored:", err)
+	}
+}
@@ -0,0 +1,133 @@
+package glow
+
+// seeded_keys.go derives keys from seeds, so that a test, a demo or a load
+// generation run can be repeated with exactly the same keys, and so that
+// signatures can be pinned by golden vectors. The derivation is public and
+// the seeds are guessable, so anybody can recompute the private key of a
+// seeded key.
+//
+// SEEDED KEYS MUST NEVER BE USED IN PRODUCTION. A device or a GCA with a
+// seeded key can be impersonated by anybody who knows or guesses the seed.
+//
+// TestGCAKey and TestDeviceKey derive the keys of the well-known test key
+// space from fixed seeds. A server that is not in internal test mode refuses
+// every authorization of a device with a key from that space, and refuses to
+// register a GCA key from it, see IsTestKey. Keys that get derived from any
+// other seed can't be recognized, so keeping them out of production is up to
+// whoever picked the seed.
+//
+// Like every other key of the protocol, a seeded key is a secp256k1 key whose
+// compressed public key has the prefix 0x02, see GenerateKeyPair.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// TestKeySpaceSize is the number of keys of each kind in the well-known test
+// key space. TestGCAKey and TestDeviceKey accept the indices from 0 up to but
+// not including TestKeySpaceSize.
+const TestKeySpaceSize = 256
+
+// seededKeyPrefix separates the hashes of the derivation from every other
+// hash that gets made of the seed.
+const seededKeyPrefix = "glow seeded key"
+
+var (
+	// testKeys contains the public keys of the well-known test key space.
+	// It is built the first time that it is needed.
+	testKeys     map[PublicKey]struct{}
+	testKeysOnce sync.Once
+)
+
+// GenerateKeyFromSeed derives a key pair from a seed. The same seed always
+// produces the same key pair. The seed can be any length, but it has to be
+// secret for the key to be, so seeded keys are only meant for testing.
+func GenerateKeyFromSeed(seed []byte) (PublicKey, PrivateKey) {
+	// Candidates that aren't valid private keys, or whose public key has
+	// the prefix 0x03, are skipped by hashing in a counter. Half of the
+	// candidates are accepted, so the loop never gets far.
+	for i := uint32(0); i < 500; i++ {
+		h := sha256.New()
+		h.Write([]byte(seededKeyPrefix))
+		h.Write(binary.LittleEndian.AppendUint32(nil, i))
+		h.Write(seed)
+		privateKeyECDSA, err := crypto.ToECDSA(h.Sum(nil))
+		if err != nil {
+			continue
+		}
+		publicKeyCompressed := crypto.CompressPubkey(&privateKeyECDSA.PublicKey)
+		if publicKeyCompressed[0] != 0x02 {
+			continue
+		}
+		var publicKey PublicKey
+		var privateKey PrivateKey
+		copy(publicKey[:], publicKeyCompressed[1:])
+		copy(privateKey[:], crypto.FromECDSA(privateKeyECDSA))
+		return publicKey, privateKey
+	}
+	panic("did not derive a good key in 500 attempts")
+}
+
+// DeriveSeed derives the seed of a single key from a seed that is shared by a
+// whole set of keys, like the devices of a synthetic fleet. Different labels
+// or indices give unrelated seeds.
+func DeriveSeed(seed []byte, label string, n int) []byte {
+	return []byte(fmt.Sprintf("%x/%s/%d", seed, label, n))
+}
+
+// FleetGCAKey returns the GCA key of the synthetic fleet of the seed. Together
+// with FleetDeviceKey, this lets the test harness and the load generator
+// recreate the same fleet from nothing but the seed.
+func FleetGCAKey(seed []byte) (PublicKey, PrivateKey) {
+	return GenerateKeyFromSeed(DeriveSeed(seed, "gca", 0))
+}
+
+// FleetDeviceKey returns the key of the device with the provided ShortID in
+// the synthetic fleet of the seed.
+func FleetDeviceKey(seed []byte, shortID uint32) (PublicKey, PrivateKey) {
+	return GenerateKeyFromSeed(DeriveSeed(seed, "device", int(shortID)))
+}
+
+// testKeySeed returns the seed of a key in the well-known test key space.
+func testKeySeed(kind string, n int) []byte {
+	if n < 0 || n >= TestKeySpaceSize {
+		panic(fmt.Sprintf("test key index %v is outside of the test key space", n))
+	}
+	return DeriveSeed([]byte("glow test keys"), kind, n)
+}
+
+// TestGCAKey returns the GCA key with index n in the well-known test key
+// space. The function panics if n is outside of [0, TestKeySpaceSize). Only
+// tests and servers in internal test mode accept these keys.
+func TestGCAKey(n int) (PublicKey, PrivateKey) {
+	return GenerateKeyFromSeed(testKeySeed("gca", n))
+}
+
+// TestDeviceKey returns the device key with index n in the well-known test
+// key space. The function panics if n is outside of [0, TestKeySpaceSize).
+// Only tests and servers in internal test mode accept these keys.
+func TestDeviceKey(n int) (PublicKey, PrivateKey) {
+	return GenerateKeyFromSeed(testKeySeed("device", n))
+}
+
+// IsTestKey returns whether the public key belongs to the well-known test key
+// space, meaning that its private key is public knowledge. The first call
+// derives the whole space, which takes a moment.
+func IsTestKey(pk PublicKey) bool {
+	testKeysOnce.Do(func() {
+		testKeys = make(map[PublicKey]struct{}, 2*TestKeySpaceSize)
+		for n := 0; n < TestKeySpaceSize; n++ {
+			gcaPub, _ := TestGCAKey(n)
+			devicePub, _ := TestDeviceKey(n)
+			testKeys[gcaPub] = struct{}{}
+			testKeys[devicePub] = struct{}{}
+		}
+	})
+	_, exists := testKeys[pk]
+	return exists
+}
@@ -0,0 +1,58 @@
+package glow
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestSeededKeys pins the keys that get derived from seeds. A failure means
+// that the derivation changed, and with it every golden vector that was made
+// with a seeded key.
+func TestSeededKeys(t *testing.T) {
+	gcaKey := func(n int) PublicKey { pub, _ := TestGCAKey(n); return pub }
+	deviceKey := func(n int) PublicKey { pub, _ := TestDeviceKey(n); return pub }
+	seeded := func(seed string) PublicKey { pub, _ := GenerateKeyFromSeed([]byte(seed)); return pub }
+	fleetGCA, _ := FleetGCAKey([]byte("fleet"))
+	fleetDevice, _ := FleetDeviceKey([]byte("fleet"), 7)
+	tests := []struct {
+		name string
+		got  PublicKey
+		want string
+	}{
+		{"TestGCAKey(0)", gcaKey(0), "4cff9e5f0427b1f93bbecda176335d21bb3f03642de2398ec0b67ca13467b088"},
+		{"TestGCAKey(255)", gcaKey(255), "c21f13ff513e464a2f6825f9a7998a5398fa3bed250f03ca57bef2ec92303990"},
+		{"TestDeviceKey(0)", deviceKey(0), "645d0c8b46a9ec61fd05fb5e4778c9e576820322e5b7a87d1aa885d505abd617"},
+		{"GenerateKeyFromSeed", seeded("seed"), "3dbe5eed1c9b71584be14d5c3b14f919107ce175f8b0d60a771c5c0321663e8d"},
+		{"FleetGCAKey", fleetGCA, "08c95d5cc40bfdc776258b76b67cdabd113b8a0c12de67b69864e670db070925"},
+		{"FleetDeviceKey", fleetDevice, "37a7e20030c1eb436e06235173721206a0611901457081e3fd551ee6d825fb75"},
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(test.got[:]); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// The private key signs for the public key.
+	pub, priv := TestGCAKey(0)
+	if hex.EncodeToString(priv[:]) != "ab6c319cc574d72b8f5b3f3f453a4330e6d6fa3885a488384ae3a20cf79cb89f" {
+		t.Error("unexpected private key:", hex.EncodeToString(priv[:]))
+	}
+	if !Verify(pub, []byte("data"), Sign([]byte("data"), priv)) {
+		t.Error("the seeded key does not sign for its public key")
+	}
+	if seeded("seed2") == seeded("seed") || deviceKey(1) == deviceKey(0) || gcaKey(0) == deviceKey(0) {
+		t.Error("different seeds gave the same key")
+	}
+
+	// Only the keys of the test key space are test keys.
+	random, _ := GenerateKeyPair()
+	if !IsTestKey(gcaKey(0)) || !IsTestKey(deviceKey(TestKeySpaceSize-1)) || IsTestKey(random) || IsTestKey(fleetDevice) {
+		t.Error("the test key space was not recognized")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("an index outside of the test key space was accepted")
+		}
+	}()
+	TestDeviceKey(TestKeySpaceSize)
+}
@@ -1,7 +1,12 @@
 package glow
 
 import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/crypto"
 )
@@ -55,12 +60,31 @@ func GenerateKeyPair() (PublicKey, PrivateKey) {
 
 // Sign generates an Ethereum signature for given data using a private key.
 func Sign(data []byte, privateKey PrivateKey) Signature {
+	return NewSigner(privateKey).Sign(data)
+}
+
+// Signer signs with a private key that has already been parsed, which saves
+// parsing the key for every signature when the same key signs over and over,
+// like the key that a server signs its report acks with.
+type Signer struct {
+	key *ecdsa.PrivateKey
+}
+
+// NewSigner parses the private key for signing. The function panics if the
+// key is not a valid key.
+func NewSigner(privateKey PrivateKey) Signer {
 	privateKeyECDSA, err := crypto.ToECDSA(privateKey[:])
 	if err != nil {
 		panic(err)
 	}
+	return Signer{key: privateKeyECDSA}
+}
+
+// Sign generates an Ethereum signature for the given data. The signature is
+// the same one that Sign produces for the key of the signer.
+func (s Signer) Sign(data []byte) Signature {
 	hash := crypto.Keccak256Hash(data)
-	sig, err := crypto.Sign(hash.Bytes(), privateKeyECDSA)
+	sig, err := crypto.Sign(hash[:], s.key)
 	if err != nil {
 		panic(err)
 	}
@@ -71,16 +95,14 @@ func Sign(data []byte, privateKey PrivateKey) Signature {
 
 // Verify checks the Ethereum signature for given data and a public key.
 func Verify(publicKey PublicKey, data []byte, signature Signature) bool {
-	// Add back the 0x02 prefix to the public key.
-	publicKey33 := append([]byte{0x02}, publicKey[:]...)
-
-	// Decompress the public key to get the ECDSA public key, then verify.
-	publicKeyECDSA, err := crypto.DecompressPubkey(publicKey33)
-	if err != nil {
-		return false
-	}
+	// Add back the 0x02 prefix to the public key. The signature gets checked
+	// against the compressed key directly, a key that doesn't decompress
+	// fails the check.
+	var publicKey33 [33]byte
+	publicKey33[0] = 0x02
+	copy(publicKey33[1:], publicKey[:])
 	hash := crypto.Keccak256Hash(data)
-	return crypto.VerifySignature(crypto.FromECDSAPub(publicKeyECDSA), hash.Bytes(), signature[:])
+	return crypto.VerifySignature(publicKey33[:], hash[:], signature[:])
 }
 
 // PubKeyToAddr will convert a PublicKey to its corresponding Ethereum Address.
@@ -98,3 +120,44 @@ func PubKeyToAddr(pk PublicKey) (string, error) {
 	address := crypto.PubkeyToAddress(*ecdsaKey)
 	return address.String(), nil
 }
+
+// ParsePublicKey parses a public key that was provided as a string. Hex
+// encoded keys are accepted in either case and with or without a '0x' prefix.
+// Anything else is decoded as base64.
+func ParsePublicKey(s string) (PublicKey, error) {
+	var pk PublicKey
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if len(trimmed) == hex.EncodedLen(len(pk)) {
+		b, err := hex.DecodeString(trimmed)
+		if err != nil {
+			return pk, fmt.Errorf("invalid hex public key: %v", err)
+		}
+		copy(pk[:], b)
+		return pk, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return pk, fmt.Errorf("public key is neither hex nor base64")
+	}
+	if len(b) != len(pk) {
+		return pk, fmt.Errorf("public key has length %v, expected %v", len(b), len(pk))
+	}
+	copy(pk[:], b)
+	return pk, nil
+}
+
+// UnmarshalJSON accepts a public key in any of the string forms understood by
+// ParsePublicKey, as well as the array of bytes that a PublicKey gets
+// marshalled to.
+func (pk *PublicKey) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return json.Unmarshal(data, (*[32]byte)(pk))
+	}
+	parsed, err := ParsePublicKey(s)
+	if err != nil {
+		return err
+	}
+	*pk = parsed
+	return nil
+}
@@ -1,6 +1,10 @@
 package glow
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
 	"testing"
 )
 
@@ -10,11 +14,15 @@ func TestSignAndVerify(t *testing.T) {
 	data := []byte("Hello, world!")
 	wrongData := []byte("Hello, everyone!")
 
-	// Generate a key pair and sign some data.
-	publicKey, privateKey := GenerateKeyPair()
-	_, privateKey2 := GenerateKeyPair()
+	// Sign some data with seeded keys. Signatures are deterministic, so
+	// the signature is pinned.
+	publicKey, privateKey := TestDeviceKey(0)
+	_, privateKey2 := TestDeviceKey(1)
 	signature := Sign(data, privateKey)
 	wrongSignature := Sign(data, privateKey2)
+	if sig := hex.EncodeToString(signature[:]); sig != "bdf84058d7e4c1cc64048c1148f75a524a011a76dc7b243e0cfd7cbcf0162a306a3123c705a1a40d76306d37e237a610a18e5ba4cb17b4328c0a219fa52e6d14" {
+		t.Fatal("unexpected signature:", sig)
+	}
 
 	// Verify the signature
 	isValid := Verify(publicKey, data, signature)
@@ -35,3 +43,53 @@ func TestSignAndVerify(t *testing.T) {
 		t.Fatalf("Signature is incorrectly valid")
 	}
 }
+
+// TestParsePublicKey checks the accepted encodings of a public key.
+func TestParsePublicKey(t *testing.T) {
+	pk, _ := GenerateKeyPair()
+	lower := hex.EncodeToString(pk[:])
+	for _, s := range []string{
+		lower,
+		strings.ToUpper(lower),
+		"0x" + lower,
+		"0X" + strings.ToUpper(lower),
+		base64.StdEncoding.EncodeToString(pk[:]),
+	} {
+		parsed, err := ParsePublicKey(s)
+		if err != nil {
+			t.Errorf("unable to parse %q: %v", s, err)
+		} else if parsed != pk {
+			t.Errorf("%q parsed to the wrong key", s)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"0x",
+		lower[:62],
+		lower + "00",
+		"zz" + lower[2:],
+		"0x" + base64.StdEncoding.EncodeToString(pk[:]),
+		base64.StdEncoding.EncodeToString(pk[:31]),
+	} {
+		if _, err := ParsePublicKey(s); err == nil {
+			t.Errorf("malformed key %q was accepted", s)
+		}
+	}
+
+	// JSON accepts the strings as well as the byte array that a key
+	// gets marshalled to.
+	arrayJSON, err := json.Marshal(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{string(arrayJSON), `"` + lower + `"`, `"0x` + lower + `"`} {
+		var decoded PublicKey
+		if err := json.Unmarshal([]byte(data), &decoded); err != nil || decoded != pk {
+			t.Errorf("unable to decode %v: %v", data, err)
+		}
+	}
+	var decoded PublicKey
+	if err := json.Unmarshal([]byte(`"nope"`), &decoded); err == nil {
+		t.Error("malformed json key was accepted")
+	}
+}
@@ -0,0 +1,65 @@
+package glow
+
+// signed_response.go contains the wrapper that the GCA servers use when an
+// API caller asks for a signed response. It allows third parties to check
+// that a response really came from a particular GCA server, even if the
+// response was relayed by someone else.
+//
+// The wrapper is a JSON object with the fields Body, Timestamp, PublicKey and
+// Signature. Body is a string that contains the JSON of the unsigned
+// response, exactly as it was signed. The signature covers:
+//
+//	"SignedResponse" || PublicKey (32 bytes) || Timestamp (8 bytes, little endian) || Body
+//
+// where the Body bytes are the raw contents of the Body string. The signature
+// is the same 64 byte signature used everywhere else, over the Keccak256 hash
+// of those bytes. A verifier must take the Body as a string rather than
+// re-serializing the parsed JSON, because there are many ways to serialize
+// the same JSON object.
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SignedResponse wraps the JSON body of an API response with a signature
+// from the GCA server that produced it.
+type SignedResponse struct {
+	Body      string    // The JSON of the unsigned response
+	Timestamp int64     // Unix time at which the response was signed
+	PublicKey PublicKey // The key of the GCA server that signed the response
+	Signature Signature
+}
+
+// SigningBytes returns the bytes that the GCA server signs.
+func (sr SignedResponse) SigningBytes() []byte {
+	return SerializeSignedResponseForSigning(sr)
+}
+
+// NewSignedResponse creates a SignedResponse for the provided body.
+func NewSignedResponse(body []byte, timestamp int64, pubKey PublicKey, privKey PrivateKey) SignedResponse {
+	sr := SignedResponse{
+		Body:      string(body),
+		Timestamp: timestamp,
+		PublicKey: pubKey,
+	}
+	sr.Signature = Sign(sr.SigningBytes(), privKey)
+	return sr
+}
+
+// VerifySignedResponse decodes a signed response and checks that it was
+// signed by the provided server key. The body of the response is returned,
+// ready to be passed to json.Unmarshal.
+func VerifySignedResponse(data []byte, serverKey PublicKey) ([]byte, error) {
+	var sr SignedResponse
+	if err := json.Unmarshal(data, &sr); err != nil {
+		return nil, fmt.Errorf("unable to decode signed response: %v", err)
+	}
+	if sr.PublicKey != serverKey {
+		return nil, fmt.Errorf("response was signed by an unexpected key")
+	}
+	if !Verify(sr.PublicKey, sr.SigningBytes(), sr.Signature) {
+		return nil, fmt.Errorf("invalid signature on response")
+	}
+	return []byte(sr.Body), nil
+}
@@ -0,0 +1,43 @@
+package glow
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestVerifySignedResponse checks that a signed response verifies, and that
+// changing any single byte of the body or using the wrong key makes the
+// verification fail.
+func TestVerifySignedResponse(t *testing.T) {
+	pub, priv := GenerateKeyPair()
+	body := []byte(`{"ShortID":5,"PowerOutput":[1,2,3]}`)
+	data, err := json.Marshal(NewSignedResponse(body, 1700000000, pub, priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err := VerifySignedResponse(data, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(verified) != string(body) {
+		t.Fatal("body did not survive the round trip")
+	}
+
+	otherPub, _ := GenerateKeyPair()
+	if _, err := VerifySignedResponse(data, otherPub); err == nil {
+		t.Fatal("response verified against the wrong key")
+	}
+	for i := range body {
+		tampered := append([]byte{}, body...)
+		tampered[i]++
+		sr := NewSignedResponse(body, 1700000000, pub, priv)
+		sr.Body = string(tampered)
+		data, err := json.Marshal(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifySignedResponse(data, pub); err == nil {
+			t.Fatal("tampered response verified, byte", i)
+		}
+	}
+}
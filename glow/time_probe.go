@@ -0,0 +1,92 @@
+package glow
+
+// This file contains the time probe, which lets a device measure the drift of
+// its clock against a GCA server over UDP. The device sends a probe with a
+// random nonce, and the server answers with its current time, signed so that
+// the device can't be tricked into adjusting for drift that isn't there.
+//
+// The probe is padded so that it is larger than the response, which prevents
+// the probe from being used as an amplification vector.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// timeProbePrefix marks a packet as a time probe.
+var timeProbePrefix = []byte("TimeProbe")
+
+const (
+	// TimeProbeSize is the size of a serialized TimeProbe. It has to be
+	// different from the size of an equipment report, and at least as
+	// large as a serialized TimeProbeResponse.
+	TimeProbeSize = 96
+
+	// TimeProbeResponseSize is the size of a serialized
+	// TimeProbeResponse.
+	TimeProbeResponseSize = 84
+)
+
+// TimeProbe is a request for the current time of a GCA server.
+type TimeProbe struct {
+	Nonce uint64 // Chosen by the device to match the response to the probe
+}
+
+// Serialize creates the padded binary representation of the probe.
+func (tp TimeProbe) Serialize() []byte {
+	bytes := make([]byte, TimeProbeSize)
+	copy(bytes, timeProbePrefix)
+	binary.LittleEndian.PutUint64(bytes[len(timeProbePrefix):], tp.Nonce)
+	return bytes
+}
+
+// DeserializeTimeProbe takes a byte slice and attempts to convert it back into
+// a TimeProbe.
+func DeserializeTimeProbe(i []byte) (TimeProbe, error) {
+	if len(i) != TimeProbeSize {
+		return TimeProbe{}, errors.New("input byte slice has incorrect length")
+	}
+	if !bytes.HasPrefix(i, timeProbePrefix) {
+		return TimeProbe{}, errors.New("input byte slice is not a time probe")
+	}
+	return TimeProbe{Nonce: binary.LittleEndian.Uint64(i[len(timeProbePrefix):])}, nil
+}
+
+// TimeProbeResponse is the answer of a GCA server to a TimeProbe.
+type TimeProbeResponse struct {
+	Nonce     uint64    // The nonce of the probe being answered
+	UnixMilli int64     // The time of the server in unix milliseconds
+	Timeslot  uint32    // The current timeslot of the server
+	Signature Signature // The signature of the GCA server
+}
+
+// SigningBytes returns the bytes that should be signed by the server when
+// answering a time probe.
+func (tpr TimeProbeResponse) SigningBytes() []byte {
+	return SerializeTimeProbeResponseForSigning(tpr)
+}
+
+// Serialize creates a compact binary representation of the response.
+func (tpr TimeProbeResponse) Serialize() []byte {
+	bytes := make([]byte, TimeProbeResponseSize)
+	binary.LittleEndian.PutUint64(bytes[0:], tpr.Nonce)
+	binary.LittleEndian.PutUint64(bytes[8:], uint64(tpr.UnixMilli))
+	binary.LittleEndian.PutUint32(bytes[16:], tpr.Timeslot)
+	copy(bytes[20:], tpr.Signature[:])
+	return bytes
+}
+
+// DeserializeTimeProbeResponse takes a byte slice and attempts to convert it
+// back into a TimeProbeResponse. The signature is not checked.
+func DeserializeTimeProbeResponse(i []byte) (TimeProbeResponse, error) {
+	if len(i) != TimeProbeResponseSize {
+		return TimeProbeResponse{}, errors.New("input byte slice has incorrect length")
+	}
+	var tpr TimeProbeResponse
+	tpr.Nonce = binary.LittleEndian.Uint64(i[0:8])
+	tpr.UnixMilli = int64(binary.LittleEndian.Uint64(i[8:16]))
+	tpr.Timeslot = binary.LittleEndian.Uint32(i[16:20])
+	copy(tpr.Signature[:], i[20:])
+	return tpr, nil
+}
@@ -0,0 +1,53 @@
+package glow
+
+import (
+	"testing"
+)
+
+// TestTimeProbeSerialization checks that time probes and their responses
+// survive a round trip, and that a response is never larger than a probe.
+func TestTimeProbeSerialization(t *testing.T) {
+	tp := TimeProbe{Nonce: 0xdeadbeef}
+	data := tp.Serialize()
+	if len(data) == len(EquipmentReport{}.Serialize()) {
+		t.Fatal("a time probe can't be told apart from a report")
+	}
+	decoded, err := DeserializeTimeProbe(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != tp {
+		t.Fatal("probe did not survive the round trip")
+	}
+	data[0] = 'X'
+	if _, err := DeserializeTimeProbe(data); err == nil {
+		t.Fatal("expected an error for a packet without the prefix")
+	}
+
+	pub, priv := GenerateKeyPair()
+	tpr := TimeProbeResponse{Nonce: tp.Nonce, UnixMilli: 1700352000123, Timeslot: 77}
+	tpr.Signature = Sign(tpr.SigningBytes(), priv)
+	rdata := tpr.Serialize()
+	if len(rdata) > TimeProbeSize {
+		t.Fatal("time probe response is larger than a time probe")
+	}
+	decodedResp, err := DeserializeTimeProbeResponse(rdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedResp != tpr {
+		t.Fatal("response did not survive the round trip")
+	}
+	if !Verify(pub, decodedResp.SigningBytes(), decodedResp.Signature) {
+		t.Fatal("signature does not verify")
+	}
+
+	// Changing the time should invalidate the signature.
+	decodedResp.UnixMilli++
+	if Verify(pub, decodedResp.SigningBytes(), decodedResp.Signature) {
+		t.Fatal("signature verified after the time was changed")
+	}
+	if _, err := DeserializeTimeProbeResponse(rdata[:TimeProbeResponseSize-1]); err == nil {
+		t.Fatal("expected an error for a short response")
+	}
+}
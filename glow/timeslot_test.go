@@ -0,0 +1,61 @@
+package glow
+
+import (
+	"testing"
+)
+
+// TestTimeslotConversions checks the conversions between timeslots and unix
+// times around the genesis time and at the week boundaries.
+func TestTimeslotConversions(t *testing.T) {
+	// Around the genesis time.
+	if _, err := UnixToTimeslot(GenesisTime - 1); err == nil {
+		t.Fatal("expected a time before genesis to be rejected")
+	}
+	for _, tc := range []struct {
+		unix     int64
+		timeslot uint32
+	}{
+		{GenesisTime, 0},
+		{GenesisTime + 299, 0},
+		{GenesisTime + 300, 1},
+		{GenesisTime + 2016*300 - 1, 2015},
+		{GenesisTime + 2016*300, 2016},
+		{GenesisTime + 2*2016*300, 4032},
+	} {
+		timeslot, err := UnixToTimeslot(tc.unix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timeslot != tc.timeslot {
+			t.Fatalf("unix time %v: got timeslot %v, want %v", tc.unix-GenesisTime, timeslot, tc.timeslot)
+		}
+	}
+
+	// Every week starts exactly one week after the previous one, and a
+	// timeslot round trips through its unix time.
+	for _, timeslot := range []uint32{0, 1, 2015, 2016, 2017, 4031, 4032, 52 * 2016} {
+		unix := TimeslotToUnix(timeslot)
+		if unix != GenesisTime+int64(timeslot)*300 {
+			t.Fatalf("timeslot %v: got unix time %v", timeslot, unix-GenesisTime)
+		}
+		back, err := UnixToTimeslot(unix)
+		if err != nil || back != timeslot {
+			t.Fatalf("timeslot %v did not round trip: %v %v", timeslot, back, err)
+		}
+	}
+	if TimeslotToUnix(2016)-TimeslotToUnix(0) != 7*24*60*60 {
+		t.Fatal("a week is not 2016 timeslots long")
+	}
+
+	// Large timeslots don't overflow.
+	var last uint32 = 1<<32 - 1
+	if TimeslotToUnix(last) != GenesisTime+int64(last)*300 {
+		t.Fatal("the last timeslot overflowed")
+	}
+	if timeslot, err := UnixToTimeslot(TimeslotToUnix(last)); err != nil || timeslot != last {
+		t.Fatal("the last timeslot did not round trip:", timeslot, err)
+	}
+	if _, err := UnixToTimeslot(TimeslotToUnix(last) + 300); err == nil {
+		t.Fatal("expected a time past the last timeslot to be rejected")
+	}
+}
@@ -0,0 +1,109 @@
+package glow
+
+// timeslot_ticker.go contains the TimeslotTicker, which wakes a background
+// loop at the start of every timeslot. A loop that sleeps for a fixed interval
+// drifts against the timeslots by however long each iteration takes. The
+// ticker instead computes the next boundary from the genesis time before
+// every wait, so it lands on the boundaries no matter how long the loop
+// takes. It also recovers from adjustments of the clock: a wait that ends
+// before the boundary, because the clock was set back, waits again for the
+// boundary of the new time.
+//
+// The ticker waits in the goroutine of the loop, rather than in a goroutine
+// of its own, so a test that drives the ticker with a manual clock knows that
+// the loop is done with an iteration once the ticker is waiting again.
+
+import (
+	"time"
+)
+
+// TimeslotClock is the clock that a TimeslotTicker reads the time from and
+// sleeps on. The clocks of the server satisfy it.
+type TimeslotClock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that receives the current time once the
+	// duration has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the clock of the machine.
+type systemClock struct{}
+
+// Now implements TimeslotClock.
+func (systemClock) Now() time.Time { return time.Now() }
+
+// After implements TimeslotClock.
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// NextTimeslotBoundary returns the start of the first timeslot that begins
+// after t. Before the genesis time the boundaries continue every 5 minutes, so
+// the result is always between 0 and 5 minutes after t.
+func NextTimeslotBoundary(t time.Time) time.Time {
+	offset := t.Unix() - int64(GenesisTime)
+	n := offset / 300
+	if offset < 0 && offset%300 != 0 {
+		n--
+	}
+	return time.Unix(int64(GenesisTime)+(n+1)*300, 0)
+}
+
+// UntilNextTimeslot returns how long it is from t until the next timeslot
+// boundary.
+func UntilNextTimeslot(t time.Time) time.Duration {
+	return NextTimeslotBoundary(t).Sub(t)
+}
+
+// TimeslotTicker wakes a loop at the start of every timeslot.
+type TimeslotTicker struct {
+	clock   TimeslotClock
+	maxWait time.Duration
+}
+
+// NewTimeslotTicker returns a ticker on the provided clock, nil is the clock
+// of the machine. If maxWait is above zero, Next also returns once maxWait has
+// passed without a boundary. That bounds how late a tick is when the clock
+// jumps forward during a wait, and lets the loops of the test build notice
+// the timeslots that are set by hand.
+func NewTimeslotTicker(clock TimeslotClock, maxWait time.Duration) *TimeslotTicker {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &TimeslotTicker{clock: clock, maxWait: maxWait}
+}
+
+// Next blocks until the next timeslot boundary, or until maxWait has passed,
+// and returns the time of the clock when it woke up. It returns false as soon
+// as stop is closed.
+func (tt *TimeslotTicker) Next(stop <-chan struct{}) (time.Time, bool) {
+	now := tt.clock.Now()
+	boundary := NextTimeslotBoundary(now)
+	remaining := tt.maxWait
+	for {
+		d := boundary.Sub(now)
+		if tt.maxWait > 0 && d > remaining {
+			d = remaining
+		}
+		select {
+		case <-tt.clock.After(d):
+		case <-stop:
+			return time.Time{}, false
+		}
+		now = tt.clock.Now()
+		if !now.Before(boundary) {
+			return now, true
+		}
+		if tt.maxWait > 0 {
+			remaining -= d
+			if remaining <= 0 {
+				return now, true
+			}
+		}
+
+		// The clock says that the boundary hasn't come yet, which
+		// means that the clock was set back during the wait. Wait for
+		// the next boundary of the new time.
+		boundary = NextTimeslotBoundary(now)
+	}
+}
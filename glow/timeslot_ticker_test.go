@@ -0,0 +1,234 @@
+package glow
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// manualClock is a TimeslotClock that only moves when the test moves it.
+type manualClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []manualWaiter
+}
+
+// manualWaiter is a call to After that hasn't fired yet.
+type manualWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// newManualClock returns a manual clock that starts at the provided time.
+func newManualClock(now time.Time) *manualClock {
+	m := &manualClock{now: now}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// Now implements TimeslotClock.
+func (m *manualClock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// After implements TimeslotClock.
+func (m *manualClock) After(d time.Duration) <-chan time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := make(chan time.Time, 1)
+	m.waiters = append(m.waiters, manualWaiter{deadline: m.now.Add(d), c: c})
+	m.cond.Broadcast()
+	return c
+}
+
+// waiting blocks until there is a call to After, and returns its deadline.
+func (m *manualClock) waiting() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.waiters) == 0 {
+		m.cond.Wait()
+	}
+	return m.waiters[0].deadline
+}
+
+// set moves the clock and fires the calls to After whose deadline passed. If
+// fire is set, every call to After fires, like the timers of the machine do
+// when the clock is set back while they run.
+func (m *manualClock) set(now time.Time, fire bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now
+	var pending []manualWaiter
+	for _, w := range m.waiters {
+		if !fire && w.deadline.After(now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- now
+	}
+	m.waiters = pending
+}
+
+// TestNextTimeslotBoundary checks the boundaries around the genesis time.
+func TestNextTimeslotBoundary(t *testing.T) {
+	genesis := int64(GenesisTime)
+	for _, tc := range []struct {
+		t    time.Time
+		want int64
+	}{
+		{time.Unix(genesis, 0), genesis + 300},
+		{time.Unix(genesis, 1), genesis + 300},
+		{time.Unix(genesis+299, 999999999), genesis + 300},
+		{time.Unix(genesis+300, 0), genesis + 600},
+		{time.Unix(genesis-1, 0), genesis},
+		{time.Unix(genesis-300, 0), genesis},
+		{time.Unix(genesis-301, 0), genesis - 300},
+	} {
+		if got := NextTimeslotBoundary(tc.t); got.Unix() != tc.want || got.Nanosecond() != 0 {
+			t.Errorf("boundary after %v: got %v, want %v", tc.t.Sub(time.Unix(genesis, 0)), got.Unix()-genesis, tc.want-genesis)
+		}
+		if d := UntilNextTimeslot(tc.t); d <= 0 || d > 300*time.Second {
+			t.Errorf("time until the boundary after %v is %v", tc.t.Sub(time.Unix(genesis, 0)), d)
+		}
+	}
+}
+
+// TestTimeslotTicker runs a ticker on a manual clock through a simulated day,
+// with a loop whose iterations take a different amount of time every
+// timeslot, and checks that every tick lands exactly on a boundary.
+func TestTimeslotTicker(t *testing.T) {
+	start := time.Unix(int64(GenesisTime)+1234, 5e8)
+	c := newManualClock(start)
+	tt := NewTimeslotTicker(c, 0)
+	stop := make(chan struct{})
+	ticks := make(chan time.Time)
+	next := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			now, ok := tt.Next(stop)
+			if !ok {
+				return
+			}
+			ticks <- now
+			<-next
+		}
+	}()
+
+	boundary := NextTimeslotBoundary(start)
+	for i := 0; i < 288; i++ {
+		if deadline := c.waiting(); !deadline.Equal(boundary) {
+			t.Fatalf("tick %v: waiting until %v, want %v", i, deadline, boundary)
+		}
+		c.set(boundary, false)
+		now := <-ticks
+		if !now.Equal(boundary) {
+			t.Fatalf("tick %v landed at %v, want %v", i, now, boundary)
+		}
+		if timeslot, err := UnixToTimeslot(now.Unix()); err != nil || TimeslotToUnix(timeslot) != now.Unix() {
+			t.Fatalf("tick %v is not at the start of a timeslot: %v", i, now)
+		}
+
+		// The iteration of the loop takes anywhere from no time to
+		// most of the timeslot.
+		c.set(boundary.Add(time.Duration(i*37%290)*time.Second), false)
+		boundary = boundary.Add(300 * time.Second)
+		next <- struct{}{}
+	}
+	if elapsed := boundary.Sub(NextTimeslotBoundary(start)); elapsed != 24*time.Hour {
+		t.Fatal("the ticks did not cover a day:", elapsed)
+	}
+
+	// The clock gets set back by two minutes while the ticker waits, and
+	// the wait ends early. The ticker waits again, and still ticks on the
+	// boundary.
+	c.waiting()
+	c.set(c.Now().Add(-2*time.Minute), true)
+	if deadline := c.waiting(); !deadline.Equal(boundary) {
+		t.Fatalf("waiting until %v after the clock was set back, want %v", deadline, boundary)
+	}
+	c.set(boundary, false)
+	if now := <-ticks; !now.Equal(boundary) {
+		t.Fatal("tick after the clock was set back landed at", now)
+	}
+
+	// The clock gets set back by more than a timeslot, the ticker ticks
+	// on the boundaries of the new time.
+	c.set(boundary.Add(-20*time.Minute+time.Second), false)
+	next <- struct{}{}
+	boundary = boundary.Add(-15 * time.Minute)
+	if deadline := c.waiting(); !deadline.Equal(boundary) {
+		t.Fatalf("waiting until %v after the clock was set back, want %v", deadline, boundary)
+	}
+	c.set(boundary, false)
+	if now := <-ticks; !now.Equal(boundary) {
+		t.Fatal("tick after the clock was set back landed at", now)
+	}
+
+	// A jump forward past several boundaries is a single tick, and the
+	// next tick is back on a boundary.
+	next <- struct{}{}
+	c.waiting()
+	jump := boundary.Add(17*time.Minute + 3*time.Second)
+	c.set(jump, false)
+	if now := <-ticks; !now.Equal(jump) {
+		t.Fatal("tick after the jump landed at", now)
+	}
+	next <- struct{}{}
+	if deadline := c.waiting(); !deadline.Equal(NextTimeslotBoundary(jump)) {
+		t.Fatal("waiting until a time that is not the next boundary:", deadline)
+	}
+
+	close(stop)
+	<-done
+}
+
+// TestTimeslotTickerMaxWait checks that a ticker with a maximum wait wakes up
+// once the maximum wait is over, even when the clock was set back.
+func TestTimeslotTickerMaxWait(t *testing.T) {
+	start := time.Unix(int64(GenesisTime)+600, 0)
+	c := newManualClock(start)
+	tt := NewTimeslotTicker(c, time.Minute)
+	ticks := make(chan time.Time)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			now, ok := tt.Next(stop)
+			if !ok {
+				return
+			}
+			ticks <- now
+		}
+	}()
+	defer close(stop)
+
+	if deadline := c.waiting(); !deadline.Equal(start.Add(time.Minute)) {
+		t.Fatal("waiting past the maximum wait:", deadline)
+	}
+	c.set(start.Add(time.Minute), false)
+	if now := <-ticks; !now.Equal(start.Add(time.Minute)) {
+		t.Fatal("unexpected tick:", now)
+	}
+
+	// The clock is set back during the wait. The maximum wait is measured
+	// by the timer rather than by the clock, so the ticker still wakes up
+	// when the timer fires.
+	c.waiting()
+	back := start.Add(30 * time.Second)
+	c.set(back, true)
+	if now := <-ticks; !now.Equal(back) {
+		t.Fatal("unexpected tick after the clock was set back:", now)
+	}
+
+	// Near the boundary the boundary comes first.
+	c.waiting()
+	c.set(start.Add(290*time.Second), true)
+	<-ticks
+	if deadline := c.waiting(); !deadline.Equal(start.Add(300 * time.Second)) {
+		t.Fatal("waiting past the boundary:", deadline)
+	}
+}
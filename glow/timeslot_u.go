@@ -2,17 +2,23 @@ package glow
 
 import (
 	"fmt"
+	"math"
 )
 
-// UnixToTimeslot converts a unix time to the current timeslot.
+// UnixToTimeslot converts a unix time to the timeslot that contains it. Times
+// before the genesis time are not part of any timeslot.
 func UnixToTimeslot(time int64) (uint32, error) {
 	if time < GenesisTime {
 		return 0, fmt.Errorf("not a valid timeslot")
 	}
-	return uint32(time-GenesisTime) / 300, nil
+	timeslot := (time - GenesisTime) / 300
+	if timeslot > math.MaxUint32 {
+		return 0, fmt.Errorf("not a valid timeslot")
+	}
+	return uint32(timeslot), nil
 }
 
 // TimeslotToUnix converts a timeslot to the unix timestamp that it began.
 func TimeslotToUnix(timeslot uint32) int64 {
-	return GenesisTime + int64(timeslot*300)
+	return GenesisTime + int64(timeslot)*300
 }
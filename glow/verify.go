@@ -0,0 +1,160 @@
+package glow
+
+// verify.go contains the checks that third parties need to verify the data
+// that they downloaded from a GCA server without having to trust whoever
+// relayed it: the signed stats of a week, the report roots and the proofs
+// that a report is part of a root, and the signed reports of the devices.
+// The audit log is checked with VerifyAuditLog, and signed responses such as
+// the period summaries with VerifySignedResponse. bin/gca-verify wraps all of
+// them in a command line tool.
+//
+// Every check returns an error that says exactly what failed to verify, and
+// nil if everything checks out. The golden vectors in testdata/verify were
+// produced by the server code, so they break if the server and these checks
+// ever disagree.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// SignedDeviceStats is the part of the stats of one device that the signature
+// of the stats of a week covers.
+type SignedDeviceStats struct {
+	PublicKey    PublicKey
+	PowerOutputs [2016]uint64
+	ImpactRates  [2016]float64
+}
+
+// SignedAllDeviceStats is the part of an all-device-stats response that the
+// server signs, along with the signature. The JSON of the response decodes
+// into it.
+type SignedAllDeviceStats struct {
+	Devices        []SignedDeviceStats
+	TimeslotOffset uint32
+	Signature      Signature
+}
+
+// AppendDeviceStatsSigningBytes appends the signed part of the stats of one
+// device to b.
+func AppendDeviceStatsSigningBytes(b []byte, pk PublicKey, powerOutputs *[2016]uint64, impactRates *[2016]float64) []byte {
+	b = append(b, pk[:]...)
+	for _, po := range powerOutputs {
+		b = binary.LittleEndian.AppendUint64(b, po)
+	}
+	for _, ir := range impactRates {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(ir))
+	}
+	return b
+}
+
+// SigningBytes returns the bytes that the server signs for the stats, which
+// are the prefix "AllDeviceStats", the number of devices, the signed part of
+// the stats of every device, and the timeslot offset.
+func (s SignedAllDeviceStats) SigningBytes() []byte {
+	b := make([]byte, 0, len("AllDeviceStats")+4+len(s.Devices)*(32+8*2*2016)+4)
+	b = append(b, "AllDeviceStats"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(s.Devices)))
+	for i := range s.Devices {
+		ds := &s.Devices[i]
+		b = AppendDeviceStatsSigningBytes(b, ds.PublicKey, &ds.PowerOutputs, &ds.ImpactRates)
+	}
+	return binary.LittleEndian.AppendUint32(b, s.TimeslotOffset)
+}
+
+// VerifyAllDeviceStats decodes the JSON of an all-device-stats response and
+// checks that the stats were signed by the provided server key.
+func VerifyAllDeviceStats(data []byte, serverKey PublicKey) (SignedAllDeviceStats, error) {
+	var s SignedAllDeviceStats
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("unable to decode device stats: %v", err)
+	}
+	if s.Signature == (Signature{}) {
+		return s, errors.New("device stats are not signed")
+	}
+	if !Verify(serverKey, s.SigningBytes(), s.Signature) {
+		return s, fmt.Errorf("invalid signature on the device stats of timeslot offset %v", s.TimeslotOffset)
+	}
+	return s, nil
+}
+
+// ReportRootSigningBytes returns the bytes that a server signs to publish the
+// root over the numReports reports of the week that starts at periodStart.
+func ReportRootSigningBytes(periodStart, numReports uint32, root [32]byte) []byte {
+	b := make([]byte, 0, len("ReportRoot")+4+4+32)
+	b = append(b, "ReportRoot"...)
+	b = binary.LittleEndian.AppendUint32(b, periodStart)
+	b = binary.LittleEndian.AppendUint32(b, numReports)
+	return append(b, root[:]...)
+}
+
+// VerifyReportRoot checks that the root of the week that starts at
+// periodStart was signed by the provided server key.
+func VerifyReportRoot(serverKey PublicKey, periodStart, numReports uint32, root [32]byte, sig Signature) error {
+	if !Verify(serverKey, ReportRootSigningBytes(periodStart, numReports, root), sig) {
+		return fmt.Errorf("invalid signature on the report root of period start %v", periodStart)
+	}
+	return nil
+}
+
+// CheckReportProof is VerifyReportProof with the reason that the proof failed.
+func CheckReportProof(root [32]byte, leaf []byte, index, numLeaves uint32, proof [][32]byte) error {
+	if len(leaf) != ReportLeafSize {
+		return fmt.Errorf("leaf has length %v, expected %v", len(leaf), ReportLeafSize)
+	}
+	if index >= numLeaves {
+		return fmt.Errorf("leaf index %v is out of range for %v leaves", index, numLeaves)
+	}
+	hash := hashReportLeaf(leaf)
+	used := 0
+	for size := numLeaves; size > 1; size = (size + 1) / 2 {
+		if index%2 == 1 || index+1 < size {
+			if used == len(proof) {
+				return fmt.Errorf("proof has %v hashes, which is too short for leaf %v of %v", len(proof), index, numLeaves)
+			}
+			if index%2 == 1 {
+				hash = hashReportNode(proof[used], hash)
+			} else {
+				hash = hashReportNode(hash, proof[used])
+			}
+			used++
+		}
+		index /= 2
+	}
+	if used != len(proof) {
+		return fmt.Errorf("proof has %v hashes, expected %v", len(proof), used)
+	}
+	if hash != root {
+		return errors.New("proof does not lead to the root")
+	}
+	return nil
+}
+
+// DecodeReportLeaf returns the public key of the device and the report in a
+// leaf. The leaf does not contain the ShortID of the device, which has to be
+// provided.
+func DecodeReportLeaf(leaf []byte, shortID uint32) (PublicKey, EquipmentReport, error) {
+	var pk PublicKey
+	var er EquipmentReport
+	if len(leaf) != ReportLeafSize {
+		return pk, er, fmt.Errorf("leaf has length %v, expected %v", len(leaf), ReportLeafSize)
+	}
+	copy(pk[:], leaf)
+	er.ShortID = shortID
+	er.Timeslot = binary.LittleEndian.Uint32(leaf[32:])
+	er.PowerOutput = binary.LittleEndian.Uint64(leaf[36:])
+	copy(er.Signature[:], leaf[44:])
+	return pk, er, nil
+}
+
+// VerifyEquipmentReport checks that the report was signed by the provided key
+// of its device.
+func VerifyEquipmentReport(pk PublicKey, er EquipmentReport) error {
+	if !Verify(pk, er.SigningBytes(), er.Signature) {
+		return fmt.Errorf("invalid signature on the report of ShortID %v for timeslot %v", er.ShortID, er.Timeslot)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package glow
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// verifyVectorKeys are the keys that signed the golden vectors.
+type verifyVectorKeys struct {
+	ServerKey    string `json:"server_key"`
+	GCAKey       string `json:"gca_key"`
+	DeviceKey    string `json:"device_key"`
+	AuditLogHead string `json:"audit_log_head"`
+}
+
+// verifyVectorProof is the JSON of a report proof, as served by
+// /api/v1/report-proof.
+type verifyVectorProof struct {
+	Root struct {
+		PeriodStart uint32 `json:"period_start"`
+		NumReports  uint32 `json:"num_reports"`
+		Root        string `json:"root"`
+		Signature   string `json:"signature"`
+	} `json:"root"`
+	Leaf   string   `json:"leaf"`
+	Index  uint32   `json:"index"`
+	Proof  []string `json:"proof"`
+	Report struct {
+		ShortID     uint32 `json:"short_id"`
+		Timeslot    uint32 `json:"timeslot"`
+		PowerOutput uint64 `json:"power_output"`
+		Signature   string `json:"signature"`
+	} `json:"report"`
+}
+
+// readVector reads one of the golden vectors in testdata/verify.
+func readVector(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "verify", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// decodeHex decodes a hex string into a fixed size array.
+func decodeHex(t *testing.T, s string, dst []byte) {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(dst) {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	copy(dst, b)
+}
+
+// TestVerifyGoldenVectors checks the golden vectors in testdata/verify, which
+// were signed by the server code, and checks that tampering with any of them
+// is caught.
+func TestVerifyGoldenVectors(t *testing.T) {
+	var keys verifyVectorKeys
+	if err := json.Unmarshal(readVector(t, "keys.json"), &keys); err != nil {
+		t.Fatal(err)
+	}
+	var serverKey, deviceKey, otherKey PublicKey
+	var head [32]byte
+	decodeHex(t, keys.ServerKey, serverKey[:])
+	decodeHex(t, keys.DeviceKey, deviceKey[:])
+	decodeHex(t, keys.GCAKey, otherKey[:])
+	decodeHex(t, keys.AuditLogHead, head[:])
+
+	t.Run("stats", func(t *testing.T) {
+		data := readVector(t, "all-device-stats.json")
+		stats, err := VerifyAllDeviceStats(data, serverKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.TimeslotOffset != 4032 || len(stats.Devices) != 2 || stats.Devices[0].PublicKey != deviceKey || stats.Devices[0].PowerOutputs[110] != 110000 {
+			t.Fatal("unexpected stats:", stats.TimeslotOffset, len(stats.Devices))
+		}
+		if _, err := VerifyAllDeviceStats(data, otherKey); err == nil {
+			t.Fatal("stats verified against the wrong key")
+		}
+		stats.Devices[1].ImpactRates[7] += 1e-12
+		tampered, _ := json.Marshal(stats)
+		if _, err := VerifyAllDeviceStats(tampered, serverKey); err == nil {
+			t.Fatal("tampered stats verified")
+		}
+	})
+
+	t.Run("audit log", func(t *testing.T) {
+		var page struct {
+			Entries []AuditEntry `json:"entries"`
+		}
+		if err := json.Unmarshal(readVector(t, "audit-log.json"), &page); err != nil {
+			t.Fatal(err)
+		}
+		got, err := VerifyAuditLog([32]byte{}, page.Entries)
+		if err != nil || got != head {
+			t.Fatal("audit log did not verify:", err)
+		}
+		// Every page can be verified on its own, given the hash of the
+		// entry before it.
+		if got, err := VerifyAuditLog(page.Entries[0].Hash(), page.Entries[1:]); err != nil || got != head {
+			t.Fatal("second page did not verify:", err)
+		}
+		if _, err := VerifyAuditLog([32]byte{}, page.Entries[1:]); err == nil {
+			t.Fatal("audit log with a missing entry verified")
+		}
+		page.Entries[1].Timeslot++
+		if _, err := VerifyAuditLog([32]byte{}, page.Entries); err == nil {
+			t.Fatal("audit log with a changed entry verified")
+		}
+		page.Entries[1].Timeslot--
+		page.Entries[1].Signatures[1].SigningBytes[0] ^= 1
+		if _, err := VerifyAuditLog([32]byte{}, page.Entries); err == nil {
+			t.Fatal("audit log with a bad signature verified")
+		}
+	})
+
+	t.Run("report proof", func(t *testing.T) {
+		var vp verifyVectorProof
+		if err := json.Unmarshal(readVector(t, "report-proof.json"), &vp); err != nil {
+			t.Fatal(err)
+		}
+		var root [32]byte
+		var sig Signature
+		decodeHex(t, vp.Root.Root, root[:])
+		decodeHex(t, vp.Root.Signature, sig[:])
+		leaf, err := hex.DecodeString(vp.Leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof := make([][32]byte, len(vp.Proof))
+		for i, p := range vp.Proof {
+			decodeHex(t, p, proof[i][:])
+		}
+		if err := VerifyReportRoot(serverKey, vp.Root.PeriodStart, vp.Root.NumReports, root, sig); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyReportRoot(serverKey, vp.Root.PeriodStart+2016, vp.Root.NumReports, root, sig); err == nil {
+			t.Fatal("root verified for the wrong period")
+		}
+		if err := CheckReportProof(root, leaf, vp.Index, vp.Root.NumReports, proof); err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckReportProof(root, leaf, vp.Index+1, vp.Root.NumReports, proof); err == nil {
+			t.Fatal("proof verified for the wrong index")
+		}
+		if err := CheckReportProof(root, leaf, vp.Index, vp.Root.NumReports, proof[1:]); err == nil {
+			t.Fatal("short proof verified")
+		}
+		if err := CheckReportProof(root, leaf, vp.Index, vp.Root.NumReports, append(proof, root)); err == nil {
+			t.Fatal("long proof verified")
+		}
+		if err := CheckReportProof(root, leaf[1:], vp.Index, vp.Root.NumReports, proof); err == nil {
+			t.Fatal("short leaf verified")
+		}
+
+		// The leaf carries the report that it commits to.
+		pk, er, err := DecodeReportLeaf(leaf, vp.Report.ShortID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pk != deviceKey || er.Timeslot != vp.Report.Timeslot || er.PowerOutput != vp.Report.PowerOutput || hex.EncodeToString(er.Signature[:]) != vp.Report.Signature {
+			t.Fatal("leaf does not match the report:", er)
+		}
+		if err := VerifyEquipmentReport(pk, er); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("report", func(t *testing.T) {
+		var hr struct {
+			ShortID     uint32 `json:"short_id"`
+			Timeslot    uint32 `json:"timeslot"`
+			PowerOutput uint64 `json:"power_output"`
+			Signature   string `json:"signature"`
+		}
+		if err := json.Unmarshal(readVector(t, "report.json"), &hr); err != nil {
+			t.Fatal(err)
+		}
+		er := EquipmentReport{ShortID: hr.ShortID, Timeslot: hr.Timeslot, PowerOutput: hr.PowerOutput}
+		decodeHex(t, hr.Signature, er.Signature[:])
+		if err := VerifyEquipmentReport(deviceKey, er); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyEquipmentReport(otherKey, er); err == nil {
+			t.Fatal("report verified against the wrong key")
+		}
+		er.PowerOutput++
+		if err := VerifyEquipmentReport(deviceKey, er); err == nil {
+			t.Fatal("tampered report verified")
+		}
+	})
+
+	t.Run("period summary", func(t *testing.T) {
+		data := readVector(t, "period-summary.json")
+		body, err := VerifySignedResponse(data, serverKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var summary struct {
+			PeriodStart uint32 `json:"period_start"`
+		}
+		if err := json.Unmarshal(body, &summary); err != nil || summary.PeriodStart != 4032 {
+			t.Fatal("unexpected summary:", string(body), err)
+		}
+		if _, err := VerifySignedResponse(data, otherKey); err == nil {
+			t.Fatal("summary verified against the wrong key")
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package glow
+
+// webhook_event.go contains the signature that the GCA servers put on the
+// events that they post to webhooks, which allows a receiver to check that an
+// event really came from a particular GCA server. The signature is sent hex
+// encoded in the X-GCA-Signature header, and covers:
+//
+//	"WebhookEvent" || Body
+//
+// where the Body bytes are the raw body of the POST. A receiver must verify the
+// raw body before parsing it, because there are many ways to serialize the same
+// JSON object.
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// WebhookSignatureHeader is the header that carries the signature of a
+// webhook event.
+const WebhookSignatureHeader = "X-GCA-Signature"
+
+// SignWebhookEvent returns the value of the signature header for the provided
+// body.
+func SignWebhookEvent(body []byte, privKey PrivateKey) string {
+	sig := Sign(SerializeWebhookEventForSigning(body), privKey)
+	return hex.EncodeToString(sig[:])
+}
+
+// VerifyWebhookEvent checks that the value of the signature header was
+// produced by the provided server key for the provided body.
+func VerifyWebhookEvent(body []byte, header string, serverKey PublicKey) error {
+	raw, err := hex.DecodeString(header)
+	if err != nil || len(raw) != len(Signature{}) {
+		return fmt.Errorf("malformed webhook signature")
+	}
+	var sig Signature
+	copy(sig[:], raw)
+	if !Verify(serverKey, SerializeWebhookEventForSigning(body), sig) {
+		return fmt.Errorf("invalid signature on webhook event")
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package glow
+
+import (
+	"testing"
+)
+
+// TestVerifyWebhookEvent checks that a signed event verifies, and that a
+// tampered body, the wrong key or a malformed header make the verification
+// fail.
+func TestVerifyWebhookEvent(t *testing.T) {
+	pub, priv := GenerateKeyPair()
+	body := []byte(`{"event":"equipment.banned","short_id":5}`)
+	header := SignWebhookEvent(body, priv)
+	if err := VerifyWebhookEvent(body, header, pub); err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _ := GenerateKeyPair()
+	if err := VerifyWebhookEvent(body, header, otherPub); err == nil {
+		t.Fatal("event verified against the wrong key")
+	}
+	tampered := append([]byte{}, body...)
+	tampered[len(tampered)-2]++
+	if err := VerifyWebhookEvent(tampered, header, pub); err == nil {
+		t.Fatal("tampered event verified")
+	}
+	for _, bad := range []string{"", "zz", header[:10]} {
+		if err := VerifyWebhookEvent(body, bad, pub); err == nil {
+			t.Fatalf("malformed header %q verified", bad)
+		}
+	}
+}
@@ -5,13 +5,22 @@ go 1.22.1
 require (
 	github.com/ethereum/go-ethereum v1.14.3
 	github.com/glowlabs-org/threadgroup v0.0.0-20240512114128-232ca7c42d0d
+	golang.org/x/crypto v0.23.0
+	modernc.org/sqlite v1.34.5
 )
 
 require (
 	github.com/btcsuite/btcd/btcec/v2 v2.3.3 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.3.0 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/glowlabs-org/errors v0.0.0-20240512103511-f6f59e80d2a3 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	github.com/holiman/uint256 v1.2.4 // indirect
-	golang.org/x/crypto v0.23.0 // indirect
-	golang.org/x/sys v0.20.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	modernc.org/libc v1.55.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
 )
@@ -0,0 +1,397 @@
+package server
+
+// alerts.go routes the events that an operator wants to hear about to the
+// alert backends. Every event has a type, like "offline" or
+// "peer.unreachable", and the "alerts" section of server-config.json picks the
+// backends that each type goes to:
+//
+//	"alerts": {
+//		"smtp": {
+//			"server": "smtp.example.com:587",
+//			"username": "gca",
+//			"password": "secret",
+//			"from": "gca@example.com",
+//			"to": ["ops@example.com"]
+//		},
+//		"slack": {"url": "https://hooks.slack.com/services/T000/B000/XXXX"},
+//		"routes": {
+//			"offline": ["webhooks", "slack"],
+//			"persist.failed": ["smtp", "slack"],
+//			"*": ["webhooks"]
+//		}
+//	}
+//
+// A type without a route of its own takes the "*" route, and without any
+// routes every event goes to the webhooks, which is how the server behaved
+// before there were other backends. The webhooks are still configured through
+// webhooks.json, see offline_webhooks.go.
+//
+// Alert delivery never holds up the caller. Every backend has a retry queue of
+// its own, see retry_queue.go, which a background thread drains. The webhooks
+// keep the queue of webhook_queue.go, and the email and the Slack backends
+// queue their alerts in smtpQueue.json and slackQueue.json. Every dropped or
+// failed delivery is logged and counted in alert_delivery_failures_total, by
+// backend.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The names of the alert backends.
+const (
+	alertBackendWebhooks = "webhooks"
+	alertBackendSMTP     = "smtp"
+	alertBackendSlack    = "slack"
+)
+
+// The event types sent when the server can't persist reports, see
+// persist_health.go.
+const (
+	alertEventPersistFailed    = "persist.failed"
+	alertEventPersistRecovered = "persist.recovered"
+)
+
+// alertRouteDefault is the route of the event types without a route of their
+// own.
+const alertRouteDefault = "*"
+
+// alertTypes are the event types that can be routed.
+var alertTypes = []string{
+	webhookEventOffline,
+	webhookEventRecovered,
+	webhookEventExpiring,
+	webhookEventAuthorized,
+	webhookEventDeauthorized,
+	webhookEventBanned,
+	webhookEventPeerUnreachable,
+	webhookEventPeerRecovered,
+	alertEventPersistFailed,
+	alertEventPersistRecovered,
+}
+
+// alertEvent is an event that can be sent to the alert backends.
+type alertEvent interface {
+	// alertType returns the type that the event gets routed by.
+	alertType() string
+
+	// alertSummary returns a line of text that describes the event, for
+	// the backends that are read by people.
+	alertSummary() string
+}
+
+// alert is an event on its way to the alert backends.
+type alert struct {
+	Type    string
+	Summary string
+	Body    []byte // The JSON encoding of the event
+}
+
+// Alerter is an alert backend. Alert is called with the server mutex held, so
+// it must not block and must not take the mutex.
+type Alerter interface {
+	Name() string
+	Alert(a alert)
+}
+
+// smtpConfig is the email backend of the alerts config.
+type smtpConfig struct {
+	Server   string   `json:"server"` // host:port of the SMTP server
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// slackConfig is the Slack backend of the alerts config. Any service that
+// accepts Slack incoming webhooks works.
+type slackConfig struct {
+	URL string `json:"url"`
+}
+
+// alertsConfig is the "alerts" section of server-config.json.
+type alertsConfig struct {
+	SMTP   *smtpConfig         `json:"smtp"`
+	Slack  *slackConfig        `json:"slack"`
+	Routes map[string][]string `json:"routes"`
+}
+
+// validate checks that every route names a known event type and backends that
+// are configured.
+func (ac alertsConfig) validate() error {
+	if ac.SMTP != nil && (ac.SMTP.Server == "" || ac.SMTP.From == "" || len(ac.SMTP.To) == 0) {
+		return fmt.Errorf("alerts smtp needs a server, a from address and at least one to address")
+	}
+	if ac.SMTP != nil {
+		if _, _, err := net.SplitHostPort(ac.SMTP.Server); err != nil {
+			return fmt.Errorf("invalid alerts smtp server: %v", err)
+		}
+	}
+	if ac.Slack != nil && !strings.HasPrefix(ac.Slack.URL, "http://") && !strings.HasPrefix(ac.Slack.URL, "https://") {
+		return fmt.Errorf("alerts slack needs an http or https url")
+	}
+	for typ, backends := range ac.Routes {
+		known := typ == alertRouteDefault
+		for _, t := range alertTypes {
+			known = known || t == typ
+		}
+		if !known {
+			return fmt.Errorf("unknown alert type %q in alerts routes", typ)
+		}
+		for _, b := range backends {
+			switch {
+			case b == alertBackendWebhooks:
+			case b == alertBackendSMTP && ac.SMTP != nil:
+			case b == alertBackendSlack && ac.Slack != nil:
+			case b == alertBackendSMTP || b == alertBackendSlack:
+				return fmt.Errorf("alert type %q is routed to %v, which is not configured", typ, b)
+			default:
+				return fmt.Errorf("unknown alert backend %q in alerts routes", b)
+			}
+		}
+	}
+	return nil
+}
+
+// route returns the backends that an event type goes to.
+func (ac alertsConfig) route(typ string) []string {
+	if backends, exists := ac.Routes[typ]; exists {
+		return backends
+	}
+	if backends, exists := ac.Routes[alertRouteDefault]; exists {
+		return backends
+	}
+	return []string{alertBackendWebhooks}
+}
+
+// describe returns the config without any of its secrets, for the reload log.
+func (ac alertsConfig) describe() string {
+	var backends []string
+	if ac.SMTP != nil {
+		backends = append(backends, fmt.Sprintf("smtp via %v to %v recipients", ac.SMTP.Server, len(ac.SMTP.To)))
+	}
+	if ac.Slack != nil {
+		backends = append(backends, "slack")
+	}
+	var routes []string
+	for typ, b := range ac.Routes {
+		routes = append(routes, typ+"="+strings.Join(b, ","))
+	}
+	sort.Strings(routes)
+	return fmt.Sprintf("backends [%v] routes [%v]", strings.Join(backends, "; "), strings.Join(routes, " "))
+}
+
+// webhookAlerter sends alerts to the webhooks of webhooks.json, through the
+// webhook queue.
+type webhookAlerter struct {
+	gcas *GCAServer
+}
+
+// Name implements Alerter.
+func (wa webhookAlerter) Name() string { return alertBackendWebhooks }
+
+// Alert implements Alerter. The webhook queue has its own mutex, which can be
+// used while holding the server mutex.
+func (wa webhookAlerter) Alert(a alert) {
+	gcas := wa.gcas
+	if !gcas.webhooksEnabled {
+		return
+	}
+	if err := gcas.staticWebhookQueue.managedPush(gcas.webhooks.URLs, a.Body); err != nil {
+		gcas.logger.Errorf("unable to queue webhook event: %v", err)
+	}
+}
+
+// queuedAlerter is a backend that sends alerts one at a time from a retry
+// queue, with a background thread calling send. The destination of every
+// alert is the name of the backend, so the backend backs off as a whole.
+type queuedAlerter struct {
+	name  string
+	queue *retryQueue
+	send  func(alert) error
+	gcas  *GCAServer
+}
+
+// newQueuedAlerter loads the queue of a backend that sends its alerts with the
+// provided function. The thread that drains the queue is started by
+// launchAlerters.
+func (gcas *GCAServer) newQueuedAlerter(name string, file string, send func(alert) error) (*queuedAlerter, error) {
+	q, err := gcas.loadRetryQueue(gcas.newRetryQueueConfig(name, file))
+	if err != nil {
+		return nil, err
+	}
+	return &queuedAlerter{
+		name:  name,
+		queue: q,
+		send:  send,
+		gcas:  gcas,
+	}, nil
+}
+
+// Name implements Alerter.
+func (qa *queuedAlerter) Name() string { return qa.name }
+
+// Alert implements Alerter. The queue has its own mutex, which can be used
+// while holding the server mutex.
+func (qa *queuedAlerter) Alert(a alert) {
+	payload, err := json.Marshal(a)
+	if err == nil {
+		err = qa.queue.managedPush([]string{qa.name}, payload)
+	}
+	if err != nil {
+		qa.gcas.logger.WithFields("backend", qa.name, "type", a.Type, "error", err).Error("unable to queue alert")
+	}
+}
+
+// threadedDeliver sends the queued alerts until the server shuts down.
+func (qa *queuedAlerter) threadedDeliver() {
+	qa.gcas.threadedDrainRetryQueue(qa.queue, func(e *retryEntry) error {
+		var a alert
+		if err := json.Unmarshal(e.Payload, &a); err != nil {
+			// A payload that can't be decoded would fail forever,
+			// so it counts as delivered.
+			qa.gcas.logger.WithFields("backend", qa.name, "error", err).Error("dropping an alert that can't be decoded")
+			return nil
+		}
+		return qa.send(a)
+	})
+}
+
+// newAlerters creates the alert backends and loads their queues, which are
+// also added to the retry queues of the server. Alerts can be queued right
+// away, but the email and the Slack backends only start sending once
+// launchAlerters is called.
+func (gcas *GCAServer) newAlerters() (map[string]Alerter, error) {
+	alerters := map[string]Alerter{alertBackendWebhooks: webhookAlerter{gcas: gcas}}
+	for _, backend := range []struct {
+		name string
+		file string
+		send func(alert) error
+	}{
+		{alertBackendSMTP, SMTPQueueFile, gcas.managedSendAlertEmail},
+		{alertBackendSlack, SlackQueueFile, gcas.managedSendAlertSlack},
+	} {
+		qa, err := gcas.newQueuedAlerter(backend.name, backend.file, backend.send)
+		if err != nil {
+			return nil, err
+		}
+		alerters[backend.name] = qa
+		gcas.staticRetryQueues = append(gcas.staticRetryQueues, qa.queue)
+	}
+	return alerters, nil
+}
+
+// launchAlerters starts the threads of the queued alert backends.
+func (gcas *GCAServer) launchAlerters() {
+	for _, name := range []string{alertBackendSMTP, alertBackendSlack} {
+		qa := gcas.staticAlerters[name].(*queuedAlerter)
+		gcas.launchComponent("alerts-"+name, nil, qa.threadedDeliver)
+	}
+}
+
+// queueAlert sends an event to the backends that its type is routed to. The
+// mutex must be held.
+func (gcas *GCAServer) queueAlert(event alertEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		gcas.logger.Errorf("unable to encode alert: %v", err)
+		return
+	}
+	a := alert{Type: event.alertType(), Summary: event.alertSummary(), Body: body}
+	for _, name := range gcas.alerts.route(a.Type) {
+		gcas.staticAlerters[name].Alert(a)
+	}
+}
+
+// alertsEnabled returns whether any alert backend is configured. The mutex
+// must be held.
+func (gcas *GCAServer) alertsEnabled() bool {
+	return gcas.webhooksEnabled || gcas.alerts.SMTP != nil || gcas.alerts.Slack != nil
+}
+
+// managedSendAlertEmail sends an alert to the recipients of the email backend.
+func (gcas *GCAServer) managedSendAlertEmail(a alert) error {
+	gcas.mu.RLock()
+	sc := gcas.alerts.SMTP
+	gcas.mu.RUnlock()
+	if sc == nil {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(sc.Server)
+	conn, err := net.DialTimeout("tcp", sc.Server, alertTimeout)
+	if err != nil {
+		return fmt.Errorf("unable to reach smtp server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(alertTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("unable to talk to smtp server: %v", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("unable to start tls: %v", err)
+		}
+	}
+	if sc.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", sc.Username, sc.Password, host)); err != nil {
+			return fmt.Errorf("unable to authenticate: %v", err)
+		}
+	}
+	if err := c.Mail(sc.From); err != nil {
+		return err
+	}
+	for _, to := range sc.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	var event bytes.Buffer
+	json.Indent(&event, a.Body, "", "  ")
+	fmt.Fprintf(w, "From: %v\r\nTo: %v\r\nSubject: [gca] %v\r\nDate: %v\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%v\r\n\r\n%v\r\n",
+		sc.From, strings.Join(sc.To, ", "), a.Summary, gcas.now().Format(time.RFC1123Z), a.Summary, event.String())
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// managedSendAlertSlack posts an alert to the incoming webhook of the Slack
+// backend.
+func (gcas *GCAServer) managedSendAlertSlack(a alert) error {
+	gcas.mu.RLock()
+	sc := gcas.alerts.Slack
+	gcas.mu.RUnlock()
+	if sc == nil {
+		return nil
+	}
+	body, _ := json.Marshal(map[string]string{"text": "[gca] " + a.Summary})
+	req, err := http.NewRequestWithContext(gcas.staticShutdownCtx, "POST", sc.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create slack request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := http.Client{Timeout: alertTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("slack returned status %v", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// smtpReceiver is an SMTP server that accepts every message and collects
+// them. A silent receiver accepts connections but never answers.
+type smtpReceiver struct {
+	listener net.Listener
+	silent   bool
+	messages []string
+
+	mu sync.Mutex
+}
+
+// newSMTPReceiver starts an SMTP receiver on a local port.
+func newSMTPReceiver(t *testing.T, silent bool) *smtpReceiver {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr := &smtpReceiver{listener: l, silent: silent}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go sr.serve(conn)
+		}
+	}()
+	return sr
+}
+
+// serve speaks just enough SMTP to take a message.
+func (sr *smtpReceiver) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if sr.silent {
+		r.ReadString('\n')
+		return
+	}
+	fmt.Fprint(conn, "220 localhost\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"):
+			fmt.Fprint(conn, "250 localhost\r\n")
+		case cmd == "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			var msg strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				msg.WriteString(line)
+			}
+			sr.mu.Lock()
+			sr.messages = append(sr.messages, msg.String())
+			sr.mu.Unlock()
+			fmt.Fprint(conn, "250 ok\r\n")
+		case cmd == "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+// slackReceiver collects the texts posted to it, or fails every post.
+type slackReceiver struct {
+	texts   []string
+	failing bool
+
+	mu sync.Mutex
+}
+
+// ServeHTTP implements http.Handler.
+func (sr *slackReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	var msg struct {
+		Text string `json:"text"`
+	}
+	if sr.failing || json.NewDecoder(r.Body).Decode(&msg) != nil {
+		http.Error(w, "no", http.StatusInternalServerError)
+		return
+	}
+	sr.texts = append(sr.texts, msg.Text)
+}
+
+// waitFor waits until the condition holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for", what)
+		}
+	}
+}
+
+// TestAlerts checks that every alert type goes to the backends of its route,
+// and that routes to backends that aren't configured are refused.
+func TestAlerts(t *testing.T) {
+	glow.SetCurrentTimeslot(100)
+	defer glow.SetCurrentTimeslot(0)
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	mail := newSMTPReceiver(t, false)
+	defer mail.listener.Close()
+	slack := &slackReceiver{}
+	slackServer := httptest.NewServer(slack)
+	defer slackServer.Close()
+	hooks := &webhookReceiver{}
+	hooksServer := httptest.NewServer(hooks)
+	defer hooksServer.Close()
+
+	webhooks, _ := json.Marshal(webhookConfig{URLs: []string{hooksServer.URL}})
+	if err := os.WriteFile(filepath.Join(dir, WebhooksConfigFile), webhooks, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig := func(ac alertsConfig) {
+		t.Helper()
+		data, _ := json.Marshal(map[string]interface{}{"alerts": ac})
+		if err := os.WriteFile(filepath.Join(dir, ServerConfigFile), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := alertsConfig{
+		SMTP:  &smtpConfig{Server: mail.listener.Addr().String(), Password: "hunter2", From: "gca@example.com", To: []string{"ops@example.com", "gca@example.com"}},
+		Slack: &slackConfig{URL: slackServer.URL},
+		Routes: map[string][]string{
+			alertEventPersistFailed: {alertBackendSMTP, alertBackendSlack},
+			webhookEventAuthorized:  {alertBackendSlack},
+			alertRouteDefault:       {alertBackendWebhooks},
+		},
+	}
+	writeConfig(config)
+	res, err := server.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fmt.Sprint(res.Changed), "alerts: ") || strings.Contains(fmt.Sprint(res.Changed), "hunter2") {
+		t.Fatal("unexpected changes:", res.Changed)
+	}
+
+	// The authorization only goes to Slack.
+	_, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the slack alert", func() bool {
+		slack.mu.Lock()
+		defer slack.mu.Unlock()
+		return len(slack.texts) == 1
+	})
+	if slack.texts[0] != "[gca] equipment 1 was authorized" {
+		t.Fatal("unexpected slack text:", slack.texts[0])
+	}
+
+	// A failed write goes to email and Slack, the recovery takes the
+	// default route to the webhooks.
+	server.mu.Lock()
+	server.persistHook = func(string) error { return syscall.ENOSPC }
+	server.mu.Unlock()
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, 100, priv)); outcome != reportRetryLater {
+		t.Fatal("unexpected outcome:", outcome)
+	}
+	server.mu.Lock()
+	server.persistHook = nil
+	server.mu.Unlock()
+	events := hooks.waitForEvents(1)
+	if len(events) != 1 || events[0].Event != alertEventPersistRecovered {
+		t.Fatalf("unexpected webhook events: %+v", events)
+	}
+	waitFor(t, "the email", func() bool {
+		mail.mu.Lock()
+		defer mail.mu.Unlock()
+		return len(mail.messages) == 1
+	})
+	msg := mail.messages[0]
+	if !strings.Contains(msg, "Subject: [gca] unable to persist reports") || !strings.Contains(msg, `"event": "persist.failed"`) || !strings.Contains(msg, "To: ops@example.com, gca@example.com") {
+		t.Fatal("unexpected email:", msg)
+	}
+	waitFor(t, "the second slack alert", func() bool {
+		slack.mu.Lock()
+		defer slack.mu.Unlock()
+		return len(slack.texts) == 2
+	})
+	for _, backend := range []string{alertBackendWebhooks, alertBackendSMTP, alertBackendSlack} {
+		if n := server.staticMetrics.AlertFailures(backend); n != 0 {
+			t.Fatalf("%v failures for %v", n, backend)
+		}
+	}
+
+	// Routes need known types and configured backends, and a bad config
+	// leaves the old one in place.
+	for _, bad := range []alertsConfig{
+		{Routes: map[string][]string{alertEventPersistFailed: {alertBackendSMTP}}},
+		{Routes: map[string][]string{"persist.lost": {alertBackendWebhooks}}},
+		{Routes: map[string][]string{alertRouteDefault: {"pager"}}},
+		{SMTP: &smtpConfig{Server: "localhost", From: "gca@example.com", To: []string{"ops@example.com"}}},
+		{Slack: &slackConfig{URL: "hooks.slack.com"}},
+	} {
+		writeConfig(bad)
+		if _, err := server.Reload(); err == nil {
+			t.Fatalf("config was accepted: %+v", bad)
+		}
+	}
+	server.mu.RLock()
+	kept := server.alerts.Slack != nil
+	server.mu.RUnlock()
+	if !kept {
+		t.Fatal("a bad config replaced the alerts")
+	}
+}
+
+// TestAlertsDeadBackends checks that backends which don't answer never hold
+// up the caller, that they keep their alerts for a retry, and that every
+// alert they lose or fail to deliver is counted for them.
+func TestAlertsDeadBackends(t *testing.T) {
+	opts := DefaultServerOptions()
+	opts.RetryQueueMaxEntries = 100
+	server, dir, _, _, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	mail := newSMTPReceiver(t, true)
+	defer mail.listener.Close()
+	slack := &slackReceiver{failing: true}
+	slackServer := httptest.NewServer(slack)
+	defer slackServer.Close()
+	config, _ := json.Marshal(map[string]interface{}{"alerts": alertsConfig{
+		SMTP:   &smtpConfig{Server: mail.listener.Addr().String(), From: "gca@example.com", To: []string{"ops@example.com"}},
+		Slack:  &slackConfig{URL: slackServer.URL},
+		Routes: map[string][]string{alertRouteDefault: {alertBackendSMTP, alertBackendSlack}},
+	}})
+	if err := os.WriteFile(filepath.Join(dir, ServerConfigFile), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The email backend is stuck on the first alert, so both queues fill
+	// up and the oldest alerts get dropped.
+	start := time.Now()
+	server.mu.Lock()
+	for i := 0; i < opts.RetryQueueMaxEntries+10; i++ {
+		server.queueAlert(PeerStatusEvent{Event: webhookEventPeerUnreachable, Location: "127.0.0.1"})
+	}
+	server.mu.Unlock()
+	if time.Since(start) > time.Second {
+		t.Fatal("queueing the alerts blocked:", time.Since(start))
+	}
+	for _, backend := range []string{alertBackendSMTP, alertBackendSlack} {
+		if n := server.staticMetrics.AlertFailures(backend); n < 10 {
+			t.Fatalf("the dropped alerts of %v were not counted: %v", backend, n)
+		}
+	}
+
+	// The failed deliveries are counted, and the backends keep their
+	// alerts for the next attempt.
+	waitFor(t, "the slack failures", func() bool {
+		return server.staticMetrics.AlertFailures(alertBackendSlack) >= 13
+	})
+	waitFor(t, "the email timeout", func() bool {
+		return server.staticMetrics.AlertFailures(alertBackendSMTP) >= 11
+	})
+	var metrics strings.Builder
+	server.staticMetrics.WritePrometheus(&metrics)
+	server.writeRetryQueueMetrics(&metrics)
+	for _, line := range []string{
+		"alert_delivery_failures_total{backend=\"webhooks\"} 0\n",
+		"retry_queue_dropped_total{queue=\"slack\",reason=\"size\"} 10\n",
+		"retry_queue_dropped_total{queue=\"smtp\",reason=\"size\"} 10\n",
+		fmt.Sprintf("retry_queue_depth{queue=\"slack\",destination=\"slack\"} %d\n", opts.RetryQueueMaxEntries),
+	} {
+		if !strings.Contains(metrics.String(), line) {
+			t.Fatal("missing", line, "from the metrics:", metrics.String())
+		}
+	}
+
+	// Once Slack is back, the backlog gets delivered.
+	slack.mu.Lock()
+	slack.failing = false
+	slack.mu.Unlock()
+	waitFor(t, "the slack backlog", func() bool {
+		slack.mu.Lock()
+		defer slack.mu.Unlock()
+		return len(slack.texts) == opts.RetryQueueMaxEntries
+	})
+}
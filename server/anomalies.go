@@ -0,0 +1,643 @@
+package server
+
+// anomalies.go flags devices whose reports follow patterns that are
+// implausible for real solar equipment, so that the GCA knows which curves to
+// look at instead of having to eyeball thousands of them. Three patterns are
+// detected:
+//
+//   - night_output: the device reports production while the sun is below the
+//     horizon at its location, for at least anomaly_night_timeslots in a row.
+//     Devices without a location are skipped.
+//   - constant_output: the device reports the exact same production for at
+//     least anomaly_constant_timeslots in a row.
+//   - output_spike: the device reports more than anomaly_spike_factor times
+//     the anomaly_spike_percentile of its own production over the week
+//     before. The percentile is recomputed once per day.
+//
+// The detection runs in the background every anomaly_check_timeslots, see
+// reload.go for the settings. It copies the reports of a chunk of devices at a
+// time, with the same chunk size as the stats snapshots, and analyzes the copy
+// without holding the mutex, so it never holds up the ingestion of reports.
+// The corrections of the GCA are applied to the copy, so a corrected value is
+// never flagged.
+//
+// Anomalies are advisory. They never affect whether a report is accepted, or
+// any of the stats. An anomaly covers a run of consecutive timeslots, which is
+// extended when a later pass finds that the run continued, and it keeps the
+// power outputs of the run as evidence. The anomalies are saved after every
+// pass and listed by GET /api/v1/anomalies.
+//
+// The GCA clears an anomaly with a signed dismissal that names the device, the
+// kind and the start of the run. A dismissed anomaly stays dismissed when the
+// run continues. Dismissals are persisted, recorded in the audit log, and
+// forwarded to all of the other GCA servers, the same way that overrides are.
+// A dismissal for an anomaly that this server has not flagged yet is kept, so
+// that the anomaly is dismissed when it gets flagged. Dismissed anomalies are
+// dropped once their run falls out of the reporting window, the others are
+// kept until they are dismissed.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// The kinds of anomalies that get detected.
+const (
+	anomalyNightOutput    = "night_output"
+	anomalyConstantOutput = "constant_output"
+	anomalyOutputSpike    = "output_spike"
+)
+
+// anomalyKinds is the set of the kinds of anomalies.
+var anomalyKinds = map[string]struct{}{
+	anomalyNightOutput:    {},
+	anomalyConstantOutput: {},
+	anomalyOutputSpike:    {},
+}
+
+// errAnomalyPassMigrated is returned when the reports were migrated during a
+// pass of the anomaly detection, the pass has to start over.
+var errAnomalyPassMigrated = errors.New("the reports were migrated during the anomaly detection")
+
+// anomalyThresholds are the settings of the anomaly detection, see reload.go.
+type anomalyThresholds struct {
+	checkTimeslots    uint32  // The number of timeslots between two passes
+	nightTimeslots    uint32  // The shortest run of production at night that gets flagged
+	constantTimeslots uint32  // The shortest run of identical production that gets flagged
+	spikeFactor       float64 // How many times the percentile an output must exceed to be flagged
+	spikePercentile   float64 // The percentile of the production of the week before
+}
+
+// Anomaly is a run of timeslots in which the reports of a device followed an
+// implausible pattern.
+type Anomaly struct {
+	ShortID       uint32
+	PublicKey     glow.PublicKey
+	Kind          string // One of "night_output", "constant_output", or "output_spike"
+	StartTimeslot uint32
+	EndTimeslot   uint32   // The last timeslot of the run
+	PowerOutputs  []uint64 // The evidence, every power output from StartTimeslot to EndTimeslot
+	Reference     uint64   // For an output_spike, the percentile of the week before the run
+	DetectedAt    int64    // Unix time at which the anomaly was first flagged
+	Dismissed     bool     // Set if the GCA dismissed the anomaly, only filled in by the handler
+}
+
+// anomalyKey identifies an anomaly, and the dismissal that clears it.
+type anomalyKey struct {
+	ShortID       uint32
+	Kind          string
+	StartTimeslot uint32
+}
+
+// AnomalyDismissal is the decision of the GCA that an anomaly is not a
+// problem.
+type AnomalyDismissal struct {
+	PublicKey     glow.PublicKey // The device of the anomaly
+	Kind          string
+	StartTimeslot uint32
+	Signature     glow.Signature
+}
+
+// SigningBytes returns the bytes that the GCA signs to authorize the
+// dismissal.
+func (ad AnomalyDismissal) SigningBytes() []byte {
+	return glow.SerializeAnomalyDismissalForSigning(ad.PublicKey, ad.Kind, ad.StartTimeslot)
+}
+
+// Serialize returns the compact binary representation of the dismissal.
+func (ad AnomalyDismissal) Serialize() []byte {
+	b := make([]byte, 0, 32+1+len(ad.Kind)+4+64)
+	b = append(b, ad.PublicKey[:]...)
+	b = append(b, byte(len(ad.Kind)))
+	b = append(b, ad.Kind...)
+	b = binary.LittleEndian.AppendUint32(b, ad.StartTimeslot)
+	return append(b, ad.Signature[:]...)
+}
+
+// DeserializeAnomalyDismissal reverses a call to Serialize. It returns the
+// number of bytes that were consumed, as the size of a serialized dismissal
+// depends on the length of its kind.
+func DeserializeAnomalyDismissal(b []byte) (AnomalyDismissal, int, error) {
+	var ad AnomalyDismissal
+	if len(b) < 33 {
+		return ad, 0, fmt.Errorf("anomaly dismissal is too short")
+	}
+	copy(ad.PublicKey[:], b[:32])
+	kindLen := int(b[32])
+	n := 33 + kindLen + 4 + 64
+	if len(b) < n {
+		return ad, 0, fmt.Errorf("anomaly dismissal is too short")
+	}
+	ad.Kind = string(b[33 : 33+kindLen])
+	i := 33 + kindLen
+	ad.StartTimeslot = binary.LittleEndian.Uint32(b[i:])
+	copy(ad.Signature[:], b[i+4:n])
+	return ad, n, nil
+}
+
+// isProduction returns whether a power output is a report of production, as
+// opposed to a missing report, a banned timeslot or an underflowed negative
+// output.
+func isProduction(output uint64) bool {
+	return output > 1 && output < math.MaxInt64
+}
+
+// solarElevation returns the elevation of the sun in degrees above the
+// horizon at the provided location and unix time. It uses the low precision
+// formulas of the Astronomical Almanac, which are a lot more accurate than a
+// night check needs.
+func solarElevation(latitude, longitude float64, unix int64) float64 {
+	rad := math.Pi / 180
+	d := float64(unix)/86400 - 10957.5 // Days since J2000
+	g := (357.529 + 0.98560028*d) * rad
+	q := 280.459 + 0.98564736*d
+	l := (q + 1.915*math.Sin(g) + 0.020*math.Sin(2*g)) * rad
+	e := (23.439 - 0.00000036*d) * rad
+	ra := math.Atan2(math.Cos(e)*math.Sin(l), math.Cos(l))
+	dec := math.Asin(math.Sin(e) * math.Sin(l))
+	gmst := math.Mod(18.697374558+24.06570982441908*d, 24)
+	h := (gmst*15+longitude)*rad - ra
+	lat := latitude * rad
+	return math.Asin(math.Sin(lat)*math.Sin(dec)+math.Cos(lat)*math.Cos(dec)*math.Cos(h)) / rad
+}
+
+// percentile returns the value below which the provided percentage of the
+// values fall, using the nearest rank. The values get sorted.
+func percentile(values []uint64, p float64) uint64 {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(values))))
+	if rank < 1 {
+		rank = 1
+	}
+	return values[rank-1]
+}
+
+// anomalyDevice is the copy of a device that the detection works on.
+type anomalyDevice struct {
+	shortID   uint32
+	publicKey glow.PublicKey
+	latitude  float64
+	longitude float64
+	outputs   [4032]uint64 // The power outputs with the overrides of the GCA applied
+}
+
+// newAnomaly returns the anomaly for the run of the outputs from index start
+// to index end, inclusive.
+func (dev *anomalyDevice) newAnomaly(kind string, offset uint32, start, end int) Anomaly {
+	return Anomaly{
+		ShortID:       dev.shortID,
+		PublicKey:     dev.publicKey,
+		Kind:          kind,
+		StartTimeslot: offset + uint32(start),
+		EndTimeslot:   offset + uint32(end),
+		PowerOutputs:  append([]uint64(nil), dev.outputs[start:end+1]...),
+	}
+}
+
+// detectAnomalies returns the anomalies of a device, where the outputs start
+// at the provided offset and only the timeslots before now are complete.
+func detectAnomalies(dev *anomalyDevice, offset uint32, now uint32, at anomalyThresholds) []Anomaly {
+	n := 0
+	if now > offset {
+		n = int(now - offset)
+	}
+	if n > len(dev.outputs) {
+		n = len(dev.outputs)
+	}
+	outputs := dev.outputs[:n]
+	var anomalies []Anomaly
+
+	// Production at night. A location of 0,0 means that the device has
+	// no location.
+	if dev.latitude != 0 || dev.longitude != 0 {
+		start := -1
+		for i := 0; i <= n; i++ {
+			night := i < n && isProduction(outputs[i]) && solarElevation(dev.latitude, dev.longitude, glow.TimeslotToUnix(offset+uint32(i))+150) < anomalyNightSunElevation
+			if night && start < 0 {
+				start = i
+			} else if !night && start >= 0 {
+				if uint32(i-start) >= at.nightTimeslots {
+					anomalies = append(anomalies, dev.newAnomaly(anomalyNightOutput, offset, start, i-1))
+				}
+				start = -1
+			}
+		}
+	}
+
+	// The same production for many timeslots in a row.
+	for i := 0; i < n; {
+		j := i + 1
+		for j < n && outputs[j] == outputs[i] {
+			j++
+		}
+		if isProduction(outputs[i]) && uint32(j-i) >= at.constantTimeslots {
+			anomalies = append(anomalies, dev.newAnomaly(anomalyConstantOutput, offset, i, j-1))
+		}
+		i = j
+	}
+
+	// Production far above the percentile of the week before. The
+	// percentile changes at the start of every day.
+	var reference, runReference uint64
+	var history []uint64
+	start := -1
+	for i := 0; i <= n; i++ {
+		if i < n && (i == 0 || (offset+uint32(i))%288 == 0) {
+			history = history[:0]
+			for j := i - anomalySpikeHistory; j < i; j++ {
+				if j >= 0 && isProduction(outputs[j]) {
+					history = append(history, outputs[j])
+				}
+			}
+			reference = 0
+			if len(history) >= anomalySpikeMinSamples {
+				reference = percentile(history, at.spikePercentile)
+			}
+		}
+		spike := i < n && reference > 0 && isProduction(outputs[i]) && float64(outputs[i]) > at.spikeFactor*float64(reference)
+		if spike && start < 0 {
+			start, runReference = i, reference
+		} else if !spike && start >= 0 {
+			a := dev.newAnomaly(anomalyOutputSpike, offset, start, i-1)
+			a.Reference = runReference
+			anomalies = append(anomalies, a)
+			start = -1
+		}
+	}
+	return anomalies
+}
+
+// managedDetectAnomalies runs a pass of the anomaly detection over the
+// reports in memory, and returns the number of anomalies that were flagged
+// for the first time.
+func (gcas *GCAServer) managedDetectAnomalies() (int, error) {
+	gcas.mu.RLock()
+	at := gcas.anomalyThresholds
+	offset := gcas.equipmentReportsOffset
+	shortIDs := gcas.sortedReportShortIDs()
+	gcas.mu.RUnlock()
+	now := gcas.currentTimeslot()
+
+	// Copy a chunk of devices at a time, and analyze the copy without
+	// holding the mutex.
+	var detected []Anomaly
+	chunk := make([]anomalyDevice, statsSnapshotChunk)
+	for i := 0; i < len(shortIDs); i += statsSnapshotChunk {
+		n := 0
+		gcas.mu.RLock()
+		if gcas.equipmentReportsOffset != offset {
+			gcas.mu.RUnlock()
+			return 0, errAnomalyPassMigrated
+		}
+		for _, shortID := range shortIDs[i:min(i+statsSnapshotChunk, len(shortIDs))] {
+			reports, exists := gcas.equipmentReports[shortID]
+			if !exists {
+				continue
+			}
+			ea := gcas.equipment[shortID]
+			dev := &chunk[n]
+			dev.shortID, dev.publicKey = shortID, ea.PublicKey
+			dev.latitude, dev.longitude = ea.Latitude, ea.Longitude
+			dev.outputs = reports.PowerOutputs
+			gcas.applyReportOverrides(shortID, offset, dev.outputs[:])
+			n++
+		}
+		gcas.mu.RUnlock()
+		for j := range chunk[:n] {
+			detected = append(detected, detectAnomalies(&chunk[j], offset, now, at)...)
+		}
+	}
+
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	changed, flagged := false, 0
+	detectedAt := gcas.now().Unix()
+	for _, a := range detected {
+		isNew, updated := gcas.mergeAnomaly(a, detectedAt)
+		if isNew {
+			flagged++
+		}
+		changed = changed || updated
+	}
+	if !changed {
+		return 0, nil
+	}
+	if err := gcas.saveAnomalies(); err != nil {
+		return flagged, err
+	}
+	return flagged, nil
+}
+
+// mergeAnomaly adds a detected anomaly to the anomalies of its device. If the
+// device already has an anomaly of the same kind that overlaps or touches the
+// detected one, that anomaly gets extended instead, keeping its start so that
+// its dismissal still applies. It returns whether the anomaly is new, and
+// whether anything changed. The mutex must be held.
+func (gcas *GCAServer) mergeAnomaly(a Anomaly, detectedAt int64) (bool, bool) {
+	anomalies := gcas.anomalies[a.ShortID]
+	for i := range anomalies {
+		ex := &anomalies[i]
+		if ex.Kind != a.Kind || ex.StartTimeslot > a.EndTimeslot || ex.EndTimeslot+1 < a.StartTimeslot {
+			continue
+		}
+		end := max(ex.EndTimeslot, a.EndTimeslot)
+		outputs := make([]uint64, end-ex.StartTimeslot+1)
+		for j := range outputs {
+			ts := ex.StartTimeslot + uint32(j)
+			if ts >= a.StartTimeslot && ts <= a.EndTimeslot {
+				outputs[j] = a.PowerOutputs[ts-a.StartTimeslot]
+			} else {
+				outputs[j] = ex.PowerOutputs[j]
+			}
+		}
+		changed := !slices.Equal(outputs, ex.PowerOutputs)
+		ex.EndTimeslot, ex.PowerOutputs = end, outputs
+		return false, changed
+	}
+	a.DetectedAt = detectedAt
+	gcas.anomalies[a.ShortID] = append(anomalies, a)
+	return true, true
+}
+
+// isDismissed returns whether the GCA dismissed an anomaly. The mutex must be
+// held.
+func (gcas *GCAServer) isDismissed(a Anomaly) bool {
+	_, dismissed := gcas.anomalyDismissals[anomalyKey{ShortID: a.ShortID, Kind: a.Kind, StartTimeslot: a.StartTimeslot}]
+	return dismissed
+}
+
+// saveAnomalies writes the anomalies to disk. The mutex must be held.
+func (gcas *GCAServer) saveAnomalies() error {
+	anomalies := make([]Anomaly, 0)
+	for _, deviceAnomalies := range gcas.anomalies {
+		anomalies = append(anomalies, deviceAnomalies...)
+	}
+	sortAnomalies(anomalies)
+	data, err := json.Marshal(anomalies)
+	if err != nil {
+		return fmt.Errorf("unable to encode anomalies: %v", err)
+	}
+	if err := gcas.staticStorage.WriteFile(AnomaliesFile, data, 0644); err != nil {
+		return fmt.Errorf("unable to save anomalies: %v", err)
+	}
+	return nil
+}
+
+// sortAnomalies sorts anomalies by ShortID, then by start, then by kind.
+func sortAnomalies(anomalies []Anomaly) {
+	sort.Slice(anomalies, func(i, j int) bool {
+		if anomalies[i].ShortID != anomalies[j].ShortID {
+			return anomalies[i].ShortID < anomalies[j].ShortID
+		}
+		if anomalies[i].StartTimeslot != anomalies[j].StartTimeslot {
+			return anomalies[i].StartTimeslot < anomalies[j].StartTimeslot
+		}
+		return anomalies[i].Kind < anomalies[j].Kind
+	})
+}
+
+// threadedDetectAnomalies runs a pass of the anomaly detection every
+// anomaly_check_timeslots, until the server shuts down. The setting can be
+// changed by Reload, so it is read again on every check.
+func (gcas *GCAServer) threadedDetectAnomalies() {
+	var last uint32
+	ran := false
+	for {
+		if !gcas.sleep(anomalyCheckFrequency) {
+			return
+		}
+		gcas.mu.RLock()
+		every := gcas.anomalyThresholds.checkTimeslots
+		gcas.mu.RUnlock()
+		now := gcas.currentTimeslot()
+		if ran && now < last+every {
+			continue
+		}
+		flagged, err := gcas.managedDetectAnomalies()
+		if err != nil {
+			gcas.logger.Warnf("anomaly detection failed: %v", err)
+			continue
+		}
+		if flagged > 0 {
+			gcas.logger.WithFields("anomalies", flagged).Info("flagged new anomalies")
+		}
+		last, ran = now, true
+	}
+}
+
+// AnomaliesHandler lists the anomalies that have not been dismissed,
+// optionally filtered to a single device with the 'short_id' query parameter.
+// With 'dismissed=true', the dismissed anomalies are listed as well.
+func (gcas *GCAServer) AnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for anomalies.")
+		return
+	}
+	var filter *uint32
+	if sidStr := r.URL.Query().Get("short_id"); sidStr != "" {
+		sid, err := strconv.ParseUint(sidStr, 10, 32)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid short_id")
+			return
+		}
+		shortID := uint32(sid)
+		filter = &shortID
+	}
+	withDismissed := r.URL.Query().Get("dismissed") == "true"
+
+	anomalies := []Anomaly{}
+	gcas.mu.RLock()
+	for shortID, deviceAnomalies := range gcas.anomalies {
+		if filter != nil && shortID != *filter {
+			continue
+		}
+		for _, a := range deviceAnomalies {
+			a.Dismissed = gcas.isDismissed(a)
+			if !a.Dismissed || withDismissed {
+				anomalies = append(anomalies, a)
+			}
+		}
+	}
+	gcas.mu.RUnlock()
+	sortAnomalies(anomalies)
+	gcas.writeJSONResponse(w, r, anomalies)
+}
+
+// DismissAnomalyHandler accepts a dismissal of an anomaly from the GCA.
+func (gcas *GCAServer) DismissAnomalyHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for anomaly dismissal.")
+		return
+	}
+
+	var request AnomalyDismissal
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+	isNew, err := gcas.managedDismissAnomaly(request)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to dismiss anomaly:", err))
+		gcas.requestLogger(r).WithFields("pubkey", request.PublicKey, "kind", request.Kind, "start", request.StartTimeslot).Warn("Failed to dismiss anomaly: ", err)
+		return
+	}
+
+	// Forward the dismissal to the other servers, which will have
+	// flagged the same anomaly. Only new dismissals get forwarded, which
+	// prevents the servers from endlessly passing the same request
+	// around.
+	if isNew {
+		gcas.gcaServers.mu.Lock()
+		ass := make([]AuthorizedServer, len(gcas.gcaServers.servers))
+		copy(ass, gcas.gcaServers.servers)
+		gcas.gcaServers.mu.Unlock()
+		jsonBody, _ := json.Marshal(request)
+		for _, as := range ass {
+			resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/anomalies/dismiss", jsonBody)
+			if err != nil {
+				gcas.requestLogger(r).WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to forward anomaly dismissal")
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	gcas.requestLogger(r).WithFields("pubkey", request.PublicKey, "kind", request.Kind, "start", request.StartTimeslot).Info("Successfully dismissed anomaly.")
+}
+
+// managedDismissAnomaly verifies and saves a dismissal. The bool indicates
+// whether the dismissal is new to this server.
+func (gcas *GCAServer) managedDismissAnomaly(ad AnomalyDismissal) (bool, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return false, errNotInitialized
+	}
+	if _, exists := anomalyKinds[ad.Kind]; !exists {
+		return false, withCode(ErrCodeMalformedRequest, fmt.Errorf("unknown anomaly kind %q", ad.Kind))
+	}
+	if !gcas.verifyGCASignature(ad.SigningBytes(), ad.Signature) {
+		return false, withCode(ErrCodeInvalidSignature, errors.New("invalid signature on anomaly dismissal"))
+	}
+	shortID, exists := gcas.equipmentShortID[ad.PublicKey]
+	if !exists {
+		return false, withCode(ErrCodeUnknownDevice, errors.New("equipment not found"))
+	}
+	key := anomalyKey{ShortID: shortID, Kind: ad.Kind, StartTimeslot: ad.StartTimeslot}
+	if _, exists := gcas.anomalyDismissals[key]; exists {
+		return false, nil
+	}
+
+	// Record and persist the dismissal before applying it.
+	err := gcas.recordAudit(auditRecord{
+		action:     glow.AuditAnomalyDismissal,
+		request:    ad.Serialize(),
+		signatures: []glow.AuditSignature{gcas.gcaAuditSignature(ad.SigningBytes(), ad.Signature)},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := gcas.staticStorage.AppendFile(AnomalyDismissalsFile, ad.Serialize(), 0644); err != nil {
+		return false, fmt.Errorf("unable to save anomaly dismissal: %v", err)
+	}
+	gcas.anomalyDismissals[key] = ad
+	return true, nil
+}
+
+// loadAnomalies loads the anomalies and the dismissals from disk, creating
+// the dismissals file if it does not exist yet. This needs to happen after
+// the equipment is loaded.
+func (gcas *GCAServer) loadAnomalies() error {
+	data, err := gcas.staticStorage.ReadFile(AnomaliesFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read anomalies file: %v", err)
+	}
+	if err == nil {
+		var anomalies []Anomaly
+		if err := json.Unmarshal(data, &anomalies); err != nil {
+			return fmt.Errorf("unable to parse anomalies file: %v", err)
+		}
+		for _, a := range anomalies {
+			gcas.anomalies[a.ShortID] = append(gcas.anomalies[a.ShortID], a)
+		}
+	}
+
+	data, err = gcas.staticStorage.ReadFile(AnomalyDismissalsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(AnomalyDismissalsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read anomaly dismissals file: %v", err)
+	}
+	for i := 0; len(data) > 0; i++ {
+		ad, n, err := DeserializeAnomalyDismissal(data)
+		if err != nil {
+			return fmt.Errorf("%v: record %v: %v", AnomalyDismissalsFile, i, err)
+		}
+		if !gcas.verifyPersistedGCASignature(ad.SigningBytes(), ad.Signature) {
+			return fmt.Errorf("%v: record %v: invalid signature on anomaly dismissal", AnomalyDismissalsFile, i)
+		}
+		shortID, exists := gcas.equipmentShortID[ad.PublicKey]
+		if !exists {
+			return fmt.Errorf("%v: record %v: dismissal for unknown equipment", AnomalyDismissalsFile, i)
+		}
+		gcas.anomalyDismissals[anomalyKey{ShortID: shortID, Kind: ad.Kind, StartTimeslot: ad.StartTimeslot}] = ad
+		data = data[n:]
+	}
+	return nil
+}
+
+// pruneAnomalies drops the dismissed anomalies that ended before the reports
+// in memory, and the dismissals that can no longer match an anomaly. The
+// mutex must be held.
+func (gcas *GCAServer) pruneAnomalies() {
+	pruned := false
+	for shortID, anomalies := range gcas.anomalies {
+		kept := anomalies[:0]
+		for _, a := range anomalies {
+			if a.EndTimeslot < gcas.equipmentReportsOffset && gcas.isDismissed(a) {
+				pruned = true
+				continue
+			}
+			kept = append(kept, a)
+		}
+		if len(kept) == 0 {
+			delete(gcas.anomalies, shortID)
+		} else {
+			gcas.anomalies[shortID] = kept
+		}
+	}
+	for key := range gcas.anomalyDismissals {
+		if key.StartTimeslot >= gcas.equipmentReportsOffset {
+			continue
+		}
+		matched := false
+		for _, a := range gcas.anomalies[key.ShortID] {
+			matched = matched || (a.Kind == key.Kind && a.StartTimeslot == key.StartTimeslot)
+		}
+		if !matched {
+			delete(gcas.anomalyDismissals, key)
+		}
+	}
+	if pruned {
+		if err := gcas.saveAnomalies(); err != nil {
+			gcas.logger.Errorf("unable to save anomalies: %v", err)
+		}
+	}
+}
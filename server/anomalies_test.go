@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// testAnomalyThresholds are the default thresholds of the anomaly detection.
+var testAnomalyThresholds = anomalyThresholds{
+	checkTimeslots:    defaultAnomalyCheckTimeslots,
+	nightTimeslots:    defaultAnomalyNightTimeslots,
+	constantTimeslots: defaultAnomalyConstantTimeslots,
+	spikeFactor:       defaultAnomalySpikeFactor,
+	spikePercentile:   defaultAnomalySpikePercentile,
+}
+
+// TestDetectAnomalies feeds a device with a plausible curve and three
+// implausible patterns to the detection, and checks that exactly the three
+// patterns get flagged.
+func TestDetectAnomalies(t *testing.T) {
+	dev := &anomalyDevice{shortID: 3, latitude: 40.7, longitude: -74}
+	elevation := func(i int) float64 {
+		return solarElevation(dev.latitude, dev.longitude, glow.TimeslotToUnix(uint32(i))+150)
+	}
+	for i := range dev.outputs {
+		if elevation(i) > 0 {
+			dev.outputs[i] = 1000 + uint64(i%50)
+		}
+	}
+
+	// Find a stretch of night for the night output, a stretch of daylight
+	// for the constant output, and a timeslot in the second week for the
+	// spike.
+	find := func(from, length int, day bool) int {
+		for i := from; i+length < len(dev.outputs); i++ {
+			matched := true
+			for j := i; j < i+length && matched; j++ {
+				matched = (elevation(j) > 0) == day && (day || elevation(j) < anomalyNightSunElevation-1)
+			}
+			if matched {
+				return i
+			}
+		}
+		t.Fatal("no stretch found")
+		return 0
+	}
+	night := find(300, 4, false)
+	for i := night; i < night+4; i++ {
+		dev.outputs[i] = 100
+	}
+	constant := find(300, 40, true)
+	for i := constant; i < constant+40; i++ {
+		dev.outputs[i] = 777
+	}
+	spike := find(2016+300, 1, true)
+	dev.outputs[spike] = 10000
+
+	anomalies := detectAnomalies(dev, 0, 4032, testAnomalyThresholds)
+	found := make(map[string]Anomaly)
+	for _, a := range anomalies {
+		if _, exists := found[a.Kind]; exists {
+			t.Fatalf("more than one %v anomaly: %+v", a.Kind, anomalies)
+		}
+		found[a.Kind] = a
+	}
+	if a := found[anomalyNightOutput]; a.StartTimeslot != uint32(night) || a.EndTimeslot != uint32(night+3) || len(a.PowerOutputs) != 4 || a.PowerOutputs[0] != 100 {
+		t.Fatalf("unexpected night anomaly: %+v", a)
+	}
+	if a := found[anomalyConstantOutput]; a.StartTimeslot != uint32(constant) || a.EndTimeslot != uint32(constant+39) {
+		t.Fatalf("unexpected constant anomaly: %+v", a)
+	}
+	if a := found[anomalyOutputSpike]; a.StartTimeslot != uint32(spike) || a.EndTimeslot != uint32(spike) || a.Reference < 1000 || a.Reference >= 1050 {
+		t.Fatalf("unexpected spike anomaly: %+v", a)
+	}
+
+	// A device without a location is never flagged for night output, and
+	// the timeslots from now on are not looked at.
+	dev.latitude, dev.longitude = 0, 0
+	for _, a := range detectAnomalies(dev, 0, uint32(spike), testAnomalyThresholds) {
+		if a.Kind == anomalyNightOutput || a.Kind == anomalyOutputSpike {
+			t.Fatalf("unexpected anomaly: %+v", a)
+		}
+	}
+}
+
+// postAnomalyDismissal submits a dismissal signed with the provided key, and
+// returns the status of the response.
+func (gcas *GCAServer) postAnomalyDismissal(ad AnomalyDismissal, gcaPrivKey glow.PrivateKey) (int, error) {
+	ad.Signature = glow.Sign(ad.SigningBytes(), gcaPrivKey)
+	body, err := json.Marshal(ad)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.Post("http://"+gcas.httpDialAddr()+"/api/v1/anomalies/dismiss", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// getAnomalies fetches the anomalies from the server.
+func (gcas *GCAServer) getAnomalies(t *testing.T, query string) []Anomaly {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/anomalies?%v", gcas.httpDialAddr(), query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var anomalies []Anomaly
+	if err := json.NewDecoder(resp.Body).Decode(&anomalies); err != nil {
+		t.Fatal(err)
+	}
+	return anomalies
+}
+
+// TestAnomalies checks that a device with constant output gets flagged, that
+// the anomaly is extended as the run continues, and that a dismissal of the
+// GCA clears the anomaly for good, also across a restart.
+func TestAnomalies(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(60)
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(4, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(0); i < 40; i++ {
+		server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, i, ePriv))
+	}
+	if _, err := server.managedDetectAnomalies(); err != nil {
+		t.Fatal(err)
+	}
+	anomalies := server.getAnomalies(t, "short_id=4")
+	if len(anomalies) != 1 || anomalies[0].Kind != anomalyConstantOutput || anomalies[0].StartTimeslot != 0 || anomalies[0].EndTimeslot != 39 || len(anomalies[0].PowerOutputs) != 40 || anomalies[0].PublicKey != ea.PublicKey {
+		t.Fatalf("unexpected anomalies: %+v", anomalies)
+	}
+	if anomalies := server.getAnomalies(t, "short_id=5"); len(anomalies) != 0 {
+		t.Fatal("the filter was ignored")
+	}
+
+	// The dismissal needs the signature of the GCA and a known kind.
+	ad := AnomalyDismissal{PublicKey: ea.PublicKey, Kind: anomalyConstantOutput, StartTimeslot: 0}
+	_, otherPriv := glow.GenerateKeyPair()
+	if status, err := server.postAnomalyDismissal(ad, otherPriv); err != nil || status != http.StatusForbidden {
+		t.Fatal("dismissal with a bad signature was accepted:", status, err)
+	}
+	unknown := ad
+	unknown.Kind = "vibes"
+	if status, err := server.postAnomalyDismissal(unknown, gcaPrivKey); err != nil || status != http.StatusBadRequest {
+		t.Fatal("dismissal of an unknown kind was accepted:", status, err)
+	}
+	if status, err := server.postAnomalyDismissal(ad, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("dismissal failed:", status, err)
+	}
+	ad.Signature = glow.Sign(ad.SigningBytes(), gcaPrivKey)
+	server.auditLog.mu.Lock()
+	last := server.auditLog.entries[len(server.auditLog.entries)-1]
+	server.auditLog.mu.Unlock()
+	if last.Action != glow.AuditAnomalyDismissal || !bytes.Equal(last.Request, ad.Serialize()) {
+		t.Fatalf("unexpected audit entry: %+v", last)
+	}
+
+	// The run continues, which extends the anomaly without undoing the
+	// dismissal.
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 40, ePriv))
+	if flagged, err := server.managedDetectAnomalies(); err != nil || flagged != 0 {
+		t.Fatal("the continued run was flagged again:", flagged, err)
+	}
+	checkDismissed := func(server *GCAServer) {
+		t.Helper()
+		if anomalies := server.getAnomalies(t, ""); len(anomalies) != 0 {
+			t.Fatalf("dismissed anomaly is still listed: %+v", anomalies)
+		}
+		anomalies := server.getAnomalies(t, "dismissed=true")
+		if len(anomalies) != 1 || !anomalies[0].Dismissed || anomalies[0].EndTimeslot != 40 || len(anomalies[0].PowerOutputs) != 41 {
+			t.Fatalf("unexpected dismissed anomalies: %+v", anomalies)
+		}
+	}
+	checkDismissed(server)
+
+	// The anomalies and the dismissal survive a restart.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	checkDismissed(server)
+}
+
+// TestAnomalyDismissalSerialization checks that a dismissal survives the
+// round trip through its binary representation.
+func TestAnomalyDismissalSerialization(t *testing.T) {
+	pub, priv := glow.GenerateKeyPair()
+	ad := AnomalyDismissal{PublicKey: pub, Kind: anomalyOutputSpike, StartTimeslot: 4033}
+	ad.Signature = glow.Sign(ad.SigningBytes(), priv)
+	b := ad.Serialize()
+	decoded, n, err := DeserializeAnomalyDismissal(append(b, 1, 2, 3))
+	if err != nil || n != len(b) || decoded != ad {
+		t.Fatal("dismissal changed in the round trip:", err, n, decoded)
+	}
+	for i := 0; i < len(b); i++ {
+		if _, _, err := DeserializeAnomalyDismissal(b[:i]); err == nil {
+			t.Fatal("truncated dismissal was accepted at length", i)
+		}
+	}
+}
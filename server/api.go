@@ -1,26 +1,273 @@
 package server
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
+
+	"github.com/glowlabs-org/gca-backend/glow"
 )
 
 // launchAPI sets up the HTTP API endpoints and starts the HTTP server.
 // This function initializes the API routes and starts the HTTP server.
 func (gcas *GCAServer) launchAPI() {
+	// The parameters and responses that many of the routes share.
+	pubkey := queryParam("pubkey", "The hex encoded public key of the device")
+	shortID := queryParam("short_id", "The ShortID of the device")
+	start := queryParam("start", "The first timeslot of the range")
+	end := queryParam("end", "The timeslot after the range")
+	period := queryParam("period", "A timeslot in the week to return, the current week by default")
+	latitude := requiredParam("latitude", "The latitude of the location")
+	longitude := requiredParam("longitude", "The longitude of the location")
+	allDevices := queryParam("all", "Set to true to return every device")
+	statsParams := []RouteParam{
+		queryParam("timeslot_offset", "The first timeslot of the week to return"),
+		period,
+		queryParam("cursor", "The cursor from the previous page"),
+		queryParam("limit", "The number of devices per page"),
+		queryParam("offset", "The index of the first device of the page"),
+		pubkey,
+		shortID,
+		queryParam("since_timeslot", "Only return the devices that changed since the timeslot"),
+		queryParam("insert_false_negatives", "Set to true to test the handling of missing reports"),
+	}
+	status := map[string]string{}
+
 	// Attach all of the handlers to the mux.
-	gcas.mux.HandleFunc("/api/v1/all-device-stats", gcas.AllDeviceStatsHandler)
-	gcas.mux.HandleFunc("/api/v1/authorized-servers", gcas.AuthorizedServersHandler)
-	gcas.mux.HandleFunc("/api/v1/authorize-equipment", gcas.AuthorizeEquipmentHandler)
-	gcas.mux.HandleFunc("/api/v1/equipment", gcas.EquipmentHandler)
-	gcas.mux.HandleFunc("/api/v1/equipment-migrate", gcas.EquipmentMigrateHandler)
-	gcas.mux.HandleFunc("/api/v1/register-gca", gcas.RegisterGCAHandler)
-	gcas.mux.HandleFunc("/api/v1/recent-reports", gcas.RecentReportsHandler)
-	gcas.mux.HandleFunc("/api/v1/geo-stats", gcas.GeoStatsHandler)
-	gcas.mux.HandleFunc("/api/v1/archive", gcas.ArchiveHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/admin/backup", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Download a backup of the server directory", Request: BackupRequest{}, ResponseType: "application/gzip"},
+	}}, gcas.allowScope(ScopeTriggerBackup, gcas.BackupHandler))
+	gcas.handleRoute(Route{Path: "/api/v1/admin/trim", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Trim the history of the server", Request: TrimRequest{}, Response: TrimResult{}, Signed: true},
+	}}, gcas.requireScope(ScopeTrimHistory, gcas.TrimHandler))
+	gcas.handleRoute(Route{Path: "/api/v1/admin/webhooks", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the webhook configuration", Response: webhookConfig{}, Signed: true},
+		{Method: http.MethodPost, Summary: "Replace the webhook configuration", Request: webhookConfig{}, Response: ReloadResult{}, Signed: true},
+	}}, gcas.requireScope(ScopeManageWebhooks, gcas.WebhooksHandler))
+	gcas.handleRoute(Route{Path: "/api/v1/all-device-stats", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the stats of every device for a week", Params: statsParams, Response: AllDeviceStats{}, Signed: true, Binary: true},
+	}}, gcas.AllDeviceStatsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/anomalies", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the anomalies in the output of the devices", Params: []RouteParam{queryParam("dismissed", "Set to true to include the dismissed anomalies"), shortID}, Response: []Anomaly{}, Signed: true},
+	}}, gcas.AnomaliesHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/anomalies/dismiss", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Dismiss an anomaly", Request: AnomalyDismissal{}, Response: status},
+	}}, gcas.DismissAnomalyHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/audit-log", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Page through the audit log", Params: []RouteParam{queryParam("limit", "The number of entries per page"), queryParam("offset", "The index of the first entry of the page")}, Response: AuditLogResponse{}, Signed: true},
+	}}, gcas.requireScope(ScopeReadAudit, gcas.AuditLogHandler))
+	gcas.handleRoute(Route{Path: "/api/v1/authorized-servers", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the servers that the GCA authorized", Response: AuthorizedServersResponse{}},
+		{Method: http.MethodPost, Summary: "Add a server that the GCA authorized", Request: AuthorizedServer{}, Response: status},
+	}}, gcas.AuthorizedServersHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/authorize-equipment", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Authorize a device", Request: glow.EquipmentAuthorization{}, Response: status},
+	}}, gcas.AuthorizeEquipmentHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/authorize-equipment/batch", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Authorize many devices at once", Request: []glow.EquipmentAuthorization{}, Response: BatchAuthorizationResponse{}},
+	}}, gcas.BatchAuthorizeEquipmentHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/banned-equipment", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the banned devices", Params: []RouteParam{pubkey}, Response: []BannedEquipment{}, Signed: true},
+	}}, gcas.BannedEquipmentHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/deauthorize-equipment", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Deauthorize a device", Request: EquipmentDeauthorization{}, Response: status},
+	}}, gcas.DeauthorizeEquipmentHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/equipment-region", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Set the grid region of a device", Request: EquipmentRegion{}, Response: status},
+	}}, gcas.EquipmentRegionHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/device-impact", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the carbon impact of a device", Params: []RouteParam{pubkey, start, end, queryParam("detailed", "Set to true to include every timeslot")}, Response: DeviceImpact{}, Signed: true},
+	}}, gcas.DeviceImpactHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/device-note", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Attach a note to a device", Request: DeviceNote{}, Response: status},
+	}}, gcas.DeviceNoteHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/device-notes", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the notes of a device", Params: []RouteParam{pubkey}, Response: []DeviceNote{}, Signed: true},
+	}}, gcas.DeviceNotesHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/device-summary", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the summary of a device", Params: []RouteParam{pubkey, shortID}, Response: DeviceSummary{}, Signed: true},
+	}}, gcas.DeviceSummaryHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/equipment", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the authorized devices", Response: EquipmentResponse{}},
+	}}, gcas.EquipmentHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/equipment-bans", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the proofs that got devices banned", Response: []EquivocationProof{}, Signed: true},
+		{Method: http.MethodPost, Summary: "Ban a device with a proof of equivocation", Request: EquivocationProof{}, Response: status},
+	}}, gcas.EquipmentBansHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/equipment-migrate", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Migrate a device to another GCA", Request: EquipmentMigration{}, Response: status},
+	}}, gcas.EquipmentMigrateHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/equipment-report", Feature: FeatureHTTPReports, Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Submit a report packet", RequestType: "application/octet-stream", ResponseType: "application/octet-stream"},
+	}}, gcas.EquipmentReportHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/equipment-reports/batch", Feature: FeatureBatchReports, Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Submit many reports at once", Request: []glow.EquipmentReport{}, Response: BatchReportsResponse{}},
+	}}, gcas.BatchReportsHandler)
+	gcas.handleRoute(Route{Path: validateReportPath, Feature: FeatureReportValidation, Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Check a report packet without storing it", RequestType: "application/octet-stream", Response: ReportValidation{}, Signed: true},
+	}}, gcas.ValidateReportHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/equipment-reports.csv", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Download the reports of a device as CSV", Params: []RouteParam{pubkey, start, end}, ResponseType: "text/csv"},
+	}}, gcas.EquipmentReportsCSVHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/device-export", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Download the full history of a device", Params: []RouteParam{pubkey}, ResponseType: "application/octet-stream"},
+	}}, gcas.DeviceExportHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/flagged-reports", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the reports that await review", Params: []RouteParam{shortID}, Response: []FlaggedReport{}, Signed: true},
+	}}, gcas.FlaggedReportsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/flagged-reports/review", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Accept or reject a flagged report", Request: FlaggedReportReview{}, Response: status},
+	}}, gcas.allowScope(ScopeResolveFlaggedReports, gcas.ReviewFlaggedReportHandler))
+	gcas.handleRoute(Route{Path: "/api/v1/validation-warnings", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the devices whose reports fail a validation rule in warn mode", Params: []RouteParam{queryParam("rule", "Only return the warnings of the rule")}, Response: ValidationWarningsResponse{}, Signed: true},
+	}}, gcas.ValidationWarningsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/historical-reports", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the reports of a device over a range of timeslots", Params: []RouteParam{pubkey, start, end, queryParam("late_only", "Set to true to only return the reports that arrived late")}, Response: HistoricalReportsResponse{}, Binary: true},
+	}}, gcas.HistoricalReportsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/impact-rates", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the impact rates of the region of a device", Params: []RouteParam{shortID, start, end}, Response: ImpactRatesResponse{}, Signed: true},
+	}}, gcas.ImpactRatesHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/operator-keys", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the operator keys", Response: []OperatorDelegation{}, Signed: true},
+		{Method: http.MethodPost, Summary: "Delegate or revoke an operator key", Request: OperatorDelegation{}, Response: status},
+	}}, gcas.OperatorKeysHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/register-gca", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Register the key of the GCA", Request: GCARegistration{}, Response: GCARegistrationResponse{}},
+	}}, gcas.RegisterGCAHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/register-server", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Add a server that the GCA authorized", Request: AuthorizedServer{}, Response: status},
+	}}, gcas.RegisterServerHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/rotate-gca-key", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Rotate the key of the GCA", Request: GCAKeyRotation{}, Response: status},
+	}}, gcas.GCAKeyRotationHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/rotate-device-key", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Rotate the key of a device", Request: DeviceKeyRotation{}, Response: status},
+	}}, gcas.RotateDeviceKeyHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/gca-key-history", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the keys that the GCA has had", Response: GCAKeyHistoryResponse{}, Signed: true},
+	}}, gcas.GCAKeyHistoryHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/export-equipment", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Release a device to another GCA", Request: EquipmentRelease{}, Response: EquipmentBundle{}, Signed: true},
+	}}, gcas.EquipmentExportHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/import-equipment", Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Import a device that another GCA released", Request: EquipmentImportRequest{}, Response: EquipmentImportResponse{}, Signed: true},
+	}}, gcas.EquipmentImportHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/equipment-imports", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the imported devices", Params: []RouteParam{pubkey}, Response: []EquipmentImportSummary{}, Signed: true},
+	}}, gcas.EquipmentImportsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/peer-status", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the health of the other authorized servers", Response: PeerStatusResponse{}, Signed: true},
+	}}, gcas.PeerStatusHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/period-status", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get whether a week has been finalized", Params: []RouteParam{period}, Response: PeriodStatus{}, Signed: true},
+	}}, gcas.PeriodStatusHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/period-summary", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the summary of a finalized week", Params: []RouteParam{period}, Response: PeriodSummary{}},
+	}}, gcas.PeriodSummaryHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/recent-reports", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the reports of a device for a week", Params: []RouteParam{requiredParam("publicKey", "The hex encoded public key of the device"), period}, Response: RecentReportsResponse{}, Signed: true},
+	}}, gcas.RecentReportsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/report-bitfields", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get which timeslots of the current week have reports", Params: []RouteParam{pubkey}, Response: ReportBitfieldsResponse{}, Signed: true},
+	}}, gcas.ReportBitfieldsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/period-totals", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the output of every device for the current week", Response: []PeriodTotal{}, Signed: true},
+	}}, gcas.PeriodTotalsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/report-gaps", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the timeslots that devices didn't report", Params: []RouteParam{pubkey, shortID, allDevices}, Response: ReportGapsResponse{}, Signed: true},
+	}}, gcas.ReportGapsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/report-overrides", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the report overrides", Params: []RouteParam{pubkey}, Response: []ReportOverride{}, Signed: true},
+		{Method: http.MethodPost, Summary: "Override the report of a device", Request: ReportOverride{}, Response: status},
+	}}, gcas.ReportOverridesHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/report-proof", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Prove that a report is part of a report root", Params: []RouteParam{pubkey, requiredParam("timeslot", "The timeslot of the report")}, Response: ReportProofResponse{}, Signed: true},
+	}}, gcas.ReportProofHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/report-roots", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the report roots", Response: []ReportRootResponse{}, Signed: true},
+	}}, gcas.ReportRootsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/reports/stream", Feature: FeatureReportStream, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Stream the accepted reports over a websocket", Params: []RouteParam{pubkey}},
+	}}, gcas.ReportStreamHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/server-info", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the identity, build and capabilities of the server", Response: ServerInfoResponse{}, Signed: true},
+	}}, gcas.ServerInfoHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/device-bootstrap", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get everything that a new device needs to start reporting", Params: []RouteParam{requiredParam("pubkey", "The hex encoded public key of the device")}, Response: DeviceBootstrapResponse{}, Signed: true},
+	}}, gcas.DeviceBootstrapHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/server-timeline", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the operational timeline of the server", Params: []RouteParam{queryParam("since_timeslot", "Only return the entries since the timeslot")}, Response: ServerTimelineResponse{}, Signed: true},
+	}}, gcas.ServerTimelineHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/stats-delta", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the stats that changed since a version", Params: []RouteParam{queryParam("since_version", "The version of the last delta"), queryParam("boot_id", "The boot of the server that the version belongs to")}, Response: StatsDeltaResponse{}, Signed: true},
+	}}, gcas.StatsDeltaHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/short-id/{id}", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Look up a device by its ShortID", Params: []RouteParam{{Name: "id", In: "path", Description: "The ShortID of the device"}}, Response: ShortIDLookup{}, Signed: true},
+	}}, gcas.ShortIDHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/time", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the time of the server", Response: TimeResponse{}, Signed: true},
+	}}, gcas.TimeHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/geo-stats", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the grid stats of a location", Params: []RouteParam{latitude, longitude}, Response: GeoStatsResponse{}},
+	}}, gcas.GeoStatsHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/archive", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Download the public files of the server", ResponseType: "application/zip"},
+	}}, gcas.ArchiveHandler)
+	gcas.handleRoute(Route{Path: "/api/v1/spec", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the description of every route of the server", Response: APISpec{}, Signed: true},
+	}}, gcas.SpecHandler)
+	gcas.handleRoute(Route{Path: "/api/v2/all-device-stats", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the stats of every device for a week", Params: append(statsParams, queryParam("fields", "The comma separated fields to return")), Response: V2AllDeviceStatsResponse{}, Signed: true},
+	}}, gcas.V2AllDeviceStatsHandler)
+	gcas.handleRoute(Route{Path: "/api/v2/authorized-servers", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the servers that the GCA authorized", Response: V2AuthorizedServersResponse{}, Signed: true},
+	}}, gcas.V2AuthorizedServersHandler)
+	gcas.handleRoute(Route{Path: "/api/v2/banned-equipment", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the banned devices", Params: []RouteParam{pubkey}, Response: V2BannedEquipmentResponse{}, Signed: true},
+	}}, gcas.V2BannedEquipmentHandler)
+	gcas.handleRoute(Route{Path: "/api/v2/device-summary", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the summary of a device", Params: []RouteParam{pubkey, shortID}, Response: V2DeviceSummary{}, Signed: true},
+	}}, gcas.V2DeviceSummaryHandler)
+	gcas.handleRoute(Route{Path: "/api/v2/equipment", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Page through the authorized devices", Params: []RouteParam{queryParam("cursor", "The cursor from the previous page"), queryParam("limit", "The number of devices per page")}, Response: V2EquipmentResponse{}, Signed: true},
+	}}, gcas.V2EquipmentHandler)
+	gcas.handleRoute(Route{Path: "/api/v2/flagged-reports", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the reports that await review", Params: []RouteParam{shortID}, Response: []V2FlaggedReport{}, Signed: true},
+	}}, gcas.V2FlaggedReportsHandler)
+	gcas.handleRoute(Route{Path: "/api/v2/recent-reports", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the reports of a device for a week", Params: []RouteParam{pubkey, shortID, period}, Response: V2RecentReportsResponse{}, Signed: true},
+	}}, gcas.V2RecentReportsHandler)
+	gcas.handleRoute(Route{Path: "/api/v2/report-gaps", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the timeslots that devices didn't report", Params: []RouteParam{pubkey, shortID, allDevices}, Response: V2ReportGapsResponse{}, Signed: true},
+	}}, gcas.V2ReportGapsHandler)
+	gcas.handleRoute(Route{Path: "/healthz", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the health of the server", Response: HealthzResponse{}},
+	}}, gcas.HealthzHandler)
+	gcas.handleRoute(Route{Path: "/metrics", Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the metrics of the server in the Prometheus format", ResponseType: "text/plain"},
+	}}, gcas.MetricsHandler)
 	// Internal APIs which will not be accessible except under bench testing mode
-	gcas.mux.HandleFunc("/api/int/wt-signal-index", gcas.InternalWattTimeSignalIndexHandler)
-	gcas.mux.HandleFunc("/api/int/wt-historical", gcas.InternalWattTimeHistoricalHandler)
+	gcas.handleRoute(Route{Path: "/api/int/wt-signal-index", Internal: true, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Query the WattTime signal index of a location", Params: []RouteParam{latitude, longitude}, ResponseType: "application/json"},
+	}}, gcas.loopbackOnly(gcas.InternalWattTimeSignalIndexHandler))
+	gcas.handleRoute(Route{Path: "/api/int/wt-historical", Internal: true, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Query the WattTime history of a location", Params: []RouteParam{latitude, longitude, requiredParam("start", "The start of the range, as yyyy-mm-ddThh:mm:ssZ"), requiredParam("dur", "The length of the range")}, Response: DataPointsJSON{}},
+	}}, gcas.loopbackOnly(gcas.InternalWattTimeHistoricalHandler))
+	gcas.handleRoute(Route{Path: "/internal/set-time", Internal: true, Operations: []Operation{
+		{Method: http.MethodPost, Summary: "Set the clock of the server", Request: SetTimeRequest{}, Response: SetTimeResponse{}},
+	}}, gcas.loopbackOnly(gcas.InternalSetTimeHandler))
+	gcas.handleRoute(Route{Path: "/internal/test-gca-keys", Internal: true, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the keys of the test GCA", Response: TestGCAKeysResponse{}},
+	}}, gcas.loopbackOnly(gcas.InternalTestGCAKeysHandler))
+	if gcas.allowIntApis || gcas.staticDebug {
+		gcas.registerDebugHandlers()
+	}
+
+	// A tenant gets its requests from the API of its host, see
+	// tenants.go.
+	if gcas.staticTenantHost != nil {
+		return
+	}
 
 	// Create a listener. In prod it's a specfic port, during testing it's
 	// ":0". Because we don't know what the port is during testing, we need
@@ -30,6 +277,7 @@ func (gcas *GCAServer) launchAPI() {
 		panic("unable to launch gca api")
 	}
 	gcas.httpPort = uint16(listener.Addr().(*net.TCPAddr).Port)
+	gcas.shareTenantPorts()
 
 	// Launch the background thread that keeps the API running. The
 	// listener gets handed off to the httpServer, which will be
@@ -37,9 +285,22 @@ func (gcas *GCAServer) launchAPI() {
 	// not need to be closed here. If the Launch fails, the listener will
 	// never get attached to the httpServer, which means we will have to
 	// close it manually.
-	err = gcas.tg.Launch(func() {
-		gcas.logger.Info("Starting HTTP server on ", gcas.httpServer.Addr)
-		if err := gcas.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+	if gcas.staticTLS != nil {
+		gcas.httpServer.TLSConfig = &tls.Config{
+			GetCertificate: gcas.staticTLS.getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+	err = gcas.launchComponent("http-server", nil, func() {
+		var err error
+		if gcas.staticTLS != nil {
+			gcas.logger.Info("Starting HTTPS server on ", gcas.httpServer.Addr)
+			err = gcas.httpServer.ServeTLS(listener, "", "")
+		} else {
+			gcas.logger.Info("Starting HTTP server on ", gcas.httpServer.Addr)
+			err = gcas.httpServer.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			gcas.logger.Fatal("Could not start HTTP server: ", err)
 		}
 	})
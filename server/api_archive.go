@@ -11,8 +11,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"time"
 )
 
@@ -66,15 +64,15 @@ func (arc *zipArchiveWriter) AddFile(reader io.Reader, name string, modTime time
 // to produce an archive.
 func (gcas *GCAServer) ArchiveHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is allowed")
 		return
 	}
 	if r.ContentLength != 0 {
-		http.Error(w, "Request should not have a body", http.StatusBadRequest)
+		gcas.writeError(w, ErrCodeMalformedRequest, "Request should not have a body")
 		return
 	}
 	if !gcas.ApiArchiveRateLimiter.Allow() {
-		http.Error(w, fmt.Sprintf("Too many requests, this server allows %v every %v", apiArchiveLimit, apiArchiveRate), http.StatusTooManyRequests)
+		gcas.writeError(w, ErrCodeRateLimited, fmt.Sprintf("Too many requests, this server allows %v every %v", apiArchiveLimit, apiArchiveRate))
 		return
 	}
 	arc := NewArchive()
@@ -85,37 +83,36 @@ func (gcas *GCAServer) ArchiveHandler(w http.ResponseWriter, r *http.Request) {
 	for _, pf := range PublicFiles {
 		err := gcas.addFile(pf, arc)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error zipping file %v: %v", pf, err), http.StatusInternalServerError)
+			gcas.writeError(w, ErrCodeInternalError, fmt.Sprintf("Error zipping file %v: %v", pf, err))
 			return
 		}
 	}
 	// Add the pseudo file server.pubkey last, as the other files are signed by it.
 	if err := gcas.addPubKeyFile("server.pubkey", arc); err != nil {
-		http.Error(w, fmt.Sprintf("Error zipping server.pubkey: %v", err), http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeInternalError, fmt.Sprintf("Error zipping server.pubkey: %v", err))
 		return
 	}
 	if err := gcas.addReadmeFile(arc); err != nil {
-		http.Error(w, fmt.Sprintf("Error adding README: %v", err), http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeInternalError, fmt.Sprintf("Error adding README: %v", err))
 		return
 	}
 
 	// Close archive and write out the response
 	buf, err := arc.Close()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeInternalError, fmt.Sprintf("%v", err))
 		return
 	}
 	w.Header().Set("Content-Type", "application/zip")
 	if _, err := w.Write(buf.Bytes()); err != nil {
-		http.Error(w, "Failed to write archive response", http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeInternalError, "Failed to write archive response")
 		return
 	}
 }
 
 // Add a file to an archive, copying all the data in the file.
 func (gcas *GCAServer) addFile(name string, arc *zipArchiveWriter) error {
-	path := filepath.Join(gcas.baseDir, name)
-	file, err := os.Open(path)
+	file, err := gcas.staticStorage.Open(name)
 	if err != nil {
 		return err
 	}
@@ -133,8 +130,7 @@ func (gcas *GCAServer) addFile(name string, arc *zipArchiveWriter) error {
 // Add a pseudo-file "server.pubkey" to an archive, copying only the
 // public key part of the data file "server.keys".
 func (gcas *GCAServer) addPubKeyFile(name string, arc *zipArchiveWriter) error {
-	path := filepath.Join(gcas.baseDir, "server.keys")
-	file, err := os.Open(path)
+	file, err := gcas.staticStorage.Open(ServerKeysFile)
 	if err != nil {
 		return err
 	}
@@ -173,7 +169,7 @@ func (gcas *GCAServer) addPubKeyFile(name string, arc *zipArchiveWriter) error {
 func (gcas *GCAServer) addReadmeFile(arc *zipArchiveWriter) error {
 	var buf bytes.Buffer
 	buf.WriteString(ReadmeContents)
-	if err := arc.AddFile(&buf, "README", time.Now()); err != nil {
+	if err := arc.AddFile(&buf, "README", gcas.now()); err != nil {
 		return err
 	}
 	return nil
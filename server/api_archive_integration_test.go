@@ -7,8 +7,6 @@ import (
 	"io"
 	"math/rand"
 	"net/http"
-	"os"
-	"path/filepath"
 	"slices"
 	"sync"
 	"sync/atomic"
@@ -22,7 +20,7 @@ import (
 // gets an archive and compares to the original file data.
 func TestApiArchive(t *testing.T) {
 	// Create a populated test environment and start a new server.
-	gcas, dir, err := ServerWithArchiveFiles(t.Name())
+	gcas, _, err := ServerWithArchiveFiles(t.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,8 +35,7 @@ func TestApiArchive(t *testing.T) {
 
 	// Add the public files to the test.
 	for _, name := range PublicFiles {
-		path := filepath.Join(dir, name)
-		data, err := os.ReadFile(path)
+		data, err := gcas.staticStorage.ReadFile(name)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -51,8 +48,7 @@ func TestApiArchive(t *testing.T) {
 	// This test verifies this value directly.
 	const pkf = "server.pubkey"
 	fileMap[pkf] = false
-	path := filepath.Join(dir, "server.keys")
-	data, err := os.ReadFile(path)
+	data, err := gcas.staticStorage.ReadFile(ServerKeysFile)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -210,7 +206,7 @@ func ServerWithArchiveFiles(name string) (*GCAServer, string, error) {
 	}
 
 	// Submit new hardware via API
-	auth, authPriv, err := gcas.submitNewHardware(0, gcaPrivKey)
+	auth, authPriv, err := gcas.AuthorizeTestDevice(0, gcaPrivKey)
 	if err != nil {
 		return nil, "", err
 	}
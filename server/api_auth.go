@@ -0,0 +1,213 @@
+package server
+
+// api_auth.go authenticates HTTP requests that carry a GCA-Signature
+// Authorization header, see glow/request_auth.go for the format. A request
+// can be signed by the GCA, with the key that is accepted in the current
+// timeslot, or by an operator key that the GCA delegated scopes to, see
+// operator_keys.go. A signed request has to be sent within requestAuthWindow
+// seconds of its timestamp, and every signature is only accepted once.
+//
+// Requests without the header pass through untouched, so the public endpoints
+// don't change. Endpoints that need a signed request are wrapped in
+// requireScope, and endpoints that also accept a request that is signed in its
+// body are wrapped in allowScope. The GCA holds every scope, an operator only
+// the ones delegated to it. The identity of the signer is added to the
+// context of the request, which puts it in the log lines of the handler, and
+// lets handlers add the signature to the audit log.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// The roles of an authenticated requester.
+const (
+	authRoleGCA      = "gca"
+	authRoleOperator = "operator"
+)
+
+// authIdentityKey is the context key of the identity of a signed request.
+type authIdentityKey struct{}
+
+// authIdentity is the verified signer of a request.
+type authIdentity struct {
+	role      string
+	publicKey glow.PublicKey
+	scopes    OperatorScopes
+	signature glow.AuditSignature
+}
+
+// String returns the role and the key of the signer, for the logs.
+func (ai authIdentity) String() string {
+	return fmt.Sprintf("%v:%x", ai.role, ai.publicKey[:8])
+}
+
+// requestAuthenticator holds the signatures that were seen recently.
+type requestAuthenticator struct {
+	seen   map[glow.Signature]int64
+	seenMu sync.Mutex
+}
+
+// markSeen records a signature, and returns false if it was already seen.
+// Signatures are forgotten once their timestamp is outside of the window,
+// because they get refused as stale from then on.
+func (ra *requestAuthenticator) markSeen(sig glow.Signature, timestamp, now int64) bool {
+	ra.seenMu.Lock()
+	defer ra.seenMu.Unlock()
+	if ra.seen == nil {
+		ra.seen = make(map[glow.Signature]int64)
+	}
+	for s, ts := range ra.seen {
+		if ts < now-requestAuthWindow {
+			delete(ra.seen, s)
+		}
+	}
+	if _, exists := ra.seen[sig]; exists {
+		return false
+	}
+	ra.seen[sig] = timestamp
+	return true
+}
+
+// authenticatedIdentity returns the verified signer of a request, if the
+// request was signed.
+func authenticatedIdentity(r *http.Request) (authIdentity, bool) {
+	ai, ok := r.Context().Value(authIdentityKey{}).(authIdentity)
+	return ai, ok
+}
+
+// requestAuditSignatures returns the signature of a signed request in the form
+// of the audit log, or nil if the request was not signed.
+func requestAuditSignatures(r *http.Request) []glow.AuditSignature {
+	if ai, ok := authenticatedIdentity(r); ok {
+		return []glow.AuditSignature{ai.signature}
+	}
+	return nil
+}
+
+// managedAuthRole returns the role and the scopes of the provided key, or an
+// empty role if the key may not sign requests.
+func (gcas *GCAServer) managedAuthRole(key glow.PublicKey) (string, OperatorScopes) {
+	gcas.mu.RLock()
+	defer gcas.mu.RUnlock()
+	if gcas.gcaPubkeyAvailable && key == gcas.gcaKeyAt(gcas.currentTimeslot()) {
+		return authRoleGCA, allOperatorScopes
+	}
+	if scopes, exists := gcas.operatorScopes(key); exists {
+		return authRoleOperator, scopes
+	}
+	return "", 0
+}
+
+// writeUnauthorized refuses a request that needs a valid signature.
+func (gcas *GCAServer) writeUnauthorized(w http.ResponseWriter, r *http.Request, msg string) {
+	w.Header().Set("WWW-Authenticate", glow.RequestAuthScheme)
+	gcas.writeError(w, ErrCodeUnauthorized, msg)
+	gcas.requestLogger(r).WithFields("remote", r.RemoteAddr).Warn("refused http request: ", msg)
+}
+
+// authenticateRequests wraps the API so that the Authorization header of every
+// signed request gets verified. A request with a header that doesn't verify
+// is refused, even if the endpoint doesn't need a signature.
+func (gcas *GCAServer) authenticateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auth, err := glow.ParseRequestAuth(header)
+		if err != nil {
+			gcas.writeUnauthorized(w, r, err.Error())
+			return
+		}
+		now := gcas.now().Unix()
+		if auth.Timestamp < now-requestAuthWindow || auth.Timestamp > now+requestAuthWindow {
+			gcas.writeUnauthorized(w, r, fmt.Sprintf("request timestamp is not within %v seconds of the current time", requestAuthWindow))
+			return
+		}
+		role, scopes := gcas.managedAuthRole(auth.PublicKey)
+		if role == "" {
+			gcas.writeUnauthorized(w, r, "request was not signed by the GCA or an operator")
+			return
+		}
+
+		// The body is read here to hash it, which is safe because the
+		// body size limits wrap this middleware.
+		var body []byte
+		if r.Body != nil {
+			body, err = io.ReadAll(r.Body)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				gcas.writeError(w, ErrCodeRequestTooLarge, fmt.Sprintf("Request body is larger than the limit of %v bytes", tooLarge.Limit))
+				return
+			} else if err != nil {
+				gcas.writeError(w, ErrCodeMalformedRequest, "Unable to read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		sb := auth.SigningBytes(r.Method, signedRequestURI(r), sha256.Sum256(body))
+		if !glow.Verify(auth.PublicKey, sb, auth.Signature) {
+			gcas.writeUnauthorized(w, r, "invalid request signature")
+			return
+		}
+		if !gcas.staticRequestAuth.markSeen(auth.Signature, auth.Timestamp, now) {
+			gcas.writeUnauthorized(w, r, "request signature was already used")
+			return
+		}
+
+		ai := authIdentity{
+			role:      role,
+			publicKey: auth.PublicKey,
+			scopes:    scopes,
+			signature: glow.AuditSignature{PublicKey: auth.PublicKey, SigningBytes: sb, Signature: auth.Signature},
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authIdentityKey{}, ai)))
+	})
+}
+
+// writeScopeDenied refuses a signed request from an operator that lacks the
+// scope of the endpoint.
+func (gcas *GCAServer) writeScopeDenied(w http.ResponseWriter, r *http.Request, scope OperatorScopes) {
+	gcas.writeError(w, ErrCodeScopeDenied, fmt.Sprintf("this operator key was not delegated the %v scope", scope))
+	gcas.requestLogger(r).WithFields("remote", r.RemoteAddr, "scope", scope).Warn("refused http request outside of the operator's scope")
+}
+
+// requireScope wraps a handler so that it only serves requests signed by the
+// GCA or by an operator with the provided scope.
+func (gcas *GCAServer) requireScope(scope OperatorScopes, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ai, ok := authenticatedIdentity(r)
+		if !ok {
+			gcas.writeUnauthorized(w, r, "this endpoint needs a request signed by the GCA or an operator")
+			return
+		}
+		if !ai.scopes.Has(scope) {
+			gcas.writeScopeDenied(w, r, scope)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowScope wraps a handler that also serves unsigned requests, because it
+// checks a signature in the body. Signed requests still need the provided
+// scope.
+func (gcas *GCAServer) allowScope(scope OperatorScopes, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ai, ok := authenticatedIdentity(r); ok && !ai.scopes.Has(scope) {
+			gcas.writeScopeDenied(w, r, scope)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestRequestAuth checks which signed requests the audit log endpoint accepts.
+func TestRequestAuth(t *testing.T) {
+	server, _, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	url := "http://" + server.httpDialAddr() + "/api/v1/audit-log?limit=5"
+
+	// do sends a request with the provided Authorization header.
+	do := func(method, url, header string, body []byte) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	header := func(pub glow.PublicKey, priv glow.PrivateKey, timestamp int64) string {
+		return glow.NewRequestAuth("GET", "/api/v1/audit-log?limit=5", nil, timestamp, pub, priv).Header()
+	}
+	now := time.Now().Unix()
+
+	// Unsigned requests are refused, signed ones are served once.
+	resp := do("GET", url, "", nil)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != glow.RequestAuthScheme {
+		t.Fatal("unsigned request was not refused:", resp.StatusCode, resp.Header)
+	}
+	signed := header(gcaPubKey, gcaPrivKey, now)
+	if resp := do("GET", url, signed, nil); resp.StatusCode != http.StatusOK {
+		t.Fatal("signed request was refused:", resp.StatusCode)
+	}
+	if resp := do("GET", url, signed, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("replayed request was accepted:", resp.StatusCode)
+	}
+
+	// Stale timestamps, other paths, and unknown keys are refused.
+	if resp := do("GET", url, header(gcaPubKey, gcaPrivKey, now-2*requestAuthWindow), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("stale request was accepted:", resp.StatusCode)
+	}
+	if resp := do("GET", url+"0", header(gcaPubKey, gcaPrivKey, now+1), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("signature was accepted for another path:", resp.StatusCode)
+	}
+	opPub, opPriv := glow.GenerateKeyPair()
+	if resp := do("GET", url, header(opPub, opPriv, now), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("unknown key was accepted:", resp.StatusCode)
+	}
+
+	// A broken header is refused on public endpoints too.
+	if resp := do("GET", "http://"+server.httpDialAddr()+"/api/v1/time", "GCA-Signature pubkey=00", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("broken header was accepted:", resp.StatusCode)
+	}
+
+	// Once the GCA delegates the key, the operator gets served.
+	od := OperatorDelegation{PublicKey: opPub, Name: "ops", Scopes: ScopeReadAudit, Timestamp: now}
+	od.Signature = glow.Sign(od.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedDelegateOperator(od); err != nil {
+		t.Fatal(err)
+	}
+	if resp := do("GET", url, header(opPub, opPriv, now+2), nil); resp.StatusCode != http.StatusOK {
+		t.Fatal("operator request was refused:", resp.StatusCode)
+	}
+}
+
+// TestRequestAuthIdentity checks that a signed request reaches the handler
+// with the identity of the signer, and that the body is covered by the
+// signature.
+func TestRequestAuthIdentity(t *testing.T) {
+	server, _, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	var got authIdentity
+	var gotBody string
+	handler := server.authenticateRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = authenticatedIdentity(r)
+		var buf bytes.Buffer
+		buf.ReadFrom(r.Body)
+		gotBody = buf.String()
+	}))
+
+	body := `{"ShortID":1}`
+	req := httptest.NewRequest("POST", "/api/v1/flagged-reports/review", strings.NewReader(body))
+	if err := glow.SignRequest(req, gcaPubKey, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || got.role != authRoleGCA || got.publicKey != gcaPubKey || gotBody != body {
+		t.Fatalf("unexpected identity: %v %+v %q", rec.Code, got, gotBody)
+	}
+	if !glow.Verify(got.signature.PublicKey, got.signature.SigningBytes, got.signature.Signature) {
+		t.Fatal("audit signature does not verify")
+	}
+
+	// A different body breaks the signature.
+	req = httptest.NewRequest("POST", "/api/v1/flagged-reports/review", strings.NewReader(body))
+	if err := glow.SignRequest(req, gcaPubKey, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	req.Body = io.NopCloser(strings.NewReader(`{"ShortID":2}`))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatal("request with a changed body was accepted:", rec.Code)
+	}
+}
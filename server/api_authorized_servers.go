@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -26,8 +25,8 @@ func (s *GCAServer) AuthorizedServersHandler(w http.ResponseWriter, r *http.Requ
 
 	// And also accept GET requests.
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is supported.", http.StatusMethodNotAllowed)
-		s.logger.Warn("Received non-GET request for recent reports.")
+		s.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		s.requestLogger(r).Warn("Received non-GET request for recent reports.")
 		return
 	}
 
@@ -38,82 +37,73 @@ func (s *GCAServer) AuthorizedServersHandler(w http.ResponseWriter, r *http.Requ
 
 	// Send the response as JSON with a status code of OK
 	if err := json.NewEncoder(w).Encode(asr); err != nil {
-		http.Error(w, "Failed to encode JSON response", http.StatusInternalServerError)
-		s.logger.Error("Failed to encode JSON response:", err)
+		s.writeError(w, ErrCodeInternalError, "Failed to encode JSON response")
+		s.requestLogger(r).Error("Failed to encode JSON response:", err)
 		return
 	}
 }
 
 // The POST handler receives a single server to be added to the server
-// collection. After the new server information is received, it will send
-// details of that server to all of the other servers.
+// collection, or the removal of a server. Both are signed by the GCA. After
+// the new server information is received, it will send details of that
+// server to all of the other servers.
 func (s *GCAServer) AuthorizedServersHandlerPOST(w http.ResponseWriter, r *http.Request) {
 	// Decode the JSON request body.
 	var server AuthorizedServer
 	if err := json.NewDecoder(r.Body).Decode(&server); err != nil {
-		http.Error(w, "Failed to decode JSON request", http.StatusInternalServerError)
-		s.logger.Error("Failed to decode JSON request:", err)
+		s.writeError(w, ErrCodeMalformedRequest, "Failed to decode JSON request")
+		s.requestLogger(r).Error("Failed to decode JSON request:", err)
 		return
 	}
 
-	// Validate the signature.
-	sb := server.SigningBytes()
-	if !glow.Verify(s.gcaPubkey, sb, server.GCAAuthorization) {
-		http.Error(w, "Invalid signature!", http.StatusInternalServerError)
-		s.logger.Error("Invalid signature!")
+	// Validate the signature and save the server. Servers that are
+	// already known, including servers that were removed, are ignored.
+	updated, err := s.managedRegisterServer(server)
+	if err != nil {
+		s.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to register server: ", err))
+		s.requestLogger(r).Error("Failed to register server: ", err)
+		return
+	}
+	if !updated {
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+		s.requestLogger(r).Info("received authorization for server that already exists")
 		return
 	}
 
-	// Verify that the new server isn't conflicting with existing servers.
-	// The GCA isn't allowed to update the information (like location and
-	// ports) for the server. Any updates will be ignored. The server would
-	// instead have to be banned and a new public key would need to be
-	// created.
-	s.gcaServers.mu.Lock()
-	for i := 0; i < len(s.gcaServers.servers); i++ {
-		if s.gcaServers.servers[i].PublicKey == server.PublicKey {
-			if s.gcaServers.servers[i].Banned {
-				s.gcaServers.mu.Unlock()
-				json.NewEncoder(w).Encode(map[string]string{"status": "success"})
-				s.logger.Info("received authorization for server that is banned")
-				return
-			}
-			if !server.Banned {
-				s.gcaServers.mu.Unlock()
-				json.NewEncoder(w).Encode(map[string]string{"status": "success"})
-				s.logger.Info("received authorization for server that already exists")
-				return
-			}
-			s.gcaServers.servers[i] = server
-			s.gcaServers.mu.Unlock()
-			json.NewEncoder(w).Encode(map[string]string{"status": "success"})
-			s.logger.Info("received authorization to ban server")
-			return
-		}
+	s.managedAnnounceServer(server, s.requestLogger(r))
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	if server.Banned {
+		s.requestLogger(r).Info("received authorization to ban server")
+	} else {
+		s.requestLogger(r).Info("received authorization for new server")
 	}
-	// If we made it here, it's a new server. The loop would have caught
-	// any other instances for this server and it would have exited the
-	// function.
-	s.gcaServers.servers = append(s.gcaServers.servers, server)
-	// Create a list of all the servers that we need to call to submit this
-	// new server to. This list that we send the new server to actually
-	// includes the server itself, and that is intentional because we want
-	// to make sure that the server's own list of viable servers includes
-	// itself.
-	ass := make([]AuthorizedServer, len(s.gcaServers.servers))
-	copy(ass, s.gcaServers.servers)
-	s.gcaServers.mu.Unlock()
+}
+
+// managedAnnounceServer sends a registration or a removal that changed the
+// list of servers to every other server, and sends a new server the full list
+// of authorized equipment.
+func (s *GCAServer) managedAnnounceServer(server AuthorizedServer, log *Logger) {
+	// Create a list of all the servers that we need to call to submit this server to.
+	// For a new server, this list includes the server itself, and that is
+	// intentional because we want to make sure that the server's own list
+	// of viable servers includes itself.
+	ass := s.AuthorizedServers()
 
 	// Create a list of all the authorized devices that we want to send to
 	// the new server. This is potentially a decent amount of traffic, but
 	// onboarding a new server is pretty rare and we want to make sure they
 	// know everything. Note that this happens under its own mutex.
-	s.mu.Lock()
+	s.mu.RLock()
 	auths := make([]glow.EquipmentAuthorization, 0)
-	for _, e := range s.equipment {
+	for shortID, e := range s.equipment {
+		// Imported equipment is imported into every server on its
+		// own, see api_equipment_transfer.go.
+		if _, imported := s.equipmentImports[shortID]; imported {
+			continue
+		}
 		auths = append(auths, e)
 	}
-	s.mu.Unlock()
+	s.mu.RUnlock()
 
 	// Send the new server to all of the other GCA servers we know about.
 	// This means that there's sort of a quadradic DoS here, where each new
@@ -137,9 +127,9 @@ func (s *GCAServer) AuthorizedServersHandlerPOST(w http.ResponseWriter, r *http.
 		if err != nil {
 			continue
 		}
-		resp, err := http.Post(fmt.Sprintf("http://%v:%v/api/v1/authorized-servers", as.Location, as.HttpPort), "application/json", bytes.NewBuffer(j))
+		resp, err := s.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/authorized-servers", j)
 		if err != nil {
-			s.logger.Infof("Failed to send request to server: %v", err)
+			log.WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("Failed to send request to server")
 			continue
 		}
 		// We don't check any errors because if there is an error,
@@ -150,6 +140,9 @@ func (s *GCAServer) AuthorizedServersHandlerPOST(w http.ResponseWriter, r *http.
 		// anyway.
 		resp.Body.Close()
 	}
+	if server.Banned {
+		return
+	}
 
 	// Send the new server the full list of authorized equipment.
 	for _, a := range auths {
@@ -157,14 +150,25 @@ func (s *GCAServer) AuthorizedServersHandlerPOST(w http.ResponseWriter, r *http.
 		if err != nil {
 			continue
 		}
-		resp, err := http.Post(fmt.Sprintf("http://%v:%v/api/v1/authorize-equipment", server.Location, server.HttpPort), "application/json", bytes.NewBuffer(j))
+		resp, err := s.postJSON("http://"+glow.HostPort(server.Location, server.HttpPort)+"/api/v1/authorize-equipment", j)
 		if err != nil {
-			s.logger.Infof("Failed to send request to server: %v", err)
+			log.WithFields("endpoint", glow.HostPort(server.Location, server.HttpPort), "error", err).Info("Failed to send request to server")
 			continue
 		}
 		resp.Body.Close()
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
-	s.logger.Info("received authorization for new server")
+}
+
+// RegisterServerHandler registers a new server with a POST request that
+// carries an AuthorizedServer signed by the GCA. Removing a server is done the
+// same way, with 'Banned' set. A removed server can never be registered again.
+func (s *GCAServer) RegisterServerHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		s.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		s.requestLogger(r).Warn("Received non-POST request for server registration.")
+		return
+	}
+	s.AuthorizedServersHandlerPOST(w, r)
 }
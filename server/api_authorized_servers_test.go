@@ -29,8 +29,7 @@ func TestAuthorizeServers(t *testing.T) {
 	}
 
 	// Sign the authorization request with GCA's private key.
-	sb := ea.SigningBytes()
-	ea.Signature = glow.Sign(sb, gcaPrivKey)
+	ea = SignEquipmentAuthorization(ea, gcaPrivKey)
 
 	// Convert the request body to JSON.
 	jsonBody, _ := json.Marshal(ea)
@@ -59,3 +58,103 @@ func TestAuthorizeServers(t *testing.T) {
 		t.Fatalf("Unexpected response: %v", response)
 	}
 }
+
+// postServerRegistration posts a server registration and returns the status
+// code of the response.
+func postServerRegistration(t *testing.T, server *GCAServer, as AuthorizedServer) int {
+	t.Helper()
+	j, _ := json.Marshal(as)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/register-server", server.httpPort), "application/json", bytes.NewBuffer(j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestRegisterServer checks that server registrations and removals signed by
+// the GCA are accepted and survive a restart, and that nothing else is.
+func TestRegisterServer(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey, _ := glow.GenerateKeyPair()
+	as := AuthorizedServer{
+		PublicKey: pubkey,
+		Location:  "127.0.0.1",
+		HttpPort:  1,
+		TcpPort:   2,
+		UdpPort:   3,
+	}
+
+	// Unsigned registrations get refused.
+	if status := postServerRegistration(t, server, as); status != http.StatusForbidden {
+		t.Fatal("unsigned registration was not refused:", status)
+	}
+	as.GCAAuthorization = glow.Sign(as.SigningBytes(), gcaPrivKey)
+	if status := postServerRegistration(t, server, as); status != http.StatusOK {
+		t.Fatal("registration failed:", status)
+	}
+	if servers := server.AuthorizedServers(); len(servers) != 1 || servers[0] != as {
+		t.Fatalf("unexpected servers: %+v", servers)
+	}
+
+	// Changing the details of the server is ignored.
+	moved := as
+	moved.Location = "10.0.0.1"
+	moved.GCAAuthorization = glow.Sign(moved.SigningBytes(), gcaPrivKey)
+	if status := postServerRegistration(t, server, moved); status != http.StatusOK {
+		t.Fatal("duplicate registration failed:", status)
+	}
+	if servers := server.AuthorizedServers(); len(servers) != 1 || servers[0] != as {
+		t.Fatalf("registration was updated: %+v", servers)
+	}
+
+	// The registration survives a restart, and so does a removal.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servers := server.AuthorizedServers(); len(servers) != 1 || servers[0] != as {
+		t.Fatalf("registration was lost in a restart: %+v", servers)
+	}
+	removed := as
+	removed.Banned = true
+	removed.GCAAuthorization = glow.Sign(removed.SigningBytes(), gcaPrivKey)
+	if status := postServerRegistration(t, server, removed); status != http.StatusOK {
+		t.Fatal("removal failed:", status)
+	}
+	if status := postServerRegistration(t, server, as); status != http.StatusOK {
+		t.Fatal("registration failed:", status)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servers := server.AuthorizedServers(); len(servers) != 1 || servers[0] != removed {
+		t.Fatalf("removal was lost in a restart: %+v", servers)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tampered file is not loaded.
+	data, err := serverStorage(dir).ReadFile(AuthorizedServersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[40] ^= 1
+	if err := serverStorage(dir).WriteFile(AuthorizedServersFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGCAServer(dir, false); err == nil {
+		t.Fatal("server started with a tampered authorized servers file")
+	}
+}
@@ -0,0 +1,309 @@
+package server
+
+// api_backup.go contains an endpoint which lets the GCA take a backup of the
+// full state of the server, which is the way to move a server to a new
+// machine. The backup gets unpacked again with RestoreBackup, see
+// backup_restore.go.
+//
+// Writes are quiesced by holding the server mutex while every persist file is
+// opened. Apart from the reports journal, every persist file is only ever
+// replaced by renaming a new file over it, so a file that is open keeps its
+// contents no matter what gets written after the mutex is released. The
+// journal is appended to in place, so it gets read into memory while the
+// mutex is held. The backup is then streamed to the caller without holding
+// the mutex.
+//
+// The backup is a tar.gz file. It contains every file in the storage of the
+// server, which by default is the server directory, except for the logs and
+// any temporary files, followed by a
+// manifest that lists the checksum of every file, the public key of the
+// server, and the timeslot in which the backup was taken. The manifest is
+// signed by the server.
+//
+// Because the backup contains the private key of the server, it is only
+// handed out over TLS or to a caller on a loopback address.
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// BackupManifestFile is the name of the manifest within a backup.
+const BackupManifestFile = "backup-manifest.json"
+
+// BackupRequest is an order from the GCA to take a backup of the server.
+type BackupRequest struct {
+	Timestamp int64          // Unix time of the request
+	Signature glow.Signature // A signature from the GCA
+}
+
+// SigningBytes returns the bytes that the GCA signs to authorize the backup.
+func (br BackupRequest) SigningBytes() []byte {
+	b := []byte("BackupRequest")
+	return binary.LittleEndian.AppendUint64(b, uint64(br.Timestamp))
+}
+
+// BackupFile describes a single file within a backup.
+type BackupFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"sha256"`
+}
+
+// BackupManifest is the last entry of every backup. It identifies the server
+// that the backup belongs to, and lists the checksums of all other files.
+type BackupManifest struct {
+	ServerPublicKey string       `json:"server_pubkey"`
+	GCAPublicKey    string       `json:"gca_pubkey"`
+	CreatedTimeslot uint32       `json:"created_timeslot"`
+	CreatedAt       int64        `json:"created_at"`
+	Files           []BackupFile `json:"files"`
+	Signature       string       `json:"signature"`
+}
+
+// SigningBytes returns the bytes that the server signs to vouch for the
+// manifest.
+func (bm BackupManifest) SigningBytes() []byte {
+	b := []byte("BackupManifest")
+	b = append(b, bm.ServerPublicKey...)
+	b = append(b, bm.GCAPublicKey...)
+	b = binary.LittleEndian.AppendUint32(b, bm.CreatedTimeslot)
+	b = binary.LittleEndian.AppendUint64(b, uint64(bm.CreatedAt))
+	for _, f := range bm.Files {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(f.Name)))
+		b = append(b, f.Name...)
+		b = binary.LittleEndian.AppendUint64(b, uint64(f.Size))
+		b = append(b, f.Checksum...)
+	}
+	return b
+}
+
+// backupEntry is a file that was captured for a backup. Either file is open,
+// or data holds the contents of the file.
+type backupEntry struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+	file    StorageFile
+	data    []byte
+}
+
+// BackupHandler streams a backup of the server to the GCA.
+func (gcas *GCAServer) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for a backup.")
+		return
+	}
+	if r.TLS == nil && !isLoopbackAddr(r.RemoteAddr) {
+		gcas.writeError(w, ErrCodeInsecureTransport, "backups are only available over TLS or from a loopback address")
+		return
+	}
+
+	// A request with a GCA-Signature header was already checked by the
+	// auth middleware, which includes the scope of an operator. Any other
+	// request needs a backup request that is signed by the GCA.
+	_, signed := authenticatedIdentity(r)
+	var request BackupRequest
+	if !signed {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+			gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+			return
+		}
+	}
+
+	entries, manifest, err := gcas.managedSnapshotFiles(request, signed)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to take backup: ", err))
+		gcas.requestLogger(r).Warn("Failed to take backup: ", err)
+		return
+	}
+	defer func() {
+		for _, e := range entries {
+			if e.file != nil {
+				e.file.Close()
+			}
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"gca-backup-%d.tar.gz\"", manifest.CreatedTimeslot))
+	if err := gcas.writeBackup(w, entries, manifest); err != nil {
+		gcas.requestLogger(r).Warn("Unable to write backup: ", err)
+		return
+	}
+	gcas.requestLogger(r).Infof("sent a backup with %v files", len(entries))
+}
+
+// managedSnapshotFiles verifies the backup request, unless the HTTP request
+// was already authenticated, and then captures every file in the server
+// directory. The returned manifest does not have the file list and the
+// signature yet, they get filled in while the backup is being written.
+func (gcas *GCAServer) managedSnapshotFiles(request BackupRequest, authenticated bool) ([]backupEntry, BackupManifest, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+
+	if !gcas.gcaPubkeyAvailable {
+		return nil, BackupManifest{}, errNotInitialized
+	}
+	// The auth middleware already refused stale and replayed requests
+	// that were authenticated by their header.
+	now := gcas.now().Unix()
+	if !authenticated {
+		if !gcas.verifyGCASignature(request.SigningBytes(), request.Signature) {
+			return nil, BackupManifest{}, withCode(ErrCodeInvalidSignature, fmt.Errorf("invalid signature on backup request"))
+		}
+		if request.Timestamp < now-backupRequestWindow || request.Timestamp > now+backupRequestWindow {
+			return nil, BackupManifest{}, withCode(ErrCodeMalformedRequest, fmt.Errorf("backup request timestamp is not within %v seconds of the current time", backupRequestWindow))
+		}
+		// A request can't be replayed, because its timestamp has to be
+		// newer than the timestamp of the last request.
+		if request.Timestamp <= gcas.lastBackupTimestamp {
+			return nil, BackupManifest{}, withCode(ErrCodeConflict, fmt.Errorf("backup request is not newer than the last backup request"))
+		}
+		gcas.lastBackupTimestamp = request.Timestamp
+	}
+
+	var entries []backupEntry
+	names, err := gcas.staticStorage.List("")
+	for _, name := range names {
+		// Every tenant gets backed up through its own API, see
+		// tenants.go.
+		if isBackupExcluded(path.Base(name)) || strings.HasPrefix(name, TenantsDir+"/") {
+			continue
+		}
+		var e backupEntry
+		e, err = gcas.captureBackupEntry(name)
+		if err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	if err != nil {
+		for _, e := range entries {
+			if e.file != nil {
+				e.file.Close()
+			}
+		}
+		return nil, BackupManifest{}, fmt.Errorf("unable to capture the server files: %v", err)
+	}
+	manifest := BackupManifest{
+		ServerPublicKey: hex.EncodeToString(gcas.staticPublicKey[:]),
+		GCAPublicKey:    hex.EncodeToString(gcas.gcaPubkey[:]),
+		CreatedTimeslot: gcas.currentTimeslot(),
+		CreatedAt:       now,
+	}
+	return entries, manifest, nil
+}
+
+// captureBackupEntry opens a persist file for the backup, or reads it into
+// memory if it is the reports journal. The mutex must be held.
+func (gcas *GCAServer) captureBackupEntry(name string) (backupEntry, error) {
+	e := backupEntry{name: name}
+	var info os.FileInfo
+	var err error
+	if name == ReportsJournalFile {
+		if e.data, err = gcas.staticStorage.ReadFile(name); err != nil {
+			return e, err
+		}
+		info, err = gcas.staticStorage.Stat(name)
+	} else {
+		if e.file, err = gcas.staticStorage.Open(name); err != nil {
+			return e, err
+		}
+		info, err = e.file.Stat()
+	}
+	if err != nil {
+		if e.file != nil {
+			e.file.Close()
+		}
+		return e, err
+	}
+	e.mode, e.modTime = info.Mode().Perm(), info.ModTime()
+	return e, nil
+}
+
+// isBackupExcluded returns whether a file in the server directory is left out
+// of backups. The logs aren't state, and temporary files are never read.
+func isBackupExcluded(name string) bool {
+	return strings.HasPrefix(name, "server.log") || strings.HasSuffix(name, tmpFileSuffix)
+}
+
+// writeBackup writes the captured files to w as a tar.gz, followed by the
+// signed manifest.
+func (gcas *GCAServer) writeBackup(w io.Writer, entries []backupEntry, manifest BackupManifest) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		var src io.Reader
+		var size int64
+		if e.file != nil {
+			info, err := e.file.Stat()
+			if err != nil {
+				return fmt.Errorf("unable to stat %v: %v", e.name, err)
+			}
+			src, size = e.file, info.Size()
+		} else {
+			src, size = bytes.NewReader(e.data), int64(len(e.data))
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Mode:     int64(e.mode),
+			Size:     size,
+			ModTime:  e.modTime,
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to write header for %v: %v", e.name, err)
+		}
+		hasher := sha256.New()
+		if _, err := io.CopyN(io.MultiWriter(tw, hasher), src, size); err != nil {
+			return fmt.Errorf("unable to write %v: %v", e.name, err)
+		}
+		manifest.Files = append(manifest.Files, BackupFile{
+			Name:     e.name,
+			Size:     size,
+			Checksum: hex.EncodeToString(hasher.Sum(nil)),
+		})
+	}
+
+	sig := glow.Sign(manifest.SigningBytes(), gcas.staticPrivateKey)
+	manifest.Signature = hex.EncodeToString(sig[:])
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return fmt.Errorf("unable to encode manifest: %v", err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     BackupManifestFile,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Unix(manifest.CreatedAt, 0),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write manifest header: %v", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("unable to write manifest: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("unable to finish tar: %v", err)
+	}
+	return zw.Close()
+}
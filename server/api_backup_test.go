@@ -0,0 +1,232 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// requestBackup posts a backup request to the server and returns the status
+// and the body of the response.
+func requestBackup(t *testing.T, server *GCAServer, request BackupRequest) (int, []byte) {
+	t.Helper()
+	body, _ := json.Marshal(request)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/admin/backup", server.httpPort), "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+// rewriteBackup unpacks a backup, passes every entry through edit, and packs
+// it up again. Entries for which edit returns nil are dropped.
+func rewriteBackup(t *testing.T, backup []byte, edit func(name string, data []byte) []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(backup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(zw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		data = edit(hdr.Name, data)
+		if data == nil {
+			continue
+		}
+		hdr.Size = int64(len(data))
+		tw.WriteHeader(hdr)
+		tw.Write(data)
+	}
+	tw.Close()
+	zw.Close()
+	return out.Bytes()
+}
+
+// TestBackupRestore takes a backup of a server, restores it into a new
+// directory, and checks that the restored server has the same state.
+func TestBackupRestore(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 3, ePriv)); outcome != reportAccepted {
+		t.Fatal("report was not accepted:", outcome)
+	}
+
+	// Bad requests are refused.
+	now := time.Now().Unix()
+	unsigned := BackupRequest{Timestamp: now}
+	if status, _ := requestBackup(t, server, unsigned); status != http.StatusForbidden {
+		t.Fatal("unsigned backup request was not refused:", status)
+	}
+	stale := BackupRequest{Timestamp: now - 2*backupRequestWindow}
+	stale.Signature = glow.Sign(stale.SigningBytes(), gcaPrivKey)
+	if status, _ := requestBackup(t, server, stale); status != http.StatusBadRequest {
+		t.Fatal("stale backup request was not refused:", status)
+	}
+
+	// Take the backup, and check that the request can't be replayed.
+	request := BackupRequest{Timestamp: now}
+	request.Signature = glow.Sign(request.SigningBytes(), gcaPrivKey)
+	status, backup := requestBackup(t, server, request)
+	if status != http.StatusOK {
+		t.Fatalf("backup failed: %v %s", status, backup)
+	}
+	if status, _ := requestBackup(t, server, request); status != http.StatusConflict {
+		t.Fatal("replayed backup request was not refused:", status)
+	}
+
+	// The manifest comes last, and the logs are left out.
+	var names []string
+	rewriteBackup(t, backup, func(name string, data []byte) []byte {
+		names = append(names, name)
+		return data
+	})
+	if len(names) == 0 || names[len(names)-1] != BackupManifestFile {
+		t.Fatal("manifest is not the last entry of the backup:", names)
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "server.log") {
+			t.Fatal("backup contains the log:", name)
+		}
+	}
+
+	// Restoring the backup of a different server, restoring into a
+	// directory that is not empty, and restoring a tampered backup all
+	// fail and leave nothing behind.
+	otherKey, _ := glow.GenerateKeyPair()
+	wrongDir := filepath.Join(dir, "wrong")
+	if _, err := RestoreBackup(bytes.NewReader(backup), wrongDir, otherKey); err == nil {
+		t.Fatal("restored the backup of a different server")
+	}
+	if entries, _ := ioutil.ReadDir(wrongDir); len(entries) != 0 {
+		t.Fatal("failed restore left files behind:", len(entries))
+	}
+	if _, err := RestoreBackup(bytes.NewReader(backup), dir, glow.PublicKey{}); err == nil {
+		t.Fatal("restored into a directory that is not empty")
+	}
+	tampered := map[string][]byte{
+		"modified file": rewriteBackup(t, backup, func(name string, data []byte) []byte {
+			if name == EquipmentAuthorizationsFile {
+				data[len(data)-1] ^= 1
+			}
+			return data
+		}),
+		"missing file": rewriteBackup(t, backup, func(name string, data []byte) []byte {
+			if name == "server.keys" {
+				return nil
+			}
+			return data
+		}),
+		"missing manifest": rewriteBackup(t, backup, func(name string, data []byte) []byte {
+			if name == BackupManifestFile {
+				return nil
+			}
+			return data
+		}),
+	}
+	for name, b := range tampered {
+		tamperedDir := filepath.Join(dir, "tampered")
+		if _, err := RestoreBackup(bytes.NewReader(b), tamperedDir, server.staticPublicKey); err == nil {
+			t.Fatalf("%v: tampered backup was restored", name)
+		}
+		if entries, _ := ioutil.ReadDir(tamperedDir); len(entries) != 0 {
+			t.Fatalf("%v: failed restore left files behind", name)
+		}
+	}
+
+	// Restore the backup for real, and start a server from it. The backup
+	// gets restored to disk, so the restored server uses the files.
+	restoreDir := filepath.Join(dir, "restored")
+	useFileStorage(restoreDir)
+	manifest, err := RestoreBackup(bytes.NewReader(backup), restoreDir, server.staticPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.CreatedTimeslot != glow.CurrentTimeslot() || len(manifest.Files) != len(names)-1 {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+	// The WattTime credentials are not part of the storage, so they are
+	// only in the backup when the storage is the server directory.
+	if err := os.MkdirAll(filepath.Join(restoreDir, "watttime_data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"username", "password"} {
+		path := filepath.Join(restoreDir, "watttime_data", name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pubkey := server.staticPublicKey
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewGCAServer(restoreDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	restored.mu.RLock()
+	defer restored.mu.RUnlock()
+	if restored.staticPublicKey != pubkey || !restored.gcaPubkeyAvailable {
+		t.Fatal("restored server does not have the same keys")
+	}
+	if restored.equipment[ea.ShortID].PublicKey != ea.PublicKey {
+		t.Fatal("restored server is missing the equipment")
+	}
+	if restored.equipmentReports[ea.ShortID].PowerOutputs[3] != 5 {
+		t.Fatal("restored server is missing the report")
+	}
+}
+
+// TestBackupRestoreRefusesEscapes checks that a backup can't write outside of
+// the server directory.
+func TestBackupRestoreRefusesEscapes(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(zw)
+	tw.WriteHeader(&tar.Header{Name: "../escaped", Mode: 0644, Size: 2, Typeflag: tar.TypeReg})
+	tw.Write([]byte("hi"))
+	tw.Close()
+	zw.Close()
+	if _, err := RestoreBackup(&b, filepath.Join(dir, "server"), glow.PublicKey{}); err == nil {
+		t.Fatal("restored a backup with an escaping name")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Fatal("backup wrote outside of the server directory")
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+// api_banned_equipment.go contains an endpoint that lists the banned
+// equipment, along with why and when each piece of equipment was banned.
+//
+// Equipment can be banned for two reasons. The GCA orders a ban by signing a
+// second authorization for a ShortID that is already in use, in which case
+// the evidence is the set of conflicting authorizations. The equipment can
+// also ban itself by signing two different reports for the same timeslot, in
+// which case the evidence is the EquivocationProof.
+//
+// An equivocation ban takes effect at the timeslot of the conflicting
+// reports, and a GCA-ordered ban takes effect at the timeslot in which the
+// server noticed the conflicting authorizations. The reason and the timeslot
+// of every ban are persisted when the ban first happens, because they can't
+// be recovered from the evidence alone: the authorizations don't say when the
+// conflict was noticed. The records are
+// loaded before any of the evidence, so that replaying the evidence at
+// startup doesn't change when a ban took effect. Bans that predate the
+// records file get recorded with the timeslot of the first startup that
+// notices them.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// equipmentBanRecordSize is the size of a serialized equipmentBanRecord.
+const equipmentBanRecordSize = 4 + 1 + 4
+
+// The reasons that equipment can be banned for.
+const (
+	banReasonGCAOrdered   uint8 = 0
+	banReasonEquivocation uint8 = 1
+)
+
+// equipmentBanRecord contains the metadata of a ban.
+type equipmentBanRecord struct {
+	ShortID  uint32
+	Reason   uint8
+	Timeslot uint32 // The timeslot at which the ban took effect
+}
+
+// Serialize returns the binary representation of the record.
+func (ebr equipmentBanRecord) Serialize() []byte {
+	b := make([]byte, equipmentBanRecordSize)
+	binary.LittleEndian.PutUint32(b[0:], ebr.ShortID)
+	b[4] = ebr.Reason
+	binary.LittleEndian.PutUint32(b[5:], ebr.Timeslot)
+	return b
+}
+
+// deserializeEquipmentBanRecord reverses a call to Serialize.
+func deserializeEquipmentBanRecord(b []byte) (equipmentBanRecord, error) {
+	var ebr equipmentBanRecord
+	if len(b) != equipmentBanRecordSize {
+		return ebr, fmt.Errorf("unexpected ban record size: %v", len(b))
+	}
+	ebr.ShortID = binary.LittleEndian.Uint32(b[0:])
+	ebr.Reason = b[4]
+	ebr.Timeslot = binary.LittleEndian.Uint32(b[5:])
+	if ebr.Reason != banReasonGCAOrdered && ebr.Reason != banReasonEquivocation {
+		return ebr, fmt.Errorf("unknown ban reason: %v", ebr.Reason)
+	}
+	return ebr, nil
+}
+
+// BannedEquipment describes a single banned piece of equipment. Exactly one
+// of Authorizations and Equivocation is set, depending on the reason.
+type BannedEquipment struct {
+	PublicKey      string                        `json:"pubkey"` // The key of the equipment, hex encoded
+	ShortID        uint32                        `json:"short_id"`
+	Reason         string                        `json:"reason"`   // Either "gca_ordered" or "equivocation"
+	Timeslot       uint32                        `json:"timeslot"` // The timeslot at which the ban took effect
+	Authorizations []glow.EquipmentAuthorization `json:"authorizations,omitempty"`
+	Equivocation   *EquivocationProof            `json:"equivocation,omitempty"`
+}
+
+// recordBan persists the metadata of a ban and lets the webhooks know about
+// it, unless the ban was already recorded. It has to be called before the
+// equipment gets removed from the state.
+func (gcas *GCAServer) recordBan(shortID uint32, reason uint8, timeslot uint32) {
+	if _, exists := gcas.equipmentBanRecords[shortID]; exists {
+		return
+	}
+	ebr := equipmentBanRecord{ShortID: shortID, Reason: reason, Timeslot: timeslot}
+	gcas.equipmentBanRecords[shortID] = ebr
+	if err := gcas.staticStorage.AppendFile(BannedEquipmentFile, ebr.Serialize(), 0644); err != nil {
+		gcas.logger.Errorf("unable to save ban record: %v", err)
+	}
+	gcas.queueEquipmentEvent(webhookEventBanned, shortID, gcas.equipment[shortID].PublicKey, timeslot)
+}
+
+// banConflictingAuthorizations bans a ShortID that the GCA has signed two
+// different authorizations for, keeping both authorizations as evidence.
+func (gcas *GCAServer) banConflictingAuthorizations(current glow.EquipmentAuthorization, ea glow.EquipmentAuthorization) {
+	gcas.equipmentBanAuths[ea.ShortID] = []glow.EquipmentAuthorization{current, ea}
+	gcas.recordBan(ea.ShortID, banReasonGCAOrdered, gcas.currentTimeslot())
+	gcas.banEquipment(ea.ShortID)
+}
+
+// loadEquipmentBanRecords loads the ban metadata from disk, creating the file
+// if it does not exist yet. This needs to happen before the equipment is
+// loaded.
+func (gcas *GCAServer) loadEquipmentBanRecords() error {
+	data, err := gcas.staticStorage.ReadFile(BannedEquipmentFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(BannedEquipmentFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read banned equipment file: %v", err)
+	}
+	if len(data)%equipmentBanRecordSize != 0 {
+		return fmt.Errorf("banned equipment file has an unexpected size")
+	}
+	for i := 0; i < len(data); i += equipmentBanRecordSize {
+		ebr, err := deserializeEquipmentBanRecord(data[i : i+equipmentBanRecordSize])
+		if err != nil {
+			return fmt.Errorf("unable to decode ban record: %v", err)
+		}
+		if _, exists := gcas.equipmentBanRecords[ebr.ShortID]; !exists {
+			gcas.equipmentBanRecords[ebr.ShortID] = ebr
+		}
+	}
+	return nil
+}
+
+// buildBannedEquipment returns the description of a banned ShortID.
+func (gcas *GCAServer) buildBannedEquipment(shortID uint32) BannedEquipment {
+	ebr := gcas.equipmentBanRecords[shortID]
+	be := BannedEquipment{
+		ShortID:  shortID,
+		Timeslot: ebr.Timeslot,
+	}
+	if ebr.Reason == banReasonEquivocation {
+		ep := gcas.equipmentBanProofs[shortID]
+		be.Reason = "equivocation"
+		be.PublicKey = hex.EncodeToString(ep.Authorization.PublicKey[:])
+		be.Equivocation = &ep
+	} else {
+		auths := gcas.equipmentBanAuths[shortID]
+		be.Reason = "gca_ordered"
+		if len(auths) > 0 {
+			be.PublicKey = hex.EncodeToString(auths[0].PublicKey[:])
+		}
+		be.Authorizations = auths
+	}
+	return be
+}
+
+// BannedEquipmentHandler returns all of the banned equipment. The optional
+// 'pubkey' query parameter limits the response to the equipment with that
+// key, which for a GCA-ordered ban matches any of the conflicting
+// authorizations.
+func (gcas *GCAServer) BannedEquipmentHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for banned equipment.")
+		return
+	}
+
+	var pk glow.PublicKey
+	pkStr := r.URL.Query().Get("pubkey")
+	if pkStr != "" {
+		var err error
+		pk, err = glow.ParsePublicKey(pkStr)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid pubkey")
+			return
+		}
+	}
+
+	gcas.mu.RLock()
+	banned := make([]BannedEquipment, 0, len(gcas.equipmentBans))
+	for shortID := range gcas.equipmentBans {
+		be := gcas.buildBannedEquipment(shortID)
+		if pkStr != "" && !be.hasPublicKey(pk) {
+			continue
+		}
+		banned = append(banned, be)
+	}
+	gcas.mu.RUnlock()
+
+	sort.Slice(banned, func(i, j int) bool { return banned[i].ShortID < banned[j].ShortID })
+	gcas.writeJSONResponse(w, r, banned)
+}
+
+// hasPublicKey returns whether the provided key belongs to the banned
+// equipment.
+func (be BannedEquipment) hasPublicKey(pk glow.PublicKey) bool {
+	if be.Equivocation != nil {
+		return be.Equivocation.Authorization.PublicKey == pk
+	}
+	for _, ea := range be.Authorizations {
+		if ea.PublicKey == pk {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getBannedEquipment fetches the banned equipment with the provided query.
+func (gcas *GCAServer) getBannedEquipment(query string) (int, []BannedEquipment, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/banned-equipment?%v", gcas.httpPort, query))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil, nil
+	}
+	var banned []BannedEquipment
+	err = json.NewDecoder(resp.Body).Decode(&banned)
+	return resp.StatusCode, banned, err
+}
+
+// TestBannedEquipment checks that both kinds of bans are listed with their
+// evidence, and that the ban timeslots survive a restart.
+func TestBannedEquipment(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(20)
+	defer glow.SetCurrentTimeslot(0)
+
+	// The GCA bans ShortID 1 by authorizing it twice.
+	original, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, _ := glow.GenerateKeyPair()
+	replacement := SignEquipmentAuthorization(glow.EquipmentAuthorization{ShortID: 1, PublicKey: pk, Capacity: 1000}, gcaPrivKey)
+	if err := server.AuthorizeEquipment(replacement, gcaPrivKey); err == nil {
+		t.Fatal("conflicting authorization did not cause a ban")
+	}
+
+	// ShortID 2 bans itself by signing conflicting reports.
+	ea, ePriv, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, power := range []uint64{5, 7} {
+		er := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 12, PowerOutput: power}
+		er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+		server.managedHandleEquipmentReport(er.Serialize())
+	}
+
+	check := func() {
+		t.Helper()
+		status, banned, err := server.getBannedEquipment("")
+		if err != nil || status != http.StatusOK {
+			t.Fatal("unable to fetch banned equipment:", status, err)
+		}
+		if len(banned) != 2 {
+			t.Fatalf("unexpected banned equipment: %+v", banned)
+		}
+		gca, equivocation := banned[0], banned[1]
+		if gca.ShortID != 1 || gca.Reason != "gca_ordered" || gca.Timeslot != 20 || gca.PublicKey != hex.EncodeToString(original.PublicKey[:]) {
+			t.Errorf("unexpected gca ordered ban: %+v", gca)
+		}
+		if len(gca.Authorizations) != 2 || gca.Authorizations[0] != original || gca.Authorizations[1] != replacement || gca.Equivocation != nil {
+			t.Errorf("unexpected gca ordered evidence: %+v", gca)
+		}
+		if equivocation.ShortID != 2 || equivocation.Reason != "equivocation" || equivocation.Timeslot != 12 || equivocation.PublicKey != hex.EncodeToString(ea.PublicKey[:]) {
+			t.Errorf("unexpected equivocation ban: %+v", equivocation)
+		}
+		if equivocation.Equivocation == nil || server.verifyEquivocationProof(*equivocation.Equivocation) != nil || equivocation.Authorizations != nil {
+			t.Errorf("unexpected equivocation evidence: %+v", equivocation)
+		}
+
+		// Either of the conflicting keys finds the GCA ordered ban.
+		for _, pk := range []glow.PublicKey{original.PublicKey, replacement.PublicKey} {
+			_, filtered, err := server.getBannedEquipment("pubkey=" + hex.EncodeToString(pk[:]))
+			if err != nil || len(filtered) != 1 || filtered[0].ShortID != 1 {
+				t.Errorf("filter did not find the gca ordered ban: %+v %v", filtered, err)
+			}
+		}
+		_, filtered, err := server.getBannedEquipment("pubkey=" + hex.EncodeToString(ea.PublicKey[:]))
+		if err != nil || len(filtered) != 1 || filtered[0].ShortID != 2 {
+			t.Errorf("filter did not find the equivocation ban: %+v %v", filtered, err)
+		}
+		_, filtered, err = server.getBannedEquipment("pubkey=" + hex.EncodeToString(make([]byte, 32)))
+		if err != nil || len(filtered) != 0 {
+			t.Errorf("filter matched unknown equipment: %+v %v", filtered, err)
+		}
+		if status, _, _ := server.getBannedEquipment("pubkey=zz"); status != http.StatusBadRequest {
+			t.Error("invalid pubkey was accepted:", status)
+		}
+	}
+	check()
+
+	// The ban timeslots don't change when the bans get replayed after a
+	// restart at a later timeslot.
+	server.Close()
+	glow.SetCurrentTimeslot(30)
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	check()
+}
@@ -0,0 +1,144 @@
+package server
+
+// api_batch_reports.go contains an endpoint that allows equipment to submit a
+// large number of reports at once over HTTP. This is primarily useful for
+// devices that have been offline for a few hours, as replaying dozens of UDP
+// packets over a poor cell connection means that some of them never make it.
+//
+// Each report in the batch is signed by the equipment and gets validated
+// independently, using the same code path as the UDP listener. A single bad
+// report only affects its own result, the rest of the batch is still
+// processed.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// BatchReportResult contains the result for a single report in a batch.
+type BatchReportResult struct {
+	ShortID  uint32
+	Timeslot uint32
+	Status   string // Either "accepted", "duplicate", or "rejected"
+	Reason   string // The reason the report was rejected, empty otherwise
+	Code     string // The error code of a rejected report, empty otherwise
+}
+
+// BatchReportsResponse contains the results of a batch submission, in the
+// same order as the reports in the request.
+type BatchReportsResponse struct {
+	Results   []BatchReportResult
+	Signature glow.Signature
+}
+
+// SigningBytes returns the bytes that should be signed by the GCA server to
+// authenticate the response.
+func (brr BatchReportsResponse) SigningBytes() []byte {
+	b := []byte("BatchReportsResponse")
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(brr.Results)))
+	for _, r := range brr.Results {
+		b = binary.LittleEndian.AppendUint32(b, r.ShortID)
+		b = binary.LittleEndian.AppendUint32(b, r.Timeslot)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(r.Status)))
+		b = append(b, r.Status...)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(r.Reason)))
+		b = append(b, r.Reason...)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(r.Code)))
+		b = append(b, r.Code...)
+	}
+	return b
+}
+
+// newBatchReportResult converts the outcome of a report into a batch result.
+func newBatchReportResult(report glow.EquipmentReport, ro reportOutcome) BatchReportResult {
+	result := BatchReportResult{
+		ShortID:  report.ShortID,
+		Timeslot: report.Timeslot,
+	}
+	switch ro {
+	case reportAccepted:
+		result.Status = "accepted"
+	case reportDuplicate:
+		result.Status = "duplicate"
+	default:
+		result.Status = "rejected"
+		result.Reason = ro.String()
+		result.Code = ro.apiErrorCode()
+	}
+	return result
+}
+
+// BatchReportsHandler accepts a batch of equipment reports. The body can
+// either be a JSON array of EquipmentReport objects, or when the Content-Type
+// is application/octet-stream, the serialized reports concatenated together.
+func (gcas *GCAServer) BatchReportsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for batch reports.")
+		return
+	}
+
+	// Decode the reports. The body is limited to a generous multiple of
+	// the largest valid batch so that nobody can make the server read an
+	// arbitrary amount of data.
+	body := http.MaxBytesReader(w, r.Body, maxBatchReports*1024)
+	var untrustedReports []glow.EquipmentReport
+	if r.Header.Get("Content-Type") == "application/octet-stream" {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "Unable to read request body")
+			return
+		}
+		if len(data)%equipmentReportSize != 0 {
+			gcas.writeError(w, ErrCodeMalformedRequest, fmt.Sprintf("Request body must be a multiple of %d bytes", equipmentReportSize))
+			return
+		}
+		for i := 0; i < len(data); i += equipmentReportSize {
+			report, err := glow.DeserializeReport(data[i : i+equipmentReportSize])
+			if err != nil {
+				gcas.writeError(w, ErrCodeMalformedRequest, "Unable to decode report")
+				return
+			}
+			untrustedReports = append(untrustedReports, report)
+		}
+	} else {
+		if err := json.NewDecoder(body).Decode(&untrustedReports); err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+			gcas.requestLogger(r).Warn("Failed to decode batch reports: ", err)
+			return
+		}
+	}
+	if len(untrustedReports) == 0 {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Batch must contain at least one report")
+		return
+	}
+	if len(untrustedReports) > maxBatchReports {
+		gcas.writeError(w, ErrCodeRequestTooLarge, fmt.Sprintf("Batch contains %d reports, the limit is %d", len(untrustedReports), maxBatchReports))
+		return
+	}
+
+	// Process every report independently.
+	var resp BatchReportsResponse
+	for _, report := range untrustedReports {
+		outcome, _ := gcas.managedHandleEquipmentReport(report.Serialize())
+		result := newBatchReportResult(report, outcome)
+		if outcome == reportStale {
+			result.Reason = gcas.staleTimeslotReason(report.Timeslot)
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	resp.Signature = glow.Sign(resp.SigningBytes(), gcas.staticPrivateKey)
+
+	// Send the response as JSON with a status code of OK
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		gcas.requestLogger(r).Error("Failed to encode JSON response:", err)
+		return
+	}
+}
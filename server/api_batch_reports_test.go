@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postBatchReports submits a batch of reports to the server.
+func (gcas *GCAServer) postBatchReports(contentType string, body []byte) (int, BatchReportsResponse, error) {
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/equipment-reports/batch", gcas.httpPort), contentType, bytes.NewReader(body))
+	if err != nil {
+		return 0, BatchReportsResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, BatchReportsResponse{}, nil
+	}
+	var brr BatchReportsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&brr); err != nil {
+		return 0, BatchReportsResponse{}, err
+	}
+	return resp.StatusCode, brr, nil
+}
+
+// TestBatchReports submits a batch that mixes valid, duplicate, and tampered
+// reports and checks that each report gets the right result.
+func TestBatchReports(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(6, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the batch.
+	makeReport := func(timeslot uint32, output uint64) glow.EquipmentReport {
+		er := glow.EquipmentReport{
+			ShortID:     ea.ShortID,
+			Timeslot:    timeslot,
+			PowerOutput: output,
+		}
+		er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+		return er
+	}
+	tampered := makeReport(3, 50)
+	tampered.PowerOutput = 60
+	unknown := makeReport(4, 50)
+	unknown.ShortID = ea.ShortID + 1
+	batch := []glow.EquipmentReport{
+		makeReport(1, 50),
+		makeReport(1, 50), // duplicate of the first report
+		makeReport(2, 70),
+		tampered,
+		unknown,
+		makeReport(5000, 50), // too far in the future
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, brr, err := server.postBatchReports("application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("unexpected status:", status)
+	}
+	if !glow.Verify(server.staticPublicKey, brr.SigningBytes(), brr.Signature) {
+		t.Fatal("bad signature on batch response")
+	}
+	expected := []BatchReportResult{
+		{ShortID: 6, Timeslot: 1, Status: "accepted"},
+		{ShortID: 6, Timeslot: 1, Status: "duplicate"},
+		{ShortID: 6, Timeslot: 2, Status: "accepted"},
+		{ShortID: 6, Timeslot: 3, Status: "rejected", Reason: "bad_signature", Code: ErrCodeInvalidSignature},
+		{ShortID: 7, Timeslot: 4, Status: "rejected", Reason: "unauthorized_device", Code: ErrCodeUnknownDevice},
+		{ShortID: 6, Timeslot: 5000, Status: "rejected", Reason: "timeslot 5000 is outside of the accepted window, which is timeslots 0 through 432", Code: ErrCodeStaleTimeslot},
+	}
+	if len(brr.Results) != len(expected) {
+		t.Fatal("wrong number of results:", len(brr.Results))
+	}
+	for i := range expected {
+		if brr.Results[i] != expected[i] {
+			t.Error("unexpected result at", i, brr.Results[i])
+		}
+	}
+
+	// The valid reports should have landed, and the tampered report
+	// should not have affected its timeslot.
+	server.mu.Lock()
+	reports := server.equipmentReports[ea.ShortID]
+	if reports.PowerOutputs[1] != 50 || reports.PowerOutputs[2] != 70 || reports.PowerOutputs[3] != 0 {
+		server.mu.Unlock()
+		t.Fatal("batch was not integrated correctly")
+	}
+	server.mu.Unlock()
+
+	// Submit the same kind of batch using the binary format.
+	var blob []byte
+	blob = append(blob, makeReport(8, 40).Serialize()...)
+	blob = append(blob, tampered.Serialize()...)
+	status, brr, err = server.postBatchReports("application/octet-stream", blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(brr.Results) != 2 || brr.Results[0].Status != "accepted" || brr.Results[1].Reason != "bad_signature" {
+		t.Fatal("unexpected binary batch response:", status, brr.Results)
+	}
+
+	// Batches that are too large, empty, or malformed should be rejected
+	// outright.
+	var big []byte
+	for i := 0; i < maxBatchReports+1; i++ {
+		big = append(big, makeReport(10, 40).Serialize()...)
+	}
+	status, _, err = server.postBatchReports("application/octet-stream", big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatal("expected an oversized batch to be rejected:", status)
+	}
+	for _, bad := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{"application/json", []byte("[]")},
+		{"application/json", []byte("not json")},
+		{"application/octet-stream", blob[:100]},
+	} {
+		status, _, err = server.postBatchReports(bad.contentType, bad.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusBadRequest {
+			t.Error("expected a bad request for", string(bad.body), "got", status)
+		}
+	}
+}
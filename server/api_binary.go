@@ -0,0 +1,376 @@
+package server
+
+// api_binary.go contains the binary encodings of the all-device-stats and
+// historical-reports endpoints. A request with glow.BinaryContentType in its
+// Accept header gets the binary encoding, everything else keeps getting JSON.
+// The encodings are built from the primitives in glow/binary_encoding.go, and
+// the client package has the matching decoders.
+//
+// Binary responses are never wrapped in a glow.SignedResponse, the 'signed'
+// query parameter is ignored. The device stats carry the signature of the
+// server, and every historical report carries the signature of its device,
+// which covers everything that the receiver needs to trust.
+//
+// The encoding of AllDeviceStats is:
+//
+//	version (varint)
+//	timeslot offset (4 bytes)
+//	signature (64 bytes)
+//	total devices (varint)
+//	1 and the version, commit, and build date of the build, or 0 (varint)
+//	number of devices (varint)
+//	for every device:
+//		public key (32 bytes)
+//		2016 power outputs (varint each)
+//		the impact rates as runs of equal values, each a length (varint)
+//		followed by the rate (8 bytes), adding up to 2016 rates
+//		region (string)
+//		the stale impact rates, the corrected timeslots, and the outage
+//		timeslots, each a number of indexes (varint) followed by the
+//		indexes (varint each)
+//		flags (varint), 1 if the device is expired and 2 if it is online
+//		the last seen timeslot plus one, or 0 if the device has never
+//		reported (varint)
+//
+// The encoding of the historical reports is written as it gets streamed:
+//
+//	version (varint)
+//	public key (32 bytes)
+//	start, end (signed varint each)
+//	chunks of reports, each a number of reports (varint) followed by the
+//	reports, and a final chunk with zero reports
+//	every report is the ShortID, timeslot, and power output (varint each)
+//	followed by the signature (64 bytes) and the unix time at which the
+//	server received the report, or 0 (signed varint)
+//	number of gaps (varint), followed by the start and end of every gap
+//	(signed varint each)
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+const (
+	// allDeviceStatsBinaryVersion is the version of the binary encoding of
+	// AllDeviceStats.
+	allDeviceStatsBinaryVersion = 3
+
+	// historicalReportsBinaryVersion is the version of the binary encoding
+	// of the historical reports. Version 2 added the receipts of the
+	// reports.
+	historicalReportsBinaryVersion = 2
+
+	// minBinaryDeviceSize is the smallest that an encoded device can be:
+	// a key, a byte per power output, a single run of impact rates, an
+	// empty region, three empty lists of indexes, no flags, and no last
+	// seen timeslot.
+	minBinaryDeviceSize = 32 + 2016 + 1 + 8 + 1 + 3 + 2
+
+	// minBinaryReportSize is the smallest that an encoded historical
+	// report can be.
+	minBinaryReportSize = 3 + 64 + 1
+)
+
+// HistoricalReportsResponse is the full response of the historical-reports
+// endpoint, in either encoding.
+type HistoricalReportsResponse struct {
+	PublicKey string                 `json:"pubkey"`
+	Start     int64                  `json:"start"`
+	End       int64                  `json:"end"`
+	Reports   []HistoricalReport     `json:"reports"`
+	Gaps      []HistoricalReportsGap `json:"gaps"`
+}
+
+// wantsBinary returns whether the Accept header of the request asks for the
+// binary encoding.
+func wantsBinary(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == glow.BinaryContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// binaryETag returns the ETag of the binary encoding of a response, which has
+// to differ from the ETag of the JSON encoding.
+func binaryETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + `-bin"`
+}
+
+// writeBinaryResponse writes an encoded response.
+func (gcas *GCAServer) writeBinaryResponse(w http.ResponseWriter, r *http.Request, data []byte) {
+	w.Header().Set("Content-Type", glow.BinaryContentType)
+	if _, err := w.Write(data); err != nil {
+		gcas.requestLogger(r).Warn("Unable to write binary response:", err)
+	}
+}
+
+// MarshalBinary returns the binary encoding of the stats.
+func (ads AllDeviceStats) MarshalBinary() ([]byte, error) {
+	var e glow.BinaryEncoder
+	e.Uvarint(allDeviceStatsBinaryVersion)
+	e.Uint32(ads.TimeslotOffset)
+	e.Fixed(ads.Signature[:])
+	if ads.TotalDevices < 0 {
+		return nil, fmt.Errorf("negative total devices")
+	}
+	e.Uvarint(uint64(ads.TotalDevices))
+	if ads.Build != nil {
+		e.Uvarint(1)
+		e.String(ads.Build.Version)
+		e.String(ads.Build.Commit)
+		e.String(ads.Build.BuildDate)
+	} else {
+		e.Uvarint(0)
+	}
+	e.Uvarint(uint64(len(ads.Devices)))
+	for i := range ads.Devices {
+		ds := &ads.Devices[i]
+		e.Fixed(ds.PublicKey[:])
+		for _, po := range ds.PowerOutputs {
+			e.Uvarint(po)
+		}
+		for j := 0; j < len(ds.ImpactRates); {
+			run := 1
+			bits := math.Float64bits(ds.ImpactRates[j])
+			for j+run < len(ds.ImpactRates) && math.Float64bits(ds.ImpactRates[j+run]) == bits {
+				run++
+			}
+			e.Uvarint(uint64(run))
+			e.Float64(ds.ImpactRates[j])
+			j += run
+		}
+		e.String(ds.Region)
+		for _, indexes := range [][]int{ds.StaleImpactRates, ds.CorrectedTimeslots, ds.OutageTimeslots} {
+			e.Uvarint(uint64(len(indexes)))
+			for _, index := range indexes {
+				if index < 0 {
+					return nil, fmt.Errorf("negative timeslot index")
+				}
+				e.Uvarint(uint64(index))
+			}
+		}
+		var flags uint64
+		if ds.Expired {
+			flags |= 1
+		}
+		if ds.Online {
+			flags |= 2
+		}
+		e.Uvarint(flags)
+		if ds.LastSeenTimeslot != nil {
+			e.Uvarint(uint64(*ds.LastSeenTimeslot) + 1)
+		} else {
+			e.Uvarint(0)
+		}
+	}
+	return e.Bytes(), nil
+}
+
+// decodeTimeslotIndexes decodes a list of indexes into the 2016 timeslots of
+// a week.
+func decodeTimeslotIndexes(d *glow.BinaryDecoder) []int {
+	var indexes []int
+	n := d.Count(1)
+	for j := 0; j < n && d.Err() == nil; j++ {
+		index := d.Uvarint()
+		if index >= 2016 {
+			d.Fail(fmt.Errorf("timeslot index out of range"))
+		}
+		indexes = append(indexes, int(index))
+	}
+	return indexes
+}
+
+// UnmarshalBinary decodes the binary encoding of the stats. The signature is
+// not checked.
+func (ads *AllDeviceStats) UnmarshalBinary(data []byte) error {
+	d := glow.NewBinaryDecoder(data)
+	if version := d.Uvarint(); d.Err() == nil && version != allDeviceStatsBinaryVersion {
+		return fmt.Errorf("unknown device stats encoding version %v", version)
+	}
+	var decoded AllDeviceStats
+	decoded.TimeslotOffset = d.Uint32()
+	d.Fixed(decoded.Signature[:])
+	total := d.Uvarint()
+	if total > math.MaxInt32 {
+		d.Fail(fmt.Errorf("total devices out of range"))
+	}
+	decoded.TotalDevices = int(total)
+	switch d.Uvarint() {
+	case 0:
+	case 1:
+		decoded.Build = &BuildInfo{Version: d.String(), Commit: d.String(), BuildDate: d.String()}
+	default:
+		d.Fail(fmt.Errorf("invalid build marker"))
+	}
+	numDevices := d.Count(minBinaryDeviceSize)
+	if numDevices > 0 {
+		decoded.Devices = make([]DeviceStats, numDevices)
+	}
+	for i := 0; i < numDevices && d.Err() == nil; i++ {
+		ds := &decoded.Devices[i]
+		d.Fixed(ds.PublicKey[:])
+		for j := range ds.PowerOutputs {
+			ds.PowerOutputs[j] = d.Uvarint()
+		}
+		for j := 0; j < len(ds.ImpactRates) && d.Err() == nil; {
+			run := d.Uvarint()
+			rate := d.Float64()
+			if run == 0 || run > uint64(len(ds.ImpactRates)-j) {
+				d.Fail(fmt.Errorf("invalid run of impact rates"))
+				break
+			}
+			for k := 0; k < int(run); k++ {
+				ds.ImpactRates[j+k] = rate
+			}
+			j += int(run)
+		}
+		ds.Region = d.String()
+		ds.StaleImpactRates = decodeTimeslotIndexes(d)
+		ds.CorrectedTimeslots = decodeTimeslotIndexes(d)
+		ds.OutageTimeslots = decodeTimeslotIndexes(d)
+		flags := d.Uvarint()
+		lastSeen := d.Uvarint()
+		if flags > 3 || lastSeen > math.MaxUint32+1 || (flags&2 != 0 && lastSeen == 0) {
+			d.Fail(fmt.Errorf("invalid device status"))
+		}
+		ds.Expired = flags&1 != 0
+		ds.Online = flags&2 != 0
+		if lastSeen > 0 {
+			timeslot := uint32(lastSeen - 1)
+			unix := glow.TimeslotToUnix(timeslot)
+			ds.LastSeenTimeslot, ds.LastSeenUnix = &timeslot, &unix
+		}
+	}
+	if d.Err() == nil && d.Remaining() != 0 {
+		d.Fail(fmt.Errorf("device stats have %v trailing bytes", d.Remaining()))
+	}
+	if err := d.Err(); err != nil {
+		return fmt.Errorf("unable to decode device stats: %v", err)
+	}
+	*ads = decoded
+	return nil
+}
+
+// appendHistoricalHeader appends the part of the binary encoding of the
+// historical reports that comes before the reports.
+func appendHistoricalHeader(e *glow.BinaryEncoder, publicKey glow.PublicKey, start, end int64) {
+	e.Uvarint(historicalReportsBinaryVersion)
+	e.Fixed(publicKey[:])
+	e.Varint(start)
+	e.Varint(end)
+}
+
+// appendHistoricalChunk appends a chunk of reports to the binary encoding of
+// the historical reports. An empty chunk ends the reports, so nothing is
+// appended for an empty set of reports.
+func appendHistoricalChunk(e *glow.BinaryEncoder, reports []receivedReport) {
+	if len(reports) == 0 {
+		return
+	}
+	e.Uvarint(uint64(len(reports)))
+	for _, report := range reports {
+		e.Uvarint(uint64(report.ShortID))
+		e.Uvarint(uint64(report.Timeslot))
+		e.Uvarint(report.PowerOutput)
+		e.Fixed(report.Signature[:])
+		e.Varint(report.ReceivedAt)
+	}
+}
+
+// appendHistoricalTrailer appends the end of the reports and the gaps to the
+// binary encoding of the historical reports.
+func appendHistoricalTrailer(e *glow.BinaryEncoder, gaps []HistoricalReportsGap) {
+	e.Uvarint(0)
+	e.Uvarint(uint64(len(gaps)))
+	for _, gap := range gaps {
+		e.Varint(gap.Start)
+		e.Varint(gap.End)
+	}
+}
+
+// MarshalBinary returns the binary encoding of the historical reports, as the
+// endpoint would stream it.
+func (hr HistoricalReportsResponse) MarshalBinary() ([]byte, error) {
+	publicKey, err := glow.ParsePublicKey(hr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	var e glow.BinaryEncoder
+	appendHistoricalHeader(&e, publicKey, hr.Start, hr.End)
+	reports := make([]receivedReport, 0, len(hr.Reports))
+	for _, report := range hr.Reports {
+		sig, err := hex.DecodeString(report.Signature)
+		if err != nil || len(sig) != len(glow.Signature{}) {
+			return nil, fmt.Errorf("invalid signature on report for timeslot %v", report.Timeslot)
+		}
+		er := glow.EquipmentReport{ShortID: report.ShortID, Timeslot: report.Timeslot, PowerOutput: report.PowerOutput}
+		copy(er.Signature[:], sig)
+		reports = append(reports, receivedReport{EquipmentReport: er, ReceivedAt: report.ReceivedAt})
+	}
+	appendHistoricalChunk(&e, reports)
+	appendHistoricalTrailer(&e, hr.Gaps)
+	return e.Bytes(), nil
+}
+
+// UnmarshalBinary decodes the binary encoding of the historical reports. The
+// signatures of the reports are not checked.
+func (hr *HistoricalReportsResponse) UnmarshalBinary(data []byte) error {
+	d := glow.NewBinaryDecoder(data)
+	if version := d.Uvarint(); d.Err() == nil && version != historicalReportsBinaryVersion {
+		return fmt.Errorf("unknown historical reports encoding version %v", version)
+	}
+	var publicKey glow.PublicKey
+	d.Fixed(publicKey[:])
+	decoded := HistoricalReportsResponse{
+		PublicKey: hex.EncodeToString(publicKey[:]),
+		Start:     d.Varint(),
+		End:       d.Varint(),
+		Reports:   []HistoricalReport{},
+		Gaps:      []HistoricalReportsGap{},
+	}
+	for d.Err() == nil {
+		n := d.Count(minBinaryReportSize)
+		if n == 0 {
+			break
+		}
+		for i := 0; i < n && d.Err() == nil; i++ {
+			shortID, timeslot := d.Uvarint(), d.Uvarint()
+			if shortID > math.MaxUint32 || timeslot > math.MaxUint32 {
+				d.Fail(fmt.Errorf("report field out of range"))
+			}
+			report := HistoricalReport{
+				ShortID:     uint32(shortID),
+				Timeslot:    uint32(timeslot),
+				Timestamp:   glow.TimeslotToUnix(uint32(timeslot)),
+				PowerOutput: d.Uvarint(),
+			}
+			var sig glow.Signature
+			d.Fixed(sig[:])
+			report.Signature = hex.EncodeToString(sig[:])
+			report.ReceivedAt = d.Varint()
+			decoded.Reports = append(decoded.Reports, report)
+		}
+	}
+	numGaps := d.Count(2)
+	for i := 0; i < numGaps && d.Err() == nil; i++ {
+		decoded.Gaps = append(decoded.Gaps, HistoricalReportsGap{Start: d.Varint(), End: d.Varint()})
+	}
+	if d.Err() == nil && d.Remaining() != 0 {
+		d.Fail(fmt.Errorf("historical reports have %v trailing bytes", d.Remaining()))
+	}
+	if err := d.Err(); err != nil {
+		return fmt.Errorf("unable to decode historical reports: %v", err)
+	}
+	*hr = decoded
+	return nil
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// testBinaryStats returns stats for n devices with values in every field
+// that the binary encoding covers.
+func testBinaryStats(n int) AllDeviceStats {
+	rng := rand.New(rand.NewSource(int64(n)))
+	ads := AllDeviceStats{TimeslotOffset: 4032, TotalDevices: n + 3, Build: &BuildInfo{Version: "v1", Commit: "abc", BuildDate: "today"}}
+	rng.Read(ads.Signature[:])
+	for i := 0; i < n; i++ {
+		var ds DeviceStats
+		rng.Read(ds.PublicKey[:])
+		for j := 0; j < 2016; j++ {
+			switch rng.Intn(4) {
+			case 0:
+				ds.PowerOutputs[j] = uint64(rng.Intn(24))
+			case 1:
+				ds.PowerOutputs[j] = uint64(rng.Intn(5000))
+			case 2:
+				ds.PowerOutputs[j] = math.MaxInt64 - uint64(rng.Intn(100))
+			}
+		}
+		// Impact rates change every hour, and are zero for the last day.
+		for j := 0; j < 2016-288; j++ {
+			if j%12 == 0 {
+				ds.ImpactRates[j] = rng.Float64()
+			} else {
+				ds.ImpactRates[j] = ds.ImpactRates[j-1]
+			}
+		}
+		if i%2 == 0 {
+			ds.Region = "CAISO_NORTH"
+			ds.StaleImpactRates = []int{0, 5, 2015}
+			ds.CorrectedTimeslots = []int{7}
+			ds.OutageTimeslots = []int{8, 2015}
+			lastSeen, lastSeenUnix := uint32(4032+i), glow.TimeslotToUnix(uint32(4032+i))
+			ds.LastSeenTimeslot, ds.LastSeenUnix = &lastSeen, &lastSeenUnix
+			ds.Online = true
+			ds.Expired = i%4 == 0
+		}
+		ads.Devices = append(ads.Devices, ds)
+	}
+	return ads
+}
+
+// TestAllDeviceStatsBinary checks the round trip of the binary encoding of
+// the stats, and that damaged encodings are rejected.
+func TestAllDeviceStatsBinary(t *testing.T) {
+	for _, n := range []int{0, 1, 5} {
+		ads := testBinaryStats(n)
+		data, err := ads.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded AllDeviceStats
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, ads) {
+			t.Fatal("stats changed in the round trip")
+		}
+		for _, size := range []int{0, 1, 50, len(data) / 2, len(data) - 1} {
+			if err := decoded.UnmarshalBinary(data[:size]); err == nil {
+				t.Fatal("truncated stats were accepted at length", size)
+			}
+		}
+		if err := decoded.UnmarshalBinary(append(data, 0)); err == nil {
+			t.Fatal("stats with trailing data were accepted")
+		}
+	}
+	// A missing build survives as well.
+	ads := testBinaryStats(1)
+	ads.Build = nil
+	data, _ := ads.MarshalBinary()
+	var decoded AllDeviceStats
+	if err := decoded.UnmarshalBinary(data); err != nil || decoded.Build != nil {
+		t.Fatal("missing build did not survive the round trip:", err)
+	}
+}
+
+// getBinary fetches a route from the server in the binary encoding.
+func (gcas *GCAServer) getBinary(t *testing.T, route string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%v%v", gcas.httpPort, route), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json;q=0.5, "+glow.BinaryContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// TestBinaryEndpoints checks that the stats and the historical reports are
+// served in the binary encoding only when the request asks for it, and that
+// both encodings hold the same data. The impact rates aren't collected, so
+// the state doesn't change between the fetches.
+func TestBinaryEndpoints(t *testing.T) {
+	opts := DefaultServerOptions()
+	opts.DisableImpactCollection = true
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := uint32(0); ts < 20; ts += 3 {
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, ts, ePriv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+
+	// The stats.
+	route := "/api/v1/all-device-stats?timeslot_offset=0"
+	resp, data := server.getBinary(t, route, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != glow.BinaryContentType {
+		t.Fatal("unexpected response:", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var binaryStats AllDeviceStats
+	if err := binaryStats.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !glow.Verify(server.staticPublicKey, binaryStats.SigningBytes(), binaryStats.Signature) {
+		t.Fatal("binary stats are not signed by the server")
+	}
+	jsonResp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v%v", server.httpPort, route))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jsonStats AllDeviceStats
+	err = json.NewDecoder(jsonResp.Body).Decode(&jsonStats)
+	jsonResp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(binaryStats, jsonStats) {
+		t.Fatal("binary and JSON stats differ")
+	}
+	if !bytes.Contains([]byte(jsonResp.Header.Get("Vary")), []byte("Accept")) {
+		t.Error("stats don't vary by the Accept header")
+	}
+
+	// The two encodings have different ETags, and each of them can be
+	// revalidated.
+	etag := resp.Header.Get("ETag")
+	if etag == "" || etag == jsonResp.Header.Get("ETag") {
+		t.Fatal("binary stats need an ETag of their own:", etag)
+	}
+	resp, _ = server.getBinary(t, route, http.Header{"If-None-Match": {jsonResp.Header.Get("ETag")}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("binary stats matched the JSON ETag:", resp.StatusCode)
+	}
+	resp, _ = server.getBinary(t, route, http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatal("binary stats were not revalidated:", resp.StatusCode)
+	}
+
+	// The historical reports.
+	end := glow.TimeslotToUnix(4032)
+	route = fmt.Sprintf("/api/v1/historical-reports?pubkey=%x&start=0&end=%v", ea.PublicKey, end)
+	resp, data = server.getBinary(t, route, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != glow.BinaryContentType {
+		t.Fatal("unexpected response:", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var binaryReports HistoricalReportsResponse
+	if err := binaryReports.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	jsonResp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%v%v", server.httpPort, route))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jsonReports HistoricalReportsResponse
+	err = json.NewDecoder(jsonResp.Body).Decode(&jsonReports)
+	jsonResp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(binaryReports.Reports) != 7 || !reflect.DeepEqual(binaryReports, jsonReports) {
+		t.Fatalf("binary and JSON reports differ: %+v %+v", binaryReports, jsonReports)
+	}
+	if encoded, err := binaryReports.MarshalBinary(); err != nil || !bytes.Equal(encoded, data) {
+		t.Fatal("streamed encoding differs from MarshalBinary:", err)
+	}
+
+	// Errors are still JSON.
+	resp, data = server.getBinary(t, "/api/v1/all-device-stats?timeslot_offset=5", nil)
+	if resp.StatusCode != http.StatusBadRequest || !json.Valid(data) {
+		t.Fatal("unexpected error response:", resp.StatusCode, string(data))
+	}
+}
+
+// testBinaryReports returns a historical reports response with n reports.
+func testBinaryReports(n int) HistoricalReportsResponse {
+	pk, priv := glow.GenerateKeyPair()
+	hr := HistoricalReportsResponse{
+		PublicKey: hex.EncodeToString(pk[:]),
+		Start:     glow.GenesisTime,
+		End:       glow.GenesisTime + 1e6,
+		Reports:   []HistoricalReport{},
+		Gaps:      []HistoricalReportsGap{{Start: glow.GenesisTime, End: glow.GenesisTime + 600}},
+	}
+	for i := 0; i < n; i++ {
+		er := glow.EquipmentReport{ShortID: 3, Timeslot: uint32(i * 2), PowerOutput: uint64(i * 1000)}
+		er.Signature = glow.Sign(er.SigningBytes(), priv)
+		hr.Reports = append(hr.Reports, HistoricalReport{
+			ShortID:     er.ShortID,
+			Timeslot:    er.Timeslot,
+			Timestamp:   glow.TimeslotToUnix(er.Timeslot),
+			PowerOutput: er.PowerOutput,
+			Signature:   hex.EncodeToString(er.Signature[:]),
+		})
+	}
+	return hr
+}
+
+// FuzzAllDeviceStatsBinary checks that anything the decoder accepts encodes
+// back to data that decodes to the same stats.
+func FuzzAllDeviceStatsBinary(f *testing.F) {
+	for _, n := range []int{0, 1, 2} {
+		data, _ := testBinaryStats(n).MarshalBinary()
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var ads AllDeviceStats
+		if ads.UnmarshalBinary(data) != nil {
+			return
+		}
+		encoded, err := ads.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded AllDeviceStats
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+		// NaN rates are compared by their bits.
+		a, _ := ads.MarshalBinary()
+		b, _ := decoded.MarshalBinary()
+		if !bytes.Equal(a, b) || len(decoded.Devices) != len(ads.Devices) {
+			t.Fatal("stats changed in the round trip")
+		}
+	})
+}
+
+// FuzzHistoricalReportsBinary checks that anything the decoder accepts
+// encodes back to the same bytes.
+func FuzzHistoricalReportsBinary(f *testing.F) {
+	for _, n := range []int{0, 1, 10} {
+		data, _ := testBinaryReports(n).MarshalBinary()
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var hr HistoricalReportsResponse
+		if hr.UnmarshalBinary(data) != nil {
+			return
+		}
+		encoded, err := hr.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded HistoricalReportsResponse
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, hr) {
+			t.Fatal("reports changed in the round trip")
+		}
+	})
+}
+
+// BenchmarkDeviceStatsEncoding compares the cost and the size of the JSON and
+// the binary encoding of the stats of 100 devices.
+func BenchmarkDeviceStatsEncoding(b *testing.B) {
+	ads := testBinaryStats(100)
+	jsonData, err := json.Marshal(ads)
+	if err != nil {
+		b.Fatal(err)
+	}
+	binaryData, err := ads.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	var decoded AllDeviceStats
+	if err := json.Unmarshal(jsonData, &decoded); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("JSONEncode", func(b *testing.B) {
+		b.ReportMetric(float64(len(jsonData)), "payload-bytes")
+		for i := 0; i < b.N; i++ {
+			json.Marshal(ads)
+		}
+	})
+	b.Run("BinaryEncode", func(b *testing.B) {
+		b.ReportMetric(float64(len(binaryData)), "payload-bytes")
+		for i := 0; i < b.N; i++ {
+			ads.MarshalBinary()
+		}
+	})
+	b.Run("JSONDecode", func(b *testing.B) {
+		b.ReportMetric(float64(len(jsonData)), "payload-bytes")
+		for i := 0; i < b.N; i++ {
+			var decoded AllDeviceStats
+			json.Unmarshal(jsonData, &decoded)
+		}
+	})
+	b.Run("BinaryDecode", func(b *testing.B) {
+		b.ReportMetric(float64(len(binaryData)), "payload-bytes")
+		for i := 0; i < b.N; i++ {
+			var decoded AllDeviceStats
+			decoded.UnmarshalBinary(binaryData)
+		}
+	})
+}
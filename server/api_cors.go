@@ -0,0 +1,145 @@
+package server
+
+// api_cors.go lets browser dashboards call the HTTP API directly. The origins
+// that may do so are listed under cors_origins in server-config.json, and can
+// be changed with a reload like the other runtime settings. Requests from an
+// origin that isn't listed still get served, but without the CORS headers, so
+// the browser won't hand the response to the page. Preflight requests from
+// such an origin are refused outright.
+//
+// The wildcard origin "*" allows every origin. It is only accepted in internal
+// test mode, so a production server always has to name its dashboards.
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// The headers of a CORS response.
+const (
+	corsAllowMethods  = "GET, HEAD, POST"
+	corsAllowHeaders  = "Accept, Content-Type, If-None-Match, X-Request-ID"
+	corsExposeHeaders = "ETag, Retry-After, X-Request-ID, X-State-Version"
+	corsMaxAge        = "600"
+)
+
+// corsOrigins is a set of allowed origins. It is never modified after it is
+// created, a reload swaps in a new set.
+type corsOrigins struct {
+	any     bool
+	allowed map[string]struct{}
+}
+
+// corsPolicy holds the origins that may call the API.
+type corsPolicy struct {
+	origins atomic.Pointer[corsOrigins]
+}
+
+// set replaces the allowed origins.
+func (cp *corsPolicy) set(origins []string) {
+	co := &corsOrigins{allowed: make(map[string]struct{})}
+	for _, origin := range origins {
+		if origin == "*" {
+			co.any = true
+		}
+		co.allowed[origin] = struct{}{}
+	}
+	cp.origins.Store(co)
+}
+
+// list returns the allowed origins, sorted.
+func (cp *corsPolicy) list() []string {
+	co := cp.origins.Load()
+	if co == nil {
+		return nil
+	}
+	origins := make([]string, 0, len(co.allowed))
+	for origin := range co.allowed {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+// allows returns whether the provided origin may call the API.
+func (cp *corsPolicy) allows(origin string) bool {
+	co := cp.origins.Load()
+	if co == nil {
+		return false
+	}
+	if co.any {
+		return true
+	}
+	_, allowed := co.allowed[origin]
+	return allowed
+}
+
+// enabled returns whether any origin may call the API.
+func (cp *corsPolicy) enabled() bool {
+	co := cp.origins.Load()
+	return co != nil && len(co.allowed) > 0
+}
+
+// parseCORSOrigins checks the origins of the config file, and returns them in
+// their canonical form. An origin is a scheme and a host with an optional
+// port, without a path. The wildcard is only allowed in internal test mode.
+func parseCORSOrigins(origins []string, internalTestMode bool) ([]string, error) {
+	var parsed []string
+	for _, origin := range origins {
+		if origin == "*" {
+			if !internalTestMode {
+				return nil, fmt.Errorf("the wildcard origin is only allowed in internal test mode")
+			}
+			parsed = append(parsed, origin)
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin %q: %v", origin, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+			return nil, fmt.Errorf("invalid origin %q, expected a scheme and a host like https://dashboard.example.com", origin)
+		}
+		parsed = append(parsed, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	sort.Strings(parsed)
+	return parsed, nil
+}
+
+// handleCORS wraps the API so that requests from allowed origins get the CORS
+// headers, and preflight requests get answered without reaching the handlers
+// or the rate limits.
+func (gcas *GCAServer) handleCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		policy := &gcas.staticCORS
+		if origin == "" || !policy.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := policy.allows(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			if !allowed {
+				gcas.writeError(w, ErrCodeOriginNotAllowed, "Origin is not allowed to call this server")
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCORS checks the CORS headers for an allowed and a disallowed origin, and
+// the preflight requests of both.
+func TestCORS(t *testing.T) {
+	server, dir, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	base := "http://" + server.httpDialAddr()
+	allowed := "https://dashboard.example.com"
+	err = os.WriteFile(filepath.Join(dir, ServerConfigFile), []byte(`{"cors_origins": ["https://Dashboard.example.com"]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := server.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Changed) != 1 || !strings.Contains(res.Changed[0], "cors_origins") {
+		t.Fatal("unexpected changes:", res.Changed)
+	}
+
+	// do sends a request with the provided origin.
+	do := func(method, route, origin string, preflight bool) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, base+route, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", "content-type")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// An allowed origin gets the headers, and can read ETag and
+	// X-Request-ID.
+	resp := do("GET", "/api/v1/time", allowed, false)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != allowed {
+		t.Fatal("allowed origin did not get the cors headers:", resp.StatusCode, resp.Header)
+	}
+	expose := resp.Header.Get("Access-Control-Expose-Headers")
+	if !strings.Contains(expose, "ETag") || !strings.Contains(expose, "X-Request-ID") {
+		t.Fatal("custom headers are not exposed:", expose)
+	}
+	if resp.Header.Get("Vary") == "" {
+		t.Fatal("response does not vary by origin")
+	}
+
+	// A disallowed origin still gets served, but without the headers.
+	resp = do("GET", "/api/v1/time", "https://evil.example.com", false)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("disallowed origin got the cors headers:", resp.StatusCode, resp.Header)
+	}
+
+	// Preflights are answered without reaching the handlers or the write
+	// budget.
+	server.staticAPILimits.write.setLimits(time.Hour, 1)
+	for i := 0; i < 3; i++ {
+		resp = do("OPTIONS", "/api/v1/authorize-equipment", allowed, true)
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatal("preflight was not answered:", resp.StatusCode)
+		}
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != allowed || !strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), "POST") {
+		t.Fatal("preflight is missing the cors headers:", resp.Header)
+	}
+	if !strings.Contains(strings.ToLower(resp.Header.Get("Access-Control-Allow-Headers")), "content-type") {
+		t.Fatal("preflight does not allow the content type header:", resp.Header)
+	}
+	resp = do("OPTIONS", "/api/v1/authorize-equipment", "https://evil.example.com", true)
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("preflight from a disallowed origin was not refused:", resp.StatusCode)
+	}
+
+	// The wildcard is refused outside of internal test mode.
+	err = os.WriteFile(filepath.Join(dir, ServerConfigFile), []byte(`{"cors_origins": ["*"]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Reload(); err == nil {
+		t.Fatal("wildcard origin was accepted")
+	}
+	if resp := do("GET", "/api/v1/time", allowed, false); resp.Header.Get("Access-Control-Allow-Origin") != allowed {
+		t.Fatal("failed reload changed the origins")
+	}
+}
+
+// TestParseCORSOrigins checks which origins are accepted in the config.
+func TestParseCORSOrigins(t *testing.T) {
+	origins, err := parseCORSOrigins([]string{"https://b.example.com", "HTTP://A.example.com:8080/"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(origins) != 2 || origins[0] != "http://a.example.com:8080" || origins[1] != "https://b.example.com" {
+		t.Fatal("unexpected origins:", origins)
+	}
+	if origins, err := parseCORSOrigins([]string{"*"}, true); err != nil || len(origins) != 1 {
+		t.Fatal("wildcard was refused in internal test mode:", err)
+	}
+	for _, bad := range []string{"*", "dashboard.example.com", "ftp://example.com", "https://example.com/path", "https://"} {
+		if _, err := parseCORSOrigins([]string{bad}, false); err == nil {
+			t.Error("invalid origin was accepted:", bad)
+		}
+	}
+
+	// Internal test mode allows every origin with the wildcard.
+	var cp corsPolicy
+	cp.set([]string{"*"})
+	if !cp.allows("https://anything.example.com") {
+		t.Fatal("wildcard does not allow every origin")
+	}
+}
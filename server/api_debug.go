@@ -0,0 +1,133 @@
+package server
+
+// api_debug.go contains the profiling and debugging endpoints of the server.
+// They are only registered in internal test mode or when the server was
+// launched with the Debug option, which keeps them out of the way in normal
+// production use, and they only answer callers on a loopback address. An
+// operator reaches them over SSH, for example with
+// 'go tool pprof http://localhost:35015/debug/pprof/heap'.
+//
+// /debug/state is meant to be pasted into support cases, so it only contains
+// counts and never any keys or reports.
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// DebugStateResponse is a redacted summary of the in-memory state of the
+// server.
+type DebugStateResponse struct {
+	UptimeSeconds   int64  `json:"uptime_seconds"`
+	CurrentTimeslot uint32 `json:"current_timeslot"`
+	Goroutines      int    `json:"goroutines"`
+	HeapAllocBytes  uint64 `json:"heap_alloc_bytes"`
+
+	Equipment                 int    `json:"equipment"`
+	EquipmentBans             int    `json:"equipment_bans"`
+	EquipmentDeauthorizations int    `json:"equipment_deauthorizations"`
+	EquipmentMigrations       int    `json:"equipment_migrations"`
+	EquipmentImports          int    `json:"equipment_imports"`
+	EquipmentRegions          int    `json:"equipment_regions"`
+	EquipmentOffline          int    `json:"equipment_offline"`
+	EquipmentReportsOffset    uint32 `json:"equipment_reports_offset"`
+	EquipmentHistoryOffset    uint32 `json:"equipment_history_offset"`
+	StatsHistoryWeeks         int    `json:"stats_history_weeks"`
+	StatsHistoryEvicted       int    `json:"stats_history_evicted"`
+	FlaggedReports            int    `json:"flagged_reports"`
+	RecentReports             int    `json:"recent_reports"`
+	RecentEquipmentAuths      int    `json:"recent_equipment_auths"`
+	AuthorizedServers         int    `json:"authorized_servers"`
+	GCAKeyRotations           int    `json:"gca_key_rotations"`
+	GCAKeyAvailable           bool   `json:"gca_key_available"`
+	WattTimeRegions           int    `json:"watttime_regions"`
+	ReportQueueDepth          int    `json:"report_queue_depth"`
+
+	Components []ComponentStatus `json:"components"` // The background loops, see components.go
+}
+
+// registerDebugHandlers attaches the debug endpoints to the mux.
+func (gcas *GCAServer) registerDebugHandlers() {
+	profile := []RouteParam{queryParam("seconds", "How long to profile for")}
+	gcas.handleRoute(Route{Path: "/debug/pprof/", Feature: FeatureDebug, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "List the profiles, or get the profile named in the path", ResponseType: "application/octet-stream"},
+	}}, loopbackCallersOnly(pprof.Index))
+	gcas.handleRoute(Route{Path: "/debug/pprof/cmdline", Feature: FeatureDebug, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the command line of the server", ResponseType: "text/plain"},
+	}}, loopbackCallersOnly(pprof.Cmdline))
+	gcas.handleRoute(Route{Path: "/debug/pprof/profile", Feature: FeatureDebug, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Take a CPU profile", Params: profile, ResponseType: "application/octet-stream"},
+	}}, loopbackCallersOnly(pprof.Profile))
+	gcas.handleRoute(Route{Path: "/debug/pprof/symbol", Feature: FeatureDebug, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Count the symbols of the server", ResponseType: "text/plain"},
+		{Method: http.MethodPost, Summary: "Look up the symbols of program counters", RequestType: "text/plain", ResponseType: "text/plain"},
+	}}, loopbackCallersOnly(pprof.Symbol))
+	gcas.handleRoute(Route{Path: "/debug/pprof/trace", Feature: FeatureDebug, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Take an execution trace", Params: profile, ResponseType: "application/octet-stream"},
+	}}, loopbackCallersOnly(pprof.Trace))
+	gcas.handleRoute(Route{Path: "/debug/vars", Feature: FeatureDebug, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get the exported variables of the server", ResponseType: "application/json"},
+	}}, loopbackCallersOnly(expvar.Handler().ServeHTTP))
+	gcas.handleRoute(Route{Path: "/debug/state", Feature: FeatureDebug, Operations: []Operation{
+		{Method: http.MethodGet, Summary: "Get a redacted summary of the state of the server", Response: DebugStateResponse{}, Signed: true},
+	}}, loopbackCallersOnly(gcas.DebugStateHandler))
+}
+
+// loopbackCallersOnly wraps a debug endpoint so that it refuses every caller
+// that isn't connecting from a loopback address. Unlike loopbackOnly, the
+// check can't be turned off.
+func loopbackCallersOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackAddr(r.RemoteAddr) {
+			http.Error(w, "Debug endpoints are only available from loopback addresses", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// DebugStateHandler returns a redacted summary of the in-memory state of the
+// server.
+func (gcas *GCAServer) DebugStateHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		return
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	resp := DebugStateResponse{
+		UptimeSeconds:     int64(gcas.now().Sub(gcas.staticStartTime).Seconds()),
+		CurrentTimeslot:   gcas.currentTimeslot(),
+		Goroutines:        runtime.NumGoroutine(),
+		HeapAllocBytes:    ms.HeapAlloc,
+		ReportQueueDepth:  len(gcas.staticReportQueue),
+		AuthorizedServers: len(gcas.AuthorizedServers()),
+		Components:        gcas.componentStatuses(),
+	}
+
+	gcas.mu.RLock()
+	resp.Equipment = len(gcas.equipment)
+	resp.EquipmentBans = len(gcas.equipmentBans)
+	resp.EquipmentDeauthorizations = len(gcas.equipmentDeauthorizations)
+	resp.EquipmentMigrations = len(gcas.equipmentMigrations)
+	resp.EquipmentImports = len(gcas.equipmentImports)
+	resp.EquipmentRegions = len(gcas.equipmentRegions)
+	resp.EquipmentOffline = len(gcas.equipmentOffline)
+	resp.EquipmentReportsOffset = gcas.equipmentReportsOffset
+	resp.EquipmentHistoryOffset = gcas.equipmentHistoryOffset
+	resp.StatsHistoryWeeks = len(gcas.equipmentStatsHistory)
+	resp.StatsHistoryEvicted = gcas.equipmentHistoryEvicted
+	resp.FlaggedReports = len(gcas.flaggedReports)
+	resp.RecentReports = len(gcas.recentReports)
+	resp.RecentEquipmentAuths = len(gcas.recentEquipmentAuths)
+	resp.GCAKeyRotations = len(gcas.gcaKeyRotations)
+	resp.GCAKeyAvailable = gcas.gcaPubkeyAvailable
+	resp.WattTimeRegions = len(gcas.wattTimeCaches)
+	gcas.mu.RUnlock()
+
+	gcas.writeJSONResponse(w, r, resp)
+}
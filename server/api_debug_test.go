@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getDebug fetches one of the debug endpoints and returns the status code.
+// The body is decoded into v if v is not nil.
+func (gcas *GCAServer) getDebug(path string, v interface{}) (int, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v%v", gcas.httpPort, path))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return 0, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// TestDebugEndpoints checks that the debug endpoints only exist in internal
+// test mode or with the Debug option, and that the state summary has the
+// right counts.
+func TestDebugEndpoints(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.AuthorizeTestDevice(1, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/goroutine", "/debug/vars", "/debug/state"}
+	for _, path := range paths {
+		status, err := server.getDebug(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusNotFound {
+			t.Fatal("expected the debug endpoints to be missing:", path, status)
+		}
+	}
+	server.Close()
+
+	// checkEndpoints checks that all of the debug endpoints are served.
+	checkEndpoints := func(server *GCAServer) {
+		t.Helper()
+		for _, path := range paths {
+			status, err := server.getDebug(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != http.StatusOK {
+				t.Fatal("expected the debug endpoint to be served:", path, status)
+			}
+		}
+		var vars map[string]interface{}
+		if _, err := server.getDebug("/debug/vars", &vars); err != nil {
+			t.Fatal(err)
+		}
+		if _, exists := vars["memstats"]; !exists {
+			t.Fatal("expvar is missing the memstats")
+		}
+		var state DebugStateResponse
+		if _, err := server.getDebug("/debug/state", &state); err != nil {
+			t.Fatal(err)
+		}
+		if state.Equipment != 1 || !state.GCAKeyAvailable || state.Goroutines == 0 {
+			t.Fatalf("unexpected state: %+v", state)
+		}
+	}
+
+	opts := DefaultServerOptions()
+	opts.Debug = true
+	server, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEndpoints(server)
+	server.Close()
+
+	server, err = NewGCAServer(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	checkEndpoints(server)
+
+	// Callers that aren't on a loopback address are refused.
+	req := httptest.NewRequest(http.MethodGet, "/debug/state", nil)
+	req.RemoteAddr = "10.0.0.1:4000"
+	rec := httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("expected a remote caller to be refused:", rec.Code)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+// api_device_bootstrap.go serves the minimal configuration that a device needs
+// to start reporting, so that a device can be shipped with nothing but its
+// keypair and the address of one GCA server. The device polls the endpoint
+// with its public key until the GCA has authorized it, and then gets its
+// ShortID, its authorization, the servers it can report to, and the
+// parameters of the report protocol in a single response.
+//
+// The document is meant to be requested with signed=true. Everything in it
+// that the device has to trust is signed by the GCA: the authorization and
+// every authorized server carry a signature of the GCA, and the signature on
+// the response ties the document to a server that is in the list. A device
+// that was shipped with the key of the GCA can check all of it, a device that
+// wasn't trusts the key of the GCA on first use.
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// DeviceBootstrapResponse is everything a device needs to start reporting.
+type DeviceBootstrapResponse struct {
+	ShortID              uint32                      `json:"short_id"`
+	Authorization        glow.EquipmentAuthorization `json:"authorization"`
+	GCAPublicKey         glow.PublicKey              `json:"gca_public_key"`
+	AuthorizedServers    []AuthorizedServer          `json:"authorized_servers"`
+	TimeslotSeconds      uint32                      `json:"timeslot_seconds"`
+	CurrentTimeslot      uint32                      `json:"current_timeslot"`
+	ReportWindow         ReportWindow                `json:"report_window"`
+	ReportPacketVersions []int                       `json:"report_packet_versions"`
+}
+
+// DeviceBootstrapHandler returns the bootstrap document of the device with the
+// public key in the 'pubkey' query parameter. A device that the GCA hasn't
+// authorized yet gets UNKNOWN_DEVICE with a Retry-After header, which tells it
+// how long to wait before polling again.
+func (gcas *GCAServer) DeviceBootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for a device bootstrap.")
+		return
+	}
+	pk, err := glow.ParsePublicKey(r.URL.Query().Get("pubkey"))
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "invalid pubkey")
+		return
+	}
+
+	currentTimeslot := gcas.currentTimeslot()
+	gcas.mu.RLock()
+	shortID, exists := gcas.equipmentShortID[pk]
+	ea := gcas.equipment[shortID]
+	_, banned := gcas.equipmentBans[shortID]
+	_, deauthorized := gcas.equipmentDeauthorizations[pk]
+	gcaKey := gcas.gcaPubkey
+	gcas.mu.RUnlock()
+	switch {
+	case deauthorized:
+		gcas.writeError(w, ErrCodeDeviceDeauthorized, "the device was deauthorized")
+		return
+	case !exists:
+		w.Header().Set("Retry-After", strconv.Itoa(deviceBootstrapRetryAfter))
+		gcas.writeError(w, ErrCodeUnknownDevice, "the device has not been authorized yet")
+		return
+	case banned:
+		gcas.writeError(w, ErrCodeDeviceBanned, "the device is banned")
+		return
+	case ea.ExpiredAt(currentTimeslot):
+		gcas.writeError(w, ErrCodeDeviceExpired, "the authorization of the device has expired")
+		return
+	}
+
+	earliest, latest := gcas.reportWindow(currentTimeslot)
+	gcas.writeJSONResponse(w, r, DeviceBootstrapResponse{
+		ShortID:           shortID,
+		Authorization:     ea,
+		GCAPublicKey:      gcaKey,
+		AuthorizedServers: gcas.AuthorizedServers(),
+		TimeslotSeconds:   timeslotSeconds,
+		CurrentTimeslot:   currentTimeslot,
+		ReportWindow: ReportWindow{
+			PastTimeslots:    gcas.staticReportPastWindow,
+			FutureTimeslots:  gcas.staticReportFutureWindow,
+			EarliestTimeslot: earliest,
+			LatestTimeslot:   latest,
+		},
+		ReportPacketVersions: glow.ReportPacketVersions(),
+	})
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestDeviceBootstrap checks that a device gets told to poll again until it
+// is authorized, that the document of an authorized device has everything it
+// needs to start reporting, and that a deauthorized device is refused.
+func TestDeviceBootstrap(t *testing.T) {
+	server, _, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	pk, _ := glow.GenerateKeyPair()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/device-bootstrap?pubkey=%x", server.httpPort, pk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Retry-After") != strconv.Itoa(deviceBootstrapRetryAfter) {
+		t.Fatal("unexpected response for an unknown device:", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	var dbr DeviceBootstrapResponse
+	if status, code, _ := server.getPage("v1/device-bootstrap?pubkey=abc", &dbr); status != http.StatusBadRequest || code != ErrCodeMalformedRequest {
+		t.Fatal("a bad pubkey was accepted:", status, code)
+	}
+
+	ea, _, err := server.AuthorizeTestDevice(3, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := "v1/device-bootstrap?pubkey=" + hex.EncodeToString(ea.PublicKey[:])
+	if status, code, err := server.getPage(route, &dbr); err != nil || status != http.StatusOK {
+		t.Fatal("unable to get the bootstrap document:", status, code, err)
+	}
+	earliest, latest := server.reportWindow(server.currentTimeslot())
+	if dbr.ShortID != 3 || dbr.Authorization != ea || dbr.GCAPublicKey != gcaPubKey || dbr.TimeslotSeconds != 300 {
+		t.Fatalf("unexpected document: %+v", dbr)
+	}
+	if dbr.ReportWindow.EarliestTimeslot != earliest || dbr.ReportWindow.LatestTimeslot != latest || len(dbr.ReportPacketVersions) != len(glow.ReportPacketVersions()) {
+		t.Fatalf("unexpected report parameters: %+v", dbr)
+	}
+
+	server.deauthorizeTestDevice(t, ea, server.currentTimeslot(), gcaPrivKey)
+	if status, code, _ := server.getPage(route, &dbr); status != http.StatusForbidden || code != ErrCodeDeviceDeauthorized {
+		t.Fatal("a deauthorized device got its document:", status, code)
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+// api_device_export.go lets the owner of a device download the full history of
+// the device as a device export, see glow/device_export.go, which anyone can
+// verify with the keys of the GCA and of the server. The export contains the
+// authorization, the key rotations, every signed report that the server still
+// has, from the oldest archive through the reports in memory, the overrides
+// of the GCA, and the bans. A banned device exports the reports and the
+// overrides that count toward its totals, see ban_accounting.go.
+//
+// The export is streamed. The state that lives in memory is copied out under
+// the lock, which is at most the reports of the window, and the archives are
+// read one week at a time after the lock is released. Only the archives of
+// the weeks before the copied window are read, so a week that gets archived
+// while the export runs is exported once, from the copy. An error after the
+// response has started cuts the export off before its manifest, which makes
+// the export fail to verify.
+//
+// Reports that are held for review aren't part of the export, as the server
+// hasn't accepted them.
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// deviceExportSnapshot is the part of a device export that is copied out of
+// the memory of the server.
+type deviceExportSnapshot struct {
+	authorization   glow.EquipmentAuthorization
+	banned          bool
+	keyRotations    []glow.ExportedKeyRotation
+	windowOffset    uint32
+	reports         []glow.EquipmentReport
+	overrides       []glow.ExportedOverride
+	equivocation    *glow.ExportedEquivocation
+	bannedTimeslots []uint32
+}
+
+// deviceExportSnapshot copies the state of the device with the provided
+// authorization key that goes into an export. The bool is false if the server
+// doesn't know the device. The mutex must be held.
+func (gcas *GCAServer) deviceExportSnapshot(pubkey glow.PublicKey) (deviceExportSnapshot, bool, error) {
+	var snap deviceExportSnapshot
+	snap.windowOffset = gcas.equipmentReportsOffset
+
+	// A banned device is no longer among the equipment, its authorization
+	// is kept with the proof of its ban.
+	shortID, exists := gcas.equipmentShortID[pubkey]
+	if exists {
+		snap.authorization = gcas.equipment[shortID]
+	} else if shortID, exists = gcas.bannedDeviceShortID(pubkey); exists {
+		snap.banned = true
+		if ep, proven := gcas.equipmentBanProofs[shortID]; proven {
+			snap.authorization = ep.Authorization
+			snap.equivocation = &glow.ExportedEquivocation{First: ep.First, Second: ep.Second}
+		} else {
+			for _, ea := range gcas.equipmentBanAuths[shortID] {
+				if ea.PublicKey == pubkey {
+					snap.authorization = ea
+				}
+			}
+		}
+	} else {
+		return snap, false, nil
+	}
+
+	for _, rot := range gcas.deviceKeyRotations[pubkey] {
+		snap.keyRotations = append(snap.keyRotations, glow.ExportedKeyRotation{
+			OldKey:             rot.OldKey,
+			NewKey:             rot.NewKey,
+			ActivationTimeslot: rot.ActivationTimeslot,
+			DeviceSignature:    rot.DeviceSignature,
+			GCASignature:       rot.GCASignature,
+		})
+	}
+	if dr, exists := gcas.windowReports(shortID); exists {
+		reports, err := gcas.signedReports(shortID, 0, len(dr.PowerOutputs))
+		if err != nil {
+			return snap, true, err
+		}
+		snap.reports = reports
+		for i, po := range dr.PowerOutputs {
+			if po == 1 {
+				snap.bannedTimeslots = append(snap.bannedTimeslots, snap.windowOffset+uint32(i))
+			}
+		}
+	}
+	for _, ro := range gcas.reportOverrides[shortID] {
+		if !gcas.reportCounts(shortID, ro.Timeslot) {
+			continue
+		}
+		snap.overrides = append(snap.overrides, glow.ExportedOverride{
+			Timeslot:    ro.Timeslot,
+			PowerOutput: ro.PowerOutput,
+			Outage:      ro.Outage,
+			Reason:      ro.Reason,
+			Timestamp:   ro.Timestamp,
+			Signature:   ro.Signature,
+		})
+	}
+	sort.Slice(snap.overrides, func(i, j int) bool { return snap.overrides[i].Timeslot < snap.overrides[j].Timeslot })
+	return snap, true, nil
+}
+
+// bannedDeviceShortID returns the ShortID of a banned device with the
+// provided authorization key. The mutex must be held.
+func (gcas *GCAServer) bannedDeviceShortID(pubkey glow.PublicKey) (uint32, bool) {
+	for shortID, ep := range gcas.equipmentBanProofs {
+		if ep.Authorization.PublicKey == pubkey {
+			return shortID, true
+		}
+	}
+	for shortID, auths := range gcas.equipmentBanAuths {
+		for _, ea := range auths {
+			if ea.PublicKey == pubkey {
+				return shortID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// DeviceExportHandler streams the device export of the device with the
+// 'pubkey' query parameter.
+func (gcas *GCAServer) DeviceExportHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for a device export.")
+		return
+	}
+
+	// Parse the public key.
+	publicKeyStr := r.URL.Query().Get("pubkey")
+	if publicKeyStr == "" {
+		gcas.writeError(w, ErrCodeMalformedRequest, "pubkey is a required query parameter")
+		return
+	}
+	publicKey, err := glow.ParsePublicKey(publicKeyStr)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid public key format")
+		return
+	}
+
+	gcas.mu.RLock()
+	snap, exists, err := gcas.deviceExportSnapshot(publicKey)
+	overlap := gcas.staticKeyRotationOverlap
+	gcas.mu.RUnlock()
+	if !exists {
+		gcas.writeError(w, ErrCodeUnknownDevice, "equipment not found")
+		return
+	}
+	if err != nil {
+		gcas.requestLogger(r).Errorf("unable to load the reports of a device export: %v", err)
+		gcas.writeError(w, ErrCodeInternalError, "Unable to load the reports of the device")
+		return
+	}
+	periods, err := gcas.archivedPeriods()
+	if err != nil {
+		gcas.requestLogger(r).Errorf("unable to list the archives for a device export: %v", err)
+		gcas.writeError(w, ErrCodeInternalError, "Unable to list the report archives")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"device-export-%d.bin\"", snap.authorization.ShortID))
+	if err := gcas.writeDeviceExport(w, snap, periods, overlap); err != nil {
+		gcas.requestLogger(r).Warn("Unable to write device export:", err)
+	}
+}
+
+// writeDeviceExport streams the export of a device to w, reading the archives
+// of the provided periods that come before the window of the snapshot.
+func (gcas *GCAServer) writeDeviceExport(w http.ResponseWriter, snap deviceExportSnapshot, periods []uint32, overlap uint32) error {
+	flusher, _ := w.(http.Flusher)
+	dw := glow.NewDeviceExportWriter(w, snap.authorization, overlap)
+	for _, rot := range snap.keyRotations {
+		if err := dw.WriteKeyRotation(rot); err != nil {
+			return err
+		}
+	}
+	for _, periodStart := range periods {
+		if periodStart >= snap.windowOffset {
+			break
+		}
+		device, found, err := gcas.loadArchivedDevice(periodStart, snap.authorization.PublicKey)
+		if os.IsNotExist(err) {
+			// The archive was pruned after it was listed.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read the archive of period %v: %v", periodStart, err)
+		}
+		if !found {
+			continue
+		}
+		for _, report := range device.Reports {
+			if err := dw.WriteReport(report); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	for _, report := range snap.reports {
+		if err := dw.WriteReport(report); err != nil {
+			return err
+		}
+	}
+	for _, o := range snap.overrides {
+		if err := dw.WriteOverride(o); err != nil {
+			return err
+		}
+	}
+	if snap.equivocation != nil {
+		if err := dw.WriteEquivocation(*snap.equivocation); err != nil {
+			return err
+		}
+	}
+	for _, ts := range snap.bannedTimeslots {
+		if err := dw.WriteBannedTimeslot(ts); err != nil {
+			return err
+		}
+	}
+	return dw.Finish(gcas.now().Unix(), snap.banned, gcas.staticPublicKey, gcas.staticPrivateKey)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// fetchDeviceExport downloads the device export of a device.
+func (gcas *GCAServer) fetchDeviceExport(pubkey glow.PublicKey) ([]byte, int, error) {
+	resp, err := http.Get("http://" + gcas.httpDialAddr() + "/api/v1/device-export?pubkey=" + hex.EncodeToString(pubkey[:]))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return data, resp.StatusCode, err
+}
+
+// TestDeviceExport checks that the export of a device contains its archived
+// and its current reports, its overrides and its bans, and that it verifies
+// against the keys of the GCA and the server.
+func TestDeviceExport(t *testing.T) {
+	server, _, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cheater, cheaterPriv, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reports of the first week end up in the archive.
+	for ts := uint32(0); ts < 6; ts += 2 {
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, ts, ePriv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+	glow.SetCurrentTimeslot(3300)
+	for i := 0; i < 100; i++ {
+		server.mu.RLock()
+		ero := server.equipmentReportsOffset
+		server.mu.RUnlock()
+		if ero != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, ts := range []uint32{3290, 3295} {
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, ts, ePriv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+	ro := ReportOverride{PublicKey: ea.PublicKey, Timeslot: 3295, PowerOutput: 50, Reason: "meter was reset", Timestamp: time.Now().Unix()}
+	ro.Signature = glow.Sign(ro.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedOverrideReport(ro); err != nil {
+		t.Fatal(err)
+	}
+
+	data, code, err := server.fetchDeviceExport(ea.PublicKey)
+	if err != nil || code != http.StatusOK {
+		t.Fatal("unable to fetch the export:", code, err)
+	}
+	de, err := glow.VerifyDeviceExport(bytes.NewReader(data), gcaPubKey, server.staticPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(de.Reports) != 5 || de.Reports[0].Timeslot != 0 || de.Reports[4].Timeslot != 3295 || de.Manifest.Banned {
+		t.Fatalf("unexpected export: %+v", de)
+	}
+	if len(de.Overrides) != 1 || de.Overrides[0].PowerOutput != 50 {
+		t.Fatal("override is missing from the export:", de.Overrides)
+	}
+
+	// A device that got banned for signing two different reports is still
+	// exported, with the proof of its ban.
+	for _, power := range []uint64{5, 6} {
+		er := glow.EquipmentReport{ShortID: cheater.ShortID, Timeslot: 3298, PowerOutput: power}
+		er.Signature = glow.Sign(er.SigningBytes(), cheaterPriv)
+		server.managedHandleEquipmentReport(er.Serialize())
+	}
+	data, code, err = server.fetchDeviceExport(cheater.PublicKey)
+	if err != nil || code != http.StatusOK {
+		t.Fatal("unable to fetch the export of the banned device:", code, err)
+	}
+	de, err = glow.VerifyDeviceExport(bytes.NewReader(data), gcaPubKey, server.staticPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !de.Manifest.Banned || len(de.Equivocations) != 1 || de.Equivocations[0].First.Timeslot != 3298 {
+		t.Fatalf("unexpected export of the banned device: %+v", de)
+	}
+
+	// Unknown devices don't have an export.
+	unknown, _ := glow.GenerateKeyPair()
+	if _, code, err := server.fetchDeviceExport(unknown); err != nil || code != http.StatusNotFound {
+		t.Fatal("unexpected status for an unknown device:", code, err)
+	}
+}
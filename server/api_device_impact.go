@@ -0,0 +1,171 @@
+package server
+
+// api_device_impact.go contains an endpoint that computes the carbon impact of
+// a single device over a range of timeslots, so that every consumer of the
+// API gets the same figure instead of multiplying the reports by the impact
+// rates themselves.
+//
+// The carbon impact of a timeslot is the energy of the report in milliwatt
+// hours, multiplied by the impact rate in grams per megawatt hour, divided by
+// 1e9 to get grams:
+//
+//	carbon = energy * impactRate / 1e9
+//
+// A timeslot only counts towards the carbon impact if it has both an unbanned
+// report and an impact rate. The total energy covers every unbanned report,
+// whether or not its timeslot has an impact rate. The timeslots that are
+// missing a report or an impact rate are listed separately, so that the
+// caller knows how much of the range the figures cover. Banned timeslots did
+// get a report, so they are not missing, but they contribute nothing.
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// DeviceImpactTimeslot is the carbon impact of a device at a single timeslot.
+type DeviceImpactTimeslot struct {
+	Timeslot     uint32   `json:"timeslot"`
+	Energy       int64    `json:"energy"`        // Milliwatt hours, zero if there is no unbanned report
+	ImpactRate   *float64 `json:"impact_rate"`   // Grams per megawatt hour, null if missing
+	CarbonImpact float64  `json:"carbon_impact"` // Grams
+}
+
+// DeviceImpact contains the carbon impact of a device over the timeslots
+// [Start, End).
+type DeviceImpact struct {
+	ShortID            uint32                 `json:"short_id"`
+	PublicKey          glow.PublicKey         `json:"pubkey"`
+	Start              uint32                 `json:"start"`
+	End                uint32                 `json:"end"`
+	TotalEnergy        int64                  `json:"total_energy"`         // Credited milliwatt hours of every unbanned report
+	CarbonImpact       float64                `json:"carbon_impact"`        // Grams, over the covered timeslots
+	CoveredTimeslots   uint32                 `json:"covered_timeslots"`    // Timeslots with both an unbanned report and an impact rate
+	BannedTimeslots    uint32                 `json:"banned_timeslots"`     // Timeslots whose report was banned
+	MissingReports     []ReportGap            `json:"missing_reports"`      // Timeslots without a report
+	MissingImpactRates []ReportGap            `json:"missing_impact_rates"` // Timeslots without an impact rate
+	Timeslots          []DeviceImpactTimeslot `json:"timeslots,omitempty"`  // Only set if the breakdown was requested
+}
+
+// DeviceImpactHandler returns the DeviceImpact of the device with the
+// 'pubkey' query parameter, for the timeslots from 'start' (inclusive) to
+// 'end' (exclusive). Setting 'detailed=true' adds a breakdown per timeslot,
+// which limits the range to maxImpactRatesTimeslots.
+func (gcas *GCAServer) DeviceImpactHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for device impact.")
+		return
+	}
+
+	// Parse the query parameters.
+	q := r.URL.Query()
+	publicKey, err := glow.ParsePublicKey(q.Get("pubkey"))
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "invalid pubkey")
+		return
+	}
+	start, err := strconv.ParseUint(q.Get("start"), 10, 32)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "invalid start format")
+		return
+	}
+	end, err := strconv.ParseUint(q.Get("end"), 10, 32)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "invalid end format")
+		return
+	}
+	if end <= start {
+		gcas.writeError(w, ErrCodeMalformedRequest, "end must be greater than start")
+		return
+	}
+	detailed := q.Get("detailed") == "true"
+	if end-start > maxDeviceImpactTimeslots || (detailed && end-start > maxImpactRatesTimeslots) {
+		gcas.writeError(w, ErrCodeMalformedRequest, "range covers too many timeslots")
+		return
+	}
+
+	gcas.mu.RLock()
+	shortID, exists := gcas.equipmentShortID[publicKey]
+	gcas.mu.RUnlock()
+	if !exists {
+		gcas.writeError(w, ErrCodeUnknownDevice, "equipment not found")
+		return
+	}
+
+	if gcas.managedNeedsStatsHistory(uint32(start)) {
+		writeLoadingError(w, gcas.writeError)
+		return
+	}
+
+	// Collect the data one week at a time, the same way as the CSV
+	// export.
+	outputs := make([]uint64, 0, end-start)
+	rates := make([]float64, 0, end-start)
+	for chunkStart := uint32(start); chunkStart < uint32(end); {
+		chunkEnd := chunkStart - chunkStart%2016 + 2016
+		if chunkEnd > uint32(end) {
+			chunkEnd = uint32(end)
+		}
+		chunkOutputs, chunkRates := gcas.managedReportsChunk(shortID, publicKey, chunkStart, chunkEnd)
+		outputs = append(outputs, chunkOutputs...)
+		rates = append(rates, chunkRates...)
+		chunkStart = chunkEnd
+	}
+
+	di := computeDeviceImpact(uint32(start), outputs, rates, detailed)
+	di.ShortID = shortID
+	di.PublicKey = publicKey
+	gcas.writeJSONResponse(w, r, di)
+}
+
+// computeDeviceImpact computes the DeviceImpact of the provided power outputs
+// and impact rates, where the first element of each corresponds to the start
+// timeslot. A power output of 0 means there is no report and 1 means the
+// report was banned, and an impact rate of 0 means there is no impact rate.
+func computeDeviceImpact(start uint32, outputs []uint64, rates []float64, detailed bool) DeviceImpact {
+	di := DeviceImpact{
+		Start: start,
+		End:   start + uint32(len(outputs)),
+	}
+	hasReport := make([]bool, len(outputs))
+	hasRate := make([]bool, len(outputs))
+	for i, output := range outputs {
+		hasReport[i] = output != 0
+		hasRate[i] = rates[i] != 0
+
+		// Negative readings and garbage count as no production.
+		var energy int64
+		if output == 1 {
+			di.BannedTimeslots++
+		} else if output != 0 {
+			energy = int64(glow.CreditedPowerOutput(output))
+		}
+		di.TotalEnergy += energy
+
+		var carbon float64
+		if energy != 0 && hasRate[i] {
+			carbon = float64(energy) * rates[i] / 1e9
+			di.CarbonImpact += carbon
+			di.CoveredTimeslots++
+		}
+		if detailed {
+			dit := DeviceImpactTimeslot{
+				Timeslot:     start + uint32(i),
+				Energy:       energy,
+				CarbonImpact: carbon,
+			}
+			if hasRate[i] {
+				rate := rates[i]
+				dit.ImpactRate = &rate
+			}
+			di.Timeslots = append(di.Timeslots, dit)
+		}
+	}
+	di.MissingReports = findReportGaps(hasReport, start)
+	di.MissingImpactRates = findReportGaps(hasRate, start)
+	return di
+}
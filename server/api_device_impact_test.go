@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getDeviceImpact fetches the carbon impact of a device, returning the status
+// code and the decoded response.
+func (gcas *GCAServer) getDeviceImpact(query string) (int, DeviceImpact, error) {
+	var di DeviceImpact
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/device-impact?%v", gcas.httpPort, query))
+	if err != nil {
+		return 0, di, fmt.Errorf("unable to get device impact: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&di); err != nil {
+			return 0, di, fmt.Errorf("unable to decode device impact: %v", err)
+		}
+	}
+	return resp.StatusCode, di, nil
+}
+
+// TestDeviceImpact checks the carbon impact of a device against values that
+// were computed by hand.
+func TestDeviceImpact(t *testing.T) {
+	glow.SetCurrentTimeslot(3000)
+	defer glow.SetCurrentTimeslot(0)
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The data straddles a week boundary. Energy is in milliwatt hours
+	// and impact rates are in grams per megawatt hour.
+	negative := -500000
+	data := []struct {
+		output uint64
+		rate   float64
+	}{
+		{0, 400000},                // 2014: no report
+		{1, 400000},                // 2015: banned
+		{2000000, 400000},          // 2016: 2e6 * 4e5 / 1e9 = 800 grams
+		{3000000, 0},               // 2017: no impact rate
+		{1000000, 500000},          // 2018: 1e6 * 5e5 / 1e9 = 500 grams
+		{uint64(negative), 400000}, // 2019: negative, so no production
+		{0, 0},                     // 2020: neither
+	}
+	server.mu.Lock()
+	for i, d := range data {
+		server.equipmentReports[1].PowerOutputs[2014+i] = d.output
+		server.equipmentImpactRate[1][2014+i] = d.rate
+	}
+	server.mu.Unlock()
+
+	query := fmt.Sprintf("pubkey=%x&start=2014&end=2021", ea.PublicKey)
+	status, di, err := server.getDeviceImpact(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("unexpected status:", status)
+	}
+	if di.ShortID != 1 || di.Start != 2014 || di.End != 2021 {
+		t.Fatalf("unexpected device or range: %+v", di)
+	}
+	if di.TotalEnergy != 6000000 || di.CarbonImpact != 1300 || di.CoveredTimeslots != 2 || di.BannedTimeslots != 1 {
+		t.Fatalf("unexpected totals: %+v", di)
+	}
+	wantMissingReports := []ReportGap{{2014, 2014, 1, ""}, {2020, 2020, 1, ""}}
+	wantMissingRates := []ReportGap{{2017, 2017, 1, ""}, {2020, 2020, 1, ""}}
+	if !reflect.DeepEqual(di.MissingReports, wantMissingReports) || !reflect.DeepEqual(di.MissingImpactRates, wantMissingRates) {
+		t.Fatalf("unexpected coverage: %+v %+v", di.MissingReports, di.MissingImpactRates)
+	}
+	if di.Timeslots != nil {
+		t.Fatal("the breakdown was not requested")
+	}
+
+	// The breakdown.
+	status, di, err = server.getDeviceImpact(query + "&detailed=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(di.Timeslots) != len(data) {
+		t.Fatalf("unexpected breakdown: %v %+v", status, di.Timeslots)
+	}
+	wantEnergy := []int64{0, 0, 2000000, 3000000, 1000000, 0, 0}
+	wantCarbon := []float64{0, 0, 800, 0, 500, 0, 0}
+	for i, dit := range di.Timeslots {
+		if dit.Timeslot != uint32(2014+i) || dit.Energy != wantEnergy[i] || dit.CarbonImpact != wantCarbon[i] {
+			t.Fatalf("unexpected breakdown at %v: %+v", i, dit)
+		}
+		if (dit.ImpactRate == nil) != (data[i].rate == 0) || (dit.ImpactRate != nil && *dit.ImpactRate != data[i].rate) {
+			t.Fatalf("unexpected impact rate at %v: %v", i, dit.ImpactRate)
+		}
+	}
+
+	// Invalid requests.
+	unknown, _ := glow.GenerateKeyPair()
+	for _, req := range []struct {
+		query  string
+		status int
+	}{
+		{"pubkey=zz&start=2014&end=2021", http.StatusBadRequest},
+		{fmt.Sprintf("pubkey=%x&start=2021&end=2014", ea.PublicKey), http.StatusBadRequest},
+		{fmt.Sprintf("pubkey=%x&start=0&end=%v", ea.PublicKey, maxDeviceImpactTimeslots+1), http.StatusBadRequest},
+		{fmt.Sprintf("pubkey=%x&start=0&end=%v&detailed=true", ea.PublicKey, maxImpactRatesTimeslots+1), http.StatusBadRequest},
+		{fmt.Sprintf("pubkey=%x&start=2014&end=2021", unknown), http.StatusNotFound},
+	} {
+		status, _, err := server.getDeviceImpact(req.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != req.status {
+			t.Fatal("unexpected status:", req.query, status)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package server
+
+// api_device_key_rotation.go lets a device move to a new key without losing
+// its ShortID or its history, which is the way out if the key of a device
+// leaks. Without it, the only remedy is a ban followed by a new authorization,
+// which starts the device over.
+//
+// The device signs a rotation with its current key that names the new key and
+// the timeslot at which the new key takes over, and the GCA counter-signs it.
+// Reports with a timeslot at or after the activation timeslot may be signed
+// by the new key. Reports signed by the old key keep being accepted for
+// KeyRotationOverlap timeslots past the activation, so that reports which were
+// signed before the device switched over still get in. After that, the old
+// key is refused. The validity of a key only depends on the timeslot of the
+// report, which keeps every server in agreement about which reports are
+// valid, no matter when a rotation reaches it.
+//
+// The device keeps the public key of its authorization as its identity, which
+// is the key that the stats, the history, and the other endpoints list it
+// under. The key that it currently signs with is in the SigningKey field of
+// the device stats. Rotations can be chained, every rotation has to be signed
+// by the key that the previous rotation handed off to, and a key can only
+// ever belong to one device.
+//
+// Rotations are persisted to disk and forwarded to all of the other GCA
+// servers, the same way that deauthorizations are.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// deviceKeyRotationSize is the size of a serialized DeviceKeyRotation.
+const deviceKeyRotationSize = 4 + 32 + 32 + 4 + 64 + 64
+
+// DeviceKeyRotation is a handoff from one key of a device to another.
+type DeviceKeyRotation struct {
+	ShortID            uint32         // The device that rotates its key
+	OldKey             glow.PublicKey // The key that is being replaced
+	NewKey             glow.PublicKey // The key that takes over
+	ActivationTimeslot uint32         // The first timeslot that the new key may sign reports for
+	DeviceSignature    glow.Signature // A signature from the old key
+	GCASignature       glow.Signature // A signature from the GCA over the rotation and the device signature
+}
+
+// SigningBytes returns the bytes that the old key of the device signs to hand
+// off to the new key.
+func (rot DeviceKeyRotation) SigningBytes() []byte {
+	return glow.SerializeDeviceKeyRotationForSigning(rot.ShortID, rot.OldKey, rot.NewKey, rot.ActivationTimeslot)
+}
+
+// GCASigningBytes returns the bytes that the GCA signs to counter-sign the
+// rotation, which are the signing bytes followed by the device signature.
+func (rot DeviceKeyRotation) GCASigningBytes() []byte {
+	return append(rot.SigningBytes(), rot.DeviceSignature[:]...)
+}
+
+// Serialize returns the compact binary representation of the rotation.
+func (rot DeviceKeyRotation) Serialize() []byte {
+	b := make([]byte, deviceKeyRotationSize)
+	binary.LittleEndian.PutUint32(b, rot.ShortID)
+	copy(b[4:], rot.OldKey[:])
+	copy(b[36:], rot.NewKey[:])
+	binary.LittleEndian.PutUint32(b[68:], rot.ActivationTimeslot)
+	copy(b[72:], rot.DeviceSignature[:])
+	copy(b[136:], rot.GCASignature[:])
+	return b
+}
+
+// DeserializeDeviceKeyRotation reverses a call to Serialize.
+func DeserializeDeviceKeyRotation(b []byte) (DeviceKeyRotation, error) {
+	var rot DeviceKeyRotation
+	if len(b) != deviceKeyRotationSize {
+		return rot, fmt.Errorf("unexpected device key rotation size: %v", len(b))
+	}
+	rot.ShortID = binary.LittleEndian.Uint32(b)
+	copy(rot.OldKey[:], b[4:36])
+	copy(rot.NewKey[:], b[36:68])
+	rot.ActivationTimeslot = binary.LittleEndian.Uint32(b[68:])
+	copy(rot.DeviceSignature[:], b[72:136])
+	copy(rot.GCASignature[:], b[136:])
+	return rot, nil
+}
+
+// latestDeviceKey returns the key at the end of the chain of rotations of the
+// device with the provided authorization key, which is the only key that can
+// sign the next rotation. The mutex must be held.
+func (gcas *GCAServer) latestDeviceKey(pubkey glow.PublicKey) glow.PublicKey {
+	if rots := gcas.deviceKeyRotations[pubkey]; len(rots) > 0 {
+		return rots[len(rots)-1].NewKey
+	}
+	return pubkey
+}
+
+// deviceKeysAt returns the keys that may sign the reports for the provided
+// timeslot of the device with the provided authorization key. During the
+// overlap of a rotation, that is both the old and the new key. The mutex must
+// be held.
+func (gcas *GCAServer) deviceKeysAt(pubkey glow.PublicKey, timeslot uint32) []glow.PublicKey {
+	return gcas.appendDeviceKeysAt(nil, pubkey, timeslot)
+}
+
+// appendDeviceKeysAt appends the keys of deviceKeysAt to keys, so that the
+// report path can look them up into a buffer on the stack. The mutex must be
+// held.
+func (gcas *GCAServer) appendDeviceKeysAt(keys []glow.PublicKey, pubkey glow.PublicKey, timeslot uint32) []glow.PublicKey {
+	key, start := pubkey, uint32(0)
+	for _, rot := range gcas.deviceKeyRotations[pubkey] {
+		if timeslot >= start && int64(timeslot) < int64(rot.ActivationTimeslot)+int64(gcas.staticKeyRotationOverlap) {
+			keys = append(keys, key)
+		}
+		key, start = rot.NewKey, rot.ActivationTimeslot
+	}
+	if timeslot >= start {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// verifyDeviceSignature checks a signature over a report for the provided
+// timeslot against the keys that the device with the provided authorization
+// key may sign with in that timeslot. The mutex must be held.
+func (gcas *GCAServer) verifyDeviceSignature(pubkey glow.PublicKey, timeslot uint32, sb []byte, sig glow.Signature) bool {
+	for _, key := range gcas.deviceKeysAt(pubkey, timeslot) {
+		if glow.Verify(key, sb, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeviceKeyAt returns whether the provided key may sign the reports for the
+// provided timeslot of the device with the provided ShortID. The mutex must be
+// held.
+func (gcas *GCAServer) isDeviceKeyAt(shortID uint32, key glow.PublicKey, timeslot uint32) bool {
+	equipment, exists := gcas.equipment[shortID]
+	if !exists {
+		return false
+	}
+	var buf [2]glow.PublicKey
+	for _, k := range gcas.appendDeviceKeysAt(buf[:0], equipment.PublicKey, timeslot) {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDeviceKeyRotation checks that a rotation extends the chain of the
+// device that it names, and that the new key has never been used by any
+// device. The signature of the GCA is checked by the caller. The mutex must
+// be held.
+func (gcas *GCAServer) checkDeviceKeyRotation(rot DeviceKeyRotation) error {
+	equipment, exists := gcas.equipment[rot.ShortID]
+	if !exists {
+		if _, banned := gcas.equipmentBans[rot.ShortID]; banned {
+			return withCode(ErrCodeDeviceBanned, fmt.Errorf("equipment %v is banned", rot.ShortID))
+		}
+		return withCode(ErrCodeUnknownDevice, fmt.Errorf("unknown equipment ID: %d", rot.ShortID))
+	}
+	latest := gcas.latestDeviceKey(equipment.PublicKey)
+	if rot.OldKey != latest {
+		return withCode(ErrCodeInvalidSignature, fmt.Errorf("rotation must be signed by the latest key of the device %x", latest))
+	}
+	if !glow.Verify(rot.OldKey, rot.SigningBytes(), rot.DeviceSignature) {
+		return withCode(ErrCodeInvalidSignature, errors.New("invalid device signature on device key rotation"))
+	}
+	if rot.NewKey == (glow.PublicKey{}) {
+		return withCode(ErrCodeMalformedRequest, errors.New("rotation has no new key"))
+	}
+	if _, exists := gcas.equipmentShortID[rot.NewKey]; exists {
+		return withCode(ErrCodeMalformedRequest, errors.New("rotation hands off to a key that was already used"))
+	}
+	if _, exists := gcas.deviceKeyOwners[rot.NewKey]; exists {
+		return withCode(ErrCodeMalformedRequest, errors.New("rotation hands off to a key that was already used"))
+	}
+	if _, exists := gcas.equipmentDeauthorizations[rot.NewKey]; exists {
+		return withCode(ErrCodeMalformedRequest, errors.New("rotation hands off to a key that was already used"))
+	}
+	rots := gcas.deviceKeyRotations[equipment.PublicKey]
+	if n := len(rots); n > 0 && rot.ActivationTimeslot < rots[n-1].ActivationTimeslot {
+		return withCode(ErrCodeMalformedRequest, errors.New("rotation activates before the previous rotation"))
+	}
+	return nil
+}
+
+// addDeviceKeyRotation adds a checked rotation to the chain of its device.
+// The mutex must be held.
+func (gcas *GCAServer) addDeviceKeyRotation(rot DeviceKeyRotation) {
+	pubkey := gcas.equipment[rot.ShortID].PublicKey
+	gcas.deviceKeyRotations[pubkey] = append(gcas.deviceKeyRotations[pubkey], rot)
+	gcas.deviceKeyOwners[rot.NewKey] = rot.ShortID
+}
+
+// managedRotateDeviceKey verifies and saves a rotation. The bool indicates
+// whether the rotation is new to this server. A rotation that was synced from
+// a peer may activate in the past, the peer already checked that it didn't
+// when the rotation was submitted, see peer_sync_records.go.
+func (gcas *GCAServer) managedRotateDeviceKey(rot DeviceKeyRotation, synced bool) (bool, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return false, errNotInitialized
+	}
+	if !gcas.verifyGCASignature(rot.GCASigningBytes(), rot.GCASignature) {
+		return false, withCode(ErrCodeInvalidSignature, errors.New("invalid gca signature on device key rotation"))
+	}
+
+	// A rotation that is already part of the chain is redundant.
+	if equipment, exists := gcas.equipment[rot.ShortID]; exists {
+		for _, prev := range gcas.deviceKeyRotations[equipment.PublicKey] {
+			if prev == rot {
+				return false, nil
+			}
+		}
+	}
+	if err := gcas.checkDeviceKeyRotation(rot); err != nil {
+		return false, err
+	}
+	if err := gcas.verifyNotTestKey("device", rot.NewKey); err != nil {
+		return false, err
+	}
+	if !synced && rot.ActivationTimeslot < gcas.currentTimeslot() {
+		return false, withCode(ErrCodeStaleTimeslot, fmt.Errorf("activation timeslot %v is in the past", rot.ActivationTimeslot))
+	}
+
+	// Record and persist the rotation before applying it.
+	err := gcas.recordAudit(auditRecord{
+		action:  glow.AuditDeviceKeyRotation,
+		request: rot.Serialize(),
+		signatures: []glow.AuditSignature{
+			{PublicKey: rot.OldKey, SigningBytes: rot.SigningBytes(), Signature: rot.DeviceSignature},
+			gcas.gcaAuditSignature(rot.GCASigningBytes(), rot.GCASignature),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := gcas.staticStorage.AppendFile(DeviceKeyRotationsFile, rot.Serialize(), 0644); err != nil {
+		return false, fmt.Errorf("unable to save device key rotation: %v", err)
+	}
+	gcas.addDeviceKeyRotation(rot)
+	gcas.bumpStateVersion()
+	return true, nil
+}
+
+// loadDeviceKeyRotations loads the rotations of every device from disk,
+// creating the file if it does not exist yet. This needs to happen after the
+// equipment is loaded, and before any reports or bans get loaded.
+func (gcas *GCAServer) loadDeviceKeyRotations() error {
+	data, err := gcas.staticStorage.ReadFile(DeviceKeyRotationsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(DeviceKeyRotationsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read device key rotations file: %v", err)
+	}
+	if len(data)%deviceKeyRotationSize != 0 {
+		return fmt.Errorf("device key rotations file has an unexpected size")
+	}
+	for i := 0; i < len(data); i += deviceKeyRotationSize {
+		rot, err := DeserializeDeviceKeyRotation(data[i : i+deviceKeyRotationSize])
+		if err != nil {
+			return fmt.Errorf("unable to decode device key rotation: %v", err)
+		}
+		if !gcas.verifyPersistedGCASignature(rot.GCASigningBytes(), rot.GCASignature) {
+			return fmt.Errorf("invalid gca signature on persisted device key rotation")
+		}
+		// The device may have been banned since, in which case its
+		// rotations no longer matter.
+		if _, banned := gcas.equipmentBans[rot.ShortID]; banned {
+			continue
+		}
+		if err := gcas.checkDeviceKeyRotation(rot); err != nil {
+			return fmt.Errorf("%v: record %v: %v", DeviceKeyRotationsFile, i/deviceKeyRotationSize, err)
+		}
+		gcas.addDeviceKeyRotation(rot)
+	}
+	return nil
+}
+
+// RotateDeviceKeyHandler handles requests to rotate the key of a device.
+func (gcas *GCAServer) RotateDeviceKeyHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for a device key rotation.")
+		return
+	}
+
+	// Decode the JSON request body into the rotation.
+	var request DeviceKeyRotation
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+
+	// Validate and process the request.
+	isNew, err := gcas.managedRotateDeviceKey(request, false)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to rotate device key: ", err))
+		gcas.requestLogger(r).WithFields("short_id", request.ShortID).Warn("Failed to rotate device key: ", err)
+		return
+	}
+
+	// Forward the rotation to all of the other servers, so that failover
+	// servers accept the reports that are signed by the new key. Only new
+	// rotations get forwarded, which prevents the servers from endlessly
+	// passing the same request around.
+	if isNew {
+		gcas.gcaServers.mu.Lock()
+		ass := make([]AuthorizedServer, len(gcas.gcaServers.servers))
+		copy(ass, gcas.gcaServers.servers)
+		gcas.gcaServers.mu.Unlock()
+		jsonBody, _ := json.Marshal(request)
+		for _, as := range ass {
+			resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/rotate-device-key", jsonBody)
+			if err != nil {
+				gcas.requestLogger(r).WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to forward device key rotation")
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	// Send a success response
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	gcas.requestLogger(r).WithFields("short_id", request.ShortID, "new_key", hex.EncodeToString(request.NewKey[:]), "activation_timeslot", request.ActivationTimeslot).Info("Accepted device key rotation.")
+}
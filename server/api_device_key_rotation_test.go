@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postDeviceKeyRotation will submit a device key rotation to the server and
+// return the status code.
+func (gcas *GCAServer) postDeviceKeyRotation(rot DeviceKeyRotation) (int, error) {
+	jsonBody, _ := json.Marshal(rot)
+	resp, err := http.Post(fmt.Sprintf("http://%v/api/v1/rotate-device-key", gcas.httpDialAddr()), "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return 0, fmt.Errorf("unable to send device key rotation: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// newDeviceKeyRotation creates a rotation of a device from oldPriv to a fresh
+// key, counter-signed by the GCA.
+func newDeviceKeyRotation(shortID uint32, oldPub glow.PublicKey, oldPriv glow.PrivateKey, activation uint32, gcaPriv glow.PrivateKey) (DeviceKeyRotation, glow.PrivateKey) {
+	newPub, newPriv := glow.GenerateKeyPair()
+	rot := DeviceKeyRotation{ShortID: shortID, OldKey: oldPub, NewKey: newPub, ActivationTimeslot: activation}
+	rot.DeviceSignature = glow.Sign(rot.SigningBytes(), oldPriv)
+	rot.GCASignature = glow.Sign(rot.GCASigningBytes(), gcaPriv)
+	return rot, newPriv
+}
+
+// TestDeviceKeyRotation checks that a rotation needs both signatures, that the
+// old key is accepted during the overlap and refused after it, that the
+// reports of the new key are attributed to the same device, and that
+// everything survives a restart.
+func TestDeviceKeyRotation(t *testing.T) {
+	glow.SetCurrentTimeslot(100)
+	defer glow.SetCurrentTimeslot(0)
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{KeyRotationOverlap: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, oldPriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rotation needs the signature of the device and of the GCA, and
+	// can't hand off to a key of another device.
+	post := func(rot DeviceKeyRotation, want int) {
+		t.Helper()
+		if status, err := server.postDeviceKeyRotation(rot); err != nil || status != want {
+			t.Fatal("unexpected status for a rotation:", status, want, err)
+		}
+	}
+	rot, newPriv := newDeviceKeyRotation(1, ea.PublicKey, oldPriv, 110, gcaPrivKey)
+	forged := rot
+	forged.GCASignature = glow.Sign(forged.GCASigningBytes(), oldPriv)
+	post(forged, http.StatusForbidden)
+	forged = rot
+	forged.DeviceSignature = glow.Sign(forged.SigningBytes(), newPriv)
+	forged.GCASignature = glow.Sign(forged.GCASigningBytes(), gcaPrivKey)
+	post(forged, http.StatusForbidden)
+	taken := rot
+	taken.NewKey = other.PublicKey
+	taken.DeviceSignature = glow.Sign(taken.SigningBytes(), oldPriv)
+	taken.GCASignature = glow.Sign(taken.GCASigningBytes(), gcaPrivKey)
+	post(taken, http.StatusBadRequest)
+	stale, _ := newDeviceKeyRotation(1, ea.PublicKey, oldPriv, 99, gcaPrivKey)
+	post(stale, http.StatusUnprocessableEntity)
+	post(rot, http.StatusOK)
+	post(rot, http.StatusOK)
+
+	send := func(ts uint32, priv glow.PrivateKey) reportOutcome {
+		outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, ts, priv))
+		return outcome
+	}
+	checks := []struct {
+		timeslot uint32
+		priv     glow.PrivateKey
+		want     reportOutcome
+	}{
+		{105, oldPriv, reportAccepted},
+		{106, newPriv, reportOutsideAuthorization},
+		{110, newPriv, reportAccepted},
+		{119, oldPriv, reportAccepted},
+		{120, oldPriv, reportOutsideAuthorization},
+		{121, newPriv, reportAccepted},
+	}
+	for _, c := range checks {
+		if outcome := send(c.timeslot, c.priv); outcome != c.want {
+			t.Fatal("unexpected outcome:", c.timeslot, outcome, c.want)
+		}
+	}
+
+	// The reports of both keys belong to the device, which lists the new
+	// key in its stats.
+	server.mu.RLock()
+	reports := server.equipmentReports[1]
+	for _, ts := range []uint32{105, 110, 119, 121} {
+		if reports.PowerOutputs[ts] != 5 {
+			server.mu.RUnlock()
+			t.Fatal("report is missing:", ts)
+		}
+	}
+	server.mu.RUnlock()
+	status, ads, err := server.getAllDeviceStats("")
+	if err != nil || status != http.StatusOK {
+		t.Fatal("unable to fetch the stats:", status, err)
+	}
+	for _, ds := range ads.Devices {
+		if ds.PublicKey == ea.PublicKey && (ds.SigningKey == nil || *ds.SigningKey != rot.NewKey || ds.PowerOutputs[110] != 5) {
+			t.Fatalf("unexpected stats for the rotated device: %v", ds.SigningKey)
+		}
+		if ds.PublicKey == other.PublicKey && ds.SigningKey != nil {
+			t.Fatal("a device that never rotated has a signing key")
+		}
+	}
+
+	// The next rotation has to come from the new key.
+	next, _ := newDeviceKeyRotation(1, ea.PublicKey, oldPriv, 130, gcaPrivKey)
+	post(next, http.StatusForbidden)
+
+	// The rotation and the reports of the new key get loaded after a
+	// restart.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	server, err = NewGCAServerWithOptions(dir, false, ServerOptions{KeyRotationOverlap: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.mu.RLock()
+	reports = server.equipmentReports[1]
+	loaded := reports.PowerOutputs[110] == 5 && reports.PowerOutputs[121] == 5 && reports.PowerOutputs[119] == 5
+	server.mu.RUnlock()
+	if !loaded {
+		t.Fatal("the reports of the rotated device were not loaded")
+	}
+	if outcome := send(122, newPriv); outcome != reportAccepted {
+		t.Fatal("report from the new key was not accepted after a restart:", outcome)
+	}
+	if outcome := send(123, oldPriv); outcome != reportOutsideAuthorization {
+		t.Fatal("report from the old key was accepted after a restart:", outcome)
+	}
+}
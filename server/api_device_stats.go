@@ -21,12 +21,15 @@ package server
 // a test.
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"math"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"time"
 
@@ -38,6 +41,55 @@ type DeviceStats struct {
 	PublicKey    glow.PublicKey
 	PowerOutputs [2016]uint64
 	ImpactRates  [2016]float64
+
+	// Region is the WattTime region that the impact rates of the device
+	// currently come from, empty if the region is looked up from the
+	// coordinates of the device. It is not covered by the signature or
+	// included in the serialized form.
+	Region string `json:"Region,omitempty"`
+
+	// StaleImpactRates are the indexes of the impact rates that were
+	// filled with the last known value while WattTime was unavailable,
+	// and have not been backfilled yet. It is not covered by the
+	// signature or included in the serialized form either.
+	StaleImpactRates []int `json:"StaleImpactRates,omitempty"`
+
+	// CorrectedTimeslots are the indexes of the power outputs that were
+	// replaced by an override of the GCA, and OutageTimeslots are the
+	// indexes of the power outputs that the GCA filled in for a documented
+	// outage, see report_overrides.go. The power outputs themselves are
+	// covered by the signature, these lists are not, and neither is
+	// included in the serialized form.
+	CorrectedTimeslots []int `json:"CorrectedTimeslots,omitempty"`
+	OutageTimeslots    []int `json:"OutageTimeslots,omitempty"`
+
+	// Expired is set if the current authorization of the device expires
+	// before the end of the week, the reports for the timeslots from the
+	// expiry on are rejected, see equipment_expiry.go. It is not covered
+	// by the signature or included in the serialized form.
+	Expired bool `json:"Expired,omitempty"`
+
+	// SigningKey is the key that the device rotated to, nil if the device
+	// signs with the key of its authorization, see
+	// api_device_key_rotation.go. It is not covered by the signature or
+	// included in the serialized form.
+	SigningKey *glow.PublicKey `json:"SigningKey,omitempty"`
+
+	// LastSeenTimeslot is the most recent timeslot that the device
+	// reported for, and LastSeenUnix is its start. Both are null if the
+	// device has never reported. Online is set if the device reported
+	// within the last online_timeslots, see reload.go. None of them are
+	// covered by the signature or included in the serialized form.
+	LastSeenTimeslot *uint32 `json:"LastSeenTimeslot"`
+	LastSeenUnix     *int64  `json:"LastSeenUnix"`
+	Online           bool    `json:"Online"`
+
+	// Banned is set if the device is banned, and BanTimeslot is the
+	// timeslot from which on its reports don't count, see
+	// ban_accounting.go. Neither is covered by the signature or included
+	// in the serialized form.
+	Banned      bool   `json:"Banned,omitempty"`
+	BanTimeslot uint32 `json:"BanTimeslot,omitempty"`
 }
 
 // AllDeviceStats contains aggregate weekly statistics
@@ -45,39 +97,104 @@ type AllDeviceStats struct {
 	Devices        []DeviceStats // A set of data for each device
 	TimeslotOffset uint32        // Establish what week is covered by the data
 	Signature      glow.Signature
+
+	// TotalDevices is the number of devices that matched the filters of the
+	// request before limit and offset were applied. It is only used to help
+	// callers page through the results, and is not covered by the signature
+	// or included in the serialized form.
+	TotalDevices int `json:"total_devices"`
+
+	// NextCursor continues the pagination after this page, see
+	// page_cursors.go. It is empty on the last page, and like
+	// TotalDevices, it is not covered by the signature or included in
+	// the serialized form, which gets it in the X-Next-Cursor header.
+	NextCursor string `json:"next_cursor,omitempty"`
+
+	// Build is the build of the server that served the stats. Like
+	// TotalDevices, it is not covered by the signature or included in the
+	// serialized form.
+	Build *BuildInfo `json:"build,omitempty"`
 }
 
-// SigningBytes returns the set of bytes that should be signed by the GCA
-// server to authenticate the response.
-func (ads AllDeviceStats) SigningBytes() []byte {
-	// Add the length prefix
-	b := make([]byte, 4+len(ads.Devices)*(32+8*2*2016)+4)
-	i := 0
-	binary.LittleEndian.PutUint32(b, uint32(len(ads.Devices)))
-	i += 4
+// deviceStatsFilter contains the query parameters that can be used to narrow
+// down the set of devices returned by the all-device-stats endpoint.
+type deviceStatsFilter struct {
+	hasShortID    bool
+	shortID       uint32
+	hasPubKey     bool
+	pubKey        glow.PublicKey
+	limit         int // zero means no limit
+	offset        int
+	cursor        *pageCursor // See page_cursors.go
+	sinceTimeslot uint32
+}
 
-	// Add all the device data.
-	for x := 0; x < len(ads.Devices); x++ {
-		copy(b[i:], ads.Devices[x].PublicKey[:])
-		i += 32
-		for _, po := range ads.Devices[x].PowerOutputs {
-			binary.LittleEndian.PutUint64(b[i:], po)
-			i += 8
+// parseDeviceStatsFilter will parse the filtering and paging query
+// parameters of the all-device-stats endpoint.
+func parseDeviceStatsFilter(q url.Values) (dsf deviceStatsFilter, err error) {
+	if str := q.Get("short_id"); str != "" {
+		shortID, err := strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			return dsf, fmt.Errorf("invalid short_id format")
 		}
-		for _, ir := range ads.Devices[x].ImpactRates {
-			binary.LittleEndian.PutUint64(b[i:], math.Float64bits(ir))
-			i += 8
+		dsf.hasShortID = true
+		dsf.shortID = uint32(shortID)
+	}
+	if str := q.Get("pubkey"); str != "" {
+		pk, err := glow.ParsePublicKey(str)
+		if err != nil {
+			return dsf, fmt.Errorf("invalid pubkey format")
+		}
+		dsf.hasPubKey = true
+		dsf.pubKey = pk
+	}
+	if str := q.Get("limit"); str != "" {
+		limit, err := strconv.ParseUint(str, 10, 31)
+		if err != nil {
+			return dsf, fmt.Errorf("invalid limit format")
 		}
+		dsf.limit = int(limit)
 	}
+	if str := q.Get("offset"); str != "" {
+		offset, err := strconv.ParseUint(str, 10, 31)
+		if err != nil {
+			return dsf, fmt.Errorf("invalid offset format")
+		}
+		dsf.offset = int(offset)
+	}
+	if str := q.Get("cursor"); str != "" {
+		if dsf.offset != 0 {
+			return dsf, fmt.Errorf("offset can't be combined with a cursor")
+		}
+		pc, err := decodePageCursor(str)
+		if err != nil {
+			return dsf, err
+		}
+		dsf.cursor = &pc
+	}
+	if str := q.Get("since_timeslot"); str != "" {
+		since, err := strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			return dsf, fmt.Errorf("invalid since_timeslot format")
+		}
+		dsf.sinceTimeslot = uint32(since)
+	}
+	return dsf, nil
+}
 
-	// Add the timeslot offset.
-	binary.LittleEndian.PutUint32(b[i:], ads.TimeslotOffset)
-	i += 4
-	if i != len(b) {
-		panic("SigningBytes gone wrong")
+// SigningBytes returns the set of bytes that should be signed by the GCA
+// server to authenticate the response. They are the same bytes as the
+// SigningBytes of a glow.SignedAllDeviceStats, which is what third parties
+// verify the stats with.
+func (ads AllDeviceStats) SigningBytes() []byte {
+	b := make([]byte, 0, len("AllDeviceStats")+4+len(ads.Devices)*(32+8*2*2016)+4)
+	b = append(b, "AllDeviceStats"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(ads.Devices)))
+	for x := range ads.Devices {
+		ds := &ads.Devices[x]
+		b = glow.AppendDeviceStatsSigningBytes(b, ds.PublicKey, &ds.PowerOutputs, &ds.ImpactRates)
 	}
-	b = append([]byte("AllDeviceStats"), b...)
-	return b
+	return binary.LittleEndian.AppendUint32(b, ads.TimeslotOffset)
 }
 
 // Serialize will convert an AllDeviceStats to a byte slice.
@@ -198,58 +315,76 @@ func (ds DeviceStats) MarshalJSON() ([]byte, error) {
 }
 
 // AllDeviceStatsHandler will return the statistics on all of the devices for
-// the requested week.
+// the requested week, as JSON or in the binary encoding of api_binary.go.
 func (s *GCAServer) AllDeviceStatsHandler(w http.ResponseWriter, r *http.Request) {
 	// Only accept GET requests
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is supported.", http.StatusMethodNotAllowed)
-		s.logger.Warn("Received non-GET request for recent reports.")
+		s.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		s.requestLogger(r).Warn("Received non-GET request for recent reports.")
 		return
 	}
 
-	// Retrieve the desired week from the query.
-	tsoStr := r.URL.Query().Get("timeslot_offset")
-	if tsoStr == "" {
-		http.Error(w, "timeslot_offset is a required query parameter", http.StatusBadRequest)
+	// Retrieve the desired week from the query, which is either a
+	// timeslot offset or a period, see retained_periods.go.
+	tso, err := s.statsTimeslotOffset(r.URL.Query())
+	if err != nil {
+		s.writeError(w, ErrCodeMalformedRequest, err.Error())
 		return
 	}
-	tsoU64, err := strconv.ParseUint(tsoStr, 10, 32)
+	dsf, err := parseDeviceStatsFilter(r.URL.Query())
 	if err != nil {
-		http.Error(w, "invalid timeslot_offset format", http.StatusBadRequest)
+		s.writeError(w, ErrCodeMalformedRequest, err.Error())
 		return
 	}
-	tso := uint32(tsoU64)
 	if tso%2016 != 0 {
 		down := tso / 2016
 		down *= 2016
 		up := down + 2016
-		s := fmt.Sprintf("invalid timeslot_offset, must be multiple of 2016 - nearby numbers are %d and %d", down, up)
-		http.Error(w, s, http.StatusBadRequest)
+		msg := fmt.Sprintf("invalid timeslot_offset, must be multiple of 2016 - nearby numbers are %d and %d", down, up)
+		s.writeError(w, ErrCodeMalformedRequest, msg)
 		return
 	}
 
 	// Check whether we need to return all of the current values, or if we
-	// need to return
-	var stats AllDeviceStats
-	s.mu.Lock()
-	if tso < s.equipmentReportsOffset {
-		relativeTSO := tso - s.equipmentHistoryOffset
-		stats = s.equipmentStatsHistory[relativeTSO/2016]
-		s.mu.Unlock()
-	} else {
-		stats, err = s.buildDeviceStats(tso)
-		s.mu.Unlock()
-		if err != nil {
-			http.Error(w, "unable to build stats for the provided timeslot: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+	// need to return. The stats come from a snapshot, see
+	// stats_snapshot.go, filtering, signing, and marshaling happen without
+	// holding the lock. Responses with false negatives are different every
+	// time, so they don't get an ETag.
+	wantNeg := r.URL.Query().Get("insert_false_negatives") == "true"
+	binaryOut := wantsBinary(r)
+	w.Header().Add("Vary", "Accept")
+	snap, err := s.managedPagedStatsSnapshot(tso, dsf)
+	if errorCode(err, "") == ErrCodeLoading {
+		writeLoadingError(w, s.writeError)
+		return
 	}
+	if err != nil {
+		s.writeError(w, errorCode(err, ErrCodeInternalError), err.Error())
+		return
+	}
+	now := s.currentTimeslot()
+	etag := timeslotETag(snap.etag, now)
+	setStateVersionHeader(w, snap)
+	if binaryOut {
+		etag = binaryETag(etag)
+	}
+	if !wantNeg && etagMatches(r, etag) {
+		writeNotModified(w, etag)
+		return
+	}
+	page, total, more := pageDeviceStats(snap.stats, dsf, snap.shortIDs)
+	stats := copyDeviceStatsPage(snap.stats, page, total, dsf.cutoff(tso))
+	stats.NextCursor = s.statsNextCursor(snap, page, more)
+	if stats.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", stats.NextCursor)
+	}
+	setDeviceAnnotations(&stats, snap.annotations, snap.onlineTimeslots, now)
+	s.signDeviceStats(&stats)
 
 	// Check for a special query parameter that's asking for negative
 	// numbers. If there is a request for negative numbers, run through the
 	// ads and randomly set some values to be negative.
-	wantNegStr := r.URL.Query().Get("insert_false_negatives")
-	if wantNegStr == "true" {
+	if wantNeg {
 		rand.Seed(time.Now().UnixNano())
 		for i := 0; i < len(stats.Devices); i++ {
 			for j := 0; j < len(stats.Devices[i].PowerOutputs); j++ {
@@ -265,50 +400,321 @@ func (s *GCAServer) AllDeviceStatsHandler(w http.ResponseWriter, r *http.Request
 				if stats.Devices[i].PowerOutputs[j] > 1e18 {
 					continue
 				}
-				stats.Devices[i].PowerOutputs[j] = uint64(-1 * float64(stats.Devices[i].PowerOutputs[j]))
+				stats.Devices[i].PowerOutputs[j] = uint64(-int64(stats.Devices[i].PowerOutputs[j]))
 			}
 		}
 	}
 
 	// Send the response as JSON with a status code of OK
-	if err := json.NewEncoder(w).Encode(stats); err != nil {
-		http.Error(w, "Failed to encode JSON response", http.StatusInternalServerError)
+	if !wantNeg {
+		w.Header().Set("ETag", etag)
+	}
+	build := Build
+	stats.Build = &build
+	if binaryOut {
+		data, err := stats.MarshalBinary()
+		if err != nil {
+			s.writeError(w, ErrCodeInternalError, "Failed to encode binary response")
+			s.requestLogger(r).Error("Failed to encode binary response:", err)
+			return
+		}
+		s.writeBinaryResponse(w, r, data)
 		return
 	}
+	s.writeJSONResponse(w, r, stats)
 }
 
-// managedBuildDeviceStats will build a DeviceStats object for the provided
+// statsTimeslotOffset returns the timeslot offset of the week that a request
+// for device stats asks for, from the 'timeslot_offset' or the 'period' query
+// parameter. If both are set, they have to name the same week.
+func (s *GCAServer) statsTimeslotOffset(q url.Values) (uint32, error) {
+	period, hasPeriod, err := s.parsePeriod(q)
+	if err != nil {
+		return 0, err
+	}
+	tsoStr := q.Get("timeslot_offset")
+	if tsoStr == "" {
+		if !hasPeriod {
+			return 0, fmt.Errorf("timeslot_offset is a required query parameter")
+		}
+		return period * 2016, nil
+	}
+	tso, err := strconv.ParseUint(tsoStr, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeslot_offset format")
+	}
+	if hasPeriod && tso != uint64(period)*2016 {
+		return 0, fmt.Errorf("timeslot_offset %v is not the start of period %v", tso, period)
+	}
+	return uint32(tso), nil
+}
+
+// buildDeviceStats will build a signed AllDeviceStats object for the provided
 // timeslot offset.
-func (s *GCAServer) buildDeviceStats(timeslotOffset uint32) (ads AllDeviceStats, err error) {
-	// Check that timeslotOffset is in a range where the ads can be built.
+func (s *GCAServer) buildDeviceStats(timeslotOffset uint32) (AllDeviceStats, error) {
+	ads, err := s.snapshotDeviceStats(timeslotOffset)
+	if err != nil {
+		return ads, err
+	}
+	s.signDeviceStats(&ads)
+	return ads, nil
+}
+
+// signDeviceStats adds the signature of the server to the stats. It doesn't
+// touch the state of the server, so it can be called without holding the
+// mutex.
+func (s *GCAServer) signDeviceStats(ads *AllDeviceStats) {
+	ads.Signature = glow.Sign(ads.SigningBytes(), s.staticPrivateKey)
+}
+
+// snapshotDeviceStats copies the reports and impact rates of every device for
+// the provided timeslot offset, without signing the result.
+func (s *GCAServer) snapshotDeviceStats(timeslotOffset uint32) (ads AllDeviceStats, err error) {
+	x, err := s.windowIndex(timeslotOffset)
+	if err != nil {
+		return ads, err
+	}
+
+	// Build the ads. The devices are filled in place, a DeviceStats is too
+	// large to be copied around while the mutex is held.
+	shortIDs := s.windowShortIDs()
+	if len(shortIDs) > 0 {
+		ads.Devices = make([]DeviceStats, len(shortIDs))
+	}
+	for j, shortID := range shortIDs {
+		s.copyDeviceStats(&ads.Devices[j], shortID, timeslotOffset, x)
+	}
+
+	ads.TimeslotOffset = timeslotOffset
+	return ads, nil
+}
+
+// windowIndex returns the index in the reporting window of the week that
+// starts at the provided timeslot offset, which has to be one of the two
+// weeks in the window.
+func (s *GCAServer) windowIndex(timeslotOffset uint32) (int, error) {
 	if timeslotOffset%2016 != 0 {
-		return ads, fmt.Errorf("timeslotOffset must be a multiple of 2016")
+		return 0, fmt.Errorf("timeslotOffset must be a multiple of 2016")
 	}
 	if timeslotOffset < s.equipmentReportsOffset {
-		return ads, fmt.Errorf("timeslotOffset must not predate the current equipment offset")
-	}
-	var x int
-	if timeslotOffset == s.equipmentReportsOffset+2016 {
-		x = 2016
+		return 0, fmt.Errorf("timeslotOffset must not predate the current equipment offset")
 	}
 	if timeslotOffset > s.equipmentReportsOffset+2016 {
-		return ads, fmt.Errorf("timeslotOffset must not be in the future")
+		return 0, fmt.Errorf("timeslotOffset must not be in the future")
 	}
+	return int(timeslotOffset - s.equipmentReportsOffset), nil
+}
+
+// copyDeviceStats copies the power outputs and the impact rates of a device
+// for the week at index x of the reporting window. For a banned device these
+// are the ones from before its ban, see ban_accounting.go.
+func (s *GCAServer) copyDeviceStats(ds *DeviceStats, shortID uint32, timeslotOffset uint32, x int) {
+	reports, _ := s.windowReports(shortID)
+	ds.PublicKey = s.devicePublicKey(shortID)
+	copy(ds.PowerOutputs[:], reports.PowerOutputs[x:])
+	s.applyReportOverrides(shortID, timeslotOffset, ds.PowerOutputs[:])
+	copy(ds.ImpactRates[:], s.windowImpactRates(shortID)[x:])
+}
 
-	// Build the ads.
-	for shortID, reports := range s.equipmentReports {
-		var ds DeviceStats
-		ds.PublicKey = s.equipment[shortID].PublicKey
-		for i := 0; i < 2016; i++ {
-			ds.PowerOutputs[i] = reports[x+i].PowerOutput
+// deviceShortIDs returns the ShortIDs of the devices in the provided stats,
+// which is all that pageDeviceStats needs from the state of the server.
+// Devices that are no longer known to the server are left out.
+func (s *GCAServer) deviceShortIDs(ads AllDeviceStats) map[glow.PublicKey]uint32 {
+	shortIDs := make(map[glow.PublicKey]uint32, len(ads.Devices))
+	for _, ds := range ads.Devices {
+		if shortID, exists := s.deviceShortID(ds.PublicKey); exists {
+			shortIDs[ds.PublicKey] = shortID
 		}
-		copy(ds.ImpactRates[:], s.equipmentImpactRate[shortID][x:])
-		ads.Devices = append(ads.Devices, ds)
 	}
+	return shortIDs
+}
+
+// deviceAnnotation contains the fields of a DeviceStats that come from the
+// current state of the server rather than from the stats.
+type deviceAnnotation struct {
+	region             string
+	staleImpactRates   []int
+	correctedTimeslots []int
+	outageTimeslots    []int
+	expired            bool
+	signingKey         *glow.PublicKey
+	lastSeen           uint32
+	hasReported        bool
+	latitude           float64
+	longitude          float64
+	hasLocation        bool
+	note               *DeviceNote
+	uptime             *V2DeviceUptime
+	authorization      *glow.EquipmentAuthorization
+	banned             bool
+	banTimeslot        uint32
+}
+
+// deviceAnnotations returns the current region, the stale impact rates, the
+// overridden timeslots, the expiry, the last report, the location, the note,
+// the uptime and the authorization of the devices in the provided stats.
+func (s *GCAServer) deviceAnnotations(ads AllDeviceStats) map[glow.PublicKey]deviceAnnotation {
+	annotations := make(map[glow.PublicKey]deviceAnnotation)
+	for _, ds := range ads.Devices {
+		annotations[ds.PublicKey] = s.deviceAnnotation(ds.PublicKey, ads.TimeslotOffset)
+	}
+	return annotations
+}
 
-	// Set the timeslot offset and add a signature.
-	ads.TimeslotOffset = timeslotOffset
-	sb := ads.SigningBytes()
-	ads.Signature = glow.Sign(sb, s.staticPrivateKey)
-	return ads, nil
+// deviceAnnotation returns the annotation of a single device for the week
+// that starts at the provided timeslot offset.
+func (s *GCAServer) deviceAnnotation(publicKey glow.PublicKey, timeslotOffset uint32) deviceAnnotation {
+	da := deviceAnnotation{region: s.equipmentRegion(publicKey)}
+	if shortID, exists := s.equipmentShortID[publicKey]; exists {
+		da.staleImpactRates = s.staleImpactRates(shortID, timeslotOffset, 2016)
+		da.correctedTimeslots, da.outageTimeslots = s.overriddenTimeslots(shortID, timeslotOffset, 2016)
+		ea := s.equipment[shortID]
+		da.expired = ea.ExpiredAt(timeslotOffset + 2015)
+		if latest := s.latestDeviceKey(publicKey); latest != publicKey {
+			da.signingKey = &latest
+		}
+		da.lastSeen, da.hasReported = s.equipmentLastSeen[shortID]
+		da.latitude, da.longitude, da.hasLocation = ea.Latitude, ea.Longitude, true
+		da.uptime = s.deviceUptime(shortID, timeslotOffset)
+		da.authorization = &ea
+	} else if shortID, exists := s.deviceShortID(publicKey); exists {
+		// A banned device only has the reports from before its
+		// ban, and none of the state of an active device.
+		da.correctedTimeslots, da.outageTimeslots = s.overriddenTimeslots(shortID, timeslotOffset, 2016)
+		da.lastSeen, da.hasReported = s.equipmentLastSeen[shortID]
+		da.banTimeslot, da.banned = s.banTimeslot(shortID)
+	}
+	if dn, exists := s.latestDeviceNote(publicKey); exists {
+		da.note = &dn
+	}
+	return da
+}
+
+// setDeviceAnnotations fills in the fields from deviceAnnotations, a device is
+// online if it reported within onlineTimeslots of the provided timeslot. The
+// stats must be the result of copyDeviceStatsPage, the stats history must not
+// be modified.
+func setDeviceAnnotations(ads *AllDeviceStats, annotations map[glow.PublicKey]deviceAnnotation, onlineTimeslots uint32, now uint32) {
+	for i := range ads.Devices {
+		da := annotations[ads.Devices[i].PublicKey]
+		ads.Devices[i].Region = da.region
+		ads.Devices[i].StaleImpactRates = da.staleImpactRates
+		ads.Devices[i].CorrectedTimeslots = da.correctedTimeslots
+		ads.Devices[i].OutageTimeslots = da.outageTimeslots
+		ads.Devices[i].Expired = da.expired
+		ads.Devices[i].SigningKey = da.signingKey
+		ads.Devices[i].Banned = da.banned
+		ads.Devices[i].BanTimeslot = da.banTimeslot
+		if da.hasReported {
+			lastSeen, lastSeenUnix := da.lastSeen, glow.TimeslotToUnix(da.lastSeen)
+			ads.Devices[i].LastSeenTimeslot = &lastSeen
+			ads.Devices[i].LastSeenUnix = &lastSeenUnix
+			ads.Devices[i].Online = !da.banned && da.lastSeen+onlineTimeslots > now
+		}
+	}
+}
+
+// pageDeviceStats returns the indexes of the devices in the provided stats
+// that are on the page of a request, along with the number of devices that
+// matched the filters and whether there are more devices after the page. The
+// devices are sorted by ShortID so that pages remain stable between requests,
+// devices that are not in shortIDs are sorted to the end by public key. The
+// mutex does not need to be held, the ShortIDs come from deviceShortIDs.
+func pageDeviceStats(ads AllDeviceStats, dsf deviceStatsFilter, shortIDs map[glow.PublicKey]uint32) ([]int, int, bool) {
+	// Sort the indexes of the devices, a DeviceStats is too large to be
+	// moved around by the sort.
+	devices := ads.Devices
+	order := make([]int, len(devices))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		di, dj := &devices[order[i]], &devices[order[j]]
+		si, iKnown := shortIDs[di.PublicKey]
+		sj, jKnown := shortIDs[dj.PublicKey]
+		if iKnown != jKnown {
+			return iKnown
+		}
+		if iKnown && si != sj {
+			return si < sj
+		}
+		return bytes.Compare(di.PublicKey[:], dj.PublicKey[:]) < 0
+	})
+
+	// Drop any devices that don't match the short_id or pubkey filter. An
+	// unknown device results in an empty list rather than an error.
+	matched := order[:0]
+	for _, i := range order {
+		if dsf.hasPubKey && devices[i].PublicKey != dsf.pubKey {
+			continue
+		}
+		if dsf.hasShortID {
+			shortID, exists := shortIDs[devices[i].PublicKey]
+			if !exists || shortID != dsf.shortID {
+				continue
+			}
+		}
+		matched = append(matched, i)
+	}
+	total := len(matched)
+
+	// Apply the paging. A cursor skips the devices up to and including
+	// the last device of the previous page, see page_cursors.go.
+	if dsf.cursor != nil {
+		start := sort.Search(len(matched), func(j int) bool {
+			pk := devices[matched[j]].PublicKey
+			shortID, known := shortIDs[pk]
+			return dsf.cursor.after(known, shortID, pk)
+		})
+		matched = matched[start:]
+	}
+	if dsf.offset >= len(matched) {
+		matched = matched[:0]
+	} else {
+		matched = matched[dsf.offset:]
+	}
+	more := false
+	if dsf.limit > 0 && dsf.limit < len(matched) {
+		matched = matched[:dsf.limit]
+		more = true
+	}
+	return matched, total, more
+}
+
+// cutoff returns the number of timeslots at the start of the week that starts
+// at the provided timeslot offset that predate the since_timeslot.
+func (dsf deviceStatsFilter) cutoff(timeslotOffset uint32) uint32 {
+	if dsf.sinceTimeslot <= timeslotOffset {
+		return 0
+	}
+	if cutoff := dsf.sinceTimeslot - timeslotOffset; cutoff < 2016 {
+		return cutoff
+	}
+	return 2016
+}
+
+// copyDeviceStatsPage copies the devices of a page out of the provided stats,
+// blanking out the data of the first cutoff timeslots. The result still needs
+// to be signed with signDeviceStats. The input is not modified, as it may be
+// part of the stats history.
+func copyDeviceStatsPage(ads AllDeviceStats, page []int, total int, cutoff uint32) AllDeviceStats {
+	filtered := make([]DeviceStats, len(page))
+	for j, i := range page {
+		filtered[j] = ads.Devices[i]
+	}
+
+	// Blank out any data that predates the since_timeslot.
+	for i := range filtered {
+		for j := uint32(0); j < cutoff; j++ {
+			filtered[i].PowerOutputs[j] = 0
+			filtered[i].ImpactRates[j] = 0
+		}
+	}
+
+	result := AllDeviceStats{
+		Devices:        filtered,
+		TimeslotOffset: ads.TimeslotOffset,
+		TotalDevices:   total,
+	}
+	return result
 }
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getAllDeviceStats queries the all-device-stats endpoint with the provided
+// extra query parameters.
+func (gcas *GCAServer) getAllDeviceStats(params string) (int, AllDeviceStats, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/all-device-stats?timeslot_offset=0%v", gcas.httpPort, params))
+	if err != nil {
+		return 0, AllDeviceStats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, AllDeviceStats{}, nil
+	}
+	var ads AllDeviceStats
+	if err := json.NewDecoder(resp.Body).Decode(&ads); err != nil {
+		return 0, AllDeviceStats{}, err
+	}
+	return resp.StatusCode, ads, nil
+}
+
+// TestAllDeviceStatsFiltering checks the filtering and paging parameters of
+// the all-device-stats endpoint.
+func TestAllDeviceStatsFiltering(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Authorize the devices out of order, and give each one a report at
+	// timeslots 1 and 10.
+	shortIDs := []uint32{9, 2, 5}
+	keys := make(map[uint32]glow.PublicKey)
+	for _, shortID := range shortIDs {
+		ea, priv, err := server.AuthorizeTestDevice(shortID, gcaPrivKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[shortID] = ea.PublicKey
+		server.managedHandleEquipmentReport(generateTestReport(shortID, 1, priv))
+		server.managedHandleEquipmentReport(generateTestReport(shortID, 10, priv))
+	}
+
+	// Without any filters, every device should be returned in order of
+	// ShortID, with a valid signature.
+	_, ads, err := server.getAllDeviceStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices) != 3 || ads.TotalDevices != 3 {
+		t.Fatal("unexpected number of devices:", len(ads.Devices), ads.TotalDevices)
+	}
+	for i, shortID := range []uint32{2, 5, 9} {
+		if ads.Devices[i].PublicKey != keys[shortID] {
+			t.Fatal("devices are not sorted by ShortID")
+		}
+	}
+	if !glow.Verify(server.staticPublicKey, ads.SigningBytes(), ads.Signature) {
+		t.Fatal("bad signature")
+	}
+
+	// Page through the devices.
+	_, ads, err = server.getAllDeviceStats("&limit=2&offset=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices) != 2 || ads.TotalDevices != 3 || ads.Devices[0].PublicKey != keys[5] || ads.Devices[1].PublicKey != keys[9] {
+		t.Fatal("paging returned the wrong devices")
+	}
+	if !glow.Verify(server.staticPublicKey, ads.SigningBytes(), ads.Signature) {
+		t.Fatal("bad signature on a page")
+	}
+	_, ads, err = server.getAllDeviceStats("&offset=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices) != 0 || ads.TotalDevices != 3 {
+		t.Fatal("expected an empty page past the end")
+	}
+
+	// Filter by short_id and by pubkey.
+	_, ads, err = server.getAllDeviceStats("&short_id=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices) != 1 || ads.TotalDevices != 1 || ads.Devices[0].PublicKey != keys[5] {
+		t.Fatal("short_id filter failed")
+	}
+	pk := keys[9]
+	_, ads, err = server.getAllDeviceStats("&pubkey=" + hex.EncodeToString(pk[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices) != 1 || ads.Devices[0].PublicKey != keys[9] {
+		t.Fatal("pubkey filter failed")
+	}
+
+	// An unknown pubkey should produce an empty list rather than an error.
+	unknown, _ := glow.GenerateKeyPair()
+	status, ads, err := server.getAllDeviceStats("&pubkey=" + hex.EncodeToString(unknown[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(ads.Devices) != 0 || ads.TotalDevices != 0 {
+		t.Fatal("unknown pubkey should return an empty list:", status, len(ads.Devices))
+	}
+
+	// since_timeslot should drop the older report data.
+	_, ads, err = server.getAllDeviceStats("&short_id=2&since_timeslot=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ads.Devices[0].PowerOutputs[1] != 0 || ads.Devices[0].PowerOutputs[10] != 5 {
+		t.Fatal("since_timeslot was not applied:", ads.Devices[0].PowerOutputs[1], ads.Devices[0].PowerOutputs[10])
+	}
+
+	// Bad parameters should be rejected.
+	for _, params := range []string{"&limit=-1", "&offset=x", "&short_id=y", "&pubkey=zz", "&pubkey=abcd", "&since_timeslot=-4"} {
+		status, _, err := server.getAllDeviceStats(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusBadRequest {
+			t.Error("expected a bad request for", params, "got", status)
+		}
+	}
+}
+
+// TestDeviceStatsLastSeen checks that the stats report when each device was
+// last seen, that a device that never reported has no last seen timeslot, and
+// that the online flag follows the current timeslot and the online_timeslots
+// setting.
+func TestDeviceStatsLastSeen(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(12)
+	defer glow.SetCurrentTimeslot(0)
+
+	_, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.AuthorizeTestDevice(2, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	server.managedHandleEquipmentReport(generateTestReport(1, 10, priv))
+	server.managedHandleEquipmentReport(generateTestReport(1, 4, priv))
+
+	check := func(online bool) {
+		t.Helper()
+		_, ads, err := server.getAllDeviceStats("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ads.Devices) != 2 {
+			t.Fatal("unexpected number of devices:", len(ads.Devices))
+		}
+		ds := ads.Devices[0]
+		if ds.LastSeenTimeslot == nil || *ds.LastSeenTimeslot != 10 || ds.LastSeenUnix == nil || *ds.LastSeenUnix != glow.TimeslotToUnix(10) || ds.Online != online {
+			t.Fatalf("unexpected last seen: %v %v %v", ds.LastSeenTimeslot, ds.LastSeenUnix, ds.Online)
+		}
+		if ds := ads.Devices[1]; ds.LastSeenTimeslot != nil || ds.LastSeenUnix != nil || ds.Online {
+			t.Fatal("a device without reports has a last seen timeslot")
+		}
+	}
+	check(true)
+
+	// The device goes offline as time passes, and a longer online_timeslots
+	// brings it back.
+	glow.SetCurrentTimeslot(10 + deviceOnlineTimeslots)
+	check(false)
+	if err := os.WriteFile(filepath.Join(dir, ServerConfigFile), []byte(`{"online_timeslots": 100}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+}
+
+// TestAllDeviceStatsVerify checks that the stats that the server serves, plain
+// and wrapped in a signed response, verify with the checks of the glow package
+// that third parties use.
+func TestAllDeviceStatsVerify(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(12)
+	defer glow.SetCurrentTimeslot(0)
+	_, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.managedHandleEquipmentReport(generateTestReport(1, 10, priv))
+
+	fetch := func(params string) []byte {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/all-device-stats?timeslot_offset=0%v", server.httpDialAddr(), params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("unable to fetch the stats:", resp.StatusCode, err)
+		}
+		return data
+	}
+	stats, err := glow.VerifyAllDeviceStats(fetch(""), server.staticPublicKey)
+	if err != nil || len(stats.Devices) != 1 || stats.Devices[0].PowerOutputs[10] != 5 {
+		t.Fatal("the stats did not verify:", err)
+	}
+	body, err := glow.VerifySignedResponse(fetch("&signed=true"), server.staticPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := glow.VerifyAllDeviceStats(body, server.staticPublicKey); err != nil {
+		t.Fatal("the signed stats did not verify:", err)
+	}
+}
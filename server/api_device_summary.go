@@ -0,0 +1,158 @@
+package server
+
+// api_device_summary.go contains an endpoint that summarizes the reports of a
+// single device for the current week, which saves dashboards from having to
+// crunch the raw report arrays themselves.
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// DeviceSummary contains summary statistics for a single device over the
+// current week.
+type DeviceSummary struct {
+	ShortID            uint32
+	PublicKey          glow.PublicKey
+	WeekStart          uint32  // The first timeslot of the current week
+	ReportsReceived    uint32  // Reports received this week, including banned timeslots
+	BannedTimeslots    uint32  // Timeslots this week that were banned
+	TotalEnergy        int64   // Sum of the credited power outputs of this week's unbanned reports and outages, with the overrides of the GCA applied
+	RawEnergy          int64   // Sum of the readings behind TotalEnergy, including the negative readings and the garbage
+	AveragePower       float64 // TotalEnergy divided by the number of unbanned reports and outages
+	CorrectedTimeslots uint32  // Timeslots this week whose report was corrected by the GCA
+	OutageTimeslots    uint32  // Timeslots this week without a report that the GCA filled in for an outage
+	MissedTimeslots    uint32  // Completed timeslots this week without a report
+	LastSeenTimeslot   uint32  // The most recent timeslot with a report, only valid if HasReported is set
+	HasReported        bool    // Whether any report is held in memory for the device
+	Online             bool    // Whether the device reported within the last online_timeslots, see reload.go, never set for a banned device
+	Banned             bool    // Whether the device is banned, only the reports from before BanTimeslot count, see ban_accounting.go
+	BanTimeslot        uint32  // The timeslot from which on the reports of a banned device don't count
+}
+
+// DeviceSummaryHandler returns the DeviceSummary for the device identified by
+// either the 'pubkey' or the 'short_id' query parameter.
+func (gcas *GCAServer) DeviceSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for device summary.")
+		return
+	}
+
+	// Figure out which device is being requested.
+	q := r.URL.Query()
+	pkStr := q.Get("pubkey")
+	sidStr := q.Get("short_id")
+	if (pkStr == "") == (sidStr == "") {
+		gcas.writeError(w, ErrCodeMalformedRequest, "exactly one of pubkey or short_id must be provided")
+		return
+	}
+	var pk glow.PublicKey
+	var shortID uint32
+	if pkStr != "" {
+		var err error
+		pk, err = glow.ParsePublicKey(pkStr)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid pubkey")
+			return
+		}
+	} else {
+		sid, err := strconv.ParseUint(sidStr, 10, 32)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid short_id")
+			return
+		}
+		shortID = uint32(sid)
+	}
+
+	gcas.mu.RLock()
+	if pkStr != "" {
+		var exists bool
+		shortID, exists = gcas.deviceShortID(pk)
+		if !exists {
+			gcas.mu.RUnlock()
+			gcas.writeError(w, ErrCodeUnknownDevice, "unknown device")
+			return
+		}
+	}
+	if _, exists := gcas.windowReports(shortID); !exists {
+		gcas.mu.RUnlock()
+		gcas.writeError(w, ErrCodeUnknownDevice, "unknown device")
+		return
+	}
+	summary := gcas.buildDeviceSummary(shortID, gcas.currentTimeslot())
+	gcas.mu.RUnlock()
+
+	gcas.writeJSONResponse(w, r, summary)
+}
+
+// buildDeviceSummary computes the DeviceSummary of a device, using the
+// provided timeslot as the current time. The device must have reports in the
+// reporting window.
+func (gcas *GCAServer) buildDeviceSummary(shortID uint32, now uint32) DeviceSummary {
+	ds := DeviceSummary{
+		ShortID:   shortID,
+		PublicKey: gcas.devicePublicKey(shortID),
+		WeekStart: now - now%2016,
+	}
+	ds.BanTimeslot, ds.Banned = gcas.banTimeslot(shortID)
+	reports, _ := gcas.windowReports(shortID)
+	overrides := gcas.reportOverrides[shortID]
+	ero := gcas.equipmentReportsOffset
+
+	// Walk the current week. Timeslots that aren't in memory are skipped,
+	// which can only happen briefly around a migration.
+	var unbanned int64
+	for ts := ds.WeekStart; ts < ds.WeekStart+2016 && ts <= now; ts++ {
+		if ts < ero || ts >= ero+4032 || !gcas.reportCounts(shortID, ts) {
+			continue
+		}
+		output := reports.PowerOutputs[ts-ero]
+		ro, overridden := overrides[ts]
+		if overridden {
+			output = ro.PowerOutput
+			if ro.Outage {
+				ds.OutageTimeslots++
+			} else {
+				ds.CorrectedTimeslots++
+			}
+		}
+		switch output {
+		case 0:
+			if ts < now {
+				ds.MissedTimeslots++
+			}
+		case 1:
+			ds.ReportsReceived++
+			ds.BannedTimeslots++
+		default:
+			// Negative readings and garbage count as no
+			// production. An outage has no report.
+			if !overridden || !ro.Outage {
+				ds.ReportsReceived++
+			}
+			ds.TotalEnergy += int64(glow.CreditedPowerOutput(output))
+			if !glow.PowerOutputIsSentinel(output) {
+				ds.RawEnergy += glow.PowerReading(output)
+			}
+			unbanned++
+		}
+	}
+	if unbanned > 0 {
+		ds.AveragePower = float64(ds.TotalEnergy) / float64(unbanned)
+	}
+
+	// Find the most recent report anywhere in memory.
+	for i := 4031; i >= 0; i-- {
+		if reports.PowerOutputs[i] != 0 {
+			ds.LastSeenTimeslot = ero + uint32(i)
+			ds.HasReported = true
+			break
+		}
+	}
+	ds.Online = !ds.Banned && ds.HasReported && ds.LastSeenTimeslot+gcas.onlineTimeslots > now
+	return ds
+}
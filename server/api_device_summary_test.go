@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getDeviceSummary fetches the device summary with the provided query.
+func (gcas *GCAServer) getDeviceSummary(query string) (int, DeviceSummary, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/device-summary?%v", gcas.httpPort, query))
+	if err != nil {
+		return 0, DeviceSummary{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, DeviceSummary{}, nil
+	}
+	var ds DeviceSummary
+	err = json.NewDecoder(resp.Body).Decode(&ds)
+	return resp.StatusCode, ds, err
+}
+
+// TestDeviceSummary checks the summary statistics of a device that has
+// reported for part of the week.
+func TestDeviceSummary(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(20)
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(4, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Report for timeslots 1 through 10, and get timeslot 3 banned by
+	// sending a report above the capacity that the GCA has rejected.
+	for i := uint32(1); i <= 10; i++ {
+		if i == 3 {
+			continue
+		}
+		server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, i, ePriv))
+	}
+	oversized := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 3, PowerOutput: 2 * ea.Capacity}
+	oversized.Signature = glow.Sign(oversized.SigningBytes(), ePriv)
+	frr := FlaggedReportReview{ShortID: ea.ShortID, Timeslot: 3, PowerOutput: oversized.PowerOutput}
+	frr.Signature = glow.Sign(frr.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedReviewFlaggedReport(frr); err != nil {
+		t.Fatal(err)
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(oversized.Serialize()); outcome != reportBanned {
+		t.Fatal("rejected report did not ban the timeslot:", outcome)
+	}
+
+	status, ds, err := server.getDeviceSummary("pubkey=" + hex.EncodeToString(ea.PublicKey[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("unexpected status:", status)
+	}
+	expected := DeviceSummary{
+		ShortID:          ea.ShortID,
+		PublicKey:        ea.PublicKey,
+		WeekStart:        0,
+		ReportsReceived:  10,
+		BannedTimeslots:  1,
+		TotalEnergy:      45,
+		RawEnergy:        45,
+		AveragePower:     5,
+		MissedTimeslots:  10, // timeslots 0 and 11 through 19
+		LastSeenTimeslot: 10,
+		HasReported:      true,
+		Online:           true,
+	}
+	if ds != expected {
+		t.Fatalf("unexpected summary: %+v", ds)
+	}
+
+	// Uppercase and 0x prefixed keys are accepted as well.
+	upper := strings.ToUpper(hex.EncodeToString(ea.PublicKey[:]))
+	for _, pk := range []string{upper, "0x" + upper} {
+		status, byKey, err := server.getDeviceSummary("pubkey=" + pk)
+		if err != nil || status != http.StatusOK || byKey != expected {
+			t.Fatalf("unexpected summary for %v: %v %+v %v", pk, status, byKey, err)
+		}
+	}
+
+	// The same summary is available by ShortID.
+	_, byShortID, err := server.getDeviceSummary(fmt.Sprintf("short_id=%v", ea.ShortID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byShortID != expected {
+		t.Fatalf("unexpected summary by short id: %+v", byShortID)
+	}
+
+	// The device goes offline once enough timeslots pass without a
+	// report, and a new week starts with a clean slate.
+	server.mu.Lock()
+	offline := server.buildDeviceSummary(ea.ShortID, 10+deviceOnlineTimeslots)
+	nextWeek := server.buildDeviceSummary(ea.ShortID, 2016+5)
+	server.mu.Unlock()
+	if offline.Online || offline.LastSeenTimeslot != 10 {
+		t.Fatalf("expected the device to be offline: %+v", offline)
+	}
+	if nextWeek.WeekStart != 2016 || nextWeek.ReportsReceived != 0 || nextWeek.MissedTimeslots != 5 || !nextWeek.HasReported {
+		t.Fatalf("unexpected summary for the next week: %+v", nextWeek)
+	}
+
+	// Bad lookups get rejected.
+	for query, expectedStatus := range map[string]int{
+		"":                     http.StatusBadRequest,
+		"short_id=4&pubkey=00": http.StatusBadRequest,
+		"pubkey=zz":            http.StatusBadRequest,
+		"short_id=-1":          http.StatusBadRequest,
+		"short_id=5":           http.StatusNotFound,
+		"pubkey=" + hex.EncodeToString(make([]byte, 32)): http.StatusNotFound,
+	} {
+		status, _, err := server.getDeviceSummary(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != expectedStatus {
+			t.Errorf("query %q: expected %v, got %v", query, expectedStatus, status)
+		}
+	}
+}
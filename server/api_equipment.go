@@ -20,7 +20,7 @@ type EquipmentResponse struct {
 func (gcas *GCAServer) EquipmentHandler(w http.ResponseWriter, r *http.Request) {
 	// Restrict to GET calls.
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is allowed")
 		return
 	}
 
@@ -28,15 +28,19 @@ func (gcas *GCAServer) EquipmentHandler(w http.ResponseWriter, r *http.Request)
 	er := EquipmentResponse{
 		EquipmentDetails: make(map[uint32]glow.EquipmentAuthorization),
 	}
-	gcas.mu.Lock()
+	gcas.mu.RLock()
 	for k, v := range gcas.equipment {
+		// Deauthorized equipment is no longer part of the active set.
+		if _, exists := gcas.equipmentDeauthorizations[v.PublicKey]; exists {
+			continue
+		}
 		er.EquipmentDetails[k] = v
 	}
-	gcas.mu.Unlock()
+	gcas.mu.RUnlock()
 
 	// Write the response
 	if err := json.NewEncoder(w).Encode(er); err != nil {
-		http.Error(w, "Failed to encode JSON response: "+err.Error(), http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeInternalError, "Failed to encode JSON response: "+err.Error())
 		return
 	}
 }
@@ -5,7 +5,6 @@ package server
 // requests to the server.
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,24 +18,24 @@ import (
 func (gca *GCAServer) AuthorizeEquipmentHandler(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is supported.", http.StatusMethodNotAllowed)
-		gca.logger.Warn("Received non-POST request for equipment authorization.")
+		gca.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gca.requestLogger(r).Warn("Received non-POST request for equipment authorization.")
 		return
 	}
 
 	// Decode the JSON request body into the authorization.
 	var request glow.EquipmentAuthorization
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		gca.logger.Error("Failed to decode request body: ", err)
+		gca.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gca.requestLogger(r).Error("Failed to decode request body: ", err)
 		return
 	}
 
 	// Validate and process the request
 	isNew, err := gca.managedAuthorizeEquipment(request)
 	if err != nil {
-		http.Error(w, fmt.Sprint("Failed to authorize equipment:", err), http.StatusInternalServerError)
-		gca.logger.Error("Failed to authorize equipment: ", err)
+		gca.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to authorize equipment:", err))
+		gca.requestLogger(r).WithFields("short_id", request.ShortID, "pubkey", request.PublicKey).Error("Failed to authorize equipment: ", err)
 		return
 	}
 
@@ -61,16 +60,17 @@ func (gca *GCAServer) AuthorizeEquipmentHandler(w http.ResponseWriter, r *http.R
 	gca.gcaServers.mu.Unlock()
 	for _, as := range ass {
 		jsonBody, _ := json.Marshal(request)
-		resp, err := http.Post(fmt.Sprintf("http://%v:%v/api/v1/authorize-equipment", as.Location, as.HttpPort), "application/json", bytes.NewBuffer(jsonBody))
+		resp, err := gca.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/authorize-equipment", jsonBody)
 		if err != nil {
-			gca.logger.Infof("unable to send http request to submit new hardware: %v", err)
+			gca.requestLogger(r).WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to send http request to submit new hardware")
+			continue
 		}
 		resp.Body.Close()
 	}
 
 	// Send a success response
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
-	gca.logger.Info("Successfully authorized equipment.")
+	gca.requestLogger(r).WithFields("short_id", request.ShortID, "pubkey", request.PublicKey).Info("Successfully authorized equipment.")
 }
 
 // managedAuthorizeEquipment performs the actual authorization based on the client request.
@@ -79,31 +79,70 @@ func (gcas *GCAServer) managedAuthorizeEquipment(auth glow.EquipmentAuthorizatio
 	gcas.mu.Lock()
 	defer gcas.mu.Unlock()
 	if !gcas.gcaPubkeyAvailable {
-		return false, fmt.Errorf("this gca server has not yet been initialized by the GCA")
+		return false, errNotInitialized
 	}
 
 	err := gcas.verifyEquipmentAuthorization(auth)
 	if err != nil {
-		gcas.logger.Warn("Received bad equipment authorization signature", auth)
-		return false, fmt.Errorf("unable to verify authorization: %v", err)
+		gcas.logger.WithFields("short_id", auth.ShortID, "pubkey", auth.PublicKey).Warn("Received bad equipment authorization signature")
+		return false, withCode(ErrCodeInvalidSignature, fmt.Errorf("unable to verify authorization: %v", err))
+	}
+	if err := gcas.verifyAuthorizationVersion(auth); err != nil {
+		return false, err
+	}
+	if err := gcas.verifyNotTestKey("device", auth.PublicKey); err != nil {
+		return false, err
 	}
 	isNew, err := gcas.saveEquipment(auth)
 	if err != nil {
-		gcas.logger.Warn("Unable to save equipment:", auth)
-		return false, fmt.Errorf("unable to save equipment: %v", err)
+		gcas.logger.WithFields("short_id", auth.ShortID, "pubkey", auth.PublicKey, "error", err).Warn("Unable to save equipment")
+		return false, fmt.Errorf("unable to save equipment: %w", err)
 	}
 	return isNew, nil
 }
 
 // verifyEquipmentAuthorization checks the validity of the signature on an EquipmentAuthorization.
 //
-// It uses the public key of the Grid Control Authority (gcaPubkey) to verify the signature.
+// It uses the public key of the Grid Control Authority that is accepted in the
+// current timeslot to verify the signature, see api_gca_key_rotation.go.
 // The method returns an error if the verification fails.
 func (gcas *GCAServer) verifyEquipmentAuthorization(ea glow.EquipmentAuthorization) error {
 	signingBytes := ea.SigningBytes()
-	isValid := glow.Verify(gcas.gcaPubkey, signingBytes, ea.Signature)
+	isValid := gcas.verifyGCASignature(signingBytes, ea.Signature)
 	if !isValid {
 		return errors.New("invalid signature on EquipmentAuthorization")
 	}
 	return nil
 }
+
+// verifyPersistedEquipmentAuthorization checks the signature on an
+// EquipmentAuthorization that the server accepted in the past, which may have
+// been signed by a GCA key that has since been rotated out. The authorization
+// of imported equipment was verified as part of the import.
+func (gcas *GCAServer) verifyPersistedEquipmentAuthorization(ea glow.EquipmentAuthorization) error {
+	if ei, imported := gcas.equipmentImports[ea.ShortID]; imported && ei.authorization() == ea {
+		return nil
+	}
+	if !gcas.verifyPersistedGCASignature(ea.SigningBytes(), ea.Signature) {
+		return errors.New("invalid signature on EquipmentAuthorization")
+	}
+	return nil
+}
+
+// verifyAuthorizationVersion checks that an EquipmentAuthorization uses a
+// format that the server accepts. The legacy format has no nonce and can
+// therefore be replayed, so it is only accepted in internal test mode to give
+// existing deployments a migration path.
+func (gcas *GCAServer) verifyAuthorizationVersion(ea glow.EquipmentAuthorization) error {
+	switch ea.Version {
+	case glow.EquipmentAuthorizationVersion, glow.EquipmentAuthorizationVersionExpiring:
+		return nil
+	case glow.EquipmentAuthorizationVersionLegacy:
+		if gcas.allowIntApis {
+			return nil
+		}
+		return withCode(ErrCodeMalformedRequest, errors.New("legacy equipment authorizations are only accepted in internal test mode"))
+	default:
+		return withCode(ErrCodeMalformedRequest, fmt.Errorf("unsupported equipment authorization version: %v", ea.Version))
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+// api_equipment_auth_batch.go contains an endpoint that allows the GCA to
+// authorize many pieces of equipment at once, which is useful when
+// provisioning a large farm.
+//
+// Each authorization in the batch is validated independently and gets its own
+// result. All of the authorizations that need to be recorded are persisted
+// with a single atomic write, so a crash in the middle of a batch can never
+// leave only part of it on disk. If the write fails, none of the batch is
+// applied and the GCA can safely retry the whole thing.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// The possible statuses of an authorization in a batch.
+const (
+	batchAuthAuthorized        = "authorized"
+	batchAuthAlreadyAuthorized = "already-authorized"
+	batchAuthInvalidSignature  = "invalid-signature"
+	batchAuthShortIDConflict   = "shortID-conflict"
+	batchAuthRejected          = "rejected"
+)
+
+// BatchAuthorizationResult contains the result for a single authorization in
+// a batch.
+type BatchAuthorizationResult struct {
+	ShortID uint32
+	Status  string // One of "authorized", "already-authorized", "invalid-signature", "shortID-conflict", or "rejected"
+	Reason  string // Extra detail for a "rejected" authorization, empty otherwise
+}
+
+// BatchAuthorizationResponse contains the results of a bulk authorization, in
+// the same order as the authorizations in the request.
+type BatchAuthorizationResponse struct {
+	Results   []BatchAuthorizationResult
+	Signature glow.Signature
+}
+
+// SigningBytes returns the bytes that should be signed by the GCA server to
+// authenticate the response.
+func (bar BatchAuthorizationResponse) SigningBytes() []byte {
+	b := []byte("BatchAuthorizationResponse")
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(bar.Results)))
+	for _, r := range bar.Results {
+		b = binary.LittleEndian.AppendUint32(b, r.ShortID)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(r.Status)))
+		b = append(b, r.Status...)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(r.Reason)))
+		b = append(b, r.Reason...)
+	}
+	return b
+}
+
+// BatchAuthorizeEquipmentHandler accepts a JSON array of equipment
+// authorizations from the GCA.
+func (gcas *GCAServer) BatchAuthorizeEquipmentHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for bulk equipment authorization.")
+		return
+	}
+
+	// Decode the authorizations, limiting the size of the body to a
+	// generous multiple of the largest valid batch.
+	body := http.MaxBytesReader(w, r.Body, maxBatchAuthorizations*1024)
+	var untrustedAuths []glow.EquipmentAuthorization
+	if err := json.NewDecoder(body).Decode(&untrustedAuths); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode bulk authorizations: ", err)
+		return
+	}
+	if len(untrustedAuths) == 0 {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Batch must contain at least one authorization")
+		return
+	}
+	if len(untrustedAuths) > maxBatchAuthorizations {
+		gcas.writeError(w, ErrCodeRequestTooLarge, fmt.Sprintf("Batch contains %d authorizations, the limit is %d", len(untrustedAuths), maxBatchAuthorizations))
+		return
+	}
+
+	results, newAuths, err := gcas.managedAuthorizeEquipmentBatch(untrustedAuths)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to authorize equipment:", err))
+		gcas.requestLogger(r).Error("Failed to authorize equipment batch: ", err)
+		return
+	}
+
+	// Forward the new authorizations to the other servers, the same way
+	// that single authorizations are forwarded. Only new equipment and
+	// the conflicts within the batch get forwarded, which keeps the
+	// servers from passing the same batch around forever.
+	if len(newAuths) > 0 {
+		gcas.gcaServers.mu.Lock()
+		ass := make([]AuthorizedServer, len(gcas.gcaServers.servers))
+		copy(ass, gcas.gcaServers.servers)
+		gcas.gcaServers.mu.Unlock()
+		jsonBody, _ := json.Marshal(newAuths)
+		for _, as := range ass {
+			resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/authorize-equipment/batch", jsonBody)
+			if err != nil {
+				gcas.requestLogger(r).WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to forward bulk equipment authorization")
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	resp := BatchAuthorizationResponse{Results: results}
+	resp.Signature = glow.Sign(resp.SigningBytes(), gcas.staticPrivateKey)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		gcas.requestLogger(r).Error("Failed to encode JSON response:", err)
+		return
+	}
+	gcas.requestLogger(r).Infof("Processed bulk authorization of %v devices, %v new.", len(untrustedAuths), len(newAuths))
+}
+
+// managedAuthorizeEquipmentBatch validates every authorization in a batch,
+// persists all of the ones that need to be recorded in a single write, and
+// then applies them. The authorizations that added new equipment, and the
+// ones that banned a ShortID within the batch, are returned alongside the
+// results.
+//
+// Authorizations that conflict with existing equipment are recorded, just
+// like they are for single authorizations, because they are the evidence
+// that the ShortID needs to be banned.
+func (gcas *GCAServer) managedAuthorizeEquipmentBatch(untrustedAuths []glow.EquipmentAuthorization) ([]BatchAuthorizationResult, []glow.EquipmentAuthorization, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return nil, nil, errNotInitialized
+	}
+
+	// Classify every authorization against the current state plus the
+	// earlier entries of the batch. Nothing is modified until the batch
+	// has been saved.
+	results := make([]BatchAuthorizationResult, len(untrustedAuths))
+	pending := make(map[uint32]glow.EquipmentAuthorization)
+	pendingResults := make(map[uint32][]int)
+	batchBans := make(map[uint32]struct{})
+	pendingBans := make(map[uint32]struct{})
+	pendingNonces := make(map[uint64]struct{})
+	var toSave, newAuths []glow.EquipmentAuthorization
+	for i, ea := range untrustedAuths {
+		results[i].ShortID = ea.ShortID
+		if err := gcas.verifyEquipmentAuthorization(ea); err != nil {
+			gcas.logger.WithFields("short_id", ea.ShortID, "pubkey", ea.PublicKey).Warn("Received bad equipment authorization signature")
+			results[i].Status = batchAuthInvalidSignature
+			continue
+		}
+		if err := gcas.verifyAuthorizationVersion(ea); err != nil {
+			results[i].Status = batchAuthRejected
+			results[i].Reason = err.Error()
+			continue
+		}
+		if err := gcas.verifyNotTestKey("device", ea.PublicKey); err != nil {
+			results[i].Status = batchAuthRejected
+			results[i].Reason = err.Error()
+			continue
+		}
+		_, banned := gcas.equipmentBans[ea.ShortID]
+		_, pendingBan := pendingBans[ea.ShortID]
+		if banned || pendingBan {
+			results[i].Status = batchAuthShortIDConflict
+			continue
+		}
+		if _, exists := gcas.equipmentDeauthorizations[ea.PublicKey]; exists {
+			results[i].Status = batchAuthRejected
+			results[i].Reason = "equipment with this public key has been deauthorized"
+			continue
+		}
+		if err := gcas.checkShortIDReuse(ea); err != nil {
+			results[i].Status = batchAuthRejected
+			results[i].Reason = err.Error()
+			continue
+		}
+		current, exists := pending[ea.ShortID]
+		inBatch := exists
+		if !exists {
+			current, exists = gcas.equipment[ea.ShortID]
+		}
+		// An authorization that has since been renewed is outdated
+		// rather than a conflict, see equipment_expiry.go.
+		if exists && (current == ea || isRenewal(ea, current)) {
+			results[i].Status = batchAuthAlreadyAuthorized
+			continue
+		}
+		if ea.Version != glow.EquipmentAuthorizationVersionLegacy {
+			_, used := gcas.equipmentNonces[ea.Nonce]
+			_, pendingUse := pendingNonces[ea.Nonce]
+			if used || pendingUse {
+				results[i].Status = batchAuthRejected
+				results[i].Reason = fmt.Sprintf("authorization nonce %v has already been used", ea.Nonce)
+				continue
+			}
+			pendingNonces[ea.Nonce] = struct{}{}
+		}
+		toSave = append(toSave, ea)
+		if exists && !isRenewal(current, ea) {
+			// When the conflict is with an earlier entry of the batch,
+			// that entry ends up banned as well.
+			if inBatch {
+				for _, j := range pendingResults[ea.ShortID] {
+					results[j].Status = batchAuthShortIDConflict
+				}
+				batchBans[ea.ShortID] = struct{}{}
+			}
+			delete(pending, ea.ShortID)
+			delete(pendingResults, ea.ShortID)
+			pendingBans[ea.ShortID] = struct{}{}
+			results[i].Status = batchAuthShortIDConflict
+			continue
+		}
+		pending[ea.ShortID] = ea
+		pendingResults[ea.ShortID] = append(pendingResults[ea.ShortID], i)
+		results[i].Status = batchAuthAuthorized
+	}
+	if len(toSave) == 0 {
+		return results, nil, nil
+	}
+
+	// Save the whole batch at once. Legacy authorizations live in their
+	// own file, so a batch that mixes formats takes one write per file and
+	// is not atomic as a whole. That is only possible in internal test
+	// mode.
+	files := make(map[string][]byte)
+	records := make([]auditRecord, 0, len(toSave))
+	for _, ea := range toSave {
+		name := gcas.equipmentFile(ea)
+		files[name] = append(files[name], ea.Serialize()...)
+		records = append(records, auditRecord{
+			action:     glow.AuditEquipmentAuthorization,
+			request:    ea.Serialize(),
+			signatures: []glow.AuditSignature{gcas.gcaAuditSignature(ea.SigningBytes(), ea.Signature)},
+		})
+	}
+	if err := gcas.recordAudit(records...); err != nil {
+		return nil, nil, err
+	}
+	for name, data := range files {
+		err := gcas.staticStorage.AppendFile(name, data, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to save equipment: %v", err)
+		}
+	}
+
+	// Apply the batch in order, which reproduces the outcomes computed
+	// above. A ShortID that the batch itself banned gets all of its
+	// authorizations forwarded, otherwise the other servers would
+	// authorize the first one without ever seeing the conflict.
+	for _, ea := range toSave {
+		_, banned := batchBans[ea.ShortID]
+		if gcas.applyEquipment(ea) || banned {
+			newAuths = append(newAuths, ea)
+		}
+	}
+	return results, newAuths, nil
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postBatchAuthorizations submits a batch of authorizations to the server.
+func (gcas *GCAServer) postBatchAuthorizations(eas []glow.EquipmentAuthorization) (int, BatchAuthorizationResponse, error) {
+	jsonBody, _ := json.Marshal(eas)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/authorize-equipment/batch", gcas.httpPort), "application/json", bytes.NewReader(jsonBody))
+	if err != nil {
+		return 0, BatchAuthorizationResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, BatchAuthorizationResponse{}, nil
+	}
+	var bar BatchAuthorizationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bar); err != nil {
+		return 0, BatchAuthorizationResponse{}, err
+	}
+	return resp.StatusCode, bar, nil
+}
+
+// TestBatchAuthorizeEquipment submits a batch containing new, repeated,
+// conflicting, and badly signed authorizations, including two different
+// authorizations for the same ShortID, and checks that every entry
+// gets the right result and that the batch survives a restart.
+func TestBatchAuthorizeEquipment(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeAuth := func(shortID uint32, signer glow.PrivateKey) glow.EquipmentAuthorization {
+		pub, _ := glow.GenerateKeyPair()
+		ea := glow.EquipmentAuthorization{
+			ShortID:    shortID,
+			PublicKey:  pub,
+			Capacity:   1e6,
+			Expiration: 100e6,
+		}
+		return SignEquipmentAuthorization(ea, signer)
+	}
+	_, wrongKey := glow.GenerateKeyPair()
+	batch := []glow.EquipmentAuthorization{
+		makeAuth(10, gcaPrivKey),
+		makeAuth(11, wrongKey),
+		existing,
+		makeAuth(1, gcaPrivKey), // conflicts with the existing equipment
+		makeAuth(12, gcaPrivKey),
+		makeAuth(13, gcaPrivKey),
+		makeAuth(13, gcaPrivKey), // conflicts with the entry before it
+	}
+	status, bar, err := server.postBatchAuthorizations(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("unexpected status:", status)
+	}
+	if !glow.Verify(server.staticPublicKey, bar.SigningBytes(), bar.Signature) {
+		t.Fatal("bad signature on the response")
+	}
+	expected := []string{
+		batchAuthAuthorized,
+		batchAuthInvalidSignature,
+		batchAuthAlreadyAuthorized,
+		batchAuthShortIDConflict,
+		batchAuthAuthorized,
+		batchAuthShortIDConflict,
+		batchAuthShortIDConflict,
+	}
+	if len(bar.Results) != len(expected) {
+		t.Fatal("wrong number of results:", len(bar.Results))
+	}
+	for i, r := range bar.Results {
+		if r.ShortID != batch[i].ShortID || r.Status != expected[i] {
+			t.Error("unexpected result", i, r)
+		}
+	}
+
+	// Check the state, both before and after a restart.
+	checkState := func() {
+		t.Helper()
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if server.equipment[10] != batch[0] || server.equipment[12] != batch[4] {
+			t.Fatal("new equipment is missing")
+		}
+		if _, exists := server.equipment[11]; exists {
+			t.Fatal("badly signed equipment was authorized")
+		}
+		if _, exists := server.equipmentBans[1]; !exists {
+			t.Fatal("conflicting ShortID was not banned")
+		}
+		if _, exists := server.equipment[13]; exists {
+			t.Fatal("ShortID that conflicts within the batch was authorized")
+		}
+		if _, exists := server.equipmentBans[13]; !exists {
+			t.Fatal("ShortID that conflicts within the batch was not banned")
+		}
+	}
+	checkState()
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	checkState()
+
+	// Submitting the same batch again should not add anything new.
+	_, bar, err = server.postBatchAuthorizations(batch[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bar.Results[0].Status != batchAuthAlreadyAuthorized {
+		t.Fatal("repeated authorization was not recognized:", bar.Results[0])
+	}
+
+	// A renewal is authorized, whether it renews equipment that the
+	// server already has or an earlier entry of the same batch.
+	makeExpiring := func(shortID uint32) (glow.EquipmentAuthorization, glow.EquipmentAuthorization) {
+		pub, _ := glow.GenerateKeyPair()
+		ea := glow.EquipmentAuthorization{
+			Version:    glow.EquipmentAuthorizationVersionExpiring,
+			ShortID:    shortID,
+			PublicKey:  pub,
+			Capacity:   1e6,
+			Expiration: 1000,
+			Nonce:      testAuthorizationNonce.Add(1),
+		}
+		renewal := ea
+		renewal.Expiration = 5000
+		renewal.Nonce = testAuthorizationNonce.Add(1)
+		ea.Signature = glow.Sign(ea.SigningBytes(), gcaPrivKey)
+		renewal.Signature = glow.Sign(renewal.SigningBytes(), gcaPrivKey)
+		return ea, renewal
+	}
+	checkRenewal := func(batch []glow.EquipmentAuthorization, expected []string, renewal glow.EquipmentAuthorization) {
+		t.Helper()
+		_, bar, err := server.postBatchAuthorizations(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bar.Results) != len(expected) {
+			t.Fatal("wrong number of results:", len(bar.Results))
+		}
+		for i, r := range bar.Results {
+			if r.Status != expected[i] {
+				t.Error("unexpected result", i, r)
+			}
+		}
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if server.equipment[renewal.ShortID] != renewal {
+			t.Fatal("the renewal is not the current authorization")
+		}
+		if _, exists := server.equipmentBans[renewal.ShortID]; exists {
+			t.Fatal("a renewal got the ShortID banned")
+		}
+	}
+	original, renewal := makeExpiring(20)
+	checkRenewal([]glow.EquipmentAuthorization{original, renewal}, []string{batchAuthAuthorized, batchAuthAuthorized}, renewal)
+	original, renewal = makeExpiring(21)
+	_, _, err = server.postBatchAuthorizations([]glow.EquipmentAuthorization{original})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRenewal([]glow.EquipmentAuthorization{renewal}, []string{batchAuthAuthorized}, renewal)
+
+	// Resubmitting an authorization after its renewal is outdated rather
+	// than a conflict, both on its own and after the renewal in a batch.
+	checkRenewal([]glow.EquipmentAuthorization{original}, []string{batchAuthAlreadyAuthorized}, renewal)
+	original, renewal = makeExpiring(22)
+	checkRenewal([]glow.EquipmentAuthorization{renewal, original}, []string{batchAuthAuthorized, batchAuthAlreadyAuthorized}, renewal)
+
+	// Both sides of a conflict within a batch get forwarded, so that the
+	// other servers ban the ShortID as well.
+	conflict := []glow.EquipmentAuthorization{makeAuth(14, gcaPrivKey), makeAuth(14, gcaPrivKey)}
+	results, forwarded, err := server.managedAuthorizeEquipmentBatch(conflict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Status != batchAuthShortIDConflict {
+			t.Error("unexpected result", i, r)
+		}
+	}
+	if len(forwarded) != 2 || forwarded[0] != conflict[0] || forwarded[1] != conflict[1] {
+		t.Fatal("the conflict was not forwarded:", len(forwarded))
+	}
+
+	// Empty and oversized batches are rejected.
+	status, _, err = server.postBatchAuthorizations(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusBadRequest {
+		t.Fatal("expected an empty batch to be rejected:", status)
+	}
+	large := make([]glow.EquipmentAuthorization, maxBatchAuthorizations+1)
+	status, _, err = server.postBatchAuthorizations(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatal("expected an oversized batch to be rejected:", status)
+	}
+}
+
+// TestBatchAuthorizeEquipmentAtomic interrupts the write of a batch and
+// checks that none of the batch was applied.
+func TestBatchAuthorizeEquipmentAtomic(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	// The faults get injected into the atomic writes of the files.
+	useFileStorage(dir)
+	server, _, gcaPrivKey, err := SetupTestServer(dir, DefaultServerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch []glow.EquipmentAuthorization
+	for i := uint32(0); i < 20; i++ {
+		pub, _ := glow.GenerateKeyPair()
+		ea := glow.EquipmentAuthorization{
+			ShortID:   i,
+			PublicKey: pub,
+			Capacity:  1e6,
+		}
+		batch = append(batch, SignEquipmentAuthorization(ea, gcaPrivKey))
+	}
+	clearFault := injectWriteFault()
+	_, _, err = server.managedAuthorizeEquipmentBatch(batch)
+	clearFault()
+	if err == nil {
+		t.Fatal("expected the interrupted batch to fail")
+	}
+	server.mu.Lock()
+	numEquipment := len(server.equipment)
+	server.mu.Unlock()
+	if numEquipment != 0 {
+		t.Fatal("part of a failed batch was applied:", numEquipment)
+	}
+
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.mu.Lock()
+	numEquipment = len(server.equipment)
+	server.mu.Unlock()
+	if numEquipment != 0 {
+		t.Fatal("part of a failed batch was recorded:", numEquipment)
+	}
+}
@@ -11,64 +11,6 @@ import (
 	"github.com/glowlabs-org/gca-backend/glow"
 )
 
-// submitNewHardware will create a new piece of hardware and submit it to the
-// GCA server.
-func (gcas *GCAServer) submitNewHardware(shortID uint32, gcaPrivKey glow.PrivateKey) (ea glow.EquipmentAuthorization, equipmentKey glow.PrivateKey, err error) {
-	// Verify that the shortID is free. Even if the shortID is not free,
-	// we'll still make the web request because the caller may want the
-	// request to go through.
-	gcas.mu.Lock()
-	_, shortIDAlreadyUsed := gcas.equipment[shortID]
-	gcas.mu.Unlock()
-
-	// Create a keypair for the equipment, then create the equipment
-	// request body.
-	pubkey, equipmentKey := glow.GenerateKeyPair()
-	ea = glow.EquipmentAuthorization{
-		ShortID:    shortID,
-		PublicKey:  pubkey,
-		Capacity:   15400300,
-		Debt:       11223344,
-		Expiration: 100e6 + glow.CurrentTimeslot(), // ensure the hardware won't be invalid for a while, but leave enough room for tests to intentionally expire the hardware
-	}
-	sb := ea.SigningBytes()
-	ea.Signature = glow.Sign(sb, gcaPrivKey)
-
-	// Convert the request to json and post it.
-	jsonBody, _ := json.Marshal(ea)
-	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/authorize-equipment", gcas.httpPort), "application/json", bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("unable to send http request to submit new hardware: %v", err)
-	}
-
-	// Verify the response.
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("expected status 200, but got %d: %s", resp.StatusCode, string(bodyBytes))
-	}
-	var response map[string]string
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("Failed to decode response: %v", err)
-	}
-	if status, exists := response["status"]; !exists || status != "success" {
-		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("Unexpected response: %v", response)
-	}
-	resp.Body.Close()
-
-	// Verify that the server sees the new equipment.
-	if shortIDAlreadyUsed {
-		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("shortID already in use")
-	}
-	gcas.mu.Lock()
-	_, exists := gcas.equipment[shortID]
-	gcas.mu.Unlock()
-	if !exists {
-		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("equipment does not appear to have been added to server correctly")
-	}
-	gcas.CheckInvariants()
-	return ea, equipmentKey, nil
-}
-
 // TestAuthorizeEquipmentIntegration checks that the full flow for
 // authorizing new equipment works as intended.
 func TestAuthorizeEquipmentIntegration(t *testing.T) {
@@ -86,8 +28,7 @@ func TestAuthorizeEquipmentIntegration(t *testing.T) {
 	}
 
 	// Sign the authorization request with GCA's private key.
-	sb := ea.SigningBytes()
-	ea.Signature = glow.Sign(sb, gcaPrivKey)
+	ea = SignEquipmentAuthorization(ea, gcaPrivKey)
 
 	// Convert the request body to JSON format.
 	jsonBody, _ := json.Marshal(ea)
@@ -152,8 +93,7 @@ func TestAuthorizeEquipmentIntegration(t *testing.T) {
 		Expiration: 2000,    // Expiry time for the equipment
 	}
 	// Sign the authorization request with GCA's private key.
-	sb = ea.SigningBytes()
-	ea.Signature = glow.Sign(sb, gcaPrivKey)
+	ea = SignEquipmentAuthorization(ea, gcaPrivKey)
 	// Convert the request body to JSON format.
 	jsonBody, _ = json.Marshal(ea)
 	// Perform an HTTP POST request to the authorize-equipment endpoint.
@@ -193,8 +133,7 @@ func TestAuthorizeEquipmentIntegration(t *testing.T) {
 		Expiration: 2000,    // Expiry time for the equipment
 	}
 	// Sign the authorization request with GCA's private key.
-	sb = ea.SigningBytes()
-	ea.Signature = glow.Sign(sb, gcaPrivKey)
+	ea = SignEquipmentAuthorization(ea, gcaPrivKey)
 	// Convert the request body to JSON format.
 	jsonBody, _ = json.Marshal(ea)
 	// Perform an HTTP POST request to the authorize-equipment endpoint.
@@ -227,7 +166,7 @@ func TestAuthorizeEquipmentIntegration(t *testing.T) {
 	}
 
 	// Test the hardware function quickly.
-	_, _, err = server.submitNewHardware(1024, gcaPrivKey)
+	_, _, err = server.AuthorizeTestDevice(1024, gcaPrivKey)
 	if err != nil {
 		t.Fatal(err)
 	}
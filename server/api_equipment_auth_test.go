@@ -29,8 +29,7 @@ func TestAuthorizeEquipmentEndpoint(t *testing.T) {
 	}
 
 	// Sign the authorization request with GCA's private key.
-	sb := ea.SigningBytes()
-	ea.Signature = glow.Sign(sb, gcaPrivKey)
+	ea = SignEquipmentAuthorization(ea, gcaPrivKey)
 	jsonBody, _ := json.Marshal(ea)
 	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/authorize-equipment", server.httpPort), "application/json", bytes.NewBuffer(jsonBody))
 	if err != nil {
@@ -99,3 +98,98 @@ func TestVerifyEquipmentAuthorization(t *testing.T) {
 		t.Errorf("Verified an invalid EquipmentAuthorization without error")
 	}
 }
+
+// TestAuthorizationReplayProtection checks that nonces can't be reused, that
+// consumed nonces survive a restart, and that the legacy format is only
+// accepted in internal test mode.
+func TestAuthorizationReplayProtection(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeAuth := func(shortID uint32, nonce uint64) glow.EquipmentAuthorization {
+		pub, _ := glow.GenerateKeyPair()
+		ea := glow.EquipmentAuthorization{
+			Version:   glow.EquipmentAuthorizationVersion,
+			ShortID:   shortID,
+			PublicKey: pub,
+			Capacity:  1e6,
+			Nonce:     nonce,
+		}
+		ea.Signature = glow.Sign(ea.SigningBytes(), gcaPrivKey)
+		return ea
+	}
+
+	// Authorize a device, then present the same authorization again, which
+	// should be harmless.
+	ea := makeAuth(1, 7)
+	isNew, err := server.managedAuthorizeEquipment(ea)
+	if err != nil || !isNew {
+		t.Fatal("authorization failed:", isNew, err)
+	}
+	isNew, err = server.managedAuthorizeEquipment(ea)
+	if err != nil || isNew {
+		t.Fatal("repeated authorization was not idempotent:", isNew, err)
+	}
+
+	// A different authorization with the same nonce gets rejected, in a
+	// batch as well.
+	if _, err := server.managedAuthorizeEquipment(makeAuth(2, 7)); err == nil {
+		t.Fatal("expected a reused nonce to be rejected")
+	}
+	results, _, err := server.managedAuthorizeEquipmentBatch([]glow.EquipmentAuthorization{makeAuth(3, 7), makeAuth(4, 8), makeAuth(5, 8)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != batchAuthRejected || results[1].Status != batchAuthAuthorized || results[2].Status != batchAuthRejected {
+		t.Fatalf("unexpected batch results: %+v", results)
+	}
+
+	// Legacy and unknown formats are rejected outside of internal test
+	// mode.
+	legacy := glow.EquipmentAuthorization{ShortID: 6, Capacity: 1e6}
+	legacy.Signature = glow.Sign(legacy.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedAuthorizeEquipment(legacy); err == nil {
+		t.Fatal("expected a legacy authorization to be rejected")
+	}
+	future := makeAuth(6, 9)
+	future.Version = glow.EquipmentAuthorizationVersionExpiring + 1
+	future.Signature = glow.Sign(future.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedAuthorizeEquipment(future); err == nil {
+		t.Fatal("expected an unknown version to be rejected")
+	}
+
+	// The consumed nonces survive a restart, and internal test mode
+	// accepts the legacy format.
+	server.Close()
+	server, err = NewGCAServer(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	loaded := server.equipment[1]
+	numEquipment := len(server.equipment)
+	server.mu.Unlock()
+	if loaded != ea || numEquipment != 2 {
+		t.Fatal("equipment was not reloaded correctly:", numEquipment)
+	}
+	if _, err := server.managedAuthorizeEquipment(makeAuth(2, 7)); err == nil {
+		t.Fatal("expected a reused nonce to be rejected after a restart")
+	}
+	isNew, err = server.managedAuthorizeEquipment(legacy)
+	if err != nil || !isNew {
+		t.Fatal("legacy authorization was rejected in internal test mode:", err)
+	}
+	server.Close()
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.mu.Lock()
+	_, legacyLoaded := server.equipment[legacy.ShortID]
+	server.mu.Unlock()
+	if !legacyLoaded {
+		t.Fatal("legacy equipment was not reloaded")
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+// This file contains an endpoint which allows the GCA to deauthorize a piece
+// of equipment, typically because the equipment was decommissioned or because
+// its key was compromised.
+//
+// Deauthorized equipment stays in the equipment map so that its historical
+// reports remain available for auditing, but the server stops accepting its
+// reports starting with the timeslot after the deauthorization, no matter when
+// the reports arrive, see authorization_window.go. A public key that has been
+// deauthorized can never be authorized again, which prevents any ambiguity
+// about which ShortID its history belongs to.
+//
+// Deauthorizations are persisted to disk and forwarded to all of the other
+// GCA servers, the same way that new equipment authorizations are.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// equipmentDeauthorizationSize is the size of a serialized
+// EquipmentDeauthorization.
+const equipmentDeauthorizationSize = 32 + 8 + 64
+
+// EquipmentDeauthorization is an order from the GCA to stop accepting reports
+// from a piece of equipment.
+type EquipmentDeauthorization struct {
+	PublicKey glow.PublicKey // The equipment being deauthorized
+	Timestamp int64          // Unix time of the deauthorization
+	Signature glow.Signature // A signature from the GCA
+}
+
+// SigningBytes returns the bytes that the GCA signs to authorize the
+// deauthorization, which are the public key, followed by the string
+// "deauthorize", followed by the timestamp.
+func (ed EquipmentDeauthorization) SigningBytes() []byte {
+	b := make([]byte, 0, 32+11+8)
+	b = append(b, ed.PublicKey[:]...)
+	b = append(b, []byte("deauthorize")...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(ed.Timestamp))
+	return b
+}
+
+// Serialize returns the compact binary representation of the
+// deauthorization.
+func (ed EquipmentDeauthorization) Serialize() []byte {
+	b := make([]byte, equipmentDeauthorizationSize)
+	copy(b, ed.PublicKey[:])
+	binary.LittleEndian.PutUint64(b[32:], uint64(ed.Timestamp))
+	copy(b[40:], ed.Signature[:])
+	return b
+}
+
+// DeserializeEquipmentDeauthorization reverses a call to Serialize.
+func DeserializeEquipmentDeauthorization(b []byte) (EquipmentDeauthorization, error) {
+	var ed EquipmentDeauthorization
+	if len(b) != equipmentDeauthorizationSize {
+		return ed, fmt.Errorf("unexpected deauthorization size: %v", len(b))
+	}
+	copy(ed.PublicKey[:], b[:32])
+	ed.Timestamp = int64(binary.LittleEndian.Uint64(b[32:]))
+	copy(ed.Signature[:], b[40:])
+	return ed, nil
+}
+
+// CutoffTimeslot returns the first timeslot for which reports from the
+// equipment are no longer accepted.
+func (ed EquipmentDeauthorization) CutoffTimeslot() uint32 {
+	timeslot, err := glow.UnixToTimeslot(ed.Timestamp)
+	if err != nil {
+		// The deauthorization predates genesis, so no reports are
+		// accepted at all.
+		return 0
+	}
+	return timeslot + 1
+}
+
+// DeauthorizeEquipmentHandler handles requests from the GCA to deauthorize a
+// piece of equipment.
+func (gcas *GCAServer) DeauthorizeEquipmentHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for equipment deauthorization.")
+		return
+	}
+
+	// Decode the JSON request body into the deauthorization.
+	var request EquipmentDeauthorization
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+
+	// Validate and process the request.
+	isNew, err := gcas.managedDeauthorizeEquipment(request)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to deauthorize equipment:", err))
+		gcas.requestLogger(r).WithFields("pubkey", request.PublicKey).Warn("Failed to deauthorize equipment: ", err)
+		return
+	}
+
+	// Forward the deauthorization to all of the other servers, so that
+	// failover servers stop accepting reports as well. Only new
+	// deauthorizations get forwarded, which prevents the servers from
+	// endlessly passing the same request around.
+	if isNew {
+		gcas.gcaServers.mu.Lock()
+		ass := make([]AuthorizedServer, len(gcas.gcaServers.servers))
+		copy(ass, gcas.gcaServers.servers)
+		gcas.gcaServers.mu.Unlock()
+		jsonBody, _ := json.Marshal(request)
+		for _, as := range ass {
+			resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/deauthorize-equipment", jsonBody)
+			if err != nil {
+				gcas.requestLogger(r).WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to forward equipment deauthorization")
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	// Send a success response
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	gcas.requestLogger(r).WithFields("pubkey", request.PublicKey).Info("Successfully deauthorized equipment.")
+}
+
+// managedDeauthorizeEquipment verifies and saves a deauthorization. The bool
+// indicates whether the deauthorization is new to this server.
+func (gcas *GCAServer) managedDeauthorizeEquipment(ed EquipmentDeauthorization) (bool, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return false, errNotInitialized
+	}
+	if !gcas.verifyGCASignature(ed.SigningBytes(), ed.Signature) {
+		return false, withCode(ErrCodeInvalidSignature, fmt.Errorf("invalid signature on equipment deauthorization"))
+	}
+
+	// Only the earliest deauthorization for a device counts, anything
+	// after that is redundant. An earlier one replaces the current one,
+	// so that servers which got different deauthorizations settle on the
+	// same one once they sync, see peer_sync_records.go.
+	if current, exists := gcas.equipmentDeauthorizations[ed.PublicKey]; exists && current.Timestamp <= ed.Timestamp {
+		return false, nil
+	}
+
+	// Record and persist the deauthorization before applying it.
+	err := gcas.recordAudit(auditRecord{
+		action:     glow.AuditEquipmentDeauthorization,
+		request:    ed.Serialize(),
+		signatures: []glow.AuditSignature{gcas.gcaAuditSignature(ed.SigningBytes(), ed.Signature)},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := gcas.staticStorage.AppendFile(EquipmentDeauthorizationsFile, ed.Serialize(), 0644); err != nil {
+		return false, fmt.Errorf("unable to save deauthorization: %v", err)
+	}
+	gcas.equipmentDeauthorizations[ed.PublicKey] = ed
+	// Reports for the timeslots past the cutoff may have been accepted
+	// before the deauthorization got here, see authorization_window.go.
+	shortID, exists := gcas.equipmentShortID[ed.PublicKey]
+	if exists {
+		gcas.dropDeauthorizedReports(shortID, ed.CutoffTimeslot())
+		gcas.recordDeviceChange(StateChangeDeauthorization, shortID, ed.PublicKey, ed.CutoffTimeslot())
+	} else {
+		gcas.bumpStateVersion()
+	}
+	gcas.queueEquipmentEvent(webhookEventDeauthorized, gcas.equipmentShortID[ed.PublicKey], ed.PublicKey, ed.CutoffTimeslot())
+	return true, nil
+}
+
+// loadEquipmentDeauthorizations will load all of the deauthorizations from
+// disk, creating the file if it does not exist yet.
+func (gcas *GCAServer) loadEquipmentDeauthorizations() error {
+	data, err := gcas.staticStorage.ReadFile(EquipmentDeauthorizationsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(EquipmentDeauthorizationsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read deauthorizations file: %v", err)
+	}
+	if len(data)%equipmentDeauthorizationSize != 0 {
+		return fmt.Errorf("deauthorizations file has an unexpected size")
+	}
+	for i := 0; i < len(data); i += equipmentDeauthorizationSize {
+		ed, err := DeserializeEquipmentDeauthorization(data[i : i+equipmentDeauthorizationSize])
+		if err != nil {
+			return fmt.Errorf("unable to decode deauthorization: %v", err)
+		}
+		if !gcas.verifyPersistedGCASignature(ed.SigningBytes(), ed.Signature) {
+			return fmt.Errorf("invalid signature on persisted deauthorization")
+		}
+		if current, exists := gcas.equipmentDeauthorizations[ed.PublicKey]; !exists || ed.Timestamp < current.Timestamp {
+			gcas.equipmentDeauthorizations[ed.PublicKey] = ed
+		}
+	}
+	return nil
+}
+
+// isDeauthorized returns whether the equipment with the provided ShortID was
+// deauthorized at or before the provided timeslot.
+func (gcas *GCAServer) isDeauthorized(shortID uint32, timeslot uint32) bool {
+	equipment, exists := gcas.equipment[shortID]
+	if !exists {
+		return false
+	}
+	ed, exists := gcas.equipmentDeauthorizations[equipment.PublicKey]
+	return exists && timeslot >= ed.CutoffTimeslot()
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postDeauthorization will submit a deauthorization to the server and return
+// the status code.
+func (gcas *GCAServer) postDeauthorization(ed EquipmentDeauthorization) (int, error) {
+	jsonBody, _ := json.Marshal(ed)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/deauthorize-equipment", gcas.httpPort), "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return 0, fmt.Errorf("unable to send deauthorization: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// TestDeauthorizeEquipment checks that deauthorized equipment stops having
+// its reports accepted, keeps its history, stays deauthorized across
+// restarts, and cannot be authorized again.
+func TestDeauthorizeEquipment(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 3, ePriv))
+	if outcome != reportAccepted {
+		t.Fatal("report was not accepted:", outcome)
+	}
+
+	// A deauthorization with a bad signature should be rejected.
+	ed := EquipmentDeauthorization{
+		PublicKey: ea.PublicKey,
+		Timestamp: glow.TimeslotToUnix(5),
+	}
+	_, badKey := glow.GenerateKeyPair()
+	ed.Signature = glow.Sign(ed.SigningBytes(), badKey)
+	status, err := server.postDeauthorization(ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusForbidden {
+		t.Fatal("expected a bad signature to be rejected:", status)
+	}
+
+	// Submit a valid deauthorization. Reports are still accepted for the
+	// timeslot of the deauthorization, but not for anything after.
+	ed.Signature = glow.Sign(ed.SigningBytes(), gcaPrivKey)
+	status, err = server.postDeauthorization(ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("deauthorization failed:", status)
+	}
+	outcome, _ = server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 5, ePriv))
+	if outcome != reportAccepted {
+		t.Fatal("report before the cutoff was not accepted:", outcome)
+	}
+	outcome, authenticated := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 6, ePriv))
+	if outcome != reportDeauthorized || !authenticated {
+		t.Fatal("report after the cutoff was not rejected:", outcome, authenticated)
+	}
+
+	// Submitting the same deauthorization again should be harmless.
+	status, err = server.postDeauthorization(ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("repeated deauthorization failed:", status)
+	}
+
+	// The device should be gone from the active set, but its history
+	// should still be there.
+	server.mu.Lock()
+	reports := server.equipmentReports[ea.ShortID]
+	server.mu.Unlock()
+	if reports.PowerOutputs[3] == 0 || reports.PowerOutputs[5] == 0 || reports.PowerOutputs[6] != 0 {
+		t.Fatal("history was not preserved correctly")
+	}
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/equipment", server.httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var er EquipmentResponse
+	err = json.NewDecoder(resp.Body).Decode(&er)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := er.EquipmentDetails[ea.ShortID]; exists {
+		t.Fatal("deauthorized equipment is still listed")
+	}
+
+	// Re-authorizing the same public key under a new ShortID should fail.
+	reauth := ea
+	reauth.ShortID = 2
+	if err := server.AuthorizeEquipment(reauth, gcaPrivKey); err == nil {
+		t.Fatal("deauthorized equipment was authorized again")
+	}
+
+	// The deauthorization should survive a restart.
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	outcome, _ = server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 7, ePriv))
+	if outcome != reportDeauthorized {
+		t.Fatal("deauthorization was lost after a restart:", outcome)
+	}
+	server.mu.Lock()
+	reports = server.equipmentReports[ea.ShortID]
+	server.mu.Unlock()
+	if reports.PowerOutputs[3] == 0 || reports.PowerOutputs[5] == 0 {
+		t.Fatal("history was lost after a restart")
+	}
+}
+
+// TestDeauthorizeEquipmentForwarding checks that a deauthorization gets
+// forwarded to the other GCA servers.
+func TestDeauthorizeEquipmentForwarding(t *testing.T) {
+	server, _, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	failover, _, err := SetupTestEnvironmentKnownGCA(t.Name()+"-failover", gcaPubKey, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer failover.Close()
+
+	// Tell the primary server about the failover server.
+	server.gcaServers.mu.Lock()
+	server.gcaServers.servers = append(server.gcaServers.servers, AuthorizedServer{
+		PublicKey: failover.staticPublicKey,
+		Location:  "127.0.0.1",
+		HttpPort:  failover.httpPort,
+		TcpPort:   failover.tcpPort,
+		UdpPort:   failover.udpPort,
+	})
+	server.gcaServers.mu.Unlock()
+
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := EquipmentDeauthorization{
+		PublicKey: ea.PublicKey,
+		Timestamp: glow.TimeslotToUnix(0),
+	}
+	ed.Signature = glow.Sign(ed.SigningBytes(), gcaPrivKey)
+	status, err := server.postDeauthorization(ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("deauthorization failed:", status)
+	}
+
+	// Forwarding happens before the handler responds, so the failover
+	// server should already know about the deauthorization.
+	failover.mu.Lock()
+	_, exists := failover.equipmentDeauthorizations[ea.PublicKey]
+	failover.mu.Unlock()
+	if !exists {
+		t.Fatal("deauthorization was not forwarded")
+	}
+	outcome, _ := failover.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 1, ePriv))
+	if outcome != reportDeauthorized {
+		t.Fatal("failover server accepted a report from deauthorized equipment:", outcome)
+	}
+}
+
+// TestDeauthorizeEquipmentHexPubkey checks that the public key in a request
+// body can be provided as a hex string.
+func TestDeauthorizeEquipmentHexPubkey(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := EquipmentDeauthorization{
+		PublicKey: ea.PublicKey,
+		Timestamp: glow.TimeslotToUnix(5),
+	}
+	ed.Signature = glow.Sign(ed.SigningBytes(), gcaPrivKey)
+	body, _ := json.Marshal(map[string]interface{}{
+		"PublicKey": "0x" + hex.EncodeToString(ed.PublicKey[:]),
+		"Timestamp": ed.Timestamp,
+		"Signature": ed.Signature,
+	})
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/deauthorize-equipment", server.httpPort), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("deauthorization with a hex pubkey failed:", resp.StatusCode)
+	}
+	server.mu.Lock()
+	_, exists := server.equipmentDeauthorizations[ea.PublicKey]
+	server.mu.Unlock()
+	if !exists {
+		t.Fatal("deauthorization was not applied")
+	}
+}
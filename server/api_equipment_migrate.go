@@ -5,6 +5,7 @@ package server
 // requests to the server.
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -43,10 +44,11 @@ func (em EquipmentMigration) Serialize() []byte {
 // SigningBytes returns the data that should be signed by the
 // EquipmentMigration.
 func (em EquipmentMigration) SigningBytes() []byte {
-	// The SigningBytes are just the serialized bytes minus the signature
-	// plus a special prefix.
-	result := em.Serialize()
-	return append([]byte("EquipmentMigration"), result[:len(result)-64]...)
+	servers := make([][]byte, 0, len(em.NewServers))
+	for _, as := range em.NewServers {
+		servers = append(servers, as.Serialize())
+	}
+	return glow.SerializeEquipmentMigrationForSigning(em.Equipment, em.NewGCA, em.NewShortID, servers)
 }
 
 // EquipmentMigrateHandler handles an API request from the GCA to move a piece
@@ -55,31 +57,46 @@ func (em EquipmentMigration) SigningBytes() []byte {
 func (gca *GCAServer) EquipmentMigrateHandler(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is supported.", http.StatusMethodNotAllowed)
-		gca.logger.Warn("Received non-POST request for equipment migration.")
+		gca.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gca.requestLogger(r).Warn("Received non-POST request for equipment migration.")
 		return
 	}
 
 	// Decode the JSON request body into the authorization.
 	var request EquipmentMigration
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		gca.logger.Error("Failed to decode request body: ", err)
+		gca.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gca.requestLogger(r).Error("Failed to decode request body: ", err)
 		return
 	}
 
 	// Validate and process the request
 	err := gca.managedValidateMigration(request)
 	if err != nil {
-		http.Error(w, fmt.Sprint("Failed to authorize equipment:", err), http.StatusInternalServerError)
-		gca.logger.Error("Failed to authorize equipment: ", err)
+		gca.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to authorize equipment:", err))
+		gca.requestLogger(r).Error("Failed to authorize equipment: ", err)
 		return
 	}
 
-	// Now that the migration request has been validated, add it to the
-	// equipment migration list.
+	// Now that the migration request has been validated, record it in the
+	// audit log and add it to the equipment migration list. A migration
+	// that is already known is not recorded again.
 	gca.mu.Lock()
+	if current, exists := gca.equipmentMigrations[request.Equipment]; !exists || !bytes.Equal(current.Serialize(), request.Serialize()) {
+		sigs := []glow.AuditSignature{gca.gcaAuditSignature(request.SigningBytes(), request.Signature)}
+		for _, as := range request.NewServers {
+			sigs = append(sigs, glow.AuditSignature{PublicKey: request.NewGCA, SigningBytes: as.SigningBytes(), Signature: as.GCAAuthorization})
+		}
+		err := gca.recordAudit(auditRecord{action: glow.AuditEquipmentMigration, request: request.Serialize(), signatures: sigs})
+		if err != nil {
+			gca.mu.Unlock()
+			gca.writeError(w, ErrCodeInternalError, fmt.Sprint("Failed to record equipment migration:", err))
+			gca.requestLogger(r).Error("Failed to record equipment migration: ", err)
+			return
+		}
+	}
 	gca.equipmentMigrations[request.Equipment] = request
+	gca.bumpStateVersion()
 	gca.mu.Unlock()
 
 	// TODO: Need to persist the list of migrations, and write tests to
@@ -87,7 +104,7 @@ func (gca *GCAServer) EquipmentMigrateHandler(w http.ResponseWriter, r *http.Req
 
 	// Send a success response
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
-	gca.logger.Info("Successfully authorized equipment.")
+	gca.requestLogger(r).Info("Successfully authorized equipment.")
 }
 
 // managedValidateMigration will check that the EquipmentMigration is valid.
@@ -97,8 +114,11 @@ func (gca *GCAServer) EquipmentMigrateHandler(w http.ResponseWriter, r *http.Req
 func (gcas *GCAServer) managedValidateMigration(em EquipmentMigration) error {
 	// Check the signature on the entire migration.
 	sb := em.SigningBytes()
-	if !glow.Verify(gcas.gcaPubkey, sb, em.Signature) {
-		return fmt.Errorf("invalid signature on equipment migration")
+	gcas.mu.RLock()
+	valid := gcas.verifyGCASignature(sb, em.Signature)
+	gcas.mu.RUnlock()
+	if !valid {
+		return withCode(ErrCodeInvalidSignature, fmt.Errorf("invalid signature on equipment migration"))
 	}
 
 	// Check the signature on each authorized server. Remember that the
@@ -106,7 +126,7 @@ func (gcas *GCAServer) managedValidateMigration(em EquipmentMigration) error {
 	for _, as := range em.NewServers {
 		sb := as.SigningBytes()
 		if !glow.Verify(em.NewGCA, sb, as.GCAAuthorization) {
-			return fmt.Errorf("invalid signature on authorized server within equipment migration")
+			return withCode(ErrCodeInvalidSignature, fmt.Errorf("invalid signature on authorized server within equipment migration"))
 		}
 	}
 
@@ -0,0 +1,225 @@
+package server
+
+// This file contains an endpoint which allows the GCA to assign a piece of
+// equipment to a WattTime region, also called a balancing authority. The
+// region decides which impact rates get attached to the reports of the
+// equipment.
+//
+// Equipment without a region uses the default region of the server, and if
+// the server has no default region either, the region is looked up from the
+// coordinates of the equipment, which is what the server did before regions
+// could be assigned. The equipment authorization isn't touched, so that the
+// authorizations stay compatible with every monitor and every server.
+//
+// The GCA can move a device to a different region at any time. The newest
+// assignment wins, and an assignment with an empty region returns the device
+// to the default. Assignments are persisted to disk and forwarded to all of
+// the other GCA servers, the same way that deauthorizations are.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// maxRegionLength is the longest region name that can be assigned. WattTime
+// region names are short abbreviations such as CAISO_NORTH.
+const maxRegionLength = 32
+
+// equipmentRegionSize is the size of a serialized EquipmentRegion. The region
+// is padded with zeroes to maxRegionLength.
+const equipmentRegionSize = 32 + 8 + maxRegionLength + 64
+
+// EquipmentRegion is an order from the GCA to use the impact rates of a
+// specific WattTime region for a piece of equipment.
+type EquipmentRegion struct {
+	PublicKey glow.PublicKey // The equipment being assigned
+	Region    string         // The WattTime region, empty for the default
+	Timestamp int64          // Unix time of the assignment
+	Signature glow.Signature // A signature from the GCA
+}
+
+// SigningBytes returns the bytes that the GCA signs to authorize the
+// assignment, which are the public key, followed by the string "region",
+// followed by the timestamp and the padded region.
+func (er EquipmentRegion) SigningBytes() []byte {
+	b := make([]byte, 0, 32+6+8+maxRegionLength)
+	b = append(b, er.PublicKey[:]...)
+	b = append(b, []byte("region")...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(er.Timestamp))
+	var region [maxRegionLength]byte
+	copy(region[:], er.Region)
+	return append(b, region[:]...)
+}
+
+// Serialize returns the compact binary representation of the assignment.
+func (er EquipmentRegion) Serialize() []byte {
+	b := make([]byte, equipmentRegionSize)
+	copy(b, er.PublicKey[:])
+	binary.LittleEndian.PutUint64(b[32:], uint64(er.Timestamp))
+	copy(b[40:40+maxRegionLength], er.Region)
+	copy(b[40+maxRegionLength:], er.Signature[:])
+	return b
+}
+
+// DeserializeEquipmentRegion reverses a call to Serialize.
+func DeserializeEquipmentRegion(b []byte) (EquipmentRegion, error) {
+	var er EquipmentRegion
+	if len(b) != equipmentRegionSize {
+		return er, fmt.Errorf("unexpected region assignment size: %v", len(b))
+	}
+	copy(er.PublicKey[:], b[:32])
+	er.Timestamp = int64(binary.LittleEndian.Uint64(b[32:]))
+	er.Region = string(bytes.TrimRight(b[40:40+maxRegionLength], "\x00"))
+	copy(er.Signature[:], b[40+maxRegionLength:])
+	if err := validateRegion(er.Region); err != nil {
+		return er, err
+	}
+	return er, nil
+}
+
+// validateRegion checks that a region name only uses the characters that
+// appear in WattTime region names. The empty region is valid.
+func validateRegion(region string) error {
+	if len(region) > maxRegionLength {
+		return fmt.Errorf("region is longer than %v characters", maxRegionLength)
+	}
+	for _, c := range region {
+		if !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '_' && c != '-' {
+			return fmt.Errorf("region contains the invalid character %q", c)
+		}
+	}
+	return nil
+}
+
+// EquipmentRegionHandler handles requests from the GCA to assign a piece of
+// equipment to a region.
+func (gcas *GCAServer) EquipmentRegionHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for an equipment region.")
+		return
+	}
+
+	// Decode the JSON request body into the assignment.
+	var request EquipmentRegion
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+
+	// Validate and process the request.
+	isNew, err := gcas.managedAssignEquipmentRegion(request)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to assign equipment region:", err))
+		gcas.requestLogger(r).WithFields("pubkey", request.PublicKey).Warn("Failed to assign equipment region: ", err)
+		return
+	}
+
+	// Forward the assignment to all of the other servers, so that every
+	// server attaches the same impact rates. Only new assignments get
+	// forwarded, which prevents the servers from endlessly passing the
+	// same request around.
+	if isNew {
+		gcas.gcaServers.mu.Lock()
+		ass := make([]AuthorizedServer, len(gcas.gcaServers.servers))
+		copy(ass, gcas.gcaServers.servers)
+		gcas.gcaServers.mu.Unlock()
+		jsonBody, _ := json.Marshal(request)
+		for _, as := range ass {
+			resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/equipment-region", jsonBody)
+			if err != nil {
+				gcas.requestLogger(r).WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to forward equipment region")
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	// Send a success response
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	gcas.requestLogger(r).WithFields("pubkey", request.PublicKey, "region", request.Region).Info("Successfully assigned equipment region.")
+}
+
+// managedAssignEquipmentRegion verifies and saves a region assignment. The
+// bool indicates whether the assignment is new to this server.
+func (gcas *GCAServer) managedAssignEquipmentRegion(er EquipmentRegion) (bool, error) {
+	if err := validateRegion(er.Region); err != nil {
+		return false, withCode(ErrCodeMalformedRequest, err)
+	}
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return false, errNotInitialized
+	}
+	if !gcas.verifyGCASignature(er.SigningBytes(), er.Signature) {
+		return false, withCode(ErrCodeInvalidSignature, fmt.Errorf("invalid signature on equipment region"))
+	}
+
+	// Only an assignment that is newer than the current one counts,
+	// anything else is redundant.
+	if current, exists := gcas.equipmentRegions[er.PublicKey]; exists && er.Timestamp <= current.Timestamp {
+		return false, nil
+	}
+
+	// Record and persist the assignment before applying it.
+	err := gcas.recordAudit(auditRecord{
+		action:     glow.AuditEquipmentRegion,
+		request:    er.Serialize(),
+		signatures: []glow.AuditSignature{gcas.gcaAuditSignature(er.SigningBytes(), er.Signature)},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := gcas.staticStorage.AppendFile(EquipmentRegionsFile, er.Serialize(), 0644); err != nil {
+		return false, fmt.Errorf("unable to save equipment region: %v", err)
+	}
+	gcas.equipmentRegions[er.PublicKey] = er
+	gcas.bumpStateVersion()
+	return true, nil
+}
+
+// loadEquipmentRegions will load all of the region assignments from disk,
+// creating the file if it does not exist yet.
+func (gcas *GCAServer) loadEquipmentRegions() error {
+	data, err := gcas.staticStorage.ReadFile(EquipmentRegionsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(EquipmentRegionsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read equipment regions file: %v", err)
+	}
+	if len(data)%equipmentRegionSize != 0 {
+		return fmt.Errorf("equipment regions file has an unexpected size")
+	}
+	for i := 0; i < len(data); i += equipmentRegionSize {
+		er, err := DeserializeEquipmentRegion(data[i : i+equipmentRegionSize])
+		if err != nil {
+			return fmt.Errorf("%v: record %v: %v", EquipmentRegionsFile, i/equipmentRegionSize, err)
+		}
+		if !gcas.verifyPersistedGCASignature(er.SigningBytes(), er.Signature) {
+			return fmt.Errorf("%v: record %v: invalid signature", EquipmentRegionsFile, i/equipmentRegionSize)
+		}
+		if current, exists := gcas.equipmentRegions[er.PublicKey]; !exists || er.Timestamp > current.Timestamp {
+			gcas.equipmentRegions[er.PublicKey] = er
+		}
+	}
+	return nil
+}
+
+// equipmentRegion returns the region whose impact rates apply to the
+// provided equipment. An empty region means that the region has to be looked
+// up from the coordinates of the equipment. The mutex must be held.
+func (gcas *GCAServer) equipmentRegion(pk glow.PublicKey) string {
+	if er, exists := gcas.equipmentRegions[pk]; exists && er.Region != "" {
+		return er.Region
+	}
+	return gcas.staticDefaultRegion
+}
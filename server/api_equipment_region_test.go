@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/watttime/mock"
+)
+
+// postEquipmentRegion submits a region assignment to the server and returns
+// the status code of the response.
+func (gcas *GCAServer) postEquipmentRegion(er EquipmentRegion) (int, error) {
+	jsonBody, _ := json.Marshal(er)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/equipment-region", gcas.httpPort), "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return 0, fmt.Errorf("unable to send equipment region: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// regionTestMoer returns the impact rate that the mock WattTime API returns
+// for a region at timeslot 10.
+func regionTestMoer(region string) float64 {
+	return mock.DefaultMOER(region, 10) * 453.59237
+}
+
+// TestEquipmentRegion checks that the GCA can assign regions to devices, that
+// the impact rates of a device come from its region or the default region,
+// and that the assignments survive a restart.
+func TestEquipmentRegion(t *testing.T) {
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+
+	wattTime := mock.NewServer()
+	defer wattTime.Close()
+
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{WattTimeURL: wattTime.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea1, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea2, _, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assignments need a valid region and a signature from the GCA.
+	er := EquipmentRegion{PublicKey: ea1.PublicKey, Region: "CAISO NORTH", Timestamp: 100}
+	er.Signature = glow.Sign(er.SigningBytes(), gcaPrivKey)
+	status, err := server.postEquipmentRegion(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusBadRequest {
+		t.Fatal("expected an invalid region to be rejected:", status)
+	}
+	er.Region = "CAISO_NORTH"
+	_, wrongKey := glow.GenerateKeyPair()
+	er.Signature = glow.Sign(er.SigningBytes(), wrongKey)
+	status, err = server.postEquipmentRegion(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusForbidden {
+		t.Fatal("expected an assignment without a gca signature to be rejected:", status)
+	}
+	er.Signature = glow.Sign(er.SigningBytes(), gcaPrivKey)
+	status, err = server.postEquipmentRegion(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("assignment failed:", status)
+	}
+
+	// An older assignment is ignored.
+	older := EquipmentRegion{PublicKey: ea1.PublicKey, Region: "PJM", Timestamp: 50}
+	older.Signature = glow.Sign(older.SigningBytes(), gcaPrivKey)
+	status, err = server.postEquipmentRegion(older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("older assignment failed:", status)
+	}
+
+	// The device with a region gets the impact rate of its region.
+	if err := server.managedGetWattTimeIndexData("", ""); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.RLock()
+	rate := server.equipmentImpactRate[1][10]
+	server.mu.RUnlock()
+	if rate != regionTestMoer("CAISO_NORTH") {
+		t.Fatal("unexpected impact rate for the region:", rate)
+	}
+
+	// The stats expose the region.
+	status, ads, err := server.getAllDeviceStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(ads.Devices) != 2 {
+		t.Fatal("unexpected stats:", status, len(ads.Devices))
+	}
+	if ads.Devices[0].Region != "CAISO_NORTH" || ads.Devices[1].Region != "" {
+		t.Fatalf("unexpected regions: %q %q", ads.Devices[0].Region, ads.Devices[1].Region)
+	}
+
+	// After a restart with a default region, the assignment is still
+	// there and the other device uses the default.
+	server.Close()
+	server, err = NewGCAServerWithOptions(dir, false, ServerOptions{DefaultRegion: "ERCOT", WattTimeURL: wattTime.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.managedGetWattTimeIndexData("", ""); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.RLock()
+	rate1 := server.equipmentImpactRate[1][10]
+	rate2 := server.equipmentImpactRate[2][10]
+	region2 := server.equipmentRegion(ea2.PublicKey)
+	server.mu.RUnlock()
+	if rate1 != regionTestMoer("CAISO_NORTH") || rate2 != regionTestMoer("ERCOT") || region2 != "ERCOT" {
+		t.Fatal("unexpected impact rates after restart:", rate1, rate2, region2)
+	}
+
+	// An assignment to the empty region returns the device to the
+	// default.
+	reset := EquipmentRegion{PublicKey: ea1.PublicKey, Timestamp: 200}
+	reset.Signature = glow.Sign(reset.SigningBytes(), gcaPrivKey)
+	status, err = server.postEquipmentRegion(reset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("reset failed:", status)
+	}
+	server.mu.RLock()
+	region1 := server.equipmentRegion(ea1.PublicKey)
+	server.mu.RUnlock()
+	if region1 != "ERCOT" {
+		t.Fatal("expected the device to use the default region:", region1)
+	}
+	server.Close()
+
+	// An invalid default region is refused.
+	if _, err := NewGCAServerWithOptions(dir, false, ServerOptions{DefaultRegion: "not a region"}); err == nil {
+		t.Fatal("expected an invalid default region to be refused")
+	}
+}
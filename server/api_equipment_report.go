@@ -0,0 +1,85 @@
+package server
+
+// api_equipment_report.go contains an endpoint that accepts a single report
+// packet over HTTP, for devices that sit behind networks that drop UDP
+// traffic. The body is the exact packet that the device would send to the UDP
+// port, in any of the layouts that the UDP listener accepts, and it goes
+// through the same checks and gets the same signed ack back. A report that
+// was accepted over one transport is a duplicate on the other.
+//
+// Heartbeats, see heartbeats.go, can be posted to the same endpoint. They
+// don't get an ack over UDP, so they don't get one here either.
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// EquipmentReportHandler accepts a single report packet. A report with a
+// valid signature gets the serialized ReportAck as the response, with the
+// status of the report in the ack, exactly like the UDP listener would send
+// it. Any other report gets an error.
+func (gcas *GCAServer) EquipmentReportHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for equipment report.")
+		return
+	}
+
+	// Anything longer than the largest packet is malformed, so there's no
+	// reason to read past it.
+	packet, err := io.ReadAll(http.MaxBytesReader(w, r.Body, glow.HeartbeatSize))
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Unable to read request body")
+		return
+	}
+	if len(packet) == glow.HeartbeatSize {
+		gcas.serveHeartbeat(w, r, packet)
+		return
+	}
+	data, err := gcas.admitReportPacket(packet, nil)
+	if errors.Is(err, errRateLimitedPacket) {
+		gcas.writeError(w, ErrCodeRateLimited, "Too many reports from this device, try again later")
+		return
+	}
+	if err != nil {
+		gcas.requestLogger(r).WithFields("size", len(packet), "outcome", "malformed_packet", "error", err).Warn("http packet rejected")
+		gcas.writeError(w, ErrCodeMalformedRequest, "Unable to decode report packet")
+		return
+	}
+
+	ack, outcome, authenticated := gcas.managedIngestReport(data, "http", remoteAddr(r.RemoteAddr))
+	if !authenticated {
+		gcas.writeError(w, outcome.apiErrorCode(), outcome.String())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(ack.Serialize()); err != nil {
+		gcas.requestLogger(r).Warn("Failed to write report ack: ", err)
+	}
+}
+
+// serveHeartbeat records a heartbeat that was posted to the endpoint. A
+// heartbeat that was recorded gets an empty response, anything else gets an
+// error.
+func (gcas *GCAServer) serveHeartbeat(w http.ResponseWriter, r *http.Request, packet []byte) {
+	outcome, _, err := gcas.managedIngestHeartbeat(packet, "http", remoteAddr(r.RemoteAddr))
+	if errors.Is(err, errRateLimitedPacket) {
+		gcas.writeError(w, ErrCodeRateLimited, "Too many reports from this device, try again later")
+		return
+	}
+	if err != nil {
+		gcas.requestLogger(r).WithFields("size", len(packet), "outcome", "malformed_packet", "error", err).Warn("http packet rejected")
+		gcas.writeError(w, ErrCodeMalformedRequest, "Unable to decode heartbeat")
+		return
+	}
+	if code := outcome.apiErrorCode(); code != "" {
+		gcas.writeError(w, code, outcome.String())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postReportPacket posts a report packet to the equipment report endpoint, and
+// returns the ack, or the error code if the server refused to ack the report.
+func (gcas *GCAServer) postReportPacket(packet []byte) (*glow.ReportAck, string, error) {
+	resp, err := http.Post("http://"+gcas.httpDialAddr()+"/api/v1/equipment-report", "application/octet-stream", bytes.NewReader(packet))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr APIError
+		json.Unmarshal(data, &apiErr)
+		return nil, apiErr.Code, nil
+	}
+	ra, err := glow.DeserializeReportAck(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return &ra, "", nil
+}
+
+// TestEquipmentReportHTTP checks that a report packet gets the same treatment
+// over HTTP as it gets over UDP, and that the two transports share their
+// state: a report that was accepted over one of them is a duplicate on the
+// other.
+func TestEquipmentReportHTTP(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(4, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A report that goes over HTTP first is a duplicate over UDP.
+	report := generateTestReport(ea.ShortID, 3, ePriv)
+	ra, code, err := server.postReportPacket(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra == nil || ra.ShortID != ea.ShortID || ra.Timeslot != 3 || ra.Status != glow.ReportAckAccepted {
+		t.Fatal("unexpected ack:", ra, code)
+	}
+	if !glow.Verify(server.staticPublicKey, ra.SigningBytes(), ra.Signature) {
+		t.Fatal("ack has a bad signature")
+	}
+	ra, err = server.sendReportReadAck(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra == nil || ra.Status != glow.ReportAckDuplicate {
+		t.Fatal("expected a duplicate ack over udp:", ra)
+	}
+
+	// A report that goes over UDP first is a duplicate over HTTP.
+	report = generateTestReport(ea.ShortID, 4, ePriv)
+	ra, err = server.sendReportReadAck(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra == nil || ra.Status != glow.ReportAckAccepted {
+		t.Fatal("expected an accepted ack over udp:", ra)
+	}
+	ra, code, err = server.postReportPacket(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra == nil || ra.Status != glow.ReportAckDuplicate {
+		t.Fatal("expected a duplicate ack over http:", ra, code)
+	}
+
+	// The versioned packets work over HTTP too.
+	er := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 5, PowerOutput: 7}
+	er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+	packet, err := glow.EncodeReportPacket(er, glow.ReportPacketVersion1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra, code, err = server.postReportPacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra == nil || ra.Status != glow.ReportAckAccepted {
+		t.Fatal("version 1 packet was not accepted:", ra, code)
+	}
+	server.mu.Lock()
+	power := server.equipmentReports[ea.ShortID].PowerOutputs[5]
+	server.mu.Unlock()
+	if power != 7 {
+		t.Fatal("version 1 packet was not applied")
+	}
+
+	// A report with a bad signature doesn't get an ack, and neither does
+	// a packet that can't be decoded.
+	_, otherPriv := glow.GenerateKeyPair()
+	ra, code, err = server.postReportPacket(generateTestReport(ea.ShortID, 6, otherPriv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra != nil || code != ErrCodeInvalidSignature {
+		t.Fatal("report with a bad signature was acked:", ra, code)
+	}
+	ra, code, err = server.postReportPacket(report[:20])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra != nil || code != ErrCodeMalformedRequest {
+		t.Fatal("malformed packet was acked:", ra, code)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%v:%v/api/v1/equipment-report", serverIP, server.httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("GET was not refused:", resp.StatusCode)
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+// api_equipment_reports_csv.go provides a CSV export of the report history of
+// a single device, which is primarily used by auditors. The export combines
+// the weekly stats history with the live reports of the current window.
+//
+// The rows are streamed to the caller one week at a time. The server lock is
+// only held while a single week of data is being copied out, which keeps the
+// memory footprint small and ensures a slow reader can't stall the server.
+//
+// If the requested range extends past the data that the server has, the
+// response contains whatever is available and the X-Truncated header is set
+// to "true". The range that was actually returned is placed in the
+// X-Available-Start and X-Available-End headers.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// EquipmentReportsCSVHandler streams the history of a device as a CSV with
+// the columns timeslot, timestamp, power_output, impact_rate, and
+// received_at, which is the unix time at which the report was received and
+// empty if the server has no receipt for it, see report_receipts.go. The range is
+// selected with the 'start' (inclusive) and 'end' (exclusive) query
+// parameters, both default to the full range available on the server.
+func (gcas *GCAServer) EquipmentReportsCSVHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for equipment reports csv.")
+		return
+	}
+
+	// Parse the public key.
+	publicKeyStr := r.URL.Query().Get("pubkey")
+	if publicKeyStr == "" {
+		gcas.writeError(w, ErrCodeMalformedRequest, "pubkey is a required query parameter")
+		return
+	}
+	publicKey, err := glow.ParsePublicKey(publicKeyStr)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid public key format")
+		return
+	}
+
+	// Determine the range of data that the server has for the device.
+	gcas.mu.RLock()
+	shortID, exists := gcas.equipmentShortID[publicKey]
+	availStart := gcas.equipmentHistoryOffset
+	availEnd := gcas.equipmentReportsOffset + 4032
+	gcas.mu.RUnlock()
+	if !exists {
+		gcas.writeError(w, ErrCodeUnknownDevice, "equipment not found")
+		return
+	}
+
+	// Parse the requested range.
+	start := availStart
+	end := availEnd
+	if str := r.URL.Query().Get("start"); str != "" {
+		start64, err := strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid start format")
+			return
+		}
+		start = uint32(start64)
+	}
+	if str := r.URL.Query().Get("end"); str != "" {
+		end64, err := strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid end format")
+			return
+		}
+		end = uint32(end64)
+	}
+	if end <= start {
+		gcas.writeError(w, ErrCodeMalformedRequest, "end must be greater than start")
+		return
+	}
+
+	// Clamp the range to the available data.
+	truncated := false
+	if start < availStart {
+		start = availStart
+		truncated = true
+	}
+	if end > availEnd {
+		end = availEnd
+		truncated = true
+	}
+	if end < start {
+		end = start
+	}
+	if start < end && gcas.managedNeedsStatsHistory(start) {
+		writeLoadingError(w, gcas.writeError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"equipment-reports-%d.csv\"", shortID))
+	if truncated {
+		w.Header().Set("X-Truncated", "true")
+	}
+	w.Header().Set("X-Available-Start", strconv.FormatUint(uint64(start), 10))
+	w.Header().Set("X-Available-End", strconv.FormatUint(uint64(end), 10))
+
+	// Stream the rows out one week at a time.
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"timeslot", "timestamp", "power_output", "impact_rate", "received_at"}); err != nil {
+		gcas.requestLogger(r).Warn("Unable to write csv header:", err)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	for chunkStart := start; chunkStart < end; {
+		chunkEnd := chunkStart - chunkStart%2016 + 2016
+		if chunkEnd > end {
+			chunkEnd = end
+		}
+		outputs, rates := gcas.managedReportsChunk(shortID, publicKey, chunkStart, chunkEnd)
+		receipts := gcas.managedReceiptsChunk(shortID, chunkStart, chunkEnd)
+		for i := range outputs {
+			ts := chunkStart + uint32(i)
+			receivedAt := ""
+			if receipts[ts] != 0 {
+				receivedAt = strconv.FormatInt(receipts[ts], 10)
+			}
+			row := []string{
+				strconv.FormatUint(uint64(ts), 10),
+				strconv.FormatInt(glow.TimeslotToUnix(ts), 10),
+				strconv.FormatUint(outputs[i], 10),
+				strconv.FormatFloat(rates[i], 'g', -1, 64),
+				receivedAt,
+			}
+			if err := cw.Write(row); err != nil {
+				gcas.requestLogger(r).Warn("Unable to write csv row:", err)
+				return
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			gcas.requestLogger(r).Warn("Unable to flush csv rows:", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		chunkStart = chunkEnd
+	}
+}
+
+// managedReportsChunk returns the power outputs and impact rates of a device
+// for the timeslots [start, end). The range must not cross a week boundary.
+// Timeslots where the server has no data for the device are left as zero.
+// The power outputs include the overrides of the GCA, the stats history
+// already has them applied.
+func (gcas *GCAServer) managedReportsChunk(shortID uint32, publicKey glow.PublicKey, start, end uint32) ([]uint64, []float64) {
+	outputs := make([]uint64, end-start)
+	rates := make([]float64, end-start)
+
+	// Pull from the live window if the chunk falls inside of it.
+	gcas.mu.RLock()
+	if start >= gcas.equipmentReportsOffset {
+		defer gcas.mu.RUnlock()
+		reports, exists := gcas.equipmentReports[shortID]
+		if !exists {
+			return outputs, rates
+		}
+		impactRates := gcas.equipmentImpactRate[shortID]
+		for ts := start; ts < end; ts++ {
+			i := ts - gcas.equipmentReportsOffset
+			if i >= 4032 {
+				break
+			}
+			outputs[ts-start] = reports.PowerOutputs[i]
+			if impactRates != nil {
+				rates[ts-start] = impactRates[i]
+			}
+		}
+		gcas.applyReportOverrides(shortID, start, outputs)
+		return outputs, rates
+	}
+
+	// Otherwise the chunk comes from the stats history, which may have to
+	// be read from disk.
+	historyOffset := gcas.equipmentHistoryOffset
+	gcas.mu.RUnlock()
+	if start < historyOffset {
+		return outputs, rates
+	}
+	ads, exists, err := gcas.managedHistoryWeek(int((start - historyOffset) / 2016))
+	if err != nil {
+		gcas.logger.Errorf("unable to read the stats history: %v", err)
+	}
+	if !exists {
+		return outputs, rates
+	}
+	for _, ds := range ads.Devices {
+		if ds.PublicKey != publicKey {
+			continue
+		}
+		for ts := start; ts < end; ts++ {
+			i := ts - ads.TimeslotOffset
+			outputs[ts-start] = ds.PowerOutputs[i]
+			rates[ts-start] = ds.ImpactRates[i]
+		}
+		break
+	}
+	return outputs, rates
+}
+
+// managedReceiptsChunk returns the receipts of the reports of a device for the
+// timeslots [start, end) by timeslot, from memory or from the receipts of the
+// archived week. The range must not cross a week boundary.
+func (gcas *GCAServer) managedReceiptsChunk(shortID uint32, start, end uint32) map[uint32]int64 {
+	gcas.mu.RLock()
+	if start >= gcas.equipmentReportsOffset {
+		defer gcas.mu.RUnlock()
+		receipts := make(map[uint32]int64)
+		for ts := start; ts < end; ts++ {
+			if at := gcas.receivedAt(shortID, ts); at != 0 {
+				receipts[ts] = at
+			}
+		}
+		return receipts
+	}
+	gcas.mu.RUnlock()
+	receipts, err := gcas.loadArchivedReceipts(start-start%2016, shortID)
+	if err != nil {
+		gcas.logger.Error(err)
+	}
+	return receipts
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getReportsCSV fetches the csv export for the provided public key, returning
+// the response and the parsed rows (without the header).
+func (gcas *GCAServer) getReportsCSV(pk glow.PublicKey, params string) (*http.Response, [][]string, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/equipment-reports.csv?pubkey=%v%v", gcas.httpPort, hex.EncodeToString(pk[:]), params))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil, nil
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rows) == 0 || rows[0][0] != "timeslot" {
+		return nil, nil, fmt.Errorf("csv is missing its header")
+	}
+	return resp, rows[1:], nil
+}
+
+// TestEquipmentReportsCSV checks the csv export of the report history,
+// including a range that crosses from the history into the live reports.
+func TestEquipmentReportsCSV(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, priv, err := server.AuthorizeTestDevice(7, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 10, priv))
+
+	// Check a range that falls inside the live reports.
+	resp, rows, err := server.getReportsCSV(ea.PublicKey, "&start=5&end=15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(rows) != 10 {
+		t.Fatal("unexpected response:", resp.StatusCode, len(rows))
+	}
+	if resp.Header.Get("Content-Disposition") != "attachment; filename=\"equipment-reports-7.csv\"" {
+		t.Fatal("bad content disposition:", resp.Header.Get("Content-Disposition"))
+	}
+	if resp.Header.Get("X-Truncated") != "" {
+		t.Fatal("response should not be truncated")
+	}
+	if rows[5][0] != "10" || rows[5][1] != strconv.FormatInt(glow.TimeslotToUnix(10), 10) || rows[5][2] != "5" || rows[4][2] != "0" {
+		t.Fatal("unexpected rows:", rows[4], rows[5])
+	}
+
+	// Shift the live window forward by hand so that the report above
+	// becomes part of the history.
+	server.mu.Lock()
+	stats, err := server.buildDeviceStats(0)
+	if err != nil {
+		server.mu.Unlock()
+		t.Fatal(err)
+	}
+	server.equipmentStatsHistory = append(server.equipmentStatsHistory, stats)
+	server.equipmentReportsOffset = 2016
+	server.equipmentReports[ea.ShortID] = new(deviceReports)
+	server.mu.Unlock()
+	glow.SetCurrentTimeslot(2030)
+	defer glow.SetCurrentTimeslot(0)
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 2020, priv))
+
+	// Request a range that crosses the boundary and runs past the end of
+	// the data.
+	resp, rows, err = server.getReportsCSV(ea.PublicKey, "&start=10&end=9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("X-Truncated") != "true" || resp.Header.Get("X-Available-End") != strconv.Itoa(2016+4032) {
+		t.Fatal("expected a truncated response:", resp.Header)
+	}
+	if len(rows) != 2016+4032-10 {
+		t.Fatal("wrong number of rows:", len(rows))
+	}
+	if rows[0][2] != "5" || rows[2020-10][2] != "5" || rows[2019-10][2] != "0" {
+		t.Fatal("data was not pulled from both the history and the live reports")
+	}
+
+	// Bad requests.
+	unknown, _ := glow.GenerateKeyPair()
+	resp, _, err = server.getReportsCSV(unknown, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected a 404 for unknown equipment:", resp.StatusCode)
+	}
+	resp, _, err = server.getReportsCSV(ea.PublicKey, "&start=20&end=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected a 400 for a backwards range:", resp.StatusCode)
+	}
+}
@@ -0,0 +1,602 @@
+package server
+
+// api_equipment_transfer.go moves a device, along with its history, from the
+// servers of one GCA to the servers of another GCA.
+//
+// The GCA that currently oversees the device signs an EquipmentRelease that
+// names the device and the GCA that takes it over, and posts it to the export
+// endpoint of one of its servers. The server answers with an EquipmentBundle
+// that contains the release, the authorization of the device, every signed
+// report that the server has for the device, and the ban if the device was
+// banned. Everything in the bundle carries its original signature, so the
+// bundle can be checked without trusting the server that produced it.
+//
+// The GCA that takes over the device co-signs the release, and posts the
+// bundle to the import endpoint of one of its own servers. The importing
+// server checks the authorization against the key history of the source GCA,
+// the release against the source GCA, and every report against the key of
+// the device. Banned devices are refused.
+//
+// The authorization is signed by the source GCA, so the ShortID inside of it
+// can collide with a ShortID that the destination already uses. In that case
+// the destination assigns the next free ShortID, and records a mapping from
+// the old ShortID to the new ShortID. The device has to sign its reports with
+// the new ShortID from then on. The reports in the bundle keep the old
+// ShortID, they are kept as part of the import and never get moved into the
+// reporting window, so that their signatures stay verifiable.
+//
+// A device that was imported can't be exported again, because its reports on
+// this server are signed with a ShortID that its authorization doesn't carry.
+//
+// Imports are not forwarded between servers, the destination GCA imports the
+// bundle into each of its servers, and receives the assigned ShortID from
+// each of them.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// equipmentReleaseSize is the size of a serialized EquipmentRelease.
+const equipmentReleaseSize = 32 + 32 + 32 + 64
+
+// EquipmentRelease is signed by the GCA that oversees a device to hand the
+// device over to another GCA.
+type EquipmentRelease struct {
+	Equipment      glow.PublicKey // The device that is being released
+	SourceGCA      glow.PublicKey // The GCA that releases the device
+	DestinationGCA glow.PublicKey // The GCA that takes over the device
+	Signature      glow.Signature // A signature from the SourceGCA
+}
+
+// SigningBytes returns the bytes that the source GCA signs to release the
+// device.
+func (er EquipmentRelease) SigningBytes() []byte {
+	b := []byte("EquipmentRelease")
+	b = append(b, er.Equipment[:]...)
+	b = append(b, er.SourceGCA[:]...)
+	return append(b, er.DestinationGCA[:]...)
+}
+
+// ImportSigningBytes returns the bytes that the destination GCA signs to
+// accept the device.
+func (er EquipmentRelease) ImportSigningBytes() []byte {
+	b := []byte("EquipmentImport")
+	b = append(b, er.SigningBytes()...)
+	return append(b, er.Signature[:]...)
+}
+
+// EquipmentBundle contains everything that the source servers know about a
+// device.
+type EquipmentBundle struct {
+	Release       EquipmentRelease
+	InitialGCA    glow.PublicKey   // The key that the source GCA registered with
+	KeyRotations  []GCAKeyRotation // The rotations from the InitialGCA to the SourceGCA
+	Authorization glow.EquipmentAuthorization
+	Reports       []glow.EquipmentReport // Every signed report, in order of timeslot
+	Ban           *BannedEquipment       `json:",omitempty"`
+}
+
+// EquipmentImportRequest is posted by the destination GCA to import a device.
+type EquipmentImportRequest struct {
+	Bundle     EquipmentBundle
+	Acceptance glow.Signature // A signature from the DestinationGCA over the ImportSigningBytes of the release
+}
+
+// EquipmentImportResponse is the response to a successful import.
+type EquipmentImportResponse struct {
+	Status     string `json:"status"`
+	OldShortID uint32 `json:"old_short_id"`
+	ShortID    uint32 `json:"short_id"`
+}
+
+// equipmentImport is an imported device, as it is kept by the destination.
+type equipmentImport struct {
+	ShortID    uint32 // The ShortID on this server
+	Bundle     EquipmentBundle
+	Acceptance glow.Signature
+}
+
+// authorization returns the authorization of the device with the ShortID
+// that it has on this server. The signature on it only verifies against the
+// original ShortID.
+func (ei equipmentImport) authorization() glow.EquipmentAuthorization {
+	ea := ei.Bundle.Authorization
+	ea.ShortID = ei.ShortID
+	return ea
+}
+
+// Serialize returns the binary representation of the import:
+//
+//	ShortID (4 bytes)
+//	acceptance (64 bytes)
+//	release (160 bytes)
+//	initial GCA key (32 bytes)
+//	number of rotations (4 bytes), followed by the rotations
+//	size of the authorization (4 bytes), followed by the authorization
+//	number of reports (4 bytes), followed by the reports
+func (ei equipmentImport) Serialize() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, ei.ShortID)
+	b = append(b, ei.Acceptance[:]...)
+	rel := ei.Bundle.Release
+	b = append(b, rel.Equipment[:]...)
+	b = append(b, rel.SourceGCA[:]...)
+	b = append(b, rel.DestinationGCA[:]...)
+	b = append(b, rel.Signature[:]...)
+	b = append(b, ei.Bundle.InitialGCA[:]...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(ei.Bundle.KeyRotations)))
+	for _, rot := range ei.Bundle.KeyRotations {
+		b = append(b, rot.Serialize()...)
+	}
+	ea := ei.Bundle.Authorization.Serialize()
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(ea)))
+	b = append(b, ea...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(ei.Bundle.Reports)))
+	for _, report := range ei.Bundle.Reports {
+		b = append(b, report.Serialize()...)
+	}
+	return b
+}
+
+// deserializeEquipmentImport reverses a call to Serialize, returning the
+// number of bytes that were consumed.
+func deserializeEquipmentImport(data []byte) (equipmentImport, int, error) {
+	var ei equipmentImport
+	n := 0
+	next := func(size int) ([]byte, error) {
+		if size < 0 || len(data)-n < size {
+			return nil, errors.New("import record is truncated")
+		}
+		b := data[n : n+size]
+		n += size
+		return b, nil
+	}
+	nextCount := func(itemSize int) (int, error) {
+		b, err := next(4)
+		if err != nil {
+			return 0, err
+		}
+		count := int(binary.LittleEndian.Uint32(b))
+		if count > (len(data)-n)/itemSize {
+			return 0, errors.New("import record is truncated")
+		}
+		return count, nil
+	}
+
+	head, err := next(4 + 64 + equipmentReleaseSize + 32)
+	if err != nil {
+		return ei, 0, err
+	}
+	ei.ShortID = binary.LittleEndian.Uint32(head)
+	copy(ei.Acceptance[:], head[4:])
+	rel := &ei.Bundle.Release
+	copy(rel.Equipment[:], head[68:])
+	copy(rel.SourceGCA[:], head[100:])
+	copy(rel.DestinationGCA[:], head[132:])
+	copy(rel.Signature[:], head[164:])
+	copy(ei.Bundle.InitialGCA[:], head[228:])
+
+	rotations, err := nextCount(gcaKeyRotationSize)
+	if err != nil {
+		return ei, 0, err
+	}
+	for i := 0; i < rotations; i++ {
+		b, _ := next(gcaKeyRotationSize)
+		rot, err := DeserializeGCAKeyRotation(b)
+		if err != nil {
+			return ei, 0, err
+		}
+		ei.Bundle.KeyRotations = append(ei.Bundle.KeyRotations, rot)
+	}
+	eaSize, err := nextCount(1)
+	if err != nil {
+		return ei, 0, err
+	}
+	b, _ := next(eaSize)
+	ei.Bundle.Authorization, err = glow.DeserializeEquipmentAuthorization(b)
+	if err != nil {
+		return ei, 0, err
+	}
+	reports, err := nextCount(80)
+	if err != nil {
+		return ei, 0, err
+	}
+	for i := 0; i < reports; i++ {
+		b, _ := next(80)
+		report, err := glow.DeserializeReport(b)
+		if err != nil {
+			return ei, 0, err
+		}
+		ei.Bundle.Reports = append(ei.Bundle.Reports, report)
+	}
+	return ei, n, nil
+}
+
+// EquipmentImportSummary describes an imported device.
+type EquipmentImportSummary struct {
+	PublicKey  string           `json:"pubkey"`
+	SourceGCA  string           `json:"source_gca"`
+	OldShortID uint32           `json:"old_short_id"`
+	ShortID    uint32           `json:"short_id"`
+	Reports    int              `json:"reports"`
+	Bundle     *EquipmentBundle `json:"bundle,omitempty"`
+}
+
+// verifyEquipmentBundle checks every signature in a bundle. It does not
+// depend on the state of the server.
+func verifyEquipmentBundle(b EquipmentBundle) error {
+	rel := b.Release
+	if !glow.Verify(rel.SourceGCA, rel.SigningBytes(), rel.Signature) {
+		return withCode(ErrCodeInvalidSignature, errors.New("invalid signature on equipment release"))
+	}
+
+	// Walk the key history of the source GCA, which has to end at the
+	// key that signed the release.
+	keys := []glow.PublicKey{b.InitialGCA}
+	for i, rot := range b.KeyRotations {
+		if rot.OldKey != keys[len(keys)-1] || !glow.Verify(rot.OldKey, rot.SigningBytes(), rot.Signature) {
+			return withCode(ErrCodeInvalidSignature, fmt.Errorf("key rotation %v of the source gca does not verify", i))
+		}
+		keys = append(keys, rot.NewKey)
+	}
+	if keys[len(keys)-1] != rel.SourceGCA {
+		return withCode(ErrCodeInvalidSignature, errors.New("key history does not lead to the gca that signed the release"))
+	}
+
+	ea := b.Authorization
+	if ea.PublicKey != rel.Equipment {
+		return withCode(ErrCodeMalformedRequest, errors.New("authorization is for a different device than the release"))
+	}
+	authorized := false
+	for _, key := range keys {
+		if glow.Verify(key, ea.SigningBytes(), ea.Signature) {
+			authorized = true
+			break
+		}
+	}
+	if !authorized {
+		return withCode(ErrCodeInvalidSignature, errors.New("authorization is not signed by the source gca"))
+	}
+
+	for i, report := range b.Reports {
+		if report.ShortID != ea.ShortID {
+			return withCode(ErrCodeMalformedRequest, fmt.Errorf("report %v is for ShortID %v, expected %v", i, report.ShortID, ea.ShortID))
+		}
+		if i > 0 && report.Timeslot <= b.Reports[i-1].Timeslot {
+			return withCode(ErrCodeMalformedRequest, fmt.Errorf("report %v is out of order", i))
+		}
+		if !glow.Verify(ea.PublicKey, report.SigningBytes(), report.Signature) {
+			return withCode(ErrCodeInvalidSignature, fmt.Errorf("invalid signature on report %v", i))
+		}
+	}
+	return nil
+}
+
+// managedBuildEquipmentBundle verifies a release and collects the bundle for
+// the released device.
+func (gcas *GCAServer) managedBuildEquipmentBundle(rel EquipmentRelease) (EquipmentBundle, error) {
+	gcas.mu.RLock()
+	if !gcas.gcaPubkeyAvailable {
+		gcas.mu.RUnlock()
+		return EquipmentBundle{}, errNotInitialized
+	}
+	if rel.SourceGCA != gcas.gcaKeyAt(gcas.currentTimeslot()) || !gcas.verifyGCASignature(rel.SigningBytes(), rel.Signature) {
+		gcas.mu.RUnlock()
+		return EquipmentBundle{}, withCode(ErrCodeInvalidSignature, errors.New("release is not signed by the gca of this server"))
+	}
+	b := EquipmentBundle{
+		Release:      rel,
+		InitialGCA:   gcas.gcaPubkey,
+		KeyRotations: append([]GCAKeyRotation(nil), gcas.gcaKeyRotations...),
+	}
+
+	// The bundle only carries the authorization key, which can't verify
+	// the reports that were signed after a key rotation.
+	if len(gcas.deviceKeyRotations[rel.Equipment]) > 0 {
+		gcas.mu.RUnlock()
+		return EquipmentBundle{}, withCode(ErrCodeConflict, errors.New("equipment has rotated its key and can't be exported"))
+	}
+
+	// Find the device, which is either active or banned.
+	found := false
+	if shortID, exists := gcas.equipmentShortID[rel.Equipment]; exists {
+		if _, imported := gcas.equipmentImports[shortID]; imported {
+			gcas.mu.RUnlock()
+			return EquipmentBundle{}, withCode(ErrCodeConflict, errors.New("equipment was imported from another gca and can't be exported again"))
+		}
+		b.Authorization = gcas.equipment[shortID]
+		found = true
+	} else {
+		shortIDs := make([]uint32, 0, len(gcas.equipmentBans))
+		for shortID := range gcas.equipmentBans {
+			shortIDs = append(shortIDs, shortID)
+		}
+		sort.Slice(shortIDs, func(i, j int) bool { return shortIDs[i] < shortIDs[j] })
+		for _, shortID := range shortIDs {
+			be := gcas.buildBannedEquipment(shortID)
+			if !be.hasPublicKey(rel.Equipment) {
+				continue
+			}
+			if be.Equivocation != nil {
+				b.Authorization = be.Equivocation.Authorization
+			}
+			for _, ea := range be.Authorizations {
+				if ea.PublicKey == rel.Equipment {
+					b.Authorization = ea
+				}
+			}
+			b.Ban = &be
+			found = true
+			break
+		}
+	}
+	if !found {
+		gcas.mu.RUnlock()
+		return EquipmentBundle{}, withCode(ErrCodeUnknownDevice, errors.New("equipment is not known to this server"))
+	}
+
+	// Copy the reports out of the reporting window.
+	var live []glow.EquipmentReport
+	offset := gcas.equipmentReportsOffset
+	if _, exists := gcas.equipmentReports[b.Authorization.ShortID]; exists && b.Ban == nil {
+		var err error
+		live, err = gcas.signedReports(b.Authorization.ShortID, 0, 4032)
+		if err != nil {
+			gcas.mu.RUnlock()
+			return EquipmentBundle{}, err
+		}
+	}
+	gcas.mu.RUnlock()
+
+	// The older reports come out of the archives.
+	periods, err := gcas.archivedPeriods()
+	if err != nil {
+		return EquipmentBundle{}, err
+	}
+	for _, periodStart := range periods {
+		if periodStart >= offset {
+			break
+		}
+		device, found, err := gcas.loadArchivedDevice(periodStart, rel.Equipment)
+		if err != nil {
+			return EquipmentBundle{}, fmt.Errorf("unable to read the archive for period %v: %v", periodStart, err)
+		}
+		if found {
+			b.Reports = append(b.Reports, device.Reports...)
+		}
+	}
+	b.Reports = append(b.Reports, live...)
+	return b, nil
+}
+
+// applyEquipmentImport adds an imported device to the in-memory state.
+func (gcas *GCAServer) applyEquipmentImport(ei equipmentImport) {
+	ea := ei.authorization()
+	gcas.equipmentImports[ei.ShortID] = ei
+	gcas.allocateShortID(ea.ShortID, ea.PublicKey)
+	gcas.equipmentShortID[ea.PublicKey] = ea.ShortID
+	gcas.equipment[ea.ShortID] = ea
+	gcas.staticReportLimiter.addDevice(ea.ShortID)
+	gcas.recordDeviceChange(StateChangeAuthorization, ea.ShortID, ea.PublicKey, 0)
+	gcas.equipmentImpactRate[ea.ShortID] = new([4032]float64)
+	gcas.equipmentReports[ea.ShortID] = new(deviceReports)
+}
+
+// managedImportEquipment verifies and saves an import. It returns the
+// ShortID of the device on this server, and whether the import is new.
+func (gcas *GCAServer) managedImportEquipment(req EquipmentImportRequest) (uint32, bool, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return 0, false, errNotInitialized
+	}
+	rel := req.Bundle.Release
+	if rel.DestinationGCA != gcas.gcaKeyAt(gcas.currentTimeslot()) {
+		return 0, false, withCode(ErrCodeInvalidSignature, errors.New("release names a different destination gca"))
+	}
+	if !gcas.verifyGCASignature(rel.ImportSigningBytes(), req.Acceptance) {
+		return 0, false, withCode(ErrCodeInvalidSignature, errors.New("invalid signature on equipment import"))
+	}
+
+	// Importing the same device again is a no-op.
+	if shortID, exists := gcas.equipmentShortID[rel.Equipment]; exists {
+		if ei, imported := gcas.equipmentImports[shortID]; imported && ei.Bundle.Release == rel {
+			return shortID, false, nil
+		}
+		return 0, false, withCode(ErrCodeConflict, errors.New("equipment is already known to this server"))
+	}
+	if _, exists := gcas.equipmentDeauthorizations[rel.Equipment]; exists {
+		return 0, false, withCode(ErrCodeDeviceDeauthorized, errors.New("equipment with this public key has been deauthorized"))
+	}
+	if req.Bundle.Ban != nil {
+		return 0, false, withCode(ErrCodeDeviceBanned, errors.New("banned equipment can't be imported"))
+	}
+	if err := verifyEquipmentBundle(req.Bundle); err != nil {
+		return 0, false, err
+	}
+	if err := gcas.verifyNotTestKey("device", rel.Equipment); err != nil {
+		return 0, false, err
+	}
+
+	// Keep the ShortID of the device unless it's taken, in which case
+	// the device gets a ShortID that was never allocated, see short_ids.go.
+	shortID := req.Bundle.Authorization.ShortID
+	if gcas.shortIDInUse(shortID) {
+		shortID = gcas.nextShortID()
+	}
+	ei := equipmentImport{ShortID: shortID, Bundle: req.Bundle, Acceptance: req.Acceptance}
+	err := gcas.recordAudit(auditRecord{
+		action:  glow.AuditEquipmentImport,
+		request: ei.Serialize(),
+		signatures: []glow.AuditSignature{
+			gcas.gcaAuditSignature(rel.ImportSigningBytes(), req.Acceptance),
+			{PublicKey: rel.SourceGCA, SigningBytes: rel.SigningBytes(), Signature: rel.Signature},
+		},
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if err := gcas.staticStorage.AppendFile(EquipmentImportsFile, ei.Serialize(), 0644); err != nil {
+		return 0, false, fmt.Errorf("unable to save equipment import: %v", err)
+	}
+	gcas.applyEquipmentImport(ei)
+	return shortID, true, nil
+}
+
+// loadEquipmentImports loads the imported devices from disk, creating the
+// file if it does not exist yet. This needs to happen after the equipment
+// and the deauthorizations are loaded, and before any bans are replayed.
+// The ShortIDs of the imports are in the registry already, unless the server
+// died between saving the import and saving the allocation.
+func (gcas *GCAServer) loadEquipmentImports() error {
+	data, err := gcas.staticStorage.ReadFile(EquipmentImportsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(EquipmentImportsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read equipment imports file: %v", err)
+	}
+	for i := 0; len(data) > 0; i++ {
+		ei, n, err := deserializeEquipmentImport(data)
+		if err != nil {
+			return fmt.Errorf("%v: record %v: %v", EquipmentImportsFile, i, err)
+		}
+		data = data[n:]
+		if !gcas.verifyPersistedGCASignature(ei.Bundle.Release.ImportSigningBytes(), ei.Acceptance) {
+			return fmt.Errorf("%v: record %v: invalid signature on equipment import", EquipmentImportsFile, i)
+		}
+		if err := verifyEquipmentBundle(ei.Bundle); err != nil {
+			return fmt.Errorf("%v: record %v: %v", EquipmentImportsFile, i, err)
+		}
+		_, known := gcas.equipmentShortID[ei.Bundle.Release.Equipment]
+		_, active := gcas.equipment[ei.ShortID]
+		_, banned := gcas.equipmentBans[ei.ShortID]
+		owner, allocated := gcas.shortIDOwners[ei.ShortID]
+		if known || active || banned || (allocated && owner != ei.Bundle.Release.Equipment) {
+			return fmt.Errorf("%v: record %v: equipment collides with equipment that is already known", EquipmentImportsFile, i)
+		}
+		gcas.applyEquipmentImport(ei)
+	}
+	return nil
+}
+
+// EquipmentExportHandler answers a release from the GCA with the bundle of
+// the released device.
+func (gcas *GCAServer) EquipmentExportHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for equipment export.")
+		return
+	}
+
+	// Decode the JSON request body into the release.
+	var request EquipmentRelease
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+
+	bundle, err := gcas.managedBuildEquipmentBundle(request)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to export equipment: ", err))
+		gcas.requestLogger(r).Warn("Failed to export equipment: ", err)
+		return
+	}
+	gcas.requestLogger(r).WithFields("pubkey", hex.EncodeToString(request.Equipment[:]), "reports", len(bundle.Reports)).Info("Exported equipment.")
+	gcas.writeJSONResponse(w, r, bundle)
+}
+
+// EquipmentImportHandler imports a device that was exported by the servers
+// of another GCA.
+func (gcas *GCAServer) EquipmentImportHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for equipment import.")
+		return
+	}
+
+	// Decode the JSON request body into the import.
+	var request EquipmentImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+
+	shortID, isNew, err := gcas.managedImportEquipment(request)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to import equipment: ", err))
+		gcas.requestLogger(r).Warn("Failed to import equipment: ", err)
+		return
+	}
+	if isNew {
+		gcas.requestLogger(r).WithFields("pubkey", hex.EncodeToString(request.Bundle.Release.Equipment[:]), "old_short_id", request.Bundle.Authorization.ShortID, "short_id", shortID).Info("Imported equipment.")
+	}
+	json.NewEncoder(w).Encode(EquipmentImportResponse{
+		Status:     "success",
+		OldShortID: request.Bundle.Authorization.ShortID,
+		ShortID:    shortID,
+	})
+}
+
+// EquipmentImportsHandler lists the imported devices, with the mapping from
+// the ShortID on the source servers to the ShortID on this server. The
+// optional 'pubkey' query parameter limits the response to a single device,
+// and includes its full bundle.
+func (gcas *GCAServer) EquipmentImportsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for equipment imports.")
+		return
+	}
+
+	var filter *glow.PublicKey
+	if pubkeyStr := r.URL.Query().Get("pubkey"); pubkeyStr != "" {
+		pk, err := glow.ParsePublicKey(pubkeyStr)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "Invalid public key format")
+			return
+		}
+		filter = &pk
+	}
+
+	gcas.mu.RLock()
+	imports := make([]EquipmentImportSummary, 0, len(gcas.equipmentImports))
+	for _, ei := range gcas.equipmentImports {
+		rel := ei.Bundle.Release
+		if filter != nil && rel.Equipment != *filter {
+			continue
+		}
+		summary := EquipmentImportSummary{
+			PublicKey:  hex.EncodeToString(rel.Equipment[:]),
+			SourceGCA:  hex.EncodeToString(rel.SourceGCA[:]),
+			OldShortID: ei.Bundle.Authorization.ShortID,
+			ShortID:    ei.ShortID,
+			Reports:    len(ei.Bundle.Reports),
+		}
+		if filter != nil {
+			bundle := ei.Bundle
+			summary.Bundle = &bundle
+		}
+		imports = append(imports, summary)
+	}
+	gcas.mu.RUnlock()
+	if filter != nil && len(imports) == 0 {
+		gcas.writeError(w, ErrCodeNotFound, "equipment was not imported")
+		return
+	}
+	sort.Slice(imports, func(i, j int) bool { return imports[i].ShortID < imports[j].ShortID })
+	gcas.writeJSONResponse(w, r, imports)
+}
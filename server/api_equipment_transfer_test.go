@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postTransferJSON posts a value to a transfer endpoint and decodes the
+// response into resp if the request succeeds.
+func (gcas *GCAServer) postTransferJSON(endpoint string, v interface{}, resp interface{}) (int, error) {
+	jsonBody, _ := json.Marshal(v)
+	r, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v%v", gcas.httpPort, endpoint), "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return 0, fmt.Errorf("unable to send request: %v", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode == http.StatusOK && resp != nil {
+		if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+			return 0, fmt.Errorf("unable to decode response: %v", err)
+		}
+	}
+	return r.StatusCode, nil
+}
+
+// TestEquipmentTransfer moves a device between the servers of two different
+// GCAs, where the ShortID of the device is already taken on the destination.
+func TestEquipmentTransfer(t *testing.T) {
+	src, _, srcGCAPub, srcGCAPriv, err := SetupTestEnvironment(t.Name() + "-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, dstDir, dstGCAPub, dstGCAPriv, err := SetupTestEnvironment(t.Name() + "-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The device has a few reports on the source, and its ShortID is
+	// already in use on the destination.
+	ea, ePriv, err := src.AuthorizeTestDevice(1, srcGCAPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := uint32(0); ts < 5; ts++ {
+		if outcome, _ := src.managedHandleEquipmentReport(generateTestReport(ea.ShortID, ts, ePriv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+	if _, _, err := dst.AuthorizeTestDevice(1, dstGCAPriv); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the GCA of the source can release the device.
+	rel := EquipmentRelease{Equipment: ea.PublicKey, SourceGCA: srcGCAPub, DestinationGCA: dstGCAPub}
+	rel.Signature = glow.Sign(rel.SigningBytes(), dstGCAPriv)
+	status, err := src.postTransferJSON("/api/v1/export-equipment", rel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusForbidden {
+		t.Fatal("expected a release from the wrong gca to be rejected:", status)
+	}
+	rel.Signature = glow.Sign(rel.SigningBytes(), srcGCAPriv)
+	var bundle EquipmentBundle
+	status, err = src.postTransferJSON("/api/v1/export-equipment", rel, &bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("export failed:", status)
+	}
+	if bundle.Authorization != ea || len(bundle.Reports) != 5 || bundle.Ban != nil {
+		t.Fatalf("unexpected bundle: %+v", bundle)
+	}
+
+	// The destination GCA has to accept the device, and the bundle must
+	// not be tampered with.
+	req := EquipmentImportRequest{Bundle: bundle}
+	req.Acceptance = glow.Sign(rel.ImportSigningBytes(), srcGCAPriv)
+	status, err = dst.postTransferJSON("/api/v1/import-equipment", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusForbidden {
+		t.Fatal("expected an import without acceptance to be rejected:", status)
+	}
+	req.Acceptance = glow.Sign(rel.ImportSigningBytes(), dstGCAPriv)
+	tampered := req
+	tampered.Bundle.Reports = append([]glow.EquipmentReport(nil), bundle.Reports...)
+	tampered.Bundle.Reports[2].PowerOutput++
+	status, err = dst.postTransferJSON("/api/v1/import-equipment", tampered, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusForbidden {
+		t.Fatal("expected a tampered report to be rejected:", status)
+	}
+
+	// The import gets the next free ShortID, and importing again is a
+	// no-op.
+	var resp EquipmentImportResponse
+	status, err = dst.postTransferJSON("/api/v1/import-equipment", req, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || resp.OldShortID != 1 || resp.ShortID != 2 {
+		t.Fatalf("unexpected import response: %v %+v", status, resp)
+	}
+	status, err = dst.postTransferJSON("/api/v1/import-equipment", req, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || resp.ShortID != 2 {
+		t.Fatalf("unexpected response to a repeated import: %v %+v", status, resp)
+	}
+
+	// The device reports to the destination with its new ShortID, and the
+	// GCA can't hand out the ShortID to another device.
+	if outcome, _ := dst.managedHandleEquipmentReport(generateTestReport(2, 6, ePriv)); outcome != reportAccepted {
+		t.Fatal("report with the new ShortID was not accepted:", outcome)
+	}
+	if _, _, err := dst.AuthorizeTestDevice(2, dstGCAPriv); err == nil {
+		t.Fatal("the ShortID of imported equipment was authorized again")
+	}
+
+	// The mapping and the bundle survive a restart, and the reports in the
+	// bundle still verify against the key of the device.
+	dst.Close()
+	dst, err = NewGCAServer(dstDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	r, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/equipment-imports?pubkey=%x", dst.httpPort, ea.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	var imports []EquipmentImportSummary
+	if err := json.NewDecoder(r.Body).Decode(&imports); err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != 1 || imports[0].OldShortID != 1 || imports[0].ShortID != 2 || imports[0].Bundle == nil {
+		t.Fatalf("unexpected imports: %+v", imports)
+	}
+	for _, report := range imports[0].Bundle.Reports {
+		if !glow.Verify(ea.PublicKey, report.SigningBytes(), report.Signature) {
+			t.Fatal("report in the bundle does not verify")
+		}
+	}
+	dst.mu.RLock()
+	_, exists := dst.equipment[2]
+	dst.mu.RUnlock()
+	if !exists {
+		t.Fatal("imported equipment did not survive a restart")
+	}
+}
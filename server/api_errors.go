@@ -0,0 +1,213 @@
+package server
+
+// api_errors.go contains the structured errors of the HTTP API. Every error
+// response is a JSON object of the form
+//
+//	{"code": "INVALID_SIGNATURE", "message": "invalid signature on EquipmentAuthorization"}
+//
+// The code is one of the ErrCode constants below and is meant for machines,
+// callers should never need to look at the message to decide what went
+// wrong. Each code has a fixed HTTP status, so the status alone is enough to
+// tell client errors, missing resources, and server problems apart.
+//
+// The messages are the same strings that the v1 handlers have always
+// returned as plain text. During the transition to structured errors, a
+// server can be launched with ServerOptions.LegacyErrors, in which case the
+// v1 handlers write the plain text message (with the new status) instead of
+// the JSON object. The v2 handlers always return structured errors.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// The error codes that the HTTP API can return.
+const (
+	ErrCodeInvalidSignature     = "INVALID_SIGNATURE"     // A signature in the request did not verify
+	ErrCodeUnknownDevice        = "UNKNOWN_DEVICE"        // The device is not known to the server
+	ErrCodeDeviceBanned         = "DEVICE_BANNED"         // The device or its ShortID is banned
+	ErrCodeDeviceDeauthorized   = "DEVICE_DEAUTHORIZED"   // The device was deauthorized by the GCA
+	ErrCodeDeviceExpired        = "DEVICE_EXPIRED"        // The authorization of the device expired before the timeslot
+	ErrCodeOutsideAuthorization = "OUTSIDE_AUTHORIZATION" // The timeslot is outside of the authorization of the key that signed the report
+	ErrCodeStaleTimeslot        = "STALE_TIMESLOT"        // The timeslot is outside of the accepted window
+	ErrCodeReportFlagged        = "REPORT_FLAGGED"        // The report exceeds the capacity and awaits review
+	ErrCodePeriodFinalized      = "PERIOD_FINALIZED"      // The week of the timeslot has been finalized
+	ErrCodeMalformedRequest     = "MALFORMED_REQUEST"     // The request could not be parsed or is invalid
+	ErrCodeRequestTooLarge      = "REQUEST_TOO_LARGE"     // The request contains too many items
+	ErrCodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"    // The route does not support the HTTP method
+	ErrCodeNotFound             = "NOT_FOUND"             // The requested resource does not exist
+	ErrCodeConflict             = "CONFLICT"              // The request conflicts with the state of the server
+	ErrCodeNotInitialized       = "NOT_INITIALIZED"       // The GCA has not registered with the server yet
+	ErrCodeGCAKeyMismatch       = "GCA_KEY_MISMATCH"      // A different GCA key has already been registered
+	ErrCodeRateLimited          = "RATE_LIMITED"          // Too many requests were made, try again later
+	ErrCodeInsecureTransport    = "INSECURE_TRANSPORT"    // The request needs TLS or a loopback connection
+	ErrCodeUnauthorized         = "UNAUTHORIZED"          // The request needs a valid signature from the GCA or an operator
+	ErrCodeScopeDenied          = "SCOPE_DENIED"          // The operator key was not delegated the scope that the request needs
+	ErrCodeOriginNotAllowed     = "ORIGIN_NOT_ALLOWED"    // The browser origin may not call this server
+	ErrCodeServerBusy           = "SERVER_BUSY"           // The server is at capacity, try again later
+	ErrCodeServerShuttingDown   = "SERVER_SHUTTING_DOWN"  // The server is shutting down
+	ErrCodeLoading              = "LOADING"               // The server is still loading the data that the request needs
+	ErrCodeResyncRequired       = "RESYNC_REQUIRED"       // The changes that were asked for are no longer known, fetch everything again
+	ErrCodeCursorExpired        = "CURSOR_EXPIRED"        // The snapshot of the cursor is gone, restart the pagination
+	ErrCodeStorageUnavailable   = "STORAGE_UNAVAILABLE"   // The server can't durably store the request right now, try again later
+	ErrCodeUpstreamError        = "UPSTREAM_ERROR"        // A third party service that the server relies on failed
+	ErrCodeInternalError        = "INTERNAL_ERROR"        // Something went wrong inside of the server
+)
+
+// errNotInitialized is returned by anything that needs the GCA key before
+// the GCA has registered with the server.
+var errNotInitialized = withCode(ErrCodeNotInitialized, errors.New("this gca server has not yet been initialized by the GCA"))
+
+// errorCodeStatus maps every error code to the HTTP status that gets sent
+// alongside it.
+var errorCodeStatus = map[string]int{
+	ErrCodeInvalidSignature:     http.StatusForbidden,
+	ErrCodeUnknownDevice:        http.StatusNotFound,
+	ErrCodeDeviceBanned:         http.StatusForbidden,
+	ErrCodeDeviceDeauthorized:   http.StatusForbidden,
+	ErrCodeDeviceExpired:        http.StatusForbidden,
+	ErrCodeOutsideAuthorization: http.StatusForbidden,
+	ErrCodeStaleTimeslot:        http.StatusUnprocessableEntity,
+	ErrCodeReportFlagged:        http.StatusUnprocessableEntity,
+	ErrCodePeriodFinalized:      http.StatusConflict,
+	ErrCodeMalformedRequest:     http.StatusBadRequest,
+	ErrCodeRequestTooLarge:      http.StatusRequestEntityTooLarge,
+	ErrCodeMethodNotAllowed:     http.StatusMethodNotAllowed,
+	ErrCodeNotFound:             http.StatusNotFound,
+	ErrCodeConflict:             http.StatusConflict,
+	ErrCodeNotInitialized:       http.StatusServiceUnavailable,
+	ErrCodeGCAKeyMismatch:       http.StatusConflict,
+	ErrCodeRateLimited:          http.StatusTooManyRequests,
+	ErrCodeInsecureTransport:    http.StatusForbidden,
+	ErrCodeUnauthorized:         http.StatusUnauthorized,
+	ErrCodeScopeDenied:          http.StatusForbidden,
+	ErrCodeOriginNotAllowed:     http.StatusForbidden,
+	ErrCodeServerBusy:           http.StatusServiceUnavailable,
+	ErrCodeServerShuttingDown:   http.StatusServiceUnavailable,
+	ErrCodeLoading:              http.StatusServiceUnavailable,
+	ErrCodeResyncRequired:       http.StatusGone,
+	ErrCodeCursorExpired:        http.StatusGone,
+	ErrCodeStorageUnavailable:   http.StatusServiceUnavailable,
+	ErrCodeUpstreamError:        http.StatusBadGateway,
+	ErrCodeInternalError:        http.StatusInternalServerError,
+}
+
+// ErrorCodeStatus returns the HTTP status that the API sends with the
+// provided error code.
+func ErrorCodeStatus(code string) int {
+	if status, exists := errorCodeStatus[code]; exists {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// APIError is the body of every structured error response.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// codedError attaches an error code to an error, which allows the handler
+// that reports the error to pick the right code without matching on the
+// message. The message of the wrapped error is unchanged.
+type codedError struct {
+	code string
+	err  error
+}
+
+// Error implements the error interface.
+func (ce codedError) Error() string {
+	return ce.err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (ce codedError) Unwrap() error {
+	return ce.err
+}
+
+// withCode attaches an error code to an error.
+func withCode(code string, err error) error {
+	return codedError{code: code, err: err}
+}
+
+// errorCode returns the code attached to the error, or the fallback if the
+// error has no code.
+func errorCode(err error, fallback string) string {
+	var ce codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return fallback
+}
+
+// ErrorCode returns the error code that is attached to an error returned by
+// the server, which is the code that the HTTP API would send for it, or an
+// empty string if the error has no code.
+func ErrorCode(err error) string {
+	return errorCode(err, "")
+}
+
+// apiErrorCode returns the error code that describes why a report was not
+// accepted, or an empty string if the report was accepted.
+func (ro reportOutcome) apiErrorCode() string {
+	switch ro {
+	case reportAccepted, reportDuplicate:
+		return ""
+	case reportBanned:
+		return ErrCodeDeviceBanned
+	case reportStale:
+		return ErrCodeStaleTimeslot
+	case reportBadSignature:
+		return ErrCodeInvalidSignature
+	case reportUnknownDevice:
+		return ErrCodeUnknownDevice
+	case reportInvalidPower:
+		return ErrCodeMalformedRequest
+	case reportDeauthorized:
+		return ErrCodeDeviceDeauthorized
+	case reportExpired:
+		return ErrCodeDeviceExpired
+	case reportFlagged:
+		return ErrCodeReportFlagged
+	case reportFinalized:
+		return ErrCodePeriodFinalized
+	case reportRetryLater:
+		return ErrCodeStorageUnavailable
+	case reportOutsideAuthorization:
+		return ErrCodeOutsideAuthorization
+	}
+	return ErrCodeInternalError
+}
+
+// writeAPIError writes a structured error response.
+func (gcas *GCAServer) writeAPIError(w http.ResponseWriter, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(ErrorCodeStatus(code))
+	if err := json.NewEncoder(w).Encode(APIError{Code: code, Message: message}); err != nil {
+		gcas.logger.Error("Failed to encode JSON error:", err)
+	}
+}
+
+// writeError writes an error response for a v1 handler, which is a
+// structured error unless the server was launched with legacy errors.
+func (gcas *GCAServer) writeError(w http.ResponseWriter, code string, message string) {
+	if gcas.staticLegacyErrors {
+		http.Error(w, message, ErrorCodeStatus(code))
+		return
+	}
+	gcas.writeAPIError(w, code, message)
+}
+
+// refuseDuringShutdown wraps the API so that requests which arrive while the
+// server is shutting down get a clear error instead of racing the shutdown.
+func (gcas *GCAServer) refuseDuringShutdown(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gcas.tg.IsStopped() {
+			gcas.writeError(w, ErrCodeServerShuttingDown, "Server is shutting down")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
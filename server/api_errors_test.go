@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// apiRequest sends a request to the provided v1 route and returns the status
+// and the raw body.
+func (gcas *GCAServer) apiRequest(method string, route string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://127.0.0.1:%v/api/v1/%v", gcas.httpPort, route), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
+
+// TestStructuredErrors checks that the v1 handlers return structured errors
+// with the right codes and statuses, and that the legacy switch brings the
+// plain text errors back.
+func TestStructuredErrors(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	pub, _ := glow.GenerateKeyPair()
+	if err := server.AuthorizeEquipment(glow.EquipmentAuthorization{ShortID: 1, PublicKey: pub, Capacity: 1000}, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	unsigned, _ := json.Marshal(EquipmentDeauthorization{PublicKey: pub})
+	banned, _ := json.Marshal(SignEquipmentAuthorization(glow.EquipmentAuthorization{ShortID: 1, PublicKey: pub, Capacity: 999}, gcaPrivKey))
+
+	tests := []struct {
+		method  string
+		route   string
+		body    []byte
+		status  int
+		code    string
+		message string
+	}{
+		{"POST", "equipment", nil, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Only GET method is supported."},
+		{"POST", "authorize-equipment", []byte("{"), http.StatusBadRequest, ErrCodeMalformedRequest, "Invalid request body"},
+		{"POST", "deauthorize-equipment", unsigned, http.StatusForbidden, ErrCodeInvalidSignature, "Failed to deauthorize equipment:invalid signature on equipment deauthorization"},
+		{"GET", "device-summary?short_id=7", nil, http.StatusNotFound, ErrCodeUnknownDevice, "unknown device"},
+		{"GET", "all-device-stats?timeslot_offset=1", nil, http.StatusBadRequest, ErrCodeMalformedRequest, "invalid timeslot_offset, must be multiple of 2016 - nearby numbers are 0 and 2016"},
+		// The second authorization conflicts with the first one and bans
+		// the ShortID, after which it can't be used anymore.
+		{"POST", "authorize-equipment", banned, http.StatusForbidden, ErrCodeDeviceBanned, "Failed to authorize equipment:unable to save equipment: duplicate authorization received, banning equipment"},
+		{"POST", "authorize-equipment", banned, http.StatusForbidden, ErrCodeDeviceBanned, "Failed to authorize equipment:unable to save equipment: equipment with this ShortID is banned"},
+	}
+	for _, tc := range tests {
+		status, body, err := server.apiRequest(tc.method, tc.route, tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var apiErr APIError
+		if err := json.Unmarshal(body, &apiErr); err != nil {
+			t.Fatalf("%v %v did not return a structured error: %s", tc.method, tc.route, body)
+		}
+		if status != tc.status || apiErr.Code != tc.code || apiErr.Message != tc.message {
+			t.Errorf("%v %v: unexpected error %v %+v", tc.method, tc.route, status, apiErr)
+		}
+	}
+
+	// The errors of the Go API carry the same codes.
+	_, err = server.managedAuthorizeEquipment(SignEquipmentAuthorization(glow.EquipmentAuthorization{ShortID: 1, PublicKey: pub, Capacity: 998}, gcaPrivKey))
+	if ErrorCode(err) != ErrCodeDeviceBanned || ErrorCode(fmt.Errorf("unable to save: %w", err)) != ErrCodeDeviceBanned || ErrorCode(io.EOF) != "" {
+		t.Error("unexpected error code:", err)
+	}
+
+	// The same request returns the old plain text message in legacy mode.
+	legacy, _, _, _, err := SetupTestEnvironmentWithOptions(t.Name()+"-legacy", ServerOptions{LegacyErrors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+	status, body, err := legacy.apiRequest("POST", "authorize-equipment", []byte("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusBadRequest || string(body) != "Invalid request body\n" {
+		t.Errorf("unexpected legacy error: %v %q", status, body)
+	}
+}
+
+// TestShuttingDownError checks that requests which arrive while the server is
+// shutting down get the shutdown error.
+func TestShuttingDownError(t *testing.T) {
+	server, _, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.refuseDuringShutdown(server.mux)
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/equipment", nil))
+	var apiErr APIError
+	if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || apiErr.Code != ErrCodeServerShuttingDown {
+		t.Errorf("unexpected error during shutdown: %v %+v", rec.Code, apiErr)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+// api_etag.go lets the stats endpoints answer conditional requests. Dashboards
+// poll all-device-stats every few seconds and nearly always get back the same
+// response, so the response carries an ETag and a request with a matching
+// If-None-Match header gets a 304 without a body.
+//
+// The ETag is built from a version counter that is bumped under the mutex
+// every time the reports, the equipment, or the impact rates change, rather
+// than from a hash of the response, so checking it costs nothing. The counter
+// starts over when the server restarts, so the ETag also contains a random ID
+// that is picked at startup.
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// bumpStateVersion records that the state of the server changed, which
+// invalidates the ETags that were handed out before. The mutex must be held.
+func (gcas *GCAServer) bumpStateVersion() {
+	gcas.stateVersion++
+}
+
+// stateETag returns the ETag for the current state of the server. The mutex
+// must be held, at least for reading.
+func (gcas *GCAServer) stateETag() string {
+	return fmt.Sprintf(`"%v-%v"`, gcas.staticBootID, gcas.stateVersion)
+}
+
+// etagMatches returns whether the If-None-Match header of the request allows
+// the provided ETag to be answered with a 304.
+func etagMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// timeslotETag adds the current timeslot to the ETag of a stats response. The
+// online flags of the devices change as time passes even when the state does
+// not, so a response is only reused for as long as the timeslot lasts.
+func timeslotETag(etag string, timeslot uint32) string {
+	return fmt.Sprintf(`%v-%v"`, strings.TrimSuffix(etag, `"`), timeslot)
+}
+
+// writeNotModified answers a conditional request for which nothing changed.
+func writeNotModified(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+}
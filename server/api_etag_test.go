@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestStatsETag polls the stats endpoints, checks that unchanged stats are
+// answered with a 304, and that every kind of state change hands out a new
+// ETag. The impact rates aren't collected, so nothing but the mutations of the
+// test changes the state.
+func TestStatsETag(t *testing.T) {
+	opts := DefaultServerOptions()
+	opts.DisableImpactCollection = true
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poll := func(route string, ifNoneMatch string) (int, string, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%v/api/%v", server.httpPort, route), nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("ETag"), body
+	}
+	const stats = "v1/all-device-stats?timeslot_offset=0"
+	status, etag, body := poll(stats, "")
+	if status != http.StatusOK || etag == "" || len(body) == 0 {
+		t.Fatalf("unexpected first poll: %v %q", status, etag)
+	}
+	// The response is compressed, which makes the ETag weak. The weak and
+	// the strong form both match.
+	strong := strings.TrimPrefix(etag, "W/")
+	for _, header := range []string{etag, strong, `"other", ` + strong, "*"} {
+		status, newETag, body := poll(stats, header)
+		if status != http.StatusNotModified || newETag != etag || len(body) != 0 {
+			t.Fatalf("If-None-Match %v: unexpected response %v %q %q", header, status, newETag, body)
+		}
+	}
+	if status, _, _ := poll(stats, `"stale"`); status != http.StatusOK {
+		t.Fatal("a stale ETag was not answered with the stats:", status)
+	}
+	if _, noETag, _ := poll(stats+"&insert_false_negatives=true", ""); noETag != "" {
+		t.Error("stats with false negatives got an ETag")
+	}
+	const v2Stats = "v2/all-device-stats?timeslot_offset=0"
+	status, v2ETag, _ := poll(v2Stats, "")
+	if status != http.StatusOK || v2ETag == "" {
+		t.Fatal("v2 stats did not return an ETag:", status)
+	}
+	if status, _, _ := poll(v2Stats, v2ETag); status != http.StatusNotModified {
+		t.Fatal("v2 stats were not answered with a 304:", status)
+	}
+
+	// Every mutation must change the ETag.
+	mutations := []struct {
+		name   string
+		mutate func()
+	}{
+		{"report", func() {
+			server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 5, ePriv))
+		}},
+		{"authorization", func() {
+			if _, _, err := server.AuthorizeTestDevice(2, gcaPrivKey); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"ban", func() {
+			er := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 5, PowerOutput: 6}
+			er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+			if outcome, _ := server.managedHandleEquipmentReport(er.Serialize()); outcome != reportBanned {
+				t.Fatal("conflicting report did not ban the equipment:", outcome)
+			}
+		}},
+		{"reports migration", func() {
+			glow.SetCurrentTimeslot(3300)
+			for i := 0; i < 100; i++ {
+				server.mu.RLock()
+				ero := server.equipmentReportsOffset
+				server.mu.RUnlock()
+				if ero != 0 {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Fatal("the reports were not migrated")
+		}},
+	}
+	for _, m := range mutations {
+		m.mutate()
+		status, newETag, body := poll(stats, etag)
+		if status != http.StatusOK || newETag == etag || len(body) == 0 {
+			t.Fatalf("%v: ETag did not change: %v %q", m.name, status, newETag)
+		}
+		if status, _, _ := poll(stats, newETag); status != http.StatusNotModified {
+			t.Fatalf("%v: the new ETag was not answered with a 304: %v", m.name, status)
+		}
+		etag = newETag
+	}
+
+	// The version starts over after a restart, the ETag must not.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServerWithOptions(server.baseDir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if status, _, _ := poll(stats, etag); status != http.StatusOK {
+		t.Fatal("an ETag from before the restart was answered with a 304:", status)
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+// api_gca_key_rotation.go lets the GCA move the server to a new key, which is
+// the way out if the key of the GCA gets compromised. The current key signs a
+// handoff that names the new key and the timeslot at which the new key takes
+// over. Rotations can be chained, every rotation has to be signed by the key
+// that the previous rotation handed off to.
+//
+// Before the activation timeslot, the server keeps accepting authorizations
+// and admin actions signed by the old key. From the activation timeslot
+// onward, only the new key is accepted. Everything that the server accepted
+// before the activation stays valid, which is why the data that gets loaded
+// from disk is checked against every key in the chain.
+//
+// Authorizations don't carry a timestamp, so an authorization signed by the
+// old key that only reaches the server after the activation timeslot is
+// refused, even if it was signed long before.
+//
+// Rotations are persisted to disk and forwarded to all of the other GCA
+// servers, the same way that deauthorizations are.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// gcaKeyRotationSize is the size of a serialized GCAKeyRotation.
+const gcaKeyRotationSize = 32 + 32 + 4 + 64
+
+// GCAKeyRotation is a handoff from one GCA key to another.
+type GCAKeyRotation struct {
+	OldKey             glow.PublicKey // The key that is being replaced
+	NewKey             glow.PublicKey // The key that takes over
+	ActivationTimeslot uint32         // The first timeslot in which only the new key is accepted
+	Signature          glow.Signature // A signature from the old key
+}
+
+// SigningBytes returns the bytes that the old key signs to hand off to the new
+// key.
+func (rot GCAKeyRotation) SigningBytes() []byte {
+	b := []byte("GCAKeyRotation")
+	b = append(b, rot.OldKey[:]...)
+	b = append(b, rot.NewKey[:]...)
+	return binary.LittleEndian.AppendUint32(b, rot.ActivationTimeslot)
+}
+
+// Serialize returns the compact binary representation of the rotation.
+func (rot GCAKeyRotation) Serialize() []byte {
+	b := make([]byte, gcaKeyRotationSize)
+	copy(b, rot.OldKey[:])
+	copy(b[32:], rot.NewKey[:])
+	binary.LittleEndian.PutUint32(b[64:], rot.ActivationTimeslot)
+	copy(b[68:], rot.Signature[:])
+	return b
+}
+
+// DeserializeGCAKeyRotation reverses a call to Serialize.
+func DeserializeGCAKeyRotation(b []byte) (GCAKeyRotation, error) {
+	var rot GCAKeyRotation
+	if len(b) != gcaKeyRotationSize {
+		return rot, fmt.Errorf("unexpected key rotation size: %v", len(b))
+	}
+	copy(rot.OldKey[:], b[:32])
+	copy(rot.NewKey[:], b[32:])
+	rot.ActivationTimeslot = binary.LittleEndian.Uint32(b[64:])
+	copy(rot.Signature[:], b[68:])
+	return rot, nil
+}
+
+// GCAKeyHistoryRotation is a single rotation in the key history, hex encoded.
+type GCAKeyHistoryRotation struct {
+	OldKey             string `json:"old_key"`
+	NewKey             string `json:"new_key"`
+	ActivationTimeslot uint32 `json:"activation_timeslot"`
+	Signature          string `json:"signature"`
+}
+
+// GCAKeyHistoryResponse contains the key that the GCA registered with, every
+// rotation since then, and the key that is accepted right now.
+type GCAKeyHistoryResponse struct {
+	InitialKey string                  `json:"initial_key"`
+	CurrentKey string                  `json:"current_key"`
+	Rotations  []GCAKeyHistoryRotation `json:"rotations"`
+}
+
+// latestGCAKey returns the key at the end of the chain of rotations, which is
+// the only key that can sign the next rotation.
+func (gcas *GCAServer) latestGCAKey() glow.PublicKey {
+	if n := len(gcas.gcaKeyRotations); n > 0 {
+		return gcas.gcaKeyRotations[n-1].NewKey
+	}
+	return gcas.gcaPubkey
+}
+
+// gcaKeyAt returns the key that is accepted in the provided timeslot.
+func (gcas *GCAServer) gcaKeyAt(timeslot uint32) glow.PublicKey {
+	key := gcas.gcaPubkey
+	for _, rot := range gcas.gcaKeyRotations {
+		if rot.ActivationTimeslot > timeslot {
+			break
+		}
+		key = rot.NewKey
+	}
+	return key
+}
+
+// verifyGCASignature checks a signature against the key of the GCA that is
+// accepted in the current timeslot.
+func (gcas *GCAServer) verifyGCASignature(sb []byte, sig glow.Signature) bool {
+	return glow.Verify(gcas.gcaKeyAt(gcas.currentTimeslot()), sb, sig)
+}
+
+// verifyPersistedGCASignature checks a signature against every key in the
+// chain of rotations. It is meant for data that the server accepted in the
+// past, when one of the older keys was still valid.
+func (gcas *GCAServer) verifyPersistedGCASignature(sb []byte, sig glow.Signature) bool {
+	if glow.Verify(gcas.gcaPubkey, sb, sig) {
+		return true
+	}
+	for _, rot := range gcas.gcaKeyRotations {
+		if glow.Verify(rot.NewKey, sb, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGCAKeyRotation checks that a rotation extends the current chain.
+func (gcas *GCAServer) checkGCAKeyRotation(rot GCAKeyRotation) error {
+	latest := gcas.latestGCAKey()
+	if rot.OldKey != latest {
+		return withCode(ErrCodeInvalidSignature, fmt.Errorf("rotation must be signed by the latest gca key %x", latest))
+	}
+	if !glow.Verify(rot.OldKey, rot.SigningBytes(), rot.Signature) {
+		return withCode(ErrCodeInvalidSignature, errors.New("invalid signature on gca key rotation"))
+	}
+	if rot.NewKey == (glow.PublicKey{}) {
+		return withCode(ErrCodeMalformedRequest, errors.New("rotation has no new key"))
+	}
+	if rot.NewKey == gcas.gcaPubkey {
+		return withCode(ErrCodeMalformedRequest, errors.New("rotation hands off to a key that was already used"))
+	}
+	for _, prev := range gcas.gcaKeyRotations {
+		if rot.NewKey == prev.NewKey {
+			return withCode(ErrCodeMalformedRequest, errors.New("rotation hands off to a key that was already used"))
+		}
+	}
+	if n := len(gcas.gcaKeyRotations); n > 0 && rot.ActivationTimeslot < gcas.gcaKeyRotations[n-1].ActivationTimeslot {
+		return withCode(ErrCodeMalformedRequest, errors.New("rotation activates before the previous rotation"))
+	}
+	return nil
+}
+
+// managedRotateGCAKey verifies and saves a rotation. The bool indicates
+// whether the rotation is new to this server.
+func (gcas *GCAServer) managedRotateGCAKey(rot GCAKeyRotation) (bool, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return false, errNotInitialized
+	}
+
+	// A rotation that is already part of the chain is redundant.
+	for _, prev := range gcas.gcaKeyRotations {
+		if prev == rot {
+			return false, nil
+		}
+	}
+	if err := gcas.checkGCAKeyRotation(rot); err != nil {
+		return false, err
+	}
+	if err := gcas.verifyNotTestKey("gca", rot.NewKey); err != nil {
+		return false, err
+	}
+	if rot.ActivationTimeslot < gcas.currentTimeslot() {
+		return false, withCode(ErrCodeStaleTimeslot, fmt.Errorf("activation timeslot %v is in the past", rot.ActivationTimeslot))
+	}
+
+	// Record and persist the rotation before applying it.
+	err := gcas.recordAudit(auditRecord{
+		action:     glow.AuditGCAKeyRotation,
+		request:    rot.Serialize(),
+		signatures: []glow.AuditSignature{{PublicKey: rot.OldKey, SigningBytes: rot.SigningBytes(), Signature: rot.Signature}},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := gcas.staticStorage.AppendFile(GCAKeyRotationsFile, rot.Serialize(), 0644); err != nil {
+		return false, fmt.Errorf("unable to save gca key rotation: %v", err)
+	}
+	gcas.gcaKeyRotations = append(gcas.gcaKeyRotations, rot)
+	return true, nil
+}
+
+// loadGCAKeyRotations loads the chain of rotations from disk, creating the
+// file if it does not exist yet. This needs to happen after the GCA key is
+// loaded, and before anything that was signed by the GCA.
+func (gcas *GCAServer) loadGCAKeyRotations() error {
+	data, err := gcas.staticStorage.ReadFile(GCAKeyRotationsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(GCAKeyRotationsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read gca key rotations file: %v", err)
+	}
+	if len(data)%gcaKeyRotationSize != 0 {
+		return fmt.Errorf("gca key rotations file has an unexpected size")
+	}
+	for i := 0; i < len(data); i += gcaKeyRotationSize {
+		rot, err := DeserializeGCAKeyRotation(data[i : i+gcaKeyRotationSize])
+		if err != nil {
+			return fmt.Errorf("unable to decode gca key rotation: %v", err)
+		}
+		if err := gcas.checkGCAKeyRotation(rot); err != nil {
+			return fmt.Errorf("%v: record %v: %v", GCAKeyRotationsFile, i/gcaKeyRotationSize, err)
+		}
+		gcas.gcaKeyRotations = append(gcas.gcaKeyRotations, rot)
+	}
+	return nil
+}
+
+// GCAKeyRotationHandler handles requests from the GCA to rotate its key.
+func (gcas *GCAServer) GCAKeyRotationHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for a gca key rotation.")
+		return
+	}
+
+	// Decode the JSON request body into the rotation.
+	var request GCAKeyRotation
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+
+	// Validate and process the request.
+	isNew, err := gcas.managedRotateGCAKey(request)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to rotate gca key: ", err))
+		gcas.requestLogger(r).Warn("Failed to rotate gca key: ", err)
+		return
+	}
+
+	// Forward the rotation to all of the other servers. Only new
+	// rotations get forwarded, which prevents the servers from endlessly
+	// passing the same request around.
+	if isNew {
+		jsonBody, _ := json.Marshal(request)
+		for _, as := range gcas.AuthorizedServers() {
+			if as.Banned {
+				continue
+			}
+			resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/rotate-gca-key", jsonBody)
+			if err != nil {
+				gcas.requestLogger(r).WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to forward gca key rotation")
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	// Send a success response
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	gcas.requestLogger(r).WithFields("new_key", hex.EncodeToString(request.NewKey[:]), "activation_timeslot", request.ActivationTimeslot).Info("Accepted gca key rotation.")
+}
+
+// GCAKeyHistoryHandler returns the full chain of GCA key rotations.
+func (gcas *GCAServer) GCAKeyHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for the gca key history.")
+		return
+	}
+
+	gcas.mu.RLock()
+	if !gcas.gcaPubkeyAvailable {
+		gcas.mu.RUnlock()
+		gcas.writeError(w, ErrCodeNotInitialized, errNotInitialized.Error())
+		return
+	}
+	current := gcas.gcaKeyAt(gcas.currentTimeslot())
+	resp := GCAKeyHistoryResponse{
+		InitialKey: hex.EncodeToString(gcas.gcaPubkey[:]),
+		CurrentKey: hex.EncodeToString(current[:]),
+		Rotations:  make([]GCAKeyHistoryRotation, 0, len(gcas.gcaKeyRotations)),
+	}
+	for _, rot := range gcas.gcaKeyRotations {
+		resp.Rotations = append(resp.Rotations, GCAKeyHistoryRotation{
+			OldKey:             hex.EncodeToString(rot.OldKey[:]),
+			NewKey:             hex.EncodeToString(rot.NewKey[:]),
+			ActivationTimeslot: rot.ActivationTimeslot,
+			Signature:          hex.EncodeToString(rot.Signature[:]),
+		})
+	}
+	gcas.mu.RUnlock()
+	gcas.writeJSONResponse(w, r, resp)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postGCAKeyRotation will submit a key rotation to the server and return the
+// status code.
+func (gcas *GCAServer) postGCAKeyRotation(rot GCAKeyRotation) (int, error) {
+	jsonBody, _ := json.Marshal(rot)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/rotate-gca-key", gcas.httpPort), "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return 0, fmt.Errorf("unable to send key rotation: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// getGCAKeyHistory fetches the key history from the server.
+func (gcas *GCAServer) getGCAKeyHistory() (GCAKeyHistoryResponse, error) {
+	var history GCAKeyHistoryResponse
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/gca-key-history", gcas.httpPort))
+	if err != nil {
+		return history, fmt.Errorf("unable to fetch key history: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return history, fmt.Errorf("unexpected status: %v", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&history)
+	return history, err
+}
+
+// newGCAKeyRotation creates a rotation from oldPriv to a fresh key.
+func newGCAKeyRotation(oldPub glow.PublicKey, oldPriv glow.PrivateKey, activation uint32) (GCAKeyRotation, glow.PrivateKey) {
+	newPub, newPriv := glow.GenerateKeyPair()
+	rot := GCAKeyRotation{OldKey: oldPub, NewKey: newPub, ActivationTimeslot: activation}
+	rot.Signature = glow.Sign(rot.SigningBytes(), oldPriv)
+	return rot, newPriv
+}
+
+// TestGCAKeyRotation checks that rotations have to be signed by the latest
+// key, that rotations can be chained, that the new key takes over at the
+// activation timeslot, and that everything survives a restart.
+func TestGCAKeyRotation(t *testing.T) {
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+	server, dir, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Authorize a device with the registered key.
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rotation signed by a key that isn't the current one is rejected.
+	otherPub, otherPriv := glow.GenerateKeyPair()
+	forged, _ := newGCAKeyRotation(otherPub, otherPriv, 20)
+	status, err := server.postGCAKeyRotation(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusForbidden {
+		t.Fatal("expected a rotation from an unknown key to be rejected:", status)
+	}
+	forged.OldKey = gcaPubKey
+	status, err = server.postGCAKeyRotation(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusForbidden {
+		t.Fatal("expected a rotation with a bad signature to be rejected:", status)
+	}
+
+	// Rotate to a second key, then chain a rotation to a third key.
+	rot1, priv1 := newGCAKeyRotation(gcaPubKey, gcaPrivKey, 20)
+	status, err = server.postGCAKeyRotation(rot1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("first rotation was rejected:", status)
+	}
+
+	// The registered key can't sign a second rotation, only the key it
+	// handed off to can.
+	stale, _ := newGCAKeyRotation(gcaPubKey, gcaPrivKey, 30)
+	status, err = server.postGCAKeyRotation(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusForbidden {
+		t.Fatal("expected a rotation from a rotated key to be rejected:", status)
+	}
+	rot2, priv2 := newGCAKeyRotation(rot1.NewKey, priv1, 30)
+	status, err = server.postGCAKeyRotation(rot2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("chained rotation was rejected:", status)
+	}
+
+	// The history has both rotations, and the registered key is still
+	// active.
+	history, err := server.getGCAKeyHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Rotations) != 2 || history.Rotations[1].OldKey != hex.EncodeToString(rot1.NewKey[:]) || history.Rotations[1].ActivationTimeslot != 30 {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	if history.InitialKey != hex.EncodeToString(gcaPubKey[:]) || history.CurrentKey != history.InitialKey {
+		t.Fatalf("unexpected keys in history: %+v", history)
+	}
+
+	// After the first activation, only the second key is accepted.
+	glow.SetCurrentTimeslot(20)
+	if _, _, err := server.AuthorizeTestDevice(2, gcaPrivKey); err == nil {
+		t.Fatal("authorization from a rotated key was accepted")
+	}
+	if _, _, err := server.AuthorizeTestDevice(2, priv1); err != nil {
+		t.Fatal(err)
+	}
+
+	// After the second activation, only the third key is accepted.
+	glow.SetCurrentTimeslot(30)
+	if _, _, err := server.AuthorizeTestDevice(3, priv1); err == nil {
+		t.Fatal("authorization from a rotated key was accepted")
+	}
+	if _, _, err := server.AuthorizeTestDevice(3, priv2); err != nil {
+		t.Fatal(err)
+	}
+	history, err = server.getGCAKeyHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.CurrentKey != hex.EncodeToString(rot2.NewKey[:]) {
+		t.Fatal("history does not report the latest key as current")
+	}
+
+	// The rotations and every device, including the one authorized by
+	// the registered key, survive a restart.
+	server.Close()
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.mu.RLock()
+	rotations := len(server.gcaKeyRotations)
+	_, exists := server.equipment[ea.ShortID]
+	devices := len(server.equipment)
+	server.mu.RUnlock()
+	if rotations != 2 {
+		t.Fatal("rotations did not survive a restart:", rotations)
+	}
+	if !exists || devices != 3 {
+		t.Fatal("devices did not survive a restart:", devices)
+	}
+
+	// Resubmitting a rotation is a no-op, and a rotation that activates
+	// in the past is rejected.
+	status, err = server.postGCAKeyRotation(rot1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("resubmitted rotation was rejected:", status)
+	}
+	late, _ := newGCAKeyRotation(rot2.NewKey, priv2, 29)
+	status, err = server.postGCAKeyRotation(late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status == http.StatusOK {
+		t.Fatal("rotation activating in the past was accepted")
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/fs"
@@ -25,7 +26,7 @@ type GeoStatsResponse struct {
 func (gcas *GCAServer) GeoStatsHandler(w http.ResponseWriter, r *http.Request) {
 	// Only allow GET calls.
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is allowed")
 		return
 	}
 
@@ -34,7 +35,7 @@ func (gcas *GCAServer) GeoStatsHandler(w http.ResponseWriter, r *http.Request) {
 	latitude, errLat := strconv.ParseFloat(query.Get("latitude"), 64)
 	longitude, errLong := strconv.ParseFloat(query.Get("longitude"), 64)
 	if errLat != nil || errLong != nil {
-		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid query parameters")
 		return
 	}
 
@@ -43,40 +44,40 @@ func (gcas *GCAServer) GeoStatsHandler(w http.ResponseWriter, r *http.Request) {
 	wtPasswordPath := filepath.Join(gcas.baseDir, "watttime_data", "password")
 	username, err := loadWattTimeCredentials(wtUsernamePath)
 	if err != nil {
-		http.Error(w, "Error in loading watttime username", http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeInternalError, "Error in loading watttime username")
 		return
 	}
 	password, err := loadWattTimeCredentials(wtPasswordPath)
 	if err != nil {
-		http.Error(w, "Error in loading watttime password", http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeInternalError, "Error in loading watttime password")
 		return
 	}
-	token, err := staticGetWattTimeToken(username, password)
+	token, err := staticGetWattTimeToken(r.Context(), gcas.staticWattTimeURL, username, password)
 	if err != nil {
-		http.Error(w, "Error in fetching watttime token", http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeUpstreamError, "Error in fetching watttime token")
 		return
 	}
 
 	// Fetch NASA data for this coordinate.
 	nasaData, err := fetchNASAData(latitude, longitude)
 	if err != nil {
-		http.Error(w, "Error in fetching nasa data", http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeUpstreamError, "Error in fetching nasa data")
 		return
 	}
 
 	// Fetch the balancing authority for this coordinate.
-	ba, err := getBalancingAuthority(token, latitude, longitude)
+	ba, err := getBalancingAuthority(r.Context(), gcas.staticWattTimeURL, token, latitude, longitude)
 	if err != nil {
-		http.Error(w, "Error in fetching balancing authority", http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeUpstreamError, "Error in fetching balancing authority")
 		return
 	}
 
 	// Get all of the historical data for this BA. It's a very expensive operation,
 	// but only if the historical data is not cached locally already. Luckily, most
 	// of the historical data is already cached locally.
-	err = gcas.fetchAndSaveHistoricalBAData(token, ba)
+	err = gcas.fetchAndSaveHistoricalBAData(r.Context(), token, ba)
 	if err != nil {
-		http.Error(w, "Error in fetching balancing authority", http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeUpstreamError, "Error in fetching balancing authority")
 		return
 	}
 
@@ -84,7 +85,7 @@ func (gcas *GCAServer) GeoStatsHandler(w http.ResponseWriter, r *http.Request) {
 	// it to disk if the data is not already saved.
 	baData, err := gcas.loadMOERData(ba)
 	if err != nil {
-		http.Error(w, "Error loading balancing authority historical data", http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeInternalError, "Error loading balancing authority historical data")
 		return
 	}
 
@@ -92,7 +93,7 @@ func (gcas *GCAServer) GeoStatsHandler(w http.ResponseWriter, r *http.Request) {
 	averageSunlight, averageCarbonCredits, err := calculateGeoStats(nasaData, baData)
 	if err != nil {
 		log.Println("Error in calculation:", err)
-		http.Error(w, "Error in calculation", http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeInternalError, "Error in calculation")
 		return
 	}
 
@@ -103,7 +104,7 @@ func (gcas *GCAServer) GeoStatsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewEncoder(w).Encode(responseData); err != nil {
-		http.Error(w, "Failed to encode JSON response", http.StatusInternalServerError)
+		gcas.writeError(w, ErrCodeInternalError, "Failed to encode JSON response")
 		return
 	}
 }
@@ -149,7 +150,7 @@ func fetchNASAData(latitude, longitude float64) (map[string]float64, error) {
 // fetchAndSaveHistoricalBAData fetches historical data for the given balancing
 // authority and saves it locally. WattTime allows querying historical data
 // for up to 32 days, so we will create 12 data files for each month of the year.
-func (gcas *GCAServer) fetchAndSaveHistoricalBAData(token, ba string) error {
+func (gcas *GCAServer) fetchAndSaveHistoricalBAData(ctx context.Context, token, ba string) error {
 	dataPath := filepath.Join(gcas.baseDir, "watttime_data", ba)
 	if err := os.MkdirAll(dataPath, os.ModePerm); err != nil {
 		return err
@@ -176,11 +177,11 @@ func (gcas *GCAServer) fetchAndSaveHistoricalBAData(token, ba string) error {
 		}
 	}
 	for _, f := range needed {
-		raw, err := getWattTimeHistoricalDataRaw(token, ba, f.start.Unix(), f.end.Unix())
+		raw, err := getWattTimeHistoricalDataRaw(ctx, gcas.staticWattTimeURL, token, ba, f.start.Unix(), f.end.Unix())
 		if err != nil {
 			return err
 		}
-		if err = os.WriteFile(f.name, raw, 0644); err != nil {
+		if err = writeFileAtomic(f.name, raw, 0644); err != nil {
 			return err
 		}
 		gcas.logger.Info("wrote historical data file: ", f.name)
@@ -0,0 +1,217 @@
+package server
+
+// api_gzip.go contains the middleware that compresses the responses of the
+// HTTP API. The big JSON responses compress about 10:1, which matters to
+// dashboards and devices that are on metered cellular links.
+//
+// A response only gets compressed if the client sent Accept-Encoding: gzip and
+// the body reaches gzipMinSize, smaller bodies aren't worth the overhead. The
+// first gzipMinSize bytes are held back to make that decision, everything
+// after that is compressed as it gets written, so a large response never has
+// to be buffered in full. A handler that flushes before reaching the threshold
+// is streaming small messages, and its response is left uncompressed.
+//
+// The ETag of a compressed response is marked as weak, because the compressed
+// bytes are not the same representation as the uncompressed bytes. The stats
+// handlers compare ETags weakly, so the weak ETag still yields a 304.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinSize is the smallest response body that gets compressed.
+const gzipMinSize = 4096
+
+// gzipWriters recycles the gzip writers, which are expensive to allocate.
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// acceptsGzip returns whether the Accept-Encoding header of the request allows
+// a gzip response.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.TrimSpace(name)
+			if !strings.EqualFold(name, "gzip") && name != "*" {
+				continue
+			}
+			// A quality of zero means that gzip is not acceptable.
+			if qStr, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(qStr), 64); err == nil && q == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body of a response once it reaches
+// gzipMinSize. Until then the body is held in buf and the status is held back,
+// because the headers can't be sent before it is known whether the response
+// gets compressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	buf      []byte
+	status   int
+	decided  bool
+	gz       *gzip.Writer
+	hijacked bool
+}
+
+// weakenETag marks the ETag of the response, if there is one, as weak.
+func (gw *gzipResponseWriter) weakenETag() {
+	etag := gw.Header().Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		gw.Header().Set("ETag", "W/"+etag)
+	}
+}
+
+// WriteHeader holds the status back until it is known whether the response
+// gets compressed. Responses that can't have a body are passed on directly.
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if gw.status != 0 || gw.decided {
+		return
+	}
+	gw.status = status
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		if status == http.StatusNotModified {
+			gw.weakenETag()
+		}
+		gw.decided = true
+		gw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// start decides whether the response gets compressed, sends the headers, and
+// writes out the buffered part of the body.
+func (gw *gzipResponseWriter) start(compress bool) error {
+	gw.decided = true
+	h := gw.Header()
+	if compress && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		gw.weakenETag()
+		gw.gz = gzipWriters.Get().(*gzip.Writer)
+		gw.gz.Reset(gw.ResponseWriter)
+	}
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Write buffers the body until gzipMinSize is reached, and compresses it from
+// then on.
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !gw.decided {
+		if len(gw.buf)+len(b) < gzipMinSize {
+			gw.buf = append(gw.buf, b...)
+			return len(b), nil
+		}
+		if err := gw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	return gw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher. A flush before the threshold was reached
+// sends the response uncompressed.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		if err := gw.start(false); err != nil {
+			return
+		}
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if f, ok := gw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, which the websocket handlers rely on.
+func (gw *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := gw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		gw.hijacked = true
+		gw.decided = true
+	}
+	return conn, brw, err
+}
+
+// finish writes out whatever is left of the response once the handler has
+// returned.
+func (gw *gzipResponseWriter) finish() {
+	if gw.hijacked {
+		return
+	}
+	if !gw.decided && (gw.status != 0 || len(gw.buf) > 0) {
+		gw.start(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+		gw.gz.Reset(nil)
+		gzipWriters.Put(gw.gz)
+		gw.gz = nil
+	}
+}
+
+// compressible returns whether a response with the provided Content-Type is
+// worth compressing. Archives are already compressed.
+func compressible(contentType string) bool {
+	for _, prefix := range []string{"application/zip", "application/gzip", "application/x-gzip", "image/", "video/"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressResponses wraps the API so that large responses get compressed for
+// the clients that accept gzip.
+func (gcas *GCAServer) compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestGzipResponses fetches a few endpoints with and without gzip and checks
+// that the decoded bodies are identical, and that only the large responses
+// get compressed. The impact rates aren't collected, so the responses don't
+// change between the fetches.
+func TestGzipResponses(t *testing.T) {
+	opts := DefaultServerOptions()
+	opts.DisableImpactCollection = true
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transport must not handle gzip by itself, otherwise the encoding
+	// of the response can't be checked.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	fetch := func(route string, gzipped bool) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%v/%v", server.httpPort, route), nil)
+		if gzipped {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	tests := []struct {
+		route      string
+		compressed bool
+	}{
+		{"api/v1/all-device-stats?timeslot_offset=0", true},
+		{"api/v2/all-device-stats?timeslot_offset=0", true},
+		{"api/v1/recent-reports?publicKey=" + hex.EncodeToString(ea.PublicKey[:]), true},
+		{"api/v1/equipment-reports.csv?pubkey=" + hex.EncodeToString(ea.PublicKey[:]), true},
+		{"api/v1/equipment", false},
+	}
+	for _, tc := range tests {
+		plainResp, plain := fetch(tc.route, false)
+		gzResp, gz := fetch(tc.route, true)
+		if plainResp.StatusCode != http.StatusOK || gzResp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: unexpected status %v %v", tc.route, plainResp.StatusCode, gzResp.StatusCode)
+		}
+		if plainResp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%v: response without Accept-Encoding was compressed", tc.route)
+		}
+		if (gzResp.Header.Get("Content-Encoding") == "gzip") != tc.compressed {
+			t.Fatalf("%v: unexpected Content-Encoding %q", tc.route, gzResp.Header.Get("Content-Encoding"))
+		}
+		if tc.compressed {
+			zr, err := gzip.NewReader(bytes.NewReader(gz))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("%v: %v bytes compressed to %v", tc.route, len(decoded), len(gz))
+			if len(gz) >= len(decoded) {
+				t.Errorf("%v: compression did not shrink the response", tc.route)
+			}
+			gz = decoded
+		}
+		if !bytes.Equal(plain, gz) {
+			t.Errorf("%v: decoded body differs from the uncompressed body", tc.route)
+		}
+		if !strings.Contains(gzResp.Header.Get("Vary"), "Accept-Encoding") {
+			t.Errorf("%v: response does not vary on Accept-Encoding", tc.route)
+		}
+	}
+
+	// A compressed response has a weak ETag, which still revalidates.
+	route := "api/v1/all-device-stats?timeslot_offset=0"
+	gzResp, _ := fetch(route, true)
+	etag := gzResp.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatal("compressed response does not have a weak ETag:", etag)
+	}
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%v/%v", server.httpPort, route), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", etag)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != etag {
+		t.Fatalf("weak ETag did not revalidate: %v %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+// TestGzipMiddleware checks the cases of the middleware that the endpoints
+// don't cover.
+func TestGzipMiddleware(t *testing.T) {
+	server, _, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	large := strings.Repeat("compressible ", gzipMinSize)
+	serve := func(acceptEncoding string, h http.HandlerFunc) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		server.compressResponses(h).ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Large bodies written in small pieces get compressed.
+	rec := serve("deflate, gzip;q=0.5", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(large)))
+		w.WriteHeader(http.StatusCreated)
+		for i := 0; i < len(large); i += 100 {
+			end := i + 100
+			if end > len(large) {
+				end = len(large)
+			}
+			w.Write([]byte(large[i:end]))
+		}
+	})
+	if rec.Code != http.StatusCreated || rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Content-Length") != "" {
+		t.Fatalf("large response was not compressed: %v %v", rec.Code, rec.Header())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := io.ReadAll(zr); string(decoded) != large {
+		t.Fatal("decoded body does not match")
+	}
+
+	// Refused gzip, small bodies, early flushes, and archives stay
+	// uncompressed.
+	cases := map[string]struct {
+		acceptEncoding string
+		handler        http.HandlerFunc
+		body           string
+	}{
+		"refused": {"gzip;q=0, identity", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(large)) }, large},
+		"small":   {"gzip", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("small")) }, "small"},
+		"flushed": {"gzip", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("event\n"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(large))
+		}, "event\n" + large},
+		"archive": {"gzip", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/zip")
+			w.Write([]byte(large))
+		}, large},
+	}
+	for name, tc := range cases {
+		rec := serve(tc.acceptEncoding, tc.handler)
+		if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != tc.body {
+			t.Errorf("%v: response should not have been compressed: %v", name, rec.Header())
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+// api_healthz.go provides a readiness endpoint for load balancers and service
+// managers. The endpoint only reports healthy once NewGCAServer has finished
+// launching every listener and loading every persist file, and it reports
+// unhealthy as soon as Close() has been called. It also reports unhealthy
+// while the UDP listener is restarting after its socket failed, as the server
+// can't ingest reports during that time, and while the server can't store
+// reports, see persist_health.go.
+//
+// The response is not signed. It is meant to be consumed by infrastructure on
+// the same network as the server, and none of the data in it is used to make
+// decisions about the protocol.
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HealthzResponse contains the status of the server.
+type HealthzResponse struct {
+	Status            string // Either "ok", "starting", "udp listener down", "storage degraded", or "shutting down"
+	UptimeSeconds     int64  // How long the server has been running
+	CurrentTimeslot   uint32 // The current protocol timeslot according to the server
+	AuthorizedDevices int    // The number of devices that can submit reports
+	SyncHealthy       bool   // Whether the sync listener has been launched and is running
+	UDPHealthy        bool   // Whether the UDP listener has a working socket, false while it restarts
+	LastSyncTime      int64  // Unix timestamp of the last sync request that was served, 0 if none
+
+	// The health of the WattTime integration, see watttime_series.go.
+	WattTimeLastSuccess     int64  // Unix timestamp of the last successful WattTime fetch, 0 if none
+	WattTimeStaleSlots      int    // The number of impact rates that are filled from stale data
+	WattTimeBackfilledSlots uint64 // The number of stale impact rates that were backfilled
+
+	// The health of the storage, see persist_health.go.
+	StorageHealthy     bool   // Whether reports can be stored, false after a failed write or while the disk is low
+	StorageError       string // The file and the error of the last failed write, empty once every report was written
+	UnpersistedReports int    // The number of reports that are waiting for their write to be retried
+	LowDisk            bool   // Whether the free disk space is below the watermark
+	DiskFreeBytes      uint64 // The free disk space at the last check, 0 if the check is disabled
+
+	// The backlog of every destination of the webhooks and the alert
+	// backends that has deliveries waiting, see retry_queue.go. A backlog
+	// does not make the server unhealthy.
+	RetryQueues []RetryQueueBacklog
+
+	// The build of the server, see buildinfo.go.
+	Version   string
+	Commit    string
+	BuildDate string
+}
+
+// HealthzHandler returns a 200 if the server is ready to accept reports, and
+// a 503 if the server is still starting up, can't store reports, or has begun
+// shutting down.
+func (gcas *GCAServer) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		return
+	}
+
+	// Grab the state of the server.
+	gcas.mu.RLock()
+	ready := gcas.ready
+	shuttingDown := gcas.shuttingDown
+	devices := 0
+	for _, ea := range gcas.equipment {
+		if _, exists := gcas.equipmentDeauthorizations[ea.PublicKey]; !exists {
+			devices++
+		}
+	}
+	lastSync := gcas.lastSyncTime
+	lastWattTime := gcas.wattTimeLastSuccess
+	staleSlots := gcas.staleImpactSlots()
+	backfilled := gcas.wattTimeBackfilled
+	storageHealthy := !gcas.storageDegraded()
+	var storageErr string
+	if gcas.persistErr != nil {
+		storageErr = gcas.persistErr.Error()
+	}
+	unpersisted := len(gcas.unpersistedReports)
+	lowDisk := gcas.lowDisk
+	free := gcas.diskFree
+	gcas.mu.RUnlock()
+	udpDown := gcas.udpListener.managedDown()
+	retryQueues := gcas.managedRetryBacklog()
+
+	hr := HealthzResponse{
+		Status:            "ok",
+		UptimeSeconds:     int64(gcas.now().Sub(gcas.staticStartTime) / time.Second),
+		CurrentTimeslot:   gcas.currentTimeslot(),
+		AuthorizedDevices: devices,
+		SyncHealthy:       ready && !shuttingDown,
+		UDPHealthy:        ready && !shuttingDown && !udpDown,
+
+		WattTimeStaleSlots:      staleSlots,
+		WattTimeBackfilledSlots: backfilled,
+
+		StorageHealthy:     storageHealthy,
+		StorageError:       storageErr,
+		UnpersistedReports: unpersisted,
+		LowDisk:            lowDisk,
+		DiskFreeBytes:      free,
+
+		RetryQueues: retryQueues,
+
+		Version:   Build.Version,
+		Commit:    Build.Commit,
+		BuildDate: Build.BuildDate,
+	}
+	if !lastSync.IsZero() {
+		hr.LastSyncTime = lastSync.Unix()
+	}
+	if !lastWattTime.IsZero() {
+		hr.WattTimeLastSuccess = lastWattTime.Unix()
+	}
+	status := http.StatusOK
+	if !ready {
+		hr.Status = "starting"
+		status = http.StatusServiceUnavailable
+	}
+	if ready && udpDown {
+		hr.Status = "udp listener down"
+		status = http.StatusServiceUnavailable
+	}
+	if ready && !udpDown && !storageHealthy {
+		hr.Status = "storage degraded"
+		status = http.StatusServiceUnavailable
+	}
+	if shuttingDown {
+		hr.Status = "shutting down"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(hr); err != nil {
+		gcas.requestLogger(r).Error("Failed to encode JSON response:", err)
+		return
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getHealthz fetches the healthz endpoint and decodes the response.
+func (gcas *GCAServer) getHealthz() (int, HealthzResponse, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/healthz", gcas.httpPort))
+	if err != nil {
+		return 0, HealthzResponse{}, err
+	}
+	defer resp.Body.Close()
+	var hr HealthzResponse
+	if err := json.NewDecoder(resp.Body).Decode(&hr); err != nil {
+		return 0, HealthzResponse{}, err
+	}
+	return resp.StatusCode, hr, nil
+}
+
+// TestHealthz checks that the healthz endpoint reflects the state of the
+// server.
+func TestHealthz(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server should be healthy right after startup.
+	status, hr, err := server.getHealthz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || hr.Status != "ok" {
+		t.Fatal("server is not healthy after startup:", status, hr)
+	}
+	if hr.AuthorizedDevices != 0 || hr.LastSyncTime != 0 || !hr.SyncHealthy {
+		t.Fatal("unexpected healthz response:", hr)
+	}
+
+	// Add a device and perform a sync, both should show up in the
+	// response.
+	ea, _, err := server.AuthorizeTestDevice(5, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = server.requestEquipmentBitfield(ea.ShortID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, hr, err = server.getHealthz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || hr.AuthorizedDevices != 1 || hr.LastSyncTime == 0 {
+		t.Fatal("unexpected healthz response:", status, hr)
+	}
+
+	// Once the server has been closed, the handler should report that the
+	// server is shutting down.
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	rec := httptest.NewRecorder()
+	server.HealthzHandler(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatal("expected a 503 after shutdown, got", rec.Code)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&hr); err != nil {
+		t.Fatal(err)
+	}
+	if hr.Status != "shutting down" || hr.SyncHealthy {
+		t.Fatal("unexpected healthz response after shutdown:", hr)
+	}
+}
@@ -0,0 +1,300 @@
+package server
+
+// api_historical_reports.go provides the signed reports of a device over any
+// range of time, including the weeks that have fallen out of the reporting
+// window. The weeks in the reporting window are read from memory and the
+// older weeks are read from the report archives.
+//
+// The response is streamed one week at a time. An archived week is read by
+// scanning the archive, which only holds the reports of the requested device
+// in memory, and the server lock is only held while a week of live reports is
+// copied out. The original signatures of the device are included with every
+// report, so that anyone holding the public key of the device can verify the
+// reports without trusting the server.
+//
+// Weeks that have no archive, either because they were discarded before
+// archiving existed or because the archive is unreadable, are listed in the
+// gaps of the response.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// HistoricalReport is a single signed report of a device.
+type HistoricalReport struct {
+	ShortID     uint32 `json:"short_id"`
+	Timeslot    uint32 `json:"timeslot"`
+	Timestamp   int64  `json:"timestamp"`
+	PowerOutput uint64 `json:"power_output"`
+	Signature   string `json:"signature"`
+
+	// ReceivedAt is the unix time at which the server received the
+	// report, left out if the server has no receipt for it, see
+	// report_receipts.go. It isn't covered by the signature.
+	ReceivedAt int64 `json:"received_at,omitempty"`
+}
+
+// receivedReport is a signed report along with the unix time at which the
+// server received it, 0 if unknown.
+type receivedReport struct {
+	glow.EquipmentReport
+	ReceivedAt int64
+}
+
+// HistoricalReportsGap is a range of time, in unix seconds, for which the
+// server has no record of the reports. The start is inclusive and the end is
+// exclusive.
+type HistoricalReportsGap struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// historicalReportsHeader is the part of the response that comes before the
+// reports.
+type historicalReportsHeader struct {
+	PublicKey string `json:"pubkey"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+}
+
+// HistoricalReportsHandler streams the signed reports of the device with the
+// provided 'pubkey' for the unix time range selected by the 'start'
+// (inclusive) and 'end' (exclusive) query parameters. The response is a JSON
+// object with the fields pubkey, start, end, reports, and gaps, unless the
+// binary encoding of api_binary.go is requested. With 'late_only=true', only
+// the reports that were received more than the late report threshold after
+// the end of their timeslot are returned, see report_receipts.go.
+func (gcas *GCAServer) HistoricalReportsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for historical reports.")
+		return
+	}
+
+	// Parse the public key.
+	q := r.URL.Query()
+	publicKeyStr := q.Get("pubkey")
+	if publicKeyStr == "" {
+		gcas.writeError(w, ErrCodeMalformedRequest, "pubkey is a required query parameter")
+		return
+	}
+	publicKey, err := glow.ParsePublicKey(publicKeyStr)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid public key format")
+		return
+	}
+
+	// Parse the requested range.
+	start, err := strconv.ParseInt(q.Get("start"), 10, 64)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "start must be a unix timestamp")
+		return
+	}
+	end, err := strconv.ParseInt(q.Get("end"), 10, 64)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "end must be a unix timestamp")
+		return
+	}
+	if end <= start {
+		gcas.writeError(w, ErrCodeMalformedRequest, "end must be greater than start")
+		return
+	}
+	lateOnly := q.Get("late_only") == "true"
+	if lateOnly && !gcas.staticRecordReceipts {
+		gcas.writeError(w, ErrCodeNotFound, "this server does not record when reports are received")
+		return
+	}
+	startTimeslot, endTimeslot, ok := timeslotRange(start, end)
+
+	// There is nothing to return past the end of the reporting window.
+	gcas.mu.RLock()
+	windowEnd := gcas.equipmentReportsOffset + 4032
+	gcas.mu.RUnlock()
+	if endTimeslot > windowEnd {
+		endTimeslot = windowEnd
+	}
+	if !ok || endTimeslot < startTimeslot {
+		endTimeslot = startTimeslot
+	}
+
+	// Both encodings are streamed the same way: a header, a chunk of
+	// reports for every week, and a trailer with the gaps.
+	var header []byte
+	var encodeChunk func([]receivedReport) []byte
+	var encodeTrailer func([]HistoricalReportsGap) []byte
+	w.Header().Add("Vary", "Accept")
+	if wantsBinary(r) {
+		w.Header().Set("Content-Type", glow.BinaryContentType)
+		var e glow.BinaryEncoder
+		appendHistoricalHeader(&e, publicKey, start, end)
+		header = e.Bytes()
+		encodeChunk = func(reports []receivedReport) []byte {
+			var e glow.BinaryEncoder
+			appendHistoricalChunk(&e, reports)
+			return e.Bytes()
+		}
+		encodeTrailer = func(gaps []HistoricalReportsGap) []byte {
+			var e glow.BinaryEncoder
+			appendHistoricalTrailer(&e, gaps)
+			return e.Bytes()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		header, _ = json.Marshal(historicalReportsHeader{
+			PublicKey: hex.EncodeToString(publicKey[:]),
+			Start:     start,
+			End:       end,
+		})
+		header = append(header[:len(header)-1], `,"reports":[`...)
+		first := true
+		encodeChunk = func(reports []receivedReport) []byte {
+			var buf []byte
+			for _, report := range reports {
+				if !first {
+					buf = append(buf, ',')
+				}
+				first = false
+				b, _ := json.Marshal(HistoricalReport{
+					ShortID:     report.ShortID,
+					Timeslot:    report.Timeslot,
+					Timestamp:   glow.TimeslotToUnix(report.Timeslot),
+					PowerOutput: report.PowerOutput,
+					Signature:   hex.EncodeToString(report.Signature[:]),
+					ReceivedAt:  report.ReceivedAt,
+				})
+				buf = append(buf, b...)
+			}
+			return buf
+		}
+		encodeTrailer = func(gaps []HistoricalReportsGap) []byte {
+			trailer, _ := json.Marshal(gaps)
+			return append(append([]byte(`],"gaps":`), trailer...), "}\n"...)
+		}
+	}
+	if _, err := w.Write(header); err != nil {
+		gcas.requestLogger(r).Warn("Unable to write historical reports:", err)
+		return
+	}
+
+	// Stream the reports out one week at a time.
+	flusher, _ := w.(http.Flusher)
+	gaps := []HistoricalReportsGap{}
+	for chunkStart := startTimeslot; chunkStart < endTimeslot; {
+		weekStart := chunkStart - chunkStart%2016
+		chunkEnd := weekStart + 2016
+		if chunkEnd > endTimeslot {
+			chunkEnd = endTimeslot
+		}
+		reports, available := gcas.managedHistoricalChunk(r, publicKey, weekStart, chunkStart, chunkEnd)
+		if lateOnly {
+			late := reports[:0]
+			for _, report := range reports {
+				if gcas.reportLate(report.Timeslot, report.ReceivedAt) {
+					late = append(late, report)
+				}
+			}
+			reports = late
+		}
+		if !available {
+			gapStart, gapEnd := glow.TimeslotToUnix(chunkStart), glow.TimeslotToUnix(chunkEnd)
+			if n := len(gaps); n > 0 && gaps[n-1].End == gapStart {
+				gaps[n-1].End = gapEnd
+			} else {
+				gaps = append(gaps, HistoricalReportsGap{Start: gapStart, End: gapEnd})
+			}
+		}
+		if _, err := w.Write(encodeChunk(reports)); err != nil {
+			gcas.requestLogger(r).Warn("Unable to write historical reports:", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		chunkStart = chunkEnd
+	}
+
+	if _, err := w.Write(encodeTrailer(gaps)); err != nil {
+		gcas.requestLogger(r).Warn("Unable to write historical reports:", err)
+	}
+}
+
+// timeslotRange converts a range of unix time into the range of timeslots
+// that overlap with it. The returned bool is false if the range ends before
+// genesis.
+func timeslotRange(start, end int64) (uint32, uint32, bool) {
+	if end <= glow.GenesisTime {
+		return 0, 0, false
+	}
+	startTimeslot := uint32(0)
+	if start > glow.GenesisTime {
+		startTimeslot, _ = glow.UnixToTimeslot(start)
+	}
+	endTimeslot, _ := glow.UnixToTimeslot(end)
+	if glow.TimeslotToUnix(endTimeslot) < end {
+		endTimeslot++
+	}
+	return startTimeslot, endTimeslot, true
+}
+
+// managedHistoricalChunk returns the signed reports of a device for the
+// timeslots [start, end), which all fall in the week that starts at
+// weekStart, along with their receipts. The bool is false if the server has
+// no record of the week.
+func (gcas *GCAServer) managedHistoricalChunk(r *http.Request, publicKey glow.PublicKey, weekStart, start, end uint32) ([]receivedReport, bool) {
+	// Pull from the live window if the week is still inside of it. The
+	// offset is checked under the lock, so a migration that happens in the
+	// meantime sends the week to the archive instead.
+	gcas.mu.RLock()
+	if weekStart >= gcas.equipmentReportsOffset {
+		var reports []receivedReport
+		shortID, exists := gcas.equipmentShortID[publicKey]
+		if _, ok := gcas.equipmentReports[shortID]; exists && ok {
+			ero := gcas.equipmentReportsOffset
+			signed, err := gcas.signedReports(shortID, int(start-ero), int(end-ero))
+			if err != nil {
+				gcas.requestLogger(r).Errorf("unable to load the reports for period %v: %v", weekStart, err)
+				gcas.mu.RUnlock()
+				return nil, false
+			}
+			for _, report := range signed {
+				reports = append(reports, receivedReport{EquipmentReport: report, ReceivedAt: gcas.receivedAt(shortID, report.Timeslot)})
+			}
+		}
+		gcas.mu.RUnlock()
+		return reports, true
+	}
+	gcas.mu.RUnlock()
+
+	// Otherwise the week comes from its archive.
+	device, found, err := gcas.loadArchivedDevice(weekStart, publicKey)
+	if os.IsNotExist(err) {
+		return nil, false
+	}
+	if err != nil {
+		gcas.requestLogger(r).Errorf("unable to read the archive for period %v: %v", weekStart, err)
+		return nil, false
+	}
+	if !found {
+		return nil, true
+	}
+	// The reports are served without their receipts if the receipts of
+	// the week can't be read.
+	receipts, err := gcas.loadArchivedReceipts(weekStart, device.ShortID)
+	if err != nil {
+		gcas.requestLogger(r).Error(err)
+	}
+	var reports []receivedReport
+	for _, report := range device.Reports {
+		if report.Timeslot >= start && report.Timeslot < end {
+			reports = append(reports, receivedReport{EquipmentReport: report, ReceivedAt: receipts[report.Timeslot]})
+		}
+	}
+	return reports, true
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestHistoricalReports archives two weeks of reports and checks that the
+// endpoint merges the archives with the live reports, that the signatures
+// still verify, and that a missing archive shows up as a gap.
+func TestHistoricalReports(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := hex.EncodeToString(ea.PublicKey[:])
+
+	// Report into a timeslot, then migrate the reports until the offset
+	// reaches the provided value.
+	report := func(ts uint32) {
+		t.Helper()
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, ts, ePriv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+	migrate := func(now, offset uint32) {
+		t.Helper()
+		glow.SetCurrentTimeslot(now)
+		for i := 0; i < 100; i++ {
+			server.mu.RLock()
+			ero := server.equipmentReportsOffset
+			server.mu.RUnlock()
+			if ero == offset {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("the reports were not migrated")
+	}
+	for ts := uint32(0); ts < 10; ts += 2 {
+		report(ts)
+	}
+	migrate(3300, 2016)
+	report(3300)
+	report(3302)
+	migrate(5316, 4032)
+	report(5316)
+
+	query := func(params string) (int, HistoricalReportsResponse) {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/historical-reports?%v", server.httpPort, params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var hr HistoricalReportsResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&hr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, hr
+	}
+	timeslots := func(hr HistoricalReportsResponse) []uint32 {
+		var ts []uint32
+		for _, report := range hr.Reports {
+			ts = append(ts, report.Timeslot)
+		}
+		return ts
+	}
+
+	// The full range spans two archives and the live window.
+	start, end := glow.TimeslotToUnix(0), glow.TimeslotToUnix(6000)
+	status, hr := query(fmt.Sprintf("pubkey=%v&start=%v&end=%v", pubkey, start, end))
+	if status != http.StatusOK {
+		t.Fatal("unexpected status:", status)
+	}
+	if fmt.Sprint(timeslots(hr)) != "[0 2 4 6 8 3300 3302 5316]" || len(hr.Gaps) != 0 {
+		t.Fatalf("unexpected reports %v and gaps %v", timeslots(hr), hr.Gaps)
+	}
+	for _, r := range hr.Reports {
+		var sig glow.Signature
+		b, err := hex.DecodeString(r.Signature)
+		if err != nil || len(b) != len(sig) {
+			t.Fatal("bad signature encoding:", r.Signature)
+		}
+		copy(sig[:], b)
+		er := glow.EquipmentReport{ShortID: r.ShortID, Timeslot: r.Timeslot, PowerOutput: r.PowerOutput}
+		if !glow.Verify(ea.PublicKey, er.SigningBytes(), sig) || r.Timestamp != glow.TimeslotToUnix(r.Timeslot) {
+			t.Fatalf("report for timeslot %v does not verify", r.Timeslot)
+		}
+	}
+
+	// A partial range only returns the reports inside of it. The end is
+	// exclusive, and a timestamp inside of a timeslot includes the timeslot.
+	status, hr = query(fmt.Sprintf("pubkey=%v&start=%v&end=%v", pubkey, glow.TimeslotToUnix(4)+10, glow.TimeslotToUnix(3302)))
+	if status != http.StatusOK || fmt.Sprint(timeslots(hr)) != "[4 6 8 3300]" {
+		t.Fatalf("unexpected partial range: %v %v", status, timeslots(hr))
+	}
+
+	// A missing archive becomes a gap, and the rest is still returned.
+	if err := server.staticStorage.Remove(reportArchiveFile(0)); err != nil {
+		t.Fatal(err)
+	}
+	status, hr = query(fmt.Sprintf("pubkey=%v&start=%v&end=%v", pubkey, start, end))
+	if status != http.StatusOK || fmt.Sprint(timeslots(hr)) != "[3300 3302 5316]" {
+		t.Fatalf("unexpected reports with a missing archive: %v %v", status, timeslots(hr))
+	}
+	if len(hr.Gaps) != 1 || hr.Gaps[0].Start != start || hr.Gaps[0].End != glow.TimeslotToUnix(2016) {
+		t.Fatalf("unexpected gaps: %+v", hr.Gaps)
+	}
+
+	// An unknown device has no reports, and bad requests are refused.
+	otherKey, _ := glow.GenerateKeyPair()
+	status, hr = query(fmt.Sprintf("pubkey=%x&start=%v&end=%v", otherKey, start, end))
+	if status != http.StatusOK || len(hr.Reports) != 0 {
+		t.Fatalf("unexpected response for an unknown device: %v %v", status, hr.Reports)
+	}
+	for _, params := range []string{
+		fmt.Sprintf("start=%v&end=%v", start, end),
+		fmt.Sprintf("pubkey=%v&start=abc&end=%v", pubkey, end),
+		fmt.Sprintf("pubkey=%v&start=%v", pubkey, start),
+		fmt.Sprintf("pubkey=%v&start=%v&end=%v", pubkey, end, start),
+	} {
+		if status, _ := query(params); status != http.StatusBadRequest {
+			t.Errorf("%v: expected a bad request, got %v", params, status)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+// api_impact_rates.go provides the impact rates of a single device over a
+// range of timeslots, along with the flags that say whether each impact rate
+// was fetched in time or filled from stale data. Auditors use it to recompute
+// the carbon impact of a device independently of the server.
+//
+// Devices that share a region share their impact rates, so the impact rates
+// of a region can be read from any of its devices.
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+)
+
+// ImpactRate is the impact rate of a device at a single timeslot.
+type ImpactRate struct {
+	Timeslot   uint32   `json:"timeslot"`
+	Rate       *float64 `json:"rate"`       // null if no impact rate was obtained
+	Stale      bool     `json:"stale"`      // Filled with the last known value while WattTime was down
+	Backfilled bool     `json:"backfilled"` // Filled with stale data and later replaced with the real value
+}
+
+// ImpactRatesResponse contains the impact rates of a device for the timeslots
+// [Start, End).
+type ImpactRatesResponse struct {
+	ShortID   uint32       `json:"short_id"`
+	PublicKey string       `json:"pubkey"` // hex encoded
+	Region    string       `json:"region,omitempty"`
+	Start     uint32       `json:"start"`
+	End       uint32       `json:"end"`
+	Rates     []ImpactRate `json:"rates"`
+}
+
+// ImpactRatesHandler returns the impact rates for the device with the
+// 'short_id' query parameter, for the timeslots from 'start' (inclusive) to
+// 'end' (exclusive). The range can cover at most maxImpactRatesTimeslots
+// timeslots.
+func (gcas *GCAServer) ImpactRatesHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for impact rates.")
+		return
+	}
+
+	// Parse the query parameters.
+	query := r.URL.Query()
+	sid, err := strconv.ParseUint(query.Get("short_id"), 10, 32)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "invalid short_id format")
+		return
+	}
+	start, err := strconv.ParseUint(query.Get("start"), 10, 32)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "invalid start format")
+		return
+	}
+	end, err := strconv.ParseUint(query.Get("end"), 10, 32)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "invalid end format")
+		return
+	}
+	if end <= start {
+		gcas.writeError(w, ErrCodeMalformedRequest, "end must be greater than start")
+		return
+	}
+	if end-start > maxImpactRatesTimeslots {
+		gcas.writeError(w, ErrCodeMalformedRequest, "range covers too many timeslots")
+		return
+	}
+	shortID := uint32(sid)
+
+	gcas.mu.RLock()
+	publicKey, exists := gcas.shortIDOwners[shortID]
+	var region string
+	if exists {
+		region = gcas.equipmentRegion(publicKey)
+	}
+	gcas.mu.RUnlock()
+	if !exists {
+		gcas.writeError(w, ErrCodeUnknownDevice, "equipment not found")
+		return
+	}
+
+	if gcas.managedNeedsStatsHistory(uint32(start)) {
+		writeLoadingError(w, gcas.writeError)
+		return
+	}
+
+	resp := ImpactRatesResponse{
+		ShortID:   shortID,
+		PublicKey: hex.EncodeToString(publicKey[:]),
+		Region:    region,
+		Start:     uint32(start),
+		End:       uint32(end),
+		Rates:     make([]ImpactRate, 0, end-start),
+	}
+	for chunkStart := uint32(start); chunkStart < uint32(end); {
+		chunkEnd := chunkStart - chunkStart%2016 + 2016
+		if chunkEnd > uint32(end) {
+			chunkEnd = uint32(end)
+		}
+		_, rates := gcas.managedReportsChunk(shortID, publicKey, chunkStart, chunkEnd)
+		gcas.mu.RLock()
+		for i, rate := range rates {
+			ts := chunkStart + uint32(i)
+			ir := ImpactRate{Timeslot: ts}
+			if rate != 0 {
+				rate := rate
+				ir.Rate = &rate
+			}
+			flags := gcas.impactFlags[shortID][ts]
+			ir.Stale = flags == impactRateStale
+			ir.Backfilled = flags == impactRateBackfilled
+			resp.Rates = append(resp.Rates, ir)
+		}
+		gcas.mu.RUnlock()
+		chunkStart = chunkEnd
+	}
+	gcas.writeJSONResponse(w, r, resp)
+}
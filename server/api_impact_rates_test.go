@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/watttime/mock"
+)
+
+// getImpactRates fetches the impact rates of a device, returning the status
+// code and the decoded response.
+func (gcas *GCAServer) getImpactRates(shortID string, start, end uint32) (int, ImpactRatesResponse, error) {
+	var irr ImpactRatesResponse
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/impact-rates?short_id=%v&start=%v&end=%v", gcas.httpPort, shortID, start, end))
+	if err != nil {
+		return 0, irr, fmt.Errorf("unable to get impact rates: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&irr); err != nil {
+			return 0, irr, fmt.Errorf("unable to decode impact rates: %v", err)
+		}
+	}
+	return resp.StatusCode, irr, nil
+}
+
+// TestImpactRates checks that the impact rates endpoint returns nulls for
+// missing impact rates and flags the stale and backfilled ones, and that the
+// impact rates and the flags survive a restart.
+func TestImpactRates(t *testing.T) {
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+	wattTime := mock.NewServer()
+	defer wattTime.Close()
+
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{WattTimeURL: wattTime.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.AuthorizeTestDevice(1, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	grams := func(timeslot uint32) float64 { return mock.DefaultMOER(mock.DefaultRegion, timeslot) * 453.59237 }
+	if !server.waitForImpactRate(1, 10, grams(10)) {
+		t.Fatal("impact rate was not fetched")
+	}
+
+	// Fill timeslot 11 with stale data, then let it get backfilled, and
+	// fill timeslot 12 with stale data that doesn't get backfilled.
+	wattTime.SetDown(true)
+	glow.SetCurrentTimeslot(11)
+	if !server.waitForImpactRate(1, 11, grams(10)) {
+		t.Fatal("the stale impact rate was not filled in")
+	}
+	wattTime.SetDown(false)
+	if !server.waitForImpactRate(1, 11, grams(11)) {
+		t.Fatal("the stale impact rate was not backfilled")
+	}
+	wattTime.SetDown(true)
+	glow.SetCurrentTimeslot(12)
+	if !server.waitForImpactRate(1, 12, grams(11)) {
+		t.Fatal("the stale impact rate was not filled in")
+	}
+
+	// checkRates checks the impact rates of timeslots 8 through 12.
+	checkRates := func(server *GCAServer) {
+		t.Helper()
+		status, irr, err := server.getImpactRates("1", 8, 13)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK || irr.ShortID != 1 || irr.Start != 8 || irr.End != 13 || len(irr.Rates) != 5 {
+			t.Fatalf("unexpected response: %v %+v", status, irr)
+		}
+		for i, want := range []struct {
+			rate       float64
+			stale      bool
+			backfilled bool
+		}{{0, false, false}, {0, false, false}, {grams(10), false, false}, {grams(11), false, true}, {grams(11), true, false}} {
+			ir := irr.Rates[i]
+			if ir.Timeslot != uint32(8+i) || ir.Stale != want.stale || ir.Backfilled != want.backfilled {
+				t.Fatalf("unexpected impact rate at %v: %+v", i, ir)
+			}
+			if (ir.Rate == nil) != (want.rate == 0) || (ir.Rate != nil && *ir.Rate != want.rate) {
+				t.Fatalf("unexpected impact rate at %v: %v", i, ir.Rate)
+			}
+		}
+	}
+	checkRates(server)
+
+	// Invalid requests.
+	for _, req := range []struct {
+		shortID    string
+		start, end uint32
+		status     int
+	}{
+		{"x", 8, 13, http.StatusBadRequest},
+		{"1", 13, 8, http.StatusBadRequest},
+		{"1", 0, maxImpactRatesTimeslots + 1, http.StatusBadRequest},
+		{"5", 8, 13, http.StatusNotFound},
+	} {
+		status, _, err := server.getImpactRates(req.shortID, req.start, req.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != req.status {
+			t.Fatal("unexpected status:", req, status)
+		}
+	}
+	server.Close()
+
+	// A torn record at the end of the log is dropped at startup.
+	if err := serverStorage(dir).AppendFile(ImpactRatesFile, make([]byte, impactRateRecordSize-3), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServerWithOptions(dir, false, ServerOptions{WattTimeURL: wattTime.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRates(server)
+
+	// The impact rates are the same after the log gets compacted.
+	server.mu.Lock()
+	err = server.compactImpactRates()
+	server.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	server, err = NewGCAServerWithOptions(dir, false, ServerOptions{WattTimeURL: wattTime.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	checkRates(server)
+}
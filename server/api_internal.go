@@ -4,12 +4,39 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strconv"
 	"time"
 )
 
+// loopbackOnly wraps an internal API so that it refuses callers which aren't
+// connecting from a loopback address, if the server was launched with
+// LoopbackInternalAPIs. The check looks at the caller rather than at the
+// address that the listener is bound to, so it also holds when the HTTP API
+// is reachable on every interface.
+func (gcas *GCAServer) loopbackOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if gcas.staticLoopbackIntApis && !isLoopbackAddr(r.RemoteAddr) {
+			http.Error(w, "Internal APIs are only available from loopback addresses", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isLoopbackAddr returns whether the host of the provided "host:port" address
+// is a loopback IP.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // InternalWattTimeHistoricalHandler is an Internal API to test the WattTime historical query.
 // For a latitude and longitude, a start time, and a duration, returns historical energy data
 // for this range. Time format is yyyy-mm-ddThh:mm:ssZ.
@@ -52,20 +79,20 @@ func (gcas *GCAServer) InternalWattTimeHistoricalHandler(w http.ResponseWriter,
 		http.Error(w, "Error in loading watttime password", http.StatusInternalServerError)
 		return
 	}
-	token, err := staticGetWattTimeToken(username, password)
+	token, err := staticGetWattTimeToken(r.Context(), gcas.staticWattTimeURL, username, password)
 	if err != nil {
 		http.Error(w, "Error in fetching watttime token", http.StatusInternalServerError)
-		gcas.logger.Error("watttime fetch token error:", err)
+		gcas.requestLogger(r).Error("watttime fetch token error:", err)
 		return
 	}
 	// Get the region and historical data
-	region, err := getBalancingAuthority(token, latitude, longitude)
+	region, err := getBalancingAuthority(r.Context(), gcas.staticWattTimeURL, token, latitude, longitude)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("unable to get watttime region: %v", err), http.StatusInternalServerError)
 		return
 	}
 	endTime := start.Add(dur)
-	raw, err := getWattTimeHistoricalDataRaw(token, region, start.Unix(), endTime.Unix())
+	raw, err := getWattTimeHistoricalDataRaw(r.Context(), gcas.staticWattTimeURL, token, region, start.Unix(), endTime.Unix())
 	if err != nil {
 		http.Error(w, fmt.Sprintf("unable to get watttime historical data: %v", err), http.StatusInternalServerError)
 		return
@@ -120,16 +147,16 @@ func (gcas *GCAServer) InternalWattTimeSignalIndexHandler(w http.ResponseWriter,
 		http.Error(w, "Error in loading watttime password", http.StatusInternalServerError)
 		return
 	}
-	token, err := staticGetWattTimeToken(username, password)
+	token, err := staticGetWattTimeToken(r.Context(), gcas.staticWattTimeURL, username, password)
 	if err != nil {
 		http.Error(w, "Error in fetching watttime token", http.StatusInternalServerError)
-		gcas.logger.Error("watttime fetch token error:", err)
+		gcas.requestLogger(r).Error("watttime fetch token error:", err)
 		return
 	}
-	moer, epoch, region, err := getWattTimeIndex(token, latitude, longitude)
+	moer, epoch, region, err := getWattTimeIndex(r.Context(), gcas.staticWattTimeURL, token, latitude, longitude)
 	if err != nil {
 		http.Error(w, "Error in fetching watttime index", http.StatusInternalServerError)
-		gcas.logger.Error("watttime fetch watttime index error:", err)
+		gcas.requestLogger(r).Error("watttime fetch watttime index error:", err)
 		return
 	}
 	type jsonResponse struct {
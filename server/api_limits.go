@@ -0,0 +1,183 @@
+package server
+
+// api_limits.go protects the HTTP API from clients that send huge requests or
+// flood the server with them. Every request body is capped, with a larger
+// allowance for the batch endpoints. On top of that, every remote IP gets two
+// budgets: one for the query endpoints that have to walk a lot of data, like
+// the stats and the historical reports, and a stricter one for requests that
+// write, which is every request that isn't a GET or a HEAD. The report
+// validation gets a budget of its own, which is stricter still. Cheap reads
+// like /healthz are not limited at all.
+//
+// The budgets use the same lock-free token buckets as the UDP rate limiter,
+// see report_rate_limit.go. The limits live in server-config.json and can be
+// changed with a reload. Servers in internal test mode skip all of the limits.
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queryEndpoints are the read endpoints that count against the query budget.
+var queryEndpoints = map[string]struct{}{
+	"/api/v1/all-device-stats":      {},
+	"/api/v1/device-export":         {},
+	"/api/v1/device-impact":         {},
+	"/api/v1/device-summary":        {},
+	"/api/v1/equipment-reports.csv": {},
+	"/api/v1/geo-stats":             {},
+	"/api/v1/historical-reports":    {},
+	"/api/v1/impact-rates":          {},
+	"/api/v1/report-gaps":           {},
+	"/api/v1/report-proof":          {},
+	"/api/v2/all-device-stats":      {},
+	"/api/v2/device-summary":        {},
+	"/api/v2/report-gaps":           {},
+}
+
+// batchEndpoints are the endpoints that get the larger body allowance.
+var batchEndpoints = map[string]struct{}{
+	"/api/v1/authorize-equipment/batch": {},
+	"/api/v1/equipment-reports/batch":   {},
+	"/api/v1/import-equipment":          {},
+}
+
+// clientLimiter gives every remote IP its own budget.
+type clientLimiter struct {
+	clients sync.Map // string -> *rateBucket
+
+	interval atomic.Int64
+	burst    atomic.Int64
+}
+
+// setLimits changes the limits of the budgets. The budgets keep their current
+// state.
+func (cl *clientLimiter) setLimits(interval time.Duration, burst int64) {
+	cl.interval.Store(int64(interval))
+	cl.burst.Store(burst)
+}
+
+// limits returns the limits of the budgets.
+func (cl *clientLimiter) limits() (interval time.Duration, burst int64) {
+	return time.Duration(cl.interval.Load()), cl.burst.Load()
+}
+
+// allow returns whether a request from the provided IP fits in its budget. If
+// it doesn't, the second return value is how long the client has to wait
+// before the next request fits.
+func (cl *clientLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	b, _ := cl.clients.LoadOrStore(ip, new(rateBucket))
+	bucket := b.(*rateBucket)
+	interval, burst := cl.interval.Load(), cl.burst.Load()
+	if bucket.allow(now.UnixNano(), interval, burst) {
+		return true, 0
+	}
+	wait := bucket.tat.Load() - interval*(burst-1) - now.UnixNano()
+	return false, time.Duration(wait)
+}
+
+// prune forgets the budgets that are full again, which keeps the map from
+// growing with every IP that ever made a request.
+func (cl *clientLimiter) prune(now time.Time) {
+	cl.clients.Range(func(key, value any) bool {
+		if value.(*rateBucket).tat.Load() <= now.UnixNano() {
+			cl.clients.Delete(key)
+		}
+		return true
+	})
+}
+
+// apiLimits contains the limits of the HTTP API.
+type apiLimits struct {
+	query    clientLimiter
+	write    clientLimiter
+	validate clientLimiter // The report validations, see api_validate_report.go
+
+	maxBody      atomic.Int64
+	maxBatchBody atomic.Int64
+}
+
+// newAPILimits returns the default limits of the HTTP API.
+func newAPILimits() *apiLimits {
+	al := new(apiLimits)
+	al.query.setLimits(httpQueryInterval, httpQueryBurst)
+	al.write.setLimits(httpWriteInterval, httpWriteBurst)
+	al.validate.setLimits(validateReportInterval, validateReportBurst)
+	al.maxBody.Store(maxRequestBody)
+	al.maxBatchBody.Store(maxBatchRequestBody)
+	return al
+}
+
+// remoteIP returns the IP of the caller of a request, which is what the
+// budgets are keyed by.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitRequests wraps the API so that every request is held to the body size
+// caps and the budget of its caller.
+func (gcas *GCAServer) limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gcas.allowIntApis {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limits := gcas.staticAPILimits
+		_, batch := batchEndpoints[r.URL.Path]
+		maxBody := limits.maxBody.Load()
+		if batch {
+			maxBody = limits.maxBatchBody.Load()
+		}
+		if r.ContentLength > maxBody {
+			gcas.staticMetrics.RecordHTTPLimited(httpLimitedBodySize)
+			gcas.writeError(w, ErrCodeRequestTooLarge, fmt.Sprintf("Request body is %v bytes, the limit is %v", r.ContentLength, maxBody))
+			return
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		}
+
+		limiter, reason := (*clientLimiter)(nil), ""
+		if r.URL.Path == validateReportPath {
+			limiter, reason = &limits.validate, httpLimitedValidate
+		} else if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			limiter, reason = &limits.write, httpLimitedWrite
+		} else if _, query := queryEndpoints[r.URL.Path]; query {
+			limiter, reason = &limits.query, httpLimitedQuery
+		}
+		if limiter != nil {
+			if ok, wait := limiter.allow(remoteIP(r), gcas.now()); !ok {
+				gcas.staticMetrics.RecordHTTPLimited(reason)
+				retry := int64((wait + time.Second - 1) / time.Second)
+				if retry < 1 {
+					retry = 1
+				}
+				w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+				gcas.writeError(w, ErrCodeRateLimited, fmt.Sprintf("Too many requests, try again in %v seconds", retry))
+				gcas.requestLogger(r).WithFields("remote", r.RemoteAddr, "budget", reason).Debug("rate limited http request")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// threadedPruneAPILimits periodically forgets the budgets of the callers that
+// haven't made a request in a while.
+func (gcas *GCAServer) threadedPruneAPILimits() {
+	for gcas.sleep(httpLimiterPruneInterval) {
+		now := gcas.now()
+		gcas.staticAPILimits.query.prune(now)
+		gcas.staticAPILimits.write.prune(now)
+		gcas.staticAPILimits.validate.prune(now)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestClientLimiter checks that every IP gets its own budget, that a refused
+// request reports how long to wait, and that full budgets get pruned.
+func TestClientLimiter(t *testing.T) {
+	var cl clientLimiter
+	cl.setLimits(time.Minute, 2)
+	now := time.Now()
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "2001:db8::1", "2001:db8::1"} {
+		if ok, _ := cl.allow(ip, now); !ok {
+			t.Fatal("request was limited early:", ip)
+		}
+	}
+	ok, wait := cl.allow("192.0.2.1", now)
+	if ok {
+		t.Fatal("request beyond the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Fatal("unexpected wait:", wait)
+	}
+	if ok, _ := cl.allow("192.0.2.1", now.Add(wait)); !ok {
+		t.Fatal("request was refused after waiting")
+	}
+
+	// Nothing is full yet, so nothing gets pruned. Two minutes later
+	// every budget is full again.
+	cl.prune(now)
+	count := func() int {
+		n := 0
+		cl.clients.Range(func(key, value any) bool {
+			n++
+			return true
+		})
+		return n
+	}
+	if count() != 2 {
+		t.Fatal("budgets were pruned early:", count())
+	}
+	cl.prune(now.Add(3 * time.Minute))
+	if count() != 0 {
+		t.Fatal("full budgets were not pruned:", count())
+	}
+}
+
+// TestAPILimits checks the body size caps and the per IP budgets of a running
+// server.
+func TestAPILimits(t *testing.T) {
+	server, _, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	base := "http://" + server.httpDialAddr()
+
+	// A body over the cap is refused before it reaches the handler, while
+	// the batch endpoints accept a larger body.
+	big := bytes.Repeat([]byte("a"), maxRequestBody+1)
+	resp, err := http.Post(base+"/api/v1/authorize-equipment", "application/json", bytes.NewReader(big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatal("oversized body was not refused:", resp.StatusCode)
+	}
+	resp, err = http.Post(base+"/api/v1/authorize-equipment/batch", "application/json", bytes.NewReader(big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		t.Fatal("batch endpoint refused a body under its allowance")
+	}
+
+	// Tighten the budgets. The query budget only covers the expensive
+	// endpoints, so /healthz keeps working.
+	server.staticAPILimits.query.setLimits(time.Hour, 2)
+	server.staticAPILimits.write.setLimits(time.Hour, 1)
+	get := func(route string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(base + route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		if resp := get("/api/v1/all-device-stats?timeslot_offset=0"); resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatal("query was limited early:", i)
+		}
+	}
+	resp = get("/api/v1/historical-reports")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("query beyond the burst was not limited:", resp.StatusCode)
+	}
+	if retry, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retry < 1 {
+		t.Fatal("bad Retry-After header:", resp.Header.Get("Retry-After"))
+	}
+	for i := 0; i < 5; i++ {
+		if resp := get("/healthz"); resp.StatusCode != http.StatusOK {
+			t.Fatal("healthz was limited:", resp.StatusCode)
+		}
+	}
+
+	// Writes have their own budget.
+	post := func() int {
+		t.Helper()
+		resp, err := http.Post(base+"/api/v1/authorize-equipment", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(); code == http.StatusTooManyRequests {
+		t.Fatal("first write was limited")
+	}
+	if code := post(); code != http.StatusTooManyRequests {
+		t.Fatal("write beyond the burst was not limited:", code)
+	}
+
+	// The refusals show up in the metrics.
+	var buf bytes.Buffer
+	server.staticMetrics.WritePrometheus(&buf)
+	for _, e := range []string{
+		"http_requests_limited_total{reason=\"body_size\"} 1\n",
+		"http_requests_limited_total{reason=\"query\"} 1\n",
+		"http_requests_limited_total{reason=\"write\"} 1\n",
+	} {
+		if !strings.Contains(buf.String(), e) {
+			t.Errorf("metrics output is missing %q", e)
+		}
+	}
+}
+
+// TestAPILimitsInternalTestMode checks that servers in internal test mode skip
+// the limits.
+func TestAPILimitsInternalTestMode(t *testing.T) {
+	limits := newAPILimits()
+	limits.write.setLimits(time.Hour, 1)
+	gcas := &GCAServer{allowIntApis: true, staticAPILimits: limits, staticMetrics: newMetrics()}
+	handler := gcas.limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 3; i++ {
+		body := bytes.Repeat([]byte("a"), maxRequestBody+1)
+		req := httptest.NewRequest("POST", "/api/v1/authorize-equipment", bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatal("request was limited in internal test mode:", rec.Code)
+		}
+	}
+}
+
+// TestAPILimitsReload checks that the limits can be changed in the server
+// config.
+func TestAPILimitsReload(t *testing.T) {
+	server, dir, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	config, err := json.Marshal(map[string]interface{}{
+		"http_query_interval":    "2s",
+		"http_query_burst":       5,
+		"http_write_interval":    "1m",
+		"http_write_burst":       3,
+		"max_request_body":       1000,
+		"max_batch_request_body": 2000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ServerConfigFile), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := server.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Changed) != 6 {
+		t.Fatalf("expected 6 changes: %+v", res.Changed)
+	}
+	limits := server.staticAPILimits
+	qi, qb := limits.query.limits()
+	wi, wb := limits.write.limits()
+	if qi != 2*time.Second || qb != 5 || wi != time.Minute || wb != 3 || limits.maxBody.Load() != 1000 || limits.maxBatchBody.Load() != 2000 {
+		t.Fatal("unexpected limits:", qi, qb, wi, wb, limits.maxBody.Load(), limits.maxBatchBody.Load())
+	}
+
+	// Negative limits are refused.
+	if err := os.WriteFile(filepath.Join(dir, ServerConfigFile), []byte(`{"max_request_body": -1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Reload(); err == nil {
+		t.Fatal("negative body limit was accepted")
+	}
+}
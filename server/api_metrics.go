@@ -0,0 +1,21 @@
+package server
+
+// api_metrics.go exposes the operational counters of the server in the
+// Prometheus text exposition format. Like the healthz endpoint, the response
+// is meant for monitoring infrastructure and is therefore not signed.
+
+import (
+	"net/http"
+)
+
+// MetricsHandler writes all of the server metrics.
+func (gcas *GCAServer) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	gcas.staticMetrics.WritePrometheus(w)
+	gcas.writeRetryQueueMetrics(w)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getMetrics fetches the metrics endpoint and returns the body.
+func (gcas *GCAServer) getMetrics() (string, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/metrics", gcas.httpPort))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// TestMetricsRejectedReports submits a mix of good and bad reports and checks
+// that the counters move.
+func TestMetricsRejectedReports(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(3, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Submit a good report, a duplicate of it, a report with a bad
+	// signature, and a report from an unknown device.
+	good := generateTestReport(ea.ShortID, 1, ePriv)
+	server.managedHandleEquipmentReport(good)
+	server.managedHandleEquipmentReport(good)
+	_, wrongKey := glow.GenerateKeyPair()
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 2, wrongKey))
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID+1, 2, ePriv))
+
+	m := server.staticMetrics
+	if m.reportsReceived.Load() != 4 {
+		t.Fatal("wrong received count:", m.reportsReceived.Load())
+	}
+	if m.ReportsDuplicate() != 1 || m.ReportsRejected(reportDuplicate) != 0 || m.ReportsRejected(reportBadSignature) != 1 || m.ReportsRejected(reportUnknownDevice) != 1 {
+		t.Fatal("wrong rejected counts")
+	}
+
+	// Send a malformed udp packet and wait for the listener to see it.
+	err = sendUDPReport([]byte("too short"), server.udpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && m.udpPacketsMalformed.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Check the exposition output.
+	body, err := server.getMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"reports_received_total 4\n",
+		"reports_rejected_total{reason=\"bad_signature\"} 1\n",
+		"reports_rejected_total{reason=\"unauthorized_device\"} 1\n",
+		"reports_duplicate_total 1\n",
+		"reports_rejected_total{reason=\"stale_timeslot\"} 0\n",
+		"udp_packets_malformed_total 1\n",
+		"udp_packets_panicked_total 0\n",
+		"udp_listener_restarts_total 0\n",
+		"persist_duration_seconds_count 1\n",
+		"sync_operations_total 0\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("metrics output is missing %q:\n%v", e, body)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+// api_period_totals.go contains an endpoint that returns the totals of every
+// device for the current week so far. Nearly every consumer of the server
+// only wants to know how much each device has produced this week, and they
+// would otherwise all download the power outputs of every device to add them
+// up.
+//
+// The totals are not computed per request. Every deviceReports keeps running
+// totals for both weeks of the reporting window, which get adjusted whenever
+// a timeslot changes what it counts for: a report gets accepted, a timeslot
+// gets banned, the GCA overrides a timeslot, or a report is flagged or
+// reviewed. The totals count the same way as the device summary, with the
+// overrides of the GCA applied and only the credited power outputs, see
+// glow.CreditedPowerOutput. A migration shifts the totals along with the
+// reports.
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// periodTotals are the running totals of a device over a week.
+type periodTotals struct {
+	Power   int64  // The credited power outputs, with the overrides applied
+	Reports uint32 // The timeslots with an unbanned report
+	Flagged uint32 // The reports waiting for review by the GCA
+}
+
+// PeriodTotal contains the totals of a device for the current week.
+type PeriodTotal struct {
+	ShortID      uint32 `json:"short_id"`
+	PublicKey    string `json:"pubkey_hex"`
+	TotalPower   int64  `json:"total_power"`            // Milliwatt hours, the same as the total energy of the device summary
+	ReportCount  uint32 `json:"report_count"`           // Timeslots with an unbanned report
+	FlaggedCount uint32 `json:"flagged_count"`          // Reports waiting for review by the GCA
+	Banned       bool   `json:"banned"`                 // Whether the device is banned, see ban_accounting.go
+	BanTimeslot  uint32 `json:"ban_timeslot,omitempty"` // The timeslot from which on the reports of a banned device don't count
+}
+
+// timeslotTotals returns what index i of the window of a device adds to the
+// totals of its week. The mutex must be held.
+func (gcas *GCAServer) timeslotTotals(shortID uint32, i int) periodTotals {
+	var pt periodTotals
+	dr, _ := gcas.windowReports(shortID)
+	if !gcas.reportCounts(shortID, gcas.equipmentReportsOffset+uint32(i)) {
+		return pt
+	}
+	output := dr.PowerOutputs[i]
+	if output > 1 {
+		pt.Reports = 1
+	}
+	if ro, exists := gcas.reportOverrides[shortID][gcas.equipmentReportsOffset+uint32(i)]; exists {
+		output = ro.PowerOutput
+	}
+	pt.Power = int64(glow.CreditedPowerOutput(output))
+	return pt
+}
+
+// adjustPeriodTotals updates the totals of the week that index i of the
+// window of a device falls in, after the index changed from adding the
+// provided totals. The mutex must be held.
+func (gcas *GCAServer) adjustPeriodTotals(shortID uint32, i int, before periodTotals) {
+	after := gcas.timeslotTotals(shortID, i)
+	dr, _ := gcas.windowReports(shortID)
+	pt := &dr.Totals[i/2016]
+	pt.Power += after.Power - before.Power
+	pt.Reports += after.Reports - before.Reports
+}
+
+// countFlaggedReport adds the provided number of flagged reports to the
+// totals of the week of a timeslot. The mutex must be held.
+func (gcas *GCAServer) countFlaggedReport(slot reportSlot, n int) {
+	dr, exists := gcas.equipmentReports[slot.ShortID]
+	ero := gcas.equipmentReportsOffset
+	if !exists || slot.Timeslot < ero || slot.Timeslot >= ero+4032 {
+		return
+	}
+	dr.Totals[(slot.Timeslot-ero)/2016].Flagged += uint32(n)
+}
+
+// recomputePeriodTotals adds up the totals of every device from the state in
+// memory, which is only needed once everything has been loaded. The mutex
+// must be held.
+func (gcas *GCAServer) recomputePeriodTotals() {
+	for shortID, dr := range gcas.equipmentReports {
+		gcas.recomputeDeviceTotals(shortID, dr)
+	}
+	for shortID, bd := range gcas.bannedDevices {
+		gcas.recomputeDeviceTotals(shortID, bd.Reports)
+	}
+	for slot := range gcas.flaggedReports {
+		gcas.countFlaggedReport(slot, 1)
+	}
+}
+
+// recomputeDeviceTotals adds up the totals of a single device, leaving out
+// the flagged reports. The mutex must be held.
+func (gcas *GCAServer) recomputeDeviceTotals(shortID uint32, dr *deviceReports) {
+	dr.Totals = [2]periodTotals{}
+	for i := 0; i < 4032; i++ {
+		gcas.adjustPeriodTotals(shortID, i, periodTotals{})
+	}
+}
+
+// PeriodTotalsHandler returns the PeriodTotal of every authorized device and
+// of every banned device whose ban is in the reporting window, in order of
+// ShortID.
+func (gcas *GCAServer) PeriodTotalsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for period totals.")
+		return
+	}
+
+	// The totals switch over to the next week before the migration does,
+	// so the ETag has to change with the week as well as with the state.
+	gcas.mu.RLock()
+	start := gcas.currentPeriodIndex()
+	etag := timeslotETag(gcas.stateETag(), gcas.equipmentReportsOffset+uint32(start))
+	if etagMatches(r, etag) {
+		gcas.mu.RUnlock()
+		writeNotModified(w, etag)
+		return
+	}
+	shortIDs := gcas.windowShortIDs()
+	totals := make([]PeriodTotal, 0, len(shortIDs))
+	for _, shortID := range shortIDs {
+		reports, _ := gcas.windowReports(shortID)
+		pk := gcas.devicePublicKey(shortID)
+		pt := reports.Totals[start/2016]
+		banTimeslot, banned := gcas.banTimeslot(shortID)
+		totals = append(totals, PeriodTotal{
+			ShortID:      shortID,
+			PublicKey:    hex.EncodeToString(pk[:]),
+			TotalPower:   pt.Power,
+			ReportCount:  pt.Reports,
+			FlaggedCount: pt.Flagged,
+			Banned:       banned,
+			BanTimeslot:  banTimeslot,
+		})
+	}
+	gcas.mu.RUnlock()
+
+	w.Header().Set("ETag", etag)
+	gcas.writeJSONResponse(w, r, totals)
+}
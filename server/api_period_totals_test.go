@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getPeriodTotals fetches the period totals, sending the provided ETag as
+// If-None-Match if it is set.
+func (gcas *GCAServer) getPeriodTotals(etag string) (int, []PeriodTotal, string, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%v/api/v1/period-totals", gcas.httpDialAddr()), nil)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	defer resp.Body.Close()
+	var totals []PeriodTotal
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(&totals)
+	}
+	return resp.StatusCode, totals, resp.Header.Get("ETag"), err
+}
+
+// TestPeriodTotals checks that the running totals of the current week follow
+// the reports, flags, reviews and overrides, that they match the device
+// summary, and that they survive a restart and a migration.
+func TestPeriodTotals(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { server.Close() }()
+	glow.SetCurrentTimeslot(20)
+	defer glow.SetCurrentTimeslot(0)
+	ea1, priv1, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea2, priv2, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := uint32(1); ts <= 5; ts++ {
+		server.managedHandleEquipmentReport(generateTestReport(1, ts, priv1))
+	}
+	oversized := func(ea glow.EquipmentAuthorization, timeslot uint32, priv glow.PrivateKey) glow.EquipmentReport {
+		er := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: timeslot, PowerOutput: 2 * ea.Capacity}
+		er.Signature = glow.Sign(er.SigningBytes(), priv)
+		if outcome, _ := server.managedHandleEquipmentReport(er.Serialize()); outcome != reportFlagged {
+			t.Fatal("the oversized report was not flagged:", outcome)
+		}
+		return er
+	}
+	flagged1 := oversized(ea1, 6, priv1)
+	flagged2 := oversized(ea2, 4, priv2)
+
+	check := func(server *GCAServer, etag string, want ...PeriodTotal) string {
+		t.Helper()
+		status, totals, newETag, err := server.getPeriodTotals(etag)
+		if err != nil || status != http.StatusOK || newETag == "" || newETag == etag {
+			t.Fatal("unexpected response:", status, newETag, err)
+		}
+		if fmt.Sprint(totals) != fmt.Sprint(want) {
+			t.Fatalf("unexpected totals:\n%+v\nwant\n%+v", totals, want)
+		}
+		for _, pt := range totals {
+			server.mu.RLock()
+			summary := server.buildDeviceSummary(pt.ShortID, server.currentTimeslot())
+			server.mu.RUnlock()
+			if pt.TotalPower != summary.TotalEnergy {
+				t.Fatalf("the totals of %v don't match the summary: %v != %v", pt.ShortID, pt.TotalPower, summary.TotalEnergy)
+			}
+		}
+		return newETag
+	}
+	hex1, hex2 := hex.EncodeToString(ea1.PublicKey[:]), hex.EncodeToString(ea2.PublicKey[:])
+	etag := check(server, "", PeriodTotal{1, hex1, 25, 5, 1, false, 0}, PeriodTotal{2, hex2, 0, 0, 1, false, 0})
+
+	// Nothing changed, so the poller gets a 304. The compression of the
+	// response makes the ETag weak.
+	if status, _, sameETag, err := server.getPeriodTotals(etag); err != nil || status != http.StatusNotModified || strings.TrimPrefix(sameETag, "W/") != strings.TrimPrefix(etag, "W/") {
+		t.Fatal("unchanged totals were sent again:", status, sameETag, err)
+	}
+
+	// Rejecting a flagged report bans the timeslot, accepting one counts
+	// the report.
+	for _, review := range []struct {
+		report glow.EquipmentReport
+		accept bool
+	}{{flagged1, false}, {flagged2, true}} {
+		frr := FlaggedReportReview{ShortID: review.report.ShortID, Timeslot: review.report.Timeslot, PowerOutput: review.report.PowerOutput, Accept: review.accept}
+		frr.Signature = glow.Sign(frr.SigningBytes(), gcaPrivKey)
+		if _, err := server.managedReviewFlaggedReport(frr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	capacity2 := int64(2 * ea2.Capacity)
+	etag = check(server, etag, PeriodTotal{1, hex1, 25, 5, 0, false, 0}, PeriodTotal{2, hex2, capacity2, 1, 0, false, 0})
+
+	// A correction replaces the power of a report, and an outage adds
+	// power without a report. A correction of the banned timeslot counts
+	// too, the same as in the summary.
+	now := time.Now().Unix()
+	for _, ro := range []ReportOverride{
+		{PublicKey: ea1.PublicKey, Timeslot: 2, PowerOutput: 60, Timestamp: now},
+		{PublicKey: ea1.PublicKey, Timeslot: 10, PowerOutput: 7, Outage: true, Timestamp: now},
+		{PublicKey: ea1.PublicKey, Timeslot: 2, PowerOutput: 50, Timestamp: now + 1},
+		{PublicKey: ea1.PublicKey, Timeslot: 6, PowerOutput: 9, Timestamp: now},
+	} {
+		if status, err := server.postReportOverride(ro, gcaPrivKey); err != nil || status != http.StatusOK {
+			t.Fatal("the override was refused:", status, err)
+		}
+	}
+	etag = check(server, etag, PeriodTotal{1, hex1, 4*5 + 50 + 7 + 9, 5, 0, false, 0}, PeriodTotal{2, hex2, capacity2, 1, 0, false, 0})
+
+	// A report of the next week doesn't count yet.
+	glow.SetCurrentTimeslot(2015)
+	server.managedHandleEquipmentReport(generateTestReport(2, 2016, priv2))
+	etag = check(server, etag, PeriodTotal{1, hex1, 86, 5, 0, false, 0}, PeriodTotal{2, hex2, capacity2, 1, 0, false, 0})
+
+	// The totals are added up again after a restart.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(server, "", PeriodTotal{1, hex1, 86, 5, 0, false, 0}, PeriodTotal{2, hex2, capacity2, 1, 0, false, 0})
+
+	// The next week gets served once it starts, and survives the
+	// migration.
+	glow.SetCurrentTimeslot(2030)
+	etag = check(server, etag, PeriodTotal{1, hex1, 0, 0, 0, false, 0}, PeriodTotal{2, hex2, 5, 1, 0, false, 0})
+	glow.SetCurrentTimeslot(reportMigrationThreshold + 1)
+	for i := 0; i < 200; i++ {
+		server.mu.RLock()
+		offset := server.equipmentReportsOffset
+		server.mu.RUnlock()
+		if offset == 2016 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.managedHandleEquipmentReport(generateTestReport(1, reportMigrationThreshold, priv1))
+	check(server, etag, PeriodTotal{1, hex1, 5, 1, 0, false, 0}, PeriodTotal{2, hex2, 5, 1, 0, false, 0})
+}
@@ -3,7 +3,6 @@ package server
 // TODO: The code here does not align with standards.
 
 import (
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -16,68 +15,85 @@ type RecentReportsResponse struct {
 	Reports        [4032]glow.EquipmentReport `json:"Reports"`        // Array of equipment reports
 	TimeslotOffset uint32                     `json:"TimeslotOffset"` // The timeslot offset of the first report
 	Signature      glow.Signature             `json:"Signature"`      // Signature of the GCA server
+
+	// TimeslotOffsetUnix is the unix time at which the first timeslot
+	// begins, and ReportTimes holds the absolute timeslot and the unix time
+	// of every element of Reports, including the ones without a report,
+	// along with the time at which the report was received. Neither is
+	// covered by the signature.
+	TimeslotOffsetUnix int64            `json:"TimeslotOffsetUnix"`
+	ReportTimes        [4032]ReportTime `json:"ReportTimes"`
+}
+
+// ReportTime is the absolute timeslot of a report, and the unix time at which
+// the timeslot begins. ReceivedAt is the unix time at which the server
+// received the report, left out for the timeslots without a report and for
+// the reports without a receipt, see report_receipts.go.
+type ReportTime struct {
+	Timeslot   uint32 `json:"Timeslot"`
+	Unix       int64  `json:"Unix"`
+	ReceivedAt int64  `json:"ReceivedAt,omitempty"`
 }
 
-// RecentReportsHandler handles requests for fetching the most recent equipment reports.
+// RecentReportsHandler handles requests for fetching the most recent equipment
+// reports, or the reports of the retained period given by the 'period' query
+// parameter, see retained_periods.go.
 func (s *GCAServer) RecentReportsHandler(w http.ResponseWriter, r *http.Request) {
 	// Only accept GET requests
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is supported.", http.StatusMethodNotAllowed)
-		s.logger.Warn("Received non-GET request for recent reports.")
+		s.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		s.requestLogger(r).Warn("Received non-GET request for recent reports.")
 		return
 	}
 
 	// Retrieve the public key from query parameters
-	publicKeyHex := r.URL.Query().Get("publicKey")
-	if publicKeyHex == "" {
-		http.Error(w, "Public key is required as a query parameter", http.StatusBadRequest)
-		s.logger.Warn("Public key not provided in query parameters")
+	publicKeyStr := r.URL.Query().Get("publicKey")
+	if publicKeyStr == "" {
+		s.writeError(w, ErrCodeMalformedRequest, "Public key is required as a query parameter")
+		s.requestLogger(r).Warn("Public key not provided in query parameters")
 		return
 	}
-	publicKeyBytes, err := hex.DecodeString(publicKeyHex)
+	publicKey, err := glow.ParsePublicKey(publicKeyStr)
 	if err != nil {
-		http.Error(w, "Invalid public key format", http.StatusBadRequest)
-		s.logger.Error("Failed to decode public key:", err)
+		s.writeError(w, ErrCodeMalformedRequest, "Invalid public key format")
+		s.requestLogger(r).Error("Failed to decode public key:", err)
 		return
 	}
-	var publicKey glow.PublicKey
-	if len(publicKeyBytes) != len(publicKey) {
-		http.Error(w, "Invalid public key length", http.StatusBadRequest)
-		s.logger.Warn("Invalid public key length")
+
+	period, hasPeriod, err := s.parsePeriod(r.URL.Query())
+	if err != nil {
+		s.writeError(w, ErrCodeMalformedRequest, err.Error())
 		return
 	}
-	copy(publicKey[:], publicKeyBytes)
+	var periodp *uint32
+	if hasPeriod {
+		periodp = &period
+	}
 
 	// Fetch the equipment reports and generate a signature
-	response, err := s.getRecentReportsWithSignature(publicKey)
+	response, err := s.getRecentReportsWithSignature(publicKey, periodp)
 	if err != nil {
-		http.Error(w, fmt.Sprint("Failed to fetch equipment reports:", err), http.StatusInternalServerError)
-		s.logger.Error("Failed to fetch equipment reports:", err)
+		s.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to fetch equipment reports:", err))
+		s.requestLogger(r).Error("Failed to fetch equipment reports:", err)
 		return
 	}
 
 	// Send the response as JSON with a status code of OK
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode JSON response", http.StatusInternalServerError)
-		s.logger.Error("Failed to encode JSON response:", err)
-		return
-	}
+	s.writeJSONResponse(w, r, response)
 }
 
-// getRecentReportsWithSignature fetches the 4032 most recent equipment reports and signs the response.
-func (s *GCAServer) getRecentReportsWithSignature(publicKey glow.PublicKey) (RecentReportsResponse, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	// Convert the public key to a ShortID for lookup
-	shortID, exists := s.equipmentShortID[publicKey]
-	if !exists {
-		return RecentReportsResponse{}, fmt.Errorf("equipment not found")
-	}
-	reports, exists := s.equipmentReports[shortID]
-	if !exists {
-		return RecentReportsResponse{}, fmt.Errorf("no reports found for the provided public key")
+// getRecentReportsWithSignature fetches the 4032 most recent equipment
+// reports, or the 4032 reports from the start of the provided period, and
+// signs the response.
+func (s *GCAServer) getRecentReportsWithSignature(publicKey glow.PublicKey, period *uint32) (RecentReportsResponse, error) {
+	// The reports are copied under the read lock, the serialization and
+	// the signature happen after the lock is released. The signatures are
+	// read off of disk, see report_store.go.
+	drw, err := s.managedDeviceReportWindow(publicKey, period)
+	if err != nil {
+		return RecentReportsResponse{}, err
 	}
+	reports, ero := drw.reports, drw.offset
 
 	// Serialize the reports for signing
 	reportsBytes, err := json.Marshal(reports)
@@ -87,8 +103,15 @@ func (s *GCAServer) getRecentReportsWithSignature(publicKey glow.PublicKey) (Rec
 
 	// Sign the serialized reports
 	sig := glow.Sign(reportsBytes, s.staticPrivateKey)
-	return RecentReportsResponse{
-		Reports:   *reports,
-		Signature: sig,
-	}, nil
+	response := RecentReportsResponse{
+		Reports:            reports,
+		TimeslotOffset:     ero,
+		Signature:          sig,
+		TimeslotOffsetUnix: glow.TimeslotToUnix(ero),
+	}
+	for i := range response.ReportTimes {
+		timeslot := ero + uint32(i)
+		response.ReportTimes[i] = ReportTime{Timeslot: timeslot, Unix: glow.TimeslotToUnix(timeslot), ReceivedAt: drw.receivedAt[i]}
+	}
+	return response, nil
 }
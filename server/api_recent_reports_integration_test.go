@@ -20,7 +20,7 @@ func TestRecentReportsIntegration(t *testing.T) {
 	defer server.Close()
 
 	// Set up a piece of equipment and generate some reports for testing
-	ea, equipmentKey, err := server.submitNewHardware(12345, gcaPrivKey)
+	ea, equipmentKey, err := server.AuthorizeTestDevice(12345, gcaPrivKey)
 	if err != nil {
 		t.Fatal("Failed to submit new hardware: ", err)
 	}
@@ -96,7 +96,7 @@ func TestRecentReportsIntegration(t *testing.T) {
 	}
 
 	// Set up a piece of equipment without generating reports
-	ea, _, err = server.submitNewHardware(12346, gcaPrivKey)
+	ea, _, err = server.AuthorizeTestDevice(12346, gcaPrivKey)
 	if err != nil {
 		t.Fatal("Failed to submit new hardware: ", err)
 	}
@@ -125,3 +125,45 @@ func TestRecentReportsIntegration(t *testing.T) {
 		}
 	}
 }
+
+// TestRecentReportsTimes checks that the recent reports carry the absolute
+// timeslot and the unix time of every report after the reports have rotated.
+func TestRecentReportsTimes(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	ero := server.equipmentReportsOffset
+	server.equipmentReportsOffset = ero + 4032
+	server.mu.Unlock()
+	defer func() {
+		server.mu.Lock()
+		server.equipmentReportsOffset = ero
+		server.mu.Unlock()
+	}()
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/recent-reports?publicKey=%x", server.httpPort, ea.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response RecentReportsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.TimeslotOffset != ero+4032 || response.TimeslotOffsetUnix != glow.TimeslotToUnix(ero+4032) {
+		t.Fatal("unexpected timeslot offset:", response.TimeslotOffset, response.TimeslotOffsetUnix)
+	}
+	for _, i := range []int{0, 1, 2015, 2016, 4031} {
+		want := ReportTime{Timeslot: ero + 4032 + uint32(i), Unix: glow.TimeslotToUnix(ero + 4032 + uint32(i))}
+		if response.ReportTimes[i] != want {
+			t.Fatalf("unexpected report time at %v: %+v", i, response.ReportTimes[i])
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+// api_report_bitfields.go contains an endpoint that returns which timeslots of
+// the current week every device has reported, without the power outputs.
+// Monitoring tools that only watch for gaps in the reports would otherwise
+// have to download the stats of every device, which are about 50 times
+// larger.
+//
+// The bits are not computed per request. Every deviceReports keeps a bit per
+// timeslot of the reporting window that gets set when a report is accepted,
+// cleared when the timeslot is banned, and shifted along with the reports in
+// a migration, so the endpoint only has to copy out the bits of the current
+// week.
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// ReportBitfield contains the timeslots of the current week that a device has
+// an accepted report for.
+type ReportBitfield struct {
+	ShortID   uint32 `json:"short_id"`
+	PublicKey string `json:"pubkey"`   // Hex encoded
+	Bitfield  string `json:"bitfield"` // Base64 of 252 bytes, bit i%8 of byte i/8 is set if PeriodStart+i has a report
+}
+
+// ReportBitfieldsResponse is the response of the report bitfields endpoint.
+type ReportBitfieldsResponse struct {
+	PeriodStart uint32           `json:"period_start"`
+	Devices     []ReportBitfield `json:"devices"` // In order of ShortID
+}
+
+// currentPeriodIndex returns the index in the reports in memory at which the
+// week of the current timeslot starts. The mutex must be held.
+func (gcas *GCAServer) currentPeriodIndex() int {
+	if gcas.currentTimeslot() >= gcas.equipmentReportsOffset+2016 {
+		return 2016
+	}
+	return 0
+}
+
+// ReportBitfieldsHandler returns the ReportBitfield of every authorized device,
+// or only of the device with the 'pubkey' query parameter.
+func (gcas *GCAServer) ReportBitfieldsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for report bitfields.")
+		return
+	}
+
+	var pk glow.PublicKey
+	pkStr := r.URL.Query().Get("pubkey")
+	if pkStr != "" {
+		var err error
+		pk, err = glow.ParsePublicKey(pkStr)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid pubkey")
+			return
+		}
+	}
+
+	gcas.mu.RLock()
+	start := gcas.currentPeriodIndex()
+	resp := ReportBitfieldsResponse{
+		PeriodStart: gcas.equipmentReportsOffset + uint32(start),
+		Devices:     make([]ReportBitfield, 0, len(gcas.equipment)),
+	}
+	for shortID, ea := range gcas.equipment {
+		if pkStr != "" && ea.PublicKey != pk {
+			continue
+		}
+		reports, exists := gcas.equipmentReports[shortID]
+		if !exists {
+			continue
+		}
+		resp.Devices = append(resp.Devices, ReportBitfield{
+			ShortID:   shortID,
+			PublicKey: hex.EncodeToString(ea.PublicKey[:]),
+			Bitfield:  base64.StdEncoding.EncodeToString(reports.Reported[start/8 : (start+2016)/8]),
+		})
+	}
+	gcas.mu.RUnlock()
+	if pkStr != "" && len(resp.Devices) == 0 {
+		gcas.writeError(w, ErrCodeUnknownDevice, "equipment not found")
+		return
+	}
+
+	sort.Slice(resp.Devices, func(i, j int) bool { return resp.Devices[i].ShortID < resp.Devices[j].ShortID })
+	gcas.writeJSONResponse(w, r, resp)
+}
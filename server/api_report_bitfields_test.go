@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getReportBitfields fetches the report bitfields with the provided query.
+func (gcas *GCAServer) getReportBitfields(query string) (int, ReportBitfieldsResponse, error) {
+	var rbr ReportBitfieldsResponse
+	resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/report-bitfields?%v", gcas.httpDialAddr(), query))
+	if err != nil {
+		return 0, rbr, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, rbr, nil
+	}
+	return resp.StatusCode, rbr, json.NewDecoder(resp.Body).Decode(&rbr)
+}
+
+// reportedTimeslots decodes a bitfield into the list of reported timeslots.
+func reportedTimeslots(t *testing.T, periodStart uint32, bitfield string) []uint32 {
+	t.Helper()
+	bits, err := base64.StdEncoding.DecodeString(bitfield)
+	if err != nil || len(bits) != 252 {
+		t.Fatal("bad bitfield:", len(bits), err)
+	}
+	var timeslots []uint32
+	for i := 0; i < 2016; i++ {
+		if bits[i/8]&(1<<(i%8)) != 0 {
+			timeslots = append(timeslots, periodStart+uint32(i))
+		}
+	}
+	return timeslots
+}
+
+// TestReportBitfields checks that the bitfields follow the accepted reports of
+// the current week, through bans and migrations.
+func TestReportBitfields(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer glow.SetCurrentTimeslot(0)
+	glow.SetCurrentTimeslot(20)
+
+	ea1, priv1, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea2, priv2, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []uint32{0, 9, 20} {
+		server.managedHandleEquipmentReport(generateTestReport(1, ts, priv1))
+	}
+	server.managedHandleEquipmentReport(generateTestReport(2, 3, priv2))
+	// A report of the next week is not part of the current week.
+	glow.SetCurrentTimeslot(2000)
+	server.managedHandleEquipmentReport(generateTestReport(2, 2016, priv2))
+
+	check := func(query string, want map[uint32][]uint32) ReportBitfieldsResponse {
+		t.Helper()
+		status, rbr, err := server.getReportBitfields(query)
+		if err != nil || status != http.StatusOK || len(rbr.Devices) != len(want) {
+			t.Fatal("unexpected response:", status, rbr, err)
+		}
+		for _, rb := range rbr.Devices {
+			got := reportedTimeslots(t, rbr.PeriodStart, rb.Bitfield)
+			if fmt.Sprint(got) != fmt.Sprint(want[rb.ShortID]) {
+				t.Fatalf("unexpected timeslots for %v: got %v, want %v", rb.ShortID, got, want[rb.ShortID])
+			}
+		}
+		return rbr
+	}
+	rbr := check("", map[uint32][]uint32{1: {0, 9, 20}, 2: {3}})
+	if rbr.PeriodStart != 0 || rbr.Devices[0].ShortID != 1 || rbr.Devices[1].PublicKey != hex.EncodeToString(ea2.PublicKey[:]) {
+		t.Fatal("unexpected response:", rbr)
+	}
+	check("pubkey="+hex.EncodeToString(ea1.PublicKey[:]), map[uint32][]uint32{1: {0, 9, 20}})
+	otherPub, _ := glow.GenerateKeyPair()
+	if status, _, err := server.getReportBitfields("pubkey=" + hex.EncodeToString(otherPub[:])); err != nil || status != http.StatusNotFound {
+		t.Fatal("unexpected status for an unknown device:", status, err)
+	}
+	if status, _, err := server.getReportBitfields("pubkey=nope"); err != nil || status != http.StatusBadRequest {
+		t.Fatal("unexpected status for a bad pubkey:", status, err)
+	}
+
+	// A banned timeslot loses its bit.
+	server.mu.Lock()
+	server.equipmentReports[1].ban(9)
+	server.mu.Unlock()
+	check("", map[uint32][]uint32{1: {0, 20}, 2: {3}})
+
+	// Once the next week starts, its bits get served, and they survive the
+	// migration of the old week.
+	glow.SetCurrentTimeslot(2020)
+	server.managedHandleEquipmentReport(generateTestReport(1, 2017, priv1))
+	check("", map[uint32][]uint32{1: {2017}, 2: {2016}})
+	glow.SetCurrentTimeslot(reportMigrationThreshold + 1)
+	for i := 0; i < 200; i++ {
+		server.mu.RLock()
+		offset := server.equipmentReportsOffset
+		server.mu.RUnlock()
+		if offset == 2016 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rbr = check("", map[uint32][]uint32{1: {2017}, 2: {2016}})
+	if rbr.PeriodStart != 2016 {
+		t.Fatal("unexpected period start after the migration:", rbr.PeriodStart)
+	}
+}
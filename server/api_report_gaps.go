@@ -0,0 +1,187 @@
+package server
+
+// api_report_gaps.go contains an endpoint that lists the gaps in the report
+// history of devices over the current reporting period, so that the GCA can
+// chase down missing data before settlement.
+//
+// The reporting period is the current week, up to but not including the
+// current timeslot. A gap is a run of timeslots in which no report was
+// received. Banned timeslots are not gaps, because a report did arrive.
+//
+// Computing the gaps for every device is linear in the number of devices, so
+// the handler only holds the server mutex long enough to snapshot which
+// timeslots have reports, and finds the gaps after releasing it.
+//
+// Every gap says whether it overlaps a time that the server was down or
+// degraded according to the server timeline, in which case the cause is
+// "server" rather than "device", see server_timeline.go.
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// ReportGap is a contiguous range of timeslots without any reports. Both ends
+// of the range are inclusive.
+type ReportGap struct {
+	StartTimeslot uint32 `json:"start_timeslot"`
+	EndTimeslot   uint32 `json:"end_timeslot"`
+	Length        uint32 `json:"length"`
+	Cause         string `json:"cause,omitempty"` // GapCauseDevice or GapCauseServer
+}
+
+// DeviceReportGaps contains the gaps of a single device.
+type DeviceReportGaps struct {
+	ShortID   uint32         `json:"short_id"`
+	PublicKey glow.PublicKey `json:"pubkey"`
+	Gaps      []ReportGap    `json:"gaps"`
+}
+
+// ReportGapsResponse contains the gaps of each requested device over the
+// period [PeriodStart, PeriodEnd).
+type ReportGapsResponse struct {
+	PeriodStart uint32             `json:"period_start"`
+	PeriodEnd   uint32             `json:"period_end"`
+	Devices     []DeviceReportGaps `json:"devices"`
+}
+
+// reportPresence is a snapshot of which timeslots of the reporting period
+// have a report for a device.
+type reportPresence struct {
+	shortID   uint32
+	publicKey glow.PublicKey
+	present   []bool
+}
+
+// ReportGapsHandler returns the report gaps for the device identified by the
+// 'pubkey' or 'short_id' query parameter, or for every device if 'all=true'
+// is set.
+func (gcas *GCAServer) ReportGapsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for report gaps.")
+		return
+	}
+
+	// Figure out which devices are being requested.
+	q := r.URL.Query()
+	all := q.Get("all") == "true"
+	pkStr := q.Get("pubkey")
+	sidStr := q.Get("short_id")
+	lookups := 0
+	for _, set := range []bool{all, pkStr != "", sidStr != ""} {
+		if set {
+			lookups++
+		}
+	}
+	if lookups != 1 {
+		gcas.writeError(w, ErrCodeMalformedRequest, "exactly one of pubkey, short_id, or all=true must be provided")
+		return
+	}
+	var pk glow.PublicKey
+	var shortID uint32
+	if pkStr != "" {
+		var err error
+		pk, err = glow.ParsePublicKey(pkStr)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid pubkey")
+			return
+		}
+	} else if sidStr != "" {
+		sid, err := strconv.ParseUint(sidStr, 10, 32)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid short_id")
+			return
+		}
+		shortID = uint32(sid)
+	}
+
+	// Snapshot the report presence while holding the lock.
+	now := gcas.currentTimeslot()
+	periodStart := now - now%2016
+	var snapshots []reportPresence
+	gcas.mu.RLock()
+	if all {
+		for sid := range gcas.equipmentReports {
+			snapshots = append(snapshots, gcas.snapshotReportPresence(sid, periodStart, now))
+		}
+	} else {
+		exists := true
+		if pkStr != "" {
+			shortID, exists = gcas.equipmentShortID[pk]
+		}
+		if _, ok := gcas.equipmentReports[shortID]; !ok || !exists {
+			gcas.mu.RUnlock()
+			gcas.writeError(w, ErrCodeUnknownDevice, "unknown device")
+			return
+		}
+		snapshots = append(snapshots, gcas.snapshotReportPresence(shortID, periodStart, now))
+	}
+	gcas.mu.RUnlock()
+
+	// Compute the gaps without the lock.
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].shortID < snapshots[j].shortID })
+	resp := ReportGapsResponse{
+		PeriodStart: periodStart,
+		PeriodEnd:   now,
+		Devices:     make([]DeviceReportGaps, 0, len(snapshots)),
+	}
+	windows := gcas.outageWindows(now)
+	for _, rp := range snapshots {
+		gaps := findReportGaps(rp.present, periodStart)
+		for i := range gaps {
+			gaps[i].Cause = gapCause(gaps[i], windows)
+		}
+		resp.Devices = append(resp.Devices, DeviceReportGaps{
+			ShortID:   rp.shortID,
+			PublicKey: rp.publicKey,
+			Gaps:      gaps,
+		})
+	}
+	gcas.writeJSONResponse(w, r, resp)
+}
+
+// snapshotReportPresence records which timeslots in [start, end) have a
+// report for the provided device. Timeslots that are not in memory are
+// treated as missing.
+func (gcas *GCAServer) snapshotReportPresence(shortID uint32, start uint32, end uint32) reportPresence {
+	rp := reportPresence{
+		shortID:   shortID,
+		publicKey: gcas.equipment[shortID].PublicKey,
+		present:   make([]bool, end-start),
+	}
+	reports := gcas.equipmentReports[shortID]
+	ero := gcas.equipmentReportsOffset
+	for ts := start; ts < end; ts++ {
+		if ts >= ero && ts < ero+4032 {
+			rp.present[ts-start] = reports.PowerOutputs[ts-ero] != 0
+		}
+	}
+	return rp
+}
+
+// findReportGaps returns the runs of missing timeslots in the provided
+// presence slice, where the first element corresponds to the start timeslot.
+func findReportGaps(present []bool, start uint32) []ReportGap {
+	gaps := []ReportGap{}
+	for i := 0; i < len(present); i++ {
+		if present[i] {
+			continue
+		}
+		j := i
+		for j+1 < len(present) && !present[j+1] {
+			j++
+		}
+		gaps = append(gaps, ReportGap{
+			StartTimeslot: start + uint32(i),
+			EndTimeslot:   start + uint32(j),
+			Length:        uint32(j - i + 1),
+		})
+		i = j
+	}
+	return gaps
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getReportGaps fetches the report gaps with the provided query.
+func (gcas *GCAServer) getReportGaps(query string) (int, ReportGapsResponse, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/report-gaps?%v", gcas.httpPort, query))
+	if err != nil {
+		return 0, ReportGapsResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, ReportGapsResponse{}, nil
+	}
+	var rgr ReportGapsResponse
+	err = json.NewDecoder(resp.Body).Decode(&rgr)
+	return resp.StatusCode, rgr, err
+}
+
+// TestFindReportGaps checks the gap scanning on its own.
+func TestFindReportGaps(t *testing.T) {
+	tests := []struct {
+		present []bool
+		gaps    []ReportGap
+	}{
+		{nil, []ReportGap{}},
+		{[]bool{true, true}, []ReportGap{}},
+		{[]bool{false, false, false}, []ReportGap{{100, 102, 3, ""}}},
+		{[]bool{false, true, false, false, true}, []ReportGap{{100, 100, 1, ""}, {102, 103, 2, ""}}},
+		{[]bool{true, false, true, false}, []ReportGap{{101, 101, 1, ""}, {103, 103, 1, ""}}},
+	}
+	for i, test := range tests {
+		gaps := findReportGaps(test.present, 100)
+		if !reflect.DeepEqual(gaps, test.gaps) {
+			t.Errorf("test %v: expected %v, got %v", i, test.gaps, gaps)
+		}
+	}
+}
+
+// TestReportGaps checks the endpoint for a single device and for all
+// devices, including a device that has never reported.
+func TestReportGaps(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(2016 + 10)
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	silent, _, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []uint32{2016 + 2, 2016 + 3, 2016 + 7} {
+		server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, ts, ePriv))
+	}
+
+	status, rgr, err := server.getReportGaps(fmt.Sprintf("short_id=%v", ea.ShortID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("unexpected status:", status)
+	}
+	if rgr.PeriodStart != 2016 || rgr.PeriodEnd != 2016+10 || len(rgr.Devices) != 1 {
+		t.Fatalf("unexpected response: %+v", rgr)
+	}
+	expected := []ReportGap{{2016, 2017, 2, GapCauseDevice}, {2020, 2022, 3, GapCauseDevice}, {2024, 2025, 2, GapCauseDevice}}
+	if !reflect.DeepEqual(rgr.Devices[0].Gaps, expected) {
+		t.Fatalf("unexpected gaps: %v", rgr.Devices[0].Gaps)
+	}
+
+	status, rgr, err = server.getReportGaps("all=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(rgr.Devices) != 2 {
+		t.Fatalf("unexpected response: %v %+v", status, rgr)
+	}
+	if rgr.Devices[1].ShortID != silent.ShortID || rgr.Devices[1].PublicKey != silent.PublicKey {
+		t.Fatal("devices are not sorted by ShortID")
+	}
+	if !reflect.DeepEqual(rgr.Devices[1].Gaps, []ReportGap{{2016, 2025, 10, GapCauseDevice}}) {
+		t.Fatalf("expected one gap covering the period: %v", rgr.Devices[1].Gaps)
+	}
+
+	// Bad lookups get rejected.
+	for query, expectedStatus := range map[string]int{
+		"":                    http.StatusBadRequest,
+		"all=true&short_id=1": http.StatusBadRequest,
+		"pubkey=zz":           http.StatusBadRequest,
+		"short_id=3":          http.StatusNotFound,
+	} {
+		status, _, err := server.getReportGaps(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != expectedStatus {
+			t.Errorf("query %q: expected %v, got %v", query, expectedStatus, status)
+		}
+	}
+}
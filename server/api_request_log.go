@@ -0,0 +1,159 @@
+package server
+
+// api_request_log.go contains the middleware that logs every HTTP request.
+//
+// Each request gets a request ID, which is returned to the caller in the
+// X-Request-ID header and is added to every line that the handler logs
+// through requestLogger, so that a failure reported by a user can be found in
+// the logs. A caller may provide its own ID in the X-Request-ID header, for
+// example when the server sits behind a proxy that already assigns IDs.
+//
+// In internal test mode every request is logged at Info level. In production
+// only the requests that failed with a server error or took longer than
+// slowRequestThreshold are logged, at Warn level, to keep the logs quiet.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// slowRequestThreshold is the duration after which a request is
+	// considered slow and always gets logged.
+	slowRequestThreshold = time.Second
+
+	// maxRequestIDLength is the longest request ID that is accepted from
+	// a caller.
+	maxRequestIDLength = 64
+)
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// requestRecorder wraps a ResponseWriter to capture the status and the size
+// of the response.
+type requestRecorder struct {
+	http.ResponseWriter
+	status   int
+	size     int
+	hijacked bool
+}
+
+// WriteHeader records the status before passing it on.
+func (rr *requestRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the size of the response before passing the data on.
+func (rr *requestRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.size += n
+	return n, err
+}
+
+// Flush implements http.Flusher, which the streaming handlers rely on.
+func (rr *requestRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, which the websocket handlers rely on.
+func (rr *requestRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		rr.hijacked = true
+		rr.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// validRequestID returns whether a request ID that was provided by the caller
+// is safe to put in the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestID returns the ID that the middleware assigned to the request, or an
+// empty string if the request did not pass through the middleware.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the logger that handlers should use while serving a
+// request, which adds the request ID to every line as the request_id field,
+// and the signer of a signed request as the auth field.
+func (gcas *GCAServer) requestLogger(r *http.Request) *Logger {
+	logger := gcas.logger
+	if id := requestID(r); id != "" {
+		logger = logger.WithFields("request_id", id)
+	}
+	if ai, ok := authenticatedIdentity(r); ok {
+		logger = logger.WithFields("auth", ai.String())
+	}
+	return logger
+}
+
+// logRequests wraps the API so that every request gets a request ID and a log
+// line with its outcome.
+func (gcas *GCAServer) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		rr := &requestRecorder{ResponseWriter: w}
+		start := gcas.now()
+		next.ServeHTTP(rr, r)
+		duration := gcas.now().Sub(start)
+		if rr.status == 0 {
+			rr.status = http.StatusOK
+		}
+
+		logger := gcas.requestLogger(r).WithFields("method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "status", rr.status, "size", rr.size, "duration", duration)
+		// Hijacked connections are long lived streams, so their
+		// duration says nothing about the health of the server.
+		slow := duration > slowRequestThreshold && !rr.hijacked
+		if rr.status >= 500 || slow {
+			logger.Warn("http request")
+		} else if gcas.allowIntApis {
+			logger.Info("http request")
+		}
+	})
+}
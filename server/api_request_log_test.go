@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// readServerLog returns the contents of the log file of the server.
+func readServerLog(t *testing.T, dir string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestRequestIDs checks that every response has a request ID, and that IDs
+// provided by the caller are only kept if they are safe to log.
+func TestRequestIDs(t *testing.T) {
+	server, _, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	get := func(id string) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%v/api/v1/equipment", server.httpPort), nil)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("X-Request-ID")
+	}
+
+	first, second := get(""), get("")
+	if len(first) != 16 || len(second) != 16 || first == second {
+		t.Errorf("unexpected generated request ids: %q %q", first, second)
+	}
+	if id := get("proxy-assigned_id.1"); id != "proxy-assigned_id.1" {
+		t.Error("caller provided request id was not kept:", id)
+	}
+	for _, bad := range []string{"has space", "semi;colon", strings.Repeat("a", maxRequestIDLength+1)} {
+		if id := get(bad); id == bad || len(id) != 16 {
+			t.Errorf("unsafe request id %q was not replaced: %q", bad, id)
+		}
+	}
+}
+
+// TestRequestLogging checks which requests get logged in production mode,
+// and that the log lines of a handler carry the request ID.
+func TestRequestLogging(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	handler := server.logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			server.requestLogger(r).Warn("handler detail")
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/slow":
+			time.Sleep(slowRequestThreshold + 10*time.Millisecond)
+			w.Write([]byte("done"))
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	serve := func(path string) string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Header().Get("X-Request-ID")
+	}
+
+	okID, failID, slowID := serve("/ok"), serve("/fail"), serve("/slow")
+	log := readServerLog(t, dir)
+	if strings.Contains(log, okID) {
+		t.Error("successful request was logged in production mode")
+	}
+	if !strings.Contains(log, "handler detail request_id="+failID+"\n") {
+		t.Error("handler log line does not carry the request id")
+	}
+	if !strings.Contains(log, "http request request_id="+failID+" method=GET path=/fail") || !strings.Contains(log, "status=500") {
+		t.Error("failed request was not logged")
+	}
+	if !strings.Contains(log, "http request request_id="+slowID+" method=GET path=/slow remote=192.0.2.1:1234 status=200 size=4") {
+		t.Error("slow request was not logged")
+	}
+
+	// Rejected UDP packets get a structured log line as well.
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wrongKey := glow.GenerateKeyPair()
+	if err := sendUDPReport(generateTestReport(ea.ShortID, 3, wrongKey), server.udpPort); err != nil {
+		t.Fatal(err)
+	}
+	expected := "udp packet rejected remote=127.0.0.1:"
+	for i := 0; i < 100 && !strings.Contains(readServerLog(t, dir), expected); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	log = readServerLog(t, dir)
+	if !strings.Contains(log, expected) || !strings.Contains(log, "short_id=1 timeslot=3 outcome=bad_signature authenticated=false") {
+		t.Error("rejected udp packet was not logged")
+	}
+}
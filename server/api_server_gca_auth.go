@@ -20,14 +20,22 @@ package server
 // into their lockbook.
 //
 // This endpoint is a POST request.
+//
+// Registering is idempotent. Resubmitting the key that is already registered
+// succeeds, so a GCA that never saw the response can safely retry, while a
+// different key is refused with GCA_KEY_MISMATCH. The registration is
+// committed to disk with a single atomic write of the registration file,
+// which retires the temp key. gcaPubKey.dat is written afterwards for the
+// tools that read it, and gets rebuilt from the registration file at startup
+// if the server died before writing it.
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"path/filepath"
+	"os"
 
 	"github.com/glowlabs-org/gca-backend/glow"
 )
@@ -41,6 +49,9 @@ type GCARegistration struct {
 	Signature glow.Signature
 }
 
+// gcaRegistrationSize is the size of a serialized GCARegistration.
+const gcaRegistrationSize = 32 + 64
+
 // GCARegistrationResponse defines the response that the server writes after a
 // successful GCA registration.
 type GCARegistrationResponse struct {
@@ -64,28 +75,47 @@ func (gr *GCARegistration) SigningBytes() []byte {
 	return data
 }
 
+// Serialize returns the compact binary representation of the registration.
+func (gr GCARegistration) Serialize() []byte {
+	b := make([]byte, gcaRegistrationSize)
+	copy(b, gr.GCAKey[:])
+	copy(b[32:], gr.Signature[:])
+	return b
+}
+
+// DeserializeGCARegistration reverses a call to Serialize.
+func DeserializeGCARegistration(b []byte) (GCARegistration, error) {
+	var gr GCARegistration
+	if len(b) != gcaRegistrationSize {
+		return gr, fmt.Errorf("unexpected registration size: %v", len(b))
+	}
+	copy(gr.GCAKey[:], b[:32])
+	copy(gr.Signature[:], b[32:])
+	return gr, nil
+}
+
 // RegisterGCAHandler handles the GCA registration requests.
 // This function serves as the HTTP handler for GCA registration.
 func (s *GCAServer) RegisterGCAHandler(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is supported.", http.StatusMethodNotAllowed)
-		s.logger.Warn("Received non-POST request for GCA registration.")
+		s.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		s.requestLogger(r).Warn("Received non-POST request for GCA registration.")
 		return
 	}
 
 	// Decode the JSON request body into RegisterGCARequest struct
 	var request GCARegistration
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
-		s.logger.Error("Failed to decode request body:", err)
+		s.writeError(w, ErrCodeMalformedRequest, "Invalid request body: "+err.Error())
+		s.requestLogger(r).Error("Failed to decode request body:", err)
 		return
 	}
 
 	// Validate and process the request
 	if err := s.registerGCA(request); err != nil {
-		http.Error(w, fmt.Sprint("Failed to register GCA:", err), http.StatusInternalServerError)
-		s.logger.Error("Failed to register GCA:", err)
+		s.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to register GCA:", err))
+		s.requestLogger(r).Error("Failed to register GCA:", err)
 		return
 	}
 
@@ -98,13 +128,13 @@ func (s *GCAServer) RegisterGCAHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		// Handle the error if JSON encoding fails
-		http.Error(w, "Failed to encode JSON response", http.StatusInternalServerError)
-		s.logger.Error("Failed to encode JSON response:", err)
+		s.writeError(w, ErrCodeInternalError, "Failed to encode JSON response")
+		s.requestLogger(r).Error("Failed to encode JSON response:", err)
 		return
 	}
 
 	// Log the successful registration
-	s.logger.Info("Successfully registered GCA.")
+	s.requestLogger(r).Info("Successfully registered GCA.")
 }
 
 // registerGCA performs the actual registration based on the client request.
@@ -112,16 +142,22 @@ func (s *GCAServer) RegisterGCAHandler(w http.ResponseWriter, r *http.Request) {
 func (gcas *GCAServer) registerGCA(gr GCARegistration) error {
 	gcas.mu.Lock()
 	defer gcas.mu.Unlock()
-	if gcas.gcaPubkeyAvailable {
-		return fmt.Errorf("a GCA key has already been registered")
-	}
 
 	// Parse and verify the GCA key
-	sb := gr.SigningBytes()
-	isValid := glow.Verify(gcas.gcaTempKey, sb, gr.Signature)
-	if !isValid {
+	if err := gcas.verifyGCAKey(gr); err != nil {
 		gcas.logger.Warn("Received bad GCA registration:", gr)
-		return errors.New("invalid signature on GCAKey")
+		return withCode(ErrCodeInvalidSignature, err)
+	}
+
+	// A retry of the registration that already went through succeeds.
+	if gcas.gcaPubkeyAvailable {
+		if gr.GCAKey == gcas.gcaPubkey {
+			return nil
+		}
+		return withCode(ErrCodeGCAKeyMismatch, fmt.Errorf("a different GCA key has already been registered"))
+	}
+	if err := gcas.verifyNotTestKey("gca", gr.GCAKey); err != nil {
+		return err
 	}
 	err := gcas.saveGCAKey(gr)
 	if err != nil {
@@ -133,9 +169,8 @@ func (gcas *GCAServer) registerGCA(gr GCARegistration) error {
 
 // verifyGCAKey verifies the signature on a GCAKey object.
 //
-// It uses the public key of some authority (let's assume it's available in
-// the server struct as someAuthorityPubkey) to verify the signature.
-// The method returns an error if the verification fails.
+// It uses the temp key of the GCA to verify the signature. The method returns
+// an error if the verification fails.
 func (gcas *GCAServer) verifyGCAKey(gr GCARegistration) error {
 	// Generate the byte slice intended for the signing operation
 	signingBytes := gr.SigningBytes()
@@ -151,25 +186,71 @@ func (gcas *GCAServer) verifyGCAKey(gr GCARegistration) error {
 	return nil
 }
 
-// saveGCAKey saves the GCA key to a file on disk.
+// saveGCAKey saves the GCA key to disk.
 //
-// This function takes the GCA key, serialized as a byte array,
-// and writes it to a file. The path for the file is determined by
-// concatenating the server's base directory with "gcaPubKey.dat"
+// The registration file is the commit point. Once it has been written, the
+// temp key is retired and the real key is in use, even if the server dies
+// before gcaPubKey.dat is written.
 func (server *GCAServer) saveGCAKey(gr GCARegistration) error {
-	// Determine the file path for the public key.
-	// This should reside in the same directory as when reading it,
-	// usually specified in server.baseDir.
-	pubkeyPath := filepath.Join(server.baseDir, "gcaPubKey.dat")
-
-	// Write the serialized public key to a file.
-	// ioutil.WriteFile creates the file if it doesn't exist,
-	// or truncates it before writing if it does.
-	err := ioutil.WriteFile(pubkeyPath, gr.GCAKey[:], 0644)
+	err := server.staticStorage.WriteFile(GCARegistrationFile, gr.Serialize(), 0644)
 	if err != nil {
-		return fmt.Errorf("unable to write public key to file: %v", err)
+		return fmt.Errorf("unable to write registration to file: %v", err)
 	}
+	server.gcaPubkey = gr.GCAKey
+	server.gcaPubkeyAvailable = true
 
+	// The registration has been committed, so a failure to write the
+	// public key file gets repaired at the next startup instead of being
+	// reported to the GCA.
+	err = server.staticStorage.WriteFile(GCAPubkeyFile, gr.GCAKey[:], 0644)
+	if err != nil {
+		server.logger.Warnf("unable to write public key to file, it will be rebuilt at startup: %v", err)
+	}
+	return nil
+}
+
+// loadGCAPubkey loads the Glow Certification Agent public key from disk.
+//
+// The registration file is the source of truth. If the server died between
+// writing the registration file and writing gcaPubKey.dat, gcaPubKey.dat is
+// rebuilt here. Servers that registered before the registration file existed
+// only have gcaPubKey.dat, which is trusted as is.
+func (server *GCAServer) loadGCAPubkey() error {
+	pubkeyData, err := server.staticStorage.ReadFile(GCAPubkeyFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read public key from file: %v", err)
+	}
+	pubkeyExists := err == nil
+	if pubkeyExists && len(pubkeyData) != 32 {
+		return fmt.Errorf("public key file has an unexpected size: %v", len(pubkeyData))
+	}
+
+	regData, err := server.staticStorage.ReadFile(GCARegistrationFile)
+	if os.IsNotExist(err) {
+		if !pubkeyExists {
+			server.logger.Info("GCA Temp Key not available, waiting to receive over the API")
+			return nil
+		}
+		server.gcaPubkeyAvailable = true
+		copy(server.gcaPubkey[:], pubkeyData)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read registration from file: %v", err)
+	}
+	gr, err := DeserializeGCARegistration(regData)
+	if err != nil {
+		return fmt.Errorf("%v: %v", GCARegistrationFile, err)
+	}
+	if err := server.verifyGCAKey(gr); err != nil {
+		return fmt.Errorf("%v: %v", GCARegistrationFile, err)
+	}
+	if !pubkeyExists || !bytes.Equal(pubkeyData, gr.GCAKey[:]) {
+		server.logger.Warn("GCA public key file does not match the registration, rebuilding it")
+		if err := server.staticStorage.WriteFile(GCAPubkeyFile, gr.GCAKey[:], 0644); err != nil {
+			return fmt.Errorf("unable to rebuild public key file: %v", err)
+		}
+	}
 	server.gcaPubkey = gr.GCAKey
 	server.gcaPubkeyAvailable = true
 	return nil
@@ -23,6 +23,9 @@ package server
 // that other tests can use it when they need it.
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/glowlabs-org/gca-backend/glow"
@@ -72,3 +75,137 @@ func TestGCAKeyLifecycle(t *testing.T) {
 		t.Fatal("expecting an error")
 	}
 }
+
+// faultAtomicWrites makes the atomic writes to the named file fail halfway, as
+// if the process had died in the middle of the write. The returned function
+// removes the fault.
+func faultAtomicWrites(name string) func() {
+	atomicWriteFault = func(f *os.File, data []byte) error {
+		if filepath.Base(f.Name()) != name+tmpFileSuffix {
+			_, err := f.Write(data)
+			return err
+		}
+		f.Write(data[:len(data)/2])
+		return errInjectedFault
+	}
+	return func() {
+		atomicWriteFault = nil
+	}
+}
+
+// TestGCARegistrationIdempotent checks that resubmitting the registered key
+// succeeds, and that a different key is refused with a clear code.
+func TestGCARegistrationIdempotent(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	gcas, tempPrivKey, err := gcaServerWithTempKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+
+	gcaPubKey, gcaPrivKey, err := gcas.submitGCAKey(tempPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gcas.submitKnownGCAKey(tempPrivKey, gcaPubKey, gcaPrivKey); err != nil {
+		t.Fatal("resubmitting the registered key failed:", err)
+	}
+	_, _, err = gcas.submitGCAKey(tempPrivKey)
+	if err == nil || !strings.Contains(err.Error(), ErrCodeGCAKeyMismatch) {
+		t.Fatal("expected a different key to be refused with a mismatch:", err)
+	}
+	if gcas.gcaPubkey != gcaPubKey {
+		t.Fatal("the registered key changed")
+	}
+}
+
+// TestGCARegistrationRecovery simulates a crash at each step of the
+// registration, and checks that the server always comes back either fully
+// registered or not registered at all.
+func TestGCARegistrationRecovery(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	// The faults get injected into the atomic writes of the files.
+	useFileStorage(dir)
+	gcas, tempPrivKey, err := gcaServerWithTempKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restart := func() {
+		gcas.Close()
+		gcas, err = NewGCAServer(dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pubkeyPath := filepath.Join(dir, "gcaPubKey.dat")
+
+	// Die while writing the registration. Nothing was committed, so the
+	// server comes back unregistered and accepts any key.
+	firstPub, firstPriv := glow.GenerateKeyPair()
+	removeFault := faultAtomicWrites(GCARegistrationFile)
+	err = gcas.submitKnownGCAKey(tempPrivKey, firstPub, firstPriv)
+	removeFault()
+	if err == nil {
+		t.Fatal("expected the registration to fail")
+	}
+	restart()
+	if gcas.gcaPubkeyAvailable {
+		t.Fatal("server is registered after a failed registration")
+	}
+
+	// Die after committing the registration, while writing gcaPubKey.dat.
+	// The registration stands, and the key file gets rebuilt at startup.
+	gcaPubKey, gcaPrivKey := glow.GenerateKeyPair()
+	removeFault = faultAtomicWrites("gcaPubKey.dat")
+	err = gcas.submitKnownGCAKey(tempPrivKey, gcaPubKey, gcaPrivKey)
+	removeFault()
+	if err != nil {
+		t.Fatal("a committed registration was reported as failed:", err)
+	}
+	if _, err := os.Stat(pubkeyPath); !os.IsNotExist(err) {
+		t.Fatal("expected the public key file to be missing")
+	}
+	restart()
+	data, err := os.ReadFile(pubkeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gcas.gcaPubkeyAvailable || gcas.gcaPubkey != gcaPubKey || string(data) != string(gcaPubKey[:]) {
+		t.Fatal("registration was not recovered")
+	}
+
+	// The retry of a GCA that never saw the response succeeds, a
+	// different key is refused.
+	if err := gcas.submitKnownGCAKey(tempPrivKey, gcaPubKey, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := gcas.submitKnownGCAKey(tempPrivKey, firstPub, firstPriv); err == nil {
+		t.Fatal("a different key was accepted after recovering")
+	}
+
+	// A key file that disagrees with the registration gets replaced.
+	if err := os.WriteFile(pubkeyPath, firstPub[:], 0644); err != nil {
+		t.Fatal(err)
+	}
+	restart()
+	data, err = os.ReadFile(pubkeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gcas.gcaPubkey != gcaPubKey || string(data) != string(gcaPubKey[:]) {
+		t.Fatal("key file was not rebuilt from the registration")
+	}
+
+	// A registration that wasn't signed by the temp key keeps the server
+	// from starting.
+	gcas.Close()
+	_, badPriv := glow.GenerateKeyPair()
+	gr := GCARegistration{GCAKey: firstPub}
+	gr.Signature = glow.Sign(gr.SigningBytes(), badPriv)
+	if err := os.WriteFile(filepath.Join(dir, GCARegistrationFile), gr.Serialize(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGCAServer(dir, false); err == nil {
+		t.Fatal("server started with a forged registration")
+	}
+}
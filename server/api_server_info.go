@@ -0,0 +1,183 @@
+package server
+
+// api_server_info.go describes the server to its callers: which server it is,
+// which build it runs, and which optional protocol features it supports.
+// Devices use the capabilities to decide which version of the UDP report
+// packet to send, see glow/report_packet.go. A server without this endpoint
+// only accepts legacy report packets.
+//
+// Like every other JSON endpoint, the server info can be requested with
+// signed=true, which wraps it in a response that is signed by the server.
+// Callers that cache the server info should keep the signed form, so that
+// the capabilities can be checked back to the server that advertised them.
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// The optional features that a server can advertise. Callers must treat a
+// feature that isn't listed as unsupported, and ignore features that they
+// don't know about.
+const (
+	// FeatureReportAcks means that the server sends a signed ack for every
+	// authenticated UDP report.
+	FeatureReportAcks = "report_acks"
+
+	// FeatureBatchReports means that the server accepts reports on
+	// /api/v1/equipment-reports/batch.
+	FeatureBatchReports = "batch_reports"
+
+	// FeatureHTTPReports means that the server accepts single report
+	// packets on /api/v1/equipment-report, for devices that can't reach
+	// the UDP port.
+	FeatureHTTPReports = "http_reports"
+
+	// FeatureBinaryEncoding means that the server serves the compact binary
+	// encoding of the endpoints listed in api_binary.go.
+	FeatureBinaryEncoding = "binary_encoding"
+
+	// FeatureReportStream means that the server streams accepted reports
+	// over a websocket on /api/v1/reports/stream.
+	FeatureReportStream = "report_stream"
+
+	// FeatureReportValidation means that the server validates report
+	// packets without recording them on /api/v1/validate-report.
+	FeatureReportValidation = "report_validation"
+
+	// FeatureHeartbeats means that the server accepts heartbeats on the
+	// UDP port and on /api/v1/equipment-report, see heartbeats.go.
+	FeatureHeartbeats = "heartbeats"
+
+	// FeatureTLS means that the HTTP API is served over TLS.
+	FeatureTLS = "tls"
+
+	// FeatureDebug means that the debug endpoints are registered under
+	// /debug/.
+	FeatureDebug = "debug"
+)
+
+// apiVersions are the versions of the HTTP API that the server serves.
+var apiVersions = []int{1, 2}
+
+// ServerCapabilities lists the optional protocol features that a server
+// supports. New features are added as new fields, so that callers can tell
+// an older server apart by the zero value.
+type ServerCapabilities struct {
+	// ReportPacketVersions are the versions of the UDP report packet that
+	// the server accepts, where 0 is the legacy unversioned layout.
+	ReportPacketVersions []int `json:"report_packet_versions"`
+
+	// APIVersions are the versions of the HTTP API that the server
+	// serves, such as 2 for the /api/v2/ endpoints.
+	APIVersions []int `json:"api_versions"`
+
+	// BinaryVersions are the versions of the binary encodings, by
+	// endpoint.
+	BinaryVersions map[string]int `json:"binary_versions"`
+
+	// Features are the optional features that are enabled on the server.
+	Features []string `json:"features"`
+}
+
+// HasFeature returns whether the server advertises the provided feature.
+func (sc ServerCapabilities) HasFeature(feature string) bool {
+	for _, f := range sc.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAPIVersion returns whether the server serves the provided version of the
+// HTTP API.
+func (sc ServerCapabilities) HasAPIVersion(version int) bool {
+	for _, v := range sc.APIVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// ReportWindow is the range of timeslots that a server accepts reports for.
+// The range moves with the current timeslot, devices can use the tolerances
+// to work out the window at any other time.
+type ReportWindow struct {
+	PastTimeslots    uint32 `json:"past_timeslots"`    // How far the timeslot of a report may be behind the current timeslot
+	FutureTimeslots  uint32 `json:"future_timeslots"`  // How far the timeslot of a report may be ahead of the current timeslot
+	EarliestTimeslot uint32 `json:"earliest_timeslot"` // The earliest timeslot that is accepted at the current timeslot
+	LatestTimeslot   uint32 `json:"latest_timeslot"`   // The latest timeslot that is accepted at the current timeslot
+}
+
+// ServerInfoResponse describes a GCA server.
+type ServerInfoResponse struct {
+	PublicKey       string             `json:"public_key"`
+	GCAPublicKey    string             `json:"gca_public_key,omitempty"` // Empty until the GCA is registered
+	Build           BuildInfo          `json:"build"`
+	TcpPort         uint16             `json:"tcp_port"`
+	UdpPort         uint16             `json:"udp_port"`
+	CurrentTimeslot uint32             `json:"current_timeslot"`
+	ReportWindow    ReportWindow       `json:"report_window"`
+	Capabilities    ServerCapabilities `json:"capabilities"`
+	Tenants         []string           `json:"tenants,omitempty"` // The GCAs that are hosted under /gca/<id>/, see tenants.go
+}
+
+// serverFeatures returns the optional features that are enabled on the
+// server.
+func (gcas *GCAServer) serverFeatures() []string {
+	features := []string{FeatureReportAcks, FeatureBatchReports, FeatureHTTPReports, FeatureBinaryEncoding, FeatureReportStream, FeatureReportValidation, FeatureHeartbeats}
+	if gcas.staticTLS != nil {
+		features = append(features, FeatureTLS)
+	}
+	if gcas.allowIntApis || gcas.staticDebug {
+		features = append(features, FeatureDebug)
+	}
+	return features
+}
+
+// ServerInfoHandler returns the identity, build and capabilities of the
+// server.
+func (gcas *GCAServer) ServerInfoHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for the server info.")
+		return
+	}
+	currentTimeslot := gcas.currentTimeslot()
+	earliest, latest := gcas.reportWindow(currentTimeslot)
+	info := ServerInfoResponse{
+		PublicKey:       hex.EncodeToString(gcas.staticPublicKey[:]),
+		Build:           Build,
+		TcpPort:         gcas.tcpPort,
+		UdpPort:         gcas.udpPort,
+		CurrentTimeslot: currentTimeslot,
+		ReportWindow: ReportWindow{
+			PastTimeslots:    gcas.staticReportPastWindow,
+			FutureTimeslots:  gcas.staticReportFutureWindow,
+			EarliestTimeslot: earliest,
+			LatestTimeslot:   latest,
+		},
+		Capabilities: ServerCapabilities{
+			ReportPacketVersions: glow.ReportPacketVersions(),
+			APIVersions:          apiVersions,
+			BinaryVersions: map[string]int{
+				"all-device-stats":   allDeviceStatsBinaryVersion,
+				"historical-reports": historicalReportsBinaryVersion,
+			},
+			Features: gcas.serverFeatures(),
+		},
+		Tenants: gcas.tenantIDs(),
+	}
+	gcas.mu.RLock()
+	if gcas.gcaPubkeyAvailable {
+		gcaKey := gcas.gcaKeyAt(currentTimeslot)
+		info.GCAPublicKey = hex.EncodeToString(gcaKey[:])
+	}
+	gcas.mu.RUnlock()
+	gcas.writeJSONResponse(w, r, info)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestServerInfo checks that the server info names the server and its GCA,
+// lists its ports, and advertises the report packet versions that the
+// listener accepts along with the optional features.
+func TestServerInfo(t *testing.T) {
+	server, _, gcaPubKey, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(77)
+	defer glow.SetCurrentTimeslot(0)
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/server-info", server.httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info ServerInfoResponse
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PublicKey != hex.EncodeToString(server.staticPublicKey[:]) {
+		t.Fatal("wrong public key:", info.PublicKey)
+	}
+	if info.Build != Build {
+		t.Fatal("wrong build:", info.Build)
+	}
+	if !reflect.DeepEqual(info.Capabilities.ReportPacketVersions, glow.ReportPacketVersions()) {
+		t.Fatal("wrong report packet versions:", info.Capabilities.ReportPacketVersions)
+	}
+	if info.GCAPublicKey != hex.EncodeToString(gcaPubKey[:]) || info.TcpPort != server.tcpPort || info.UdpPort != server.udpPort || info.CurrentTimeslot != 77 {
+		t.Fatalf("unexpected server info: %+v", info)
+	}
+	// The window is cut off at timeslot 0.
+	if info.ReportWindow != (ReportWindow{PastTimeslots: defaultReportWindow, FutureTimeslots: defaultReportWindow, EarliestTimeslot: 0, LatestTimeslot: 77 + defaultReportWindow}) {
+		t.Fatalf("unexpected report window: %+v", info.ReportWindow)
+	}
+	if !info.Capabilities.HasAPIVersion(2) || info.Capabilities.BinaryVersions["all-device-stats"] != allDeviceStatsBinaryVersion {
+		t.Fatalf("unexpected versions: %+v", info.Capabilities)
+	}
+	for _, feature := range []string{FeatureReportAcks, FeatureBatchReports, FeatureHTTPReports, FeatureBinaryEncoding, FeatureReportStream, FeatureReportValidation} {
+		if !info.Capabilities.HasFeature(feature) {
+			t.Fatal("feature is not advertised:", feature, info.Capabilities.Features)
+		}
+	}
+	if info.Capabilities.HasFeature(FeatureTLS) || info.Capabilities.HasFeature(FeatureDebug) {
+		t.Fatal("disabled features are advertised:", info.Capabilities.Features)
+	}
+
+	// The server info can be signed like any other response.
+	data, err := server.getSigned("/api/v1/server-info?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := glow.VerifySignedResponse(data, server.staticPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed ServerInfoResponse
+	if err := json.Unmarshal(body, &signed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(signed, info) {
+		t.Fatalf("signed server info differs: %+v", signed)
+	}
+
+	resp, err = http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/server-info", server.httpPort), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("expected a POST to be rejected:", resp.StatusCode)
+	}
+}
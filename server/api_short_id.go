@@ -0,0 +1,108 @@
+package server
+
+// api_short_id.go contains an endpoint that maps a ShortID back to the device
+// that it was allocated to, along with the authorization and the current
+// status of the device.
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// The statuses that a ShortID can have.
+const (
+	shortIDStatusActive       = "active"
+	shortIDStatusDeauthorized = "deauthorized"
+	shortIDStatusBanned       = "banned"
+	shortIDStatusExpired      = "expired"
+)
+
+// ShortIDLookup describes the device that a ShortID was allocated to.
+type ShortIDLookup struct {
+	ShortID        uint32                       `json:"short_id"`
+	PublicKey      string                       `json:"pubkey"` // hex encoded
+	Status         string                       `json:"status"` // One of "active", "deauthorized", "banned", or "expired"
+	Imported       bool                         `json:"imported"`
+	Authorization  *glow.EquipmentAuthorization `json:"authorization,omitempty"`
+	DeauthorizedAt int64                        `json:"deauthorized_at,omitempty"` // Unix time of the deauthorization
+	Ban            *BannedEquipment             `json:"ban,omitempty"`
+	HighWaterMark  uint32                       `json:"high_water_mark"` // The highest ShortID that was ever allocated
+}
+
+// ShortIDHandler returns the device that the ShortID in the path was
+// allocated to, or NOT_FOUND if the ShortID was never allocated.
+func (gcas *GCAServer) ShortIDHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for a ShortID.")
+		return
+	}
+	sid, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "invalid ShortID")
+		return
+	}
+	shortID := uint32(sid)
+
+	gcas.mu.RLock()
+	lookup, found := gcas.lookupShortID(shortID)
+	gcas.mu.RUnlock()
+	if !found {
+		gcas.writeError(w, ErrCodeNotFound, "ShortID was never allocated")
+		return
+	}
+	gcas.writeJSONResponse(w, r, lookup)
+}
+
+// lookupShortID builds the ShortIDLookup for a ShortID. The bool is false if
+// the ShortID was never allocated. The mutex must be held.
+func (gcas *GCAServer) lookupShortID(shortID uint32) (ShortIDLookup, bool) {
+	owner, allocated := gcas.shortIDOwners[shortID]
+	_, banned := gcas.equipmentBans[shortID]
+	if !allocated && !banned {
+		return ShortIDLookup{}, false
+	}
+	lookup := ShortIDLookup{
+		ShortID:       shortID,
+		PublicKey:     hex.EncodeToString(owner[:]),
+		Status:        shortIDStatusActive,
+		HighWaterMark: gcas.shortIDHighWater,
+	}
+	_, lookup.Imported = gcas.equipmentImports[shortID]
+	if ea, exists := gcas.equipment[shortID]; exists {
+		lookup.Authorization = &ea
+	}
+
+	// A banned ShortID reports the evidence of the ban, which also holds
+	// the authorization of the device.
+	if banned {
+		be := gcas.buildBannedEquipment(shortID)
+		lookup.Status = shortIDStatusBanned
+		lookup.Ban = &be
+		if !allocated {
+			lookup.PublicKey = be.PublicKey
+		}
+		if be.Equivocation != nil {
+			ea := be.Equivocation.Authorization
+			lookup.Authorization = &ea
+		}
+		for _, ea := range be.Authorizations {
+			if ea.PublicKey == owner {
+				ea := ea
+				lookup.Authorization = &ea
+			}
+		}
+		return lookup, true
+	}
+	if ed, exists := gcas.equipmentDeauthorizations[owner]; exists {
+		lookup.Status = shortIDStatusDeauthorized
+		lookup.DeauthorizedAt = ed.Timestamp
+	} else if lookup.Authorization != nil && lookup.Authorization.ExpiredAt(gcas.currentTimeslot()) {
+		lookup.Status = shortIDStatusExpired
+	}
+	return lookup, true
+}
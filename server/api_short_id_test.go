@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getShortID looks up a ShortID, returning the status code and the decoded
+// response.
+func (gcas *GCAServer) getShortID(id string) (int, ShortIDLookup, error) {
+	var lookup ShortIDLookup
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/short-id/%v", gcas.httpPort, id))
+	if err != nil {
+		return 0, lookup, fmt.Errorf("unable to look up ShortID: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&lookup); err != nil {
+			return 0, lookup, fmt.Errorf("unable to decode lookup: %v", err)
+		}
+	}
+	return resp.StatusCode, lookup, nil
+}
+
+// TestShortIDLookup checks the lookup of active, deauthorized, and never
+// allocated ShortIDs, and that a ShortID is never handed to a different
+// device, including after a restart.
+func TestShortIDLookup(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired, _, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := EquipmentDeauthorization{PublicKey: retired.PublicKey, Timestamp: glow.TimeslotToUnix(5)}
+	ed.Signature = glow.Sign(ed.SigningBytes(), gcaPrivKey)
+	status, err := server.postDeauthorization(ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal("deauthorization failed:", status)
+	}
+
+	// An active ShortID.
+	status, lookup, err := server.getShortID("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || lookup.Status != shortIDStatusActive || lookup.PublicKey != hex.EncodeToString(active.PublicKey[:]) {
+		t.Fatalf("unexpected lookup of an active ShortID: %v %+v", status, lookup)
+	}
+	if lookup.Authorization == nil || *lookup.Authorization != active || lookup.HighWaterMark != 2 {
+		t.Fatalf("unexpected lookup of an active ShortID: %+v", lookup)
+	}
+
+	// A deauthorized ShortID.
+	status, lookup, err = server.getShortID("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || lookup.Status != shortIDStatusDeauthorized || lookup.DeauthorizedAt != ed.Timestamp {
+		t.Fatalf("unexpected lookup of a deauthorized ShortID: %v %+v", status, lookup)
+	}
+
+	// A ShortID that was never allocated, and one that isn't a number.
+	status, _, err = server.getShortID("3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusNotFound {
+		t.Fatal("expected a never allocated ShortID to be missing:", status)
+	}
+	status, _, err = server.getShortID("two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusBadRequest {
+		t.Fatal("expected an invalid ShortID to be rejected:", status)
+	}
+
+	// The ShortID of the deauthorized device can't go to a new device,
+	// and trying doesn't ban the ShortID.
+	if _, _, err := server.AuthorizeTestDevice(2, gcaPrivKey); err == nil {
+		t.Fatal("the ShortID of a deauthorized device was reused")
+	}
+	server.mu.RLock()
+	_, banned := server.equipmentBans[2]
+	server.mu.RUnlock()
+	if banned {
+		t.Fatal("reusing a ShortID banned the deauthorized device")
+	}
+
+	// The allocations survive a restart. A server whose registry predates
+	// the allocations rebuilds it from the equipment.
+	server.Close()
+	if err := serverStorage(dir).Remove(ShortIDsFile); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	status, lookup, err = server.getShortID("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || lookup.PublicKey != hex.EncodeToString(retired.PublicKey[:]) || lookup.HighWaterMark != 2 {
+		t.Fatalf("allocation did not survive a restart: %v %+v", status, lookup)
+	}
+	if _, _, err := server.AuthorizeTestDevice(2, gcaPrivKey); err == nil {
+		t.Fatal("the ShortID of a deauthorized device was reused after a restart")
+	}
+}
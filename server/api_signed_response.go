@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// writeJSONResponse writes the provided value to the response as JSON. If the
+// request has the query parameter 'signed=true', the JSON is wrapped in a
+// glow.SignedResponse that is signed by the GCA server.
+func (gcas *GCAServer) writeJSONResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("signed") != "true" {
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			gcas.writeError(w, ErrCodeInternalError, "Failed to encode JSON response")
+			gcas.requestLogger(r).Error("Failed to encode JSON response:", err)
+		}
+		return
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		gcas.writeError(w, ErrCodeInternalError, "Failed to encode JSON response")
+		gcas.requestLogger(r).Error("Failed to encode JSON response:", err)
+		return
+	}
+	// The signature has to cover the redacted coordinates, see
+	// location_privacy.go.
+	body = redactRequestLocations(r, body)
+	sr := glow.NewSignedResponse(body, gcas.now().Unix(), gcas.staticPublicKey, gcas.staticPrivateKey)
+	if err := json.NewEncoder(w).Encode(sr); err != nil {
+		gcas.requestLogger(r).Error("Failed to encode signed JSON response:", err)
+		return
+	}
+}
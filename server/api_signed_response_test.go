@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getSigned fetches an endpoint with 'signed=true' and returns the raw body.
+func (gcas *GCAServer) getSigned(endpoint string) ([]byte, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v%v&signed=true", gcas.httpPort, endpoint))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %v", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// tamperSignedResponse flips one byte inside the body of a signed response.
+func tamperSignedResponse(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var sr glow.SignedResponse
+	if err := json.Unmarshal(data, &sr); err != nil {
+		t.Fatal(err)
+	}
+	b := []byte(sr.Body)
+	b[len(b)/2]++
+	sr.Body = string(b)
+	tampered, err := json.Marshal(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tampered
+}
+
+// TestSignedResponses fetches signed versions of the device stats and the
+// recent reports, verifies them, and checks that tampering is detected.
+func TestSignedResponses(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(3, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 2, ePriv))
+	if outcome != reportAccepted {
+		t.Fatal("report was not accepted:", outcome)
+	}
+
+	// Check the device stats.
+	data, err := server.getSigned("/api/v1/all-device-stats?timeslot_offset=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := glow.VerifySignedResponse(data, server.staticPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ads AllDeviceStats
+	if err := json.Unmarshal(body, &ads); err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices) != 1 || ads.Devices[0].PowerOutputs[2] != 5 {
+		t.Fatal("unexpected device stats in the signed response")
+	}
+	if _, err := glow.VerifySignedResponse(tamperSignedResponse(t, data), server.staticPublicKey); err == nil {
+		t.Fatal("tampered device stats verified")
+	}
+
+	// Check the recent reports.
+	data, err = server.getSigned("/api/v1/recent-reports?publicKey=" + hex.EncodeToString(ea.PublicKey[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = glow.VerifySignedResponse(data, server.staticPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rrr RecentReportsResponse
+	if err := json.Unmarshal(body, &rrr); err != nil {
+		t.Fatal(err)
+	}
+	if rrr.Reports[2].PowerOutput != 5 {
+		t.Fatal("unexpected reports in the signed response")
+	}
+	if _, err := glow.VerifySignedResponse(tamperSignedResponse(t, data), server.staticPublicKey); err == nil {
+		t.Fatal("tampered recent reports verified")
+	}
+
+	// Without the query parameter, the response is not wrapped.
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/all-device-stats?timeslot_offset=0", server.httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var unsigned AllDeviceStats
+	if err := json.NewDecoder(resp.Body).Decode(&unsigned); err != nil {
+		t.Fatal(err)
+	}
+	if len(unsigned.Devices) != 1 {
+		t.Fatal("unexpected unsigned response")
+	}
+}
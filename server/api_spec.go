@@ -0,0 +1,379 @@
+package server
+
+// api_spec.go describes the HTTP API. Every handler is attached to the mux
+// through handleRoute together with a Route, which names the methods of the
+// endpoint, its parameters, and the types of its request and response
+// bodies. handleRoute refuses a route without a description, so an endpoint
+// can't be added without also showing up in the spec.
+//
+// GET /api/v1/spec serves the routes as an OpenAPI 3 document. The document
+// is assembled from the routes that are on the mux of the server that
+// answers, so the debug endpoints only show up on a server that has them,
+// and the internal APIs only on a server that allows them.
+// The optional features that are enabled on the server are listed under
+// x-features, and every operation that belongs to one of them names it in
+// x-feature. Operations whose response can be signed with ?signed=true are
+// marked with x-signed.
+//
+// The schemas are derived from the Go types of the bodies, following their
+// json tags. Named structs go into the components of the document and are
+// referenced from the operations.
+
+import (
+	"encoding"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// openAPIVersion is the version of the OpenAPI specification that the spec
+// follows.
+const openAPIVersion = "3.0.3"
+
+// RouteParam describes a query, path, or header parameter of an operation.
+type RouteParam struct {
+	Name        string
+	In          string // One of "query", "path", or "header"
+	Description string
+	Required    bool
+}
+
+// Operation describes one method of a route.
+type Operation struct {
+	Method  string
+	Summary string
+	Params  []RouteParam
+
+	// Request and Response are values of the types of the request and
+	// response bodies, nil if the body is empty or isn't JSON.
+	Request  interface{}
+	Response interface{}
+
+	// RequestType and ResponseType are the content types of the bodies
+	// when they aren't JSON.
+	RequestType  string
+	ResponseType string
+
+	Signed bool // Whether the response can be signed with ?signed=true, see api_signed_response.go
+	Binary bool // Whether the response is also available in the binary encoding, see api_binary.go
+}
+
+// Route describes an endpoint of the HTTP API.
+type Route struct {
+	Path       string
+	Feature    string // The optional feature that the endpoint belongs to, see serverFeatures
+	Internal   bool   // Only served when the internal APIs are allowed, see api_internal.go
+	Operations []Operation
+}
+
+// queryParam describes an optional query parameter.
+func queryParam(name string, description string) RouteParam {
+	return RouteParam{Name: name, In: "query", Description: description}
+}
+
+// requiredParam describes a query parameter that the request must have.
+func requiredParam(name string, description string) RouteParam {
+	return RouteParam{Name: name, In: "query", Description: description, Required: true}
+}
+
+// methods returns the methods of the route, in order of registration.
+func (route Route) methods() []string {
+	methods := make([]string, 0, len(route.Operations))
+	for _, op := range route.Operations {
+		methods = append(methods, op.Method)
+	}
+	return methods
+}
+
+// handleRoute attaches a handler to the mux and remembers the route, which
+// lets the spec and the tests go through every endpoint of the API. Requests
+// with a method that the route doesn't describe are refused before they
+// reach the handler.
+func (gcas *GCAServer) handleRoute(route Route, handler http.HandlerFunc) {
+	if route.Path == "" || len(route.Operations) == 0 {
+		panic(fmt.Sprintf("route %q has no operations", route.Path))
+	}
+	for _, op := range route.Operations {
+		if op.Method == "" || op.Summary == "" {
+			panic(fmt.Sprintf("route %q has an undescribed operation", route.Path))
+		}
+	}
+	allow := strings.Join(route.methods(), ", ")
+	refusal := "Only " + strings.Join(route.methods(), " and ") + " method is supported."
+	if len(route.Operations) > 1 {
+		refusal = "Only " + strings.Join(route.methods(), " and ") + " methods are supported."
+	}
+	v2 := strings.HasPrefix(route.Path, "/api/v2/")
+	gcas.routes = append(gcas.routes, route)
+	gcas.mux.HandleFunc(route.Path, func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range route.methods() {
+			if r.Method == method {
+				handler(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		if v2 {
+			gcas.writeAPIError(w, ErrCodeMethodNotAllowed, "only "+allow+" is supported")
+			return
+		}
+		gcas.writeError(w, ErrCodeMethodNotAllowed, refusal)
+	})
+}
+
+// APISpec is an OpenAPI 3 document that describes the HTTP API of a server.
+type APISpec struct {
+	OpenAPI     string                             `json:"openapi"`
+	Info        APISpecInfo                        `json:"info"`
+	Paths       map[string]map[string]APIOperation `json:"paths"`
+	Components  APIComponents                      `json:"components"`
+	APIVersions []int                              `json:"x-api-versions"`
+	Features    []string                           `json:"x-features"`
+}
+
+// APISpecInfo identifies the server that the spec describes.
+type APISpecInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// APIComponents holds the schemas that the operations refer to.
+type APIComponents struct {
+	Schemas map[string]*JSONSchema `json:"schemas"`
+}
+
+// APIOperation describes one method of a path.
+type APIOperation struct {
+	Summary     string                 `json:"summary"`
+	Parameters  []APIParameter         `json:"parameters,omitempty"`
+	RequestBody *APIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]APIResponse `json:"responses"`
+	Feature     string                 `json:"x-feature,omitempty"`
+	Signed      bool                   `json:"x-signed,omitempty"`
+}
+
+// APIParameter describes a parameter of an operation.
+type APIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Schema      *JSONSchema `json:"schema"`
+}
+
+// APIRequestBody describes the request body of an operation.
+type APIRequestBody struct {
+	Required bool                    `json:"required"`
+	Content  map[string]APIMediaType `json:"content"`
+}
+
+// APIResponse describes a response of an operation.
+type APIResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]APIMediaType `json:"content,omitempty"`
+}
+
+// APIMediaType pairs a content type with the schema of the body.
+type APIMediaType struct {
+	Schema *JSONSchema `json:"schema,omitempty"`
+}
+
+// JSONSchema is the subset of the OpenAPI schema object that the spec uses.
+type JSONSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+}
+
+// schemaOverrides are the schemas of the types whose JSON encoding doesn't
+// follow from their Go type.
+var schemaOverrides = map[reflect.Type]*JSONSchema{
+	reflect.TypeOf(OperatorScopes(0)): {Type: "array", Items: &JSONSchema{Type: "string"}},
+	reflect.TypeOf(time.Time{}):       {Type: "string", Format: "date-time"},
+	reflect.TypeOf(time.Duration(0)):  {Type: "integer", Format: "int64"},
+}
+
+// schemaBuilder derives schemas from Go types and collects the schemas of
+// named structs, which are referenced instead of inlined.
+type schemaBuilder struct {
+	schemas map[string]*JSONSchema
+}
+
+// schema returns the schema of the JSON encoding of the provided value.
+func (sb *schemaBuilder) schema(v interface{}) *JSONSchema {
+	return sb.typeSchema(reflect.TypeOf(v))
+}
+
+// typeSchema returns the schema of the JSON encoding of the provided type.
+func (sb *schemaBuilder) typeSchema(t reflect.Type) *JSONSchema {
+	if t == nil {
+		return &JSONSchema{}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if s, ok := schemaOverrides[t]; ok {
+		return s
+	}
+	if t.Implements(reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()) {
+		return &JSONSchema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &JSONSchema{Type: "integer", Format: "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JSONSchema{Type: "integer", Format: "uint64"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Slice:
+		// encoding/json writes byte slices as base64.
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &JSONSchema{Type: "string", Format: "byte"}
+		}
+		return &JSONSchema{Type: "array", Items: sb.typeSchema(t.Elem())}
+	case reflect.Array:
+		// Keys and signatures are arrays, which encoding/json writes
+		// as a list of numbers.
+		n := t.Len()
+		return &JSONSchema{Type: "array", Items: sb.typeSchema(t.Elem()), MinItems: &n, MaxItems: &n}
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: sb.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sb.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, exists := sb.schemas[name]; !exists {
+			// Reserve the name first, the struct may refer to
+			// itself.
+			sb.schemas[name] = &JSONSchema{}
+			*sb.schemas[name] = *sb.structSchema(t)
+		}
+		return &JSONSchema{Ref: "#/components/schemas/" + name}
+	}
+	// Interfaces can hold anything.
+	return &JSONSchema{}
+}
+
+// structSchema returns the schema of a struct, following the rules of
+// encoding/json for json tags and embedded structs.
+func (sb *schemaBuilder) structSchema(t reflect.Type) *JSONSchema {
+	s := &JSONSchema{Type: "object", Properties: make(map[string]*JSONSchema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for pname, ps := range sb.structSchema(ft).Properties {
+					if _, exists := s.Properties[pname]; !exists {
+						s.Properties[pname] = ps
+					}
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = sb.typeSchema(f.Type)
+	}
+	return s
+}
+
+// schemaName returns the name of a named type in the components of the
+// spec, which is qualified for the types that don't come from this package.
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if i := strings.Index(name, "["); i >= 0 {
+		name = name[:i]
+	}
+	if t.PkgPath() != reflect.TypeOf(Route{}).PkgPath() {
+		pkg := t.PkgPath()
+		pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+		name = pkg + "." + name
+	}
+	return name
+}
+
+// buildSpec assembles the spec of the routes on the mux.
+func (gcas *GCAServer) buildSpec() APISpec {
+	sb := &schemaBuilder{schemas: make(map[string]*JSONSchema)}
+	errorContent := map[string]APIMediaType{"application/json": {Schema: sb.schema(APIError{})}}
+	spec := APISpec{
+		OpenAPI:     openAPIVersion,
+		Info:        APISpecInfo{Title: "GCA server", Version: Build.Version},
+		Paths:       make(map[string]map[string]APIOperation),
+		APIVersions: apiVersions,
+		Features:    gcas.serverFeatures(),
+	}
+	for _, route := range gcas.routes {
+		if route.Internal && !gcas.allowIntApis {
+			continue
+		}
+		ops := make(map[string]APIOperation)
+		for _, op := range route.Operations {
+			ao := APIOperation{
+				Summary:   op.Summary,
+				Responses: map[string]APIResponse{"default": {Description: "The request failed", Content: errorContent}},
+				Feature:   route.Feature,
+				Signed:    op.Signed,
+			}
+			for _, p := range op.Params {
+				ao.Parameters = append(ao.Parameters, APIParameter{Name: p.Name, In: p.In, Description: p.Description, Required: p.Required || p.In == "path", Schema: &JSONSchema{Type: "string"}})
+			}
+			if op.Signed {
+				ao.Parameters = append(ao.Parameters, APIParameter{Name: "signed", In: "query", Description: "Set to true to get the response signed by the server", Schema: &JSONSchema{Type: "boolean"}})
+			}
+			if op.Request != nil {
+				ao.RequestBody = &APIRequestBody{Required: true, Content: map[string]APIMediaType{"application/json": {Schema: sb.schema(op.Request)}}}
+			} else if op.RequestType != "" {
+				ao.RequestBody = &APIRequestBody{Required: true, Content: map[string]APIMediaType{op.RequestType: {}}}
+			}
+			ok := APIResponse{Description: "The request succeeded", Content: make(map[string]APIMediaType)}
+			if op.Response != nil {
+				ok.Content["application/json"] = APIMediaType{Schema: sb.schema(op.Response)}
+			}
+			if op.ResponseType != "" {
+				ok.Content[op.ResponseType] = APIMediaType{}
+			}
+			if op.Binary {
+				ok.Content[glow.BinaryContentType] = APIMediaType{}
+			}
+			ao.Responses["200"] = ok
+			ops[strings.ToLower(op.Method)] = ao
+		}
+		spec.Paths[route.Path] = ops
+	}
+	spec.Components.Schemas = sb.schemas
+	return spec
+}
+
+// SpecHandler serves the spec of the HTTP API of the server.
+func (gcas *GCAServer) SpecHandler(w http.ResponseWriter, r *http.Request) {
+	gcas.writeJSONResponse(w, r, gcas.buildSpec())
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestAPISpec checks that every route on the mux shows up in the spec with
+// all of its methods, that every path in the spec refuses a method it doesn't
+// describe with the methods that it does, and that the schemas that the
+// operations refer to are in the components, both on a regular server and on
+// a server in internal test mode.
+func TestAPISpec(t *testing.T) {
+	server, dir, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAPISpec(t, server)
+	server.Close()
+
+	// A server in internal test mode also has the internal APIs and the
+	// debug endpoints.
+	server, err = NewGCAServer(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	checkAPISpec(t, server)
+}
+
+// checkAPISpec fetches the spec of the server and checks it against the
+// routes on its mux.
+func checkAPISpec(t *testing.T, server *GCAServer) {
+	t.Helper()
+	var spec APISpec
+	if status, code, err := server.getPage("v1/spec", &spec); err != nil || status != http.StatusOK {
+		t.Fatal("unable to get the spec:", status, code, err)
+	}
+	if spec.OpenAPI != openAPIVersion || spec.Info.Version != Build.Version || !reflect.DeepEqual(spec.Features, server.serverFeatures()) {
+		t.Fatalf("unexpected spec info: %v %+v %v", spec.OpenAPI, spec.Info, spec.Features)
+	}
+
+	// Every route is in the spec, and nothing else is. The internal APIs
+	// are only in the spec of a server that allows them.
+	served := 0
+	for _, route := range server.routes {
+		ops, exists := spec.Paths[route.Path]
+		if route.Internal && !server.allowIntApis {
+			if exists {
+				t.Fatalf("%v is in the spec while the internal APIs are off", route.Path)
+			}
+			continue
+		}
+		served++
+		if !exists {
+			t.Fatalf("%v is missing from the spec", route.Path)
+		}
+		if len(ops) != len(route.Operations) {
+			t.Fatalf("%v has %v operations in the spec", route.Path, len(ops))
+		}
+		for _, op := range route.Operations {
+			ao, exists := ops[strings.ToLower(op.Method)]
+			if !exists || ao.Summary != op.Summary || ao.Feature != route.Feature || ao.Signed != op.Signed {
+				t.Fatalf("%v %v is missing from the spec: %+v", op.Method, route.Path, ao)
+			}
+		}
+	}
+	if len(spec.Paths) != served {
+		t.Fatalf("the spec has %v paths for %v routes", len(spec.Paths), served)
+	}
+	_, debug := spec.Paths["/debug/state"]
+	_, internal := spec.Paths["/internal/set-time"]
+	if debug != (server.allowIntApis || server.staticDebug) || internal != server.allowIntApis {
+		t.Fatal("unexpected debug or internal routes in the spec:", debug, internal)
+	}
+
+	// Every path in the spec answers a probe with a method it doesn't have
+	// with the methods that it does have.
+	for path, ops := range spec.Paths {
+		url := fmt.Sprintf("http://127.0.0.1:%v%v", server.httpPort, strings.ReplaceAll(path, "{id}", "1"))
+		req, _ := http.NewRequest(http.MethodOptions, url, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		allow := strings.Split(resp.Header.Get("Allow"), ", ")
+		if resp.StatusCode != http.StatusMethodNotAllowed || len(allow) != len(ops) {
+			t.Fatalf("unexpected response to OPTIONS %v: %v %v", path, resp.StatusCode, allow)
+		}
+		for _, method := range allow {
+			if _, exists := ops[strings.ToLower(method)]; !exists {
+				t.Fatalf("%v allows %v, which is not in the spec", path, method)
+			}
+		}
+	}
+
+	// The responses refer to the schemas in the components.
+	ok := spec.Paths["/api/v1/device-bootstrap"]["get"].Responses["200"].Content["application/json"].Schema
+	schema, exists := spec.Components.Schemas[strings.TrimPrefix(ok.Ref, "#/components/schemas/")]
+	if !exists || schema.Properties["authorization"] == nil || schema.Properties["authorization"].Ref != "#/components/schemas/glow.EquipmentAuthorization" {
+		t.Fatalf("unexpected schema for the bootstrap document: %v %+v", ok.Ref, schema)
+	}
+	if _, exists := spec.Components.Schemas["glow.EquipmentAuthorization"]; !exists {
+		t.Fatal("the schema of the authorization is missing")
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+// api_stats_delta.go lets pollers follow the stats incrementally. An ETag
+// tells a poller that something changed, but not what, so it would still
+// have to download all of the stats to find the few new reports. Instead,
+// the server keeps the most recent changes to its state in a ring buffer,
+// each tagged with the state version that it produced, see api_etag.go, and
+// /api/v1/stats-delta?since_version=<n> returns the changes after version n
+// along with the current version.
+//
+// The buffer only covers the accepted reports, the authorizations, the
+// deauthorizations, the bans and the overrides of the GCA. Other changes, like impact rates or
+// heartbeats, bump the version without leaving an entry. The buffer holds a
+// fixed number of changes, and once the changes after a version have been
+// pushed out, a request for that version gets a 410 and the poller has to
+// download the full stats again. The same happens after a restart, as the
+// versions start over and the buffer starts out empty. The boot_id of the
+// response identifies the run of the server that the versions belong to.
+//
+// The all-device-stats responses of the current weeks carry the version that
+// their snapshot was built at in the X-State-Version header, which is where a
+// poller picks up the deltas after a full download. The snapshot may already
+// contain some of the changes after that version, applying a change twice
+// leaves the stats the same.
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// The kinds of state changes in the stats delta.
+const (
+	StateChangeReport          = "report"          // A report was accepted
+	StateChangeAuthorization   = "authorization"   // A device was authorized or imported
+	StateChangeBan             = "ban"             // A device was banned
+	StateChangeDeauthorization = "deauthorization" // A device was deauthorized, its reports from the timeslot on no longer count
+	StateChangeOverride        = "override"        // The GCA overrode the report of a timeslot
+)
+
+// StateChange is one change in the stats delta. The timeslot and the power
+// output are those of the report or the override, and the timeslot of a ban
+// is its ban timeslot, see ban_accounting.go. The timeslot of a
+// deauthorization is its cutoff.
+type StateChange struct {
+	Version     uint64 `json:"version"`
+	Kind        string `json:"kind"`
+	ShortID     uint32 `json:"short_id"`
+	PublicKey   string `json:"pubkey_hex,omitempty"`
+	Timeslot    uint32 `json:"timeslot,omitempty"`
+	PowerOutput uint64 `json:"power_output,omitempty"`
+}
+
+// StatsDeltaResponse is the response of the stats-delta endpoint. The changes
+// are in order of version.
+type StatsDeltaResponse struct {
+	BootID  string        `json:"boot_id"`
+	Version uint64        `json:"version"`
+	Changes []StateChange `json:"changes"`
+}
+
+// stateChangeLog is a ring buffer of the most recent state changes.
+type stateChangeLog struct {
+	changes []StateChange
+	start   int
+	count   int
+
+	// floor is the version before the oldest change in the log, the
+	// changes up to it are no longer known.
+	floor uint64
+}
+
+// newStateChangeLog returns a log that holds the provided number of changes.
+func newStateChangeLog(size int) *stateChangeLog {
+	return &stateChangeLog{changes: make([]StateChange, size)}
+}
+
+// add appends a change to the log, pushing out the oldest change if the log
+// is full.
+func (l *stateChangeLog) add(sc StateChange) {
+	if l.count == len(l.changes) {
+		l.floor = l.changes[l.start].Version
+		l.changes[l.start] = sc
+		l.start = (l.start + 1) % len(l.changes)
+		return
+	}
+	l.changes[(l.start+l.count)%len(l.changes)] = sc
+	l.count++
+}
+
+// reset empties the log, starting it over at the provided version.
+func (l *stateChangeLog) reset(version uint64) {
+	l.start = 0
+	l.count = 0
+	l.floor = version
+}
+
+// since returns the changes after the provided version. The bool is false if
+// some of those changes have been pushed out of the log.
+func (l *stateChangeLog) since(version uint64) ([]StateChange, bool) {
+	if version < l.floor {
+		return nil, false
+	}
+	changes := []StateChange{}
+	for i := 0; i < l.count; i++ {
+		sc := l.changes[(l.start+i)%len(l.changes)]
+		if sc.Version > version {
+			changes = append(changes, sc)
+		}
+	}
+	return changes, true
+}
+
+// recordStateChange bumps the state version and adds the change to the stats
+// delta under the new version. The mutex must be held.
+func (gcas *GCAServer) recordStateChange(sc StateChange) {
+	gcas.bumpStateVersion()
+	sc.Version = gcas.stateVersion
+	gcas.stateChanges.add(sc)
+}
+
+// recordDeviceChange records a change that concerns a device as a whole. A
+// ShortID that gets banned before it was authorized has no key. The mutex
+// must be held.
+func (gcas *GCAServer) recordDeviceChange(kind string, shortID uint32, pubkey glow.PublicKey, timeslot uint32) {
+	sc := StateChange{
+		Kind:     kind,
+		ShortID:  shortID,
+		Timeslot: timeslot,
+	}
+	if pubkey != (glow.PublicKey{}) {
+		sc.PublicKey = hex.EncodeToString(pubkey[:])
+	}
+	gcas.recordStateChange(sc)
+}
+
+// setStateVersionHeader tells the caller which state version a stats response
+// was built from. Snapshots of the history have no version.
+func setStateVersionHeader(w http.ResponseWriter, snap *statsSnapshot) {
+	if snap.version != 0 {
+		w.Header().Set("X-State-Version", strconv.FormatUint(snap.version, 10))
+	}
+}
+
+// StatsDeltaHandler returns the state changes after the 'since_version' query
+// parameter. If the changes are no longer known, or the version belongs to
+// another run of the server than the optional 'boot_id' parameter says, the
+// response is a 410 and the caller has to fetch the full stats again.
+func (gcas *GCAServer) StatsDeltaHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for a stats delta.")
+		return
+	}
+	since, err := strconv.ParseUint(r.URL.Query().Get("since_version"), 10, 64)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "since_version must be a state version")
+		return
+	}
+	bootID := r.URL.Query().Get("boot_id")
+
+	gcas.mu.RLock()
+	resp := StatsDeltaResponse{
+		BootID:  gcas.staticBootID,
+		Version: gcas.stateVersion,
+	}
+	changes, known := gcas.stateChanges.since(since)
+	gcas.mu.RUnlock()
+	if !known || since > resp.Version || (bootID != "" && bootID != resp.BootID) {
+		gcas.writeError(w, ErrCodeResyncRequired, "the changes since this version are no longer known, fetch the full stats")
+		return
+	}
+	resp.Changes = changes
+	gcas.writeJSONResponse(w, r, resp)
+}
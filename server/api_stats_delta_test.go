@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getStatsDelta fetches the changes after the provided version.
+func (gcas *GCAServer) getStatsDelta(since uint64, bootID string) (int, StatsDeltaResponse, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/stats-delta?since_version=%v&boot_id=%v", gcas.httpDialAddr(), since, bootID))
+	if err != nil {
+		return 0, StatsDeltaResponse{}, err
+	}
+	defer resp.Body.Close()
+	var delta StatsDeltaResponse
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(&delta)
+	}
+	return resp.StatusCode, delta, err
+}
+
+// TestStatsDelta drives a poller that keeps a copy of the power outputs of a
+// device through deltas, until it falls so far behind that it has to fetch
+// the full stats again.
+func TestStatsDelta(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{StateChangeBuffer: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(20)
+	defer glow.SetCurrentTimeslot(0)
+	ea, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The poller starts out with the full stats and the version that they
+	// were built at.
+	var version uint64
+	var bootID string
+	outputs := make(map[uint32]uint64)
+	resync := func() {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/all-device-stats?timeslot_offset=0", server.httpDialAddr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var ads AllDeviceStats
+		if err := json.NewDecoder(resp.Body).Decode(&ads); err != nil || len(ads.Devices) != 1 {
+			t.Fatal("unable to fetch the stats:", err, len(ads.Devices))
+		}
+		version, err = strconv.ParseUint(resp.Header.Get("X-State-Version"), 10, 64)
+		if err != nil {
+			t.Fatal("no state version:", err)
+		}
+		clear(outputs)
+		for i, output := range ads.Devices[0].PowerOutputs {
+			outputs[uint32(i)] = output
+		}
+	}
+	poll := func() (int, []StateChange) {
+		t.Helper()
+		status, delta, err := server.getStatsDelta(version, bootID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK {
+			return status, nil
+		}
+		bootID = delta.BootID
+		version = delta.Version
+		for _, sc := range delta.Changes {
+			if sc.Kind == StateChangeReport || sc.Kind == StateChangeOverride {
+				outputs[sc.Timeslot] = sc.PowerOutput
+			}
+		}
+		return status, delta.Changes
+	}
+	resync()
+
+	// New reports and an override show up in order.
+	for ts := uint32(1); ts <= 3; ts++ {
+		server.managedHandleEquipmentReport(generateTestReport(1, ts, priv))
+	}
+	ro := ReportOverride{PublicKey: ea.PublicKey, Timeslot: 2, PowerOutput: 50, Reason: "meter was reset", Timestamp: time.Now().Unix()}
+	if status, err := server.postReportOverride(ro, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("unable to override:", status, err)
+	}
+	status, changes := poll()
+	if status != http.StatusOK || len(changes) != 4 {
+		t.Fatalf("unexpected delta: %v %+v", status, changes)
+	}
+	for i, sc := range changes {
+		if sc.ShortID != 1 || (i > 0 && sc.Version <= changes[i-1].Version) {
+			t.Fatalf("unexpected change: %+v", sc)
+		}
+	}
+	if changes[2].Kind != StateChangeReport || changes[2].Timeslot != 3 || changes[3].Kind != StateChangeOverride || changes[3].PowerOutput != 50 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	if outputs[1] != 5 || outputs[2] != 50 || outputs[3] != 5 {
+		t.Fatal("the poller is out of date:", outputs[1], outputs[2], outputs[3])
+	}
+
+	// Nothing changed since the last poll.
+	if status, changes := poll(); status != http.StatusOK || len(changes) != 0 {
+		t.Fatalf("unexpected delta: %v %+v", status, changes)
+	}
+
+	// A poller that falls behind by more than the buffer gets a 410, and
+	// picks up the deltas again after a full download.
+	for ts := uint32(4); ts <= 10; ts++ {
+		server.managedHandleEquipmentReport(generateTestReport(1, ts, priv))
+	}
+	if status, _ := poll(); status != http.StatusGone {
+		t.Fatal("expected a 410 for a version that aged out:", status)
+	}
+	resync()
+	if outputs[10] != 5 {
+		t.Fatal("the full stats are out of date")
+	}
+	server.managedHandleEquipmentReport(generateTestReport(1, 11, priv))
+	if status, changes := poll(); status != http.StatusOK || len(changes) != 1 || changes[0].Timeslot != 11 || outputs[11] != 5 {
+		t.Fatalf("unexpected delta after the resync: %v %+v", status, changes)
+	}
+
+	// A ban and a new device are changes too.
+	er := glow.EquipmentReport{ShortID: 1, Timeslot: 11, PowerOutput: 9}
+	er.Signature = glow.Sign(er.SigningBytes(), priv)
+	server.managedHandleEquipmentReport(er.Serialize())
+	_, priv2, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, changes = poll()
+	if status != http.StatusOK || len(changes) != 2 {
+		t.Fatalf("unexpected delta: %v %+v", status, changes)
+	}
+	if changes[0].Kind != StateChangeBan || changes[0].Timeslot != 11 || changes[0].PublicKey == "" || changes[1].Kind != StateChangeAuthorization || changes[1].ShortID != 2 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	server.managedHandleEquipmentReport(generateTestReport(2, 1, priv2))
+	if status, changes := poll(); status != http.StatusOK || len(changes) != 1 || changes[0].ShortID != 2 {
+		t.Fatalf("unexpected delta: %v %+v", status, changes)
+	}
+
+	// Versions from the future and from another run of the server are
+	// unknown, and the version has to be a number.
+	if status, _, _ := server.getStatsDelta(version+1, bootID); status != http.StatusGone {
+		t.Fatal("expected a 410 for a future version:", status)
+	}
+	if status, _, _ := server.getStatsDelta(version, "other"); status != http.StatusGone {
+		t.Fatal("expected a 410 for another boot:", status)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/stats-delta?since_version=x", server.httpDialAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected a 400 for a bad version:", resp.StatusCode)
+	}
+}
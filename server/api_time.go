@@ -0,0 +1,68 @@
+package server
+
+// api_time.go contains the endpoints that let devices measure the drift of
+// their clocks against the server. A device with a drifting clock signs
+// reports for the wrong timeslot, and its data either lands in the wrong
+// timeslot or gets rejected as stale.
+//
+// The time is available over HTTP, and over UDP with a time probe for devices
+// that are behind a NAT or can't afford the overhead of HTTP. The UDP
+// response is signed, and is smaller than the probe so that the listener
+// can't be used for amplification. Probes from everyone share one budget,
+// which bounds the time that the listener spends signing responses.
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TimeResponse contains the current time of the server.
+type TimeResponse struct {
+	Unix        int64  `json:"unix"`         // Unix time in seconds
+	UnixMilli   int64  `json:"unix_ms"`      // Unix time in milliseconds
+	Timeslot    uint32 `json:"timeslot"`     // The current timeslot
+	GenesisTime int64  `json:"genesis_time"` // The unix time at which timeslot 0 begins
+}
+
+// TimeHandler returns the current time of the server.
+func (gcas *GCAServer) TimeHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for the time.")
+		return
+	}
+	now := gcas.now()
+	gcas.writeJSONResponse(w, r, TimeResponse{
+		Unix:        now.Unix(),
+		UnixMilli:   now.UnixMilli(),
+		Timeslot:    gcas.currentTimeslot(),
+		GenesisTime: glow.GenesisTime,
+	})
+}
+
+// handleTimeProbe answers a time probe that arrived over UDP, if the probe is
+// well formed and within the budget of time probes.
+func (server *GCAServer) handleTimeProbe(udpConn *net.UDPConn, addr *net.UDPAddr, rawData []byte) {
+	tp, err := glow.DeserializeTimeProbe(rawData)
+	if err != nil {
+		server.logger.WithFields("remote", addr, "size", len(rawData), "outcome", "malformed_packet").Warn("udp packet rejected")
+		server.staticMetrics.RecordMalformedPacket()
+		return
+	}
+	if !server.staticTimeProbes.allow(server.now().UnixNano(), int64(timeProbeInterval), timeProbeBurst) {
+		return
+	}
+	tpr := glow.TimeProbeResponse{
+		Nonce:     tp.Nonce,
+		UnixMilli: server.now().UnixMilli(),
+		Timeslot:  server.currentTimeslot(),
+	}
+	tpr.Signature = glow.Sign(tpr.SigningBytes(), server.staticPrivateKey)
+	_, err = udpConn.WriteToUDP(tpr.Serialize(), addr)
+	if err != nil && !server.tg.IsStopped() {
+		server.logger.Warn("Failed to send time probe response: ", err)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// sendTimeProbe sends a raw packet to the UDP listener and waits briefly for a
+// time probe response. A nil response is returned if nothing arrives.
+func (gcas *GCAServer) sendTimeProbe(probe []byte) (*glow.TimeProbeResponse, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(serverIP, strconv.Itoa(int(gcas.udpPort))))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(probe); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, nil
+	}
+	if n >= len(probe) {
+		return nil, fmt.Errorf("response is not smaller than the probe: %v >= %v", n, len(probe))
+	}
+	tpr, err := glow.DeserializeTimeProbeResponse(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	return &tpr, nil
+}
+
+// TestTime checks the time endpoint and the signed responses to time probes.
+func TestTime(t *testing.T) {
+	glow.SetCurrentTimeslot(25)
+	defer glow.SetCurrentTimeslot(0)
+	server, _, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// The time over HTTP.
+	before := time.Now()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/time", server.httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tr TimeResponse
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Timeslot != 25 || tr.GenesisTime != glow.GenesisTime || tr.UnixMilli < before.UnixMilli() || tr.UnixMilli > time.Now().UnixMilli() || tr.Unix != tr.UnixMilli/1000 {
+		t.Fatalf("unexpected time: %+v", tr)
+	}
+	resp, err = http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/time", server.httpPort), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("expected a POST to be rejected:", resp.StatusCode)
+	}
+
+	// The time over UDP.
+	before = time.Now()
+	tp := glow.TimeProbe{Nonce: 77}
+	tpr, err := server.sendTimeProbe(tp.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tpr == nil {
+		t.Fatal("no response to the time probe")
+	}
+	if tpr.Nonce != 77 || tpr.Timeslot != 25 || tpr.UnixMilli < before.UnixMilli() || tpr.UnixMilli > time.Now().UnixMilli() {
+		t.Fatalf("unexpected response: %+v", *tpr)
+	}
+	if !glow.Verify(server.staticPublicKey, tpr.SigningBytes(), tpr.Signature) {
+		t.Fatal("response has a bad signature")
+	}
+
+	// A packet with the size of a probe but the wrong prefix gets no
+	// response.
+	tpr, err = server.sendTimeProbe(make([]byte, glow.TimeProbeSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tpr != nil {
+		t.Fatal("expected no response to a malformed probe")
+	}
+}
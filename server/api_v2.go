@@ -0,0 +1,797 @@
+package server
+
+// api_v2.go contains the /api/v2 routes, which serve the same data as the v1
+// read endpoints with a consistent JSON shape. The v1 routes are left exactly
+// as they are, the v2 handlers are wrappers around the same state.
+//
+// Every v2 response follows the same rules:
+//
+//   - field names are snake_case
+//   - public keys and signatures are hex encoded strings
+//   - timeslots are absolute, and every timeslot field 'x_timeslot' (or just
+//     'timeslot') is paired with a field 'x_unix' (or just 'unix') that holds
+//     the unix time at which the timeslot starts
+//   - errors are always the structured errors of api_errors.go, regardless of
+//     ServerOptions.LegacyErrors
+//
+// The v2 routes accept the same query parameters as their v1 counterparts,
+// including 'signed=true'. The geo-stats endpoint depends on third party data
+// and is not part of v2 yet.
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// V2Equipment is an equipment authorization.
+type V2Equipment struct {
+	ShortID                uint32  `json:"short_id"`
+	PublicKey              string  `json:"pubkey"`
+	Version                uint8   `json:"version"`
+	Latitude               float64 `json:"latitude"`
+	Longitude              float64 `json:"longitude"`
+	Capacity               uint64  `json:"capacity"`       // Milliwatthours per timeslot, as signed
+	CapacityWatts          float64 `json:"capacity_watts"` // The same capacity as an average power
+	Debt                   uint64  `json:"debt"`
+	ExpirationTimeslot     uint32  `json:"expiration_timeslot"`
+	ExpirationUnix         int64   `json:"expiration_unix"`
+	InitializationTimeslot uint32  `json:"initialization_timeslot"`
+	InitializationUnix     int64   `json:"initialization_unix"`
+	ProtocolFee            uint64  `json:"protocol_fee"`
+	Nonce                  uint64  `json:"nonce"`
+	Signature              string  `json:"signature"`
+
+	// Note is the current annotation of the GCA on the device, see
+	// device_notes.go. The full history is at /api/v1/device-notes.
+	Note *V2DeviceNote `json:"note,omitempty"`
+}
+
+// V2DeviceNote is an annotation from the GCA on a device.
+type V2DeviceNote struct {
+	Note      string            `json:"note,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+	Signature string            `json:"signature"`
+}
+
+// V2EquipmentResponse lists the active equipment, sorted by ShortID.
+type V2EquipmentResponse struct {
+	Equipment  []V2Equipment `json:"equipment"`
+	NextCursor string        `json:"next_cursor,omitempty"` // Continues after this page, see page_cursors.go
+}
+
+// V2AuthorizedServer is a GCA server that the GCA has authorized.
+type V2AuthorizedServer struct {
+	PublicKey        string `json:"pubkey"`
+	Banned           bool   `json:"banned"`
+	Location         string `json:"location"`
+	HttpPort         uint16 `json:"http_port"`
+	TcpPort          uint16 `json:"tcp_port"`
+	UdpPort          uint16 `json:"udp_port"`
+	GCAAuthorization string `json:"gca_authorization"`
+}
+
+// V2AuthorizedServersResponse lists the authorized servers.
+type V2AuthorizedServersResponse struct {
+	Servers []V2AuthorizedServer `json:"servers"`
+}
+
+// V2Report is a signed report from a device. Banned timeslots are reported
+// with 'banned' set and no power output.
+type V2Report struct {
+	ShortID     uint32 `json:"short_id"`
+	Timeslot    uint32 `json:"timeslot"`
+	Unix        int64  `json:"unix"`
+	PowerOutput int64  `json:"power_output"`
+	Banned      bool   `json:"banned"`
+	Signature   string `json:"signature"`
+}
+
+// V2RecentReportsResponse contains the reports that the server holds in
+// memory for a device, skipping the timeslots without a report.
+type V2RecentReportsResponse struct {
+	ShortID       uint32     `json:"short_id"`
+	PublicKey     string     `json:"pubkey"`
+	StartTimeslot uint32     `json:"start_timeslot"`
+	StartUnix     int64      `json:"start_unix"`
+	Reports       []V2Report `json:"reports"`
+}
+
+// V2DeviceStats contains the weekly statistics of one device. Underflowed
+// power outputs are negative. Only the fields that were picked with the
+// 'fields' query parameter get encoded, see stats_fields.go.
+type V2DeviceStats struct {
+	PublicKey    string          `json:"pubkey"`
+	ShortID      *uint32         `json:"short_id,omitempty"` // Null if the device is no longer known to the server
+	PowerOutputs []int64         `json:"power_outputs"`
+	ImpactRates  []float64       `json:"impact_rates"`
+	Totals       *V2DeviceTotals `json:"totals,omitempty"`
+	Region       string          `json:"region,omitempty"`      // The WattTime region, empty if looked up from the coordinates
+	SigningKey   string          `json:"signing_key,omitempty"` // The key that the device rotated to, empty if it never rotated
+
+	// The indexes of the impact rates that were filled from stale data.
+	StaleImpactRates []int `json:"stale_impact_rates,omitempty"`
+
+	// The indexes of the power outputs that the GCA corrected, and of the
+	// ones that it filled in for an outage.
+	CorrectedTimeslots []int `json:"corrected_timeslots,omitempty"`
+	OutageTimeslots    []int `json:"outage_timeslots,omitempty"`
+
+	// The indexes of the power outputs that hold a negative or garbage
+	// reading, which count as no production, see glow.CreditedPowerOutput.
+	UncreditedTimeslots []int `json:"uncredited_timeslots,omitempty"`
+
+	// The most recent timeslot with a report and its start, null if the
+	// device has never reported, and whether that was within the last
+	// online_timeslots.
+	LastSeenTimeslot *uint32 `json:"last_seen_timeslot"`
+	LastSeenUnix     *int64  `json:"last_seen_unix"`
+	Online           bool    `json:"online"`
+
+	// The coordinates of the device, and the current note of the GCA on
+	// the device, see device_notes.go.
+	Location *V2Location   `json:"location,omitempty"`
+	Note     *V2DeviceNote `json:"note,omitempty"`
+
+	// The uptime of the device over the elapsed part of the week, null for
+	// the weeks that are no longer in memory, see heartbeats.go.
+	Uptime *V2DeviceUptime `json:"uptime,omitempty"`
+
+	// The authorization of the device as the GCA signed it, left out for
+	// devices that are no longer known to the server. The note is never
+	// set here, it has its own field.
+	Authorization *V2Equipment `json:"authorization,omitempty"`
+
+	// Whether the device is banned, and the timeslot from which on its
+	// reports don't count, see ban_accounting.go. Both are left out for
+	// devices that aren't banned.
+	Banned      bool    `json:"banned,omitempty"`
+	BanTimeslot *uint32 `json:"ban_timeslot,omitempty"`
+
+	fields statsFields // The fields that get encoded, zero for the default
+}
+
+// V2DeviceTotals adds up the power outputs of a device over a week.
+type V2DeviceTotals struct {
+	Energy          int64   `json:"energy"`               // The sum of the credited power outputs
+	Impact          float64 `json:"impact"`               // The sum of the credited power outputs times their impact rates
+	Reports         uint32  `json:"reports"`              // The timeslots with a power output, including banned timeslots
+	BannedTimeslots uint32  `json:"banned_timeslots"`     // The timeslots that were banned
+	RawEnergy       *int64  `json:"raw_energy,omitempty"` // The sum of the readings, only set if it isn't the energy
+}
+
+// V2DeviceUptime describes how much of the elapsed part of a week a device
+// was alive for. A device is alive during a timeslot if it sent a report or a
+// heartbeat for it.
+type V2DeviceUptime struct {
+	Percent             float64 `json:"percent"`               // The share of the elapsed timeslots that the device was alive for
+	Timeslots           uint32  `json:"timeslots"`             // The elapsed timeslots of the week
+	ReportedTimeslots   uint32  `json:"reported_timeslots"`    // The timeslots with a report
+	IdleTimeslots       uint32  `json:"idle_timeslots"`        // The timeslots with a heartbeat that read no production
+	MeterFaultTimeslots uint32  `json:"meter_fault_timeslots"` // The timeslots with a heartbeat that reported a meter fault
+}
+
+// V2Location contains the coordinates of a device.
+type V2Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// V2AllDeviceStatsResponse contains the statistics of every device for a
+// week. The signature is the same one that the v1 route returns, and covers
+// the SigningBytes of the matching AllDeviceStats.
+type V2AllDeviceStatsResponse struct {
+	WeekStartTimeslot uint32          `json:"week_start_timeslot"`
+	WeekStartUnix     int64           `json:"week_start_unix"`
+	TotalDevices      int             `json:"total_devices"`
+	Devices           []V2DeviceStats `json:"devices"`
+	Signature         string          `json:"signature,omitempty"`   // Left out unless pubkey, power_outputs and impact_rates are picked
+	NextCursor        string          `json:"next_cursor,omitempty"` // Continues after this page, see page_cursors.go
+	Build             BuildInfo       `json:"build"`
+}
+
+// V2DeviceSummary contains the summary statistics of a device for the
+// current week. The last seen fields are zero if the device has not
+// reported.
+type V2DeviceSummary struct {
+	ShortID            uint32  `json:"short_id"`
+	PublicKey          string  `json:"pubkey"`
+	WeekStartTimeslot  uint32  `json:"week_start_timeslot"`
+	WeekStartUnix      int64   `json:"week_start_unix"`
+	ReportsReceived    uint32  `json:"reports_received"`
+	BannedTimeslots    uint32  `json:"banned_timeslots"`
+	TotalEnergy        int64   `json:"total_energy"`
+	RawEnergy          int64   `json:"raw_energy"`
+	AveragePower       float64 `json:"average_power"`
+	CorrectedTimeslots uint32  `json:"corrected_timeslots"`
+	OutageTimeslots    uint32  `json:"outage_timeslots"`
+	MissedTimeslots    uint32  `json:"missed_timeslots"`
+	LastSeenTimeslot   uint32  `json:"last_seen_timeslot"`
+	LastSeenUnix       int64   `json:"last_seen_unix"`
+	HasReported        bool    `json:"has_reported"`
+	Online             bool    `json:"online"`
+}
+
+// V2ReportGap is a run of timeslots without reports, both ends inclusive.
+type V2ReportGap struct {
+	StartTimeslot uint32 `json:"start_timeslot"`
+	StartUnix     int64  `json:"start_unix"`
+	EndTimeslot   uint32 `json:"end_timeslot"`
+	EndUnix       int64  `json:"end_unix"`
+	Length        uint32 `json:"length"`
+	Cause         string `json:"cause"` // "device", or "server" if the server was down or degraded
+}
+
+// V2DeviceReportGaps contains the gaps of a single device.
+type V2DeviceReportGaps struct {
+	ShortID   uint32        `json:"short_id"`
+	PublicKey string        `json:"pubkey"`
+	Gaps      []V2ReportGap `json:"gaps"`
+}
+
+// V2ReportGapsResponse contains the gaps of each requested device over the
+// period [period_start, period_end).
+type V2ReportGapsResponse struct {
+	PeriodStartTimeslot uint32               `json:"period_start_timeslot"`
+	PeriodStartUnix     int64                `json:"period_start_unix"`
+	PeriodEndTimeslot   uint32               `json:"period_end_timeslot"`
+	PeriodEndUnix       int64                `json:"period_end_unix"`
+	Devices             []V2DeviceReportGaps `json:"devices"`
+}
+
+// V2FlaggedReport is a report that is waiting for review by the GCA.
+type V2FlaggedReport struct {
+	ShortID     uint32 `json:"short_id"`
+	PublicKey   string `json:"pubkey"`
+	Timeslot    uint32 `json:"timeslot"`
+	Unix        int64  `json:"unix"`
+	PowerOutput int64  `json:"power_output"`
+	Capacity    uint64 `json:"capacity"`
+	Signature   string `json:"signature"`
+}
+
+// V2EquivocationProof shows that a device signed two different reports for
+// the same timeslot.
+type V2EquivocationProof struct {
+	Authorization V2Equipment `json:"authorization"`
+	First         V2Report    `json:"first"`
+	Second        V2Report    `json:"second"`
+}
+
+// V2BannedEquipment describes a banned device. Exactly one of
+// 'authorizations' and 'equivocation' is set, depending on the reason.
+type V2BannedEquipment struct {
+	ShortID        uint32               `json:"short_id"`
+	PublicKey      string               `json:"pubkey"`
+	Reason         string               `json:"reason"`
+	BanTimeslot    uint32               `json:"ban_timeslot"`
+	BanUnix        int64                `json:"ban_unix"`
+	Authorizations []V2Equipment        `json:"authorizations,omitempty"`
+	Equivocation   *V2EquivocationProof `json:"equivocation,omitempty"`
+}
+
+// V2BannedEquipmentResponse lists the banned equipment, sorted by ShortID.
+type V2BannedEquipmentResponse struct {
+	Equipment []V2BannedEquipment `json:"equipment"`
+}
+
+// v2RequireGet writes an error and returns false if the request is not a GET
+// request.
+func (gcas *GCAServer) v2RequireGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		gcas.writeAPIError(w, ErrCodeMethodNotAllowed, "only GET is supported")
+		return false
+	}
+	return true
+}
+
+// v2Hex hex encodes a key or a signature.
+func v2Hex(b []byte) string {
+	return hex.EncodeToString(b)
+}
+
+// v2Equipment converts an equipment authorization to its v2 form.
+func v2Equipment(ea glow.EquipmentAuthorization) V2Equipment {
+	return V2Equipment{
+		ShortID:                ea.ShortID,
+		PublicKey:              v2Hex(ea.PublicKey[:]),
+		Version:                ea.Version,
+		Latitude:               ea.Latitude,
+		Longitude:              ea.Longitude,
+		Capacity:               ea.Capacity,
+		CapacityWatts:          capacityWatts(ea.Capacity),
+		Debt:                   ea.Debt,
+		ExpirationTimeslot:     ea.Expiration,
+		ExpirationUnix:         glow.TimeslotToUnix(ea.Expiration),
+		InitializationTimeslot: ea.Initialization,
+		InitializationUnix:     glow.TimeslotToUnix(ea.Initialization),
+		ProtocolFee:            ea.ProtocolFee,
+		Nonce:                  ea.Nonce,
+		Signature:              v2Hex(ea.Signature[:]),
+	}
+}
+
+// capacityWatts converts a capacity in milliwatthours per timeslot to watts.
+// A timeslot is 5 minutes, so there are 12 of them in an hour.
+func capacityWatts(capacity uint64) float64 {
+	return float64(capacity) * 12 / 1000
+}
+
+// v2DeviceNote converts a note to its v2 form.
+func v2DeviceNote(dn DeviceNote) *V2DeviceNote {
+	return &V2DeviceNote{Note: dn.Note, Fields: dn.Fields, Timestamp: dn.Timestamp, Signature: v2Hex(dn.Signature[:])}
+}
+
+// v2Report converts a report to its v2 form.
+func v2Report(er glow.EquipmentReport) V2Report {
+	v2r := V2Report{
+		ShortID:   er.ShortID,
+		Timeslot:  er.Timeslot,
+		Unix:      glow.TimeslotToUnix(er.Timeslot),
+		Signature: v2Hex(er.Signature[:]),
+	}
+	if er.PowerOutput == 1 {
+		v2r.Banned = true
+	} else {
+		v2r.PowerOutput = int64(er.PowerOutput)
+	}
+	return v2r
+}
+
+// v2LookupDevice finds the ShortID of the device named by the 'pubkey' or
+// 'short_id' query parameter, of which exactly one must be set. On failure
+// the error response has already been written. The server mutex must be
+// held.
+func (gcas *GCAServer) v2LookupDevice(w http.ResponseWriter, q url.Values) (uint32, bool) {
+	pkStr := q.Get("pubkey")
+	sidStr := q.Get("short_id")
+	if (pkStr == "") == (sidStr == "") {
+		gcas.writeAPIError(w, ErrCodeMalformedRequest, "exactly one of pubkey or short_id must be provided")
+		return 0, false
+	}
+	var shortID uint32
+	if pkStr != "" {
+		pk, err := glow.ParsePublicKey(pkStr)
+		if err != nil {
+			gcas.writeAPIError(w, ErrCodeMalformedRequest, "invalid pubkey")
+			return 0, false
+		}
+		var exists bool
+		shortID, exists = gcas.equipmentShortID[pk]
+		if !exists {
+			gcas.writeAPIError(w, ErrCodeUnknownDevice, "unknown device")
+			return 0, false
+		}
+	} else {
+		sid, err := strconv.ParseUint(sidStr, 10, 32)
+		if err != nil {
+			gcas.writeAPIError(w, ErrCodeMalformedRequest, "invalid short_id")
+			return 0, false
+		}
+		shortID = uint32(sid)
+	}
+	if _, exists := gcas.equipmentReports[shortID]; !exists {
+		gcas.writeAPIError(w, ErrCodeUnknownDevice, "unknown device")
+		return 0, false
+	}
+	return shortID, true
+}
+
+// V2EquipmentHandler lists the active equipment, along with the current note
+// of the GCA on every device.
+func (gcas *GCAServer) V2EquipmentHandler(w http.ResponseWriter, r *http.Request) {
+	if !gcas.v2RequireGet(w, r) {
+		return
+	}
+	// The listing can be paged with 'limit' and 'cursor', see
+	// page_cursors.go.
+	q := r.URL.Query()
+	var limit int
+	if str := q.Get("limit"); str != "" {
+		l, err := strconv.ParseUint(str, 10, 31)
+		if err != nil {
+			gcas.writeAPIError(w, ErrCodeMalformedRequest, "invalid limit format")
+			return
+		}
+		limit = int(l)
+	}
+	var el *equipmentListing
+	page := []V2Equipment{}
+	if str := q.Get("cursor"); str != "" {
+		pc, err := decodePageCursor(str)
+		if err == nil && pc.kind != pageKindEquipment {
+			err = withCode(ErrCodeMalformedRequest, errors.New("the cursor does not belong to the equipment listing"))
+		}
+		var value interface{}
+		if err == nil {
+			value, err = gcas.pageSnapshotValue(pc)
+		}
+		if err != nil {
+			gcas.writeAPIError(w, errorCode(err, ErrCodeMalformedRequest), err.Error())
+			return
+		}
+		el = value.(*equipmentListing)
+		start := sort.Search(len(el.equipment), func(i int) bool { return el.equipment[i].ShortID > pc.shortID })
+		page = el.equipment[start:]
+	} else {
+		el = gcas.managedEquipmentListing()
+		page = el.equipment
+	}
+	more := limit > 0 && limit < len(page)
+	if more {
+		page = page[:limit]
+	}
+	gcas.writeJSONResponse(w, r, V2EquipmentResponse{
+		Equipment:  page,
+		NextCursor: gcas.equipmentNextCursor(el, page, more),
+	})
+}
+
+// managedEquipmentListing returns the authorized equipment that hasn't been
+// deauthorized, in order of ShortID.
+func (gcas *GCAServer) managedEquipmentListing() *equipmentListing {
+	el := &equipmentListing{equipment: []V2Equipment{}}
+	gcas.mu.RLock()
+	el.version = gcas.stateVersion
+	for _, ea := range gcas.equipment {
+		if _, exists := gcas.equipmentDeauthorizations[ea.PublicKey]; exists {
+			continue
+		}
+		v2e := v2Equipment(ea)
+		if dn, exists := gcas.latestDeviceNote(ea.PublicKey); exists {
+			v2e.Note = v2DeviceNote(dn)
+		}
+		el.equipment = append(el.equipment, v2e)
+	}
+	gcas.mu.RUnlock()
+	sort.Slice(el.equipment, func(i, j int) bool { return el.equipment[i].ShortID < el.equipment[j].ShortID })
+	return el
+}
+
+// V2AuthorizedServersHandler lists the authorized servers.
+func (gcas *GCAServer) V2AuthorizedServersHandler(w http.ResponseWriter, r *http.Request) {
+	if !gcas.v2RequireGet(w, r) {
+		return
+	}
+	resp := V2AuthorizedServersResponse{Servers: []V2AuthorizedServer{}}
+	for _, as := range gcas.AuthorizedServers() {
+		resp.Servers = append(resp.Servers, V2AuthorizedServer{
+			PublicKey:        v2Hex(as.PublicKey[:]),
+			Banned:           as.Banned,
+			Location:         as.Location,
+			HttpPort:         as.HttpPort,
+			TcpPort:          as.TcpPort,
+			UdpPort:          as.UdpPort,
+			GCAAuthorization: v2Hex(as.GCAAuthorization[:]),
+		})
+	}
+	gcas.writeJSONResponse(w, r, resp)
+}
+
+// V2RecentReportsHandler returns the reports held in memory for a device, or
+// the reports of the retained period given by the 'period' query parameter,
+// see retained_periods.go.
+func (gcas *GCAServer) V2RecentReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if !gcas.v2RequireGet(w, r) {
+		return
+	}
+	period, hasPeriod, err := gcas.parsePeriod(r.URL.Query())
+	if err != nil {
+		gcas.writeAPIError(w, ErrCodeMalformedRequest, err.Error())
+		return
+	}
+	gcas.mu.RLock()
+	shortID, ok := gcas.v2LookupDevice(w, r.URL.Query())
+	if !ok {
+		gcas.mu.RUnlock()
+		return
+	}
+	ero := gcas.equipmentReportsOffset
+	pk := gcas.equipment[shortID].PublicKey
+	var ers []glow.EquipmentReport
+	if !hasPeriod {
+		reports := gcas.equipmentReports[shortID]
+		for i := range reports.PowerOutputs {
+			if reports.PowerOutputs[i] != 0 {
+				ers = append(ers, reports.report(shortID, ero, i))
+			}
+		}
+		err = gcas.loadReportSignatures(ers)
+	}
+	gcas.mu.RUnlock()
+	if hasPeriod {
+		var drw deviceReportWindow
+		drw, err = gcas.managedDeviceReportWindow(pk, &period)
+		if errorCode(err, "") != "" {
+			gcas.writeAPIError(w, errorCode(err, ""), err.Error())
+			return
+		}
+		ero = drw.offset
+		for _, er := range drw.reports {
+			if er.PowerOutput != 0 {
+				ers = append(ers, er)
+			}
+		}
+	}
+	if err != nil {
+		gcas.logger.Errorf("unable to load report signatures: %v", err)
+		gcas.writeAPIError(w, ErrCodeInternalError, "unable to load reports")
+		return
+	}
+	resp := V2RecentReportsResponse{
+		ShortID:       shortID,
+		PublicKey:     v2Hex(pk[:]),
+		StartTimeslot: ero,
+		StartUnix:     glow.TimeslotToUnix(ero),
+		Reports:       []V2Report{},
+	}
+	for _, er := range ers {
+		resp.Reports = append(resp.Reports, v2Report(er))
+	}
+	gcas.writeJSONResponse(w, r, resp)
+}
+
+// V2AllDeviceStatsHandler returns the statistics of every device for the
+// week given by the 'timeslot_offset' query parameter.
+func (gcas *GCAServer) V2AllDeviceStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !gcas.v2RequireGet(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	tso, err := gcas.statsTimeslotOffset(q)
+	if err != nil {
+		gcas.writeAPIError(w, ErrCodeMalformedRequest, err.Error())
+		return
+	}
+	if tso%2016 != 0 {
+		gcas.writeAPIError(w, ErrCodeMalformedRequest, "timeslot_offset must be a multiple of 2016")
+		return
+	}
+	dsf, err := parseDeviceStatsFilter(q)
+	if err != nil {
+		gcas.writeAPIError(w, ErrCodeMalformedRequest, err.Error())
+		return
+	}
+	fields, err := parseStatsFields(q)
+	if err != nil {
+		gcas.writeAPIError(w, ErrCodeMalformedRequest, err.Error())
+		return
+	}
+	snap, err := gcas.managedPagedStatsSnapshot(tso, dsf)
+	if errorCode(err, "") == ErrCodeLoading {
+		writeLoadingError(w, gcas.writeAPIError)
+		return
+	}
+	if err != nil {
+		gcas.writeAPIError(w, errorCode(err, ErrCodeMalformedRequest), err.Error())
+		return
+	}
+	now := gcas.currentTimeslot()
+	etag := timeslotETag(snap.etag, now)
+	setStateVersionHeader(w, snap)
+	if etagMatches(r, etag) {
+		writeNotModified(w, etag)
+		return
+	}
+
+	// The devices are built straight from the snapshot, so that the fields
+	// that weren't picked never get copied. Only a response that can be
+	// verified gets the copy that the signature needs.
+	page, total, more := pageDeviceStats(snap.stats, dsf, snap.shortIDs)
+	cutoff := dsf.cutoff(tso)
+	resp := V2AllDeviceStatsResponse{
+		WeekStartTimeslot: tso,
+		WeekStartUnix:     glow.TimeslotToUnix(tso),
+		TotalDevices:      total,
+		Devices:           make([]V2DeviceStats, 0, len(page)),
+		NextCursor:        gcas.statsNextCursor(snap, page, more),
+		Build:             Build,
+	}
+	if fields.has(statsFieldsSigned) {
+		stats := copyDeviceStatsPage(snap.stats, page, total, cutoff)
+		gcas.signDeviceStats(&stats)
+		resp.Signature = v2Hex(stats.Signature[:])
+	}
+	for _, i := range page {
+		resp.Devices = append(resp.Devices, snap.v2DeviceStats(&snap.stats.Devices[i], fields, cutoff, now))
+	}
+	w.Header().Set("ETag", etag)
+	gcas.writeJSONResponse(w, r, resp)
+}
+
+// V2DeviceSummaryHandler returns the summary of the device named by the
+// 'pubkey' or 'short_id' query parameter.
+func (gcas *GCAServer) V2DeviceSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	if !gcas.v2RequireGet(w, r) {
+		return
+	}
+	gcas.mu.RLock()
+	shortID, ok := gcas.v2LookupDevice(w, r.URL.Query())
+	if !ok {
+		gcas.mu.RUnlock()
+		return
+	}
+	ds := gcas.buildDeviceSummary(shortID, gcas.currentTimeslot())
+	gcas.mu.RUnlock()
+
+	resp := V2DeviceSummary{
+		ShortID:            ds.ShortID,
+		PublicKey:          v2Hex(ds.PublicKey[:]),
+		WeekStartTimeslot:  ds.WeekStart,
+		WeekStartUnix:      glow.TimeslotToUnix(ds.WeekStart),
+		ReportsReceived:    ds.ReportsReceived,
+		BannedTimeslots:    ds.BannedTimeslots,
+		TotalEnergy:        ds.TotalEnergy,
+		RawEnergy:          ds.RawEnergy,
+		AveragePower:       ds.AveragePower,
+		CorrectedTimeslots: ds.CorrectedTimeslots,
+		OutageTimeslots:    ds.OutageTimeslots,
+		MissedTimeslots:    ds.MissedTimeslots,
+		HasReported:        ds.HasReported,
+		Online:             ds.Online,
+	}
+	if ds.HasReported {
+		resp.LastSeenTimeslot = ds.LastSeenTimeslot
+		resp.LastSeenUnix = glow.TimeslotToUnix(ds.LastSeenTimeslot)
+	}
+	gcas.writeJSONResponse(w, r, resp)
+}
+
+// V2ReportGapsHandler returns the report gaps of the device named by the
+// 'pubkey' or 'short_id' query parameter, or of every device if 'all=true'
+// is set.
+func (gcas *GCAServer) V2ReportGapsHandler(w http.ResponseWriter, r *http.Request) {
+	if !gcas.v2RequireGet(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	now := gcas.currentTimeslot()
+	periodStart := now - now%2016
+	var snapshots []reportPresence
+	gcas.mu.RLock()
+	if q.Get("all") == "true" {
+		if q.Get("pubkey") != "" || q.Get("short_id") != "" {
+			gcas.mu.RUnlock()
+			gcas.writeAPIError(w, ErrCodeMalformedRequest, "all=true can not be combined with pubkey or short_id")
+			return
+		}
+		for sid := range gcas.equipmentReports {
+			snapshots = append(snapshots, gcas.snapshotReportPresence(sid, periodStart, now))
+		}
+	} else {
+		shortID, ok := gcas.v2LookupDevice(w, q)
+		if !ok {
+			gcas.mu.RUnlock()
+			return
+		}
+		snapshots = append(snapshots, gcas.snapshotReportPresence(shortID, periodStart, now))
+	}
+	gcas.mu.RUnlock()
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].shortID < snapshots[j].shortID })
+	resp := V2ReportGapsResponse{
+		PeriodStartTimeslot: periodStart,
+		PeriodStartUnix:     glow.TimeslotToUnix(periodStart),
+		PeriodEndTimeslot:   now,
+		PeriodEndUnix:       glow.TimeslotToUnix(now),
+		Devices:             make([]V2DeviceReportGaps, 0, len(snapshots)),
+	}
+	windows := gcas.outageWindows(now)
+	for _, rp := range snapshots {
+		drg := V2DeviceReportGaps{
+			ShortID:   rp.shortID,
+			PublicKey: v2Hex(rp.publicKey[:]),
+			Gaps:      []V2ReportGap{},
+		}
+		for _, gap := range findReportGaps(rp.present, periodStart) {
+			drg.Gaps = append(drg.Gaps, V2ReportGap{
+				StartTimeslot: gap.StartTimeslot,
+				StartUnix:     glow.TimeslotToUnix(gap.StartTimeslot),
+				EndTimeslot:   gap.EndTimeslot,
+				EndUnix:       glow.TimeslotToUnix(gap.EndTimeslot),
+				Length:        gap.Length,
+				Cause:         gapCause(gap, windows),
+			})
+		}
+		resp.Devices = append(resp.Devices, drg)
+	}
+	gcas.writeJSONResponse(w, r, resp)
+}
+
+// V2FlaggedReportsHandler lists the reports waiting for review, optionally
+// limited to the device given by the 'short_id' query parameter.
+func (gcas *GCAServer) V2FlaggedReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if !gcas.v2RequireGet(w, r) {
+		return
+	}
+	var filter *uint32
+	if sidStr := r.URL.Query().Get("short_id"); sidStr != "" {
+		sid, err := strconv.ParseUint(sidStr, 10, 32)
+		if err != nil {
+			gcas.writeAPIError(w, ErrCodeMalformedRequest, "invalid short_id")
+			return
+		}
+		shortID := uint32(sid)
+		filter = &shortID
+	}
+
+	flagged := []V2FlaggedReport{}
+	gcas.mu.RLock()
+	for slot, report := range gcas.flaggedReports {
+		if filter != nil && slot.ShortID != *filter {
+			continue
+		}
+		ea := gcas.equipment[slot.ShortID]
+		flagged = append(flagged, V2FlaggedReport{
+			ShortID:     report.ShortID,
+			PublicKey:   v2Hex(ea.PublicKey[:]),
+			Timeslot:    report.Timeslot,
+			Unix:        glow.TimeslotToUnix(report.Timeslot),
+			PowerOutput: int64(report.PowerOutput),
+			Capacity:    ea.Capacity,
+			Signature:   v2Hex(report.Signature[:]),
+		})
+	}
+	gcas.mu.RUnlock()
+	sort.Slice(flagged, func(i, j int) bool {
+		if flagged[i].ShortID != flagged[j].ShortID {
+			return flagged[i].ShortID < flagged[j].ShortID
+		}
+		return flagged[i].Timeslot < flagged[j].Timeslot
+	})
+	gcas.writeJSONResponse(w, r, flagged)
+}
+
+// V2BannedEquipmentHandler lists the banned equipment, optionally limited to
+// the equipment with the key given by the 'pubkey' query parameter.
+func (gcas *GCAServer) V2BannedEquipmentHandler(w http.ResponseWriter, r *http.Request) {
+	if !gcas.v2RequireGet(w, r) {
+		return
+	}
+	var pk glow.PublicKey
+	pkStr := r.URL.Query().Get("pubkey")
+	if pkStr != "" {
+		var err error
+		pk, err = glow.ParsePublicKey(pkStr)
+		if err != nil {
+			gcas.writeAPIError(w, ErrCodeMalformedRequest, "invalid pubkey")
+			return
+		}
+	}
+
+	resp := V2BannedEquipmentResponse{Equipment: []V2BannedEquipment{}}
+	gcas.mu.RLock()
+	for shortID := range gcas.equipmentBans {
+		be := gcas.buildBannedEquipment(shortID)
+		if pkStr != "" && !be.hasPublicKey(pk) {
+			continue
+		}
+		v2be := V2BannedEquipment{
+			ShortID:     be.ShortID,
+			PublicKey:   be.PublicKey,
+			Reason:      be.Reason,
+			BanTimeslot: be.Timeslot,
+			BanUnix:     glow.TimeslotToUnix(be.Timeslot),
+		}
+		for _, ea := range be.Authorizations {
+			v2be.Authorizations = append(v2be.Authorizations, v2Equipment(ea))
+		}
+		if be.Equivocation != nil {
+			v2be.Equivocation = &V2EquivocationProof{
+				Authorization: v2Equipment(be.Equivocation.Authorization),
+				First:         v2Report(be.Equivocation.First),
+				Second:        v2Report(be.Equivocation.Second),
+			}
+		}
+		resp.Equipment = append(resp.Equipment, v2be)
+	}
+	gcas.mu.RUnlock()
+	sort.Slice(resp.Equipment, func(i, j int) bool { return resp.Equipment[i].ShortID < resp.Equipment[j].ShortID })
+	gcas.writeJSONResponse(w, r, resp)
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getV2 fetches a v2 route, decoding the body into a generic JSON value.
+func (gcas *GCAServer) getV2(route string) (int, interface{}, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v2/%v", gcas.httpPort, route))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	var body interface{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body, err
+}
+
+// checkKeys fails the test unless the provided value is an object with
+// exactly the provided keys.
+func checkKeys(t *testing.T, name string, v interface{}, keys ...string) map[string]interface{} {
+	t.Helper()
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		t.Fatalf("%v is not an object: %v", name, v)
+	}
+	var got []string
+	for k := range obj {
+		got = append(got, k)
+	}
+	sort.Strings(got)
+	sort.Strings(keys)
+	if strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("%v has keys %v, expected %v", name, got, keys)
+	}
+	return obj
+}
+
+// checkList fails the test unless the provided value is a list of the
+// provided length.
+func checkList(t *testing.T, name string, v interface{}, length int) []interface{} {
+	t.Helper()
+	list, ok := v.([]interface{})
+	if !ok || len(list) != length {
+		t.Fatalf("%v is not a list of length %v: %v", name, length, v)
+	}
+	return list
+}
+
+// checkTimeslot fails the test unless the object has a timeslot field with
+// the provided value, paired with the matching unix field.
+func checkTimeslot(t *testing.T, name string, obj map[string]interface{}, timeslotKey string, unixKey string, timeslot uint32) {
+	t.Helper()
+	if obj[timeslotKey] != float64(timeslot) || obj[unixKey] != float64(glow.TimeslotToUnix(timeslot)) {
+		t.Errorf("%v has unexpected %v/%v: %v/%v", name, timeslotKey, unixKey, obj[timeslotKey], obj[unixKey])
+	}
+}
+
+// The keys of the shared v2 objects.
+var (
+	v2EquipmentKeys = []string{"short_id", "pubkey", "version", "latitude", "longitude", "capacity", "capacity_watts", "debt", "expiration_timeslot", "expiration_unix", "initialization_timeslot", "initialization_unix", "protocol_fee", "nonce", "signature"}
+	v2ReportKeys    = []string{"short_id", "timeslot", "unix", "power_output", "banned", "signature"}
+	v2ErrorKeys     = []string{"code", "message"}
+)
+
+// TestV2Routes exercises every v2 route and checks the schema of the
+// responses, including the error responses.
+func TestV2Routes(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+
+	// ShortID 1 reports normally and has a flagged report, ShortID 2 gets
+	// banned for equivocation, and ShortID 3 gets banned by the GCA.
+	pub, priv := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{ShortID: 1, PublicKey: pub, Capacity: 1000, Expiration: 5000}
+	if err := server.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, er := range []glow.EquipmentReport{
+		{ShortID: 1, Timeslot: 4, PowerOutput: 500},
+		{ShortID: 1, Timeslot: 5, PowerOutput: 5e6},
+	} {
+		er.Signature = glow.Sign(er.SigningBytes(), priv)
+		server.managedHandleEquipmentReport(er.Serialize())
+	}
+	equivocator, ePriv, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, power := range []uint64{5, 7} {
+		er := glow.EquipmentReport{ShortID: equivocator.ShortID, Timeslot: 6, PowerOutput: power}
+		er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+		server.managedHandleEquipmentReport(er.Serialize())
+	}
+	if _, _, err := server.AuthorizeTestDevice(3, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	pk3, _ := glow.GenerateKeyPair()
+	replacement := SignEquipmentAuthorization(glow.EquipmentAuthorization{ShortID: 3, PublicKey: pk3, Capacity: 1000}, gcaPrivKey)
+	if err := server.AuthorizeEquipment(replacement, gcaPrivKey); err == nil {
+		t.Fatal("conflicting authorization did not cause a ban")
+	}
+	pubHex := hex.EncodeToString(pub[:])
+
+	get := func(route string) interface{} {
+		t.Helper()
+		status, body, err := server.getV2(route)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("unable to fetch %v: %v %v %v", route, status, body, err)
+		}
+		return body
+	}
+
+	// equipment
+	body := checkKeys(t, "equipment", get("equipment"), "equipment")
+	equipment := checkList(t, "equipment", body["equipment"], 1)
+	obj := checkKeys(t, "equipment item", equipment[0], v2EquipmentKeys...)
+	if obj["pubkey"] != pubHex || obj["short_id"] != float64(1) {
+		t.Errorf("unexpected equipment: %v", obj)
+	}
+	checkTimeslot(t, "equipment", obj, "expiration_timeslot", "expiration_unix", 5000)
+
+	// authorized-servers
+	body = checkKeys(t, "authorized-servers", get("authorized-servers"), "servers")
+	for _, s := range body["servers"].([]interface{}) {
+		checkKeys(t, "server", s, "pubkey", "banned", "location", "http_port", "tcp_port", "udp_port", "gca_authorization")
+	}
+
+	// recent-reports
+	body = checkKeys(t, "recent-reports", get("recent-reports?pubkey="+pubHex), "short_id", "pubkey", "start_timeslot", "start_unix", "reports")
+	checkTimeslot(t, "recent-reports", body, "start_timeslot", "start_unix", 0)
+	reports := checkList(t, "reports", body["reports"], 1)
+	obj = checkKeys(t, "report", reports[0], v2ReportKeys...)
+	checkTimeslot(t, "report", obj, "timeslot", "unix", 4)
+	if obj["power_output"] != float64(500) || obj["banned"] != false {
+		t.Errorf("unexpected report: %v", obj)
+	}
+
+	// all-device-stats
+	body = checkKeys(t, "all-device-stats", get("all-device-stats?timeslot_offset=0"), "week_start_timeslot", "week_start_unix", "total_devices", "devices", "signature", "build")
+	checkTimeslot(t, "all-device-stats", body, "week_start_timeslot", "week_start_unix", 0)
+	checkKeys(t, "build", body["build"], "version", "commit", "build_date")
+	// The banned devices are listed with their ban, and without any of
+	// the reports from the ban timeslot on.
+	devices := checkList(t, "devices", body["devices"], 3)
+	for i, banTimeslot := range []float64{6, 10} {
+		banned := checkKeys(t, "banned device stats", devices[i+1], "pubkey", "power_outputs", "impact_rates", "last_seen_timeslot", "last_seen_unix", "online", "banned", "ban_timeslot")
+		if banned["banned"] != true || banned["ban_timeslot"] != banTimeslot || banned["online"] != false {
+			t.Errorf("unexpected banned device: %v %v %v", banned["banned"], banned["ban_timeslot"], banned["online"])
+		}
+		if outputs := checkList(t, "power outputs", banned["power_outputs"], 2016); outputs[6] != float64(0) {
+			t.Error("the report from the ban timeslot counts:", outputs[6])
+		}
+	}
+	obj = checkKeys(t, "device stats", devices[0], "pubkey", "power_outputs", "impact_rates", "last_seen_timeslot", "last_seen_unix", "online", "uptime", "authorization")
+	checkKeys(t, "authorization", obj["authorization"], v2EquipmentKeys...)
+	checkKeys(t, "uptime", obj["uptime"], "percent", "timeslots", "reported_timeslots", "idle_timeslots", "meter_fault_timeslots")
+	checkTimeslot(t, "device stats", obj, "last_seen_timeslot", "last_seen_unix", 4)
+	outputs := checkList(t, "power outputs", obj["power_outputs"], 2016)
+	if obj["pubkey"] != pubHex || outputs[4] != float64(500) || outputs[5] != float64(0) {
+		t.Errorf("unexpected device stats: %v %v %v", obj["pubkey"], outputs[4], outputs[5])
+	}
+	checkList(t, "impact rates", obj["impact_rates"], 2016)
+
+	// device-summary, by pubkey and by ShortID
+	for _, query := range []string{"pubkey=" + pubHex, "short_id=1"} {
+		obj = checkKeys(t, "device-summary", get("device-summary?"+query), "short_id", "pubkey", "week_start_timeslot", "week_start_unix", "reports_received", "banned_timeslots", "total_energy", "raw_energy", "average_power", "corrected_timeslots", "outage_timeslots", "missed_timeslots", "last_seen_timeslot", "last_seen_unix", "has_reported", "online")
+		checkTimeslot(t, "device-summary", obj, "last_seen_timeslot", "last_seen_unix", 4)
+		if obj["pubkey"] != pubHex || obj["reports_received"] != float64(1) {
+			t.Errorf("unexpected device summary: %v", obj)
+		}
+	}
+
+	// report-gaps
+	body = checkKeys(t, "report-gaps", get("report-gaps?short_id=1"), "period_start_timeslot", "period_start_unix", "period_end_timeslot", "period_end_unix", "devices")
+	checkTimeslot(t, "report-gaps", body, "period_end_timeslot", "period_end_unix", 10)
+	devices = checkList(t, "gap devices", body["devices"], 1)
+	obj = checkKeys(t, "gap device", devices[0], "short_id", "pubkey", "gaps")
+	gaps := checkList(t, "gaps", obj["gaps"], 2)
+	obj = checkKeys(t, "gap", gaps[0], "start_timeslot", "start_unix", "end_timeslot", "end_unix", "length", "cause")
+	checkTimeslot(t, "gap", obj, "end_timeslot", "end_unix", 3)
+	checkList(t, "all gaps", get("report-gaps?all=true").(map[string]interface{})["devices"], 1)
+
+	// flagged-reports
+	flagged := checkList(t, "flagged-reports", get("flagged-reports"), 1)
+	obj = checkKeys(t, "flagged report", flagged[0], "short_id", "pubkey", "timeslot", "unix", "power_output", "capacity", "signature")
+	checkTimeslot(t, "flagged report", obj, "timeslot", "unix", 5)
+	checkList(t, "filtered flagged-reports", get("flagged-reports?short_id=2"), 0)
+
+	// banned-equipment
+	body = checkKeys(t, "banned-equipment", get("banned-equipment"), "equipment")
+	banned := checkList(t, "banned equipment", body["equipment"], 2)
+	obj = checkKeys(t, "equivocation ban", banned[0], "short_id", "pubkey", "reason", "ban_timeslot", "ban_unix", "equivocation")
+	checkTimeslot(t, "equivocation ban", obj, "ban_timeslot", "ban_unix", 6)
+	proof := checkKeys(t, "proof", obj["equivocation"], "authorization", "first", "second")
+	checkKeys(t, "proof authorization", proof["authorization"], v2EquipmentKeys...)
+	checkKeys(t, "proof first", proof["first"], v2ReportKeys...)
+	checkKeys(t, "proof second", proof["second"], v2ReportKeys...)
+	obj = checkKeys(t, "gca ordered ban", banned[1], "short_id", "pubkey", "reason", "ban_timeslot", "ban_unix", "authorizations")
+	checkTimeslot(t, "gca ordered ban", obj, "ban_timeslot", "ban_unix", 10)
+	for _, auth := range checkList(t, "authorizations", obj["authorizations"], 2) {
+		checkKeys(t, "authorization", auth, v2EquipmentKeys...)
+	}
+	body = checkKeys(t, "filtered banned-equipment", get("banned-equipment?pubkey="+hex.EncodeToString(pk3[:])), "equipment")
+	checkList(t, "filtered banned equipment", body["equipment"], 1)
+
+	// Every route returns structured errors.
+	for _, tc := range []struct {
+		route  string
+		status int
+		code   string
+	}{
+		{"equipment", http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"authorized-servers", http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"recent-reports?pubkey=" + pubHex, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"all-device-stats?timeslot_offset=0", http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"device-summary?short_id=1", http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"report-gaps?short_id=1", http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"flagged-reports", http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"banned-equipment", http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+	} {
+		resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v2/%v", server.httpPort, tc.route), "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body interface{}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != tc.status {
+			t.Fatalf("unexpected response to POST %v: %v %v", tc.route, resp.StatusCode, err)
+		}
+		if obj := checkKeys(t, "error", body, v2ErrorKeys...); obj["code"] != tc.code {
+			t.Errorf("unexpected error code for POST %v: %v", tc.route, obj)
+		}
+	}
+	unknownHex := hex.EncodeToString(make([]byte, 32))
+	for _, tc := range []struct {
+		route  string
+		status int
+		code   string
+	}{
+		{"recent-reports?pubkey=zz", http.StatusBadRequest, ErrCodeMalformedRequest},
+		{"recent-reports?pubkey=" + unknownHex, http.StatusNotFound, ErrCodeUnknownDevice},
+		{"all-device-stats?timeslot_offset=7", http.StatusBadRequest, ErrCodeMalformedRequest},
+		{"all-device-stats?timeslot_offset=0&pubkey=zz", http.StatusBadRequest, ErrCodeMalformedRequest},
+		{"device-summary", http.StatusBadRequest, ErrCodeMalformedRequest},
+		{"device-summary?short_id=2", http.StatusNotFound, ErrCodeUnknownDevice},
+		{"report-gaps?all=true&short_id=1", http.StatusBadRequest, ErrCodeMalformedRequest},
+		{"report-gaps?short_id=x", http.StatusBadRequest, ErrCodeMalformedRequest},
+		{"flagged-reports?short_id=x", http.StatusBadRequest, ErrCodeMalformedRequest},
+		{"banned-equipment?pubkey=zz", http.StatusBadRequest, ErrCodeMalformedRequest},
+	} {
+		status, body, err := server.getV2(tc.route)
+		if err != nil || status != tc.status {
+			t.Fatalf("unexpected response to GET %v: %v %v", tc.route, status, err)
+		}
+		if obj := checkKeys(t, "error", body, v2ErrorKeys...); obj["code"] != tc.code {
+			t.Errorf("unexpected error code for GET %v: %v", tc.route, obj)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+// api_validate_report.go contains an endpoint that tells the developers of
+// device firmware why the server would reject a report. A rejected UDP report
+// only ever shows up as a missing ack, which doesn't say what was wrong with
+// it. The endpoint takes the same packet as the equipment report endpoint, see
+// api_equipment_report.go, runs it through every check that a real report
+// goes through, and returns the result of each check.
+//
+// Nothing is recorded: the state, the rate limits of the device, and the
+// metrics of the reports are left alone, so a validation can't be used to
+// submit a report, and it doesn't count as one. The endpoint has a budget of
+// its own that is much smaller than the budget of a device, so it can't be
+// used to check signatures in bulk either, see api_limits.go.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// ReportCheckResult is the result of a single check of a report validation.
+type ReportCheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Outcome string `json:"outcome,omitempty"` // The outcome that a failed check gives the report
+	Detail  string `json:"detail,omitempty"`
+
+	// Mode is set for the rules that aren't enforced, see
+	// validation_rules.go. A rule that is off always passes, and a rule
+	// in warn mode can fail without an outcome.
+	Mode string `json:"mode,omitempty"`
+}
+
+// ReportValidation is the response of the report validation endpoint.
+type ReportValidation struct {
+	// Recorded is always false, the validation never changes the state of
+	// the server.
+	Recorded bool   `json:"recorded"`
+	Note     string `json:"note"`
+
+	PacketVersion byte   `json:"packet_version"`
+	ShortID       uint32 `json:"short_id"`
+	Timeslot      uint32 `json:"timeslot"`
+	PowerOutput   uint64 `json:"power_output"`
+
+	// Outcome is the outcome that the report would get if it was
+	// submitted right now, which is the outcome of the first check that
+	// failed, or "accepted" if every check passed.
+	Outcome string              `json:"outcome"`
+	Checks  []ReportCheckResult `json:"checks"`
+}
+
+// validateReportPath is the route of the report validation.
+const validateReportPath = "/api/v1/validate-report"
+
+// validationNote is the note of every report validation.
+const validationNote = "This was a validation only, the report was not recorded. Submit the report over UDP or to /api/v1/equipment-report to record it."
+
+// add appends the result of a check to the validation. A check that failed
+// sets the outcome of the validation, unless an earlier check already did.
+func (rv *ReportValidation) add(name string, failed reportOutcome, err error) {
+	res := ReportCheckResult{Name: name, Passed: err == nil}
+	if err != nil {
+		res.Outcome = failed.String()
+		res.Detail = err.Error()
+		if rv.Outcome == reportAccepted.String() {
+			rv.Outcome = res.Outcome
+		}
+	}
+	rv.Checks = append(rv.Checks, res)
+}
+
+// addRule appends the result of a check of a rule in the mode of the rule. A
+// rule that is off doesn't get checked, and a rule in warn mode doesn't set
+// the outcome of the validation.
+func (rv *ReportValidation) addRule(name string, mode ValidationMode, failed reportOutcome, check func() error) {
+	switch mode {
+	case ValidationOff:
+		rv.Checks = append(rv.Checks, ReportCheckResult{Name: name, Passed: true, Mode: mode.String()})
+	case ValidationWarn:
+		res := ReportCheckResult{Name: name, Passed: true, Mode: mode.String()}
+		if err := check(); err != nil {
+			res.Passed = false
+			res.Detail = err.Error()
+		}
+		rv.Checks = append(rv.Checks, res)
+	default:
+		rv.add(name, failed, check())
+	}
+}
+
+// managedValidateReport runs a report packet through the checks of the report
+// pipeline, without recording anything.
+func (gcas *GCAServer) managedValidateReport(packet []byte) ReportValidation {
+	rv := ReportValidation{Note: validationNote, Outcome: reportAccepted.String()}
+	report, version, err := glow.DecodeReportPacket(packet)
+	rv.PacketVersion = version
+	if err != nil {
+		rv.Outcome = "malformed_packet"
+		rv.Checks = append(rv.Checks, ReportCheckResult{Name: "packet", Outcome: rv.Outcome, Detail: err.Error()})
+		return rv
+	}
+	rv.Checks = append(rv.Checks, ReportCheckResult{Name: "packet", Passed: true})
+	rv.ShortID, rv.Timeslot, rv.PowerOutput = report.ShortID, report.Timeslot, report.PowerOutput
+
+	// The signature is verified before the mutex is acquired, just like
+	// for a real report.
+	_, pubkey, verifyErr := gcas.managedVerifyReport(report.Serialize())
+
+	gcas.mu.RLock()
+	defer gcas.mu.RUnlock()
+
+	// The checks of the signature come in the order in which
+	// handleEquipmentReport tells its failures apart.
+	var banErr, authErr error
+	if _, banned := gcas.equipmentBans[report.ShortID]; banned {
+		banErr = fmt.Errorf("ShortID %v has been banned", report.ShortID)
+	}
+	rv.add("ban", reportBanned, banErr)
+	ea, exists := gcas.equipment[report.ShortID]
+	if !exists {
+		authErr = fmt.Errorf("ShortID %v does not belong to authorized equipment", report.ShortID)
+	}
+	rv.add("authorization", reportUnknownDevice, authErr)
+	if verifyErr == nil && !gcas.isDeviceKeyAt(report.ShortID, pubkey, report.Timeslot) {
+		verifyErr = errors.New("the key that signed the report is no longer a key of the equipment")
+	}
+	sigOutcome := reportBadSignature
+	if exists && errors.Is(verifyErr, errOutsideAuthorization) && gcas.isDeviceKey(ea.PublicKey, pubkey) {
+		sigOutcome = reportOutsideAuthorization
+		verifyErr = fmt.Errorf("the report was signed by key %x of the equipment, which isn't valid at timeslot %v", pubkey, report.Timeslot)
+	} else if exists && verifyErr != nil {
+		verifyErr = fmt.Errorf("the signature does not verify against the keys of equipment %x at timeslot %v", ea.PublicKey, report.Timeslot)
+	}
+	rv.add("signature", sigOutcome, verifyErr)
+
+	for _, c := range reportChecks {
+		rv.addRule(c.name, gcas.validationMode(c.name), c.outcome, func() error { return c.check(gcas, report) })
+	}
+	if exists {
+		outcome, err := gcas.checkReportSlot(report)
+		rv.add("existing_report", outcome, err)
+		// A rejection by the GCA applies in every mode of the rule.
+		outcome, err = gcas.checkReportCapacity(report)
+		if outcome == reportBanned {
+			rv.add("capacity", outcome, err)
+		} else {
+			rv.addRule("capacity", gcas.validationMode("capacity"), outcome, func() error { return err })
+		}
+	}
+	if gcas.storageDegraded() {
+		rv.add("storage", reportRetryLater, errors.New("the server can't store reports durably right now"))
+	} else {
+		rv.add("storage", reportRetryLater, nil)
+	}
+	return rv
+}
+
+// slotPower returns the power output that the server already has for the
+// timeslot of a report, which is 0 if the timeslot is empty, and whether that
+// power output belongs to a flagged report. The mutex must be held.
+func (gcas *GCAServer) slotPower(report glow.EquipmentReport) (uint64, bool) {
+	reports := gcas.equipmentReports[report.ShortID]
+	if reports == nil || report.Timeslot < gcas.equipmentReportsOffset || report.Timeslot >= gcas.equipmentReportsOffset+4032 {
+		return 0, false
+	}
+	if flagged, isFlagged := gcas.flaggedReports[reportSlot{ShortID: report.ShortID, Timeslot: report.Timeslot}]; isFlagged {
+		return flagged.PowerOutput, true
+	}
+	return reports.PowerOutputs[report.Timeslot-gcas.equipmentReportsOffset], false
+}
+
+// checkReportSlot compares a report to the report that the server already has
+// for its timeslot, the same way that applyReport does. The mutex must be
+// held.
+func (gcas *GCAServer) checkReportSlot(report glow.EquipmentReport) (reportOutcome, error) {
+	power, isFlagged := gcas.slotPower(report)
+	switch {
+	case power == 0:
+		return reportAccepted, nil
+	case power == 1 && !isFlagged:
+		return reportBanned, fmt.Errorf("timeslot %v has been banned for the equipment", report.Timeslot)
+	case power == report.PowerOutput:
+		return reportDuplicate, errors.New("the server already has this report")
+	default:
+		return reportBanned, fmt.Errorf("the server already has a report with a power output of %v for timeslot %v, a different report for the same timeslot gets the equipment banned", power, report.Timeslot)
+	}
+}
+
+// checkReportCapacity checks whether a report would be held for review by the
+// GCA for exceeding the capacity of its equipment. Only the first report of a
+// timeslot gets held, see applyReport. The mutex must be held.
+func (gcas *GCAServer) checkReportCapacity(report glow.EquipmentReport) (reportOutcome, error) {
+	if power, _ := gcas.slotPower(report); power != 0 || !gcas.exceedsCapacity(report) {
+		return reportAccepted, nil
+	}
+	review, reviewed := gcas.flaggedReportReviews[reportSlot{ShortID: report.ShortID, Timeslot: report.Timeslot}]
+	if !reviewed || review.PowerOutput != report.PowerOutput {
+		return reportFlagged, fmt.Errorf("the power output of %v exceeds the capacity of the equipment, the report would be held for review by the GCA", report.PowerOutput)
+	}
+	if !review.Accept {
+		return reportBanned, errors.New("the GCA rejected this report when it was held for review")
+	}
+	return reportAccepted, nil
+}
+
+// ValidateReportHandler runs a report packet through the checks of the report
+// pipeline and returns the result of every check, without recording the
+// report.
+func (gcas *GCAServer) ValidateReportHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for report validation.")
+		return
+	}
+
+	// Anything longer than the largest packet is malformed, so there's no
+	// reason to read past it.
+	packet, err := io.ReadAll(http.MaxBytesReader(w, r.Body, glow.MaxReportPacketSize))
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, fmt.Sprintf("Unable to read request body, a report packet is at most %v bytes", glow.MaxReportPacketSize))
+		return
+	}
+	gcas.writeJSONResponse(w, r, gcas.managedValidateReport(packet))
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// validateReport posts a report packet to the report validation endpoint.
+func (gcas *GCAServer) validateReport(packet []byte) (ReportValidation, *http.Response, error) {
+	var rv ReportValidation
+	resp, err := http.Post("http://"+gcas.httpDialAddr()+validateReportPath, "application/octet-stream", bytes.NewReader(packet))
+	if err != nil {
+		return rv, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return rv, resp, nil
+	}
+	return rv, resp, json.NewDecoder(resp.Body).Decode(&rv)
+}
+
+// signedTestReport returns a report that is signed with the provided key.
+func signedTestReport(shortID uint32, timeslot uint32, power uint64, key glow.PrivateKey) glow.EquipmentReport {
+	er := glow.EquipmentReport{ShortID: shortID, Timeslot: timeslot, PowerOutput: power}
+	er.Signature = glow.Sign(er.SigningBytes(), key)
+	return er
+}
+
+// TestValidateReport checks that the report validation names the check that a
+// report fails, that it never records anything, and that it has a budget of
+// its own.
+func TestValidateReport(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(4, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv := glow.GenerateKeyPair()
+	ts := server.currentTimeslot()
+
+	// expect validates a report and checks the outcome and the check that
+	// failed.
+	expect := func(packet []byte, outcome string, failed string) ReportValidation {
+		t.Helper()
+		rv, resp, err := server.validateReport(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("validation failed:", resp.StatusCode)
+		}
+		if rv.Recorded || !strings.Contains(rv.Note, "not recorded") {
+			t.Fatal("validation does not say that nothing was recorded:", rv)
+		}
+		if rv.Outcome != outcome {
+			t.Fatalf("expected outcome %v, got %v: %+v", outcome, rv.Outcome, rv.Checks)
+		}
+		for _, c := range rv.Checks {
+			if !c.Passed && failed == "" {
+				t.Fatal("check failed:", c)
+			}
+			if !c.Passed && c.Name == failed && c.Outcome == outcome && c.Detail != "" {
+				return rv
+			}
+		}
+		if failed != "" {
+			t.Fatalf("check %v did not fail: %+v", failed, rv.Checks)
+		}
+		return rv
+	}
+
+	expect([]byte{1, 2, 3}, "malformed_packet", "packet")
+	expect(signedTestReport(99, ts, 5, ePriv).Serialize(), reportUnknownDevice.String(), "authorization")
+	expect(signedTestReport(ea.ShortID, ts, 5, otherPriv).Serialize(), reportBadSignature.String(), "signature")
+	expect(signedTestReport(ea.ShortID, ts+10000, 5, ePriv).Serialize(), reportStale.String(), "timeslot_window")
+
+	// A valid report passes every check, and can still be submitted
+	// afterwards, because the validation didn't record it.
+	report := signedTestReport(ea.ShortID, ts, 5, ePriv)
+	rv := expect(report.Serialize(), reportAccepted.String(), "")
+	if rv.ShortID != ea.ShortID || rv.Timeslot != ts || rv.PowerOutput != 5 || len(rv.Checks) < 10 {
+		t.Fatal("unexpected validation:", rv)
+	}
+	if server.reportedPower(ea.ShortID, ts) != 0 {
+		t.Fatal("validation recorded the report")
+	}
+	if ra, err := server.SubmitTestReport(ea.ShortID, ts, 5, ePriv); err != nil || ra.Status != glow.ReportAckAccepted {
+		t.Fatal("report was not accepted after its validation:", ra, err)
+	}
+
+	// Once the report is in, the same report is a duplicate, and a
+	// different report for the timeslot would get the device banned,
+	// which the validation doesn't do.
+	expect(report.Serialize(), reportDuplicate.String(), "existing_report")
+	expect(signedTestReport(ea.ShortID, ts, 6, ePriv).Serialize(), reportBanned.String(), "existing_report")
+	server.mu.RLock()
+	_, banned := server.equipmentBans[ea.ShortID]
+	server.mu.RUnlock()
+	if banned {
+		t.Fatal("validation banned the device")
+	}
+	expect(signedTestReport(ea.ShortID, ts+1, 1e12, ePriv).Serialize(), reportFlagged.String(), "capacity")
+	server.mu.RLock()
+	flagged := len(server.flaggedReports)
+	server.mu.RUnlock()
+	if flagged != 0 {
+		t.Fatal("validation flagged the report")
+	}
+
+	// The budget of the validations is gone, and the refusal shows up in
+	// the metrics.
+	_, resp, err := server.validateReport(report.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("validation beyond the burst was not limited:", resp.StatusCode)
+	}
+	if retry, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retry < 1 {
+		t.Fatal("bad Retry-After header:", resp.Header.Get("Retry-After"))
+	}
+	var buf bytes.Buffer
+	server.staticMetrics.WritePrometheus(&buf)
+	if !strings.Contains(buf.String(), "http_requests_limited_total{reason=\"validate\"} 1\n") {
+		t.Error("metrics output is missing the refused validation")
+	}
+}
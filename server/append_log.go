@@ -0,0 +1,98 @@
+package server
+
+// append_log.go implements the logs of fixed size records that are held open
+// for the lifetime of the server, such as the impact rates log and the
+// heartbeats log. Every record ends with a 4 byte checksum of the rest of the
+// record. At startup a log is replayed in order, and a torn record at the end
+// fails its checksum and gets dropped. A log that grows stale gets compacted
+// by rewriting it from memory.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+// appendLog is an open log of fixed size records.
+type appendLog struct {
+	name   string // The name of the file in the storage
+	desc   string // How the log is called in errors and warnings
+	file   StorageLog
+	server *GCAServer
+}
+
+// decodeLogRecords hands every valid record at the start of the data to visit,
+// in order, and returns the length of the valid prefix of the data.
+func decodeLogRecords(data []byte, recordSize int, visit func(record []byte)) int {
+	validLen := 0
+	for len(data)-validLen >= recordSize {
+		record := data[validLen : validLen+recordSize]
+		if crc32.ChecksumIEEE(record[:recordSize-4]) != binary.LittleEndian.Uint32(record[recordSize-4:]) {
+			break
+		}
+		validLen += recordSize
+		visit(record)
+	}
+	return validLen
+}
+
+// loadAppendLog opens a log, replays it, and keeps it open so that new records
+// can be appended to it. The log gets closed when the server stops.
+func (gcas *GCAServer) loadAppendLog(name, desc string, recordSize int, visit func(record []byte)) (*appendLog, error) {
+	f, err := gcas.staticStorage.OpenLog(name, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %v: %v", desc, err)
+	}
+	l := &appendLog{name: name, desc: desc, file: f, server: gcas}
+	if err := l.replay(recordSize, visit); err != nil {
+		f.Close()
+		return nil, err
+	}
+	gcas.tg.AfterStop(func() error {
+		gcas.mu.Lock()
+		defer gcas.mu.Unlock()
+		return l.file.Close()
+	})
+	return l, nil
+}
+
+// replay hands every valid record of the log to visit, in order.
+func (l *appendLog) replay(recordSize int, visit func(record []byte)) error {
+	data, err := ioutil.ReadAll(l.file)
+	if err != nil {
+		return fmt.Errorf("unable to read %v: %v", l.desc, err)
+	}
+	validLen := decodeLogRecords(data, recordSize, visit)
+	// Drop any trailing partial record so that new records get appended
+	// directly after the last valid one.
+	if validLen != len(data) {
+		l.server.logger.Warnf("dropping %v corrupt bytes from the end of the %v", len(data)-validLen, l.desc)
+		if err := l.file.Truncate(int64(validLen)); err != nil {
+			return fmt.Errorf("unable to truncate %v: %v", l.desc, err)
+		}
+	}
+	return nil
+}
+
+// Write appends records to the log. The mutex must be held.
+func (l *appendLog) Write(records []byte) (int, error) {
+	return l.file.Write(records)
+}
+
+// rewrite replaces the contents of the log with the provided records. The
+// mutex must be held.
+func (l *appendLog) rewrite(data []byte) error {
+	if err := l.server.staticStorage.WriteFile(l.name, data, 0644); err != nil {
+		return fmt.Errorf("unable to rewrite %v: %v", l.desc, err)
+	}
+	// The old handle points at the file that was replaced, so the log has
+	// to be opened again.
+	f, err := l.server.staticStorage.OpenLog(l.name, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to reopen %v: %v", l.desc, err)
+	}
+	l.file.Close()
+	l.file = f
+	return nil
+}
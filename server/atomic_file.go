@@ -0,0 +1,114 @@
+package server
+
+// atomic_file.go contains helpers for writing persist files so that a crash
+// or power loss at any moment leaves either the old file or the new file
+// intact, never a partially written one.
+//
+// Every write goes to a temporary file in the same directory as the target.
+// The temporary file is synced to disk and then renamed over the target,
+// followed by a sync of the directory so that the rename itself is durable.
+// Appending to a file is done by writing the existing contents plus the new
+// data to the temporary file.
+//
+// A crash can leave a temporary file behind. Temporary files are never read,
+// and they get cleaned up by removeStaleTmpFiles at startup.
+//
+// The reports journal and the reports file don't use these helpers, as
+// rewriting them for every report or every compaction would defeat their
+// purpose. Instead, the journal protects itself from torn writes with
+// checksums, and the reports file, whose records all have the same size,
+// drops a partial record at the end, see report_persist.go.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tmpFileSuffix is appended to the name of a file to get the name of the
+// temporary file that is used while writing it.
+const tmpFileSuffix = ".tmp"
+
+// atomicWriteFault, when set, is called in place of writing the data to the
+// temporary file. It is only set during testing, to simulate a crash in the
+// middle of a write.
+var atomicWriteFault func(f *os.File, data []byte) error
+
+// writeFileAtomic replaces the file at path with the provided data.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + tmpFileSuffix
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return fmt.Errorf("unable to create temp file: %v", err)
+	}
+	if atomicWriteFault != nil {
+		err = atomicWriteFault(f, data)
+	} else {
+		_, err = f.Write(data)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write temp file: %v", err)
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to sync temp file: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to close temp file: %v", err)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("unable to rename temp file: %v", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// appendFileAtomic appends the provided data to the file at path, creating
+// the file if it does not exist.
+func appendFileAtomic(path string, data []byte, perm os.FileMode) error {
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read file: %v", err)
+	}
+	full := make([]byte, 0, len(existing)+len(data))
+	full = append(full, existing...)
+	full = append(full, data...)
+	return writeFileAtomic(path, full, perm)
+}
+
+// syncDir syncs a directory, which makes any renames within it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open dir for syncing: %v", err)
+	}
+	err = d.Sync()
+	if err != nil {
+		d.Close()
+		return fmt.Errorf("unable to sync dir: %v", err)
+	}
+	return d.Close()
+}
+
+// removeStaleTmpFiles deletes any temporary files in the provided directory
+// or its subdirectories that were left behind by an interrupted write.
+func (gcas *GCAServer) removeStaleTmpFiles(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), tmpFileSuffix) {
+			return nil
+		}
+		gcas.logger.Warnf("removing stale temp file: %v", path)
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("unable to remove stale temp file: %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// errInjectedFault is returned by the fault injector.
+var errInjectedFault = errors.New("injected fault")
+
+// injectWriteFault makes the next atomic writes and appends to the reports
+// file stop at a random offset, as if the process had died in the middle of
+// the write. The returned function removes the fault.
+func injectWriteFault() func() {
+	atomicWriteFault = func(f *os.File, data []byte) error {
+		if len(data) > 0 {
+			f.Write(data[:rand.Intn(len(data))])
+		}
+		return errInjectedFault
+	}
+	reportsFileWriteFault = func(f StorageLog, data []byte) error {
+		if len(data) > 0 {
+			f.Write(data[:rand.Intn(len(data))])
+		}
+		return errInjectedFault
+	}
+	return func() {
+		atomicWriteFault = nil
+		reportsFileWriteFault = nil
+	}
+}
+
+// TestWriteFileAtomicFaults interrupts writes at random offsets and checks
+// that the target file always contains either the old or the new data.
+func TestWriteFileAtomicFaults(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	path := filepath.Join(dir, "target.dat")
+	old := bytes.Repeat([]byte{1}, 500)
+	err := writeFileAtomic(path, old, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		clearFault := injectWriteFault()
+		err := appendFileAtomic(path, bytes.Repeat([]byte{2}, 300), 0644)
+		clearFault()
+		if err == nil {
+			t.Fatal("expected the injected fault to cause an error")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, old) {
+			t.Fatal("target file was modified by an interrupted write")
+		}
+	}
+
+	// A successful write should replace the contents, and startup cleanup
+	// should remove the temp file left by the interrupted writes.
+	err = appendFileAtomic(path, []byte{3}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, append(old, 3)) {
+		t.Fatal("append did not land")
+	}
+	err = os.WriteFile(path+tmpFileSuffix, []byte("stale"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := NewLogger(ERROR, filepath.Join(dir, "test.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	gcas := &GCAServer{logger: logger}
+	err = gcas.removeStaleTmpFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + tmpFileSuffix); !os.IsNotExist(err) {
+		t.Fatal("stale temp file was not removed")
+	}
+}
+
+// TestPersistFaultRecovery interrupts the writes of the GCA key, equipment
+// authorizations, and report state at random offsets, and checks that the
+// server always restarts with a consistent view of its files.
+func TestPersistFaultRecovery(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	// The faults get injected into the atomic writes of the files.
+	useFileStorage(dir)
+	server, tempPrivKey, err := gcaServerWithTempKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt the write of the GCA key, then restart and check that the
+	// server is still waiting for a key.
+	clearFault := injectWriteFault()
+	_, _, err = server.submitGCAKey(tempPrivKey)
+	clearFault()
+	if err == nil {
+		t.Fatal("expected registering the GCA key to fail")
+	}
+	restart := func() {
+		t.Helper()
+		err := server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err = NewGCAServer(dir, false)
+		if err != nil {
+			t.Fatal("server failed to restart after an interrupted write:", err)
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+tmpFileSuffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 0 {
+			t.Fatal("stale temp files were not removed:", matches)
+		}
+	}
+	restart()
+	server.mu.Lock()
+	available := server.gcaPubkeyAvailable
+	server.mu.Unlock()
+	if available {
+		t.Fatal("server should not have a GCA key")
+	}
+	_, gcaPrivKey, err := server.submitGCAKey(tempPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Repeatedly interrupt equipment authorizations and journal
+	// compactions, restarting the server after each one.
+	for i := uint32(0); i < 10; i++ {
+		// Authorize a device with the write interrupted.
+		newPub, _ := glow.GenerateKeyPair()
+		newEA := glow.EquipmentAuthorization{
+			ShortID:   100 + i,
+			PublicKey: newPub,
+			Capacity:  1e9,
+		}
+		clearFault = injectWriteFault()
+		err = server.AuthorizeEquipment(newEA, gcaPrivKey)
+		clearFault()
+		if err == nil {
+			t.Fatal("expected the authorization to fail")
+		}
+
+		// Send a report and interrupt the compaction.
+		server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, i+1, ePriv))
+		clearFault = injectWriteFault()
+		server.mu.Lock()
+		err = server.compactReportsJournal()
+		server.mu.Unlock()
+		clearFault()
+		if err == nil {
+			t.Fatal("expected the compaction to fail")
+		}
+
+		restart()
+		server.mu.Lock()
+		numEquipment := len(server.equipment)
+		server.mu.Unlock()
+		if numEquipment != 1 {
+			t.Fatal("interrupted authorization changed the equipment:", numEquipment)
+		}
+		if !server.checkReports(ea.ShortID, i+1) {
+			t.Fatal("reports were lost after an interrupted compaction")
+		}
+	}
+
+	// A compaction without faults should still work.
+	server.mu.Lock()
+	err = server.compactReportsJournal()
+	server.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restart()
+	defer server.Close()
+	if !server.checkReports(ea.ShortID, 10) {
+		t.Fatal("reports were lost after compaction")
+	}
+}
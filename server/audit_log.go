@@ -0,0 +1,184 @@
+package server
+
+// audit_log.go keeps the audit log of the server, an append-only record of
+// every privileged action that the server accepted: equipment authorizations,
+// deauthorizations, bans, server registrations, GCA key rotations,
+// migrations, region assignments, device notes, imports, and reviews of
+// flagged reports. The format of the entries and the verification of the hash
+// chain live in glow/audit_log.go, so auditors can check a downloaded log
+// without the server package.
+//
+// An action is recorded before any of its effects are persisted, and an
+// action that can't be recorded is refused. If the server dies between the
+// two writes, the log can contain an action whose effects were never saved,
+// but the server never holds an effect that the log is missing.
+//
+// The log is loaded and verified at startup, and kept in memory so that the
+// audit-log endpoint can page through it.
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+const (
+	// defaultAuditLogPageSize is the number of entries that the audit-log
+	// endpoint returns if no limit is provided.
+	defaultAuditLogPageSize = 100
+
+	// maxAuditLogPageSize is the largest number of entries that the
+	// audit-log endpoint returns at once.
+	maxAuditLogPageSize = 1000
+)
+
+// auditLog is the in-memory copy of the audit log. Actions get recorded under
+// different locks, so the log has a mutex of its own, which is always taken
+// last.
+type auditLog struct {
+	entries  []glow.AuditEntry
+	lastHash [32]byte
+
+	mu sync.Mutex
+}
+
+// auditRecord is an action that is about to be added to the audit log.
+type auditRecord struct {
+	action     glow.AuditAction
+	request    []byte
+	signatures []glow.AuditSignature
+}
+
+// AuditLogResponse is a page of the audit log.
+type AuditLogResponse struct {
+	Offset  int               `json:"offset"`  // The index of the first entry in the page
+	Total   int               `json:"total"`   // The number of entries in the whole log
+	Entries []glow.AuditEntry `json:"entries"` // Verify with glow.VerifyAuditLog
+}
+
+// gcaAuditSignature returns the audit signature of data that was signed by
+// the GCA key that is accepted in the current timeslot. The mutex must be
+// held.
+func (gcas *GCAServer) gcaAuditSignature(sb []byte, sig glow.Signature) glow.AuditSignature {
+	return glow.AuditSignature{PublicKey: gcas.gcaKeyAt(gcas.currentTimeslot()), SigningBytes: sb, Signature: sig}
+}
+
+// persistedGCAAuditSignature returns the audit signature of data that was
+// signed by any of the keys in the chain of GCA keys. The mutex must be held.
+func (gcas *GCAServer) persistedGCAAuditSignature(sb []byte, sig glow.Signature) glow.AuditSignature {
+	key := gcas.gcaPubkey
+	for _, rot := range gcas.gcaKeyRotations {
+		if glow.Verify(key, sb, sig) {
+			break
+		}
+		key = rot.NewKey
+	}
+	return glow.AuditSignature{PublicKey: key, SigningBytes: sb, Signature: sig}
+}
+
+// recordAudit adds actions to the audit log, in order. The caller must
+// persist the effects of the actions only if recordAudit succeeds.
+func (gcas *GCAServer) recordAudit(records ...auditRecord) error {
+	gcas.auditLog.mu.Lock()
+	defer gcas.auditLog.mu.Unlock()
+
+	prev := gcas.auditLog.lastHash
+	entries := make([]glow.AuditEntry, 0, len(records))
+	var data []byte
+	for _, rec := range records {
+		if len(rec.signatures) == 0 || len(rec.signatures) > 255 {
+			return fmt.Errorf("audit entry has %v signatures", len(rec.signatures))
+		}
+		e := glow.AuditEntry{
+			PrevHash:   prev,
+			Action:     rec.action,
+			Timeslot:   gcas.currentTimeslot(),
+			Request:    rec.request,
+			Signatures: rec.signatures,
+		}
+		entries = append(entries, e)
+		data = append(data, e.Serialize()...)
+		prev = e.Hash()
+	}
+	if err := gcas.staticStorage.AppendFile(AuditLogFile, data, 0644); err != nil {
+		return fmt.Errorf("unable to save audit log entry: %v", err)
+	}
+	gcas.auditLog.entries = append(gcas.auditLog.entries, entries...)
+	gcas.auditLog.lastHash = prev
+	return nil
+}
+
+// loadAuditLog loads the audit log from disk and verifies its hash chain,
+// creating the file if it does not exist yet.
+func (gcas *GCAServer) loadAuditLog() error {
+	data, err := gcas.staticStorage.ReadFile(AuditLogFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(AuditLogFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read audit log: %v", err)
+	}
+	var entries []glow.AuditEntry
+	for len(data) > 0 {
+		e, n, err := glow.DeserializeAuditEntry(data)
+		if err != nil {
+			return fmt.Errorf("unable to decode audit log entry %v: %v", len(entries), err)
+		}
+		entries = append(entries, e)
+		data = data[n:]
+	}
+	lastHash, err := glow.VerifyAuditLog([32]byte{}, entries)
+	if err != nil {
+		return fmt.Errorf("audit log is corrupt: %v", err)
+	}
+	gcas.auditLog.entries = entries
+	gcas.auditLog.lastHash = lastHash
+	return nil
+}
+
+// AuditLogHandler returns a page of the audit log. The offset and limit query
+// parameters select the page, the limit defaults to 100 entries and can be at
+// most 1000.
+func (gcas *GCAServer) AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for the audit log.")
+		return
+	}
+
+	offset, limit := 0, defaultAuditLogPageSize
+	q := r.URL.Query()
+	if str := q.Get("offset"); str != "" {
+		n, err := strconv.ParseUint(str, 10, 31)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid offset format")
+			return
+		}
+		offset = int(n)
+	}
+	if str := q.Get("limit"); str != "" {
+		n, err := strconv.ParseUint(str, 10, 31)
+		if err != nil || n == 0 || n > maxAuditLogPageSize {
+			gcas.writeError(w, ErrCodeMalformedRequest, fmt.Sprintf("limit must be between 1 and %v", maxAuditLogPageSize))
+			return
+		}
+		limit = int(n)
+	}
+
+	gcas.auditLog.mu.Lock()
+	resp := AuditLogResponse{Offset: offset, Total: len(gcas.auditLog.entries), Entries: []glow.AuditEntry{}}
+	if offset < len(gcas.auditLog.entries) {
+		end := offset + limit
+		if end > len(gcas.auditLog.entries) {
+			end = len(gcas.auditLog.entries)
+		}
+		resp.Entries = append(resp.Entries, gcas.auditLog.entries[offset:end]...)
+	}
+	gcas.auditLog.mu.Unlock()
+	gcas.writeJSONResponse(w, r, resp)
+}
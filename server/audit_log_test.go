@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getAuditLog fetches a page of the audit log with the provided query, signing
+// the request with the provided key.
+func (gcas *GCAServer) getAuditLog(query string, pub glow.PublicKey, priv glow.PrivateKey) (int, AuditLogResponse, error) {
+	var page AuditLogResponse
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%v/api/v1/audit-log?%v", gcas.httpDialAddr(), query), nil)
+	if err != nil {
+		return 0, page, err
+	}
+	if err := glow.SignRequest(req, pub, priv); err != nil {
+		return 0, page, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, page, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, page, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	return resp.StatusCode, page, err
+}
+
+// TestAuditLog checks that privileged actions get recorded with the key that
+// verified them, that the log can be paged through and verified, and that the
+// log survives a restart but not tampering.
+func TestAuditLog(t *testing.T) {
+	// The log gets replaced by a directory to make its writes fail, which
+	// needs the files.
+	dir := glow.GenerateTestDir(t.Name())
+	useFileStorage(dir)
+	server, gcaPubKey, gcaPrivKey, err := SetupTestServer(dir, DefaultServerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i <= 3; i++ {
+		if _, _, err := server.AuthorizeTestDevice(i, gcaPrivKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ed := EquipmentDeauthorization{PublicKey: server.equipment[2].PublicKey, Timestamp: 5}
+	ed.Signature = glow.Sign(ed.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedDeauthorizeEquipment(ed); err != nil {
+		t.Fatal(err)
+	}
+	// A repeated deauthorization changes nothing, and isn't recorded.
+	if _, err := server.managedDeauthorizeEquipment(ed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Download the log in pages of two entries, and verify each page.
+	check := func() {
+		t.Helper()
+		var entries []glow.AuditEntry
+		var prev [32]byte
+		for offset := 0; ; offset += 2 {
+			status, page, err := server.getAuditLog(fmt.Sprintf("offset=%v&limit=2", offset), gcaPubKey, gcaPrivKey)
+			if err != nil || status != http.StatusOK {
+				t.Fatal("unable to fetch audit log:", status, err)
+			}
+			if page.Total != 4 || page.Offset != offset {
+				t.Fatalf("unexpected page: %+v", page)
+			}
+			if len(page.Entries) == 0 {
+				break
+			}
+			prev, err = glow.VerifyAuditLog(prev, page.Entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, page.Entries...)
+		}
+		expected := []glow.AuditAction{glow.AuditEquipmentAuthorization, glow.AuditEquipmentAuthorization, glow.AuditEquipmentAuthorization, glow.AuditEquipmentDeauthorization}
+		if len(entries) != len(expected) {
+			t.Fatal("unexpected number of entries:", len(entries))
+		}
+		for i, e := range entries {
+			if e.Action != expected[i] || len(e.Signatures) != 1 || e.Signatures[0].PublicKey != gcaPubKey {
+				t.Fatalf("unexpected entry %v: %+v", i, e)
+			}
+		}
+		if _, err := DeserializeEquipmentDeauthorization(entries[3].Request); err != nil {
+			t.Fatal("recorded request can't be decoded:", err)
+		}
+	}
+	check()
+	for _, query := range []string{"limit=0", "limit=1001", "limit=two", "offset=-1"} {
+		if status, _, _ := server.getAuditLog(query, gcaPubKey, gcaPrivKey); status != http.StatusBadRequest {
+			t.Error("unexpected status for", query, status)
+		}
+	}
+
+	// The log survives a restart.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// An action that can't be recorded is refused, and not applied.
+	path := filepath.Join(dir, AuditLogFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pk, _ := glow.GenerateKeyPair()
+	if err := server.AuthorizeEquipment(glow.EquipmentAuthorization{ShortID: 4, PublicKey: pk, Capacity: 1000}, gcaPrivKey); err == nil {
+		t.Fatal("authorization was accepted without an audit entry")
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := server.equipment[4]; exists {
+		t.Fatal("unrecorded authorization was persisted")
+	}
+	check()
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tampered log stops the server from starting.
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGCAServer(dir, false); err == nil {
+		t.Fatal("server started with a tampered audit log")
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+// authorization_window.go ties the reports of a device to the lifetime of its
+// authorization. A device may only report for the timeslots from the
+// Initialization timeslot of its authorization up to the cutoff of its
+// deauthorization or the expiry of its authorization, and within that, only
+// with the keys that are valid for the timeslot, see
+// api_device_key_rotation.go. The lifetime only depends on the timeslot of a
+// report, never on when the report arrives, so that a key which leaked after
+// it was deauthorized or rotated away can't be used to backfill timeslots it
+// no longer covers.
+//
+// A report that was signed by a key of the device for a timeslot that the key
+// doesn't cover gets the outside_authorization outcome, as do reports for the
+// timeslots before the Initialization timeslot. Reports from after the cutoff
+// of a deauthorization keep their deauthorized outcome.
+//
+// A deauthorization can reach a server after reports for timeslots past its
+// cutoff were accepted, as the reports for the current timeslot keep coming
+// in until the GCA acts. Those reports are dropped from the state when the
+// deauthorization is applied, and are skipped when the reports are loaded
+// from disk again. The reports that an equivocation proof names have to be
+// within the lifetime as well, so that two replayed reports can't get a
+// device banned.
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// errOutsideAuthorization is returned by managedVerifyReport for a report
+// that was signed by a key of the equipment which can't sign reports for the
+// timeslot of the report.
+var errOutsideAuthorization = errors.New("the report was signed by a key of the equipment that isn't valid for its timeslot")
+
+// deviceKeys returns every key that the device with the provided
+// authorization key ever signed with, starting with the authorization key.
+// The mutex must be held.
+func (gcas *GCAServer) deviceKeys(pubkey glow.PublicKey) []glow.PublicKey {
+	keys := []glow.PublicKey{pubkey}
+	for _, rot := range gcas.deviceKeyRotations[pubkey] {
+		keys = append(keys, rot.NewKey)
+	}
+	return keys
+}
+
+// isDeviceKey returns whether the device with the provided authorization key
+// ever signed with the provided key. The mutex must be held.
+func (gcas *GCAServer) isDeviceKey(pubkey glow.PublicKey, key glow.PublicKey) bool {
+	for _, k := range gcas.deviceKeys(pubkey) {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizationWindowError returns an error if the provided timeslot is
+// outside of the lifetime of the authorization. The mutex must be held.
+func (gcas *GCAServer) authorizationWindowError(ea glow.EquipmentAuthorization, timeslot uint32) error {
+	if timeslot < ea.Initialization {
+		return fmt.Errorf("the equipment may only report starting with timeslot %v", ea.Initialization)
+	}
+	if ed, exists := gcas.equipmentDeauthorizations[ea.PublicKey]; exists && timeslot >= ed.CutoffTimeslot() {
+		return fmt.Errorf("the equipment was deauthorized before timeslot %v", timeslot)
+	}
+	if ea.ExpiredAt(timeslot) {
+		expiration, _ := ea.ExpiresAt()
+		return fmt.Errorf("the authorization of the equipment expired at timeslot %v", expiration)
+	}
+	return nil
+}
+
+// dropDeauthorizedReports removes the reports of a device for the timeslots
+// at or after the cutoff of its deauthorization, including the reports that
+// await review. Banned timeslots stay banned. The mutex must be held.
+func (gcas *GCAServer) dropDeauthorizedReports(shortID uint32, cutoff uint32) {
+	dr, exists := gcas.equipmentReports[shortID]
+	if !exists {
+		return
+	}
+	ero := gcas.equipmentReportsOffset
+	start := 0
+	if cutoff > ero {
+		start = int(cutoff - ero)
+	}
+	for i := start; i < 4032; i++ {
+		slot := reportSlot{ShortID: shortID, Timeslot: ero + uint32(i)}
+		if _, flagged := gcas.flaggedReports[slot]; flagged {
+			delete(gcas.flaggedReports, slot)
+			gcas.countFlaggedReport(slot, -1)
+		}
+		if dr.PowerOutputs[i] == 0 || dr.PowerOutputs[i] == 1 {
+			continue
+		}
+		before := gcas.timeslotTotals(shortID, i)
+		dr.clear(i)
+		gcas.adjustPeriodTotals(shortID, i, before)
+	}
+}
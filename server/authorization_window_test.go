@@ -0,0 +1,175 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// deauthorizeTestDevice deauthorizes a device as of the provided timeslot, so
+// that its reports are refused from the next timeslot on.
+func (gcas *GCAServer) deauthorizeTestDevice(t *testing.T, ea glow.EquipmentAuthorization, timeslot uint32, gcaPrivKey glow.PrivateKey) {
+	t.Helper()
+	ed := EquipmentDeauthorization{PublicKey: ea.PublicKey, Timestamp: glow.TimeslotToUnix(timeslot)}
+	ed.Signature = glow.Sign(ed.SigningBytes(), gcaPrivKey)
+	if _, err := gcas.managedDeauthorizeEquipment(ed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDeauthorizationReplays replays reports from before and after the cutoff
+// of a deauthorization, once with the deauthorization arriving first and once
+// with the reports arriving first, and checks that only the reports before the
+// cutoff count, that replays can't get the device banned, and that the result
+// survives a restart.
+func TestDeauthorizationReplays(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(shortID, timeslot uint32, power uint64, priv glow.PrivateKey) reportOutcome {
+		t.Helper()
+		outcome, _ := server.managedHandleEquipmentReport(signedTestReport(shortID, timeslot, power, priv).Serialize())
+		return outcome
+	}
+	expect := func(shortID, timeslot uint32, power uint64, priv glow.PrivateKey, want reportOutcome) {
+		t.Helper()
+		if outcome := send(shortID, timeslot, power, priv); outcome != want {
+			t.Fatalf("unexpected outcome for timeslot %v: %v, expected %v", timeslot, outcome, want)
+		}
+	}
+
+	// The deauthorization arrives first. The cutoff is timeslot 6.
+	first, firstPriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.deauthorizeTestDevice(t, first, 5, gcaPrivKey)
+	expect(1, 7, 20, firstPriv, reportDeauthorized)
+	expect(1, 7, 30, firstPriv, reportDeauthorized)
+	expect(1, 4, 20, firstPriv, reportAccepted)
+
+	// The reports arrive first, and the reports past the cutoff are
+	// dropped when the deauthorization is applied.
+	second, secondPriv, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(2, 4, 20, secondPriv, reportAccepted)
+	expect(2, 7, 20, secondPriv, reportAccepted)
+	expect(2, 8, 20, secondPriv, reportAccepted)
+	server.deauthorizeTestDevice(t, second, 5, gcaPrivKey)
+	expect(2, 7, 30, secondPriv, reportDeauthorized)
+	expect(2, 4, 20, secondPriv, reportDuplicate)
+
+	// A conflicting pair of reports past the cutoff doesn't prove
+	// anything, whichever server it comes from.
+	ep := EquivocationProof{
+		Authorization: second,
+		First:         signedTestReport(2, 7, 20, secondPriv),
+		Second:        signedTestReport(2, 7, 30, secondPriv),
+	}
+	if _, err := server.managedApplyEquivocationProof(ep); ErrorCode(err) != ErrCodeOutsideAuthorization {
+		t.Fatal("a proof outside of the authorization was not refused:", err)
+	}
+
+	check := func() {
+		t.Helper()
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		for _, shortID := range []uint32{1, 2} {
+			if _, banned := server.equipmentBans[shortID]; banned {
+				t.Fatal("replays got the device banned:", shortID)
+			}
+			reports := server.equipmentReports[shortID]
+			if reports.PowerOutputs[4] != 20 || reports.PowerOutputs[7] != 0 || reports.PowerOutputs[8] != 0 {
+				t.Fatal("unexpected reports:", shortID, reports.PowerOutputs[4], reports.PowerOutputs[7], reports.PowerOutputs[8])
+			}
+			if reports.Totals[0].Power != 20 || reports.Totals[0].Reports != 1 {
+				t.Fatal("the totals still count the dropped reports:", reports.Totals[0])
+			}
+		}
+	}
+	check()
+
+	// The reports past the cutoff are still in the reports files, but
+	// they get skipped when the reports are loaded.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	check()
+	expect(2, 7, 30, secondPriv, reportDeauthorized)
+}
+
+// TestAuthorizationLifetime checks that reports for the timeslots before the
+// Initialization of an authorization, and reports from a key that the device
+// rotated away from, are refused with their own outcome, error code, and
+// metric.
+func TestAuthorizationLifetime(t *testing.T) {
+	glow.SetCurrentTimeslot(100)
+	defer glow.SetCurrentTimeslot(0)
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{KeyRotationOverlap: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	pub, priv := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{
+		ShortID:        1,
+		PublicKey:      pub,
+		Capacity:       15400300,
+		Expiration:     100e6,
+		Initialization: 90,
+	}
+	if err := server.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	expect := func(timeslot uint32, priv glow.PrivateKey, want reportOutcome) {
+		t.Helper()
+		outcome, authenticated := server.managedHandleEquipmentReport(generateTestReport(1, timeslot, priv))
+		if outcome != want || !authenticated {
+			t.Fatalf("unexpected outcome for timeslot %v: %v %v, expected %v", timeslot, outcome, authenticated, want)
+		}
+	}
+	expect(89, priv, reportOutsideAuthorization)
+	expect(90, priv, reportAccepted)
+
+	// After the overlap of a rotation, the old key no longer covers the
+	// timeslots, and the new key never covered the ones before its
+	// activation.
+	rot, newPriv := newDeviceKeyRotation(1, pub, priv, 105, gcaPrivKey)
+	if _, err := server.managedRotateDeviceKey(rot, false); err != nil {
+		t.Fatal(err)
+	}
+	expect(95, newPriv, reportOutsideAuthorization)
+	expect(114, priv, reportAccepted)
+	expect(115, priv, reportOutsideAuthorization)
+	expect(115, newPriv, reportAccepted)
+
+	// The validation names the same outcome, and a key that never
+	// belonged to the device is still a bad signature.
+	rv := server.managedValidateReport(generateTestReport(1, 116, priv))
+	if rv.Outcome != reportOutsideAuthorization.String() {
+		t.Fatal("unexpected validation outcome:", rv.Outcome, rv.Checks)
+	}
+	_, otherPriv := glow.GenerateKeyPair()
+	outcome, authenticated := server.managedHandleEquipmentReport(generateTestReport(1, 116, otherPriv))
+	if outcome != reportBadSignature || authenticated {
+		t.Fatal("a report from a foreign key was authenticated:", outcome)
+	}
+
+	if reportOutsideAuthorization.apiErrorCode() != ErrCodeOutsideAuthorization || reportOutsideAuthorization.ackStatus() != glow.ReportAckOutsideAuthorization {
+		t.Fatal("the outcome has the wrong code")
+	}
+	var metrics strings.Builder
+	server.staticMetrics.WritePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), "reports_rejected_total{reason=\"outside_authorization\"} 3\n") {
+		t.Fatal("unexpected metrics:", metrics.String())
+	}
+}
@@ -1,8 +1,22 @@
 package server
 
+// authorized_servers.go holds the list of GCA servers, which the GCA extends
+// by signing a registration and shrinks by signing a removal. Both arrive
+// through /api/v1/register-server and get appended to the authorized servers
+// file. The file is also watched, see threadedWatchAuthorizedServers, so an
+// operator can sync the file from another server or restore it from a backup
+// and the server picks up the new entries without a restart, and announces
+// them to its peers like it would a registration that came in through the
+// API. Entries that disappear from the file are not removed, only a signed
+// removal does that.
+
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/glowlabs-org/gca-backend/glow"
 )
@@ -24,6 +38,11 @@ type AuthorizedServer struct {
 type AuthorizedServers struct {
 	servers []AuthorizedServer
 
+	// The size and the modification time of the authorized servers file
+	// when it was last read.
+	fileSize    int64
+	fileModTime time.Time
+
 	mu sync.Mutex
 }
 
@@ -39,29 +58,226 @@ func (gcas *GCAServer) AuthorizedServers() []AuthorizedServer {
 
 // Create the serialization for the AuthorizedServer.
 func (as *AuthorizedServer) Serialize() []byte {
-	// Calculate the length.
-	locationLength := len(as.Location)
-	totalLength := 104 + locationLength
-	data := make([]byte, totalLength)
-
-	// Serialize the fields, except the signature.
-	copy(data[0:32], as.PublicKey[:])
-	if as.Banned {
-		data[32] = 1
-	} else {
-		data[32] = 0
-	}
-	data[33] = byte(locationLength)
-	copy(data[34:], []byte(as.Location))
-	binary.LittleEndian.PutUint16(data[34+locationLength:], as.HttpPort)
-	binary.LittleEndian.PutUint16(data[36+locationLength:], as.TcpPort)
-	binary.LittleEndian.PutUint16(data[38+locationLength:], as.UdpPort)
-	copy(data[40+locationLength:], as.GCAAuthorization[:])
-	return data
+	data := make([]byte, 0, 104+len(as.Location))
+	data = glow.AppendAuthorizedServer(data, as.PublicKey, as.Banned, as.Location, as.HttpPort, as.TcpPort, as.UdpPort)
+	return append(data, as.GCAAuthorization[:]...)
 }
 
 // SigningBytes generates the byte slice for signing an AuthorizedServer.
 func (as *AuthorizedServer) SigningBytes() []byte {
-	data := as.Serialize()
-	return append([]byte("AuthorizedServer"), data[:len(data)-64]...)
+	return glow.SerializeAuthorizedServerForSigning(as.PublicKey, as.Banned, as.Location, as.HttpPort, as.TcpPort, as.UdpPort)
+}
+
+// DeserializeAuthorizedServer reverses a call to Serialize. It returns the
+// number of bytes that were consumed, as the size of a serialized server
+// depends on the length of its location.
+func DeserializeAuthorizedServer(data []byte) (AuthorizedServer, int, error) {
+	var as AuthorizedServer
+	if len(data) < 104 {
+		return as, 0, errors.New("authorized server is too short")
+	}
+	locationLength := int(data[33])
+	if len(data) < 104+locationLength {
+		return as, 0, errors.New("authorized server is too short")
+	}
+	copy(as.PublicKey[:], data[0:32])
+	switch data[32] {
+	case 0:
+	case 1:
+		as.Banned = true
+	default:
+		return as, 0, fmt.Errorf("invalid banned flag: %v", data[32])
+	}
+	as.Location = string(data[34 : 34+locationLength])
+	as.HttpPort = binary.LittleEndian.Uint16(data[34+locationLength:])
+	as.TcpPort = binary.LittleEndian.Uint16(data[36+locationLength:])
+	as.UdpPort = binary.LittleEndian.Uint16(data[38+locationLength:])
+	copy(as.GCAAuthorization[:], data[40+locationLength:104+locationLength])
+	return as, 104 + locationLength, nil
+}
+
+// isServerUpdate returns whether a registration changes the list of servers.
+// The GCA isn't allowed to update the information (like location and ports)
+// of a server. Any updates are ignored, the server would instead have to be
+// removed and a new public key would need to be created. A removal is final.
+//
+// The caller must hold the lock of the server list.
+func (gcas *GCAServer) isServerUpdate(as AuthorizedServer) bool {
+	for _, s := range gcas.gcaServers.servers {
+		if s.PublicKey == as.PublicKey {
+			return !s.Banned && as.Banned
+		}
+	}
+	return true
+}
+
+// applyAuthorizedServer adds a registration to the list of servers, or
+// replaces the entry of a server that got removed. The registration must be
+// an update according to isServerUpdate.
+//
+// The caller must hold the lock of the server list.
+func (gcas *GCAServer) applyAuthorizedServer(as AuthorizedServer) {
+	for i, s := range gcas.gcaServers.servers {
+		if s.PublicKey == as.PublicKey {
+			gcas.gcaServers.servers[i] = as
+			return
+		}
+	}
+	gcas.gcaServers.servers = append(gcas.gcaServers.servers, as)
+}
+
+// managedRegisterServer verifies a registration or a removal signed by the
+// GCA, and saves it if it changes the list of servers. The bool indicates
+// whether the list changed.
+func (gcas *GCAServer) managedRegisterServer(as AuthorizedServer) (bool, error) {
+	gcas.mu.RLock()
+	available, gcaPubkey := gcas.gcaPubkeyAvailable, gcas.gcaKeyAt(gcas.currentTimeslot())
+	gcas.mu.RUnlock()
+	if !available {
+		return false, errNotInitialized
+	}
+	if len(as.Location) > 255 {
+		return false, withCode(ErrCodeMalformedRequest, fmt.Errorf("location is %v bytes, at most 255 are allowed", len(as.Location)))
+	}
+	if !glow.Verify(gcaPubkey, as.SigningBytes(), as.GCAAuthorization) {
+		return false, withCode(ErrCodeInvalidSignature, errors.New("invalid signature on authorized server"))
+	}
+
+	gcas.gcaServers.mu.Lock()
+	defer gcas.gcaServers.mu.Unlock()
+	if !gcas.isServerUpdate(as) {
+		return false, nil
+	}
+	err := gcas.recordAudit(auditRecord{
+		action:     glow.AuditServerRegistration,
+		request:    as.Serialize(),
+		signatures: []glow.AuditSignature{{PublicKey: gcaPubkey, SigningBytes: as.SigningBytes(), Signature: as.GCAAuthorization}},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := gcas.staticStorage.AppendFile(AuthorizedServersFile, as.Serialize(), 0644); err != nil {
+		return false, fmt.Errorf("unable to save authorized server: %v", err)
+	}
+	gcas.applyAuthorizedServer(as)
+	return true, nil
+}
+
+// parseAuthorizedServers decodes the contents of the authorized servers file
+// and verifies every entry against the keys of the GCA. The mutex must be
+// held.
+func (gcas *GCAServer) parseAuthorizedServers(data []byte) ([]AuthorizedServer, error) {
+	var servers []AuthorizedServer
+	for i := 0; len(data) > 0; i++ {
+		as, n, err := DeserializeAuthorizedServer(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v: record %v: %v", AuthorizedServersFile, i, err)
+		}
+		if !gcas.verifyPersistedGCASignature(as.SigningBytes(), as.GCAAuthorization) {
+			return nil, fmt.Errorf("%v: record %v: invalid signature on authorized server", AuthorizedServersFile, i)
+		}
+		servers = append(servers, as)
+		data = data[n:]
+	}
+	return servers, nil
+}
+
+// applyAuthorizedServers applies the entries that change the list of servers,
+// in order, and returns them.
+//
+// The caller must hold the lock of the server list.
+func (gcas *GCAServer) applyAuthorizedServers(servers []AuthorizedServer) []AuthorizedServer {
+	var applied []AuthorizedServer
+	for _, as := range servers {
+		if gcas.isServerUpdate(as) {
+			gcas.applyAuthorizedServer(as)
+			applied = append(applied, as)
+		}
+	}
+	return applied
+}
+
+// loadAuthorizedServers loads the registrations and removals of servers from
+// disk, creating the file if it does not exist yet. This needs to happen after
+// the GCA key is loaded.
+func (gcas *GCAServer) loadAuthorizedServers() error {
+	data, err := gcas.staticStorage.ReadFile(AuthorizedServersFile)
+	if os.IsNotExist(err) {
+		err = gcas.staticStorage.WriteFile(AuthorizedServersFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read authorized servers file: %v", err)
+	}
+	info, err := gcas.staticStorage.Stat(AuthorizedServersFile)
+	if err != nil {
+		return fmt.Errorf("unable to stat authorized servers file: %v", err)
+	}
+	servers, err := gcas.parseAuthorizedServers(data)
+	if err != nil {
+		return err
+	}
+	gcas.gcaServers.mu.Lock()
+	defer gcas.gcaServers.mu.Unlock()
+	gcas.applyAuthorizedServers(servers)
+	gcas.gcaServers.fileSize, gcas.gcaServers.fileModTime = info.Size(), info.ModTime()
+	return nil
+}
+
+// managedReloadAuthorizedServers reads the authorized servers file again if it
+// changed since it was last read, and applies the entries that change the
+// list of servers, which it returns. Nothing is applied if any entry of the
+// file is invalid, and an invalid file is only reported once.
+func (gcas *GCAServer) managedReloadAuthorizedServers() ([]AuthorizedServer, error) {
+	info, err := gcas.staticStorage.Stat(AuthorizedServersFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat authorized servers file: %v", err)
+	}
+	gcas.gcaServers.mu.Lock()
+	unchanged := info.Size() == gcas.gcaServers.fileSize && info.ModTime().Equal(gcas.gcaServers.fileModTime)
+	gcas.gcaServers.mu.Unlock()
+	if unchanged {
+		return nil, nil
+	}
+	data, err := gcas.staticStorage.ReadFile(AuthorizedServersFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read authorized servers file: %v", err)
+	}
+	gcas.mu.RLock()
+	servers, err := gcas.parseAuthorizedServers(data)
+	gcas.mu.RUnlock()
+	gcas.gcaServers.mu.Lock()
+	defer gcas.gcaServers.mu.Unlock()
+	gcas.gcaServers.fileSize, gcas.gcaServers.fileModTime = info.Size(), info.ModTime()
+	if err != nil {
+		return nil, err
+	}
+	return gcas.applyAuthorizedServers(servers), nil
+}
+
+// threadedWatchAuthorizedServers checks the authorized servers file for
+// changes until the server shuts down. A reload checks it as well.
+func (gcas *GCAServer) threadedWatchAuthorizedServers() {
+	for {
+		if !gcas.sleep(authorizedServersCheckFrequency) {
+			return
+		}
+		if _, err := gcas.managedPickUpAuthorizedServers(); err != nil {
+			gcas.logger.Errorf("unable to reload the authorized servers: %v", err)
+		}
+	}
+}
+
+// managedPickUpAuthorizedServers reloads the authorized servers file and
+// announces the entries that changed the list, returning how many did.
+func (gcas *GCAServer) managedPickUpAuthorizedServers() (int, error) {
+	applied, err := gcas.managedReloadAuthorizedServers()
+	if err != nil {
+		return 0, err
+	}
+	for _, as := range applied {
+		log := gcas.logger.WithFields("server", glow.HostPort(as.Location, as.HttpPort), "banned", as.Banned)
+		log.Info("picked up a change to the authorized servers file")
+		gcas.managedAnnounceServer(as, log)
+	}
+	return len(applied), nil
 }
@@ -0,0 +1,212 @@
+package server
+
+// backup_restore.go unpacks a backup that was taken with the backup endpoint
+// into a new server directory. The restore happens before the server is
+// started for the first time, so that the server never sees a partially
+// restored directory.
+//
+// A restore only goes into an empty directory, which rules out mixing the
+// state of two servers. Nothing is trusted until the whole backup has been
+// read: every file has to match the checksum in the manifest, the manifest
+// has to be signed by the server key that is inside the backup, and the GCA
+// key inside the backup has to match the manifest. If any of the checks fail,
+// everything that was unpacked is removed again.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// backupManifestMaxSize is the largest manifest that a restore will read.
+const backupManifestMaxSize = 1 << 24
+
+// RestoreBackup unpacks the backup in r into dir, which must be empty or not
+// exist yet. If expected is not the zero key, the backup must belong to the
+// server with that public key, which catches restoring the backup of the
+// wrong server.
+func RestoreBackup(r io.Reader, dir string, expected glow.PublicKey) (BackupManifest, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return BackupManifest{}, fmt.Errorf("unable to read the server directory: %v", err)
+	}
+	if len(entries) != 0 {
+		return BackupManifest{}, fmt.Errorf("the server directory %v is not empty", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return BackupManifest{}, fmt.Errorf("unable to create the server directory: %v", err)
+	}
+
+	manifest, err := unpackBackup(r, dir, expected)
+	if err != nil {
+		// The directory was empty, so everything in it came from the
+		// backup.
+		entries, _ := ioutil.ReadDir(dir)
+		for _, e := range entries {
+			os.RemoveAll(filepath.Join(dir, e.Name()))
+		}
+		return BackupManifest{}, err
+	}
+	return manifest, nil
+}
+
+// unpackBackup writes the files of the backup into dir and verifies them
+// against the manifest.
+func unpackBackup(r io.Reader, dir string, expected glow.PublicKey) (BackupManifest, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return BackupManifest{}, fmt.Errorf("unable to decompress backup: %v", err)
+	}
+	tr := tar.NewReader(zr)
+
+	var manifest BackupManifest
+	haveManifest := false
+	unpacked := make(map[string]BackupFile)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return BackupManifest{}, fmt.Errorf("unable to read backup: %v", err)
+		}
+		if haveManifest {
+			return BackupManifest{}, fmt.Errorf("backup has files after the manifest")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return BackupManifest{}, fmt.Errorf("backup entry %v is not a regular file", hdr.Name)
+		}
+		if hdr.Name == BackupManifestFile {
+			data, err := ioutil.ReadAll(io.LimitReader(tr, backupManifestMaxSize))
+			if err != nil {
+				return BackupManifest{}, fmt.Errorf("unable to read manifest: %v", err)
+			}
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return BackupManifest{}, fmt.Errorf("unable to decode manifest: %v", err)
+			}
+			haveManifest = true
+			continue
+		}
+
+		// Refuse names that would escape the server directory.
+		name := path.Clean(hdr.Name)
+		if name != hdr.Name || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return BackupManifest{}, fmt.Errorf("backup entry has an invalid name: %v", hdr.Name)
+		}
+		if _, exists := unpacked[name]; exists {
+			return BackupManifest{}, fmt.Errorf("backup contains %v twice", name)
+		}
+		bf, err := unpackBackupFile(tr, filepath.Join(dir, filepath.FromSlash(name)), os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return BackupManifest{}, fmt.Errorf("unable to unpack %v: %v", name, err)
+		}
+		bf.Name = name
+		unpacked[name] = bf
+	}
+	if !haveManifest {
+		return BackupManifest{}, fmt.Errorf("backup has no manifest")
+	}
+	if err := verifyBackup(dir, manifest, unpacked, expected); err != nil {
+		return BackupManifest{}, err
+	}
+	return manifest, nil
+}
+
+// unpackBackupFile writes a single file of the backup to disk, and returns
+// its size and checksum.
+func unpackBackupFile(r io.Reader, dest string, perm os.FileMode) (BackupFile, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return BackupFile{}, err
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hasher), r)
+	if err != nil {
+		f.Close()
+		return BackupFile{}, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return BackupFile{}, err
+	}
+	if err := f.Close(); err != nil {
+		return BackupFile{}, err
+	}
+	return BackupFile{Size: size, Checksum: hex.EncodeToString(hasher.Sum(nil))}, nil
+}
+
+// verifyBackup checks the unpacked files against the manifest, and checks
+// that the keys in the backup are consistent with each other.
+func verifyBackup(dir string, manifest BackupManifest, unpacked map[string]BackupFile, expected glow.PublicKey) error {
+	serverKey, err := glow.ParsePublicKey(manifest.ServerPublicKey)
+	if err != nil {
+		return fmt.Errorf("manifest has an invalid server key: %v", err)
+	}
+	if expected != (glow.PublicKey{}) && serverKey != expected {
+		return fmt.Errorf("backup belongs to server %x, not to server %x", serverKey, expected)
+	}
+	sigBytes, err := hex.DecodeString(manifest.Signature)
+	var sig glow.Signature
+	if err != nil || len(sigBytes) != len(sig) {
+		return fmt.Errorf("manifest has an invalid signature")
+	}
+	copy(sig[:], sigBytes)
+	if !glow.Verify(serverKey, manifest.SigningBytes(), sig) {
+		return fmt.Errorf("manifest is not signed by server %x", serverKey)
+	}
+
+	// Every file must be in the manifest with the same checksum, and
+	// nothing may be missing.
+	if len(manifest.Files) != len(unpacked) {
+		return fmt.Errorf("backup has %v files, the manifest lists %v", len(unpacked), len(manifest.Files))
+	}
+	for _, want := range manifest.Files {
+		got, exists := unpacked[want.Name]
+		if !exists {
+			return fmt.Errorf("backup is missing %v", want.Name)
+		}
+		if got.Size != want.Size || got.Checksum != want.Checksum {
+			return fmt.Errorf("%v does not match its checksum", want.Name)
+		}
+	}
+
+	// The keys of the server have to be the keys that signed the
+	// manifest, and the GCA key has to be the one in the manifest.
+	keys, err := ioutil.ReadFile(filepath.Join(dir, "server.keys"))
+	if err != nil || len(keys) != 96 {
+		return fmt.Errorf("backup does not contain the server keys")
+	}
+	var pub glow.PublicKey
+	var priv glow.PrivateKey
+	copy(pub[:], keys[:32])
+	copy(priv[:], keys[32:])
+	if pub != serverKey {
+		return fmt.Errorf("server keys in the backup belong to %x, but the manifest was signed by %x", pub, serverKey)
+	}
+	check := []byte("BackupKeyCheck")
+	if !glow.Verify(pub, check, glow.Sign(check, priv)) {
+		return fmt.Errorf("server private key in the backup does not match the public key")
+	}
+	gcaKey, err := ioutil.ReadFile(filepath.Join(dir, "gcaPubKey.dat"))
+	if err != nil {
+		return fmt.Errorf("backup does not contain the gca key")
+	}
+	if hex.EncodeToString(gcaKey) != manifest.GCAPublicKey {
+		return fmt.Errorf("gca key in the backup does not match the manifest")
+	}
+	return nil
+}
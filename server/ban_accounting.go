@@ -0,0 +1,192 @@
+package server
+
+// ban_accounting.go contains the one rule for how a banned device counts
+// toward the totals that the server publishes: the reports that the device
+// sent for the timeslots before its ban timeslot count, the reports for the
+// ban timeslot and everything after it never do. The ban timeslot is the
+// conflicting report of an equivocation, or the timeslot at which the GCA
+// ordered the ban, see api_banned_equipment.go. A ban that predates the ban
+// records has no timeslot and none of its reports count.
+//
+// A ban removes the device from the equipment, but the reports that still
+// count are kept in bannedDevices for as long as the ban timeslot is in the
+// reporting window. Every endpoint that adds up reports finds the reports of
+// a device through windowReports and decides whether a timeslot counts with
+// reportCounts, so the all-device-stats, the device summary, the period
+// totals, the period summary and the device export all agree on what a
+// banned device produced. Each of them lists the banned device with an
+// explicit banned flag and the ban timeslot.
+//
+// The reports that don't count are cleared when the device gets banned, and
+// the overrides of the GCA for those timeslots are ignored. After a restart
+// the reports are loaded back from the reports files, see loadReport.
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// bannedDevice holds the part of the reporting window of a banned device that
+// still counts toward its totals.
+type bannedDevice struct {
+	PublicKey   glow.PublicKey
+	Reports     *deviceReports
+	ImpactRates *[4032]float64
+}
+
+// banTimeslot returns the timeslot at which a device was banned. The bool is
+// false if the device isn't banned. The mutex must be held.
+func (gcas *GCAServer) banTimeslot(shortID uint32) (uint32, bool) {
+	if _, banned := gcas.equipmentBans[shortID]; !banned {
+		return 0, false
+	}
+	return gcas.equipmentBanRecords[shortID].Timeslot, true
+}
+
+// reportCounts returns whether the report of a device for the provided
+// timeslot counts toward the totals of the device. The mutex must be held.
+func (gcas *GCAServer) reportCounts(shortID uint32, timeslot uint32) bool {
+	banTimeslot, banned := gcas.banTimeslot(shortID)
+	return !banned || timeslot < banTimeslot
+}
+
+// windowReports returns the reports of a device in the reporting window, for
+// a banned device only the ones that count. The mutex must be held.
+func (gcas *GCAServer) windowReports(shortID uint32) (*deviceReports, bool) {
+	if dr, exists := gcas.equipmentReports[shortID]; exists {
+		return dr, true
+	}
+	if bd, exists := gcas.bannedDevices[shortID]; exists {
+		return bd.Reports, true
+	}
+	return nil, false
+}
+
+// windowImpactRates returns the impact rates of a device in the reporting
+// window. The mutex must be held.
+func (gcas *GCAServer) windowImpactRates(shortID uint32) *[4032]float64 {
+	if rates, exists := gcas.equipmentImpactRate[shortID]; exists {
+		return rates
+	}
+	if bd, exists := gcas.bannedDevices[shortID]; exists {
+		return bd.ImpactRates
+	}
+	return new([4032]float64)
+}
+
+// devicePublicKey returns the authorization key of a device that has reports
+// in the reporting window. The mutex must be held.
+func (gcas *GCAServer) devicePublicKey(shortID uint32) glow.PublicKey {
+	if bd, exists := gcas.bannedDevices[shortID]; exists {
+		return bd.PublicKey
+	}
+	return gcas.equipment[shortID].PublicKey
+}
+
+// deviceShortID returns the ShortID of the device with the provided
+// authorization key, whether or not the device is banned. The mutex must be
+// held.
+func (gcas *GCAServer) deviceShortID(pubkey glow.PublicKey) (uint32, bool) {
+	if shortID, exists := gcas.equipmentShortID[pubkey]; exists {
+		return shortID, true
+	}
+	return gcas.bannedDeviceShortID(pubkey)
+}
+
+// windowShortIDs returns the ShortIDs of every device with reports in the
+// reporting window, including the banned devices, in order. The mutex must be
+// held.
+func (gcas *GCAServer) windowShortIDs() []uint32 {
+	shortIDs := make([]uint32, 0, len(gcas.equipmentReports)+len(gcas.bannedDevices))
+	for shortID := range gcas.equipmentReports {
+		shortIDs = append(shortIDs, shortID)
+	}
+	for shortID := range gcas.bannedDevices {
+		shortIDs = append(shortIDs, shortID)
+	}
+	sort.Slice(shortIDs, func(i, j int) bool { return shortIDs[i] < shortIDs[j] })
+	return shortIDs
+}
+
+// retainBannedReports moves the reports of a device that is being banned to
+// bannedDevices, clearing the reports that don't count. Nothing is kept if
+// the ban timeslot is before the reporting window. The ban must already be
+// recorded. The mutex must be held.
+func (gcas *GCAServer) retainBannedReports(shortID uint32) {
+	dr, exists := gcas.equipmentReports[shortID]
+	banTimeslot, _ := gcas.banTimeslot(shortID)
+	if !exists || banTimeslot < gcas.equipmentReportsOffset {
+		return
+	}
+	rates, exists := gcas.equipmentImpactRate[shortID]
+	if !exists {
+		rates = new([4032]float64)
+	}
+	for i := range dr.PowerOutputs {
+		if !gcas.reportCounts(shortID, gcas.equipmentReportsOffset+uint32(i)) {
+			dr.clear(i)
+			rates[i] = 0
+		}
+	}
+	gcas.bannedDevices[shortID] = &bannedDevice{
+		PublicKey:   gcas.equipment[shortID].PublicKey,
+		Reports:     dr,
+		ImpactRates: rates,
+	}
+	gcas.recomputeDeviceTotals(shortID, dr)
+}
+
+// retainBannedReport adds a report of a banned device that was loaded from
+// disk, if the report counts. The first report for a timeslot is kept, any
+// other one is the equivocation that got the device banned. The mutex must be
+// held.
+func (gcas *GCAServer) retainBannedReport(report glow.EquipmentReport, record uint32) {
+	bd, exists := gcas.bannedDevices[report.ShortID]
+	ero := gcas.equipmentReportsOffset
+	if !exists || report.Timeslot < ero || report.Timeslot >= ero+4032 || !gcas.reportCounts(report.ShortID, report.Timeslot) {
+		return
+	}
+	i := int(report.Timeslot - ero)
+	if bd.Reports.PowerOutputs[i] == 0 {
+		bd.Reports.setReport(i, report, record)
+	}
+}
+
+// parseBannedReport verifies a report that was loaded from disk against the
+// key of a banned device, as parseReport only knows the equipment that isn't
+// banned. The error of parseReport is returned for any other report. The
+// mutex must be held.
+func (gcas *GCAServer) parseBannedReport(rawData []byte, parseErr error) (glow.EquipmentReport, error) {
+	report, err := glow.DeserializeReport(rawData)
+	if err != nil {
+		return report, parseErr
+	}
+	bd, exists := gcas.bannedDevices[report.ShortID]
+	if !exists {
+		return report, parseErr
+	}
+	if !gcas.verifyDeviceSignature(bd.PublicKey, report.Timeslot, report.SigningBytes(), report.Signature) {
+		return report, errors.New("failed to verify signature")
+	}
+	return report, nil
+}
+
+// migrateBannedDevices shifts the reports of the banned devices along with
+// the reporting window, and drops the banned devices whose ban timeslot is no
+// longer in the window, as none of their reports in the window count. The
+// mutex must be held.
+func (gcas *GCAServer) migrateBannedDevices(shift bool) {
+	for shortID, bd := range gcas.bannedDevices {
+		if banTimeslot, _ := gcas.banTimeslot(shortID); banTimeslot < gcas.equipmentReportsOffset {
+			delete(gcas.bannedDevices, shortID)
+			continue
+		}
+		if shift {
+			bd.Reports.shift()
+			copy(bd.ImpactRates[:2016], bd.ImpactRates[2016:])
+			clear(bd.ImpactRates[2016:])
+		}
+	}
+}
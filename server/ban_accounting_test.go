@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestBannedDeviceAccounting bans a device in the middle of a week and checks
+// that the all-device-stats, the device summary, the period totals, the
+// device export and the period summary all list it as banned and agree on its
+// totals, counting the reports and overrides from before the ban timeslot and
+// none of the ones from the ban timeslot on, also after a restart.
+func TestBannedDeviceAccounting(t *testing.T) {
+	server, dir, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { server.Close() }()
+	glow.SetCurrentTimeslot(20)
+	defer glow.SetCurrentTimeslot(0)
+	ea, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, priv2, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The device reports for the timeslots 1 through 13, the GCA corrects
+	// one timeslot before the ban and one after it, and then the device
+	// signs a conflicting report for timeslot 11, which bans it from
+	// there on.
+	for ts := uint32(1); ts <= 13; ts++ {
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, ts, priv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+	for ts := uint32(1); ts <= 4; ts++ {
+		server.managedHandleEquipmentReport(generateTestReport(2, ts, priv2))
+	}
+	for _, ro := range []ReportOverride{
+		{PublicKey: ea.PublicKey, Timeslot: 3, PowerOutput: 50, Reason: "meter was reset", Timestamp: time.Now().Unix()},
+		{PublicKey: ea.PublicKey, Timeslot: 12, PowerOutput: 70, Reason: "meter was reset", Timestamp: time.Now().Unix()},
+	} {
+		if status, err := server.postReportOverride(ro, gcaPrivKey); err != nil || status != http.StatusOK {
+			t.Fatal("unable to override:", status, err)
+		}
+	}
+	er := glow.EquipmentReport{ShortID: 1, Timeslot: 11, PowerOutput: 9}
+	er.Signature = glow.Sign(er.SigningBytes(), priv)
+	if outcome, _ := server.managedHandleEquipmentReport(er.Serialize()); outcome != reportBanned {
+		t.Fatal("conflicting report did not ban the device:", outcome)
+	}
+	const banTimeslot = 11
+	const total = 9*5 + 50
+	const reports = 10
+
+	check := func(server *GCAServer) {
+		t.Helper()
+
+		// all-device-stats
+		status, ads, err := server.getAllDeviceStats("")
+		if err != nil || status != http.StatusOK || len(ads.Devices) != 2 {
+			t.Fatal("unable to fetch the stats:", status, err, len(ads.Devices))
+		}
+		ds := ads.Devices[0]
+		var energy int64
+		for _, output := range ds.PowerOutputs {
+			energy += int64(glow.CreditedPowerOutput(output))
+		}
+		if ds.PublicKey != ea.PublicKey || !ds.Banned || ds.BanTimeslot != banTimeslot || ds.Online || energy != total || ads.Devices[1].Banned {
+			t.Fatalf("unexpected stats: %v %v %v %v %v", ds.PublicKey, ds.Banned, ds.BanTimeslot, ds.Online, energy)
+		}
+
+		// v2 all-device-stats
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v2/all-device-stats?timeslot_offset=0&fields=short_id,totals,banned", server.httpPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v2 struct {
+			Devices []V2DeviceStats `json:"devices"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&v2)
+		resp.Body.Close()
+		if err != nil || len(v2.Devices) != 2 {
+			t.Fatal("unable to fetch the v2 stats:", err, len(v2.Devices))
+		}
+		v2ds := v2.Devices[0]
+		if v2ds.ShortID == nil || *v2ds.ShortID != 1 || !v2ds.Banned || v2ds.BanTimeslot == nil || *v2ds.BanTimeslot != banTimeslot || v2ds.Totals.Energy != total || v2ds.Totals.Reports != reports {
+			t.Fatalf("unexpected v2 stats: %+v %+v", v2ds, v2ds.Totals)
+		}
+		if v2.Devices[1].Banned || v2.Devices[1].BanTimeslot != nil {
+			t.Fatalf("the other device is banned: %+v", v2.Devices[1])
+		}
+
+		// device-summary, by pubkey and by ShortID
+		for _, query := range []string{fmt.Sprintf("pubkey=%x", ea.PublicKey), "short_id=1"} {
+			status, summary, err := server.getDeviceSummary(query)
+			if err != nil || status != http.StatusOK {
+				t.Fatal("unable to fetch the summary:", query, status, err)
+			}
+			if summary.PublicKey != ea.PublicKey || !summary.Banned || summary.BanTimeslot != banTimeslot || summary.Online || summary.TotalEnergy != total || summary.ReportsReceived != reports || summary.CorrectedTimeslots != 1 {
+				t.Fatalf("unexpected summary: %+v", summary)
+			}
+		}
+
+		// period-totals
+		status, totals, _, err := server.getPeriodTotals("")
+		if err != nil || status != http.StatusOK || len(totals) != 2 {
+			t.Fatal("unable to fetch the totals:", status, err, totals)
+		}
+		if pt := totals[0]; pt.ShortID != 1 || !pt.Banned || pt.BanTimeslot != banTimeslot || pt.TotalPower != total || pt.ReportCount != reports {
+			t.Fatalf("unexpected totals: %+v", pt)
+		}
+		if totals[1].Banned || totals[1].TotalPower != 20 {
+			t.Fatalf("unexpected totals of the other device: %+v", totals[1])
+		}
+
+		// device-export
+		data, code, err := server.fetchDeviceExport(ea.PublicKey)
+		if err != nil || code != http.StatusOK {
+			t.Fatal("unable to fetch the export:", code, err)
+		}
+		de, err := glow.VerifyDeviceExport(bytes.NewReader(data), gcaPubKey, server.staticPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs := make(map[uint32]uint64)
+		for _, report := range de.Reports {
+			outputs[report.Timeslot] = report.PowerOutput
+		}
+		for _, ro := range de.Overrides {
+			outputs[ro.Timeslot] = ro.PowerOutput
+		}
+		energy = 0
+		for _, output := range outputs {
+			energy += int64(glow.CreditedPowerOutput(output))
+		}
+		if !de.Manifest.Banned || len(de.Reports) != reports || energy != total {
+			t.Fatalf("unexpected export: %v %v %v", de.Manifest.Banned, len(de.Reports), energy)
+		}
+	}
+	check(server)
+
+	// The reports from before the ban are loaded back after a restart.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(server)
+
+	// The period summary agrees once the week is final.
+	glow.SetCurrentTimeslot(3300)
+	var data []byte
+	for i := 0; i < 100 && data == nil; i++ {
+		status, body, err := server.getPeriodSummary("0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status == http.StatusOK {
+			data = body
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if data == nil {
+		t.Fatal("the summary was not finalized")
+	}
+	body, err := glow.VerifySignedResponse(data, server.staticPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ps PeriodSummary
+	if err := json.Unmarshal(body, &ps); err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.Devices) != 2 || ps.TotalEnergy != total+20 {
+		t.Fatalf("unexpected summary: %+v", ps)
+	}
+	if pdt := ps.Devices[0]; pdt.ShortID != 1 || !pdt.Banned || pdt.BanTimeslot != banTimeslot || pdt.TotalEnergy != total || pdt.Reports != reports || pdt.CorrectedTimeslots != 1 {
+		t.Fatalf("unexpected summary of the banned device: %+v", pdt)
+	}
+	if ps.Devices[1].Banned {
+		t.Fatalf("the other device is banned: %+v", ps.Devices[1])
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+// buildinfo.go identifies the build of the running server, so that operators
+// can tell which build a remote server is on. The gca-server binary fills in
+// Build from the values that get injected with ldflags at build time.
+
+import "fmt"
+
+// BuildInfo describes a build of the server.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// Build is the build of the running server. The defaults identify a
+// development build that was compiled without ldflags.
+var Build = BuildInfo{
+	Version:   "dev",
+	Commit:    "unknown",
+	BuildDate: "unknown",
+}
+
+// String formats the build info for the --version flag.
+func (bi BuildInfo) String() string {
+	return fmt.Sprintf("%v (commit %v, built %v)", bi.Version, bi.Commit, bi.BuildDate)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestBuildInfo checks that the build info that main.go sets shows up in the
+// healthz and stats responses.
+func TestBuildInfo(t *testing.T) {
+	if Build.Version != "dev" {
+		t.Fatal("unexpected default version:", Build.Version)
+	}
+	defer func(old BuildInfo) { Build = old }(Build)
+	Build = BuildInfo{Version: "v1.2.3", Commit: "abc123", BuildDate: "2024-01-02T03:04:05Z"}
+
+	server, _, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	_, hr, err := server.getHealthz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hr.Version != Build.Version || hr.Commit != Build.Commit || hr.BuildDate != Build.BuildDate {
+		t.Fatal("unexpected build info in healthz:", hr)
+	}
+
+	_, ads, err := server.getAllDeviceStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ads.Build == nil || *ads.Build != Build {
+		t.Fatal("unexpected build info in the stats:", ads.Build)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v2/all-device-stats?timeslot_offset=0", server.httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var v2 V2AllDeviceStatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&v2); err != nil {
+		t.Fatal(err)
+	}
+	if v2.Build != Build {
+		t.Fatal("unexpected build info in the v2 stats:", v2.Build)
+	}
+}
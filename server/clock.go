@@ -0,0 +1,173 @@
+package server
+
+// clock.go contains the clock that the server asks for the current time, see
+// the clock package. Everything that depends on the time goes through the
+// clock of the server instead of calling time.Now or glow.CurrentTimeslot
+// directly: the report windows, the migration of the reports, the expiry of
+// the equipment, the rate limits, the timestamps exchanged with the other
+// servers, and the sleeps of the background loops, see gcas.sleep. This lets a
+// test swap in a clocktest.Manual clock through ServerOptions.Clock, and lets
+// an integration test fast-forward a running server through
+// /internal/set-time. Only the deadlines of network connections, which the
+// operating system enforces, and the guards of the test build against servers
+// that hang stay on the clock of the machine.
+//
+// The clock of the server wraps the configured clock with an offset, which is
+// zero until /internal/set-time gets called. The offset is only ever set in
+// internal test mode, and as long as it is zero the server asks the wrapped
+// clock for the timeslot, so the manual timeslot of the test build keeps
+// working.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server/clock"
+)
+
+// Clock is the source of the current time of a GCAServer.
+type Clock = clock.Clock
+
+// serverClock is a Clock that can be moved to a different time. The offset is
+// the number of nanoseconds that the clock is ahead of the wrapped clock.
+// Moving the clock does not change when the sleeps end.
+type serverClock struct {
+	wrapped Clock
+	offset  atomic.Int64
+	moved   atomic.Bool
+}
+
+// newServerClock wraps the provided clock, nil wraps the clock of the
+// machine.
+func newServerClock(c Clock) *serverClock {
+	if c == nil {
+		c = clock.System{}
+	}
+	return &serverClock{wrapped: c}
+}
+
+// Now implements Clock.
+func (sc *serverClock) Now() time.Time {
+	return sc.wrapped.Now().Add(time.Duration(sc.offset.Load()))
+}
+
+// After implements Clock.
+func (sc *serverClock) After(d time.Duration) <-chan time.Time {
+	return sc.wrapped.After(d)
+}
+
+// NewTicker implements Clock.
+func (sc *serverClock) NewTicker(d time.Duration) clock.Ticker {
+	return sc.wrapped.NewTicker(d)
+}
+
+// CurrentTimeslot implements Clock. Once the clock has been moved, the
+// timeslot follows from the time, and is zero before genesis.
+func (sc *serverClock) CurrentTimeslot() uint32 {
+	if !sc.moved.Load() {
+		return sc.wrapped.CurrentTimeslot()
+	}
+	timeslot, err := glow.UnixToTimeslot(sc.Now().Unix())
+	if err != nil {
+		return 0
+	}
+	return timeslot
+}
+
+// set moves the clock to the provided time.
+func (sc *serverClock) set(t time.Time) {
+	sc.offset.Store(int64(t.Sub(sc.wrapped.Now())))
+	sc.moved.Store(true)
+}
+
+// now returns the current time according to the clock of the server.
+func (gcas *GCAServer) now() time.Time {
+	return gcas.staticClock.Now()
+}
+
+// currentTimeslot returns the current timeslot according to the clock of the
+// server.
+func (gcas *GCAServer) currentTimeslot() uint32 {
+	return gcas.staticClock.CurrentTimeslot()
+}
+
+// sleep is tg.Sleep on the clock of the server. It returns false as soon as
+// the server is stopped, and true once the duration has passed.
+func (gcas *GCAServer) sleep(d time.Duration) bool {
+	select {
+	case <-gcas.tg.StopChan():
+		return false
+	default:
+	}
+	select {
+	case <-gcas.staticClock.After(d):
+		return true
+	case <-gcas.tg.StopChan():
+		return false
+	}
+}
+
+// SetTimeRequest is the request of /internal/set-time. Exactly one of the
+// fields must be set. A timeslot moves the clock to the start of the
+// timeslot.
+type SetTimeRequest struct {
+	Unix     *int64  `json:"unix"`
+	Timeslot *uint32 `json:"timeslot"`
+}
+
+// SetTimeResponse is the time of the server after /internal/set-time.
+type SetTimeResponse struct {
+	Unix     int64  `json:"unix"`
+	Timeslot uint32 `json:"timeslot"`
+}
+
+// InternalSetTimeHandler is an internal API that moves the clock of the
+// server, so that integration tests can fast-forward through the migration
+// of the reports and the expiry of the equipment. The clock keeps running
+// from the new time, and the reports get migrated right away if the new time
+// is past the weeks in memory. The API is rejected outside of internal test
+// mode.
+func (gcas *GCAServer) InternalSetTimeHandler(w http.ResponseWriter, r *http.Request) {
+	if !gcas.allowIntApis {
+		http.Error(w, "Not implemented in production", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req SetTimeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		return
+	}
+	var target time.Time
+	switch {
+	case req.Unix != nil && req.Timeslot == nil:
+		target = time.Unix(*req.Unix, 0)
+	case req.Timeslot != nil && req.Unix == nil:
+		target = time.Unix(glow.TimeslotToUnix(*req.Timeslot), 0)
+	default:
+		http.Error(w, "Exactly one of unix and timeslot must be set", http.StatusBadRequest)
+		return
+	}
+	if _, err := glow.UnixToTimeslot(target.Unix()); err != nil {
+		http.Error(w, "Time is outside of the protocol: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	gcas.staticClock.set(target)
+	gcas.managedCatchUpMigrations()
+	gcas.mu.Lock()
+	gcas.bumpStateVersion()
+	gcas.mu.Unlock()
+	gcas.logger.WithFields("unix", target.Unix()).Info("Moved the clock of the server")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SetTimeResponse{
+		Unix:     gcas.now().Unix(),
+		Timeslot: gcas.currentTimeslot(),
+	})
+}
@@ -0,0 +1,63 @@
+// Package clock contains the Clock that a GCA server reads the time from.
+//
+// The server never calls time.Now or glow.CurrentTimeslot directly, it asks
+// its Clock instead, and every background loop of the server sleeps on the
+// Clock. Production servers use System, tests can use clocktest.Manual to
+// step through migrations, expiries and report windows without sleeping.
+package clock
+
+import (
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// Clock is a source of the current time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that receives the current time once the
+	// duration has passed.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTicker returns a ticker that sends the current time on its
+	// channel every time the duration passes.
+	NewTicker(d time.Duration) Ticker
+
+	// CurrentTimeslot returns the current timeslot of the protocol.
+	CurrentTimeslot() uint32
+}
+
+// Ticker is a ticker created by a Clock.
+type Ticker interface {
+	// C returns the channel that the ticks get sent on.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker, no more ticks get sent after it returns.
+	Stop()
+}
+
+// System is the clock of the machine.
+type System struct{}
+
+// systemTicker is a Ticker of the clock of the machine.
+type systemTicker struct {
+	*time.Ticker
+}
+
+// Now implements Clock.
+func (System) Now() time.Time { return time.Now() }
+
+// After implements Clock.
+func (System) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// NewTicker implements Clock.
+func (System) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+// CurrentTimeslot implements Clock. The test build uses the manual timeslot of
+// glow.SetCurrentTimeslot.
+func (System) CurrentTimeslot() uint32 { return glow.CurrentTimeslot() }
+
+// C implements Ticker.
+func (st systemTicker) C() <-chan time.Time { return st.Ticker.C }
@@ -0,0 +1,174 @@
+// Package clocktest contains a manual clock for the tests of the GCA server.
+//
+// A Manual clock only moves when the test moves it, and the sleeps and the
+// tickers of the server fire as soon as the clock passes their deadline. The
+// test can wait for a background loop of the server to go back to sleep, which
+// makes a full iteration of the loop deterministic:
+//
+//	c := clocktest.NewManual(time.Unix(glow.GenesisTime, 0))
+//	opts := server.DefaultServerOptions()
+//	opts.Clock = c
+//	...
+//	c.Advance(time.Hour)
+//	c.WaitForSleep(time.Hour) // the loop that sleeps for an hour ran again
+package clocktest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server/clock"
+)
+
+// waiter is a call to After, or a ticker, that has not fired yet. Tickers
+// have a period, calls to After do not.
+type waiter struct {
+	deadline time.Time
+	duration time.Duration
+	period   time.Duration
+	c        chan time.Time
+}
+
+// Manual is a clock.Clock that only moves when Advance or Set gets called.
+type Manual struct {
+	now     time.Time
+	waiters []*waiter
+
+	mu   sync.Mutex
+	cond *sync.Cond
+}
+
+// ticker is a clock.Ticker of a Manual clock.
+type ticker struct {
+	m *Manual
+	w *waiter
+}
+
+// NewManual returns a manual clock that starts at the provided time.
+func NewManual(now time.Time) *Manual {
+	m := &Manual{now: now}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// Now implements clock.Clock.
+func (m *Manual) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// CurrentTimeslot implements clock.Clock. The timeslot follows from the time
+// of the clock, and is zero before genesis.
+func (m *Manual) CurrentTimeslot() uint32 {
+	timeslot, err := glow.UnixToTimeslot(m.Now().Unix())
+	if err != nil {
+		return 0
+	}
+	return timeslot
+}
+
+// After implements clock.Clock.
+func (m *Manual) After(d time.Duration) <-chan time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- m.now
+		return c
+	}
+	m.waiters = append(m.waiters, &waiter{deadline: m.now.Add(d), duration: d, c: c})
+	m.cond.Broadcast()
+	return c
+}
+
+// NewTicker implements clock.Clock. Like a time.Ticker, the ticker drops the
+// ticks that the receiver is too slow for.
+func (m *Manual) NewTicker(d time.Duration) clock.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := &waiter{deadline: m.now.Add(d), duration: d, period: d, c: make(chan time.Time, 1)}
+	m.waiters = append(m.waiters, w)
+	m.cond.Broadcast()
+	return ticker{m: m, w: w}
+}
+
+// C implements clock.Ticker.
+func (t ticker) C() <-chan time.Time { return t.w.c }
+
+// Stop implements clock.Ticker.
+func (t ticker) Stop() {
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	t.m.remove(t.w)
+}
+
+// remove drops a waiter. The mutex must be held.
+func (m *Manual) remove(w *waiter) {
+	for i, other := range m.waiters {
+		if other == w {
+			m.waiters = append(m.waiters[:i], m.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the clock forward by the provided duration.
+func (m *Manual) Advance(d time.Duration) {
+	m.Set(m.Now().Add(d))
+}
+
+// Set moves the clock to the provided time, and fires every call to After and
+// every ticker whose deadline has passed. Moving the clock backwards fires
+// nothing.
+func (m *Manual) Set(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now
+	var pending []*waiter
+	for _, w := range m.waiters {
+		if w.deadline.After(now) {
+			pending = append(pending, w)
+			continue
+		}
+		select {
+		case w.c <- now:
+		default:
+		}
+		if w.period > 0 {
+			for !w.deadline.After(now) {
+				w.deadline = w.deadline.Add(w.period)
+			}
+			pending = append(pending, w)
+		}
+	}
+	m.waiters = pending
+	m.cond.Broadcast()
+}
+
+// WaitForSleep blocks until something is waiting on a call to After with the
+// provided duration. A background loop of the server is identified by the
+// duration that it sleeps for, so calling WaitForSleep after Advance waits
+// for the loop to finish the iteration that the clock woke it up for.
+func (m *Manual) WaitForSleep(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for !m.sleeping(d) {
+		m.cond.Wait()
+	}
+}
+
+// sleeping returns whether a call to After with the provided duration has not
+// fired yet. The mutex must be held.
+func (m *Manual) sleeping(d time.Duration) bool {
+	for _, w := range m.waiters {
+		if w.period == 0 && w.duration == d {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestManual checks that the sleeps and the tickers of a manual clock fire
+// exactly when the clock passes their deadline.
+func TestManual(t *testing.T) {
+	start := time.Unix(glow.TimeslotToUnix(10), 0)
+	m := NewManual(start)
+	if !m.Now().Equal(start) || m.CurrentTimeslot() != 10 {
+		t.Fatal("unexpected start:", m.Now(), m.CurrentTimeslot())
+	}
+	fired := func(c <-chan time.Time) bool {
+		select {
+		case <-c:
+			return true
+		default:
+			return false
+		}
+	}
+
+	after := m.After(time.Minute)
+	ticker := m.NewTicker(time.Minute)
+	defer ticker.Stop()
+	m.WaitForSleep(time.Minute)
+	m.Advance(59 * time.Second)
+	if fired(after) || fired(ticker.C()) {
+		t.Fatal("fired before the deadline")
+	}
+	m.Advance(time.Second)
+	if !fired(after) || !fired(ticker.C()) {
+		t.Fatal("did not fire at the deadline")
+	}
+
+	// The ticker keeps ticking, but drops the ticks that were not received,
+	// and a stopped ticker does not tick at all.
+	m.Advance(3 * time.Minute)
+	if !fired(ticker.C()) || fired(ticker.C()) {
+		t.Fatal("unexpected ticks")
+	}
+	ticker.Stop()
+	m.Advance(time.Minute)
+	if fired(ticker.C()) {
+		t.Fatal("stopped ticker ticked")
+	}
+	if m.CurrentTimeslot() != 11 {
+		t.Fatal("unexpected timeslot:", m.CurrentTimeslot())
+	}
+
+	// WaitForSleep returns once a goroutine sleeps for the duration.
+	done := make(chan struct{})
+	go func() {
+		<-m.After(time.Hour)
+		close(done)
+	}()
+	m.WaitForSleep(time.Hour)
+	m.Advance(time.Hour)
+	<-done
+}
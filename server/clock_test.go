@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server/clock/clocktest"
+)
+
+// postSetTime moves the clock of the server through the internal API, and
+// returns the status and the time of the server after the call.
+func (gcas *GCAServer) postSetTime(t *testing.T, body string) (int, SetTimeResponse) {
+	t.Helper()
+	resp, err := http.Post("http://"+gcas.httpDialAddr()+"/internal/set-time", "application/json", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var str SetTimeResponse
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&str); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, str
+}
+
+// TestSetTime checks that the internal API moves the clock that the report
+// windows, the migration of the reports and the time endpoint use, and that
+// the API is rejected outside of internal test mode.
+func TestSetTime(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := server.postSetTime(t, `{"timeslot": 5000}`); status != http.StatusNotImplemented {
+		t.Fatal("the clock was moved outside of internal test mode:", status)
+	}
+	if server.currentTimeslot() != 0 {
+		t.Fatal("the clock moved:", server.currentTimeslot())
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A clock can also be provided when launching the server.
+	opts := DefaultServerOptions()
+	start := time.Unix(glow.TimeslotToUnix(77), 0)
+	opts.Clock = clocktest.NewManual(start)
+	server, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.currentTimeslot() != 77 || !server.now().Equal(start) {
+		t.Fatal("the provided clock was not used:", server.currentTimeslot(), server.now())
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err = NewGCAServer(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{`{}`, `{"timeslot": 5000, "unix": 5}`, `{"unix": 5}`, `nope`} {
+		if status, _ := server.postSetTime(t, body); status != http.StatusBadRequest {
+			t.Fatalf("bad request %v was accepted: %v", body, status)
+		}
+	}
+	status, str := server.postSetTime(t, `{"timeslot": 5000}`)
+	if status != http.StatusOK || str.Timeslot != 5000 {
+		t.Fatal("unable to move the clock:", status, str)
+	}
+
+	// The time endpoint, the report windows and the migration all follow
+	// the clock.
+	rec := httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/time", nil))
+	var tr TimeResponse
+	if err := json.NewDecoder(rec.Body).Decode(&tr); err != nil || tr.Timeslot != 5000 || tr.Unix < str.Unix {
+		t.Fatal("the time endpoint did not follow the clock:", tr, err)
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 10, ePriv)); outcome != reportStale {
+		t.Fatal("report from before the new time was not rejected:", outcome)
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 5000, ePriv)); outcome != reportAccepted {
+		t.Fatal("report at the new time was not accepted:", outcome)
+	}
+	if !server.migrationDue(0) {
+		t.Fatal("the migration did not follow the clock")
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+// components.go contains the registry of the background loops of the server.
+// A loop that is launched with launchComponent gets a name, and Close() stops
+// the loops one at a time, in the reverse order of their launch, so that a
+// loop that feeds another one is stopped after it. Close() waits up to
+// componentStopTimeout for each of them and logs the ones that don't stop in
+// time, which names the loop that is holding up the shutdown instead of
+// leaving a hung Close() to be debugged from a stack dump.
+//
+// The loops are stopped after the listeners are closed and the stop channel
+// of the threadgroup is closed, which is all that most of the loops need to
+// return. A loop that waits on something else can pass a stop function that
+// wakes it up. /debug/state lists the components and whether they are still
+// running.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// component is a background loop of the server.
+type component struct {
+	name string
+	stop func() // Wakes the loop up during shutdown, can be nil
+	done chan struct{}
+}
+
+// running returns whether the loop of the component hasn't returned yet.
+func (c *component) running() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// componentRegistry holds the components of the server, in the order that
+// they were launched.
+type componentRegistry struct {
+	components []*component
+	mu         sync.Mutex
+}
+
+// ComponentStatus is the state of a background loop, as listed by
+// /debug/state.
+type ComponentStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+}
+
+// launchComponent registers a background loop under the provided name and
+// launches it in the threadgroup. The loop has to return once the stop
+// channel of the threadgroup is closed, or once stop is called if it isn't
+// nil.
+func (gcas *GCAServer) launchComponent(name string, stop func(), loop func()) error {
+	c := &component{name: name, stop: stop, done: make(chan struct{})}
+	gcas.components.mu.Lock()
+	gcas.components.components = append(gcas.components.components, c)
+	gcas.components.mu.Unlock()
+	err := gcas.tg.Launch(func() {
+		defer close(c.done)
+		loop()
+	})
+	if err != nil {
+		close(c.done)
+	}
+	return err
+}
+
+// stopComponents stops the components in the reverse order of their launch,
+// giving each of them componentStopTimeout to return. It runs while the
+// threadgroup is stopping, see Close.
+func (gcas *GCAServer) stopComponents() error {
+	gcas.components.mu.Lock()
+	components := append([]*component(nil), gcas.components.components...)
+	gcas.components.mu.Unlock()
+
+	var stuck []string
+	for i := len(components) - 1; i >= 0; i-- {
+		c := components[i]
+		if c.stop != nil {
+			c.stop()
+		}
+		t := time.NewTimer(componentStopTimeout)
+		select {
+		case <-c.done:
+			t.Stop()
+		case <-t.C:
+			gcas.logger.Errorf("component %v did not stop within %v", c.name, componentStopTimeout)
+			stuck = append(stuck, c.name)
+		}
+	}
+	if len(stuck) > 0 {
+		return fmt.Errorf("components did not stop in time: %v", stuck)
+	}
+	return nil
+}
+
+// componentStatuses returns the state of every component, in the order that
+// they were launched.
+func (gcas *GCAServer) componentStatuses() []ComponentStatus {
+	gcas.components.mu.Lock()
+	defer gcas.components.mu.Unlock()
+	statuses := make([]ComponentStatus, 0, len(gcas.components.components))
+	for _, c := range gcas.components.components {
+		statuses = append(statuses, ComponentStatus{Name: c.name, Running: c.running()})
+	}
+	return statuses
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestComponents checks that the background loops register themselves, that
+// Close stops them in the reverse order of their launch, and that a loop that
+// doesn't stop in time gets named.
+func TestComponents(t *testing.T) {
+	server, _, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The loops of the server show up in the debug state.
+	w := httptest.NewRecorder()
+	server.DebugStateHandler(w, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+	var ds DebugStateResponse
+	if err := json.NewDecoder(w.Body).Decode(&ds); err != nil {
+		t.Fatal(err)
+	}
+	running := make(map[string]bool)
+	for _, cs := range ds.Components {
+		running[cs.Name] = cs.Running
+	}
+	for _, name := range []string{"migration", "peer-sync", "sync-listener", "watttime-impact-data", "watttime-week-data", "webhooks", "udp-listener", "report-worker-0", "http-server"} {
+		if !running[name] {
+			t.Errorf("component %v is not running: %v", name, ds.Components)
+		}
+	}
+
+	// Three more components, one of which ignores the shutdown for longer
+	// than the timeout.
+	var mu sync.Mutex
+	var stopped []string
+	stopper := func(name string) func() {
+		return func() {
+			mu.Lock()
+			stopped = append(stopped, name)
+			mu.Unlock()
+		}
+	}
+	release := make(chan struct{})
+	server.launchComponent("test-first", stopper("test-first"), func() { <-server.tg.StopChan() })
+	server.launchComponent("test-stuck", stopper("test-stuck"), func() { <-release })
+	server.launchComponent("test-last", stopper("test-last"), func() { <-server.tg.StopChan() })
+	time.AfterFunc(componentStopTimeout+500*time.Millisecond, func() { close(release) })
+
+	err = server.Close()
+	if err == nil || !strings.Contains(err.Error(), "test-stuck") || strings.Contains(err.Error(), "test-first") {
+		t.Fatal("the stuck component was not reported:", err)
+	}
+	if strings.Join(stopped, ",") != "test-last,test-stuck,test-first" {
+		t.Fatal("the components were not stopped in reverse order:", stopped)
+	}
+	if err := server.CheckComponentsStopped(); err != nil {
+		t.Fatal(err)
+	}
+}
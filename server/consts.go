@@ -1,7 +1,176 @@
 package server
 
+import "time"
+
 const (
 	equipmentReportSize = 80
+
+	// maxBatchReports is the largest number of reports that can be
+	// submitted in a single call to the batch reports endpoint, which is
+	// one day of reports for a single device.
+	maxBatchReports = 288
+
+	// maxBatchAuthorizations is the largest number of equipment
+	// authorizations that can be submitted in a single call to the bulk
+	// authorization endpoint.
+	maxBatchAuthorizations = 500
+
+	// maxRequestBody is the largest request body in bytes that the HTTP
+	// API accepts, except on the batch endpoints, which accept up to
+	// maxBatchRequestBody. The limits can be changed in
+	// server-config.json.
+	maxRequestBody      = 64 << 10
+	maxBatchRequestBody = 8 << 20
+
+	// maxReportStreams is the largest number of report stream connections
+	// that can be open at once.
+	maxReportStreams = 64
+
+	// reportStreamBufferSize is the number of reports that can be queued
+	// for a report stream consumer before the consumer gets dropped.
+	reportStreamBufferSize = 256
+
+	// defaultReportWindow is the number of timeslots that a report may be
+	// behind or ahead of the current timeslot by, unless the server
+	// options say otherwise. 432 timeslots is 36 hours.
+	defaultReportWindow = 432
+
+	// defaultKeyRotationOverlap is the number of timeslots past the
+	// activation of a device key rotation in which reports signed by the
+	// old key are still accepted, unless the server options say
+	// otherwise. 12 timeslots is one hour.
+	defaultKeyRotationOverlap = 12
+
+	// defaultMinFreeDisk is the number of free bytes in the persist
+	// directory below which the server stops accepting reports, unless
+	// the server options say otherwise, see persist_health.go.
+	defaultMinFreeDisk = 64 << 20
+
+	// defaultLateReportThreshold is the number of timeslots after the end
+	// of its timeslot at which a report counts as late, unless the server
+	// options say otherwise, see report_receipts.go. 12 timeslots is one
+	// hour.
+	defaultLateReportThreshold = 12
+
+	// reportMigrationThreshold is the number of timeslots that the current
+	// timeslot has to be past the start of the reports in memory before
+	// the oldest week gets rotated out.
+	reportMigrationThreshold = 3200
+
+	// defaultHistoryRetentionWeeks is the number of weeks of the stats
+	// history that are kept in memory, unless server-config.json says
+	// otherwise. Older weeks are read from the history file when they are
+	// needed.
+	defaultHistoryRetentionWeeks = 52
+
+	// defaultRetainedPeriods is the number of weeks before the reporting
+	// window whose signed reports stay queryable, unless the server options
+	// say otherwise, see retained_periods.go.
+	defaultRetainedPeriods = 1
+
+	// defaultStateChangeBuffer is the number of recent state changes that
+	// the stats-delta endpoint can return, unless the server options say
+	// otherwise, see api_stats_delta.go.
+	defaultStateChangeBuffer = 10000
+
+	// reportMigrationSlack is the number of timeslots that a migration may
+	// be late by, for example because fetching the WattTime data for the
+	// week took a while, without reports for the newest timeslots in the
+	// future window falling outside of the reports in memory.
+	reportMigrationSlack = 288
+
+	// deviceOnlineTimeslots is the number of timeslots that can pass since
+	// a device last reported before the device is considered offline,
+	// unless server-config.json says otherwise.
+	deviceOnlineTimeslots = 12
+
+	// defaultOfflineThreshold is the number of timeslots that a device can
+	// go without reporting before the offline webhooks fire, if the
+	// webhooks config does not say otherwise.
+	defaultOfflineThreshold = 12
+
+	// expiryWarningTimeslots is the number of timeslots before the
+	// authorization of a device expires at which the webhooks get warned,
+	// which is 30 days.
+	expiryWarningTimeslots = 30 * 288
+
+	// The defaults of the anomaly detection settings in
+	// server-config.json, see anomalies.go. The detection runs every
+	// hour, and flags 15 minutes of production at night, 3 hours of
+	// identical production, and production above 3 times the 95th
+	// percentile of the week before.
+	defaultAnomalyCheckTimeslots    = 12
+	defaultAnomalyNightTimeslots    = 3
+	defaultAnomalyConstantTimeslots = 36
+	defaultAnomalySpikeFactor       = 3
+	defaultAnomalySpikePercentile   = 95
+
+	// anomalyNightSunElevation is the elevation of the sun in degrees
+	// below which it is night for the anomaly detection. At -6 degrees,
+	// the end of civil twilight, there is no light left to produce
+	// anything from.
+	anomalyNightSunElevation = -6
+
+	// anomalySpikeHistory is the number of timeslots before a timeslot
+	// that its percentile is computed from, and anomalySpikeMinSamples
+	// is the smallest number of timeslots with production that the
+	// percentile needs.
+	anomalySpikeHistory    = 2016
+	anomalySpikeMinSamples = 288
+
+	// backupRequestWindow is the number of seconds that the timestamp of
+	// a backup request may be away from the current time.
+	backupRequestWindow = 300
+
+	// requestAuthWindow is the number of seconds that the timestamp of a
+	// signed HTTP request may be away from the current time.
+	requestAuthWindow = 300
+
+	// peerSyncWindow is the number of seconds that the timestamp of a
+	// peer sync hello may be away from the current time.
+	peerSyncWindow = 300
+
+	// loadingRetryAfter is the number of seconds that callers are told to
+	// wait before retrying a request for data that is still being loaded.
+	loadingRetryAfter = 5
+
+	// deviceBootstrapRetryAfter is the number of seconds that a device
+	// which hasn't been authorized yet is told to wait before asking for
+	// its bootstrap document again, see api_device_bootstrap.go.
+	deviceBootstrapRetryAfter = 60
+
+	// timeslotSeconds is the length of a timeslot.
+	timeslotSeconds = 300
+
+	// defaultRetryQueueMaxEntries is the number of deliveries that each
+	// retry queue holds before the oldest ones get dropped, see
+	// retry_queue.go.
+	defaultRetryQueueMaxEntries = 1000
+
+	// wattTimeAPIURL is the base URL of the WattTime API.
+	wattTimeAPIURL = "https://api.watttime.org"
+
+	// selfTestTimeout is how long the self test waits for WattTime and
+	// for each peer before the check fails.
+	selfTestTimeout = 5 * time.Second
+
+	// selfTestMaxClockSkew is the largest difference between the clock
+	// of the server and the clock of a peer that the self test accepts.
+	selfTestMaxClockSkew = 30 * time.Second
+
+	// wattTimeRetries is the number of times that a request to WattTime
+	// is attempted before the impact rates fall back to stale data.
+	wattTimeRetries = 4
+
+	// maxImpactRatesTimeslots is the largest number of timeslots that can
+	// be requested from the impact rates endpoint in a single call, which
+	// is four weeks.
+	maxImpactRatesTimeslots = 4 * 2016
+
+	// maxDeviceImpactTimeslots is the largest number of timeslots that the
+	// device impact endpoint will summarize in a single call, which is one
+	// year.
+	maxDeviceImpactTimeslots = 52 * 2016
 )
 
 const (
@@ -9,10 +178,173 @@ const (
 	// objects.
 	AllDeviceStatsHistoryFile = "allDeviceStats.dat"
 
-	// MaxCapacityBuffer determines how much a solar farm is allowed to
-	// exceed its capacity by in a 5 minute period without the report being
-	// banned. There's in implied division by 100, so 135 implies 135%.
-	MaxCapacityBuffer = 135
+	// DefaultCapacityTolerance determines how much a solar farm is
+	// allowed to exceed its capacity by in a 5 minute period without the
+	// report being flagged for review. There's an implied division by 100,
+	// so 20 allows reports of up to 120% of the capacity.
+	DefaultCapacityTolerance = 20
+
+	// DeviceNotesFile contains every note that the GCA has made on
+	// equipment, see device_notes.go.
+	DeviceNotesFile = "deviceNotes.dat"
+
+	// EquipmentDeauthorizationsFile contains every deauthorization that
+	// the GCA has issued for equipment.
+	EquipmentDeauthorizationsFile = "equipmentDeauthorizations.dat"
+
+	// EquipmentRegionsFile contains every region assignment that the GCA
+	// has issued for equipment.
+	EquipmentRegionsFile = "equipmentRegions.dat"
+
+	// EquipmentReportsFile contains the equipment reports that have been
+	// folded in from the journal. Every report in the file is a raw 80
+	// byte serialized report.
+	EquipmentReportsFile = "equipment-reports.dat"
+
+	// ReportsJournalFile contains the equipment reports that have been
+	// received since the last compaction. Each record is length prefixed
+	// and checksummed so that a torn write can be detected at startup.
+	ReportsJournalFile = "equipmentReportsJournal.dat"
+
+	// LegacyEquipmentAuthorizationsFile contains the equipment
+	// authorizations in the legacy format, which have no version byte and
+	// can therefore not share a file with the current format.
+	// EquipmentAuthorizationsFile contains the authorizations in the
+	// current format.
+	LegacyEquipmentAuthorizationsFile = "equipment-authorizations.dat"
+	EquipmentAuthorizationsFile       = "equipment-authorizations-v1.dat"
+
+	// FlaggedReportsFile contains the reports that exceeded the capacity
+	// of their equipment, and FlaggedReportReviewsFile contains the
+	// decisions of the GCA about those reports.
+	FlaggedReportsFile       = "flaggedReports.dat"
+	FlaggedReportReviewsFile = "flaggedReportReviews.dat"
+
+	// EquipmentBanProofsFile contains the proofs for equipment that was
+	// banned for signing conflicting reports.
+	EquipmentBanProofsFile = "equipmentBanProofs.dat"
+
+	// AuthorizedServersFile contains every server registration and
+	// removal that the GCA has signed, in the order they were received.
+	AuthorizedServersFile = "authorizedServers.dat"
+
+	// EquipmentImportsFile contains the devices that were imported from
+	// the servers of another GCA, see api_equipment_transfer.go.
+	EquipmentImportsFile = "equipmentImports.dat"
+
+	// ShortIDsFile contains every ShortID that was ever allocated, along
+	// with the public key it was allocated to, see short_ids.go.
+	ShortIDsFile = "shortIDs.dat"
+
+	// ImpactRatesFile contains the impact rates of the timeslots that are
+	// in memory, along with the flags of every impact rate that was
+	// filled from stale data, see impact_rates.go.
+	ImpactRatesFile = "impactRates.dat"
+
+	// HeartbeatsFile contains the heartbeats of the devices for the
+	// timeslots that are in memory, see heartbeats.go.
+	HeartbeatsFile = "heartbeats.dat"
+
+	// ReportReceiptsFile contains the times at which the reports that are
+	// in memory were received, see report_receipts.go.
+	ReportReceiptsFile = "report-receipts.dat"
+
+	// ServerKeysFile contains the keypair of the server, which gets
+	// created at the first startup.
+	ServerKeysFile = "server.keys"
+
+	// GCATempPubkeyFile contains the temp key of the GCA, which gets
+	// provisioned before the first startup, and GCAPubkeyFile the real key
+	// of the GCA once it registered, see api_server_gca_auth.go.
+	GCATempPubkeyFile = "gcaTempPubKey.dat"
+	GCAPubkeyFile     = "gcaPubKey.dat"
+
+	// TestGCAKeysFile contains the private keys that a server in internal
+	// test mode generates for itself when it wasn't provisioned, see
+	// test_gca_keys.go.
+	TestGCAKeysFile = "testGCAKeys.dat"
+
+	// GCARegistrationFile contains the registration of the real GCA key,
+	// including the signature from the temp key. Writing it is the step
+	// that retires the temp key, see api_server_gca_auth.go.
+	GCARegistrationFile = "gcaRegistration.dat"
+
+	// GCAKeyRotationsFile contains the chain of signed handoffs from the
+	// registered GCA key to each of its successors.
+	GCAKeyRotationsFile = "gcaKeyRotations.dat"
+
+	// DeviceKeyRotationsFile contains every key rotation of every device,
+	// counter-signed by the GCA.
+	DeviceKeyRotationsFile = "deviceKeyRotations.dat"
+
+	// BannedEquipmentFile contains the reason and the timeslot of every
+	// ban.
+	BannedEquipmentFile = "bannedEquipment.dat"
+
+	// AuditLogFile contains the hash chained record of every privileged
+	// action that the server accepted, see audit_log.go.
+	AuditLogFile = "auditLog.dat"
+
+	// ReportRootsFile contains the signed Merkle root of the reports of
+	// every week that has fallen out of the reporting window, see
+	// report_roots.go.
+	ReportRootsFile = "reportRoots.dat"
+
+	// WebhooksConfigFile contains the configuration for the device status
+	// webhooks. The webhooks are disabled if the file does not exist.
+	WebhooksConfigFile = "webhooks.json"
+
+	// WebhookQueueFile contains the webhook deliveries that have not
+	// succeeded yet, see webhook_queue.go.
+	WebhookQueueFile = "webhookQueue.json"
+
+	// SMTPQueueFile and SlackQueueFile contain the alerts that the email and
+	// the Slack backend have not delivered yet, see alerts.go.
+	SMTPQueueFile  = "smtpQueue.json"
+	SlackQueueFile = "slackQueue.json"
+
+	// OperatorDelegationsFile contains every delegation of scopes to an
+	// operator key that the GCA has signed, including revocations, see
+	// operator_keys.go.
+	OperatorDelegationsFile = "operatorDelegations.dat"
+
+	// AnomaliesFile contains the anomalies that the anomaly detection
+	// flagged, and AnomalyDismissalsFile every dismissal of an anomaly
+	// that the GCA has signed, see anomalies.go.
+	AnomaliesFile         = "anomalies.json"
+	AnomalyDismissalsFile = "anomalyDismissals.dat"
+
+	// ReportOverridesFile contains every override of a power output that
+	// the GCA has signed, see report_overrides.go.
+	ReportOverridesFile = "reportOverrides.dat"
+
+	// ServerConfigFile contains the settings that can be changed while
+	// the server is running, see reload.go.
+	ServerConfigFile = "server-config.json"
+
+	// ReportArchiveDir contains an archive of the signed reports for
+	// every week that has fallen out of the reporting window.
+	ReportArchiveDir = "archive"
+
+	// PortsFile contains the ports that the server's listeners are using.
+	// It gets written every time the server starts.
+	PortsFile = "serverPorts.dat"
+
+	// SQLiteDatabaseFile contains the persist files of a server that
+	// uses the SQLite storage backend, see storage_sqlite.go.
+	SQLiteDatabaseFile = "gca.db"
+
+	// LockFile is held by the server that runs in the directory, see
+	// dir_lock.go.
+	LockFile = "server.lock"
+
+	// ServerTimelineFile contains the operational timeline of the server,
+	// one JSON entry per line. CleanShutdownFile is written when the
+	// server closes and removed when it starts, and ServerAliveFile is
+	// rewritten while the server runs, see server_timeline.go.
+	ServerTimelineFile = "serverTimeline.json"
+	CleanShutdownFile  = "cleanShutdown.json"
+	ServerAliveFile    = "serverAlive.json"
 
 	// Full year to use for WattTime historical MOER data.
 	WattTimeYear = 2023
@@ -21,5 +353,5 @@ const (
 var (
 	// Change order of the public files: gca public key, equipment authorization, equipment reports, all device statistics.
 	// Files should be archived in reverse order.
-	PublicFiles = []string{"allDeviceStats.dat", "equipment-reports.dat", "equipment-authorizations.dat", "gcaPubKey.dat", "gcaTempPubKey.dat"}
+	PublicFiles = []string{"allDeviceStats.dat", "equipmentReportsJournal.dat", "equipment-reports.dat", "flaggedReports.dat", "flaggedReportReviews.dat", "reportOverrides.dat", "equipmentDeauthorizations.dat", "deviceKeyRotations.dat", "equipmentBanProofs.dat", "bannedEquipment.dat", "equipment-authorizations-v1.dat", "equipment-authorizations.dat", "gcaPubKey.dat", "gcaTempPubKey.dat"}
 )
@@ -10,18 +10,100 @@ import (
 const (
 	maxRecentReports        = 100e3
 	maxRecentEquipmentAuths = 1e3
-	serverIP                = "0.0.0.0"
+	serverIP                = "::"
 	httpPort                = 35015
 	tcpPort                 = 35030
 	udpPort                 = 35045
 	defaultLogLevel         = WARN
 	testMode                = false
-	serverShutdownTime      = 90 * time.Second
+	serverShutdownTime      = 5 * time.Second
+	udpDrainTimeout         = 5 * time.Second
+	componentStopTimeout    = 10 * time.Second
+	httpReadTimeout         = 45 * time.Second
 	wattTimeFrequency       = 2 * time.Minute
+	wattTimeRetryBackoff    = 2 * time.Second
 
-	ReportMigrationFrequency        = 1 * time.Hour
-	WattTimeWeekDataUpdateFrequency = 24 * time.Hour
+	ReportMigrationFrequency          = 1 * time.Hour
+	ReportsJournalCompactionFrequency = 1 * time.Hour
+	WattTimeWeekDataUpdateFrequency   = 24 * time.Hour
+
+	peerSyncFrequency = 15 * time.Minute
+	peerSyncLimit     = 4
+	peerSyncRate      = 15 * time.Minute
+	peerSyncTimeout   = 2 * time.Minute
+
+	peerProbeFrequency = 1 * time.Minute
+	peerProbeSpacing   = 1 * time.Second
+	peerProbeTimeout   = 10 * time.Second
+	peerDownThreshold  = 10 * time.Minute
+
+	reportStreamWriteTimeout = 10 * time.Second
+
+	deviceStatusCheckFrequency = 1 * time.Minute
+	retryQueueBackoff          = 5 * time.Second
+	retryQueueMaxBackoff       = 10 * time.Minute
+	anomalyCheckFrequency      = 1 * time.Minute
+	webhookTimeout             = 10 * time.Second
+	alertTimeout               = 30 * time.Second
+
+	diskCheckFrequency              = 1 * time.Minute
+	serverAliveFrequency            = 1 * time.Minute
+	authorizedServersCheckFrequency = 30 * time.Second
+	persistRetryBackoff             = 1 * time.Second
+	persistMaxBackoff               = 1 * time.Minute
 
 	apiArchiveLimit = 3
 	apiArchiveRate  = 3 * time.Second
+
+	// Each device may send two reports per timeslot, one for the regular
+	// cadence and one for retransmissions, plus a burst that covers every
+	// timeslot that is still inside the 432 timeslot acceptance window.
+	// Reports from ShortIDs that the server doesn't know share one budget.
+	deviceReportInterval  = 150 * time.Second
+	deviceReportBurst     = 432
+	unknownReportInterval = 10 * time.Millisecond
+	unknownReportBurst    = 100
+
+	// Every remote IP may make one request per second to the query
+	// endpoints of the HTTP API, with a burst of 60, and one write every
+	// 10 seconds, with a burst of 30. Budgets that have been full for
+	// httpLimiterPruneInterval get forgotten.
+	httpQueryInterval        = time.Second
+	httpQueryBurst           = 60
+	httpWriteInterval        = 10 * time.Second
+	httpWriteBurst           = 30
+	httpLimiterPruneInterval = 10 * time.Minute
+
+	// Every remote IP may validate one report every 30 seconds, with a
+	// burst of 10, which is far below what a device may submit. The
+	// validations don't count against the write budget.
+	validateReportInterval = 30 * time.Second
+	validateReportBurst    = 10
+
+	// Time probes from everyone share one budget.
+	timeProbeInterval = 10 * time.Millisecond
+	timeProbeBurst    = 100
+
+	// reportQueueSize is the number of UDP packets that can wait for a
+	// report worker before the listener starts dropping packets.
+	reportQueueSize = 4096
+
+	// The UDP listener waits udpRestartBackoff before it rebinds its
+	// socket after a fatal error, doubling the wait after every failed
+	// attempt up to udpRestartMaxBackoff.
+	udpRestartBackoff    = time.Second
+	udpRestartMaxBackoff = time.Minute
+
+	// defaultStatsSnapshotMaxAge is how long the all-device-stats
+	// endpoints may keep serving a snapshot after the state changed.
+	defaultStatsSnapshotMaxAge = 2 * time.Second
+
+	// defaultPageCursorTTL is how long the snapshot of a paged listing is
+	// kept after the last cursor for it was handed out.
+	defaultPageCursorTTL = 10 * time.Minute
+
+	// defaultRetryQueueMaxAge is how long a delivery waits in a retry queue
+	// before it gets dropped. A destination that is down for a week still
+	// gets every delivery once it comes back.
+	defaultRetryQueueMaxAge = 8 * 24 * time.Hour
 )
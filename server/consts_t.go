@@ -17,11 +17,67 @@ const (
 	defaultLogLevel         = DEBUG
 	testMode                = true
 	serverShutdownTime      = 5 * time.Second
+	udpDrainTimeout         = 2 * time.Second
+	componentStopTimeout    = 2 * time.Second
+	httpReadTimeout         = 2500 * time.Millisecond
 	wattTimeFrequency       = 20 * time.Millisecond
+	wattTimeRetryBackoff    = 5 * time.Millisecond
 
-	ReportMigrationFrequency        = 100 * time.Millisecond
-	WattTimeWeekDataUpdateFrequency = 1000 * time.Millisecond
+	ReportMigrationFrequency          = 100 * time.Millisecond
+	ReportsJournalCompactionFrequency = 5 * time.Second
+	WattTimeWeekDataUpdateFrequency   = 1000 * time.Millisecond
+
+	peerSyncFrequency = 2 * time.Second
+	peerSyncLimit     = 5
+	peerSyncRate      = 1 * time.Second
+	peerSyncTimeout   = 5 * time.Second
+
+	peerProbeFrequency = 20 * time.Millisecond
+	peerProbeSpacing   = 5 * time.Millisecond
+	peerProbeTimeout   = 500 * time.Millisecond
+	peerDownThreshold  = 100 * time.Millisecond
+
+	reportStreamWriteTimeout = 1 * time.Second
+
+	deviceStatusCheckFrequency = 20 * time.Millisecond
+	retryQueueBackoff          = 10 * time.Millisecond
+	retryQueueMaxBackoff       = 100 * time.Millisecond
+	anomalyCheckFrequency      = 20 * time.Millisecond
+	webhookTimeout             = 1 * time.Second
+	alertTimeout               = 500 * time.Millisecond
+
+	diskCheckFrequency              = 50 * time.Millisecond
+	serverAliveFrequency            = 50 * time.Millisecond
+	authorizedServersCheckFrequency = 20 * time.Millisecond
+	persistRetryBackoff             = 10 * time.Millisecond
+	persistMaxBackoff               = 100 * time.Millisecond
 
 	apiArchiveLimit = 3
 	apiArchiveRate  = 60 * time.Millisecond
+
+	deviceReportInterval  = time.Microsecond
+	deviceReportBurst     = 10e3
+	unknownReportInterval = time.Microsecond
+	unknownReportBurst    = 10e3
+
+	httpQueryInterval        = time.Microsecond
+	httpQueryBurst           = 10e3
+	httpWriteInterval        = time.Microsecond
+	httpWriteBurst           = 10e3
+	httpLimiterPruneInterval = 50 * time.Millisecond
+
+	validateReportInterval = time.Minute
+	validateReportBurst    = 8
+
+	timeProbeInterval = time.Microsecond
+	timeProbeBurst    = 10e3
+
+	reportQueueSize = 64
+
+	udpRestartBackoff    = 10 * time.Millisecond
+	udpRestartMaxBackoff = 100 * time.Millisecond
+
+	defaultStatsSnapshotMaxAge = 0
+	defaultPageCursorTTL       = time.Minute
+	defaultRetryQueueMaxAge    = time.Hour
 )
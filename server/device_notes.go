@@ -0,0 +1,350 @@
+package server
+
+// device_notes.go lets the GCA annotate a piece of equipment, for example with
+// the name of the installer, the serial number of the meter, or a note about
+// a site visit. A note is signed by the GCA and holds a free-text note, a
+// small map of key/value fields, or both. The notes don't change how the
+// reports of the equipment are handled, they are only there for the people
+// that look after the equipment. The one exception is the location_privacy
+// field, which decides whether the public endpoints show the coordinates of
+// the equipment, see location_privacy.go.
+//
+// The server keeps every note that it accepted, so the notes form a history
+// per device. The newest note is the current annotation of the device and is
+// returned inline by /api/v2/equipment, the full history is returned by
+// /api/v1/device-notes. A note with neither text nor fields clears the
+// current annotation, while staying in the history.
+//
+// The notes are kept by public key rather than by ShortID, so that they are
+// still there after the equipment gets deauthorized. They are persisted,
+// recorded in the audit log, and forwarded to all of the other GCA servers,
+// the same way that region assignments are.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+const (
+	// maxDeviceNoteLength is the longest free-text note, in bytes.
+	maxDeviceNoteLength = 1024
+
+	// maxDeviceNoteFields is the largest number of key/value fields that a
+	// note can hold.
+	maxDeviceNoteFields = 16
+
+	// maxDeviceNoteKeyLength and maxDeviceNoteValueLength are the longest
+	// key and the longest value of a field, in bytes.
+	maxDeviceNoteKeyLength   = 32
+	maxDeviceNoteValueLength = 255
+)
+
+// DeviceNote is an annotation from the GCA on a piece of equipment.
+type DeviceNote struct {
+	PublicKey glow.PublicKey    // The equipment being annotated
+	Note      string            // Free text, at most 1024 bytes
+	Fields    map[string]string // At most 16 fields, with keys of up to 32 and values of up to 255 bytes
+	Timestamp int64             // Unix time of the note, the newest note is the current one
+	Signature glow.Signature    // A signature from the GCA
+}
+
+// body returns the note and the fields in their binary form, with the fields
+// sorted by key so that the result doesn't depend on the order of the map.
+func (dn DeviceNote) body() []byte {
+	keys := make([]string, 0, len(dn.Fields))
+	for k := range dn.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := binary.LittleEndian.AppendUint16(nil, uint16(len(dn.Note)))
+	b = append(b, dn.Note...)
+	b = append(b, byte(len(keys)))
+	for _, k := range keys {
+		b = append(b, byte(len(k)))
+		b = append(b, k...)
+		b = append(b, byte(len(dn.Fields[k])))
+		b = append(b, dn.Fields[k]...)
+	}
+	return b
+}
+
+// SigningBytes returns the bytes that the GCA signs to authorize the note,
+// which are the public key, followed by the string "note", followed by the
+// timestamp, the note and the fields sorted by key.
+func (dn DeviceNote) SigningBytes() []byte {
+	b := make([]byte, 0, 32+4+8)
+	b = append(b, dn.PublicKey[:]...)
+	b = append(b, []byte("note")...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(dn.Timestamp))
+	return append(b, dn.body()...)
+}
+
+// Serialize returns the compact binary representation of the note.
+func (dn DeviceNote) Serialize() []byte {
+	b := make([]byte, 0, 32+8+64)
+	b = append(b, dn.PublicKey[:]...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(dn.Timestamp))
+	b = append(b, dn.body()...)
+	return append(b, dn.Signature[:]...)
+}
+
+// DeserializeDeviceNote reverses a call to Serialize. It returns the number
+// of bytes that were consumed, as the size of a serialized note depends on
+// its contents.
+func DeserializeDeviceNote(b []byte) (DeviceNote, int, error) {
+	var dn DeviceNote
+	tooShort := errors.New("device note is too short")
+	if len(b) < 42 {
+		return dn, 0, tooShort
+	}
+	copy(dn.PublicKey[:], b[:32])
+	dn.Timestamp = int64(binary.LittleEndian.Uint64(b[32:]))
+	noteLen := int(binary.LittleEndian.Uint16(b[40:]))
+	i := 42 + noteLen
+	if len(b) < i+1 {
+		return dn, 0, tooShort
+	}
+	dn.Note = string(b[42:i])
+	fields := int(b[i])
+	i++
+	for f := 0; f < fields; f++ {
+		var kv [2]string
+		for j := range kv {
+			if len(b) < i+1 || len(b) < i+1+int(b[i]) {
+				return dn, 0, tooShort
+			}
+			kv[j] = string(b[i+1 : i+1+int(b[i])])
+			i += 1 + int(b[i])
+		}
+		if dn.Fields == nil {
+			dn.Fields = make(map[string]string)
+		}
+		dn.Fields[kv[0]] = kv[1]
+	}
+	if len(b) < i+64 {
+		return dn, 0, tooShort
+	}
+	copy(dn.Signature[:], b[i:i+64])
+	if err := validateDeviceNote(dn); err != nil {
+		return dn, 0, err
+	}
+	return dn, i + 64, nil
+}
+
+// validateDeviceNote checks that a note stays within the size limits.
+func validateDeviceNote(dn DeviceNote) error {
+	if len(dn.Note) > maxDeviceNoteLength {
+		return fmt.Errorf("note is %v bytes, at most %v are allowed", len(dn.Note), maxDeviceNoteLength)
+	}
+	if len(dn.Fields) > maxDeviceNoteFields {
+		return fmt.Errorf("note has %v fields, at most %v are allowed", len(dn.Fields), maxDeviceNoteFields)
+	}
+	for k, v := range dn.Fields {
+		if k == "" || len(k) > maxDeviceNoteKeyLength {
+			return fmt.Errorf("field keys must be between 1 and %v bytes", maxDeviceNoteKeyLength)
+		}
+		if len(v) > maxDeviceNoteValueLength {
+			return fmt.Errorf("the value of field %q is %v bytes, at most %v are allowed", k, len(v), maxDeviceNoteValueLength)
+		}
+	}
+	return validateLocationPrivacy(dn.Fields)
+}
+
+// DeviceNoteHandler handles requests from the GCA to annotate a piece of
+// equipment.
+func (gcas *GCAServer) DeviceNoteHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for a device note.")
+		return
+	}
+
+	// Decode the JSON request body into the note.
+	var request DeviceNote
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+
+	// Validate and process the request.
+	isNew, err := gcas.managedAddDeviceNote(request)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to add device note:", err))
+		gcas.requestLogger(r).WithFields("pubkey", request.PublicKey).Warn("Failed to add device note: ", err)
+		return
+	}
+
+	// Forward the note to all of the other servers, so that every server
+	// has the same history. Only new notes get forwarded, which prevents
+	// the servers from endlessly passing the same request around.
+	if isNew {
+		gcas.gcaServers.mu.Lock()
+		ass := make([]AuthorizedServer, len(gcas.gcaServers.servers))
+		copy(ass, gcas.gcaServers.servers)
+		gcas.gcaServers.mu.Unlock()
+		jsonBody, _ := json.Marshal(request)
+		for _, as := range ass {
+			resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/device-note", jsonBody)
+			if err != nil {
+				gcas.requestLogger(r).WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to forward device note")
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	// Send a success response
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	gcas.requestLogger(r).WithFields("pubkey", request.PublicKey, "fields", len(request.Fields)).Info("Successfully added device note.")
+}
+
+// DeviceNotesHandler returns the history of the notes of the device with the
+// 'pubkey' query parameter, oldest first.
+func (gcas *GCAServer) DeviceNotesHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for device notes.")
+		return
+	}
+	publicKey, err := glow.ParsePublicKey(r.URL.Query().Get("pubkey"))
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid public key format")
+		return
+	}
+
+	gcas.mu.RLock()
+	if !gcas.isKnownDevice(publicKey) {
+		gcas.mu.RUnlock()
+		gcas.writeError(w, ErrCodeUnknownDevice, "equipment not found")
+		return
+	}
+	notes := append([]DeviceNote{}, gcas.deviceNotes[publicKey]...)
+	gcas.mu.RUnlock()
+	gcas.writeJSONResponse(w, r, notes)
+}
+
+// isKnownDevice returns whether the public key belongs to equipment that is
+// authorized on this server or that was deauthorized. The mutex must be held.
+func (gcas *GCAServer) isKnownDevice(pk glow.PublicKey) bool {
+	if _, exists := gcas.equipmentShortID[pk]; exists {
+		return true
+	}
+	_, exists := gcas.equipmentDeauthorizations[pk]
+	return exists
+}
+
+// addDeviceNote inserts a note into the history of its device, which is kept
+// in order of timestamp. The mutex must be held.
+func (gcas *GCAServer) addDeviceNote(dn DeviceNote) {
+	notes := gcas.deviceNotes[dn.PublicKey]
+	i := sort.Search(len(notes), func(i int) bool { return notes[i].Timestamp > dn.Timestamp })
+	notes = append(notes, DeviceNote{})
+	copy(notes[i+1:], notes[i:])
+	notes[i] = dn
+	gcas.deviceNotes[dn.PublicKey] = notes
+	gcas.updateLocationPrivacy(dn.PublicKey)
+}
+
+// deviceNoteAt returns the note of a device with the provided timestamp. The
+// mutex must be held.
+func (gcas *GCAServer) deviceNoteAt(pk glow.PublicKey, timestamp int64) (DeviceNote, bool) {
+	for _, dn := range gcas.deviceNotes[pk] {
+		if dn.Timestamp == timestamp {
+			return dn, true
+		}
+	}
+	return DeviceNote{}, false
+}
+
+// latestDeviceNote returns the current annotation of a device, which is its
+// newest note, and false if the device has none or the newest note is empty.
+// The mutex must be held.
+func (gcas *GCAServer) latestDeviceNote(pk glow.PublicKey) (DeviceNote, bool) {
+	notes := gcas.deviceNotes[pk]
+	if len(notes) == 0 {
+		return DeviceNote{}, false
+	}
+	dn := notes[len(notes)-1]
+	return dn, dn.Note != "" || len(dn.Fields) > 0
+}
+
+// managedAddDeviceNote verifies and saves a note. The bool indicates whether
+// the note is new to this server.
+func (gcas *GCAServer) managedAddDeviceNote(dn DeviceNote) (bool, error) {
+	if err := validateDeviceNote(dn); err != nil {
+		return false, withCode(ErrCodeMalformedRequest, err)
+	}
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return false, errNotInitialized
+	}
+	if !gcas.verifyGCASignature(dn.SigningBytes(), dn.Signature) {
+		return false, withCode(ErrCodeInvalidSignature, errors.New("invalid signature on device note"))
+	}
+	if !gcas.isKnownDevice(dn.PublicKey) {
+		return false, withCode(ErrCodeUnknownDevice, errors.New("equipment not found"))
+	}
+
+	// A device has at most one note per timestamp, so a note that was
+	// already received is redundant.
+	if current, exists := gcas.deviceNoteAt(dn.PublicKey, dn.Timestamp); exists {
+		if bytes.Equal(current.Serialize(), dn.Serialize()) {
+			return false, nil
+		}
+		return false, withCode(ErrCodeConflict, errors.New("a different note with the same timestamp exists"))
+	}
+
+	// Record and persist the note before applying it.
+	err := gcas.recordAudit(auditRecord{
+		action:     glow.AuditDeviceNote,
+		request:    dn.Serialize(),
+		signatures: []glow.AuditSignature{gcas.gcaAuditSignature(dn.SigningBytes(), dn.Signature)},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := gcas.staticStorage.AppendFile(DeviceNotesFile, dn.Serialize(), 0644); err != nil {
+		return false, fmt.Errorf("unable to save device note: %v", err)
+	}
+	gcas.addDeviceNote(dn)
+	gcas.bumpStateVersion()
+	return true, nil
+}
+
+// loadDeviceNotes will load all of the notes from disk, creating the file if
+// it does not exist yet.
+func (gcas *GCAServer) loadDeviceNotes() error {
+	data, err := gcas.staticStorage.ReadFile(DeviceNotesFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(DeviceNotesFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read device notes file: %v", err)
+	}
+	for i := 0; len(data) > 0; i++ {
+		dn, n, err := DeserializeDeviceNote(data)
+		if err != nil {
+			return fmt.Errorf("%v: record %v: %v", DeviceNotesFile, i, err)
+		}
+		if !gcas.verifyPersistedGCASignature(dn.SigningBytes(), dn.Signature) {
+			return fmt.Errorf("%v: record %v: invalid signature on device note", DeviceNotesFile, i)
+		}
+		if _, exists := gcas.deviceNoteAt(dn.PublicKey, dn.Timestamp); !exists {
+			gcas.addDeviceNote(dn)
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postDeviceNote submits a note to the server and returns the status code of
+// the response.
+func (gcas *GCAServer) postDeviceNote(dn DeviceNote) (int, error) {
+	jsonBody, _ := json.Marshal(dn)
+	resp, err := http.Post("http://"+gcas.httpDialAddr()+"/api/v1/device-note", "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// fetchDeviceNotes fetches the history of the notes of a device.
+func (gcas *GCAServer) fetchDeviceNotes(pubkey glow.PublicKey) ([]DeviceNote, int, error) {
+	resp, err := http.Get("http://" + gcas.httpDialAddr() + "/api/v1/device-notes?pubkey=" + hex.EncodeToString(pubkey[:]))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, nil
+	}
+	var notes []DeviceNote
+	return notes, resp.StatusCode, json.NewDecoder(resp.Body).Decode(&notes)
+}
+
+// TestDeviceNotes checks that the GCA can annotate a device, that the newest
+// note shows up in the equipment listing, and that the history survives a
+// deauthorization and a restart.
+func TestDeviceNotes(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(dn DeviceNote, want int) {
+		t.Helper()
+		dn.Signature = glow.Sign(dn.SigningBytes(), gcaPrivKey)
+		if status, err := server.postDeviceNote(dn); err != nil || status != want {
+			t.Fatalf("unexpected status for note %q: %v %v", dn.Note, status, err)
+		}
+	}
+
+	// Notes need a signature from the GCA and have to stay within the
+	// size limits.
+	first := DeviceNote{PublicKey: ea.PublicKey, Note: "installed by Acme", Fields: map[string]string{"meter": "SN-1234", "site": "roof"}, Timestamp: 100}
+	_, wrongKey := glow.GenerateKeyPair()
+	bad := first
+	bad.Signature = glow.Sign(bad.SigningBytes(), wrongKey)
+	if status, err := server.postDeviceNote(bad); err != nil || status != http.StatusForbidden {
+		t.Fatal("a note without a gca signature was accepted:", status, err)
+	}
+	post(DeviceNote{PublicKey: ea.PublicKey, Note: strings.Repeat("x", maxDeviceNoteLength+1), Timestamp: 50}, http.StatusBadRequest)
+	post(DeviceNote{PublicKey: ea.PublicKey, Fields: map[string]string{strings.Repeat("k", maxDeviceNoteKeyLength+1): "v"}, Timestamp: 50}, http.StatusBadRequest)
+	post(DeviceNote{PublicKey: ea.PublicKey, Fields: map[string]string{"": "v"}, Timestamp: 50}, http.StatusBadRequest)
+	unknown, _ := glow.GenerateKeyPair()
+	post(DeviceNote{PublicKey: unknown, Note: "who?", Timestamp: 50}, http.StatusNotFound)
+
+	// A note that was already received is accepted again, a different note
+	// with the same timestamp is not.
+	post(first, http.StatusOK)
+	post(first, http.StatusOK)
+	post(DeviceNote{PublicKey: ea.PublicKey, Note: "conflict", Timestamp: 100}, http.StatusConflict)
+	post(DeviceNote{PublicKey: ea.PublicKey, Note: "site visit, panels cleaned", Timestamp: 200}, http.StatusOK)
+
+	// The equipment listing carries the newest note.
+	resp, err := http.Get("http://" + server.httpDialAddr() + "/api/v2/equipment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v2er V2EquipmentResponse
+	err = json.NewDecoder(resp.Body).Decode(&v2er)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v2er.Equipment) != 1 || v2er.Equipment[0].Note == nil || v2er.Equipment[0].Note.Note != "site visit, panels cleaned" || v2er.Equipment[0].Note.Timestamp != 200 {
+		t.Fatalf("the newest note is not in the listing: %+v", v2er.Equipment)
+	}
+
+	// The history survives a deauthorization and a restart, oldest first.
+	ed := EquipmentDeauthorization{PublicKey: ea.PublicKey, Timestamp: glow.TimeslotToUnix(0)}
+	ed.Signature = glow.Sign(ed.SigningBytes(), gcaPrivKey)
+	if status, err := server.postDeauthorization(ed); err != nil || status != http.StatusOK {
+		t.Fatal("deauthorization failed:", status, err)
+	}
+	post(DeviceNote{PublicKey: ea.PublicKey, Note: "retired", Timestamp: 150}, http.StatusOK)
+	server.Close()
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	notes, status, err := server.fetchDeviceNotes(ea.PublicKey)
+	if err != nil || status != http.StatusOK {
+		t.Fatal("unable to fetch the notes:", status, err)
+	}
+	if len(notes) != 3 || notes[0].Timestamp != 100 || notes[1].Note != "retired" || notes[2].Timestamp != 200 {
+		t.Fatalf("unexpected history: %+v", notes)
+	}
+	if notes[0].Fields["meter"] != "SN-1234" || !glow.Verify(server.gcaPubkey, notes[0].SigningBytes(), notes[0].Signature) {
+		t.Fatal("the fields of the note did not survive the restart:", notes[0].Fields)
+	}
+	if _, status, err := server.fetchDeviceNotes(unknown); err != nil || status != http.StatusNotFound {
+		t.Fatal("unexpected status for an unknown device:", status, err)
+	}
+
+	// The notes are in the audit log.
+	server.auditLog.mu.Lock()
+	recorded := 0
+	for _, e := range server.auditLog.entries {
+		if e.Action == glow.AuditDeviceNote {
+			recorded++
+		}
+	}
+	server.auditLog.mu.Unlock()
+	if recorded != 3 {
+		t.Fatal("unexpected number of notes in the audit log:", recorded)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+// dir_lock.go keeps track of which server directories are in use. A running
+// server holds an exclusive flock on the lock file in its directory for as
+// long as it runs, so a second server refuses to start in the same
+// directory, and OpenStateReadOnly can tell a live directory from a copy or
+// one whose server has stopped. The lock belongs to the open file rather
+// than to the file itself, so a lock file that is left behind by a crash, or
+// that got copied along with the directory, doesn't lock anything.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// ErrServerDirLocked is returned when a server directory is in use by a
+// running server.
+var ErrServerDirLocked = errors.New("the server directory is in use by a running server")
+
+// lockServerDir takes the lock of a server directory. The returned function
+// releases the lock again.
+func lockServerDir(dir string) (func() error, error) {
+	f, err := os.OpenFile(filepath.Join(dir, LockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the lock file: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("unable to lock %v: %w", dir, ErrServerDirLocked)
+		}
+		return nil, fmt.Errorf("unable to lock %v: %v", dir, err)
+	}
+	// The pid is only there to help an operator find the server that
+	// holds the lock.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f.Close, nil
+}
+
+// serverDirLocked returns whether a running server holds the lock of a server
+// directory.
+func serverDirLocked(dir string) (bool, error) {
+	f, err := os.Open(filepath.Join(dir, LockFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to open the lock file: %v", err)
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to check the lock file: %v", err)
+	}
+	return false, nil
+}
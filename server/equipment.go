@@ -7,10 +7,10 @@ package server
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 
 	"github.com/glowlabs-org/gca-backend/glow"
 )
@@ -32,62 +32,36 @@ func (gcas *GCAServer) addRecentEquipmentAuth(ea glow.EquipmentAuthorization) {
 // saveAllDeviceStats will save the provided AllDeviceStats object to disk,
 // adding it to the file that contains the history of all device stats.
 func (gcas *GCAServer) saveAllDeviceStats(ads AllDeviceStats) error {
-	file, err := os.OpenFile(filepath.Join(gcas.baseDir, AllDeviceStatsHistoryFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("unable to open all device stats file: %v", err)
-	}
-	defer file.Close()
-
 	b := ads.Serialize()
-	_, err = file.Write(b)
+	err := gcas.staticStorage.AppendFile(AllDeviceStatsHistoryFile, b, 0644)
 	if err != nil {
 		return fmt.Errorf("unable to write data to disk: %v", err)
 	}
+	gcas.equipmentHistoryPositions = append(gcas.equipmentHistoryPositions, gcas.equipmentHistorySize)
+	gcas.equipmentHistorySize += int64(len(b))
 	return nil
 }
 
 // loadEquipment reads the serialized EquipmentAuthorizations from disk,
 // deserializes them, and then verifies each of them.
 //
-// It reads from a file called 'equipment-authorizations.dat' within the 'baseDir' folder.
-// The method creates a new file if the file does not exist.
+// The legacy authorizations are loaded before the authorizations in the
+// current format. Both files get created if they do not exist.
 func (gcas *GCAServer) loadEquipment() error {
-	// Determine the full path of the 'equipment-authorizations.dat' file within 'baseDir'
-	filePath := filepath.Join(gcas.baseDir, "equipment-authorizations.dat")
-
-	// Attempt to read the file. If it doesn't exist, create it.
-	rawData, err := ioutil.ReadFile(filePath)
+	legacy, err := gcas.readEquipmentFile(LegacyEquipmentAuthorizationsFile, glow.EquipmentAuthorizationLegacySize)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Create the file if it does not exist
-			f, err := os.Create(filePath)
-			if err != nil {
-				return err
-			}
-			f.Close()
-			return nil
-		}
 		return err
 	}
-
-	// Proceed to deserialize and verify the EquipmentAuthorizations if any data was read
-	var equipment []glow.EquipmentAuthorization
-	buffer := bytes.NewBuffer(rawData)
-	for buffer.Len() > 0 {
-		// Deserialize the EquipmentAuthorization
-		ea, err := glow.DeserializeEquipmentAuthorization(buffer.Next(148))
-		if err != nil {
-			return err
-		}
-
-		// Verify the EquipmentAuthorization
-		if err := gcas.verifyEquipmentAuthorization(ea); err != nil {
-			return err
-		}
-
-		equipment = append(equipment, ea)
+	versioned, err := gcas.readEquipmentFile(EquipmentAuthorizationsFile, glow.EquipmentAuthorizationSize)
+	if err != nil {
+		return err
 	}
+	equipment := append(legacy, versioned...)
 	for _, ea := range equipment {
+		// Every saved authorization has consumed its nonce, even if
+		// the equipment ended up banned.
+		gcas.recordAuthorizationNonce(ea)
+
 		// Load the equipment, paying close attention to the ban rules.
 		_, exists := gcas.equipmentBans[ea.ShortID]
 		if exists {
@@ -102,6 +76,11 @@ func (gcas *GCAServer) loadEquipment() error {
 			if bytes.Equal(a, b) {
 				continue
 			}
+			// An authorization that has since been renewed is
+			// outdated rather than a conflict.
+			if isRenewal(ea, current) {
+				continue
+			}
 		}
 		// Add the auth to the recents either way.
 		gcas.addRecentEquipmentAuth(ea)
@@ -109,65 +88,128 @@ func (gcas *GCAServer) loadEquipment() error {
 		if !exists {
 			gcas.equipmentShortID[ea.PublicKey] = ea.ShortID
 			gcas.equipment[ea.ShortID] = ea
+			gcas.staticReportLimiter.addDevice(ea.ShortID)
+			gcas.bumpStateVersion()
 			gcas.equipmentImpactRate[ea.ShortID] = new([4032]float64)
-			gcas.equipmentReports[ea.ShortID] = new([4032]glow.EquipmentReport)
+			gcas.equipmentReports[ea.ShortID] = new(deviceReports)
+			continue
+		}
+		if isRenewal(current, ea) {
+			gcas.renewEquipment(ea)
 			continue
 		}
 		// If a conflict exists, ban the equipment.
-		delete(gcas.equipment, ea.ShortID)
-		delete(gcas.equipmentImpactRate, ea.ShortID)
-		delete(gcas.equipmentReports, ea.ShortID)
-		delete(gcas.equipmentShortID, ea.PublicKey)
-		gcas.equipmentBans[ea.ShortID] = struct{}{}
+		gcas.banConflictingAuthorizations(current, ea)
 	}
 
 	return nil
 }
 
-// loadEquipmentHistory will open the history file that contains all of the
-// DeviceStatsHistory entries, and load it into the server one element at a
-// time. This loading process will also inform the equipmentReportsOffset value
-// that gets set before all of the recentReports are loaded.
-func (gcas *GCAServer) loadEquipmentHistory() error {
-	// Read the full file into memory. We keep all of the structs in memory
-	// already anyway, if it starts to get too big we can optimize later.
-	path := filepath.Join(gcas.baseDir, AllDeviceStatsHistoryFile)
-	data, err := ioutil.ReadFile(path)
-	// Create the file if it doesn't exist.
-	if os.IsNotExist(err) {
-		f, err := os.Create(path)
-		if err != nil {
-			return fmt.Errorf("unable to create device stats history file: %v", err)
+// readEquipmentFile reads and verifies all of the EquipmentAuthorizations in
+// the provided file, where every authorization has the provided size.
+func (gcas *GCAServer) readEquipmentFile(name string, size int) ([]glow.EquipmentAuthorization, error) {
+	// Attempt to read the file. If it doesn't exist, create it.
+	rawData, err := gcas.staticStorage.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Create the file if it does not exist
+			return nil, gcas.staticStorage.WriteFile(name, nil, 0644)
 		}
-		err = f.Close()
+		return nil, err
+	}
+
+	// Proceed to deserialize and verify the EquipmentAuthorizations if any data was read
+	var equipment []glow.EquipmentAuthorization
+	buffer := bytes.NewBuffer(rawData)
+	for buffer.Len() > 0 {
+		// Deserialize the EquipmentAuthorization
+		ea, err := glow.DeserializeEquipmentAuthorization(buffer.Next(size))
 		if err != nil {
-			return fmt.Errorf("unable to close device stats histroy file: %v", err)
+			return nil, err
+		}
+
+		// Verify the EquipmentAuthorization
+		if err := gcas.verifyPersistedEquipmentAuthorization(ea); err != nil {
+			return nil, err
 		}
-		return nil
+
+		equipment = append(equipment, ea)
 	}
-	if err != nil {
-		return fmt.Errorf("unable to load the device stats history file: %v", err)
+	return equipment, nil
+}
+
+// equipmentFile returns the name of the file that holds authorizations in the
+// same format as the provided authorization.
+func (gcas *GCAServer) equipmentFile(ea glow.EquipmentAuthorization) string {
+	if ea.Version == glow.EquipmentAuthorizationVersionLegacy {
+		return LegacyEquipmentAuthorizationsFile
 	}
+	return EquipmentAuthorizationsFile
+}
 
-	// Deserialize the device stats one week at at time.
-	for {
-		// Once we've parsed all the data, we can return.
-		if len(data) == 0 {
-			return nil
+// recordAuthorizationNonce marks the nonce of a saved authorization as
+// consumed. Legacy authorizations don't have a nonce.
+func (gcas *GCAServer) recordAuthorizationNonce(ea glow.EquipmentAuthorization) {
+	if ea.Version != glow.EquipmentAuthorizationVersionLegacy {
+		gcas.equipmentNonces[ea.Nonce] = struct{}{}
+	}
+}
+
+// loadEquipmentHistory scans the history file that contains all of the
+// AllDeviceStats entries, without decoding them. The scan checks that the
+// file is made of complete entries, and informs the equipmentReportsOffset
+// value that gets set before all of the recentReports are loaded. The entries
+// themselves get decoded in the background by threadedLoadEquipmentHistory,
+// which gets the size of the file that was scanned, and the number of entries
+// in it.
+func (gcas *GCAServer) loadEquipmentHistory() (int64, int, error) {
+	f, err := gcas.staticStorage.Open(AllDeviceStatsHistoryFile)
+	// Create the file if it doesn't exist.
+	if os.IsNotExist(err) {
+		if err := gcas.staticStorage.WriteFile(AllDeviceStatsHistoryFile, nil, 0644); err != nil {
+			return 0, 0, fmt.Errorf("unable to create device stats history file: %v", err)
 		}
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to load the device stats history file: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to load the device stats history file: %v", err)
+	}
 
-		ads, i, err := DeserializeStreamAllDeviceStats(data)
-		if err != nil {
-			return fmt.Errorf("unable to decode all device stats: %v", err)
+	// Every entry starts with the number of devices, which gives the size
+	// of the entry, and ends with its timeslot offset and signature.
+	var pos int64
+	var entries int
+	var buf [4]byte
+	for pos < fi.Size() {
+		if _, err := f.ReadAt(buf[:], pos); err != nil {
+			return 0, 0, fmt.Errorf("unable to decode all device stats: %v", err)
+		}
+		devicesSize := int64(binary.LittleEndian.Uint32(buf[:])) * (32 + 8*2*2016)
+		size := 4 + devicesSize + 4 + 64
+		if pos+size > fi.Size() {
+			return 0, 0, fmt.Errorf("unable to decode all device stats: entry %v is truncated", entries)
 		}
-		gcas.equipmentStatsHistory = append(gcas.equipmentStatsHistory, ads)
-		gcas.equipmentReportsOffset = ads.TimeslotOffset + 2016
-		data = data[i:]
+		if _, err := f.ReadAt(buf[:], pos+4+devicesSize); err != nil {
+			return 0, 0, fmt.Errorf("unable to decode all device stats: %v", err)
+		}
+		gcas.equipmentReportsOffset = binary.LittleEndian.Uint32(buf[:]) + 2016
+		gcas.equipmentHistoryPositions = append(gcas.equipmentHistoryPositions, pos)
+		pos += size
+		entries++
 	}
+	// None of the weeks are in memory until the background load is done.
+	gcas.equipmentHistorySize = pos
+	gcas.equipmentHistoryEvicted = entries
+	return pos, entries, nil
 }
 
 // saveEquipment serializes a given EquipmentAuthorization and appends it to
-// the 'equipment-authorizations.dat' file. The function opens the file in append
+// the equipment authorizations file for its format. The function opens the file in append
 // mode, or creates it if it does not exist.
 //
 // The method returns an error if it fails to open the file, write to it,
@@ -175,10 +217,30 @@ func (gcas *GCAServer) loadEquipmentHistory() error {
 //
 // The bool indicates whether the equipment is new or not.
 func (gcas *GCAServer) saveEquipment(ea glow.EquipmentAuthorization) (bool, error) {
+	// The ShortID that opens a sync session between servers can't belong
+	// to any equipment.
+	if ea.ShortID == peerSyncMagic {
+		return false, withCode(ErrCodeMalformedRequest, fmt.Errorf("ShortID %v is reserved", peerSyncMagic))
+	}
 	// Before saving, check if the equipment is already on the banlist.
 	_, exists := gcas.equipmentBans[ea.ShortID]
 	if exists {
-		return false, fmt.Errorf("equipment with this ShortID is banned")
+		return false, withCode(ErrCodeDeviceBanned, errors.New("equipment with this ShortID is banned"))
+	}
+	// Equipment that has been deauthorized can never be authorized again.
+	_, exists = gcas.equipmentDeauthorizations[ea.PublicKey]
+	if exists {
+		return false, withCode(ErrCodeDeviceDeauthorized, errors.New("equipment with this public key has been deauthorized"))
+	}
+
+	// A key that a device rotated to belongs to that device.
+	if shortID, exists := gcas.deviceKeyOwners[ea.PublicKey]; exists && shortID != ea.ShortID {
+		return false, withCode(ErrCodeConflict, fmt.Errorf("public key belongs to equipment %v", shortID))
+	}
+
+	// A ShortID that belonged to another device can't be reused.
+	if err := gcas.checkShortIDReuse(ea); err != nil {
+		return false, err
 	}
 
 	// Now check if there's already equipment with the same ShortID
@@ -189,113 +251,164 @@ func (gcas *GCAServer) saveEquipment(ea glow.EquipmentAuthorization) (bool, erro
 			// Exit without complaining.
 			return false, nil
 		}
+		// An authorization that has since been renewed is outdated
+		// rather than a conflict.
+		if isRenewal(ea, current) {
+			return false, nil
+		}
+	}
+	// Any other authorization must not reuse a nonce, otherwise an old
+	// authorization could be replayed.
+	if ea.Version != glow.EquipmentAuthorizationVersionLegacy {
+		if _, exists := gcas.equipmentNonces[ea.Nonce]; exists {
+			return false, withCode(ErrCodeConflict, fmt.Errorf("authorization nonce %v has already been used", ea.Nonce))
+		}
 	}
 
 	// Save the authorization, whether or not there's a conflict. If there is a
 	// conflict, we need to save the auth so we can prove to other parties that
 	// this ShortID needs to be banned.
 	//
-	// Determine the full path of the 'equipment-authorizations.dat' file within 'baseDir'
-	filePath := filepath.Join(gcas.baseDir, "equipment-authorizations.dat")
-	// Open the file in append mode.
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0644)
+	// Serialize the EquipmentAuthorization to a byte slice
+	serializedData := ea.Serialize()
+	// Record the authorization in the audit log, and then append the
+	// serialized data to the file
+	err := gcas.recordAudit(auditRecord{
+		action:     glow.AuditEquipmentAuthorization,
+		request:    serializedData,
+		signatures: []glow.AuditSignature{gcas.gcaAuditSignature(ea.SigningBytes(), ea.Signature)},
+	})
 	if err != nil {
 		return false, err
 	}
-	defer file.Close()
-	// Serialize the EquipmentAuthorization to a byte slice
-	serializedData := ea.Serialize()
-	// Write the serialized data to the file
-	_, err = file.Write(serializedData)
+	err = gcas.staticStorage.AppendFile(gcas.equipmentFile(ea), serializedData, 0644)
 	if err != nil {
 		return false, err
 	}
+	if !gcas.applyEquipment(ea) {
+		return false, withCode(ErrCodeDeviceBanned, errors.New("duplicate authorization received, banning equipment"))
+	}
+	return true, nil
+}
+
+// applyEquipment adds a saved EquipmentAuthorization to the in-memory state.
+// A renewal replaces the current authorization of its ShortID, see
+// equipment_expiry.go. If any other authorization already exists for the same
+// ShortID, the ShortID gets banned instead. The return value is false if the
+// ShortID was banned. Either way, the webhooks get an equipment event.
+func (gcas *GCAServer) applyEquipment(ea glow.EquipmentAuthorization) bool {
 	// Also add this to the recent equipment list so that the evidence will propagate
 	// to other servers that are trying to sync.
 	gcas.addRecentEquipmentAuth(ea)
+	gcas.recordAuthorizationNonce(ea)
 
 	// If there is no conflict, add the new auth and exit.
+	current, exists := gcas.equipment[ea.ShortID]
 	if !exists {
+		gcas.allocateShortID(ea.ShortID, ea.PublicKey)
 		gcas.equipmentShortID[ea.PublicKey] = ea.ShortID
 		gcas.equipment[ea.ShortID] = ea
+		gcas.staticReportLimiter.addDevice(ea.ShortID)
+		gcas.recordDeviceChange(StateChangeAuthorization, ea.ShortID, ea.PublicKey, 0)
 		gcas.equipmentImpactRate[ea.ShortID] = new([4032]float64)
-		gcas.equipmentReports[ea.ShortID] = new([4032]glow.EquipmentReport)
-		return true, nil
+		gcas.equipmentReports[ea.ShortID] = new(deviceReports)
+		gcas.queueEquipmentEvent(webhookEventAuthorized, ea.ShortID, ea.PublicKey, gcas.currentTimeslot())
+		return true
+	}
+	if isRenewal(current, ea) {
+		gcas.renewEquipment(ea)
+		gcas.queueEquipmentEvent(webhookEventAuthorized, ea.ShortID, ea.PublicKey, gcas.currentTimeslot())
+		return true
 	}
 
 	// There is a conflict, so we need to delete the equipment from the list of
 	// equipment and also add a ban.
-	delete(gcas.equipmentShortID, ea.PublicKey)
-	delete(gcas.equipment, ea.ShortID)
-	delete(gcas.equipmentImpactRate, ea.ShortID)
-	delete(gcas.equipmentReports, ea.ShortID)
-	gcas.equipmentBans[ea.ShortID] = struct{}{}
-	return false, fmt.Errorf("duplicate authorization received, banning equipment")
+	gcas.banConflictingAuthorizations(current, ea)
+	return false
 }
 
 // launchMigrateReporst will launch a background thread that will infrequently
 // migrate the reports between weeks.
-func (gcas *GCAServer) launchMigrateReports(username, password string) {
+func (gcas *GCAServer) launchMigrateReports() {
 	// At startup, the equipment reports may need to be migrated multiple
-	// times. Loop and perform the migration repeatedly until the current
-	// time and the reports offset are within 4000 timeslots. This needs to
-	// block startup, because other routines depend on the equipment
-	// reports being up to date.
-	for {
-		gcas.mu.Lock()
-		ero := gcas.equipmentReportsOffset
-		gcas.mu.Unlock()
-		now := glow.CurrentTimeslot()
-		if int64(now)-int64(ero) < 4000 {
-			break
-		}
-		gcas.migrateReports(username, password)
-	}
+	// times. This needs to block startup, because other routines depend on
+	// the equipment reports being up to date.
+	gcas.managedCatchUpMigrations()
 
 	// Launch a background thread that will keep updating the equipment
-	// reports.
-	gcas.tg.Launch(func() {
+	// reports. The thread wakes up at the start of every timeslot, which is
+	// when a migration can become due, and at least every
+	// ReportMigrationFrequency in case the clock jumps.
+	gcas.launchComponent("migration", nil, func() {
+		ticker := glow.NewTimeslotTicker(gcas.staticClock, ReportMigrationFrequency)
 		for {
-			gcas.mu.Lock()
-			ero := gcas.equipmentReportsOffset
-			gcas.mu.Unlock()
-			now := glow.CurrentTimeslot()
-			if int64(now)-int64(ero) > 3200 {
-				gcas.migrateReports(username, password)
-			}
-			if !gcas.tg.Sleep(ReportMigrationFrequency) {
+			gcas.managedFinalizePeriodIf(gcas.finalizationDue)
+			gcas.managedMigrateReportsIf(gcas.migrationDue)
+			if _, ok := ticker.Next(gcas.tg.StopChan()); !ok {
 				return
 			}
 		}
 	})
 }
 
-// migrateReports will perform a migration function on the reports.
-func (gcas *GCAServer) migrateReports(username, password string) {
-	// Fetch all of the moer values for the week.
-	err := gcas.managedGetWattTimeWeekData(username, password)
-	if err != nil {
-		// All we can do is log the error, we still need to rotate the
-		// time and save the data.
-		gcas.logger.Errorf("unable to fetch WattTime week data: %v", err)
+// managedCatchUpMigrations performs the migration repeatedly until the current
+// time and the reports offset are within the migration threshold, so that the
+// report windows are in memory, and then finalizes the oldest week if it is
+// due.
+func (gcas *GCAServer) managedCatchUpMigrations() {
+	for {
+		if migrated, _ := gcas.managedMigrateReportsIf(gcas.migrationDue); !migrated {
+			break
+		}
 	}
-	// Save the device stats.
-	gcas.mu.Lock()
-	stats, err := gcas.buildDeviceStats(gcas.equipmentReportsOffset)
-	if err != nil {
-		panic("unable to build device stats: " + err.Error())
+	gcas.managedFinalizePeriodIf(gcas.finalizationDue)
+}
+
+// migrationDue returns whether the current timeslot is far enough past the
+// provided reports offset for the oldest week to be rotated out.
+func (gcas *GCAServer) migrationDue(ero uint32) bool {
+	return int64(gcas.currentTimeslot())-int64(ero) > reportMigrationThreshold
+}
+
+// managedMigrateReportsIf migrates the reports if the provided condition holds
+// for the current reports offset, and returns whether it did along with the
+// number of reports that were moved out of memory. The migration mutex keeps
+// the offset from changing between the check and the migration.
+func (gcas *GCAServer) managedMigrateReportsIf(due func(ero uint32) bool) (bool, int) {
+	gcas.migrationMu.Lock()
+	defer gcas.migrationMu.Unlock()
+	gcas.mu.RLock()
+	ero := gcas.equipmentReportsOffset
+	gcas.mu.RUnlock()
+	if !due(ero) {
+		return false, 0
 	}
-	gcas.equipmentStatsHistory = append(gcas.equipmentStatsHistory, stats)
-	err = gcas.saveAllDeviceStats(stats)
-	if err != nil {
-		panic("failed to save all device stats: " + err.Error())
+	return true, gcas.migrateReports()
+}
+
+// migrateReports will perform a migration function on the reports, and
+// returns the number of reports in the week that was rotated out. It must
+// only be called by managedMigrateReportsIf.
+func (gcas *GCAServer) migrateReports() int {
+	// The week that gets rotated out has to be finalized first, which
+	// saves its stats, see period_finalization.go.
+	gcas.mu.RLock()
+	finalized := gcas.oldestPeriodFinalized
+	gcas.mu.RUnlock()
+	if !finalized {
+		gcas.finalizePeriod()
 	}
+	gcas.mu.Lock()
 	// Copy the last half of every report into the first
 	// half, then blank out the last half.
-	for _, report := range gcas.equipmentReports {
-		var blankReports [2016]glow.EquipmentReport
-		copy(report[:2016], report[2016:])
-		copy(report[2016:], blankReports[:])
+	moved := 0
+	for _, reports := range gcas.equipmentReports {
+		for i := 0; i < 2016; i++ {
+			if reports.signed(i) {
+				moved++
+			}
+		}
+		reports.shift()
 	}
 	// Repeat for the impact values.
 	for _, rates := range gcas.equipmentImpactRate {
@@ -303,8 +416,25 @@ func (gcas *GCAServer) migrateReports(username, password string) {
 		copy(rates[:2016], rates[2016:])
 		copy(rates[2016:], blankRates[:])
 	}
-	// Update the reports offset.
+	// Update the reports offset, and drop the flagged reports and the
+	// dismissed anomalies that fell out of the window.
 	gcas.equipmentReportsOffset += 2016
+	gcas.oldestPeriodFinalized = false
+	gcas.migrateBannedDevices(true)
+	gcas.pruneFlaggedReports()
+	gcas.pruneAnomalies()
+	gcas.pruneRetainedPeriods()
+	if err := gcas.compactImpactRates(); err != nil {
+		gcas.logger.Errorf("unable to compact impact rates: %v", err)
+	}
+	if err := gcas.compactHeartbeats(); err != nil {
+		gcas.logger.Errorf("unable to compact heartbeats: %v", err)
+	}
+	if err := gcas.compactReportReceipts(); err != nil {
+		gcas.logger.Errorf("unable to compact report receipts: %v", err)
+	}
+	gcas.bumpStateVersion()
 	gcas.logger.Info("completed an equipment reports migration")
 	gcas.mu.Unlock()
+	return moved
 }
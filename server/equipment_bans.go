@@ -0,0 +1,301 @@
+package server
+
+// equipment_bans.go contains the automatic banning of equipment that signs two
+// different reports for the same timeslot.
+//
+// Honest equipment only ever signs one report per timeslot, so two validly
+// signed reports with different contents are proof that the equipment (or its
+// key) is misbehaving. When that happens, both reports are recorded together
+// with the GCA authorization of the equipment as an EquivocationProof, and the
+// equipment is banned the same way that equipment with conflicting
+// authorizations is banned.
+//
+// The proof contains everything needed to verify it independently: the
+// authorization ties the public key of the equipment to its ShortID, and the
+// two reports are signed by that public key. The proofs are persisted and
+// loaded before any reports, are exposed at /api/v1/equipment-bans, and are
+// forwarded to the other GCA servers, which verify them before applying the
+// ban themselves.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// EquivocationProof shows that a piece of equipment signed two different
+// reports for the same timeslot.
+type EquivocationProof struct {
+	Authorization glow.EquipmentAuthorization // The authorization of the equipment, signed by the GCA
+	First         glow.EquipmentReport        // The report that was received first
+	Second        glow.EquipmentReport        // The conflicting report
+}
+
+// Serialize returns the binary representation of the proof. The
+// authorization is prefixed with its length because the legacy and current
+// authorization formats have different sizes.
+func (ep EquivocationProof) Serialize() []byte {
+	auth := ep.Authorization.Serialize()
+	b := make([]byte, 0, 2+len(auth)+2*equipmentReportSize)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(auth)))
+	b = append(b, auth...)
+	b = append(b, ep.First.Serialize()...)
+	b = append(b, ep.Second.Serialize()...)
+	return b
+}
+
+// DeserializeStreamEquivocationProof decodes the proof at the front of the
+// provided data, returning the proof and the number of bytes that were
+// consumed.
+func DeserializeStreamEquivocationProof(data []byte) (EquivocationProof, int, error) {
+	var ep EquivocationProof
+	if len(data) < 2 {
+		return ep, 0, fmt.Errorf("equivocation proof is truncated")
+	}
+	authLen := int(binary.LittleEndian.Uint16(data))
+	size := 2 + authLen + 2*equipmentReportSize
+	if len(data) < size {
+		return ep, 0, fmt.Errorf("equivocation proof is truncated")
+	}
+	var err error
+	ep.Authorization, err = glow.DeserializeEquipmentAuthorization(data[2 : 2+authLen])
+	if err != nil {
+		return ep, 0, fmt.Errorf("unable to decode authorization: %v", err)
+	}
+	reports := data[2+authLen:]
+	ep.First, err = glow.DeserializeReport(reports[:equipmentReportSize])
+	if err != nil {
+		return ep, 0, fmt.Errorf("unable to decode first report: %v", err)
+	}
+	ep.Second, err = glow.DeserializeReport(reports[equipmentReportSize : size-2-authLen])
+	if err != nil {
+		return ep, 0, fmt.Errorf("unable to decode second report: %v", err)
+	}
+	return ep, size, nil
+}
+
+// verifyEquivocationProof checks that the authorization in the proof was
+// signed by the GCA, and that it names the equipment that signed two
+// different reports for the same timeslot. Two signatures over the same power
+// output are a resend of the same report rather than a conflict.
+func (gcas *GCAServer) verifyEquivocationProof(ep EquivocationProof) error {
+	if err := gcas.verifyPersistedEquipmentAuthorization(ep.Authorization); err != nil {
+		return withCode(ErrCodeInvalidSignature, err)
+	}
+	if ep.First.ShortID != ep.Authorization.ShortID || ep.Second.ShortID != ep.Authorization.ShortID {
+		return fmt.Errorf("reports do not belong to the authorized equipment")
+	}
+	if ep.First.Timeslot != ep.Second.Timeslot {
+		return fmt.Errorf("reports are for different timeslots")
+	}
+	if ep.First.PowerOutput == ep.Second.PowerOutput {
+		return fmt.Errorf("reports do not conflict")
+	}
+	for _, report := range []glow.EquipmentReport{ep.First, ep.Second} {
+		if !gcas.verifyDeviceSignature(ep.Authorization.PublicKey, report.Timeslot, report.SigningBytes(), report.Signature) {
+			return withCode(ErrCodeInvalidSignature, fmt.Errorf("invalid signature on report"))
+		}
+	}
+	return nil
+}
+
+// banEquipment removes a piece of equipment from the state and adds its
+// ShortID to the banlist. The reports from before the ban timeslot are kept,
+// see ban_accounting.go.
+func (gcas *GCAServer) banEquipment(shortID uint32) {
+	gcas.equipmentBans[shortID] = struct{}{}
+	gcas.retainBannedReports(shortID)
+	current, exists := gcas.equipment[shortID]
+	if exists {
+		delete(gcas.equipmentShortID, current.PublicKey)
+	}
+	delete(gcas.equipment, shortID)
+	gcas.staticReportLimiter.removeDevice(shortID)
+	delete(gcas.equipmentImpactRate, shortID)
+	delete(gcas.impactFlags, shortID)
+	delete(gcas.equipmentReports, shortID)
+	for slot := range gcas.flaggedReports {
+		if slot.ShortID == shortID {
+			delete(gcas.flaggedReports, slot)
+		}
+	}
+	banTimeslot, _ := gcas.banTimeslot(shortID)
+	gcas.recordDeviceChange(StateChangeBan, shortID, current.PublicKey, banTimeslot)
+}
+
+// applyEquivocationProof bans the equipment named by a verified proof. The
+// bool is false if a proof for the equipment was already known.
+func (gcas *GCAServer) applyEquivocationProof(ep EquivocationProof) bool {
+	if _, exists := gcas.equipmentBanProofs[ep.Authorization.ShortID]; exists {
+		return false
+	}
+	gcas.equipmentBanProofs[ep.Authorization.ShortID] = ep
+	gcas.recordBan(ep.Authorization.ShortID, banReasonEquivocation, ep.Second.Timeslot)
+	gcas.banEquipment(ep.Authorization.ShortID)
+	return true
+}
+
+// saveEquivocationProof records a proof in the audit log and appends it to
+// the proofs file. The mutex must be held.
+func (gcas *GCAServer) saveEquivocationProof(ep EquivocationProof) error {
+	pk := ep.Authorization.PublicKey
+	err := gcas.recordAudit(auditRecord{
+		action:  glow.AuditEquipmentBan,
+		request: ep.Serialize(),
+		signatures: []glow.AuditSignature{
+			gcas.persistedGCAAuditSignature(ep.Authorization.SigningBytes(), ep.Authorization.Signature),
+			{PublicKey: pk, SigningBytes: ep.First.SigningBytes(), Signature: ep.First.Signature},
+			{PublicKey: pk, SigningBytes: ep.Second.SigningBytes(), Signature: ep.Second.Signature},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := gcas.staticStorage.AppendFile(EquipmentBanProofsFile, ep.Serialize(), 0644); err != nil {
+		return fmt.Errorf("unable to save equivocation proof: %v", err)
+	}
+	return nil
+}
+
+// recordEquivocation is called when equipment has signed two different
+// reports for the same timeslot. It bans the equipment, saves the proof, and
+// forwards the proof to the other servers in the background.
+func (gcas *GCAServer) recordEquivocation(first glow.EquipmentReport, second glow.EquipmentReport) {
+	ep := EquivocationProof{
+		Authorization: gcas.equipment[second.ShortID],
+		First:         first,
+		Second:        second,
+	}
+	if !gcas.applyEquivocationProof(ep) {
+		return
+	}
+	gcas.logger.WithFields("short_id", second.ShortID, "pubkey", ep.Authorization.PublicKey, "timeslot", second.Timeslot).Warn("equipment signed conflicting reports, banning equipment")
+	if err := gcas.saveEquivocationProof(ep); err != nil {
+		gcas.logger.Errorf("unable to persist equipment ban: %v", err)
+	}
+	gcas.tg.Launch(func() {
+		gcas.threadedForwardEquivocationProof(ep)
+	})
+}
+
+// threadedForwardEquivocationProof sends a proof to all of the other GCA
+// servers, so that they ban the equipment as well.
+func (gcas *GCAServer) threadedForwardEquivocationProof(ep EquivocationProof) {
+	gcas.gcaServers.mu.Lock()
+	ass := make([]AuthorizedServer, len(gcas.gcaServers.servers))
+	copy(ass, gcas.gcaServers.servers)
+	gcas.gcaServers.mu.Unlock()
+	jsonBody, _ := json.Marshal(ep)
+	for _, as := range ass {
+		resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/equipment-bans", jsonBody)
+		if err != nil {
+			gcas.logger.WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to forward equipment ban")
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// EquipmentBansHandler returns the proofs for all of the equipment that was
+// banned for signing conflicting reports on GET, and accepts proofs from
+// other servers on POST.
+func (gcas *GCAServer) EquipmentBansHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		gcas.mu.RLock()
+		proofs := make([]EquivocationProof, 0, len(gcas.equipmentBanProofs))
+		for _, ep := range gcas.equipmentBanProofs {
+			proofs = append(proofs, ep)
+		}
+		gcas.mu.RUnlock()
+		sort.Slice(proofs, func(i, j int) bool {
+			return proofs[i].Authorization.ShortID < proofs[j].Authorization.ShortID
+		})
+		gcas.writeJSONResponse(w, r, proofs)
+	case http.MethodPost:
+		var request EquivocationProof
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+			gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+			return
+		}
+		isNew, err := gcas.managedApplyEquivocationProof(request)
+		if err != nil {
+			gcas.writeError(w, errorCode(err, ErrCodeMalformedRequest), fmt.Sprint("Failed to apply equipment ban:", err))
+			gcas.requestLogger(r).Warn("Failed to apply equipment ban: ", err)
+			return
+		}
+		// Only new proofs get forwarded, which prevents the servers
+		// from endlessly passing the same proof around.
+		if isNew {
+			gcas.threadedForwardEquivocationProof(request)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	default:
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET and POST methods are supported.")
+		gcas.requestLogger(r).Warn("Received unsupported request for equipment bans.")
+	}
+}
+
+// managedApplyEquivocationProof verifies, saves, and applies a proof that was
+// received from another server. The bool indicates whether the proof is new
+// to this server.
+func (gcas *GCAServer) managedApplyEquivocationProof(ep EquivocationProof) (bool, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return false, errNotInitialized
+	}
+	if err := gcas.verifyEquivocationProof(ep); err != nil {
+		return false, err
+	}
+	// Reports outside of the lifetime of the authorization don't count,
+	// so they can't prove anything either, see authorization_window.go.
+	if err := gcas.authorizationWindowError(ep.Authorization, ep.First.Timeslot); err != nil {
+		return false, withCode(ErrCodeOutsideAuthorization, fmt.Errorf("reports are outside of the authorization: %v", err))
+	}
+	if _, exists := gcas.equipmentBanProofs[ep.Authorization.ShortID]; exists {
+		return false, nil
+	}
+	// Persist the proof before applying it.
+	if err := gcas.saveEquivocationProof(ep); err != nil {
+		return false, withCode(ErrCodeInternalError, err)
+	}
+	return gcas.applyEquivocationProof(ep), nil
+}
+
+// loadEquivocationProofs loads the proofs from disk and bans the equipment
+// they name, creating the file if it does not exist yet. This needs to
+// happen after the equipment is loaded and before any reports are loaded.
+func (gcas *GCAServer) loadEquivocationProofs() error {
+	data, err := gcas.staticStorage.ReadFile(EquipmentBanProofsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(EquipmentBanProofsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read equipment bans file: %v", err)
+	}
+	for len(data) > 0 {
+		ep, n, err := DeserializeStreamEquivocationProof(data)
+		if err != nil {
+			return fmt.Errorf("unable to decode equivocation proof: %v", err)
+		}
+		data = data[n:]
+		// Older servers also banned equipment for signing the same report
+		// twice with different signatures. Those proofs are skipped.
+		if ep.First.PowerOutput == ep.Second.PowerOutput {
+			gcas.logger.WithFields("short_id", ep.Authorization.ShortID, "timeslot", ep.First.Timeslot).Warn("Skipping equivocation proof for a resent report")
+			continue
+		}
+		if err := gcas.verifyEquivocationProof(ep); err != nil {
+			return fmt.Errorf("invalid persisted equivocation proof: %v", err)
+		}
+		gcas.applyEquivocationProof(ep)
+	}
+	return nil
+}
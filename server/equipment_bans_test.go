@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getEquipmentBans fetches the equivocation proofs from the server.
+func (gcas *GCAServer) getEquipmentBans() ([]EquivocationProof, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/equipment-bans", gcas.httpPort))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %v", resp.StatusCode)
+	}
+	var proofs []EquivocationProof
+	err = json.NewDecoder(resp.Body).Decode(&proofs)
+	return proofs, err
+}
+
+// postEquipmentBan submits an equivocation proof, returning the status code.
+func (gcas *GCAServer) postEquipmentBan(ep EquivocationProof) (int, error) {
+	jsonBody, _ := json.Marshal(ep)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/equipment-bans", gcas.httpPort), "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// TestEquivocationBan checks that equipment which signs two different reports
+// for the same timeslot gets banned, and that the proof can be verified,
+// survives a restart, and gets forwarded to the other servers.
+func TestEquivocationBan(t *testing.T) {
+	server, dir, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failover, _, err := SetupTestEnvironmentKnownGCA(t.Name()+"-failover", gcaPubKey, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer failover.Close()
+	server.gcaServers.mu.Lock()
+	server.gcaServers.servers = append(server.gcaServers.servers, AuthorizedServer{
+		PublicKey: failover.staticPublicKey,
+		Location:  "127.0.0.1",
+		HttpPort:  failover.httpPort,
+		TcpPort:   failover.tcpPort,
+		UdpPort:   failover.udpPort,
+	})
+	server.gcaServers.mu.Unlock()
+
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	honest, ePriv2, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Resending the same report is harmless, a different report for the
+	// same timeslot gets the equipment banned.
+	first := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 3, PowerOutput: 5}
+	first.Signature = glow.Sign(first.SigningBytes(), ePriv)
+	second := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 3, PowerOutput: 7}
+	second.Signature = glow.Sign(second.SigningBytes(), ePriv)
+	for _, er := range []glow.EquipmentReport{first, first} {
+		server.managedHandleEquipmentReport(er.Serialize())
+	}
+	server.managedHandleEquipmentReport(generateTestReport(honest.ShortID, 3, ePriv2))
+	if outcome, _ := server.managedHandleEquipmentReport(second.Serialize()); outcome != reportBanned {
+		t.Fatal("conflicting report did not cause a ban:", outcome)
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 4, ePriv)); outcome != reportBanned {
+		t.Fatal("banned equipment was able to submit a report:", outcome)
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(honest.ShortID, 4, ePriv2)); outcome != reportAccepted {
+		t.Fatal("other equipment was affected by the ban:", outcome)
+	}
+
+	// The proof is available over the API and can be verified by anyone
+	// who knows the GCA key.
+	proofs, err := server.getEquipmentBans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proofs) != 1 || proofs[0].First != first || proofs[0].Second != second || proofs[0].Authorization != ea {
+		t.Fatalf("unexpected proofs: %+v", proofs)
+	}
+	if err := server.verifyEquivocationProof(proofs[0]); err != nil {
+		t.Fatal("proof does not verify:", err)
+	}
+	for _, mutate := range []func(*EquivocationProof){
+		func(ep *EquivocationProof) { ep.Second = ep.First },
+		func(ep *EquivocationProof) { ep.Second.PowerOutput++ },
+		func(ep *EquivocationProof) { ep.Authorization.Capacity++ },
+		func(ep *EquivocationProof) { ep.Second.Timeslot++ },
+	} {
+		bad := proofs[0]
+		mutate(&bad)
+		if err := server.verifyEquivocationProof(bad); err == nil {
+			t.Error("invalid proof was accepted")
+		}
+	}
+
+	// The ban gets forwarded to the failover server in the background.
+	var forwarded bool
+	for i := 0; i < 100 && !forwarded; i++ {
+		time.Sleep(10 * time.Millisecond)
+		failover.mu.Lock()
+		_, forwarded = failover.equipmentBans[ea.ShortID]
+		failover.mu.Unlock()
+	}
+	if !forwarded {
+		t.Fatal("ban was not forwarded to the failover server")
+	}
+	invalid := proofs[0]
+	invalid.Second = invalid.First
+	if status, err := failover.postEquipmentBan(invalid); err != nil || status != http.StatusBadRequest {
+		t.Fatal("invalid proof was not rejected:", status, err)
+	}
+
+	// The ban survives a restart, and the ShortID can't be reused.
+	server.Close()
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.mu.Lock()
+	_, banned := server.equipmentBans[ea.ShortID]
+	_, hasProof := server.equipmentBanProofs[ea.ShortID]
+	_, honestKnown := server.equipment[honest.ShortID]
+	server.mu.Unlock()
+	if !banned || !hasProof || !honestKnown {
+		t.Fatal("state was not restored after a restart:", banned, hasProof, honestKnown)
+	}
+	if _, _, err := server.AuthorizeTestDevice(ea.ShortID, gcaPrivKey); err == nil {
+		t.Fatal("banned ShortID was authorized again")
+	}
+}
+
+// FuzzEquivocationProofEncoding checks that equivocation proofs survive a
+// round trip, and that changing any byte of a proof makes it fail
+// verification.
+func FuzzEquivocationProofEncoding(f *testing.F) {
+	gcas, _, _, gcaPrivKey, err := SetupTestEnvironment(f.Name())
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer gcas.Close()
+	pub, priv := glow.GenerateKeyPair()
+
+	f.Add(uint32(1), uint32(2016), uint64(5), uint64(6), byte(1))
+	f.Add(uint32(0), uint32(0), uint64(0), uint64(1<<63), byte(0x80))
+	f.Fuzz(func(t *testing.T, shortID, timeslot uint32, first, second uint64, delta byte) {
+		if first == second {
+			return
+		}
+		ea := SignEquipmentAuthorization(glow.EquipmentAuthorization{
+			ShortID:    shortID,
+			PublicKey:  pub,
+			Capacity:   15400300,
+			Expiration: timeslot + 4032,
+		}, gcaPrivKey)
+		ep := EquivocationProof{
+			Authorization: ea,
+			First:         glow.EquipmentReport{ShortID: shortID, Timeslot: timeslot, PowerOutput: first},
+			Second:        glow.EquipmentReport{ShortID: shortID, Timeslot: timeslot, PowerOutput: second},
+		}
+		ep.First.Signature = glow.Sign(ep.First.SigningBytes(), priv)
+		ep.Second.Signature = glow.Sign(ep.Second.SigningBytes(), priv)
+
+		data := ep.Serialize()
+		decoded, n, err := DeserializeStreamEquivocationProof(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(data) || decoded != ep {
+			t.Fatal("proof changed in the round trip")
+		}
+		verify := func(b []byte) error {
+			ep, _, err := DeserializeStreamEquivocationProof(b)
+			if err != nil {
+				return err
+			}
+			gcas.mu.RLock()
+			defer gcas.mu.RUnlock()
+			return gcas.verifyEquivocationProof(ep)
+		}
+		if err := verify(data); err != nil {
+			t.Fatal(err)
+		}
+		if delta == 0 {
+			delta = 1
+		}
+		mutated := make([]byte, len(data))
+		for i := range data {
+			copy(mutated, data)
+			mutated[i] ^= delta
+			if verify(mutated) == nil {
+				t.Fatalf("proof still verifies after byte %v was changed", i)
+			}
+		}
+	})
+}
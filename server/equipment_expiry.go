@@ -0,0 +1,89 @@
+package server
+
+// equipment_expiry.go contains the expiry and the renewal of equipment
+// authorizations. Authorizations in the expiring format carry a timeslot from
+// which on the device can no longer submit reports, see
+// glow.EquipmentAuthorizationVersionExpiring. The server keeps the reports and
+// the history of an expired device, it only rejects the reports for the
+// timeslots after the expiry with DEVICE_EXPIRED, and marks the device as
+// expired in the stats.
+//
+// The GCA extends the expiry of a device by signing a renewal, which is a new
+// authorization in the expiring format that is identical to the current
+// authorization of the device except for a fresh nonce and a later
+// expiration. A renewal gets submitted like any other authorization, and
+// replaces the current authorization without changing the ShortID of the
+// device. Any other authorization for the same ShortID is still a conflict
+// that bans the ShortID. Servers can receive the authorizations of a device
+// out of order, so an authorization that the current authorization is a
+// renewal of is ignored instead of being treated as a conflict.
+//
+// If the webhooks are configured, the device status watcher warns them once
+// per authorization when a device gets within 30 days of its expiry, see
+// offline_webhooks.go.
+
+import (
+	"encoding/hex"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// isRenewal returns whether the authorization renews the current
+// authorization of its ShortID.
+func isRenewal(current, ea glow.EquipmentAuthorization) bool {
+	if ea.Version != glow.EquipmentAuthorizationVersionExpiring {
+		return false
+	}
+	currentExpiry, expires := current.ExpiresAt()
+	if !expires {
+		return false
+	}
+	if expiry, expires := ea.ExpiresAt(); expires && expiry <= currentExpiry {
+		return false
+	}
+	renewed := current
+	renewed.Expiration = ea.Expiration
+	renewed.Nonce = ea.Nonce
+	renewed.Signature = ea.Signature
+	return renewed == ea && current.Nonce != ea.Nonce
+}
+
+// renewEquipment replaces the current authorization of a device with its
+// renewal.
+func (gcas *GCAServer) renewEquipment(ea glow.EquipmentAuthorization) {
+	gcas.equipment[ea.ShortID] = ea
+	delete(gcas.equipmentExpiryWarned, ea.ShortID)
+	gcas.bumpStateVersion()
+	gcas.logger.WithFields("short_id", ea.ShortID, "expiration", ea.Expiration).Info("Renewed the authorization of equipment")
+}
+
+// detectExpiringDevices returns an event for every device whose authorization
+// expires within expiryWarningTimeslots of the provided timeslot, and that
+// the webhooks have not been warned about yet. Devices that have already
+// expired or that were deauthorized are ignored.
+func (gcas *GCAServer) detectExpiringDevices(now uint32) []DeviceStatusEvent {
+	var events []DeviceStatusEvent
+	detectedAt := gcas.now().Unix()
+	for shortID, ea := range gcas.equipment {
+		expiry, expires := ea.ExpiresAt()
+		if !expires || now >= expiry || expiry-now > expiryWarningTimeslots {
+			continue
+		}
+		if warned, exists := gcas.equipmentExpiryWarned[shortID]; exists && warned == expiry {
+			continue
+		}
+		if _, deauthorized := gcas.equipmentDeauthorizations[ea.PublicKey]; deauthorized {
+			continue
+		}
+		gcas.equipmentExpiryWarned[shortID] = expiry
+		events = append(events, DeviceStatusEvent{
+			Event:              webhookEventExpiring,
+			ShortID:            shortID,
+			PubkeyHex:          hex.EncodeToString(ea.PublicKey[:]),
+			LastSeenTimeslot:   gcas.equipmentLastSeen[shortID],
+			ExpirationTimeslot: expiry,
+			DetectedAt:         detectedAt,
+		})
+	}
+	return events
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestEquipmentExpiry checks that reports are rejected once the authorization
+// of a device expires, that a renewal extends the expiry without changing the
+// ShortID, that an outdated authorization is not treated as a conflict, and
+// that the webhooks get warned about every expiry once.
+func TestEquipmentExpiry(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &webhookReceiver{}
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+	config, _ := json.Marshal(webhookConfig{URLs: []string{receiverServer.URL}})
+	if err := os.WriteFile(filepath.Join(dir, WebhooksConfigFile), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+	// The webhooks get other events too, such as the authorizations.
+	expiringEvents := func(n int) []DeviceStatusEvent {
+		var expiring []DeviceStatusEvent
+		for _, event := range receiver.waitForEvents(n) {
+			if event.Event == webhookEventExpiring {
+				expiring = append(expiring, event)
+			}
+		}
+		return expiring
+	}
+
+	// The device expires well within the warning period.
+	pub, priv := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{
+		Version:    glow.EquipmentAuthorizationVersionExpiring,
+		ShortID:    1,
+		PublicKey:  pub,
+		Capacity:   15400300,
+		Expiration: 100,
+		Nonce:      testAuthorizationNonce.Add(1),
+	}
+	if err := server.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	ea.Signature = glow.Sign(ea.SigningBytes(), gcaPrivKey)
+	events := expiringEvents(2)
+	if len(events) != 1 || events[0].ShortID != 1 || events[0].ExpirationTimeslot != 100 {
+		t.Fatalf("expected an expiring event, got %+v", events)
+	}
+
+	// Reports are accepted up to the expiry, and rejected from then on.
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, 10, priv)); outcome != reportAccepted {
+		t.Fatal("report before the expiry was not accepted:", outcome)
+	}
+	glow.SetCurrentTimeslot(100)
+	outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, 100, priv))
+	if outcome != reportExpired || outcome.apiErrorCode() != ErrCodeDeviceExpired {
+		t.Fatal("report after the expiry was not rejected:", outcome)
+	}
+
+	// The history is kept, and the device is marked as expired.
+	_, ads, err := server.getAllDeviceStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices) != 1 || !ads.Devices[0].Expired || ads.Devices[0].PowerOutputs[10] != 5 {
+		t.Fatalf("expired device is not in the stats: %+v", ads.Devices)
+	}
+
+	// A renewal extends the expiry and gets warned about again.
+	renewal := ea
+	renewal.Expiration = 5000
+	renewal.Nonce = testAuthorizationNonce.Add(1)
+	if err := server.AuthorizeEquipment(renewal, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	renewal.Signature = glow.Sign(renewal.SigningBytes(), gcaPrivKey)
+
+	// The device also went offline in the meantime.
+	events = expiringEvents(5)
+	if len(events) != 2 || events[1].ExpirationTimeslot != 5000 {
+		t.Fatalf("expected a second expiring event, got %+v", events)
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, 100, priv)); outcome != reportAccepted {
+		t.Fatal("report after the renewal was not accepted:", outcome)
+	}
+	_, ads, err = server.getAllDeviceStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices) != 1 || ads.Devices[0].Expired {
+		t.Fatalf("renewed device is still expired: %+v", ads.Devices)
+	}
+
+	// The outdated authorization is not a conflict, neither when it gets
+	// submitted again nor when the authorizations get loaded.
+	if err := server.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	checkRenewed := func() {
+		t.Helper()
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		_, banned := server.equipmentBans[1]
+		if banned || server.equipment[1] != renewal {
+			t.Fatal("the renewal was not kept:", banned, server.equipment[1])
+		}
+	}
+	checkRenewed()
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	checkRenewed()
+}
@@ -5,18 +5,29 @@ import (
 	"time"
 
 	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server/clock/clocktest"
 )
 
-// TestThreadedMigrateReports tests the migration of equipment reports.
+// TestThreadedMigrateReports tests the migration of equipment reports. The
+// server runs on a manual clock, and every step of the test runs exactly one
+// iteration of the migration thread.
 func TestThreadedMigrateReports(t *testing.T) {
-	gcas, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	c := clocktest.NewManual(time.Unix(glow.GenesisTime, 0))
+	opts := DefaultServerOptions()
+	opts.Clock = c
+	gcas, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer gcas.Close()
-	defer func() {
-		glow.SetCurrentTimeslot(0)
-	}()
+	c.WaitForSleep(ReportMigrationFrequency)
+	// migrationCycle moves the clock to the provided timeslot, which must
+	// be at least one cycle ahead, and waits for the migration thread to
+	// go back to sleep.
+	migrationCycle := func(timeslot uint32) {
+		c.Set(time.Unix(glow.TimeslotToUnix(timeslot), 0))
+		c.WaitForSleep(ReportMigrationFrequency)
+	}
 
 	// Generate a dummy EquipmentAuthorization
 	ePubKey, _ := glow.GenerateKeyPair()
@@ -27,13 +38,9 @@ func TestThreadedMigrateReports(t *testing.T) {
 	}
 
 	// Generate reports that will fill out the first 2 migrations.
-	dummyReport := [4032]glow.EquipmentReport{}
-	for i := 0; i < len(dummyReport); i++ {
-		dummyReport[i] = glow.EquipmentReport{
-			ShortID:     dummyEquipment.ShortID,
-			Timeslot:    uint32(i),
-			PowerOutput: uint64(1000 + i),
-		}
+	dummyReport := deviceReports{}
+	for i := 0; i < len(dummyReport.PowerOutputs); i++ {
+		dummyReport.PowerOutputs[i] = uint64(1000 + i)
 	}
 	// Just load the dummy reports right into the gcas.
 	gcas.equipmentReports[dummyEquipment.ShortID] = &dummyReport
@@ -41,19 +48,19 @@ func TestThreadedMigrateReports(t *testing.T) {
 	// Verify that nothing got pruned.
 	for i := 0; i < 4032; i++ {
 		gcas.mu.Lock()
-		if gcas.equipmentReports[dummyEquipment.ShortID][i].PowerOutput < 2 {
+		if gcas.equipmentReports[dummyEquipment.ShortID].PowerOutputs[i] < 2 {
 			gcas.mu.Unlock()
 			t.Fatal("equipment should still exist")
 		}
 		gcas.mu.Unlock()
 	}
-	// Wait 350 milliseconds, which should trigger a prune. Except that no
-	// prune should be triggered because we aren't inside the prune window.
-	time.Sleep(350 * time.Millisecond)
+	// Run a migration cycle. No prune should be triggered because we
+	// aren't inside the prune window.
+	migrationCycle(1)
 	// Verify that nothing got pruned.
 	for i := 0; i < 4032; i++ {
 		gcas.mu.Lock()
-		if gcas.equipmentReports[dummyEquipment.ShortID][i].PowerOutput < 2 {
+		if gcas.equipmentReports[dummyEquipment.ShortID].PowerOutputs[i] < 2 {
 			gcas.mu.Unlock()
 			t.Fatal("equipment should still exist")
 		}
@@ -61,14 +68,11 @@ func TestThreadedMigrateReports(t *testing.T) {
 	}
 
 	// Update the timeslot just enough that we shouldn't be getting pruned still.
-	glow.SetCurrentTimeslot(3000)
-	// Wait 350 milliseconds, which should trigger a prune. Except that no
-	// prune should be triggered because we aren't inside the prune window.
-	time.Sleep(350 * time.Millisecond)
+	migrationCycle(3000)
 	// Verify that nothing got pruned.
 	for i := 0; i < 4032; i++ {
 		gcas.mu.Lock()
-		if gcas.equipmentReports[dummyEquipment.ShortID][i].PowerOutput < 2 {
+		if gcas.equipmentReports[dummyEquipment.ShortID].PowerOutputs[i] < 2 {
 			gcas.mu.Unlock()
 			t.Fatal("equipment should still exist")
 		}
@@ -76,14 +80,11 @@ func TestThreadedMigrateReports(t *testing.T) {
 	}
 
 	// Update the timeslot just enough that things should be getting pruned now.
-	glow.SetCurrentTimeslot(3300)
-	// Wait 350 milliseconds, which should trigger a prune. Except that no
-	// prune should be triggered because we aren't inside the prune window.
-	time.Sleep(350 * time.Millisecond)
+	migrationCycle(3300)
 	// Verify that things got pruned
 	for i := 0; i < 2016; i++ {
 		gcas.mu.Lock()
-		if gcas.equipmentReports[dummyEquipment.ShortID][i].PowerOutput < 2 {
+		if gcas.equipmentReports[dummyEquipment.ShortID].PowerOutputs[i] < 2 {
 			gcas.mu.Unlock()
 			t.Fatal("equipment should have been pruned")
 		}
@@ -91,18 +92,18 @@ func TestThreadedMigrateReports(t *testing.T) {
 	}
 	for i := 2016; i < 4032; i++ {
 		gcas.mu.Lock()
-		if gcas.equipmentReports[dummyEquipment.ShortID][i].PowerOutput != 0 {
+		if gcas.equipmentReports[dummyEquipment.ShortID].PowerOutputs[i] != 0 {
 			gcas.mu.Unlock()
 			t.Fatal("equipment should still exist")
 		}
 		gcas.mu.Unlock()
 	}
 
-	// Wait for another prune cycle, verify nothing happens.
-	time.Sleep(350 * time.Millisecond)
+	// Run another prune cycle, verify nothing happens.
+	migrationCycle(3301)
 	for i := 0; i < 2016; i++ {
 		gcas.mu.Lock()
-		if gcas.equipmentReports[dummyEquipment.ShortID][i].PowerOutput < 2 {
+		if gcas.equipmentReports[dummyEquipment.ShortID].PowerOutputs[i] < 2 {
 			gcas.mu.Unlock()
 			t.Fatal("equipment should still exist")
 		}
@@ -110,7 +111,7 @@ func TestThreadedMigrateReports(t *testing.T) {
 	}
 	for i := 2016; i < 4032; i++ {
 		gcas.mu.Lock()
-		if gcas.equipmentReports[dummyEquipment.ShortID][i].PowerOutput != 0 {
+		if gcas.equipmentReports[dummyEquipment.ShortID].PowerOutputs[i] != 0 {
 			gcas.mu.Unlock()
 			t.Fatal("equipment should still exist")
 		}
@@ -118,10 +119,10 @@ func TestThreadedMigrateReports(t *testing.T) {
 	}
 
 	// Update the time to 5000, which should still not cause a prune.
-	time.Sleep(350 * time.Millisecond)
+	migrationCycle(5000)
 	for i := 0; i < 2016; i++ {
 		gcas.mu.Lock()
-		if gcas.equipmentReports[dummyEquipment.ShortID][i].PowerOutput < 2 {
+		if gcas.equipmentReports[dummyEquipment.ShortID].PowerOutputs[i] < 2 {
 			gcas.mu.Unlock()
 			t.Fatal("equipment should still exist")
 		}
@@ -129,7 +130,7 @@ func TestThreadedMigrateReports(t *testing.T) {
 	}
 	for i := 2016; i < 4032; i++ {
 		gcas.mu.Lock()
-		if gcas.equipmentReports[dummyEquipment.ShortID][i].PowerOutput != 0 {
+		if gcas.equipmentReports[dummyEquipment.ShortID].PowerOutputs[i] != 0 {
 			gcas.mu.Unlock()
 			t.Fatal("equipment should still exist")
 		}
@@ -138,11 +139,10 @@ func TestThreadedMigrateReports(t *testing.T) {
 
 	// Update the current timeslot to trigger another migration, now all of
 	// the reports should be migrated out.
-	glow.SetCurrentTimeslot(5300)
-	time.Sleep(350 * time.Millisecond)
+	migrationCycle(5300)
 	for i := 0; i < 4032; i++ {
 		gcas.mu.Lock()
-		if gcas.equipmentReports[dummyEquipment.ShortID][i].PowerOutput != 0 {
+		if gcas.equipmentReports[dummyEquipment.ShortID].PowerOutputs[i] != 0 {
 			t.Error("all the reports should have been cycled out:", i)
 		}
 		gcas.mu.Unlock()
@@ -0,0 +1,337 @@
+package server
+
+// flagged_reports.go contains the handling of reports that claim more power
+// than the equipment can physically produce, which usually means that a meter
+// is miswired.
+//
+// A report is flagged if its power output exceeds the capacity of the
+// equipment by more than the capacity tolerance. Flagged reports are not
+// integrated into the state, so they don't count towards any stats or impact
+// calculations. Instead they are persisted to their own file and held until
+// the GCA reviews them. The GCA can either accept a flagged report, in which
+// case it gets integrated like any other report, or reject it, in which case
+// the timeslot gets banned.
+//
+// Reviews are persisted and loaded before any reports, so that a reviewed
+// report gets the same treatment after a restart. A review names the power
+// output of the report it applies to, so it can never be used to accept a
+// different report for the same timeslot.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// flaggedReportReviewSize is the size of a serialized FlaggedReportReview.
+const flaggedReportReviewSize = 4 + 4 + 8 + 1 + 64
+
+// reportSlot identifies a single timeslot of a single device.
+type reportSlot struct {
+	ShortID  uint32
+	Timeslot uint32
+}
+
+// FlaggedReport is a report that is waiting for review, along with the
+// capacity of the equipment that sent it.
+type FlaggedReport struct {
+	ShortID     uint32
+	PublicKey   glow.PublicKey
+	Timeslot    uint32
+	PowerOutput uint64
+	Capacity    uint64
+	Signature   glow.Signature // The signature of the equipment on the report
+}
+
+// FlaggedReportReview is a decision from the GCA about a flagged report.
+type FlaggedReportReview struct {
+	ShortID     uint32
+	Timeslot    uint32
+	PowerOutput uint64 // The power output of the report being reviewed
+	Accept      bool   // Accepts the report if true, otherwise rejects it permanently
+	Signature   glow.Signature
+}
+
+// SigningBytes returns the bytes that the GCA signs to authorize the review.
+func (frr FlaggedReportReview) SigningBytes() []byte {
+	b := []byte("FlaggedReportReview")
+	b = binary.LittleEndian.AppendUint32(b, frr.ShortID)
+	b = binary.LittleEndian.AppendUint32(b, frr.Timeslot)
+	b = binary.LittleEndian.AppendUint64(b, frr.PowerOutput)
+	if frr.Accept {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Serialize returns the compact binary representation of the review.
+func (frr FlaggedReportReview) Serialize() []byte {
+	b := make([]byte, flaggedReportReviewSize)
+	binary.LittleEndian.PutUint32(b[0:], frr.ShortID)
+	binary.LittleEndian.PutUint32(b[4:], frr.Timeslot)
+	binary.LittleEndian.PutUint64(b[8:], frr.PowerOutput)
+	if frr.Accept {
+		b[16] = 1
+	}
+	copy(b[17:], frr.Signature[:])
+	return b
+}
+
+// DeserializeFlaggedReportReview reverses a call to Serialize.
+func DeserializeFlaggedReportReview(b []byte) (FlaggedReportReview, error) {
+	var frr FlaggedReportReview
+	if len(b) != flaggedReportReviewSize {
+		return frr, fmt.Errorf("unexpected flagged report review size: %v", len(b))
+	}
+	frr.ShortID = binary.LittleEndian.Uint32(b[0:])
+	frr.Timeslot = binary.LittleEndian.Uint32(b[4:])
+	frr.PowerOutput = binary.LittleEndian.Uint64(b[8:])
+	frr.Accept = b[16] == 1
+	copy(frr.Signature[:], b[17:])
+	return frr, nil
+}
+
+// exceedsCapacity returns whether a report claims more power than the
+// equipment can produce, including the tolerance, or a reading so far out in
+// either direction that it can only be garbage. Negative readings that are
+// within glow.MaxPowerOutput never exceed the capacity.
+func (gcas *GCAServer) exceedsCapacity(report glow.EquipmentReport) bool {
+	if glow.PowerOutputIsGarbage(report.PowerOutput) {
+		return true
+	}
+	limit := gcas.equipment[report.ShortID].Capacity * (100 + gcas.staticCapacityTolerance) / 100
+	return glow.PowerReading(report.PowerOutput) > 0 && report.PowerOutput > limit
+}
+
+// FlaggedReportsHandler returns all of the reports that are waiting for
+// review, optionally filtered to a single device with the 'short_id' query
+// parameter.
+func (gcas *GCAServer) FlaggedReportsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for flagged reports.")
+		return
+	}
+	var filter *uint32
+	if sidStr := r.URL.Query().Get("short_id"); sidStr != "" {
+		sid, err := strconv.ParseUint(sidStr, 10, 32)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid short_id")
+			return
+		}
+		shortID := uint32(sid)
+		filter = &shortID
+	}
+
+	flagged := []FlaggedReport{}
+	gcas.mu.RLock()
+	for slot, report := range gcas.flaggedReports {
+		if filter != nil && slot.ShortID != *filter {
+			continue
+		}
+		ea := gcas.equipment[slot.ShortID]
+		flagged = append(flagged, FlaggedReport{
+			ShortID:     report.ShortID,
+			PublicKey:   ea.PublicKey,
+			Timeslot:    report.Timeslot,
+			PowerOutput: report.PowerOutput,
+			Capacity:    ea.Capacity,
+			Signature:   report.Signature,
+		})
+	}
+	gcas.mu.RUnlock()
+	sort.Slice(flagged, func(i, j int) bool {
+		if flagged[i].ShortID != flagged[j].ShortID {
+			return flagged[i].ShortID < flagged[j].ShortID
+		}
+		return flagged[i].Timeslot < flagged[j].Timeslot
+	})
+	gcas.writeJSONResponse(w, r, flagged)
+}
+
+// ReviewFlaggedReportHandler accepts a review of a flagged report from the
+// GCA.
+func (gcas *GCAServer) ReviewFlaggedReportHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for flagged report review.")
+		return
+	}
+
+	var request FlaggedReportReview
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+	isNew, err := gcas.managedReviewFlaggedReport(request, requestAuditSignatures(r)...)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeMalformedRequest), fmt.Sprint("Failed to review flagged report:", err))
+		gcas.requestLogger(r).Warn("Failed to review flagged report: ", err)
+		return
+	}
+
+	// Forward the review to the other servers, which will have flagged
+	// the same report. Only new reviews get forwarded, which prevents the
+	// servers from endlessly passing the same review around.
+	if isNew {
+		gcas.gcaServers.mu.Lock()
+		ass := make([]AuthorizedServer, len(gcas.gcaServers.servers))
+		copy(ass, gcas.gcaServers.servers)
+		gcas.gcaServers.mu.Unlock()
+		jsonBody, _ := json.Marshal(request)
+		for _, as := range ass {
+			resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/flagged-reports/review", jsonBody)
+			if err != nil {
+				gcas.requestLogger(r).Infof("unable to forward flagged report review: %v", err)
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	gcas.requestLogger(r).Info("Successfully reviewed flagged report.")
+}
+
+// managedReviewFlaggedReport verifies and saves a review, and then applies it
+// to the flagged report if the report is waiting for review. Reviews for
+// reports that this server has not flagged yet are kept, so that the report
+// gets the same treatment if it arrives later. The bool indicates whether
+// the review is new to this server. The signatures of the HTTP request that
+// carried the review, if any, are added to its audit record.
+func (gcas *GCAServer) managedReviewFlaggedReport(frr FlaggedReportReview, requestSigs ...glow.AuditSignature) (bool, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return false, errNotInitialized
+	}
+	reviewSig, err := gcas.operatorSignature(frr.SigningBytes(), frr.Signature, ScopeResolveFlaggedReports)
+	if err != nil {
+		return false, fmt.Errorf("flagged report review: %w", err)
+	}
+
+	// Only the first review of a report counts, the decision is permanent.
+	slot := reportSlot{ShortID: frr.ShortID, Timeslot: frr.Timeslot}
+	if current, exists := gcas.flaggedReportReviews[slot]; exists {
+		if current.PowerOutput == frr.PowerOutput && current.Accept == frr.Accept {
+			return false, nil
+		}
+		return false, withCode(ErrCodeConflict, fmt.Errorf("this report has already been reviewed"))
+	}
+
+	// Record and persist the review before applying it.
+	err = gcas.recordAudit(auditRecord{
+		action:     glow.AuditFlaggedReportReview,
+		request:    frr.Serialize(),
+		signatures: append([]glow.AuditSignature{reviewSig}, requestSigs...),
+	})
+	if err != nil {
+		return false, withCode(ErrCodeInternalError, err)
+	}
+	if err := gcas.staticStorage.AppendFile(FlaggedReportReviewsFile, frr.Serialize(), 0644); err != nil {
+		return false, withCode(ErrCodeInternalError, fmt.Errorf("unable to save flagged report review: %v", err))
+	}
+	gcas.flaggedReportReviews[slot] = frr
+	gcas.bumpStateVersion()
+
+	// Apply the review by integrating the flagged report again, which
+	// will now either accept the report or ban the timeslot. The report
+	// is already persisted in the flagged reports file.
+	report, exists := gcas.flaggedReports[slot]
+	if exists && report.PowerOutput == frr.PowerOutput {
+		delete(gcas.flaggedReports, slot)
+		gcas.countFlaggedReport(slot, -1)
+		gcas.applyReport(report, 0, ValidationEnforce)
+	}
+	return true, nil
+}
+
+// saveFlaggedReport appends a flagged report to the flagged reports file.
+func (gcas *GCAServer) saveFlaggedReport(report glow.EquipmentReport) error {
+	if err := gcas.staticStorage.AppendFile(FlaggedReportsFile, report.Serialize(), 0644); err != nil {
+		return fmt.Errorf("unable to save flagged report: %v", err)
+	}
+	return nil
+}
+
+// loadFlaggedReportReviews loads all of the reviews from disk, creating the
+// file if it does not exist yet. This needs to happen before the reports are
+// loaded.
+func (gcas *GCAServer) loadFlaggedReportReviews() error {
+	data, err := gcas.staticStorage.ReadFile(FlaggedReportReviewsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(FlaggedReportReviewsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read flagged report reviews file: %v", err)
+	}
+	if len(data)%flaggedReportReviewSize != 0 {
+		return fmt.Errorf("flagged report reviews file has an unexpected size")
+	}
+	for i := 0; i < len(data); i += flaggedReportReviewSize {
+		frr, err := DeserializeFlaggedReportReview(data[i : i+flaggedReportReviewSize])
+		if err != nil {
+			return fmt.Errorf("unable to decode flagged report review: %v", err)
+		}
+		if !gcas.verifyPersistedOperatorSignature(frr.SigningBytes(), frr.Signature, gcas.operatorReviewKeys) {
+			return fmt.Errorf("invalid signature on persisted flagged report review")
+		}
+		slot := reportSlot{ShortID: frr.ShortID, Timeslot: frr.Timeslot}
+		if _, exists := gcas.flaggedReportReviews[slot]; !exists {
+			gcas.flaggedReportReviews[slot] = frr
+		}
+	}
+	return nil
+}
+
+// loadFlaggedReports loads the flagged reports from disk, creating the file
+// if it does not exist yet. The reports are integrated the same way that
+// they were when they arrived, which puts them back up for review unless
+// they have been reviewed.
+func (gcas *GCAServer) loadFlaggedReports() error {
+	data, err := gcas.staticStorage.ReadFile(FlaggedReportsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(FlaggedReportsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read flagged reports file: %v", err)
+	}
+	if len(data)%equipmentReportSize != 0 {
+		return fmt.Errorf("flagged reports file has an unexpected size")
+	}
+	for i := 0; i < len(data); i += equipmentReportSize {
+		rawReport := data[i : i+equipmentReportSize]
+		report, err := gcas.parseReport(rawReport)
+		if err := gcas.loadReport(rawReport, report, err, 0, ValidationEnforce); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneFlaggedReports drops the flagged reports and reviews for timeslots
+// that are no longer held in memory, as those reports can no longer be
+// integrated.
+func (gcas *GCAServer) pruneFlaggedReports() {
+	for slot := range gcas.flaggedReports {
+		if slot.Timeslot < gcas.equipmentReportsOffset {
+			delete(gcas.flaggedReports, slot)
+		}
+	}
+	for slot := range gcas.flaggedReportReviews {
+		if slot.Timeslot < gcas.equipmentReportsOffset {
+			delete(gcas.flaggedReportReviews, slot)
+		}
+	}
+}
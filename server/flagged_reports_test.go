@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getFlaggedReports fetches the flagged reports with the provided query.
+func (gcas *GCAServer) getFlaggedReports(query string) ([]FlaggedReport, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/flagged-reports?%v", gcas.httpPort, query))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %v", resp.StatusCode)
+	}
+	var flagged []FlaggedReport
+	err = json.NewDecoder(resp.Body).Decode(&flagged)
+	return flagged, err
+}
+
+// postReview submits a flagged report review, returning the status code.
+func (gcas *GCAServer) postReview(frr FlaggedReportReview) (int, error) {
+	jsonBody, _ := json.Marshal(frr)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/flagged-reports/review", gcas.httpPort), "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// TestFlaggedReports checks the capacity boundary, and that the GCA can
+// accept or reject flagged reports.
+func TestFlaggedReports(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+	pub, priv := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{ShortID: 1, PublicKey: pub, Capacity: 1000}
+	if err := server.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	sendReport := func(timeslot uint32, power uint64) (glow.EquipmentReport, reportOutcome) {
+		er := glow.EquipmentReport{ShortID: 1, Timeslot: timeslot, PowerOutput: power}
+		er.Signature = glow.Sign(er.SigningBytes(), priv)
+		outcome, _ := server.managedHandleEquipmentReport(er.Serialize())
+		return er, outcome
+	}
+
+	// Reports at the capacity and at the edge of the tolerance are fine,
+	// anything above the tolerance gets flagged.
+	if _, outcome := sendReport(1, 1000); outcome != reportAccepted {
+		t.Fatal("report at capacity was not accepted:", outcome)
+	}
+	if _, outcome := sendReport(2, 1000*(100+DefaultCapacityTolerance)/100); outcome != reportAccepted {
+		t.Fatal("report at the tolerance was not accepted:", outcome)
+	}
+	accepted, outcome := sendReport(3, 1000*(100+DefaultCapacityTolerance)/100+1)
+	if outcome != reportFlagged {
+		t.Fatal("report above the tolerance was not flagged:", outcome)
+	}
+	rejected, _ := sendReport(4, 5e6)
+	pending, _ := sendReport(5, 5e6)
+	if _, outcome := sendReport(5, 5e6); outcome != reportDuplicate {
+		t.Fatal("resending a flagged report should be a duplicate:", outcome)
+	}
+
+	// The flagged reports are listed, and don't count towards the stats.
+	flagged, err := server.getFlaggedReports("short_id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != 3 || flagged[0].Timeslot != 3 || flagged[0].PowerOutput != accepted.PowerOutput || flagged[0].Capacity != 1000 || flagged[0].PublicKey != pub {
+		t.Fatalf("unexpected flagged reports: %+v", flagged)
+	}
+	if other, err := server.getFlaggedReports("short_id=2"); err != nil || len(other) != 0 {
+		t.Fatal("filter was not applied:", other, err)
+	}
+	server.mu.Lock()
+	summary := server.buildDeviceSummary(1, 10)
+	server.mu.Unlock()
+	if summary.TotalEnergy != 2200 || summary.ReportsReceived != 2 {
+		t.Fatalf("flagged reports were counted in the summary: %+v", summary)
+	}
+
+	// Reviews need a valid GCA signature.
+	review := func(er glow.EquipmentReport, accept bool) FlaggedReportReview {
+		frr := FlaggedReportReview{ShortID: er.ShortID, Timeslot: er.Timeslot, PowerOutput: er.PowerOutput, Accept: accept}
+		frr.Signature = glow.Sign(frr.SigningBytes(), gcaPrivKey)
+		return frr
+	}
+	forged := review(accepted, true)
+	forged.Accept = false
+	if status, err := server.postReview(forged); err != nil || status != http.StatusForbidden {
+		t.Fatal("forged review was not rejected:", status, err)
+	}
+
+	// Accept one report and reject another.
+	for _, frr := range []FlaggedReportReview{review(accepted, true), review(rejected, false)} {
+		if status, err := server.postReview(frr); err != nil || status != http.StatusOK {
+			t.Fatal("review failed:", status, err)
+		}
+	}
+	if status, _ := server.postReview(review(accepted, false)); status != http.StatusConflict {
+		t.Fatal("a review should not be changeable:", status)
+	}
+	checkState := func() {
+		t.Helper()
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if server.liveReports(t, 1)[3] != accepted {
+			t.Error("accepted report was not integrated")
+		}
+		if server.equipmentReports[1].PowerOutputs[4] != 1 {
+			t.Error("rejected report did not ban the timeslot")
+		}
+		if len(server.flaggedReports) != 1 || server.flaggedReports[reportSlot{ShortID: 1, Timeslot: 5}] != pending {
+			t.Error("unexpected flagged reports:", server.flaggedReports)
+		}
+	}
+	checkState()
+
+	// The decisions survive a restart.
+	server.Close()
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	checkState()
+
+	// A review that arrives before the report is applied once the report
+	// shows up.
+	early := glow.EquipmentReport{ShortID: 1, Timeslot: 6, PowerOutput: 5e6}
+	if status, err := server.postReview(review(early, true)); err != nil || status != http.StatusOK {
+		t.Fatal("review failed:", status, err)
+	}
+	if _, outcome := sendReport(6, 5e6); outcome != reportAccepted {
+		t.Fatal("reviewed report was not accepted:", outcome)
+	}
+
+	// A conflicting report for a flagged timeslot bans the equipment.
+	if _, outcome := sendReport(5, 500); outcome != reportBanned {
+		t.Fatal("conflicting report did not cause a ban:", outcome)
+	}
+	server.mu.Lock()
+	_, stillFlagged := server.flaggedReports[reportSlot{ShortID: 1, Timeslot: 5}]
+	_, banned := server.equipmentBans[1]
+	proof := server.equipmentBanProofs[1]
+	server.mu.Unlock()
+	if stillFlagged || !banned || proof.First != pending {
+		t.Fatal("conflict was not handled:", stillFlagged, banned, proof)
+	}
+}
@@ -0,0 +1,272 @@
+package server
+
+// heartbeats.go contains the heartbeats that devices send for the timeslots
+// that they have no production to report for, see glow/heartbeat.go. A
+// heartbeat arrives on the UDP port or on /api/v1/equipment-report like a
+// report, is signed by the device like a report, and goes through the same
+// rate limits and the same checks, other than the one on the power output.
+//
+// Heartbeats are kept apart from the reports. They have no power output, so
+// they can't end up in the totals, the impact, the period summaries or the
+// reward calculations, and they are never synced to other servers. Every
+// device has a two bit status for every timeslot in memory, and the statuses
+// are appended to a small log that is rewritten when the reports rotate. A
+// later heartbeat for the same timeslot replaces the status, heartbeats don't
+// equivocate. The signatures are not kept, the presence of a device is not
+// something that anyone has to be able to verify later.
+//
+// The v2 device stats report the uptime of a device over the elapsed part of
+// the week, which counts the timeslots that have a report or a heartbeat.
+// Heartbeats don't get acks, a lost heartbeat only costs a bit of uptime.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// heartbeatRecordSize is the size of a record in the heartbeats log, which is
+// the ShortID, the timeslot, the status and a checksum.
+const heartbeatRecordSize = 4 + 4 + 1 + 4
+
+// devicePresence holds the heartbeat status of every timeslot in memory for a
+// device, two bits per timeslot, starting at the reports offset. 0 means that
+// no heartbeat was received.
+type devicePresence [4032 * 2 / 64]uint64
+
+// status returns the heartbeat status of the timeslot at the provided index.
+func (dp *devicePresence) status(i int) byte {
+	return byte(dp[i/32]>>(uint(i%32)*2)) & 3
+}
+
+// set sets the heartbeat status of the timeslot at the provided index.
+func (dp *devicePresence) set(i int, status byte) {
+	shift := uint(i%32) * 2
+	dp[i/32] = dp[i/32]&^(3<<shift) | uint64(status&3)<<shift
+}
+
+// shift moves the second week into the first one and blanks out the second
+// week, for when the reports rotate.
+func (dp *devicePresence) shift() {
+	half := len(dp) / 2
+	copy(dp[:half], dp[half:])
+	for i := half; i < len(dp); i++ {
+		dp[i] = 0
+	}
+}
+
+// encodeHeartbeatRecord returns the record of a heartbeat status in the
+// heartbeats log.
+func encodeHeartbeatRecord(shortID uint32, timeslot uint32, status byte) []byte {
+	record := make([]byte, heartbeatRecordSize)
+	binary.LittleEndian.PutUint32(record[0:], shortID)
+	binary.LittleEndian.PutUint32(record[4:], timeslot)
+	record[8] = status
+	binary.LittleEndian.PutUint32(record[9:], crc32.ChecksumIEEE(record[:9]))
+	return record
+}
+
+// managedIngestHeartbeat decodes a heartbeat packet, checks it against the
+// rate limits of its device, and records it. Packets that don't decode and
+// packets that are over the limit return errMalformedPacket and
+// errRateLimitedPacket, like admitReportPacket. The transport and the remote
+// address only show up in the log.
+func (gcas *GCAServer) managedIngestHeartbeat(packet []byte, transport string, remote fmt.Stringer) (reportOutcome, bool, error) {
+	hb, err := glow.DeserializeHeartbeat(packet)
+	if err != nil {
+		gcas.staticMetrics.RecordMalformedPacket()
+		return 0, false, fmt.Errorf("%w: %v", errMalformedPacket, err)
+	}
+	allowed, known := gcas.staticReportLimiter.allow(hb.ShortID, gcas.now())
+	if !allowed {
+		gcas.staticMetrics.RecordRateLimited(known)
+		return 0, false, errRateLimitedPacket
+	}
+	pubkey, err := gcas.managedVerifyHeartbeat(hb)
+	gcas.mu.Lock()
+	outcome, authenticated := gcas.handleHeartbeat(hb, pubkey, err)
+	gcas.mu.Unlock()
+	if outcome != reportAccepted && outcome != reportDuplicate {
+		gcas.logger.WithFields("remote", remote, "short_id", hb.ShortID, "timeslot", hb.Timeslot, "outcome", outcome, "authenticated", authenticated).Warnf("%v heartbeat rejected", transport)
+	}
+	return outcome, authenticated, nil
+}
+
+// managedVerifyHeartbeat verifies the signature of a heartbeat, returning the
+// key that signed it, see managedVerifyReport.
+func (gcas *GCAServer) managedVerifyHeartbeat(hb glow.Heartbeat) (glow.PublicKey, error) {
+	gcas.mu.RLock()
+	equipment, ok := gcas.equipment[hb.ShortID]
+	keys := gcas.deviceKeysAt(equipment.PublicKey, hb.Timeslot)
+	gcas.mu.RUnlock()
+	if !ok {
+		return glow.PublicKey{}, fmt.Errorf("unknown equipment ID: %d", hb.ShortID)
+	}
+	sb := hb.SigningBytes()
+	for _, key := range keys {
+		if glow.Verify(key, sb, hb.Signature) {
+			return key, nil
+		}
+	}
+	return glow.PublicKey{}, errors.New("failed to verify signature")
+}
+
+// handleHeartbeat records a verified heartbeat, returning the outcome and
+// whether the heartbeat was authenticated, see handleEquipmentReport. The
+// mutex must be held.
+func (gcas *GCAServer) handleHeartbeat(hb glow.Heartbeat, pubkey glow.PublicKey, err error) (reportOutcome, bool) {
+	if err == nil && !gcas.isDeviceKeyAt(hb.ShortID, pubkey, hb.Timeslot) {
+		err = errors.New("equipment changed during verification")
+	}
+	if err != nil {
+		if _, banned := gcas.equipmentBans[hb.ShortID]; banned {
+			return reportBanned, false
+		}
+		if _, exists := gcas.equipment[hb.ShortID]; !exists {
+			return reportUnknownDevice, false
+		}
+		return reportBadSignature, false
+	}
+
+	// The checks of the reports apply to heartbeats as well, other than
+	// the one on the power output, which a heartbeat doesn't have. The
+	// warnings only count reports, so a rule that isn't enforced is
+	// skipped.
+	report := glow.EquipmentReport{ShortID: hb.ShortID, Timeslot: hb.Timeslot}
+	for _, c := range reportChecks {
+		if c.name == "power_output" || gcas.validationMode(c.name) != ValidationEnforce {
+			continue
+		}
+		if err := c.check(gcas, report); err != nil {
+			return c.outcome, true
+		}
+	}
+	if hb.Timeslot < gcas.equipmentReportsOffset || hb.Timeslot >= gcas.equipmentReportsOffset+4032 {
+		return reportStale, true
+	}
+
+	i := int(hb.Timeslot - gcas.equipmentReportsOffset)
+	dp := gcas.devicePresence[hb.ShortID]
+	if dp == nil {
+		dp = new(devicePresence)
+		gcas.devicePresence[hb.ShortID] = dp
+	}
+	if dp.status(i) == hb.Status {
+		return reportDuplicate, true
+	}
+	dp.set(i, hb.Status)
+	gcas.bumpStateVersion()
+	// A heartbeat that didn't make it into the log only costs a bit of
+	// uptime after a restart, so it's still accepted.
+	if _, err := gcas.heartbeatsLog.Write(encodeHeartbeatRecord(hb.ShortID, hb.Timeslot, hb.Status)); err != nil {
+		gcas.logger.Errorf("unable to write to the heartbeats log: %v", err)
+	}
+	return reportAccepted, true
+}
+
+// heartbeatServer returns the server that a heartbeat packet that arrived at
+// the UDP listener belongs to, which is the first of the hosted servers whose
+// device signed it, see managedRouteReportPacket. Servers without tenants
+// keep every heartbeat.
+func (server *GCAServer) heartbeatServer(packet []byte) *GCAServer {
+	if len(server.staticTenants) == 0 {
+		return server
+	}
+	hb, err := glow.DeserializeHeartbeat(packet)
+	if err != nil {
+		return server
+	}
+	for _, s := range server.hostedServers() {
+		if _, err := s.managedVerifyHeartbeat(hb); err == nil {
+			return s
+		}
+	}
+	return server.shortIDTenant(hb.ShortID)
+}
+
+// deviceUptime returns the uptime of a device over the elapsed part of the
+// week that starts at the provided timeslot offset, nil if the week isn't in
+// memory or hasn't started yet. The mutex must be held.
+func (gcas *GCAServer) deviceUptime(shortID uint32, timeslotOffset uint32) *V2DeviceUptime {
+	reports, exists := gcas.equipmentReports[shortID]
+	if !exists || timeslotOffset < gcas.equipmentReportsOffset {
+		return nil
+	}
+	end := timeslotOffset + 2016
+	if now := gcas.currentTimeslot(); now < end {
+		end = now
+	}
+	if end > gcas.equipmentReportsOffset+4032 {
+		end = gcas.equipmentReportsOffset + 4032
+	}
+	if end <= timeslotOffset {
+		return nil
+	}
+	dp := gcas.devicePresence[shortID]
+	uptime := V2DeviceUptime{Timeslots: end - timeslotOffset}
+	var alive uint32
+	for timeslot := timeslotOffset; timeslot < end; timeslot++ {
+		i := int(timeslot - gcas.equipmentReportsOffset)
+		var status byte
+		if dp != nil {
+			status = dp.status(i)
+		}
+		switch status {
+		case glow.HeartbeatIdle:
+			uptime.IdleTimeslots++
+		case glow.HeartbeatMeterFault:
+			uptime.MeterFaultTimeslots++
+		}
+		if reports.PowerOutputs[i] != 0 {
+			uptime.ReportedTimeslots++
+		}
+		if reports.PowerOutputs[i] != 0 || status != 0 {
+			alive++
+		}
+	}
+	uptime.Percent = float64(alive) * 100 / float64(uptime.Timeslots)
+	return &uptime
+}
+
+// loadHeartbeats replays the heartbeats log, and opens it so that new records
+// can be appended to it. Records for devices that are no longer known and for
+// timeslots that are no longer in memory are skipped.
+func (gcas *GCAServer) loadHeartbeats() error {
+	l, err := gcas.loadAppendLog(HeartbeatsFile, "heartbeats log", heartbeatRecordSize, func(record []byte) {
+		shortID := binary.LittleEndian.Uint32(record[0:])
+		timeslot := binary.LittleEndian.Uint32(record[4:])
+		if _, exists := gcas.equipment[shortID]; !exists || timeslot < gcas.equipmentReportsOffset || timeslot >= gcas.equipmentReportsOffset+4032 {
+			return
+		}
+		dp := gcas.devicePresence[shortID]
+		if dp == nil {
+			dp = new(devicePresence)
+			gcas.devicePresence[shortID] = dp
+		}
+		dp.set(int(timeslot-gcas.equipmentReportsOffset), record[8])
+	})
+	if err != nil {
+		return err
+	}
+	gcas.heartbeatsLog = l
+	return nil
+}
+
+// compactHeartbeats shifts the heartbeat statuses along with the reports and
+// rewrites the heartbeats log with the statuses that are still in memory. It
+// gets called after the reports rotate. The mutex must be held.
+func (gcas *GCAServer) compactHeartbeats() error {
+	var data []byte
+	for shortID, dp := range gcas.devicePresence {
+		dp.shift()
+		for i := 0; i < 2016; i++ {
+			if status := dp.status(i); status != 0 {
+				data = append(data, encodeHeartbeatRecord(shortID, gcas.equipmentReportsOffset+uint32(i), status)...)
+			}
+		}
+	}
+	return gcas.heartbeatsLog.rewrite(data)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postHeartbeat submits a heartbeat to the report endpoint and returns the
+// status code of the response.
+func (gcas *GCAServer) postHeartbeat(hb glow.Heartbeat) (int, error) {
+	resp, err := http.Post("http://"+gcas.httpDialAddr()+"/api/v1/equipment-report", "application/octet-stream", bytes.NewReader(hb.Serialize()))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// TestHeartbeats checks that heartbeats get recorded over both transports,
+// that they show up in the uptime of a device without counting as
+// production, and that they survive a restart.
+func TestHeartbeats(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+	_, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	er := glow.EquipmentReport{ShortID: 1, Timeslot: 4, PowerOutput: 500}
+	er.Signature = glow.Sign(er.SigningBytes(), priv)
+	if outcome, _ := server.managedHandleEquipmentReport(er.Serialize()); outcome != reportAccepted {
+		t.Fatal("report was not accepted:", outcome)
+	}
+	heartbeat := func(timeslot uint32, status byte) glow.Heartbeat {
+		hb := glow.Heartbeat{ShortID: 1, Timeslot: timeslot, Status: status}
+		hb.Signature = glow.Sign(hb.SigningBytes(), priv)
+		return hb
+	}
+
+	// Heartbeats over UDP don't get an ack, so wait for them to land.
+	conn, err := net.Dial("udp", server.udpDialAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, hb := range []glow.Heartbeat{heartbeat(5, glow.HeartbeatIdle), heartbeat(6, glow.HeartbeatIdle), heartbeat(7, glow.HeartbeatMeterFault)} {
+		if _, err := conn.Write(hb.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := func() bool {
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		dp := server.devicePresence[1]
+		return dp != nil && dp.status(7) == glow.HeartbeatMeterFault && dp.status(5) == glow.HeartbeatIdle
+	}
+	for start := time.Now(); !received(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the heartbeats never arrived")
+		}
+	}
+
+	// Heartbeats over HTTP go through the same checks as reports.
+	_, wrongKey := glow.GenerateKeyPair()
+	forged := glow.Heartbeat{ShortID: 1, Timeslot: 8, Status: glow.HeartbeatIdle}
+	forged.Signature = glow.Sign(forged.SigningBytes(), wrongKey)
+	unknown := glow.Heartbeat{ShortID: 2, Timeslot: 8, Status: glow.HeartbeatIdle}
+	unknown.Signature = glow.Sign(unknown.SigningBytes(), priv)
+	for _, test := range []struct {
+		hb   glow.Heartbeat
+		want int
+	}{
+		{heartbeat(8, glow.HeartbeatIdle), http.StatusNoContent},
+		{heartbeat(8, glow.HeartbeatIdle), http.StatusNoContent},
+		{forged, http.StatusForbidden},
+		{unknown, http.StatusNotFound},
+		{heartbeat(5000, glow.HeartbeatIdle), http.StatusUnprocessableEntity},
+	} {
+		if status, err := server.postHeartbeat(test.hb); err != nil || status != test.want {
+			t.Fatalf("unexpected status for heartbeat %+v: %v %v", test.hb, status, err)
+		}
+	}
+
+	// Ten timeslots of the week have passed, five of which have a report or
+	// a heartbeat. The heartbeats don't add to the totals.
+	check := func() {
+		t.Helper()
+		status, body, err := server.getV2("all-device-stats?timeslot_offset=0&fields=uptime,totals")
+		if err != nil || status != http.StatusOK {
+			t.Fatal("unable to fetch the stats:", status, err)
+		}
+		obj := checkKeys(t, "device stats", checkList(t, "devices", body.(map[string]interface{})["devices"], 1)[0], "uptime", "totals")
+		uptime := checkKeys(t, "uptime", obj["uptime"], "percent", "timeslots", "reported_timeslots", "idle_timeslots", "meter_fault_timeslots")
+		if uptime["percent"] != float64(50) || uptime["timeslots"] != float64(10) || uptime["reported_timeslots"] != float64(1) || uptime["idle_timeslots"] != float64(3) || uptime["meter_fault_timeslots"] != float64(1) {
+			t.Fatal("unexpected uptime:", uptime)
+		}
+		totals := checkKeys(t, "totals", obj["totals"], "energy", "impact", "reports", "banned_timeslots")
+		if totals["energy"] != float64(500) || totals["reports"] != float64(1) {
+			t.Fatal("the heartbeats counted as production:", totals)
+		}
+	}
+	check()
+
+	// The heartbeats survive a restart.
+	server.Close()
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	check()
+}
@@ -0,0 +1,183 @@
+package server
+
+// history_retention.go bounds the memory that the stats history uses. Every
+// week of the history holds the stats of every device, so the history grows
+// by a few megabytes per thousand devices every week. Only the most recent
+// history_retention_weeks weeks, see reload.go, are kept in memory. The older
+// weeks are evicted, and get read back from the history file whenever an
+// endpoint needs them, which is slower but serves the same data.
+//
+// The GCA can also trim the memory right away with a signed POST to
+// /api/v1/admin/trim, which names a timeslot. Every week of reports in memory
+// that ends at or before the timeslot is archived and migrated into the
+// history early, and every week of the history that ends at or before the
+// timeslot is evicted. A trim refuses timeslots where reports are still
+// accepted, so that no report that a device can still send ever ends up
+// outside of the reports in memory.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// historyDeviceMemory is the memory that a device uses in a week of the
+// stats history.
+var historyDeviceMemory = int64(reflect.TypeOf(DeviceStats{}).Size())
+
+// TrimRequest asks the server to trim everything in memory that ends at or
+// before the Timeslot.
+type TrimRequest struct {
+	Timeslot uint32 `json:"timeslot"`
+}
+
+// TrimResult describes what a trim did.
+type TrimResult struct {
+	WeeksMigrated  int   `json:"weeks_migrated"`  // The weeks of reports that were archived and migrated early
+	ReportsMoved   int   `json:"reports_moved"`   // The number of reports in those weeks
+	WeeksEvicted   int   `json:"weeks_evicted"`   // The weeks of the stats history that were evicted from memory
+	BytesReclaimed int64 `json:"bytes_reclaimed"` // The memory that the evicted weeks used
+}
+
+// TrimHandler trims the memory of the server, see history_retention.go.
+func (gcas *GCAServer) TrimHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only POST method is supported.")
+		gcas.requestLogger(r).Warn("Received non-POST request for a trim.")
+		return
+	}
+	var request TrimRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+	res, err := gcas.managedTrim(request.Timeslot)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to trim: ", err))
+		gcas.requestLogger(r).Warn("Failed to trim: ", err)
+		return
+	}
+	gcas.requestLogger(r).WithFields("timeslot", request.Timeslot, "weeks_migrated", res.WeeksMigrated, "reports_moved", res.ReportsMoved, "weeks_evicted", res.WeeksEvicted, "bytes_reclaimed", res.BytesReclaimed).Info("Trimmed the memory.")
+	gcas.writeJSONResponse(w, r, res)
+}
+
+// managedTrim migrates the weeks of reports and evicts the weeks of history
+// that end at or before the provided timeslot.
+func (gcas *GCAServer) managedTrim(timeslot uint32) (TrimResult, error) {
+	// The timeslots that reports are still accepted for stay in memory.
+	if earliest := int64(gcas.currentTimeslot()) - int64(gcas.staticReportPastWindow); int64(timeslot) > earliest {
+		return TrimResult{}, withCode(ErrCodeConflict, fmt.Errorf("timeslot %v is inside of the window in which reports are accepted, which starts at %v", timeslot, earliest))
+	}
+	if !gcas.statsHistoryLoaded() {
+		return TrimResult{}, withCode(ErrCodeLoading, errors.New("the stats history is still loading"))
+	}
+
+	var res TrimResult
+	for {
+		migrated, reports := gcas.managedMigrateReportsIf(func(ero uint32) bool {
+			return ero+2016 <= timeslot
+		})
+		if !migrated {
+			break
+		}
+		res.WeeksMigrated++
+		res.ReportsMoved += reports
+	}
+
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if timeslot >= gcas.equipmentHistoryOffset {
+		weeks := int((timeslot-gcas.equipmentHistoryOffset)/2016) - gcas.equipmentHistoryEvicted
+		res.WeeksEvicted, res.BytesReclaimed = gcas.evictHistoryWeeks(weeks)
+	}
+	return res, nil
+}
+
+// evictHistory evicts the oldest weeks of the stats history from memory until
+// no more than the retention is left. Nothing is evicted while the history is
+// loading, the load applies the retention when it's done.
+func (gcas *GCAServer) evictHistory() {
+	if !gcas.statsHistoryLoaded() {
+		return
+	}
+	weeks, reclaimed := gcas.evictHistoryWeeks(len(gcas.equipmentStatsHistory) - gcas.historyRetentionWeeks)
+	if weeks > 0 {
+		gcas.logger.Infof("evicted %v weeks of the stats history from memory, reclaiming %v bytes", weeks, reclaimed)
+	}
+}
+
+// evictHistoryWeeks evicts up to the provided number of the oldest weeks of
+// the stats history in memory, and returns the number of weeks that were
+// evicted along with the memory that they used. Only weeks that are in the
+// history file get evicted.
+func (gcas *GCAServer) evictHistoryWeeks(weeks int) (int, int64) {
+	if onDisk := len(gcas.equipmentHistoryPositions) - gcas.equipmentHistoryEvicted; weeks > onDisk {
+		weeks = onDisk
+	}
+	if weeks > len(gcas.equipmentStatsHistory) {
+		weeks = len(gcas.equipmentStatsHistory)
+	}
+	if weeks <= 0 {
+		return 0, 0
+	}
+	var reclaimed int64
+	for _, ads := range gcas.equipmentStatsHistory[:weeks] {
+		reclaimed += int64(len(ads.Devices)) * historyDeviceMemory
+	}
+	// The remaining weeks get a new slice, so that the evicted ones can be
+	// collected.
+	gcas.equipmentStatsHistory = append([]AllDeviceStats(nil), gcas.equipmentStatsHistory[weeks:]...)
+	gcas.equipmentHistoryEvicted += weeks
+	return weeks, reclaimed
+}
+
+// managedHistoryWeek returns the stats of a week of the history, counting from
+// equipmentHistoryOffset, and false if the history does not have the week.
+// Weeks that were evicted from memory are read from the history file without
+// holding the mutex, the file is only ever appended to.
+func (gcas *GCAServer) managedHistoryWeek(week int) (AllDeviceStats, bool, error) {
+	gcas.mu.RLock()
+	if week < 0 || week >= gcas.equipmentHistoryEvicted+len(gcas.equipmentStatsHistory) {
+		gcas.mu.RUnlock()
+		return AllDeviceStats{}, false, nil
+	}
+	if week >= gcas.equipmentHistoryEvicted {
+		ads := gcas.equipmentStatsHistory[week-gcas.equipmentHistoryEvicted]
+		gcas.mu.RUnlock()
+		return ads, true, nil
+	}
+	pos := gcas.equipmentHistoryPositions[week]
+	gcas.mu.RUnlock()
+	ads, err := gcas.readHistoryEntry(pos)
+	if err != nil {
+		return AllDeviceStats{}, false, err
+	}
+	return ads, true, nil
+}
+
+// readHistoryEntry reads the week of the history that starts at the provided
+// position of the history file. The mutex does not need to be held.
+func (gcas *GCAServer) readHistoryEntry(pos int64) (AllDeviceStats, error) {
+	f, err := gcas.staticStorage.Open(AllDeviceStatsHistoryFile)
+	if err != nil {
+		return AllDeviceStats{}, fmt.Errorf("unable to open the device stats history: %v", err)
+	}
+	defer f.Close()
+	var header [4]byte
+	if _, err := f.ReadAt(header[:], pos); err != nil {
+		return AllDeviceStats{}, fmt.Errorf("unable to read the device stats history: %v", err)
+	}
+	buf := make([]byte, 4+int(binary.LittleEndian.Uint32(header[:]))*(32+8*2*2016)+4+64)
+	if _, err := f.ReadAt(buf, pos); err != nil {
+		return AllDeviceStats{}, fmt.Errorf("unable to read the device stats history: %v", err)
+	}
+	ads, _, err := DeserializeStreamAllDeviceStats(buf)
+	if err != nil {
+		return AllDeviceStats{}, fmt.Errorf("unable to decode all device stats: %v", err)
+	}
+	return ads, nil
+}
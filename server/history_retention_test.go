@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postTrim sends a trim request, signed with the provided key if it isn't
+// empty, and returns the status and the result.
+func (gcas *GCAServer) postTrim(timeslot uint32, pub glow.PublicKey, priv glow.PrivateKey) (int, TrimResult, error) {
+	body, _ := json.Marshal(TrimRequest{Timeslot: timeslot})
+	req, err := http.NewRequest("POST", "http://"+gcas.httpDialAddr()+"/api/v1/admin/trim", bytes.NewReader(body))
+	if err != nil {
+		return 0, TrimResult{}, err
+	}
+	if pub != (glow.PublicKey{}) {
+		if err := glow.SignRequest(req, pub, priv); err != nil {
+			return 0, TrimResult{}, err
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, TrimResult{}, err
+	}
+	defer resp.Body.Close()
+	var res TrimResult
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(&res)
+	}
+	return resp.StatusCode, res, err
+}
+
+// TestHistoryRetention checks that only the configured number of weeks of the
+// stats history are kept in memory, that the evicted weeks are still served
+// from disk, and that a trim migrates and evicts everything up to its
+// timeslot without reaching into the window of accepted reports.
+func TestHistoryRetention(t *testing.T) {
+	dir, gcaPubKey, gcaPrivKey := generateLargeState(t, 2, 4, 5)
+	defer glow.SetCurrentTimeslot(0)
+	writeConfig := func(retention int) {
+		t.Helper()
+		data := []byte(fmt.Sprintf(`{"history_retention_weeks": %v}`, retention))
+		if err := os.WriteFile(filepath.Join(dir, ServerConfigFile), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(2)
+	server, err := NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.waitForStatsHistory(t)
+	checkMemory := func(weeks, evicted int) {
+		t.Helper()
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		if len(server.equipmentStatsHistory) != weeks || server.equipmentHistoryEvicted != evicted {
+			t.Fatal("unexpected history in memory:", len(server.equipmentStatsHistory), server.equipmentHistoryEvicted)
+		}
+	}
+	checkMemory(2, 2)
+
+	// The evicted weeks are read from disk.
+	_, ads, err := server.getAllDeviceStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices) != 2 || ads.Devices[1].PowerOutputs[7] != 8 || !glow.Verify(server.staticPublicKey, ads.SigningBytes(), ads.Signature) {
+		t.Fatal("the evicted week was not served:", len(ads.Devices))
+	}
+	pubkey := hex.EncodeToString(ads.Devices[1].PublicKey[:])
+	resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/equipment-reports.csv?pubkey=%v&start=2016&end=2026", server.httpDialAddr(), pubkey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 11 || rows[4][2] != "4" || rows[4][3] != "1" {
+		t.Fatal("the evicted week was not exported:", rows)
+	}
+
+	// A lower retention evicts more on reload.
+	writeConfig(1)
+	res, err := server.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Changed) != 1 || res.Changed[0] != "history_retention_weeks: 2 -> 1" {
+		t.Fatal("unexpected reload result:", res)
+	}
+	checkMemory(1, 3)
+
+	// A trim needs a signature, and must stay out of the window of
+	// accepted reports.
+	ero := uint32(4 * 2016)
+	now := ero + 2016 + defaultReportWindow + 10
+	glow.SetCurrentTimeslot(now)
+	if status, _, err := server.postTrim(ero+2016, glow.PublicKey{}, glow.PrivateKey{}); err != nil || status != http.StatusUnauthorized {
+		t.Fatal("unsigned trim was accepted:", status, err)
+	}
+	if status, _, err := server.postTrim(now-defaultReportWindow+1, gcaPubKey, gcaPrivKey); err != nil || status != http.StatusConflict {
+		t.Fatal("trim into the report window was accepted:", status, err)
+	}
+
+	// The trim migrates the week of reports that it covers, and evicts the
+	// whole history from memory. The migration already evicted the oldest
+	// week to keep the retention, which leaves the trim with the migrated
+	// week.
+	status, res2, err := server.postTrim(ero+2016, gcaPubKey, gcaPrivKey)
+	if err != nil || status != http.StatusOK {
+		t.Fatal("trim was refused:", status, err)
+	}
+	if res2.WeeksMigrated != 1 || res2.ReportsMoved != 10 || res2.WeeksEvicted != 1 || res2.BytesReclaimed != 2*historyDeviceMemory {
+		t.Fatalf("unexpected trim result: %+v", res2)
+	}
+	checkMemory(0, 5)
+	server.mu.RLock()
+	newEro := server.equipmentReportsOffset
+	server.mu.RUnlock()
+	if newEro != ero+2016 || int64(newEro) > int64(now)-defaultReportWindow {
+		t.Fatal("the trim moved the reports to the wrong offset:", newEro)
+	}
+	var migrated AllDeviceStats
+	resp, err = http.Get(fmt.Sprintf("http://%v/api/v1/all-device-stats?timeslot_offset=%v", server.httpDialAddr(), ero))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&migrated)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrated.Devices) != 2 || migrated.Devices[0].PowerOutputs[4] != 5 || migrated.Devices[0].PowerOutputs[5] != 0 {
+		t.Fatal("the migrated week was not served from disk:", migrated.Devices)
+	}
+
+	// Nothing is left to trim.
+	status, res2, err = server.postTrim(ero+2016, gcaPubKey, gcaPrivKey)
+	if err != nil || status != http.StatusOK || res2 != (TrimResult{}) {
+		t.Fatalf("second trim did something: %v %+v %v", status, res2, err)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+// impact_rates.go persists the impact rates of the devices, so that they
+// survive a restart.
+//
+// The impact rates of the timeslots in memory are kept in a log, where every
+// record holds the impact rate and the flags of one device at one timeslot,
+// followed by a checksum. Whenever an impact rate or its flags change, a
+// record gets appended to the log, which is held open for the lifetime of the
+// server. At startup the log is replayed in order, so the last record for a
+// timeslot wins. A torn record at the end of the log fails its checksum and
+// gets dropped.
+//
+// The impact rates of older timeslots are part of the device stats history.
+// Their flags are not, so every time that the reports rotate, the log is
+// rewritten with the impact rates that are still in memory plus the flags of
+// every older timeslot.
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+)
+
+// The flags of an impact rate. An impact rate without flags was fetched from
+// WattTime in time.
+const (
+	// impactRateStale marks an impact rate that was filled with the last
+	// known value while WattTime was unavailable.
+	impactRateStale uint8 = 1
+
+	// impactRateBackfilled marks an impact rate that was filled with stale
+	// data and later replaced with the real value.
+	impactRateBackfilled uint8 = 2
+)
+
+// impactRateRecordSize is the size of a record in the impact rates log, which
+// is the ShortID, the timeslot, the impact rate, the flags, and a 4 byte
+// checksum.
+const impactRateRecordSize = 4 + 4 + 8 + 1 + 4
+
+// encodeImpactRateRecord returns the log record for the impact rate of a
+// device at a timeslot.
+func encodeImpactRateRecord(shortID, timeslot uint32, rate float64, flags uint8) []byte {
+	record := make([]byte, impactRateRecordSize)
+	binary.LittleEndian.PutUint32(record[0:], shortID)
+	binary.LittleEndian.PutUint32(record[4:], timeslot)
+	binary.LittleEndian.PutUint64(record[8:], math.Float64bits(rate))
+	record[16] = flags
+	binary.LittleEndian.PutUint32(record[17:], crc32.ChecksumIEEE(record[:17]))
+	return record
+}
+
+// setImpactFlags sets the flags of the impact rate of a device at a timeslot.
+// The mutex must be held.
+func (gcas *GCAServer) setImpactFlags(shortID, timeslot uint32, flags uint8) {
+	if flags == 0 {
+		delete(gcas.impactFlags[shortID], timeslot)
+		if len(gcas.impactFlags[shortID]) == 0 {
+			delete(gcas.impactFlags, shortID)
+		}
+		return
+	}
+	if gcas.impactFlags[shortID] == nil {
+		gcas.impactFlags[shortID] = make(map[uint32]uint8)
+	}
+	gcas.impactFlags[shortID][timeslot] = flags
+}
+
+// loadImpactRates replays the impact rates log, and opens it so that new
+// records can be appended to it. Records for devices that are no longer known
+// are skipped.
+func (gcas *GCAServer) loadImpactRates() error {
+	l, err := gcas.loadAppendLog(ImpactRatesFile, "impact rates log", impactRateRecordSize, func(record []byte) {
+		shortID := binary.LittleEndian.Uint32(record[0:])
+		timeslot := binary.LittleEndian.Uint32(record[4:])
+		rates, exists := gcas.equipmentImpactRate[shortID]
+		if bd, banned := gcas.bannedDevices[shortID]; !exists && banned && gcas.reportCounts(shortID, timeslot) {
+			if timeslot >= gcas.equipmentReportsOffset && timeslot < gcas.equipmentReportsOffset+4032 {
+				bd.ImpactRates[timeslot-gcas.equipmentReportsOffset] = math.Float64frombits(binary.LittleEndian.Uint64(record[8:]))
+			}
+			return
+		}
+		if !exists || timeslot >= gcas.equipmentReportsOffset+4032 {
+			return
+		}
+		gcas.setImpactFlags(shortID, timeslot, record[16])
+		if timeslot >= gcas.equipmentReportsOffset {
+			rates[timeslot-gcas.equipmentReportsOffset] = math.Float64frombits(binary.LittleEndian.Uint64(record[8:]))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	gcas.impactRatesLog = l
+	return nil
+}
+
+// saveImpactRates appends a batch of records to the impact rates log. A
+// failure is logged rather than returned, the impact rates stay in memory
+// either way. The mutex must be held.
+func (gcas *GCAServer) saveImpactRates(records []byte) {
+	if len(records) == 0 {
+		return
+	}
+	if _, err := gcas.impactRatesLog.Write(records); err != nil {
+		gcas.logger.Errorf("unable to write to the impact rates log: %v", err)
+	}
+}
+
+// compactImpactRates rewrites the impact rates log with the impact rates that
+// are in memory and the flags of the older impact rates. It gets called after
+// the reports rotate. The mutex must be held.
+func (gcas *GCAServer) compactImpactRates() error {
+	var data []byte
+	for shortID, rates := range gcas.equipmentImpactRate {
+		for i, rate := range rates {
+			timeslot := gcas.equipmentReportsOffset + uint32(i)
+			flags := gcas.impactFlags[shortID][timeslot]
+			if rate != 0 || flags != 0 {
+				data = append(data, encodeImpactRateRecord(shortID, timeslot, rate, flags)...)
+			}
+		}
+	}
+	for shortID, slots := range gcas.impactFlags {
+		for timeslot, flags := range slots {
+			if timeslot < gcas.equipmentReportsOffset {
+				data = append(data, encodeImpactRateRecord(shortID, timeslot, 0, flags)...)
+			}
+		}
+	}
+
+	return gcas.impactRatesLog.rewrite(data)
+}
@@ -0,0 +1,490 @@
+package server
+
+// location_privacy.go keeps the coordinates of private devices out of the
+// public API. Some owners don't want the location of their installation to be
+// visible to anyone, while the GCA still needs the real coordinates for the
+// region lookups and for audits.
+//
+// A device is private if the GCA said so in a device note, see
+// device_notes.go, with the field location_privacy set to "private". The
+// newest note that has the field decides, so notes without it don't change
+// the privacy of the device. "public" opts a device out of the server
+// default, which makes every device private if PrivateLocations is set, and
+// "default" goes back to the server default.
+//
+// The coordinates are redacted in one place: a middleware that rewrites every
+// JSON response of a request that isn't signed by the GCA, or by an operator
+// with the read-audit scope, see api_auth.go. Any object in the response that
+// holds a latitude and a longitude of a private device gets them truncated to
+// one decimal, or removed with LocationRedactionOmit, no matter which
+// endpoint built it, so a new endpoint can't leak them by accident. The
+// matching is on the coordinates themselves, which also redacts a public
+// device that sits at exactly the same spot. Signed responses are redacted
+// before they get signed, see api_signed_response.go.
+//
+// The redacted authorizations no longer verify against their signature. The
+// exports keep the full coordinates for that reason: the device export is
+// binary and the equipment export is released by the GCA, and the audit log
+// needs a signed request anyway. The binary responses are left alone, none of
+// them carry coordinates.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// locationPrivacyField is the field of a device note that sets the location
+// privacy of the device.
+const locationPrivacyField = "location_privacy"
+
+// The values of the location_privacy field of a device note.
+const (
+	LocationPrivacyPrivate = "private" // The coordinates get redacted
+	LocationPrivacyPublic  = "public"  // The coordinates are public, even if the server default is private
+	LocationPrivacyDefault = "default" // The server default applies
+)
+
+// LocationRedaction is how the coordinates of a private device get redacted.
+type LocationRedaction int
+
+// Constants for the different redactions.
+const (
+	LocationRedactionTruncate LocationRedaction = iota // The coordinates get truncated to one decimal
+	LocationRedactionOmit                              // The coordinates get removed
+)
+
+// String returns the name of the redaction.
+func (lr LocationRedaction) String() string {
+	if lr == LocationRedactionOmit {
+		return "omit"
+	}
+	return "truncate"
+}
+
+// ParseLocationRedaction converts the name of a redaction, as used on the
+// command line, into a LocationRedaction.
+func ParseLocationRedaction(name string) (LocationRedaction, error) {
+	switch name {
+	case "truncate":
+		return LocationRedactionTruncate, nil
+	case "omit":
+		return LocationRedactionOmit, nil
+	}
+	return LocationRedactionTruncate, fmt.Errorf("unknown location redaction %q, must be 'truncate' or 'omit'", name)
+}
+
+// RedactCoordinate truncates a coordinate to the one decimal that public
+// requests get to see of a private device.
+func RedactCoordinate(c float64) float64 {
+	return math.Trunc(c*10) / 10
+}
+
+// fullLocationPaths are the endpoints whose responses are never redacted.
+var fullLocationPaths = map[string]bool{
+	"/api/v1/audit-log":        true,
+	"/api/v1/device-export":    true,
+	"/api/v1/export-equipment": true,
+}
+
+// validateLocationPrivacy checks the location_privacy field of a device note,
+// if it has one.
+func validateLocationPrivacy(fields map[string]string) error {
+	v, exists := fields[locationPrivacyField]
+	if !exists || v == LocationPrivacyPrivate || v == LocationPrivacyPublic || v == LocationPrivacyDefault {
+		return nil
+	}
+	return fmt.Errorf("the %v field must be %q, %q or %q", locationPrivacyField, LocationPrivacyPrivate, LocationPrivacyPublic, LocationPrivacyDefault)
+}
+
+// updateLocationPrivacy sets the location privacy of a device to the newest
+// of its notes that has the location_privacy field. The mutex must be held.
+func (gcas *GCAServer) updateLocationPrivacy(pk glow.PublicKey) {
+	notes := gcas.deviceNotes[pk]
+	for i := len(notes) - 1; i >= 0; i-- {
+		if v, exists := notes[i].Fields[locationPrivacyField]; exists && v != LocationPrivacyDefault {
+			gcas.locationPrivacy[pk] = v
+			return
+		} else if exists {
+			break
+		}
+	}
+	delete(gcas.locationPrivacy, pk)
+}
+
+// locationPrivate returns whether the coordinates of a device get redacted.
+// The mutex must be held.
+func (gcas *GCAServer) locationPrivate(pk glow.PublicKey) bool {
+	if v, exists := gcas.locationPrivacy[pk]; exists {
+		return v == LocationPrivacyPrivate
+	}
+	return gcas.staticPrivateLocations
+}
+
+// locationRedactor redacts the coordinates of the private devices from the
+// responses of a request.
+type locationRedactor struct {
+	coords map[[2]float64]struct{}
+	mode   LocationRedaction
+}
+
+// locationRedactorKey is the context key of the redactor of a request.
+type locationRedactorKey struct{}
+
+// managedLocationRedactor returns the redactor of a request, or nil if the
+// request gets to see the full coordinates or no device is private.
+func (gcas *GCAServer) managedLocationRedactor(r *http.Request) *locationRedactor {
+	if ai, ok := authenticatedIdentity(r); ok && ai.scopes.Has(ScopeReadAudit) {
+		return nil
+	}
+	if fullLocationPaths[r.URL.Path] {
+		return nil
+	}
+
+	gcas.mu.RLock()
+	defer gcas.mu.RUnlock()
+	if !gcas.staticPrivateLocations && len(gcas.locationPrivacy) == 0 {
+		return nil
+	}
+	lr := &locationRedactor{
+		coords: make(map[[2]float64]struct{}),
+		mode:   gcas.staticLocationRedaction,
+	}
+	add := func(ea glow.EquipmentAuthorization) {
+		if gcas.locationPrivate(ea.PublicKey) {
+			lr.coords[[2]float64{ea.Latitude, ea.Longitude}] = struct{}{}
+		}
+	}
+	for _, ea := range gcas.equipment {
+		add(ea)
+	}
+	for _, auths := range gcas.equipmentBanAuths {
+		for _, ea := range auths {
+			add(ea)
+		}
+	}
+	if len(lr.coords) == 0 {
+		return nil
+	}
+	return lr
+}
+
+// redactRequestLocations redacts a JSON body with the redactor of the
+// request, for the responses that get signed before they are written.
+func redactRequestLocations(r *http.Request, body []byte) []byte {
+	lr, ok := r.Context().Value(locationRedactorKey{}).(*locationRedactor)
+	if !ok {
+		return body
+	}
+	return lr.redact(body)
+}
+
+// redact returns the body with the coordinates of the private devices
+// redacted. A body that isn't JSON, or that has nothing to redact, is
+// returned as it is.
+func (lr *locationRedactor) redact(body []byte) []byte {
+	if !bytes.Contains(body, []byte("atitude")) {
+		return body
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var values []interface{}
+	for {
+		v, err := decodeOrderedJSON(dec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return body
+		}
+		values = append(values, v)
+	}
+	changed := false
+	for _, v := range values {
+		changed = lr.redactValue(v) || changed
+	}
+	if !changed {
+		return body
+	}
+	var buf bytes.Buffer
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		encodeOrderedJSON(&buf, v)
+	}
+	if body[len(body)-1] == '\n' {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// redactValue redacts the coordinates in a decoded JSON value, and returns
+// whether anything was redacted.
+func (lr *locationRedactor) redactValue(v interface{}) bool {
+	changed := false
+	switch v := v.(type) {
+	case *jsonObject:
+		lat, lon := -1, -1
+		for i, m := range v.members {
+			if strings.EqualFold(m.key, "latitude") {
+				lat = i
+			} else if strings.EqualFold(m.key, "longitude") {
+				lon = i
+			}
+		}
+		if lat >= 0 && lon >= 0 && lr.private(v.members[lat].value, v.members[lon].value) {
+			changed = true
+			if lr.mode == LocationRedactionOmit {
+				v.remove(lat, lon)
+			} else {
+				v.members[lat].value = redactedNumber(v.members[lat].value)
+				v.members[lon].value = redactedNumber(v.members[lon].value)
+			}
+		}
+		for _, m := range v.members {
+			changed = lr.redactValue(m.value) || changed
+		}
+	case []interface{}:
+		for _, e := range v {
+			changed = lr.redactValue(e) || changed
+		}
+	}
+	return changed
+}
+
+// private returns whether a pair of JSON values are the coordinates of a
+// private device.
+func (lr *locationRedactor) private(lat, lon interface{}) bool {
+	latNum, ok1 := lat.(json.Number)
+	lonNum, ok2 := lon.(json.Number)
+	if !ok1 || !ok2 {
+		return false
+	}
+	latF, err1 := latNum.Float64()
+	lonF, err2 := lonNum.Float64()
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	_, private := lr.coords[[2]float64{latF, lonF}]
+	return private
+}
+
+// redactedNumber truncates a coordinate that is known to be a number.
+func redactedNumber(v interface{}) json.Number {
+	f, _ := v.(json.Number).Float64()
+	return json.Number(strconv.FormatFloat(RedactCoordinate(f), 'f', -1, 64))
+}
+
+// jsonObject is a decoded JSON object that keeps its keys in order, so that a
+// redacted response looks the same as the original besides the coordinates.
+type jsonObject struct {
+	members []jsonMember
+}
+
+// jsonMember is a key of a jsonObject and its value.
+type jsonMember struct {
+	key   string
+	value interface{}
+}
+
+// remove removes the members at the provided indexes.
+func (o *jsonObject) remove(indexes ...int) {
+	drop := make(map[int]bool, len(indexes))
+	for _, i := range indexes {
+		drop[i] = true
+	}
+	members := o.members[:0]
+	for i, m := range o.members {
+		if !drop[i] {
+			members = append(members, m)
+		}
+	}
+	o.members = members
+}
+
+// decodeOrderedJSON decodes the next JSON value from the decoder into
+// *jsonObject, []interface{}, json.Number, string, bool or nil.
+func decodeOrderedJSON(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		o := &jsonObject{}
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := keyTok.(string)
+			if !ok {
+				return nil, errors.New("object key is not a string")
+			}
+			value, err := decodeOrderedJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			o.members = append(o.members, jsonMember{key: key, value: value})
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return o, nil
+	case json.Delim('['):
+		a := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrderedJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, value)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return a, nil
+	case json.Delim('}'), json.Delim(']'):
+		return nil, errors.New("unexpected end of a value")
+	}
+	return tok, nil
+}
+
+// encodeOrderedJSON is the reverse of decodeOrderedJSON.
+func encodeOrderedJSON(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case *jsonObject:
+		buf.WriteByte('{')
+		for i, m := range v.members {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(m.key)
+			buf.Write(key)
+			buf.WriteByte(':')
+			encodeOrderedJSON(buf, m.value)
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			encodeOrderedJSON(buf, e)
+		}
+		buf.WriteByte(']')
+	case json.Number:
+		buf.WriteString(string(v))
+	default:
+		b, _ := json.Marshal(v)
+		buf.Write(b)
+	}
+}
+
+// locationResponseWriter holds back a JSON response until the handler is done,
+// so that its coordinates can be redacted. A response with any other content
+// type is passed on as it gets written, which keeps the binary and the
+// streaming responses as they are.
+type locationResponseWriter struct {
+	http.ResponseWriter
+	lr          *locationRedactor
+	buf         bytes.Buffer
+	status      int
+	decided     bool
+	passThrough bool
+}
+
+// decide looks at the content type once the handler starts its response. The
+// handlers that encode JSON without setting a content type get buffered too.
+func (lw *locationResponseWriter) decide() {
+	if lw.decided {
+		return
+	}
+	lw.decided = true
+	ct := lw.Header().Get("Content-Type")
+	lw.passThrough = ct != "" && !strings.Contains(ct, "json")
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (lw *locationResponseWriter) WriteHeader(status int) {
+	lw.decide()
+	if lw.passThrough {
+		lw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if lw.status == 0 {
+		lw.status = status
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (lw *locationResponseWriter) Write(b []byte) (int, error) {
+	lw.decide()
+	if lw.passThrough {
+		return lw.ResponseWriter.Write(b)
+	}
+	return lw.buf.Write(b)
+}
+
+// Flush passes the flush on to a response that isn't held back.
+func (lw *locationResponseWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok && lw.passThrough {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, for the WebSocket endpoints.
+func (lw *locationResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := lw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		lw.decided = true
+		lw.passThrough = true
+	}
+	return conn, brw, err
+}
+
+// finish writes out the redacted response once the handler has returned.
+func (lw *locationResponseWriter) finish() {
+	if !lw.decided || lw.passThrough {
+		return
+	}
+	body := lw.lr.redact(lw.buf.Bytes())
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	lw.Header().Del("Content-Length")
+	lw.ResponseWriter.WriteHeader(lw.status)
+	lw.ResponseWriter.Write(body)
+}
+
+// redactLocations wraps the API so that the coordinates of the private
+// devices are redacted from the responses of the public requests. It has to
+// sit inside of authenticateRequests, which identifies the signed requests.
+func (gcas *GCAServer) redactLocations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lr := gcas.managedLocationRedactor(r)
+		if lr == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lw := &locationResponseWriter{ResponseWriter: w, lr: lr}
+		next.ServeHTTP(lw, r.WithContext(context.WithValue(r.Context(), locationRedactorKey{}, lr)))
+		lw.finish()
+	})
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// authorizeLocatedDevice authorizes a device at the provided coordinates.
+func (gcas *GCAServer) authorizeLocatedDevice(t *testing.T, shortID uint32, lat, lon float64, gcaPrivKey glow.PrivateKey) (glow.EquipmentAuthorization, glow.PrivateKey) {
+	t.Helper()
+	pub, priv := glow.GenerateKeyPair()
+	ea := SignEquipmentAuthorization(glow.EquipmentAuthorization{
+		ShortID:    shortID,
+		PublicKey:  pub,
+		Latitude:   lat,
+		Longitude:  lon,
+		Capacity:   15400300,
+		Debt:       11223344,
+		Expiration: 100e6 + glow.CurrentTimeslot(),
+	}, gcaPrivKey)
+	if _, err := gcas.managedAuthorizeEquipment(ea); err != nil {
+		t.Fatal(err)
+	}
+	return ea, priv
+}
+
+// getLocationBody fetches a route, signed by the provided key if it isn't
+// nil, and returns whatever arrived of the body within a second, as some
+// routes stream.
+func (gcas *GCAServer) getLocationBody(t *testing.T, uri string, pub glow.PublicKey, priv *glow.PrivateKey) (int, string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+gcas.httpDialAddr()+uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priv != nil {
+		req.Header.Set("Authorization", glow.NewRequestAuth(http.MethodGet, uri, nil, time.Now().Unix(), pub, *priv).Header())
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v: %v", uri, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// TestLocationPrivacy goes through every GET route of the API and checks that
+// none of them shows the full coordinates of a private device to a public
+// request, while the GCA still gets to see them.
+func TestLocationPrivacy(t *testing.T) {
+	server, _, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(20)
+	defer glow.SetCurrentTimeslot(0)
+	private, privateKey := server.authorizeLocatedDevice(t, 1, 37.774929, -122.419416, gcaPrivKey)
+	public, publicKey := server.authorizeLocatedDevice(t, 2, 51.507351, -0.127758, gcaPrivKey)
+	for ts := uint32(1); ts <= 3; ts++ {
+		server.managedHandleEquipmentReport(generateTestReport(1, ts, privateKey))
+		server.managedHandleEquipmentReport(generateTestReport(2, ts, publicKey))
+	}
+
+	// The GCA makes the first device private with a note, and only the
+	// known values are accepted.
+	post := func(dn DeviceNote, want int) {
+		t.Helper()
+		dn.Signature = glow.Sign(dn.SigningBytes(), gcaPrivKey)
+		if status, err := server.postDeviceNote(dn); err != nil || status != want {
+			t.Fatalf("unexpected status for note %+v: %v %v", dn.Fields, status, err)
+		}
+	}
+	post(DeviceNote{PublicKey: private.PublicKey, Fields: map[string]string{locationPrivacyField: "secret"}, Timestamp: 90}, http.StatusBadRequest)
+	post(DeviceNote{PublicKey: private.PublicKey, Fields: map[string]string{locationPrivacyField: LocationPrivacyPrivate}, Timestamp: 100}, http.StatusOK)
+	// A newer note without the field leaves the device private.
+	post(DeviceNote{PublicKey: private.PublicKey, Note: "site visit", Timestamp: 110}, http.StatusOK)
+
+	// No GET route shows the full coordinates to a public request, with or
+	// without a signed response.
+	pubkey := hex.EncodeToString(private.PublicKey[:])
+	query := "?pubkey=" + pubkey + "&short_id=1&timeslot_offset=0&fields=short_id,pubkey,location"
+	for _, route := range server.routes {
+		// The profiles of pprof take 30 seconds and show no state.
+		if strings.HasPrefix(route.Path, "/debug/pprof/") {
+			continue
+		}
+		path := strings.ReplaceAll(route.Path, "{id}", "1")
+		for _, uri := range []string{path + query, path + query + "&signed=true"} {
+			_, body := server.getLocationBody(t, uri, glow.PublicKey{}, nil)
+			if strings.Contains(body, "37.774929") || strings.Contains(body, "-122.419416") {
+				t.Errorf("%v shows the full coordinates of a private device: %.300s", uri, body)
+			}
+		}
+	}
+
+	// The private device is truncated and the public one is left alone.
+	_, body := server.getLocationBody(t, "/api/v2/equipment", glow.PublicKey{}, nil)
+	var equipment struct{ Equipment []V2Equipment }
+	if err := json.Unmarshal([]byte(body), &equipment); err != nil || len(equipment.Equipment) != 2 {
+		t.Fatal(err, body)
+	}
+	for _, e := range equipment.Equipment {
+		if e.ShortID == 1 && (e.Latitude != 37.7 || e.Longitude != -122.4) {
+			t.Fatal("the private device wasn't truncated:", e.Latitude, e.Longitude)
+		}
+		if e.ShortID == 2 && (e.Latitude != public.Latitude || e.Longitude != public.Longitude) {
+			t.Fatal("the public device was redacted:", e.Latitude, e.Longitude)
+		}
+	}
+	// The redacted response still has its keys in order.
+	if strings.Index(body, `"short_id"`) > strings.Index(body, `"latitude"`) {
+		t.Fatal("the keys of the redacted response were reordered:", body)
+	}
+
+	// A request signed by the GCA gets the full coordinates, on plain and
+	// on signed responses.
+	for _, uri := range []string{"/api/v1/equipment", "/api/v1/short-id/1?signed=true"} {
+		status, body := server.getLocationBody(t, uri, gcaPubKey, &gcaPrivKey)
+		if status != http.StatusOK || !strings.Contains(body, "37.774929") {
+			t.Fatalf("%v hides the coordinates from the GCA: %v %.300s", uri, status, body)
+		}
+	}
+
+	// A signed response of a public request verifies with the redacted
+	// coordinates.
+	_, body = server.getLocationBody(t, "/api/v1/short-id/1?signed=true", glow.PublicKey{}, nil)
+	signedBody, err := glow.VerifySignedResponse([]byte(body), server.staticPublicKey)
+	if err != nil || !strings.Contains(string(signedBody), "37.7,") {
+		t.Fatal("unexpected signed response:", err, string(signedBody))
+	}
+
+	// "default" returns the device to the server default, which is public.
+	post(DeviceNote{PublicKey: private.PublicKey, Fields: map[string]string{locationPrivacyField: LocationPrivacyDefault}, Timestamp: 120}, http.StatusOK)
+	if _, body := server.getLocationBody(t, "/api/v1/equipment", glow.PublicKey{}, nil); !strings.Contains(body, "37.774929") {
+		t.Fatal("the device is still private:", body)
+	}
+}
+
+// TestLocationPrivacyDefault checks the server default with the omitted
+// coordinates, and that a device can opt out of it.
+func TestLocationPrivacyDefault(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{PrivateLocations: true, LocationRedaction: LocationRedactionOmit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	private, _ := server.authorizeLocatedDevice(t, 1, 37.774929, -122.419416, gcaPrivKey)
+	public, _ := server.authorizeLocatedDevice(t, 2, 51.507351, -0.127758, gcaPrivKey)
+	dn := DeviceNote{PublicKey: public.PublicKey, Fields: map[string]string{locationPrivacyField: LocationPrivacyPublic}, Timestamp: 100}
+	dn.Signature = glow.Sign(dn.SigningBytes(), gcaPrivKey)
+	if status, err := server.postDeviceNote(dn); err != nil || status != http.StatusOK {
+		t.Fatal("unable to post the note:", status, err)
+	}
+
+	_, body := server.getLocationBody(t, "/api/v2/equipment", glow.PublicKey{}, nil)
+	var equipment struct{ Equipment []map[string]interface{} }
+	if err := json.Unmarshal([]byte(body), &equipment); err != nil || len(equipment.Equipment) != 2 {
+		t.Fatal(err, body)
+	}
+	for _, e := range equipment.Equipment {
+		_, hasLat := e["latitude"]
+		_, hasLon := e["longitude"]
+		switch e["short_id"] {
+		case float64(private.ShortID):
+			if hasLat || hasLon {
+				t.Fatal("the coordinates of the private device weren't omitted:", e)
+			}
+		case float64(public.ShortID):
+			if e["latitude"] != public.Latitude || e["longitude"] != public.Longitude {
+				t.Fatal("the device that opted out was redacted:", e)
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+// log_rotation.go keeps the server log from filling up the disk. Once the
+// active log file grows past its size limit, it gets renamed with a timestamp
+// suffix and a fresh file is started in its place. Only the most recent
+// rotated files are kept, older ones get deleted.
+//
+// All of the loggers that are derived from the same NewLogger call share a
+// single logFile, and the mutex of the logFile serializes the writes with the
+// rotation so that no line gets lost or split across two files.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLogMaxSize is the size in bytes after which the server log gets
+	// rotated.
+	DefaultLogMaxSize = 100e6
+
+	// DefaultLogMaxFiles is the number of rotated log files that are kept
+	// around.
+	DefaultLogMaxFiles = 10
+
+	// logRotationTimeFormat is the format of the timestamp suffix of a
+	// rotated log file. It sorts in chronological order.
+	logRotationTimeFormat = "20060102-150405.000000000"
+)
+
+// logFile is a log file that rotates itself once it grows too large.
+type logFile struct {
+	path     string
+	file     *os.File
+	size     int64
+	maxSize  int64 // Zero disables rotation
+	maxFiles int
+	stdout   bool // The file is stdout, which never rotates or gets closed
+
+	mu sync.Mutex
+}
+
+// openLogFile opens the log file at the provided path for appending.
+func openLogFile(path string) (*logFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &logFile{path: path, file: file, size: stat.Size()}, nil
+}
+
+// stdoutLogFile returns a logFile that writes to stdout.
+func stdoutLogFile() *logFile {
+	return &logFile{file: os.Stdout, stdout: true}
+}
+
+// setLimits sets the size after which the file gets rotated and the number of
+// rotated files that are kept.
+func (lf *logFile) setLimits(maxSize int64, maxFiles int) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	lf.maxSize = maxSize
+	lf.maxFiles = maxFiles
+}
+
+// WriteString appends a line to the log file, rotating the file first if the
+// line would push it past its size limit.
+func (lf *logFile) WriteString(line string) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.file == nil {
+		return
+	}
+	if !lf.stdout && lf.maxSize > 0 && lf.size > 0 && lf.size+int64(len(line)) > lf.maxSize {
+		if err := lf.rotate(); err != nil {
+			// Keep logging to whichever file is open, a failed
+			// rotation shouldn't cost us the log line.
+			fmt.Fprintf(os.Stderr, "unable to rotate log file: %v\n", err)
+		}
+	}
+	if lf.file == nil {
+		return
+	}
+	n, _ := lf.file.WriteString(line)
+	lf.size += int64(n)
+}
+
+// rotate moves the active file aside, opens a new one, and deletes the rotated
+// files that exceed the limit. The caller must hold the mutex.
+func (lf *logFile) rotate() error {
+	rotatedPath := lf.path + "." + time.Now().UTC().Format(logRotationTimeFormat)
+	if err := os.Rename(lf.path, rotatedPath); err != nil {
+		return fmt.Errorf("unable to rename log file: %v", err)
+	}
+	file, err := os.OpenFile(lf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		// The old handle still points at the rotated file, so the
+		// lines end up there until the next attempt.
+		return fmt.Errorf("unable to open new log file: %v", err)
+	}
+	lf.file.Close()
+	lf.file = file
+	lf.size = 0
+	return lf.removeOldFiles()
+}
+
+// removeOldFiles deletes the oldest rotated files until at most maxFiles are
+// left. The caller must hold the mutex.
+func (lf *logFile) removeOldFiles() error {
+	rotated, err := rotatedLogFiles(lf.path)
+	if err != nil {
+		return err
+	}
+	for len(rotated) > lf.maxFiles {
+		if err := os.Remove(rotated[0]); err != nil {
+			return fmt.Errorf("unable to remove old log file: %v", err)
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// rotatedLogFiles returns the rotated files of the log at the provided path,
+// oldest first.
+func rotatedLogFiles(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list rotated log files: %v", err)
+	}
+	var rotated []string
+	for _, m := range matches {
+		suffix := m[len(path)+1:]
+		if _, err := time.Parse(logRotationTimeFormat, suffix); err == nil {
+			rotated = append(rotated, m)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// Close closes the log file, all later writes are dropped.
+func (lf *logFile) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.file == nil {
+		return nil
+	}
+	if lf.stdout {
+		lf.file = nil
+		return nil
+	}
+	err := lf.file.Close()
+	lf.file = nil
+	return err
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestLogRotation writes past the size limit from several goroutines and
+// checks that the files get rotated without losing or splitting lines, and
+// that only the most recent rotated files are kept.
+func TestLogRotation(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	path := filepath.Join(dir, "test.log")
+	logger, err := NewLogger(DEBUG, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	logger.SetRotation(1000, 1000)
+
+	// Write enough lines to rotate many times, but never enough to hit
+	// the file limit, so that every line can be accounted for.
+	const writers, linesPerWriter = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			child := logger.WithFields("writer", w)
+			for i := 0; i < linesPerWriter; i++ {
+				child.Infof("line %v", i)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	rotated, err := rotatedLogFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) < 10 {
+		t.Fatalf("expected the log to be rotated many times, got %v rotated files", len(rotated))
+	}
+	seen := make(map[string]bool)
+	for _, p := range append(rotated, path) {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 1000 {
+			t.Errorf("%v exceeds the size limit: %v bytes", p, len(data))
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			i := strings.Index(line, "] line ")
+			if i < 0 {
+				t.Fatalf("malformed log line in %v: %q", p, line)
+			}
+			seen[line[i:]] = true
+		}
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < linesPerWriter; i++ {
+			if !seen[fmt.Sprintf("] line %v writer=%v", i, w)] {
+				t.Fatalf("line %v of writer %v was lost", i, w)
+			}
+		}
+	}
+
+	// Lowering the file limit deletes the oldest files on the next
+	// rotation.
+	logger.SetRotation(1000, 3)
+	for i := 0; i < 50; i++ {
+		logger.Infof("more %v", i)
+	}
+	remaining, err := rotatedLogFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 3 {
+		t.Fatalf("expected 3 rotated files, got %v", len(remaining))
+	}
+	if remaining[0] < rotated[len(rotated)-1] {
+		t.Error("older rotated files were kept:", remaining)
+	}
+}
+
+// TestServerLogRotation checks that the limits in the server options are
+// applied to the server log.
+func TestServerLogRotation(t *testing.T) {
+	opts := DefaultServerOptions()
+	opts.HttpPort, opts.TcpPort, opts.UdpPort = 0, 0, 0
+	opts.LogMaxSize = 200
+	opts.LogMaxFiles = 2
+	server, dir, _, _, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	for i := 0; i < 20; i++ {
+		server.logger.Infof("filler line %v to push the log past its limit", i)
+	}
+	path := filepath.Join(dir, "server.log")
+	rotated, err := rotatedLogFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 rotated files, got %v", len(rotated))
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() > 200 {
+		t.Error("server log exceeds its limit:", stat.Size())
+	}
+}
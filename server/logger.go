@@ -1,11 +1,22 @@
 package server
 
 // This file implements a logging utility for the GCA server.
+//
+// The logger writes either plain text lines, which is the default, or one JSON
+// object per line for operators that feed the logs into an aggregator. Both
+// formats can carry key/value fields, which get attached to a logger with
+// WithFields and are added to every line that logger writes.
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
 )
 
 // LogLevel represents the level of logging.
@@ -20,10 +31,80 @@ const (
 	FATAL                 // Fatal error level (4)
 )
 
+// ParseLogLevel converts the name of a log level, as used in the config file,
+// into a LogLevel.
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DEBUG, nil
+	case "info":
+		return INFO, nil
+	case "warn":
+		return WARN, nil
+	case "error":
+		return ERROR, nil
+	}
+	return INFO, fmt.Errorf("unknown log level %q, must be 'debug', 'info', 'warn', or 'error'", name)
+}
+
+// String returns the name of the log level.
+func (ll LogLevel) String() string {
+	switch ll {
+	case DEBUG:
+		return "debug"
+	case INFO:
+		return "info"
+	case WARN:
+		return "warn"
+	case ERROR:
+		return "error"
+	case FATAL:
+		return "fatal"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(ll))
+}
+
+// LogFormat determines how the lines of a logger get rendered.
+type LogFormat int
+
+// Constants for the different log formats.
+const (
+	LogFormatText LogFormat = iota // "[time LEVEL] message key=value"
+	LogFormatJSON                  // One JSON object per line
+)
+
+// String returns the name of the log format.
+func (lf LogFormat) String() string {
+	if lf == LogFormatJSON {
+		return "json"
+	}
+	return "text"
+}
+
+// ParseLogFormat converts the name of a log format, as used on the command
+// line, into a LogFormat.
+func ParseLogFormat(name string) (LogFormat, error) {
+	switch name {
+	case "text":
+		return LogFormatText, nil
+	case "json":
+		return LogFormatJSON, nil
+	}
+	return LogFormatText, fmt.Errorf("unknown log format %q, must be 'text' or 'json'", name)
+}
+
+// logField is a key/value pair that gets added to every line of a logger.
+type logField struct {
+	key   string
+	value interface{}
+}
+
 // Logger holds the configuration for a logger.
 type Logger struct {
-	level LogLevel // Minimum log level to output
-	file  *os.File // File to write logs to
+	level  *atomic.Int32 // Minimum log level to output, shared with the child loggers
+	file   *logFile      // File to write logs to
+	format LogFormat     // How lines get rendered
+	fields []logField    // Added to every line
 }
 
 // NewLogger initializes a new logger.
@@ -31,12 +112,39 @@ type Logger struct {
 // logFile: File name to which logs will be written.
 // Returns a pointer to a Logger or an error if any.
 func NewLogger(logLevel LogLevel, logFile string) (*Logger, error) {
-	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	file, err := openLogFile(logFile)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Logger{level: logLevel, file: file}, nil
+	level := new(atomic.Int32)
+	level.Store(int32(logLevel))
+	return &Logger{level: level, file: file}, nil
+}
+
+// NewStdoutLogger initializes a new logger that writes to stdout instead of a
+// file, which is what container platforms collect.
+func NewStdoutLogger(logLevel LogLevel) *Logger {
+	level := new(atomic.Int32)
+	level.Store(int32(logLevel))
+	return &Logger{level: level, file: stdoutLogFile()}
+}
+
+// Level returns the minimum log level that gets written.
+func (l *Logger) Level() LogLevel {
+	return LogLevel(l.level.Load())
+}
+
+// SetLevel changes the minimum log level that gets written. The change applies
+// to the logger and to every logger that was derived from it with WithFields.
+func (l *Logger) SetLevel(level LogLevel) {
+	l.level.Store(int32(level))
+}
+
+// SetRotation makes the logger rotate its file once it exceeds maxSize bytes,
+// keeping at most maxFiles rotated files. A maxSize of zero disables rotation.
+func (l *Logger) SetRotation(maxSize int64, maxFiles int) {
+	l.file.setLimits(maxSize, maxFiles)
 }
 
 // Close closes the log file.
@@ -44,10 +152,94 @@ func (l *Logger) Close() error {
 	return l.file.Close()
 }
 
+// WithFields returns a logger that writes to the same file, adding the
+// provided key/value pairs to every line. The arguments alternate between a
+// key and its value, e.g. WithFields("short_id", 5, "timeslot", 100). The
+// returned logger shares the file of its parent and must not be closed.
+func (l *Logger) WithFields(keyvals ...interface{}) *Logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+len(keyvals)/2+1)
+	copy(fields, l.fields)
+	for i := 0; i < len(keyvals); i += 2 {
+		f := logField{key: fmt.Sprint(keyvals[i])}
+		if i+1 < len(keyvals) {
+			f.value = keyvals[i+1]
+		}
+		fields = append(fields, f)
+	}
+	return &Logger{level: l.level, file: l.file, format: l.format, fields: fields}
+}
+
+// logValue converts a field value into the value that gets logged. Keys and
+// signatures are logged as hex, everything else that knows how to print
+// itself is logged as a string.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case glow.PublicKey:
+		return hex.EncodeToString(v[:])
+	case glow.Signature:
+		return hex.EncodeToString(v[:])
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// textLine renders a line in the plain text format.
+func (l *Logger) textLine(t time.Time, level string, msg string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[%s %s] %s", t.Format("2006-01-02 15:04:05"), level, msg)
+	for _, f := range l.fields {
+		v := fmt.Sprint(logValue(f.value))
+		if v == "" || strings.ContainsAny(v, " =\"\n") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&sb, " %s=%s", f.key, v)
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// jsonLine renders a line in the JSON format. The fields come after the
+// timestamp, level, and message, in the order they were added. A field can't
+// replace one of those three keys, it gets an underscore prefix instead.
+func (l *Logger) jsonLine(t time.Time, level string, msg string) string {
+	var sb strings.Builder
+	writeKV := func(key string, value interface{}) {
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		sb.Write(k)
+		sb.WriteByte(':')
+		sb.Write(v)
+	}
+	sb.WriteByte('{')
+	writeKV("timestamp", t.UTC().Format(time.RFC3339Nano))
+	sb.WriteByte(',')
+	writeKV("level", level)
+	sb.WriteByte(',')
+	writeKV("message", msg)
+	for _, f := range l.fields {
+		key := f.key
+		if key == "timestamp" || key == "level" || key == "message" {
+			key = "_" + key
+		}
+		sb.WriteByte(',')
+		writeKV(key, logValue(f.value))
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
 // Internal logging function. Handles actual file writes.
 func (l *Logger) log(level LogLevel, msg string) {
-	if level >= l.level {
-		currentTime := time.Now().Format("2006-01-02 15:04:05")
+	if level >= l.Level() {
+		currentTime := time.Now()
 		prefix := ""
 
 		switch level {
@@ -63,7 +255,12 @@ func (l *Logger) log(level LogLevel, msg string) {
 			prefix = "FATAL"
 		}
 
-		logMsg := fmt.Sprintf("[%s %s] %s\n", currentTime, prefix, msg)
+		var logMsg string
+		if l.format == LogFormatJSON {
+			logMsg = l.jsonLine(currentTime, prefix, msg)
+		} else {
+			logMsg = l.textLine(currentTime, prefix, msg)
+		}
 		l.file.WriteString(logMsg)
 
 		if level == FATAL {
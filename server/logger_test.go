@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestLoggerFields checks how fields get rendered in the text format.
+func TestLoggerFields(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	path := filepath.Join(dir, "test.log")
+	logger, err := NewLogger(DEBUG, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	pub, _ := glow.GenerateKeyPair()
+	logger.WithFields("short_id", 5).WithFields("pubkey", pub, "error", errors.New("no good"), "empty", "").Info("received report")
+	logger.Warn("no fields")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %v", len(lines))
+	}
+	expected := "INFO] received report short_id=5 pubkey=" + hex.EncodeToString(pub[:]) + ` error="no good" empty=""`
+	if !strings.HasSuffix(lines[0], expected) {
+		t.Error("unexpected line:", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "WARN] no fields") {
+		t.Error("unexpected line:", lines[1])
+	}
+}
+
+// TestJSONLogs launches a server with JSON logs and checks that every line of
+// its log is a JSON object with the required keys.
+func TestJSONLogs(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{LogFormat: LogFormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Get the server to log a rejected report, which has fields.
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wrongKey := glow.GenerateKeyPair()
+	if err := sendUDPReport(generateTestReport(ea.ShortID, 3, wrongKey), server.udpPort); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && !strings.Contains(readServerLog(t, dir), "udp packet rejected"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines int
+	var rejected map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("log line is not json: %v: %s", err, scanner.Text())
+		}
+		for _, key := range []string{"timestamp", "level", "message"} {
+			if _, ok := line[key].(string); !ok {
+				t.Errorf("log line is missing %v: %s", key, scanner.Text())
+			}
+		}
+		if _, err := time.Parse(time.RFC3339Nano, line["timestamp"].(string)); err != nil {
+			t.Error("bad timestamp:", err)
+		}
+		if line["message"] == "udp packet rejected" {
+			rejected = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if lines == 0 {
+		t.Fatal("server did not log anything")
+	}
+	if rejected == nil {
+		t.Fatal("rejected report was not logged")
+	}
+	if rejected["level"] != "WARN" || rejected["short_id"] != float64(1) || rejected["timeslot"] != float64(3) || rejected["outcome"] != "bad_signature" || rejected["authenticated"] != false {
+		t.Errorf("unexpected fields: %v", rejected)
+	}
+}
+
+// TestParseLogFormat checks the names that the binary accepts.
+func TestParseLogFormat(t *testing.T) {
+	if f, err := ParseLogFormat("json"); err != nil || f != LogFormatJSON {
+		t.Error("json was not parsed:", f, err)
+	}
+	if f, err := ParseLogFormat("text"); err != nil || f != LogFormatText {
+		t.Error("text was not parsed:", f, err)
+	}
+	if _, err := ParseLogFormat("xml"); err == nil {
+		t.Error("unknown format was accepted")
+	}
+}
@@ -0,0 +1,333 @@
+package server
+
+// metrics.go tracks operational counters for the server and exposes them in
+// the Prometheus text exposition format. The counters are updated from deep
+// inside the report handling path, which typically holds the server mutex, so
+// everything in this file is implemented with atomics rather than a mutex.
+// That keeps the metrics from ever stacking on top of the server mutex.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// persistDurationBuckets defines the upper bounds of the buckets for the
+// persist_duration_seconds histogram.
+var persistDurationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// rejectionReasons lists the label values of reports_rejected_total, in the
+// order that they get written out.
+var rejectionReasons = []reportOutcome{
+	reportBadSignature,
+	reportUnknownDevice,
+	reportBanned,
+	reportStale,
+	reportInvalidPower,
+	reportDeauthorized,
+	reportFlagged,
+	reportExpired,
+	reportFinalized,
+	reportRetryLater,
+	reportOutsideAuthorization,
+}
+
+// histogram is a lock-free Prometheus style histogram.
+type histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64 // one count per bucket, plus a final +Inf bucket
+	sumBits atomic.Uint64   // float64 bits of the running sum
+	count   atomic.Uint64
+}
+
+// newHistogram returns a histogram with the provided bucket bounds.
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds a value to the histogram.
+func (h *histogram) Observe(v float64) {
+	i := 0
+	for i < len(h.buckets) && v > h.buckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64frombits(old) + v
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+// writeTo writes the histogram in the Prometheus text format.
+func (h *histogram) writeTo(w io.Writer, name string) {
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b, cumulative)
+	}
+	cumulative += h.counts[len(h.buckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n", name, math.Float64frombits(h.sumBits.Load()))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count.Load())
+}
+
+// metrics contains all of the operational counters of the server.
+type metrics struct {
+	reportsReceived     atomic.Uint64
+	udpPacketsMalformed atomic.Uint64
+	udpPacketsPanicked  atomic.Uint64
+	udpRestarts         atomic.Uint64
+	udpLimitedDevice    atomic.Uint64
+	udpLimitedUnknown   atomic.Uint64
+	udpQueueFull        atomic.Uint64
+	httpLimitedBody     atomic.Uint64
+	httpLimitedQuery    atomic.Uint64
+	httpLimitedWrite    atomic.Uint64
+	httpLimitedValidate atomic.Uint64
+	syncOperations      atomic.Uint64
+	reportsDuplicate    atomic.Uint64
+	reportsRejected     [numReportOutcomes]atomic.Uint64
+	persistDuration     *histogram
+	persistFailures     atomic.Uint64
+	alertFailures       map[string]*atomic.Uint64
+	validationWarnings  map[string]*atomic.Uint64
+	storageDegraded     atomic.Bool
+	diskFree            atomic.Uint64
+}
+
+// newMetrics returns an empty set of metrics.
+func newMetrics() *metrics {
+	validationWarnings := make(map[string]*atomic.Uint64)
+	for _, rule := range configurableRules {
+		validationWarnings[rule] = new(atomic.Uint64)
+	}
+	return &metrics{
+		persistDuration: newHistogram(persistDurationBuckets),
+		alertFailures: map[string]*atomic.Uint64{
+			alertBackendWebhooks: {},
+			alertBackendSMTP:     {},
+			alertBackendSlack:    {},
+		},
+		validationWarnings: validationWarnings,
+	}
+}
+
+// RecordOutcome records the outcome of a report that was submitted to the
+// server. Accepted reports only count towards reports_received_total.
+// Duplicates are not rejections, a device that retransmits a report it
+// already sent is behaving normally, so they get a counter of their own.
+func (m *metrics) RecordOutcome(ro reportOutcome) {
+	m.reportsReceived.Add(1)
+	switch ro {
+	case reportAccepted:
+	case reportDuplicate:
+		m.reportsDuplicate.Add(1)
+	default:
+		m.reportsRejected[ro].Add(1)
+	}
+}
+
+// RecordRateLimited records a UDP packet that was dropped because its device,
+// or the shared budget of unknown devices, was over budget.
+func (m *metrics) RecordRateLimited(known bool) {
+	if known {
+		m.udpLimitedDevice.Add(1)
+	} else {
+		m.udpLimitedUnknown.Add(1)
+	}
+}
+
+// RecordQueueFull records a UDP packet that was dropped because the queue of
+// the report workers was full.
+func (m *metrics) RecordQueueFull() {
+	m.udpQueueFull.Add(1)
+}
+
+// The label values of http_requests_limited_total.
+const (
+	httpLimitedBodySize = "body_size"
+	httpLimitedQuery    = "query"
+	httpLimitedWrite    = "write"
+	httpLimitedValidate = "validate"
+)
+
+// RecordHTTPLimited records an HTTP request that was refused because its body
+// was too large, or because its caller was over the query, the write, or the
+// report validation budget.
+func (m *metrics) RecordHTTPLimited(reason string) {
+	switch reason {
+	case httpLimitedBodySize:
+		m.httpLimitedBody.Add(1)
+	case httpLimitedQuery:
+		m.httpLimitedQuery.Add(1)
+	case httpLimitedWrite:
+		m.httpLimitedWrite.Add(1)
+	case httpLimitedValidate:
+		m.httpLimitedValidate.Add(1)
+	}
+}
+
+// ReportsRejected returns the number of reports that were rejected for the
+// provided reason.
+func (m *metrics) ReportsRejected(ro reportOutcome) uint64 {
+	return m.reportsRejected[ro].Load()
+}
+
+// ReportsDuplicate returns the number of reports that were duplicates.
+func (m *metrics) ReportsDuplicate() uint64 {
+	return m.reportsDuplicate.Load()
+}
+
+// RecordMalformedPacket records a UDP packet that could not be decoded.
+func (m *metrics) RecordMalformedPacket() {
+	m.udpPacketsMalformed.Add(1)
+}
+
+// RecordPacketPanic records a UDP packet that caused a panic while it was
+// being handled. These packets also count as malformed.
+func (m *metrics) RecordPacketPanic() {
+	m.udpPacketsPanicked.Add(1)
+	m.udpPacketsMalformed.Add(1)
+}
+
+// RecordUDPRestart records a restart of the UDP listener after its socket
+// failed.
+func (m *metrics) RecordUDPRestart() {
+	m.udpRestarts.Add(1)
+}
+
+// RecordSync records a sync request that was served.
+func (m *metrics) RecordSync() {
+	m.syncOperations.Add(1)
+}
+
+// ObservePersist records how long a persist operation took.
+func (m *metrics) ObservePersist(d time.Duration) {
+	m.persistDuration.Observe(d.Seconds())
+}
+
+// RecordPersistFailure records a write of a report to disk that failed.
+func (m *metrics) RecordPersistFailure() {
+	m.persistFailures.Add(1)
+}
+
+// RecordAlertFailure records an alert that the provided backend dropped or
+// failed to deliver.
+func (m *metrics) RecordAlertFailure(backend string) {
+	m.alertFailures[backend].Add(1)
+}
+
+// AlertFailures returns the number of alerts that the provided backend
+// dropped or failed to deliver.
+func (m *metrics) AlertFailures(backend string) uint64 {
+	return m.alertFailures[backend].Load()
+}
+
+// RecordValidationWarning records a report that failed a rule in warn mode,
+// see validation_rules.go.
+func (m *metrics) RecordValidationWarning(rule string) {
+	m.validationWarnings[rule].Add(1)
+}
+
+// ValidationWarnings returns the number of reports that failed the provided
+// rule in warn mode.
+func (m *metrics) ValidationWarnings(rule string) uint64 {
+	return m.validationWarnings[rule].Load()
+}
+
+// SetStorageState records whether the server refuses reports because it can't
+// store them, and the free space of the server directory.
+func (m *metrics) SetStorageState(degraded bool, diskFree uint64) {
+	m.storageDegraded.Store(degraded)
+	m.diskFree.Store(diskFree)
+}
+
+// WritePrometheus writes all of the metrics in the Prometheus text format.
+func (m *metrics) WritePrometheus(w io.Writer) {
+	fmt.Fprintln(w, "# HELP reports_received_total Equipment reports received by the server.")
+	fmt.Fprintln(w, "# TYPE reports_received_total counter")
+	fmt.Fprintf(w, "reports_received_total %d\n", m.reportsReceived.Load())
+
+	fmt.Fprintln(w, "# HELP reports_duplicate_total Equipment reports that were identical to a report the server already had.")
+	fmt.Fprintln(w, "# TYPE reports_duplicate_total counter")
+	fmt.Fprintf(w, "reports_duplicate_total %d\n", m.reportsDuplicate.Load())
+
+	fmt.Fprintln(w, "# HELP reports_rejected_total Equipment reports that were not accepted, by reason.")
+	fmt.Fprintln(w, "# TYPE reports_rejected_total counter")
+	for _, ro := range rejectionReasons {
+		fmt.Fprintf(w, "reports_rejected_total{reason=\"%s\"} %d\n", ro, m.reportsRejected[ro].Load())
+	}
+
+	fmt.Fprintln(w, "# HELP udp_packets_malformed_total UDP packets that could not be decoded as a report.")
+	fmt.Fprintln(w, "# TYPE udp_packets_malformed_total counter")
+	fmt.Fprintf(w, "udp_packets_malformed_total %d\n", m.udpPacketsMalformed.Load())
+
+	fmt.Fprintln(w, "# HELP udp_packets_panicked_total UDP packets that caused a panic in the listener, which was recovered.")
+	fmt.Fprintln(w, "# TYPE udp_packets_panicked_total counter")
+	fmt.Fprintf(w, "udp_packets_panicked_total %d\n", m.udpPacketsPanicked.Load())
+
+	fmt.Fprintln(w, "# HELP udp_listener_restarts_total Restarts of the UDP listener after its socket failed.")
+	fmt.Fprintln(w, "# TYPE udp_listener_restarts_total counter")
+	fmt.Fprintf(w, "udp_listener_restarts_total %d\n", m.udpRestarts.Load())
+
+	fmt.Fprintln(w, "# HELP udp_packets_rate_limited_total UDP packets dropped before verification because their device was over budget.")
+	fmt.Fprintln(w, "# TYPE udp_packets_rate_limited_total counter")
+	fmt.Fprintf(w, "udp_packets_rate_limited_total{device=\"known\"} %d\n", m.udpLimitedDevice.Load())
+	fmt.Fprintf(w, "udp_packets_rate_limited_total{device=\"unknown\"} %d\n", m.udpLimitedUnknown.Load())
+
+	fmt.Fprintln(w, "# HELP udp_packets_queue_full_total UDP packets dropped because the report workers were falling behind.")
+	fmt.Fprintln(w, "# TYPE udp_packets_queue_full_total counter")
+	fmt.Fprintf(w, "udp_packets_queue_full_total %d\n", m.udpQueueFull.Load())
+
+	fmt.Fprintln(w, "# HELP http_requests_limited_total HTTP requests refused for a body that is too large or a caller that is over budget.")
+	fmt.Fprintln(w, "# TYPE http_requests_limited_total counter")
+	fmt.Fprintf(w, "http_requests_limited_total{reason=\"%s\"} %d\n", httpLimitedBodySize, m.httpLimitedBody.Load())
+	fmt.Fprintf(w, "http_requests_limited_total{reason=\"%s\"} %d\n", httpLimitedQuery, m.httpLimitedQuery.Load())
+	fmt.Fprintf(w, "http_requests_limited_total{reason=\"%s\"} %d\n", httpLimitedWrite, m.httpLimitedWrite.Load())
+	fmt.Fprintf(w, "http_requests_limited_total{reason=\"%s\"} %d\n", httpLimitedValidate, m.httpLimitedValidate.Load())
+
+	fmt.Fprintln(w, "# HELP persist_duration_seconds Time spent persisting reports to disk.")
+	fmt.Fprintln(w, "# TYPE persist_duration_seconds histogram")
+	m.persistDuration.writeTo(w, "persist_duration_seconds")
+
+	fmt.Fprintln(w, "# HELP persist_failures_total Writes of reports to disk that failed.")
+	fmt.Fprintln(w, "# TYPE persist_failures_total counter")
+	fmt.Fprintf(w, "persist_failures_total %d\n", m.persistFailures.Load())
+
+	fmt.Fprintln(w, "# HELP storage_degraded Whether reports are refused because they can't be stored, 1 if they are.")
+	fmt.Fprintln(w, "# TYPE storage_degraded gauge")
+	degraded := 0
+	if m.storageDegraded.Load() {
+		degraded = 1
+	}
+	fmt.Fprintf(w, "storage_degraded %d\n", degraded)
+
+	fmt.Fprintln(w, "# HELP disk_free_bytes Free space of the server directory at the last check.")
+	fmt.Fprintln(w, "# TYPE disk_free_bytes gauge")
+	fmt.Fprintf(w, "disk_free_bytes %d\n", m.diskFree.Load())
+
+	fmt.Fprintln(w, "# HELP alert_delivery_failures_total Alerts that were dropped or could not be delivered, by backend.")
+	fmt.Fprintln(w, "# TYPE alert_delivery_failures_total counter")
+	for _, backend := range []string{alertBackendWebhooks, alertBackendSMTP, alertBackendSlack} {
+		fmt.Fprintf(w, "alert_delivery_failures_total{backend=\"%s\"} %d\n", backend, m.alertFailures[backend].Load())
+	}
+
+	fmt.Fprintln(w, "# HELP validation_warnings_total Equipment reports that were accepted although they failed a rule in warn mode, by rule.")
+	fmt.Fprintln(w, "# TYPE validation_warnings_total counter")
+	for _, rule := range configurableRules {
+		fmt.Fprintf(w, "validation_warnings_total{rule=\"%s\"} %d\n", rule, m.validationWarnings[rule].Load())
+	}
+
+	fmt.Fprintln(w, "# HELP sync_operations_total Sync requests served to equipment.")
+	fmt.Fprintln(w, "# TYPE sync_operations_total counter")
+	fmt.Fprintf(w, "sync_operations_total %d\n", m.syncOperations.Load())
+}
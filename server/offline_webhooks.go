@@ -0,0 +1,251 @@
+package server
+
+// offline_webhooks.go contains a background watcher that notices when a
+// device stops reporting, and notifies a set of webhooks when that happens.
+// When the device starts reporting again, a recovery event is sent. The
+// watcher also sends an expiring event when the authorization of a device is
+// about to expire, see equipment_expiry.go.
+//
+// The webhooks are configured by placing a JSON file in the server directory:
+//
+//	{
+//		"urls": ["https://example.com/hook"],
+//		"offline_threshold": 12
+//	}
+//
+// offline_threshold is the number of timeslots that a device can be silent
+// before it is considered offline, and defaults to 12 (one hour). If the file
+// does not exist, the watcher does not send anything. The file is read again
+// on every Reload. The GCA, or an operator with the manage-webhooks scope, can
+// also read and replace the file through /api/v1/admin/webhooks.
+//
+// Devices are only tracked once they have sent at least one report, and
+// deauthorized devices are ignored. Events are delivered in the background
+// through the alert backends, see alerts.go, so a slow or broken backend
+// never holds up the watcher or the server mutex. Which devices are offline is
+// not persisted, so a device that is offline when the server restarts gets
+// reported again.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// The event types sent to the webhooks.
+const (
+	webhookEventOffline   = "offline"
+	webhookEventRecovered = "recovered"
+	webhookEventExpiring  = "expiring"
+)
+
+// webhookConfig is the contents of the webhooks config file.
+type webhookConfig struct {
+	URLs             []string `json:"urls"`
+	OfflineThreshold uint32   `json:"offline_threshold"`
+}
+
+// DeviceStatusEvent is the payload that gets posted to the webhooks.
+type DeviceStatusEvent struct {
+	Event              string `json:"event"` // One of "offline", "recovered", or "expiring"
+	ShortID            uint32 `json:"short_id"`
+	PubkeyHex          string `json:"pubkey_hex"`
+	LastSeenTimeslot   uint32 `json:"last_seen_timeslot"`
+	ExpirationTimeslot uint32 `json:"expiration_timeslot,omitempty"` // Only set for expiring events
+	DetectedAt         int64  `json:"detected_at"`                   // Unix time at which the change was detected
+}
+
+// alertType implements alertEvent.
+func (e DeviceStatusEvent) alertType() string { return e.Event }
+
+// alertSummary implements alertEvent.
+func (e DeviceStatusEvent) alertSummary() string {
+	switch e.Event {
+	case webhookEventOffline:
+		return fmt.Sprintf("device %v went offline, it last reported for timeslot %v", e.ShortID, e.LastSeenTimeslot)
+	case webhookEventExpiring:
+		return fmt.Sprintf("the authorization of device %v expires at timeslot %v", e.ShortID, e.ExpirationTimeslot)
+	}
+	return fmt.Sprintf("device %v is reporting again", e.ShortID)
+}
+
+// loadWebhookConfig loads the webhooks config file from the server directory.
+// The bool is false if the file does not exist.
+func loadWebhookConfig(baseDir string) (webhookConfig, bool, error) {
+	var wc webhookConfig
+	data, err := os.ReadFile(filepath.Join(baseDir, WebhooksConfigFile))
+	if os.IsNotExist(err) {
+		return wc, false, nil
+	}
+	if err != nil {
+		return wc, false, fmt.Errorf("unable to read webhooks config: %v", err)
+	}
+	if err := json.Unmarshal(data, &wc); err != nil {
+		return wc, false, fmt.Errorf("unable to parse webhooks config: %v", err)
+	}
+	if len(wc.URLs) == 0 {
+		return wc, false, fmt.Errorf("webhooks config does not contain any urls")
+	}
+	if wc.OfflineThreshold == 0 {
+		wc.OfflineThreshold = defaultOfflineThreshold
+	}
+	return wc, true, nil
+}
+
+// WebhooksHandler returns the webhooks config on a GET. A POST replaces the
+// config file and reloads it, and a config without any urls removes the file,
+// which turns the webhooks off. The response to a POST lists what the reload
+// changed.
+func (gcas *GCAServer) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		gcas.mu.RLock()
+		wc := webhookConfig{URLs: []string{}}
+		if gcas.webhooksEnabled {
+			wc.URLs = append(wc.URLs, gcas.webhooks.URLs...)
+			wc.OfflineThreshold = gcas.webhooks.OfflineThreshold
+		}
+		gcas.mu.RUnlock()
+		gcas.writeJSONResponse(w, r, wc)
+		return
+	case http.MethodPost:
+	default:
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET and POST methods are supported.")
+		gcas.requestLogger(r).Warn("Received unsupported request for the webhooks.")
+		return
+	}
+
+	var wc webhookConfig
+	if err := json.NewDecoder(r.Body).Decode(&wc); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+	for _, u := range wc.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			gcas.writeError(w, ErrCodeMalformedRequest, fmt.Sprintf("invalid webhook url %q", u))
+			return
+		}
+	}
+	res, err := gcas.managedReplaceWebhookConfig(wc)
+	if err != nil {
+		gcas.writeError(w, ErrCodeInternalError, fmt.Sprint("Failed to update the webhooks: ", err))
+		gcas.requestLogger(r).Warn("Failed to update the webhooks: ", err)
+		return
+	}
+	gcas.requestLogger(r).WithFields("urls", len(wc.URLs)).Info("Updated the webhooks.")
+	gcas.writeJSONResponse(w, r, res)
+}
+
+// managedReplaceWebhookConfig writes a new webhooks config file and reloads
+// the runtime settings. The old file is put back if the reload fails.
+func (gcas *GCAServer) managedReplaceWebhookConfig(wc webhookConfig) (ReloadResult, error) {
+	path := filepath.Join(gcas.baseDir, WebhooksConfigFile)
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return ReloadResult{}, fmt.Errorf("unable to read webhooks config: %v", err)
+	}
+	existed := err == nil
+	if len(wc.URLs) == 0 {
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		data, _ := json.MarshalIndent(wc, "", "\t")
+		err = writeFileAtomic(path, data, 0644)
+	}
+	if err != nil {
+		return ReloadResult{}, fmt.Errorf("unable to save webhooks config: %v", err)
+	}
+	res, err := gcas.Reload()
+	if err != nil {
+		if existed {
+			writeFileAtomic(path, old, 0644)
+		} else {
+			os.Remove(path)
+		}
+		return ReloadResult{}, err
+	}
+	return res, nil
+}
+
+// recordLastSeen tracks the most recent timeslot that a device has reported
+// for.
+func (gcas *GCAServer) recordLastSeen(report glow.EquipmentReport) {
+	if last, exists := gcas.equipmentLastSeen[report.ShortID]; !exists || report.Timeslot > last {
+		gcas.equipmentLastSeen[report.ShortID] = report.Timeslot
+	}
+}
+
+// detectDeviceStatusChanges compares the last seen timeslot of every device
+// to the provided timeslot, and returns an event for every device that went
+// offline or recovered since the previous call.
+func (gcas *GCAServer) detectDeviceStatusChanges(now uint32, threshold uint32) []DeviceStatusEvent {
+	var events []DeviceStatusEvent
+	detectedAt := gcas.now().Unix()
+	for shortID, ea := range gcas.equipment {
+		last, exists := gcas.equipmentLastSeen[shortID]
+		if !exists {
+			continue
+		}
+		if _, deauthorized := gcas.equipmentDeauthorizations[ea.PublicKey]; deauthorized {
+			continue
+		}
+		silent := now > last && now-last >= threshold
+		_, offline := gcas.equipmentOffline[shortID]
+		var event string
+		if silent && !offline {
+			gcas.equipmentOffline[shortID] = struct{}{}
+			event = webhookEventOffline
+		} else if !silent && offline {
+			delete(gcas.equipmentOffline, shortID)
+			event = webhookEventRecovered
+		} else {
+			continue
+		}
+		events = append(events, DeviceStatusEvent{
+			Event:            event,
+			ShortID:          shortID,
+			PubkeyHex:        hex.EncodeToString(ea.PublicKey[:]),
+			LastSeenTimeslot: last,
+			DetectedAt:       detectedAt,
+		})
+	}
+	return events
+}
+
+// threadedWatchDeviceStatus periodically checks for devices that have gone
+// offline or recovered, and queues the events as alerts, see alerts.go. The
+// alert backends can be changed by Reload, so the config is read again on
+// every check. Without webhooks, the default offline threshold applies.
+func (gcas *GCAServer) threadedWatchDeviceStatus() {
+	for {
+		if !gcas.sleep(deviceStatusCheckFrequency) {
+			return
+		}
+		gcas.mu.Lock()
+		if !gcas.alertsEnabled() {
+			gcas.mu.Unlock()
+			continue
+		}
+		threshold := uint32(defaultOfflineThreshold)
+		if gcas.webhooksEnabled {
+			threshold = gcas.webhooks.OfflineThreshold
+		}
+		now := gcas.currentTimeslot()
+		events := gcas.detectDeviceStatusChanges(now, threshold)
+		events = append(events, gcas.detectExpiringDevices(now)...)
+		for _, event := range events {
+			gcas.queueAlert(event)
+		}
+		gcas.mu.Unlock()
+	}
+}
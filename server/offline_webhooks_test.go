@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// webhookReceiver collects the events posted to it. The first 'failures'
+// requests get answered with an error to exercise the retry logic.
+type webhookReceiver struct {
+	events   []DeviceStatusEvent
+	failures int
+
+	mu sync.Mutex
+}
+
+// ServeHTTP implements http.Handler.
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if wr.failures > 0 {
+		wr.failures--
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	var event DeviceStatusEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, "bad event", http.StatusBadRequest)
+		return
+	}
+	wr.events = append(wr.events, event)
+}
+
+// waitForEvents waits until the receiver has collected n events, and returns
+// them.
+func (wr *webhookReceiver) waitForEvents(n int) []DeviceStatusEvent {
+	for i := 0; i < 200; i++ {
+		wr.mu.Lock()
+		if len(wr.events) >= n {
+			events := append([]DeviceStatusEvent{}, wr.events...)
+			wr.mu.Unlock()
+			return events
+		}
+		wr.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// TestOfflineWebhooks checks that the webhooks receive an event when a device
+// goes offline and another one when it recovers, with failed deliveries
+// being retried.
+func TestOfflineWebhooks(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, ePriv, err := server.AuthorizeTestDevice(7, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 9, ePriv))
+
+	// Configure two webhooks, the second of which fails a couple of times
+	// before accepting events, then restart the server to pick up the
+	// config.
+	primary := &webhookReceiver{}
+	flaky := &webhookReceiver{failures: 2}
+	primaryServer := httptest.NewServer(primary)
+	defer primaryServer.Close()
+	flakyServer := httptest.NewServer(flaky)
+	defer flakyServer.Close()
+	config, _ := json.Marshal(webhookConfig{
+		URLs:             []string{primaryServer.URL, flakyServer.URL},
+		OfflineThreshold: 3,
+	})
+	err = os.WriteFile(filepath.Join(dir, WebhooksConfigFile), config, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// The device is still within the threshold, then goes silent for too
+	// long.
+	time.Sleep(5 * deviceStatusCheckFrequency)
+	if events := primary.waitForEvents(0); len(events) != 0 {
+		t.Fatal("device was reported offline too early:", events)
+	}
+	glow.SetCurrentTimeslot(12)
+	expected := DeviceStatusEvent{
+		Event:            webhookEventOffline,
+		ShortID:          ea.ShortID,
+		PubkeyHex:        hex.EncodeToString(ea.PublicKey[:]),
+		LastSeenTimeslot: 9,
+	}
+	for _, wr := range []*webhookReceiver{primary, flaky} {
+		events := wr.waitForEvents(1)
+		if len(events) != 1 {
+			t.Fatal("expected one offline event, got", events)
+		}
+		if events[0].DetectedAt == 0 {
+			t.Fatal("missing detection time")
+		}
+		events[0].DetectedAt = 0
+		if events[0] != expected {
+			t.Fatalf("unexpected event: %+v", events[0])
+		}
+	}
+
+	// Reporting again should trigger a recovery event.
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 12, ePriv))
+	expected.Event = webhookEventRecovered
+	expected.LastSeenTimeslot = 12
+	for _, wr := range []*webhookReceiver{primary, flaky} {
+		events := wr.waitForEvents(2)
+		if len(events) != 2 {
+			t.Fatal("expected a recovery event, got", events)
+		}
+		events[1].DetectedAt = 0
+		if events[1] != expected {
+			t.Fatalf("unexpected event: %+v", events[1])
+		}
+	}
+}
+
+// TestLoadWebhookConfig checks the defaults and validation of the webhooks
+// config.
+func TestLoadWebhookConfig(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	_, enabled, err := loadWebhookConfig(dir)
+	if err != nil || enabled {
+		t.Fatal("expected a missing config to disable the webhooks:", enabled, err)
+	}
+	path := filepath.Join(dir, WebhooksConfigFile)
+	if err := os.WriteFile(path, []byte(`{"urls": ["http://127.0.0.1:1/hook"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wc, enabled, err := loadWebhookConfig(dir)
+	if err != nil || !enabled {
+		t.Fatal("expected the webhooks to be enabled:", enabled, err)
+	}
+	if wc.OfflineThreshold != defaultOfflineThreshold {
+		t.Fatal("default threshold was not applied:", wc.OfflineThreshold)
+	}
+	for _, bad := range []string{`{"urls": []}`, `not json`} {
+		if err := os.WriteFile(path, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := loadWebhookConfig(dir); err == nil {
+			t.Fatal("expected an error for config", bad)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package server
+
+// operator_keys.go lets the GCA delegate a part of its authority to operator
+// keys, so that the GCA key can stay offline for the routine work of running
+// a server. A delegation is signed by the GCA, and names the operator key and
+// the scopes that the key gets. Each scope unlocks a group of admin
+// endpoints:
+//
+//   - read-audit: GET /api/v1/audit-log
+//   - trigger-backup: POST /api/v1/admin/backup
+//   - resolve-flagged-reports: POST /api/v1/flagged-reports/review
+//   - manage-webhooks: GET and POST /api/v1/admin/webhooks
+//
+// A newer delegation for the same key replaces the older one, and a
+// delegation with Revoked set takes every scope away. The delegations are
+// persisted, recorded in the audit log, and forwarded to all of the other GCA
+// servers, the same way that deauthorizations are. The current delegation of
+// every key is listed at GET /api/v1/operator-keys.
+//
+// Operators sign their requests the same way the GCA does, see api_auth.go. A
+// review of a flagged report is also forwarded to the other servers, so an
+// operator signs the review itself with its key, in place of the GCA.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// OperatorScopes is a set of scopes that can be delegated to an operator.
+type OperatorScopes uint32
+
+// The scopes of an operator.
+const (
+	ScopeReadAudit OperatorScopes = 1 << iota
+	ScopeTriggerBackup
+	ScopeResolveFlaggedReports
+	ScopeManageWebhooks
+	ScopeTrimHistory
+
+	// allOperatorScopes is every scope, which is what the GCA holds.
+	allOperatorScopes = ScopeReadAudit | ScopeTriggerBackup | ScopeResolveFlaggedReports | ScopeManageWebhooks | ScopeTrimHistory
+)
+
+// operatorScopeNames are the names of the scopes, as used in JSON.
+var operatorScopeNames = []struct {
+	scope OperatorScopes
+	name  string
+}{
+	{ScopeReadAudit, "read-audit"},
+	{ScopeTriggerBackup, "trigger-backup"},
+	{ScopeResolveFlaggedReports, "resolve-flagged-reports"},
+	{ScopeManageWebhooks, "manage-webhooks"},
+	{ScopeTrimHistory, "trim-history"},
+}
+
+// Has returns whether the set contains every scope of the provided set.
+func (s OperatorScopes) Has(scope OperatorScopes) bool {
+	return s&scope == scope
+}
+
+// String returns the names of the scopes, separated by commas.
+func (s OperatorScopes) String() string {
+	names := s.names()
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// names returns the names of the scopes in the set.
+func (s OperatorScopes) names() []string {
+	names := []string{}
+	for _, sn := range operatorScopeNames {
+		if s.Has(sn.scope) {
+			names = append(names, sn.name)
+		}
+	}
+	return names
+}
+
+// MarshalJSON encodes the scopes as a list of their names.
+func (s OperatorScopes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.names())
+}
+
+// UnmarshalJSON decodes a list of scope names.
+func (s *OperatorScopes) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("scopes must be a list of names: %v", err)
+	}
+	*s = 0
+outer:
+	for _, name := range names {
+		for _, sn := range operatorScopeNames {
+			if sn.name == name {
+				*s |= sn.scope
+				continue outer
+			}
+		}
+		return fmt.Errorf("unknown scope %q", name)
+	}
+	return nil
+}
+
+// OperatorDelegation is an order from the GCA to give scopes to an operator
+// key, or to take them away.
+type OperatorDelegation struct {
+	PublicKey glow.PublicKey // The key of the operator
+	Name      string         // A name for the operator, at most 255 bytes
+	Scopes    OperatorScopes // The scopes that the operator gets
+	Revoked   bool           // Whether the delegation takes every scope away
+	Timestamp int64          // Unix time of the delegation
+	Signature glow.Signature // A signature from the GCA
+}
+
+// SigningBytes returns the bytes that the GCA signs to make the delegation.
+func (od OperatorDelegation) SigningBytes() []byte {
+	return glow.SerializeOperatorDelegationForSigning(od.PublicKey, od.Name, uint32(od.Scopes), od.Revoked, od.Timestamp)
+}
+
+// Serialize returns the compact binary representation of the delegation.
+func (od OperatorDelegation) Serialize() []byte {
+	b := make([]byte, 0, 32+1+len(od.Name)+4+1+8+64)
+	b = append(b, od.PublicKey[:]...)
+	b = append(b, byte(len(od.Name)))
+	b = append(b, od.Name...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(od.Scopes))
+	if od.Revoked {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = binary.LittleEndian.AppendUint64(b, uint64(od.Timestamp))
+	return append(b, od.Signature[:]...)
+}
+
+// DeserializeOperatorDelegation reverses a call to Serialize. It returns the
+// number of bytes that were consumed, as the size of a serialized delegation
+// depends on the length of its name.
+func DeserializeOperatorDelegation(b []byte) (OperatorDelegation, int, error) {
+	var od OperatorDelegation
+	if len(b) < 33 {
+		return od, 0, fmt.Errorf("operator delegation is too short")
+	}
+	copy(od.PublicKey[:], b[:32])
+	nameLen := int(b[32])
+	n := 33 + nameLen + 4 + 1 + 8 + 64
+	if len(b) < n {
+		return od, 0, fmt.Errorf("operator delegation is too short")
+	}
+	od.Name = string(b[33 : 33+nameLen])
+	i := 33 + nameLen
+	od.Scopes = OperatorScopes(binary.LittleEndian.Uint32(b[i:]))
+	if b[i+4] > 1 {
+		return od, 0, fmt.Errorf("invalid revoked flag")
+	}
+	od.Revoked = b[i+4] == 1
+	od.Timestamp = int64(binary.LittleEndian.Uint64(b[i+5:]))
+	copy(od.Signature[:], b[i+13:n])
+	return od, n, nil
+}
+
+// activeScopes returns the scopes that the delegation grants.
+func (od OperatorDelegation) activeScopes() OperatorScopes {
+	if od.Revoked {
+		return 0
+	}
+	return od.Scopes
+}
+
+// OperatorKeysHandler lists the current delegation of every operator key on
+// a GET, and accepts a new delegation from the GCA on a POST.
+func (gcas *GCAServer) OperatorKeysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		gcas.mu.RLock()
+		operators := make([]OperatorDelegation, 0, len(gcas.operatorDelegations))
+		for _, od := range gcas.operatorDelegations {
+			operators = append(operators, od)
+		}
+		gcas.mu.RUnlock()
+		sort.Slice(operators, func(i, j int) bool {
+			if operators[i].Name != operators[j].Name {
+				return operators[i].Name < operators[j].Name
+			}
+			return string(operators[i].PublicKey[:]) < string(operators[j].PublicKey[:])
+		})
+		gcas.writeJSONResponse(w, r, operators)
+		return
+	case http.MethodPost:
+	default:
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET and POST methods are supported.")
+		gcas.requestLogger(r).Warn("Received unsupported request for operator keys.")
+		return
+	}
+
+	var request OperatorDelegation
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+	isNew, err := gcas.managedDelegateOperator(request)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to delegate operator key:", err))
+		gcas.requestLogger(r).WithFields("operator", request.PublicKey).Warn("Failed to delegate operator key: ", err)
+		return
+	}
+
+	// Forward the delegation to all of the other servers, so that the
+	// operator has the same scopes everywhere. Only new delegations get
+	// forwarded, which prevents the servers from endlessly passing the
+	// same request around.
+	if isNew {
+		gcas.gcaServers.mu.Lock()
+		ass := make([]AuthorizedServer, len(gcas.gcaServers.servers))
+		copy(ass, gcas.gcaServers.servers)
+		gcas.gcaServers.mu.Unlock()
+		jsonBody, _ := json.Marshal(request)
+		for _, as := range ass {
+			resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/operator-keys", jsonBody)
+			if err != nil {
+				gcas.requestLogger(r).WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to forward operator delegation")
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	gcas.requestLogger(r).WithFields("operator", request.Name, "scopes", request.activeScopes()).Info("Successfully delegated operator key.")
+}
+
+// isDelegationUpdate returns whether a delegation replaces the current
+// delegation of its key. The mutex must be held.
+func (gcas *GCAServer) isDelegationUpdate(od OperatorDelegation) bool {
+	current, exists := gcas.operatorDelegations[od.PublicKey]
+	return !exists || od.Timestamp > current.Timestamp
+}
+
+// applyOperatorDelegation makes a delegation the current delegation of its
+// key. The mutex must be held.
+func (gcas *GCAServer) applyOperatorDelegation(od OperatorDelegation) {
+	gcas.operatorDelegations[od.PublicKey] = od
+	if od.Scopes.Has(ScopeResolveFlaggedReports) {
+		gcas.operatorReviewKeys[od.PublicKey] = struct{}{}
+	}
+}
+
+// managedDelegateOperator verifies and saves a delegation. The bool indicates
+// whether the delegation is new to this server.
+func (gcas *GCAServer) managedDelegateOperator(od OperatorDelegation) (bool, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return false, errNotInitialized
+	}
+	if len(od.Name) > 255 {
+		return false, withCode(ErrCodeMalformedRequest, fmt.Errorf("name is %v bytes, at most 255 are allowed", len(od.Name)))
+	}
+	if od.Scopes&^allOperatorScopes != 0 {
+		return false, withCode(ErrCodeMalformedRequest, fmt.Errorf("unknown scopes %#x", uint32(od.Scopes&^allOperatorScopes)))
+	}
+	if !gcas.verifyGCASignature(od.SigningBytes(), od.Signature) {
+		return false, withCode(ErrCodeInvalidSignature, errors.New("invalid signature on operator delegation"))
+	}
+	if od.PublicKey == gcas.gcaKeyAt(gcas.currentTimeslot()) {
+		return false, withCode(ErrCodeMalformedRequest, errors.New("the GCA key can't be an operator key"))
+	}
+	if current, exists := gcas.operatorDelegations[od.PublicKey]; exists && !gcas.isDelegationUpdate(od) {
+		if current == od {
+			return false, nil
+		}
+		return false, withCode(ErrCodeConflict, errors.New("a newer delegation for this operator key exists"))
+	}
+
+	// Record and persist the delegation before applying it.
+	err := gcas.recordAudit(auditRecord{
+		action:     glow.AuditOperatorDelegation,
+		request:    od.Serialize(),
+		signatures: []glow.AuditSignature{gcas.gcaAuditSignature(od.SigningBytes(), od.Signature)},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := gcas.staticStorage.AppendFile(OperatorDelegationsFile, od.Serialize(), 0644); err != nil {
+		return false, fmt.Errorf("unable to save operator delegation: %v", err)
+	}
+	gcas.applyOperatorDelegation(od)
+	gcas.bumpStateVersion()
+	return true, nil
+}
+
+// loadOperatorDelegations loads the delegations from disk, creating the file
+// if it does not exist yet. This needs to happen after the GCA key is loaded,
+// and before the reviews of flagged reports, which may be signed by
+// operators.
+func (gcas *GCAServer) loadOperatorDelegations() error {
+	data, err := gcas.staticStorage.ReadFile(OperatorDelegationsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(OperatorDelegationsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read operator delegations file: %v", err)
+	}
+	for i := 0; len(data) > 0; i++ {
+		od, n, err := DeserializeOperatorDelegation(data)
+		if err != nil {
+			return fmt.Errorf("%v: record %v: %v", OperatorDelegationsFile, i, err)
+		}
+		if !gcas.verifyPersistedGCASignature(od.SigningBytes(), od.Signature) {
+			return fmt.Errorf("%v: record %v: invalid signature on operator delegation", OperatorDelegationsFile, i)
+		}
+		if gcas.isDelegationUpdate(od) {
+			gcas.applyOperatorDelegation(od)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// operatorSignature checks that data was signed by the current GCA key or by
+// an operator that currently holds the provided scope, and returns the
+// signature in the form of the audit log. The mutex must be held.
+func (gcas *GCAServer) operatorSignature(sb []byte, sig glow.Signature, scope OperatorScopes) (glow.AuditSignature, error) {
+	if gcas.verifyGCASignature(sb, sig) {
+		return gcas.gcaAuditSignature(sb, sig), nil
+	}
+	for key, od := range gcas.operatorDelegations {
+		if !glow.Verify(key, sb, sig) {
+			continue
+		}
+		if !od.activeScopes().Has(scope) {
+			return glow.AuditSignature{}, withCode(ErrCodeScopeDenied, fmt.Errorf("operator %q was not delegated the %v scope", od.Name, scope))
+		}
+		return glow.AuditSignature{PublicKey: key, SigningBytes: sb, Signature: sig}, nil
+	}
+	return glow.AuditSignature{}, withCode(ErrCodeInvalidSignature, errors.New("invalid signature"))
+}
+
+// verifyPersistedOperatorSignature checks a signature against every key in
+// the chain of GCA keys and the provided operator keys. Data that an operator
+// signed stays valid after the operator is revoked, the same way that data
+// signed by an older GCA key stays valid after a rotation.
+func (gcas *GCAServer) verifyPersistedOperatorSignature(sb []byte, sig glow.Signature, operators map[glow.PublicKey]struct{}) bool {
+	if gcas.verifyPersistedGCASignature(sb, sig) {
+		return true
+	}
+	for key := range operators {
+		if glow.Verify(key, sb, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// operatorScopes returns the scopes that are currently delegated to a key.
+// The mutex must be held.
+func (gcas *GCAServer) operatorScopes(key glow.PublicKey) (OperatorScopes, bool) {
+	od, exists := gcas.operatorDelegations[key]
+	if !exists || od.Revoked {
+		return 0, false
+	}
+	return od.Scopes, true
+}
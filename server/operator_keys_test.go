@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// delegateTestOperator posts a delegation signed by the GCA, and returns the
+// status of the response.
+func (gcas *GCAServer) delegateTestOperator(od OperatorDelegation, gcaPrivKey glow.PrivateKey) (int, error) {
+	od.Signature = glow.Sign(od.SigningBytes(), gcaPrivKey)
+	body, err := json.Marshal(od)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.Post("http://"+gcas.httpDialAddr()+"/api/v1/operator-keys", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// signedRequest sends a request signed with the provided key, and returns the
+// response along with its error code, if any.
+func (gcas *GCAServer) signedRequest(method, route string, body []byte, pub glow.PublicKey, priv glow.PrivateKey) (*http.Response, string, error) {
+	req, err := http.NewRequest(method, "http://"+gcas.httpDialAddr()+route, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := glow.SignRequest(req, pub, priv); err != nil {
+		return nil, "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var apiErr APIError
+	json.Unmarshal(data, &apiErr)
+	return resp, apiErr.Code, nil
+}
+
+// TestOperatorKeys checks that operators are held to the scopes that the GCA
+// delegated to them, and that a revocation takes effect everywhere, including
+// after a restart.
+func TestOperatorKeys(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opPub, opPriv := glow.GenerateKeyPair()
+	now := time.Now().Unix()
+
+	// A delegation needs the signature of the GCA.
+	od := OperatorDelegation{PublicKey: opPub, Name: "night-shift", Scopes: ScopeReadAudit | ScopeResolveFlaggedReports, Timestamp: now}
+	_, otherPriv := glow.GenerateKeyPair()
+	if status, err := server.delegateTestOperator(od, otherPriv); err != nil || status != http.StatusForbidden {
+		t.Fatal("delegation with a bad signature was accepted:", status, err)
+	}
+	if status, err := server.delegateTestOperator(od, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("delegation was refused:", status, err)
+	}
+
+	// The delegation is listed, with the names of its scopes.
+	resp, err := http.Get("http://" + server.httpDialAddr() + "/api/v1/operator-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var listed []OperatorDelegation
+	if err := json.Unmarshal(data, &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Name != "night-shift" || listed[0].Scopes != od.Scopes || listed[0].Revoked {
+		t.Fatalf("unexpected operators: %+v", listed)
+	}
+	if !strings.Contains(string(data), `"Scopes":["read-audit","resolve-flagged-reports"]`) {
+		t.Fatal("scopes are not listed by name:", string(data))
+	}
+
+	// The operator can read the audit log, but can't manage the webhooks
+	// or take a backup.
+	if resp, code, err := server.signedRequest("GET", "/api/v1/audit-log", nil, opPub, opPriv); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("operator can't read the audit log:", code, err)
+	}
+	if resp, code, err := server.signedRequest("GET", "/api/v1/admin/webhooks", nil, opPub, opPriv); err != nil || resp.StatusCode != http.StatusForbidden || code != ErrCodeScopeDenied {
+		t.Fatal("operator was allowed outside of its scope:", code, err)
+	}
+	if resp, code, err := server.signedRequest("POST", "/api/v1/admin/backup", nil, opPub, opPriv); err != nil || resp.StatusCode != http.StatusForbidden || code != ErrCodeScopeDenied {
+		t.Fatal("operator took a backup outside of its scope:", code, err)
+	}
+
+	// The operator can sign a review. The audit log records the key of
+	// the operator.
+	frr := FlaggedReportReview{ShortID: 7, Timeslot: 100, PowerOutput: 5, Accept: true}
+	frr.Signature = glow.Sign(frr.SigningBytes(), opPriv)
+	if _, err := server.managedReviewFlaggedReport(frr); err != nil {
+		t.Fatal("operator review was refused:", err)
+	}
+	server.auditLog.mu.Lock()
+	last := server.auditLog.entries[len(server.auditLog.entries)-1]
+	server.auditLog.mu.Unlock()
+	if last.Action != glow.AuditFlaggedReportReview || last.Signatures[0].PublicKey != opPub {
+		t.Fatalf("unexpected audit entry: %+v", last)
+	}
+
+	// A newer delegation replaces the scopes. An older one is refused.
+	od.Scopes, od.Timestamp = ScopeManageWebhooks, now+1
+	if status, err := server.delegateTestOperator(od, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("new delegation was refused:", status, err)
+	}
+	od.Timestamp = now - 1
+	if status, err := server.delegateTestOperator(od, gcaPrivKey); err != nil || status != http.StatusConflict {
+		t.Fatal("older delegation was accepted:", status, err)
+	}
+	if resp, code, err := server.signedRequest("GET", "/api/v1/audit-log", nil, opPub, opPriv); err != nil || code != ErrCodeScopeDenied {
+		t.Fatal("operator kept a scope that was taken away:", resp.StatusCode, code, err)
+	}
+	frr2 := FlaggedReportReview{ShortID: 8, Timeslot: 100, PowerOutput: 5, Accept: true}
+	frr2.Signature = glow.Sign(frr2.SigningBytes(), opPriv)
+	if _, err := server.managedReviewFlaggedReport(frr2); errorCode(err, "") != ErrCodeScopeDenied {
+		t.Fatal("review outside of the operator's scope was not refused:", err)
+	}
+	if resp, code, err := server.signedRequest("POST", "/api/v1/admin/webhooks", []byte(`{"urls":["https://hooks.example.com/a"],"offline_threshold":6}`), opPub, opPriv); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("operator can't manage the webhooks:", code, err)
+	}
+	server.mu.RLock()
+	enabled, threshold := server.webhooksEnabled, server.webhooks.OfflineThreshold
+	server.mu.RUnlock()
+	if !enabled || threshold != 6 {
+		t.Fatal("webhooks were not applied:", enabled, threshold)
+	}
+
+	// The delegations and the operator review survive a restart, and so
+	// does a revocation.
+	od.Revoked, od.Timestamp = true, now+2
+	if status, err := server.delegateTestOperator(od, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("revocation was refused:", status, err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, exists := server.flaggedReportReviews[reportSlot{ShortID: 7, Timeslot: 100}]; !exists {
+		t.Fatal("operator review was not loaded")
+	}
+	if resp, code, err := server.signedRequest("GET", "/api/v1/admin/webhooks", nil, opPub, opPriv); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("revoked operator was served:", code, err)
+	}
+}
+
+// TestOperatorDelegationSerialization checks that a delegation survives the
+// round trip through Serialize, and that truncated records are refused.
+func TestOperatorDelegationSerialization(t *testing.T) {
+	pub, _ := glow.GenerateKeyPair()
+	od := OperatorDelegation{PublicKey: pub, Name: "ops", Scopes: ScopeTriggerBackup, Revoked: true, Timestamp: 1700000000}
+	od.Signature[5] = 9
+	b := od.Serialize()
+	decoded, n, err := DeserializeOperatorDelegation(append(b, 1, 2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != od || n != len(b) {
+		t.Fatalf("delegation did not survive the round trip: %+v %v", decoded, n)
+	}
+	for i := 0; i < len(b); i++ {
+		if _, _, err := DeserializeOperatorDelegation(b[:i]); err == nil {
+			t.Fatal("truncated delegation was accepted at length", i)
+		}
+	}
+
+	var scopes OperatorScopes
+	if err := json.Unmarshal([]byte(`["trigger-backup","manage-webhooks"]`), &scopes); err != nil || scopes != ScopeTriggerBackup|ScopeManageWebhooks {
+		t.Fatal("unexpected scopes:", scopes, err)
+	}
+	if err := json.Unmarshal([]byte(`["root"]`), &scopes); err == nil {
+		t.Fatal("unknown scope was accepted")
+	}
+}
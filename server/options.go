@@ -0,0 +1,477 @@
+package server
+
+// options.go contains the settings that an operator can adjust when launching
+// a GCAServer. The defaults match the constants in consts_p.go and consts_t.go,
+// so a server launched with NewGCAServer behaves the same as it always has.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// ServerOptions contains the configurable settings of a GCAServer. A port of
+// zero means that the operating system will pick an ephemeral port, the
+// actual port can be retrieved by calling Ports() after startup.
+type ServerOptions struct {
+	HttpPort uint16 // Port for the HTTP API
+	TcpPort  uint16 // Port for the TCP sync listener
+	UdpPort  uint16 // Port for the UDP report listener
+
+	// The IP addresses that each listener binds to. An empty address
+	// binds to all interfaces in production and to loopback in testing.
+	// IPv6 addresses may be written with or without brackets, and the
+	// wildcard addresses "::" and "0.0.0.0" both bind a single dual-stack
+	// socket that accepts IPv4 and IPv6 traffic.
+	HttpAddr string
+	TcpAddr  string
+	UdpAddr  string
+
+	// LoopbackInternalAPIs makes the internal test mode endpoints refuse
+	// every caller that isn't connecting from a loopback address, no
+	// matter which address the HTTP API is bound to.
+	LoopbackInternalAPIs bool
+
+	// CapacityTolerance is the percentage that a report may exceed the
+	// capacity of its equipment by before it gets flagged for review.
+	CapacityTolerance uint64
+
+	// ValidationModes are the modes of the configurable validation rules
+	// by name, see validation_rules.go. The rules that are missing are
+	// enforced.
+	ValidationModes map[string]ValidationMode
+
+	// LegacyErrors makes the v1 handlers return the plain text error
+	// messages that they returned before the structured errors were
+	// introduced. It exists so that tests and tools which still assert on
+	// the old strings keep working during the transition.
+	LegacyErrors bool
+
+	// LogFormat selects between plain text logs, the default, and JSON
+	// logs with one object per line.
+	LogFormat LogFormat
+
+	// LogMaxSize is the size in bytes after which the server log gets
+	// rotated, and LogMaxFiles is the number of rotated files that are
+	// kept. Zero values fall back to DefaultLogMaxSize and
+	// DefaultLogMaxFiles, a negative LogMaxSize disables rotation.
+	LogMaxSize  int64
+	LogMaxFiles int
+
+	// LogStdout writes the server log to stdout instead of server.log,
+	// for platforms that collect the output of the process. The log is
+	// never rotated.
+	LogStdout bool
+
+	// TLSCertFile and TLSKeyFile are the paths of the certificate and the
+	// key of the HTTP API. If they are empty, the API serves TLS only if
+	// cert.pem and key.pem exist in the server directory.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ReportWorkers is the number of goroutines that parse and verify the
+	// reports that arrive over UDP. Zero uses one worker per CPU.
+	ReportWorkers int
+
+	// DefaultRegion is the WattTime region of the equipment that the GCA
+	// did not assign a region to. If it is empty, the region of such
+	// equipment is looked up from its coordinates.
+	DefaultRegion string
+
+	// PrivateLocations makes every device private whose location privacy
+	// the GCA didn't set, so that the public endpoints redact its
+	// coordinates, see location_privacy.go. LocationRedaction says how,
+	// either by truncating them to one decimal, the default, or by
+	// removing them.
+	PrivateLocations  bool
+	LocationRedaction LocationRedaction
+
+	// WattTimeURL is the base URL of the WattTime API, empty for the real
+	// API. Tests use it to point the server at a fake WattTime server.
+	WattTimeURL string
+
+	// DisableImpactCollection stops the background loop that fetches the
+	// current impact rate of every device from WattTime. Every new impact
+	// rate changes the stats, so tests that compare the responses of two
+	// fetches use it to keep the state from changing in between.
+	DisableImpactCollection bool
+
+	// WattTimeUsername and WattTimePassword are the credentials of the
+	// WattTime API. If they are empty, the credentials are read from
+	// watttime_data/username and watttime_data/password in the server
+	// directory, which are also read again by Reload.
+	WattTimeUsername string
+	WattTimePassword string
+
+	// ReportPastWindow and ReportFutureWindow are the number of timeslots
+	// that the timeslot of a report may be behind or ahead of the current
+	// timeslot. Both windows are relative to the clock rather than to the
+	// week, so a report for the last timeslot of a week is still accepted
+	// after the week ends, and a report for the first timeslot of a week is
+	// accepted before it starts. Zero values fall back to
+	// defaultReportWindow.
+	ReportPastWindow   uint32
+	ReportFutureWindow uint32
+
+	// FinalizationDelay is the number of timeslots after the end of a week
+	// at which the server finalizes the week, see period_finalization.go.
+	// Reports and overrides for a finalized week are rejected. Zero falls
+	// back to the past report window, so that no report that would have
+	// been accepted gets rejected.
+	FinalizationDelay uint32
+
+	// KeyRotationOverlap is the number of timeslots past the activation of
+	// a device key rotation in which reports signed by the old key are
+	// still accepted, see api_device_key_rotation.go. Every server of the
+	// GCA needs the same value to agree on which reports are valid. Zero
+	// falls back to defaultKeyRotationOverlap.
+	KeyRotationOverlap uint32
+
+	// MinFreeDisk is the number of free bytes in the server directory
+	// below which the server stops accepting reports, before a write
+	// has to fail, see persist_health.go. Zero falls back to
+	// defaultMinFreeDisk, a negative value disables the check.
+	MinFreeDisk int64
+
+	// Debug registers the pprof, expvar, and state endpoints under
+	// /debug/ even when the server is not in internal test mode, see
+	// api_debug.go.
+	Debug bool
+
+	// NotifySocket is the systemd notify socket, and WatchdogInterval is
+	// the interval in which systemd expects a heartbeat on it, zero if the
+	// watchdog is disabled. LoadEnvConfig takes both from the variables
+	// that systemd sets, see sdnotify.go.
+	NotifySocket     string
+	WatchdogInterval time.Duration
+
+	// StatsSnapshotMaxAge is how long a snapshot of the device stats may
+	// keep being served after the state changed, which bounds how stale
+	// the all-device-stats endpoints can be, see stats_snapshot.go. Zero
+	// falls back to defaultStatsSnapshotMaxAge, a negative value rebuilds
+	// the snapshot after every change.
+	StatsSnapshotMaxAge time.Duration
+
+	// PageCursorTTL is how long the server holds on to the snapshot of a
+	// paged listing after it handed out a cursor for it, see
+	// page_cursors.go. Zero falls back to defaultPageCursorTTL.
+	PageCursorTTL time.Duration
+
+	// RetryQueueMaxEntries and RetryQueueMaxAge bound each of the queues
+	// of the deliveries to the webhooks and the alert backends, see
+	// retry_queue.go. The oldest delivery is dropped when a queue is full,
+	// and a delivery is dropped once it has been waiting for longer than
+	// the maximum age. Zero values fall back to
+	// defaultRetryQueueMaxEntries and defaultRetryQueueMaxAge.
+	RetryQueueMaxEntries int
+	RetryQueueMaxAge     time.Duration
+
+	// DeviceReportInterval and DeviceReportBurst are the budget of report
+	// packets that every known device gets on the UDP listener, and
+	// UnknownReportInterval and UnknownReportBurst are the budget that the
+	// unknown devices share, see report_rate_limit.go. A budget holds up
+	// to burst packets and refills by one packet per interval. Zero values
+	// fall back to deviceReportInterval, deviceReportBurst,
+	// unknownReportInterval and unknownReportBurst. The limits in
+	// server-config.json take precedence, see reload.go.
+	DeviceReportInterval  time.Duration
+	DeviceReportBurst     int64
+	UnknownReportInterval time.Duration
+	UnknownReportBurst    int64
+
+	// RetainedPeriods is the number of weeks before the current one that
+	// the stats and the recent reports endpoints serve through their
+	// period parameter, see retained_periods.go. The signed reports of
+	// every retained week are kept in memory after the week leaves the
+	// reporting window, which is 80 bytes per report, up to 161 kB per
+	// device and week. The week that was finalized last is kept from its
+	// finalization on, so up to RetainedPeriods+1 weeks are in memory. Zero
+	// keeps none and only serves the current week.
+	RetainedPeriods int
+
+	// StateChangeBuffer is the number of recent state changes that the
+	// stats-delta endpoint can return, see api_stats_delta.go. A poller
+	// that falls further behind has to fetch the full stats again. Zero
+	// falls back to defaultStateChangeBuffer.
+	StateChangeBuffer int
+
+	// DisableReportReceipts stops the server from recording when it
+	// received every report, see report_receipts.go. The receipts take 16
+	// bytes per report on disk and 16 kB per device in memory.
+	DisableReportReceipts bool
+
+	// LateReportThreshold is the number of timeslots after the end of its
+	// timeslot at which a report counts as late for the late_only filter
+	// of the historical reports. Zero falls back to
+	// defaultLateReportThreshold.
+	LateReportThreshold uint32
+
+	// Storage is where the server keeps its persist files, nil keeps them
+	// in the server directory, see storage.go. Tests use a MemoryStorage.
+	Storage Storage
+
+	// StorageBackend selects the storage if Storage is nil, either files
+	// in the server directory, the default, or a SQLite database, see
+	// storage_sqlite.go.
+	StorageBackend StorageBackend
+
+	// Clock is the source of the current time of the server, nil uses the
+	// clock of the machine. Tests use it to control the time of the
+	// migrations and the expiries, see clock.go.
+	Clock Clock
+
+	// Tenants are the ids of the other GCAs that the server hosts, each
+	// of which keeps its state in tenants/<id> in the server directory,
+	// see tenants.go.
+	Tenants []string
+
+	// tenantHost is the server that hosts this server as a tenant.
+	tenantHost *GCAServer
+}
+
+// DefaultServerOptions returns the options that get used when calling
+// NewGCAServer.
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{
+		HttpPort: httpPort,
+		TcpPort:  tcpPort,
+		UdpPort:  udpPort,
+
+		HttpAddr: serverIP,
+		TcpAddr:  serverIP,
+		UdpAddr:  serverIP,
+
+		CapacityTolerance: DefaultCapacityTolerance,
+
+		LogMaxSize:  DefaultLogMaxSize,
+		LogMaxFiles: DefaultLogMaxFiles,
+
+		ReportWorkers: runtime.NumCPU(),
+
+		ReportPastWindow:   defaultReportWindow,
+		ReportFutureWindow: defaultReportWindow,
+
+		RetainedPeriods: defaultRetainedPeriods,
+	}
+}
+
+// reportLimits returns the budgets of the report packets, with the defaults
+// filled in for the limits that were left at zero.
+func (opts ServerOptions) reportLimits() (deviceInterval time.Duration, deviceBurst int64, unknownInterval time.Duration, unknownBurst int64) {
+	deviceInterval, deviceBurst = opts.DeviceReportInterval, opts.DeviceReportBurst
+	unknownInterval, unknownBurst = opts.UnknownReportInterval, opts.UnknownReportBurst
+	if deviceInterval == 0 {
+		deviceInterval = deviceReportInterval
+	}
+	if deviceBurst == 0 {
+		deviceBurst = deviceReportBurst
+	}
+	if unknownInterval == 0 {
+		unknownInterval = unknownReportInterval
+	}
+	if unknownBurst == 0 {
+		unknownBurst = unknownReportBurst
+	}
+	return deviceInterval, deviceBurst, unknownInterval, unknownBurst
+}
+
+// LocalOnly binds all of the listeners to 127.0.0.1 and limits the internal
+// APIs to loopback callers, for servers that sit behind a reverse proxy.
+func (opts *ServerOptions) LocalOnly() {
+	opts.HttpAddr = "127.0.0.1"
+	opts.TcpAddr = "127.0.0.1"
+	opts.UdpAddr = "127.0.0.1"
+	opts.LoopbackInternalAPIs = true
+}
+
+// bindAddrs returns the addresses that the http, tcp, and udp listeners
+// should bind to, filling in the default for empty addresses and removing the
+// brackets around IPv6 addresses.
+func (opts ServerOptions) bindAddrs() (httpAddr string, tcpAddr string, udpAddr string, err error) {
+	addrs := []string{opts.HttpAddr, opts.TcpAddr, opts.UdpAddr}
+	for i := range addrs {
+		if addrs[i] == "" {
+			addrs[i] = serverIP
+		}
+		addrs[i] = glow.TrimBrackets(addrs[i])
+		if net.ParseIP(addrs[i]) == nil {
+			return "", "", "", fmt.Errorf("invalid bind address %q, must be an IP address", addrs[i])
+		}
+	}
+	return addrs[0], addrs[1], addrs[2], nil
+}
+
+// reportWorkers returns the number of report workers that should be
+// launched, filling in the default for a zero value.
+func (opts ServerOptions) reportWorkers() (int, error) {
+	if opts.ReportWorkers < 0 {
+		return 0, fmt.Errorf("invalid number of report workers %v, must not be negative", opts.ReportWorkers)
+	}
+	if opts.ReportWorkers == 0 {
+		return runtime.NumCPU(), nil
+	}
+	return opts.ReportWorkers, nil
+}
+
+// reportWindows returns the past and the future report windows, filling in the
+// default for zero values. The reports of both windows have to be in memory
+// at all times, so the past window can't reach back past the start of the
+// reports in memory after a migration, and the future window can't reach past
+// their end before a migration that is running late.
+func (opts ServerOptions) reportWindows() (past uint32, future uint32, err error) {
+	past, future = opts.ReportPastWindow, opts.ReportFutureWindow
+	if past == 0 {
+		past = defaultReportWindow
+	}
+	if future == 0 {
+		future = defaultReportWindow
+	}
+	if maxPast := uint32(reportMigrationThreshold - 2016); past > maxPast {
+		return 0, 0, fmt.Errorf("invalid report past window %v, must be at most %v", past, maxPast)
+	}
+	if maxFuture := uint32(4032 - reportMigrationThreshold - reportMigrationSlack); future > maxFuture {
+		return 0, 0, fmt.Errorf("invalid report future window %v, must be at most %v", future, maxFuture)
+	}
+	return past, future, nil
+}
+
+// finalizationDelay returns the finalization delay, filling in the provided
+// past report window for a zero value. A week has to be finalized before it
+// gets rotated out of memory.
+func (opts ServerOptions) finalizationDelay(past uint32) (uint32, error) {
+	delay := opts.FinalizationDelay
+	if delay == 0 {
+		delay = past
+	}
+	if maxDelay := uint32(reportMigrationThreshold - 2016); delay > maxDelay {
+		return 0, fmt.Errorf("invalid finalization delay %v, must be at most %v", delay, maxDelay)
+	}
+	return delay, nil
+}
+
+// keyRotationOverlap returns the overlap of device key rotations, filling in
+// the default for a zero value.
+func (opts ServerOptions) keyRotationOverlap() uint32 {
+	if opts.KeyRotationOverlap == 0 {
+		return defaultKeyRotationOverlap
+	}
+	return opts.KeyRotationOverlap
+}
+
+// minFreeDisk returns the free disk space below which the server stops
+// accepting reports, filling in the default for a zero value. 0 means that
+// the check is disabled.
+func (opts ServerOptions) minFreeDisk() uint64 {
+	if opts.MinFreeDisk < 0 {
+		return 0
+	}
+	if opts.MinFreeDisk == 0 {
+		return defaultMinFreeDisk
+	}
+	return uint64(opts.MinFreeDisk)
+}
+
+// retainedPeriods returns the number of retained weeks, which must not be
+// negative.
+func (opts ServerOptions) retainedPeriods() (int, error) {
+	if opts.RetainedPeriods < 0 {
+		return 0, fmt.Errorf("invalid number of retained periods %v, must not be negative", opts.RetainedPeriods)
+	}
+	return opts.RetainedPeriods, nil
+}
+
+// stateChangeBuffer returns the number of state changes that are kept for the
+// stats delta, filling in the default for a zero value.
+func (opts ServerOptions) stateChangeBuffer() (int, error) {
+	if opts.StateChangeBuffer < 0 {
+		return 0, fmt.Errorf("invalid state change buffer %v, must not be negative", opts.StateChangeBuffer)
+	}
+	if opts.StateChangeBuffer == 0 {
+		return defaultStateChangeBuffer, nil
+	}
+	return opts.StateChangeBuffer, nil
+}
+
+// lateReportThreshold returns the late report threshold, filling in the
+// default for a zero value.
+func (opts ServerOptions) lateReportThreshold() uint32 {
+	if opts.LateReportThreshold == 0 {
+		return defaultLateReportThreshold
+	}
+	return opts.LateReportThreshold
+}
+
+// statsSnapshotMaxAge returns the maximum age of a stale stats snapshot,
+// filling in the default for a zero value.
+func (opts ServerOptions) statsSnapshotMaxAge() time.Duration {
+	if opts.StatsSnapshotMaxAge == 0 {
+		return defaultStatsSnapshotMaxAge
+	}
+	return opts.StatsSnapshotMaxAge
+}
+
+// pageCursorTTL returns how long the snapshot of a cursor is kept, filling in
+// the default for a zero value.
+func (opts ServerOptions) pageCursorTTL() time.Duration {
+	if opts.PageCursorTTL == 0 {
+		return defaultPageCursorTTL
+	}
+	return opts.PageCursorTTL
+}
+
+// retryQueueLimits returns the maximum number of entries and the maximum age
+// of the retry queues, filling in the defaults for zero values.
+func (opts ServerOptions) retryQueueLimits() (int, time.Duration, error) {
+	maxEntries, maxAge := opts.RetryQueueMaxEntries, opts.RetryQueueMaxAge
+	if maxEntries < 0 {
+		return 0, 0, fmt.Errorf("invalid retry queue size %v, must not be negative", maxEntries)
+	}
+	if maxAge < 0 {
+		return 0, 0, fmt.Errorf("invalid retry queue age %v, must not be negative", maxAge)
+	}
+	if maxEntries == 0 {
+		maxEntries = defaultRetryQueueMaxEntries
+	}
+	if maxAge == 0 {
+		maxAge = defaultRetryQueueMaxAge
+	}
+	return maxEntries, maxAge, nil
+}
+
+// savePortsFile writes the ports that the listeners ended up using to the
+// ports file, which allows provisioning tools to discover how to reach the
+// server. The ports are written as HttpPort, TcpPort, UdpPort, each as a
+// LittleEndian uint16.
+func (gcas *GCAServer) savePortsFile() error {
+	var data [6]byte
+	binary.LittleEndian.PutUint16(data[0:], gcas.httpPort)
+	binary.LittleEndian.PutUint16(data[2:], gcas.tcpPort)
+	binary.LittleEndian.PutUint16(data[4:], gcas.udpPort)
+	path := filepath.Join(gcas.baseDir, PortsFile)
+	if err := writeFileAtomic(path, data[:], 0644); err != nil {
+		return fmt.Errorf("unable to write ports file: %v", err)
+	}
+	return nil
+}
+
+// LoadPortsFile reads the ports file from the provided server directory and
+// returns the http, tcp, and udp ports in that order.
+func LoadPortsFile(baseDir string) (httpPort uint16, tcpPort uint16, udpPort uint16, err error) {
+	data, err := os.ReadFile(filepath.Join(baseDir, PortsFile))
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("unable to read ports file: %v", err)
+	}
+	if len(data) != 6 {
+		return 0, 0, 0, fmt.Errorf("ports file has an unexpected size: %v", len(data))
+	}
+	httpPort = binary.LittleEndian.Uint16(data[0:])
+	tcpPort = binary.LittleEndian.Uint16(data[2:])
+	udpPort = binary.LittleEndian.Uint16(data[4:])
+	return httpPort, tcpPort, udpPort, nil
+}
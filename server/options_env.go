@@ -0,0 +1,198 @@
+package server
+
+// options_env.go reads the settings of a GCAServer from environment
+// variables, for platforms like Kubernetes where a container gets configured
+// through its environment rather than through flags and a home directory.
+//
+// gca-server resolves every setting with the same precedence: a flag beats
+// the environment variable, and the environment variable beats the default.
+// It gets there by loading the environment first and using the result as the
+// defaults of its flags.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvConfig is the configuration that was read from the environment.
+type EnvConfig struct {
+	Dir          string // GCA_DATA_DIR, or the older GCA_SERVER_DIR
+	InternalTest bool   // GCA_INTERNAL_TEST
+	LocalOnly    bool   // GCA_LOCAL_ONLY
+
+	Options ServerOptions
+}
+
+// envVar is a single environment variable and the function that applies its
+// value.
+type envVar struct {
+	name string
+	set  func(string) error
+}
+
+// envVars returns the environment variables that point into the config.
+func (cfg *EnvConfig) envVars() []envVar {
+	opts := &cfg.Options
+	return []envVar{
+		{"GCA_DATA_DIR", envString(&cfg.Dir)},
+		{"GCA_INTERNAL_TEST", envBool(&cfg.InternalTest)},
+		{"GCA_LOCAL_ONLY", envBool(&cfg.LocalOnly)},
+		{"GCA_HTTP_PORT", envPort(&opts.HttpPort)},
+		{"GCA_TCP_PORT", envPort(&opts.TcpPort)},
+		{"GCA_UDP_PORT", envPort(&opts.UdpPort)},
+		{"GCA_HTTP_ADDR", envString(&opts.HttpAddr)},
+		{"GCA_TCP_ADDR", envString(&opts.TcpAddr)},
+		{"GCA_UDP_ADDR", envString(&opts.UdpAddr)},
+		{"GCA_LOOPBACK_INTERNAL_APIS", envBool(&opts.LoopbackInternalAPIs)},
+		{"GCA_CAPACITY_TOLERANCE", func(s string) (err error) {
+			opts.CapacityTolerance, err = strconv.ParseUint(s, 10, 64)
+			return err
+		}},
+		{"GCA_VALIDATION_MODES", func(s string) (err error) {
+			opts.ValidationModes, err = ParseValidationModes(s)
+			if err != nil {
+				return err
+			}
+			return validateValidationModes(opts.ValidationModes)
+		}},
+		{"GCA_LOG_FORMAT", func(s string) (err error) {
+			// JSON logs are meant for a collector, which reads
+			// stdout in a container.
+			opts.LogFormat, err = ParseLogFormat(s)
+			opts.LogStdout = opts.LogFormat == LogFormatJSON
+			return err
+		}},
+		{"GCA_LOG_STDOUT", envBool(&opts.LogStdout)},
+		{"GCA_LOG_MAX_SIZE", func(s string) (err error) {
+			opts.LogMaxSize, err = strconv.ParseInt(s, 10, 64)
+			return err
+		}},
+		{"GCA_LOG_MAX_FILES", envInt(&opts.LogMaxFiles)},
+		{"GCA_TLS_CERT", envString(&opts.TLSCertFile)},
+		{"GCA_TLS_KEY", envString(&opts.TLSKeyFile)},
+		{"GCA_REPORT_WORKERS", envInt(&opts.ReportWorkers)},
+		{"GCA_DEFAULT_REGION", envString(&opts.DefaultRegion)},
+		{"GCA_PRIVATE_LOCATIONS", envBool(&opts.PrivateLocations)},
+		{"GCA_LOCATION_REDACTION", func(s string) (err error) {
+			opts.LocationRedaction, err = ParseLocationRedaction(s)
+			return err
+		}},
+		{"GCA_WATTTIME_URL", envString(&opts.WattTimeURL)},
+		{"GCA_WATTTIME_USER", envString(&opts.WattTimeUsername)},
+		{"GCA_WATTTIME_PASSWORD", envString(&opts.WattTimePassword)},
+		{"GCA_REPORT_PAST_WINDOW", envTimeslots(&opts.ReportPastWindow)},
+		{"GCA_REPORT_FUTURE_WINDOW", envTimeslots(&opts.ReportFutureWindow)},
+		{"GCA_FINALIZATION_DELAY", envTimeslots(&opts.FinalizationDelay)},
+		{"GCA_KEY_ROTATION_OVERLAP", envTimeslots(&opts.KeyRotationOverlap)},
+		{"GCA_MIN_FREE_DISK", func(s string) (err error) {
+			opts.MinFreeDisk, err = strconv.ParseInt(s, 10, 64)
+			return err
+		}},
+		{"GCA_RETAINED_PERIODS", envInt(&opts.RetainedPeriods)},
+		{"GCA_STATE_CHANGE_BUFFER", envInt(&opts.StateChangeBuffer)},
+		{"GCA_DISABLE_REPORT_RECEIPTS", envBool(&opts.DisableReportReceipts)},
+		{"GCA_LATE_REPORT_THRESHOLD", envTimeslots(&opts.LateReportThreshold)},
+		{"GCA_RETRY_QUEUE_MAX_ENTRIES", envInt(&opts.RetryQueueMaxEntries)},
+		{"GCA_RETRY_QUEUE_MAX_AGE", envDuration(&opts.RetryQueueMaxAge)},
+		{"GCA_DEBUG", envBool(&opts.Debug)},
+		{"GCA_STORAGE", func(s string) (err error) {
+			opts.StorageBackend, err = ParseStorageBackend(s)
+			return err
+		}},
+		{"GCA_TENANTS", func(s string) error {
+			opts.Tenants = ParseTenantList(s)
+			return validateTenants(opts.Tenants)
+		}},
+	}
+}
+
+// LoadEnvConfig reads the configuration from the environment, starting from
+// DefaultServerOptions. getenv is usually os.Getenv. Variables that are unset
+// or empty keep their default, and a variable that can't be parsed is an
+// error. GCA_LOG_FORMAT=json also sends the log to stdout, unless
+// GCA_LOG_STDOUT says otherwise.
+func LoadEnvConfig(getenv func(string) string) (EnvConfig, error) {
+	cfg := EnvConfig{
+		Dir:     getenv("GCA_SERVER_DIR"),
+		Options: DefaultServerOptions(),
+	}
+	for _, v := range cfg.envVars() {
+		value := strings.TrimSpace(getenv(v.name))
+		if value == "" {
+			continue
+		}
+		if err := v.set(value); err != nil {
+			return EnvConfig{}, fmt.Errorf("invalid value for %v: %v", v.name, err)
+		}
+	}
+
+	// systemd sets its own variables when the server runs as a notify
+	// unit.
+	cfg.Options.NotifySocket = getenv("NOTIFY_SOCKET")
+	interval, err := parseWatchdogInterval(getenv("WATCHDOG_USEC"), getenv("WATCHDOG_PID"))
+	if err != nil {
+		return EnvConfig{}, fmt.Errorf("invalid value for WATCHDOG_USEC: %v", err)
+	}
+	cfg.Options.WatchdogInterval = interval
+	return cfg, nil
+}
+
+// envString returns a setter for a string setting.
+func envString(dest *string) func(string) error {
+	return func(s string) error {
+		*dest = s
+		return nil
+	}
+}
+
+// envBool returns a setter for a boolean setting, which accepts the values of
+// strconv.ParseBool.
+func envBool(dest *bool) func(string) error {
+	return func(s string) (err error) {
+		*dest, err = strconv.ParseBool(s)
+		return err
+	}
+}
+
+// envInt returns a setter for an integer setting.
+func envInt(dest *int) func(string) error {
+	return func(s string) (err error) {
+		*dest, err = strconv.Atoi(s)
+		return err
+	}
+}
+
+// envDuration returns a setter for a duration, which accepts the values of
+// time.ParseDuration.
+func envDuration(dest *time.Duration) func(string) error {
+	return func(s string) (err error) {
+		*dest, err = time.ParseDuration(s)
+		return err
+	}
+}
+
+// envPort returns a setter for a port.
+func envPort(dest *uint16) func(string) error {
+	return func(s string) error {
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return err
+		}
+		*dest = uint16(port)
+		return nil
+	}
+}
+
+// envTimeslots returns a setter for a number of timeslots.
+func envTimeslots(dest *uint32) func(string) error {
+	return func(s string) error {
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return err
+		}
+		*dest = uint32(n)
+		return nil
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestLoadEnvConfig checks that the environment variables override the
+// defaults, and that invalid values are refused.
+func TestLoadEnvConfig(t *testing.T) {
+	// Without any variables the defaults are used.
+	cfg, err := LoadEnvConfig(func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Dir != "" || cfg.InternalTest || !reflect.DeepEqual(cfg.Options, DefaultServerOptions()) {
+		t.Fatalf("unexpected config without variables: %+v", cfg)
+	}
+
+	env := map[string]string{
+		"GCA_SERVER_DIR":         "/old",
+		"GCA_DATA_DIR":           "/data",
+		"GCA_INTERNAL_TEST":      "true",
+		"GCA_HTTP_PORT":          "8080",
+		"GCA_UDP_PORT":           " 9090 ",
+		"GCA_HTTP_ADDR":          "10.0.0.1",
+		"GCA_LOG_FORMAT":         "json",
+		"GCA_LOG_MAX_FILES":      "3",
+		"GCA_WATTTIME_USER":      "user",
+		"GCA_WATTTIME_PASSWORD":  "pass",
+		"GCA_REPORT_PAST_WINDOW": "100",
+		"GCA_DEBUG":              "1",
+		"GCA_STORAGE":            "sqlite",
+		"GCA_TENANTS":            "solar-a, solar-b,",
+	}
+	getenv := func(key string) string { return env[key] }
+	cfg, err = LoadEnvConfig(getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DefaultServerOptions()
+	expected.HttpPort = 8080
+	expected.UdpPort = 9090
+	expected.HttpAddr = "10.0.0.1"
+	expected.LogFormat = LogFormatJSON
+	expected.LogStdout = true
+	expected.LogMaxFiles = 3
+	expected.WattTimeUsername = "user"
+	expected.WattTimePassword = "pass"
+	expected.ReportPastWindow = 100
+	expected.Debug = true
+	expected.StorageBackend = StorageBackendSQLite
+	expected.Tenants = []string{"solar-a", "solar-b"}
+	if cfg.Dir != "/data" || !cfg.InternalTest || cfg.LocalOnly {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Options, expected) {
+		t.Fatalf("unexpected options:\n%+v\n%+v", cfg.Options, expected)
+	}
+
+	// GCA_SERVER_DIR still works on its own, and the log can be kept in a
+	// file while using the JSON format.
+	delete(env, "GCA_DATA_DIR")
+	env["GCA_LOG_STDOUT"] = "false"
+	cfg, err = LoadEnvConfig(getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Dir != "/old" || cfg.Options.LogFormat != LogFormatJSON || cfg.Options.LogStdout {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+
+	for key, value := range map[string]string{
+		"GCA_HTTP_PORT":          "65536",
+		"GCA_TCP_PORT":           "http",
+		"GCA_LOG_FORMAT":         "xml",
+		"GCA_DEBUG":              "yes please",
+		"GCA_REPORT_WORKERS":     "1.5",
+		"GCA_REPORT_PAST_WINDOW": "-1",
+		"GCA_STORAGE":            "postgres",
+		"GCA_TENANTS":            "a,Bad",
+	} {
+		_, err := LoadEnvConfig(func(k string) string {
+			if k == key {
+				return value
+			}
+			return ""
+		})
+		if err == nil {
+			t.Fatalf("expected %v=%v to be refused", key, value)
+		}
+	}
+}
+
+// TestEnvOnlyServer boots a server that is configured entirely through the
+// environment, the way it runs in a container: the WattTime credentials come
+// from the environment and the log goes to stdout, so nothing but the data
+// dir has to be writable.
+func TestEnvOnlyServer(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tempPubKey, _ := glow.GenerateKeyPair()
+	if err := serverStorage(dir).WriteFile(GCATempPubkeyFile, tempPubKey[:], 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"GCA_DATA_DIR":          dir,
+		"GCA_HTTP_PORT":         "0",
+		"GCA_TCP_PORT":          "0",
+		"GCA_UDP_PORT":          "0",
+		"GCA_LOG_FORMAT":        "json",
+		"GCA_WATTTIME_USER":     "env-user",
+		"GCA_WATTTIME_PASSWORD": "env-pass",
+	}
+	cfg, err := LoadEnvConfig(func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewGCAServerWithOptions(cfg.Dir, false, cfg.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if username, password := server.managedWattTimeCredentials(); username != "env-user" || password != "env-pass" {
+		t.Fatal("credentials were not taken from the environment:", username, password)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "server.log")); !os.IsNotExist(err) {
+		t.Fatal("expected the log to go to stdout:", err)
+	}
+
+	// A reload keeps the credentials of the environment.
+	if _, err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if username, _ := server.managedWattTimeCredentials(); username != "env-user" {
+		t.Fatal("reload replaced the credentials:", username)
+	}
+}
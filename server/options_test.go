@@ -0,0 +1,333 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// freePorts asks the OS for a tcp port and a udp port that are currently free.
+func freePorts(t *testing.T) (tcp1 uint16, tcp2 uint16, udp uint16) {
+	l1, err := net.Listen("tcp", serverIP+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	l2, err := net.Listen("tcp", serverIP+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	u, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(serverIP)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	tcp1 = uint16(l1.Addr().(*net.TCPAddr).Port)
+	tcp2 = uint16(l2.Addr().(*net.TCPAddr).Port)
+	udp = uint16(u.LocalAddr().(*net.UDPAddr).Port)
+	return tcp1, tcp2, udp
+}
+
+// TestServerOptionsPorts checks that the ports provided in the options are
+// used by the listeners and recorded in the ports file.
+func TestServerOptionsPorts(t *testing.T) {
+	// Grab a set of free ports, they are closed again before the server
+	// launches.
+	httpP, tcpP, udpP := freePorts(t)
+	opts := ServerOptions{
+		HttpPort: httpP,
+		TcpPort:  tcpP,
+		UdpPort:  udpP,
+	}
+	server, dir, _, _, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	h, tc, u := server.Ports()
+	if h != httpP || tc != tcpP || u != udpP {
+		t.Fatal("server is not using the requested ports:", h, tc, u, opts)
+	}
+	fh, ftc, fu, err := LoadPortsFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fh != h || ftc != tc || fu != u {
+		t.Fatal("ports file does not match the ports in use:", fh, ftc, fu)
+	}
+}
+
+// TestServerOptionsEphemeralPorts checks that the default test options
+// result in the OS picking ports, and that the ports file records the ports
+// that were picked.
+func TestServerOptionsEphemeralPorts(t *testing.T) {
+	server, dir, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	h, tc, u := server.Ports()
+	if h == 0 || tc == 0 || u == 0 {
+		t.Fatal("expected ephemeral ports to be assigned:", h, tc, u)
+	}
+	fh, ftc, fu, err := LoadPortsFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fh != h || ftc != tc || fu != u {
+		t.Fatal("ports file does not match the ports in use:", fh, ftc, fu)
+	}
+}
+
+// nonLoopbackIP returns an IPv4 address of this machine that isn't a loopback
+// address, or nil if there is none.
+func nonLoopbackIP(t *testing.T) net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+// TestServerOptionsBindAddrs checks that a server launched with LocalOnly is
+// bound to loopback and can't be reached through another interface, while a
+// server bound to all interfaces can.
+func TestServerOptionsBindAddrs(t *testing.T) {
+	opts := ServerOptions{}
+	opts.LocalOnly()
+	server, _, _, _, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if host, _, _ := net.SplitHostPort(server.httpServer.Addr); host != "127.0.0.1" {
+		t.Fatal("http api is not bound to loopback:", server.httpServer.Addr)
+	}
+	dial := func(ip net.IP, port uint16) error {
+		conn, err := net.Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	loopback := net.ParseIP("127.0.0.1")
+	if dial(loopback, server.httpPort) != nil || dial(loopback, server.tcpPort) != nil {
+		t.Fatal("loopback server can't be reached on loopback")
+	}
+
+	ip := nonLoopbackIP(t)
+	if ip == nil {
+		t.Skip("no non-loopback interface available")
+	}
+	if dial(ip, server.httpPort) == nil || dial(ip, server.tcpPort) == nil {
+		t.Error("loopback server accepted a connection on", ip)
+	}
+
+	// A server bound to every interface can be reached on the same IP.
+	open, _, _, _, err := SetupTestEnvironmentWithOptions(t.Name()+"-open", ServerOptions{HttpAddr: "0.0.0.0", TcpAddr: "0.0.0.0", UdpAddr: "0.0.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	if err := dial(ip, open.httpPort); err != nil {
+		t.Error("open http api can't be reached:", err)
+	}
+	if err := dial(ip, open.tcpPort); err != nil {
+		t.Error("open sync listener can't be reached:", err)
+	}
+}
+
+// TestServerOptionsBadBindAddr checks that a bind address which isn't an IP
+// is refused at startup.
+func TestServerOptionsBadBindAddr(t *testing.T) {
+	_, _, _, _, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{TcpAddr: "example.com"})
+	if err == nil {
+		t.Fatal("server launched with an invalid bind address")
+	}
+}
+
+// TestLoopbackInternalAPIs checks that the internal APIs can be limited to
+// loopback callers.
+func TestLoopbackInternalAPIs(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	status := func(gcas *GCAServer, remote string) int {
+		req := httptest.NewRequest("GET", "/api/int/wt-signal-index", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		gcas.loopbackOnly(ok)(rec, req)
+		return rec.Code
+	}
+	restricted := &GCAServer{staticLoopbackIntApis: true}
+	for _, remote := range []string{"127.0.0.1:4000", "[::1]:4000"} {
+		if code := status(restricted, remote); code != http.StatusOK {
+			t.Errorf("loopback caller %v was refused: %v", remote, code)
+		}
+	}
+	for _, remote := range []string{"192.0.2.1:4000", "[2001:db8::1]:4000", "garbage"} {
+		if code := status(restricted, remote); code != http.StatusForbidden {
+			t.Errorf("remote caller %v was not refused: %v", remote, code)
+		}
+	}
+	if code := status(&GCAServer{}, "192.0.2.1:4000"); code != http.StatusOK {
+		t.Error("remote caller was refused without the restriction:", code)
+	}
+}
+
+// TestServerOptionsReportWindows checks the defaults and the limits of the
+// report windows.
+func TestServerOptionsReportWindows(t *testing.T) {
+	past, future, err := ServerOptions{}.reportWindows()
+	if err != nil || past != defaultReportWindow || future != defaultReportWindow {
+		t.Fatal("unexpected default report windows:", past, future, err)
+	}
+	past, future, err = ServerOptions{ReportPastWindow: reportMigrationThreshold - 2016, ReportFutureWindow: 4032 - reportMigrationThreshold - reportMigrationSlack}.reportWindows()
+	if err != nil || past != reportMigrationThreshold-2016 || future != 4032-reportMigrationThreshold-reportMigrationSlack {
+		t.Fatal("unexpected report windows:", past, future, err)
+	}
+	if _, _, err := (ServerOptions{ReportPastWindow: reportMigrationThreshold - 2016 + 1}).reportWindows(); err == nil {
+		t.Fatal("expected a past window that reaches out of memory to be refused")
+	}
+	if _, _, err := (ServerOptions{ReportFutureWindow: 4032 - reportMigrationThreshold - reportMigrationSlack + 1}).reportWindows(); err == nil {
+		t.Fatal("expected a future window that reaches out of memory to be refused")
+	}
+	if _, err := NewGCAServerWithOptions(t.TempDir(), false, ServerOptions{ReportPastWindow: 5000}); err == nil || !strings.Contains(err.Error(), "report past window") {
+		t.Fatal("expected the server to refuse an invalid report window")
+	}
+}
+
+// ipv6Loopback skips the test if the machine can't bind to the IPv6 loopback
+// address.
+func ipv6Loopback(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback is not available:", err)
+	}
+	l.Close()
+}
+
+// TestServerOptionsIPv6 checks that a server bound to the IPv6 loopback
+// address accepts reports, sync requests, and api calls over IPv6, and that
+// bind addresses may be written with brackets.
+func TestServerOptionsIPv6(t *testing.T) {
+	ipv6Loopback(t)
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{HttpAddr: "[::1]", TcpAddr: "::1", UdpAddr: "[::1]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if addr := server.httpDialAddr(); addr != glow.HostPort("::1", server.httpPort) {
+		t.Fatal("http api is not bound to ipv6 loopback:", addr)
+	}
+	if addr := server.udpDialAddr(); addr != glow.HostPort("::1", server.udpPort) {
+		t.Fatal("udp listener is not bound to ipv6 loopback:", addr)
+	}
+
+	// Push a report over IPv6 and read it back through the sync listener.
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := server.SubmitTestReport(ea.ShortID, 2, 50, ePriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Status != glow.ReportAckAccepted {
+		t.Fatal("report was not accepted:", ack.Status)
+	}
+	_, bitfield, err := server.requestEquipmentBitfieldAt("[::1]", ea.ShortID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bitfield[0]&(1<<2) == 0 {
+		t.Fatal("report is missing from the bitfield")
+	}
+	resp, err := http.Get("http://" + glow.HostPort("::1", server.httpPort) + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("healthz over ipv6 returned", resp.StatusCode)
+	}
+
+	// The IPv4 loopback address is not part of the IPv6 bind.
+	if conn, err := net.Dial("tcp", glow.HostPort("127.0.0.1", server.tcpPort)); err == nil {
+		conn.Close()
+		t.Error("ipv6 sync listener accepted an ipv4 connection")
+	}
+}
+
+// TestServerOptionsDualStack checks that a server bound to the IPv6 wildcard
+// address accepts reports over both IPv4 and IPv6.
+func TestServerOptionsDualStack(t *testing.T) {
+	ipv6Loopback(t)
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{HttpAddr: "::", TcpAddr: "::", UdpAddr: "::"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, host := range []string{"127.0.0.1", "::1"} {
+		timeslot := uint32(2 + i)
+		er := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: timeslot, PowerOutput: 50}
+		er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+		conn, err := net.Dial("udp", glow.HostPort(host, server.udpPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write(er.Serialize())
+		if err == nil {
+			err = conn.SetReadDeadline(time.Now().Add(time.Second))
+		}
+		buf := make([]byte, 256)
+		var n int
+		if err == nil {
+			n, err = conn.Read(buf)
+		}
+		conn.Close()
+		if err != nil {
+			t.Fatalf("no ack over %v: %v", host, err)
+		}
+		ack, err := glow.DeserializeReportAck(buf[:n])
+		if err != nil || ack.Status != glow.ReportAckAccepted || ack.Timeslot != timeslot {
+			t.Fatalf("unexpected ack over %v: %v %v", host, ack, err)
+		}
+		_, bitfield, err := server.requestEquipmentBitfieldAt(host, ea.ShortID)
+		if err != nil {
+			t.Fatalf("sync over %v failed: %v", host, err)
+		}
+		if bitfield[0]&(1<<timeslot) == 0 {
+			t.Fatalf("report sent over %v is missing from the bitfield", host)
+		}
+	}
+}
+
+// TestServerOptionsBracketedBindAddr checks that the brackets around IPv6
+// bind addresses are removed, and that brackets around anything else are
+// refused.
+func TestServerOptionsBracketedBindAddr(t *testing.T) {
+	httpAddr, tcpAddr, udpAddr, err := ServerOptions{HttpAddr: "[::1]", TcpAddr: "::1", UdpAddr: "[2001:db8::1]"}.bindAddrs()
+	if err != nil || httpAddr != "::1" || tcpAddr != "::1" || udpAddr != "2001:db8::1" {
+		t.Fatal("unexpected bind addresses:", httpAddr, tcpAddr, udpAddr, err)
+	}
+	if _, _, _, err := (ServerOptions{UdpAddr: "[example.com]"}).bindAddrs(); err == nil {
+		t.Fatal("expected a bracketed host name to be refused")
+	}
+}
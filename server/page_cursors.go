@@ -0,0 +1,231 @@
+package server
+
+// page_cursors.go lets callers page through the all-device-stats endpoints and
+// the v2 equipment listing without missing or repeating devices. Paging with
+// an offset breaks as soon as a device gets authorized between two requests,
+// which shifts every device after it by one. Instead, a page that was cut off
+// by the limit comes with an opaque next_cursor, which names the snapshot that
+// the page was served from and the last device on the page. A request with
+// the cursor gets the next page from the same snapshot, so the set of devices
+// stays the same for the whole pagination, no matter what changes on the
+// server in the meantime.
+//
+// The stats come from the snapshots of stats_snapshot.go, and the equipment
+// listing gets a snapshot of its own when it is paged. The server holds on to
+// a snapshot for PageCursorTTL after it last handed out a cursor for it, and
+// to at most maxPageSnapshots snapshots at once. A cursor whose snapshot is
+// gone, which includes every cursor from before a restart, gets a 410 with
+// CURSOR_EXPIRED, and the caller has to start the pagination over.
+//
+// The devices are ordered by ShortID, so a cursor continues with the first
+// device after the last one it names, which also keeps working if the caller
+// changes the other filters between the pages.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// maxPageSnapshots is the number of snapshots that the server holds on to for
+// cursors. A stats snapshot takes 32 kB per device.
+const maxPageSnapshots = 8
+
+// pageCursorSize is the size of a decoded pageCursor.
+const pageCursorSize = 1 + 8 + 4 + 8 + 1 + 4 + 32
+
+// The kinds of listings that can be paged with a cursor.
+const (
+	pageKindStats     byte = 1 // The all-device-stats of a week
+	pageKindEquipment byte = 2 // The v2 equipment listing
+)
+
+// errCursorExpired is returned for a cursor whose snapshot the server no
+// longer has.
+var errCursorExpired = withCode(ErrCodeCursorExpired, errors.New("the snapshot of the cursor is no longer available, restart the pagination without a cursor"))
+
+// pageCursor is the position of a caller in a paged listing.
+type pageCursor struct {
+	kind    byte
+	bootID  [8]byte // See GCAServer.staticBootID, versions start over after a restart
+	week    uint32  // The timeslot offset of the stats, zero for the equipment
+	version uint64  // The state version of the snapshot
+
+	// The last device on the page. Devices without a ShortID are sorted
+	// after the others by public key, see pageDeviceStats.
+	known   bool
+	shortID uint32
+	pubKey  glow.PublicKey
+}
+
+// encode returns the opaque form of the cursor that goes into the responses.
+func (pc pageCursor) encode() string {
+	b := make([]byte, 0, pageCursorSize)
+	b = append(b, pc.kind)
+	b = append(b, pc.bootID[:]...)
+	b = binary.LittleEndian.AppendUint32(b, pc.week)
+	b = binary.LittleEndian.AppendUint64(b, pc.version)
+	if pc.known {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = binary.LittleEndian.AppendUint32(b, pc.shortID)
+	b = append(b, pc.pubKey[:]...)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodePageCursor reverses a call to encode.
+func decodePageCursor(s string) (pageCursor, error) {
+	var pc pageCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) != pageCursorSize || b[21] > 1 {
+		return pc, withCode(ErrCodeMalformedRequest, errors.New("invalid cursor"))
+	}
+	pc.kind = b[0]
+	copy(pc.bootID[:], b[1:9])
+	pc.week = binary.LittleEndian.Uint32(b[9:13])
+	pc.version = binary.LittleEndian.Uint64(b[13:21])
+	pc.known = b[21] == 1
+	pc.shortID = binary.LittleEndian.Uint32(b[22:26])
+	copy(pc.pubKey[:], b[26:])
+	return pc, nil
+}
+
+// after returns whether a device comes after the last device of the cursor,
+// in the order of pageDeviceStats.
+func (pc pageCursor) after(known bool, shortID uint32, pubKey glow.PublicKey) bool {
+	if known != pc.known {
+		return pc.known
+	}
+	if known && shortID != pc.shortID {
+		return shortID > pc.shortID
+	}
+	return bytes.Compare(pubKey[:], pc.pubKey[:]) > 0
+}
+
+// pageSnapshotKey identifies a snapshot that cursors point into.
+type pageSnapshotKey struct {
+	kind    byte
+	week    uint32
+	version uint64
+}
+
+// pageSnapshot is a snapshot that the server holds on to for cursors. The
+// value is a *statsSnapshot or an *equipmentListing.
+type pageSnapshot struct {
+	value   interface{}
+	expires time.Time
+}
+
+// pageSnapshotCache holds the snapshots that cursors point into.
+type pageSnapshotCache struct {
+	snapshots map[pageSnapshotKey]*pageSnapshot
+	mu        sync.Mutex
+}
+
+// equipmentListing is a snapshot of the v2 equipment listing, in order of
+// ShortID.
+type equipmentListing struct {
+	equipment []V2Equipment
+	version   uint64
+}
+
+// newPageCursor returns a cursor that points after the provided device of a
+// snapshot, and holds on to the snapshot.
+func (s *GCAServer) newPageCursor(key pageSnapshotKey, value interface{}, known bool, shortID uint32, pubKey glow.PublicKey) string {
+	pc := pageCursor{
+		kind:    key.kind,
+		week:    key.week,
+		version: key.version,
+		known:   known,
+		shortID: shortID,
+		pubKey:  pubKey,
+	}
+	hex.Decode(pc.bootID[:], []byte(s.staticBootID))
+
+	c := s.staticPageSnapshots
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := s.now()
+	for k, ps := range c.snapshots {
+		if !now.Before(ps.expires) {
+			delete(c.snapshots, k)
+		}
+	}
+	if _, exists := c.snapshots[key]; !exists && len(c.snapshots) >= maxPageSnapshots {
+		var oldest pageSnapshotKey
+		for k, ps := range c.snapshots {
+			if old, exists := c.snapshots[oldest]; !exists || ps.expires.Before(old.expires) {
+				oldest = k
+			}
+		}
+		delete(c.snapshots, oldest)
+	}
+	c.snapshots[key] = &pageSnapshot{value: value, expires: now.Add(s.staticPageCursorTTL)}
+	return pc.encode()
+}
+
+// pageSnapshotValue returns the snapshot that a cursor points into, or
+// errCursorExpired if the server no longer has it.
+func (s *GCAServer) pageSnapshotValue(pc pageCursor) (interface{}, error) {
+	var bootID [8]byte
+	hex.Decode(bootID[:], []byte(s.staticBootID))
+	if pc.bootID != bootID {
+		return nil, errCursorExpired
+	}
+	c := s.staticPageSnapshots
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ps, exists := c.snapshots[pageSnapshotKey{kind: pc.kind, week: pc.week, version: pc.version}]
+	if !exists || !s.now().Before(ps.expires) {
+		return nil, errCursorExpired
+	}
+	return ps.value, nil
+}
+
+// managedPagedStatsSnapshot returns the snapshot that a request for the stats
+// of the week that starts at the provided timeslot offset is served from,
+// which is the snapshot of the cursor of the request if it has one.
+func (s *GCAServer) managedPagedStatsSnapshot(timeslotOffset uint32, dsf deviceStatsFilter) (*statsSnapshot, error) {
+	if dsf.cursor == nil {
+		return s.managedStatsSnapshot(timeslotOffset)
+	}
+	if dsf.cursor.kind != pageKindStats || dsf.cursor.week != timeslotOffset {
+		return nil, withCode(ErrCodeMalformedRequest, fmt.Errorf("the cursor does not belong to the stats of timeslot_offset %v", timeslotOffset))
+	}
+	value, err := s.pageSnapshotValue(*dsf.cursor)
+	if err != nil {
+		return nil, err
+	}
+	return value.(*statsSnapshot), nil
+}
+
+// statsNextCursor returns the cursor for the page after the provided page of
+// the stats of a snapshot, or an empty string if it was the last page.
+func (s *GCAServer) statsNextCursor(snap *statsSnapshot, page []int, more bool) string {
+	if !more || len(page) == 0 {
+		return ""
+	}
+	key := pageSnapshotKey{kind: pageKindStats, week: snap.stats.TimeslotOffset, version: snap.version}
+	last := snap.stats.Devices[page[len(page)-1]].PublicKey
+	shortID, known := snap.shortIDs[last]
+	return s.newPageCursor(key, snap, known, shortID, last)
+}
+
+// equipmentNextCursor returns the cursor for the page after the provided page
+// of an equipment listing, or an empty string if it was the last page.
+func (s *GCAServer) equipmentNextCursor(el *equipmentListing, page []V2Equipment, more bool) string {
+	if !more || len(page) == 0 {
+		return ""
+	}
+	key := pageSnapshotKey{kind: pageKindEquipment, version: el.version}
+	return s.newPageCursor(key, el, true, page[len(page)-1].ShortID, glow.PublicKey{})
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getPage fetches a route of the api and decodes the body into the provided
+// value, returning the status code and the error code of the response.
+func (gcas *GCAServer) getPage(route string, v interface{}) (int, string, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/%v", gcas.httpPort, route))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var ae APIError
+		err := json.NewDecoder(resp.Body).Decode(&ae)
+		return resp.StatusCode, ae.Code, err
+	}
+	return resp.StatusCode, "", json.NewDecoder(resp.Body).Decode(v)
+}
+
+// TestPageCursors pages through the all-device-stats endpoints and the v2
+// equipment listing while devices get authorized, and checks that every page
+// continues from the snapshot of the first one, so that no device is skipped
+// or returned twice.
+func TestPageCursors(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	keyIDs := make(map[glow.PublicKey]uint32)
+	authorize := func(shortID uint32) {
+		t.Helper()
+		ea, priv, err := server.AuthorizeTestDevice(shortID, gcaPrivKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyIDs[ea.PublicKey] = shortID
+		server.managedHandleEquipmentReport(generateTestReport(shortID, 1, priv))
+	}
+	for _, shortID := range []uint32{100, 200, 300, 400, 500} {
+		authorize(shortID)
+	}
+
+	// page returns the ShortIDs and the next cursor of a page of one of
+	// the listings.
+	listings := map[string]func(cursor string) ([]uint32, string){
+		"v1 stats": func(cursor string) ([]uint32, string) {
+			var ads AllDeviceStats
+			if status, code, err := server.getPage("v1/all-device-stats?timeslot_offset=0&limit=2&cursor="+cursor, &ads); err != nil || status != http.StatusOK {
+				t.Fatal("unable to get a page:", status, code, err)
+			}
+			if ads.TotalDevices < len(ads.Devices) || !glow.Verify(server.staticPublicKey, ads.SigningBytes(), ads.Signature) {
+				t.Fatal("bad page")
+			}
+			var ids []uint32
+			for _, ds := range ads.Devices {
+				ids = append(ids, keyIDs[ds.PublicKey])
+			}
+			return ids, ads.NextCursor
+		},
+		"v2 stats": func(cursor string) ([]uint32, string) {
+			var resp V2AllDeviceStatsResponse
+			if status, code, err := server.getPage("v2/all-device-stats?timeslot_offset=0&limit=2&cursor="+cursor, &resp); err != nil || status != http.StatusOK {
+				t.Fatal("unable to get a page:", status, code, err)
+			}
+			var ids []uint32
+			for _, ds := range resp.Devices {
+				var pk glow.PublicKey
+				hex.Decode(pk[:], []byte(ds.PublicKey))
+				ids = append(ids, keyIDs[pk])
+			}
+			return ids, resp.NextCursor
+		},
+		"v2 equipment": func(cursor string) ([]uint32, string) {
+			var resp V2EquipmentResponse
+			if status, code, err := server.getPage("v2/equipment?limit=2&cursor="+cursor, &resp); err != nil || status != http.StatusOK {
+				t.Fatal("unable to get a page:", status, code, err)
+			}
+			var ids []uint32
+			for _, e := range resp.Equipment {
+				ids = append(ids, e.ShortID)
+			}
+			return ids, resp.NextCursor
+		},
+	}
+	next := uint32(101)
+	for name, page := range listings {
+		// Authorize a device that sorts before the next page, and one
+		// that sorts after it, between every two pages.
+		var got []uint32
+		want := make([]uint32, 0)
+		for _, ds := range server.managedEquipmentListing().equipment {
+			want = append(want, ds.ShortID)
+		}
+		ids, cursor := page("")
+		got = append(got, ids...)
+		for cursor != "" {
+			authorize(next)
+			authorize(next + 1000)
+			next++
+			ids, cursor = page(cursor)
+			got = append(got, ids...)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%v: paging returned %v, expected %v", name, got, want)
+		}
+
+		// A new pagination sees the new devices.
+		ids, _ = page("")
+		if len(ids) != 2 || ids[0] != 100 || ids[1] != 101 {
+			t.Fatalf("%v: the new devices are missing from the first page: %v", name, ids)
+		}
+	}
+
+	// A cursor only belongs to the listing it came from, and garbage is
+	// rejected as malformed.
+	var ads AllDeviceStats
+	if _, code, _ := server.getPage("v1/all-device-stats?timeslot_offset=0&limit=1", &ads); code != "" || ads.NextCursor == "" {
+		t.Fatal("no cursor:", code)
+	}
+	var resp V2EquipmentResponse
+	for _, route := range []string{
+		"v2/equipment?cursor=" + ads.NextCursor,
+		"v2/equipment?cursor=abc",
+		"v1/all-device-stats?timeslot_offset=2016&cursor=" + ads.NextCursor,
+		"v1/all-device-stats?timeslot_offset=0&offset=1&cursor=" + ads.NextCursor,
+	} {
+		if status, code, _ := server.getPage(route, &resp); status != http.StatusBadRequest || code != ErrCodeMalformedRequest {
+			t.Fatal("a bad cursor was accepted:", route, status, code)
+		}
+	}
+
+	// Once the snapshot of a cursor is gone, the caller is told to start
+	// over, and the same goes for cursors from before a restart.
+	server.staticPageSnapshots.mu.Lock()
+	for _, ps := range server.staticPageSnapshots.snapshots {
+		ps.expires = server.now()
+	}
+	server.staticPageSnapshots.mu.Unlock()
+	if status, code, _ := server.getPage("v1/all-device-stats?timeslot_offset=0&cursor="+ads.NextCursor, &ads); status != http.StatusGone || code != ErrCodeCursorExpired {
+		t.Fatal("an expired cursor was accepted:", status, code)
+	}
+	pc, err := decodePageCursor(ads.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.bootID[0]++
+	if status, code, _ := server.getPage("v2/all-device-stats?timeslot_offset=0&cursor="+pc.encode(), &ads); status != http.StatusGone || code != ErrCodeCursorExpired {
+		t.Fatal("a cursor from another boot was accepted:", status, code)
+	}
+
+	// The server holds on to a bounded number of snapshots.
+	for i := 0; i < maxPageSnapshots+2; i++ {
+		authorize(5000 + uint32(i))
+		if _, code, _ := server.getPage("v2/equipment?limit=1", &resp); code != "" || resp.NextCursor == "" {
+			t.Fatal("no cursor:", code)
+		}
+	}
+	server.staticPageSnapshots.mu.Lock()
+	defer server.staticPageSnapshots.mu.Unlock()
+	if len(server.staticPageSnapshots.snapshots) != maxPageSnapshots {
+		t.Fatal("unexpected number of snapshots:", len(server.staticPageSnapshots.snapshots))
+	}
+}
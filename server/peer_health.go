@@ -0,0 +1,244 @@
+package server
+
+// peer_health.go contains a monitor that keeps an eye on the other servers of
+// the GCA. A GCA runs several servers so that devices can fail over when one
+// of them goes down, but a failover server that died quietly provides no
+// redundancy, and nobody notices until the primary goes down too. Every server
+// therefore probes the /healthz endpoint of every other authorized server that
+// has not been banned, and records the latency and the outcome of each probe.
+// The results are served on /api/v1/peer-status.
+//
+// A peer that answers at all counts as reachable, even if it reports itself
+// unhealthy, the status that it reported is recorded alongside. A peer that
+// stays unreachable for peerDownThreshold gets a "peer.unreachable" alert sent
+// to the alert backends, see alerts.go, and a "peer.recovered" alert once it
+// answers again.
+//
+// Every server of the GCA runs the same monitor, so the probes are spread out
+// to keep a fleet of servers from probing each other in lockstep. The time
+// between two rounds is drawn at random between half and one and a half times
+// peerProbeFrequency, the peers are probed in a random order, and only one
+// probe is made at a time, with at least peerProbeSpacing between any two of
+// them. The results are not persisted, a server that restarts starts over
+// with every peer unknown.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// The peer event types sent to the webhooks.
+const (
+	webhookEventPeerUnreachable = "peer.unreachable"
+	webhookEventPeerRecovered   = "peer.recovered"
+)
+
+// PeerStatus contains the results of the probes of a single peer.
+type PeerStatus struct {
+	PublicKey           glow.PublicKey
+	Location            string
+	HttpPort            uint16
+	Reachable           bool   // Whether the last probe got an answer
+	Status              string // The status that the peer reported in the last answer, see HealthzResponse
+	LatencyMs           int64  // The round trip time of the last probe that got an answer
+	LastAttempt         int64  // Unix timestamp of the last probe
+	LastSuccess         int64  // Unix timestamp of the last probe that got an answer, 0 if none
+	LastError           string // The error of the last probe, empty if it got an answer
+	ConsecutiveFailures int    // The number of probes in a row that got no answer
+	DownSince           int64  // Unix timestamp of the first failed probe since the last answer, 0 while reachable
+	Alerted             bool   // Whether the webhooks have been told that the peer is unreachable
+
+	downSince time.Time
+}
+
+// PeerStatusResponse is the response of /api/v1/peer-status.
+type PeerStatusResponse struct {
+	Peers []PeerStatus
+}
+
+// PeerStatusEvent is the payload that gets posted to the webhooks when a peer
+// becomes unreachable or recovers.
+type PeerStatusEvent struct {
+	Event       string `json:"event"` // Either "peer.unreachable" or "peer.recovered"
+	PubkeyHex   string `json:"pubkey_hex"`
+	Location    string `json:"location"`
+	LastSuccess int64  `json:"last_success"` // Unix time of the last answer, 0 if the peer never answered
+	DownSince   int64  `json:"down_since"`   // Unix time of the first failed probe
+	DetectedAt  int64  `json:"detected_at"`  // Unix time at which the change was detected
+}
+
+// alertType implements alertEvent.
+func (e PeerStatusEvent) alertType() string { return e.Event }
+
+// alertSummary implements alertEvent.
+func (e PeerStatusEvent) alertSummary() string {
+	if e.Event == webhookEventPeerRecovered {
+		return fmt.Sprintf("peer %v is reachable again", e.Location)
+	}
+	return fmt.Sprintf("peer %v has been unreachable since %v", e.Location, time.Unix(e.DownSince, 0).UTC().Format(time.RFC3339))
+}
+
+// peerProbeResult is the outcome of a single probe.
+type peerProbeResult struct {
+	err     error
+	status  string
+	latency time.Duration
+}
+
+// probePeer asks a peer for its health.
+func probePeer(as AuthorizedServer) peerProbeResult {
+	client := http.Client{Timeout: peerProbeTimeout}
+	start := time.Now()
+	resp, err := client.Get("http://" + glow.HostPort(as.Location, as.HttpPort) + "/healthz")
+	if err != nil {
+		return peerProbeResult{err: err}
+	}
+	defer resp.Body.Close()
+	result := peerProbeResult{status: resp.Status, latency: time.Since(start)}
+	var hr HealthzResponse
+	if json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&hr) == nil && hr.Status != "" {
+		result.status = hr.Status
+	}
+	return result
+}
+
+// recordPeerProbe records the outcome of a probe, and returns the event for
+// the webhooks if the probe changed whether the peer is considered down. The
+// mutex must be held.
+func (gcas *GCAServer) recordPeerProbe(as AuthorizedServer, result peerProbeResult) (PeerStatusEvent, bool) {
+	ps, exists := gcas.peerStatus[as.PublicKey]
+	if !exists {
+		ps = &PeerStatus{PublicKey: as.PublicKey}
+		gcas.peerStatus[as.PublicKey] = ps
+	}
+	now := gcas.now()
+	ps.Location = as.Location
+	ps.HttpPort = as.HttpPort
+	ps.LastAttempt = now.Unix()
+	ps.Reachable = result.err == nil
+	if result.err == nil {
+		ps.Status = result.status
+		ps.LatencyMs = result.latency.Milliseconds()
+		ps.LastSuccess = now.Unix()
+		ps.LastError = ""
+		ps.ConsecutiveFailures = 0
+		downSince := ps.DownSince
+		ps.DownSince = 0
+		ps.downSince = time.Time{}
+		if !ps.Alerted {
+			return PeerStatusEvent{}, false
+		}
+		ps.Alerted = false
+		return gcas.peerStatusEvent(webhookEventPeerRecovered, ps, downSince), true
+	}
+
+	ps.Status = ""
+	ps.LastError = result.err.Error()
+	ps.ConsecutiveFailures++
+	if ps.downSince.IsZero() {
+		ps.downSince = now
+		ps.DownSince = now.Unix()
+	}
+	if ps.Alerted || now.Sub(ps.downSince) < peerDownThreshold {
+		return PeerStatusEvent{}, false
+	}
+	ps.Alerted = true
+	return gcas.peerStatusEvent(webhookEventPeerUnreachable, ps, ps.DownSince), true
+}
+
+// peerStatusEvent returns a webhook event about a peer.
+func (gcas *GCAServer) peerStatusEvent(event string, ps *PeerStatus, downSince int64) PeerStatusEvent {
+	return PeerStatusEvent{
+		Event:       event,
+		PubkeyHex:   hex.EncodeToString(ps.PublicKey[:]),
+		Location:    glow.HostPort(ps.Location, ps.HttpPort),
+		LastSuccess: ps.LastSuccess,
+		DownSince:   downSince,
+		DetectedAt:  gcas.now().Unix(),
+	}
+}
+
+// monitoredPeers returns the servers that should be probed, in a random
+// order, and forgets about the servers that should no longer be probed.
+func (gcas *GCAServer) monitoredPeers() []AuthorizedServer {
+	var peers []AuthorizedServer
+	keep := make(map[glow.PublicKey]struct{})
+	for _, as := range gcas.AuthorizedServers() {
+		if as.Banned || as.PublicKey == gcas.staticPublicKey {
+			continue
+		}
+		peers = append(peers, as)
+		keep[as.PublicKey] = struct{}{}
+	}
+	gcas.mu.Lock()
+	for key := range gcas.peerStatus {
+		if _, exists := keep[key]; !exists {
+			delete(gcas.peerStatus, key)
+		}
+	}
+	gcas.mu.Unlock()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	return peers
+}
+
+// threadedMonitorPeers probes the other servers in rounds, until the server
+// shuts down.
+func (gcas *GCAServer) threadedMonitorPeers() {
+	for {
+		wait := peerProbeFrequency/2 + time.Duration(rand.Int63n(int64(peerProbeFrequency)))
+		if !gcas.sleep(wait) {
+			return
+		}
+		for i, as := range gcas.monitoredPeers() {
+			if i > 0 && !gcas.sleep(peerProbeSpacing) {
+				return
+			}
+			result := probePeer(as)
+			gcas.mu.Lock()
+			event, changed := gcas.recordPeerProbe(as, result)
+			if changed {
+				gcas.queueAlert(event)
+			}
+			gcas.mu.Unlock()
+			if changed {
+				gcas.logger.WithFields("peer", event.Location, "event", event.Event).Warn("peer status changed")
+			}
+		}
+	}
+}
+
+// PeerStatusHandler returns the results of the probes of every peer, ordered
+// by location.
+func (gcas *GCAServer) PeerStatusHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		return
+	}
+	resp := PeerStatusResponse{Peers: []PeerStatus{}}
+	gcas.mu.RLock()
+	for _, ps := range gcas.peerStatus {
+		resp.Peers = append(resp.Peers, *ps)
+	}
+	gcas.mu.RUnlock()
+	sort.Slice(resp.Peers, func(i, j int) bool {
+		a, b := resp.Peers[i], resp.Peers[j]
+		if a.Location != b.Location {
+			return a.Location < b.Location
+		}
+		if a.HttpPort != b.HttpPort {
+			return a.HttpPort < b.HttpPort
+		}
+		return bytes.Compare(a.PublicKey[:], b.PublicKey[:]) < 0
+	})
+	gcas.writeJSONResponse(w, r, resp)
+}
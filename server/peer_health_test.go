@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// fetchPeerStatus returns the status of the provided peer from the peer status
+// endpoint of the server.
+func (gcas *GCAServer) fetchPeerStatus(peer *GCAServer) (PeerStatus, bool, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%v:%v/api/v1/peer-status", serverIP, gcas.httpPort))
+	if err != nil {
+		return PeerStatus{}, false, err
+	}
+	defer resp.Body.Close()
+	var psr PeerStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&psr); err != nil {
+		return PeerStatus{}, false, err
+	}
+	for _, ps := range psr.Peers {
+		if ps.PublicKey == peer.staticPublicKey {
+			return ps, true, nil
+		}
+	}
+	return PeerStatus{}, false, nil
+}
+
+// TestPeerHealth runs two servers that probe each other, stops one of them,
+// and checks that the other one reports it as unreachable, both on the peer
+// status endpoint and to the webhooks.
+func TestPeerHealth(t *testing.T) {
+	a, dir, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name() + "-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, _, err := SetupTestEnvironmentKnownGCA(t.Name()+"-b", gcaPubKey, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &webhookReceiver{}
+	hooks := httptest.NewServer(receiver)
+	defer hooks.Close()
+	config, _ := json.Marshal(webhookConfig{URLs: []string{hooks.URL}})
+	if err := os.WriteFile(filepath.Join(dir, WebhooksConfigFile), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	a.addPeer(b)
+
+	// b answers the probes of a.
+	var ps PeerStatus
+	for i := 0; i < 200 && !ps.Reachable; i++ {
+		time.Sleep(10 * time.Millisecond)
+		ps, _, err = a.fetchPeerStatus(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !ps.Reachable || ps.Status != "ok" || ps.LastSuccess == 0 || ps.ConsecutiveFailures != 0 || ps.Alerted {
+		t.Fatalf("peer was not probed: %+v", ps)
+	}
+
+	// Once b is gone, a notices, and tells the webhooks once b has been
+	// down for long enough.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	events := receiver.waitForEvents(1)
+	if len(events) != 1 || events[0].Event != webhookEventPeerUnreachable || events[0].PubkeyHex != hex.EncodeToString(b.staticPublicKey[:]) {
+		t.Fatal("unexpected events:", events)
+	}
+	ps, _, err = a.fetchPeerStatus(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.Reachable || ps.LastError == "" || ps.ConsecutiveFailures == 0 || ps.DownSince == 0 || !ps.Alerted {
+		t.Fatalf("peer is not reported as unreachable: %+v", ps)
+	}
+
+	// The event is only sent once.
+	time.Sleep(5 * peerProbeFrequency)
+	if events := receiver.waitForEvents(1); len(events) != 1 {
+		t.Fatal("unreachable peer was reported again:", events)
+	}
+
+	// A peer that comes back gets a recovery event. The monitor forgets
+	// peers that aren't listed, so the mutex is held throughout.
+	other := AuthorizedServer{PublicKey: glow.PublicKey{1}, Location: "127.0.0.1", HttpPort: 1}
+	a.mu.Lock()
+	a.recordPeerProbe(other, peerProbeResult{err: errors.New("refused")})
+	a.peerStatus[other.PublicKey].downSince = a.now().Add(-peerDownThreshold)
+	_, unreachable := a.recordPeerProbe(other, peerProbeResult{err: errors.New("refused")})
+	event, recovered := a.recordPeerProbe(other, peerProbeResult{status: "ok"})
+	a.mu.Unlock()
+	if !unreachable || !recovered || event.Event != webhookEventPeerRecovered || event.DownSince == 0 {
+		t.Fatal("unexpected recovery:", unreachable, recovered, event)
+	}
+
+	// A banned peer is no longer probed.
+	a.gcaServers.mu.Lock()
+	a.gcaServers.servers[len(a.gcaServers.servers)-1].Banned = true
+	a.gcaServers.mu.Unlock()
+	for i := 0; i < 200; i++ {
+		if _, exists, _ := a.fetchPeerStatus(b); !exists {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("banned peer is still monitored")
+}
@@ -0,0 +1,472 @@
+package server
+
+// peer_sync.go keeps the reports of the GCA servers in sync with each other.
+// Devices send their reports over UDP to a single server, which leaves the
+// other servers that are listed for the device with holes in their data.
+// Every server therefore periodically connects to each of the other
+// authorized servers and exchanges the reports that the other side is
+// missing.
+//
+// The sync runs over the TCP port that devices use to fetch their bitfields.
+// A device request is the 4 byte ShortID of the device, so a sync session
+// starts with the ShortID peerSyncMagic, which can not be authorized for any
+// device. The session then goes as follows, with all integers little endian:
+//
+//   - The initiator sends its public key, a unix timestamp, and a signature
+//     over both keys and the timestamp.
+//   - The responder checks that the initiator is an authorized server that
+//     has not been banned, and that the initiator has not synced too often.
+//     If anything is wrong, the responder writes a single zero byte and
+//     closes the connection. Otherwise it writes a one byte, followed by its
+//     summary.
+//   - The initiator sends its own summary.
+//   - Each side sends its administrative records, the responder going
+//     first, see peer_sync_records.go.
+//   - Each side sends the reports that the summary of the other side is
+//     missing, the responder going first.
+//   - The responder confirms with the number of reports that it accepted,
+//     so that the session is only over once both sides are done.
+//
+// A summary is the reports offset of the sender, followed by a bitfield for
+// every device that the sender knows about, in the same layout as the
+// bitfield that gets sent to devices. The summaries are signed, and the
+// signatures cover the signature of the initiator, which binds both
+// summaries to the session.
+//
+// The reports themselves are not signed by the servers, every report is
+// checked against the signature of the device before it is accepted, exactly
+// like a report that arrived over UDP. After a single session, both servers
+// have every valid report that either of them had for the devices that both
+// of them know about.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// peerSyncMagic is the ShortID that a sync session between two servers
+// starts with. It is reserved, no device can be authorized with it.
+const peerSyncMagic = ^uint32(0)
+
+const (
+	// peerSyncHelloSize is the size of the hello sent by the initiator,
+	// not counting the magic.
+	peerSyncHelloSize = 32 + 8 + 64
+
+	// peerSyncDeviceSize is the size of a single device in a summary.
+	peerSyncDeviceSize = 4 + 504
+
+	// peerSyncMaxDevices is the largest number of devices that will be
+	// accepted in a summary.
+	peerSyncMaxDevices = 1 << 20
+
+	// peerSyncMaxReports is the largest number of reports that get sent
+	// in either direction during a single session. Anything beyond that
+	// gets picked up by the next session.
+	peerSyncMaxReports = 1 << 20
+)
+
+// peerSyncHello is the first message of a sync session, which identifies the
+// initiator.
+type peerSyncHello struct {
+	PublicKey glow.PublicKey
+	Timestamp int64
+	Signature glow.Signature
+}
+
+// SigningBytes returns the bytes that the initiator signs. The key of the
+// responder is included so that a hello can't be used with another server.
+func (h peerSyncHello) SigningBytes(responder glow.PublicKey) []byte {
+	b := []byte("PeerSyncHello")
+	b = append(b, h.PublicKey[:]...)
+	b = append(b, responder[:]...)
+	return binary.LittleEndian.AppendUint64(b, uint64(h.Timestamp))
+}
+
+// peerSyncSummary lists the timeslots that a server has reports for.
+type peerSyncSummary struct {
+	Offset    uint32
+	Bitfields map[uint32]*[504]byte
+}
+
+// serialize encodes the summary, with the devices in order of their ShortID.
+func (s peerSyncSummary) serialize() []byte {
+	shortIDs := make([]uint32, 0, len(s.Bitfields))
+	for shortID := range s.Bitfields {
+		shortIDs = append(shortIDs, shortID)
+	}
+	sort.Slice(shortIDs, func(i, j int) bool { return shortIDs[i] < shortIDs[j] })
+	b := make([]byte, 8, 8+len(shortIDs)*peerSyncDeviceSize)
+	binary.LittleEndian.PutUint32(b[0:], s.Offset)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(shortIDs)))
+	for _, shortID := range shortIDs {
+		b = binary.LittleEndian.AppendUint32(b, shortID)
+		b = append(b, s.Bitfields[shortID][:]...)
+	}
+	return b
+}
+
+// summarySigningBytes returns the bytes that a server signs to vouch for its
+// summary within the session that was opened with the provided hello.
+func summarySigningBytes(hello peerSyncHello, summary []byte) []byte {
+	b := []byte("PeerSyncSummary")
+	b = append(b, hello.Signature[:]...)
+	return append(b, summary...)
+}
+
+// buildPeerSyncSummary returns the summary of the reports of this server.
+// Flagged reports count as received, as they can't be accepted again until
+// the GCA has reviewed them.
+func (gcas *GCAServer) buildPeerSyncSummary() peerSyncSummary {
+	summary := peerSyncSummary{
+		Offset:    gcas.equipmentReportsOffset,
+		Bitfields: make(map[uint32]*[504]byte, len(gcas.equipment)),
+	}
+	for shortID := range gcas.equipment {
+		bitfield := new([504]byte)
+		for i, output := range gcas.equipmentReports[shortID].PowerOutputs {
+			if output > 0 {
+				bitfield[i/8] |= 1 << (i % 8)
+			}
+		}
+		summary.Bitfields[shortID] = bitfield
+	}
+	for slot := range gcas.flaggedReports {
+		bitfield, exists := summary.Bitfields[slot.ShortID]
+		if exists && slot.Timeslot >= gcas.equipmentReportsOffset && slot.Timeslot < gcas.equipmentReportsOffset+4032 {
+			i := slot.Timeslot - gcas.equipmentReportsOffset
+			bitfield[i/8] |= 1 << (i % 8)
+		}
+	}
+	return summary
+}
+
+// missingReports returns the reports of this server that are not in the
+// summary of a peer, serialized back to back. Only the devices in the summary
+// are considered, the peer has no way to verify reports for other devices.
+func (gcas *GCAServer) missingReports(untrustedSummary peerSyncSummary) ([]byte, error) {
+	var missing []glow.EquipmentReport
+collect:
+	for shortID, bitfield := range untrustedSummary.Bitfields {
+		reports, exists := gcas.equipmentReports[shortID]
+		if !exists {
+			continue
+		}
+		for i := range reports.PowerOutputs {
+			if !reports.signed(i) {
+				continue
+			}
+			ts := gcas.equipmentReportsOffset + uint32(i)
+			if ts < untrustedSummary.Offset || ts >= untrustedSummary.Offset+4032 {
+				continue
+			}
+			j := ts - untrustedSummary.Offset
+			if bitfield[j/8]&(1<<(j%8)) != 0 {
+				continue
+			}
+			if len(missing) == peerSyncMaxReports {
+				break collect
+			}
+			missing = append(missing, reports.report(shortID, gcas.equipmentReportsOffset, i))
+		}
+	}
+	if err := gcas.loadReportSignatures(missing); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(missing)*equipmentReportSize)
+	for _, report := range missing {
+		b = append(b, report.Serialize()...)
+	}
+	return b, nil
+}
+
+// managedWritePeerSyncSummary writes the summary of this server to the
+// connection, signed for the session.
+func (gcas *GCAServer) managedWritePeerSyncSummary(conn net.Conn, hello peerSyncHello) error {
+	gcas.mu.RLock()
+	summary := gcas.buildPeerSyncSummary()
+	gcas.mu.RUnlock()
+	b := summary.serialize()
+	sig := glow.Sign(summarySigningBytes(hello, b), gcas.staticPrivateKey)
+	if _, err := conn.Write(append(b, sig[:]...)); err != nil {
+		return fmt.Errorf("unable to write summary: %v", err)
+	}
+	return nil
+}
+
+// readUntrustedPeerSyncSummary reads the summary of the peer from the
+// connection and checks that the peer signed it for the session.
+func readUntrustedPeerSyncSummary(conn net.Conn, hello peerSyncHello, peer glow.PublicKey) (peerSyncSummary, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return peerSyncSummary{}, fmt.Errorf("unable to read summary: %v", err)
+	}
+	count := binary.LittleEndian.Uint32(header[4:])
+	if count > peerSyncMaxDevices {
+		return peerSyncSummary{}, fmt.Errorf("summary has too many devices: %v", count)
+	}
+	b := make([]byte, 8+int(count)*peerSyncDeviceSize+64)
+	copy(b, header[:])
+	if _, err := io.ReadFull(conn, b[8:]); err != nil {
+		return peerSyncSummary{}, fmt.Errorf("unable to read summary: %v", err)
+	}
+	var sig glow.Signature
+	copy(sig[:], b[len(b)-64:])
+	b = b[:len(b)-64]
+	if !glow.Verify(peer, summarySigningBytes(hello, b), sig) {
+		return peerSyncSummary{}, errors.New("summary is not signed by the peer")
+	}
+
+	summary := peerSyncSummary{
+		Offset:    binary.LittleEndian.Uint32(header[0:]),
+		Bitfields: make(map[uint32]*[504]byte, count),
+	}
+	for i := 8; i < len(b); i += peerSyncDeviceSize {
+		bitfield := new([504]byte)
+		copy(bitfield[:], b[i+4:i+peerSyncDeviceSize])
+		summary.Bitfields[binary.LittleEndian.Uint32(b[i:])] = bitfield
+	}
+	return summary, nil
+}
+
+// writePeerSyncReports writes a batch of serialized reports, prefixed by the
+// number of reports.
+func writePeerSyncReports(conn net.Conn, reports []byte) error {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(reports)/equipmentReportSize))
+	if _, err := conn.Write(append(b, reports...)); err != nil {
+		return fmt.Errorf("unable to write reports: %v", err)
+	}
+	return nil
+}
+
+// managedUntrustedReadPeerSyncReports reads a batch of reports from a peer and
+// integrates every report that the device signed. It returns the number of
+// reports that were accepted.
+func (gcas *GCAServer) managedUntrustedReadPeerSyncReports(conn net.Conn) (int, error) {
+	var countBytes [4]byte
+	if _, err := io.ReadFull(conn, countBytes[:]); err != nil {
+		return 0, fmt.Errorf("unable to read reports: %v", err)
+	}
+	count := binary.LittleEndian.Uint32(countBytes[:])
+	if count > peerSyncMaxReports {
+		return 0, fmt.Errorf("peer sent too many reports: %v", count)
+	}
+	accepted := 0
+	buf := make([]byte, equipmentReportSize)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return accepted, fmt.Errorf("unable to read reports: %v", err)
+		}
+		if outcome, _ := gcas.managedHandleEquipmentReport(buf); outcome == reportAccepted {
+			accepted++
+		}
+	}
+	return accepted, nil
+}
+
+// managedAllowPeerSync checks whether a peer may open a sync session. The
+// peer has to be an authorized server that isn't banned, and it has to stay
+// within its rate limit.
+func (gcas *GCAServer) managedAllowPeerSync(peer glow.PublicKey) error {
+	found := false
+	gcas.gcaServers.mu.Lock()
+	for _, as := range gcas.gcaServers.servers {
+		if as.PublicKey == peer && !as.Banned {
+			found = true
+		}
+	}
+	gcas.gcaServers.mu.Unlock()
+	if !found || peer == gcas.staticPublicKey {
+		return fmt.Errorf("%x is not an authorized server", peer)
+	}
+
+	gcas.mu.Lock()
+	limiter, exists := gcas.peerSyncLimiters[peer]
+	if !exists {
+		limiter = glow.NewRateLimiter(peerSyncLimit, peerSyncRate)
+		gcas.peerSyncLimiters[peer] = limiter
+	}
+	gcas.mu.Unlock()
+	if !limiter.Allow() {
+		return fmt.Errorf("%x is syncing too often", peer)
+	}
+	return nil
+}
+
+// managedHandlePeerSync handles a sync session that was opened by another
+// server. The magic has already been read from the connection.
+func (gcas *GCAServer) managedHandlePeerSync(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(peerSyncTimeout))
+
+	// Read the hello, which names the server that the session is for on
+	// a host with tenants, see tenants.go.
+	var b [peerSyncHelloSize]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		gcas.logger.Infof("Unable to read peer sync hello: %v", err)
+		return
+	}
+	var hello peerSyncHello
+	copy(hello.PublicKey[:], b[:32])
+	hello.Timestamp = int64(binary.LittleEndian.Uint64(b[32:]))
+	copy(hello.Signature[:], b[40:])
+	gcas.peerHelloTenant(hello).managedServePeerSync(conn, hello)
+}
+
+// managedServePeerSync runs a sync session with the server that sent the
+// hello, after checking that the hello is addressed to this server.
+func (gcas *GCAServer) managedServePeerSync(conn net.Conn, hello peerSyncHello) {
+	refuse := func(err error) {
+		conn.Write([]byte{0})
+		gcas.logger.WithFields("remote_addr", conn.RemoteAddr().String(), "error", err).Info("refused peer sync")
+	}
+	if !glow.Verify(hello.PublicKey, hello.SigningBytes(gcas.staticPublicKey), hello.Signature) {
+		refuse(errors.New("invalid signature on hello"))
+		return
+	}
+	now := gcas.now().Unix()
+	if hello.Timestamp < now-peerSyncWindow || hello.Timestamp > now+peerSyncWindow {
+		refuse(fmt.Errorf("hello timestamp is not within %v seconds of the current time", peerSyncWindow))
+		return
+	}
+	if err := gcas.managedAllowPeerSync(hello.PublicKey); err != nil {
+		refuse(err)
+		return
+	}
+
+	// Exchange the summaries, then the reports.
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return
+	}
+	if err := gcas.managedWritePeerSyncSummary(conn, hello); err != nil {
+		gcas.logger.Infof("peer sync with %x failed: %v", hello.PublicKey, err)
+		return
+	}
+	untrustedSummary, err := readUntrustedPeerSyncSummary(conn, hello, hello.PublicKey)
+	if err != nil {
+		gcas.logger.Infof("peer sync with %x failed: %v", hello.PublicKey, err)
+		return
+	}
+	applied, err := gcas.managedExchangePeerSyncRecords(conn, hello.PublicKey, true)
+	if err != nil {
+		gcas.logger.Infof("peer sync with %x failed: %v", hello.PublicKey, err)
+		return
+	}
+	gcas.mu.RLock()
+	reports, err := gcas.missingReports(untrustedSummary)
+	gcas.mu.RUnlock()
+	if err != nil {
+		gcas.logger.Errorf("peer sync with %x failed: %v", hello.PublicKey, err)
+		return
+	}
+	if err := writePeerSyncReports(conn, reports); err != nil {
+		gcas.logger.Infof("peer sync with %x failed: %v", hello.PublicKey, err)
+		return
+	}
+	accepted, err := gcas.managedUntrustedReadPeerSyncReports(conn)
+	if err != nil {
+		gcas.logger.Infof("peer sync with %x failed: %v", hello.PublicKey, err)
+		return
+	}
+	if _, err := conn.Write(binary.LittleEndian.AppendUint32(nil, uint32(accepted))); err != nil {
+		gcas.logger.Infof("peer sync with %x failed: %v", hello.PublicKey, err)
+		return
+	}
+	gcas.logger.Infof("peer sync with %x: sent %v reports, accepted %v reports, applied %v records", hello.PublicKey, len(reports)/equipmentReportSize, accepted, applied)
+}
+
+// managedSyncWithPeer opens a sync session with another server. It returns
+// the number of reports that were accepted from the peer.
+func (gcas *GCAServer) managedSyncWithPeer(peer AuthorizedServer) (int, error) {
+	addr := glow.HostPort(peer.Location, peer.TcpPort)
+	conn, err := net.DialTimeout("tcp", addr, peerSyncTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("unable to connect to %v: %v", addr, err)
+	}
+	defer conn.Close()
+	stop := gcas.closeOnShutdown(conn)
+	defer stop()
+	conn.SetDeadline(time.Now().Add(peerSyncTimeout))
+
+	hello := peerSyncHello{
+		PublicKey: gcas.staticPublicKey,
+		Timestamp: gcas.now().Unix(),
+	}
+	hello.Signature = glow.Sign(hello.SigningBytes(peer.PublicKey), gcas.staticPrivateKey)
+	b := binary.LittleEndian.AppendUint32(nil, peerSyncMagic)
+	b = append(b, hello.PublicKey[:]...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(hello.Timestamp))
+	b = append(b, hello.Signature[:]...)
+	if _, err := conn.Write(b); err != nil {
+		return 0, fmt.Errorf("unable to write hello: %v", err)
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return 0, fmt.Errorf("unable to read hello response: %v", err)
+	}
+	if status[0] != 1 {
+		return 0, errors.New("peer refused the sync")
+	}
+
+	untrustedSummary, err := readUntrustedPeerSyncSummary(conn, hello, peer.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	if err := gcas.managedWritePeerSyncSummary(conn, hello); err != nil {
+		return 0, err
+	}
+	applied, err := gcas.managedExchangePeerSyncRecords(conn, peer.PublicKey, false)
+	if err != nil {
+		return 0, err
+	}
+	if applied > 0 {
+		gcas.logger.Infof("applied %v records from peer %x", applied, peer.PublicKey)
+	}
+	gcas.mu.RLock()
+	reports, err := gcas.missingReports(untrustedSummary)
+	gcas.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	accepted, err := gcas.managedUntrustedReadPeerSyncReports(conn)
+	if err != nil {
+		return accepted, err
+	}
+	if err := writePeerSyncReports(conn, reports); err != nil {
+		return accepted, err
+	}
+	var confirmation [4]byte
+	if _, err := io.ReadFull(conn, confirmation[:]); err != nil {
+		return accepted, fmt.Errorf("unable to read confirmation: %v", err)
+	}
+	return accepted, nil
+}
+
+// threadedSyncWithPeers periodically syncs the reports with every other
+// authorized server that has not been banned.
+func (gcas *GCAServer) threadedSyncWithPeers() {
+	for {
+		if !gcas.sleep(peerSyncFrequency) {
+			return
+		}
+		for _, as := range gcas.AuthorizedServers() {
+			if as.Banned || as.PublicKey == gcas.staticPublicKey {
+				continue
+			}
+			accepted, err := gcas.managedSyncWithPeer(as)
+			if err != nil {
+				gcas.logger.WithFields("peer", glow.HostPort(as.Location, as.TcpPort), "error", err).Info("unable to sync with peer")
+				continue
+			}
+			if accepted > 0 {
+				gcas.logger.Infof("accepted %v reports from peer %x", accepted, as.PublicKey)
+			}
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+// peer_sync_records.go extends the sync sessions between servers, see
+// peer_sync.go, to the administrative records that decide which reports are
+// valid: the bans, the deauthorizations, the report overrides and the key
+// rotations. These are normally forwarded to the other servers as soon as
+// they are accepted, but a forward that fails is never retried, which would
+// leave a failover server accepting reports from a device that its primary
+// banned, and the two servers with different period totals.
+//
+// After the summaries, each side sends all of its records, the responder
+// going first. A server with more records than fit into a session sends the
+// ones that take effect last, as the older records have had the most
+// sessions to reach the peers already. None of the records are signed by the servers. Every record
+// carries the signatures that made the sending server accept it, so the
+// receiver runs it through the same checks as a record that was submitted to
+// it directly, and a record that the receiver already has changes nothing.
+//
+// The records are applied in the order of the timeslot that they take effect
+// in, so that a chain of key rotations is applied in the order that it was
+// made. Where two servers hold different records for the same thing, both of
+// them settle on the same one: the override with the later timestamp of the
+// GCA, see isOverrideUpdate, and the deauthorization with the earliest
+// cutoff. Conflicting overrides get logged.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+const (
+	// peerSyncMaxRecords is the largest number of records that get sent
+	// in either direction during a single session. Past that, only the
+	// newest records get sent.
+	peerSyncMaxRecords = 1 << 16
+
+	// peerSyncMaxRecordSize is the size of the largest record that will
+	// be accepted, which is far larger than any record.
+	peerSyncMaxRecordSize = 4096
+)
+
+// The kinds of records that get exchanged during a sync session.
+const (
+	peerRecordEquivocationProof         uint8 = 0 // An EquivocationProof
+	peerRecordConflictingAuthorizations uint8 = 1 // The two authorizations of a GCA-ordered ban
+	peerRecordDeauthorization           uint8 = 2 // An EquipmentDeauthorization
+	peerRecordReportOverride            uint8 = 3 // A ReportOverride
+	peerRecordDeviceKeyRotation         uint8 = 4 // A DeviceKeyRotation
+)
+
+// peerSyncRecord is a single administrative record in a sync session.
+type peerSyncRecord struct {
+	Kind     uint8
+	Timeslot uint32 // The timeslot that the record takes effect in
+	Data     []byte // The serialization of the record
+}
+
+// sortPeerSyncRecords sorts the records by the timeslot that they take effect
+// in. The sort is stable, which keeps the rotations of a device that take
+// effect in the same timeslot in the order of their chain.
+func sortPeerSyncRecords(records []peerSyncRecord) {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Timeslot < records[j].Timeslot })
+}
+
+// buildPeerSyncRecords returns the administrative records of the server, in
+// the order that they should be applied in. If there are more than
+// peerSyncMaxRecords, the ones that take effect first are left out. The mutex
+// must be held.
+func (gcas *GCAServer) buildPeerSyncRecords() []peerSyncRecord {
+	var records []peerSyncRecord
+	for _, ep := range gcas.equipmentBanProofs {
+		records = append(records, peerSyncRecord{Kind: peerRecordEquivocationProof, Timeslot: ep.Second.Timeslot, Data: ep.Serialize()})
+	}
+	for shortID, auths := range gcas.equipmentBanAuths {
+		var b []byte
+		for _, ea := range auths {
+			auth := ea.Serialize()
+			b = binary.LittleEndian.AppendUint16(b, uint16(len(auth)))
+			b = append(b, auth...)
+		}
+		records = append(records, peerSyncRecord{Kind: peerRecordConflictingAuthorizations, Timeslot: gcas.equipmentBanRecords[shortID].Timeslot, Data: b})
+	}
+	for _, ed := range gcas.equipmentDeauthorizations {
+		records = append(records, peerSyncRecord{Kind: peerRecordDeauthorization, Timeslot: ed.CutoffTimeslot(), Data: ed.Serialize()})
+	}
+	for _, slots := range gcas.reportOverrides {
+		for _, ro := range slots {
+			records = append(records, peerSyncRecord{Kind: peerRecordReportOverride, Timeslot: ro.Timeslot, Data: ro.Serialize()})
+		}
+	}
+	for _, rots := range gcas.deviceKeyRotations {
+		for _, rot := range rots {
+			records = append(records, peerSyncRecord{Kind: peerRecordDeviceKeyRotation, Timeslot: rot.ActivationTimeslot, Data: rot.Serialize()})
+		}
+	}
+	sortPeerSyncRecords(records)
+	if len(records) > peerSyncMaxRecords {
+		gcas.logger.Warnf("only sending the newest %v of %v records to the peer", peerSyncMaxRecords, len(records))
+		records = records[len(records)-peerSyncMaxRecords:]
+	}
+	return records
+}
+
+// writePeerSyncRecords writes a batch of records, prefixed by the number of
+// records. Every record is its kind, its timeslot, and the length of its
+// serialization followed by the serialization.
+func writePeerSyncRecords(conn net.Conn, records []peerSyncRecord) error {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(records)))
+	for _, record := range records {
+		b = append(b, record.Kind)
+		b = binary.LittleEndian.AppendUint32(b, record.Timeslot)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(record.Data)))
+		b = append(b, record.Data...)
+	}
+	if _, err := conn.Write(b); err != nil {
+		return fmt.Errorf("unable to write records: %v", err)
+	}
+	return nil
+}
+
+// readUntrustedPeerSyncRecords reads a batch of records from a peer. The
+// records are checked when they get applied.
+func readUntrustedPeerSyncRecords(conn net.Conn) ([]peerSyncRecord, error) {
+	var countBytes [4]byte
+	if _, err := io.ReadFull(conn, countBytes[:]); err != nil {
+		return nil, fmt.Errorf("unable to read records: %v", err)
+	}
+	count := binary.LittleEndian.Uint32(countBytes[:])
+	if count > peerSyncMaxRecords {
+		return nil, fmt.Errorf("peer sent too many records: %v", count)
+	}
+	records := make([]peerSyncRecord, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var header [9]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return nil, fmt.Errorf("unable to read records: %v", err)
+		}
+		size := binary.LittleEndian.Uint32(header[5:])
+		if size > peerSyncMaxRecordSize {
+			return nil, fmt.Errorf("peer sent a record of %v bytes", size)
+		}
+		record := peerSyncRecord{
+			Kind:     header[0],
+			Timeslot: binary.LittleEndian.Uint32(header[1:]),
+			Data:     make([]byte, size),
+		}
+		if _, err := io.ReadFull(conn, record.Data); err != nil {
+			return nil, fmt.Errorf("unable to read records: %v", err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// deserializeConflictingAuthorizations reverses the serialization of the
+// authorizations of a GCA-ordered ban in buildPeerSyncRecords.
+func deserializeConflictingAuthorizations(b []byte) ([]glow.EquipmentAuthorization, error) {
+	var auths []glow.EquipmentAuthorization
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("authorization is truncated")
+		}
+		size := int(binary.LittleEndian.Uint16(b))
+		if len(b) < 2+size {
+			return nil, fmt.Errorf("authorization is truncated")
+		}
+		ea, err := glow.DeserializeEquipmentAuthorization(b[2 : 2+size])
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode authorization: %v", err)
+		}
+		auths = append(auths, ea)
+		b = b[2+size:]
+	}
+	if len(auths) != 2 {
+		return nil, fmt.Errorf("a ban needs two authorizations, got %v", len(auths))
+	}
+	return auths, nil
+}
+
+// managedApplyPeerSyncRecords applies the records that a peer sent, in the
+// order of the timeslot that they take effect in. It returns the number of
+// records that were new to this server. A record that can't be applied is
+// skipped, most of them are for devices that this server doesn't know about.
+func (gcas *GCAServer) managedApplyPeerSyncRecords(peer glow.PublicKey, untrustedRecords []peerSyncRecord) int {
+	sortPeerSyncRecords(untrustedRecords)
+	applied := 0
+	for _, record := range untrustedRecords {
+		isNew, err := gcas.managedApplyPeerSyncRecord(record)
+		if errorCode(err, "") == ErrCodeConflict {
+			gcas.logger.WithFields("peer", peer, "kind", record.Kind, "timeslot", record.Timeslot, "error", err).Warn("peer sent a conflicting record")
+		} else if err != nil {
+			gcas.logger.WithFields("peer", peer, "kind", record.Kind, "timeslot", record.Timeslot, "error", err).Debug("unable to apply record from peer")
+		}
+		if isNew {
+			applied++
+		}
+	}
+	return applied
+}
+
+// managedApplyPeerSyncRecord decodes a single record from a peer and applies
+// it the same way that the record gets applied when it is submitted to this
+// server. The bool indicates whether the record was new.
+func (gcas *GCAServer) managedApplyPeerSyncRecord(record peerSyncRecord) (bool, error) {
+	switch record.Kind {
+	case peerRecordEquivocationProof:
+		ep, n, err := DeserializeStreamEquivocationProof(record.Data)
+		if err != nil || n != len(record.Data) {
+			return false, fmt.Errorf("unable to decode equivocation proof: %v", err)
+		}
+		return gcas.managedApplyEquivocationProof(ep)
+	case peerRecordConflictingAuthorizations:
+		auths, err := deserializeConflictingAuthorizations(record.Data)
+		if err != nil {
+			return false, err
+		}
+		gcas.mu.RLock()
+		_, banned := gcas.equipmentBans[auths[0].ShortID]
+		gcas.mu.RUnlock()
+		if banned {
+			return false, nil
+		}
+		// The first authorization is a no-op if the device is already
+		// known, and the second one bans the device.
+		for _, ea := range auths {
+			if _, err := gcas.managedAuthorizeEquipment(ea); err != nil && errorCode(err, "") != ErrCodeDeviceBanned {
+				return false, err
+			}
+		}
+		gcas.mu.RLock()
+		_, banned = gcas.equipmentBans[auths[0].ShortID]
+		gcas.mu.RUnlock()
+		return banned, nil
+	case peerRecordDeauthorization:
+		ed, err := DeserializeEquipmentDeauthorization(record.Data)
+		if err != nil {
+			return false, err
+		}
+		return gcas.managedDeauthorizeEquipment(ed)
+	case peerRecordReportOverride:
+		ro, n, err := DeserializeReportOverride(record.Data)
+		if err != nil || n != len(record.Data) {
+			return false, fmt.Errorf("unable to decode report override: %v", err)
+		}
+		return gcas.managedOverrideReport(ro)
+	case peerRecordDeviceKeyRotation:
+		rot, err := DeserializeDeviceKeyRotation(record.Data)
+		if err != nil {
+			return false, err
+		}
+		return gcas.managedRotateDeviceKey(rot, true)
+	}
+	return false, fmt.Errorf("unknown record kind %v", record.Kind)
+}
+
+// managedExchangePeerSyncRecords sends the records of this server to the peer
+// and applies the records of the peer, with the responder sending first. It
+// returns the number of records that were new to this server.
+func (gcas *GCAServer) managedExchangePeerSyncRecords(conn net.Conn, peer glow.PublicKey, responder bool) (int, error) {
+	send := func() error {
+		gcas.mu.RLock()
+		records := gcas.buildPeerSyncRecords()
+		gcas.mu.RUnlock()
+		return writePeerSyncRecords(conn, records)
+	}
+	if responder {
+		if err := send(); err != nil {
+			return 0, err
+		}
+	}
+	untrustedRecords, err := readUntrustedPeerSyncRecords(conn)
+	if err != nil {
+		return 0, err
+	}
+	applied := gcas.managedApplyPeerSyncRecords(peer, untrustedRecords)
+	if !responder {
+		if err := send(); err != nil {
+			return applied, err
+		}
+	}
+	return applied, nil
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// peerEntry returns the entry that other servers use to reach the server.
+func (gcas *GCAServer) peerEntry() AuthorizedServer {
+	return AuthorizedServer{
+		PublicKey: gcas.staticPublicKey,
+		Location:  "127.0.0.1",
+		HttpPort:  gcas.httpPort,
+		TcpPort:   gcas.tcpPort,
+		UdpPort:   gcas.udpPort,
+	}
+}
+
+// addPeer adds a server to the list of authorized servers.
+func (gcas *GCAServer) addPeer(peer *GCAServer) {
+	gcas.gcaServers.mu.Lock()
+	gcas.gcaServers.servers = append(gcas.gcaServers.servers, peer.peerEntry())
+	gcas.gcaServers.mu.Unlock()
+}
+
+// TestPeerSync feeds two servers disjoint reports for the same device, and
+// checks that a single sync session leaves both servers with all of the
+// reports.
+func TestPeerSync(t *testing.T) {
+	a, _, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name() + "-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, _, err := SetupTestEnvironmentKnownGCA(t.Name()+"-b", gcaPubKey, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// Authorize a device on both servers, and a second device only on a.
+	// The servers learn about each other afterwards, so that a doesn't
+	// forward the authorizations.
+	ea, ePriv, err := a.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	_, err = b.saveEquipment(ea)
+	b.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea2, ePriv2, err := a.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.addPeer(b)
+	b.addPeer(a)
+
+	// a receives the even timeslots, b receives the odd timeslots.
+	for ts := uint32(0); ts < 20; ts++ {
+		server := a
+		if ts%2 == 1 {
+			server = b
+		}
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, ts, ePriv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+	if outcome, _ := a.managedHandleEquipmentReport(generateTestReport(ea2.ShortID, 3, ePriv2)); outcome != reportAccepted {
+		t.Fatal("report was not accepted:", outcome)
+	}
+
+	// One session is enough for both servers to have every report.
+	accepted, err := a.managedSyncWithPeer(b.peerEntry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted != 10 {
+		t.Fatal("unexpected number of reports accepted from the peer:", accepted)
+	}
+	a.mu.RLock()
+	b.mu.RLock()
+	reportsA, reportsB := a.liveReports(t, ea.ShortID), b.liveReports(t, ea.ShortID)
+	_, leaked := b.equipmentReports[ea2.ShortID]
+	b.mu.RUnlock()
+	a.mu.RUnlock()
+	if reportsA != reportsB {
+		t.Fatal("servers have different reports after the sync")
+	}
+	for ts := 0; ts < 20; ts++ {
+		if reportsA[ts].PowerOutput != 5 {
+			t.Fatal("report is missing after the sync:", ts)
+		}
+	}
+	if leaked {
+		t.Fatal("b learned about a device it has no authorization for")
+	}
+
+	// The servers have converged, so another session changes nothing.
+	accepted, err = b.managedSyncWithPeer(a.peerEntry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted != 0 {
+		t.Fatal("reports were exchanged after converging:", accepted)
+	}
+
+	// A third device gets conflicting overrides on the two servers, and
+	// the first device signs two different reports on a, which bans it
+	// there without a forward to b. b keeps accepting its reports until
+	// the next session.
+	ea3, _, err := a.AuthorizeTestDevice(3, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	_, err = b.saveEquipment(ea3)
+	b.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	older := ReportOverride{PublicKey: ea3.PublicKey, Timeslot: 4, PowerOutput: 50, Reason: "meter was reset", Timestamp: now}
+	older.Signature = glow.Sign(older.SigningBytes(), gcaPrivKey)
+	newer := ReportOverride{PublicKey: ea3.PublicKey, Timeslot: 4, PowerOutput: 60, Reason: "meter was reset again", Timestamp: now + 1}
+	newer.Signature = glow.Sign(newer.SigningBytes(), gcaPrivKey)
+	if _, err := a.managedOverrideReport(newer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.managedOverrideReport(older); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := glow.DeserializeReport(generateTestReport(ea.ShortID, 30, ePriv))
+	second := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 30, PowerOutput: 7}
+	second.Signature = glow.Sign(second.SigningBytes(), ePriv)
+	if _, err := a.managedApplyEquivocationProof(EquivocationProof{Authorization: ea, First: first, Second: second}); err != nil {
+		t.Fatal(err)
+	}
+	if outcome, _ := b.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 21, ePriv)); outcome != reportAccepted {
+		t.Fatal("b refused a report before it learned about the ban:", outcome)
+	}
+
+	// After a session started by b, the ban is effective on both servers,
+	// and both have the newer override.
+	if _, err := b.managedSyncWithPeer(a.peerEntry()); err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range []*GCAServer{a, b} {
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 22, ePriv)); outcome != reportBanned {
+			t.Fatal("a report from the banned device was not refused:", outcome)
+		}
+		server.mu.RLock()
+		ro := server.reportOverrides[ea3.ShortID][4]
+		_, banned := server.equipmentBanProofs[ea.ShortID]
+		server.mu.RUnlock()
+		if ro != newer || !banned {
+			t.Fatalf("the servers did not converge: %+v %v", ro, banned)
+		}
+	}
+
+	// A fourth device gets deauthorized on a, and a fifth device rotates
+	// its key on a. Neither gets forwarded to b.
+	var eas [2]glow.EquipmentAuthorization
+	var privs [2]glow.PrivateKey
+	for i := range eas {
+		eas[i], privs[i], err = a.AuthorizeTestDevice(uint32(4+i), gcaPrivKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.mu.Lock()
+		_, err = b.saveEquipment(eas[i])
+		b.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ed := EquipmentDeauthorization{PublicKey: eas[0].PublicKey, Timestamp: glow.TimeslotToUnix(25)}
+	ed.Signature = glow.Sign(ed.SigningBytes(), gcaPrivKey)
+	if _, err := a.managedDeauthorizeEquipment(ed); err != nil {
+		t.Fatal(err)
+	}
+	rot, newPriv := newDeviceKeyRotation(eas[1].ShortID, eas[1].PublicKey, privs[1], 40, gcaPrivKey)
+	if _, err := a.managedRotateDeviceKey(rot, false); err != nil {
+		t.Fatal(err)
+	}
+	if outcome, _ := b.managedHandleEquipmentReport(generateTestReport(eas[0].ShortID, 26, privs[0])); outcome != reportAccepted {
+		t.Fatal("b refused a report before it learned about the deauthorization:", outcome)
+	}
+
+	// After a session started by a, b applies the cutoff of the
+	// deauthorization, accepts the new key from its activation, and
+	// refuses the old key after the overlap.
+	if _, err := a.managedSyncWithPeer(b.peerEntry()); err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		shortID  uint32
+		timeslot uint32
+		priv     glow.PrivateKey
+		want     reportOutcome
+	}{
+		{eas[0].ShortID, 25, privs[0], reportAccepted},
+		{eas[0].ShortID, 27, privs[0], reportDeauthorized},
+		{eas[1].ShortID, 40, newPriv, reportAccepted},
+		{eas[1].ShortID, 40 + defaultKeyRotationOverlap, privs[1], reportOutsideAuthorization},
+	}
+	for _, c := range checks {
+		if outcome, _ := b.managedHandleEquipmentReport(generateTestReport(c.shortID, c.timeslot, c.priv)); outcome != c.want {
+			t.Fatal("unexpected outcome on b after the sync:", c.shortID, c.timeslot, outcome, c.want)
+		}
+	}
+
+	// The servers have converged, so a second session leaves the records
+	// alone, and the records of either server change nothing on the other
+	// one.
+	buildRecords := func(server *GCAServer) []peerSyncRecord {
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		return server.buildPeerSyncRecords()
+	}
+	recordsA, recordsB := buildRecords(a), buildRecords(b)
+	if _, err := b.managedSyncWithPeer(a.peerEntry()); err != nil {
+		t.Fatal(err)
+	}
+	if len(buildRecords(a)) != len(recordsA) || len(buildRecords(b)) != len(recordsB) {
+		t.Fatal("the second session changed the records")
+	}
+	if applied := a.managedApplyPeerSyncRecords(b.staticPublicKey, recordsB); len(recordsB) != 4 || applied != 0 {
+		t.Fatal("unexpected records after converging:", len(recordsB), applied)
+	}
+	if applied := b.managedApplyPeerSyncRecords(a.staticPublicKey, recordsA); len(recordsA) != 4 || applied != 0 {
+		t.Fatal("unexpected records after converging:", len(recordsA), applied)
+	}
+}
+
+// TestPeerSyncRecordsLimit checks that a server with more records than fit
+// into a session sends the newest ones.
+func TestPeerSyncRecordsLimit(t *testing.T) {
+	server, _, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// The records only get serialized, so they don't need to be valid.
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for i := uint32(0); i <= peerSyncMaxRecords; i++ {
+		server.reportOverrides[i] = map[uint32]ReportOverride{i: {Timeslot: i}}
+	}
+	records := server.buildPeerSyncRecords()
+	if len(records) != peerSyncMaxRecords {
+		t.Fatal("unexpected number of records:", len(records))
+	}
+	if records[0].Timeslot != 1 || records[len(records)-1].Timeslot != peerSyncMaxRecords {
+		t.Fatal("the wrong records were left out:", records[0].Timeslot, records[len(records)-1].Timeslot)
+	}
+}
+
+// TestPeerSyncRefusals checks that sessions from unknown servers are refused,
+// that sessions are rate limited, and that reports which don't carry a valid
+// signature from the device are not accepted.
+func TestPeerSyncRefusals(t *testing.T) {
+	a, _, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name() + "-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, _, err := SetupTestEnvironmentKnownGCA(t.Name()+"-b", gcaPubKey, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// b doesn't know about a yet.
+	if _, err := a.managedSyncWithPeer(b.peerEntry()); err == nil {
+		t.Fatal("unknown server was able to sync")
+	}
+	b.addPeer(a)
+
+	// A forged report on a never makes it to b.
+	ea, _, err := a.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	_, err = b.saveEquipment(ea)
+	b.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey := glow.GenerateKeyPair()
+	forged := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 4, PowerOutput: 5}
+	forged.Signature = glow.Sign(forged.SigningBytes(), otherKey)
+	a.mu.Lock()
+	a.equipmentReports[ea.ShortID].setReport(4, forged, 0)
+	a.mu.Unlock()
+	if _, err := a.managedSyncWithPeer(b.peerEntry()); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.RLock()
+	got := b.equipmentReports[ea.ShortID].PowerOutputs[4]
+	b.mu.RUnlock()
+	if got != 0 {
+		t.Fatal("b accepted a forged report")
+	}
+
+	// Syncing in a tight loop runs into the rate limit.
+	refused := false
+	for i := 0; i < 2*peerSyncLimit && !refused; i++ {
+		_, err := a.managedSyncWithPeer(b.peerEntry())
+		refused = err != nil
+	}
+	if !refused {
+		t.Fatal("sessions were not rate limited")
+	}
+}
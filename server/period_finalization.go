@@ -0,0 +1,184 @@
+package server
+
+// period_finalization.go freezes a week once the reports for it have had
+// time to arrive. Until then the totals of a week keep changing, as late
+// reports come in and the GCA corrects the output of its devices, so there is
+// no point in time at which the relayer can be sure that the totals it sees
+// are the totals that every server agrees on.
+//
+// The week gets finalized FinalizationDelay timeslots after it ends. At that
+// point the server saves the stats of the week to the stats history, writes
+// the archive and the report root of the week, and signs the period summary,
+// see period_summary.go. From then on, reports and overrides for the week are
+// rejected with ErrCodePeriodFinalized, and the rejected reports are counted
+// in reports_rejected_total. The week stays in memory until the migration
+// rotates it out, so the device stats endpoints keep serving it, but nothing
+// about it changes anymore.
+//
+// The finalization delay can't be longer than the time until the migration.
+// A migration that finds the oldest week not finalized yet, for example after
+// the server was down for a while, finalizes the week first. The stats
+// history is what determines the reports offset at startup, so a server that
+// restarts after finalizing a week starts with the week rotated out.
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// The statuses that a week can be in.
+const (
+	PeriodStatusOpen      = "open"      // The week has not ended yet
+	PeriodStatusGrace     = "grace"     // The week has ended, and late reports are still accepted
+	PeriodStatusFinalized = "finalized" // The totals of the week are final
+)
+
+// PeriodStatus describes where the week with the number Period is in its
+// finalization.
+type PeriodStatus struct {
+	Period      uint32 `json:"period"`
+	PeriodStart uint32 `json:"period_start"`
+	PeriodEnd   uint32 `json:"period_end"`
+	Status      string `json:"status"`
+	FinalizesAt uint32 `json:"finalizes_at"`           // The timeslot at which the week is scheduled to be finalized
+	FinalizedAt uint32 `json:"finalized_at,omitempty"` // The timeslot at which the week was finalized, if the server has its summary
+}
+
+// finalizationDue returns whether the current timeslot is far enough past the
+// end of the week at the provided reports offset for the week to be
+// finalized.
+func (gcas *GCAServer) finalizationDue(ero uint32) bool {
+	return int64(gcas.currentTimeslot()) >= int64(ero)+2016+int64(gcas.staticFinalizationDelay)
+}
+
+// isFinalizedTimeslot returns whether the week of the provided timeslot has
+// been finalized. The mutex must be held.
+func (gcas *GCAServer) isFinalizedTimeslot(timeslot uint32) bool {
+	if timeslot < gcas.equipmentReportsOffset {
+		return true
+	}
+	return gcas.oldestPeriodFinalized && timeslot < gcas.equipmentReportsOffset+2016
+}
+
+// managedFinalizePeriodIf finalizes the oldest week in memory if it has not
+// been finalized yet and the provided condition holds for the current reports
+// offset, and returns whether it did.
+func (gcas *GCAServer) managedFinalizePeriodIf(due func(ero uint32) bool) bool {
+	gcas.migrationMu.Lock()
+	defer gcas.migrationMu.Unlock()
+	gcas.mu.RLock()
+	ero := gcas.equipmentReportsOffset
+	finalized := gcas.oldestPeriodFinalized
+	gcas.mu.RUnlock()
+	if finalized || !due(ero) {
+		return false
+	}
+	gcas.finalizePeriod()
+	return true
+}
+
+// finalizePeriod saves the stats, the archive, the report root and the
+// summary of the oldest week in memory, and stops the week from taking any
+// more reports or overrides. It must only be called while holding the
+// migration mutex.
+func (gcas *GCAServer) finalizePeriod() {
+	// Fetch all of the moer values for the week.
+	err := gcas.managedGetWattTimeWeekData(gcas.managedWattTimeCredentials())
+	if err != nil {
+		// All we can do is log the error, we still need to finalize
+		// the week and save the data.
+		gcas.logger.Errorf("unable to fetch WattTime week data: %v", err)
+	}
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	// Save the device stats.
+	stats, err := gcas.buildDeviceStats(gcas.equipmentReportsOffset)
+	if err != nil {
+		panic("unable to build device stats: " + err.Error())
+	}
+	gcas.equipmentStatsHistory = append(gcas.equipmentStatsHistory, stats)
+	err = gcas.saveAllDeviceStats(stats)
+	if err != nil {
+		panic("failed to save all device stats: " + err.Error())
+	}
+	gcas.evictHistory()
+	// Archive the reports of the week. A failed archive is logged rather
+	// than fatal, the week still needs to be finalized.
+	err = gcas.archiveOldestReports()
+	if err != nil {
+		gcas.logger.Errorf("unable to archive reports: %v", err)
+	}
+	err = gcas.archiveOldestReceipts()
+	if err != nil {
+		gcas.logger.Errorf("unable to archive report receipts: %v", err)
+	}
+	// Commit to the reports of the week.
+	err = gcas.commitOldestReports()
+	if err != nil {
+		gcas.logger.Errorf("unable to commit to reports: %v", err)
+	}
+	// Publish the final totals of the week, which includes the root.
+	err = gcas.finalizePeriodSummary(stats)
+	if err != nil {
+		gcas.logger.Errorf("unable to finalize the period summary: %v", err)
+	}
+	gcas.oldestPeriodFinalized = true
+	gcas.recordPeriodFinalized(gcas.equipmentReportsOffset)
+	gcas.bumpStateVersion()
+	gcas.logger.Infof("finalized the period at timeslot %v", gcas.equipmentReportsOffset)
+}
+
+// PeriodStatusHandler returns the PeriodStatus of the week with the number in
+// the 'period' query parameter.
+func (gcas *GCAServer) PeriodStatusHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for a period status.")
+		return
+	}
+	// The bound leaves room for the timeslot of the finalization.
+	period, err := strconv.ParseUint(r.URL.Query().Get("period"), 10, 32)
+	if err != nil || period > math.MaxUint32/2016-2 {
+		gcas.writeError(w, ErrCodeMalformedRequest, "period must be a period number")
+		return
+	}
+	ps := PeriodStatus{
+		Period:      uint32(period),
+		PeriodStart: uint32(period) * 2016,
+		PeriodEnd:   uint32(period)*2016 + 2016,
+		FinalizesAt: uint32(period)*2016 + 2016 + gcas.staticFinalizationDelay,
+	}
+	gcas.mu.RLock()
+	finalized := gcas.isFinalizedTimeslot(ps.PeriodStart)
+	gcas.mu.RUnlock()
+	switch {
+	case finalized:
+		ps.Status = PeriodStatusFinalized
+	case ps.PeriodEnd > gcas.currentTimeslot():
+		ps.Status = PeriodStatusOpen
+	default:
+		ps.Status = PeriodStatusGrace
+	}
+
+	// The timeslot of the finalization is in the summary, which older
+	// weeks may not have.
+	if finalized {
+		data, err := gcas.staticStorage.ReadFile(periodSummaryFile(ps.PeriodStart))
+		if err == nil {
+			var summary PeriodSummary
+			body, err := glow.VerifySignedResponse(data, gcas.staticPublicKey)
+			if err == nil && json.Unmarshal(body, &summary) == nil {
+				ps.FinalizedAt = summary.FinalizedAt
+			}
+		} else if !os.IsNotExist(err) {
+			gcas.requestLogger(r).Errorf("unable to read the summary for period %v: %v", ps.PeriodStart, err)
+		}
+	}
+	gcas.writeJSONResponse(w, r, ps)
+}
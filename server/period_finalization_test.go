@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getPeriodStatus fetches the status of a period.
+func (gcas *GCAServer) getPeriodStatus(period uint32) (PeriodStatus, error) {
+	var ps PeriodStatus
+	resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/period-status?period=%v", gcas.httpDialAddr(), period))
+	if err != nil {
+		return ps, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ps, fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	return ps, json.NewDecoder(resp.Body).Decode(&ps)
+}
+
+// TestPeriodFinalization checks that a week keeps taking late reports until it
+// gets finalized, that those reports are in its summary, and that reports and
+// overrides for the week get rejected once it is finalized.
+func TestPeriodFinalization(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{FinalizationDelay: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(timeslot uint32) reportOutcome {
+		outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, timeslot, ePriv))
+		return outcome
+	}
+	if outcome := send(10); outcome != reportAccepted {
+		t.Fatal("report was not accepted:", outcome)
+	}
+	if ps, err := server.getPeriodStatus(0); err != nil || ps.Status != PeriodStatusOpen || ps.FinalizesAt != 2116 || ps.FinalizedAt != 0 {
+		t.Fatal("unexpected status for the open period:", ps, err)
+	}
+
+	// After the week ends, late reports are still accepted until the
+	// week gets finalized.
+	glow.SetCurrentTimeslot(2050)
+	if ps, err := server.getPeriodStatus(0); err != nil || ps.Status != PeriodStatusGrace {
+		t.Fatal("unexpected status for the period in its grace window:", ps, err)
+	}
+	if outcome := send(2000); outcome != reportAccepted {
+		t.Fatal("late report in the grace window was not accepted:", outcome)
+	}
+	if status, _, err := server.getPeriodSummary("0"); err != nil || status != http.StatusConflict {
+		t.Fatal("the summary was served before the finalization:", status, err)
+	}
+
+	glow.SetCurrentTimeslot(2116)
+	var ps PeriodStatus
+	for i := 0; i < 200 && ps.Status != PeriodStatusFinalized; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if ps, err = server.getPeriodStatus(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ps.Status != PeriodStatusFinalized || ps.FinalizedAt < 2116 {
+		t.Fatal("the period was not finalized:", ps)
+	}
+	server.mu.RLock()
+	offset, weeks := server.equipmentReportsOffset, len(server.equipmentStatsHistory)
+	server.mu.RUnlock()
+	if offset != 0 || weeks != 1 {
+		t.Fatal("the finalized week should be saved and still in memory:", offset, weeks)
+	}
+
+	// The summary includes the late report.
+	status, data, err := server.getPeriodSummary("0")
+	if err != nil || status != http.StatusOK {
+		t.Fatal("unable to fetch the summary:", status, err)
+	}
+	body, err := glow.VerifySignedResponse(data, server.staticPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary PeriodSummary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Devices) != 1 || summary.Devices[0].Reports != 2 || summary.TotalEnergy != 10 || summary.FinalizedAt != ps.FinalizedAt {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+
+	// A late report for the finalized week is rejected and counted, while
+	// the next week keeps taking reports.
+	rejected := server.staticMetrics.ReportsRejected(reportFinalized)
+	if outcome := send(2001); outcome != reportFinalized {
+		t.Fatal("late report for the finalized period was not rejected:", outcome)
+	}
+	if server.staticMetrics.ReportsRejected(reportFinalized) != rejected+1 {
+		t.Fatal("the rejected report was not counted")
+	}
+	if reportFinalized.ackStatus() != glow.ReportAckFinalized || reportFinalized.apiErrorCode() != ErrCodePeriodFinalized {
+		t.Fatal("unexpected ack status or error code for a finalized period")
+	}
+	if outcome := send(2100); outcome != reportAccepted {
+		t.Fatal("report for the next period was not accepted:", outcome)
+	}
+
+	// The same goes for overrides.
+	ro := ReportOverride{PublicKey: ea.PublicKey, Timeslot: 2000, PowerOutput: 50, Reason: "meter was reset", Timestamp: time.Now().Unix()}
+	ro.Signature = glow.Sign(ro.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedOverrideReport(ro); errorCode(err, "") != ErrCodePeriodFinalized {
+		t.Fatal("override for the finalized period was not rejected:", err)
+	}
+	if status, err := server.postReportOverride(ro, gcaPrivKey); err != nil || status != http.StatusConflict {
+		t.Fatal("unexpected status for an override of the finalized period:", status, err)
+	}
+	ro.Timeslot = 2100
+	if status, err := server.postReportOverride(ro, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("override for the next period was not accepted:", status, err)
+	}
+
+	// The finalized week is rotated out by the migration without being
+	// saved again.
+	glow.SetCurrentTimeslot(reportMigrationThreshold + 1)
+	for i := 0; i < 200 && offset == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		server.mu.RLock()
+		offset, weeks = server.equipmentReportsOffset, len(server.equipmentStatsHistory)
+		server.mu.RUnlock()
+	}
+	if offset != 2016 || weeks != 1 {
+		t.Fatal("unexpected migration of the finalized week:", offset, weeks)
+	}
+	if ps, err := server.getPeriodStatus(0); err != nil || ps.Status != PeriodStatusFinalized || ps.FinalizedAt != summary.FinalizedAt {
+		t.Fatal("unexpected status after the migration:", ps, err)
+	}
+	if ps, err := server.getPeriodStatus(1); err != nil || ps.Status != PeriodStatusOpen {
+		t.Fatal("unexpected status for the next period:", ps, err)
+	}
+}
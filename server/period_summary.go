@@ -0,0 +1,182 @@
+package server
+
+// period_summary.go contains the final figures of every completed week, for
+// the relayer that pushes the weekly production on chain. Reassembling a week
+// from the stats, the overrides and the bans leaves room for the relayer and
+// the server to disagree about which reports count, so the server publishes
+// the totals that it considers final instead.
+//
+// The summary of a week is built once, when the week gets finalized, see
+// period_finalization.go. At that point no report or override can be added to
+// the week anymore. The totals come from the same stats that get saved to the
+// stats history, so they include the overrides of the GCA, count banned
+// timeslots as zero, and leave out flagged reports that were never accepted.
+// A banned device is listed with its reports from before the ban, see
+// ban_accounting.go.
+// The summary also carries the report root of the week, see report_roots.go.
+//
+// The summary is signed and then persisted as a glow.SignedResponse, and the
+// endpoint returns the persisted bytes. Every call for the same week returns
+// exactly the same payload and signature, which the relayer can forward or
+// compare without re-serializing anything.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// PeriodDeviceTotal contains the final totals of a device for a week.
+type PeriodDeviceTotal struct {
+	ShortID            uint32         `json:"short_id"`
+	PublicKey          glow.PublicKey `json:"pubkey"`
+	TotalEnergy        int64          `json:"total_energy"`           // Credited milliwatt hours of every unbanned report
+	CarbonImpact       float64        `json:"carbon_impact"`          // Grams, see api_device_impact.go
+	Reports            uint32         `json:"reports"`                // Timeslots with an unbanned report
+	BannedTimeslots    uint32         `json:"banned_timeslots"`       // Timeslots whose report was banned
+	CorrectedTimeslots uint32         `json:"corrected_timeslots"`    // Timeslots that the GCA overrode
+	OutageTimeslots    uint32         `json:"outage_timeslots"`       // Timeslots that the GCA filled in for an outage
+	Banned             bool           `json:"banned"`                 // Whether the device is banned, see ban_accounting.go
+	BanTimeslot        uint32         `json:"ban_timeslot,omitempty"` // The timeslot from which on the reports of a banned device don't count
+}
+
+// PeriodSummary contains the final totals of every device that reported in
+// the week with the number Period, which covers the timeslots [PeriodStart,
+// PeriodEnd).
+type PeriodSummary struct {
+	Period      uint32              `json:"period"`
+	PeriodStart uint32              `json:"period_start"`
+	PeriodEnd   uint32              `json:"period_end"`
+	TotalEnergy int64               `json:"total_energy"` // Milliwatt hours, over every device
+	Devices     []PeriodDeviceTotal `json:"devices"`      // In order of ShortID
+	ReportRoot  *ReportRootResponse `json:"report_root"`  // Null if the server could not commit to the reports
+	FinalizedAt uint32              `json:"finalized_at"` // The timeslot at which the week was finalized
+}
+
+// periodSummaryFile returns the name of the summary for the week that starts
+// at periodStart.
+func periodSummaryFile(periodStart uint32) string {
+	return path.Join(ReportArchiveDir, fmt.Sprintf("period-summary-%v.json", periodStart))
+}
+
+// buildPeriodSummary builds the summary of the week of the provided stats.
+// The mutex must be held.
+func (gcas *GCAServer) buildPeriodSummary(stats AllDeviceStats) PeriodSummary {
+	periodStart := stats.TimeslotOffset
+	ps := PeriodSummary{
+		Period:      periodStart / 2016,
+		PeriodStart: periodStart,
+		PeriodEnd:   periodStart + 2016,
+		Devices:     []PeriodDeviceTotal{},
+		FinalizedAt: gcas.currentTimeslot(),
+	}
+	for _, ds := range stats.Devices {
+		shortID, exists := gcas.deviceShortID(ds.PublicKey)
+		if !exists {
+			continue
+		}
+		di := computeDeviceImpact(periodStart, ds.PowerOutputs[:], ds.ImpactRates[:], false)
+		total := PeriodDeviceTotal{
+			ShortID:         shortID,
+			PublicKey:       ds.PublicKey,
+			TotalEnergy:     di.TotalEnergy,
+			CarbonImpact:    di.CarbonImpact,
+			BannedTimeslots: di.BannedTimeslots,
+		}
+		for _, output := range ds.PowerOutputs {
+			if output > 1 {
+				total.Reports++
+			}
+		}
+		if total.Reports == 0 && total.BannedTimeslots == 0 {
+			continue
+		}
+		corrected, outages := gcas.overriddenTimeslots(shortID, periodStart, 2016)
+		total.CorrectedTimeslots = uint32(len(corrected))
+		total.OutageTimeslots = uint32(len(outages))
+		total.BanTimeslot, total.Banned = gcas.banTimeslot(shortID)
+		ps.TotalEnergy += total.TotalEnergy
+		ps.Devices = append(ps.Devices, total)
+	}
+	for _, rr := range gcas.reportRoots {
+		if rr.PeriodStart == periodStart {
+			root := reportRootResponse(rr)
+			ps.ReportRoot = &root
+		}
+	}
+	return ps
+}
+
+// finalizePeriodSummary signs and saves the summary of the week of the
+// provided stats. A summary that already exists is left alone, so the signed
+// payload of a week never changes. The mutex must be held.
+func (gcas *GCAServer) finalizePeriodSummary(stats AllDeviceStats) error {
+	name := periodSummaryFile(stats.TimeslotOffset)
+	if _, err := gcas.staticStorage.Stat(name); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("unable to check for an existing period summary: %v", err)
+	}
+	body, err := json.Marshal(gcas.buildPeriodSummary(stats))
+	if err != nil {
+		return fmt.Errorf("unable to encode period summary: %v", err)
+	}
+	sr := glow.NewSignedResponse(body, gcas.now().Unix(), gcas.staticPublicKey, gcas.staticPrivateKey)
+	data, err := json.Marshal(sr)
+	if err != nil {
+		return fmt.Errorf("unable to encode signed period summary: %v", err)
+	}
+	if err := gcas.staticStorage.WriteFile(name, append(data, '\n'), 0444); err != nil {
+		return fmt.Errorf("unable to write period summary: %v", err)
+	}
+	return nil
+}
+
+// PeriodSummaryHandler returns the signed PeriodSummary of the week with the
+// number in the 'period' query parameter, wrapped in a glow.SignedResponse.
+// Weeks that are still open, or that have not been finalized yet, get a 409
+// CONFLICT.
+func (gcas *GCAServer) PeriodSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for a period summary.")
+		return
+	}
+	period, err := strconv.ParseUint(r.URL.Query().Get("period"), 10, 32)
+	if err != nil || period > math.MaxUint32/2016 {
+		gcas.writeError(w, ErrCodeMalformedRequest, "period must be a period number")
+		return
+	}
+	periodStart := uint32(period) * 2016
+	if periodStart+2016 > gcas.currentTimeslot() {
+		gcas.writeError(w, ErrCodeConflict, "the period is still open")
+		return
+	}
+
+	data, err := gcas.staticStorage.ReadFile(periodSummaryFile(periodStart))
+	if os.IsNotExist(err) {
+		gcas.mu.RLock()
+		finalized := gcas.isFinalizedTimeslot(periodStart)
+		gcas.mu.RUnlock()
+		if !finalized {
+			gcas.writeError(w, ErrCodeConflict, "the period has not been finalized yet")
+			return
+		}
+		gcas.writeError(w, ErrCodeNotFound, "the server has no summary for the period")
+		return
+	}
+	if err != nil {
+		gcas.writeError(w, ErrCodeInternalError, "the summary of the period is unavailable")
+		gcas.requestLogger(r).Errorf("unable to read the summary for period %v: %v", periodStart, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
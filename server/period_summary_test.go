@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getPeriodSummary fetches the raw response for a period summary.
+func (gcas *GCAServer) getPeriodSummary(period string) (int, []byte, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/period-summary?period=%v", gcas.httpPort, period))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// TestPeriodSummary checks that the summary of a week is only served once
+// the week has rotated out of the reporting window, that it contains the
+// final totals and the report root, and that every call returns the same
+// signed bytes, across a restart as well.
+func TestPeriodSummary(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer glow.SetCurrentTimeslot(0)
+
+	keys := make(map[uint32]glow.PublicKey)
+	for shortID := uint32(1); shortID <= 3; shortID++ {
+		ea, ePriv, err := server.AuthorizeTestDevice(shortID, gcaPrivKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[shortID] = ea.PublicKey
+		for ts := uint32(0); ts < 5*shortID; ts++ {
+			if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(shortID, ts, ePriv)); outcome != reportAccepted {
+				t.Fatal("report was not accepted:", outcome)
+			}
+		}
+		// A conflicting report bans the first device, which takes it
+		// out of the summary.
+		if shortID == 1 {
+			er := glow.EquipmentReport{ShortID: shortID, Timeslot: 0, PowerOutput: 9}
+			er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+			if outcome, _ := server.managedHandleEquipmentReport(er.Serialize()); outcome != reportBanned {
+				t.Fatal("conflicting report did not ban the device:", outcome)
+			}
+		}
+	}
+
+	// The current week is open, and a completed week that is still in the
+	// reporting window is not final yet.
+	for _, ts := range []uint32{0, 2100} {
+		glow.SetCurrentTimeslot(ts)
+		if status, _, err := server.getPeriodSummary("0"); err != nil || status != http.StatusConflict {
+			t.Fatal("unexpected status for a period that is not final:", ts, status, err)
+		}
+	}
+	if status, _, err := server.getPeriodSummary("nope"); err != nil || status != http.StatusBadRequest {
+		t.Fatal("unexpected status for a bad period:", status, err)
+	}
+
+	glow.SetCurrentTimeslot(3300)
+	var first []byte
+	for i := 0; i < 100; i++ {
+		status, data, err := server.getPeriodSummary("0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status == http.StatusOK {
+			first = data
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if first == nil {
+		t.Fatal("the summary was not finalized")
+	}
+	body, err := glow.VerifySignedResponse(first, server.staticPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ps PeriodSummary
+	if err := json.Unmarshal(body, &ps); err != nil {
+		t.Fatal(err)
+	}
+	if ps.Period != 0 || ps.PeriodStart != 0 || ps.PeriodEnd != 2016 || len(ps.Devices) != 2 || ps.TotalEnergy != 5*(10+15) {
+		t.Fatalf("unexpected summary: %+v", ps)
+	}
+	for i, total := range ps.Devices {
+		shortID := uint32(i + 2)
+		if total.ShortID != shortID || total.PublicKey != keys[shortID] || total.Reports != 5*shortID || total.BannedTimeslots != 0 || total.TotalEnergy != 25*int64(shortID) {
+			t.Fatalf("unexpected totals: %+v", total)
+		}
+	}
+	server.mu.RLock()
+	root := reportRootResponse(server.reportRoots[0])
+	server.mu.RUnlock()
+	if ps.ReportRoot == nil || *ps.ReportRoot != root {
+		t.Fatal("the summary does not carry the report root:", ps.ReportRoot)
+	}
+	if status, _, _ := server.getPeriodSummary("1"); status != http.StatusConflict {
+		t.Fatal("unexpected status for the open period:", status)
+	}
+
+	// Every call returns the same bytes, also after a restart.
+	if status, data, err := server.getPeriodSummary("0"); err != nil || status != http.StatusOK || string(data) != string(first) {
+		t.Fatal("the summary changed between calls:", status, err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	<-server.staticStatsHistoryLoaded
+	server.mu.Lock()
+	stats := server.equipmentStatsHistory[0]
+	err = server.finalizePeriodSummary(stats)
+	server.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, data, err := server.getPeriodSummary("0"); err != nil || status != http.StatusOK || string(data) != string(first) {
+		t.Fatal("the summary changed after a restart:", status, err)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+// persist_health.go keeps the server from claiming that it accepted reports
+// that it could not store durably. When a report can't be written to the
+// reports journal or to the flagged reports file, the report stays in the
+// state and gets queued for another write, and the server becomes degraded:
+// the healthz endpoint returns a 503, and every report that arrives gets the
+// retry_later outcome, which is acked with ReportAckRetryLater so that the
+// device holds on to the report and sends it again. This includes the report
+// whose write failed. A background thread retries the queued writes with an
+// exponential backoff, and the server recovers once all of them succeeded.
+//
+// The server also becomes degraded while the free space of the server
+// directory is below ServerOptions.MinFreeDisk, which lets it stop accepting
+// reports before the writes start to fail. The free space is checked every
+// diskCheckFrequency.
+//
+// Becoming degraded because of a failed write, and recovering from it, send a
+// "persist.failed" and a "persist.recovered" alert, see alerts.go.
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// unpersistedReport is a report that was recorded in the state, but could not
+// be written to disk.
+type unpersistedReport struct {
+	report  glow.EquipmentReport
+	flagged bool
+}
+
+// PersistEvent is the alert that is sent when the server starts and stops
+// refusing reports because a write failed.
+type PersistEvent struct {
+	Event      string `json:"event"` // Either "persist.failed" or "persist.recovered"
+	Error      string `json:"error"` // The write that failed, for recoveries the last one
+	DetectedAt int64  `json:"detected_at"`
+}
+
+// alertType implements alertEvent.
+func (e PersistEvent) alertType() string { return e.Event }
+
+// alertSummary implements alertEvent.
+func (e PersistEvent) alertSummary() string {
+	if e.Event == alertEventPersistRecovered {
+		return fmt.Sprintf("reports are persisted again, the last failure was %v", e.Error)
+	}
+	return fmt.Sprintf("unable to persist reports, refusing reports until the write succeeds: %v", e.Error)
+}
+
+// diskFree returns the number of bytes that are available to the server in
+// the provided directory.
+func diskFree(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// persistReport writes a report that was recorded in the state to the file
+// that it belongs in, and returns the name of that file. The mutex must be
+// held.
+func (gcas *GCAServer) persistReport(report glow.EquipmentReport, flagged bool) (string, error) {
+	file := ReportsJournalFile
+	if flagged {
+		file = FlaggedReportsFile
+	}
+	if gcas.persistHook != nil {
+		if err := gcas.persistHook(file); err != nil {
+			return file, err
+		}
+	}
+	if flagged {
+		return file, gcas.saveFlaggedReport(report)
+	}
+	return file, gcas.saveEquipmentReport(report)
+}
+
+// storageDegraded returns whether the server refuses new reports because it
+// can't store them. The mutex must be held.
+func (gcas *GCAServer) storageDegraded() bool {
+	return len(gcas.unpersistedReports) > 0 || gcas.lowDisk
+}
+
+// updateStorageMetrics publishes the storage state to the metrics. The mutex
+// must be held.
+func (gcas *GCAServer) updateStorageMetrics() {
+	gcas.staticMetrics.SetStorageState(gcas.storageDegraded(), gcas.diskFree)
+}
+
+// queueUnpersistedReport queues a report whose write failed for another
+// attempt. The mutex must be held.
+func (gcas *GCAServer) queueUnpersistedReport(report glow.EquipmentReport, flagged bool, file string, err error) {
+	gcas.unpersistedReports = append(gcas.unpersistedReports, unpersistedReport{report: report, flagged: flagged})
+	gcas.recordPersistFailure(file, err)
+	gcas.updateStorageMetrics()
+	if len(gcas.unpersistedReports) == 1 {
+		gcas.recordDegraded(TimelineReasonPersistFailed, true)
+		gcas.queueAlert(PersistEvent{Event: alertEventPersistFailed, Error: gcas.persistErr.Error(), DetectedAt: gcas.now().Unix()})
+	}
+}
+
+// recordPersistFailure records and logs a write that failed. The mutex must
+// be held.
+func (gcas *GCAServer) recordPersistFailure(file string, err error) {
+	gcas.staticMetrics.RecordPersistFailure()
+	gcas.persistErr = fmt.Errorf("%v: %v", file, err)
+	gcas.logger.WithFields("file", file, "unpersisted_reports", len(gcas.unpersistedReports)).Errorf("PERSIST FAILURE: unable to write %v: %v, refusing reports until the write succeeds", file, err)
+}
+
+// retryUnpersistedReports writes the queued reports in the order that they
+// were recorded, stopping at the first write that fails. A journal record
+// that gets written after the fact is adopted by the report, unless the slot
+// of the report changed in the meantime. It returns whether every report was
+// written. The mutex must be held.
+func (gcas *GCAServer) retryUnpersistedReports() bool {
+	for len(gcas.unpersistedReports) > 0 {
+		ur := gcas.unpersistedReports[0]
+		record := gcas.nextReportRecord()
+		file, err := gcas.persistReport(ur.report, ur.flagged)
+		if err != nil {
+			gcas.recordPersistFailure(file, err)
+			return false
+		}
+		gcas.unpersistedReports = gcas.unpersistedReports[1:]
+		if !ur.flagged {
+			gcas.adoptReportRecord(ur.report, record)
+		}
+	}
+	gcas.unpersistedReports = nil
+	gcas.logger.Warnf("persisted every queued report, the last failure was %v", gcas.persistErr)
+	gcas.queueAlert(PersistEvent{Event: alertEventPersistRecovered, Error: gcas.persistErr.Error(), DetectedAt: gcas.now().Unix()})
+	gcas.recordDegraded(TimelineReasonPersistFailed, false)
+	gcas.persistErr = nil
+	gcas.updateStorageMetrics()
+	return true
+}
+
+// adoptReportRecord gives a report that only had its signature in memory the
+// record that it got written to. The mutex must be held.
+func (gcas *GCAServer) adoptReportRecord(report glow.EquipmentReport, record uint32) {
+	ero := gcas.equipmentReportsOffset
+	dr, exists := gcas.equipmentReports[report.ShortID]
+	if !exists || report.Timeslot < ero || report.Timeslot >= ero+4032 {
+		return
+	}
+	i := int(report.Timeslot - ero)
+	if dr.Records[i] == 0 && dr.PowerOutputs[i] == report.PowerOutput && dr.Signatures[uint16(i)] == report.Signature {
+		dr.setReport(i, report, record)
+	}
+}
+
+// managedCheckDiskSpace checks the free space of the server directory against
+// the low disk watermark.
+func (gcas *GCAServer) managedCheckDiskSpace() {
+	if gcas.staticMinFreeDisk == 0 {
+		return
+	}
+	free, err := diskFree(gcas.baseDir)
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if err != nil {
+		gcas.logger.Errorf("unable to check the free disk space of %v: %v", gcas.baseDir, err)
+		return
+	}
+	low := free < gcas.staticMinFreeDisk
+	if low && !gcas.lowDisk {
+		gcas.logger.Errorf("LOW DISK: only %v bytes are free in %v, which is below the watermark of %v bytes, refusing reports until space is freed", free, gcas.baseDir, gcas.staticMinFreeDisk)
+	}
+	if !low && gcas.lowDisk {
+		gcas.logger.Warnf("%v bytes are free in %v again, accepting reports", free, gcas.baseDir)
+	}
+	gcas.recordDegraded(TimelineReasonDiskFull, low)
+	gcas.lowDisk = low
+	gcas.diskFree = free
+	gcas.updateStorageMetrics()
+}
+
+// threadedWatchStorage checks the free disk space and retries the queued
+// writes. The retries back off exponentially while they keep failing.
+func (gcas *GCAServer) threadedWatchStorage() {
+	attempts := 0
+	for {
+		wait := diskCheckFrequency
+		gcas.mu.RLock()
+		pending := len(gcas.unpersistedReports) > 0
+		gcas.mu.RUnlock()
+		if pending {
+			wait = persistMaxBackoff
+			if attempts < 20 && persistRetryBackoff<<attempts < wait {
+				wait = persistRetryBackoff << attempts
+			}
+		}
+		if wait > diskCheckFrequency {
+			wait = diskCheckFrequency
+		}
+		if !gcas.sleep(wait) {
+			return
+		}
+		gcas.managedCheckDiskSpace()
+
+		gcas.mu.Lock()
+		if len(gcas.unpersistedReports) == 0 {
+			attempts = 0
+		} else if gcas.retryUnpersistedReports() {
+			attempts = 0
+		} else {
+			attempts++
+		}
+		gcas.mu.Unlock()
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestPersistFailure checks that a server which can't write its reports
+// stops acking them as accepted and reports itself as unhealthy, and that it
+// writes the report whose write failed once the disk works again.
+func TestPersistFailure(t *testing.T) {
+	glow.SetCurrentTimeslot(100)
+	defer glow.SetCurrentTimeslot(0)
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(ts uint32) reportOutcome {
+		outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, ts, priv))
+		return outcome
+	}
+	if outcome := send(100); outcome != reportAccepted {
+		t.Fatal("report was not accepted:", outcome)
+	}
+
+	// Fill up the disk. The report whose write fails stays in memory, but
+	// neither it nor the reports after it are accepted.
+	server.mu.Lock()
+	server.persistHook = func(string) error { return syscall.ENOSPC }
+	server.mu.Unlock()
+	if outcome := send(101); outcome != reportRetryLater || outcome.ackStatus() != glow.ReportAckRetryLater {
+		t.Fatal("unexpected outcome for a report that could not be written:", outcome)
+	}
+	if outcome := send(102); outcome != reportRetryLater {
+		t.Fatal("unexpected outcome while the storage is degraded:", outcome)
+	}
+	server.mu.RLock()
+	stored := server.equipmentReports[1].PowerOutputs[101] == 5 && server.equipmentReports[1].PowerOutputs[102] == 0
+	server.mu.RUnlock()
+	if !stored {
+		t.Fatal("unexpected reports in memory")
+	}
+	status, hr, err := server.getHealthz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusServiceUnavailable || hr.Status != "storage degraded" || hr.StorageHealthy || hr.UnpersistedReports != 1 || !strings.Contains(hr.StorageError, ReportsJournalFile) {
+		t.Fatal("unexpected healthz response:", status, hr)
+	}
+	if server.staticMetrics.ReportsRejected(reportRetryLater) != 2 || server.staticMetrics.persistFailures.Load() == 0 {
+		t.Fatal("the failures are missing from the metrics")
+	}
+
+	// Free up the disk, the queued report gets written and the server
+	// recovers.
+	server.mu.Lock()
+	server.persistHook = nil
+	server.mu.Unlock()
+	for i := 0; ; i++ {
+		status, hr, err = server.getHealthz()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status == http.StatusOK {
+			break
+		}
+		if i == 100 {
+			t.Fatal("server did not recover:", hr)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if hr.StorageError != "" || hr.UnpersistedReports != 0 {
+		t.Fatal("unexpected healthz response after the recovery:", hr)
+	}
+	if outcome := send(101); outcome != reportDuplicate {
+		t.Fatal("report that was written late is not a duplicate:", outcome)
+	}
+	if outcome := send(102); outcome != reportAccepted {
+		t.Fatal("report was not accepted after the recovery:", outcome)
+	}
+	server.mu.RLock()
+	record := server.equipmentReports[1].Records[101]
+	server.mu.RUnlock()
+	if record == 0 {
+		t.Fatal("report that was written late did not get its record")
+	}
+
+	// All of the reports survive a restart.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.mu.RLock()
+	reports := server.equipmentReports[1]
+	loaded := reports.PowerOutputs[100] == 5 && reports.PowerOutputs[101] == 5 && reports.PowerOutputs[102] == 5
+	server.mu.RUnlock()
+	if !loaded {
+		t.Fatal("reports were lost in the restart")
+	}
+}
+
+// TestLowDisk checks that a server refuses reports while the free space of its
+// directory is below the watermark.
+func TestLowDisk(t *testing.T) {
+	glow.SetCurrentTimeslot(100)
+	defer glow.SetCurrentTimeslot(0)
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{MinFreeDisk: 1 << 62})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	_, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, 100, priv)); outcome != reportRetryLater {
+		t.Fatal("report was not refused while the disk is low:", outcome)
+	}
+	status, hr, err := server.getHealthz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusServiceUnavailable || !hr.LowDisk || hr.DiskFreeBytes == 0 || hr.StorageError != "" {
+		t.Fatal("unexpected healthz response:", status, hr)
+	}
+}
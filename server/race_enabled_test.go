@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package server
+
+// raceEnabled is set when the tests run with the race detector, which slows
+// down the code enough that timing thresholds need more headroom.
+const raceEnabled = true
@@ -0,0 +1,207 @@
+package server
+
+// readonly_state.go opens the state of a server directory without running a
+// server, for tools such as analytics jobs that work on a copy of the
+// directory. OpenStateReadOnly loads the state with the same code as
+// NewGCAServer, see loadState in server.go, so that both understand the
+// persist files in the same way, but it binds no ports, launches no
+// background threads, and never writes to the directory: whatever loading
+// would change is kept in memory, see storage_readonly.go. On top of what a
+// server loads at startup, the whole stats history and every report archive
+// get read and checked, so a directory that opens is a directory that can be
+// read in full.
+//
+// A directory that a running server holds the lock of, see dir_lock.go, is
+// refused, because the files can change in the middle of the load. Force
+// opens it anyway, for a server that is known to be idle.
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// ReadOnlyOptions are the options of OpenStateReadOnly.
+type ReadOnlyOptions struct {
+	// Force opens the directory even if a running server holds its lock.
+	Force bool
+
+	// Storage is where the persist files get read from, nil reads them
+	// from the files in the directory. Nothing is ever written to it.
+	Storage Storage
+
+	// Logger gets the warnings of the load, such as a torn record at the
+	// end of a log. Nil writes them to stdout.
+	Logger *Logger
+}
+
+// ReadOnlyState is the state of a server directory that was opened with
+// OpenStateReadOnly. Its methods are safe to call concurrently.
+type ReadOnlyState struct {
+	gcas *GCAServer
+}
+
+// OpenStateReadOnly loads and verifies the state of the server directory at
+// dir without running a server. The state has to be closed when it is no
+// longer needed.
+func OpenStateReadOnly(dir string, opts ReadOnlyOptions) (*ReadOnlyState, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat the server directory: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", dir)
+	}
+	if !opts.Force {
+		locked, err := serverDirLocked(dir)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return nil, fmt.Errorf("unable to open %v: %w", dir, ErrServerDirLocked)
+		}
+	}
+
+	gcas, err := newGCAServer(dir, false, DefaultServerOptions())
+	if err != nil {
+		return nil, err
+	}
+	gcas.skipInvariants = true
+	gcas.historyRetentionWeeks = defaultHistoryRetentionWeeks
+	gcas.logger = opts.Logger
+	if gcas.logger == nil {
+		gcas.logger = NewStdoutLogger(WARN)
+	}
+	base := opts.Storage
+	if base == nil {
+		base = defaultStorage(dir)
+	}
+	// A directory without the keys of a server has never had a server
+	// run in it.
+	if _, err := base.Stat(ServerKeysFile); err != nil {
+		return nil, fmt.Errorf("%v is not a server directory: %v", dir, err)
+	}
+	gcas.staticStorage = newReadOnlyStorage(base)
+
+	ros := &ReadOnlyState{gcas: gcas}
+	if err := ros.load(); err != nil {
+		gcas.tg.Stop()
+		return nil, err
+	}
+	return ros, nil
+}
+
+// load loads the state, the stats history, and checks the archives.
+func (ros *ReadOnlyState) load() error {
+	gcas := ros.gcas
+	historySize, historyEntries, err := gcas.loadState()
+	if err != nil {
+		return err
+	}
+	if err := gcas.decodeEquipmentHistory(historySize, historyEntries); err != nil {
+		return fmt.Errorf("unable to load the device stats history: %v", err)
+	}
+	periods, err := gcas.archivedPeriods()
+	if err != nil {
+		return err
+	}
+	for _, periodStart := range periods {
+		if _, err := gcas.loadReportArchive(periodStart); err != nil {
+			return fmt.Errorf("unable to load the archive of period %v: %v", periodStart, err)
+		}
+	}
+	return nil
+}
+
+// Close releases the files of the state.
+func (ros *ReadOnlyState) Close() error {
+	return ros.gcas.tg.Stop()
+}
+
+// PublicKey returns the key of the server that the directory belongs to.
+func (ros *ReadOnlyState) PublicKey() glow.PublicKey {
+	return ros.gcas.staticPublicKey
+}
+
+// Equipment returns the authorizations of the equipment that isn't banned, in
+// order of ShortID.
+func (ros *ReadOnlyState) Equipment() []glow.EquipmentAuthorization {
+	ros.gcas.mu.RLock()
+	defer ros.gcas.mu.RUnlock()
+	equipment := make([]glow.EquipmentAuthorization, 0, len(ros.gcas.equipment))
+	for _, ea := range ros.gcas.equipment {
+		equipment = append(equipment, ea)
+	}
+	sort.Slice(equipment, func(i, j int) bool { return equipment[i].ShortID < equipment[j].ShortID })
+	return equipment
+}
+
+// BannedEquipment returns every banned ShortID, in order.
+func (ros *ReadOnlyState) BannedEquipment() []BannedEquipment {
+	ros.gcas.mu.RLock()
+	defer ros.gcas.mu.RUnlock()
+	banned := make([]BannedEquipment, 0, len(ros.gcas.equipmentBans))
+	for shortID := range ros.gcas.equipmentBans {
+		banned = append(banned, ros.gcas.buildBannedEquipment(shortID))
+	}
+	sort.Slice(banned, func(i, j int) bool { return banned[i].ShortID < banned[j].ShortID })
+	return banned
+}
+
+// DeviceSummary returns the summary of the current week of a device, with the
+// current time of the machine. The bool is false if the device has no reports
+// in the reporting window, which includes the banned devices whose ban is
+// older than the window.
+func (ros *ReadOnlyState) DeviceSummary(shortID uint32) (DeviceSummary, bool) {
+	ros.gcas.mu.RLock()
+	defer ros.gcas.mu.RUnlock()
+	if _, exists := ros.gcas.windowReports(shortID); !exists {
+		return DeviceSummary{}, false
+	}
+	return ros.gcas.buildDeviceSummary(shortID, ros.gcas.currentTimeslot()), true
+}
+
+// ReportsOffset returns the first timeslot of the reporting window, which
+// holds the two weeks of reports that haven't been archived yet.
+func (ros *ReadOnlyState) ReportsOffset() uint32 {
+	ros.gcas.mu.RLock()
+	defer ros.gcas.mu.RUnlock()
+	return ros.gcas.equipmentReportsOffset
+}
+
+// Reports returns the signed reports of a device in the reporting window, in
+// order of timeslot. A banned device only has the reports that count, see
+// ban_accounting.go.
+func (ros *ReadOnlyState) Reports(shortID uint32) ([]glow.EquipmentReport, error) {
+	ros.gcas.mu.RLock()
+	defer ros.gcas.mu.RUnlock()
+	if _, exists := ros.gcas.windowReports(shortID); !exists {
+		return nil, fmt.Errorf("ShortID %v has no reports in the reporting window", shortID)
+	}
+	return ros.gcas.signedReports(shortID, 0, 4032)
+}
+
+// Periods returns the first timeslot of every week that has an archive of its
+// reports, in order.
+func (ros *ReadOnlyState) Periods() ([]uint32, error) {
+	return ros.gcas.archivedPeriods()
+}
+
+// Period returns the archive of the reports of the week that starts at
+// periodStart.
+func (ros *ReadOnlyState) Period(periodStart uint32) (ReportArchive, error) {
+	return ros.gcas.loadReportArchive(periodStart)
+}
+
+// DeviceStats returns the unsigned stats of every device for the week that
+// starts at timeslotOffset, which is either in the stats history or in the
+// reporting window. The stats are shared and must not be modified.
+func (ros *ReadOnlyState) DeviceStats(timeslotOffset uint32) (AllDeviceStats, error) {
+	snap, err := ros.gcas.managedStatsSnapshot(timeslotOffset)
+	if err != nil {
+		return AllDeviceStats{}, err
+	}
+	return snap.stats, nil
+}
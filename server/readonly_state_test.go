@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// storageContents returns every file of a storage and its data.
+func storageContents(t *testing.T, s Storage) map[string][]byte {
+	t.Helper()
+	names, err := s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string][]byte, len(names))
+	for _, name := range names {
+		data, err := s.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[name] = data
+	}
+	return contents
+}
+
+// TestOpenStateReadOnly opens the directory of a server with devices, reports,
+// a ban and an override, and checks that the read-only state matches the
+// server without changing any of its files.
+func TestOpenStateReadOnly(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(20)
+	defer glow.SetCurrentTimeslot(0)
+	ea, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, priv2, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := uint32(1); ts <= 5; ts++ {
+		server.managedHandleEquipmentReport(generateTestReport(1, ts, priv))
+		server.managedHandleEquipmentReport(generateTestReport(2, ts, priv2))
+	}
+	ro := ReportOverride{PublicKey: ea.PublicKey, Timeslot: 3, PowerOutput: 50, Reason: "meter was reset", Timestamp: time.Now().Unix()}
+	if status, err := server.postReportOverride(ro, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("unable to override:", status, err)
+	}
+	// A second report for a timeslot with another output bans device 2.
+	er := glow.EquipmentReport{ShortID: 2, Timeslot: 5, PowerOutput: 9}
+	er.Signature = glow.Sign(er.SigningBytes(), priv2)
+	server.managedHandleEquipmentReport(er.Serialize())
+
+	// The directory of a running server is refused, unless forced.
+	if _, err := OpenStateReadOnly(dir, ReadOnlyOptions{}); !errors.Is(err, ErrServerDirLocked) {
+		t.Fatal("the directory of a running server was opened:", err)
+	}
+	ros, err := OpenStateReadOnly(dir, ReadOnlyOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ros.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// So is a second server.
+	if _, err := NewGCAServer(dir, false); !errors.Is(err, ErrServerDirLocked) {
+		t.Fatal("a second server started in the directory:", err)
+	}
+
+	server.mu.RLock()
+	wantSummary := server.buildDeviceSummary(1, server.currentTimeslot())
+	server.mu.RUnlock()
+	wantStats, err := server.managedStatsSnapshot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := storageContents(t, serverStorage(dir))
+
+	ros, err = OpenStateReadOnly(dir, ReadOnlyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ros.PublicKey() != server.staticPublicKey {
+		t.Fatal("the state has the wrong key")
+	}
+	if equipment := ros.Equipment(); len(equipment) != 1 || equipment[0] != ea {
+		t.Fatalf("unexpected equipment: %+v", equipment)
+	}
+	if banned := ros.BannedEquipment(); len(banned) != 1 || banned[0].ShortID != 2 {
+		t.Fatalf("unexpected bans: %+v", banned)
+	}
+	summary, ok := ros.DeviceSummary(1)
+	if !ok || summary.TotalEnergy != wantSummary.TotalEnergy || summary.TotalEnergy == 0 {
+		t.Fatalf("unexpected summary: %v %+v", ok, summary)
+	}
+	if _, ok := ros.DeviceSummary(3); ok {
+		t.Fatal("an unknown device has a summary")
+	}
+	reports, err := ros.Reports(1)
+	if err != nil || len(reports) != 5 || reports[2].Timeslot != 3 {
+		t.Fatalf("unexpected reports: %v %+v", err, reports)
+	}
+	if _, err := ros.Reports(3); err == nil {
+		t.Fatal("an unknown device has reports")
+	}
+	if ros.ReportsOffset() != 0 {
+		t.Fatal("unexpected reports offset:", ros.ReportsOffset())
+	}
+	if periods, err := ros.Periods(); err != nil || len(periods) != 0 {
+		t.Fatal("unexpected periods:", periods, err)
+	}
+	stats, err := ros.DeviceStats(0)
+	if err != nil || len(stats.Devices) != len(wantStats.stats.Devices) {
+		t.Fatalf("unexpected stats: %v %+v", err, stats)
+	}
+	// The reports are those that the device signed, the stats have the
+	// override applied.
+	if stats.Devices[0].PowerOutputs[3] != 50 {
+		t.Fatal("the stats are missing the override:", stats.Devices[0].PowerOutputs[3])
+	}
+	for i := range stats.Devices {
+		if stats.Devices[i].PublicKey != wantStats.stats.Devices[i].PublicKey || stats.Devices[i].PowerOutputs != wantStats.stats.Devices[i].PowerOutputs {
+			t.Fatal("the stats don't match those of the server for device", i)
+		}
+	}
+	if err := ros.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing in the directory changed, and a server still starts in it.
+	after := storageContents(t, serverStorage(dir))
+	if len(after) != len(before) {
+		t.Fatal("the number of files changed:", len(before), len(after))
+	}
+	for name, data := range before {
+		if !bytes.Equal(after[name], data) {
+			t.Fatal("the read-only state changed", name)
+		}
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// A directory that never had a server is refused.
+	if _, err := OpenStateReadOnly(t.TempDir(), ReadOnlyOptions{}); err == nil {
+		t.Fatal("an empty directory was opened")
+	}
+}
@@ -0,0 +1,461 @@
+package server
+
+// reload.go applies the settings that can be changed while the server is
+// running. They come from three places in the server directory:
+//
+//   - server-config.json holds the log level, the limits of the UDP rate
+//     limiter, the limits of the HTTP API, and the alert backends, which
+//     alerts.go describes, for example:
+//
+//     {
+//     "log_level": "debug",
+//     "device_report_interval": "150s",
+//     "device_report_burst": 432,
+//     "unknown_report_interval": "10ms",
+//     "unknown_report_burst": 100,
+//     "http_query_interval": "1s",
+//     "http_query_burst": 60,
+//     "http_write_interval": "10s",
+//     "http_write_burst": 30,
+//     "max_request_body": 65536,
+//     "max_batch_request_body": 8388608,
+//     "cors_origins": ["https://dashboard.example.com"],
+//     "history_retention_weeks": 12,
+//     "online_timeslots": 24,
+//     "anomaly_check_timeslots": 12,
+//     "anomaly_night_timeslots": 3,
+//     "anomaly_constant_timeslots": 36,
+//     "anomaly_spike_factor": 3,
+//     "anomaly_spike_percentile": 95
+//     }
+//
+//   - webhooks.json holds the device status webhooks, see offline_webhooks.go.
+//
+//   - watttime_data/username and watttime_data/password hold the WattTime
+//     credentials, unless the credentials were passed in the ServerOptions.
+//
+// The files are read at startup, and again every time Reload is called, which
+// the gca-server binary does on SIGHUP. A setting that is missing from
+// server-config.json falls back to its default. Settings that can only be
+// changed with a restart, like the ports, are recognized in the config file
+// but reported as ignored. Nothing gets applied if any of the files is
+// invalid. A reload also picks up changes to the authorized servers file right
+// away instead of waiting for threadedWatchAuthorizedServers.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// restartOnlySettings are the settings of server-config.json that can't be
+// changed while the server is running.
+var restartOnlySettings = map[string]struct{}{
+	"dir":            {},
+	"http_port":      {},
+	"tcp_port":       {},
+	"udp_port":       {},
+	"http_addr":      {},
+	"tcp_addr":       {},
+	"udp_addr":       {},
+	"report_workers": {},
+	"tls_cert":       {},
+	"tls_key":        {},
+}
+
+// serverConfig contains the settings of server-config.json that can be changed
+// while the server is running.
+type serverConfig struct {
+	LogLevel              string   `json:"log_level"`
+	DeviceReportInterval  string   `json:"device_report_interval"`
+	DeviceReportBurst     int64    `json:"device_report_burst"`
+	UnknownReportInterval string   `json:"unknown_report_interval"`
+	UnknownReportBurst    int64    `json:"unknown_report_burst"`
+	HTTPQueryInterval     string   `json:"http_query_interval"`
+	HTTPQueryBurst        int64    `json:"http_query_burst"`
+	HTTPWriteInterval     string   `json:"http_write_interval"`
+	HTTPWriteBurst        int64    `json:"http_write_burst"`
+	MaxRequestBody        int64    `json:"max_request_body"`
+	MaxBatchRequestBody   int64    `json:"max_batch_request_body"`
+	CORSOrigins           []string `json:"cors_origins"`
+	HistoryRetentionWeeks int      `json:"history_retention_weeks"`
+	OnlineTimeslots       int      `json:"online_timeslots"`
+
+	AnomalyCheckTimeslots    int     `json:"anomaly_check_timeslots"`
+	AnomalyNightTimeslots    int     `json:"anomaly_night_timeslots"`
+	AnomalyConstantTimeslots int     `json:"anomaly_constant_timeslots"`
+	AnomalySpikeFactor       float64 `json:"anomaly_spike_factor"`
+	AnomalySpikePercentile   float64 `json:"anomaly_spike_percentile"`
+
+	Alerts *alertsConfig `json:"alerts"`
+}
+
+// runtimeConfig is the full set of settings that Reload applies, after the
+// defaults have been filled in.
+type runtimeConfig struct {
+	logLevel        LogLevel
+	deviceInterval  time.Duration
+	deviceBurst     int64
+	unknownInterval time.Duration
+	unknownBurst    int64
+
+	httpQueryInterval time.Duration
+	httpQueryBurst    int64
+	httpWriteInterval time.Duration
+	httpWriteBurst    int64
+	maxBody           int64
+	maxBatchBody      int64
+
+	corsOrigins []string
+
+	historyRetentionWeeks int
+	onlineTimeslots       uint32
+	anomalyThresholds     anomalyThresholds
+
+	webhooks        webhookConfig
+	webhooksEnabled bool
+	alerts          alertsConfig
+
+	wattTimeUsername string
+	wattTimePassword string
+}
+
+// ReloadResult lists what a call to Reload did.
+type ReloadResult struct {
+	Changed []string // The settings that changed, with their old and new values
+	Ignored []string // The settings that were ignored because they need a restart
+}
+
+// loadRuntimeConfig reads the runtime settings from the server directory. The
+// second return value lists the settings in server-config.json that need a
+// restart.
+func (gcas *GCAServer) loadRuntimeConfig() (runtimeConfig, []string, error) {
+	rc := runtimeConfig{
+		logLevel:        gcas.staticDefaultLogLevel,
+		deviceInterval:  gcas.staticDefaultDeviceInterval,
+		deviceBurst:     gcas.staticDefaultDeviceBurst,
+		unknownInterval: gcas.staticDefaultUnknownInterval,
+		unknownBurst:    gcas.staticDefaultUnknownBurst,
+
+		httpQueryInterval: httpQueryInterval,
+		httpQueryBurst:    httpQueryBurst,
+		httpWriteInterval: httpWriteInterval,
+		httpWriteBurst:    httpWriteBurst,
+		maxBody:           maxRequestBody,
+		maxBatchBody:      maxBatchRequestBody,
+
+		historyRetentionWeeks: defaultHistoryRetentionWeeks,
+		onlineTimeslots:       deviceOnlineTimeslots,
+		anomalyThresholds: anomalyThresholds{
+			checkTimeslots:    defaultAnomalyCheckTimeslots,
+			nightTimeslots:    defaultAnomalyNightTimeslots,
+			constantTimeslots: defaultAnomalyConstantTimeslots,
+			spikeFactor:       defaultAnomalySpikeFactor,
+			spikePercentile:   defaultAnomalySpikePercentile,
+		},
+	}
+
+	// Read the config file. The raw keys are checked first so that typos
+	// and settings that need a restart don't go unnoticed.
+	var ignored []string
+	data, err := os.ReadFile(filepath.Join(gcas.baseDir, ServerConfigFile))
+	if err != nil && !os.IsNotExist(err) {
+		return runtimeConfig{}, nil, fmt.Errorf("unable to read server config: %v", err)
+	}
+	if err == nil {
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return runtimeConfig{}, nil, fmt.Errorf("unable to parse server config: %v", err)
+		}
+		live := reflect.TypeOf(serverConfig{})
+		for key := range raw {
+			if _, exists := restartOnlySettings[key]; exists {
+				ignored = append(ignored, key)
+				continue
+			}
+			known := false
+			for i := 0; i < live.NumField(); i++ {
+				if live.Field(i).Tag.Get("json") == key {
+					known = true
+				}
+			}
+			if !known {
+				return runtimeConfig{}, nil, fmt.Errorf("unknown setting %q in server config", key)
+			}
+		}
+		sort.Strings(ignored)
+
+		var sc serverConfig
+		if err := json.Unmarshal(data, &sc); err != nil {
+			return runtimeConfig{}, nil, fmt.Errorf("unable to parse server config: %v", err)
+		}
+		if sc.LogLevel != "" {
+			if rc.logLevel, err = ParseLogLevel(sc.LogLevel); err != nil {
+				return runtimeConfig{}, nil, err
+			}
+		}
+		if sc.DeviceReportInterval != "" {
+			if rc.deviceInterval, err = parseReportInterval(sc.DeviceReportInterval); err != nil {
+				return runtimeConfig{}, nil, fmt.Errorf("invalid device_report_interval: %v", err)
+			}
+		}
+		if sc.UnknownReportInterval != "" {
+			if rc.unknownInterval, err = parseReportInterval(sc.UnknownReportInterval); err != nil {
+				return runtimeConfig{}, nil, fmt.Errorf("invalid unknown_report_interval: %v", err)
+			}
+		}
+		if sc.DeviceReportBurst < 0 || sc.UnknownReportBurst < 0 {
+			return runtimeConfig{}, nil, fmt.Errorf("report bursts must not be negative")
+		}
+		if sc.DeviceReportBurst != 0 {
+			rc.deviceBurst = sc.DeviceReportBurst
+		}
+		if sc.UnknownReportBurst != 0 {
+			rc.unknownBurst = sc.UnknownReportBurst
+		}
+		if sc.HTTPQueryInterval != "" {
+			if rc.httpQueryInterval, err = parseReportInterval(sc.HTTPQueryInterval); err != nil {
+				return runtimeConfig{}, nil, fmt.Errorf("invalid http_query_interval: %v", err)
+			}
+		}
+		if sc.HTTPWriteInterval != "" {
+			if rc.httpWriteInterval, err = parseReportInterval(sc.HTTPWriteInterval); err != nil {
+				return runtimeConfig{}, nil, fmt.Errorf("invalid http_write_interval: %v", err)
+			}
+		}
+		if sc.HTTPQueryBurst < 0 || sc.HTTPWriteBurst < 0 || sc.MaxRequestBody < 0 || sc.MaxBatchRequestBody < 0 {
+			return runtimeConfig{}, nil, fmt.Errorf("http limits must not be negative")
+		}
+		if sc.HTTPQueryBurst != 0 {
+			rc.httpQueryBurst = sc.HTTPQueryBurst
+		}
+		if sc.HTTPWriteBurst != 0 {
+			rc.httpWriteBurst = sc.HTTPWriteBurst
+		}
+		if sc.MaxRequestBody != 0 {
+			rc.maxBody = sc.MaxRequestBody
+		}
+		if sc.MaxBatchRequestBody != 0 {
+			rc.maxBatchBody = sc.MaxBatchRequestBody
+		}
+		if rc.corsOrigins, err = parseCORSOrigins(sc.CORSOrigins, gcas.allowIntApis); err != nil {
+			return runtimeConfig{}, nil, fmt.Errorf("invalid cors_origins: %v", err)
+		}
+		if sc.HistoryRetentionWeeks < 0 {
+			return runtimeConfig{}, nil, fmt.Errorf("history_retention_weeks must not be negative")
+		}
+		if sc.HistoryRetentionWeeks != 0 {
+			rc.historyRetentionWeeks = sc.HistoryRetentionWeeks
+		}
+		if sc.OnlineTimeslots < 0 {
+			return runtimeConfig{}, nil, fmt.Errorf("online_timeslots must not be negative")
+		}
+		if sc.OnlineTimeslots != 0 {
+			rc.onlineTimeslots = uint32(sc.OnlineTimeslots)
+		}
+		if sc.AnomalyCheckTimeslots < 0 || sc.AnomalyNightTimeslots < 0 || sc.AnomalyConstantTimeslots < 0 {
+			return runtimeConfig{}, nil, fmt.Errorf("anomaly timeslots must not be negative")
+		}
+		if sc.AnomalyCheckTimeslots != 0 {
+			rc.anomalyThresholds.checkTimeslots = uint32(sc.AnomalyCheckTimeslots)
+		}
+		if sc.AnomalyNightTimeslots != 0 {
+			rc.anomalyThresholds.nightTimeslots = uint32(sc.AnomalyNightTimeslots)
+		}
+		if sc.AnomalyConstantTimeslots != 0 {
+			rc.anomalyThresholds.constantTimeslots = uint32(sc.AnomalyConstantTimeslots)
+		}
+		if sc.AnomalySpikeFactor != 0 && sc.AnomalySpikeFactor < 1 {
+			return runtimeConfig{}, nil, fmt.Errorf("anomaly_spike_factor must be at least 1")
+		}
+		if sc.AnomalySpikeFactor != 0 {
+			rc.anomalyThresholds.spikeFactor = sc.AnomalySpikeFactor
+		}
+		if sc.AnomalySpikePercentile < 0 || sc.AnomalySpikePercentile > 100 {
+			return runtimeConfig{}, nil, fmt.Errorf("anomaly_spike_percentile must be between 0 and 100")
+		}
+		if sc.AnomalySpikePercentile != 0 {
+			rc.anomalyThresholds.spikePercentile = sc.AnomalySpikePercentile
+		}
+		if sc.Alerts != nil {
+			if err := sc.Alerts.validate(); err != nil {
+				return runtimeConfig{}, nil, err
+			}
+			rc.alerts = *sc.Alerts
+		}
+	}
+
+	rc.webhooks, rc.webhooksEnabled, err = loadWebhookConfig(gcas.baseDir)
+	if err != nil {
+		return runtimeConfig{}, nil, fmt.Errorf("failed to load webhooks config: %v", err)
+	}
+	if gcas.staticWattTimeUsername != "" || gcas.staticWattTimePassword != "" {
+		rc.wattTimeUsername, rc.wattTimePassword = gcas.staticWattTimeUsername, gcas.staticWattTimePassword
+		return rc, ignored, nil
+	}
+	rc.wattTimeUsername, err = loadWattTimeCredentials(filepath.Join(gcas.baseDir, "watttime_data", "username"))
+	if err != nil {
+		return runtimeConfig{}, nil, fmt.Errorf("failed to load username: %v", err)
+	}
+	rc.wattTimePassword, err = loadWattTimeCredentials(filepath.Join(gcas.baseDir, "watttime_data", "password"))
+	if err != nil {
+		return runtimeConfig{}, nil, fmt.Errorf("failed to load password: %v", err)
+	}
+	return rc, ignored, nil
+}
+
+// parseReportInterval parses the refill interval of a rate limiter budget.
+func parseReportInterval(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("interval must be positive")
+	}
+	return d, nil
+}
+
+// applyRuntimeConfig applies the runtime settings to the server, and returns
+// a description of every setting that changed. Secrets are never part of the
+// description.
+func (gcas *GCAServer) applyRuntimeConfig(rc runtimeConfig) []string {
+	var changed []string
+	if old := gcas.logger.Level(); old != rc.logLevel {
+		changed = append(changed, fmt.Sprintf("log_level: %v -> %v", old, rc.logLevel))
+		gcas.logger.SetLevel(rc.logLevel)
+	}
+
+	di, db, ui, ub := gcas.staticReportLimiter.limits()
+	if di != rc.deviceInterval {
+		changed = append(changed, fmt.Sprintf("device_report_interval: %v -> %v", di, rc.deviceInterval))
+	}
+	if db != rc.deviceBurst {
+		changed = append(changed, fmt.Sprintf("device_report_burst: %v -> %v", db, rc.deviceBurst))
+	}
+	if ui != rc.unknownInterval {
+		changed = append(changed, fmt.Sprintf("unknown_report_interval: %v -> %v", ui, rc.unknownInterval))
+	}
+	if ub != rc.unknownBurst {
+		changed = append(changed, fmt.Sprintf("unknown_report_burst: %v -> %v", ub, rc.unknownBurst))
+	}
+	gcas.staticReportLimiter.setLimits(rc.deviceInterval, rc.deviceBurst, rc.unknownInterval, rc.unknownBurst)
+
+	limits := gcas.staticAPILimits
+	qi, qb := limits.query.limits()
+	wi, wb := limits.write.limits()
+	if qi != rc.httpQueryInterval {
+		changed = append(changed, fmt.Sprintf("http_query_interval: %v -> %v", qi, rc.httpQueryInterval))
+	}
+	if qb != rc.httpQueryBurst {
+		changed = append(changed, fmt.Sprintf("http_query_burst: %v -> %v", qb, rc.httpQueryBurst))
+	}
+	if wi != rc.httpWriteInterval {
+		changed = append(changed, fmt.Sprintf("http_write_interval: %v -> %v", wi, rc.httpWriteInterval))
+	}
+	if wb != rc.httpWriteBurst {
+		changed = append(changed, fmt.Sprintf("http_write_burst: %v -> %v", wb, rc.httpWriteBurst))
+	}
+	if old := limits.maxBody.Load(); old != rc.maxBody {
+		changed = append(changed, fmt.Sprintf("max_request_body: %v -> %v", old, rc.maxBody))
+	}
+	if old := limits.maxBatchBody.Load(); old != rc.maxBatchBody {
+		changed = append(changed, fmt.Sprintf("max_batch_request_body: %v -> %v", old, rc.maxBatchBody))
+	}
+	limits.query.setLimits(rc.httpQueryInterval, rc.httpQueryBurst)
+	limits.write.setLimits(rc.httpWriteInterval, rc.httpWriteBurst)
+	limits.maxBody.Store(rc.maxBody)
+	limits.maxBatchBody.Store(rc.maxBatchBody)
+
+	if old := gcas.staticCORS.list(); !reflect.DeepEqual(old, rc.corsOrigins) && len(old)+len(rc.corsOrigins) > 0 {
+		changed = append(changed, fmt.Sprintf("cors_origins: %v -> %v", old, rc.corsOrigins))
+	}
+	gcas.staticCORS.set(rc.corsOrigins)
+
+	gcas.mu.Lock()
+	if gcas.webhooksEnabled != rc.webhooksEnabled || !reflect.DeepEqual(gcas.webhooks.URLs, rc.webhooks.URLs) {
+		changed = append(changed, fmt.Sprintf("webhooks: %v urls -> %v urls", len(gcas.webhooks.URLs), len(rc.webhooks.URLs)))
+	}
+	if gcas.webhooksEnabled && rc.webhooksEnabled && gcas.webhooks.OfflineThreshold != rc.webhooks.OfflineThreshold {
+		changed = append(changed, fmt.Sprintf("offline_threshold: %v -> %v", gcas.webhooks.OfflineThreshold, rc.webhooks.OfflineThreshold))
+	}
+	gcas.webhooks, gcas.webhooksEnabled = rc.webhooks, rc.webhooksEnabled
+	if !reflect.DeepEqual(gcas.alerts, rc.alerts) {
+		changed = append(changed, fmt.Sprintf("alerts: %v", rc.alerts.describe()))
+	}
+	gcas.alerts = rc.alerts
+	if gcas.wattTimeUsername != rc.wattTimeUsername || gcas.wattTimePassword != rc.wattTimePassword {
+		changed = append(changed, "watttime credentials")
+	}
+	gcas.wattTimeUsername, gcas.wattTimePassword = rc.wattTimeUsername, rc.wattTimePassword
+	if gcas.historyRetentionWeeks != rc.historyRetentionWeeks {
+		changed = append(changed, fmt.Sprintf("history_retention_weeks: %v -> %v", gcas.historyRetentionWeeks, rc.historyRetentionWeeks))
+		gcas.historyRetentionWeeks = rc.historyRetentionWeeks
+		gcas.evictHistory()
+	}
+	if gcas.onlineTimeslots != rc.onlineTimeslots {
+		changed = append(changed, fmt.Sprintf("online_timeslots: %v -> %v", gcas.onlineTimeslots, rc.onlineTimeslots))
+		gcas.onlineTimeslots = rc.onlineTimeslots
+		gcas.bumpStateVersion()
+	}
+	old, at := gcas.anomalyThresholds, rc.anomalyThresholds
+	for _, s := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"anomaly_check_timeslots", old.checkTimeslots, at.checkTimeslots},
+		{"anomaly_night_timeslots", old.nightTimeslots, at.nightTimeslots},
+		{"anomaly_constant_timeslots", old.constantTimeslots, at.constantTimeslots},
+		{"anomaly_spike_factor", old.spikeFactor, at.spikeFactor},
+		{"anomaly_spike_percentile", old.spikePercentile, at.spikePercentile},
+	} {
+		if s.old != s.new {
+			changed = append(changed, fmt.Sprintf("%v: %v -> %v", s.name, s.old, s.new))
+		}
+	}
+	gcas.anomalyThresholds = at
+	gcas.mu.Unlock()
+	return changed
+}
+
+// Reload reads the runtime settings from the server directory again and
+// applies the ones that changed, logging every change. If any of the files is
+// invalid, nothing gets applied and an error is returned.
+func (gcas *GCAServer) Reload() (ReloadResult, error) {
+	gcas.reloadMu.Lock()
+	defer gcas.reloadMu.Unlock()
+
+	rc, ignored, err := gcas.loadRuntimeConfig()
+	if err != nil {
+		gcas.logger.Errorf("unable to reload the config: %v", err)
+		return ReloadResult{}, err
+	}
+	res := ReloadResult{Changed: gcas.applyRuntimeConfig(rc), Ignored: ignored}
+	for _, change := range res.Changed {
+		gcas.logger.Infof("reload changed %v", change)
+	}
+	for _, key := range res.Ignored {
+		gcas.logger.Warnf("reload ignored %v, changing it requires a restart", key)
+	}
+	if len(res.Changed) == 0 {
+		gcas.logger.Info("reload found no changes")
+	}
+	gcas.reloadTenants(&res)
+	if n, err := gcas.managedPickUpAuthorizedServers(); err != nil {
+		gcas.logger.Errorf("unable to reload the authorized servers: %v", err)
+	} else if n > 0 {
+		res.Changed = append(res.Changed, fmt.Sprintf("authorized_servers: %v changed", n))
+	}
+	return res, nil
+}
+
+// managedWattTimeCredentials returns the current WattTime credentials.
+func (gcas *GCAServer) managedWattTimeCredentials() (username, password string) {
+	gcas.mu.RLock()
+	defer gcas.mu.RUnlock()
+	return gcas.wattTimeUsername, gcas.wattTimePassword
+}
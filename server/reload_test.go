@@ -0,0 +1,115 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReload rewrites the runtime config files of a running server and checks
+// that Reload applies the live settings, reports the ones that need a
+// restart, and refuses invalid files.
+func TestReload(t *testing.T) {
+	server, dir, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defaultLevel := server.logger.Level()
+
+	// writeFile writes one of the config files into the server dir.
+	writeFile := func(name, data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing changed on disk, so nothing should change in memory.
+	res, err := server.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Changed) != 0 || len(res.Ignored) != 0 {
+		t.Fatalf("unexpected reload result: %+v", res)
+	}
+
+	writeFile(ServerConfigFile, `{
+		"log_level": "warn",
+		"device_report_interval": "1m",
+		"device_report_burst": 10,
+		"http_port": 1234
+	}`)
+	writeFile(WebhooksConfigFile, `{"urls": ["http://127.0.0.1:1/hook"], "offline_threshold": 5}`)
+	writeFile(filepath.Join("watttime_data", "username"), "new-user")
+	res, err = server.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Changed) != 5 {
+		t.Fatalf("expected 5 changes: %+v", res.Changed)
+	}
+	for _, change := range res.Changed {
+		if strings.Contains(change, "new-user") || strings.Contains(change, "ih") {
+			t.Fatal("credentials leaked into the changes:", change)
+		}
+	}
+	if !reflect.DeepEqual(res.Ignored, []string{"http_port"}) {
+		t.Fatal("expected http_port to be ignored:", res.Ignored)
+	}
+	if server.logger.Level() != WARN {
+		t.Fatal("log level was not changed:", server.logger.Level())
+	}
+	di, db, ui, ub := server.staticReportLimiter.limits()
+	if di != time.Minute || db != 10 || ui != unknownReportInterval || ub != unknownReportBurst {
+		t.Fatal("unexpected rate limits:", di, db, ui, ub)
+	}
+	server.mu.RLock()
+	if !server.webhooksEnabled || len(server.webhooks.URLs) != 1 || server.webhooks.OfflineThreshold != 5 {
+		t.Fatalf("webhooks were not changed: %+v", server.webhooks)
+	}
+	server.mu.RUnlock()
+	if username, password := server.managedWattTimeCredentials(); username != "new-user" || password != "ih" {
+		t.Fatal("unexpected credentials:", username, password)
+	}
+
+	// Invalid files are refused without applying anything.
+	for _, config := range []string{
+		`{"log_level": "info", "log_levle": "info"}`,
+		`{"log_level": "loud"}`,
+		`{"log_level": "info", "device_report_interval": "-1s"}`,
+		`{"log_level": "info"`,
+	} {
+		writeFile(ServerConfigFile, config)
+		if _, err := server.Reload(); err == nil {
+			t.Fatal("expected an error for", config)
+		}
+		if server.logger.Level() != WARN {
+			t.Fatal("a failed reload changed the log level")
+		}
+	}
+
+	// Removing the files goes back to the defaults.
+	for _, name := range []string{ServerConfigFile, WebhooksConfigFile} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if server.logger.Level() != defaultLevel {
+		t.Fatal("log level was not restored:", server.logger.Level())
+	}
+	if _, db, _, _ := server.staticReportLimiter.limits(); db != deviceReportBurst {
+		t.Fatal("device burst was not restored:", db)
+	}
+	server.mu.RLock()
+	if server.webhooksEnabled {
+		t.Fatal("webhooks are still enabled")
+	}
+	server.mu.RUnlock()
+}
@@ -0,0 +1,320 @@
+package server
+
+// report_archive.go preserves the reports that fall out of the reporting
+// window. Every reports migration discards the oldest week of reports, and
+// only the device stats of that week survive, so before the reports get
+// discarded they are written to an archive file in the archive directory.
+// This keeps the signed reports around to answer questions about the
+// production of a device long after the week has passed.
+//
+// There is one archive per week, named after the first timeslot of the week.
+// An archive is the gzip compression of the following payload:
+//
+//	period start (4 bytes)
+//	number of devices (4 bytes)
+//	for every device, in order of ShortID:
+//		ShortID (4 bytes)
+//		public key (32 bytes)
+//		number of reports (4 bytes)
+//		the serialized reports (80 bytes each), in order of timeslot
+//	sha256 checksum of everything above (32 bytes)
+//
+// Only the reports that carry a signature are archived. Timeslots that were
+// banned or that never received a report are left out.
+//
+// Archives are never modified once they exist. Each archive is read back and
+// checked against its checksum right after it is written, and the archives
+// are never loaded at startup, they only get read when they are queried.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// ArchivedDevice contains the signed reports of a single device for an
+// archived week.
+type ArchivedDevice struct {
+	ShortID   uint32
+	PublicKey glow.PublicKey
+	Reports   []glow.EquipmentReport
+}
+
+// ReportArchive contains the signed reports of every device for the week
+// that starts at PeriodStart.
+type ReportArchive struct {
+	PeriodStart uint32
+	Devices     []ArchivedDevice
+}
+
+// reportArchiveFile returns the name of the archive for the week that starts
+// at periodStart.
+func reportArchiveFile(periodStart uint32) string {
+	return path.Join(ReportArchiveDir, fmt.Sprintf("reports-%v.dat.gz", periodStart))
+}
+
+// encodeReportArchive returns the compressed archive, along with the checksum
+// of its payload.
+func encodeReportArchive(ra ReportArchive) ([]byte, [32]byte, error) {
+	var payload bytes.Buffer
+	var u32 [4]byte
+	writeUint32 := func(v uint32) {
+		binary.LittleEndian.PutUint32(u32[:], v)
+		payload.Write(u32[:])
+	}
+	writeUint32(ra.PeriodStart)
+	writeUint32(uint32(len(ra.Devices)))
+	for _, device := range ra.Devices {
+		writeUint32(device.ShortID)
+		payload.Write(device.PublicKey[:])
+		writeUint32(uint32(len(device.Reports)))
+		for _, report := range device.Reports {
+			payload.Write(report.Serialize())
+		}
+	}
+	checksum := sha256.Sum256(payload.Bytes())
+	payload.Write(checksum[:])
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(payload.Bytes()); err != nil {
+		return nil, checksum, fmt.Errorf("unable to compress archive: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, checksum, fmt.Errorf("unable to compress archive: %v", err)
+	}
+	return compressed.Bytes(), checksum, nil
+}
+
+// scanReportArchive reads a compressed archive one device at a time, and
+// hands every device to visit, so that only a single device has to be held in
+// memory. The checksum can only be verified once the whole archive has been
+// read, so the devices must not be trusted until scanReportArchive returns
+// without an error.
+func scanReportArchive(r io.Reader, visit func(ArchivedDevice)) (uint32, [32]byte, error) {
+	var checksum [32]byte
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, checksum, fmt.Errorf("unable to decompress archive: %v", err)
+	}
+	br := bufio.NewReader(zr)
+	hasher := sha256.New()
+	payload := io.TeeReader(br, hasher)
+
+	var header [8]byte
+	if _, err := io.ReadFull(payload, header[:]); err != nil {
+		return 0, checksum, fmt.Errorf("unable to read archive header: %v", err)
+	}
+	periodStart := binary.LittleEndian.Uint32(header[0:])
+	numDevices := binary.LittleEndian.Uint32(header[4:])
+	var deviceHeader [40]byte
+	reportBytes := make([]byte, equipmentReportSize)
+	for i := uint32(0); i < numDevices; i++ {
+		if _, err := io.ReadFull(payload, deviceHeader[:]); err != nil {
+			return 0, checksum, fmt.Errorf("archive is truncated: %v", err)
+		}
+		var device ArchivedDevice
+		device.ShortID = binary.LittleEndian.Uint32(deviceHeader[0:])
+		copy(device.PublicKey[:], deviceHeader[4:36])
+		numReports := binary.LittleEndian.Uint32(deviceHeader[36:])
+		if numReports > 2016 {
+			return 0, checksum, fmt.Errorf("archived device has too many reports")
+		}
+		device.Reports = make([]glow.EquipmentReport, 0, numReports)
+		for j := uint32(0); j < numReports; j++ {
+			if _, err := io.ReadFull(payload, reportBytes); err != nil {
+				return 0, checksum, fmt.Errorf("archive is truncated: %v", err)
+			}
+			report, err := glow.DeserializeReport(reportBytes)
+			if err != nil {
+				return 0, checksum, fmt.Errorf("unable to decode archived report: %v", err)
+			}
+			if report.ShortID != device.ShortID || report.Timeslot < periodStart || report.Timeslot >= periodStart+2016 {
+				return 0, checksum, fmt.Errorf("archived report does not belong to the archive")
+			}
+			device.Reports = append(device.Reports, report)
+		}
+		visit(device)
+	}
+
+	// The checksum itself is not part of the hashed payload.
+	if _, err := io.ReadFull(br, checksum[:]); err != nil {
+		return 0, checksum, fmt.Errorf("archive is truncated: %v", err)
+	}
+	if !bytes.Equal(hasher.Sum(nil), checksum[:]) {
+		return 0, checksum, fmt.Errorf("archive does not match its checksum")
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return 0, checksum, fmt.Errorf("archive has trailing data")
+	}
+	return periodStart, checksum, nil
+}
+
+// decodeReportArchive decompresses an archive and verifies its checksum,
+// returning the archive along with the checksum.
+func decodeReportArchive(data []byte) (ReportArchive, [32]byte, error) {
+	var ra ReportArchive
+	periodStart, checksum, err := scanReportArchive(bytes.NewReader(data), func(device ArchivedDevice) {
+		ra.Devices = append(ra.Devices, device)
+	})
+	if err != nil {
+		return ReportArchive{}, checksum, err
+	}
+	ra.PeriodStart = periodStart
+	return ra, checksum, nil
+}
+
+// loadReportArchive reads the archive for the week that starts at
+// periodStart off of disk.
+func (gcas *GCAServer) loadReportArchive(periodStart uint32) (ReportArchive, error) {
+	data, err := gcas.staticStorage.ReadFile(reportArchiveFile(periodStart))
+	if err != nil {
+		return ReportArchive{}, fmt.Errorf("unable to read archive: %v", err)
+	}
+	ra, _, err := decodeReportArchive(data)
+	if err != nil {
+		return ReportArchive{}, err
+	}
+	if ra.PeriodStart != periodStart {
+		return ReportArchive{}, fmt.Errorf("archive is for period %v, expected %v", ra.PeriodStart, periodStart)
+	}
+	return ra, nil
+}
+
+// loadArchivedDevice streams the archive for the week that starts at
+// periodStart and returns the reports of the device with the provided public
+// key, without loading the rest of the archive into memory. The returned
+// error satisfies os.IsNotExist if there is no archive for the week.
+func (gcas *GCAServer) loadArchivedDevice(periodStart uint32, publicKey glow.PublicKey) (ArchivedDevice, bool, error) {
+	f, err := gcas.staticStorage.Open(reportArchiveFile(periodStart))
+	if err != nil {
+		return ArchivedDevice{}, false, err
+	}
+	defer f.Close()
+	var match ArchivedDevice
+	found := false
+	archivedStart, _, err := scanReportArchive(f, func(device ArchivedDevice) {
+		if device.PublicKey == publicKey {
+			match = device
+			found = true
+		}
+	})
+	if err != nil {
+		return ArchivedDevice{}, false, err
+	}
+	if archivedStart != periodStart {
+		return ArchivedDevice{}, false, fmt.Errorf("archive is for period %v, expected %v", archivedStart, periodStart)
+	}
+	return match, found, nil
+}
+
+// archivedPeriods returns the start of every week that has an archive, in
+// ascending order.
+func (gcas *GCAServer) archivedPeriods() ([]uint32, error) {
+	names, err := gcas.staticStorage.List(ReportArchiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list archives: %v", err)
+	}
+	var periods []uint32
+	for _, name := range names {
+		var periodStart uint32
+		if _, err := fmt.Sscanf(path.Base(name), "reports-%d.dat.gz", &periodStart); err != nil {
+			continue
+		}
+		if name == reportArchiveFile(periodStart) {
+			periods = append(periods, periodStart)
+		}
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i] < periods[j] })
+	return periods, nil
+}
+
+// buildReportArchive collects the signed reports of the oldest week in the
+// reporting window. The signatures of all of the devices are loaded at once,
+// which reads the week out of the reports files in order. The mutex must be
+// held.
+func (gcas *GCAServer) buildReportArchive() (ReportArchive, error) {
+	ra := ReportArchive{PeriodStart: gcas.equipmentReportsOffset}
+	shortIDs := make([]uint32, 0, len(gcas.equipmentReports))
+	for shortID := range gcas.equipmentReports {
+		shortIDs = append(shortIDs, shortID)
+	}
+	sort.Slice(shortIDs, func(i, j int) bool { return shortIDs[i] < shortIDs[j] })
+	var all []glow.EquipmentReport
+	var counts []int
+	for _, shortID := range shortIDs {
+		reports := gcas.equipmentReports[shortID]
+		n := 0
+		for i := 0; i < 2016; i++ {
+			if reports.signed(i) {
+				all = append(all, reports.report(shortID, gcas.equipmentReportsOffset, i))
+				n++
+			}
+		}
+		counts = append(counts, n)
+	}
+	if err := gcas.loadReportSignatures(all); err != nil {
+		return ReportArchive{}, err
+	}
+	for i, shortID := range shortIDs {
+		if counts[i] > 0 {
+			ra.Devices = append(ra.Devices, ArchivedDevice{
+				ShortID:   shortID,
+				PublicKey: gcas.equipment[shortID].PublicKey,
+				Reports:   all[:counts[i]:counts[i]],
+			})
+		}
+		all = all[counts[i]:]
+	}
+	return ra, nil
+}
+
+// archiveOldestReports writes the archive for the oldest week in the
+// reporting window, and verifies it against its checksum. An archive that
+// already exists is left alone. The mutex must be held.
+func (gcas *GCAServer) archiveOldestReports() error {
+	periodStart := gcas.equipmentReportsOffset
+	name := reportArchiveFile(periodStart)
+	if _, err := gcas.staticStorage.Stat(name); err == nil {
+		gcas.logger.Warnf("archive for period %v already exists, leaving it in place", periodStart)
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("unable to check for an existing archive: %v", err)
+	}
+	ra, err := gcas.buildReportArchive()
+	if err != nil {
+		return fmt.Errorf("unable to collect the reports: %v", err)
+	}
+	data, checksum, err := encodeReportArchive(ra)
+	if err != nil {
+		return err
+	}
+	if err := gcas.staticStorage.WriteFile(name, data, 0444); err != nil {
+		return fmt.Errorf("unable to write archive: %v", err)
+	}
+	written, err := gcas.staticStorage.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("unable to read back archive: %v", err)
+	}
+	_, writtenChecksum, err := decodeReportArchive(written)
+	if err == nil && writtenChecksum != checksum {
+		err = fmt.Errorf("archive checksum changed on disk")
+	}
+	if err != nil {
+		// Don't leave a corrupt archive in place.
+		gcas.staticStorage.Remove(name)
+		return fmt.Errorf("archive failed verification: %v", err)
+	}
+	gcas.retainPeriod(ra)
+	gcas.logger.Infof("archived the reports for period %v", periodStart)
+	return nil
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestReportArchive triggers a reports migration and checks that the signed
+// reports of the discarded week end up in an archive that can be read back
+// and verified, and that the archive is never rewritten.
+func TestReportArchive(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer glow.SetCurrentTimeslot(0)
+
+	// Two devices with reports, and one without any.
+	keys := make(map[uint32]glow.PublicKey)
+	for shortID := uint32(1); shortID <= 3; shortID++ {
+		ea, ePriv, err := server.AuthorizeTestDevice(shortID, gcaPrivKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[shortID] = ea.PublicKey
+		if shortID == 3 {
+			continue
+		}
+		for ts := uint32(0); ts < 10*shortID; ts += 2 {
+			if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(shortID, ts, ePriv)); outcome != reportAccepted {
+				t.Fatal("report was not accepted:", outcome)
+			}
+		}
+	}
+	// A rejected report leaves a marker without a signature, which must not
+	// be archived.
+	server.mu.Lock()
+	server.equipmentReports[1].PowerOutputs[1] = 1
+	server.mu.Unlock()
+
+	glow.SetCurrentTimeslot(3300)
+	for i := 0; i < 100; i++ {
+		server.mu.RLock()
+		ero := server.equipmentReportsOffset
+		server.mu.RUnlock()
+		if ero != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ra, err := server.loadReportArchive(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra.PeriodStart != 0 || len(ra.Devices) != 2 {
+		t.Fatalf("unexpected archive: period %v, %v devices", ra.PeriodStart, len(ra.Devices))
+	}
+	for i, device := range ra.Devices {
+		shortID := uint32(i + 1)
+		if device.ShortID != shortID || device.PublicKey != keys[shortID] {
+			t.Fatalf("unexpected device in archive: %v %x", device.ShortID, device.PublicKey)
+		}
+		if len(device.Reports) != int(5*shortID) {
+			t.Fatalf("device %v: expected %v reports, got %v", shortID, 5*shortID, len(device.Reports))
+		}
+		for j, report := range device.Reports {
+			if report.Timeslot != uint32(2*j) || !glow.Verify(device.PublicKey, report.SigningBytes(), report.Signature) {
+				t.Fatalf("device %v: archived report %v does not verify: %+v", shortID, j, report)
+			}
+		}
+	}
+	if _, err := server.loadReportArchive(2016); err == nil {
+		t.Error("loaded an archive for a period that was not migrated")
+	}
+
+	// The archive is read only, and it is not rewritten when the same
+	// period gets migrated again.
+	name := reportArchiveFile(0)
+	info, err := server.staticStorage.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0444 {
+		t.Error("archive is writable:", info.Mode())
+	}
+	original, err := server.staticStorage.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	server.equipmentReportsOffset = 0
+	err = server.archiveOldestReports()
+	server.equipmentReportsOffset = 2016
+	server.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := server.staticStorage.ReadFile(name); !bytes.Equal(current, original) {
+		t.Error("existing archive was rewritten")
+	}
+
+	// Archives aren't needed to start the server.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(server.baseDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, err := server.loadReportArchive(0); err != nil {
+		t.Fatal("archive unreadable after a restart:", err)
+	}
+}
+
+// TestReportArchiveCorruption checks that an archive which was tampered with
+// fails to decode.
+func TestReportArchiveCorruption(t *testing.T) {
+	ra := ReportArchive{PeriodStart: 2016, Devices: []ArchivedDevice{{
+		ShortID: 7,
+		Reports: []glow.EquipmentReport{{ShortID: 7, Timeslot: 2020, PowerOutput: 40}},
+	}}}
+	data, checksum, err := encodeReportArchive(ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, decodedChecksum, err := decodeReportArchive(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedChecksum != checksum || decoded.Devices[0].Reports[0] != ra.Devices[0].Reports[0] {
+		t.Fatal("archive did not survive a round trip")
+	}
+
+	// Flip a bit in the payload and compress it again, so that only the
+	// checksum can catch it.
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload[60] ^= 1
+	var tampered bytes.Buffer
+	zw := gzip.NewWriter(&tampered)
+	zw.Write(payload)
+	zw.Close()
+	if _, _, err := decodeReportArchive(tampered.Bytes()); err == nil {
+		t.Error("tampered archive passed verification")
+	}
+	if _, _, err := decodeReportArchive(data[:len(data)/2]); err == nil {
+		t.Error("truncated archive passed verification")
+	}
+}
@@ -15,6 +15,10 @@ package server
 //
 // This combination should keep long term bandwidth requirements low while
 // still preserving long term reliability.
+//
+// Reports with a valid signature also receive a small signed ack, which lets
+// the device know right away whether a report landed. Devices that don't care
+// about acks can ignore them.
 
 import (
 	"encoding/binary"
@@ -22,24 +26,97 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"sync"
+	"syscall"
 
 	"github.com/glowlabs-org/gca-backend/glow"
 )
 
+// maxUDPPacketSize is the size of the largest packet that the UDP listener
+// accepts, which is a time probe. Report packets of every version are
+// smaller.
+const maxUDPPacketSize = glow.TimeProbeSize
+
+// udpPacketBuffer is the buffer that the UDP listener reads a packet into.
+// It has room for one byte more than the largest packet, so that oversized
+// packets can be told apart from packets that fit exactly. The kernel
+// truncates anything larger than the buffer.
+type udpPacketBuffer [maxUDPPacketSize + 1]byte
+
+// udpPacketBuffers holds the buffers of the packets that are not being read
+// or processed. A buffer that a packet was queued in goes back to the pool
+// once a worker is done with the packet, see releaseBuffer.
+var udpPacketBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(udpPacketBuffer)
+	},
+}
+
+// reportOutcome describes what happened to a report when it was submitted to
+// the server.
+type reportOutcome int
+
+const (
+	reportAccepted             reportOutcome = iota // The report was integrated into the server state
+	reportDuplicate                                 // An identical report was already known
+	reportBanned                                    // The equipment or timeslot is banned, or the report caused a ban
+	reportStale                                     // The timeslot is outside of the acceptable window
+	reportBadSignature                              // The signature did not verify
+	reportUnknownDevice                             // The ShortID does not belong to authorized equipment
+	reportInvalidPower                              // The report contained a sentinel power value
+	reportDeauthorized                              // The equipment was deauthorized before the timeslot of the report
+	reportFlagged                                   // The report exceeded the capacity of the equipment and awaits review
+	reportExpired                                   // The authorization of the equipment expired before the timeslot of the report
+	reportFinalized                                 // The week of the timeslot has been finalized
+	reportRetryLater                                // The server can't durably store reports right now
+	reportOutsideAuthorization                      // The timeslot is outside of the authorization of the key that signed the report
+	numReportOutcomes
+)
+
+// String returns the label that is used for the outcome in logs and metrics.
+func (ro reportOutcome) String() string {
+	switch ro {
+	case reportAccepted:
+		return "accepted"
+	case reportDuplicate:
+		return "duplicate"
+	case reportBanned:
+		return "banned"
+	case reportStale:
+		return "stale_timeslot"
+	case reportBadSignature:
+		return "bad_signature"
+	case reportUnknownDevice:
+		return "unauthorized_device"
+	case reportInvalidPower:
+		return "invalid_power"
+	case reportDeauthorized:
+		return "deauthorized"
+	case reportFlagged:
+		return "flagged"
+	case reportExpired:
+		return "expired"
+	case reportFinalized:
+		return "period_finalized"
+	case reportRetryLater:
+		return "retry_later"
+	case reportOutsideAuthorization:
+		return "outside_authorization"
+	}
+	return "unknown"
+}
+
 // parseReport converts raw bytes into an EquipmentReport and validates its signature.
 // This function assumes the server object has a map called 'equipment' which maps
 // equipment ShortIDs to a struct containing their ECDSA public keys.
 func (server *GCAServer) parseReport(rawData []byte) (glow.EquipmentReport, error) {
-	var report glow.EquipmentReport
 	if len(rawData) != 80 {
-		return report, fmt.Errorf("unexpected data length: expected 80 bytes, got %d bytes", len(rawData))
+		return glow.EquipmentReport{}, fmt.Errorf("unexpected data length: expected 80 bytes, got %d bytes", len(rawData))
+	}
+	report, err := glow.DeserializeReport(rawData)
+	if err != nil {
+		return report, err
 	}
-
-	// Populate the EquipmentReport fields
-	report.ShortID = binary.LittleEndian.Uint32(rawData[0:4])
-	report.Timeslot = binary.LittleEndian.Uint32(rawData[4:8])
-	report.PowerOutput = binary.LittleEndian.Uint64(rawData[8:16])
-	copy(report.Signature[:], rawData[16:])
 
 	// Validate the signature and the ShortID
 	equipment, ok := server.equipment[report.ShortID]
@@ -49,7 +126,7 @@ func (server *GCAServer) parseReport(rawData []byte) (glow.EquipmentReport, erro
 
 	// Hash the data and then verify the signature.
 	sb := report.SigningBytes()
-	if !glow.Verify(equipment.PublicKey, sb, report.Signature) {
+	if !server.verifyDeviceSignature(equipment.PublicKey, report.Timeslot, sb, report.Signature) {
 		return report, errors.New("failed to verify signature")
 	}
 
@@ -57,53 +134,141 @@ func (server *GCAServer) parseReport(rawData []byte) (glow.EquipmentReport, erro
 }
 
 // integrateReport will take an equipment report and use it to update the live
-// state of the server.
-func (server *GCAServer) integrateReport(report glow.EquipmentReport) {
+// state of the server, saving the report to disk if it was recorded. The
+// returned outcome indicates whether the report was accepted. A report that
+// was recorded but could not be saved stays in the state and gets saved
+// later, but is not acked as accepted, see persist_health.go.
+func (server *GCAServer) integrateReport(report glow.EquipmentReport) reportOutcome {
+	outcome, recorded := server.applyReport(report, server.nextReportRecord(), server.validationMode("capacity"))
+	if !recorded {
+		return outcome
+	}
+	if outcome != reportFlagged {
+		server.recordReceipt(report)
+	}
+	start := server.now()
+	file, err := server.persistReport(report, outcome == reportFlagged)
+	server.staticMetrics.ObservePersist(server.now().Sub(start))
+	if err != nil {
+		// The report didn't get its record, so its signature has to
+		// stay in memory until the write is retried.
+		if outcome != reportFlagged {
+			server.equipmentReports[report.ShortID].setReport(int(report.Timeslot-server.equipmentReportsOffset), report, 0)
+		}
+		server.queueUnpersistedReport(report, outcome == reportFlagged, file, err)
+		return reportRetryLater
+	}
+	return outcome
+}
+
+// applyReport contains the logic of integrateReport, but does not save the
+// report to disk, which allows it to be used when loading reports from disk.
+// The bool indicates whether the report was recorded in the state, in which
+// case it also needs to be persisted. The record is the number of the report
+// in the reports files, or 0 if it won't be in them, see report_store.go.
+//
+// The capacity mode is the mode of the capacity rule for the report. Only a
+// new report goes through the rule, a report that is loaded from disk was
+// accepted when it arrived and passes ValidationOff, a flagged report that is
+// loaded passes ValidationEnforce to be held again. A review of the GCA applies
+// in every mode.
+func (server *GCAServer) applyReport(report glow.EquipmentReport, record uint32, capacityMode ValidationMode) (reportOutcome, bool) {
 	// Nothing to integrate if the report is too old.
 	if report.Timeslot < server.equipmentReportsOffset {
-		return
+		return reportStale, false
 	}
-	// Panic if the timeslot is too new.
-	if report.Timeslot > server.equipmentReportsOffset+4032 {
-		server.logger.Warn("Received report that's too far in the future to integrate")
-		return
+	// Nothing to integrate if the timeslot is past the reports in memory
+	// either.
+	if report.Timeslot >= server.equipmentReportsOffset+4032 {
+		server.logger.WithFields("short_id", report.ShortID, "timeslot", report.Timeslot).Warn("Received report that's too far in the future to integrate")
+		return reportStale, false
+	}
+
+	// Reports outside of the lifetime of the authorization never get
+	// integrated. This skips the reports that were accepted before a
+	// deauthorization reached the server when they are loaded again,
+	// and keeps them from conflicting with other reports.
+	if err := server.authorizationWindowError(server.equipment[report.ShortID], report.Timeslot); err != nil {
+		server.logger.WithFields("short_id", report.ShortID, "timeslot", report.Timeslot).Debugf("Skipping report outside of the authorization: %v", err)
+		return reportOutsideAuthorization, false
 	}
 
 	// Check whether we've seen a duplicate of this report before.
 	// Timeslots that have already been banned get ignored.
-	if server.equipmentReports[report.ShortID][report.Timeslot-server.equipmentReportsOffset].PowerOutput == 1 {
-		server.logger.Warn("Received report for banned timeslot")
-		return
+	reports := server.equipmentReports[report.ShortID]
+	i := int(report.Timeslot - server.equipmentReportsOffset)
+	if reports.PowerOutputs[i] == 1 {
+		server.logger.WithFields("short_id", report.ShortID, "timeslot", report.Timeslot).Warn("Received report for banned timeslot")
+		return reportBanned, false
 	}
-	// Duplicate reports for a timeslot get ignored, assuming the reports
-	// are exactly identical.
-	if server.equipmentReports[report.ShortID][report.Timeslot-server.equipmentReportsOffset] == report {
-		server.logger.Warn("Received duplicate report")
-		return
+	// Duplicate reports for a timeslot get ignored, which includes
+	// reports that are waiting for review. A report is a duplicate if it
+	// claims the same power output as the report that is already known.
+	// The signature has already been verified, so a resend with another
+	// valid signature over the same content is a duplicate too, the
+	// device did not sign two different reports. Devices retransmit
+	// reports all the time, so duplicates are only logged for debugging.
+	slot := reportSlot{ShortID: report.ShortID, Timeslot: report.Timeslot}
+	flagged, isFlagged := server.flaggedReports[slot]
+	if reports.PowerOutputs[i] == report.PowerOutput || (isFlagged && flagged.PowerOutput == report.PowerOutput) {
+		server.logger.WithFields("short_id", report.ShortID, "timeslot", report.Timeslot).Debug("Received duplicate report")
+		return reportDuplicate, false
+	}
+	// Reports that exceed the capacity of the equipment are held for
+	// review by the GCA rather than being accepted, unless the GCA has
+	// already reviewed this exact report. A second report for the
+	// timeslot still counts as a conflict, so this only applies to the
+	// first report. In warn mode the report only gets counted, see
+	// validation_rules.go.
+	empty := reports.PowerOutputs[i] == 0 && !isFlagged
+	if empty && server.exceedsCapacity(report) {
+		review, reviewed := server.flaggedReportReviews[slot]
+		switch {
+		case reviewed && review.PowerOutput == report.PowerOutput:
+			if !review.Accept {
+				before := server.timeslotTotals(report.ShortID, i)
+				reports.ban(i)
+				server.adjustPeriodTotals(report.ShortID, i, before)
+				server.bumpStateVersion()
+				return reportBanned, false
+			}
+		case capacityMode == ValidationEnforce:
+			server.logger.WithFields("short_id", report.ShortID, "timeslot", report.Timeslot, "power_output", report.PowerOutput).Warn("Received report that exceeds the equipment capacity")
+			server.flaggedReports[slot] = report
+			server.countFlaggedReport(slot, 1)
+			server.bumpStateVersion()
+			return reportFlagged, true
+		case capacityMode == ValidationWarn:
+			server.recordValidationWarning("capacity", report, fmt.Errorf("the power output of %v exceeds the capacity of the equipment", report.PowerOutput))
+		}
 	}
 	// If there are no reports yet for the timeslot, put this report in.
-	// Otherwise ban this timeslot. We set PowerOutput to 1 to indicate
-	// that the timeslot is banned. We will need to remember that when
-	// feeding reports out of the API, we will have to replace those
-	// timeslots with blank reports.
-	//
-	// Whether or not a ban is happening, we need to record this report. If
-	// this report gets banned, we need to save this particular report so
-	// that we can provide proof to everyone else that the ban is
-	// justified, therefore we let the function continue in both cases.
-	if server.equipmentReports[report.ShortID][report.Timeslot-server.equipmentReportsOffset].PowerOutput == 0 {
-		server.equipmentReports[report.ShortID][report.Timeslot-server.equipmentReportsOffset] = report
-	} else {
-		server.logger.Warn("Received second report for timeslot")
-		server.equipmentReports[report.ShortID][report.Timeslot-server.equipmentReportsOffset].PowerOutput = 1
-	}
-	// Ban the report timeslot if the production is greater than the
-	// capacity. Reports declare negative numbers by underflowing the
-	// uint64, so we have to check with a typecast whether the report has
-	// been underflowed. We don't ban underflowed reports.
-	if report.PowerOutput > server.equipment[report.ShortID].Capacity*MaxCapacityBuffer/100 && report.PowerOutput < math.MaxInt64 {
-		server.equipmentReports[report.ShortID][report.Timeslot-server.equipmentReportsOffset].PowerOutput = 1
+	// Otherwise the equipment has signed two different reports for the
+	// same timeslot, which gets the equipment banned. Both reports are
+	// saved as a proof so that everyone else can verify that the ban is
+	// justified, so the report itself does not need to be recorded.
+	if !empty {
+		first := flagged
+		if !isFlagged {
+			firsts := []glow.EquipmentReport{reports.report(report.ShortID, server.equipmentReportsOffset, i)}
+			if err := server.loadReportSignatures(firsts); err != nil {
+				server.logger.Errorf("unable to load the conflicting report of ShortID %v: %v", report.ShortID, err)
+				return reportBanned, false
+			}
+			first = firsts[0]
+		}
+		server.recordEquivocation(first, report)
+		return reportBanned, false
 	}
+	before := server.timeslotTotals(report.ShortID, i)
+	reports.setReport(i, report, record)
+	server.adjustPeriodTotals(report.ShortID, i, before)
+	server.recordStateChange(StateChange{
+		Kind:        StateChangeReport,
+		ShortID:     report.ShortID,
+		Timeslot:    report.Timeslot,
+		PowerOutput: report.PowerOutput,
+	})
 
 	// Add the report to the list of recent reports, and truncate the list
 	// if it's too large.
@@ -113,103 +278,505 @@ func (server *GCAServer) integrateReport(report glow.EquipmentReport) {
 		copy(server.recentReports[:], server.recentReports[halfIndex:])
 		server.recentReports = server.recentReports[:halfIndex]
 	}
-	server.saveEquipmentReport(report)
+	server.recordLastSeen(report)
+	return reportAccepted, true
+}
+
+// ackStatus returns the status byte that should be used when acknowledging a
+// report with this outcome.
+func (ro reportOutcome) ackStatus() byte {
+	switch ro {
+	case reportAccepted:
+		return glow.ReportAckAccepted
+	case reportDuplicate:
+		return glow.ReportAckDuplicate
+	case reportBanned:
+		return glow.ReportAckBanned
+	case reportStale:
+		return glow.ReportAckStale
+	case reportInvalidPower:
+		return glow.ReportAckInvalidPower
+	case reportDeauthorized:
+		return glow.ReportAckDeauthorized
+	case reportFlagged:
+		return glow.ReportAckFlagged
+	case reportExpired:
+		return glow.ReportAckExpired
+	case reportFinalized:
+		return glow.ReportAckFinalized
+	case reportRetryLater:
+		return glow.ReportAckRetryLater
+	case reportOutsideAuthorization:
+		return glow.ReportAckOutsideAuthorization
+	}
+	panic("no ack status for outcome: " + ro.String())
+}
+
+// reportWindow returns the earliest and the latest timeslot that reports are
+// accepted for at the provided timeslot, both inclusive. The window is cut
+// off at both ends of the range of timeslots.
+func (server *GCAServer) reportWindow(now uint32) (earliest uint32, latest uint32) {
+	earliest, latest = 0, math.MaxUint32
+	if now > server.staticReportPastWindow {
+		earliest = now - server.staticReportPastWindow
+	}
+	if now < math.MaxUint32-server.staticReportFutureWindow {
+		latest = now + server.staticReportFutureWindow
+	}
+	return earliest, latest
+}
+
+// staleTimeslotReason explains why a report for the provided timeslot is
+// outside of the report window.
+func (server *GCAServer) staleTimeslotReason(timeslot uint32) string {
+	earliest, latest := server.reportWindow(server.currentTimeslot())
+	return fmt.Sprintf("timeslot %v is outside of the accepted window, which is timeslots %v through %v", timeslot, earliest, latest)
 }
 
 // managedHandleEquipmentReport processes the raw data received from equipment.
-func (server *GCAServer) managedHandleEquipmentReport(rawData []byte) {
+// The bool indicates whether the signature of the report was verified, which
+// determines whether the report is allowed to receive an ack.
+//
+// The signature is verified before the mutex is acquired, so that multiple
+// reports can be verified in parallel.
+func (server *GCAServer) managedHandleEquipmentReport(rawData []byte) (reportOutcome, bool) {
+	report, pubkey, err := server.managedVerifyReport(rawData)
 	server.mu.Lock()
-	defer server.mu.Unlock()
+	outcome, authenticated := server.handleEquipmentReport(report, pubkey, err)
+	server.staticMetrics.RecordOutcome(outcome)
+	var sr StreamedReport
+	if outcome == reportAccepted {
+		// The stream lists the device under its authorization key,
+		// which differs from the signing key after a rotation. The
+		// broadcaster encodes the key, if anyone is listening.
+		pubkey = server.equipment[report.ShortID].PublicKey
+		sr = StreamedReport{
+			ShortID:     report.ShortID,
+			Timeslot:    report.Timeslot,
+			PowerOutput: report.PowerOutput,
+		}
+	}
+	server.mu.Unlock()
+
+	// The report stream has its own mutex, so it can only be fed after
+	// the server mutex is released.
+	if outcome == reportAccepted {
+		server.staticReportStream.Broadcast(sr, pubkey)
+	}
+	return outcome, authenticated
+}
 
+// handleEquipmentReport contains the logic of managedHandleEquipmentReport,
+// returning the outcome of the report and whether the report was
+// authenticated. The report, the key that signed it, and the verification
+// error come from managedVerifyReport.
+func (server *GCAServer) handleEquipmentReport(report glow.EquipmentReport, pubkey glow.PublicKey, err error) (reportOutcome, bool) {
 	// We could do a check here to verify that the GCA pubkey has been
 	// provided to the server, but if no GCA key has been provided, the
 	// server should not have any authorized equipment on it anyway, and
-	// therefore parseReport should fail.
+	// therefore verification should fail.
 
-	// Parse the raw data into an EquipmentReport
-	report, err := server.parseReport(rawData)
+	// The equipment may have been banned or may have rotated its key
+	// while the signature was being verified, in which case the key is no
+	// longer authorized.
+	if err == nil && !server.isDeviceKeyAt(report.ShortID, pubkey, report.Timeslot) {
+		err = errors.New("equipment changed during verification")
+	}
 	if err != nil {
 		server.logger.Error("Report decoding failed: ", err)
-		return
+		// Figure out why decoding failed so that the right outcome
+		// gets reported.
+		if _, banned := server.equipmentBans[report.ShortID]; banned {
+			return reportBanned, false
+		}
+		equipment, exists := server.equipment[report.ShortID]
+		if !exists {
+			return reportUnknownDevice, false
+		}
+		// A report from a key that the device rotated away from is
+		// authentic, it is just for a timeslot that the key no longer
+		// covers.
+		if errors.Is(err, errOutsideAuthorization) && server.isDeviceKey(equipment.PublicKey, pubkey) {
+			return reportOutsideAuthorization, true
+		}
+		return reportBadSignature, false
 	}
 
-	// Verify that the timeslot of the report is acceptable. This means
-	// that the report must be within 432 timeslots of the current
-	// timeslot, which is 72 hours.
-	//
-	// When doing the comparison, we cast everything to int64 to handle
-	// potential overflows and underflows.
-	now := glow.CurrentTimeslot()
-	if int64(report.Timeslot) < int64(now)-432 || int64(report.Timeslot) > int64(now)+432 {
-		server.logger.Warn("Received out of bounds timeslot: ", now, " ", report.Timeslot)
-		return
+	// Run the checks of the contents of the report, in the modes of
+	// their rules, see validation_rules.go.
+	for _, c := range reportChecks {
+		mode := server.validationMode(c.name)
+		if mode == ValidationOff {
+			continue
+		}
+		if err := c.check(server, report); err != nil && mode == ValidationWarn {
+			server.recordValidationWarning(c.name, report, err)
+		} else if err != nil {
+			server.logger.WithFields("short_id", report.ShortID, "timeslot", report.Timeslot, "check", c.name).Warnf("Received report that failed a check: %v", err)
+			return c.outcome, true
+		}
 	}
+
+	// Reports that the server can't store durably are refused, so that
+	// the device holds on to them, see persist_health.go.
+	if server.storageDegraded() {
+		return reportRetryLater, true
+	}
+
+	// Integrate and save the report.
+	return server.integrateReport(report), true
+}
+
+// reportCheck is a check of the contents of a report that was authenticated.
+// A report that fails the check gets the outcome of the check.
+type reportCheck struct {
+	name    string
+	outcome reportOutcome
+	check   func(server *GCAServer, report glow.EquipmentReport) error
+}
+
+// reportChecks are the checks that every report has to pass before it gets
+// integrated, in the order that they run. They are shared with the report
+// validation, see api_validate_report.go. The mutex must be held.
+var reportChecks = []reportCheck{
+	// The report must be within the report windows of the current
+	// timeslot, both ends inclusive.
+	{"timeslot_window", reportStale, func(server *GCAServer, report glow.EquipmentReport) error {
+		if earliest, latest := server.reportWindow(server.currentTimeslot()); report.Timeslot < earliest || report.Timeslot > latest {
+			return errors.New(server.staleTimeslotReason(report.Timeslot))
+		}
+		return nil
+	}},
+	// The totals of a finalized week have been published, so the week
+	// can't take any more reports.
+	{"period_open", reportFinalized, func(server *GCAServer, report glow.EquipmentReport) error {
+		if server.isFinalizedTimeslot(report.Timeslot) {
+			return fmt.Errorf("the period of timeslot %v has been finalized", report.Timeslot)
+		}
+		return nil
+	}},
+	// Equipment that has been deauthorized can't submit reports for any
+	// timeslot after the deauthorization.
+	{"deauthorization", reportDeauthorized, func(server *GCAServer, report glow.EquipmentReport) error {
+		if server.isDeauthorized(report.ShortID, report.Timeslot) {
+			return fmt.Errorf("the equipment was deauthorized before timeslot %v", report.Timeslot)
+		}
+		return nil
+	}},
+	// Equipment can't submit reports for the timeslots before its
+	// authorization took effect, see authorization_window.go.
+	{"authorization_start", reportOutsideAuthorization, func(server *GCAServer, report glow.EquipmentReport) error {
+		if ea := server.equipment[report.ShortID]; report.Timeslot < ea.Initialization {
+			return fmt.Errorf("the equipment may only report starting with timeslot %v", ea.Initialization)
+		}
+		return nil
+	}},
+	// Equipment with an expired authorization keeps its history, but
+	// can't submit reports for the timeslots after the expiry.
+	{"expiration", reportExpired, func(server *GCAServer, report glow.EquipmentReport) error {
+		if ea := server.equipment[report.ShortID]; ea.ExpiredAt(report.Timeslot) {
+			expiration, _ := ea.ExpiresAt()
+			return fmt.Errorf("the authorization of the equipment expired at timeslot %v", expiration)
+		}
+		return nil
+	}},
 	// Reports that don't have any power generated are ignored. A power of
 	// '1' is effectively 0, and we use the '1' value to signal that a
 	// report has been banned for duplicate attempts.
-	if report.PowerOutput == 0 || report.PowerOutput == 1 {
-		server.logger.Warn("Received report with a sentinel power output")
+	{"power_output", reportInvalidPower, func(server *GCAServer, report glow.EquipmentReport) error {
+		if report.PowerOutput == 0 || report.PowerOutput == 1 {
+			return fmt.Errorf("a power output of %v is reserved, the power output has to be at least 2", report.PowerOutput)
+		}
+		return nil
+	}},
+}
+
+// sendReportAck will send a signed acknowledgement for a report back to the
+// address that the report came from. Acks are only sent for reports with a
+// valid signature, otherwise anyone could use the server to reflect traffic at
+// a spoofed source address. The ack is smaller than the report, so the server
+// can't be used for amplification either.
+func (server *GCAServer) sendReportAck(udpConn *net.UDPConn, addr *net.UDPAddr, ack glow.ReportAck) {
+	_, err := udpConn.WriteToUDP(ack.Serialize(), addr)
+	if err != nil && !server.tg.IsStopped() {
+		server.logger.Warn("Failed to send report ack: ", err)
+	}
+}
+
+// logRejectedReport writes a structured log line for a report that was not
+// accepted, which is the UDP equivalent of the HTTP request log. Reports
+// that arrive over HTTP get the same line, so that rejections can be found
+// in one place whichever way the device reached the server.
+func (server *GCAServer) logRejectedReport(transport string, remote fmt.Stringer, rawData []byte, outcome reportOutcome, authenticated bool) {
+	if len(rawData) != equipmentReportSize {
+		server.logger.WithFields("remote", remote, "size", len(rawData), "outcome", outcome, "authenticated", authenticated).Warnf("%v packet rejected", transport)
 		return
 	}
+	shortID := binary.LittleEndian.Uint32(rawData[0:4])
+	timeslot := binary.LittleEndian.Uint32(rawData[4:8])
+	server.logger.WithFields("remote", remote, "size", len(rawData), "short_id", shortID, "timeslot", timeslot, "outcome", outcome, "authenticated", authenticated).Warnf("%v packet rejected", transport)
+}
 
-	// Integrate and save the report.
-	server.integrateReport(report)
+// maxConsecutiveUDPErrors is the number of transient read errors in a row
+// after which the listener gives up on its socket and rebinds, in case the
+// socket is stuck in a state that it won't recover from.
+const maxConsecutiveUDPErrors = 100
+
+// udpListener holds the socket of the UDP listener. The socket is replaced
+// when the listener restarts after a fatal socket error, so it has its own
+// mutex, which must not be held while acquiring the server mutex.
+type udpListener struct {
+	conn     *net.UDPConn
+	down     bool          // Set while the listener is rebinding its socket
+	draining bool          // Set once the listener has to stop reading, see drainUDPReports
+	closed   bool          // Set once the server has started shutting down
+	done     chan struct{} // Closed once the listener has stopped reading, nil if it never started
+
+	mu sync.Mutex
+}
+
+// managedConn returns the current socket of the listener.
+func (ul *udpListener) managedConn() *net.UDPConn {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	return ul.conn
+}
+
+// managedDraining returns whether the listener has to stop reading.
+func (ul *udpListener) managedDraining() bool {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	return ul.draining
+}
+
+// managedDown returns whether the listener is currently rebinding its socket.
+func (ul *udpListener) managedDown() bool {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	return ul.down
+}
+
+// isTransientUDPError returns whether a read error of the UDP socket is
+// expected to clear up by itself, like a full buffer or an ICMP error from a
+// previous write. Anything else means that the socket is unusable.
+func isTransientUDPError(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN)
+}
+
+// bindUDP opens the socket of the UDP listener.
+func bindUDP(bindAddr string, port uint16) (*net.UDPConn, error) {
+	return net.ListenUDP("udp", &net.UDPAddr{
+		Port: int(port),
+		IP:   net.ParseIP(bindAddr),
+	})
 }
 
 // launchUDPServer will create a udp server that listens for reports from
-// clients.
-func (server *GCAServer) launchUDPServer() {
-	// Create the udpConn
-	udpAddress := net.UDPAddr{
-		Port: udpPort,
-		IP:   net.ParseIP(serverIP),
-	}
-	udpConn, err := net.ListenUDP("udp", &udpAddress)
+// clients, along with the workers that process the reports.
+func (server *GCAServer) launchUDPServer(bindAddr string, port uint16, workers int) {
+	// A tenant gets its reports from the listener of its host, see
+	// tenants.go, so it only needs the workers.
+	if server.staticTenantHost != nil {
+		for i := 0; i < workers; i++ {
+			server.launchComponent(fmt.Sprintf("report-worker-%v", i), nil, server.threadedProcessReports)
+		}
+		return
+	}
+
+	udpConn, err := bindUDP(bindAddr, port)
+	if err != nil {
+		server.logger.Fatal("UDP server launch failed: ", err)
+	}
 	addr, ok := udpConn.LocalAddr().(*net.UDPAddr)
 	if !ok {
 		panic("bad type on udpConn")
 	}
 	server.udpPort = uint16(addr.Port)
-	if err != nil {
-		server.logger.Fatal("UDP server launch failed: ", err)
-	}
+	server.udpListener.conn = udpConn
+	server.udpListener.done = make(chan struct{})
 	server.logger.Infof("UDP server launched on port %v", server.udpPort)
 	server.tg.OnStop(func() error {
-		return udpConn.Close()
+		server.udpListener.mu.Lock()
+		defer server.udpListener.mu.Unlock()
+		server.udpListener.closed = true
+		if server.udpListener.down {
+			// The socket was already closed by the restart.
+			return nil
+		}
+		return server.udpListener.conn.Close()
 	})
 
-	server.tg.Launch(func() {
-		server.threadedListenUDP(udpConn)
+	for i := 0; i < workers; i++ {
+		server.launchComponent(fmt.Sprintf("report-worker-%v", i), nil, server.threadedProcessReports)
+	}
+	server.launchComponent("udp-listener", nil, func() {
+		defer close(server.udpListener.done)
+		server.threadedListenUDP(bindAddr)
 	})
 }
 
-// threadedListenUDP manages the infinite loop that listens for UDP packets.
-func (server *GCAServer) threadedListenUDP(udpConn *net.UDPConn) {
+// threadedListenUDP runs the UDP listener, restarting it on a fresh socket
+// whenever the socket fails.
+func (server *GCAServer) threadedListenUDP(bindAddr string) {
 	for {
-		// Check whether the server has been stopped.
-		if server.tg.IsStopped() {
+		err := server.listenUDP(server.udpListener.managedConn())
+		if server.tg.IsStopped() || server.udpListener.managedDraining() {
+			return
+		}
+		server.logger.Errorf("UDP listener failed, restarting: %v", err)
+		if !server.managedRestartUDP(bindAddr) {
 			return
 		}
+	}
+}
 
-		// Read from the UDP socket
-		buffer := make([]byte, equipmentReportSize)
-		readBytes, _, err := udpConn.ReadFromUDP(buffer)
+// listenUDP reads packets from the socket until the socket fails, returning
+// the error that made the socket unusable. Transient errors are logged and
+// skipped, unless too many of them happen in a row.
+func (server *GCAServer) listenUDP(udpConn *net.UDPConn) error {
+	consecutiveErrors := 0
+	for {
+		// Check whether the server has been stopped, or is draining
+		// the packets that it already read.
+		if server.tg.IsStopped() || server.udpListener.managedDraining() {
+			return nil
+		}
+
+		// Read from the UDP socket.
+		buffer := udpPacketBuffers.Get().(*udpPacketBuffer)
+		readBytes, addr, err := udpConn.ReadFromUDP(buffer[:])
 		if err != nil {
+			udpPacketBuffers.Put(buffer)
 			// No need to log an error if the error is because of
 			// shutdown.
-			if !server.tg.IsStopped() {
-				server.logger.Error("Failed to read from UDP socket: ", err)
+			if server.tg.IsStopped() || server.udpListener.managedDraining() {
+				return nil
+			}
+			consecutiveErrors++
+			if !isTransientUDPError(err) || consecutiveErrors >= maxConsecutiveUDPErrors {
+				return err
 			}
+			server.logger.Warn("Failed to read from UDP socket: ", err)
 			continue
 		}
+		consecutiveErrors = 0
+		if readBytes > maxUDPPacketSize {
+			server.logger.WithFields("remote", addr, "size", readBytes, "outcome", "oversized_packet").Warn("udp packet rejected")
+			server.staticMetrics.RecordMalformedPacket()
+			udpPacketBuffers.Put(buffer)
+			continue
+		}
+		if !server.handleUDPPacket(udpConn, addr, buffer[:readBytes], buffer) {
+			udpPacketBuffers.Put(buffer)
+		}
+	}
+}
 
-		// Process the received packet if it has the correct length
-		if readBytes != equipmentReportSize {
-			server.logger.Warn("Received an incorrectly sized packet: expected ", equipmentReportSize, " bytes, got ", readBytes, " bytes")
+// managedRestartUDP closes the socket of the listener and binds a new one on
+// the same port, backing off while the port can't be bound. The listener is
+// marked as down until the new socket is in place. False is returned if the
+// server shut down before the listener could be restarted.
+func (server *GCAServer) managedRestartUDP(bindAddr string) bool {
+	server.udpListener.mu.Lock()
+	server.udpListener.down = true
+	server.udpListener.conn.Close()
+	server.udpListener.mu.Unlock()
+	server.recordDegraded(TimelineReasonListenerDown, true)
+
+	backoff := udpRestartBackoff
+	for {
+		if !server.sleep(backoff) {
+			return false
+		}
+		udpConn, err := bindUDP(bindAddr, server.udpPort)
+		if err != nil {
+			server.logger.Errorf("Unable to rebind the UDP listener on port %v: %v", server.udpPort, err)
+			backoff *= 2
+			if backoff > udpRestartMaxBackoff {
+				backoff = udpRestartMaxBackoff
+			}
 			continue
 		}
-		server.tg.Launch(func() {
-			server.managedHandleEquipmentReport(buffer)
-		})
+		server.udpListener.mu.Lock()
+		if server.udpListener.closed || server.udpListener.draining {
+			server.udpListener.mu.Unlock()
+			udpConn.Close()
+			return false
+		}
+		server.udpListener.conn = udpConn
+		server.udpListener.down = false
+		server.udpListener.mu.Unlock()
+		server.recordDegraded(TimelineReasonListenerDown, false)
+		server.staticMetrics.RecordUDPRestart()
+		server.logger.Infof("UDP listener restarted on port %v", server.udpPort)
+		return true
+	}
+}
+
+// handleUDPPacket handles a single packet that arrived at the UDP listener.
+// Time probes get answered right away, heartbeats go to the workers, and
+// everything else is processed if it decodes as a report packet of a known
+// version. The workers get the report in the legacy layout, whatever version
+// it arrived in.
+//
+// A panic while handling the packet is logged and recovered, so that a single
+// packet can never take down the listener. No locks are held by this
+// function, other than the read locks that find the server of the report on a
+// host with tenants. The report itself is only applied to the state by the
+// workers, after it was decoded here.
+//
+// The buffer is the one that the packet was read into, nil if the packet
+// isn't in a buffer of the pool. The return value indicates whether the
+// packet was queued for a worker, which takes over the buffer.
+func (server *GCAServer) handleUDPPacket(udpConn *net.UDPConn, addr *net.UDPAddr, packet []byte, buffer *udpPacketBuffer) (queued bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			server.logger.WithFields("remote", addr, "size", len(packet), "outcome", "malformed_packet", "panic", r).Errorf("udp packet caused a panic: %x", packet)
+			server.staticMetrics.RecordPacketPanic()
+		}
+	}()
+
+	if len(packet) == glow.TimeProbeSize {
+		server.handleTimeProbe(udpConn, addr, packet)
+		return false
+	}
+	// Heartbeats take the same workers as reports, see heartbeats.go.
+	if len(packet) == glow.HeartbeatSize {
+		return server.queueReportPacket(reportPacket{conn: udpConn, addr: addr, data: packet, buffer: buffer, heartbeat: true})
+	}
+
+	// The reports of the tenants arrive on the same socket, see
+	// tenants.go. A report with a ShortID that several servers know gets
+	// routed by a worker, which checks whose device signed it.
+	target, candidates := server.reportCandidates(packet)
+	if len(candidates) > 1 {
+		return server.queueReportPacket(reportPacket{conn: udpConn, addr: addr, data: packet, buffer: buffer, candidates: candidates})
+	}
+
+	// The packet has been decoded once the report is admitted, so the
+	// report can be serialized into the buffer of the packet.
+	var dst []byte
+	if buffer != nil {
+		dst = buffer[:0]
+	}
+	data, err := target.admitReportPacket(packet, dst)
+	if errors.Is(err, errMalformedPacket) {
+		server.logger.WithFields("remote", addr, "size", len(packet), "outcome", "malformed_packet", "error", err).Warn("udp packet rejected")
+		return false
+	}
+	if err != nil {
+		return false
 	}
+	return target.queueReportPacket(reportPacket{conn: udpConn, addr: addr, data: data, buffer: buffer})
 }
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestReportAcks checks that the server acks authenticated reports with the
+// right status, and stays silent for reports that fail authentication.
+func TestReportAcks(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(4, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh report should be acked as accepted, and the ack should be
+	// signed by the server.
+	report := generateTestReport(ea.ShortID, 3, ePriv)
+	ra, err := server.sendReportReadAck(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra == nil {
+		t.Fatal("no ack received")
+	}
+	if ra.ShortID != ea.ShortID || ra.Timeslot != 3 || ra.Status != glow.ReportAckAccepted {
+		t.Fatal("unexpected ack:", *ra)
+	}
+	if !glow.Verify(server.staticPublicKey, ra.SigningBytes(), ra.Signature) {
+		t.Fatal("ack has a bad signature")
+	}
+
+	// Sending the same report again should be acked as a duplicate.
+	ra, err = server.sendReportReadAck(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra == nil || ra.Status != glow.ReportAckDuplicate {
+		t.Fatal("expected a duplicate ack:", ra)
+	}
+
+	// A stale report is authenticated, so it also gets an ack.
+	ra, err = server.sendReportReadAck(generateTestReport(ea.ShortID, 5000, ePriv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra == nil || ra.Status != glow.ReportAckStale {
+		t.Fatal("expected a stale ack:", ra)
+	}
+
+	// Reports with a bad signature or from unknown devices should not
+	// get any response.
+	_, wrongKey := glow.GenerateKeyPair()
+	ra, err = server.sendReportReadAck(generateTestReport(ea.ShortID, 6, wrongKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra != nil {
+		t.Fatal("received an ack for a report with a bad signature")
+	}
+	ra, err = server.sendReportReadAck(generateTestReport(ea.ShortID+1, 6, ePriv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra != nil {
+		t.Fatal("received an ack for a report from an unknown device")
+	}
+}
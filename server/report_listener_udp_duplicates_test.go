@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// signWithRandomNonce signs the data the way glow.Sign does, but with a random
+// nonce instead of a deterministic one, which gives a different valid
+// signature over the same data every time.
+func signWithRandomNonce(t *testing.T, data []byte, privKey glow.PrivateKey) glow.Signature {
+	t.Helper()
+	curve := crypto.S256()
+	n := curve.Params().N
+	d := new(big.Int).SetBytes(privKey[:])
+	h := new(big.Int).SetBytes(crypto.Keccak256(data))
+	for {
+		k, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k.Sign() == 0 {
+			continue
+		}
+		rx, _ := curve.ScalarBaseMult(k.Bytes())
+		r := new(big.Int).Mod(rx, n)
+		if r.Sign() == 0 {
+			continue
+		}
+		s := new(big.Int).Mul(r, d)
+		s.Add(s, h)
+		s.Mul(s, new(big.Int).ModInverse(k, n))
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+		// Verification refuses signatures in the upper half of the
+		// curve order.
+		if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+			s.Sub(n, s)
+		}
+		var sig glow.Signature
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+}
+
+// TestDuplicateReports checks that resending a report is acknowledged as a
+// duplicate and counted separately from rejections, including when the resend
+// carries another signature over the same content, and that a resend with
+// different content gets the equipment banned.
+func TestDuplicateReports(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(4, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 3, PowerOutput: 5}
+	report.Signature = glow.Sign(report.SigningBytes(), ePriv)
+	if outcome, _ := server.managedHandleEquipmentReport(report.Serialize()); outcome != reportAccepted {
+		t.Fatal("report was not accepted:", outcome)
+	}
+
+	// An identical resend is acked as a duplicate over UDP, reported as a
+	// duplicate by the batch endpoint, and counted as a duplicate rather
+	// than a rejection.
+	ra, err := server.sendReportReadAck(report.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra == nil || ra.Status != glow.ReportAckDuplicate {
+		t.Fatal("expected a duplicate ack:", ra)
+	}
+	_, brr, err := server.postBatchReports("application/octet-stream", report.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(brr.Results) != 1 || brr.Results[0].Status != "duplicate" || brr.Results[0].Code != "" {
+		t.Fatalf("expected a duplicate batch result: %+v", brr.Results)
+	}
+	m := server.staticMetrics
+	if m.ReportsDuplicate() != 2 || m.ReportsRejected(reportDuplicate) != 0 {
+		t.Fatal("duplicates were not counted separately:", m.ReportsDuplicate(), m.ReportsRejected(reportDuplicate))
+	}
+
+	// A resend with another valid signature over the same content is a
+	// duplicate as well, the equipment did not sign two different
+	// reports.
+	resigned := report
+	resigned.Signature = signWithRandomNonce(t, report.SigningBytes(), ePriv)
+	if resigned.Signature == report.Signature || !glow.Verify(ea.PublicKey, resigned.SigningBytes(), resigned.Signature) {
+		t.Fatal("unable to produce a second valid signature")
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(resigned.Serialize()); outcome != reportDuplicate {
+		t.Fatal("resigned report was not treated as a duplicate:", outcome)
+	}
+	if m.ReportsDuplicate() != 3 {
+		t.Fatal("resigned report was not counted as a duplicate:", m.ReportsDuplicate())
+	}
+	server.mu.RLock()
+	_, banned := server.equipmentBans[ea.ShortID]
+	server.mu.RUnlock()
+	if banned {
+		t.Fatal("equipment was banned for resending a report")
+	}
+	if err := server.verifyEquivocationProof(EquivocationProof{Authorization: ea, First: report, Second: resigned}); err == nil {
+		t.Fatal("proof over two signatures of the same report was accepted")
+	}
+
+	// A resend with different content is an equivocation.
+	conflicting := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 3, PowerOutput: 6}
+	conflicting.Signature = glow.Sign(conflicting.SigningBytes(), ePriv)
+	if outcome, _ := server.managedHandleEquipmentReport(conflicting.Serialize()); outcome != reportBanned {
+		t.Fatal("conflicting report did not ban the equipment:", outcome)
+	}
+	server.mu.RLock()
+	_, banned = server.equipmentBans[ea.ShortID]
+	server.mu.RUnlock()
+	if !banned {
+		t.Fatal("equipment was not banned for signing conflicting reports")
+	}
+	if m.ReportsDuplicate() != 3 {
+		t.Fatal("conflicting report was counted as a duplicate:", m.ReportsDuplicate())
+	}
+}
@@ -62,9 +62,7 @@ func TestParseReportIntegration(t *testing.T) {
 		pubKey, privKey := glow.GenerateKeyPair()
 		devices[i] = glow.EquipmentAuthorization{ShortID: uint32(i), PublicKey: pubKey, Capacity: 100e6}
 		privKeys[i] = privKey
-		sb := devices[i].SigningBytes()
-		sig := glow.Sign(sb, gcaPrivKey)
-		devices[i].Signature = sig
+		devices[i] = SignEquipmentAuthorization(devices[i], gcaPrivKey)
 		_, err := server.saveEquipment(devices[i])
 		if err != nil {
 			t.Fatal(err)
@@ -135,7 +133,7 @@ func TestParseReportIntegration(t *testing.T) {
 			t.Log("retries:", retries)
 		}
 		server.mu.Lock()
-		if server.equipmentReports[device.ShortID][uint32(i)+now].PowerOutput < 2 {
+		if server.equipmentReports[device.ShortID].PowerOutputs[uint32(i)+now] < 2 {
 			t.Error("report is either banned or didn't get added to the state, when it should exist")
 		}
 		server.mu.Unlock()
@@ -168,7 +166,7 @@ func TestParseReportIntegration(t *testing.T) {
 			}
 		}
 		server.mu.Lock()
-		if server.equipmentReports[device.ShortID][uint32(i)+now].PowerOutput == 1 {
+		if server.equipmentReports[device.ShortID].PowerOutputs[uint32(i)+now] == 1 {
 			t.Error("report was banned, though it shouldn't have been banned because the sig was bad")
 		}
 		server.mu.Unlock()
@@ -180,8 +178,10 @@ func TestParseReportIntegration(t *testing.T) {
 			continue
 		}
 
-		// Now send a report with a correct sig, but have it be a
-		// duplicate, which should cause the report to get banned.
+		// Now send a report with a correct sig, but have it conflict
+		// with the first report, which should cause the equipment to
+		// get banned. The conflicting report is recorded in the proof
+		// rather than in the recent reports.
 		er = glow.EquipmentReport{
 			ShortID:     device.ShortID,
 			Timeslot:    uint32(i) + now,
@@ -193,22 +193,20 @@ func TestParseReportIntegration(t *testing.T) {
 		if err := sendUDPReport(er.Serialize(), server.udpPort); err != nil {
 			t.Fatalf("Failed to send UDP report for device %d: %v", i, err)
 		}
-		expectedReports++
-		// Loop and check for the report to make it into the report
-		// history.
+		// Loop and check for the ban to happen.
 		success = false
 		retries = 0
 		for retries = 0; retries < 10; retries++ {
 			server.mu.Lock()
-			if len(server.recentReports) == expectedReports {
-				lastReport := server.recentReports[len(server.recentReports)-1]
-				if lastReport.ShortID == device.ShortID && lastReport.Timeslot == uint32(i)+now && lastReport.PowerOutput == uint64(6+i*100) {
-					success = true
-					server.mu.Unlock()
-					break
+			proof, banned := server.equipmentBanProofs[device.ShortID]
+			server.mu.Unlock()
+			if banned {
+				if proof.Second != er {
+					t.Fatalf("unexpected proof for device %d: %+v", i, proof)
 				}
+				success = true
+				break
 			}
-			server.mu.Unlock()
 
 			// Sleep a bit and try sending the report again.
 			time.Sleep(10 * time.Millisecond)
@@ -217,16 +215,11 @@ func TestParseReportIntegration(t *testing.T) {
 			}
 		}
 		if !success {
-			t.Fatalf("No reports in recentReports after sending valid report for device %d", i)
+			t.Fatalf("Equipment was not banned after sending a conflicting report for device %d", i)
 		}
 		if retries > 3 {
 			t.Log("retries:", retries)
 		}
-		server.mu.Lock()
-		if server.equipmentReports[device.ShortID][uint32(i)+now].PowerOutput != 1 {
-			t.Error("report was not banned")
-		}
-		server.mu.Unlock()
 
 		// Now send a report with a correct sig, but have it be yet
 		// another duplicate. The report should be entirely ignored and
@@ -252,25 +245,18 @@ func TestParseReportIntegration(t *testing.T) {
 		if err := sendUDPReport(er.Serialize(), server.udpPort); err != nil {
 			t.Fatalf("Failed to send UDP report for device %d: %v", i, err)
 		}
-		// Loop and check for the report to make it into the report
-		// history.
 		server.mu.Lock()
 		if len(server.recentReports) != expectedReports {
 			t.Fatal("bad")
 		}
-		server.mu.Unlock()
-		if !success {
-			t.Fatalf("No reports in recentReports after sending valid report for device %d", i)
-		}
-		server.mu.Lock()
-		if server.equipmentReports[device.ShortID][uint32(i)+now].PowerOutput != 1 {
-			t.Error("report was not banned")
+		if _, exists := server.equipment[device.ShortID]; exists {
+			t.Error("banned equipment is still known")
 		}
 		server.mu.Unlock()
 	}
 
-	// Turn off the server and turn it back on, checking that there are
-	// still banned reports.
+	// Turn off the server and turn it back on, checking that the
+	// equipment is still banned.
 	server.Close()
 	server, err = NewGCAServer(dir, false)
 	if err != nil {
@@ -278,32 +264,35 @@ func TestParseReportIntegration(t *testing.T) {
 	}
 	defer server.Close()
 
-	// Check that the count for the recent reports is correct.
+	// Only the reports of the first device get loaded, the reports of the
+	// banned equipment are skipped.
 	server.mu.Lock()
-	if len(server.recentReports) != expectedReports {
-		t.Error("server state appears incorrect after reboot", len(server.recentReports), expectedReports)
+	if len(server.recentReports) != 1 {
+		t.Error("server state appears incorrect after reboot", len(server.recentReports))
 	}
 	server.mu.Unlock()
 
 	for i, device := range devices {
-		// For the first device, the report should not be banned. For
-		// all other devices, the report should be banned.
+		// For the first device, the report should exist. All other
+		// devices should be banned.
 		server.mu.Lock()
 		if i == 0 {
-			if server.equipmentReports[device.ShortID][uint32(i)+now].PowerOutput < 2 {
+			if server.equipmentReports[device.ShortID].PowerOutputs[uint32(i)+now] < 2 {
 				t.Error("report does not appear to exist after restart, or maybe its banned")
 			}
 		} else {
-			if server.equipmentReports[device.ShortID][uint32(i)+now].PowerOutput != 1 {
-				t.Error("report is not banned after restart")
+			_, banned := server.equipmentBans[device.ShortID]
+			_, hasProof := server.equipmentBanProofs[device.ShortID]
+			if !banned || !hasProof {
+				t.Error("equipment is not banned after restart")
 			}
 		}
 		server.mu.Unlock()
 	}
 }
 
-// TestCapacityEnforcement will check that a report gets banned for exceeding
-// the equipment capacity, and that it stays banned after a reset.
+// TestCapacityEnforcement will check that a report gets flagged for exceeding
+// the equipment capacity, and that it stays flagged after a reset.
 func TestCapacityEnforcement(t *testing.T) {
 	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
 	if err != nil {
@@ -312,9 +301,7 @@ func TestCapacityEnforcement(t *testing.T) {
 
 	pubKey, privKey := glow.GenerateKeyPair()
 	device := glow.EquipmentAuthorization{ShortID: 3, PublicKey: pubKey, Capacity: 100e6}
-	sb := device.SigningBytes()
-	sig := glow.Sign(sb, gcaPrivKey)
-	device.Signature = sig
+	device = SignEquipmentAuthorization(device, gcaPrivKey)
 	_, err = server.saveEquipment(device)
 	if err != nil {
 		t.Fatal(err)
@@ -324,7 +311,7 @@ func TestCapacityEnforcement(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Create an equipment report that we expect to get banned for having
+	// Create an equipment report that we expect to get flagged for having
 	// too high of a capacity.
 	er := glow.EquipmentReport{
 		ShortID:     device.ShortID,
@@ -337,20 +324,18 @@ func TestCapacityEnforcement(t *testing.T) {
 		t.Fatalf("Failed to send UDP report")
 	}
 
-	// Check that the server received the report.
+	// Check that the server received and flagged the report.
+	slot := reportSlot{ShortID: device.ShortID, Timeslot: 5}
 	success := false
 	retries := 0
 	for retries = 0; retries < 10; retries++ {
 		server.mu.Lock()
-		if len(server.recentReports) == 1 {
-			lastReport := server.recentReports[len(server.recentReports)-1]
-			if lastReport.ShortID == device.ShortID && lastReport.Timeslot == 5 && lastReport.PowerOutput == uint64(200e6) {
-				success = true
-				server.mu.Unlock()
-				break
-			}
-		}
+		flagged, exists := server.flaggedReports[slot]
 		server.mu.Unlock()
+		if exists && flagged == er {
+			success = true
+			break
+		}
 
 		// Sleep a bit and try sending the report again.
 		time.Sleep(10 * time.Millisecond)
@@ -359,18 +344,18 @@ func TestCapacityEnforcement(t *testing.T) {
 		}
 	}
 	if !success {
-		t.Fatalf("No reports in recentReports after sending valid report")
+		t.Fatalf("Report was not flagged after sending it")
 	}
 	if retries > 3 {
 		t.Log("retries:", retries)
 	}
 	server.mu.Lock()
-	if server.equipmentReports[device.ShortID][5].PowerOutput != 1 {
-		t.Error("report is supposed to be banned now")
+	if server.equipmentReports[device.ShortID].PowerOutputs[5] != 0 || len(server.recentReports) != 0 {
+		t.Error("flagged report is not supposed to be part of the state")
 	}
 	server.mu.Unlock()
 
-	// Restart the server and check that the ban is still in place.
+	// Restart the server and check that the report is still flagged.
 	server.CheckInvariants()
 	server.Close()
 	server, err = NewGCAServer(dir, false)
@@ -381,17 +366,9 @@ func TestCapacityEnforcement(t *testing.T) {
 	defer server.CheckInvariants()
 	server.CheckInvariants()
 
-	// Check that the count for the recent reports is correct.
-	server.mu.Lock()
-	if len(server.recentReports) != 1 {
-		t.Error("server state appears incorrect after reboot", len(server.recentReports), 1)
-	}
-	server.mu.Unlock()
-
-	// Check that the report is banned.
 	server.mu.Lock()
-	if server.equipmentReports[device.ShortID][5].PowerOutput != 1 {
-		t.Error("report is supposed to be banned now")
+	if server.flaggedReports[slot] != er || server.equipmentReports[device.ShortID].PowerOutputs[5] != 0 {
+		t.Error("report is supposed to still be flagged")
 	}
 	server.mu.Unlock()
 
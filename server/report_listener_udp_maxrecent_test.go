@@ -29,6 +29,7 @@ func TestHandleEquipmentReport_MaxRecentReports(t *testing.T) {
 		device := glow.EquipmentAuthorization{
 			ShortID:   uint32(i),
 			PublicKey: pubKey,
+			Capacity:  100e6,
 		}
 		devices = append(devices, device)
 		privKeys = append(privKeys, privKey)
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestUDPListenerRestart closes the socket of the UDP listener out from under
+// the read loop, and checks that the listener reports itself as down while
+// the port can't be bound, and then rebinds and resumes ingesting reports.
+func TestUDPListenerRestart(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(4, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.SubmitTestReport(ea.ShortID, 3, 5, ePriv); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close the socket, and grab the port before the listener can rebind
+	// it, which keeps the listener down until the port is released.
+	if err := server.udpListener.managedConn().Close(); err != nil {
+		t.Fatal(err)
+	}
+	blocker, blockErr := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(serverIP), Port: int(server.udpPort)})
+	if blockErr == nil {
+		var status int
+		var hr HealthzResponse
+		for i := 0; i < 100; i++ {
+			status, hr, err = server.getHealthz()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hr.UDPHealthy {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if status != http.StatusServiceUnavailable || hr.Status != "udp listener down" || hr.UDPHealthy {
+			t.Fatalf("healthz does not show the listener as down: %v %+v", status, hr)
+		}
+		// The restart keeps backing off while the port is taken.
+		time.Sleep(3 * udpRestartMaxBackoff)
+		if server.staticMetrics.udpRestarts.Load() != 0 {
+			t.Fatal("listener restarted while the port was taken")
+		}
+		blocker.Close()
+	} else {
+		// The listener won the race for the port.
+		t.Log("unable to take the port of the listener:", blockErr)
+	}
+
+	// The listener should come back on the same port and accept reports.
+	var ra *glow.ReportAck
+	for i := 0; i < 100 && ra == nil; i++ {
+		ra, err = server.sendReportReadAck(generateTestReport(ea.ShortID, 4, ePriv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ra == nil {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if ra == nil || (ra.Status != glow.ReportAckAccepted && ra.Status != glow.ReportAckDuplicate) {
+		t.Fatal("listener did not resume after the restart:", ra)
+	}
+	if n := server.staticMetrics.udpRestarts.Load(); n != 1 {
+		t.Fatal("wrong number of restarts:", n)
+	}
+	status, hr, err := server.getHealthz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || !hr.UDPHealthy {
+		t.Fatalf("healthz does not show the listener as healthy: %v %+v", status, hr)
+	}
+}
+
+// TestIsTransientUDPError checks which socket errors the listener retries on
+// the same socket.
+func TestIsTransientUDPError(t *testing.T) {
+	if isTransientUDPError(net.ErrClosed) {
+		t.Fatal("a closed socket is not transient")
+	}
+	if !isTransientUDPError(&net.OpError{Op: "read", Net: "udp", Err: syscall.ENOBUFS}) {
+		t.Fatal("a full buffer is transient")
+	}
+	if !isTransientUDPError(&net.OpError{Op: "read", Net: "udp", Err: syscall.ECONNREFUSED}) {
+		t.Fatal("an icmp error is transient")
+	}
+	if isTransientUDPError(&net.OpError{Op: "read", Net: "udp", Err: syscall.EBADF}) {
+		t.Fatal("a bad file descriptor is not transient")
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestUDPShutdownDrain floods the UDP listener with reports and closes the
+// server in the middle of the flood. After a restart on the same directory,
+// every report that was acked as accepted has to be there, every report that
+// is there has to have been acked, and resending
+// every report, acked or not, must only produce accepted and duplicate
+// reports, never a conflict.
+func TestUDPShutdownDrain(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const devices = 4
+	const timeslots = 400
+	var reports [][]byte
+	keys := make(map[uint32]glow.PrivateKey)
+	for shortID := uint32(1); shortID <= devices; shortID++ {
+		_, ePriv, err := server.AuthorizeTestDevice(shortID, gcaPrivKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[shortID] = ePriv
+	}
+	for ts := uint32(0); ts < timeslots; ts++ {
+		for shortID := uint32(1); shortID <= devices; shortID++ {
+			reports = append(reports, generateTestReport(shortID, ts, keys[shortID]))
+		}
+	}
+
+	// Collect the acks while the reports are flooding in, and close the
+	// server once a quarter of them are in.
+	conn, err := net.Dial("udp", server.udpDialAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	acked := make(map[reportSlot]byte)
+	reading := make(chan struct{})
+	busy := make(chan struct{})
+	go func() {
+		defer close(reading)
+		buf := make([]byte, 256)
+		for {
+			n, err := conn.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return
+			} else if err != nil {
+				continue
+			}
+			ra, err := glow.DeserializeReportAck(buf[:n])
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			acked[reportSlot{ShortID: ra.ShortID, Timeslot: ra.Timeslot}] = ra.Status
+			if len(acked) == len(reports)/4 {
+				close(busy)
+			}
+			mu.Unlock()
+		}
+	}()
+	go func() {
+		for _, report := range reports {
+			conn.Write(report)
+			time.Sleep(50 * time.Microsecond)
+		}
+	}()
+	select {
+	case <-busy:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the reports are not getting acked")
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+	<-reading
+	conn.Close()
+
+	// Every accepted report made it to disk.
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	accepted := 0
+	server.mu.Lock()
+	for slot, status := range acked {
+		if status != glow.ReportAckAccepted {
+			continue
+		}
+		accepted++
+		if power := server.equipmentReports[slot.ShortID].PowerOutputs[slot.Timeslot-server.equipmentReportsOffset]; power != 5 {
+			t.Errorf("the acked report for %+v is missing after the restart: %v", slot, power)
+		}
+	}
+	for shortID := uint32(1); shortID <= devices; shortID++ {
+		for ts := uint32(0); ts < timeslots; ts++ {
+			_, wasAcked := acked[reportSlot{ShortID: shortID, Timeslot: ts}]
+			if server.equipmentReports[shortID].PowerOutputs[ts-server.equipmentReportsOffset] != 0 && !wasAcked {
+				t.Errorf("the report for ShortID %v timeslot %v was persisted without an ack", shortID, ts)
+			}
+		}
+	}
+	server.mu.Unlock()
+	if accepted == 0 {
+		t.Fatal("no reports were accepted before the shutdown")
+	}
+
+	// The devices resend everything, the reports that were accepted come
+	// back as duplicates.
+	for _, report := range reports {
+		er, err := glow.DeserializeReport(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outcome, _ := server.managedHandleEquipmentReport(report)
+		status, wasAcked := acked[reportSlot{ShortID: er.ShortID, Timeslot: er.Timeslot}]
+		if outcome != reportAccepted && outcome != reportDuplicate {
+			t.Fatalf("the resent report for ShortID %v timeslot %v was refused: %v", er.ShortID, er.Timeslot, outcome)
+		}
+		if wasAcked && status == glow.ReportAckAccepted && outcome != reportDuplicate {
+			t.Fatalf("the acked report for ShortID %v timeslot %v was lost: %v", er.ShortID, er.Timeslot, outcome)
+		}
+	}
+	server.mu.RLock()
+	bans := len(server.equipmentBans)
+	server.mu.RUnlock()
+	if bans != 0 {
+		t.Fatal("the resends got devices banned")
+	}
+}
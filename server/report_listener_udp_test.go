@@ -3,9 +3,12 @@ package server
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server/clock/clocktest"
 )
 
 // TestParseReport tests the parseReport function of the GCAServer.
@@ -100,3 +103,180 @@ func TestParseReport(t *testing.T) {
 		t.Errorf("Expected unknown device ID error, got: %v", err)
 	}
 }
+
+// TestReportWindowRollover checks the report windows at the boundary between
+// two weeks, and across a migration of the reports in memory. The server runs
+// on a manual clock, so the test never waits for the migration.
+func TestReportWindowRollover(t *testing.T) {
+	c := clocktest.NewManual(time.Unix(glow.TimeslotToUnix(2015), 0))
+	setTimeslot := func(timeslot uint32) {
+		c.Set(time.Unix(glow.TimeslotToUnix(timeslot), 0))
+	}
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{ReportPastWindow: 10, ReportFutureWindow: 5, Clock: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(timeslot uint32) reportOutcome {
+		er := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: timeslot, PowerOutput: 100}
+		er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+		outcome, _ := server.managedHandleEquipmentReport(er.Serialize())
+		return outcome
+	}
+	check := func(timeslot uint32, want reportOutcome) {
+		t.Helper()
+		if outcome := send(timeslot); outcome != want {
+			t.Fatalf("report for timeslot %v at timeslot %v: got %v, want %v", timeslot, server.currentTimeslot(), outcome, want)
+		}
+	}
+
+	// In the last timeslot of the week, the first timeslots of the next
+	// week are accepted early, up to the end of the future window.
+	check(2016, reportAccepted)
+	check(2020, reportAccepted)
+	check(2021, reportStale)
+
+	// In the first timeslot of the next week, the last timeslots of the
+	// previous week are still accepted, up to the start of the past
+	// window.
+	setTimeslot(2016)
+	check(2015, reportAccepted)
+	check(2006, reportAccepted)
+	check(2005, reportStale)
+
+	// Once the migration threshold is crossed, the oldest week is rotated
+	// out, and the past window is still in memory.
+	now := uint32(reportMigrationThreshold + 1)
+	c.WaitForSleep(ReportMigrationFrequency)
+	setTimeslot(now)
+	c.WaitForSleep(ReportMigrationFrequency)
+	server.mu.RLock()
+	offset := server.equipmentReportsOffset
+	server.mu.RUnlock()
+	if offset != 2016 {
+		t.Fatal("the reports were not migrated:", offset)
+	}
+	check(now-10, reportAccepted)
+	check(now-11, reportStale)
+	check(now+5, reportAccepted)
+
+	// A report past the end of the reports in memory is stale rather than
+	// out of bounds.
+	er := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: 2016 + 4032, PowerOutput: 100}
+	server.mu.Lock()
+	outcome, recorded := server.applyReport(er, 0, ValidationEnforce)
+	server.mu.Unlock()
+	if outcome != reportStale || recorded {
+		t.Fatal("unexpected outcome for a report past the end of memory:", outcome, recorded)
+	}
+}
+
+// FuzzUDPPacket feeds arbitrary packets to the UDP listener, and checks that
+// none of them causes a panic. The regression seeds in testdata are packets
+// that are truncated or oversized right at the boundaries of the report and
+// time probe layouts.
+func FuzzUDPPacket(f *testing.F) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(f.Name())
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(4, gcaPrivKey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, v := range glow.ReportPacketVersions() {
+		er := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: uint32(3 + v), PowerOutput: 5}
+		er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+		packet, _ := glow.EncodeReportPacket(er, byte(v))
+		f.Add(packet)
+	}
+	f.Add(glow.TimeProbe{Nonce: 7}.Serialize())
+
+	// Responses are sent from a socket of the test to a port that nothing
+	// listens on.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer conn.Close()
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		if len(packet) > maxUDPPacketSize {
+			// The listener drops these before handling them.
+			return
+		}
+		server.handleUDPPacket(conn, addr, packet, nil)
+		if n := server.staticMetrics.udpPacketsPanicked.Load(); n != 0 {
+			t.Fatalf("%v packets caused a panic", n)
+		}
+	})
+}
+
+// TestReportWindowTolerances sweeps reports across both ends of the report
+// window with several configured tolerances, and checks that exactly the
+// timeslots inside the window are accepted.
+func TestReportWindowTolerances(t *testing.T) {
+	const now = 1000
+	tests := []struct {
+		name         string
+		past, future uint32
+		wantPast     uint32
+		wantFuture   uint32
+	}{
+		{"Default", 0, 0, defaultReportWindow, defaultReportWindow},
+		{"Tight", 1, 1, 1, 1},
+		{"SlowMeters", 12, 2, 12, 2},
+		{"FastClocks", 2, 12, 2, 12},
+		{"DefaultFuture", 30, 0, 30, defaultReportWindow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := clocktest.NewManual(time.Unix(glow.TimeslotToUnix(now), 0))
+			server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{ReportPastWindow: tt.past, ReportFutureWindow: tt.future, Clock: c})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			earliest, latest := server.reportWindow(now)
+			if earliest != now-tt.wantPast || latest != now+tt.wantFuture {
+				t.Fatal("wrong window:", earliest, latest)
+			}
+
+			// Only a couple of timeslots on either side of each
+			// end of the window are swept.
+			var timeslots []uint32
+			for _, end := range []uint32{earliest, latest} {
+				for ts := end - 2; ts <= end+2; ts++ {
+					timeslots = append(timeslots, ts)
+				}
+			}
+			for _, ts := range timeslots {
+				want := reportStale
+				if ts >= earliest && ts <= latest {
+					want = reportAccepted
+				}
+				er := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: ts, PowerOutput: 100}
+				er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+				// The tight windows overlap at both ends.
+				if outcome, _ := server.managedHandleEquipmentReport(er.Serialize()); outcome != want && !(outcome == reportDuplicate && want == reportAccepted) {
+					t.Errorf("report for timeslot %v: got %v, want %v", ts, outcome, want)
+				}
+			}
+
+			// The reason of a stale report names the window.
+			reason := server.staleTimeslotReason(latest + 1)
+			if expected := fmt.Sprintf("timeslot %v is outside of the accepted window, which is timeslots %v through %v", latest+1, earliest, latest); reason != expected {
+				t.Fatal("unexpected reason:", reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestReportPacketVersions checks that the UDP listener accepts both legacy
+// and version 1 report packets, and rejects truncated packets and unknown
+// versions as malformed.
+func TestReportPacketVersions(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(4, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := func(timeslot uint32) glow.EquipmentReport {
+		er := glow.EquipmentReport{ShortID: ea.ShortID, Timeslot: timeslot, PowerOutput: 5}
+		er.Signature = glow.Sign(er.SigningBytes(), ePriv)
+		return er
+	}
+
+	// Both versions should be accepted and acked.
+	for i, version := range []byte{glow.ReportPacketLegacy, glow.ReportPacketVersion1} {
+		packet, err := glow.EncodeReportPacket(report(uint32(3+i)), version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ra, err := server.sendReportReadAck(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ra == nil || ra.Status != glow.ReportAckAccepted || ra.Timeslot != uint32(3+i) {
+			t.Fatalf("version %v packet was not accepted: %v", version, ra)
+		}
+	}
+	server.mu.RLock()
+	for i := uint32(3); i < 5; i++ {
+		if server.equipmentReports[ea.ShortID].PowerOutputs[i-server.equipmentReportsOffset] != 5 {
+			t.Error("report is missing for timeslot", i)
+		}
+	}
+	server.mu.RUnlock()
+
+	// Truncated packets and unknown versions get no ack, and are counted
+	// as malformed.
+	v1, err := glow.EncodeReportPacket(report(5), glow.ReportPacketVersion1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := append([]byte{0x7f}, v1[1:]...)
+	zero := append([]byte{0}, v1[1:]...)
+	packets := [][]byte{v1[:1], v1[:40], v1[:len(v1)-2], unknown, zero}
+	for _, packet := range packets {
+		ra, err := server.sendReportReadAck(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ra != nil {
+			t.Fatalf("packet of size %v was acked", len(packet))
+		}
+	}
+	m := server.staticMetrics
+	for i := 0; i < 100 && m.udpPacketsMalformed.Load() < uint64(len(packets)); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.udpPacketsMalformed.Load() != uint64(len(packets)) {
+		t.Fatal("wrong malformed count:", m.udpPacketsMalformed.Load())
+	}
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	if server.equipmentReports[ea.ShortID].PowerOutputs[5-server.equipmentReportsOffset] != 0 {
+		t.Fatal("a malformed packet was integrated")
+	}
+}
@@ -0,0 +1,336 @@
+package server
+
+// report_overrides.go lets the GCA correct the power output of a device at a
+// timeslot, typically because a meter was miswired or reset and the device
+// signed a value that is known to be wrong. An override is signed by the GCA
+// and names the device, the timeslot, the corrected power output and the
+// reason for the correction.
+//
+// An override never replaces the report of the device. The signed report
+// stays in memory, in the reports file and in the archive exactly as it was
+// received, and the endpoints that list reports keep returning it. The
+// corrected value is applied on top wherever the server computes figures
+// from the reports: the device stats, the device summary, the device impact
+// and the CSV export. The device stats list the corrected timeslots of every
+// device, so that consumers can tell which values came from the GCA.
+//
+// An override can also fill a timeslot that has no report at all, for an
+// outage that the GCA has documented. Those overrides have Outage set, and a
+// server refuses one for a timeslot that it holds a report for. They are
+// listed separately in the device stats.
+//
+// A newer override for the same timeslot replaces the older one. Overrides
+// can only be made for timeslots that are still held in memory and whose week
+// has not been finalized, as the totals of a finalized week are already
+// signed, see period_finalization.go. The overrides are persisted, recorded in
+// the audit log, and forwarded to all of the other GCA servers, the same way
+// that deauthorizations are.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// ReportOverride is a correction from the GCA to the power output of a device
+// at a single timeslot.
+type ReportOverride struct {
+	PublicKey   glow.PublicKey // The device being corrected
+	Timeslot    uint32
+	PowerOutput uint64 // The corrected power output, in the same format as a report
+	Outage      bool   // Set if the device has no report for the timeslot, because of a documented outage
+	Reason      string // Why the correction was made, at most 255 bytes
+	Timestamp   int64  // Unix time of the override, a newer override replaces an older one
+	Signature   glow.Signature
+}
+
+// SigningBytes returns the bytes that the GCA signs to authorize the
+// override.
+func (ro ReportOverride) SigningBytes() []byte {
+	return glow.SerializeReportOverrideForSigning(ro.PublicKey, ro.Timeslot, ro.PowerOutput, ro.Outage, ro.Reason, ro.Timestamp)
+}
+
+// Serialize returns the compact binary representation of the override.
+func (ro ReportOverride) Serialize() []byte {
+	b := make([]byte, 0, 32+4+8+1+1+len(ro.Reason)+8+64)
+	b = append(b, ro.PublicKey[:]...)
+	b = binary.LittleEndian.AppendUint32(b, ro.Timeslot)
+	b = binary.LittleEndian.AppendUint64(b, ro.PowerOutput)
+	if ro.Outage {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = append(b, byte(len(ro.Reason)))
+	b = append(b, ro.Reason...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(ro.Timestamp))
+	return append(b, ro.Signature[:]...)
+}
+
+// DeserializeReportOverride reverses a call to Serialize. It returns the
+// number of bytes that were consumed, as the size of a serialized override
+// depends on the length of its reason.
+func DeserializeReportOverride(b []byte) (ReportOverride, int, error) {
+	var ro ReportOverride
+	if len(b) < 46 {
+		return ro, 0, fmt.Errorf("report override is too short")
+	}
+	copy(ro.PublicKey[:], b[:32])
+	ro.Timeslot = binary.LittleEndian.Uint32(b[32:])
+	ro.PowerOutput = binary.LittleEndian.Uint64(b[36:])
+	if b[44] > 1 {
+		return ro, 0, fmt.Errorf("invalid outage flag")
+	}
+	ro.Outage = b[44] == 1
+	reasonLen := int(b[45])
+	n := 46 + reasonLen + 8 + 64
+	if len(b) < n {
+		return ro, 0, fmt.Errorf("report override is too short")
+	}
+	ro.Reason = string(b[46 : 46+reasonLen])
+	i := 46 + reasonLen
+	ro.Timestamp = int64(binary.LittleEndian.Uint64(b[i:]))
+	copy(ro.Signature[:], b[i+8:n])
+	return ro, n, nil
+}
+
+// ReportOverridesHandler lists the current overrides of the device with the
+// 'pubkey' query parameter on a GET, or the overrides of every device if the
+// parameter is left out. A POST accepts a new override from the GCA.
+func (gcas *GCAServer) ReportOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var publicKey glow.PublicKey
+		pkStr := r.URL.Query().Get("pubkey")
+		if pkStr != "" {
+			var err error
+			publicKey, err = glow.ParsePublicKey(pkStr)
+			if err != nil {
+				gcas.writeError(w, ErrCodeMalformedRequest, "invalid pubkey")
+				return
+			}
+		}
+		overrides := make([]ReportOverride, 0)
+		gcas.mu.RLock()
+		for _, slots := range gcas.reportOverrides {
+			for _, ro := range slots {
+				if pkStr == "" || ro.PublicKey == publicKey {
+					overrides = append(overrides, ro)
+				}
+			}
+		}
+		gcas.mu.RUnlock()
+		sort.Slice(overrides, func(i, j int) bool {
+			if overrides[i].PublicKey != overrides[j].PublicKey {
+				return string(overrides[i].PublicKey[:]) < string(overrides[j].PublicKey[:])
+			}
+			return overrides[i].Timeslot < overrides[j].Timeslot
+		})
+		gcas.writeJSONResponse(w, r, overrides)
+		return
+	case http.MethodPost:
+	default:
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET and POST methods are supported.")
+		gcas.requestLogger(r).Warn("Received unsupported request for report overrides.")
+		return
+	}
+
+	var request ReportOverride
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid request body")
+		gcas.requestLogger(r).Warn("Failed to decode request body: ", err)
+		return
+	}
+	isNew, err := gcas.managedOverrideReport(request)
+	if err != nil {
+		gcas.writeError(w, errorCode(err, ErrCodeInternalError), fmt.Sprint("Failed to override report:", err))
+		gcas.requestLogger(r).WithFields("pubkey", request.PublicKey, "timeslot", request.Timeslot).Warn("Failed to override report: ", err)
+		return
+	}
+
+	// Forward the override to all of the other servers, so that every
+	// server computes the same figures. Only new overrides get forwarded,
+	// which prevents the servers from endlessly passing the same request
+	// around.
+	if isNew {
+		gcas.gcaServers.mu.Lock()
+		ass := make([]AuthorizedServer, len(gcas.gcaServers.servers))
+		copy(ass, gcas.gcaServers.servers)
+		gcas.gcaServers.mu.Unlock()
+		jsonBody, _ := json.Marshal(request)
+		for _, as := range ass {
+			resp, err := gcas.postJSON("http://"+glow.HostPort(as.Location, as.HttpPort)+"/api/v1/report-overrides", jsonBody)
+			if err != nil {
+				gcas.requestLogger(r).WithFields("endpoint", glow.HostPort(as.Location, as.HttpPort), "error", err).Info("unable to forward report override")
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	gcas.requestLogger(r).WithFields("pubkey", request.PublicKey, "timeslot", request.Timeslot, "outage", request.Outage).Info("Successfully overrode report.")
+}
+
+// isOverrideUpdate returns whether an override replaces the current override
+// of its timeslot. Of two overrides with the same timestamp, the one with the
+// larger signature wins, so that every server settles on the same override no
+// matter the order that the overrides reach it in. The mutex must be held.
+func (gcas *GCAServer) isOverrideUpdate(shortID uint32, ro ReportOverride) bool {
+	current, exists := gcas.reportOverrides[shortID][ro.Timeslot]
+	if !exists || ro.Timestamp > current.Timestamp {
+		return true
+	}
+	return ro.Timestamp == current.Timestamp && bytes.Compare(ro.Signature[:], current.Signature[:]) > 0
+}
+
+// applyReportOverride makes an override the current override of its
+// timeslot, and adjusts the totals of the week if the timeslot is in memory.
+// The mutex must be held.
+func (gcas *GCAServer) applyReportOverride(shortID uint32, ro ReportOverride) {
+	ero := gcas.equipmentReportsOffset
+	_, inMemory := gcas.equipmentReports[shortID]
+	inMemory = inMemory && ro.Timeslot >= ero && ro.Timeslot < ero+4032
+	var before periodTotals
+	if inMemory {
+		before = gcas.timeslotTotals(shortID, int(ro.Timeslot-ero))
+	}
+	slots, exists := gcas.reportOverrides[shortID]
+	if !exists {
+		slots = make(map[uint32]ReportOverride)
+		gcas.reportOverrides[shortID] = slots
+	}
+	slots[ro.Timeslot] = ro
+	if inMemory {
+		gcas.adjustPeriodTotals(shortID, int(ro.Timeslot-ero), before)
+	}
+}
+
+// managedOverrideReport verifies and saves an override. The bool indicates
+// whether the override is new to this server.
+func (gcas *GCAServer) managedOverrideReport(ro ReportOverride) (bool, error) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	if !gcas.gcaPubkeyAvailable {
+		return false, errNotInitialized
+	}
+	if len(ro.Reason) > 255 {
+		return false, withCode(ErrCodeMalformedRequest, fmt.Errorf("reason is %v bytes, at most 255 are allowed", len(ro.Reason)))
+	}
+	if ro.PowerOutput == 0 || ro.PowerOutput == 1 {
+		return false, withCode(ErrCodeMalformedRequest, fmt.Errorf("power output %v is reserved", ro.PowerOutput))
+	}
+	if !gcas.verifyGCASignature(ro.SigningBytes(), ro.Signature) {
+		return false, withCode(ErrCodeInvalidSignature, errors.New("invalid signature on report override"))
+	}
+	shortID, exists := gcas.equipmentShortID[ro.PublicKey]
+	if !exists {
+		return false, withCode(ErrCodeUnknownDevice, errors.New("equipment not found"))
+	}
+	if current, exists := gcas.reportOverrides[shortID][ro.Timeslot]; exists && !gcas.isOverrideUpdate(shortID, ro) {
+		if current == ro {
+			return false, nil
+		}
+		return false, withCode(ErrCodeConflict, errors.New("a newer override for this timeslot exists"))
+	}
+	if gcas.isFinalizedTimeslot(ro.Timeslot) {
+		return false, withCode(ErrCodePeriodFinalized, fmt.Errorf("timeslot %v is in a finalized period", ro.Timeslot))
+	}
+	if ro.Timeslot < gcas.equipmentReportsOffset || ro.Timeslot >= gcas.equipmentReportsOffset+4032 {
+		return false, withCode(ErrCodeMalformedRequest, fmt.Errorf("timeslot %v is not held in memory", ro.Timeslot))
+	}
+	if ro.Outage && gcas.equipmentReports[shortID].PowerOutputs[ro.Timeslot-gcas.equipmentReportsOffset] != 0 {
+		return false, withCode(ErrCodeConflict, errors.New("an outage can't be declared for a timeslot with a report"))
+	}
+
+	// Record and persist the override before applying it.
+	err := gcas.recordAudit(auditRecord{
+		action:     glow.AuditReportOverride,
+		request:    ro.Serialize(),
+		signatures: []glow.AuditSignature{gcas.gcaAuditSignature(ro.SigningBytes(), ro.Signature)},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := gcas.staticStorage.AppendFile(ReportOverridesFile, ro.Serialize(), 0644); err != nil {
+		return false, fmt.Errorf("unable to save report override: %v", err)
+	}
+	gcas.applyReportOverride(shortID, ro)
+	gcas.recordStateChange(StateChange{
+		Kind:        StateChangeOverride,
+		ShortID:     shortID,
+		Timeslot:    ro.Timeslot,
+		PowerOutput: ro.PowerOutput,
+	})
+	return true, nil
+}
+
+// loadReportOverrides loads the overrides from disk, creating the file if it
+// does not exist yet. This needs to happen after the equipment is loaded.
+func (gcas *GCAServer) loadReportOverrides() error {
+	data, err := gcas.staticStorage.ReadFile(ReportOverridesFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(ReportOverridesFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read report overrides file: %v", err)
+	}
+	for i := 0; len(data) > 0; i++ {
+		ro, n, err := DeserializeReportOverride(data)
+		if err != nil {
+			return fmt.Errorf("%v: record %v: %v", ReportOverridesFile, i, err)
+		}
+		if !gcas.verifyPersistedGCASignature(ro.SigningBytes(), ro.Signature) {
+			return fmt.Errorf("%v: record %v: invalid signature on report override", ReportOverridesFile, i)
+		}
+		shortID, exists := gcas.equipmentShortID[ro.PublicKey]
+		if !exists {
+			return fmt.Errorf("%v: record %v: override for unknown equipment", ReportOverridesFile, i)
+		}
+		if gcas.isOverrideUpdate(shortID, ro) {
+			gcas.applyReportOverride(shortID, ro)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// applyReportOverrides replaces the power outputs of a device with the
+// overrides of the GCA, where outputs[0] is the power output at the provided
+// timeslot. The overrides of the timeslots that don't count for a banned
+// device are left out, see ban_accounting.go. The mutex must be held.
+func (gcas *GCAServer) applyReportOverrides(shortID uint32, start uint32, outputs []uint64) {
+	for timeslot, ro := range gcas.reportOverrides[shortID] {
+		if timeslot >= start && timeslot-start < uint32(len(outputs)) && gcas.reportCounts(shortID, timeslot) {
+			outputs[timeslot-start] = ro.PowerOutput
+		}
+	}
+}
+
+// overriddenTimeslots returns the indexes of the corrected timeslots of a
+// device within the provided number of timeslots after the provided
+// timeslot, split into the corrections of a report and the outages. Like in
+// applyReportOverrides, the timeslots that don't count are left out. The
+// mutex must be held.
+func (gcas *GCAServer) overriddenTimeslots(shortID uint32, timeslotOffset uint32, timeslots uint32) (corrected, outages []int) {
+	for timeslot, ro := range gcas.reportOverrides[shortID] {
+		if timeslot < timeslotOffset || timeslot >= timeslotOffset+timeslots || !gcas.reportCounts(shortID, timeslot) {
+			continue
+		}
+		if ro.Outage {
+			outages = append(outages, int(timeslot-timeslotOffset))
+		} else {
+			corrected = append(corrected, int(timeslot-timeslotOffset))
+		}
+	}
+	sort.Ints(corrected)
+	sort.Ints(outages)
+	return corrected, outages
+}
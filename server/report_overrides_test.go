@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// postReportOverride submits an override signed with the provided key, and
+// returns the status of the response.
+func (gcas *GCAServer) postReportOverride(ro ReportOverride, gcaPrivKey glow.PrivateKey) (int, error) {
+	ro.Signature = glow.Sign(ro.SigningBytes(), gcaPrivKey)
+	body, err := json.Marshal(ro)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.Post("http://"+gcas.httpDialAddr()+"/api/v1/report-overrides", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// TestReportOverrides checks that an override of the GCA changes the figures
+// of a device without touching its report, that outages are marked
+// separately, and that the overrides survive a restart.
+func TestReportOverrides(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(20)
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(4, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i <= 5; i++ {
+		server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, i, ePriv))
+	}
+	now := time.Now().Unix()
+
+	// Overrides need the signature of the GCA, a power output that isn't
+	// reserved, and an outage can only be declared for an empty timeslot.
+	correction := ReportOverride{PublicKey: ea.PublicKey, Timeslot: 2, PowerOutput: 50, Reason: "meter was reset", Timestamp: now}
+	_, otherPriv := glow.GenerateKeyPair()
+	if status, err := server.postReportOverride(correction, otherPriv); err != nil || status != http.StatusForbidden {
+		t.Fatal("override with a bad signature was accepted:", status, err)
+	}
+	reserved := correction
+	reserved.PowerOutput = 1
+	if status, err := server.postReportOverride(reserved, gcaPrivKey); err != nil || status != http.StatusBadRequest {
+		t.Fatal("override with a reserved power output was accepted:", status, err)
+	}
+	badOutage := ReportOverride{PublicKey: ea.PublicKey, Timeslot: 3, PowerOutput: 7, Outage: true, Timestamp: now}
+	if status, err := server.postReportOverride(badOutage, gcaPrivKey); err != nil || status != http.StatusConflict {
+		t.Fatal("outage for a timeslot with a report was accepted:", status, err)
+	}
+	if status, err := server.postReportOverride(correction, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("override was refused:", status, err)
+	}
+	outage := ReportOverride{PublicKey: ea.PublicKey, Timeslot: 10, PowerOutput: 7, Outage: true, Reason: "inverter outage, see ticket 12", Timestamp: now}
+	if status, err := server.postReportOverride(outage, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("outage was refused:", status, err)
+	}
+
+	// A newer override replaces the correction, an older one is refused.
+	correction.PowerOutput, correction.Timestamp = 60, now+1
+	if status, err := server.postReportOverride(correction, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("newer override was refused:", status, err)
+	}
+	stale := correction
+	stale.Timestamp = now - 1
+	if status, err := server.postReportOverride(stale, gcaPrivKey); err != nil || status != http.StatusConflict {
+		t.Fatal("older override was accepted:", status, err)
+	}
+	correction.Signature = glow.Sign(correction.SigningBytes(), gcaPrivKey)
+	server.auditLog.mu.Lock()
+	last := server.auditLog.entries[len(server.auditLog.entries)-1]
+	server.auditLog.mu.Unlock()
+	if last.Action != glow.AuditReportOverride || !bytes.Equal(last.Request, correction.Serialize()) {
+		t.Fatalf("unexpected audit entry: %+v", last)
+	}
+
+	// checkFigures checks everything that the overrides change, and that
+	// the report of the device was left alone.
+	checkFigures := func(server *GCAServer) {
+		t.Helper()
+		_, ads, err := server.getAllDeviceStats("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds := ads.Devices[0]
+		if ds.PowerOutputs[2] != 60 || ds.PowerOutputs[3] != 5 || ds.PowerOutputs[10] != 7 {
+			t.Fatal("overrides were not applied to the stats:", ds.PowerOutputs[:11])
+		}
+		if !reflect.DeepEqual(ds.CorrectedTimeslots, []int{2}) || !reflect.DeepEqual(ds.OutageTimeslots, []int{10}) {
+			t.Fatal("overrides were not marked in the stats:", ds.CorrectedTimeslots, ds.OutageTimeslots)
+		}
+		_, summary, err := server.getDeviceSummary("pubkey=" + hex.EncodeToString(ea.PublicKey[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.TotalEnergy != 4*5+60+7 || summary.ReportsReceived != 5 || summary.CorrectedTimeslots != 1 || summary.OutageTimeslots != 1 || summary.MissedTimeslots != 14 {
+			t.Fatalf("overrides were not applied to the summary: %+v", summary)
+		}
+		_, di, err := server.getDeviceImpact("pubkey=" + hex.EncodeToString(ea.PublicKey[:]) + "&start=0&end=20")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if di.TotalEnergy != 4*5+60+7 {
+			t.Fatalf("overrides were not applied to the impact: %+v", di)
+		}
+		server.mu.RLock()
+		report := server.liveReports(t, ea.ShortID)[2]
+		server.mu.RUnlock()
+		if report.PowerOutput != 5 || !glow.Verify(ea.PublicKey, report.SigningBytes(), report.Signature) {
+			t.Fatal("the original report was replaced:", report)
+		}
+	}
+	checkFigures(server)
+
+	// The overrides survive a restart.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	checkFigures(server)
+}
+
+// TestReportOverrideForwarding checks that an override gets forwarded to the
+// other GCA servers.
+func TestReportOverrideForwarding(t *testing.T) {
+	server, _, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	failover, _, err := SetupTestEnvironmentKnownGCA(t.Name()+"-failover", gcaPubKey, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer failover.Close()
+	server.gcaServers.mu.Lock()
+	server.gcaServers.servers = append(server.gcaServers.servers, AuthorizedServer{
+		PublicKey: failover.staticPublicKey,
+		Location:  "127.0.0.1",
+		HttpPort:  failover.httpPort,
+		TcpPort:   failover.tcpPort,
+		UdpPort:   failover.udpPort,
+	})
+	server.gcaServers.mu.Unlock()
+
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro := ReportOverride{PublicKey: ea.PublicKey, Timeslot: 4, PowerOutput: 9, Outage: true, Reason: "outage", Timestamp: time.Now().Unix()}
+	if status, err := server.postReportOverride(ro, gcaPrivKey); err != nil || status != http.StatusOK {
+		t.Fatal("override was refused:", status, err)
+	}
+
+	// Forwarding happens before the handler responds.
+	failover.mu.RLock()
+	forwarded, exists := failover.reportOverrides[ea.ShortID][4]
+	failover.mu.RUnlock()
+	if !exists || forwarded.PowerOutput != 9 || !forwarded.Outage {
+		t.Fatal("override was not forwarded:", forwarded)
+	}
+}
+
+// TestReportOverrideSerialization checks that an override survives the round
+// trip through Serialize, and that truncated records are refused.
+func TestReportOverrideSerialization(t *testing.T) {
+	pub, _ := glow.GenerateKeyPair()
+	ro := ReportOverride{PublicKey: pub, Timeslot: 4033, PowerOutput: ^uint64(4), Outage: true, Reason: "outage", Timestamp: 1700000000}
+	ro.Signature[5] = 9
+	b := ro.Serialize()
+	decoded, n, err := DeserializeReportOverride(append(b, 1, 2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != ro || n != len(b) {
+		t.Fatalf("override did not survive the round trip: %+v %v", decoded, n)
+	}
+	for i := 0; i < len(b); i++ {
+		if _, _, err := DeserializeReportOverride(b[:i]); err == nil {
+			t.Fatal("truncated override was accepted at length", i)
+		}
+	}
+}
@@ -2,62 +2,283 @@ package server
 
 // This file contains methods related to saving reports to disk and loading
 // them off of disk.
+//
+// Reports are persisted in two files. New reports get appended to a journal,
+// where each record is length prefixed and checksummed. The journal is held
+// open for the lifetime of the server so that saving a report only costs a
+// single write call. A background thread periodically compacts the journal
+// by folding all of its reports into the main reports file, which contains
+// raw serialized reports, and then truncating the journal. The reports file
+// only ever gets appended to, so a compaction costs as much as the journal
+// that it folds in, not as much as the whole history.
+//
+// At startup, the main reports file is loaded first and then the journal is
+// replayed on top of it. If the server died in the middle of writing a
+// journal record, the partial record will fail its length or checksum check,
+// and is dropped from the journal. If the server died in the middle of a
+// compaction, the reports file may end in a partial report, which is dropped
+// the same way, and some reports may appear in both files, which is harmless
+// because duplicate reports are ignored when integrated.
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 
 	"github.com/glowlabs-org/gca-backend/glow"
 )
 
+// reportsJournalRecordSize is the size of a single journal record, which is
+// a 4 byte length prefix, the serialized report, and a 4 byte checksum.
+const reportsJournalRecordSize = 4 + equipmentReportSize + 4
+
+// reportsFileWriteFault, when set, is called in place of appending the reports
+// of the journal to the reports file. It is only set during testing, to
+// simulate a crash in the middle of a compaction.
+var reportsFileWriteFault func(f StorageLog, data []byte) error
+
+// encodeJournalRecord returns the journal record for a report.
+func encodeJournalRecord(report glow.EquipmentReport) []byte {
+	record := make([]byte, reportsJournalRecordSize)
+	binary.LittleEndian.PutUint32(record[0:], equipmentReportSize)
+	copy(record[4:], report.Serialize())
+	checksum := crc32.ChecksumIEEE(record[4 : 4+equipmentReportSize])
+	binary.LittleEndian.PutUint32(record[4+equipmentReportSize:], checksum)
+	return record
+}
+
+// decodeJournal returns the serialized reports of every complete and valid
+// record in the journal, along with the number of bytes that those records
+// occupy. Decoding stops at the first record which is incomplete or which
+// fails its checksum, everything after that point is considered corrupt.
+func decodeJournal(data []byte) (reports [][]byte, validLen int) {
+	for len(data)-validLen >= reportsJournalRecordSize {
+		record := data[validLen : validLen+reportsJournalRecordSize]
+		if binary.LittleEndian.Uint32(record[0:]) != equipmentReportSize {
+			break
+		}
+		payload := record[4 : 4+equipmentReportSize]
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(record[4+equipmentReportSize:]) {
+			break
+		}
+		reports = append(reports, payload)
+		validLen += reportsJournalRecordSize
+	}
+	return reports, validLen
+}
+
 // loadEquipmentReports will load all of the equipment reports that are saved
-// to disk.
+// to disk, first from the main reports file and then from the journal. It
+// also opens the journal so that new reports can be appended to it.
 func (gcas *GCAServer) loadEquipmentReports() error {
-	filepath := filepath.Join(gcas.baseDir, "equipment-reports.dat")
-	rawData, err := ioutil.ReadFile(filepath)
+	rawData, err := gcas.staticStorage.ReadFile(EquipmentReportsFile)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return fmt.Errorf("unable to open reports file: %v", err)
 		}
-		f, err := os.Create(filepath)
-		if err != nil {
+		if err := gcas.staticStorage.WriteFile(EquipmentReportsFile, nil, 0644); err != nil {
 			return fmt.Errorf("unable to create reports file: %v", err)
 		}
-		f.Close()
-		return nil
 	}
 
-	// Check that the data is a sensisble length.
-	if len(rawData)%80 != 0 {
-		return fmt.Errorf("reports file has an unexpected size")
+	// Drop any trailing partial report, which is left behind by a
+	// compaction that got interrupted. The journal still has the report.
+	if extra := len(rawData) % equipmentReportSize; extra != 0 {
+		gcas.logger.Warnf("dropping %v bytes of a partial report from the end of the reports file", extra)
+		rawData = rawData[:len(rawData)-extra]
+		if err := gcas.truncateReportsFile(len(rawData) / equipmentReportSize); err != nil {
+			return err
+		}
 	}
 
-	// Parse all of the reports and integrate them into the state.
-	for i := 0; i < len(rawData)/80; i++ {
-		report, err := gcas.parseReport(rawData[i*80 : i*80+80])
+	// Open the journal.
+	journal, err := gcas.staticStorage.OpenLog(ReportsJournalFile, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open reports journal: %v", err)
+	}
+	journalData, err := ioutil.ReadAll(journal)
+	if err != nil {
+		journal.Close()
+		return fmt.Errorf("unable to read reports journal: %v", err)
+	}
+	journalReports, validLen := decodeJournal(journalData)
+
+	// Verify all of the reports in parallel, and then integrate them into
+	// the state, the reports file first and then the journal. The records
+	// are numbered in that same order, see report_store.go.
+	rawReports := make([][]byte, 0, len(rawData)/equipmentReportSize+len(journalReports))
+	for i := 0; i < len(rawData)/equipmentReportSize; i++ {
+		rawReports = append(rawReports, rawData[i*equipmentReportSize:(i+1)*equipmentReportSize])
+	}
+	rawReports = append(rawReports, journalReports...)
+	reports, parseErrs := gcas.parseReports(rawReports)
+	for i := range rawReports {
+		err := gcas.loadReport(rawReports[i], reports[i], parseErrs[i], uint32(i+1), ValidationOff)
 		if err != nil {
-			return fmt.Errorf("corrupt report: %v", err)
+			journal.Close()
+			if i < len(rawData)/equipmentReportSize {
+				return fmt.Errorf("%v: record %v: %v", EquipmentReportsFile, i, err)
+			}
+			return fmt.Errorf("%v: record %v: %v", ReportsJournalFile, i-len(rawData)/equipmentReportSize, err)
+		}
+	}
+	// Drop any trailing partial record so that new records get appended
+	// directly after the last valid one.
+	if validLen != len(journalData) {
+		gcas.logger.Warnf("dropping %v corrupt bytes from the end of the reports journal", len(journalData)-validLen)
+		if err := journal.Truncate(int64(validLen)); err != nil {
+			journal.Close()
+			return fmt.Errorf("unable to truncate reports journal: %v", err)
 		}
-		gcas.integrateReport(report)
 	}
+	gcas.reportsJournal = journal
+	gcas.reportsFileRecords = uint32(len(rawData) / equipmentReportSize)
+	gcas.reportsJournalRecords = uint32(validLen / reportsJournalRecordSize)
+	if err := gcas.openReportsFile(); err != nil {
+		journal.Close()
+		return err
+	}
+	gcas.tg.AfterStop(func() error {
+		gcas.mu.Lock()
+		defer gcas.mu.Unlock()
+		gcas.reportsFile.Close()
+		return gcas.reportsJournal.Close()
+	})
+	return nil
+}
 
+// loadReport will integrate a report that was loaded from disk and parsed by
+// parseReports into the state without saving it again. The record is the
+// number of the report in the reports files, or 0 if it came from elsewhere. Reports from banned
+// equipment are only kept if they count, see ban_accounting.go, as the
+// equipment is no longer known. The ban is checked first, because the
+// equipment may have been banned by one of the reports before this one. The
+// capacity mode is passed on to applyReport.
+func (gcas *GCAServer) loadReport(rawData []byte, report glow.EquipmentReport, err error, record uint32, capacityMode ValidationMode) error {
+	if len(rawData) == equipmentReportSize {
+		if _, banned := gcas.equipmentBans[binary.LittleEndian.Uint32(rawData[0:4])]; banned {
+			if err == nil {
+				gcas.retainBannedReport(report, record)
+			}
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("corrupt report: %v", err)
+	}
+	// A report past the end of the reporting window means that the
+	// reports and the device stats history disagree about the current
+	// period.
+	if report.Timeslot >= gcas.equipmentReportsOffset+4032 {
+		return fmt.Errorf("report for timeslot %v is past the end of the period that starts at %v", report.Timeslot, gcas.equipmentReportsOffset)
+	}
+	gcas.applyReport(report, record, capacityMode)
 	return nil
 }
 
 // saveEquipmentReport will save an equipment report to disk, so that the
-// report will still be available after a restart.
-func (gcas *GCAServer) saveEquipmentReport(ea glow.EquipmentReport) error {
-	filepath := filepath.Join(gcas.baseDir, "equipment-reports.dat")
-	file, err := os.OpenFile(filepath, os.O_APPEND|os.O_WRONLY, 0644)
+// report will still be available after a restart. The report gets the record
+// returned by nextReportRecord. If the write fails, whatever part of the
+// record made it to the journal is cut off again so that the records that
+// follow stay aligned.
+func (gcas *GCAServer) saveEquipmentReport(report glow.EquipmentReport) error {
+	_, err := gcas.reportsJournal.Write(encodeJournalRecord(report))
+	if err != nil {
+		gcas.reportsJournal.Truncate(int64(gcas.reportsJournalRecords) * reportsJournalRecordSize)
+		return fmt.Errorf("unable to write equipment report to the journal: %v", err)
+	}
+	gcas.reportsJournalRecords++
+	return nil
+}
+
+// compactReportsJournal will fold all of the reports in the journal into the
+// main reports file and then truncate the journal. The reports get appended
+// to the main file and synced before the journal gets truncated, so a crash
+// at any point will not lose reports.
+func (gcas *GCAServer) compactReportsJournal() error {
+	journalData, err := gcas.staticStorage.ReadFile(ReportsJournalFile)
 	if err != nil {
-		return fmt.Errorf("unable to open file to save equipment report: %v", err)
+		return fmt.Errorf("unable to read reports journal: %v", err)
+	}
+	reports, _ := decodeJournal(journalData)
+	if len(reports) == 0 {
+		return nil
+	}
+	data := make([]byte, 0, len(reports)*equipmentReportSize)
+	for _, report := range reports {
+		data = append(data, report...)
 	}
-	defer file.Close()
-	_, err = file.Write(ea.Serialize())
+
+	// The reports file isn't rewritten through AppendFile, as that would
+	// copy the whole history for every compaction. If the write fails,
+	// whatever part of it made it to the file is cut off again so that
+	// the next compaction starts at a report boundary.
+	f, err := gcas.staticStorage.OpenLog(EquipmentReportsFile, 0644)
 	if err != nil {
-		return fmt.Errorf("unable to write to file to save equipment report: %v", err)
+		return fmt.Errorf("unable to open reports file: %v", err)
+	}
+	if reportsFileWriteFault != nil {
+		err = reportsFileWriteFault(f, data)
+	} else {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(int64(gcas.reportsFileRecords) * equipmentReportSize)
+		f.Close()
+		return fmt.Errorf("unable to write to reports file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to close reports file: %v", err)
+	}
+	// The records of the journal now follow the records of the reports
+	// file, and are also still in the journal until it gets truncated.
+	gcas.reportsFileRecords += uint32(len(reports))
+
+	// Writes to the journal always go to its end, so new records will be
+	// written at the start of the file after the truncation.
+	err = gcas.reportsJournal.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("unable to truncate reports journal: %v", err)
+	}
+	gcas.reportsJournalRecords = 0
+	return gcas.openReportsFile()
+}
+
+// truncateReportsFile cuts the reports file off after the provided number of
+// reports.
+func (gcas *GCAServer) truncateReportsFile(records int) error {
+	f, err := gcas.staticStorage.OpenLog(EquipmentReportsFile, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open reports file: %v", err)
+	}
+	err = f.Truncate(int64(records) * equipmentReportSize)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to truncate reports file: %v", err)
+	}
+	return f.Close()
+}
+
+// threadedCompactReportsJournal will periodically compact the reports
+// journal.
+func (gcas *GCAServer) threadedCompactReportsJournal() {
+	for {
+		if !gcas.sleep(ReportsJournalCompactionFrequency) {
+			return
+		}
+		gcas.mu.Lock()
+		err := gcas.compactReportsJournal()
+		gcas.mu.Unlock()
+		if err != nil {
+			gcas.logger.Errorf("unable to compact reports journal: %v", err)
+		}
 	}
-	return nil
 }
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// checkReports verifies that timeslots [1, n] of the provided equipment have
+// the power output written by generateTestReport.
+func (gcas *GCAServer) checkReports(shortID uint32, n uint32) bool {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	reports := gcas.equipmentReports[shortID]
+	for i := uint32(1); i <= n; i++ {
+		if reports.PowerOutputs[i] != 5 {
+			return false
+		}
+	}
+	return reports.PowerOutputs[n+1] == 0
+}
+
+// TestReportsJournalTruncation truncates the journal in the middle of a
+// record and checks that the server recovers cleanly at startup.
+func TestReportsJournalTruncation(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, ePriv, err := server.AuthorizeTestDevice(8, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i <= 5; i++ {
+		server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, i, ePriv))
+	}
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of writing the sixth record.
+	storage := serverStorage(dir)
+	journal, err := storage.ReadFile(ReportsJournalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal) != 5*reportsJournalRecordSize {
+		t.Fatal("journal has the wrong size:", len(journal))
+	}
+	er, err := glow.DeserializeReport(generateTestReport(ea.ShortID, 6, ePriv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := encodeJournalRecord(er)[:reportsJournalRecordSize/2]
+	err = storage.WriteFile(ReportsJournalFile, append(journal, partial...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server should start, keep the five complete reports, and drop
+	// the partial one.
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.checkReports(ea.ShortID, 5) {
+		t.Fatal("reports were not recovered from the journal")
+	}
+	info, err := storage.Stat(ReportsJournalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 5*reportsJournalRecordSize {
+		t.Fatal("partial record was not dropped from the journal:", info.Size())
+	}
+
+	// New reports should land after the last complete record.
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 6, ePriv))
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if !server.checkReports(ea.ShortID, 6) {
+		t.Fatal("report sent after recovery was lost")
+	}
+}
+
+// TestReportsJournalCompaction checks that compaction moves the reports
+// into the main reports file, and that restarts don't duplicate reports.
+func TestReportsJournalCompaction(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, ePriv, err := server.AuthorizeTestDevice(8, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i <= 3; i++ {
+		server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, i, ePriv))
+	}
+	server.mu.Lock()
+	err = server.compactReportsJournal()
+	server.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 4, ePriv))
+
+	// Three reports should be in the main file and one in the journal.
+	storage := serverStorage(dir)
+	checkSizes := func(reports, journal int64) {
+		t.Helper()
+		info, err := storage.Stat(EquipmentReportsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != reports*equipmentReportSize {
+			t.Fatal("reports file has the wrong size:", info.Size())
+		}
+		info, err = storage.Stat(ReportsJournalFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != journal*reportsJournalRecordSize {
+			t.Fatal("journal has the wrong size:", info.Size())
+		}
+	}
+	checkSizes(3, 1)
+
+	// Restart the server twice, the files should not grow.
+	for i := 0; i < 2; i++ {
+		err = server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err = NewGCAServer(dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !server.checkReports(ea.ShortID, 4) {
+			t.Fatal("reports were lost during restart")
+		}
+		checkSizes(3, 1)
+	}
+
+	// Simulate a crash between writing the main file and truncating the
+	// journal by copying the journal reports into the main file by hand.
+	// The duplicates should be harmless.
+	server.mu.Lock()
+	err = server.compactReportsJournal()
+	server.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := storage.ReadFile(EquipmentReportsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := make([]byte, 0, len(data)/equipmentReportSize*reportsJournalRecordSize)
+	for i := 0; i < len(data); i += equipmentReportSize {
+		er, err := glow.DeserializeReport(data[i : i+equipmentReportSize])
+		if err != nil {
+			t.Fatal(err)
+		}
+		journal = append(journal, encodeJournalRecord(er)...)
+	}
+	err = storage.WriteFile(ReportsJournalFile, journal, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.checkReports(ea.ShortID, 4) {
+		t.Fatal("reports were not loaded correctly with duplicates in the journal")
+	}
+
+	// Simulate a crash in the middle of appending to the main file. The
+	// partial report should be dropped, and the next compaction should
+	// append after the last complete report.
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = storage.ReadFile(EquipmentReportsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.WriteFile(EquipmentReportsFile, append(data, make([]byte, equipmentReportSize/2)...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	info, err := storage.Stat(EquipmentReportsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Fatal("partial report was not dropped from the reports file:", info.Size())
+	}
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 5, ePriv))
+	server.mu.Lock()
+	err = server.compactReportsJournal()
+	server.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.checkReports(ea.ShortID, 5) {
+		t.Fatal("reports were lost after dropping the partial report")
+	}
+}
+
+// BenchmarkReportPersistence compares the throughput of appending reports to
+// the journal against the previous approach of opening the reports file,
+// appending the report, and closing the file for every report.
+func BenchmarkReportPersistence(b *testing.B) {
+	var er glow.EquipmentReport
+	b.Run("OpenAppendClose", func(b *testing.B) {
+		path := filepath.Join(b.TempDir(), EquipmentReportsFile)
+		f, err := os.Create(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			er.Timeslot = uint32(i)
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = file.Write(er.Serialize())
+			if err != nil {
+				b.Fatal(err)
+			}
+			file.Close()
+		}
+	})
+	b.Run("Journal", func(b *testing.B) {
+		journal, err := os.OpenFile(filepath.Join(b.TempDir(), ReportsJournalFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer journal.Close()
+		gcas := &GCAServer{reportsJournal: journal}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			er.Timeslot = uint32(i)
+			err := gcas.saveEquipmentReport(er)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
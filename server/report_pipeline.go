@@ -0,0 +1,253 @@
+package server
+
+// report_pipeline.go contains the pipeline that ingests the reports that
+// arrive over UDP. The listener only reads packets and pushes them onto a
+// bounded queue. A pool of workers takes the packets off the queue, parses
+// them and verifies their signatures in parallel, and then applies the
+// verified reports to the state under the server mutex.
+//
+// Reports that arrive over HTTP, see api_equipment_report.go, skip the queue
+// but otherwise take the same path: admitReportPacket decodes the packet and
+// applies the rate limits, and managedIngestReport verifies and applies the
+// report and signs the ack.
+//
+// Verifying the signature is by far the most expensive part of handling a
+// report, and it is the only part that happens outside of the mutex. The
+// workers may finish the reports of a single device in any order, which is
+// fine because every timeslot has its own slot in equipmentReports, so a later
+// timeslot that gets applied before an earlier one doesn't affect the outcome
+// of either report. Two reports for the same timeslot are still applied one
+// at a time under the mutex, so duplicate and equivocation detection work the
+// same as before.
+//
+// When the workers fall behind, the queue fills up and the listener drops new
+// packets instead of buffering them. Devices resend the reports that the
+// server is missing after they sync, so a dropped packet only gets delayed.
+//
+// Close() first stops the listener from reading, and then gives the workers
+// up to udpDrainTimeout to validate, persist and ack every packet that was
+// already read, before the socket and the persist files get closed. A report
+// that got persisted therefore also got its ack, unless the deadline passed,
+// in which case the packets that are left get dropped without being
+// processed at all. Either way a device that resends a report it got no ack
+// for either gets it accepted or gets a duplicate, never a conflict.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// reportPacket is a UDP packet that is waiting for a report worker.
+type reportPacket struct {
+	conn *net.UDPConn // The socket that received the packet, used for the ack
+	addr *net.UDPAddr
+	data []byte
+
+	// The buffer of the pool that the data lives in, nil if it isn't in a
+	// buffer of the pool, see udpPacketBuffers.
+	buffer *udpPacketBuffer
+
+	// The servers that know the ShortID of the report, if there is more
+	// than one, see tenants.go. The data is the packet as it arrived,
+	// which hasn't been admitted by any of them yet.
+	candidates []*GCAServer
+
+	// Set if the packet is a heartbeat rather than a report, see
+	// heartbeats.go. The data is the packet as it arrived.
+	heartbeat bool
+}
+
+// remoteAddr is the address of a device that reached the server over HTTP.
+// The ingestion path takes the remote address as a fmt.Stringer, so that the
+// address of a UDP packet is only formatted if the packet gets logged.
+type remoteAddr string
+
+// String returns the address.
+func (ra remoteAddr) String() string {
+	return string(ra)
+}
+
+// releaseBuffer returns the buffer of the packet to the pool. The data of the
+// packet must not be used afterwards.
+func (pkt reportPacket) releaseBuffer() {
+	if pkt.buffer != nil {
+		udpPacketBuffers.Put(pkt.buffer)
+	}
+}
+
+// The reasons that a report packet gets dropped before it is verified.
+var (
+	errMalformedPacket   = errors.New("malformed report packet")
+	errRateLimitedPacket = errors.New("too many reports from the device")
+)
+
+// admitReportPacket decodes a report packet in any of the layouts that the
+// server accepts, and checks the report against the rate limits of its
+// device. It returns the serialized report, which is what the rest of the
+// pipeline works on. The report is appended to dst, which may be the buffer
+// of the packet itself, as the packet is no longer needed once it is decoded.
+func (server *GCAServer) admitReportPacket(packet []byte, dst []byte) ([]byte, error) {
+	report, version, err := glow.DecodeReportPacket(packet)
+	if err != nil {
+		server.staticMetrics.RecordMalformedPacket()
+		return nil, fmt.Errorf("%w of version %v: %v", errMalformedPacket, version, err)
+	}
+	data := report.AppendSerialization(dst)
+	if !server.allowReportPacket(data, server.now()) {
+		return nil, errRateLimitedPacket
+	}
+	return data, nil
+}
+
+// queueReportPacket hands a packet to the report workers. The packet is
+// dropped if the queue is full, and the return value indicates whether the
+// packet was queued.
+func (server *GCAServer) queueReportPacket(pkt reportPacket) bool {
+	server.pendingReportPackets.Add(1)
+	select {
+	case server.staticReportQueue <- pkt:
+		return true
+	default:
+		server.pendingReportPackets.Add(-1)
+		server.staticMetrics.RecordQueueFull()
+		return false
+	}
+}
+
+// threadedProcessReports is the loop of a single report worker.
+func (server *GCAServer) threadedProcessReports() {
+	for {
+		select {
+		case <-server.tg.StopChan():
+			return
+		case pkt := <-server.staticReportQueue:
+			server.managedProcessReportPacket(pkt)
+			pkt.releaseBuffer()
+			server.pendingReportPackets.Add(-1)
+		}
+	}
+}
+
+// drainUDPReports stops the UDP listener from reading new packets, and waits
+// up to udpDrainTimeout for the workers to finish the packets that were
+// already read. The socket stays open, so that the workers can still send
+// the acks. The packets that are left when the deadline passes are dropped
+// once the workers stop. The deadline is on the wall clock, since the
+// server clock may be a manual clock in testing.
+func (server *GCAServer) drainUDPReports() {
+	deadline := time.Now().Add(udpDrainTimeout)
+	server.udpListener.mu.Lock()
+	server.udpListener.draining = true
+	conn, done := server.udpListener.conn, server.udpListener.done
+	if conn != nil && !server.udpListener.down {
+		// Unblock the read that the listener is waiting on.
+		conn.SetReadDeadline(time.Now())
+	}
+	server.udpListener.mu.Unlock()
+	if done != nil {
+		t := time.NewTimer(time.Until(deadline))
+		select {
+		case <-done:
+			t.Stop()
+		case <-t.C:
+			server.logger.Warn("The UDP listener did not stop reading within the drain timeout")
+		}
+	}
+
+	read := server.pendingReportPackets.Load()
+	pending := read
+	for pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		pending = server.pendingReportPackets.Load()
+	}
+	if pending > 0 {
+		server.logger.Warnf("Drained %v UDP packets at shutdown, dropped %v that were not processed within %v", read-pending, pending, udpDrainTimeout)
+	} else if read > 0 {
+		server.logger.Infof("Drained %v UDP packets at shutdown", read)
+	}
+}
+
+// managedProcessReportPacket handles a single report packet, acknowledging it
+// if it was authenticated.
+func (server *GCAServer) managedProcessReportPacket(pkt reportPacket) {
+	if pkt.heartbeat {
+		server.heartbeatServer(pkt.data).managedIngestHeartbeat(pkt.data, "udp", pkt.addr)
+		return
+	}
+	if pkt.candidates != nil {
+		server.managedRouteReportPacket(pkt)
+		return
+	}
+	ack, _, authenticated := server.managedIngestReport(pkt.data, "udp", pkt.addr)
+	if authenticated {
+		server.sendReportAck(pkt.conn, pkt.addr, ack)
+	}
+}
+
+// managedIngestReport verifies a serialized report and applies it to the
+// state, logging it if it was rejected. Reports that were authenticated get a
+// signed ack, which carries the outcome of the report. The transport and the
+// remote address only show up in the log, see remoteAddr.
+func (server *GCAServer) managedIngestReport(data []byte, transport string, remote fmt.Stringer) (glow.ReportAck, reportOutcome, bool) {
+	outcome, authenticated := server.managedHandleEquipmentReport(data)
+	if outcome != reportAccepted && outcome != reportDuplicate {
+		server.logRejectedReport(transport, remote, data, outcome, authenticated)
+	}
+	if !authenticated {
+		return glow.ReportAck{}, outcome, false
+	}
+	ack := glow.ReportAck{
+		ShortID:  binary.LittleEndian.Uint32(data[0:4]),
+		Timeslot: binary.LittleEndian.Uint32(data[4:8]),
+		Status:   outcome.ackStatus(),
+	}
+	ack.Signature = server.staticSigner.Sign(ack.SigningBytes())
+	return ack, outcome, true
+}
+
+// managedVerifyReport parses the raw data of a report and verifies its
+// signature. The mutex is only held to look up the keys of the equipment, the
+// key that signed the report is returned so that the caller can check that it
+// is still a key of the equipment once the mutex is held again. A report that
+// was signed by a key of the equipment which isn't valid for its timeslot
+// returns that key along with errOutsideAuthorization.
+func (server *GCAServer) managedVerifyReport(rawData []byte) (glow.EquipmentReport, glow.PublicKey, error) {
+	report, err := glow.DeserializeReport(rawData)
+	if err != nil {
+		return report, glow.PublicKey{}, fmt.Errorf("unexpected data length: expected 80 bytes, got %d bytes", len(rawData))
+	}
+
+	server.mu.RLock()
+	equipment, ok := server.equipment[report.ShortID]
+	var buf [2]glow.PublicKey
+	keys := server.appendDeviceKeysAt(buf[:0], equipment.PublicKey, report.Timeslot)
+	var allKeys []glow.PublicKey
+	if len(server.deviceKeyRotations[equipment.PublicKey]) > 0 {
+		allKeys = server.deviceKeys(equipment.PublicKey)
+	}
+	server.mu.RUnlock()
+	if !ok {
+		return report, glow.PublicKey{}, fmt.Errorf("unknown equipment ID: %d", report.ShortID)
+	}
+	sb := report.SigningBytes()
+	for _, key := range keys {
+		if glow.Verify(key, sb, report.Signature) {
+			return report, key, nil
+		}
+	}
+	// Devices without rotations only have the one key, which was
+	// already tried.
+	if len(allKeys) > 0 {
+		for _, key := range allKeys {
+			if glow.Verify(key, sb, report.Signature) {
+				return report, key, errOutsideAuthorization
+			}
+		}
+	}
+	return report, glow.PublicKey{}, errors.New("failed to verify signature")
+}
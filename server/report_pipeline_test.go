@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestReportPipelineOrdering sends the reports of one device in reverse
+// timeslot order to a pool of workers, and checks that every report lands in
+// its own timeslot no matter which worker finishes first.
+func TestReportPipelineOrdering(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{ReportWorkers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const numReports = 40
+	for i := uint32(numReports); i > 0; i-- {
+		if err := sendUDPReport(generateTestReport(ea.ShortID, i, ePriv), server.udpPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := server.staticMetrics
+	for i := 0; i < 100 && m.reportsReceived.Load() < numReports; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	reports := server.liveReports(t, ea.ShortID)
+	for i := uint32(1); i <= numReports; i++ {
+		if report := reports[i]; report.Timeslot != i || report.PowerOutput != 5 {
+			t.Errorf("report for timeslot %v was not integrated: %+v", i, report)
+		}
+	}
+	if server.equipmentLastSeen[ea.ShortID] != numReports {
+		t.Error("last seen timeslot went backwards:", server.equipmentLastSeen[ea.ShortID])
+	}
+}
+
+// TestReportPipelineBackpressure stalls the workers and checks that packets
+// beyond the capacity of the queue get dropped and counted, and that the
+// queued packets are processed once the workers catch up.
+func TestReportPipelineBackpressure(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{ReportWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	addr := sink.LocalAddr().(*net.UDPAddr)
+
+	// The worker blocks on the mutex while it looks up the key of the
+	// first report it takes off the queue.
+	server.mu.Lock()
+	queued := 0
+	for i := uint32(0); i < reportQueueSize+10; i++ {
+		if server.queueReportPacket(reportPacket{conn: sink, addr: addr, data: generateTestReport(ea.ShortID, i, ePriv)}) {
+			queued++
+		}
+	}
+	server.mu.Unlock()
+	m := server.staticMetrics
+	if queued < reportQueueSize || queued > reportQueueSize+1 {
+		t.Fatal("unexpected number of queued packets:", queued)
+	}
+	if m.udpQueueFull.Load() != uint64(reportQueueSize+10-queued) {
+		t.Fatal("dropped packets were not counted:", m.udpQueueFull.Load())
+	}
+	for i := 0; i < 100 && m.reportsReceived.Load() < uint64(queued); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.reportsReceived.Load() != uint64(queued) || m.ReportsDuplicate() != 0 {
+		t.Fatal("queued packets were not processed:", m.reportsReceived.Load())
+	}
+
+	// A negative number of workers is refused.
+	_, _, _, _, err = SetupTestEnvironmentWithOptions(t.Name()+"-bad", ServerOptions{ReportWorkers: -1})
+	if err == nil {
+		t.Error("expected an error for a negative number of report workers")
+	}
+}
+
+// BenchmarkReportPipeline measures the throughput of the report workers on
+// valid reports from many devices. Apart from the journal write, all of the
+// work happens outside of the mutex, so the time per report should drop close
+// to linearly with the number of workers, as long as there are enough CPUs.
+func BenchmarkReportPipeline(b *testing.B) {
+	for _, workers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("Workers%d", workers), func(b *testing.B) {
+			server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(b.Name(), ServerOptions{ReportWorkers: workers})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer server.Close()
+			sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer sink.Close()
+			addr := sink.LocalAddr().(*net.UDPAddr)
+
+			// Every device can fill 865 timeslots around the current
+			// timeslot, so the reports get spread across devices.
+			glow.SetCurrentTimeslot(432)
+			defer glow.SetCurrentTimeslot(0)
+			const perDevice = 800
+			packets := make([]reportPacket, 0, b.N)
+			for shortID := uint32(1); len(packets) < b.N; shortID++ {
+				_, ePriv, err := server.AuthorizeTestDevice(shortID, gcaPrivKey)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for ts := uint32(0); ts < perDevice && len(packets) < b.N; ts++ {
+					packets = append(packets, reportPacket{conn: sink, addr: addr, data: generateTestReport(shortID, ts, ePriv)})
+				}
+			}
+
+			b.ResetTimer()
+			for _, pkt := range packets {
+				server.pendingReportPackets.Add(1)
+				server.staticReportQueue <- pkt
+			}
+			m := server.staticMetrics
+			for m.reportsReceived.Load() < uint64(b.N) {
+				time.Sleep(100 * time.Microsecond)
+			}
+			b.StopTimer()
+			if m.ReportsRejected(reportStale) != 0 || m.ReportsRejected(reportBadSignature) != 0 {
+				b.Fatal("reports were rejected")
+			}
+		})
+	}
+}
+
+// BenchmarkReportIngestion measures the allocations of the whole ingestion
+// path of a report that gets accepted, from the read of the UDP listener to
+// the ack that the device receives. Every report is sent only once its
+// predecessor was acked, so that none of them get dropped.
+//
+// Before the listener pooled its buffers and the signatures stopped parsing
+// their keys for every report:
+//
+//	BenchmarkReportIngestion	5000	239399 ns/op	3501 B/op	47 allocs/op
+//
+// After:
+//
+//	BenchmarkReportIngestion	5000	155241 ns/op	2107 B/op	17 allocs/op
+func BenchmarkReportIngestion(b *testing.B) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(b.Name(), ServerOptions{ReportWorkers: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(432)
+	defer glow.SetCurrentTimeslot(0)
+	const perDevice = 800
+	reports := make([][]byte, 0, b.N)
+	for shortID := uint32(1000); len(reports) < b.N; shortID++ {
+		_, ePriv, err := server.AuthorizeTestDevice(shortID, gcaPrivKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for ts := uint32(0); ts < perDevice && len(reports) < b.N; ts++ {
+			reports = append(reports, generateTestReport(shortID, ts, ePriv))
+		}
+	}
+	conn, err := net.Dial("udp", server.udpDialAddr())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	ack := make([]byte, glow.ReportAckSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, report := range reports {
+		if _, err := conn.Write(report); err != nil {
+			b.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(ack); err != nil {
+			b.Fatal(err)
+		}
+		if ack[8] != glow.ReportAckAccepted {
+			b.Fatal("the report was not accepted:", ack[8])
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+// report_rate_limit.go protects the UDP listener from devices that flood it
+// with reports. Verifying the signature of a report is by far the most
+// expensive part of handling it, so the budget of each packet is checked
+// before anything else happens, and packets over budget are dropped without
+// being verified, logged, or acked.
+//
+// Every known ShortID gets its own budget. Packets for ShortIDs that the server
+// doesn't know all share a single budget, which keeps a flood of random
+// ShortIDs from getting any further than a flood from a single device.
+//
+// The budgets are implemented with the generic cell rate algorithm, which
+// reduces a token bucket to a single timestamp that can be updated with a
+// compare and swap. Looking up the bucket of a device goes through a sync.Map,
+// so the limiter never takes a lock on the packet path and never touches the
+// server mutex.
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateBucket is a lock-free token bucket. tat is the theoretical arrival time
+// of the next packet in unix nanoseconds: the bucket is full whenever tat is
+// in the past, and every allowed packet pushes tat one interval further out.
+type rateBucket struct {
+	tat atomic.Int64
+}
+
+// allow returns whether a packet that arrives at 'now' fits in the budget. A
+// bucket refills one packet per interval and holds at most burst packets.
+func (b *rateBucket) allow(now int64, interval int64, burst int64) bool {
+	tolerance := interval * (burst - 1)
+	for {
+		old := b.tat.Load()
+		tat := old
+		if tat < now {
+			tat = now
+		}
+		if tat-now > tolerance {
+			return false
+		}
+		if b.tat.CompareAndSwap(old, tat+interval) {
+			return true
+		}
+	}
+}
+
+// reportLimiter holds the budgets of all devices. The limits are atomics so
+// that Reload can change them while packets are arriving.
+type reportLimiter struct {
+	devices sync.Map // uint32 -> *rateBucket
+	unknown rateBucket
+
+	deviceInterval  atomic.Int64
+	deviceBurst     atomic.Int64
+	unknownInterval atomic.Int64
+	unknownBurst    atomic.Int64
+}
+
+// newReportLimiter returns a limiter that gives each device a budget of burst
+// packets refilling once per interval, and gives unknown devices one shared
+// budget.
+func newReportLimiter(deviceInterval time.Duration, deviceBurst int64, unknownInterval time.Duration, unknownBurst int64) *reportLimiter {
+	rl := new(reportLimiter)
+	rl.setLimits(deviceInterval, deviceBurst, unknownInterval, unknownBurst)
+	return rl
+}
+
+// setLimits changes the limits of the budgets. The budgets keep their current
+// state, so a device that was over budget doesn't get a fresh burst.
+func (rl *reportLimiter) setLimits(deviceInterval time.Duration, deviceBurst int64, unknownInterval time.Duration, unknownBurst int64) {
+	rl.deviceInterval.Store(int64(deviceInterval))
+	rl.deviceBurst.Store(deviceBurst)
+	rl.unknownInterval.Store(int64(unknownInterval))
+	rl.unknownBurst.Store(unknownBurst)
+}
+
+// limits returns the limits of the budgets.
+func (rl *reportLimiter) limits() (deviceInterval time.Duration, deviceBurst int64, unknownInterval time.Duration, unknownBurst int64) {
+	return time.Duration(rl.deviceInterval.Load()), rl.deviceBurst.Load(), time.Duration(rl.unknownInterval.Load()), rl.unknownBurst.Load()
+}
+
+// addDevice gives a device its own budget. Adding a device that already has a
+// budget keeps the existing one.
+func (rl *reportLimiter) addDevice(shortID uint32) {
+	rl.devices.LoadOrStore(shortID, new(rateBucket))
+}
+
+// removeDevice moves a device back to the shared budget of unknown devices.
+func (rl *reportLimiter) removeDevice(shortID uint32) {
+	rl.devices.Delete(shortID)
+}
+
+// allow returns whether a packet from the provided ShortID fits in the budget,
+// and whether the ShortID belongs to a known device.
+func (rl *reportLimiter) allow(shortID uint32, now time.Time) (allowed bool, known bool) {
+	b, known := rl.devices.Load(shortID)
+	if !known {
+		return rl.unknown.allow(now.UnixNano(), rl.unknownInterval.Load(), rl.unknownBurst.Load()), false
+	}
+	return b.(*rateBucket).allow(now.UnixNano(), rl.deviceInterval.Load(), rl.deviceBurst.Load()), true
+}
+
+// allowReportPacket checks the budget of the device that sent a report packet,
+// recording the drop if the packet is over budget. The caller has already
+// checked that the packet has the size of a report, packets that are too short
+// to hold a ShortID are refused regardless.
+func (server *GCAServer) allowReportPacket(rawData []byte, now time.Time) bool {
+	if len(rawData) < 4 {
+		return false
+	}
+	shortID := binary.LittleEndian.Uint32(rawData[0:4])
+	allowed, known := server.staticReportLimiter.allow(shortID, now)
+	if !allowed {
+		server.staticMetrics.RecordRateLimited(known)
+	}
+	return allowed
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestRateBucket checks the burst and the refill of a bucket.
+func TestRateBucket(t *testing.T) {
+	var b rateBucket
+	start := time.Now().UnixNano()
+	interval := int64(time.Second)
+	for i := 0; i < 3; i++ {
+		if !b.allow(start, interval, 3) {
+			t.Fatal("burst was denied at packet", i)
+		}
+	}
+	if b.allow(start, interval, 3) {
+		t.Fatal("packet beyond the burst was allowed")
+	}
+	// One packet worth of budget comes back every interval.
+	if !b.allow(start+interval, interval, 3) || b.allow(start+interval, interval, 3) {
+		t.Fatal("bucket did not refill one packet per interval")
+	}
+	// A long quiet period refills the bucket, but never beyond the burst.
+	later := start + 100*interval
+	for i := 0; i < 3; i++ {
+		if !b.allow(later, interval, 3) {
+			t.Fatal("refilled burst was denied at packet", i)
+		}
+	}
+	if b.allow(later, interval, 3) {
+		t.Fatal("bucket refilled beyond its burst")
+	}
+}
+
+// TestRateBucketConcurrent checks that concurrent callers can't get more than
+// the burst out of a bucket between them.
+func TestRateBucketConcurrent(t *testing.T) {
+	var b rateBucket
+	now := time.Now().UnixNano()
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if b.allow(now, int64(time.Hour), 100) {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed.Load() != 100 {
+		t.Fatalf("expected 100 packets to be allowed, got %v", allowed.Load())
+	}
+}
+
+// TestReportLimiter checks that known devices have their own budgets and that
+// unknown devices share one.
+func TestReportLimiter(t *testing.T) {
+	rl := newReportLimiter(time.Hour, 2, time.Hour, 1)
+	rl.addDevice(1)
+	rl.addDevice(2)
+	now := time.Now()
+	for _, shortID := range []uint32{1, 1, 2, 2} {
+		if allowed, known := rl.allow(shortID, now); !allowed || !known {
+			t.Fatal("known device was limited early:", shortID)
+		}
+	}
+	if allowed, _ := rl.allow(1, now); allowed {
+		t.Error("device 1 exceeded its budget")
+	}
+
+	// Unknown devices share a budget, no matter the ShortID.
+	if allowed, known := rl.allow(7, now); !allowed || known {
+		t.Error("first unknown packet was not allowed")
+	}
+	if allowed, _ := rl.allow(8, now); allowed {
+		t.Error("second unknown packet was allowed")
+	}
+
+	// Adding a device again keeps its spent budget, removing it moves it
+	// to the shared budget.
+	rl.addDevice(1)
+	if allowed, _ := rl.allow(1, now); allowed {
+		t.Error("re-adding a device reset its budget")
+	}
+	rl.removeDevice(2)
+	if _, known := rl.allow(2, now); known {
+		t.Error("removed device is still known")
+	}
+}
+
+// TestUDPRateLimit sends more reports than a device's budget over UDP and
+// checks that the excess gets dropped before verification and counted.
+func TestUDPRateLimit(t *testing.T) {
+	opts := DefaultServerOptions()
+	opts.DeviceReportInterval, opts.DeviceReportBurst = time.Hour, 2
+	opts.UnknownReportInterval, opts.UnknownReportBurst = time.Hour, 1
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint32(0); i < 5; i++ {
+		if err := sendUDPReport(generateTestReport(ea.ShortID, i, ePriv), server.udpPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := uint32(0); i < 3; i++ {
+		if err := sendUDPReport(generateTestReport(100+i, 1, ePriv), server.udpPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := server.staticMetrics
+	for i := 0; i < 100 && (m.udpLimitedDevice.Load() < 3 || m.udpLimitedUnknown.Load() < 2 || m.reportsReceived.Load() < 3); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if m.udpLimitedDevice.Load() != 3 || m.udpLimitedUnknown.Load() != 2 {
+		t.Fatalf("unexpected drops: known %v unknown %v", m.udpLimitedDevice.Load(), m.udpLimitedUnknown.Load())
+	}
+	// Only the packets within budget reached the report handling.
+	if m.reportsReceived.Load() != 3 || m.ReportsRejected(reportUnknownDevice) != 1 {
+		t.Fatalf("unexpected reports: received %v unknown %v", m.reportsReceived.Load(), m.ReportsRejected(reportUnknownDevice))
+	}
+
+	body, err := server.getMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{"udp_packets_rate_limited_total{device=\"known\"} 3\n", "udp_packets_rate_limited_total{device=\"unknown\"} 2\n"} {
+		if !strings.Contains(body, e) {
+			t.Errorf("metrics output is missing %q", e)
+		}
+	}
+}
+
+// BenchmarkUDPSpam feeds a flood of badly signed reports from one device into
+// the report handling path, 10k packets per simulated second. With the limiter
+// only the budget of the device gets verified, so the cost per packet stays
+// flat, without it every packet pays for a signature verification.
+func BenchmarkUDPSpam(b *testing.B) {
+	run := func(b *testing.B, limited bool) {
+		opts := DefaultServerOptions()
+		opts.DeviceReportInterval, opts.DeviceReportBurst = 150*time.Second, 432
+		opts.UnknownReportInterval, opts.UnknownReportBurst = 10*time.Millisecond, 100
+		server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(b.Name(), opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer server.Close()
+		ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, wrongKey := glow.GenerateKeyPair()
+		packet := generateTestReport(ea.ShortID, 1, wrongKey)
+		start := time.Now()
+		verified := 0
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			now := start.Add(time.Duration(i) * 100 * time.Microsecond)
+			if limited && !server.allowReportPacket(packet, now) {
+				continue
+			}
+			server.managedHandleEquipmentReport(packet)
+			verified++
+		}
+		b.ReportMetric(float64(verified)/float64(b.N), "verified/op")
+	}
+	b.Run("Limited", func(b *testing.B) { run(b, true) })
+	b.Run("Unlimited", func(b *testing.B) { run(b, false) })
+}
@@ -0,0 +1,232 @@
+package server
+
+// report_receipts.go records when the server received every report that it
+// accepted. The timeslot of a report says which five minutes it covers, not
+// when the device sent it, and a device that was offline for a while sends
+// its backlog late. The receipts tell the two apart, so that the late reports
+// can be found, see the late_only filter of api_historical_reports.go.
+//
+// A receipt is the number of seconds between the start of the timeslot of the
+// report and the moment that the server accepted it, which fits in 4 bytes.
+// A report that arrived at or before the start of its timeslot is recorded as
+// 1 second in, as 0 means that there is no receipt. The receipt of a report
+// that the server got from another server is the time that this server got
+// it. Flagged reports that the GCA accepted after a review have no receipt.
+//
+// Every device has an array of receipts in memory for the reporting window,
+// and the receipts are appended to a log like the heartbeats are, see
+// heartbeats.go, which is rewritten when the reports rotate. A record is the
+// ShortID, the timeslot, the receipt and a checksum, 16 bytes next to the 80
+// bytes of the report in the reports file and the 88 bytes of its record in
+// the journal. Before a week leaves the window, its receipts are written next
+// to its archive, see report_archive.go, so that the receipts of archived
+// weeks can still be served. A server that runs with DisableReportReceipts
+// doesn't record, load or archive any receipts, and the endpoints leave the
+// receipts out.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// receiptRecordSize is the size of a record in the receipts log and in the
+// receipts of an archived week, which is the ShortID, the timeslot, the
+// receipt and a checksum.
+const receiptRecordSize = 4 + 4 + 4 + 4
+
+// reportReceipts holds the receipt of every timeslot in memory for a device,
+// starting at the reports offset. 0 means that there is no receipt.
+type reportReceipts [4032]uint32
+
+// shift moves the second week into the first one and blanks out the second
+// week, for when the reports rotate.
+func (rr *reportReceipts) shift() {
+	copy(rr[:2016], rr[2016:])
+	clear(rr[2016:])
+}
+
+// receiptOffset returns the receipt of a report for the provided timeslot
+// that was received at the provided time.
+func receiptOffset(timeslot uint32, received time.Time) uint32 {
+	offset := received.Unix() - glow.TimeslotToUnix(timeslot)
+	if offset < 1 {
+		return 1
+	}
+	if offset > 1<<32-1 {
+		return 1<<32 - 1
+	}
+	return uint32(offset)
+}
+
+// encodeReceiptRecord returns the record of a receipt.
+func encodeReceiptRecord(shortID uint32, timeslot uint32, offset uint32) []byte {
+	record := make([]byte, receiptRecordSize)
+	binary.LittleEndian.PutUint32(record[0:], shortID)
+	binary.LittleEndian.PutUint32(record[4:], timeslot)
+	binary.LittleEndian.PutUint32(record[8:], offset)
+	binary.LittleEndian.PutUint32(record[12:], crc32.ChecksumIEEE(record[:12]))
+	return record
+}
+
+// decodeReceiptRecord returns the receipt of a record that passed its
+// checksum.
+func decodeReceiptRecord(record []byte) (shortID uint32, timeslot uint32, offset uint32) {
+	return binary.LittleEndian.Uint32(record[0:]), binary.LittleEndian.Uint32(record[4:]), binary.LittleEndian.Uint32(record[8:])
+}
+
+// setReceipt puts a receipt into memory. Receipts for timeslots that are no
+// longer in memory are skipped. The mutex must be held.
+func (gcas *GCAServer) setReceipt(shortID uint32, timeslot uint32, offset uint32) {
+	if timeslot < gcas.equipmentReportsOffset || timeslot >= gcas.equipmentReportsOffset+4032 {
+		return
+	}
+	rr := gcas.reportReceipts[shortID]
+	if rr == nil {
+		rr = new(reportReceipts)
+		gcas.reportReceipts[shortID] = rr
+	}
+	rr[timeslot-gcas.equipmentReportsOffset] = offset
+}
+
+// recordReceipt records that a report was just accepted. A receipt that
+// didn't make it into the log is only missing after a restart, so the report
+// is still accepted. The mutex must be held.
+func (gcas *GCAServer) recordReceipt(report glow.EquipmentReport) {
+	if !gcas.staticRecordReceipts {
+		return
+	}
+	offset := receiptOffset(report.Timeslot, gcas.now())
+	gcas.setReceipt(report.ShortID, report.Timeslot, offset)
+	if _, err := gcas.receiptsLog.Write(encodeReceiptRecord(report.ShortID, report.Timeslot, offset)); err != nil {
+		gcas.logger.Errorf("unable to write to the receipts log: %v", err)
+	}
+}
+
+// receivedAt returns the unix time at which the report of a device for a
+// timeslot in the reporting window was received, 0 if there is no signed
+// report or no receipt for it. The mutex must be held.
+func (gcas *GCAServer) receivedAt(shortID uint32, timeslot uint32) int64 {
+	if timeslot < gcas.equipmentReportsOffset || timeslot >= gcas.equipmentReportsOffset+4032 {
+		return 0
+	}
+	i := int(timeslot - gcas.equipmentReportsOffset)
+	rr := gcas.reportReceipts[shortID]
+	dr, exists := gcas.windowReports(shortID)
+	if rr == nil || rr[i] == 0 || !exists || !dr.signed(i) {
+		return 0
+	}
+	return glow.TimeslotToUnix(timeslot) + int64(rr[i])
+}
+
+// reportLate returns whether a report for the provided timeslot that was
+// received at the provided unix time arrived more than the late threshold
+// after the end of its timeslot. A report without a receipt isn't late.
+func (gcas *GCAServer) reportLate(timeslot uint32, receivedAt int64) bool {
+	if receivedAt == 0 {
+		return false
+	}
+	return receivedAt > glow.TimeslotToUnix(timeslot+1+gcas.staticLateReportThreshold)
+}
+
+// loadReportReceipts replays the receipts log, and opens it so that new
+// records can be appended to it. Records for devices without reports in the
+// window and for timeslots that are no longer in memory are skipped.
+func (gcas *GCAServer) loadReportReceipts() error {
+	if !gcas.staticRecordReceipts {
+		return nil
+	}
+	l, err := gcas.loadAppendLog(ReportReceiptsFile, "receipts log", receiptRecordSize, func(record []byte) {
+		shortID, timeslot, offset := decodeReceiptRecord(record)
+		if _, exists := gcas.windowReports(shortID); exists {
+			gcas.setReceipt(shortID, timeslot, offset)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	gcas.receiptsLog = l
+	return nil
+}
+
+// compactReportReceipts shifts the receipts along with the reports and
+// rewrites the receipts log with the receipts that are still in memory. It
+// gets called after the reports rotate. The mutex must be held.
+func (gcas *GCAServer) compactReportReceipts() error {
+	if !gcas.staticRecordReceipts {
+		return nil
+	}
+	var data []byte
+	for shortID, rr := range gcas.reportReceipts {
+		rr.shift()
+		for i := 0; i < 2016; i++ {
+			if rr[i] != 0 {
+				data = append(data, encodeReceiptRecord(shortID, gcas.equipmentReportsOffset+uint32(i), rr[i])...)
+			}
+		}
+	}
+	return gcas.receiptsLog.rewrite(data)
+}
+
+// reportReceiptsFile returns the name of the receipts of the archived week
+// that starts at periodStart.
+func reportReceiptsFile(periodStart uint32) string {
+	return path.Join(ReportArchiveDir, fmt.Sprintf("receipts-%v.dat", periodStart))
+}
+
+// archiveOldestReceipts writes the receipts of the signed reports of the
+// oldest week in the reporting window next to its archive. Receipts that
+// already exist are left alone. The mutex must be held.
+func (gcas *GCAServer) archiveOldestReceipts() error {
+	if !gcas.staticRecordReceipts {
+		return nil
+	}
+	periodStart := gcas.equipmentReportsOffset
+	name := reportReceiptsFile(periodStart)
+	if _, err := gcas.staticStorage.Stat(name); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("unable to check for existing receipts: %v", err)
+	}
+	var data []byte
+	for shortID, rr := range gcas.reportReceipts {
+		for i := 0; i < 2016; i++ {
+			if at := gcas.receivedAt(shortID, periodStart+uint32(i)); at != 0 {
+				data = append(data, encodeReceiptRecord(shortID, periodStart+uint32(i), rr[i])...)
+			}
+		}
+	}
+	if err := gcas.staticStorage.WriteFile(name, data, 0444); err != nil {
+		return fmt.Errorf("unable to write receipts: %v", err)
+	}
+	return nil
+}
+
+// loadArchivedReceipts returns the unix time at which every report of a
+// device in the archived week that starts at periodStart was received, by
+// timeslot. A week without receipts returns an empty map.
+func (gcas *GCAServer) loadArchivedReceipts(periodStart uint32, shortID uint32) (map[uint32]int64, error) {
+	receipts := make(map[uint32]int64)
+	if !gcas.staticRecordReceipts {
+		return receipts, nil
+	}
+	data, err := gcas.staticStorage.ReadFile(reportReceiptsFile(periodStart))
+	if os.IsNotExist(err) {
+		return receipts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the receipts of period %v: %v", periodStart, err)
+	}
+	decodeLogRecords(data, receiptRecordSize, func(record []byte) {
+		id, timeslot, offset := decodeReceiptRecord(record)
+		if id == shortID && timeslot >= periodStart && timeslot < periodStart+2016 {
+			receipts[timeslot] = glow.TimeslotToUnix(timeslot) + int64(offset)
+		}
+	})
+	return receipts, nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server/clock/clocktest"
+)
+
+// TestReportReceipts checks that the server records when it received every
+// report, that the receipts show up on the report endpoints and survive a
+// restart and an archive, and that the late_only filter returns the reports
+// that arrived late.
+func TestReportReceipts(t *testing.T) {
+	received := glow.TimeslotToUnix(10) + 100
+	c := clocktest.NewManual(time.Unix(received, 0))
+	opts := DefaultServerOptions()
+	opts.Clock = c
+	opts.LateReportThreshold = 2
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WaitForSleep(ReportMigrationFrequency)
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := hex.EncodeToString(ea.PublicKey[:])
+	// The report for timeslot 9 arrives 100 seconds after the end of the
+	// timeslot, the one for timeslot 2 arrives 7 timeslots late.
+	for _, ts := range []uint32{9, 2} {
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, ts, ePriv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+
+	get := func(uri string, binary bool) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://"+server.httpDialAddr()+uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary {
+			req.Header.Set("Accept", glow.BinaryContentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+	historical := fmt.Sprintf("/api/v1/historical-reports?pubkey=%v&start=%v&end=%v", pubkey, glow.TimeslotToUnix(0), glow.TimeslotToUnix(20))
+	checkHistorical := func(suffix string, want string) {
+		t.Helper()
+		for _, binary := range []bool{false, true} {
+			status, body := get(historical+suffix, binary)
+			var hr HistoricalReportsResponse
+			if binary {
+				err = hr.UnmarshalBinary(body)
+			} else {
+				err = json.Unmarshal(body, &hr)
+			}
+			if status != http.StatusOK || err != nil {
+				t.Fatal("unable to fetch the historical reports:", status, err, string(body))
+			}
+			var got string
+			for _, report := range hr.Reports {
+				got += fmt.Sprintf("%v@%v ", report.Timeslot, report.ReceivedAt-received)
+			}
+			if got != want {
+				t.Fatalf("unexpected reports with binary %v: %v", binary, got)
+			}
+		}
+	}
+	checkReceipts := func() {
+		t.Helper()
+		checkHistorical("", "2@0 9@0 ")
+		checkHistorical("&late_only=true", "2@0 ")
+
+		status, body := get("/api/v1/recent-reports?publicKey="+pubkey, false)
+		var rrr RecentReportsResponse
+		if err := json.Unmarshal(body, &rrr); status != http.StatusOK || err != nil {
+			t.Fatal("unable to fetch the recent reports:", status, err)
+		}
+		if rrr.ReportTimes[9].ReceivedAt != received || rrr.ReportTimes[3].ReceivedAt != 0 {
+			t.Fatalf("unexpected report times: %+v %+v", rrr.ReportTimes[9], rrr.ReportTimes[3])
+		}
+
+		status, body = get("/api/v1/equipment-reports.csv?pubkey="+pubkey+"&start=0&end=10", false)
+		rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+		if status != http.StatusOK || err != nil || len(rows) != 11 || rows[0][4] != "received_at" {
+			t.Fatal("unexpected csv:", status, err, string(body))
+		}
+		if rows[10][4] != fmt.Sprint(received) || rows[4][4] != "" {
+			t.Fatalf("unexpected receipts in the csv: %v %v", rows[10], rows[4])
+		}
+	}
+	checkReceipts()
+
+	// The receipts survive a restart.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	c.WaitForSleep(ReportMigrationFrequency)
+	checkReceipts()
+
+	// Once the week is archived, its receipts come from the archive and
+	// the log only keeps the receipts that are still in memory.
+	c.Set(time.Unix(glow.TimeslotToUnix(3300), 0))
+	c.WaitForSleep(ReportMigrationFrequency)
+	server.mu.RLock()
+	ero := server.equipmentReportsOffset
+	server.mu.RUnlock()
+	if ero != 2016 {
+		t.Fatal("the reports were not migrated:", ero)
+	}
+	checkHistorical("", "2@0 9@0 ")
+	checkHistorical("&late_only=true", "2@0 ")
+	if data, err := server.staticStorage.ReadFile(ReportReceiptsFile); err != nil || len(data) != 0 {
+		t.Fatal("the receipts log wasn't compacted:", len(data), err)
+	}
+}
+
+// TestReportReceiptsDisabled checks that a server that doesn't record the
+// receipts leaves them out and refuses the late_only filter.
+func TestReportReceiptsDisabled(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{DisableReportReceipts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(20)
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, 5, ePriv)); outcome != reportAccepted {
+		t.Fatal("report was not accepted:", outcome)
+	}
+	if _, err := server.staticStorage.Stat(ReportReceiptsFile); err == nil {
+		t.Fatal("the receipts log was created")
+	}
+
+	uri := fmt.Sprintf("http://%v/api/v1/historical-reports?pubkey=%x&start=%v&end=%v", server.httpDialAddr(), ea.PublicKey, glow.TimeslotToUnix(0), glow.TimeslotToUnix(20))
+	resp, err := http.Get(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hr HistoricalReportsResponse
+	err = json.NewDecoder(resp.Body).Decode(&hr)
+	resp.Body.Close()
+	if err != nil || len(hr.Reports) != 1 || hr.Reports[0].ReceivedAt != 0 {
+		t.Fatalf("unexpected reports: %v %+v", err, hr.Reports)
+	}
+	resp, err = http.Get(uri + "&late_only=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("the late_only filter was accepted:", resp.StatusCode)
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+// report_roots.go commits the server to the set of reports that it accepted
+// for every week. When a reports migration discards the oldest week, the
+// server builds a Merkle tree over the signed reports of the week, signs the
+// root with the server key, and appends it to the report roots file. A
+// published root can't be changed later, so the stats that the server
+// publishes for a week can be checked against a fixed set of reports.
+//
+// The leaves are the canonical encodings from glow/report_merkle.go, in the
+// same order as the report archive: by ShortID and then by timeslot. Proofs
+// are built from the archive of the week, which holds exactly the reports
+// that the root was computed over.
+//
+// Each entry of the report roots file has a fixed size:
+//
+//	period start (4 bytes)
+//	number of reports (4 bytes)
+//	root (32 bytes)
+//	signature of the server (64 bytes)
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// reportRootSize is the size of a serialized ReportRoot.
+const reportRootSize = 4 + 4 + 32 + 64
+
+// ReportRoot is the signed commitment of the server to the reports of the
+// week that starts at PeriodStart.
+type ReportRoot struct {
+	PeriodStart uint32
+	NumReports  uint32
+	Root        [32]byte
+	Signature   glow.Signature
+}
+
+// SigningBytes returns the bytes that the server signs for the root, see
+// glow.ReportRootSigningBytes.
+func (rr ReportRoot) SigningBytes() []byte {
+	return glow.ReportRootSigningBytes(rr.PeriodStart, rr.NumReports, rr.Root)
+}
+
+// Serialize returns the fixed size encoding of the root.
+func (rr ReportRoot) Serialize() []byte {
+	b := make([]byte, reportRootSize)
+	binary.LittleEndian.PutUint32(b[0:], rr.PeriodStart)
+	binary.LittleEndian.PutUint32(b[4:], rr.NumReports)
+	copy(b[8:], rr.Root[:])
+	copy(b[40:], rr.Signature[:])
+	return b
+}
+
+// DeserializeReportRoot reverses a call to Serialize.
+func DeserializeReportRoot(b []byte) (ReportRoot, error) {
+	var rr ReportRoot
+	if len(b) != reportRootSize {
+		return rr, fmt.Errorf("report root has length %v, expected %v", len(b), reportRootSize)
+	}
+	rr.PeriodStart = binary.LittleEndian.Uint32(b[0:])
+	rr.NumReports = binary.LittleEndian.Uint32(b[4:])
+	copy(rr.Root[:], b[8:40])
+	copy(rr.Signature[:], b[40:])
+	return rr, nil
+}
+
+// ReportRootResponse is the JSON form of a ReportRoot.
+type ReportRootResponse struct {
+	PeriodStart uint32 `json:"period_start"`
+	NumReports  uint32 `json:"num_reports"`
+	Root        string `json:"root"`
+	Signature   string `json:"signature"`
+}
+
+// ReportProofResponse contains the proof that a report is part of the root
+// of its week. Verify it with glow.VerifyReportProof, using the leaf, the
+// index, the number of reports of the root, and the proof.
+type ReportProofResponse struct {
+	Root   ReportRootResponse `json:"root"`
+	Leaf   string             `json:"leaf"`
+	Index  uint32             `json:"index"`
+	Proof  []string           `json:"proof"`
+	Report HistoricalReport   `json:"report"`
+}
+
+// reportRootResponse converts a root to its JSON form.
+func reportRootResponse(rr ReportRoot) ReportRootResponse {
+	return ReportRootResponse{
+		PeriodStart: rr.PeriodStart,
+		NumReports:  rr.NumReports,
+		Root:        hex.EncodeToString(rr.Root[:]),
+		Signature:   hex.EncodeToString(rr.Signature[:]),
+	}
+}
+
+// reportLeaves returns the leaves of the tree over the reports of an
+// archive.
+func reportLeaves(ra ReportArchive) [][]byte {
+	var leaves [][]byte
+	for _, device := range ra.Devices {
+		for _, report := range device.Reports {
+			leaves = append(leaves, glow.ReportLeaf(device.PublicKey, report))
+		}
+	}
+	return leaves
+}
+
+// commitOldestReports signs and saves the root of the oldest week in the
+// reporting window. A week that already has a root is left alone. The mutex
+// must be held.
+func (gcas *GCAServer) commitOldestReports() error {
+	periodStart := gcas.equipmentReportsOffset
+	for _, rr := range gcas.reportRoots {
+		if rr.PeriodStart == periodStart {
+			return nil
+		}
+	}
+	ra, err := gcas.buildReportArchive()
+	if err != nil {
+		return fmt.Errorf("unable to collect the reports: %v", err)
+	}
+	leaves := reportLeaves(ra)
+	rr := ReportRoot{
+		PeriodStart: periodStart,
+		NumReports:  uint32(len(leaves)),
+		Root:        glow.ReportMerkleRoot(leaves),
+	}
+	rr.Signature = glow.Sign(rr.SigningBytes(), gcas.staticPrivateKey)
+	if err := gcas.staticStorage.AppendFile(ReportRootsFile, rr.Serialize(), 0644); err != nil {
+		return fmt.Errorf("unable to save report root: %v", err)
+	}
+	gcas.reportRoots = append(gcas.reportRoots, rr)
+	return nil
+}
+
+// loadReportRoots loads the report roots from disk, creating the file if it
+// does not exist yet.
+func (gcas *GCAServer) loadReportRoots() error {
+	data, err := gcas.staticStorage.ReadFile(ReportRootsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(ReportRootsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read report roots: %v", err)
+	}
+	if len(data)%reportRootSize != 0 {
+		return fmt.Errorf("report roots file has unexpected length %v", len(data))
+	}
+	gcas.reportRoots = nil
+	for i := 0; i < len(data); i += reportRootSize {
+		rr, err := DeserializeReportRoot(data[i : i+reportRootSize])
+		if err != nil {
+			return err
+		}
+		if !glow.Verify(gcas.staticPublicKey, rr.SigningBytes(), rr.Signature) {
+			return fmt.Errorf("report root for period %v has an invalid signature", rr.PeriodStart)
+		}
+		gcas.reportRoots = append(gcas.reportRoots, rr)
+	}
+	return nil
+}
+
+// ReportRootsHandler returns the signed root of every week that the server
+// has committed to, oldest first.
+func (gcas *GCAServer) ReportRootsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for report roots.")
+		return
+	}
+
+	gcas.mu.RLock()
+	roots := make([]ReportRootResponse, 0, len(gcas.reportRoots))
+	for _, rr := range gcas.reportRoots {
+		roots = append(roots, reportRootResponse(rr))
+	}
+	gcas.mu.RUnlock()
+	gcas.writeJSONResponse(w, r, roots)
+}
+
+// ReportProofHandler returns the proof that the report of the device with the
+// provided 'pubkey' for the provided 'timeslot' is part of the root of its
+// week.
+func (gcas *GCAServer) ReportProofHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for a report proof.")
+		return
+	}
+
+	q := r.URL.Query()
+	publicKeyStr := q.Get("pubkey")
+	if publicKeyStr == "" {
+		gcas.writeError(w, ErrCodeMalformedRequest, "pubkey is a required query parameter")
+		return
+	}
+	publicKey, err := glow.ParsePublicKey(publicKeyStr)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "Invalid public key format")
+		return
+	}
+	timeslot64, err := strconv.ParseUint(q.Get("timeslot"), 10, 32)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, "timeslot must be a timeslot number")
+		return
+	}
+	timeslot := uint32(timeslot64)
+
+	// Find the root of the week that holds the timeslot.
+	gcas.mu.RLock()
+	var rr ReportRoot
+	found := false
+	for _, root := range gcas.reportRoots {
+		if timeslot >= root.PeriodStart && timeslot < root.PeriodStart+2016 {
+			rr = root
+			found = true
+		}
+	}
+	gcas.mu.RUnlock()
+	if !found {
+		gcas.writeError(w, ErrCodeNotFound, "no report root covers the timeslot")
+		return
+	}
+
+	// Rebuild the tree from the archive of the week.
+	ra, err := gcas.loadReportArchive(rr.PeriodStart)
+	if err != nil {
+		gcas.writeError(w, ErrCodeInternalError, "the reports of the week are unavailable")
+		gcas.requestLogger(r).Errorf("unable to load the archive for period %v: %v", rr.PeriodStart, err)
+		return
+	}
+	leaves := reportLeaves(ra)
+	if uint32(len(leaves)) != rr.NumReports || glow.ReportMerkleRoot(leaves) != rr.Root {
+		gcas.writeError(w, ErrCodeInternalError, "the reports of the week do not match the root")
+		gcas.requestLogger(r).Errorf("the archive for period %v does not match its root", rr.PeriodStart)
+		return
+	}
+	// Find the leaf of the report.
+	index := -1
+	var report HistoricalReport
+	i := 0
+	for _, device := range ra.Devices {
+		for _, er := range device.Reports {
+			if device.PublicKey == publicKey && er.Timeslot == timeslot {
+				index = i
+				report = HistoricalReport{
+					ShortID:     er.ShortID,
+					Timeslot:    er.Timeslot,
+					Timestamp:   glow.TimeslotToUnix(er.Timeslot),
+					PowerOutput: er.PowerOutput,
+					Signature:   hex.EncodeToString(er.Signature[:]),
+				}
+			}
+			i++
+		}
+	}
+	if index < 0 {
+		gcas.writeError(w, ErrCodeNotFound, "no report was committed for the device and timeslot")
+		return
+	}
+	proof, err := glow.ReportMerkleProof(leaves, index)
+	if err != nil {
+		gcas.writeError(w, ErrCodeInternalError, "unable to build the proof")
+		gcas.requestLogger(r).Error("unable to build report proof:", err)
+		return
+	}
+	resp := ReportProofResponse{
+		Root:   reportRootResponse(rr),
+		Leaf:   hex.EncodeToString(leaves[index]),
+		Index:  uint32(index),
+		Proof:  make([]string, 0, len(proof)),
+		Report: report,
+	}
+	for _, hash := range proof {
+		resp.Proof = append(resp.Proof, hex.EncodeToString(hash[:]))
+	}
+	gcas.writeJSONResponse(w, r, resp)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getReportProof fetches the proof for the report of a device in a timeslot.
+func (gcas *GCAServer) getReportProof(pk glow.PublicKey, timeslot uint32) (int, ReportProofResponse, error) {
+	var proof ReportProofResponse
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/report-proof?pubkey=%x&timeslot=%v", gcas.httpPort, pk, timeslot))
+	if err != nil {
+		return 0, proof, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, proof, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(&proof)
+	return resp.StatusCode, proof, err
+}
+
+// verifyReportProofResponse checks a proof the way that a light verifier
+// would, using only the response and the public key of the server.
+func verifyReportProofResponse(serverKey glow.PublicKey, resp ReportProofResponse) error {
+	var rr ReportRoot
+	rr.PeriodStart = resp.Root.PeriodStart
+	rr.NumReports = resp.Root.NumReports
+	root, err := hex.DecodeString(resp.Root.Root)
+	if err != nil || len(root) != 32 {
+		return fmt.Errorf("invalid root")
+	}
+	copy(rr.Root[:], root)
+	sig, err := hex.DecodeString(resp.Root.Signature)
+	if err != nil || len(sig) != 64 {
+		return fmt.Errorf("invalid signature")
+	}
+	copy(rr.Signature[:], sig)
+	if !glow.Verify(serverKey, rr.SigningBytes(), rr.Signature) {
+		return fmt.Errorf("root is not signed by the server")
+	}
+	leaf, err := hex.DecodeString(resp.Leaf)
+	if err != nil {
+		return fmt.Errorf("invalid leaf")
+	}
+	var proof [][32]byte
+	for _, s := range resp.Proof {
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != 32 {
+			return fmt.Errorf("invalid proof")
+		}
+		var hash [32]byte
+		copy(hash[:], b)
+		proof = append(proof, hash)
+	}
+	if !glow.VerifyReportProof(rr.Root, leaf, resp.Index, rr.NumReports, proof) {
+		return fmt.Errorf("proof does not verify")
+	}
+	return nil
+}
+
+// TestReportRoots triggers a reports migration and checks that the server
+// publishes a signed root for the discarded week, hands out proofs that a
+// light verifier accepts, and keeps the root across a restart.
+func TestReportRoots(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer glow.SetCurrentTimeslot(0)
+
+	keys := make(map[uint32]glow.PublicKey)
+	for shortID := uint32(1); shortID <= 3; shortID++ {
+		ea, ePriv, err := server.AuthorizeTestDevice(shortID, gcaPrivKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[shortID] = ea.PublicKey
+		for ts := uint32(0); ts < 5*shortID; ts++ {
+			if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(shortID, ts, ePriv)); outcome != reportAccepted {
+				t.Fatal("report was not accepted:", outcome)
+			}
+		}
+	}
+
+	glow.SetCurrentTimeslot(3300)
+	for i := 0; i < 100; i++ {
+		server.mu.RLock()
+		ero := server.equipmentReportsOffset
+		server.mu.RUnlock()
+		if ero != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	check := func() {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/report-roots", server.httpPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var roots []ReportRootResponse
+		err = json.NewDecoder(resp.Body).Decode(&roots)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roots) != 1 || roots[0].PeriodStart != 0 || roots[0].NumReports != 30 {
+			t.Fatalf("unexpected roots: %+v", roots)
+		}
+		for shortID, pk := range keys {
+			for _, ts := range []uint32{0, 5*shortID - 1} {
+				status, proof, err := server.getReportProof(pk, ts)
+				if err != nil || status != http.StatusOK {
+					t.Fatal("unable to fetch proof:", status, err)
+				}
+				if proof.Root != roots[0] || proof.Report.ShortID != shortID || proof.Report.Timeslot != ts {
+					t.Fatalf("unexpected proof: %+v", proof)
+				}
+				if err := verifyReportProofResponse(server.staticPublicKey, proof); err != nil {
+					t.Fatal(err)
+				}
+				// A proof for a different report does not verify.
+				proof.Leaf = proof.Leaf[:100] + "ff" + proof.Leaf[102:]
+				if err := verifyReportProofResponse(server.staticPublicKey, proof); err == nil {
+					t.Fatal("proof verified for a tampered report")
+				}
+			}
+		}
+		// Timeslots without a report or without a root have no proof.
+		if status, _, _ := server.getReportProof(keys[1], 5); status != http.StatusNotFound {
+			t.Error("unexpected status for a missing report:", status)
+		}
+		if status, _, _ := server.getReportProof(keys[1], 2016); status != http.StatusNotFound {
+			t.Error("unexpected status for a week without a root:", status)
+		}
+	}
+	check()
+
+	// The root survives a restart, and is not recomputed.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	server.equipmentReportsOffset = 0
+	err = server.commitOldestReports()
+	server.equipmentReportsOffset = 2016
+	numRoots := len(server.reportRoots)
+	server.mu.Unlock()
+	if err != nil || numRoots != 1 {
+		t.Fatal("root was committed twice:", numRoots, err)
+	}
+	check()
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A root with an invalid signature stops the server from starting.
+	data, err := serverStorage(dir).ReadFile(ReportRootsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[10] ^= 1
+	if err := serverStorage(dir).WriteFile(ReportRootsFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGCAServer(dir, false); err == nil {
+		t.Fatal("server started with a tampered report root")
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+// report_store.go contains the in-memory layout of the reports in the
+// reporting window. Every device gets a fixed size array of power outputs
+// that is indexed by the timeslot within the window, which is all that the
+// stats, the summaries and the exports need.
+//
+// Signatures are most of the size of a report and are only needed when a
+// signed report leaves the server, which happens when syncing, archiving,
+// transferring a device and on the endpoints that return signed reports. So
+// the signatures stay on disk. Every report that is in the reports files
+// remembers the number of its record, and the signature is read back from
+// the record when it's needed. The few reports that aren't in the reports
+// files, such as flagged reports that were accepted after a review, keep
+// their signature in memory.
+//
+// The records of the reports file and of the journal are numbered together,
+// with the journal continuing where the reports file stops. Compacting the
+// journal appends its records to the reports file in the same order, and
+// records are never removed from either file, so the number of a record
+// never changes.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// reportReadSpan is the largest number of records that get read from the
+// reports files with a single read. Records that are closer together than
+// this are read together along with the records between them.
+const reportReadSpan = 1024
+
+// deviceReports holds the reports of a device for the reporting window,
+// indexed by the timeslot within the window.
+type deviceReports struct {
+	// PowerOutputs holds the power output of every report. 0 means that
+	// there is no report for the timeslot, 1 that the timeslot was banned.
+	PowerOutputs [4032]uint64
+
+	// Records holds the number of the record of every report in the
+	// reports files, counting from 1. 0 means that the report is not in
+	// the reports files.
+	Records [4032]uint32
+
+	// Signatures holds the signatures of the reports that are not in the
+	// reports files. The map stays nil until it's needed.
+	Signatures map[uint16]glow.Signature
+
+	// Reported has a bit for every timeslot that has an accepted report,
+	// bit i%8 of byte i/8 for index i. It is kept up to date as the
+	// reports change, see api_report_bitfields.go.
+	Reported [4032 / 8]byte
+
+	// Totals holds the running totals of each of the two weeks of the
+	// window, see api_period_totals.go.
+	Totals [2]periodTotals
+}
+
+// signed returns whether there is a signed report at index i, as opposed to
+// an empty or banned timeslot.
+func (dr *deviceReports) signed(i int) bool {
+	if dr.Records[i] != 0 {
+		return true
+	}
+	_, exists := dr.Signatures[uint16(i)]
+	return exists
+}
+
+// setReport puts a report at index i. If the record is 0, the report is not
+// in the reports files and its signature is kept in memory.
+func (dr *deviceReports) setReport(i int, report glow.EquipmentReport, record uint32) {
+	dr.PowerOutputs[i] = report.PowerOutput
+	dr.Records[i] = record
+	dr.Reported[i/8] |= 1 << (i % 8)
+	if record != 0 {
+		delete(dr.Signatures, uint16(i))
+		return
+	}
+	if dr.Signatures == nil {
+		dr.Signatures = make(map[uint16]glow.Signature)
+	}
+	dr.Signatures[uint16(i)] = report.Signature
+}
+
+// ban marks the timeslot at index i as banned.
+func (dr *deviceReports) ban(i int) {
+	dr.PowerOutputs[i] = 1
+	dr.Records[i] = 0
+	dr.Reported[i/8] &^= 1 << (i % 8)
+	delete(dr.Signatures, uint16(i))
+}
+
+// clear removes whatever is at index i.
+func (dr *deviceReports) clear(i int) {
+	dr.PowerOutputs[i] = 0
+	dr.Records[i] = 0
+	dr.Reported[i/8] &^= 1 << (i % 8)
+	delete(dr.Signatures, uint16(i))
+}
+
+// shift moves the second half of the window into the first half and empties
+// the second half, which is what happens to the window in a migration.
+func (dr *deviceReports) shift() {
+	copy(dr.PowerOutputs[:2016], dr.PowerOutputs[2016:])
+	clear(dr.PowerOutputs[2016:])
+	copy(dr.Records[:2016], dr.Records[2016:])
+	clear(dr.Records[2016:])
+	copy(dr.Reported[:2016/8], dr.Reported[2016/8:])
+	clear(dr.Reported[2016/8:])
+	dr.Totals[0], dr.Totals[1] = dr.Totals[1], periodTotals{}
+	if len(dr.Signatures) == 0 {
+		return
+	}
+	shifted := make(map[uint16]glow.Signature)
+	for i, sig := range dr.Signatures {
+		if i >= 2016 {
+			shifted[i-2016] = sig
+		}
+	}
+	dr.Signatures = shifted
+}
+
+// report returns the report at index i of a device whose window starts at
+// the provided offset. Empty and banned timeslots have the zero report with
+// their power output, like they always had. The signature of a report that
+// is in the reports files is left empty, loadReportSignatures fills it in.
+func (dr *deviceReports) report(shortID uint32, offset uint32, i int) glow.EquipmentReport {
+	if !dr.signed(i) {
+		return glow.EquipmentReport{PowerOutput: dr.PowerOutputs[i]}
+	}
+	return glow.EquipmentReport{
+		ShortID:     shortID,
+		Timeslot:    offset + uint32(i),
+		PowerOutput: dr.PowerOutputs[i],
+		Signature:   dr.Signatures[uint16(i)],
+	}
+}
+
+// signedReports returns the signed reports of a device between the indexes
+// start and end of the window, with their signatures. The mutex must be held.
+func (gcas *GCAServer) signedReports(shortID uint32, start int, end int) ([]glow.EquipmentReport, error) {
+	dr, _ := gcas.windowReports(shortID)
+	var reports []glow.EquipmentReport
+	for i := start; i < end; i++ {
+		if dr.signed(i) {
+			reports = append(reports, dr.report(shortID, gcas.equipmentReportsOffset, i))
+		}
+	}
+	if err := gcas.loadReportSignatures(reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// nextReportRecord returns the number that the next record appended to the
+// journal will have.
+func (gcas *GCAServer) nextReportRecord() uint32 {
+	return gcas.reportsFileRecords + gcas.reportsJournalRecords + 1
+}
+
+// loadReportSignatures reads the signatures of the provided reports off of
+// disk. Reports that aren't signed reports in the window, or that already
+// have their signature, are left alone. The records get read in order, so
+// that the reports of many devices turn into a few large reads. The mutex
+// must be held.
+func (gcas *GCAServer) loadReportSignatures(reports []glow.EquipmentReport) error {
+	type pendingRead struct {
+		record uint32
+		index  int
+	}
+	var reads []pendingRead
+	ero := gcas.equipmentReportsOffset
+	for i, report := range reports {
+		if report.PowerOutput < 2 || report.Signature != (glow.Signature{}) || report.Timeslot < ero || report.Timeslot >= ero+4032 {
+			continue
+		}
+		dr, exists := gcas.windowReports(report.ShortID)
+		if !exists || dr.Records[report.Timeslot-ero] == 0 {
+			continue
+		}
+		reads = append(reads, pendingRead{record: dr.Records[report.Timeslot-ero], index: i})
+	}
+	sort.Slice(reads, func(i, j int) bool { return reads[i].record < reads[j].record })
+
+	for start := 0; start < len(reads); {
+		// Extend the read over the records that follow within the span,
+		// as long as they are in the same file.
+		first := reads[start].record
+		inJournal := first > gcas.reportsFileRecords
+		end := start + 1
+		for end < len(reads) && reads[end].record-first < reportReadSpan && (reads[end].record > gcas.reportsFileRecords) == inJournal {
+			end++
+		}
+		records, err := gcas.readReportRecords(first, reads[end-1].record)
+		if err != nil {
+			return err
+		}
+		for _, read := range reads[start:end] {
+			want := reports[read.index]
+			report, err := glow.DeserializeReport(records[read.record-first])
+			if err != nil || report.ShortID != want.ShortID || report.Timeslot != want.Timeslot || report.PowerOutput != want.PowerOutput {
+				return fmt.Errorf("record %v does not hold the report of ShortID %v for timeslot %v", read.record, want.ShortID, want.Timeslot)
+			}
+			reports[read.index].Signature = report.Signature
+		}
+		start = end
+	}
+	return nil
+}
+
+// readReportRecords reads the records numbered first through last, which are
+// all in the reports file or all in the journal, and returns the serialized
+// report of each.
+func (gcas *GCAServer) readReportRecords(first uint32, last uint32) ([][]byte, error) {
+	var file io.ReaderAt = gcas.reportsFile
+	name := EquipmentReportsFile
+	offset, stride, header := int64(first-1)*equipmentReportSize, equipmentReportSize, 0
+	if first > gcas.reportsFileRecords {
+		file, name = gcas.reportsJournal, ReportsJournalFile
+		offset, stride, header = int64(first-1-gcas.reportsFileRecords)*reportsJournalRecordSize, reportsJournalRecordSize, 4
+	}
+	data := make([]byte, int(last-first+1)*stride)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		return nil, fmt.Errorf("unable to read records %v through %v from %v: %v", first, last, name, err)
+	}
+	records := make([][]byte, last-first+1)
+	for i := range records {
+		records[i] = data[i*stride+header : i*stride+header+equipmentReportSize]
+	}
+	return records, nil
+}
+
+// openReportsFile opens the reports file for reading signatures, closing the
+// previous handle. This has to happen again whenever the file gets replaced.
+func (gcas *GCAServer) openReportsFile() error {
+	f, err := gcas.staticStorage.Open(EquipmentReportsFile)
+	if err != nil {
+		return fmt.Errorf("unable to open reports file: %v", err)
+	}
+	if gcas.reportsFile != nil {
+		gcas.reportsFile.Close()
+	}
+	gcas.reportsFile = f
+	return nil
+}
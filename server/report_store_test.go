@@ -0,0 +1,177 @@
+package server
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// liveReports returns the reports in the window of a device the way they
+// used to be held in memory, with their signatures. The mutex must be held.
+func (gcas *GCAServer) liveReports(tb testing.TB, shortID uint32) [4032]glow.EquipmentReport {
+	tb.Helper()
+	var reports [4032]glow.EquipmentReport
+	for i := range reports {
+		reports[i] = gcas.equipmentReports[shortID].report(shortID, gcas.equipmentReportsOffset, i)
+	}
+	if err := gcas.loadReportSignatures(reports[:]); err != nil {
+		tb.Fatal(err)
+	}
+	return reports
+}
+
+// TestReportStore checks that the signatures of the reports are read back off
+// of disk from the journal, from the reports file after a compaction and
+// after a restart, that a migration moves them along with the window, and
+// that a record which doesn't hold its report is caught.
+func TestReportStore(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(3, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submit := func(ts uint32) {
+		t.Helper()
+		glow.SetCurrentTimeslot(ts)
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, ts, ePriv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+	// check verifies that exactly the provided timeslots have signed
+	// reports, and that none of the signatures are held in memory.
+	check := func(timeslots ...uint32) {
+		t.Helper()
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		reports, err := server.signedReports(ea.ShortID, 0, 4032)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != len(timeslots) {
+			t.Fatalf("expected %v signed reports, got %v", len(timeslots), len(reports))
+		}
+		for i, report := range reports {
+			if report.Timeslot != timeslots[i] || report.PowerOutput != 5 || !glow.Verify(ea.PublicKey, report.SigningBytes(), report.Signature) {
+				t.Fatalf("unexpected report: %+v", report)
+			}
+		}
+		if len(server.equipmentReports[ea.ShortID].Signatures) != 0 {
+			t.Fatal("signatures are held in memory")
+		}
+	}
+
+	// Reports in the journal, then in the reports file, then in both.
+	for ts := uint32(1); ts <= 3; ts++ {
+		submit(ts)
+	}
+	check(1, 2, 3)
+	server.mu.Lock()
+	err = server.compactReportsJournal()
+	server.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(1, 2, 3)
+	submit(2020)
+	submit(2021)
+	check(1, 2, 3, 2020, 2021)
+
+	// A restart numbers the records the same way.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	check(1, 2, 3, 2020, 2021)
+
+	// A migration moves the signatures to the new index of their
+	// timeslot.
+	glow.SetCurrentTimeslot(3300)
+	for i := 0; i < 100; i++ {
+		server.mu.RLock()
+		ero := server.equipmentReportsOffset
+		server.mu.RUnlock()
+		if ero != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	check(2020, 2021)
+	server.mu.RLock()
+	index := server.equipmentReports[ea.ShortID].report(ea.ShortID, server.equipmentReportsOffset, 4)
+	server.mu.RUnlock()
+	if index.Timeslot != 2020 {
+		t.Fatal("report is at the wrong index after the migration:", index)
+	}
+	submit(3300)
+	check(2020, 2021, 3300)
+
+	// Point the record of a report at another timeslot.
+	server.mu.Lock()
+	err = server.compactReportsJournal()
+	record := server.equipmentReports[ea.ShortID].Records[5]
+	server.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := server.staticStorage.ReadFile(EquipmentReportsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[int64(record-1)*equipmentReportSize+4] = 0xff
+	if err := server.staticStorage.WriteFile(EquipmentReportsFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The server has to open the replaced file to see the change.
+	server.mu.Lock()
+	err = server.openReportsFile()
+	if err == nil {
+		_, err = server.signedReports(ea.ShortID, 0, 4032)
+	}
+	server.mu.Unlock()
+	if err == nil || !strings.Contains(err.Error(), "does not hold") {
+		t.Fatal("corrupt record was not caught:", err)
+	}
+}
+
+// BenchmarkReportMemory measures the heap used by the reports of 5,000
+// devices that reported in every timeslot of the reporting window.
+func BenchmarkReportMemory(b *testing.B) {
+	const devices = 5000
+	for n := 0; n < b.N; n++ {
+		server, _, _, _, err := SetupTestEnvironment(b.Name())
+		if err != nil {
+			b.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		server.mu.Lock()
+		for i := uint32(0); i < devices; i++ {
+			pub, _ := glow.GenerateKeyPair()
+			server.applyEquipment(glow.EquipmentAuthorization{ShortID: 100 + i, PublicKey: pub, Capacity: 1e9})
+			for ts := uint32(0); ts < 4032; ts++ {
+				report := glow.EquipmentReport{ShortID: 100 + i, Timeslot: server.equipmentReportsOffset + ts, PowerOutput: 5}
+				report.Signature[0] = 1
+				server.applyReport(report, i*4032+ts+1, ValidationEnforce)
+			}
+		}
+		server.recentReports = nil
+		server.mu.Unlock()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/(1<<20), "heap-MB")
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/devices, "heap-B/device")
+		server.Close()
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+// report_stream.go contains a broadcaster that fans accepted equipment
+// reports out to live subscribers, and the WebSocket endpoint that exposes
+// it.
+//
+// The broadcaster is fed from the report ingestion path, so it must never
+// block. Every subscriber has a buffered channel, and a subscriber whose
+// buffer is full gets dropped instead of slowing down ingestion. The
+// broadcaster has its own mutex, so it must only be used while the server
+// mutex is not held.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// StreamedReport is the message that gets pushed to report stream
+// subscribers for every accepted report.
+type StreamedReport struct {
+	ShortID     uint32
+	PublicKey   string // hex encoded
+	Timeslot    uint32
+	PowerOutput uint64
+}
+
+// reportSubscriber is a single consumer of the report stream. The channel
+// gets closed by the broadcaster when the subscriber is removed.
+type reportSubscriber struct {
+	filter    glow.PublicKey
+	hasFilter bool
+	c         chan StreamedReport
+}
+
+// reportBroadcaster fans reports out to all of the subscribers.
+type reportBroadcaster struct {
+	subscribers    map[*reportSubscriber]struct{}
+	maxSubscribers int
+
+	mu sync.Mutex
+}
+
+// newReportBroadcaster returns a broadcaster that allows up to
+// maxSubscribers concurrent subscribers.
+func newReportBroadcaster(maxSubscribers int) *reportBroadcaster {
+	return &reportBroadcaster{
+		subscribers:    make(map[*reportSubscriber]struct{}),
+		maxSubscribers: maxSubscribers,
+	}
+}
+
+// Subscribe adds a new subscriber. If filter is not nil, the subscriber only
+// receives reports from the equipment with that public key.
+func (rb *reportBroadcaster) Subscribe(filter *glow.PublicKey) (*reportSubscriber, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if len(rb.subscribers) >= rb.maxSubscribers {
+		return nil, fmt.Errorf("too many report stream subscribers")
+	}
+	sub := &reportSubscriber{
+		c: make(chan StreamedReport, reportStreamBufferSize),
+	}
+	if filter != nil {
+		sub.filter = *filter
+		sub.hasFilter = true
+	}
+	rb.subscribers[sub] = struct{}{}
+	return sub, nil
+}
+
+// Unsubscribe removes a subscriber. It is safe to call even if the
+// subscriber was already dropped.
+func (rb *reportBroadcaster) Unsubscribe(sub *reportSubscriber) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if _, exists := rb.subscribers[sub]; exists {
+		delete(rb.subscribers, sub)
+		close(sub.c)
+	}
+}
+
+// Broadcast sends a report to every matching subscriber without blocking.
+// Subscribers that have fallen too far behind are dropped. The public key of
+// the report gets hex encoded into the report if the report doesn't have it
+// yet, which is only done once a subscriber wants the report.
+func (rb *reportBroadcaster) Broadcast(sr StreamedReport, pubkey glow.PublicKey) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for sub := range rb.subscribers {
+		if sub.hasFilter && sub.filter != pubkey {
+			continue
+		}
+		if sr.PublicKey == "" {
+			sr.PublicKey = hex.EncodeToString(pubkey[:])
+		}
+		select {
+		case sub.c <- sr:
+		default:
+			delete(rb.subscribers, sub)
+			close(sub.c)
+		}
+	}
+}
+
+// ReportStreamHandler upgrades the connection to a WebSocket and then pushes
+// a StreamedReport for every report that gets accepted while the connection
+// is open. The optional 'pubkey' query parameter limits the stream to a
+// single piece of equipment.
+func (gcas *GCAServer) ReportStreamHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for the report stream.")
+		return
+	}
+
+	// Parse the optional filter.
+	var filter *glow.PublicKey
+	if pkStr := r.URL.Query().Get("pubkey"); pkStr != "" {
+		pk, err := glow.ParsePublicKey(pkStr)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid pubkey")
+			return
+		}
+		filter = &pk
+	}
+
+	// Streams are long lived, so they need to be tracked by the
+	// threadgroup to make sure that they get closed during shutdown.
+	if err := gcas.tg.Add(); err != nil {
+		gcas.writeError(w, ErrCodeServerShuttingDown, "Server is shutting down")
+		return
+	}
+	defer gcas.tg.Done()
+	sub, err := gcas.staticReportStream.Subscribe(filter)
+	if err != nil {
+		gcas.writeError(w, ErrCodeServerBusy, "Too many open report streams")
+		gcas.requestLogger(r).Warn("Rejected report stream: ", err)
+		return
+	}
+	defer gcas.staticReportStream.Unsubscribe(sub)
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		gcas.writeError(w, ErrCodeMalformedRequest, err.Error())
+		return
+	}
+	defer ws.Close()
+
+	// Read from the client in the background so that pings get answered
+	// and a closed connection gets noticed.
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		for {
+			opcode, payload, err := ws.readFrame()
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsOpPing:
+				ws.writeFrame(wsOpPong, payload)
+			case wsOpClose:
+				ws.writeFrame(wsOpClose, payload)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case sr, ok := <-sub.c:
+			if !ok {
+				ws.writeClose(wsClosePolicyViolation, "consumer too slow")
+				gcas.requestLogger(r).Info("Dropped slow report stream consumer.")
+				return
+			}
+			msg, err := json.Marshal(sr)
+			if err != nil {
+				gcas.requestLogger(r).Error("Failed to encode streamed report:", err)
+				return
+			}
+			if err := ws.writeFrame(wsOpText, msg); err != nil {
+				return
+			}
+		case <-clientGone:
+			return
+		case <-gcas.tg.StopChan():
+			ws.writeClose(wsCloseGoingAway, "server shutting down")
+			return
+		}
+	}
+}
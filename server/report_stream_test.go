@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// testStreamClient is a bare bones WebSocket client for testing the report
+// stream.
+type testStreamClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// openReportStream opens a report stream, using the provided query string.
+func (gcas *GCAServer) openReportStream(query string) (*testStreamClient, error) {
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(gcas.httpPort)))
+	if err != nil {
+		return nil, err
+	}
+	var keyBytes [16]byte
+	rand.Read(keyBytes[:])
+	key := base64.StdEncoding.EncodeToString(keyBytes[:])
+	req := "GET /api/v1/reports/stream" + query + " HTTP/1.1\r\n" +
+		"Host: 127.0.0.1\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected status: %v", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("bad Sec-WebSocket-Accept")
+	}
+	return &testStreamClient{conn: conn, br: br}, nil
+}
+
+// readFrame reads an unmasked frame from the server.
+func (c *testStreamClient) readFrame(timeout time.Duration) (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(header[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	} else if length == 127 {
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+// readReport reads the next streamed report.
+func (c *testStreamClient) readReport() (StreamedReport, error) {
+	opcode, payload, err := c.readFrame(time.Second)
+	if err != nil {
+		return StreamedReport{}, err
+	}
+	if opcode != wsOpText {
+		return StreamedReport{}, fmt.Errorf("unexpected opcode: %v", opcode)
+	}
+	var sr StreamedReport
+	err = json.Unmarshal(payload, &sr)
+	return sr, err
+}
+
+// writeMasked sends a masked frame to the server.
+func (c *testStreamClient) writeMasked(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	mask := [4]byte{1, 2, 3, 4}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// waitForSubscribers waits until the broadcaster has the expected number of
+// subscribers, as streams get unsubscribed asynchronously when they close.
+func (rb *reportBroadcaster) waitForSubscribers(n int) bool {
+	for i := 0; i < 100; i++ {
+		rb.mu.Lock()
+		count := len(rb.subscribers)
+		rb.mu.Unlock()
+		if count == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// TestReportStream opens a filtered and an unfiltered stream and checks that
+// each of them receives the right reports.
+func TestReportStream(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea1, ePriv1, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea2, ePriv2, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reports from before the stream was opened are not sent.
+	server.managedHandleEquipmentReport(generateTestReport(ea1.ShortID, 1, ePriv1))
+	all, err := server.openReportStream("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.conn.Close()
+	filtered, err := server.openReportStream("?pubkey=" + hex.EncodeToString(ea2.PublicKey[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filtered.conn.Close()
+	if !server.staticReportStream.waitForSubscribers(2) {
+		t.Fatal("streams did not subscribe")
+	}
+
+	// Rejected reports are not sent either.
+	server.managedHandleEquipmentReport(generateTestReport(ea1.ShortID, 1, ePriv1))
+	server.managedHandleEquipmentReport(generateTestReport(ea1.ShortID, 2, ePriv1))
+	server.managedHandleEquipmentReport(generateTestReport(ea2.ShortID, 3, ePriv2))
+
+	sr, err := all.readReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := StreamedReport{ShortID: 1, PublicKey: hex.EncodeToString(ea1.PublicKey[:]), Timeslot: 2, PowerOutput: 5}
+	if sr != expected {
+		t.Fatal("unexpected report:", sr)
+	}
+	sr, err = all.readReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.ShortID != 2 || sr.Timeslot != 3 {
+		t.Fatal("unexpected report:", sr)
+	}
+	sr, err = filtered.readReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = StreamedReport{ShortID: 2, PublicKey: hex.EncodeToString(ea2.PublicKey[:]), Timeslot: 3, PowerOutput: 5}
+	if sr != expected {
+		t.Fatal("unexpected filtered report:", sr)
+	}
+
+	// Pings get answered, and a close from the client gets echoed.
+	if err := filtered.writeMasked(wsOpPing, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	opcode, payload, err := filtered.readFrame(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != wsOpPong || string(payload) != "hi" {
+		t.Fatal("bad pong:", opcode, payload)
+	}
+	if err := filtered.writeMasked(wsOpClose, nil); err != nil {
+		t.Fatal(err)
+	}
+	opcode, _, err = filtered.readFrame(time.Second)
+	if err != nil || opcode != wsOpClose {
+		t.Fatal("close was not echoed:", opcode, err)
+	}
+	if !server.staticReportStream.waitForSubscribers(1) {
+		t.Fatal("closed stream was not unsubscribed")
+	}
+
+	// Bad filters and plain requests are rejected.
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/reports/stream?pubkey=zz", server.httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected a bad filter to be rejected:", resp.StatusCode)
+	}
+	resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/reports/stream", server.httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected a request without an upgrade to be rejected:", resp.StatusCode)
+	}
+}
+
+// TestReportBroadcasterLimits checks the subscriber cap and that slow
+// consumers get dropped rather than blocking the broadcast.
+func TestReportBroadcasterLimits(t *testing.T) {
+	rb := newReportBroadcaster(2)
+	slow, err := rb.Subscribe(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, _ := glow.GenerateKeyPair()
+	other, _ := glow.GenerateKeyPair()
+	filtered, err := rb.Subscribe(&pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rb.Subscribe(nil); err == nil {
+		t.Fatal("expected the subscriber cap to be enforced")
+	}
+
+	// Overflow the slow consumer. The filtered consumer never matches, so
+	// it should survive.
+	for i := 0; i <= reportStreamBufferSize; i++ {
+		rb.Broadcast(StreamedReport{Timeslot: uint32(i)}, other)
+	}
+	for range slow.c {
+	}
+	rb.mu.Lock()
+	_, slowExists := rb.subscribers[slow]
+	_, filteredExists := rb.subscribers[filtered]
+	rb.mu.Unlock()
+	if slowExists || !filteredExists {
+		t.Fatal("wrong subscribers were dropped:", slowExists, filteredExists)
+	}
+
+	// A dropped subscriber frees up a slot, and unsubscribing twice is
+	// harmless.
+	rb.Unsubscribe(slow)
+	if _, err := rb.Subscribe(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReportStreamShutdown checks that open streams get closed when the
+// server shuts down, rather than holding up the shutdown.
+func TestReportStreamShutdown(t *testing.T) {
+	server, _, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := server.openReportStream("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.conn.Close()
+	if !server.staticReportStream.waitForSubscribers(1) {
+		t.Fatal("stream did not subscribe")
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opcode, payload, err := stream.readFrame(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != wsOpClose || binary.BigEndian.Uint16(payload) != wsCloseGoingAway {
+		t.Fatal("expected a going away close frame:", opcode, payload)
+	}
+}
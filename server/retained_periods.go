@@ -0,0 +1,232 @@
+package server
+
+// retained_periods.go keeps the previous periods queryable after they leave
+// the reporting window. A GCA reviews the previous week during the first days
+// of the new one, but the migration rotates the oldest week out of memory a
+// few days into the new week, after which the recent reports endpoints only
+// show the new weeks.
+//
+// So the server keeps the signed reports of the last RetainedPeriods weeks
+// that were finalized, see ServerOptions, in memory. The archive of a week
+// is built when the week gets finalized anyway, see report_archive.go, and the
+// retained week is that archive, which only holds the reports that carry a
+// signature. A server that restarted reads a retained week back from its
+// archive the first time it's asked for it. The stats of the retained weeks
+// come from the stats history, which keeps a lot more weeks than that.
+//
+// The stats and the recent reports endpoints take a 'period' query
+// parameter, which is 'current' for the week of the current timeslot,
+// 'previous' for the week before it, or the number of a week, counting from
+// 0 at genesis like /api/v1/period-status. Only the current week and the
+// RetainedPeriods weeks before it can be asked for. The recent reports of a
+// period cover the 4032 timeslots from the start of the period, so the
+// previous period comes with the current one, like the reports in memory did
+// while both weeks were in the reporting window. Without the parameter, the
+// endpoints return what they always have.
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// parsePeriod parses the 'period' query parameter, and returns the number of
+// the period, and false if the parameter is not set. Periods that the server
+// doesn't keep are an error.
+func (gcas *GCAServer) parsePeriod(q url.Values) (uint32, bool, error) {
+	str := q.Get("period")
+	if str == "" {
+		return 0, false, nil
+	}
+	current := gcas.currentTimeslot() / 2016
+	var period uint32
+	switch str {
+	case "current":
+		period = current
+	case "previous":
+		if current == 0 {
+			return 0, false, fmt.Errorf("there is no period before period 0")
+		}
+		period = current - 1
+	default:
+		n, err := strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid period format, must be 'current', 'previous', or a period number")
+		}
+		period = uint32(n)
+	}
+	if period > current {
+		return 0, false, fmt.Errorf("period %v is in the future, the current period is %v", period, current)
+	}
+	if int64(current)-int64(period) > int64(gcas.staticRetainedPeriods) {
+		return 0, false, fmt.Errorf("period %v is not retained, the server keeps the current period %v and the %v periods before it", period, current, gcas.staticRetainedPeriods)
+	}
+	return period, true, nil
+}
+
+// retainPeriod keeps the archive of a week that was just finalized in memory,
+// and drops the weeks that are no longer retained. The mutex must be held.
+func (gcas *GCAServer) retainPeriod(ra ReportArchive) {
+	if gcas.staticRetainedPeriods == 0 {
+		return
+	}
+	for _, retained := range gcas.retainedPeriods {
+		if retained.PeriodStart == ra.PeriodStart {
+			return
+		}
+	}
+	gcas.retainedPeriods = append(gcas.retainedPeriods, ra)
+	sort.Slice(gcas.retainedPeriods, func(i, j int) bool {
+		return gcas.retainedPeriods[i].PeriodStart < gcas.retainedPeriods[j].PeriodStart
+	})
+	gcas.pruneRetainedPeriods()
+}
+
+// isRetainedPeriod returns whether the week that starts at the provided
+// timeslot is one of the weeks before the reporting window that get kept in
+// memory. The mutex must be held.
+func (gcas *GCAServer) isRetainedPeriod(periodStart uint32) bool {
+	earliest := int64(gcas.equipmentReportsOffset) - int64(gcas.staticRetainedPeriods)*2016
+	return int64(periodStart) >= earliest && periodStart < gcas.equipmentReportsOffset+2016
+}
+
+// pruneRetainedPeriods drops the retained weeks that fell out of the
+// retention after a migration. The mutex must be held.
+func (gcas *GCAServer) pruneRetainedPeriods() {
+	kept := gcas.retainedPeriods[:0]
+	for _, ra := range gcas.retainedPeriods {
+		if gcas.isRetainedPeriod(ra.PeriodStart) {
+			kept = append(kept, ra)
+		}
+	}
+	clear(gcas.retainedPeriods[len(kept):])
+	gcas.retainedPeriods = kept
+}
+
+// managedRetainedPeriod returns the retained week that starts at the provided
+// timeslot, reading it from its archive if it isn't in memory, and false if
+// the week has no archive.
+func (gcas *GCAServer) managedRetainedPeriod(periodStart uint32) (ReportArchive, bool, error) {
+	gcas.mu.RLock()
+	for _, ra := range gcas.retainedPeriods {
+		if ra.PeriodStart == periodStart {
+			gcas.mu.RUnlock()
+			return ra, true, nil
+		}
+	}
+	gcas.mu.RUnlock()
+
+	// Archives are never modified, so they can be read without holding
+	// the mutex.
+	if _, err := gcas.staticStorage.Stat(reportArchiveFile(periodStart)); os.IsNotExist(err) {
+		return ReportArchive{}, false, nil
+	} else if err != nil {
+		return ReportArchive{}, false, fmt.Errorf("unable to check for the archive of period %v: %v", periodStart, err)
+	}
+	ra, err := gcas.loadReportArchive(periodStart)
+	if err != nil {
+		return ReportArchive{}, false, err
+	}
+	gcas.mu.Lock()
+	if gcas.isRetainedPeriod(periodStart) {
+		gcas.retainPeriod(ra)
+	}
+	gcas.mu.Unlock()
+	return ra, true, nil
+}
+
+// archivedReports returns the reports of the device with the provided public
+// key in a retained week, nil if the device has none. The devices of an
+// archive are in order of ShortID.
+func archivedReports(ra ReportArchive, shortID uint32, publicKey glow.PublicKey) []glow.EquipmentReport {
+	i := sort.Search(len(ra.Devices), func(i int) bool { return ra.Devices[i].ShortID >= shortID })
+	if i < len(ra.Devices) && ra.Devices[i].ShortID == shortID && ra.Devices[i].PublicKey == publicKey {
+		return ra.Devices[i].Reports
+	}
+	return nil
+}
+
+// deviceReportWindow holds the reports of a device for 4032 timeslots.
+type deviceReportWindow struct {
+	shortID uint32
+	offset  uint32 // The timeslot of the first report
+	reports [4032]glow.EquipmentReport
+
+	// receivedAt holds the unix time at which every report in the
+	// reporting window was received, 0 if unknown, see
+	// report_receipts.go.
+	receivedAt [4032]int64
+}
+
+// managedDeviceReportWindow returns the reports of the device with the
+// provided public key for the 4032 timeslots from the start of the provided
+// period, or from the start of the reporting window if the period is nil. The
+// reports of the timeslots that are no longer in the reporting window come
+// from the retained weeks, with the reports without a signature left out.
+func (gcas *GCAServer) managedDeviceReportWindow(publicKey glow.PublicKey, period *uint32) (deviceReportWindow, error) {
+	var drw deviceReportWindow
+	for {
+		gcas.mu.RLock()
+		ero := gcas.equipmentReportsOffset
+		gcas.mu.RUnlock()
+		start := ero
+		if period != nil {
+			start = *period * 2016
+		}
+
+		// The retained weeks get loaded before the lock is taken, and
+		// the window is built again if the reports were migrated in
+		// between.
+		var retained []ReportArchive
+		for periodStart := start; periodStart < ero && periodStart < start+4032; periodStart += 2016 {
+			ra, exists, err := gcas.managedRetainedPeriod(periodStart)
+			if err != nil {
+				return drw, err
+			}
+			if exists {
+				retained = append(retained, ra)
+			}
+		}
+
+		gcas.mu.RLock()
+		if gcas.equipmentReportsOffset != ero {
+			gcas.mu.RUnlock()
+			continue
+		}
+		shortID, exists := gcas.equipmentShortID[publicKey]
+		if !exists {
+			gcas.mu.RUnlock()
+			return drw, withCode(ErrCodeUnknownDevice, fmt.Errorf("equipment not found"))
+		}
+		live, exists := gcas.equipmentReports[shortID]
+		if !exists {
+			gcas.mu.RUnlock()
+			return drw, withCode(ErrCodeNotFound, fmt.Errorf("no reports found for the provided public key"))
+		}
+		drw.shortID = shortID
+		drw.offset = start
+		for i := range drw.reports {
+			if ts := start + uint32(i); ts >= ero && ts-ero < 4032 {
+				drw.reports[i] = live.report(shortID, ero, int(ts-ero))
+				drw.receivedAt[i] = gcas.receivedAt(shortID, ts)
+			}
+		}
+		err := gcas.loadReportSignatures(drw.reports[:])
+		gcas.mu.RUnlock()
+		if err != nil {
+			return drw, err
+		}
+		for _, ra := range retained {
+			for _, report := range archivedReports(ra, shortID, publicKey) {
+				if report.Timeslot >= start && report.Timeslot-start < 4032 {
+					drw.reports[report.Timeslot-start] = report
+				}
+			}
+		}
+		return drw, nil
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// fetchPeriodReports fetches the recent reports of a device for the provided
+// period.
+func (gcas *GCAServer) fetchPeriodReports(pubkey glow.PublicKey, period string) (RecentReportsResponse, int, error) {
+	var rrr RecentReportsResponse
+	resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/recent-reports?publicKey=%v&period=%v", gcas.httpDialAddr(), hex.EncodeToString(pubkey[:]), period))
+	if err != nil {
+		return rrr, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return rrr, resp.StatusCode, nil
+	}
+	return rrr, resp.StatusCode, json.NewDecoder(resp.Body).Decode(&rrr)
+}
+
+// migrateToTimeslot moves the current timeslot forward and waits for the
+// migration thread to rotate the reports until the reports offset is the
+// provided one.
+func migrateToTimeslot(t *testing.T, gcas *GCAServer, timeslot uint32, offset uint32) {
+	t.Helper()
+	glow.SetCurrentTimeslot(timeslot)
+	for i := 0; i < 200; i++ {
+		gcas.mu.RLock()
+		ero := gcas.equipmentReportsOffset
+		gcas.mu.RUnlock()
+		if ero == offset {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the reports were not migrated to", offset)
+}
+
+// TestRetainedPeriods checks that the previous period stays queryable through
+// the stats and the recent reports endpoints after it left the reporting
+// window, from memory and, after a restart, from its archive.
+func TestRetainedPeriods(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer glow.SetCurrentTimeslot(0)
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []uint32{2, 4} {
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, ts, ePriv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+	glow.SetCurrentTimeslot(2020)
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 2020, ePriv)); outcome != reportAccepted {
+		t.Fatal("report was not accepted:", outcome)
+	}
+	migrateToTimeslot(t, server, 3300, 2016)
+
+	// The previous period is out of the reporting window, its reports come
+	// from memory along with the reports of the current period.
+	server.mu.RLock()
+	retained := len(server.retainedPeriods)
+	server.mu.RUnlock()
+	if retained != 1 {
+		t.Fatal("expected the previous period to be retained:", retained)
+	}
+	check := func(period string, offset uint32, timeslots ...uint32) {
+		t.Helper()
+		rrr, code, err := server.fetchPeriodReports(ea.PublicKey, period)
+		if err != nil || code != http.StatusOK {
+			t.Fatal("unable to fetch the reports of the period:", period, code, err)
+		}
+		if rrr.TimeslotOffset != offset || rrr.ReportTimes[0].Timeslot != offset {
+			t.Fatal("unexpected offset:", rrr.TimeslotOffset)
+		}
+		reportsBytes, _ := json.Marshal(rrr.Reports)
+		if !glow.Verify(server.staticPublicKey, reportsBytes, rrr.Signature) {
+			t.Fatal("bad signature on the reports of the period", period)
+		}
+		found := 0
+		for i, er := range rrr.Reports {
+			if er.PowerOutput == 0 {
+				continue
+			}
+			if er.Timeslot != offset+uint32(i) || !glow.Verify(ea.PublicKey, er.SigningBytes(), er.Signature) {
+				t.Fatal("bad report in the period:", i, er)
+			}
+			found++
+		}
+		if found != len(timeslots) {
+			t.Fatalf("expected %v reports in period %v, got %v", len(timeslots), period, found)
+		}
+		for _, ts := range timeslots {
+			if rrr.Reports[ts-offset].PowerOutput != 5 {
+				t.Fatal("missing report for timeslot", ts)
+			}
+		}
+	}
+	check("previous", 0, 2, 4, 2020)
+	check("0", 0, 2, 4, 2020)
+	check("current", 2016, 2020)
+
+	// The stats of the previous period come from the stats history.
+	resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/all-device-stats?period=previous", server.httpDialAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ads AllDeviceStats
+	err = json.NewDecoder(resp.Body).Decode(&ads)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ads.TimeslotOffset != 0 || len(ads.Devices) != 1 || ads.Devices[0].PowerOutputs[4] != 5 {
+		t.Fatal("unexpected stats for the previous period:", ads.TimeslotOffset, len(ads.Devices))
+	}
+	if !glow.Verify(server.staticPublicKey, ads.SigningBytes(), ads.Signature) {
+		t.Fatal("bad signature on the stats of the previous period")
+	}
+
+	// A restarted server reads the period back from its archive.
+	server.mu.Lock()
+	server.retainedPeriods = nil
+	server.mu.Unlock()
+	check("previous", 0, 2, 4, 2020)
+	server.mu.RLock()
+	retained = len(server.retainedPeriods)
+	server.mu.RUnlock()
+	if retained != 1 {
+		t.Fatal("the period was not retained again after it was loaded:", retained)
+	}
+
+	// Periods in the future and periods past the retention are refused,
+	// and so is a timeslot offset that disagrees with the period.
+	for _, period := range []string{"2", "bogus"} {
+		if _, code, err := server.fetchPeriodReports(ea.PublicKey, period); err != nil || code != http.StatusBadRequest {
+			t.Fatal("unexpected status for period", period, code, err)
+		}
+	}
+	resp, err = http.Get(fmt.Sprintf("http://%v/api/v1/all-device-stats?period=previous&timeslot_offset=2016", server.httpDialAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("a timeslot offset that disagrees with the period was accepted:", resp.StatusCode)
+	}
+	migrateToTimeslot(t, server, 5300, 4032)
+	if _, code, err := server.fetchPeriodReports(ea.PublicKey, "0"); err != nil || code != http.StatusBadRequest {
+		t.Fatal("a period past the retention was served:", code, err)
+	}
+	check("previous", 2016, 2020)
+	server.mu.RLock()
+	retained = len(server.retainedPeriods)
+	server.mu.RUnlock()
+	if retained != 1 {
+		t.Fatal("the retention was not pruned:", retained)
+	}
+}
+
+// TestRetainedPeriodsDisabled checks that a server that retains no periods
+// keeps nothing in memory and only serves the current period.
+func TestRetainedPeriodsDisabled(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{RetainedPeriods: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer glow.SetCurrentTimeslot(0)
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrateToTimeslot(t, server, 3300, 2016)
+	server.mu.RLock()
+	retained := len(server.retainedPeriods)
+	server.mu.RUnlock()
+	if retained != 0 {
+		t.Fatal("a period was retained:", retained)
+	}
+	if _, code, err := server.fetchPeriodReports(ea.PublicKey, "previous"); err != nil || code != http.StatusBadRequest {
+		t.Fatal("the previous period was served:", code, err)
+	}
+	if rrr, code, err := server.fetchPeriodReports(ea.PublicKey, "current"); err != nil || code != http.StatusOK || rrr.TimeslotOffset != 2016 {
+		t.Fatal("the current period was not served:", code, err)
+	}
+	if _, _, _, _, err := SetupTestEnvironmentWithOptions(t.Name()+"-bad", ServerOptions{RetainedPeriods: -1}); err == nil {
+		t.Fatal("a negative number of retained periods was accepted")
+	}
+}
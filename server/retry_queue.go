@@ -0,0 +1,423 @@
+package server
+
+// retry_queue.go contains the bounded, persisted queue that every delivery to
+// a destination outside of the server goes through: the webhook events of
+// webhook_queue.go, and the alerts of the email and the Slack backends of
+// alerts.go. A destination can be down for a week, so a queue must stay
+// bounded no matter how long an outage lasts. It holds at most
+// RetryQueueMaxEntries entries and drops the oldest entry to make room for a
+// new one, and it drops every entry that has been waiting for longer than
+// RetryQueueMaxAge. Every dropped entry is logged and counted in
+// retry_queue_dropped_total, by queue and reason.
+//
+// A queue is saved to its file after every change, before anything gets
+// sent, and loaded again at startup, so an entry only leaves the queue once it
+// was delivered or dropped. Every destination has a backoff of its own: after
+// a failed delivery nothing gets sent to the destination until the backoff
+// ran out, which doubles with every failure up to the maximum, with jitter so
+// that the retries of the destinations that went down together don't line
+// up. A destination that is down gets one attempt per backoff, no matter how
+// many entries are waiting for it. The entries of a destination are
+// delivered in the order they were queued, and a delivery that succeeds
+// resets the backoff.
+//
+// The depth of the backlog of every destination and the age of its oldest
+// entry are exposed by the metrics endpoint and by /healthz.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The reasons that an entry gets dropped for.
+const (
+	retryDropSize = "size" // The queue was full
+	retryDropAge  = "age"  // The entry was older than the maximum age
+)
+
+// RetryQueueBacklog is the backlog of a destination of a retry queue.
+type RetryQueueBacklog struct {
+	Queue            string // The name of the queue, which is the name of its alert backend
+	Destination      string // The destination, without the path of a URL
+	Depth            int    // The number of entries waiting for the destination
+	OldestAgeSeconds int64  // How long the oldest of the entries has been waiting
+	Failures         int    // The number of failed deliveries since the last one that succeeded
+}
+
+// retryQueueConfig contains the settings of a retry queue.
+type retryQueueConfig struct {
+	name       string
+	file       string
+	maxEntries int
+	maxAge     time.Duration
+
+	// legacy parses the file of a queue from before the retry queues, a
+	// JSON array. Nil if the queue had no such file.
+	legacy func(data []byte, now time.Time) ([]*retryEntry, error)
+}
+
+// retryEntry is a payload that still has to be delivered to a destination.
+type retryEntry struct {
+	Destination string          `json:"destination"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	Queued      time.Time       `json:"queued"`
+}
+
+// retryDestination is the backoff of a destination.
+type retryDestination struct {
+	Failures    int       `json:"failures"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// retryQueueFile is the content of the file of a retry queue.
+type retryQueueFile struct {
+	Entries      []*retryEntry                `json:"entries"`
+	Destinations map[string]*retryDestination `json:"destinations"`
+}
+
+// retryQueue is a bounded, persisted queue of deliveries. The wake channel
+// gets signaled whenever an entry is added. The queue has its own mutex, which
+// can be used while holding the server mutex.
+type retryQueue struct {
+	staticConfig retryQueueConfig
+
+	entries      []*retryEntry
+	destinations map[string]*retryDestination
+	dropped      map[string]uint64 // By reason, since startup
+
+	wake chan struct{}
+	gcas *GCAServer
+	mu   sync.Mutex
+}
+
+// newRetryQueueConfig returns the settings of a retry queue, with the limits
+// of the server.
+func (gcas *GCAServer) newRetryQueueConfig(name string, file string) retryQueueConfig {
+	return retryQueueConfig{
+		name:       name,
+		file:       file,
+		maxEntries: gcas.staticRetryQueueMaxEntries,
+		maxAge:     gcas.staticRetryQueueMaxAge,
+	}
+}
+
+// loadRetryQueue loads a retry queue from the storage of the server. A
+// missing file is an empty queue.
+func (gcas *GCAServer) loadRetryQueue(cfg retryQueueConfig) (*retryQueue, error) {
+	q := &retryQueue{
+		staticConfig: cfg,
+		destinations: make(map[string]*retryDestination),
+		dropped:      make(map[string]uint64),
+		wake:         make(chan struct{}, 1),
+		gcas:         gcas,
+	}
+	data, err := gcas.staticStorage.ReadFile(cfg.file)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the %v queue: %v", cfg.name, err)
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' && cfg.legacy != nil {
+		q.entries, err = cfg.legacy(trimmed, gcas.now())
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the %v queue: %v", cfg.name, err)
+		}
+		return q, nil
+	}
+	var qf retryQueueFile
+	if err := json.Unmarshal(data, &qf); err != nil {
+		return nil, fmt.Errorf("unable to parse the %v queue: %v", cfg.name, err)
+	}
+	q.entries = qf.Entries
+	for dest, rd := range qf.Destinations {
+		q.destinations[dest] = rd
+	}
+	return q, nil
+}
+
+// save writes the queue to disk. The mutex must be held.
+func (q *retryQueue) save() error {
+	data, err := json.Marshal(retryQueueFile{Entries: q.entries, Destinations: q.destinations})
+	if err != nil {
+		return fmt.Errorf("unable to encode the %v queue: %v", q.staticConfig.name, err)
+	}
+	if err := q.gcas.staticStorage.WriteFile(q.staticConfig.file, data, 0644); err != nil {
+		return fmt.Errorf("unable to save the %v queue: %v", q.staticConfig.name, err)
+	}
+	return nil
+}
+
+// drop removes the entries at the provided indices, which must be sorted, and
+// counts them for the provided reason. The mutex must be held.
+func (q *retryQueue) drop(indices []int, reason string) {
+	if len(indices) == 0 {
+		return
+	}
+	kept := q.entries[:0]
+	next := 0
+	for i, e := range q.entries {
+		if next < len(indices) && indices[next] == i {
+			next++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	for i := len(kept); i < len(q.entries); i++ {
+		q.entries[i] = nil
+	}
+	q.entries = kept
+	q.dropped[reason] += uint64(len(indices))
+	for range indices {
+		q.gcas.staticMetrics.RecordAlertFailure(q.staticConfig.name)
+	}
+	q.gcas.logger.WithFields("queue", q.staticConfig.name, "dropped", len(indices), "reason", reason).Error("retry queue dropped deliveries")
+}
+
+// evictExpired drops the entries that are older than the maximum age, and
+// returns whether there were any. The mutex must be held.
+func (q *retryQueue) evictExpired(now time.Time) bool {
+	var expired []int
+	for i, e := range q.entries {
+		if now.Sub(e.Queued) > q.staticConfig.maxAge {
+			expired = append(expired, i)
+		}
+	}
+	q.drop(expired, retryDropAge)
+	return len(expired) > 0
+}
+
+// forgetIdle removes the backoff of the destinations that have nothing
+// queued. The mutex must be held.
+func (q *retryQueue) forgetIdle() {
+	queued := make(map[string]bool)
+	for _, e := range q.entries {
+		queued[e.Destination] = true
+	}
+	for dest := range q.destinations {
+		if !queued[dest] {
+			delete(q.destinations, dest)
+		}
+	}
+}
+
+// managedPush queues a delivery of the payload to every destination, dropping
+// the oldest entries if the queue is full.
+func (q *retryQueue) managedPush(destinations []string, payload []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.gcas.now()
+	for _, dest := range destinations {
+		q.entries = append(q.entries, &retryEntry{Destination: dest, Payload: payload, Queued: now})
+	}
+	if excess := len(q.entries) - q.staticConfig.maxEntries; excess > 0 {
+		oldest := make([]int, excess)
+		for i := range oldest {
+			oldest[i] = i
+		}
+		q.drop(oldest, retryDropSize)
+		q.forgetIdle()
+	}
+	err := q.save()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// managedNext drops the expired entries, and returns the oldest entry whose
+// destination is not backing off. If there is none, it returns the time at
+// which the next entry becomes due or expires, which is zero if the queue is
+// empty.
+func (q *retryQueue) managedNext(now time.Time) (*retryEntry, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.evictExpired(now) {
+		q.forgetIdle()
+		if err := q.save(); err != nil {
+			q.gcas.logger.Errorf("unable to update the %v queue: %v", q.staticConfig.name, err)
+		}
+	}
+	var next time.Time
+	for _, e := range q.entries {
+		rd, backingOff := q.destinations[e.Destination]
+		if !backingOff || !rd.NextAttempt.After(now) {
+			return e, time.Time{}
+		}
+		if next.IsZero() || rd.NextAttempt.Before(next) {
+			next = rd.NextAttempt
+		}
+		if expires := e.Queued.Add(q.staticConfig.maxAge); expires.Before(next) {
+			next = expires
+		}
+	}
+	return nil, next
+}
+
+// managedFinish removes an entry that was delivered, or backs off the
+// destination of an entry that failed. Entries that were dropped while they
+// were being sent only update the backoff.
+func (q *retryQueue) managedFinish(e *retryEntry, delivered bool, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if delivered {
+		delete(q.destinations, e.Destination)
+		for i, queued := range q.entries {
+			if queued == e {
+				q.entries = append(q.entries[:i], q.entries[i+1:]...)
+				break
+			}
+		}
+		return q.save()
+	}
+
+	// The backoff doubles with every failure, up to the maximum, and
+	// the jitter picks a time in its second half.
+	rd, exists := q.destinations[e.Destination]
+	if !exists {
+		rd = &retryDestination{}
+		q.destinations[e.Destination] = rd
+	}
+	backoff := retryQueueMaxBackoff
+	if rd.Failures < 20 && retryQueueBackoff<<rd.Failures < backoff {
+		backoff = retryQueueBackoff << rd.Failures
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	rd.Failures++
+	rd.NextAttempt = now.Add(backoff)
+	e.Attempts++
+	return q.save()
+}
+
+// managedBacklog returns the backlog of every destination that has entries
+// waiting, in order of destination. Destinations with the same label are
+// reported together.
+func (q *retryQueue) managedBacklog(now time.Time) []RetryQueueBacklog {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	byLabel := make(map[string]*RetryQueueBacklog)
+	for _, e := range q.entries {
+		label := retryDestinationLabel(e.Destination)
+		b, exists := byLabel[label]
+		if !exists {
+			b = &RetryQueueBacklog{Queue: q.staticConfig.name, Destination: label}
+			byLabel[label] = b
+		}
+		if rd, exists := q.destinations[e.Destination]; exists && rd.Failures > b.Failures {
+			b.Failures = rd.Failures
+		}
+		b.Depth++
+		if age := int64(now.Sub(e.Queued) / time.Second); age > b.OldestAgeSeconds {
+			b.OldestAgeSeconds = age
+		}
+	}
+	resp := make([]RetryQueueBacklog, 0, len(byLabel))
+	for _, b := range byLabel {
+		resp = append(resp, *b)
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Destination < resp[j].Destination })
+	return resp
+}
+
+// managedDropped returns the number of entries that were dropped since
+// startup, by reason.
+func (q *retryQueue) managedDropped() map[string]uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return map[string]uint64{
+		retryDropSize: q.dropped[retryDropSize],
+		retryDropAge:  q.dropped[retryDropAge],
+	}
+}
+
+// retryDestinationLabel returns the name of a destination that is safe to
+// show to monitoring. The path and the query of a webhook URL can carry a
+// secret, so only the scheme and the host are kept.
+func retryDestinationLabel(dest string) string {
+	u, err := url.Parse(dest)
+	if err != nil || u.Host == "" {
+		return dest
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// threadedDrainRetryQueue delivers the entries of a retry queue with the
+// provided function as they become due, until the server shuts down.
+func (gcas *GCAServer) threadedDrainRetryQueue(q *retryQueue, send func(*retryEntry) error) {
+	for {
+		e, next := q.managedNext(gcas.now())
+		if e != nil {
+			err := send(e)
+			if err != nil {
+				gcas.staticMetrics.RecordAlertFailure(q.staticConfig.name)
+				gcas.logger.WithFields("queue", q.staticConfig.name, "destination", retryDestinationLabel(e.Destination), "attempts", e.Attempts+1, "error", err).Warn("unable to deliver, retrying")
+			}
+			if err := q.managedFinish(e, err == nil, gcas.now()); err != nil {
+				gcas.logger.Errorf("unable to update the %v queue: %v", q.staticConfig.name, err)
+			}
+			select {
+			case <-gcas.tg.StopChan():
+				return
+			default:
+			}
+			continue
+		}
+
+		// Wait for the next entry to become due or expire, or for a
+		// new entry.
+		var fire <-chan time.Time
+		if !next.IsZero() {
+			fire = gcas.staticClock.After(next.Sub(gcas.now()))
+		}
+		select {
+		case <-gcas.tg.StopChan():
+			return
+		case <-q.wake:
+		case <-fire:
+		}
+	}
+}
+
+// managedRetryBacklog returns the backlog of every retry queue of the server.
+func (gcas *GCAServer) managedRetryBacklog() []RetryQueueBacklog {
+	backlog := []RetryQueueBacklog{}
+	now := gcas.now()
+	for _, q := range gcas.staticRetryQueues {
+		backlog = append(backlog, q.managedBacklog(now)...)
+	}
+	return backlog
+}
+
+// writeRetryQueueMetrics writes the backlogs and the drops of the retry queues
+// in the Prometheus text format.
+func (gcas *GCAServer) writeRetryQueueMetrics(w io.Writer) {
+	backlog := gcas.managedRetryBacklog()
+	fmt.Fprintln(w, "# HELP retry_queue_depth Deliveries waiting in a retry queue, by queue and destination.")
+	fmt.Fprintln(w, "# TYPE retry_queue_depth gauge")
+	for _, b := range backlog {
+		fmt.Fprintf(w, "retry_queue_depth{queue=\"%s\",destination=%q} %d\n", b.Queue, b.Destination, b.Depth)
+	}
+	fmt.Fprintln(w, "# HELP retry_queue_oldest_age_seconds Age of the oldest delivery waiting in a retry queue, by queue and destination.")
+	fmt.Fprintln(w, "# TYPE retry_queue_oldest_age_seconds gauge")
+	for _, b := range backlog {
+		fmt.Fprintf(w, "retry_queue_oldest_age_seconds{queue=\"%s\",destination=%q} %d\n", b.Queue, b.Destination, b.OldestAgeSeconds)
+	}
+	fmt.Fprintln(w, "# HELP retry_queue_dropped_total Deliveries that a retry queue dropped, by queue and reason.")
+	fmt.Fprintln(w, "# TYPE retry_queue_dropped_total counter")
+	for _, q := range gcas.staticRetryQueues {
+		dropped := q.managedDropped()
+		for _, reason := range []string{retryDropSize, retryDropAge} {
+			fmt.Fprintf(w, "retry_queue_dropped_total{queue=\"%s\",reason=\"%s\"} %d\n", q.staticConfig.name, reason, dropped[reason])
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server/clock/clocktest"
+)
+
+// TestRetryQueueEviction keeps a webhook down for longer than a week, and
+// checks that its queue drops the oldest deliveries once it is full and the
+// deliveries that got too old, that the webhook backs off instead of getting
+// one attempt per delivery, and that the backlog survives a restart and shows
+// up in the metrics and the health endpoint.
+func TestRetryQueueEviction(t *testing.T) {
+	c := clocktest.NewManual(time.Unix(glow.GenesisTime, 0).Add(30 * 24 * time.Hour))
+	opts := DefaultServerOptions()
+	opts.Clock = c
+	opts.RetryQueueMaxEntries = 5
+	opts.RetryQueueMaxAge = 7 * 24 * time.Hour
+	server, dir, _, _, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &signedWebhookReceiver{failing: true}
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+	config, _ := json.Marshal(webhookConfig{URLs: []string{receiverServer.URL + "/secret-token"}})
+	if err := os.WriteFile(filepath.Join(dir, WebhooksConfigFile), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	queue := func(n int) {
+		server.mu.Lock()
+		for i := 0; i < n; i++ {
+			server.queueAlert(PeerStatusEvent{Event: webhookEventPeerUnreachable, Location: "127.0.0.1"})
+		}
+		server.mu.Unlock()
+	}
+	attempts := func() int {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return receiver.attempts
+	}
+	backlog := func() RetryQueueBacklog {
+		for _, b := range server.managedRetryBacklog() {
+			if b.Queue == alertBackendWebhooks {
+				return b
+			}
+		}
+		return RetryQueueBacklog{}
+	}
+
+	// The first delivery fails, after which the webhook backs off, no
+	// matter how many deliveries are waiting.
+	queue(3)
+	waitFor(t, "the first attempt", func() bool { return backlog().Failures == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := attempts(); n != 1 {
+		t.Fatal("the webhook did not back off:", n)
+	}
+
+	// Two days in, the queue fills up and drops the oldest deliveries.
+	c.Advance(2 * 24 * time.Hour)
+	queue(4)
+	waitFor(t, "the second attempt", func() bool { return backlog().Failures == 2 })
+	b := backlog()
+	if b.Depth != 5 || b.OldestAgeSeconds != 2*24*3600 || b.Destination != receiverServer.URL {
+		t.Fatalf("unexpected backlog: %+v", b)
+	}
+	if dropped := server.staticWebhookQueue.managedDropped(); dropped[retryDropSize] != 2 || dropped[retryDropAge] != 0 {
+		t.Fatal("unexpected drops:", dropped)
+	}
+	_, hr, err := server.getHealthz()
+	if err != nil || len(hr.RetryQueues) != 1 || hr.RetryQueues[0] != b {
+		t.Fatalf("unexpected backlog in the health endpoint: %+v %v", hr.RetryQueues, err)
+	}
+	var metrics strings.Builder
+	server.writeRetryQueueMetrics(&metrics)
+	if strings.Contains(metrics.String(), "secret-token") || !strings.Contains(metrics.String(), "retry_queue_depth{queue=\"webhooks\",destination=\""+receiverServer.URL+"\"} 5\n") {
+		t.Fatal("unexpected metrics:", metrics.String())
+	}
+
+	// The backlog and the backoff survive a restart.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if b := backlog(); b.Depth != 5 || b.Failures != 2 {
+		t.Fatalf("the backlog did not survive the restart: %+v", b)
+	}
+
+	// After a week, the deliveries of the first day expire, and two days
+	// later the rest of them.
+	c.Advance(5*24*time.Hour + time.Second)
+	waitFor(t, "the first expiry", func() bool { return backlog().Depth == 4 })
+	c.Advance(2 * 24 * time.Hour)
+	waitFor(t, "the second expiry", func() bool { return backlog().Depth == 0 })
+	if dropped := server.staticWebhookQueue.managedDropped(); dropped[retryDropAge] != 5 {
+		t.Fatal("unexpected drops:", dropped)
+	}
+
+	// Once the webhook is back, new deliveries go out right away.
+	receiver.mu.Lock()
+	receiver.failing = false
+	receiver.mu.Unlock()
+	queue(1)
+	waitFor(t, "the delivery", func() bool {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return len(receiver.bodies) == 1
+	})
+	waitFor(t, "the empty queue", func() bool { return len(server.managedRetryBacklog()) == 0 })
+}
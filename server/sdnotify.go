@@ -0,0 +1,97 @@
+package server
+
+// sdnotify.go implements the parts of the systemd notify protocol that the
+// server uses, so that the server can run as a Type=notify unit with a
+// watchdog. The protocol is a single datagram per message on the unix socket
+// that systemd passes in NOTIFY_SOCKET, so it doesn't need libsystemd.
+//
+// The server sends READY=1 once every listener is bound and every persist
+// file is loaded, STOPPING=1 as soon as Close is called, and WATCHDOG=1 from a
+// heartbeat loop while the server is healthy. The heartbeat takes the main
+// mutex, which every loop of the server depends on, so a deadlocked server
+// stops sending heartbeats and gets restarted by systemd.
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The messages of the notify protocol.
+const (
+	sdNotifyReady    = "READY=1"
+	sdNotifyStopping = "STOPPING=1"
+	sdNotifyWatchdog = "WATCHDOG=1"
+)
+
+// sdNotify sends a message to the notify socket. A socket name that starts
+// with '@' is in the abstract namespace. An empty socket name means that the
+// server isn't running under systemd, and nothing is sent.
+func sdNotify(socket, state string) error {
+	if socket == "" {
+		return nil
+	}
+	name := socket
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("unable to dial notify socket: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("unable to write to notify socket: %v", err)
+	}
+	return nil
+}
+
+// parseWatchdogInterval converts the WATCHDOG_USEC and WATCHDOG_PID variables
+// that systemd sets into the interval that the watchdog expects a heartbeat
+// in. The interval is zero if the watchdog is disabled or meant for a
+// different process.
+func parseWatchdogInterval(usec, pid string) (time.Duration, error) {
+	if usec == "" {
+		return 0, nil
+	}
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(usec, 10, 63)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// managedNotifySystemd sends a message to systemd, logging any failure. The
+// notifications are best effort, a failure never stops the server.
+func (gcas *GCAServer) managedNotifySystemd(state string) {
+	if err := sdNotify(gcas.staticNotifySocket, state); err != nil {
+		gcas.logger.Warnf("unable to send %v to systemd: %v", state, err)
+	}
+}
+
+// threadedSystemdWatchdog sends a heartbeat to systemd at twice the rate that
+// the watchdog requires, skipping every beat in which the server is not
+// healthy.
+func (gcas *GCAServer) threadedSystemdWatchdog() {
+	ticker := gcas.staticClock.NewTicker(gcas.staticWatchdogInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gcas.tg.StopChan():
+			return
+		case <-ticker.C():
+		}
+		gcas.mu.Lock()
+		healthy := gcas.ready && !gcas.shuttingDown
+		gcas.mu.Unlock()
+		if healthy {
+			gcas.managedNotifySystemd(sdNotifyWatchdog)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens on a unix datagram socket the way that systemd
+// does, and returns the socket along with its name.
+func fakeNotifySocket(t *testing.T) (*net.UnixConn, string) {
+	t.Helper()
+	// Unix socket paths are limited to around 100 bytes, so the socket
+	// can't live in the test dir.
+	dir, err := os.MkdirTemp("", "sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	name := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, name
+}
+
+// readNotification reads the next message from the fake notify socket, and
+// returns an empty string if nothing arrives within the timeout.
+func readNotification(t *testing.T, conn *net.UnixConn, timeout time.Duration) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+// TestSdNotify checks the datagram writer against a fake notify socket.
+func TestSdNotify(t *testing.T) {
+	conn, name := fakeNotifySocket(t)
+	if err := sdNotify(name, sdNotifyReady); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readNotification(t, conn, time.Second); msg != sdNotifyReady {
+		t.Fatal("unexpected message:", msg)
+	}
+
+	// Sockets in the abstract namespace start with an '@'.
+	abstract := "@gca-sdnotify-" + strconv.Itoa(os.Getpid())
+	aconn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: "\x00" + abstract[1:], Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aconn.Close()
+	if err := sdNotify(abstract, sdNotifyWatchdog); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readNotification(t, aconn, time.Second); msg != sdNotifyWatchdog {
+		t.Fatal("unexpected message:", msg)
+	}
+
+	// Without a socket nothing is sent, and a missing socket is an error.
+	if err := sdNotify("", sdNotifyReady); err != nil {
+		t.Fatal(err)
+	}
+	if err := sdNotify(name+"-missing", sdNotifyReady); err == nil {
+		t.Fatal("expected an error for a missing socket")
+	}
+}
+
+// TestParseWatchdogInterval checks the parsing of the watchdog variables.
+func TestParseWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		interval  time.Duration
+		valid     bool
+	}{
+		{"", "", 0, true},
+		{"30000000", "", 30 * time.Second, true},
+		{"500", pid, 500 * time.Microsecond, true},
+		{"500", "1", 0, true},
+		{"soon", "", 0, false},
+		{"-5", "", 0, false},
+	}
+	for _, test := range tests {
+		interval, err := parseWatchdogInterval(test.usec, test.pid)
+		if (err == nil) != test.valid || interval != test.interval {
+			t.Errorf("%q %q: unexpected result %v %v", test.usec, test.pid, interval, err)
+		}
+	}
+}
+
+// TestSystemdNotifications checks that a server sends READY=1 once it has
+// started, sends heartbeats only while its mutex can be acquired, and sends
+// STOPPING=1 when it gets closed.
+func TestSystemdNotifications(t *testing.T) {
+	conn, name := fakeNotifySocket(t)
+	opts := DefaultServerOptions()
+	opts.NotifySocket = name
+	opts.WatchdogInterval = 100 * time.Millisecond
+	server, _, _, _, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := readNotification(t, conn, time.Second); msg != sdNotifyReady {
+		t.Fatal("expected the server to be ready:", msg)
+	}
+	if msg := readNotification(t, conn, time.Second); msg != sdNotifyWatchdog {
+		t.Fatal("expected a heartbeat:", msg)
+	}
+
+	// A stuck mutex stops the heartbeats.
+	server.mu.Lock()
+	readNotification(t, conn, 60*time.Millisecond) // A beat that was already past the lock
+	if msg := readNotification(t, conn, 300*time.Millisecond); msg != "" {
+		server.mu.Unlock()
+		t.Fatal("heartbeat was sent while the server was stuck:", msg)
+	}
+	server.mu.Unlock()
+	if msg := readNotification(t, conn, time.Second); msg != sdNotifyWatchdog {
+		t.Fatal("expected the heartbeats to resume:", msg)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg := readNotification(t, conn, time.Second)
+		if msg == sdNotifyStopping {
+			break
+		}
+		if msg != sdNotifyWatchdog {
+			t.Fatal("expected the server to be stopping:", msg)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package server
+
+// selftest.go contains the self test, which lets an operator check that the
+// environment of a new server is sane before starting it for real. The self
+// test never starts the listeners and never writes to the persist files, it
+// only looks at what the server would need at startup: a writable data
+// directory with space on it, key files that parse, ports that can be bound,
+// WattTime credentials that work, peers that can be reached, and a clock that
+// agrees with them.
+//
+// Every check either passes or fails with a hint on how to fix it. Hard checks
+// are the ones that keep the server from running correctly, the other checks
+// only warn, because for example a peer can be down for reasons that have
+// nothing to do with this server.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// SelfTestCheck is the outcome of one check of the self test.
+type SelfTestCheck struct {
+	Name   string
+	Passed bool
+	Hard   bool   // Whether a failure keeps the server from running correctly
+	Detail string // What the check found
+	Remedy string // How to fix a failure, empty if the check passed
+}
+
+// selfTestPass returns a check that passed.
+func selfTestPass(name string, detail string) SelfTestCheck {
+	return SelfTestCheck{Name: name, Passed: true, Detail: detail}
+}
+
+// selfTestFail returns a check that failed.
+func selfTestFail(name string, hard bool, detail string, remedy string) SelfTestCheck {
+	return SelfTestCheck{Name: name, Hard: hard, Detail: detail, Remedy: remedy}
+}
+
+// SelfTest runs every check of the self test against the server directory
+// and the options that the server would be started with.
+func SelfTest(dir string, opts ServerOptions) []SelfTestCheck {
+	checks := []SelfTestCheck{
+		selfTestDataDir(dir, opts),
+		selfTestKeyFiles(dir, opts),
+	}
+	checks = append(checks, selfTestPorts(opts)...)
+	checks = append(checks, selfTestWattTime(dir, opts))
+	return append(checks, selfTestPeers(dir, opts)...)
+}
+
+// SelfTestPassed returns whether none of the hard checks failed.
+func SelfTestPassed(checks []SelfTestCheck) bool {
+	for _, check := range checks {
+		if check.Hard && !check.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// selfTestDataDir checks that the server directory can be written to and has
+// enough free space. A directory that doesn't exist yet gets created at
+// startup, so its closest existing parent is checked instead.
+func selfTestDataDir(dir string, opts ServerOptions) SelfTestCheck {
+	const name = "data directory"
+	existing := dir
+	for {
+		info, err := os.Stat(existing)
+		if err == nil && !info.IsDir() {
+			return selfTestFail(name, true, existing+" is not a directory", "point --dir at a directory")
+		}
+		if err == nil || filepath.Dir(existing) == existing {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	f, err := os.CreateTemp(existing, ".self-test-")
+	if err != nil {
+		return selfTestFail(name, true, fmt.Sprintf("%v is not writable: %v", existing, err), "fix the permissions of the directory, or point --dir somewhere the server can write to")
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	free, err := diskFree(existing)
+	if err != nil {
+		return selfTestFail(name, true, fmt.Sprintf("unable to read the free space of %v: %v", existing, err), "check that the directory is on a mounted volume")
+	}
+	if min := opts.minFreeDisk(); free < min {
+		return selfTestFail(name, true, fmt.Sprintf("%v has %v bytes free, reports are refused below %v", existing, free, min), "free up space on the volume, or lower --min-free-disk")
+	}
+	detail := fmt.Sprintf("%v is writable and has %v bytes free", dir, free)
+	if existing != dir {
+		detail = fmt.Sprintf("%v will be created in %v, which is writable and has %v bytes free", dir, existing, free)
+	}
+	return selfTestPass(name, detail)
+}
+
+// selfTestStorage returns the storage that the server would read its files
+// from, or nil if the storage doesn't exist yet. A SQLite database is only
+// opened if it exists, so that the self test doesn't create one.
+func selfTestStorage(dir string, opts ServerOptions) (Storage, func(), error) {
+	if opts.Storage != nil {
+		return opts.Storage, func() {}, nil
+	}
+	if opts.StorageBackend != StorageBackendSQLite {
+		return defaultStorage(dir), func() {}, nil
+	}
+	path := filepath.Join(dir, SQLiteDatabaseFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, func() {}, nil
+	}
+	st, err := OpenSQLiteStorage(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return st, func() { st.Close() }, nil
+}
+
+// selfTestReadFile reads a file from the storage of the self test. A storage
+// that doesn't exist has no files.
+func selfTestReadFile(st Storage, name string) ([]byte, error) {
+	if st == nil {
+		return nil, os.ErrNotExist
+	}
+	return st.ReadFile(name)
+}
+
+// selfTestKeyFiles checks that the key files that exist parse. The keys of
+// the server are created at the first startup, and the GCA key arrives over
+// the API, but the temp key of the GCA has to be provisioned before the first
+// startup.
+func selfTestKeyFiles(dir string, opts ServerOptions) SelfTestCheck {
+	const name = "key files"
+	st, done, err := selfTestStorage(dir, opts)
+	if err != nil {
+		return selfTestFail(name, true, fmt.Sprintf("unable to open the storage: %v", err), "check the --storage setting and the database file")
+	}
+	defer done()
+
+	var found []string
+	for _, kf := range []struct {
+		file      string
+		size      int
+		mustExist bool
+		absent    string
+	}{
+		{ServerKeysFile, 96, false, "the server keys will be created at startup"},
+		{GCATempPubkeyFile, 32, true, ""},
+		{GCAPubkeyFile, 32, false, "the GCA key will be received over the API"},
+	} {
+		data, err := selfTestReadFile(st, kf.file)
+		if os.IsNotExist(err) && !kf.mustExist {
+			found = append(found, kf.absent)
+			continue
+		}
+		if os.IsNotExist(err) {
+			return selfTestFail(name, true, kf.file+" is missing", "copy the temp public key of the GCA into "+filepath.Join(dir, kf.file))
+		}
+		if err != nil {
+			return selfTestFail(name, true, fmt.Sprintf("unable to read %v: %v", kf.file, err), "fix the permissions of "+kf.file)
+		}
+		if len(data) != kf.size {
+			return selfTestFail(name, true, fmt.Sprintf("%v is %v bytes, expected %v", kf.file, len(data), kf.size), "restore "+kf.file+" from a backup, or remove it if it can be recreated")
+		}
+		found = append(found, kf.file+" is valid")
+	}
+	return selfTestPass(name, strings.Join(found, ", "))
+}
+
+// selfTestPorts checks that the ports of the listeners can be bound. Port 0
+// picks a free port, which always works.
+func selfTestPorts(opts ServerOptions) []SelfTestCheck {
+	httpAddr, tcpAddr, udpAddr, err := opts.bindAddrs()
+	if err != nil {
+		return []SelfTestCheck{selfTestFail("ports", true, err.Error(), "fix --http-addr, --tcp-addr, and --udp-addr")}
+	}
+	var checks []SelfTestCheck
+	for _, l := range []struct {
+		name    string
+		network string
+		addr    string
+		port    uint16
+		flag    string
+	}{
+		{"http port", "tcp", httpAddr, opts.HttpPort, "--http-port"},
+		{"tcp port", "tcp", tcpAddr, opts.TcpPort, "--tcp-port"},
+		{"udp port", "udp", udpAddr, opts.UdpPort, "--udp-port"},
+	} {
+		addr := net.JoinHostPort(l.addr, strconv.Itoa(int(l.port)))
+		var err error
+		if l.network == "udp" {
+			var conn net.PacketConn
+			if conn, err = net.ListenPacket("udp", addr); err == nil {
+				conn.Close()
+			}
+		} else {
+			var listener net.Listener
+			if listener, err = net.Listen("tcp", addr); err == nil {
+				listener.Close()
+			}
+		}
+		if err != nil {
+			checks = append(checks, selfTestFail(l.name, true, fmt.Sprintf("unable to bind %v: %v", addr, err), "stop whatever is using the port, or pick another one with "+l.flag))
+			continue
+		}
+		checks = append(checks, selfTestPass(l.name, addr+" can be bound"))
+	}
+	return checks
+}
+
+// selfTestWattTime checks that the WattTime credentials, if there are any, are
+// accepted by WattTime.
+func selfTestWattTime(dir string, opts ServerOptions) SelfTestCheck {
+	const name = "watttime"
+	usernamePath := filepath.Join(dir, "watttime_data", "username")
+	passwordPath := filepath.Join(dir, "watttime_data", "password")
+	_, errUser := os.Stat(usernamePath)
+	_, errPass := os.Stat(passwordPath)
+	if os.IsNotExist(errUser) && os.IsNotExist(errPass) {
+		return selfTestPass(name, "no credentials configured")
+	}
+	username, err := loadWattTimeCredentials(usernamePath)
+	if err != nil {
+		return selfTestFail(name, true, err.Error(), "put the WattTime username in "+usernamePath)
+	}
+	password, err := loadWattTimeCredentials(passwordPath)
+	if err != nil {
+		return selfTestFail(name, true, err.Error(), "put the WattTime password in "+passwordPath)
+	}
+	url := opts.WattTimeURL
+	if url == "" {
+		url = wattTimeAPIURL
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	if _, err := staticGetWattTimeToken(ctx, url, username, password); err != nil {
+		return selfTestFail(name, true, fmt.Sprintf("unable to log in to %v: %v", url, err), "check the credentials in watttime_data, and that the server can reach WattTime")
+	}
+	return selfTestPass(name, "logged in to "+url)
+}
+
+// selfTestPeers checks that every other server of the GCA can be reached, and
+// compares the clock against the first one that answers. A clock that is off
+// gets reports rejected as being from the future or the past.
+func selfTestPeers(dir string, opts ServerOptions) []SelfTestCheck {
+	st, done, err := selfTestStorage(dir, opts)
+	if err != nil {
+		return []SelfTestCheck{selfTestFail("peers", false, fmt.Sprintf("unable to open the storage: %v", err), "check the --storage setting and the database file")}
+	}
+	defer done()
+	var self glow.PublicKey
+	if data, err := selfTestReadFile(st, ServerKeysFile); err == nil && len(data) == 96 {
+		copy(self[:], data[:32])
+	}
+
+	// The file holds every update to the list, the latest entry of a
+	// server wins.
+	data, err := selfTestReadFile(st, AuthorizedServersFile)
+	if err != nil && !os.IsNotExist(err) {
+		return []SelfTestCheck{selfTestFail("peers", false, fmt.Sprintf("unable to read %v: %v", AuthorizedServersFile, err), "fix the permissions of "+AuthorizedServersFile)}
+	}
+	var keys []glow.PublicKey
+	latest := make(map[glow.PublicKey]AuthorizedServer)
+	for len(data) > 0 {
+		as, n, err := DeserializeAuthorizedServer(data)
+		if err != nil {
+			return []SelfTestCheck{selfTestFail("peers", false, fmt.Sprintf("%v is corrupt: %v", AuthorizedServersFile, err), "restore "+AuthorizedServersFile+" from a backup")}
+		}
+		if _, exists := latest[as.PublicKey]; !exists {
+			keys = append(keys, as.PublicKey)
+		}
+		latest[as.PublicKey] = as
+		data = data[n:]
+	}
+
+	var checks []SelfTestCheck
+	clock := selfTestPass("clock", "no peer to compare against")
+	compared := false
+	for _, key := range keys {
+		as := latest[key]
+		if as.Banned || key == self {
+			continue
+		}
+		name := "peer " + glow.HostPort(as.Location, as.HttpPort)
+		skew, err := selfTestClockSkew(as)
+		if err != nil {
+			checks = append(checks, selfTestFail(name, false, err.Error(), "check the firewall rules for outbound traffic, and whether the peer is up"))
+			continue
+		}
+		checks = append(checks, selfTestPass(name, "reachable"))
+		if compared {
+			continue
+		}
+		compared = true
+		if skew < -selfTestMaxClockSkew || skew > selfTestMaxClockSkew {
+			clock = selfTestFail("clock", true, fmt.Sprintf("%v off from %v", skew, name), "enable NTP on this machine, or fix the clock of the peer")
+		} else {
+			clock = selfTestPass("clock", fmt.Sprintf("%v off from %v", skew, name))
+		}
+	}
+	return append(checks, clock)
+}
+
+// selfTestClockSkew asks a peer for its time and returns how far the local
+// clock is ahead of it. The local time is taken at the middle of the request.
+func selfTestClockSkew(as AuthorizedServer) (time.Duration, error) {
+	client := http.Client{Timeout: selfTestTimeout}
+	start := time.Now()
+	resp, err := client.Get("http://" + glow.HostPort(as.Location, as.HttpPort) + "/api/v1/time")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	end := time.Now()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("the time request failed: %v", resp.Status)
+	}
+	var tr TimeResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&tr); err != nil {
+		return 0, fmt.Errorf("unable to decode the time: %v", err)
+	}
+	local := start.Add(end.Sub(start) / 2)
+	return local.Sub(time.UnixMilli(tr.UnixMilli)), nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/watttime/mock"
+)
+
+// TestSelfTest runs every check of the self test against a directory that
+// passes it and against one that breaks it.
+func TestSelfTest(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	opts := DefaultServerOptions()
+	st := serverStorage(dir)
+
+	// The data directory has to be writable and have space, a directory
+	// that doesn't exist yet is checked through its parent.
+	if check := selfTestDataDir(dir, opts); !check.Passed {
+		t.Fatal("the data directory failed:", check.Detail)
+	}
+	if check := selfTestDataDir(filepath.Join(dir, "a", "b"), opts); !check.Passed {
+		t.Fatal("a missing data directory failed:", check.Detail)
+	}
+	full := opts
+	full.MinFreeDisk = 1 << 62
+	if check := selfTestDataDir(dir, full); check.Passed || !check.Hard {
+		t.Fatal("a full disk passed:", check.Detail)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if check := selfTestDataDir(filepath.Join(dir, "file"), opts); check.Passed {
+		t.Fatal("a file passed as the data directory")
+	}
+
+	// The temp key of the GCA has to be there, the other keys only need
+	// to parse if they exist.
+	if check := selfTestKeyFiles(dir, opts); check.Passed || !check.Hard {
+		t.Fatal("a missing temp key passed")
+	}
+	if err := st.WriteFile(GCATempPubkeyFile, make([]byte, 32), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if check := selfTestKeyFiles(dir, opts); !check.Passed {
+		t.Fatal("the key files failed:", check.Detail)
+	}
+	if err := st.WriteFile(ServerKeysFile, make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if check := selfTestKeyFiles(dir, opts); check.Passed {
+		t.Fatal("a truncated server key passed")
+	}
+	if err := st.WriteFile(ServerKeysFile, make([]byte, 96), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A port that is taken fails, a free one passes.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ports := opts
+	ports.HttpPort = uint16(l.Addr().(*net.TCPAddr).Port)
+	checks := selfTestPorts(ports)
+	if len(checks) != 3 || checks[0].Passed || !checks[1].Passed || !checks[2].Passed {
+		t.Fatalf("unexpected port checks: %+v", checks)
+	}
+
+	// WattTime is only checked if there are credentials.
+	if check := selfTestWattTime(dir, opts); !check.Passed {
+		t.Fatal("missing credentials failed:", check.Detail)
+	}
+	wtDir := filepath.Join(dir, "watttime_data")
+	if err := os.MkdirAll(wtDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(wtDir, "username"), []byte("user\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if check := selfTestWattTime(dir, opts); check.Passed {
+		t.Fatal("a missing password passed")
+	}
+	if err := os.WriteFile(filepath.Join(wtDir, "password"), []byte("pass\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wattTime := mock.NewServer()
+	wt := opts
+	wt.WattTimeURL = wattTime.URL()
+	if check := selfTestWattTime(dir, wt); !check.Passed {
+		t.Fatal("the mock WattTime failed:", check.Detail)
+	}
+	wattTime.Close()
+	if check := selfTestWattTime(dir, wt); check.Passed || !check.Hard {
+		t.Fatal("an unreachable WattTime passed")
+	}
+
+	// A peer that is down only warns, and the clock is compared against
+	// the first peer that answers.
+	var offset atomic.Int64
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(TimeResponse{UnixMilli: time.Now().Add(time.Duration(offset.Load())).UnixMilli()})
+	}))
+	defer peer.Close()
+	_, portStr, _ := net.SplitHostPort(peer.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	var data []byte
+	for i, p := range []int{1, port} {
+		as := AuthorizedServer{Location: "127.0.0.1", HttpPort: uint16(p)}
+		as.PublicKey[0] = byte(i + 1)
+		data = append(data, as.Serialize()...)
+	}
+	if err := st.WriteFile(AuthorizedServersFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checks = selfTestPeers(dir, opts)
+	if len(checks) != 3 || checks[0].Passed || checks[0].Hard || !checks[1].Passed || !checks[2].Passed {
+		t.Fatalf("unexpected peer checks: %+v", checks)
+	}
+	offset.Store(int64(time.Hour))
+	checks = selfTestPeers(dir, opts)
+	if clock := checks[len(checks)-1]; clock.Passed || !clock.Hard {
+		t.Fatalf("a skewed clock passed: %+v", clock)
+	}
+	if SelfTestPassed(SelfTest(dir, opts)) {
+		t.Fatal("the self test passed with a skewed clock")
+	}
+	offset.Store(0)
+	if checks := SelfTest(dir, opts); !SelfTestPassed(checks) {
+		t.Fatalf("the self test failed: %+v", checks)
+	}
+}
@@ -7,7 +7,8 @@ package server
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -53,15 +54,56 @@ import (
 
 // GCAServer defines the structure for our Glow Certification Agent Server.
 type GCAServer struct {
-	equipment              map[uint32]glow.EquipmentAuthorization // Map from a ShortID to the full equipment authorization
-	equipmentShortID       map[glow.PublicKey]uint32              // Map from a public key to a ShortID
-	equipmentBans          map[uint32]struct{}                    // Tracks which equipment is banned
-	equipmentImpactRate    map[uint32]*[4032]float64              // Tracks the number of micrograms of CO2 offset per WattHour of energy
-	equipmentMigrations    map[glow.PublicKey]EquipmentMigration  // Keeps track of migration orders that have been given to equipment
-	equipmentReports       map[uint32]*[4032]glow.EquipmentReport // Keeps all recent reports in memory
-	equipmentReportsOffset uint32                                 // What timeslot the equipmentReports arrays start at
-	equipmentStatsHistory  []AllDeviceStats                       // A history of all the stats that were collected for each device
-	equipmentHistoryOffset uint32                                 // Establishes the first timeslot where history is available
+	equipment                 map[uint32]glow.EquipmentAuthorization      // Map from a ShortID to the full equipment authorization
+	equipmentShortID          map[glow.PublicKey]uint32                   // Map from a public key to a ShortID
+	equipmentBans             map[uint32]struct{}                         // Tracks which equipment is banned
+	equipmentBanProofs        map[uint32]EquivocationProof                // Proofs for the equipment that was banned for signing conflicting reports
+	equipmentBanAuths         map[uint32][]glow.EquipmentAuthorization    // The conflicting authorizations of the equipment that the GCA banned
+	equipmentBanRecords       map[uint32]equipmentBanRecord               // The reason and timeslot of every ban
+	bannedDevices             map[uint32]*bannedDevice                    // The reports that banned equipment sent before its ban, see ban_accounting.go
+	equipmentImpactRate       map[uint32]*[4032]float64                   // Tracks the number of micrograms of CO2 offset per WattHour of energy
+	equipmentMigrations       map[glow.PublicKey]EquipmentMigration       // Keeps track of migration orders that have been given to equipment
+	equipmentDeauthorizations map[glow.PublicKey]EquipmentDeauthorization // Equipment that the GCA has retired
+	deviceKeyRotations        map[glow.PublicKey][]DeviceKeyRotation      // The key rotations of every device, by authorization key, see api_device_key_rotation.go
+	deviceKeyOwners           map[glow.PublicKey]uint32                   // The ShortID of every key that a device rotated to
+	operatorDelegations       map[glow.PublicKey]OperatorDelegation       // The current delegation of every operator key
+	operatorReviewKeys        map[glow.PublicKey]struct{}                 // Operator keys that were ever allowed to review flagged reports
+	reportOverrides           map[uint32]map[uint32]ReportOverride        // The current override of every corrected timeslot, by ShortID and timeslot
+	equipmentImports          map[uint32]equipmentImport                  // Equipment that was imported from another GCA, by the ShortID on this server
+	equipmentRegions          map[glow.PublicKey]EquipmentRegion          // The WattTime region that the GCA assigned to equipment
+	deviceNotes               map[glow.PublicKey][]DeviceNote             // The notes of the GCA on every device, oldest first, see device_notes.go
+	locationPrivacy           map[glow.PublicKey]string                   // The location privacy that the notes of the GCA set, see location_privacy.go
+	impactFlags               map[uint32]map[uint32]uint8                 // The flags of every impact rate that was filled from stale data, by device and timeslot
+	shortIDOwners             map[uint32]glow.PublicKey                   // The public key that every ShortID was first allocated to
+	shortIDHighWater          uint32                                      // The highest ShortID that was ever allocated
+	equipmentReports          map[uint32]*deviceReports                   // Keeps all recent reports in memory, see report_store.go
+	equipmentReportsOffset    uint32                                      // What timeslot the equipmentReports arrays start at
+	oldestPeriodFinalized     bool                                        // Whether the oldest week in equipmentReports is finalized, see period_finalization.go
+	reportsFile               StorageFile                                 // Read handle on the reports file, for loading signatures
+	reportsFileRecords        uint32                                      // The number of records in the reports file
+	reportsJournalRecords     uint32                                      // The number of records in the reports journal
+	equipmentStatsHistory     []AllDeviceStats                            // The weeks of the stats history that are kept in memory, see history_retention.go
+	equipmentHistoryEvicted   int                                         // The number of weeks at the start of the history that are only on disk
+	equipmentHistoryPositions []int64                                     // The position of every week of the history in the history file
+	equipmentHistorySize      int64                                       // The size of the history file
+	staticStatsHistoryLoaded  chan struct{}                               // Closed once the stats history has been loaded, see startup_load.go
+	equipmentHistoryOffset    uint32                                      // Establishes the first timeslot where history is available
+	equipmentLastSeen         map[uint32]uint32                           // The most recent timeslot that each device has reported for
+	devicePresence            map[uint32]*devicePresence                  // The heartbeats of every device, by ShortID, see heartbeats.go
+	reportReceipts            map[uint32]*reportReceipts                  // When the reports of every device were received, by ShortID, see report_receipts.go
+	equipmentOffline          map[uint32]struct{}                         // Devices that the offline webhooks have reported as offline
+	equipmentExpiryWarned     map[uint32]uint32                           // The expiry that the webhooks were last warned about for each device
+	equipmentNonces           map[uint64]struct{}                         // The nonces of every saved authorization
+	flaggedReports            map[reportSlot]glow.EquipmentReport         // Reports that exceeded their capacity and await review
+	flaggedReportReviews      map[reportSlot]FlaggedReportReview          // The decisions of the GCA about flagged reports
+	anomalies                 map[uint32][]Anomaly                        // The anomalies of every device, see anomalies.go
+	anomalyDismissals         map[anomalyKey]AnomalyDismissal             // The dismissals of anomalies that the GCA signed
+	peerStatus                map[glow.PublicKey]*PeerStatus              // The results of the probes of the other servers, see peer_health.go
+
+	// The state of the WattTime integration, see watttime_series.go.
+	wattTimeCaches      map[string]*wattTimeCache
+	wattTimeLastSuccess time.Time
+	wattTimeBackfilled  uint64
 
 	recentEquipmentAuths []glow.EquipmentAuthorization // Keep recent auths to more easily synchronize with redundant servers
 	recentReports        []glow.EquipmentReport        // Keep recent reports to more easily synchronize with redundant servers
@@ -79,27 +121,251 @@ type GCAServer struct {
 	gcaPubkeyAvailable bool
 	gcaTempKey         glow.PublicKey
 
+	// The signed handoffs from the registered GCA key to each of its
+	// successors, see api_gca_key_rotation.go.
+	gcaKeyRotations []GCAKeyRotation
+
 	// We need to track other servers so that clients who ping us for a
 	// list of backup servers have something they can retrieve.
 	gcaServers AuthorizedServers
 
+	// The record of every privileged action, see audit_log.go.
+	auditLog auditLog
+
+	// The signed Merkle roots of the reports of past weeks, oldest
+	// first, see report_roots.go.
+	reportRoots []ReportRoot
+
 	// These are the signing keys for the GCA server. The GCA server will
 	// sign all GET requests so that the caller knows the data is
 	// authentic.
 	staticPrivateKey glow.PrivateKey
 	staticPublicKey  glow.PublicKey
+	staticSigner     glow.Signer // The parsed private key, for the report acks
 
 	baseDir        string         // Base directory for server files
 	logger         *Logger        // Custom logger for the server
 	httpServer     *http.Server   // Web server for handling API requests
 	httpPort       uint16         // Records the port that is being used to serve the api
 	mux            *http.ServeMux // Routing for HTTP requests
+	routes         []Route        // The routes on the mux, in order of registration, see api_spec.go
 	skipInvariants bool           // If set to true, 'CheckInvariants()' will not run on Close()
 	udpPort        uint16         // The port that the UDP conn is listening on
+	udpListener    udpListener    // The socket of the UDP listener, see report_listener_udp.go
 	tcpPort        uint16         // The port that the TCP listener is using
 	allowIntApis   bool           // Enables bench testing the server with production settings
-	mu             sync.Mutex
+	reportsJournal StorageLog     // The open journal that new reports get appended to
+	impactRatesLog *appendLog     // The open log that changed impact rates get appended to
+	heartbeatsLog  *appendLog     // The open log that heartbeats get appended to
+	receiptsLog    *appendLog     // The open log that report receipts get appended to
+	mu             sync.RWMutex   // Read-only handlers only take the read lock
 	tg             threadgroup.ThreadGroup
+	components     componentRegistry // The background loops, see components.go
+
+	// Readiness tracking, used by the healthz endpoint. The server is only
+	// ready once all of the listeners and persist files are initialized,
+	// and stops being ready as soon as Close() is called.
+	ready           bool
+	shuttingDown    bool
+	lastSyncTime    time.Time // The last time a sync request was served successfully
+	staticStartTime time.Time
+
+	// staticClock is the source of the current time, see clock.go.
+	staticClock *serverClock
+
+	// staticStorage holds the persist files, see storage.go.
+	staticStorage Storage
+
+	// Changes every time the reports or the equipment change, see
+	// api_etag.go.
+	stateVersion uint64
+	staticBootID string
+
+	// The most recent changes to the state, for the stats delta, see
+	// api_stats_delta.go.
+	stateChanges *stateChangeLog
+
+	// The timestamp of the last backup request, which keeps backup
+	// requests from being replayed, see api_backup.go.
+	lastBackupTimestamp int64
+
+	// The rate limits of the other servers that open sync sessions with
+	// this server, see peer_sync.go.
+	peerSyncLimiters map[glow.PublicKey]*glow.RateLimiter
+
+	// Operational counters, exposed through the metrics endpoint. The
+	// metrics object is lock-free and can be used while holding the mutex.
+	staticMetrics *metrics
+
+	// Fans accepted reports out to the report stream. The broadcaster has
+	// its own mutex, and cannot be used while holding the server mutex.
+	staticReportStream *reportBroadcaster
+
+	// staticWebhookQueue holds the webhook deliveries that have not
+	// succeeded yet, see webhook_queue.go.
+	staticWebhookQueue *retryQueue
+
+	// staticRetryQueues are the queues of the webhooks and of the alert
+	// backends, and the limits of each, see retry_queue.go.
+	staticRetryQueues          []*retryQueue
+	staticRetryQueueMaxEntries int
+	staticRetryQueueMaxAge     time.Duration
+
+	// staticAlerters are the alert backends by name, see alerts.go.
+	staticAlerters map[string]Alerter
+
+	// The percentage that reports may exceed the capacity of their
+	// equipment by before getting flagged for review.
+	staticCapacityTolerance uint64
+
+	// The modes of the configurable validation rules, and the devices
+	// that failed a rule in warn mode by rule and ShortID, see
+	// validation_rules.go.
+	staticValidationModes map[string]ValidationMode
+	validationWarnings    map[string]map[uint32]*ValidationWarning
+
+	// Makes the v1 handlers return plain text errors, see api_errors.go.
+	staticLegacyErrors bool
+
+	// Limits the internal APIs to callers on a loopback address.
+	staticLoopbackIntApis bool
+
+	// Registers the debug endpoints outside of internal test mode.
+	staticDebug bool
+
+	// The settings that Reload can change, see reload.go. The log level
+	// and the rate limits live in the logger and the report limiter, the
+	// rest is guarded by the mutex. reloadMu keeps reloads from
+	// interleaving.
+	staticDefaultLogLevel LogLevel
+	webhooks              webhookConfig
+	webhooksEnabled       bool
+	alerts                alertsConfig
+	wattTimeUsername      string
+	wattTimePassword      string
+	historyRetentionWeeks int
+	onlineTimeslots       uint32
+	anomalyThresholds     anomalyThresholds
+	reloadMu              sync.Mutex
+
+	// Serializes the migrations of the reports, which can be started by
+	// the migration thread and by a trim, see history_retention.go.
+	migrationMu sync.Mutex
+
+	// The WattTime region of equipment that the GCA did not assign a
+	// region to, see api_equipment_region.go.
+	staticDefaultRegion string
+
+	// Whether devices without a location privacy of their own are
+	// private, and how their coordinates get redacted, see
+	// location_privacy.go.
+	staticPrivateLocations  bool
+	staticLocationRedaction LocationRedaction
+
+	// The base URL of the WattTime API.
+	staticWattTimeURL string
+
+	// The WattTime credentials from the options, which take precedence
+	// over the credential files if they are set.
+	staticWattTimeUsername string
+	staticWattTimePassword string
+
+	// The systemd notify socket and watchdog interval, see sdnotify.go.
+	staticNotifySocket     string
+	staticWatchdogInterval time.Duration
+
+	// The number of timeslots that a report may be behind or ahead of the
+	// current timeslot.
+	staticReportPastWindow   uint32
+	staticReportFutureWindow uint32
+
+	// The number of timeslots after the end of a week at which the week
+	// gets finalized, see period_finalization.go.
+	staticFinalizationDelay uint32
+
+	// The number of timeslots past the activation of a device key rotation
+	// in which the old key still gets accepted, see
+	// api_device_key_rotation.go.
+	staticKeyRotationOverlap uint32
+
+	// Whether the server records when it received every report, and the
+	// number of timeslots after which a report counts as late, see
+	// report_receipts.go.
+	staticRecordReceipts      bool
+	staticLateReportThreshold uint32
+
+	// The state of the storage, see persist_health.go. persistHook is
+	// called before every write of a report, tests use it to simulate a
+	// failing disk.
+	unpersistedReports []unpersistedReport
+	persistErr         error // The last failed write, nil once every queued report was written
+	lowDisk            bool
+	diskFree           uint64
+	persistHook        func(file string) error
+	staticMinFreeDisk  uint64
+
+	// The budgets of report packets on the UDP listener. The limiter is
+	// lock-free and can be used while holding the mutex. The defaults are
+	// the limits from the options, which Reload falls back to for the
+	// limits that server-config.json leaves out.
+	staticReportLimiter          *reportLimiter
+	staticDefaultDeviceInterval  time.Duration
+	staticDefaultDeviceBurst     int64
+	staticDefaultUnknownInterval time.Duration
+	staticDefaultUnknownBurst    int64
+
+	// The body size caps and the per IP budgets of the HTTP API, see
+	// api_limits.go.
+	staticAPILimits *apiLimits
+
+	// The snapshots that the all-device-stats endpoints are served from,
+	// and how long a snapshot may be served after the state changed, see
+	// stats_snapshot.go.
+	staticStatsSnapshots      *statsSnapshotCache
+	staticStatsSnapshotMaxAge time.Duration
+
+	// The snapshots that the cursors of paged listings point into, and how
+	// long they are kept, see page_cursors.go.
+	staticPageSnapshots *pageSnapshotCache
+	staticPageCursorTTL time.Duration
+
+	// The operational timeline of the server, see server_timeline.go.
+	staticTimeline *serverTimeline
+
+	// The archives of the weeks before the reporting window that are kept
+	// in memory, in order, and how many weeks are kept, see
+	// retained_periods.go.
+	retainedPeriods       []ReportArchive
+	staticRetainedPeriods int
+
+	// The browser origins that may call the HTTP API, see api_cors.go.
+	staticCORS corsPolicy
+
+	// The recently seen request signatures, see api_auth.go.
+	staticRequestAuth requestAuthenticator
+
+	// The budget of time probes on the UDP listener, shared by everyone.
+	staticTimeProbes rateBucket
+
+	// The UDP packets that are waiting for a report worker, see
+	// report_pipeline.go.
+	staticReportQueue chan reportPacket
+
+	// The packets that were queued for the report workers and haven't been
+	// processed yet, see drainUDPReports.
+	pendingReportPackets atomic.Int64
+
+	// The certificate of the HTTP API, nil if the API doesn't serve TLS.
+	staticTLS *certReloader
+
+	// Canceled as soon as Close() is called, see shutdown.go.
+	staticShutdownCtx    context.Context
+	staticCancelShutdown context.CancelFunc
+
+	// The GCAs that this server hosts, and the host of this server if it
+	// is a tenant, see tenants.go.
+	staticTenants    []tenant
+	staticTenantHost *GCAServer
 
 	ApiArchiveRateLimiter *glow.RateLimiter // Rate limiter for the /archive endpoint.
 }
@@ -111,26 +377,52 @@ type GCAServer struct {
 // The function will create this directory if it does not exist. internalTestMode
 // sets a higher default logging level, and enables internal APIs.
 func NewGCAServer(baseDir string, internalTestMode bool) (*GCAServer, error) {
-	// Create the directory if it doesn't exist
-	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
+	return NewGCAServerWithOptions(baseDir, internalTestMode, DefaultServerOptions())
+}
+
+// NewGCAServerWithOptions is the same as NewGCAServer, except that the caller
+// can override the default server settings.
+func NewGCAServerWithOptions(baseDir string, internalTestMode bool, opts ServerOptions) (_ *GCAServer, err error) {
+	// Create the directory if it doesn't exist. If something other than a
+	// directory is already sitting at the path, refuse to start rather
+	// than failing in a confusing way when the first persist file gets
+	// created.
+	info, err := os.Stat(baseDir)
+	if os.IsNotExist(err) {
 		if err := os.MkdirAll(baseDir, 0755); err != nil {
 			return nil, fmt.Errorf("Failed to create base directory: %v", err)
 		}
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to stat base directory: %v", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("base directory path %v exists but is not a directory", baseDir)
 	}
 
-	// Initialize GCAServer with the necessary fields
-	server := &GCAServer{
-		baseDir:               baseDir,
-		equipment:             make(map[uint32]glow.EquipmentAuthorization),
-		equipmentShortID:      make(map[glow.PublicKey]uint32),
-		equipmentBans:         make(map[uint32]struct{}),
-		equipmentImpactRate:   make(map[uint32]*[4032]float64),
-		equipmentMigrations:   make(map[glow.PublicKey]EquipmentMigration),
-		equipmentReports:      make(map[uint32]*[4032]glow.EquipmentReport),
-		recentReports:         make([]glow.EquipmentReport, 0, maxRecentReports),
-		ApiArchiveRateLimiter: glow.NewRateLimiter(apiArchiveLimit, apiArchiveRate),
-		allowIntApis:          internalTestMode,
+	httpAddr, tcpAddr, udpAddr, err := opts.bindAddrs()
+	if err != nil {
+		return nil, err
+	}
+	reportWorkers, err := opts.reportWorkers()
+	if err != nil {
+		return nil, err
 	}
+	server, err := newGCAServer(baseDir, internalTestMode, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the directory for as long as the server runs, which keeps a
+	// second server and the read-only opens out of it, see dir_lock.go.
+	unlock, err := lockServerDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			unlock()
+		}
+	}()
+	server.tg.AfterStop(unlock)
 	if testMode {
 		// Create a background thread that will print out the name of the
 		// server if the server hasn't been shut down after 120 seconds.
@@ -142,26 +434,70 @@ func NewGCAServer(baseDir string, internalTestMode bool) (*GCAServer, error) {
 	}
 
 	// Create the logger and provision its shutdown.
-	loggerPath := filepath.Join(baseDir, "server.log")
-	logger, err := NewLogger(defaultLogLevel, loggerPath)
-	if err != nil {
-		return nil, fmt.Errorf("Logger initialization failed: %v", err)
+	var logger *Logger
+	if opts.LogStdout {
+		logger = NewStdoutLogger(defaultLogLevel)
+	} else {
+		loggerPath := filepath.Join(baseDir, "server.log")
+		logger, err = NewLogger(defaultLogLevel, loggerPath)
+		if err != nil {
+			return nil, fmt.Errorf("Logger initialization failed: %v", err)
+		}
 	}
 	server.tg.AfterStop(func() error {
 		return logger.Close()
 	})
+
+	// Open the storage. A storage that the server opened itself gets
+	// closed after everything else has stopped writing to it.
+	server.staticStorage = opts.Storage
+	if server.staticStorage == nil {
+		server.staticStorage, err = openStorage(baseDir, opts.StorageBackend)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open the storage: %v", err)
+		}
+		if c, ok := server.staticStorage.(io.Closer); ok {
+			server.tg.AfterStop(c.Close)
+		}
+	}
+	logger.format = opts.LogFormat
+	logMaxSize, logMaxFiles := opts.LogMaxSize, opts.LogMaxFiles
+	if logMaxSize == 0 {
+		logMaxSize = DefaultLogMaxSize
+	} else if logMaxSize < 0 {
+		logMaxSize = 0
+	}
+	if logMaxFiles <= 0 {
+		logMaxFiles = DefaultLogMaxFiles
+	}
+	logger.SetRotation(logMaxSize, logMaxFiles)
 	server.logger = logger
 
+	// Stop the background loops once everything that was registered
+	// after this, the listeners in particular, has been stopped.
+	server.tg.OnStop(server.stopComponents)
+
 	if internalTestMode {
-		server.logger.level = INFO
+		server.logger.SetLevel(INFO)
+	}
+	server.staticDefaultLogLevel = server.logger.Level()
+
+	// Clean up any temp files that were left behind by a crash in the
+	// middle of a write. The persist files themselves are always intact.
+	if err := server.removeStaleTmpFiles(baseDir); err != nil {
+		return nil, fmt.Errorf("unable to remove stale temp files: %v", err)
 	}
 
 	// Create the http server and provision its shutdown.
+	server.staticTLS, err = loadTLSCertificate(baseDir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up tls: %v", err)
+	}
 	server.mux = http.NewServeMux()
 	server.httpServer = &http.Server{
-		Addr:        serverIP + ":" + strconv.Itoa(httpPort),
-		Handler:     server.mux,
-		ReadTimeout: serverShutdownTime / 2,
+		Addr:        net.JoinHostPort(httpAddr, strconv.Itoa(int(opts.HttpPort))),
+		Handler:     server.routeTenants(server.logRequests(server.handleCORS(server.compressResponses(server.refuseDuringShutdown(server.limitRequests(server.authenticateRequests(server.redactLocations(server.mux)))))))),
+		ReadTimeout: httpReadTimeout,
 	}
 	server.tg.OnStop(func() error {
 		// There's an error in one of the tests where the server
@@ -187,62 +523,44 @@ func NewGCAServer(baseDir string, internalTestMode bool) (*GCAServer, error) {
 		err := server.httpServer.Shutdown(ctx)
 		stopped.Store(true)
 		if err != nil {
+			// The handlers that didn't finish in time get their
+			// connections cut.
+			server.httpServer.Close()
 			server.logger.Errorf("HTTP server shutdown error: %v", err)
 			return fmt.Errorf("error shutting down the http server: %v", err)
 		}
 		return nil
 	})
 
-	// Load the GCA Server keys.
-	server.staticPublicKey, server.staticPrivateKey, err = server.loadGCAServerKeys()
+	historySize, historyEntries, err := server.loadState()
 	if err != nil {
-		return nil, fmt.Errorf("failed to load gca server keys: %v", err)
-	}
-	// Load the temporary Glow Certification Agent public key.
-	if err := server.loadGCATempKey(); err != nil {
-		return nil, fmt.Errorf("failed to load GCA public key: %v", err)
-	}
-	// Load the Glow Certification Agent permanent public key
-	if err := server.loadGCAPubkey(); err != nil {
-		return nil, fmt.Errorf("failed to load GCA public key: %v", err)
+		return nil, err
 	}
-	// Load equipment public keys
-	if err := server.loadEquipment(); err != nil {
-		return nil, fmt.Errorf("failed to load server equipment: %v", err)
-	}
-	// Load the historic data for the equipment. This will also set the
-	// 'equipmentReportsOffset` value.
-	if err := server.loadEquipmentHistory(); err != nil {
-		return nil, fmt.Errorf("failed to load server equipment history: %v", err)
-	}
-	// Load all equipment reports
-	if err := server.loadEquipmentReports(); err != nil {
-		return nil, fmt.Errorf("failed to load equipment reports: %v", err)
+	if err := server.startServerTimeline(); err != nil {
+		return nil, err
 	}
-	// TODO: Load the persisted list of authorized servers.
-	//
 	// TODO: Sync with all of the other servers and get their latest
 	// equipmentReports before starting the threadedMigrateReports loop
 	// which will permanently archive our data and prevent it from being
 	// used again.
 
-	// Load the watttime credentials.
-	wtUsernamePath := filepath.Join(server.baseDir, "watttime_data", "username")
-	wtPasswordPath := filepath.Join(server.baseDir, "watttime_data", "password")
-	username, err := loadWattTimeCredentials(wtUsernamePath)
+	// Load the settings that can be changed at runtime, which include the
+	// webhooks and the watttime credentials.
+	rc, ignored, err := server.loadRuntimeConfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to load username: %v", err)
+		return nil, err
 	}
-	password, err := loadWattTimeCredentials(wtPasswordPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load password: %v", err)
+	server.applyRuntimeConfig(rc)
+	for _, key := range ignored {
+		server.logger.Warnf("ignoring %v in %v, it can only be set with a flag", key, ServerConfigFile)
 	}
+	username, password := rc.wattTimeUsername, rc.wattTimePassword
 
 	// Immediately grab all of the data for the most recent week to catch
 	// up on anything that was missed. This runs in a background thread to
 	// avoid blocking startup.
-	server.tg.Launch(func() {
-		err = server.managedGetWattTimeWeekData(username, password)
+	server.launchComponent("watttime-catch-up", nil, func() {
+		err := server.managedGetWattTimeWeekData(username, password)
 		if err != nil {
 			// This is unfortunate, but this is not cause to abort startup,
 			// so we'll just log an error.
@@ -250,56 +568,406 @@ func NewGCAServer(baseDir string, internalTestMode bool) (*GCAServer, error) {
 		}
 	})
 
+	// Open the tenants before the listeners, which hand them their
+	// traffic.
+	if err := server.openTenants(opts.Tenants, internalTestMode, opts); err != nil {
+		return nil, err
+	}
+
 	// Start the background threads for various server functionalities.
-	server.launchUDPServer()
-	server.launchMigrateReports(username, password)
-	server.launchListenForSyncRequests()
-	server.tg.Launch(func() {
-		server.threadedCollectImpactData(username, password)
-	})
-	server.tg.Launch(func() {
-		server.threadedGetWattTimeWeekData(username, password)
-	})
+	server.launchUDPServer(udpAddr, opts.UdpPort, reportWorkers)
+	server.launchMigrateReports()
+	server.launchListenForSyncRequests(tcpAddr, opts.TcpPort)
+	if !opts.DisableImpactCollection {
+		server.launchComponent("watttime-impact-data", nil, server.threadedCollectImpactData)
+	}
+	server.launchComponent("watttime-week-data", nil, server.threadedGetWattTimeWeekData)
+	server.launchComponent("journal-compaction", nil, server.threadedCompactReportsJournal)
+	server.managedCheckDiskSpace()
+	server.launchComponent("storage-watch", nil, server.threadedWatchStorage)
+	server.launchComponent("server-timeline", nil, server.threadedMarkAlive)
+	server.launchComponent("peer-sync", nil, server.threadedSyncWithPeers)
+	server.launchComponent("device-status", nil, server.threadedWatchDeviceStatus)
+	server.launchComponent("peer-health", nil, server.threadedMonitorPeers)
+	server.launchComponent("authorized-servers", nil, server.threadedWatchAuthorizedServers)
+	server.launchComponent("webhooks", nil, server.threadedDeliverWebhooks)
+	server.launchAlerters()
+	server.launchComponent("anomalies", nil, server.threadedDetectAnomalies)
+	server.launchComponent("api-limits", nil, server.threadedPruneAPILimits)
 	server.launchAPI()
+	server.launchComponent("stats-history-load", nil, func() {
+		server.threadedLoadEquipmentHistory(historySize, historyEntries)
+	})
+
+	// Now that all of the listeners are up, record which ports they are
+	// using so that provisioning tools can find them. A tenant uses the
+	// listeners of its host.
+	if server.staticTenantHost == nil {
+		if err := server.savePortsFile(); err != nil {
+			server.Close()
+			return nil, fmt.Errorf("unable to save ports file: %v", err)
+		}
+	}
+	server.mu.Lock()
+	server.ready = true
+	server.mu.Unlock()
+	server.managedNotifySystemd(sdNotifyReady)
+	if server.staticWatchdogInterval > 0 {
+		server.launchComponent("systemd-watchdog", nil, server.threadedSystemdWatchdog)
+	}
 
 	// Return the initialized server
 	return server, nil
 }
 
+// newGCAServer validates the options and returns a server with an empty state,
+// which NewGCAServerWithOptions and OpenStateReadOnly then load the state of
+// the directory into.
+func newGCAServer(baseDir string, internalTestMode bool, opts ServerOptions) (*GCAServer, error) {
+	retainedPeriods, err := opts.retainedPeriods()
+	if err != nil {
+		return nil, err
+	}
+	stateChangeBuffer, err := opts.stateChangeBuffer()
+	if err != nil {
+		return nil, err
+	}
+	reportPastWindow, reportFutureWindow, err := opts.reportWindows()
+	if err != nil {
+		return nil, err
+	}
+	finalizationDelay, err := opts.finalizationDelay(reportPastWindow)
+	if err != nil {
+		return nil, err
+	}
+	retryQueueMaxEntries, retryQueueMaxAge, err := opts.retryQueueLimits()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateRegion(opts.DefaultRegion); err != nil {
+		return nil, fmt.Errorf("invalid default region: %v", err)
+	}
+	if opts.LocationRedaction != LocationRedactionTruncate && opts.LocationRedaction != LocationRedactionOmit {
+		return nil, fmt.Errorf("unknown location redaction %d", opts.LocationRedaction)
+	}
+	if err := validateTenants(opts.Tenants); err != nil {
+		return nil, err
+	}
+	if err := validateValidationModes(opts.ValidationModes); err != nil {
+		return nil, err
+	}
+	validationModes := make(map[string]ValidationMode, len(opts.ValidationModes))
+	for rule, mode := range opts.ValidationModes {
+		validationModes[rule] = mode
+	}
+	if opts.WattTimeURL == "" {
+		opts.WattTimeURL = wattTimeAPIURL
+	}
+	clock := newServerClock(opts.Clock)
+
+	// Initialize GCAServer with the necessary fields
+	server := &GCAServer{
+		baseDir:                    baseDir,
+		equipment:                  make(map[uint32]glow.EquipmentAuthorization),
+		equipmentShortID:           make(map[glow.PublicKey]uint32),
+		equipmentBans:              make(map[uint32]struct{}),
+		equipmentBanProofs:         make(map[uint32]EquivocationProof),
+		equipmentBanAuths:          make(map[uint32][]glow.EquipmentAuthorization),
+		equipmentBanRecords:        make(map[uint32]equipmentBanRecord),
+		bannedDevices:              make(map[uint32]*bannedDevice),
+		stateChanges:               newStateChangeLog(stateChangeBuffer),
+		equipmentImpactRate:        make(map[uint32]*[4032]float64),
+		equipmentMigrations:        make(map[glow.PublicKey]EquipmentMigration),
+		equipmentDeauthorizations:  make(map[glow.PublicKey]EquipmentDeauthorization),
+		deviceKeyRotations:         make(map[glow.PublicKey][]DeviceKeyRotation),
+		deviceKeyOwners:            make(map[glow.PublicKey]uint32),
+		operatorDelegations:        make(map[glow.PublicKey]OperatorDelegation),
+		operatorReviewKeys:         make(map[glow.PublicKey]struct{}),
+		reportOverrides:            make(map[uint32]map[uint32]ReportOverride),
+		equipmentImports:           make(map[uint32]equipmentImport),
+		equipmentRegions:           make(map[glow.PublicKey]EquipmentRegion),
+		deviceNotes:                make(map[glow.PublicKey][]DeviceNote),
+		locationPrivacy:            make(map[glow.PublicKey]string),
+		devicePresence:             make(map[uint32]*devicePresence),
+		reportReceipts:             make(map[uint32]*reportReceipts),
+		impactFlags:                make(map[uint32]map[uint32]uint8),
+		wattTimeCaches:             make(map[string]*wattTimeCache),
+		shortIDOwners:              make(map[uint32]glow.PublicKey),
+		equipmentReports:           make(map[uint32]*deviceReports),
+		equipmentLastSeen:          make(map[uint32]uint32),
+		equipmentOffline:           make(map[uint32]struct{}),
+		peerStatus:                 make(map[glow.PublicKey]*PeerStatus),
+		equipmentExpiryWarned:      make(map[uint32]uint32),
+		equipmentNonces:            make(map[uint64]struct{}),
+		flaggedReports:             make(map[reportSlot]glow.EquipmentReport),
+		flaggedReportReviews:       make(map[reportSlot]FlaggedReportReview),
+		anomalies:                  make(map[uint32][]Anomaly),
+		validationWarnings:         make(map[string]map[uint32]*ValidationWarning),
+		anomalyDismissals:          make(map[anomalyKey]AnomalyDismissal),
+		peerSyncLimiters:           make(map[glow.PublicKey]*glow.RateLimiter),
+		recentReports:              make([]glow.EquipmentReport, 0, maxRecentReports),
+		staticStatsHistoryLoaded:   make(chan struct{}),
+		ApiArchiveRateLimiter:      glow.NewRateLimiter(apiArchiveLimit, apiArchiveRate),
+		allowIntApis:               internalTestMode,
+		staticStartTime:            clock.Now(),
+		staticClock:                clock,
+		staticMetrics:              newMetrics(),
+		staticReportStream:         newReportBroadcaster(maxReportStreams),
+		staticCapacityTolerance:    opts.CapacityTolerance,
+		staticValidationModes:      validationModes,
+		staticLegacyErrors:         opts.LegacyErrors,
+		staticLoopbackIntApis:      opts.LoopbackInternalAPIs,
+		staticDebug:                opts.Debug,
+		staticDefaultRegion:        opts.DefaultRegion,
+		staticPrivateLocations:     opts.PrivateLocations,
+		staticLocationRedaction:    opts.LocationRedaction,
+		staticWattTimeURL:          opts.WattTimeURL,
+		staticWattTimeUsername:     opts.WattTimeUsername,
+		staticWattTimePassword:     opts.WattTimePassword,
+		staticNotifySocket:         opts.NotifySocket,
+		staticWatchdogInterval:     opts.WatchdogInterval,
+		staticReportPastWindow:     reportPastWindow,
+		staticReportFutureWindow:   reportFutureWindow,
+		staticFinalizationDelay:    finalizationDelay,
+		staticKeyRotationOverlap:   opts.keyRotationOverlap(),
+		staticRecordReceipts:       !opts.DisableReportReceipts,
+		staticLateReportThreshold:  opts.lateReportThreshold(),
+		staticMinFreeDisk:          opts.minFreeDisk(),
+		staticAPILimits:            newAPILimits(),
+		staticStatsSnapshots:       &statsSnapshotCache{weeks: make(map[uint32]*statsSnapshot)},
+		staticStatsSnapshotMaxAge:  opts.statsSnapshotMaxAge(),
+		staticPageSnapshots:        &pageSnapshotCache{snapshots: make(map[pageSnapshotKey]*pageSnapshot)},
+		staticPageCursorTTL:        opts.pageCursorTTL(),
+		staticRetryQueueMaxEntries: retryQueueMaxEntries,
+		staticRetryQueueMaxAge:     retryQueueMaxAge,
+		staticTimeline:             &serverTimeline{degraded: make(map[string]uint32)},
+		staticRetainedPeriods:      retainedPeriods,
+		staticReportQueue:          make(chan reportPacket, reportQueueSize),
+		staticBootID:               newRequestID(),
+		staticTenantHost:           opts.tenantHost,
+	}
+	server.staticDefaultDeviceInterval, server.staticDefaultDeviceBurst, server.staticDefaultUnknownInterval, server.staticDefaultUnknownBurst = opts.reportLimits()
+	server.staticReportLimiter = newReportLimiter(opts.reportLimits())
+	server.staticShutdownCtx, server.staticCancelShutdown = context.WithCancel(context.Background())
+	return server, nil
+}
+
+// loadState loads all of the persisted state of the server from its storage,
+// which is the same for a running server and a read-only one. It returns the
+// size of the stats history file and the number of weeks in it, which are
+// decoded separately.
+func (server *GCAServer) loadState() (int64, int, error) {
+	// Load the GCA Server keys.
+	var err error
+	server.staticPublicKey, server.staticPrivateKey, err = server.loadGCAServerKeys()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to load gca server keys: %v", err)
+	}
+	server.staticSigner = glow.NewSigner(server.staticPrivateKey)
+	// Load the temporary Glow Certification Agent public key.
+	if err := server.loadGCATempKey(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load GCA public key: %v", err)
+	}
+	// Load the Glow Certification Agent permanent public key
+	if err := server.loadGCAPubkey(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load GCA public key: %v", err)
+	}
+	// Load the rotations of the GCA key, which need to be known before
+	// anything that was signed by the GCA gets loaded.
+	if err := server.loadGCAKeyRotations(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load gca key rotations: %v", err)
+	}
+	// Load the webhook deliveries and the alerts that did not succeed
+	// before the last shutdown, before anything gets a chance to add to
+	// them.
+	server.staticWebhookQueue, err = server.loadRetryQueue(server.webhookQueueConfig())
+	if err != nil {
+		return 0, 0, err
+	}
+	server.staticRetryQueues = append(server.staticRetryQueues, server.staticWebhookQueue)
+	server.staticAlerters, err = server.newAlerters()
+	if err != nil {
+		return 0, 0, err
+	}
+	// Load the state that is needed to accept traffic. The audit log and
+	// the roots of past weeks don't depend on anything else, so they load
+	// in parallel with the equipment, see startup_load.go.
+	var historySize int64
+	var historyEntries int
+	err = loadInParallel(
+		func() error {
+			if err := server.loadAuditLog(); err != nil {
+				return fmt.Errorf("failed to load audit log: %v", err)
+			}
+			return nil
+		},
+		func() error {
+			if err := server.loadReportRoots(); err != nil {
+				return fmt.Errorf("failed to load report roots: %v", err)
+			}
+			return nil
+		},
+		func() error {
+			var err error
+			historySize, historyEntries, err = server.loadEquipmentState()
+			return err
+		},
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The changes that were replayed while loading are not part of the
+	// stats delta.
+	server.stateChanges.reset(server.stateVersion)
+	return historySize, historyEntries, nil
+}
+
+// loadEquipmentState loads the equipment, everything that decides which of it
+// is allowed to report, and the reports of the current period. It returns the
+// size of the stats history file and the number of weeks in it, which get
+// loaded in the background.
+func (server *GCAServer) loadEquipmentState() (int64, int, error) {
+	// Load the scopes that the GCA has delegated to operator keys.
+	if err := server.loadOperatorDelegations(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load operator delegations: %v", err)
+	}
+	// Load the servers that the GCA has registered.
+	if err := server.loadAuthorizedServers(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load authorized servers: %v", err)
+	}
+	// Load the metadata of the bans, which needs to be known before any
+	// of the bans get replayed.
+	if err := server.loadEquipmentBanRecords(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load banned equipment: %v", err)
+	}
+	// Load the registry of allocated ShortIDs, which needs to be known
+	// before any equipment gets loaded.
+	if err := server.loadShortIDs(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load ShortIDs: %v", err)
+	}
+	// Load equipment public keys
+	if err := server.loadEquipment(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load server equipment: %v", err)
+	}
+	// Load the equipment that has been deauthorized.
+	if err := server.loadEquipmentDeauthorizations(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load equipment deauthorizations: %v", err)
+	}
+	// Load the key rotations of the equipment, which need to be known
+	// before any reports or bans get verified.
+	if err := server.loadDeviceKeyRotations(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load device key rotations: %v", err)
+	}
+	// Load the corrections that the GCA made to the reports of equipment.
+	if err := server.loadReportOverrides(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load report overrides: %v", err)
+	}
+	// Load the anomalies and the dismissals of the GCA.
+	if err := server.loadAnomalies(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load anomalies: %v", err)
+	}
+	// Load the regions that the GCA assigned to equipment.
+	if err := server.loadEquipmentRegions(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load equipment regions: %v", err)
+	}
+	// Load the notes that the GCA made on equipment.
+	if err := server.loadDeviceNotes(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load device notes: %v", err)
+	}
+	// Load the equipment that was imported from another GCA, which needs
+	// to be known before the proofs that name it get verified.
+	if err := server.loadEquipmentImports(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load equipment imports: %v", err)
+	}
+	// Add the ShortIDs that predate the registry to it.
+	if err := server.saveLegacyShortIDs(); err != nil {
+		return 0, 0, fmt.Errorf("failed to save ShortIDs: %v", err)
+	}
+	// Load the proofs of equipment that signed conflicting reports, which
+	// bans the equipment before any of its reports get loaded.
+	if err := server.loadEquivocationProofs(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load equipment bans: %v", err)
+	}
+	// Load the historic data for the equipment. This will also set the
+	// 'equipmentReportsOffset` value.
+	historySize, historyEntries, err := server.loadEquipmentHistory()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to load server equipment history: %v", err)
+	}
+	// The bans were replayed before the reports offset was known, drop
+	// the banned equipment whose ban is older than the window.
+	server.migrateBannedDevices(false)
+	// Load the reviews of flagged reports, which need to be known before
+	// any reports get integrated.
+	if err := server.loadFlaggedReportReviews(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load flagged report reviews: %v", err)
+	}
+	// Load all equipment reports
+	if err := server.loadEquipmentReports(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load equipment reports: %v", err)
+	}
+	if err := server.loadFlaggedReports(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load flagged reports: %v", err)
+	}
+	// Cross-check the state that was loaded from the different files.
+	if err := server.verifyLoadedState(); err != nil {
+		return 0, 0, err
+	}
+	// The overrides were loaded before the reports offset was known, so
+	// the totals of the weeks get added up from scratch.
+	server.recomputePeriodTotals()
+	// Load the impact rates, which need the final set of equipment.
+	if err := server.loadImpactRates(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load impact rates: %v", err)
+	}
+	if err := server.loadHeartbeats(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load heartbeats: %v", err)
+	}
+	if err := server.loadReportReceipts(); err != nil {
+		return 0, 0, fmt.Errorf("failed to load report receipts: %v", err)
+	}
+	return historySize, historyEntries, nil
+}
+
 // Close cleanly shuts down the GCAServer instance.
 func (server *GCAServer) Close() error {
+	// Signal to the healthz endpoint that the server is no longer
+	// accepting work.
+	server.mu.Lock()
+	server.shuttingDown = true
+	server.mu.Unlock()
+	server.managedNotifySystemd(sdNotifyStopping)
+
+	// Stop reading UDP packets, and finish the reports that were already
+	// read before anything gets closed, so that every report that was
+	// persisted also gets its ack.
+	server.drainUDPReports()
+
 	// By placing this here, we know that every time a server is closed
 	// during testing, we are reviewing the state to make sure it's all in
 	// order.
 	if !server.skipInvariants {
 		server.CheckInvariants()
 	}
+	server.writeCleanShutdownMarker()
+	server.staticCancelShutdown()
 	return server.tg.Stop()
 }
 
 // loadGCAServerKeys will load the keys for the GCA server from disk, creating
 // new keys if no keys are found.
 func (server *GCAServer) loadGCAServerKeys() (glow.PublicKey, glow.PrivateKey, error) {
-	path := filepath.Join(server.baseDir, "server.keys")
-	data, err := ioutil.ReadFile(path)
+	data, err := server.staticStorage.ReadFile(ServerKeysFile)
 	if os.IsNotExist(err) {
 		server.logger.Info("Creating keys for the GCA server")
 		pub, priv := glow.GenerateKeyPair()
-		f, err := os.Create(path)
-		if err != nil {
-			return glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to create file for gca keys: %v", err)
-		}
 		var data [96]byte
 		copy(data[:32], pub[:])
 		copy(data[32:], priv[:])
-		_, err = f.Write(data[:])
+		err = server.staticStorage.WriteFile(ServerKeysFile, data[:], 0644)
 		if err != nil {
 			return glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to write keys to disk: %v", err)
 		}
-		err = f.Close()
-		if err != nil {
-			return glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to close gca key server file: %v", err)
-		}
 		return pub, priv, nil
 	}
 	if err != nil {
@@ -312,29 +980,17 @@ func (server *GCAServer) loadGCAServerKeys() (glow.PublicKey, glow.PrivateKey, e
 	return pub, priv, nil
 }
 
-// loadGCATempKey loads the temporary key of the Glow Certification Agent.
+// loadGCATempKey loads the temporary key of the Glow Certification Agent. A
+// server in internal test mode that was never provisioned generates a temp
+// key of its own, see test_gca_keys.go.
 func (server *GCAServer) loadGCATempKey() error {
-	path := filepath.Join(server.baseDir, "gcaTempPubKey.dat")
-	data, err := ioutil.ReadFile(path)
+	data, err := server.staticStorage.ReadFile(GCATempPubkeyFile)
+	if os.IsNotExist(err) && server.allowIntApis {
+		data, err = server.generateTestGCAKeys()
+	}
 	if err != nil {
 		return fmt.Errorf("unable to read temp gca key from file: %v", err)
 	}
 	copy(server.gcaTempKey[:], data)
 	return nil
 }
-
-// loadGCAPubkey loads the Glow Certification Agent public key from a file.
-func (server *GCAServer) loadGCAPubkey() error {
-	pubkeyPath := filepath.Join(server.baseDir, "gcaPubKey.dat")
-	pubkeyData, err := ioutil.ReadFile(pubkeyPath)
-	if os.IsNotExist(err) {
-		server.logger.Info("GCA Temp Key not available, waiting to receive over the API")
-		return nil
-	}
-	if err != nil {
-		return fmt.Errorf("unable to read public key from file: %v", err)
-	}
-	server.gcaPubkeyAvailable = true
-	copy(server.gcaPubkey[:], pubkeyData)
-	return nil
-}
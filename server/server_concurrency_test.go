@@ -8,6 +8,10 @@ package server
 // without setting off the race detector.
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -100,7 +104,7 @@ func TestConcurrency(t *testing.T) {
 			i := 0
 			for {
 				// Try submitting some new hardware.
-				_, _, err := gcas.submitNewHardware(666777, key)
+				_, _, err := gcas.AuthorizeTestDevice(666777, key)
 				if err == nil {
 					t.Fatal("should not be able to submit a GCA key with a bad private key")
 				}
@@ -271,7 +275,7 @@ func TestConcurrency(t *testing.T) {
 			for {
 				// Try submitting some new hardware.
 				shortID := atomic.AddUint32(&atomicShortID, 1)
-				_, _, err := gcas.submitNewHardware(shortID, key)
+				_, _, err := gcas.AuthorizeTestDevice(shortID, key)
 				if err != nil {
 					t.Fatal("should be able to submit new hardware")
 				}
@@ -300,7 +304,7 @@ func TestConcurrency(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		// Create authorized equipment to be making reports.
 		shortID := atomic.AddUint32(&atomicShortID, 1)
-		ea, ePriv, err := gcas.submitNewHardware(shortID, gcaPrivKey)
+		ea, ePriv, err := gcas.AuthorizeTestDevice(shortID, gcaPrivKey)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -356,7 +360,7 @@ func TestConcurrency(t *testing.T) {
 					totalGood := 0
 					totalBad := 0
 					for i := gcas.equipmentReportsOffset; i < glow.CurrentTimeslot() && i < gcas.equipmentReportsOffset+4032; i++ {
-						if gcas.equipmentReports[ea.ShortID][i-gcas.equipmentReportsOffset].PowerOutput > 1 {
+						if gcas.equipmentReports[ea.ShortID].PowerOutputs[i-gcas.equipmentReportsOffset] > 1 {
 							totalGood++
 						} else {
 							totalBad++
@@ -430,3 +434,82 @@ func TestConcurrency(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestStatsDoNotBlockIngestion keeps the stats endpoint busy with a large
+// response while reports are being ingested, and checks that the ingestion
+// latency stays low. The stats endpoint only holds the read lock while it
+// copies the data, so ingestion never waits for the signing or the marshaling
+// of a response.
+func TestStatsDoNotBlockIngestion(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Enough devices that every stats response is several megabytes.
+	const numDevices = 100
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(2); i <= numDevices; i++ {
+		if _, _, err := server.AuthorizeTestDevice(i, gcaPrivKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	var responses atomic.Uint64
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/all-device-stats?timeslot_offset=0", server.httpPort))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				responses.Add(1)
+			}
+		}()
+	}
+
+	// Ingest a report every few milliseconds and time each one.
+	const numReports = 150
+	latencies := make([]time.Duration, 0, numReports)
+	for i := uint32(0); i < numReports; i++ {
+		packet := generateTestReport(ea.ShortID, i, ePriv)
+		start := time.Now()
+		if outcome, _ := server.managedHandleEquipmentReport(packet); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+		latencies = append(latencies, time.Since(start))
+		time.Sleep(3 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	if responses.Load() < 3 {
+		t.Fatal("the stats endpoint was not under load:", responses.Load())
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p95 := latencies[len(latencies)*95/100]
+	t.Logf("%v stats responses, ingestion latency p50 %v p95 %v max %v", responses.Load(), latencies[len(latencies)/2], p95, latencies[len(latencies)-1])
+	threshold := 25 * time.Millisecond
+	if raceEnabled {
+		threshold *= 10
+	}
+	if p95 > threshold {
+		t.Fatal("ingestion was blocked by the stats endpoint, p95 latency:", p95)
+	}
+}
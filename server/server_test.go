@@ -0,0 +1,74 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestDistinctServerDirs launches two servers in the same process using two
+// different directories and checks that they do not share any state.
+func TestDistinctServerDirs(t *testing.T) {
+	server1, dir1, _, gcaPrivKey1, err := SetupTestEnvironment(t.Name() + "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server1.Close()
+	server2, dir2, _, _, err := SetupTestEnvironment(t.Name() + "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server2.Close()
+
+	if dir1 == dir2 {
+		t.Fatal("test environments share a directory")
+	}
+	if server1.BaseDir() != dir1 || server2.BaseDir() != dir2 {
+		t.Fatal("servers are not using the directories they were given")
+	}
+	if server1.PublicKey() == server2.PublicKey() {
+		t.Fatal("servers share a keypair")
+	}
+
+	// Authorize equipment on the first server only, the second server
+	// should not learn about it.
+	_, _, err = server1.AuthorizeTestDevice(1, gcaPrivKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server1.mu.Lock()
+	n1 := len(server1.equipment)
+	server1.mu.Unlock()
+	server2.mu.Lock()
+	n2 := len(server2.equipment)
+	server2.mu.Unlock()
+	if n1 != 1 || n2 != 0 {
+		t.Fatal("unexpected equipment counts:", n1, n2)
+	}
+
+	// Each server should have written its own persist files.
+	for _, dir := range []string{dir1, dir2} {
+		_, err := serverStorage(dir).Stat(ServerKeysFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestBaseDirIsFile checks that the server refuses to start if the base
+// directory path is occupied by a file.
+func TestBaseDirIsFile(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	path := filepath.Join(dir, "not-a-dir")
+	err := os.WriteFile(path, []byte("hi"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcas, err := NewGCAServer(path, false)
+	if err == nil {
+		gcas.Close()
+		t.Fatal("expected an error when the base dir is a file")
+	}
+}
@@ -0,0 +1,322 @@
+package server
+
+// server_timeline.go keeps an operational timeline of the server, so that a
+// gap in the reports of a device can be traced back to the server after the
+// fact. The timeline has an entry for every startup, for every time that the
+// server became degraded and recovered, and for every week that it
+// finalized, each with the timeslots it covers. It is appended to
+// ServerTimelineFile and served at /api/v1/server-timeline.
+//
+// The entry of a startup covers the time that the server was down, and says
+// how the previous run ended. Close writes CleanShutdownFile, which the next
+// startup removes again, so a startup without the marker follows a crash. The
+// server rewrites ServerAliveFile every serverAliveFrequency while it runs,
+// which is where the downtime of a crash starts.
+//
+// The server is degraded while the disk is full, while reports can't be
+// persisted, and while the UDP listener rebinds its socket, see
+// persist_health.go and report_listener_udp.go. The report gap endpoints label
+// the gaps that overlap the downtime of the server, or a time that it was
+// degraded, as server-side.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// The events of the timeline.
+const (
+	TimelineEventStartup         = "startup"          // Covers the downtime before the startup
+	TimelineEventDegraded        = "degraded"         // The server started to refuse or miss reports
+	TimelineEventRecovered       = "recovered"        // Covers the time that the server was degraded
+	TimelineEventPeriodFinalized = "period_finalized" // Covers the week that was finalized
+)
+
+// The reasons of the timeline entries. A startup has the reason that the
+// previous run ended for, which is empty for the first startup, and the
+// degraded and recovered entries have the reason that the server was
+// degraded for.
+const (
+	TimelineReasonCleanShutdown = "clean_shutdown"
+	TimelineReasonCrash         = "crash"
+	TimelineReasonDiskFull      = "disk_full"
+	TimelineReasonPersistFailed = "persist_failed"
+	TimelineReasonListenerDown  = "listener_down"
+)
+
+// The causes of a report gap.
+const (
+	GapCauseDevice = "device" // The server was up, the device didn't report
+	GapCauseServer = "server" // The gap overlaps a window in which the server was down or degraded
+)
+
+// TimelineEntry is an entry of the timeline of the server. Both ends of the
+// timeslots are inclusive.
+type TimelineEntry struct {
+	Event         string `json:"event"`
+	Reason        string `json:"reason,omitempty"`
+	StartTimeslot uint32 `json:"start_timeslot"`
+	EndTimeslot   uint32 `json:"end_timeslot"`
+	Unix          int64  `json:"unix"` // When the entry was recorded
+}
+
+// ServerTimelineResponse lists the entries of the timeline in the order they
+// were recorded.
+type ServerTimelineResponse struct {
+	Entries []TimelineEntry `json:"entries"`
+}
+
+// timelineMarker is the content of CleanShutdownFile and ServerAliveFile.
+type timelineMarker struct {
+	Timeslot uint32 `json:"timeslot"`
+	Unix     int64  `json:"unix"`
+}
+
+// serverTimeline is the in-memory copy of the timeline. The entries get
+// recorded under different locks, so the timeline has a mutex of its own,
+// which is always taken last.
+type serverTimeline struct {
+	entries  []TimelineEntry
+	degraded map[string]uint32 // The timeslot that the server became degraded at, by reason
+
+	mu sync.Mutex
+}
+
+// outageWindow is a range of timeslots, both inclusive, in which the server
+// was down or degraded.
+type outageWindow struct {
+	start uint32
+	end   uint32
+}
+
+// appendTimeline appends an entry to the timeline. A failed write is logged,
+// the timeline must never get in the way of the server. The mutex of the
+// timeline must be held.
+func (gcas *GCAServer) appendTimeline(e TimelineEntry) {
+	e.Unix = gcas.now().Unix()
+	gcas.staticTimeline.entries = append(gcas.staticTimeline.entries, e)
+	data, err := json.Marshal(e)
+	if err == nil {
+		err = gcas.staticStorage.AppendFile(ServerTimelineFile, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		gcas.logger.Errorf("unable to record %v in the server timeline: %v", e.Event, err)
+	}
+}
+
+// recordDegraded records that the server became degraded or recovered for
+// the provided reason. Repeated calls with the same state are ignored. Only
+// the mutex of the timeline is taken, so the caller may hold any other lock.
+func (gcas *GCAServer) recordDegraded(reason string, degraded bool) {
+	tl := gcas.staticTimeline
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	since, isDegraded := tl.degraded[reason]
+	now := gcas.currentTimeslot()
+	if degraded && !isDegraded {
+		tl.degraded[reason] = now
+		gcas.appendTimeline(TimelineEntry{Event: TimelineEventDegraded, Reason: reason, StartTimeslot: now, EndTimeslot: now})
+	}
+	if !degraded && isDegraded {
+		delete(tl.degraded, reason)
+		gcas.appendTimeline(TimelineEntry{Event: TimelineEventRecovered, Reason: reason, StartTimeslot: since, EndTimeslot: now})
+	}
+}
+
+// recordPeriodFinalized records that the week starting at the provided
+// timeslot was finalized. Only the mutex of the timeline is taken.
+func (gcas *GCAServer) recordPeriodFinalized(periodStart uint32) {
+	gcas.staticTimeline.mu.Lock()
+	defer gcas.staticTimeline.mu.Unlock()
+	gcas.appendTimeline(TimelineEntry{Event: TimelineEventPeriodFinalized, StartTimeslot: periodStart, EndTimeslot: periodStart + 2015})
+}
+
+// readTimelineMarker reads a marker file, returning false if there is none.
+func (gcas *GCAServer) readTimelineMarker(name string) (timelineMarker, bool, error) {
+	var tm timelineMarker
+	data, err := gcas.staticStorage.ReadFile(name)
+	if os.IsNotExist(err) {
+		return tm, false, nil
+	}
+	if err != nil {
+		return tm, false, fmt.Errorf("unable to read %v: %v", name, err)
+	}
+	if err := json.Unmarshal(data, &tm); err != nil {
+		gcas.logger.Warnf("ignoring the corrupt %v: %v", name, err)
+		return tm, false, nil
+	}
+	return tm, true, nil
+}
+
+// writeTimelineMarker writes a marker file with the current time.
+func (gcas *GCAServer) writeTimelineMarker(name string) error {
+	data, err := json.Marshal(timelineMarker{Timeslot: gcas.currentTimeslot(), Unix: gcas.now().Unix()})
+	if err != nil {
+		return err
+	}
+	return gcas.staticStorage.WriteFile(name, data, 0644)
+}
+
+// startServerTimeline loads the timeline and records the startup, along with
+// how the previous run ended and how long the server was down.
+func (gcas *GCAServer) startServerTimeline() error {
+	tl := gcas.staticTimeline
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	data, err := gcas.staticStorage.ReadFile(ServerTimelineFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read the server timeline: %v", err)
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e TimelineEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			gcas.logger.Warnf("skipping a corrupt entry of the server timeline: %v", err)
+			continue
+		}
+		tl.entries = append(tl.entries, e)
+	}
+
+	// Figure out how the previous run ended. A crash is only known to
+	// have happened after the last time that the server marked itself
+	// alive, or after the last entry of the timeline.
+	now := gcas.currentTimeslot()
+	startup := TimelineEntry{Event: TimelineEventStartup, StartTimeslot: now, EndTimeslot: now}
+	clean, cleanExists, err := gcas.readTimelineMarker(CleanShutdownFile)
+	if err != nil {
+		return err
+	}
+	alive, aliveExists, err := gcas.readTimelineMarker(ServerAliveFile)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cleanExists:
+		startup.Reason = TimelineReasonCleanShutdown
+		startup.StartTimeslot = clean.Timeslot
+	case aliveExists:
+		startup.Reason = TimelineReasonCrash
+		startup.StartTimeslot = alive.Timeslot
+	case len(tl.entries) > 0:
+		startup.Reason = TimelineReasonCrash
+		startup.StartTimeslot = tl.entries[len(tl.entries)-1].EndTimeslot
+	}
+	for _, e := range tl.entries {
+		if startup.Reason == TimelineReasonCrash && e.EndTimeslot > startup.StartTimeslot && e.EndTimeslot <= now {
+			startup.StartTimeslot = e.EndTimeslot
+		}
+	}
+	if startup.StartTimeslot > now {
+		startup.StartTimeslot = now
+	}
+	gcas.appendTimeline(startup)
+	if cleanExists {
+		if err := gcas.staticStorage.Remove(CleanShutdownFile); err != nil {
+			return fmt.Errorf("unable to remove the clean shutdown marker: %v", err)
+		}
+	}
+	if err := gcas.writeTimelineMarker(ServerAliveFile); err != nil {
+		return fmt.Errorf("unable to write the alive marker: %v", err)
+	}
+	gcas.logger.Infof("recorded the startup in the server timeline, the previous run ended with %q", startup.Reason)
+	return nil
+}
+
+// writeCleanShutdownMarker tells the next startup that the server was shut
+// down cleanly.
+func (gcas *GCAServer) writeCleanShutdownMarker() {
+	if err := gcas.writeTimelineMarker(CleanShutdownFile); err != nil {
+		gcas.logger.Errorf("unable to write the clean shutdown marker: %v", err)
+	}
+}
+
+// threadedMarkAlive rewrites ServerAliveFile every serverAliveFrequency, which
+// bounds the downtime of a crash.
+func (gcas *GCAServer) threadedMarkAlive() {
+	for gcas.sleep(serverAliveFrequency) {
+		if err := gcas.writeTimelineMarker(ServerAliveFile); err != nil {
+			gcas.logger.Errorf("unable to write the alive marker: %v", err)
+		}
+	}
+}
+
+// outageWindows returns the windows in which the server was down or
+// degraded, up to the provided timeslot.
+func (gcas *GCAServer) outageWindows(now uint32) []outageWindow {
+	tl := gcas.staticTimeline
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	var windows []outageWindow
+	open := make(map[string]uint32)
+	for _, e := range tl.entries {
+		switch e.Event {
+		case TimelineEventStartup:
+			// Whatever was degraded before a crash stayed
+			// degraded until the server went down.
+			for reason, since := range open {
+				windows = append(windows, outageWindow{start: since, end: e.StartTimeslot})
+				delete(open, reason)
+			}
+			if e.Reason != "" {
+				windows = append(windows, outageWindow{start: e.StartTimeslot, end: e.EndTimeslot})
+			}
+		case TimelineEventDegraded:
+			open[e.Reason] = e.StartTimeslot
+		case TimelineEventRecovered:
+			delete(open, e.Reason)
+			windows = append(windows, outageWindow{start: e.StartTimeslot, end: e.EndTimeslot})
+		}
+	}
+	for _, since := range open {
+		windows = append(windows, outageWindow{start: since, end: now})
+	}
+	return windows
+}
+
+// gapCause returns whether the provided gap overlaps one of the windows.
+func gapCause(gap ReportGap, windows []outageWindow) string {
+	for _, w := range windows {
+		if gap.StartTimeslot <= w.end && w.start <= gap.EndTimeslot {
+			return GapCauseServer
+		}
+	}
+	return GapCauseDevice
+}
+
+// ServerTimelineHandler returns the timeline of the server. The optional
+// 'since_timeslot' query parameter leaves out the entries that ended before
+// it.
+func (gcas *GCAServer) ServerTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for the server timeline.")
+		return
+	}
+	var since uint32
+	if str := r.URL.Query().Get("since_timeslot"); str != "" {
+		s, err := strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, "invalid since_timeslot")
+			return
+		}
+		since = uint32(s)
+	}
+
+	resp := ServerTimelineResponse{Entries: []TimelineEntry{}}
+	gcas.staticTimeline.mu.Lock()
+	for _, e := range gcas.staticTimeline.entries {
+		if e.EndTimeslot >= since {
+			resp.Entries = append(resp.Entries, e)
+		}
+	}
+	gcas.staticTimeline.mu.Unlock()
+	gcas.writeJSONResponse(w, r, resp)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// startupEntries returns the startup entries of the timeline of the server.
+func (gcas *GCAServer) startupEntries() []TimelineEntry {
+	gcas.staticTimeline.mu.Lock()
+	defer gcas.staticTimeline.mu.Unlock()
+	var startups []TimelineEntry
+	for _, e := range gcas.staticTimeline.entries {
+		if e.Event == TimelineEventStartup {
+			startups = append(startups, e)
+		}
+	}
+	return startups
+}
+
+// TestServerTimeline restarts the server after a clean shutdown and after a
+// crash, degrades it, and checks the timeline along with the causes of the
+// report gaps that overlap the downtime.
+func TestServerTimeline(t *testing.T) {
+	glow.SetCurrentTimeslot(2016 + 2)
+	defer glow.SetCurrentTimeslot(0)
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 2016+1, ePriv))
+	startups := server.startupEntries()
+	if len(startups) != 1 || startups[0].Reason != "" {
+		t.Fatalf("unexpected first startup: %+v", startups)
+	}
+
+	// A clean shutdown is told apart from a crash, and the marker is
+	// removed again at startup.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(2016 + 5)
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startups = server.startupEntries()
+	if len(startups) != 2 || startups[1].Reason != TimelineReasonCleanShutdown || startups[1].StartTimeslot != 2016+2 || startups[1].EndTimeslot != 2016+5 {
+		t.Fatalf("unexpected startup after a clean shutdown: %+v", startups)
+	}
+	if _, err := server.staticStorage.ReadFile(CleanShutdownFile); err == nil {
+		t.Fatal("the clean shutdown marker was not removed")
+	}
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 2016+6, ePriv))
+
+	// A crash leaves no marker behind, in which case the downtime starts
+	// when the server last marked itself alive.
+	glow.SetCurrentTimeslot(2016 + 7)
+	if err := server.writeTimelineMarker(ServerAliveFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.staticStorage.Remove(CleanShutdownFile); err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(2016 + 9)
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	startups = server.startupEntries()
+	if len(startups) != 3 || startups[2].Reason != TimelineReasonCrash || startups[2].StartTimeslot != 2016+7 || startups[2].EndTimeslot != 2016+9 {
+		t.Fatalf("unexpected startup after a crash: %+v", startups)
+	}
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 2016+10, ePriv))
+
+	// Degraded mode gets an entry when it starts and when it ends, and
+	// repeated calls are ignored.
+	glow.SetCurrentTimeslot(2016 + 12)
+	server.recordDegraded(TimelineReasonDiskFull, true)
+	server.recordDegraded(TimelineReasonDiskFull, true)
+	glow.SetCurrentTimeslot(2016 + 13)
+	server.recordDegraded(TimelineReasonDiskFull, false)
+	server.recordDegraded(TimelineReasonDiskFull, false)
+	glow.SetCurrentTimeslot(2016 + 16)
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 2016+14, ePriv))
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 2016+16, ePriv))
+	server.recordDegraded(TimelineReasonListenerDown, true)
+	glow.SetCurrentTimeslot(2016 + 18)
+
+	var resp ServerTimelineResponse
+	if status, code, err := server.getPage("v1/server-timeline?since_timeslot=2019", &resp); err != nil || status != http.StatusOK {
+		t.Fatal("unable to get the timeline:", status, code, err)
+	}
+	expected := []TimelineEntry{
+		{Event: TimelineEventStartup, Reason: TimelineReasonCleanShutdown, StartTimeslot: 2016 + 2, EndTimeslot: 2016 + 5},
+		{Event: TimelineEventStartup, Reason: TimelineReasonCrash, StartTimeslot: 2016 + 7, EndTimeslot: 2016 + 9},
+		{Event: TimelineEventDegraded, Reason: TimelineReasonDiskFull, StartTimeslot: 2016 + 12, EndTimeslot: 2016 + 12},
+		{Event: TimelineEventRecovered, Reason: TimelineReasonDiskFull, StartTimeslot: 2016 + 12, EndTimeslot: 2016 + 13},
+		{Event: TimelineEventDegraded, Reason: TimelineReasonListenerDown, StartTimeslot: 2016 + 16, EndTimeslot: 2016 + 16},
+	}
+	var got []TimelineEntry
+	for _, e := range resp.Entries {
+		if e.Unix == 0 {
+			t.Fatal("an entry has no time")
+		}
+		e.Unix = 0
+		got = append(got, e)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected timeline:\n%+v\nexpected\n%+v", got, expected)
+	}
+	if status, code, _ := server.getPage("v1/server-timeline?since_timeslot=abc", &resp); status != http.StatusBadRequest || code != ErrCodeMalformedRequest {
+		t.Fatal("a bad since_timeslot was accepted:", status, code)
+	}
+
+	// The first startup ended before since_timeslot.
+	if status, code, err := server.getPage("v1/server-timeline", &resp); err != nil || status != http.StatusOK || len(resp.Entries) != len(expected)+1 {
+		t.Fatal("unexpected timeline without since_timeslot:", status, code, err, len(resp.Entries))
+	}
+
+	// The gaps that overlap the downtime or the degraded windows are on
+	// the server, the others are on the device.
+	status, rgr, err := server.getReportGaps("short_id=1")
+	if err != nil || status != http.StatusOK || len(rgr.Devices) != 1 {
+		t.Fatal("unable to get the gaps:", status, err)
+	}
+	expectedGaps := []ReportGap{
+		{2016, 2016, 1, GapCauseDevice},
+		{2018, 2021, 4, GapCauseServer},
+		{2023, 2025, 3, GapCauseServer},
+		{2027, 2029, 3, GapCauseServer},
+		{2031, 2031, 1, GapCauseDevice},
+		{2033, 2033, 1, GapCauseServer},
+	}
+	if fmt.Sprint(rgr.Devices[0].Gaps) != fmt.Sprint(expectedGaps) {
+		t.Fatalf("unexpected gaps: %v", rgr.Devices[0].Gaps)
+	}
+}
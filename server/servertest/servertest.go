@@ -0,0 +1,174 @@
+// Package servertest runs a real GCA server for the tests of other projects.
+//
+// The server is launched in a temporary directory on ephemeral loopback
+// ports, with a freshly generated GCA key and a mock WattTime API, so that a
+// test never touches the network. Everything gets cleaned up when the test
+// finishes.
+//
+//	s := servertest.NewTestServer(t)
+//	d := s.AuthorizeTestDevice(1)
+//	ack := s.SubmitTestReport(d, glow.CurrentTimeslot(), 5000)
+//	if ack.Status != glow.ReportAckAccepted {
+//		t.Fatal("report was not accepted:", ack.Status)
+//	}
+//
+// A test that needs the same keys every time, for golden vectors or to replay
+// a failure, launches the server with NewSeededTestServer instead. The GCA
+// key and the keys of the devices are then derived from the seed, see
+// glow.FleetGCAKey and glow.FleetDeviceKey, so the load generator can recreate
+// the same fleet from the same seed. Seeded keys are for tests only and must
+// never be used in production.
+//
+// The helpers are thin wrappers around the exported helpers in
+// server/testing.go, which are what the tests of the server itself use.
+package servertest
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+	"github.com/glowlabs-org/gca-backend/watttime/mock"
+)
+
+// Server is a running GCA server along with the keys of its GCA.
+type Server struct {
+	GCAServer     *server.GCAServer
+	GCAPublicKey  glow.PublicKey
+	GCAPrivateKey glow.PrivateKey
+	Dir           string
+
+	// The addresses of the listeners of the server. HTTPURL has no
+	// trailing slash, so the paths of the API can be appended to it.
+	HTTPURL string
+	TCPAddr string
+	UDPAddr string
+
+	t         testing.TB
+	seed      []byte // Nil unless the keys are derived from a seed
+	wattTime  *mock.Server
+	closeOnce sync.Once
+}
+
+// Device is a piece of equipment that was authorized with the test server.
+type Device struct {
+	ShortID       uint32
+	PublicKey     glow.PublicKey
+	PrivateKey    glow.PrivateKey
+	Authorization glow.EquipmentAuthorization
+}
+
+// NewTestServer launches a GCA server and registers a GCA key with it. The
+// server gets closed and its directory gets removed when the test finishes,
+// or when Close is called.
+func NewTestServer(t testing.TB) *Server {
+	t.Helper()
+	return newTestServer(t, nil)
+}
+
+// NewSeededTestServer is the same as NewTestServer, except that the GCA key
+// and the keys of the devices that get authorized are derived from the seed.
+// The key of the server itself is still random.
+func NewSeededTestServer(t testing.TB, seed []byte) *Server {
+	t.Helper()
+	return newTestServer(t, seed)
+}
+
+// newTestServer launches the server, with seeded keys if the seed isn't nil.
+func newTestServer(t testing.TB, seed []byte) *Server {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "gcatest-")
+	if err != nil {
+		t.Fatal("unable to create server dir:", err)
+	}
+	wattTime := mock.NewServer()
+
+	opts := server.DefaultServerOptions()
+	opts.HttpPort, opts.TcpPort, opts.UdpPort = 0, 0, 0
+	opts.LocalOnly()
+	opts.WattTimeURL = wattTime.URL()
+	var gcas *server.GCAServer
+	var gcaPubKey glow.PublicKey
+	var gcaPrivKey glow.PrivateKey
+	if seed != nil {
+		gcaPubKey, gcaPrivKey = glow.FleetGCAKey(seed)
+		gcas, err = server.SetupTestServerKnownGCA(dir, opts, gcaPubKey, gcaPrivKey)
+	} else {
+		gcas, gcaPubKey, gcaPrivKey, err = server.SetupTestServer(dir, opts)
+	}
+	if err != nil {
+		wattTime.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	httpPort, tcpPort, udpPort := gcas.Ports()
+	s := &Server{
+		GCAServer:     gcas,
+		GCAPublicKey:  gcaPubKey,
+		GCAPrivateKey: gcaPrivKey,
+		Dir:           dir,
+		HTTPURL:       fmt.Sprintf("http://127.0.0.1:%v", httpPort),
+		TCPAddr:       fmt.Sprintf("127.0.0.1:%v", tcpPort),
+		UDPAddr:       fmt.Sprintf("127.0.0.1:%v", udpPort),
+		t:             t,
+		seed:          seed,
+		wattTime:      wattTime,
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// AuthorizeTestDevice creates a new piece of equipment with the provided
+// ShortID and authorizes it with the GCA key. The key of the equipment is
+// derived from the ShortID if the server was launched with a seed. The test
+// fails if the server doesn't accept the authorization.
+func (s *Server) AuthorizeTestDevice(shortID uint32) Device {
+	s.t.Helper()
+	var ea glow.EquipmentAuthorization
+	var key glow.PrivateKey
+	var err error
+	if s.seed != nil {
+		pub, priv := glow.FleetDeviceKey(s.seed, shortID)
+		ea, key, err = s.GCAServer.AuthorizeTestDeviceWithKey(shortID, s.GCAPrivateKey, pub, priv)
+	} else {
+		ea, key, err = s.GCAServer.AuthorizeTestDevice(shortID, s.GCAPrivateKey)
+	}
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return Device{
+		ShortID:       ea.ShortID,
+		PublicKey:     ea.PublicKey,
+		PrivateKey:    key,
+		Authorization: ea,
+	}
+}
+
+// SubmitTestReport sends a signed report from the device to the server, and
+// returns the ack of the server. The test fails if no ack signed by the
+// server comes back. A rejected report still has an ack, so the caller should
+// check its status.
+func (s *Server) SubmitTestReport(d Device, timeslot uint32, powerOutput uint64) glow.ReportAck {
+	s.t.Helper()
+	ack, err := s.GCAServer.SubmitTestReport(d.ShortID, timeslot, powerOutput, d.PrivateKey)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return ack
+}
+
+// Close shuts down the server and removes its directory. It is safe to call
+// more than once.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		if err := s.GCAServer.Close(); err != nil {
+			s.t.Error("unable to close server:", err)
+		}
+		s.wattTime.Close()
+		os.RemoveAll(s.Dir)
+	})
+}
@@ -0,0 +1,55 @@
+package servertest_test
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server/servertest"
+)
+
+// TestServer boots a server the way that an external module would, submits a
+// report, and checks that the server gets cleaned up.
+func TestServer(t *testing.T) {
+	s := servertest.NewTestServer(t)
+	d := s.AuthorizeTestDevice(1)
+	ack := s.SubmitTestReport(d, glow.CurrentTimeslot(), 5000)
+	if ack.Status != glow.ReportAckAccepted {
+		t.Fatal("report was not accepted:", ack.Status)
+	}
+	if ack := s.SubmitTestReport(d, glow.CurrentTimeslot(), 5000); ack.Status != glow.ReportAckDuplicate {
+		t.Fatal("expected a duplicate:", ack.Status)
+	}
+
+	resp, err := http.Get(s.HTTPURL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected health status:", resp.StatusCode)
+	}
+
+	s.Close()
+	s.Close()
+	if _, err := os.Stat(s.Dir); !os.IsNotExist(err) {
+		t.Fatal("server dir was not removed:", err)
+	}
+}
+
+// TestSeededServer checks that the keys of a seeded server and its devices
+// are the ones derived from the seed.
+func TestSeededServer(t *testing.T) {
+	seed := []byte(t.Name())
+	s := servertest.NewSeededTestServer(t, seed)
+	d := s.AuthorizeTestDevice(7)
+	gcaPub, _ := glow.FleetGCAKey(seed)
+	devicePub, _ := glow.FleetDeviceKey(seed, 7)
+	if s.GCAPublicKey != gcaPub || d.PublicKey != devicePub {
+		t.Fatal("the keys were not derived from the seed")
+	}
+	if ack := s.SubmitTestReport(d, glow.CurrentTimeslot(), 5000); ack.Status != glow.ReportAckAccepted {
+		t.Fatal("report was not accepted:", ack.Status)
+	}
+}
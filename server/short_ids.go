@@ -0,0 +1,161 @@
+package server
+
+// short_ids.go keeps track of every ShortID that has ever been allocated to a
+// public key, so that a ShortID is never handed to a different public key
+// during the lifetime of the server.
+//
+// The GCA picks the ShortID of every authorization, so most of the checks are
+// about refusing a ShortID that is already taken. A second authorization for a
+// ShortID that belongs to an active device still bans the ShortID, because the
+// GCA signed two authorizations for it. A ShortID that belongs to a device
+// which left active duty, either because it was deauthorized or because it was
+// imported, is refused instead, so that the history of the old device keeps a
+// single owner.
+//
+// The only ShortIDs that the server picks itself are the ones for imported
+// devices that collide, see api_equipment_transfer.go. Those are taken from
+// above the high-water mark, which is the highest ShortID in the registry.
+//
+// The registry is an append-only file of (ShortID, public key) records. It is
+// loaded before the equipment, and any allocation that only exists in the
+// equipment files, because it was made before the registry existed, gets
+// added to the registry at startup.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// shortIDRecordSize is the size of a record in the ShortIDs file.
+const shortIDRecordSize = 4 + 32
+
+// serializeShortIDRecord returns the record that allocates a ShortID to a
+// public key.
+func serializeShortIDRecord(shortID uint32, pk glow.PublicKey) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, shortID)
+	return append(b, pk[:]...)
+}
+
+// allocateShortID records that a ShortID belongs to a public key. A ShortID
+// that already has an owner is left alone.
+func (gcas *GCAServer) allocateShortID(shortID uint32, pk glow.PublicKey) {
+	if _, exists := gcas.shortIDOwners[shortID]; exists {
+		return
+	}
+	gcas.shortIDOwners[shortID] = pk
+	if shortID > gcas.shortIDHighWater {
+		gcas.shortIDHighWater = shortID
+	}
+	if err := gcas.staticStorage.AppendFile(ShortIDsFile, serializeShortIDRecord(shortID, pk), 0644); err != nil {
+		gcas.logger.Errorf("unable to save ShortID allocation: %v", err)
+	}
+}
+
+// checkShortIDReuse returns an error if the ShortID of an authorization was
+// allocated to a different public key, and can't be handed out again.
+func (gcas *GCAServer) checkShortIDReuse(ea glow.EquipmentAuthorization) error {
+	if _, imported := gcas.equipmentImports[ea.ShortID]; imported {
+		return withCode(ErrCodeConflict, fmt.Errorf("ShortID %v belongs to imported equipment", ea.ShortID))
+	}
+	owner, allocated := gcas.shortIDOwners[ea.ShortID]
+	if !allocated || owner == ea.PublicKey {
+		return nil
+	}
+	// A conflict with an active device bans the ShortID.
+	if current, exists := gcas.equipment[ea.ShortID]; exists && current.PublicKey == owner {
+		if _, deauthorized := gcas.equipmentDeauthorizations[owner]; !deauthorized {
+			return nil
+		}
+	}
+	return withCode(ErrCodeConflict, fmt.Errorf("ShortID %v was already allocated to %x", ea.ShortID, owner))
+}
+
+// shortIDInUse returns whether a ShortID is taken on this server.
+func (gcas *GCAServer) shortIDInUse(shortID uint32) bool {
+	_, allocated := gcas.shortIDOwners[shortID]
+	_, active := gcas.equipment[shortID]
+	_, banned := gcas.equipmentBans[shortID]
+	_, imported := gcas.equipmentImports[shortID]
+	return allocated || active || banned || imported || shortID == peerSyncMagic
+}
+
+// nextShortID returns the first free ShortID above the high-water mark.
+func (gcas *GCAServer) nextShortID() uint32 {
+	shortID := gcas.shortIDHighWater + 1
+	for gcas.shortIDInUse(shortID) {
+		shortID++
+	}
+	return shortID
+}
+
+// loadShortIDs loads the registry of allocated ShortIDs, creating the file if
+// it does not exist yet. This needs to happen before the equipment is loaded.
+func (gcas *GCAServer) loadShortIDs() error {
+	data, err := gcas.staticStorage.ReadFile(ShortIDsFile)
+	if os.IsNotExist(err) {
+		return gcas.staticStorage.WriteFile(ShortIDsFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read ShortIDs file: %v", err)
+	}
+	if len(data)%shortIDRecordSize != 0 {
+		return fmt.Errorf("ShortIDs file has an unexpected size")
+	}
+	for i := 0; i < len(data); i += shortIDRecordSize {
+		shortID := binary.LittleEndian.Uint32(data[i:])
+		var pk glow.PublicKey
+		copy(pk[:], data[i+4:i+shortIDRecordSize])
+		if owner, exists := gcas.shortIDOwners[shortID]; exists && owner != pk {
+			return fmt.Errorf("%v: record %v: ShortID %v is allocated twice", ShortIDsFile, i/shortIDRecordSize, shortID)
+		}
+		gcas.shortIDOwners[shortID] = pk
+		if shortID > gcas.shortIDHighWater {
+			gcas.shortIDHighWater = shortID
+		}
+	}
+	return nil
+}
+
+// saveLegacyShortIDs adds every allocation that is only known from the
+// equipment files to the registry, with a single write. This needs to happen
+// after the equipment is loaded, and before any bans are replayed.
+func (gcas *GCAServer) saveLegacyShortIDs() error {
+	owners := make(map[uint32]glow.PublicKey)
+	for shortID, ea := range gcas.equipment {
+		owners[shortID] = ea.PublicKey
+	}
+	for shortID, auths := range gcas.equipmentBanAuths {
+		if len(auths) > 0 {
+			owners[shortID] = auths[0].PublicKey
+		}
+	}
+	shortIDs := make([]uint32, 0, len(owners))
+	for shortID := range owners {
+		if _, exists := gcas.shortIDOwners[shortID]; !exists {
+			shortIDs = append(shortIDs, shortID)
+		}
+	}
+	if len(shortIDs) == 0 {
+		return nil
+	}
+	sort.Slice(shortIDs, func(i, j int) bool { return shortIDs[i] < shortIDs[j] })
+	var data []byte
+	for _, shortID := range shortIDs {
+		data = append(data, serializeShortIDRecord(shortID, owners[shortID])...)
+	}
+	if err := gcas.staticStorage.AppendFile(ShortIDsFile, data, 0644); err != nil {
+		return fmt.Errorf("unable to save ShortID allocations: %v", err)
+	}
+	for _, shortID := range shortIDs {
+		gcas.shortIDOwners[shortID] = owners[shortID]
+		if shortID > gcas.shortIDHighWater {
+			gcas.shortIDHighWater = shortID
+		}
+	}
+	gcas.logger.Infof("added %v existing ShortIDs to the registry", len(shortIDs))
+	return nil
+}
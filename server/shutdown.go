@@ -0,0 +1,55 @@
+package server
+
+// shutdown.go contains the pieces that keep Close() fast. The background loops
+// sleep with gcas.sleep, which returns as soon as the server is stopped, and
+// anything that waits on the network uses the shutdown context, which is
+// canceled the moment Close() is called. That way the only thing Close() has
+// to wait for is the work that is already in flight, and in-flight HTTP
+// handlers only get serverShutdownTime to finish.
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// postJSON sends a POST request with a JSON body to another server. The
+// request gets canceled when the server shuts down, so that a slow peer can't
+// hold up Close().
+//
+// The list of authorized servers doesn't say which peers serve TLS, so a peer
+// that rejects the plain http request because it expects TLS gets the request
+// again over https.
+func (gcas *GCAServer) postJSON(url string, body []byte) (*http.Response, error) {
+	post := func(url string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(gcas.staticShutdownCtx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return http.DefaultClient.Do(req)
+	}
+	resp, err := post(url)
+	if err != nil || resp.StatusCode != http.StatusBadRequest || !strings.HasPrefix(url, "http://") {
+		return resp, err
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if !strings.Contains(string(msg), "HTTP request to an HTTPS server") {
+		resp.Body = io.NopCloser(bytes.NewReader(msg))
+		return resp, nil
+	}
+	resp.Body.Close()
+	return post("https://" + strings.TrimPrefix(url, "http://"))
+}
+
+// closeOnShutdown closes the connection when the server shuts down, which
+// unblocks any read or write that is waiting on it. The returned function
+// needs to be called once the connection is no longer in use.
+func (gcas *GCAServer) closeOnShutdown(conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(gcas.staticShutdownCtx, func() {
+		conn.Close()
+	})
+}
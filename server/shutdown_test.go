@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestCloseIsFast checks that Close() returns quickly even when a peer is
+// hanging on a forwarded request and a sync client never sends its request.
+func TestCloseIsFast(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set up a peer that never answers.
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer peer.Close()
+	defer close(release)
+	peerURL, _ := url.Parse(peer.URL)
+	peerPort, _ := strconv.Atoi(peerURL.Port())
+	server.gcaServers.mu.Lock()
+	server.gcaServers.servers = append(server.gcaServers.servers, AuthorizedServer{
+		Location: "127.0.0.1",
+		HttpPort: uint16(peerPort),
+	})
+	server.gcaServers.mu.Unlock()
+
+	// Authorizing equipment gets forwarded to the peer, which leaves the
+	// handler in flight.
+	submitted := make(chan error, 1)
+	go func() {
+		_, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+		submitted <- err
+	}()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("authorization was not forwarded to the peer")
+	}
+
+	// Open a sync connection that never sends anything.
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", server.tcpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("Close() took %v", elapsed)
+	}
+	// The in-flight handler finished rather than getting cut off.
+	select {
+	case err := <-submitted:
+		if err != nil {
+			t.Error("in-flight authorization failed:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("in-flight authorization did not complete")
+	}
+}
@@ -0,0 +1,504 @@
+package server
+
+// soak_test.go drives a server through weeks of simulated time on a manual
+// clock, with many devices that report late, out of order, and more than once,
+// and with restarts along the way. After every stretch of simulated time the
+// state of the server is checked against what the devices sent:
+//
+//   - the total and the report count of every device in a week never go
+//     down, and match the reports that the server accepted,
+//   - no device has more reports in a week than timeslots have passed,
+//   - a restart loads the exact state that the server had before it, except
+//     for a finalized week, which a restart rotates out early, see
+//     period_finalization.go,
+//   - the ShortID and the public key of a device keep pointing at each other.
+//
+// A failure reports the state of the device that broke the invariant. The
+// default run is small enough for every test run, -long runs the full soak,
+// which takes minutes:
+//
+//	go test -tags test -run TestSoak ./server -long
+//
+// The run is random, every run logs its seed and -soak-seed repeats one.
+
+import (
+	"flag"
+	"fmt"
+	mrand "math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server/clock/clocktest"
+)
+
+var (
+	soakLong = flag.Bool("long", false, "run the soak test at full size")
+	soakSeed = flag.Int64("soak-seed", 0, "the seed of the soak test, random if zero")
+)
+
+// soakConfig describes a soak run.
+type soakConfig struct {
+	Devices int // The number of synthetic devices
+	Periods int // The number of weeks of simulated time
+
+	// Step is the number of timeslots that the clock moves between two
+	// rounds of deliveries, and the invariants get checked every
+	// CheckEvery timeslots.
+	Step       uint32
+	CheckEvery uint32
+
+	// ReportRate is the probability that a device reports for a
+	// timeslot, and DuplicateRate the probability that a report gets
+	// delivered a second time. Every delivery is delayed by up to
+	// MaxDelay timeslots, which reorders them.
+	ReportRate    float64
+	DuplicateRate float64
+	MaxDelay      uint32
+
+	Restarts int // The number of restarts, spread evenly over the run
+	Seed     int64
+}
+
+// soakReport is a report that a device sent, along with the deliveries that
+// are still on their way. Only the first delivery may be accepted.
+type soakReport struct {
+	report    glow.EquipmentReport
+	raw       []byte
+	delivered bool
+}
+
+// soakDelivery is a delivery of a report that arrives at the provided
+// timeslot.
+type soakDelivery struct {
+	due    uint32
+	report *soakReport
+}
+
+// soakDevice is a synthetic device.
+type soakDevice struct {
+	shortID uint32
+	pubkey  glow.PublicKey
+	privkey glow.PrivateKey
+}
+
+// soakWeek identifies a week of a device.
+type soakWeek struct {
+	shortID uint32
+	week    uint32
+}
+
+// soakTally holds the energy and the number of reports of a week.
+type soakTally struct {
+	energy  uint64
+	reports int
+}
+
+// soakSnapshot is the state of the server that has to survive a restart.
+type soakSnapshot struct {
+	Offset    uint32
+	Equipment map[uint32]glow.EquipmentAuthorization
+	ShortIDs  map[glow.PublicKey]uint32
+	Bans      map[uint32]struct{}
+	Reports   map[uint32][]glow.EquipmentReport
+}
+
+// soak is a soak run against a server.
+type soak struct {
+	cfg     soakConfig
+	rng     *mrand.Rand
+	clock   *clocktest.Manual
+	opts    ServerOptions
+	dir     string
+	server  *GCAServer
+	devices []soakDevice
+	now     uint32
+
+	pending  []soakDelivery
+	accepted map[soakWeek]soakTally // What the server accepted, by week
+	observed map[soakWeek]soakTally // What the server held at the last check
+	restarts int
+}
+
+// newSoak launches a server on a manual clock and authorizes the devices of
+// the run.
+func newSoak(t *testing.T, cfg soakConfig) *soak {
+	s := &soak{
+		cfg:      cfg,
+		rng:      mrand.New(mrand.NewSource(cfg.Seed)),
+		clock:    clocktest.NewManual(time.Unix(glow.GenesisTime, 0)),
+		opts:     DefaultServerOptions(),
+		accepted: make(map[soakWeek]soakTally),
+		observed: make(map[soakWeek]soakTally),
+	}
+	s.opts.Clock = s.clock
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), s.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.server, s.dir = server, dir
+	var auths []glow.EquipmentAuthorization
+	for i := 0; i < cfg.Devices; i++ {
+		pub, priv := glow.GenerateKeyPair()
+		d := soakDevice{shortID: uint32(i + 1), pubkey: pub, privkey: priv}
+		s.devices = append(s.devices, d)
+		auths = append(auths, SignEquipmentAuthorization(glow.EquipmentAuthorization{
+			ShortID:    d.shortID,
+			PublicKey:  pub,
+			Capacity:   15400300,
+			Expiration: 100e6,
+		}, gcaPrivKey))
+	}
+	for len(auths) > 0 {
+		n := len(auths)
+		if n > maxBatchAuthorizations {
+			n = maxBatchAuthorizations
+		}
+		results, _, err := server.managedAuthorizeEquipmentBatch(auths[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Status != batchAuthAuthorized {
+				t.Fatalf("device %v was not authorized: %+v", res.ShortID, res)
+			}
+		}
+		auths = auths[n:]
+	}
+	return s
+}
+
+// run moves the clock through every period of the run.
+func (s *soak) run() error {
+	end := uint32(s.cfg.Periods) * 2016
+	lastCheck := uint32(0)
+	for s.now < end {
+		prev := s.now
+		s.now += s.cfg.Step
+		s.clock.Set(time.Unix(glow.TimeslotToUnix(s.now), 0))
+		for ts := prev + 1; ts <= s.now; ts++ {
+			s.sendReports(ts)
+		}
+		if err := s.deliver(); err != nil {
+			return err
+		}
+		s.server.managedCatchUpMigrations()
+		if s.now-lastCheck >= s.cfg.CheckEvery || s.now >= end {
+			lastCheck = s.now
+			if err := s.check(); err != nil {
+				return err
+			}
+		}
+		if s.restarts < s.cfg.Restarts && s.now >= end/uint32(s.cfg.Restarts+1)*uint32(s.restarts+1) {
+			if err := s.restart(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendReports has every device that reports for the timeslot sign a report,
+// and schedules its deliveries.
+func (s *soak) sendReports(timeslot uint32) {
+	for _, d := range s.devices {
+		if s.rng.Float64() >= s.cfg.ReportRate {
+			continue
+		}
+		er := glow.EquipmentReport{ShortID: d.shortID, Timeslot: timeslot, PowerOutput: 10 + uint64(s.rng.Intn(1000))}
+		er.Signature = glow.Sign(er.SigningBytes(), d.privkey)
+		sr := &soakReport{report: er, raw: er.Serialize()}
+		s.schedule(sr)
+		if s.rng.Float64() < s.cfg.DuplicateRate {
+			s.schedule(sr)
+		}
+	}
+}
+
+// schedule adds a delivery of the report with a random delay.
+func (s *soak) schedule(sr *soakReport) {
+	due := sr.report.Timeslot + uint32(s.rng.Intn(int(s.cfg.MaxDelay)+1))
+	s.pending = append(s.pending, soakDelivery{due: due, report: sr})
+}
+
+// deliver submits every delivery that is due, in random order. The first
+// delivery of a report has to be accepted and every later one has to be a
+// duplicate.
+func (s *soak) deliver() error {
+	var due, later []soakDelivery
+	for _, sd := range s.pending {
+		if sd.due <= s.now {
+			due = append(due, sd)
+		} else {
+			later = append(later, sd)
+		}
+	}
+	s.pending = later
+	s.rng.Shuffle(len(due), func(i, j int) { due[i], due[j] = due[j], due[i] })
+	for _, sd := range due {
+		er := sd.report.report
+		outcome, _ := s.server.managedHandleEquipmentReport(sd.report.raw)
+		want := reportAccepted
+		if sd.report.delivered {
+			want = reportDuplicate
+		}
+		if outcome != want {
+			return s.failure(er.ShortID, "the report for timeslot %v was %v at timeslot %v, expected %v", er.Timeslot, outcome, s.now, want)
+		}
+		if !sd.report.delivered {
+			sd.report.delivered = true
+			key := soakWeek{shortID: er.ShortID, week: er.Timeslot / 2016}
+			tally := s.accepted[key]
+			tally.energy += er.PowerOutput
+			tally.reports++
+			s.accepted[key] = tally
+		}
+	}
+	return nil
+}
+
+// check checks the invariants of every device against the weeks that the
+// server holds in memory.
+func (s *soak) check() error {
+	s.server.mu.RLock()
+	defer s.server.mu.RUnlock()
+	gcas := s.server
+	ero := gcas.equipmentReportsOffset
+	for _, d := range s.devices {
+		if ea, exists := gcas.equipment[d.shortID]; !exists || ea.PublicKey != d.pubkey {
+			return s.failureLocked(d.shortID, "the ShortID no longer maps to the public key of the device")
+		}
+		if shortID, exists := gcas.equipmentShortID[d.pubkey]; !exists || shortID != d.shortID {
+			return s.failureLocked(d.shortID, "the public key maps to ShortID %v", shortID)
+		}
+		if owner, exists := gcas.shortIDOwners[d.shortID]; exists && owner != d.pubkey {
+			return s.failureLocked(d.shortID, "the ShortID is owned by %v", owner)
+		}
+
+		dr := gcas.equipmentReports[d.shortID]
+		for half := uint32(0); half < 2; half++ {
+			week := soakWeek{shortID: d.shortID, week: ero/2016 + half}
+			var tally soakTally
+			for i := half * 2016; i < (half+1)*2016; i++ {
+				if !dr.signed(int(i)) {
+					continue
+				}
+				if ero+i > s.now {
+					return s.failureLocked(d.shortID, "there is a report for timeslot %v, which has not happened yet", ero+i)
+				}
+				tally.energy += dr.PowerOutputs[i]
+				tally.reports++
+			}
+			elapsed := int64(s.now) - int64(ero+half*2016) + 1
+			if elapsed < 0 {
+				elapsed = 0
+			}
+			if int64(tally.reports) > elapsed {
+				return s.failureLocked(d.shortID, "week %v has %v reports after %v timeslots", week.week, tally.reports, elapsed)
+			}
+			if prev := s.observed[week]; tally.energy < prev.energy || tally.reports < prev.reports {
+				return s.failureLocked(d.shortID, "the total of week %v went down from %+v to %+v", week.week, prev, tally)
+			}
+			if tally != s.accepted[week] {
+				return s.failureLocked(d.shortID, "week %v holds %+v, but %+v was accepted", week.week, tally, s.accepted[week])
+			}
+			if pt := dr.Totals[half]; pt.Power != int64(tally.energy) || int(pt.Reports) != tally.reports {
+				return s.failureLocked(d.shortID, "the running totals of week %v are %+v, but the reports add up to %+v", week.week, pt, tally)
+			}
+			s.observed[week] = tally
+		}
+	}
+	for week := range s.observed {
+		if week.week < ero/2016 {
+			delete(s.observed, week)
+		}
+	}
+	return nil
+}
+
+// snapshot returns the state of the server that has to survive a restart.
+// The mutex must be held.
+func (s *soak) snapshot() (soakSnapshot, error) {
+	gcas := s.server
+	ss := soakSnapshot{
+		Offset:    gcas.equipmentReportsOffset,
+		Equipment: make(map[uint32]glow.EquipmentAuthorization),
+		ShortIDs:  make(map[glow.PublicKey]uint32),
+		Bans:      make(map[uint32]struct{}),
+		Reports:   make(map[uint32][]glow.EquipmentReport),
+	}
+	for shortID, ea := range gcas.equipment {
+		ss.Equipment[shortID] = ea
+	}
+	for pubkey, shortID := range gcas.equipmentShortID {
+		ss.ShortIDs[pubkey] = shortID
+	}
+	for shortID := range gcas.equipmentBans {
+		ss.Bans[shortID] = struct{}{}
+	}
+	for shortID := range gcas.equipmentReports {
+		reports, err := gcas.signedReports(shortID, 0, 4032)
+		if err != nil {
+			return soakSnapshot{}, err
+		}
+		ss.Reports[shortID] = reports
+	}
+	return ss, nil
+}
+
+// rotated returns the snapshot with the oldest week rotated out.
+func (ss soakSnapshot) rotated() soakSnapshot {
+	rotated := ss
+	rotated.Offset += 2016
+	rotated.Reports = make(map[uint32][]glow.EquipmentReport)
+	for shortID, reports := range ss.Reports {
+		var kept []glow.EquipmentReport
+		for _, er := range reports {
+			if er.Timeslot >= rotated.Offset {
+				kept = append(kept, er)
+			}
+		}
+		rotated.Reports[shortID] = kept
+	}
+	return rotated
+}
+
+// restart closes the server and launches it again in the same directory, and
+// checks that it comes back with the same state.
+func (s *soak) restart() error {
+	s.restarts++
+	s.server.mu.RLock()
+	before, err := s.snapshot()
+	finalized := s.server.oldestPeriodFinalized
+	s.server.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("unable to take a snapshot before restart %v: %v", s.restarts, err)
+	}
+	if finalized {
+		before = before.rotated()
+	}
+	if err := s.server.Close(); err != nil {
+		return fmt.Errorf("unable to close the server for restart %v: %v", s.restarts, err)
+	}
+	s.server, err = NewGCAServerWithOptions(s.dir, false, s.opts)
+	if err != nil {
+		return fmt.Errorf("unable to launch the server for restart %v: %v", s.restarts, err)
+	}
+	s.server.mu.RLock()
+	defer s.server.mu.RUnlock()
+	after, err := s.snapshot()
+	if err != nil {
+		return fmt.Errorf("unable to take a snapshot after restart %v: %v", s.restarts, err)
+	}
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	if before.Offset != after.Offset {
+		return fmt.Errorf("restart %v moved the reports offset from %v to %v", s.restarts, before.Offset, after.Offset)
+	}
+	for _, d := range s.devices {
+		if !reflect.DeepEqual(before.Reports[d.shortID], after.Reports[d.shortID]) || before.Equipment[d.shortID] != after.Equipment[d.shortID] {
+			return s.failureLocked(d.shortID, "restart %v changed the state of the device, it had %v reports before and %v after", s.restarts, len(before.Reports[d.shortID]), len(after.Reports[d.shortID]))
+		}
+	}
+	return fmt.Errorf("restart %v changed the equipment, the ShortIDs, or the bans", s.restarts)
+}
+
+// failure returns an error for the device that broke an invariant, along with
+// the state of the device.
+func (s *soak) failure(shortID uint32, format string, args ...interface{}) error {
+	s.server.mu.RLock()
+	defer s.server.mu.RUnlock()
+	return s.failureLocked(shortID, format, args...)
+}
+
+// failureLocked is failure for callers that hold the mutex.
+func (s *soak) failureLocked(shortID uint32, format string, args ...interface{}) error {
+	return fmt.Errorf("device %v at timeslot %v: %v\n%v", shortID, s.now, fmt.Sprintf(format, args...), s.dumpDevice(shortID))
+}
+
+// dumpDevice describes the state that the server has for a device, next to
+// what the device sent. The mutex must be held.
+func (s *soak) dumpDevice(shortID uint32) string {
+	gcas := s.server
+	var b strings.Builder
+	d := s.devices[shortID-1]
+	fmt.Fprintf(&b, "public key: %v\n", d.pubkey)
+	fmt.Fprintf(&b, "authorization: %+v\n", gcas.equipment[shortID])
+	fmt.Fprintf(&b, "ShortID of the public key: %v, owner of the ShortID: %v\n", gcas.equipmentShortID[d.pubkey], gcas.shortIDOwners[shortID])
+	_, banned := gcas.equipmentBans[shortID]
+	fmt.Fprintf(&b, "banned: %v, last seen: %v, reports offset: %v\n", banned, gcas.equipmentLastSeen[shortID], gcas.equipmentReportsOffset)
+	var weeks []soakWeek
+	for week := range s.accepted {
+		if week.shortID == shortID {
+			weeks = append(weeks, week)
+		}
+	}
+	sort.Slice(weeks, func(i, j int) bool { return weeks[i].week < weeks[j].week })
+	for _, week := range weeks {
+		fmt.Fprintf(&b, "week %v: accepted %+v, last observed %+v\n", week.week, s.accepted[week], s.observed[week])
+	}
+	pending := 0
+	for _, sd := range s.pending {
+		if sd.report.report.ShortID == shortID {
+			pending++
+		}
+	}
+	fmt.Fprintf(&b, "deliveries on their way: %v\n", pending)
+	if dr, exists := gcas.equipmentReports[shortID]; exists {
+		b.WriteString("reports in memory:")
+		for i := range dr.PowerOutputs {
+			if dr.PowerOutputs[i] != 0 {
+				fmt.Fprintf(&b, " %v=%v", gcas.equipmentReportsOffset+uint32(i), dr.PowerOutputs[i])
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// TestSoak runs a soak of the report ingestion, see the top of the file.
+func TestSoak(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	cfg := soakConfig{
+		Devices:       10,
+		Periods:       3,
+		Step:          6,
+		CheckEvery:    6,
+		ReportRate:    0.1,
+		DuplicateRate: 0.1,
+		MaxDelay:      100,
+		Restarts:      3,
+	}
+	if *soakLong {
+		cfg = soakConfig{
+			Devices:       2000,
+			Periods:       6,
+			Step:          3,
+			CheckEvery:    36,
+			ReportRate:    0.02,
+			DuplicateRate: 0.05,
+			MaxDelay:      288,
+			Restarts:      4,
+		}
+	}
+	cfg.Seed = *soakSeed
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	t.Logf("soak seed %v", cfg.Seed)
+
+	s := newSoak(t, cfg)
+	defer func() { s.server.Close() }()
+	if err := s.run(); err != nil {
+		t.Fatal(err)
+	}
+	if s.restarts != cfg.Restarts {
+		t.Fatalf("the run restarted %v times, expected %v", s.restarts, cfg.Restarts)
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+// startup_integrity.go cross-checks the state that was loaded from the
+// different persist files before the server starts serving. Every file gets
+// validated on its own while it is loaded, but a crash or a bad restore can
+// still leave the files disagreeing with each other.
+//
+// Problems that only concern derived state, like a report array that is
+// missing for an authorized device, are repaired in memory. Anything that
+// would mean picking a side between two files causes startup to fail with an
+// error that names the file and the record, so that an operator can decide
+// what to do with it.
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// integrityError returns the error for a record in a persist file that is not
+// consistent with the rest of the state.
+func integrityError(file string, format string, args ...interface{}) error {
+	return fmt.Errorf("integrity check failed: %v: %v", file, fmt.Sprintf(format, args...))
+}
+
+// verifyLoadedState checks that the state that was loaded from disk is
+// self-consistent, repairing it where that is safe. No lock is needed, as
+// this runs before any of the threads of the server are started.
+func (gcas *GCAServer) verifyLoadedState() error {
+	// Go through the equipment in order, so that the errors are
+	// deterministic.
+	shortIDs := make([]uint32, 0, len(gcas.equipment))
+	for shortID := range gcas.equipment {
+		shortIDs = append(shortIDs, shortID)
+	}
+	sort.Slice(shortIDs, func(i, j int) bool { return shortIDs[i] < shortIDs[j] })
+
+	// Every public key belongs to a single ShortID, and every authorized
+	// device has a report slot and an impact rate slot.
+	owners := make(map[glow.PublicKey]uint32)
+	for _, shortID := range shortIDs {
+		ea := gcas.equipment[shortID]
+		if owner, exists := owners[ea.PublicKey]; exists {
+			return integrityError(gcas.equipmentFile(ea), "public key %x is authorized under ShortID %v and ShortID %v", ea.PublicKey, owner, shortID)
+		}
+		owners[ea.PublicKey] = shortID
+	}
+	for _, shortID := range shortIDs {
+		ea := gcas.equipment[shortID]
+		file := gcas.equipmentFile(ea)
+		if _, banned := gcas.equipmentBans[shortID]; banned {
+			return integrityError(file, "authorization for ShortID %v is active, but the ShortID is banned", shortID)
+		}
+		if mapped, exists := gcas.equipmentShortID[ea.PublicKey]; !exists || mapped != shortID {
+			return integrityError(file, "authorization for ShortID %v is not indexed by its public key", shortID)
+		}
+		if owner, exists := gcas.shortIDOwners[shortID]; exists && owner != ea.PublicKey {
+			return integrityError(ShortIDsFile, "ShortID %v is allocated to %x, but authorized for %x", shortID, owner, ea.PublicKey)
+		}
+		if _, exists := gcas.equipmentReports[shortID]; !exists {
+			gcas.logger.Warnf("integrity check: recreating the missing report slot of ShortID %v", shortID)
+			gcas.equipmentReports[shortID] = new(deviceReports)
+		}
+		if _, exists := gcas.equipmentImpactRate[shortID]; !exists {
+			gcas.logger.Warnf("integrity check: recreating the missing impact rate slot of ShortID %v", shortID)
+			gcas.equipmentImpactRate[shortID] = new([4032]float64)
+		}
+	}
+	if len(gcas.equipmentShortID) != len(gcas.equipment) {
+		for pk, shortID := range gcas.equipmentShortID {
+			if owner, exists := owners[pk]; !exists || owner != shortID {
+				return integrityError(EquipmentAuthorizationsFile, "public key %x refers to ShortID %v, which has no authorization", pk, shortID)
+			}
+		}
+	}
+
+	// Report slots that don't belong to a device carry no information, as
+	// the reports could never have been verified.
+	for shortID := range gcas.equipmentReports {
+		if _, exists := gcas.equipment[shortID]; !exists {
+			gcas.logger.Warnf("integrity check: dropping the report slot of unknown ShortID %v", shortID)
+			delete(gcas.equipmentReports, shortID)
+		}
+	}
+	for shortID := range gcas.equipmentImpactRate {
+		if _, exists := gcas.equipment[shortID]; !exists {
+			gcas.logger.Warnf("integrity check: dropping the impact rate slot of unknown ShortID %v", shortID)
+			delete(gcas.equipmentImpactRate, shortID)
+		}
+	}
+
+	// Every report refers to a record that is in the reports files. The
+	// records themselves get checked against the report when they are read,
+	// see report_store.go.
+	numRecords := gcas.reportsFileRecords + gcas.reportsJournalRecords
+	for _, shortID := range shortIDs {
+		reports := gcas.equipmentReports[shortID]
+		for i, record := range reports.Records {
+			if record > numRecords {
+				return integrityError(EquipmentReportsFile, "report for ShortID %v timeslot %v refers to record %v, but there are only %v records", shortID, gcas.equipmentReportsOffset+uint32(i), record, numRecords)
+			}
+		}
+	}
+
+	// Every ban references a device that the server knows about, either
+	// because the device is still authorized or because the evidence for
+	// the ban is on disk. A ban record for a device that is still
+	// authorized is left behind by a crash between saving the record and
+	// saving the evidence, and is harmless.
+	banned := make([]uint32, 0, len(gcas.equipmentBanRecords))
+	for shortID := range gcas.equipmentBanRecords {
+		banned = append(banned, shortID)
+	}
+	sort.Slice(banned, func(i, j int) bool { return banned[i] < banned[j] })
+	for _, shortID := range banned {
+		_, authorized := gcas.equipment[shortID]
+		_, isBanned := gcas.equipmentBans[shortID]
+		if !authorized && !isBanned {
+			return integrityError(BannedEquipmentFile, "ban record for ShortID %v does not reference a known device", shortID)
+		}
+	}
+	for shortID := range gcas.equipmentBans {
+		_, hasAuths := gcas.equipmentBanAuths[shortID]
+		_, hasProof := gcas.equipmentBanProofs[shortID]
+		if !hasAuths && !hasProof {
+			return integrityError(EquipmentBanProofsFile, "ban of ShortID %v has no evidence", shortID)
+		}
+	}
+	return nil
+}
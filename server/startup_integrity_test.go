@@ -0,0 +1,138 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// appendToFile appends data to a persist file of a server that is not
+// running.
+func appendToFile(t *testing.T, dir, name string, data []byte) {
+	t.Helper()
+	if err := serverStorage(dir).AppendFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStartupIntegrityCorruptFiles corrupts the persist files of a server in
+// targeted ways, and checks that the server refuses to start with an error
+// that names the file and the record.
+func TestStartupIntegrityCorruptFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, dir string, ea glow.EquipmentAuthorization, ePriv, gcaPrivKey glow.PrivateKey)
+		want    []string
+	}{
+		{
+			name: "BanRecordForUnknownDevice",
+			corrupt: func(t *testing.T, dir string, ea glow.EquipmentAuthorization, ePriv, gcaPrivKey glow.PrivateKey) {
+				ebr := equipmentBanRecord{ShortID: 77, Reason: banReasonGCAOrdered, Timeslot: 3}
+				appendToFile(t, dir, BannedEquipmentFile, ebr.Serialize())
+			},
+			want: []string{BannedEquipmentFile, "ShortID 77"},
+		},
+		{
+			name: "PublicKeyUnderTwoShortIDs",
+			corrupt: func(t *testing.T, dir string, ea glow.EquipmentAuthorization, ePriv, gcaPrivKey glow.PrivateKey) {
+				dup := ea
+				dup.ShortID = 2
+				dup = SignEquipmentAuthorization(dup, gcaPrivKey)
+				appendToFile(t, dir, EquipmentAuthorizationsFile, dup.Serialize())
+			},
+			want: []string{EquipmentAuthorizationsFile, "ShortID 1 and ShortID 2"},
+		},
+		{
+			name: "ReportPastThePeriod",
+			corrupt: func(t *testing.T, dir string, ea glow.EquipmentAuthorization, ePriv, gcaPrivKey glow.PrivateKey) {
+				appendToFile(t, dir, EquipmentReportsFile, generateTestReport(ea.ShortID, 4032, ePriv))
+			},
+			want: []string{EquipmentReportsFile, "record 0", "timeslot 4032"},
+		},
+		{
+			name: "JournalReportForUnknownDevice",
+			corrupt: func(t *testing.T, dir string, ea glow.EquipmentAuthorization, ePriv, gcaPrivKey glow.PrivateKey) {
+				report := glow.EquipmentReport{ShortID: 9, Timeslot: 5, PowerOutput: 5}
+				report.Signature = glow.Sign(report.SigningBytes(), ePriv)
+				appendToFile(t, dir, ReportsJournalFile, encodeJournalRecord(report))
+			},
+			want: []string{ReportsJournalFile, "record 1", "unknown equipment ID: 9"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 3, ePriv)); outcome != reportAccepted {
+				t.Fatal("report was not accepted:", outcome)
+			}
+			if err := server.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The untouched files load fine.
+			server, err = NewGCAServer(dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := server.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.corrupt(t, dir, ea, ePriv, gcaPrivKey)
+			server, err = NewGCAServer(dir, false)
+			if err == nil {
+				server.Close()
+				t.Fatal("server started with corrupt files")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+// TestStartupIntegrityRepairs checks that the integrity check recreates the
+// report slots that are missing, and drops the ones that belong to no device.
+func TestStartupIntegrityRepairs(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	delete(server.equipmentReports, ea.ShortID)
+	delete(server.equipmentImpactRate, ea.ShortID)
+	server.equipmentReports[50] = new(deviceReports)
+	if err := server.verifyLoadedState(); err != nil {
+		t.Fatal(err)
+	}
+	if server.equipmentReports[ea.ShortID] == nil || server.equipmentImpactRate[ea.ShortID] == nil {
+		t.Fatal("missing slots were not recreated")
+	}
+	if _, exists := server.equipmentReports[50]; exists {
+		t.Fatal("slot of an unknown device was not dropped")
+	}
+
+	// A report that refers to a record past the end of the reports files
+	// can't be repaired.
+	server.equipmentReports[ea.ShortID].setReport(7, glow.EquipmentReport{PowerOutput: 5}, server.nextReportRecord())
+	if err := server.verifyLoadedState(); err == nil || !strings.Contains(err.Error(), EquipmentReportsFile) {
+		t.Fatal("report without a record was not caught:", err)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+// startup_load.go keeps the time between starting a server and its listeners
+// coming up short, because the reports that devices send in that window are
+// lost. NewGCAServer has three phases:
+//
+//  1. The state that is needed to accept traffic gets loaded: the keys, the
+//     set of authorized equipment along with its bans, and the reports of the
+//     current period. Files that don't depend on each other are loaded in
+//     parallel by loadInParallel, and the signatures of the reports, which
+//     are most of the work, are verified on every CPU by parseReports.
+//  2. The listeners come up.
+//  3. The history of the device stats, which grows by a week every week and
+//     is only needed to serve past weeks, gets decoded in the background by
+//     threadedLoadEquipmentHistory. Until it's done, the endpoints that read
+//     the history return LOADING with a Retry-After header.
+//
+// The weekly migration may append to the history while the background load is
+// running. The migrated weeks go to the end of the history in memory, and the
+// background load puts the weeks that were on disk in front of them.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// loadInParallel runs the provided loaders in their own goroutines and
+// returns the first error, after all of them have finished. The loaders must
+// not touch the same state.
+func loadInParallel(loaders ...func() error) error {
+	errs := make([]error, len(loaders))
+	var wg sync.WaitGroup
+	for i, load := range loaders {
+		wg.Add(1)
+		go func(i int, load func() error) {
+			defer wg.Done()
+			errs[i] = load()
+		}(i, load)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseReports parses and verifies the provided raw reports on every CPU. The
+// results are in the same order as the input, so that the reports can still
+// be applied in the order in which they were saved. The reports of banned
+// equipment are verified by parseBannedReport. The equipment must not change
+// while the reports are being parsed.
+func (gcas *GCAServer) parseReports(rawReports [][]byte) ([]glow.EquipmentReport, []error) {
+	reports := make([]glow.EquipmentReport, len(rawReports))
+	errs := make([]error, len(rawReports))
+	workers := runtime.GOMAXPROCS(0)
+	chunk := (len(rawReports) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < len(rawReports); start += chunk {
+		end := start + chunk
+		if end > len(rawReports) {
+			end = len(rawReports)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				reports[i], errs[i] = gcas.parseReport(rawReports[i])
+				if errs[i] != nil {
+					reports[i], errs[i] = gcas.parseBannedReport(rawReports[i], errs[i])
+				}
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return reports, errs
+}
+
+// threadedLoadEquipmentHistory decodes the first 'size' bytes of the history
+// file, which loadEquipmentHistory found to hold 'entries' entries, and puts
+// them in front of the history in memory. Only the weeks within the retention
+// get decoded, see history_retention.go. If the history can't be loaded, the
+// endpoints that need it keep returning LOADING.
+func (gcas *GCAServer) threadedLoadEquipmentHistory(size int64, entries int) {
+	if err := gcas.decodeEquipmentHistory(size, entries); err != nil {
+		gcas.logger.Errorf("unable to load the device stats history: %v", err)
+	}
+}
+
+// decodeEquipmentHistory does the work of threadedLoadEquipmentHistory. If the
+// server stops before the history is decoded, the history stays unloaded.
+func (gcas *GCAServer) decodeEquipmentHistory(size int64, entries int) error {
+	start := gcas.now()
+	gcas.mu.RLock()
+	skip := entries - gcas.historyRetentionWeeks
+	if skip < 0 {
+		skip = 0
+	}
+	var pos int64
+	if skip < entries {
+		pos = gcas.equipmentHistoryPositions[skip]
+	}
+	gcas.mu.RUnlock()
+	f, err := gcas.staticStorage.Open(AllDeviceStatsHistoryFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(io.NewSectionReader(f, pos, size-pos))
+	history := make([]AllDeviceStats, 0, entries-skip)
+	var buf []byte
+	for len(history) < entries-skip {
+		if gcas.tg.IsStopped() {
+			return nil
+		}
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		entrySize := 4 + int(binary.LittleEndian.Uint32(header[:]))*(32+8*2*2016) + 4 + 64
+		if cap(buf) < entrySize {
+			buf = make([]byte, entrySize)
+		}
+		buf = buf[:entrySize]
+		copy(buf, header[:])
+		if _, err := io.ReadFull(r, buf[4:]); err != nil {
+			return err
+		}
+		ads, _, err := DeserializeStreamAllDeviceStats(buf)
+		if err != nil {
+			return fmt.Errorf("unable to decode all device stats: %v", err)
+		}
+		history = append(history, ads)
+	}
+
+	gcas.mu.Lock()
+	gcas.equipmentStatsHistory = append(history, gcas.equipmentStatsHistory...)
+	gcas.equipmentHistoryEvicted = skip
+	close(gcas.staticStatsHistoryLoaded)
+	gcas.evictHistory()
+	gcas.mu.Unlock()
+	gcas.logger.Infof("loaded %v of %v weeks of device stats history in %v", entries-skip, entries, gcas.now().Sub(start))
+	return nil
+}
+
+// statsHistoryLoaded returns whether the background load of the stats history
+// has finished.
+func (gcas *GCAServer) statsHistoryLoaded() bool {
+	select {
+	case <-gcas.staticStatsHistoryLoaded:
+		return true
+	default:
+		return false
+	}
+}
+
+// managedNeedsStatsHistory returns whether a request for the timeslots
+// starting at 'start' needs the stats history while it is still loading.
+func (gcas *GCAServer) managedNeedsStatsHistory(start uint32) bool {
+	gcas.mu.RLock()
+	defer gcas.mu.RUnlock()
+	return start < gcas.equipmentReportsOffset && !gcas.statsHistoryLoaded()
+}
+
+// writeLoadingError tells the caller that the data it asked for is still
+// being loaded, and when to try again. v1 handlers pass writeError and v2
+// handlers pass writeAPIError.
+func writeLoadingError(w http.ResponseWriter, writeErr func(http.ResponseWriter, string, string)) {
+	w.Header().Set("Retry-After", strconv.Itoa(loadingRetryAfter))
+	writeErr(w, ErrCodeLoading, fmt.Sprintf("The server is still loading its history, try again in %v seconds", loadingRetryAfter))
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// generateLargeState fills the directory of a server with 'devices' devices,
+// 'weeks' weeks of stats history, and 'reports' reports per device in the
+// current window. The current timeslot is left at the end of the reports, so
+// that the reports stay in the window. The server is closed when it returns,
+// along with the directory it returns the keys of the GCA.
+func generateLargeState(tb testing.TB, devices, weeks, reports int) (string, glow.PublicKey, glow.PrivateKey) {
+	tb.Helper()
+	server, dir, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(tb.Name())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keys := make([]glow.PrivateKey, devices)
+	auths := make([]glow.EquipmentAuthorization, devices)
+	for i := range keys {
+		auths[i], keys[i], err = server.AuthorizeTestDevice(uint32(i), gcaPrivKey)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for w := 0; w < weeks; w++ {
+		ads := AllDeviceStats{TimeslotOffset: uint32(w * 2016), Devices: make([]DeviceStats, devices)}
+		for i := range ads.Devices {
+			ads.Devices[i].PublicKey = auths[i].PublicKey
+			for j := range ads.Devices[i].PowerOutputs {
+				ads.Devices[i].PowerOutputs[j] = uint64(i + j)
+				ads.Devices[i].ImpactRates[j] = float64(w)
+			}
+		}
+		server.signDeviceStats(&ads)
+		if err := server.saveAllDeviceStats(ads); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := server.Close(); err != nil {
+		tb.Fatal(err)
+	}
+
+	// Restart with the history in place, which moves the reports window
+	// past it, and fill the window.
+	ero := uint32(weeks * 2016)
+	glow.SetCurrentTimeslot(ero + uint32(reports))
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := range keys {
+		for ts := 0; ts < reports; ts++ {
+			report := generateTestReport(auths[i].ShortID, ero+uint32(ts), keys[i])
+			if outcome, _ := server.managedHandleEquipmentReport(report); outcome != reportAccepted {
+				tb.Fatal("report was not accepted:", outcome)
+			}
+		}
+	}
+	if err := server.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return dir, gcaPubKey, gcaPrivKey
+}
+
+// waitForStatsHistory waits for the background load of the stats history.
+func (gcas *GCAServer) waitForStatsHistory(tb testing.TB) {
+	tb.Helper()
+	select {
+	case <-gcas.staticStatsHistoryLoaded:
+	case <-time.After(10 * time.Second):
+		tb.Fatal("the stats history was not loaded")
+	}
+}
+
+// TestStartupLoading checks that the stats history loads in the background,
+// that the endpoints which need it ask the caller to retry until then, and
+// that the weeks which get migrated while it loads end up behind it.
+func TestStartupLoading(t *testing.T) {
+	dir, _, _ := generateLargeState(t, 3, 3, 5)
+	defer glow.SetCurrentTimeslot(0)
+	server, err := NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.waitForStatsHistory(t)
+
+	get := func(route string) (int, string, APIError) {
+		t.Helper()
+		resp, err := http.Get("http://" + server.httpDialAddr() + route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var apiErr APIError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return resp.StatusCode, resp.Header.Get("Retry-After"), apiErr
+	}
+	server.mu.RLock()
+	ero := server.equipmentReportsOffset
+	full := server.equipmentStatsHistory
+	pubkey := hex.EncodeToString(full[0].Devices[0].PublicKey[:])
+	server.mu.RUnlock()
+	if ero != 3*2016 || len(full) != 3 || full[1].TimeslotOffset != 2016 || full[2].Devices[1].ImpactRates[7] != 2 {
+		t.Fatal("the stats history was not loaded correctly:", ero, len(full))
+	}
+	routes := []string{
+		"/api/v1/all-device-stats?timeslot_offset=2016",
+		"/api/v2/all-device-stats?timeslot_offset=2016",
+		"/api/v1/equipment-reports.csv?pubkey=" + pubkey + "&start=0",
+		fmt.Sprintf("/api/v1/device-impact?pubkey=%v&start=2010&end=2020", pubkey),
+	}
+	for _, route := range routes {
+		if status, _, _ := get(route); status != http.StatusOK {
+			t.Fatal("history was not served:", route, status)
+		}
+	}
+
+	// Pretend that the history is still loading, and that the last week
+	// was migrated in the meantime.
+	server.mu.Lock()
+	server.staticStatsHistoryLoaded = make(chan struct{})
+	server.equipmentStatsHistory = full[2:]
+	server.mu.Unlock()
+	for _, route := range routes {
+		if status, retry, apiErr := get(route); status != http.StatusServiceUnavailable || retry == "" || apiErr.Code != ErrCodeLoading {
+			t.Fatal("history was served while loading:", route, status, retry, apiErr)
+		}
+	}
+	if status, _, _ := get(fmt.Sprintf("/api/v1/all-device-stats?timeslot_offset=%v", ero)); status != http.StatusOK {
+		t.Fatal("the current week was not served while loading:", status)
+	}
+	entrySize := int64(4 + 3*(32+8*2*2016) + 4 + 64)
+	server.threadedLoadEquipmentHistory(2*entrySize, 2)
+	server.waitForStatsHistory(t)
+	server.mu.RLock()
+	merged := server.equipmentStatsHistory
+	server.mu.RUnlock()
+	if !reflect.DeepEqual(merged, full) {
+		t.Fatal("the loaded weeks were not put in front of the migrated ones")
+	}
+
+	// A truncated history is still caught at startup.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	history, err := serverStorage(dir).ReadFile(AllDeviceStatsHistoryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serverStorage(dir).WriteFile(AllDeviceStatsHistoryFile, history[:3*entrySize-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err == nil {
+		t.Fatal("server started with a truncated history")
+	}
+}
+
+// BenchmarkStartup measures how long a server with a year of history takes
+// until NewGCAServer returns, which is when the listeners are up.
+func BenchmarkStartup(b *testing.B) {
+	dir, _, _ := generateLargeState(b, 100, 52, 250)
+	defer glow.SetCurrentTimeslot(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		server, err := NewGCAServer(dir, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(time.Since(start).Milliseconds()), "listener-ready-ms")
+		if err := server.Close(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,296 @@
+package server
+
+// stats_fields.go lets the callers of /api/v2/all-device-stats pick the fields
+// of the device stats that they need with the 'fields' query parameter, a
+// comma separated list such as fields=short_id,totals. The relayer only needs
+// the totals and the map only needs the location and the online flag, while
+// the power outputs and the impact rates of a week are almost all of the
+// response. The fields that aren't picked are never built, so leaving out the
+// report arrays also saves the copy and the encoding of them.
+//
+// Without the parameter the response is the same as it has always been, plus
+// the uptime, the decoded authorization and the uncredited timeslots of every
+// device, and the ban of the banned devices. The short_id, totals, location
+// and note fields are only included when they are asked for. The signature of
+// the response covers the public keys, the power outputs and the impact rates
+// of the devices, so it's only computed and returned if all three of them are
+// picked.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// statsFields is a set of the fields of V2DeviceStats.
+type statsFields uint32
+
+// The fields of V2DeviceStats that can be picked.
+const (
+	statsFieldPubkey statsFields = 1 << iota
+	statsFieldShortID
+	statsFieldPowerOutputs
+	statsFieldImpactRates
+	statsFieldTotals
+	statsFieldRegion
+	statsFieldSigningKey
+	statsFieldStaleImpactRates
+	statsFieldCorrectedTimeslots
+	statsFieldOutageTimeslots
+	statsFieldLastSeen
+	statsFieldOnline
+	statsFieldLocation
+	statsFieldNote
+	statsFieldUptime
+	statsFieldAuthorization
+	statsFieldUncreditedTimeslots
+	statsFieldBanned
+)
+
+// statsFieldNames are the names of the fields in the 'fields' query
+// parameter, in the order that they appear in the response. last_seen
+// covers both last_seen_timeslot and last_seen_unix, and banned covers both
+// banned and ban_timeslot.
+var statsFieldNames = []struct {
+	name  string
+	field statsFields
+}{
+	{"pubkey", statsFieldPubkey},
+	{"short_id", statsFieldShortID},
+	{"power_outputs", statsFieldPowerOutputs},
+	{"impact_rates", statsFieldImpactRates},
+	{"totals", statsFieldTotals},
+	{"region", statsFieldRegion},
+	{"signing_key", statsFieldSigningKey},
+	{"stale_impact_rates", statsFieldStaleImpactRates},
+	{"corrected_timeslots", statsFieldCorrectedTimeslots},
+	{"outage_timeslots", statsFieldOutageTimeslots},
+	{"uncredited_timeslots", statsFieldUncreditedTimeslots},
+	{"last_seen", statsFieldLastSeen},
+	{"online", statsFieldOnline},
+	{"location", statsFieldLocation},
+	{"note", statsFieldNote},
+	{"uptime", statsFieldUptime},
+	{"authorization", statsFieldAuthorization},
+	{"banned", statsFieldBanned},
+}
+
+// defaultStatsFields are the fields that are returned when the 'fields'
+// query parameter is not set.
+const defaultStatsFields = statsFieldPubkey | statsFieldPowerOutputs | statsFieldImpactRates | statsFieldRegion | statsFieldSigningKey |
+	statsFieldStaleImpactRates | statsFieldCorrectedTimeslots | statsFieldOutageTimeslots | statsFieldLastSeen | statsFieldOnline | statsFieldUptime |
+	statsFieldAuthorization | statsFieldUncreditedTimeslots | statsFieldBanned
+
+// statsFieldsSigned are the fields that the signature of the stats covers.
+const statsFieldsSigned = statsFieldPubkey | statsFieldPowerOutputs | statsFieldImpactRates
+
+// has returns whether all of the provided fields are in the set.
+func (sf statsFields) has(fields statsFields) bool {
+	return sf&fields == fields
+}
+
+// parseStatsFields parses the 'fields' query parameter, returning the default
+// fields if it is not set.
+func parseStatsFields(q url.Values) (statsFields, error) {
+	str := q.Get("fields")
+	if str == "" {
+		return defaultStatsFields, nil
+	}
+	var sf statsFields
+	for _, name := range strings.Split(str, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		field := statsFields(0)
+		for _, sfn := range statsFieldNames {
+			if sfn.name == name {
+				field = sfn.field
+				break
+			}
+		}
+		if field == 0 {
+			valid := make([]string, 0, len(statsFieldNames))
+			for _, sfn := range statsFieldNames {
+				valid = append(valid, sfn.name)
+			}
+			return 0, fmt.Errorf("unknown field %q, valid fields are %v", name, strings.Join(valid, ", "))
+		}
+		sf |= field
+	}
+	if sf == 0 {
+		return 0, fmt.Errorf("fields must name at least one field")
+	}
+	return sf, nil
+}
+
+// v2DeviceStats builds the picked fields of the v2 stats of a device. The
+// power outputs and the impact rates of the first cutoff timeslots are left
+// at zero, for since_timeslot. The stats are not modified.
+func (snap *statsSnapshot) v2DeviceStats(ds *DeviceStats, fields statsFields, cutoff uint32, now uint32) V2DeviceStats {
+	da := snap.annotations[ds.PublicKey]
+	v2ds := V2DeviceStats{fields: fields}
+	if fields.has(statsFieldPubkey) {
+		v2ds.PublicKey = v2Hex(ds.PublicKey[:])
+	}
+	if shortID, exists := snap.shortIDs[ds.PublicKey]; exists && fields.has(statsFieldShortID) {
+		v2ds.ShortID = &shortID
+	}
+	if fields.has(statsFieldPowerOutputs) {
+		v2ds.PowerOutputs = make([]int64, len(ds.PowerOutputs))
+		for i := cutoff; i < uint32(len(ds.PowerOutputs)); i++ {
+			v2ds.PowerOutputs[i] = int64(ds.PowerOutputs[i])
+		}
+	}
+	if fields.has(statsFieldImpactRates) {
+		v2ds.ImpactRates = make([]float64, len(ds.ImpactRates))
+		copy(v2ds.ImpactRates[cutoff:], ds.ImpactRates[cutoff:])
+	}
+	if fields.has(statsFieldTotals) {
+		v2ds.Totals = deviceTotals(ds, cutoff)
+	}
+	if fields.has(statsFieldRegion) {
+		v2ds.Region = da.region
+	}
+	if da.signingKey != nil && fields.has(statsFieldSigningKey) {
+		v2ds.SigningKey = v2Hex(da.signingKey[:])
+	}
+	if fields.has(statsFieldStaleImpactRates) {
+		v2ds.StaleImpactRates = da.staleImpactRates
+	}
+	if fields.has(statsFieldCorrectedTimeslots) {
+		v2ds.CorrectedTimeslots = da.correctedTimeslots
+	}
+	if fields.has(statsFieldOutageTimeslots) {
+		v2ds.OutageTimeslots = da.outageTimeslots
+	}
+	if fields.has(statsFieldUncreditedTimeslots) {
+		v2ds.UncreditedTimeslots = uncreditedTimeslots(ds, cutoff)
+	}
+	if da.hasReported {
+		lastSeen, lastSeenUnix := da.lastSeen, glow.TimeslotToUnix(da.lastSeen)
+		v2ds.LastSeenTimeslot = &lastSeen
+		v2ds.LastSeenUnix = &lastSeenUnix
+		v2ds.Online = !da.banned && da.lastSeen+snap.onlineTimeslots > now
+	}
+	if da.hasLocation && fields.has(statsFieldLocation) {
+		v2ds.Location = &V2Location{Latitude: da.latitude, Longitude: da.longitude}
+	}
+	if da.note != nil && fields.has(statsFieldNote) {
+		v2ds.Note = v2DeviceNote(*da.note)
+	}
+	if fields.has(statsFieldUptime) {
+		v2ds.Uptime = da.uptime
+	}
+	if da.authorization != nil && fields.has(statsFieldAuthorization) {
+		v2e := v2Equipment(*da.authorization)
+		v2ds.Authorization = &v2e
+	}
+	if da.banned && fields.has(statsFieldBanned) {
+		banTimeslot := da.banTimeslot
+		v2ds.Banned = true
+		v2ds.BanTimeslot = &banTimeslot
+	}
+	return v2ds
+}
+
+// deviceTotals adds up the credited power outputs of a device from the cutoff
+// on, along with the raw readings if they add up to something else.
+func deviceTotals(ds *DeviceStats, cutoff uint32) *V2DeviceTotals {
+	var totals V2DeviceTotals
+	var raw int64
+	for i := cutoff; i < uint32(len(ds.PowerOutputs)); i++ {
+		switch output := ds.PowerOutputs[i]; output {
+		case 0:
+		case 1:
+			totals.Reports++
+			totals.BannedTimeslots++
+		default:
+			credited := glow.CreditedPowerOutput(output)
+			totals.Reports++
+			totals.Energy += int64(credited)
+			totals.Impact += float64(credited) * ds.ImpactRates[i]
+			if !glow.PowerOutputIsSentinel(output) {
+				raw += glow.PowerReading(output)
+			}
+		}
+	}
+	if raw != totals.Energy {
+		totals.RawEnergy = &raw
+	}
+	return &totals
+}
+
+// uncreditedTimeslots returns the indexes from the cutoff on of the power
+// outputs that hold a reading which isn't credited, the negative readings and
+// the garbage.
+func uncreditedTimeslots(ds *DeviceStats, cutoff uint32) []int {
+	var uncredited []int
+	for i := cutoff; i < uint32(len(ds.PowerOutputs)); i++ {
+		output := ds.PowerOutputs[i]
+		if !glow.PowerOutputIsSentinel(output) && glow.CreditedPowerOutput(output) != output {
+			uncredited = append(uncredited, int(i))
+		}
+	}
+	return uncredited
+}
+
+// MarshalJSON encodes the picked fields of the stats, in the order of
+// statsFieldNames. The fields that are omitted when they are empty keep
+// being omitted when they are picked.
+func (v2ds V2DeviceStats) MarshalJSON() ([]byte, error) {
+	fields := v2ds.fields
+	if fields == 0 {
+		fields = defaultStatsFields
+	}
+	type jsonField struct {
+		key   string
+		value interface{}
+	}
+	var out []jsonField
+	add := func(field statsFields, key string, value interface{}, omit bool) {
+		if fields.has(field) && !omit {
+			out = append(out, jsonField{key, value})
+		}
+	}
+	add(statsFieldPubkey, "pubkey", v2ds.PublicKey, false)
+	add(statsFieldShortID, "short_id", v2ds.ShortID, v2ds.ShortID == nil)
+	add(statsFieldPowerOutputs, "power_outputs", v2ds.PowerOutputs, false)
+	add(statsFieldImpactRates, "impact_rates", v2ds.ImpactRates, false)
+	add(statsFieldTotals, "totals", v2ds.Totals, v2ds.Totals == nil)
+	add(statsFieldRegion, "region", v2ds.Region, v2ds.Region == "")
+	add(statsFieldSigningKey, "signing_key", v2ds.SigningKey, v2ds.SigningKey == "")
+	add(statsFieldStaleImpactRates, "stale_impact_rates", v2ds.StaleImpactRates, len(v2ds.StaleImpactRates) == 0)
+	add(statsFieldCorrectedTimeslots, "corrected_timeslots", v2ds.CorrectedTimeslots, len(v2ds.CorrectedTimeslots) == 0)
+	add(statsFieldOutageTimeslots, "outage_timeslots", v2ds.OutageTimeslots, len(v2ds.OutageTimeslots) == 0)
+	add(statsFieldUncreditedTimeslots, "uncredited_timeslots", v2ds.UncreditedTimeslots, len(v2ds.UncreditedTimeslots) == 0)
+	add(statsFieldLastSeen, "last_seen_timeslot", v2ds.LastSeenTimeslot, false)
+	add(statsFieldLastSeen, "last_seen_unix", v2ds.LastSeenUnix, false)
+	add(statsFieldOnline, "online", v2ds.Online, false)
+	add(statsFieldLocation, "location", v2ds.Location, v2ds.Location == nil)
+	add(statsFieldNote, "note", v2ds.Note, v2ds.Note == nil)
+	add(statsFieldUptime, "uptime", v2ds.Uptime, v2ds.Uptime == nil)
+	add(statsFieldAuthorization, "authorization", v2ds.Authorization, v2ds.Authorization == nil)
+	add(statsFieldBanned, "banned", v2ds.Banned, !v2ds.Banned)
+	add(statsFieldBanned, "ban_timeslot", v2ds.BanTimeslot, v2ds.BanTimeslot == nil)
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range out {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "%q:", f.key)
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestStatsFields checks that the fields query parameter of the v2 stats only
+// returns the picked fields, that the signature is only returned when it can
+// be verified, and that unknown fields are refused. The impact rates aren't
+// collected, so the signatures of two fetches can be compared.
+func TestStatsFields(t *testing.T) {
+	opts := DefaultServerOptions()
+	opts.DisableImpactCollection = true
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+
+	pub, priv := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{ShortID: 1, PublicKey: pub, Latitude: 38.5, Longitude: -121.5, Capacity: 1000, Expiration: 5000}
+	if err := server.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []uint32{4, 6, 8} {
+		er := glow.EquipmentReport{ShortID: 1, Timeslot: ts, PowerOutput: 500}
+		er.Signature = glow.Sign(er.SigningBytes(), priv)
+		server.managedHandleEquipmentReport(er.Serialize())
+	}
+	dn := DeviceNote{PublicKey: pub, Note: "roof mount", Timestamp: 100}
+	dn.Signature = glow.Sign(dn.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedAddDeviceNote(dn); err != nil {
+		t.Fatal(err)
+	}
+	get := func(route string) map[string]interface{} {
+		t.Helper()
+		status, body, err := server.getV2(route)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("unable to fetch %v: %v %v %v", route, status, body, err)
+		}
+		return body.(map[string]interface{})
+	}
+
+	// The relayer and the map only get what they ask for, without the
+	// report arrays or the signature.
+	body := checkKeys(t, "all-device-stats", get("all-device-stats?timeslot_offset=0&fields=short_id,totals&since_timeslot=5"), "week_start_timeslot", "week_start_unix", "total_devices", "devices", "build")
+	obj := checkKeys(t, "device stats", checkList(t, "devices", body["devices"], 1)[0], "short_id", "totals")
+	totals := checkKeys(t, "totals", obj["totals"], "energy", "impact", "reports", "banned_timeslots")
+	if obj["short_id"] != float64(1) || totals["energy"] != float64(1000) || totals["reports"] != float64(2) {
+		t.Errorf("unexpected totals after the since_timeslot: %v", obj)
+	}
+	body = get("all-device-stats?timeslot_offset=0&fields=location,online,note")
+	obj = checkKeys(t, "device stats", checkList(t, "devices", body["devices"], 1)[0], "location", "online", "note")
+	location := checkKeys(t, "location", obj["location"], "latitude", "longitude")
+	note := checkKeys(t, "note", obj["note"], "note", "timestamp", "signature")
+	if location["latitude"] != 38.5 || location["longitude"] != -121.5 || obj["online"] != true || note["note"] != "roof mount" {
+		t.Errorf("unexpected map view: %v", obj)
+	}
+
+	// Picking the signed fields returns the same signature as the full
+	// response.
+	full := get("all-device-stats?timeslot_offset=0")
+	body = get("all-device-stats?timeslot_offset=0&fields=pubkey,%20power_outputs%20,impact_rates")
+	obj = checkKeys(t, "device stats", checkList(t, "devices", body["devices"], 1)[0], "pubkey", "power_outputs", "impact_rates")
+	if body["signature"] == nil || body["signature"] != full["signature"] || obj["pubkey"] != hex.EncodeToString(pub[:]) {
+		t.Error("the signature of the picked fields does not match the full response:", body["signature"], full["signature"])
+	}
+	checkKeys(t, "device stats", checkList(t, "devices", full["devices"], 1)[0], "pubkey", "power_outputs", "impact_rates", "last_seen_timeslot", "last_seen_unix", "online", "uptime", "authorization")
+
+	// Unknown fields are refused with the list of the valid ones.
+	for _, fields := range []string{"totals,bogus", ",", "PowerOutputs"} {
+		status, body, err := server.getV2("all-device-stats?timeslot_offset=0&fields=" + fields)
+		if err != nil || status != http.StatusBadRequest {
+			t.Fatalf("fields %q: unexpected status %v %v", fields, status, err)
+		}
+		obj := checkKeys(t, "error", body, v2ErrorKeys...)
+		if msg, _ := obj["message"].(string); fields != "," && !strings.Contains(msg, "short_id, power_outputs") {
+			t.Errorf("fields %q: the error does not list the valid fields: %v", fields, msg)
+		}
+	}
+}
+
+// TestStatsAuthorization checks that the decoded authorization in the v2 stats
+// converts back to exactly the authorization that the v1 equipment route
+// returns, and that the GCA signature verifies against it.
+func TestStatsAuthorization(t *testing.T) {
+	server, _, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	pub, _ := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{
+		ShortID:        7,
+		PublicKey:      pub,
+		Latitude:       -33.865,
+		Longitude:      151.209,
+		Capacity:       1234567,
+		Debt:           89,
+		Expiration:     100000,
+		Initialization: 42,
+		ProtocolFee:    5000000,
+	}
+	if err := server.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	getJSON := func(route string, v interface{}) {
+		t.Helper()
+		resp, err := http.Get("http://" + server.httpDialAddr() + route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("unable to fetch", route, resp.StatusCode, err)
+		}
+	}
+	var raw EquipmentResponse
+	getJSON("/api/v1/equipment", &raw)
+	var stats struct {
+		Devices []struct {
+			Authorization V2Equipment `json:"authorization"`
+		} `json:"devices"`
+	}
+	getJSON("/api/v2/all-device-stats?timeslot_offset=0&fields=authorization", &stats)
+	if len(stats.Devices) != 1 {
+		t.Fatal("unexpected devices:", stats.Devices)
+	}
+
+	v2e := stats.Devices[0].Authorization
+	decoded := glow.EquipmentAuthorization{
+		Version:        v2e.Version,
+		ShortID:        v2e.ShortID,
+		Latitude:       v2e.Latitude,
+		Longitude:      v2e.Longitude,
+		Capacity:       v2e.Capacity,
+		Debt:           v2e.Debt,
+		Expiration:     v2e.ExpirationTimeslot,
+		Initialization: v2e.InitializationTimeslot,
+		ProtocolFee:    v2e.ProtocolFee,
+		Nonce:          v2e.Nonce,
+	}
+	pubBytes, err1 := hex.DecodeString(v2e.PublicKey)
+	sigBytes, err2 := hex.DecodeString(v2e.Signature)
+	if err1 != nil || err2 != nil || copy(decoded.PublicKey[:], pubBytes) != len(decoded.PublicKey) || copy(decoded.Signature[:], sigBytes) != len(decoded.Signature) {
+		t.Fatal("the keys are not hex:", v2e.PublicKey, v2e.Signature)
+	}
+	if decoded != raw.EquipmentDetails[7] {
+		t.Fatalf("the decoded authorization %+v does not match the raw one %+v", decoded, raw.EquipmentDetails[7])
+	}
+	if !glow.Verify(gcaPubKey, decoded.SigningBytes(), decoded.Signature) {
+		t.Fatal("the GCA signature does not verify against the decoded authorization")
+	}
+	if v2e.CapacityWatts != 14814.804 || v2e.ExpirationUnix != glow.TimeslotToUnix(100000) || v2e.InitializationUnix != glow.TimeslotToUnix(42) {
+		t.Fatalf("unexpected units: %+v", v2e)
+	}
+}
+
+// TestCreditedPowerOutputs checks that the boundary values of the power output
+// are credited as production only when they are legitimate readings, that
+// garbage is held for review, and that the stats keep the raw readings
+// alongside the credit.
+func TestCreditedPowerOutputs(t *testing.T) {
+	server, _, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+
+	// The capacity allows 1200 with the tolerance.
+	pub, priv := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{ShortID: 1, PublicKey: pub, Capacity: 1000, Expiration: 5000}
+	if err := server.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	negative, garbage := int64(-500), int64(-1<<50)
+	wrapped := uint64(garbage)
+	for _, test := range []struct {
+		timeslot    uint32
+		powerOutput uint64
+		outcome     reportOutcome
+	}{
+		{1, glow.PowerOutputNone, reportInvalidPower},
+		{2, glow.PowerOutputIdle, reportAccepted},
+		{3, 1200, reportAccepted},
+		{4, 1201, reportFlagged},
+		{5, uint64(negative), reportAccepted},
+		{6, wrapped, reportFlagged},
+		{7, glow.MaxPowerOutput + 1, reportFlagged},
+	} {
+		er := glow.EquipmentReport{ShortID: 1, Timeslot: test.timeslot, PowerOutput: test.powerOutput}
+		er.Signature = glow.Sign(er.SigningBytes(), priv)
+		if outcome, _ := server.managedHandleEquipmentReport(er.Serialize()); outcome != test.outcome {
+			t.Errorf("power output %v: unexpected outcome %v", test.powerOutput, outcome)
+		}
+	}
+
+	// The GCA lets the wrapped report through, which keeps the raw value
+	// but doesn't credit it.
+	frr := FlaggedReportReview{ShortID: 1, Timeslot: 6, PowerOutput: wrapped, Accept: true}
+	frr.Signature = glow.Sign(frr.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedReviewFlaggedReport(frr); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats struct {
+		Devices []V2DeviceStats `json:"devices"`
+	}
+	status, body, err := server.getV2("all-device-stats?timeslot_offset=0&fields=power_outputs,totals,uncredited_timeslots")
+	if err != nil || status != http.StatusOK {
+		t.Fatal("unable to fetch the stats:", status, err)
+	}
+	data, _ := json.Marshal(body)
+	if err := json.Unmarshal(data, &stats); err != nil || len(stats.Devices) != 1 {
+		t.Fatal("unexpected stats:", string(data), err)
+	}
+	ds := stats.Devices[0]
+	if ds.PowerOutputs[5] != negative || ds.PowerOutputs[6] != garbage {
+		t.Error("the raw readings were not kept:", ds.PowerOutputs[:8])
+	}
+	rawEnergy := 1200 + negative + garbage
+	if ds.Totals.Energy != 1200 || ds.Totals.Impact != 0 || ds.Totals.Reports != 4 || ds.Totals.RawEnergy == nil || *ds.Totals.RawEnergy != rawEnergy {
+		t.Errorf("unexpected totals: %+v", ds.Totals)
+	}
+	if len(ds.UncreditedTimeslots) != 2 || ds.UncreditedTimeslots[0] != 5 || ds.UncreditedTimeslots[1] != 6 {
+		t.Error("unexpected uncredited timeslots:", ds.UncreditedTimeslots)
+	}
+
+	// The summary and the impact of the device only credit the legitimate
+	// reading as well.
+	server.mu.RLock()
+	summary := server.buildDeviceSummary(1, 10)
+	server.mu.RUnlock()
+	if summary.TotalEnergy != 1200 || summary.RawEnergy != rawEnergy || summary.ReportsReceived != 4 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+	outputs := make([]uint64, 8)
+	server.mu.RLock()
+	copy(outputs, server.equipmentReports[1].PowerOutputs[:8])
+	server.mu.RUnlock()
+	rates := []float64{1e6, 1e6, 1e6, 1e6, 1e6, 1e6, 1e6, 1e6}
+	if di := computeDeviceImpact(0, outputs, rates, false); di.TotalEnergy != 1200 || di.CarbonImpact != 1.2 || di.CoveredTimeslots != 1 {
+		t.Errorf("unexpected impact: %+v", di)
+	}
+}
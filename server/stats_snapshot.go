@@ -0,0 +1,213 @@
+package server
+
+// stats_snapshot.go contains the snapshots that the all-device-stats endpoints
+// serve the weeks in the reporting window from. Copying the stats of
+// thousands of devices takes long enough that holding the mutex for the whole
+// copy shows up as stalls in the ingestion of reports. So the stats of a week
+// get copied into a snapshot a chunk of devices at a time, releasing the mutex
+// between the chunks, and the requests are filtered, signed and encoded from
+// the snapshot without holding the mutex at all.
+//
+// A snapshot is reused as long as the state has not changed since it was
+// built, or while it is younger than StatsSnapshotMaxAge, which bounds how
+// stale the stats can be. The ETag of a snapshot is the ETag of the state at
+// the start of its build, so pollers keep getting a 304 for as long as the
+// snapshot is served, and get a new ETag as soon as it is replaced. Because
+// the mutex is released between chunks, a snapshot can also contain some of
+// the changes that were made during its build, which only ever makes it
+// newer than its ETag says.
+//
+// The weeks before the reporting window come from the stats history, which
+// is never modified, so they don't need a snapshot.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// statsSnapshotChunk is the number of devices that get copied into a
+// snapshot before the mutex is released again.
+const statsSnapshotChunk = 256
+
+// errStatsSnapshotMigrated is returned when the reports were migrated while
+// a snapshot was being built, the build has to start over.
+var errStatsSnapshotMigrated = errors.New("the reports were migrated during the snapshot")
+
+// statsSnapshot contains the stats of a week along with the parts of the
+// state that filtering and annotating them needs. A snapshot is never
+// modified after it has been built.
+type statsSnapshot struct {
+	stats       AllDeviceStats                      // Unsigned and unfiltered
+	shortIDs    map[glow.PublicKey]uint32           // See deviceShortIDs
+	annotations map[glow.PublicKey]deviceAnnotation // See deviceAnnotations
+	etag        string                              // The ETag of the state when the build started
+
+	// The online_timeslots setting when the build started, which the
+	// online flags of the annotations are computed with.
+	onlineTimeslots uint32
+
+	version       uint64    // The state version when the build started
+	reportsOffset uint32    // The reports offset during the build
+	built         time.Time // When the build finished
+}
+
+// statsSnapshotCache holds the latest snapshot of every week in the
+// reporting window. The mutex is held while building a snapshot, so that
+// concurrent requests wait for a single build instead of each doing their own.
+type statsSnapshotCache struct {
+	weeks map[uint32]*statsSnapshot
+	mu    sync.Mutex
+}
+
+// managedStatsSnapshot returns a snapshot of the stats for the week that
+// starts at the provided timeslot offset.
+func (s *GCAServer) managedStatsSnapshot(timeslotOffset uint32) (*statsSnapshot, error) {
+	for {
+		s.mu.RLock()
+		if timeslotOffset < s.equipmentHistoryOffset {
+			s.mu.RUnlock()
+			return nil, withCode(ErrCodeMalformedRequest, errors.New("timeslot_offset predates the history of the server"))
+		}
+		if timeslotOffset < s.equipmentReportsOffset {
+			if !s.statsHistoryLoaded() {
+				s.mu.RUnlock()
+				return nil, withCode(ErrCodeLoading, errors.New("the stats history is still loading"))
+			}
+			week := int((timeslotOffset - s.equipmentHistoryOffset) / 2016)
+			s.mu.RUnlock()
+			return s.managedHistorySnapshot(week)
+		}
+		version := s.stateVersion
+		s.mu.RUnlock()
+
+		snap, err := s.managedCurrentStatsSnapshot(timeslotOffset, version)
+		if err != errStatsSnapshotMigrated {
+			return snap, err
+		}
+	}
+}
+
+// managedHistorySnapshot returns a snapshot of a week of the stats history,
+// which may have to be read from disk, see history_retention.go.
+func (s *GCAServer) managedHistorySnapshot(week int) (*statsSnapshot, error) {
+	stats, exists, err := s.managedHistoryWeek(week)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build stats for the provided timeslot: %v", err)
+	}
+	if !exists {
+		return nil, withCode(ErrCodeMalformedRequest, errors.New("timeslot_offset is not in the history of the server"))
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &statsSnapshot{
+		stats:       stats,
+		shortIDs:    s.deviceShortIDs(stats),
+		annotations: s.deviceAnnotations(stats),
+		etag:        s.stateETag(),
+
+		onlineTimeslots: s.onlineTimeslots,
+	}, nil
+}
+
+// managedCurrentStatsSnapshot returns the snapshot of a week in the reporting
+// window, building a new one if the cached one is out of date. The version
+// is the state version at the time of the request.
+func (s *GCAServer) managedCurrentStatsSnapshot(timeslotOffset uint32, version uint64) (*statsSnapshot, error) {
+	c := s.staticStatsSnapshots
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snap, exists := c.weeks[timeslotOffset]
+	if exists && (snap.version == version || s.now().Sub(snap.built) < s.staticStatsSnapshotMaxAge) {
+		return snap, nil
+	}
+	snap, err := s.managedBuildStatsSnapshot(timeslotOffset)
+	if err != nil {
+		return nil, err
+	}
+	// The weeks that left the reporting window are served from the
+	// history now.
+	for week := range c.weeks {
+		if week < snap.reportsOffset {
+			delete(c.weeks, week)
+		}
+	}
+	c.weeks[timeslotOffset] = snap
+	return snap, nil
+}
+
+// managedBuildStatsSnapshot copies the stats of a week in the reporting
+// window into a new snapshot. Devices that are removed during the build are
+// left out, devices that are added during the build show up in the next
+// snapshot.
+func (s *GCAServer) managedBuildStatsSnapshot(timeslotOffset uint32) (*statsSnapshot, error) {
+	s.mu.RLock()
+	x, err := s.windowIndex(timeslotOffset)
+	if err != nil {
+		s.mu.RUnlock()
+		return nil, fmt.Errorf("unable to build stats for the provided timeslot: %v", err)
+	}
+	snap := &statsSnapshot{
+		stats:         AllDeviceStats{TimeslotOffset: timeslotOffset},
+		shortIDs:      make(map[glow.PublicKey]uint32),
+		annotations:   make(map[glow.PublicKey]deviceAnnotation),
+		etag:          s.stateETag(),
+		version:       s.stateVersion,
+		reportsOffset: s.equipmentReportsOffset,
+
+		onlineTimeslots: s.onlineTimeslots,
+	}
+	shortIDs := s.windowShortIDs()
+	s.mu.RUnlock()
+
+	// The devices are allocated without holding the mutex, zeroing the
+	// stats of thousands of devices takes a while.
+	devices := make([]DeviceStats, len(shortIDs))
+	n := 0
+	for j, shortID := range shortIDs {
+		if j%statsSnapshotChunk == 0 {
+			if j > 0 {
+				s.mu.RUnlock()
+			}
+			s.mu.RLock()
+			if s.equipmentReportsOffset != snap.reportsOffset {
+				s.mu.RUnlock()
+				return nil, errStatsSnapshotMigrated
+			}
+		}
+		if _, exists := s.windowReports(shortID); !exists {
+			continue
+		}
+		ds := &devices[n]
+		n++
+		s.copyDeviceStats(ds, shortID, timeslotOffset, x)
+		if mapped, exists := s.deviceShortID(ds.PublicKey); exists {
+			snap.shortIDs[ds.PublicKey] = mapped
+		}
+		snap.annotations[ds.PublicKey] = s.deviceAnnotation(ds.PublicKey, timeslotOffset)
+	}
+	if len(shortIDs) > 0 {
+		s.mu.RUnlock()
+	}
+	if n > 0 {
+		snap.stats.Devices = devices[:n]
+	}
+	snap.built = s.now()
+	return snap, nil
+}
+
+// sortedReportShortIDs returns the ShortIDs of every device with reports in
+// memory, in order, so that the ordering of the devices in the stats is
+// stable between calls.
+func (s *GCAServer) sortedReportShortIDs() []uint32 {
+	shortIDs := make([]uint32, 0, len(s.equipmentReports))
+	for shortID := range s.equipmentReports {
+		shortIDs = append(shortIDs, shortID)
+	}
+	sort.Slice(shortIDs, func(i, j int) bool { return shortIDs[i] < shortIDs[j] })
+	return shortIDs
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getStatsETag queries the all-device-stats endpoint and returns the ETag of
+// the response along with the stats.
+func (gcas *GCAServer) getStatsETag(params string) (string, AllDeviceStats, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%v/api/v1/all-device-stats?timeslot_offset=0%v", gcas.httpDialAddr(), params))
+	if err != nil {
+		return "", AllDeviceStats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", AllDeviceStats{}, fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	var ads AllDeviceStats
+	if err := json.NewDecoder(resp.Body).Decode(&ads); err != nil {
+		return "", AllDeviceStats{}, err
+	}
+	return resp.Header.Get("ETag"), ads, nil
+}
+
+// TestStatsSnapshotStaleness checks that a snapshot keeps being served with
+// its own ETag until it gets older than StatsSnapshotMaxAge, and that the
+// stats and the ETag change together once it gets replaced.
+func TestStatsSnapshotStaleness(t *testing.T) {
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	const maxAge = 500 * time.Millisecond
+	opts := DefaultServerOptions()
+	opts.StatsSnapshotMaxAge = maxAge
+	server, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	glow.SetCurrentTimeslot(3)
+	defer glow.SetCurrentTimeslot(0)
+
+	etag, _, err := server.getStatsETag("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	built := time.Now()
+	server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, 3, ePriv))
+
+	// The snapshot from before the report is still fresh enough.
+	staleETag, stale, err := server.getStatsETag("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(built) < maxAge && (staleETag != etag || stale.Devices[0].PowerOutputs[3] != 0) {
+		t.Fatal("the snapshot was replaced before it got too old:", staleETag, etag, stale.Devices[0].PowerOutputs[3])
+	}
+
+	// Once it's too old, the report and a new ETag show up together.
+	time.Sleep(maxAge)
+	freshETag, fresh, err := server.getStatsETag("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freshETag == etag || fresh.Devices[0].PowerOutputs[3] != 5 {
+		t.Fatal("the snapshot was not replaced:", freshETag, etag, fresh.Devices[0].PowerOutputs[3])
+	}
+	again, _, err := server.getStatsETag("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != freshETag {
+		t.Fatal("the ETag changed without a change to the state:", again, freshETag)
+	}
+}
+
+// TestStatsIngestionStall measures the longest time that ingesting a report
+// takes while the stats of a large number of devices are requested over and
+// over, which is how long the stats keep the mutex away from the ingestion.
+// The snapshots get the production max age, which is what lets most of the
+// requests skip the copy.
+func TestStatsIngestionStall(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea, ePriv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultServerOptions()
+	opts.StatsSnapshotMaxAge = 2 * time.Second
+	server, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer glow.SetCurrentTimeslot(0)
+
+	// Add synthetic devices that reported in every timeslot of the first
+	// week.
+	const devices = 2000
+	server.mu.Lock()
+	for i := uint32(0); i < devices; i++ {
+		pub, _ := glow.GenerateKeyPair()
+		server.applyEquipment(glow.EquipmentAuthorization{ShortID: 100 + i, PublicKey: pub, Capacity: 1e9})
+		dr := server.equipmentReports[100+i]
+		for ts := 0; ts < 2016; ts++ {
+			dr.PowerOutputs[ts] = 5
+		}
+	}
+	server.mu.Unlock()
+
+	// Time a full copy of the stats under the read lock, which is how long
+	// the stats used to hold the mutex for.
+	start := time.Now()
+	server.mu.RLock()
+	if _, err := server.snapshotDeviceStats(0); err != nil {
+		server.mu.RUnlock()
+		t.Fatal(err)
+	}
+	server.mu.RUnlock()
+	fullCopy := time.Since(start)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	requests := 0
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, _, err := server.getStatsETag("&limit=1"); err != nil {
+				t.Error(err)
+				return
+			}
+			requests++
+		}
+	}()
+
+	var maxStall time.Duration
+	for ts := uint32(1); ts <= 200; ts++ {
+		glow.SetCurrentTimeslot(ts)
+		start := time.Now()
+		outcome, _ := server.managedHandleEquipmentReport(generateTestReport(ea.ShortID, ts, ePriv))
+		if stall := time.Since(start); stall > maxStall {
+			maxStall = stall
+		}
+		if outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	t.Logf("%v devices: full copy %v, max ingestion stall %v over %v stats requests", devices, fullCopy, maxStall, requests)
+	if requests == 0 {
+		t.Fatal("no stats were requested during the ingestion")
+	}
+	limit := 250 * time.Millisecond
+	if raceEnabled {
+		limit *= 10
+	}
+	if maxStall > limit {
+		t.Fatalf("ingesting a report stalled for %v, more than %v", maxStall, limit)
+	}
+}
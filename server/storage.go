@@ -0,0 +1,281 @@
+package server
+
+// storage.go contains the Storage interface, which is where a GCAServer keeps
+// its persist files, and the default implementation, which keeps them as
+// files in the server directory. storage_memory.go contains an implementation
+// that keeps them in memory, which the tests use, and storage_sqlite.go
+// contains one that keeps them in a SQLite database.
+//
+// The interface only contains the operations that the server actually
+// performs on its persist files: reading a whole file, atomically replacing
+// or appending to a file, reading parts of a large file, appending to the
+// two logs that are written record by record, and listing the files of a
+// directory. Nothing outside of the storage implementations touches the
+// persist files directly, so another backend, such as SQLite or an object
+// store, only needs to implement the interface.
+//
+// A few files always live in the server directory, no matter which storage
+// is used. These are inputs from the operator or provisioning tools rather
+// than state of the server: the config files that Reload reads, the TLS
+// files, the WattTime credentials and data cache, as well as the server log,
+// the ports file that other tools read, and the lock file of the running
+// server, see dir_lock.go. The SQLite database lives there as well, and so do
+// the directories of the tenants, see tenants.go, which have storages of
+// their own.
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage holds the persist files of a server. Files are named by slash
+// separated paths, such as "equipment-reports.dat" or
+// "archives/reports-4032.dat.gz". Directories are created as needed.
+//
+// A Storage is used by a single server at a time, but the methods may be
+// called concurrently.
+type Storage interface {
+	// ReadFile returns the contents of a file. The error of a file that
+	// does not exist satisfies os.IsNotExist.
+	ReadFile(name string) ([]byte, error)
+
+	// WriteFile atomically replaces a file with the provided data. A
+	// crash at any moment leaves either the old or the new file.
+	WriteFile(name string, data []byte, perm os.FileMode) error
+
+	// AppendFile atomically appends the provided data to a file,
+	// creating the file if it does not exist.
+	AppendFile(name string, data []byte, perm os.FileMode) error
+
+	// Open opens a file for reading. The file that gets read is the file
+	// as it was when it was opened, later replacements of the file are
+	// not visible through the handle.
+	Open(name string) (StorageFile, error)
+
+	// OpenLog opens a file that gets appended to record by record,
+	// creating it if it does not exist. A log that was just opened reads
+	// from the beginning of the file, and a write always goes to the end
+	// of the file, where the next read continues. Unlike AppendFile, a
+	// write to a log is not atomic, so logs need to detect torn records
+	// themselves. Sync makes the writes to a log durable.
+	OpenLog(name string, perm os.FileMode) (StorageLog, error)
+
+	// Stat returns information about a file. The error of a file that
+	// does not exist satisfies os.IsNotExist.
+	Stat(name string) (fs.FileInfo, error)
+
+	// Remove deletes a file.
+	Remove(name string) error
+
+	// List returns the names of every file in a directory and its
+	// subdirectories in lexical order, "" lists every file. A directory
+	// that does not exist has no files.
+	List(dir string) ([]string, error)
+}
+
+// StorageFile is a file of a Storage that was opened for reading.
+type StorageFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+}
+
+// StorageLog is a file of a Storage that was opened for appending.
+type StorageLog interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Truncate(size int64) error
+	Sync() error
+}
+
+// StorageBackend selects the Storage of a server that was not given one in its
+// options.
+type StorageBackend int
+
+// Constants for the different storage backends.
+const (
+	StorageBackendFile   StorageBackend = iota // Files in the server directory
+	StorageBackendSQLite                       // A SQLite database in the server directory
+)
+
+// String returns the name of the storage backend.
+func (sb StorageBackend) String() string {
+	if sb == StorageBackendSQLite {
+		return "sqlite"
+	}
+	return "file"
+}
+
+// ParseStorageBackend converts the name of a storage backend, as used on the
+// command line, into a StorageBackend.
+func ParseStorageBackend(name string) (StorageBackend, error) {
+	switch name {
+	case "file":
+		return StorageBackendFile, nil
+	case "sqlite":
+		return StorageBackendSQLite, nil
+	}
+	return StorageBackendFile, fmt.Errorf("unknown storage backend %q, must be 'file' or 'sqlite'", name)
+}
+
+// openStorage returns the storage of a server that was not given one in its
+// options.
+func openStorage(baseDir string, backend StorageBackend) (Storage, error) {
+	if backend == StorageBackendSQLite {
+		return OpenSQLiteStorage(filepath.Join(baseDir, SQLiteDatabaseFile))
+	}
+	return defaultStorage(baseDir), nil
+}
+
+// testStorage replaces the default storage of the servers that the tests
+// launch, see storage_test.go.
+var testStorage func(baseDir string) Storage
+
+// defaultStorage returns the storage of a server that was not given one in
+// its options.
+func defaultStorage(baseDir string) Storage {
+	if testStorage != nil {
+		return testStorage(baseDir)
+	}
+	return NewFileStorage(baseDir)
+}
+
+// storageFileInfo describes a file of a Storage that does not keep its files
+// on disk.
+type storageFileInfo struct {
+	name    string
+	size    int64
+	perm    os.FileMode
+	modTime time.Time
+}
+
+func (fi storageFileInfo) Name() string       { return path.Base(fi.name) }
+func (fi storageFileInfo) Size() int64        { return fi.size }
+func (fi storageFileInfo) Mode() fs.FileMode  { return fi.perm }
+func (fi storageFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi storageFileInfo) IsDir() bool        { return false }
+func (fi storageFileInfo) Sys() interface{}   { return nil }
+
+// keptInServerDir returns whether a file in the server directory stays there
+// no matter which storage is used, see the top of the file.
+func keptInServerDir(name string) bool {
+	switch name {
+	case ServerConfigFile, WebhooksConfigFile, TLSCertFile, TLSKeyFile, PortsFile, LockFile:
+		return true
+	}
+	return strings.HasPrefix(name, "server.log") || strings.HasPrefix(name, "watttime_data/") ||
+		strings.HasPrefix(name, SQLiteDatabaseFile) || strings.HasSuffix(name, tmpFileSuffix) ||
+		strings.HasPrefix(name, TenantsDir+"/")
+}
+
+// fileStorage keeps the persist files in a directory.
+type fileStorage struct {
+	dir string
+}
+
+// NewFileStorage returns a Storage that keeps the persist files in the
+// provided directory, which is what a server uses by default.
+func NewFileStorage(dir string) Storage {
+	return fileStorage{dir: dir}
+}
+
+// path returns the path of a file on disk.
+func (s fileStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+// mkdirFor creates the directory of a file.
+func (s fileStorage) mkdirFor(name string) error {
+	if dir := path.Dir(name); dir != "." {
+		return os.MkdirAll(s.path(dir), 0755)
+	}
+	return nil
+}
+
+// ReadFile implements Storage.
+func (s fileStorage) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(s.path(name))
+}
+
+// WriteFile implements Storage.
+func (s fileStorage) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := s.mkdirFor(name); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(name), data, perm)
+}
+
+// AppendFile implements Storage.
+func (s fileStorage) AppendFile(name string, data []byte, perm os.FileMode) error {
+	if err := s.mkdirFor(name); err != nil {
+		return err
+	}
+	return appendFileAtomic(s.path(name), data, perm)
+}
+
+// Open implements Storage.
+func (s fileStorage) Open(name string) (StorageFile, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenLog implements Storage.
+func (s fileStorage) OpenLog(name string, perm os.FileMode) (StorageLog, error) {
+	if err := s.mkdirFor(name); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path(name), os.O_RDWR|os.O_CREATE|os.O_APPEND, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat implements Storage.
+func (s fileStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(s.path(name))
+}
+
+// Remove implements Storage.
+func (s fileStorage) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+// List implements Storage. Temporary files of interrupted writes are not
+// listed.
+func (s fileStorage) List(dir string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(s.path(dir), func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == s.path(dir) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(info.Name(), tmpFileSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
@@ -0,0 +1,289 @@
+package server
+
+// storage_memory.go contains a Storage that keeps the persist files in memory.
+// The tests use it to avoid hitting the disk, and a server that gets
+// restarted on the same MemoryStorage picks up where the last one stopped.
+//
+// A handle that was returned by Open keeps seeing the file as it was when it
+// was opened, just like an open file on disk keeps its contents when it gets
+// replaced by a rename. Writes and truncations replace the data of a file,
+// and appends only add to the end of it, which the handles never look past.
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryFile is a file of a MemoryStorage.
+type memoryFile struct {
+	data    []byte
+	perm    os.FileMode
+	modTime time.Time
+}
+
+// MemoryStorage is a Storage that keeps the persist files in memory.
+type MemoryStorage struct {
+	files map[string]*memoryFile
+	mu    sync.Mutex
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]*memoryFile)}
+}
+
+// cleanName normalizes the name of a file.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// notExist returns the error for a file that does not exist.
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// info returns the file info of a file. The mutex must be held.
+func (f *memoryFile) info(name string) storageFileInfo {
+	return storageFileInfo{name: name, size: int64(len(f.data)), perm: f.perm, modTime: f.modTime}
+}
+
+// ReadFile implements Storage.
+func (s *MemoryStorage) ReadFile(name string) ([]byte, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists := s.files[name]
+	if !exists {
+		return nil, notExist("open", name)
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+// WriteFile implements Storage.
+func (s *MemoryStorage) WriteFile(name string, data []byte, perm os.FileMode) error {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = &memoryFile{data: append([]byte(nil), data...), perm: perm, modTime: time.Now()}
+	return nil
+}
+
+// AppendFile implements Storage.
+func (s *MemoryStorage) AppendFile(name string, data []byte, perm os.FileMode) error {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists := s.files[name]
+	if !exists {
+		f = &memoryFile{perm: perm}
+		s.files[name] = f
+	}
+	f.data = append(f.data, data...)
+	f.perm = perm
+	f.modTime = time.Now()
+	return nil
+}
+
+// memoryHandle is a file of a MemoryStorage that was opened for reading.
+type memoryHandle struct {
+	*bytes.Reader
+	info storageFileInfo
+}
+
+// Close implements io.Closer.
+func (h memoryHandle) Close() error {
+	return nil
+}
+
+// Stat returns the file info of the file as it was opened.
+func (h memoryHandle) Stat() (fs.FileInfo, error) {
+	return h.info, nil
+}
+
+// Open implements Storage.
+func (s *MemoryStorage) Open(name string) (StorageFile, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists := s.files[name]
+	if !exists {
+		return nil, notExist("open", name)
+	}
+	// The capacity is limited to the length, so that appends to the file
+	// never touch what the handle can see.
+	return memoryHandle{Reader: bytes.NewReader(f.data[:len(f.data):len(f.data)]), info: f.info(name)}, nil
+}
+
+// memoryLog is a file of a MemoryStorage that was opened for appending.
+type memoryLog struct {
+	s      *MemoryStorage
+	name   string
+	pos    int
+	closed bool
+}
+
+// file returns the file of the log, which may have been replaced since the
+// log was opened. The mutex must be held.
+func (l *memoryLog) file() (*memoryFile, error) {
+	if l.closed {
+		return nil, os.ErrClosed
+	}
+	f, exists := l.s.files[l.name]
+	if !exists {
+		f = &memoryFile{perm: 0644}
+		l.s.files[l.name] = f
+	}
+	return f, nil
+}
+
+// Read implements io.Reader.
+func (l *memoryLog) Read(p []byte) (int, error) {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	f, err := l.file()
+	if err != nil {
+		return 0, err
+	}
+	if l.pos >= len(f.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[l.pos:])
+	l.pos += n
+	return n, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (l *memoryLog) ReadAt(p []byte, off int64) (int, error) {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	f, err := l.file()
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write implements io.Writer.
+func (l *memoryLog) Write(p []byte) (int, error) {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	f, err := l.file()
+	if err != nil {
+		return 0, err
+	}
+	f.data = append(f.data, p...)
+	f.modTime = time.Now()
+	l.pos = len(f.data)
+	return len(p), nil
+}
+
+// Truncate cuts the log off at the provided size. The data is copied, so
+// that the bytes after the new end can't be overwritten while a handle from
+// before the truncation can still see them.
+func (l *memoryLog) Truncate(size int64) error {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	f, err := l.file()
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	data := make([]byte, size)
+	copy(data, f.data)
+	f.data = data
+	f.modTime = time.Now()
+	return nil
+}
+
+// Sync implements StorageLog. There is nothing to sync, as the data is never
+// kept anywhere else.
+func (l *memoryLog) Sync() error {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	_, err := l.file()
+	return err
+}
+
+// Close implements io.Closer.
+func (l *memoryLog) Close() error {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	l.closed = true
+	return nil
+}
+
+// OpenLog implements Storage.
+func (s *MemoryStorage) OpenLog(name string, perm os.FileMode) (StorageLog, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.files[name]; !exists {
+		s.files[name] = &memoryFile{perm: perm, modTime: time.Now()}
+	}
+	return &memoryLog{s: s, name: name}, nil
+}
+
+// Stat implements Storage.
+func (s *MemoryStorage) Stat(name string) (fs.FileInfo, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists := s.files[name]
+	if !exists {
+		return nil, notExist("stat", name)
+	}
+	return f.info(name), nil
+}
+
+// Remove implements Storage.
+func (s *MemoryStorage) Remove(name string) error {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.files[name]; !exists {
+		return notExist("remove", name)
+	}
+	delete(s.files, name)
+	return nil
+}
+
+// List implements Storage.
+func (s *MemoryStorage) List(dir string) ([]string, error) {
+	prefix := cleanName(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
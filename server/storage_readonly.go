@@ -0,0 +1,183 @@
+package server
+
+// storage_readonly.go contains the storage of a read-only server, see
+// readonly_state.go. Loading the state writes to the persist files now and
+// then: files that don't exist yet get created, a torn record at the end of a
+// log gets cut off, and older state gets upgraded. A read-only server has to
+// be able to do all of that without touching the directory it reads from, so
+// its storage is a copy-on-write layer on top of the real storage. Reads go
+// to the real storage until a file gets written, at which point the file is
+// copied into memory and the write goes to the copy. Removed files are
+// remembered, so that they stay removed.
+
+import (
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+)
+
+// readOnlyStorage is a Storage that reads from another Storage and keeps
+// every change in memory.
+type readOnlyStorage struct {
+	base    Storage
+	changes *MemoryStorage
+	removed map[string]struct{}
+	mu      sync.Mutex
+}
+
+// newReadOnlyStorage returns a Storage that reads from base without ever
+// writing to it.
+func newReadOnlyStorage(base Storage) *readOnlyStorage {
+	return &readOnlyStorage{
+		base:    base,
+		changes: NewMemoryStorage(),
+		removed: make(map[string]struct{}),
+	}
+}
+
+// changed returns whether a file has been written or removed, in which case
+// the base no longer has the current version of the file. The mutex must be
+// held.
+func (s *readOnlyStorage) changed(name string) bool {
+	if _, removed := s.removed[name]; removed {
+		return true
+	}
+	_, err := s.changes.Stat(name)
+	return err == nil
+}
+
+// copyUp copies a file from the base into memory before it gets changed,
+// unless it already was. The mutex must be held.
+func (s *readOnlyStorage) copyUp(name string) error {
+	if s.changed(name) {
+		return nil
+	}
+	data, err := s.base.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if fi, err := s.base.Stat(name); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	return s.changes.WriteFile(name, data, perm)
+}
+
+// ReadFile implements Storage.
+func (s *readOnlyStorage) ReadFile(name string) ([]byte, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changed(name) {
+		return s.changes.ReadFile(name)
+	}
+	return s.base.ReadFile(name)
+}
+
+// WriteFile implements Storage.
+func (s *readOnlyStorage) WriteFile(name string, data []byte, perm os.FileMode) error {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.removed, name)
+	return s.changes.WriteFile(name, data, perm)
+}
+
+// AppendFile implements Storage.
+func (s *readOnlyStorage) AppendFile(name string, data []byte, perm os.FileMode) error {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.copyUp(name); err != nil {
+		return err
+	}
+	delete(s.removed, name)
+	return s.changes.AppendFile(name, data, perm)
+}
+
+// Open implements Storage.
+func (s *readOnlyStorage) Open(name string) (StorageFile, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changed(name) {
+		return s.changes.Open(name)
+	}
+	return s.base.Open(name)
+}
+
+// OpenLog implements Storage. The log is copied into memory right away, as
+// there's no telling whether it will be written to.
+func (s *readOnlyStorage) OpenLog(name string, perm os.FileMode) (StorageLog, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.copyUp(name); err != nil {
+		return nil, err
+	}
+	delete(s.removed, name)
+	return s.changes.OpenLog(name, perm)
+}
+
+// Stat implements Storage.
+func (s *readOnlyStorage) Stat(name string) (fs.FileInfo, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changed(name) {
+		return s.changes.Stat(name)
+	}
+	return s.base.Stat(name)
+}
+
+// Remove implements Storage.
+func (s *readOnlyStorage) Remove(name string) error {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changed(name) {
+		if _, removed := s.removed[name]; removed {
+			return notExist("remove", name)
+		}
+		s.removed[name] = struct{}{}
+		return s.changes.Remove(name)
+	}
+	if _, err := s.base.Stat(name); err != nil {
+		return err
+	}
+	s.removed[name] = struct{}{}
+	return nil
+}
+
+// List implements Storage.
+func (s *readOnlyStorage) List(dir string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	base, err := s.base.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := s.changes.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(base)+len(changes))
+	for _, name := range base {
+		if _, removed := s.removed[name]; !removed {
+			names[name] = struct{}{}
+		}
+	}
+	for _, name := range changes {
+		names[name] = struct{}{}
+	}
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list, nil
+}
@@ -0,0 +1,845 @@
+package server
+
+// storage_sqlite.go contains a Storage that keeps the persist files in a
+// SQLite database, which a server uses when its StorageBackend is
+// StorageBackendSQLite. The database uses a pure Go driver, so the server
+// still builds without cgo.
+//
+// The contents of every file are kept as a sequence of chunks, which hold
+// exactly the bytes that the file would hold on disk, so none of the code
+// that reads the persist files needs to know where they are kept. On top of
+// that, the records of the files that contain devices, reports, bans, and the
+// audit log are decoded into tables of their own, in the same transaction
+// that writes them. The tables make the state available to anything that can
+// query SQLite, but the server never reads them: they are derived from the
+// files, a record that can't be decoded is left out of them instead of failing
+// the write, and they get rebuilt whenever a file is replaced.
+//
+// Every operation is a single transaction, and the database runs in WAL mode
+// with full syncs, which makes WriteFile and AppendFile atomic and durable. A
+// file that gets replaced gets a new generation of chunks, and the chunks of
+// the old generation are kept until the last handle that was opened on them
+// gets closed, which gives Open the same semantics as a rename on disk.
+//
+// The metadata of the files is cached in memory, a SQLiteStorage must not be
+// shared by two processes.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteChunkSize is the largest chunk that the data of a file gets split
+// into. Appends are stored as chunks of their own.
+const sqliteChunkSize = 1 << 20
+
+// sqliteSchema creates the tables of a SQLiteStorage. The records in the
+// derived tables are identified by the file that they are in and their
+// position within it. The unsigned 64 bit fields are stored as their signed
+// equivalent, since SQLite integers are signed.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS files (
+	name       TEXT PRIMARY KEY,
+	generation INTEGER NOT NULL,
+	size       INTEGER NOT NULL,
+	perm       INTEGER NOT NULL,
+	mod_time   INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS chunks (
+	generation INTEGER NOT NULL,
+	pos        INTEGER NOT NULL,
+	data       BLOB NOT NULL,
+	PRIMARY KEY (generation, pos)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS devices (
+	file           TEXT NOT NULL,
+	pos            INTEGER NOT NULL,
+	len            INTEGER NOT NULL,
+	short_id       INTEGER NOT NULL,
+	public_key     BLOB NOT NULL,
+	version        INTEGER NOT NULL,
+	latitude       REAL NOT NULL,
+	longitude      REAL NOT NULL,
+	capacity       INTEGER NOT NULL,
+	debt           INTEGER NOT NULL,
+	expiration     INTEGER NOT NULL,
+	initialization INTEGER NOT NULL,
+	protocol_fee   INTEGER NOT NULL,
+	nonce          INTEGER NOT NULL,
+	signature      BLOB NOT NULL,
+	PRIMARY KEY (file, pos)
+);
+CREATE INDEX IF NOT EXISTS devices_short_id ON devices (short_id);
+CREATE TABLE IF NOT EXISTS reports (
+	file         TEXT NOT NULL,
+	pos          INTEGER NOT NULL,
+	len          INTEGER NOT NULL,
+	short_id     INTEGER NOT NULL,
+	timeslot     INTEGER NOT NULL,
+	power_output INTEGER NOT NULL,
+	signature    BLOB NOT NULL,
+	PRIMARY KEY (file, pos)
+);
+CREATE INDEX IF NOT EXISTS reports_short_id_timeslot ON reports (short_id, timeslot);
+CREATE TABLE IF NOT EXISTS bans (
+	file     TEXT NOT NULL,
+	pos      INTEGER NOT NULL,
+	len      INTEGER NOT NULL,
+	short_id INTEGER NOT NULL,
+	reason   INTEGER NOT NULL,
+	timeslot INTEGER NOT NULL,
+	PRIMARY KEY (file, pos)
+);
+CREATE TABLE IF NOT EXISTS audit_entries (
+	file       TEXT NOT NULL,
+	pos        INTEGER NOT NULL,
+	len        INTEGER NOT NULL,
+	hash       BLOB NOT NULL,
+	prev_hash  BLOB NOT NULL,
+	action     INTEGER NOT NULL,
+	timeslot   INTEGER NOT NULL,
+	request    BLOB NOT NULL,
+	signatures INTEGER NOT NULL,
+	PRIMARY KEY (file, pos)
+);
+`
+
+// sqliteIndex decodes the records of a file into one of the derived tables.
+type sqliteIndex struct {
+	table   string
+	columns []string
+
+	// size is the size of every record, or zero if the records have
+	// different sizes. Appends are only decoded if they start at a record
+	// boundary.
+	size int
+
+	// decode decodes the record at the start of the data, returning its
+	// size and the values of the columns.
+	decode func(data []byte) (int, []interface{}, error)
+}
+
+// sqliteIndexes maps the files that get decoded to their index.
+var sqliteIndexes = func() map[string]sqliteIndex {
+	devices := func(size int) sqliteIndex {
+		return sqliteIndex{
+			table:   "devices",
+			columns: []string{"short_id", "public_key", "version", "latitude", "longitude", "capacity", "debt", "expiration", "initialization", "protocol_fee", "nonce", "signature"},
+			size:    size,
+			decode: func(data []byte) (int, []interface{}, error) {
+				if len(data) < size {
+					return 0, nil, io.ErrUnexpectedEOF
+				}
+				ea, err := glow.DeserializeEquipmentAuthorization(data[:size])
+				if err != nil {
+					return 0, nil, err
+				}
+				return size, []interface{}{ea.ShortID, ea.PublicKey[:], ea.Version, ea.Latitude, ea.Longitude, int64(ea.Capacity), int64(ea.Debt), ea.Expiration, ea.Initialization, int64(ea.ProtocolFee), int64(ea.Nonce), ea.Signature[:]}, nil
+			},
+		}
+	}
+	reports := func(size int, payload func([]byte) ([]byte, error)) sqliteIndex {
+		return sqliteIndex{
+			table:   "reports",
+			columns: []string{"short_id", "timeslot", "power_output", "signature"},
+			size:    size,
+			decode: func(data []byte) (int, []interface{}, error) {
+				if len(data) < size {
+					return 0, nil, io.ErrUnexpectedEOF
+				}
+				b, err := payload(data[:size])
+				if err != nil {
+					return 0, nil, err
+				}
+				er, err := glow.DeserializeReport(b)
+				if err != nil {
+					return 0, nil, err
+				}
+				return size, []interface{}{er.ShortID, er.Timeslot, int64(er.PowerOutput), er.Signature[:]}, nil
+			},
+		}
+	}
+	return map[string]sqliteIndex{
+		LegacyEquipmentAuthorizationsFile: devices(glow.EquipmentAuthorizationLegacySize),
+		EquipmentAuthorizationsFile:       devices(glow.EquipmentAuthorizationSize),
+		EquipmentReportsFile: reports(equipmentReportSize, func(b []byte) ([]byte, error) {
+			return b, nil
+		}),
+		ReportsJournalFile: reports(reportsJournalRecordSize, func(b []byte) ([]byte, error) {
+			payloads, _ := decodeJournal(b)
+			if len(payloads) != 1 {
+				return nil, errors.New("invalid journal record")
+			}
+			return payloads[0], nil
+		}),
+		BannedEquipmentFile: {
+			table:   "bans",
+			columns: []string{"short_id", "reason", "timeslot"},
+			size:    equipmentBanRecordSize,
+			decode: func(data []byte) (int, []interface{}, error) {
+				if len(data) < equipmentBanRecordSize {
+					return 0, nil, io.ErrUnexpectedEOF
+				}
+				ebr, err := deserializeEquipmentBanRecord(data[:equipmentBanRecordSize])
+				if err != nil {
+					return 0, nil, err
+				}
+				return equipmentBanRecordSize, []interface{}{ebr.ShortID, ebr.Reason, ebr.Timeslot}, nil
+			},
+		},
+		AuditLogFile: {
+			table:   "audit_entries",
+			columns: []string{"hash", "prev_hash", "action", "timeslot", "request", "signatures"},
+			decode: func(data []byte) (int, []interface{}, error) {
+				e, n, err := glow.DeserializeAuditEntry(data)
+				if err != nil {
+					return 0, nil, err
+				}
+				hash := e.Hash()
+				return n, []interface{}{hash[:], e.PrevHash[:], uint8(e.Action), e.Timeslot, e.Request, len(e.Signatures)}, nil
+			},
+		},
+	}
+}()
+
+// sqliteFile is the cached metadata of a file of a SQLiteStorage.
+type sqliteFile struct {
+	generation int64
+	size       int64
+	perm       os.FileMode
+	modTime    time.Time
+}
+
+// info returns the file info of a file.
+func (f sqliteFile) info(name string) storageFileInfo {
+	return storageFileInfo{name: name, size: f.size, perm: f.perm, modTime: f.modTime}
+}
+
+// SQLiteStorage is a Storage that keeps the persist files in a SQLite
+// database.
+type SQLiteStorage struct {
+	db *sql.DB
+
+	files          map[string]sqliteFile
+	nextGeneration int64
+	handles        map[int64]int      // The number of open handles on every generation
+	stale          map[int64]struct{} // Replaced generations that still have open handles
+	mu             sync.Mutex
+}
+
+// OpenSQLiteStorage opens the SQLite database at the provided path, creating
+// it if it does not exist.
+func OpenSQLiteStorage(path string) (*SQLiteStorage, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %v: %v", path, err)
+	}
+	// Every operation holds the mutex anyway, and a single connection
+	// keeps the pragmas in effect.
+	db.SetMaxOpenConns(1)
+	s := &SQLiteStorage{
+		db:      db,
+		files:   make(map[string]sqliteFile),
+		handles: make(map[int64]int),
+		stale:   make(map[int64]struct{}),
+	}
+	if err := s.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to load %v: %v", path, err)
+	}
+	return s, nil
+}
+
+// load creates the schema, removes the chunks of the generations that were
+// still open when the database was last closed, and loads the metadata of
+// the files.
+func (s *SQLiteStorage) load() error {
+	if _, err := s.db.Exec(sqliteSchema); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM chunks WHERE generation NOT IN (SELECT generation FROM files)`); err != nil {
+		return err
+	}
+	rows, err := s.db.Query(`SELECT name, generation, size, perm, mod_time FROM files`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var f sqliteFile
+		var perm uint32
+		var modTime int64
+		if err := rows.Scan(&name, &f.generation, &f.size, &perm, &modTime); err != nil {
+			return err
+		}
+		f.perm, f.modTime = os.FileMode(perm), time.Unix(0, modTime)
+		s.files[name] = f
+		if f.generation >= s.nextGeneration {
+			s.nextGeneration = f.generation + 1
+		}
+	}
+	return rows.Err()
+}
+
+// Close closes the database.
+func (s *SQLiteStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
+
+// update runs fn in a transaction. The mutex must be held.
+func (s *SQLiteStorage) update(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// putFile saves the metadata of a file.
+func putFile(tx *sql.Tx, name string, f sqliteFile) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO files (name, generation, size, perm, mod_time) VALUES (?, ?, ?, ?, ?)`, name, f.generation, f.size, uint32(f.perm), f.modTime.UnixNano())
+	return err
+}
+
+// putChunks saves data as the chunks of a generation, starting at the
+// provided position.
+func putChunks(tx *sql.Tx, generation, pos int64, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > sqliteChunkSize {
+			n = sqliteChunkSize
+		}
+		if _, err := tx.Exec(`INSERT INTO chunks (generation, pos, data) VALUES (?, ?, ?)`, generation, pos, data[:n]); err != nil {
+			return err
+		}
+		data, pos = data[n:], pos+int64(n)
+	}
+	return nil
+}
+
+// indexRecords decodes the records of data, which starts at the provided
+// position of a file, into the derived table of the file. Decoding stops at
+// the first record that can't be decoded.
+func indexRecords(tx *sql.Tx, name string, data []byte, pos int64) error {
+	idx, exists := sqliteIndexes[name]
+	if !exists || (idx.size > 0 && pos%int64(idx.size) != 0) {
+		return nil
+	}
+	query := fmt.Sprintf(`INSERT OR REPLACE INTO %v (file, pos, len, %v) VALUES (?, ?, ?%v)`, idx.table, strings.Join(idx.columns, ", "), strings.Repeat(", ?", len(idx.columns)))
+	for len(data) > 0 {
+		n, values, err := idx.decode(data)
+		if err != nil {
+			return nil
+		}
+		if _, err := tx.Exec(query, append([]interface{}{name, pos, n}, values...)...); err != nil {
+			return err
+		}
+		data, pos = data[n:], pos+int64(n)
+	}
+	return nil
+}
+
+// unindexRecords removes the records of a file that end past the provided
+// size from the derived table of the file.
+func unindexRecords(tx *sql.Tx, name string, size int64) error {
+	idx, exists := sqliteIndexes[name]
+	if !exists {
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf(`DELETE FROM %v WHERE file = ? AND pos + len > ?`, idx.table), name, size)
+	return err
+}
+
+// dropGeneration deletes the chunks of a generation, unless a handle is still
+// reading them. The mutex must be held.
+func (s *SQLiteStorage) dropGeneration(tx *sql.Tx, generation int64) error {
+	if s.handles[generation] > 0 {
+		s.stale[generation] = struct{}{}
+		return nil
+	}
+	_, err := tx.Exec(`DELETE FROM chunks WHERE generation = ?`, generation)
+	return err
+}
+
+// readChunks reads the bytes of a generation between off and end. Fewer
+// bytes are returned if the generation ends early. The mutex must be held.
+func (s *SQLiteStorage) readChunks(generation, off, end int64) ([]byte, error) {
+	buf := make([]byte, 0, end-off)
+	if end <= off {
+		return buf, nil
+	}
+	rows, err := s.db.Query(`SELECT pos, data FROM chunks WHERE generation = ?1 AND pos < ?3 AND pos >= COALESCE((SELECT MAX(pos) FROM chunks WHERE generation = ?1 AND pos <= ?2), 0) ORDER BY pos`, generation, off, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pos int64
+		var data []byte
+		if err := rows.Scan(&pos, &data); err != nil {
+			return nil, err
+		}
+		next := off + int64(len(buf))
+		if pos > next || pos+int64(len(data)) <= next {
+			break
+		}
+		data = data[next-pos:]
+		if rest := end - next; int64(len(data)) > rest {
+			data = data[:rest]
+		}
+		buf = append(buf, data...)
+	}
+	return buf, rows.Err()
+}
+
+// ReadFile implements Storage.
+func (s *SQLiteStorage) ReadFile(name string) ([]byte, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists := s.files[name]
+	if !exists {
+		return nil, notExist("open", name)
+	}
+	data, err := s.readChunks(f.generation, 0, f.size)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != f.size {
+		return nil, fmt.Errorf("%v is missing chunks", name)
+	}
+	return data, nil
+}
+
+// WriteFile implements Storage.
+func (s *SQLiteStorage) WriteFile(name string, data []byte, perm os.FileMode) error {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, exists := s.files[name]
+	f := sqliteFile{generation: s.nextGeneration, size: int64(len(data)), perm: perm, modTime: time.Now()}
+	err := s.update(func(tx *sql.Tx) error {
+		if err := putFile(tx, name, f); err != nil {
+			return err
+		}
+		if err := putChunks(tx, f.generation, 0, data); err != nil {
+			return err
+		}
+		if exists {
+			if err := s.dropGeneration(tx, old.generation); err != nil {
+				return err
+			}
+		}
+		if err := unindexRecords(tx, name, 0); err != nil {
+			return err
+		}
+		return indexRecords(tx, name, data, 0)
+	})
+	if err != nil {
+		if exists {
+			delete(s.stale, old.generation)
+		}
+		return err
+	}
+	s.nextGeneration++
+	s.files[name] = f
+	return nil
+}
+
+// appendData appends data to a file, creating the file with the provided
+// permissions if it does not exist. If setPerm is set, the permissions of an
+// existing file get changed as well. The mutex must be held.
+func (s *SQLiteStorage) appendData(name string, data []byte, perm os.FileMode, setPerm bool) error {
+	f, exists := s.files[name]
+	if !exists {
+		f = sqliteFile{generation: s.nextGeneration, perm: perm}
+		s.nextGeneration++
+	}
+	if setPerm {
+		f.perm = perm
+	}
+	pos := f.size
+	f.size += int64(len(data))
+	f.modTime = time.Now()
+	err := s.update(func(tx *sql.Tx) error {
+		if err := putFile(tx, name, f); err != nil {
+			return err
+		}
+		if err := putChunks(tx, f.generation, pos, data); err != nil {
+			return err
+		}
+		return indexRecords(tx, name, data, pos)
+	})
+	if err != nil {
+		return err
+	}
+	s.files[name] = f
+	return nil
+}
+
+// AppendFile implements Storage.
+func (s *SQLiteStorage) AppendFile(name string, data []byte, perm os.FileMode) error {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appendData(name, data, perm, true)
+}
+
+// sqliteHandle is a file of a SQLiteStorage that was opened for reading.
+type sqliteHandle struct {
+	s          *SQLiteStorage
+	generation int64
+	info       storageFileInfo
+	off        int64
+	closed     bool
+}
+
+// Read implements io.Reader.
+func (h *sqliteHandle) Read(p []byte) (int, error) {
+	n, err := h.ReadAt(p, h.off)
+	h.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (h *sqliteHandle) ReadAt(p []byte, off int64) (int, error) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	end := off + int64(len(p))
+	if end > h.info.size {
+		end = h.info.size
+	}
+	data, err := h.s.readChunks(h.generation, off, end)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (h *sqliteHandle) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += h.off
+	case io.SeekEnd:
+		offset += h.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	h.off = offset
+	return offset, nil
+}
+
+// Stat returns the file info of the file as it was opened.
+func (h *sqliteHandle) Stat() (fs.FileInfo, error) {
+	return h.info, nil
+}
+
+// Close implements io.Closer. The chunks of a replaced file are deleted once
+// the last handle on them gets closed.
+func (h *sqliteHandle) Close() error {
+	s := h.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h.closed {
+		return os.ErrClosed
+	}
+	h.closed = true
+	s.handles[h.generation]--
+	if s.handles[h.generation] > 0 {
+		return nil
+	}
+	delete(s.handles, h.generation)
+	if _, stale := s.stale[h.generation]; !stale {
+		return nil
+	}
+	delete(s.stale, h.generation)
+	_, err := s.db.Exec(`DELETE FROM chunks WHERE generation = ?`, h.generation)
+	return err
+}
+
+// Open implements Storage.
+func (s *SQLiteStorage) Open(name string) (StorageFile, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists := s.files[name]
+	if !exists {
+		return nil, notExist("open", name)
+	}
+	s.handles[f.generation]++
+	return &sqliteHandle{s: s, generation: f.generation, info: f.info(name)}, nil
+}
+
+// sqliteLog is a file of a SQLiteStorage that was opened for appending.
+type sqliteLog struct {
+	s      *SQLiteStorage
+	name   string
+	pos    int64
+	closed bool
+}
+
+// file returns the file of the log, which may have been replaced since the
+// log was opened. The mutex must be held.
+func (l *sqliteLog) file() (sqliteFile, error) {
+	if l.closed {
+		return sqliteFile{}, os.ErrClosed
+	}
+	f, exists := l.s.files[l.name]
+	if !exists {
+		if err := l.s.appendData(l.name, nil, 0644, false); err != nil {
+			return f, err
+		}
+		f = l.s.files[l.name]
+	}
+	return f, nil
+}
+
+// Read implements io.Reader.
+func (l *sqliteLog) Read(p []byte) (int, error) {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	f, err := l.file()
+	if err != nil {
+		return 0, err
+	}
+	if l.pos >= f.size {
+		return 0, io.EOF
+	}
+	end := l.pos + int64(len(p))
+	if end > f.size {
+		end = f.size
+	}
+	data, err := l.s.readChunks(f.generation, l.pos, end)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	l.pos += int64(n)
+	return n, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (l *sqliteLog) ReadAt(p []byte, off int64) (int, error) {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	f, err := l.file()
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	end := off + int64(len(p))
+	if end > f.size {
+		end = f.size
+	}
+	data, err := l.s.readChunks(f.generation, off, end)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write implements io.Writer.
+func (l *sqliteLog) Write(p []byte) (int, error) {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	if _, err := l.file(); err != nil {
+		return 0, err
+	}
+	if err := l.s.appendData(l.name, p, 0, false); err != nil {
+		return 0, err
+	}
+	l.pos = l.s.files[l.name].size
+	return len(p), nil
+}
+
+// Truncate cuts the log off at the provided size. Unlike a replacement, a
+// truncation is visible to the handles that were opened before it, just like
+// it is on disk.
+func (l *sqliteLog) Truncate(size int64) error {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	f, err := l.file()
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	old := f.size
+	f.size, f.modTime = size, time.Now()
+	err = l.s.update(func(tx *sql.Tx) error {
+		if err := putFile(tx, l.name, f); err != nil {
+			return err
+		}
+		if size > old {
+			return putChunks(tx, f.generation, old, make([]byte, size-old))
+		}
+		if _, err := tx.Exec(`DELETE FROM chunks WHERE generation = ? AND pos >= ?`, f.generation, size); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE chunks SET data = substr(data, 1, ?2 - pos) WHERE generation = ?1 AND pos < ?2 AND pos + length(data) > ?2`, f.generation, size); err != nil {
+			return err
+		}
+		return unindexRecords(tx, l.name, size)
+	})
+	if err != nil {
+		return err
+	}
+	l.s.files[l.name] = f
+	return nil
+}
+
+// Sync implements StorageLog. Every write is a transaction that is already
+// durable by the time that it returns.
+func (l *sqliteLog) Sync() error {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	_, err := l.file()
+	return err
+}
+
+// Close implements io.Closer.
+func (l *sqliteLog) Close() error {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	l.closed = true
+	return nil
+}
+
+// OpenLog implements Storage.
+func (s *SQLiteStorage) OpenLog(name string, perm os.FileMode) (StorageLog, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.files[name]; !exists {
+		if err := s.appendData(name, nil, perm, false); err != nil {
+			return nil, err
+		}
+	}
+	return &sqliteLog{s: s, name: name}, nil
+}
+
+// Stat implements Storage.
+func (s *SQLiteStorage) Stat(name string) (fs.FileInfo, error) {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists := s.files[name]
+	if !exists {
+		return nil, notExist("stat", name)
+	}
+	return f.info(name), nil
+}
+
+// Remove implements Storage.
+func (s *SQLiteStorage) Remove(name string) error {
+	name = cleanName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists := s.files[name]
+	if !exists {
+		return notExist("remove", name)
+	}
+	err := s.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM files WHERE name = ?`, name); err != nil {
+			return err
+		}
+		if err := s.dropGeneration(tx, f.generation); err != nil {
+			return err
+		}
+		return unindexRecords(tx, name, 0)
+	})
+	if err != nil {
+		delete(s.stale, f.generation)
+		return err
+	}
+	delete(s.files, name)
+	return nil
+}
+
+// List implements Storage.
+func (s *SQLiteStorage) List(dir string) ([]string, error) {
+	prefix := cleanName(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// countRows returns the number of rows of a derived table.
+func (s *SQLiteStorage) countRows(table string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	err := s.db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %v`, table)).Scan(&n)
+	return n, err
+}
+
+// verifyChunks checks that the chunks of every file add up to the file.
+func (s *SQLiteStorage) verifyChunks() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, f := range s.files {
+		var size int64
+		err := s.db.QueryRow(`SELECT COALESCE(SUM(length(data)), 0) FROM chunks WHERE generation = ?`, f.generation).Scan(&size)
+		if err != nil {
+			return err
+		}
+		if size != f.size {
+			return fmt.Errorf("%v has %v bytes of chunks, but a size of %v", name, size, f.size)
+		}
+	}
+	return nil
+}
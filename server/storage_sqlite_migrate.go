@@ -0,0 +1,318 @@
+package server
+
+// storage_sqlite_migrate.go converts the persist files of a server that uses
+// the file storage into the SQLite database of the SQLite storage, see
+// storage_sqlite.go. The conversion runs while the server is stopped, and
+// builds the database under a temporary name, which only gets renamed into
+// place once the database has been verified. The persist files are left
+// alone, so a server that fails to start on the database can go back to the
+// files by switching the backend back.
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// SQLiteMigration describes a migration to the SQLite storage.
+type SQLiteMigration struct {
+	Files        int   // The number of persist files that were copied
+	Bytes        int64 // The total size of those files
+	Devices      int   // The rows of the devices table
+	Reports      int   // The rows of the reports table
+	Bans         int   // The rows of the bans table
+	AuditEntries int   // The rows of the audit_entries table
+}
+
+// MigrateToSQLite copies the persist files of the server directory into a new
+// SQLite database in the directory. Before the database gets put in place, it
+// checks that every file reads back the same, that every record of the
+// devices, reports, bans, and audit log made it into its table, that every
+// report is signed by a key of its device, and that the audit log still forms
+// a valid hash chain. The server must not be running.
+func MigrateToSQLite(dir string) (SQLiteMigration, error) {
+	var m SQLiteMigration
+	dbPath := filepath.Join(dir, SQLiteDatabaseFile)
+	if _, err := os.Stat(dbPath); err == nil {
+		return m, fmt.Errorf("%v already exists", dbPath)
+	}
+	tmpPath := dbPath + tmpFileSuffix
+	removeSQLiteFiles(tmpPath)
+
+	src := NewFileStorage(dir)
+	names, err := src.List("")
+	if err != nil {
+		return m, fmt.Errorf("unable to list the server files: %v", err)
+	}
+	dst, err := OpenSQLiteStorage(tmpPath)
+	if err != nil {
+		return m, err
+	}
+	m, err = copyToSQLite(src, dst, names)
+	if closeErr := dst.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("unable to close the database: %v", closeErr)
+	}
+	if err != nil {
+		removeSQLiteFiles(tmpPath)
+		return m, err
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		removeSQLiteFiles(tmpPath)
+		return m, fmt.Errorf("unable to put the database in place: %v", err)
+	}
+	if err := syncDir(dir); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// removeSQLiteFiles removes a database along with its WAL files.
+func removeSQLiteFiles(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+}
+
+// copyToSQLite copies the persist files among the provided names into the
+// database, and verifies the copy.
+func copyToSQLite(src Storage, dst *SQLiteStorage, names []string) (SQLiteMigration, error) {
+	var m SQLiteMigration
+	var copied []string
+	for _, name := range names {
+		if keptInServerDir(name) {
+			continue
+		}
+		data, err := src.ReadFile(name)
+		if err != nil {
+			return m, fmt.Errorf("unable to read %v: %v", name, err)
+		}
+		info, err := src.Stat(name)
+		if err != nil {
+			return m, fmt.Errorf("unable to stat %v: %v", name, err)
+		}
+		if err := dst.WriteFile(name, data, info.Mode().Perm()); err != nil {
+			return m, fmt.Errorf("unable to copy %v: %v", name, err)
+		}
+		copied = append(copied, name)
+		m.Files++
+		m.Bytes += int64(len(data))
+	}
+
+	// Check the copy of every file.
+	if err := dst.verifyChunks(); err != nil {
+		return m, err
+	}
+	for _, name := range copied {
+		data, err := src.ReadFile(name)
+		if err != nil {
+			return m, fmt.Errorf("unable to read %v: %v", name, err)
+		}
+		stored, err := dst.ReadFile(name)
+		if err != nil {
+			return m, fmt.Errorf("unable to read back %v: %v", name, err)
+		}
+		if !bytes.Equal(data, stored) {
+			return m, fmt.Errorf("%v changed in the copy", name)
+		}
+	}
+
+	// Every record has to be in its table. The expected number of rows
+	// is counted by decoding the files the same way that the server
+	// loads them.
+	expected, err := countRecords(src)
+	if err != nil {
+		return m, err
+	}
+	for _, c := range []struct {
+		table string
+		dest  *int
+	}{
+		{"devices", &m.Devices},
+		{"reports", &m.Reports},
+		{"bans", &m.Bans},
+		{"audit_entries", &m.AuditEntries},
+	} {
+		if *c.dest, err = dst.countRows(c.table); err != nil {
+			return m, fmt.Errorf("unable to count the %v: %v", c.table, err)
+		}
+		if *c.dest != expected[c.table] {
+			return m, fmt.Errorf("the %v table has %v rows, but the files contain %v records", c.table, *c.dest, expected[c.table])
+		}
+	}
+	if err := dst.verifyReportSignatures(); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// readOptionalFile reads a persist file that the server may not have created
+// yet.
+func readOptionalFile(s Storage, name string) ([]byte, error) {
+	data, err := s.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %v: %v", name, err)
+	}
+	return data, nil
+}
+
+// countRecords returns the number of records of every derived table that the
+// persist files contain, verifying the hash chain of the audit log along the
+// way.
+func countRecords(s Storage) (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, f := range []struct {
+		name  string
+		table string
+		size  int
+	}{
+		{LegacyEquipmentAuthorizationsFile, "devices", glow.EquipmentAuthorizationLegacySize},
+		{EquipmentAuthorizationsFile, "devices", glow.EquipmentAuthorizationSize},
+		{EquipmentReportsFile, "reports", equipmentReportSize},
+		{BannedEquipmentFile, "bans", equipmentBanRecordSize},
+	} {
+		data, err := readOptionalFile(s, f.name)
+		if err != nil {
+			return nil, err
+		}
+		if len(data)%f.size != 0 {
+			return nil, fmt.Errorf("%v has a partial record", f.name)
+		}
+		counts[f.table] += len(data) / f.size
+	}
+
+	// A torn record at the end of the journal gets dropped by the next
+	// startup, so it doesn't count.
+	data, err := readOptionalFile(s, ReportsJournalFile)
+	if err != nil {
+		return nil, err
+	}
+	reports, _ := decodeJournal(data)
+	counts["reports"] += len(reports)
+
+	data, err = readOptionalFile(s, AuditLogFile)
+	if err != nil {
+		return nil, err
+	}
+	var entries []glow.AuditEntry
+	for len(data) > 0 {
+		e, n, err := glow.DeserializeAuditEntry(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode audit log entry %v: %v", len(entries), err)
+		}
+		entries = append(entries, e)
+		data = data[n:]
+	}
+	if _, err := glow.VerifyAuditLog([32]byte{}, entries); err != nil {
+		return nil, fmt.Errorf("audit log is corrupt: %v", err)
+	}
+	counts["audit_entries"] = len(entries)
+	return counts, nil
+}
+
+// deviceKeys returns every key that the device with a ShortID has been
+// allowed to sign reports with: the keys of its authorizations, the keys that
+// it rotated to, and the key of the import that gave it the ShortID.
+func (s *SQLiteStorage) deviceKeys() (map[uint32][]glow.PublicKey, error) {
+	keys := make(map[uint32][]glow.PublicKey)
+	if err := s.authorizationKeys(keys); err != nil {
+		return nil, err
+	}
+
+	data, err := readOptionalFile(s, DeviceKeyRotationsFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%deviceKeyRotationSize != 0 {
+		return nil, fmt.Errorf("%v has a partial record", DeviceKeyRotationsFile)
+	}
+	for i := 0; i < len(data); i += deviceKeyRotationSize {
+		rot, err := DeserializeDeviceKeyRotation(data[i : i+deviceKeyRotationSize])
+		if err != nil {
+			return nil, fmt.Errorf("%v: record %v: %v", DeviceKeyRotationsFile, i/deviceKeyRotationSize, err)
+		}
+		keys[rot.ShortID] = append(keys[rot.ShortID], rot.NewKey)
+	}
+
+	data, err = readOptionalFile(s, EquipmentImportsFile)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; len(data) > 0; i++ {
+		ei, n, err := deserializeEquipmentImport(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v: record %v: %v", EquipmentImportsFile, i, err)
+		}
+		data = data[n:]
+		keys[ei.ShortID] = append(keys[ei.ShortID], ei.Bundle.Authorization.PublicKey)
+	}
+	return keys, nil
+}
+
+// authorizationKeys adds the keys of the devices table to keys.
+func (s *SQLiteStorage) authorizationKeys(keys map[uint32][]glow.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.db.Query(`SELECT short_id, public_key FROM devices`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var shortID uint32
+		var b []byte
+		if err := rows.Scan(&shortID, &b); err != nil {
+			return err
+		}
+		var pk glow.PublicKey
+		copy(pk[:], b)
+		keys[shortID] = append(keys[shortID], pk)
+	}
+	return rows.Err()
+}
+
+// verifyReportSignatures checks that every report in the reports table is
+// signed by one of the keys of its device.
+func (s *SQLiteStorage) verifyReportSignatures() error {
+	keys, err := s.deviceKeys()
+	if err != nil {
+		return fmt.Errorf("unable to load the device keys: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.db.Query(`SELECT file, pos, short_id, timeslot, power_output, signature FROM reports`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var file string
+		var pos, powerOutput int64
+		var sig []byte
+		var er glow.EquipmentReport
+		if err := rows.Scan(&file, &pos, &er.ShortID, &er.Timeslot, &powerOutput, &sig); err != nil {
+			return err
+		}
+		er.PowerOutput = uint64(powerOutput)
+		copy(er.Signature[:], sig)
+		if !signedByDevice(er, keys[er.ShortID]) {
+			return fmt.Errorf("%v: the report at offset %v is not signed by a key of ShortID %v", file, pos, er.ShortID)
+		}
+	}
+	return rows.Err()
+}
+
+// signedByDevice returns whether a report is signed by one of the keys.
+func signedByDevice(er glow.EquipmentReport, keys []glow.PublicKey) bool {
+	for _, pk := range keys {
+		if glow.VerifyEquipmentReport(pk, er) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// testReport returns the report that generateTestReport serializes.
+func testReport(t testing.TB, shortID, timeslot uint32, priv glow.PrivateKey) glow.EquipmentReport {
+	er, err := glow.DeserializeReport(generateTestReport(shortID, timeslot, priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return er
+}
+
+// TestSQLiteStorageTables checks that the derived tables follow the files
+// that they are decoded from, and that the database keeps the files across a
+// restart.
+func TestSQLiteStorageTables(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SQLiteDatabaseFile)
+	s, err := OpenSQLiteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := func(table string) int {
+		t.Helper()
+		n, err := s.countRows(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	_, priv := glow.GenerateKeyPair()
+	report := func(ts uint32) glow.EquipmentReport {
+		return testReport(t, 1, ts, priv)
+	}
+
+	// Appending to the journal adds the reports, a torn record does not
+	// get decoded, and truncating the journal removes the reports again.
+	l, err := s.OpenLog(ReportsJournalFile, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := uint32(0); ts < 3; ts++ {
+		if _, err := l.Write(encodeJournalRecord(report(ts))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := l.Write(encodeJournalRecord(report(3))[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if n := rows("reports"); n != 3 {
+		t.Fatal("unexpected number of reports after the appends:", n)
+	}
+	if err := l.Truncate(reportsJournalRecordSize); err != nil {
+		t.Fatal(err)
+	}
+	if n := rows("reports"); n != 1 {
+		t.Fatal("unexpected number of reports after the truncation:", n)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing a file rebuilds its rows, and removing it drops them.
+	var data []byte
+	for ts := uint32(10); ts < 15; ts++ {
+		data = append(data, report(ts).Serialize()...)
+	}
+	if err := s.WriteFile(EquipmentReportsFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteFile(EquipmentReportsFile, data[:2*equipmentReportSize], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := rows("reports"); n != 3 {
+		t.Fatal("unexpected number of reports after the replacement:", n)
+	}
+	if err := s.AppendFile(EquipmentReportsFile, data[2*equipmentReportSize:], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := rows("reports"); n != 6 {
+		t.Fatal("unexpected number of reports after an append:", n)
+	}
+	var pos int64
+	err = s.db.QueryRow(`SELECT pos FROM reports WHERE file = ? AND timeslot = 14`, EquipmentReportsFile).Scan(&pos)
+	if err != nil || pos != 4*equipmentReportSize {
+		t.Fatal("unexpected position of a report:", pos, err)
+	}
+	if err := s.Remove(ReportsJournalFile); err != nil {
+		t.Fatal(err)
+	}
+	if n := rows("reports"); n != 5 {
+		t.Fatal("unexpected number of reports after a removal:", n)
+	}
+
+	// A file that can't be decoded still gets written.
+	if err := s.WriteFile(BannedEquipmentFile, []byte("not a ban record"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := rows("bans"); n != 0 {
+		t.Fatal("garbage was decoded into bans:", n)
+	}
+
+	// The chunks of a replaced file are kept while a handle can still
+	// read them, and dropped when it gets closed.
+	big := make([]byte, 3*sqliteChunkSize/2)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	if err := s.WriteFile("big", big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.Open("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteFile("big", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if _, err := f.ReadAt(buf, sqliteChunkSize-50); err != nil || !bytes.Equal(buf, big[sqliteChunkSize-50:sqliteChunkSize+50]) {
+		t.Fatal("unexpected read across two chunks:", err)
+	}
+	chunks := func() int {
+		t.Helper()
+		var n int
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM chunks`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	before := chunks()
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := chunks(); after != before-2 {
+		t.Fatal("the chunks of a replaced file were not dropped:", before, after)
+	}
+
+	// Everything survives a restart.
+	if err := s.verifyChunks(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSQLiteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stored, err := s.ReadFile(EquipmentReportsFile)
+	if err != nil || string(stored) != string(data) {
+		t.Fatal("the reports file did not survive a restart:", err)
+	}
+	if n := rows("reports"); n != 5 {
+		t.Fatal("unexpected number of reports after a restart:", n)
+	}
+	names, err := s.List("")
+	if err != nil || strings.Join(names, " ") != "bannedEquipment.dat big equipment-reports.dat" {
+		t.Fatal("unexpected files after a restart:", names, err)
+	}
+}
+
+// TestSQLiteServer runs a server on the SQLite storage and restarts it.
+func TestSQLiteServer(t *testing.T) {
+	glow.SetCurrentTimeslot(100)
+	defer glow.SetCurrentTimeslot(0)
+	opts := DefaultServerOptions()
+	opts.StorageBackend = StorageBackendSQLite
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := uint32(100); ts < 105; ts++ {
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, ts, priv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, EquipmentAuthorizationsFile)); !os.IsNotExist(err) {
+		t.Fatal("the server wrote its persist files to the directory:", err)
+	}
+
+	server, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.mu.RLock()
+	reports := server.equipmentReports[1]
+	loaded := reports != nil && reports.PowerOutputs[100] == 5 && reports.PowerOutputs[104] == 5
+	server.mu.RUnlock()
+	if !loaded {
+		t.Fatal("the reports did not survive the restart")
+	}
+}
+
+// TestMigrateToSQLite migrates the files of a server into a database, and
+// starts the server on the database.
+func TestMigrateToSQLite(t *testing.T) {
+	glow.SetCurrentTimeslot(100)
+	defer glow.SetCurrentTimeslot(0)
+	dir := glow.GenerateTestDir(t.Name())
+	useFileStorage(dir)
+	server, _, gcaPrivKey, err := SetupTestServer(dir, DefaultServerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, priv, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := uint32(100); ts < 110; ts++ {
+		if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, ts, priv)); outcome != reportAccepted {
+			t.Fatal("report was not accepted:", outcome)
+		}
+	}
+	server.mu.RLock()
+	auditEntries := len(server.auditLog.entries)
+	server.mu.RUnlock()
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A report that is not signed by its device fails the migration, and
+	// leaves nothing behind.
+	forged := testReport(t, 1, 110, priv)
+	forged.PowerOutput++
+	src := NewFileStorage(dir)
+	journal, err := src.ReadFile(ReportsJournalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AppendFile(ReportsJournalFile, encodeJournalRecord(forged), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateToSQLite(dir); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Fatal("a forged report was migrated:", err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, SQLiteDatabaseFile+"*")); len(names) != 0 {
+		t.Fatal("a failed migration left files behind:", names)
+	}
+	if err := src.WriteFile(ReportsJournalFile, journal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := MigrateToSQLite(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Files == 0 || m.Devices != 1 || m.Reports != 10 || m.AuditEntries != auditEntries {
+		t.Fatalf("unexpected migration: %+v", m)
+	}
+	if _, err := MigrateToSQLite(dir); err == nil {
+		t.Fatal("a second migration overwrote the database")
+	}
+
+	// The server comes up on the database with the same state.
+	opts := DefaultServerOptions()
+	opts.StorageBackend = StorageBackendSQLite
+	server, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, ok := server.staticStorage.(*SQLiteStorage); !ok {
+		t.Fatal("the server does not use the database")
+	}
+	server.mu.RLock()
+	reports := server.equipmentReports[1]
+	loaded := reports != nil && reports.PowerOutputs[100] == 5 && reports.PowerOutputs[109] == 5
+	server.mu.RUnlock()
+	if !loaded {
+		t.Fatal("the reports were lost in the migration")
+	}
+	if outcome, _ := server.managedHandleEquipmentReport(generateTestReport(1, 110, priv)); outcome != reportAccepted {
+		t.Fatal("report was not accepted after the migration:", outcome)
+	}
+}
+
+// BenchmarkStorageIngestion measures how fast every Storage takes reports,
+// which get appended to the journal one record at a time and compacted into
+// the reports file every 1000 reports. The reports file starts over every
+// 10000 reports, like it does when the reporting window moves on.
+func BenchmarkStorageIngestion(b *testing.B) {
+	for _, bs := range []struct {
+		name       string
+		newStorage func(b *testing.B) Storage
+	}{
+		{"File", func(b *testing.B) Storage { return NewFileStorage(b.TempDir()) }},
+		{"Memory", func(b *testing.B) Storage { return NewMemoryStorage() }},
+		{"SQLite", func(b *testing.B) Storage { return newTestSQLiteStorage(b) }},
+	} {
+		b.Run(bs.name, func(b *testing.B) {
+			s := bs.newStorage(b)
+			l, err := s.OpenLog(ReportsJournalFile, 0644)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+			_, priv := glow.GenerateKeyPair()
+			records := make([][]byte, 1000)
+			for i := range records {
+				records[i] = encodeJournalRecord(testReport(b, uint32(i), uint32(i), priv))
+			}
+			var compacted []byte
+			start := time.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := l.Write(records[i%len(records)]); err != nil {
+					b.Fatal(err)
+				}
+				if i%len(records) != len(records)-1 {
+					continue
+				}
+				if len(compacted) >= 10000*equipmentReportSize {
+					compacted = compacted[:0]
+				}
+				for _, r := range records {
+					compacted = append(compacted, r[4:4+equipmentReportSize]...)
+				}
+				if err := s.WriteFile(EquipmentReportsFile, compacted, 0644); err != nil {
+					b.Fatal(err)
+				}
+				if err := l.Truncate(0); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "reports/s")
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// The servers that the tests launch keep their persist files in memory,
+// unless GCA_TEST_STORAGE is set to "file". A server that gets restarted in
+// the same directory gets the same MemoryStorage back, just like it would find
+// its files again on disk.
+var (
+	testStorages   = make(map[string]Storage)
+	testStoragesMu sync.Mutex
+)
+
+func init() {
+	if os.Getenv("GCA_TEST_STORAGE") == "file" {
+		return
+	}
+	testStorage = func(baseDir string) Storage {
+		testStoragesMu.Lock()
+		defer testStoragesMu.Unlock()
+		dir := filepath.Clean(baseDir)
+		s, exists := testStorages[dir]
+		if !exists {
+			s = NewMemoryStorage()
+			testStorages[dir] = s
+		}
+		return s
+	}
+}
+
+// useFileStorage makes the servers that run in dir keep their persist files
+// on disk, for the tests that are about the files themselves. It has to be
+// called before the first server runs in dir.
+func useFileStorage(dir string) {
+	if testStorage == nil {
+		return
+	}
+	testStoragesMu.Lock()
+	defer testStoragesMu.Unlock()
+	testStorages[filepath.Clean(dir)] = NewFileStorage(dir)
+}
+
+// serverStorage returns the storage of the servers that run in dir, which lets
+// a test get at the persist files of a server that is not running.
+func serverStorage(dir string) Storage {
+	return defaultStorage(dir)
+}
+
+// TestStorage runs the conformance tests against every Storage.
+func TestStorage(t *testing.T) {
+	t.Run("File", func(t *testing.T) {
+		testStorageConformance(t, func() Storage { return NewFileStorage(t.TempDir()) })
+	})
+	t.Run("Memory", func(t *testing.T) {
+		testStorageConformance(t, func() Storage { return NewMemoryStorage() })
+	})
+	t.Run("SQLite", func(t *testing.T) {
+		testStorageConformance(t, func() Storage { return newTestSQLiteStorage(t) })
+	})
+	t.Run("ReadOnly", func(t *testing.T) {
+		testStorageConformance(t, func() Storage { return newReadOnlyStorage(NewFileStorage(t.TempDir())) })
+	})
+}
+
+// newTestSQLiteStorage returns a SQLiteStorage in a temporary directory, which
+// gets closed at the end of the test.
+func newTestSQLiteStorage(t testing.TB) *SQLiteStorage {
+	s, err := OpenSQLiteStorage(filepath.Join(t.TempDir(), SQLiteDatabaseFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// testStorageConformance checks that a Storage behaves the way that the
+// server expects its storage to behave.
+func testStorageConformance(t *testing.T, newStorage func() Storage) {
+	t.Run("Missing", func(t *testing.T) {
+		s := newStorage()
+		if _, err := s.ReadFile("missing"); !os.IsNotExist(err) {
+			t.Fatal("unexpected error reading a missing file:", err)
+		}
+		if _, err := s.Open("missing"); !os.IsNotExist(err) {
+			t.Fatal("unexpected error opening a missing file:", err)
+		}
+		if _, err := s.Stat("missing"); !os.IsNotExist(err) {
+			t.Fatal("unexpected error statting a missing file:", err)
+		}
+		if err := s.Remove("missing"); err == nil {
+			t.Fatal("removing a missing file succeeded")
+		}
+		names, err := s.List("missing")
+		if err != nil || len(names) != 0 {
+			t.Fatal("unexpected listing of a missing dir:", names, err)
+		}
+	})
+
+	t.Run("WriteAndAppend", func(t *testing.T) {
+		s := newStorage()
+		if err := s.WriteFile("a/b/file", []byte("one"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteFile("a/b/file", []byte("two"), 0444); err != nil {
+			t.Fatal(err)
+		}
+		info, err := s.Stat("a/b/file")
+		if err != nil || info.Size() != 3 || info.Name() != "file" || info.Mode().Perm() != 0444 {
+			t.Fatal("unexpected file info:", info, err)
+		}
+		if err := s.AppendFile("a/b/file", []byte("three"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AppendFile("new", []byte("four"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		data, err := s.ReadFile("a/b/file")
+		if err != nil || string(data) != "twothree" {
+			t.Fatal("unexpected contents:", string(data), err)
+		}
+		data, err = s.ReadFile("new")
+		if err != nil || string(data) != "four" {
+			t.Fatal("unexpected contents:", string(data), err)
+		}
+		if info, err := s.Stat("a/b/file"); err != nil || info.Size() != 8 {
+			t.Fatal("unexpected file info after an append:", info, err)
+		}
+
+		// The slice that was written can't change the file afterwards,
+		// and neither can the slice that was read.
+		buf := []byte("five")
+		if err := s.WriteFile("new", buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		buf[0] = 'x'
+		data, _ = s.ReadFile("new")
+		data[1] = 'x'
+		if data, _ := s.ReadFile("new"); string(data) != "five" {
+			t.Fatal("file changed through a slice:", string(data))
+		}
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		s := newStorage()
+		if err := s.WriteFile("file", []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := s.Open("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		// Replacing or appending to the file is not visible through the
+		// handle.
+		if err := s.AppendFile("file", []byte("abc"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteFile("file", []byte("replaced"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := f.Stat()
+		if err != nil || info.Size() != 10 {
+			t.Fatal("unexpected file info:", info, err)
+		}
+		buf := make([]byte, 4)
+		if _, err := f.ReadAt(buf, 3); err != nil || string(buf) != "3456" {
+			t.Fatal("unexpected ReadAt:", string(buf), err)
+		}
+		if _, err := f.Seek(8, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		rest, err := io.ReadAll(f)
+		if err != nil || string(rest) != "89" {
+			t.Fatal("unexpected read after seeking:", string(rest), err)
+		}
+	})
+
+	t.Run("Log", func(t *testing.T) {
+		s := newStorage()
+		l, err := s.OpenLog("dir/log", 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.Write([]byte("0123")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.Write([]byte("4567")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 3)
+		if _, err := l.ReadAt(buf, 2); err != nil || string(buf) != "234" {
+			t.Fatal("unexpected ReadAt:", string(buf), err)
+		}
+		if n, err := l.ReadAt(buf, 6); n != 2 || err != io.EOF {
+			t.Fatal("unexpected ReadAt past the end:", n, err)
+		}
+
+		// Writes go to the end of the log after a truncation.
+		if err := l.Truncate(2); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.Write([]byte("ab")); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := s.ReadFile("dir/log")
+		if err != nil || string(data) != "01ab" {
+			t.Fatal("unexpected log contents after a truncation:", string(data), err)
+		}
+
+		// A log that gets opened again keeps its contents.
+		l, err = s.OpenLog("dir/log", 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		data, err = io.ReadAll(l)
+		if err != nil || string(data) != "01ab" {
+			t.Fatal("unexpected log contents after reopening:", string(data), err)
+		}
+	})
+
+	t.Run("ListAndRemove", func(t *testing.T) {
+		s := newStorage()
+		for _, name := range []string{"b", "a/y", "a/x", "c/z/w", "ab"} {
+			if err := s.WriteFile(name, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		names, err := s.List("")
+		if err != nil || !reflect.DeepEqual(names, []string{"a/x", "a/y", "ab", "b", "c/z/w"}) {
+			t.Fatal("unexpected listing:", names, err)
+		}
+		names, err = s.List("a")
+		if err != nil || !reflect.DeepEqual(names, []string{"a/x", "a/y"}) {
+			t.Fatal("unexpected listing of a dir:", names, err)
+		}
+		if err := s.Remove("a/x"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ReadFile("a/x"); !os.IsNotExist(err) {
+			t.Fatal("removed file can still be read:", err)
+		}
+		names, err = s.List("a")
+		if err != nil || !reflect.DeepEqual(names, []string{"a/y"}) {
+			t.Fatal("unexpected listing after a removal:", names, err)
+		}
+	})
+}
+
+// TestStorageTempFiles checks that the file storage does not list the
+// temporary files of interrupted writes.
+func TestStorageTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStorage(dir)
+	if err := s.WriteFile("file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other"+tmpFileSuffix), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	names, err := s.List("")
+	if err != nil || !reflect.DeepEqual(names, []string{"file"}) {
+		t.Fatal("unexpected listing:", names, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil || !bytes.Equal(data, []byte("data")) {
+		t.Fatal("file storage did not write to the directory:", string(data), err)
+	}
+}
@@ -24,7 +24,6 @@ import (
 	"io"
 	"net"
 	"strconv"
-	"time"
 
 	"github.com/glowlabs-org/gca-backend/glow"
 )
@@ -32,9 +31,15 @@ import (
 // launchListenForSyncRequests creates a TCP listener that will listen for
 // queries that want to see which timeslots have reports for a given piece of
 // hardware.
-func (gcas *GCAServer) launchListenForSyncRequests() {
+func (gcas *GCAServer) launchListenForSyncRequests(bindAddr string, port uint16) {
+	// A tenant gets its sync requests from the listener of its host, see
+	// tenants.go.
+	if gcas.staticTenantHost != nil {
+		return
+	}
+
 	// Listen on TCP port
-	listener, err := net.Listen("tcp", serverIP+":"+strconv.Itoa(tcpPort))
+	listener, err := net.Listen("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(int(port))))
 	if err != nil {
 		gcas.logger.Fatalf("Failed to create tcp listener: %s", err)
 	}
@@ -43,7 +48,7 @@ func (gcas *GCAServer) launchListenForSyncRequests() {
 		return listener.Close()
 	})
 
-	gcas.tg.Launch(func() {
+	gcas.launchComponent("sync-listener", nil, func() {
 		gcas.threadedListenForSyncRequests(listener)
 	})
 }
@@ -93,6 +98,10 @@ func (gcas *GCAServer) threadedListenForSyncRequests(listener net.Listener) {
 // connection closing.
 func (gcas *GCAServer) managedHandleSyncConn(conn net.Conn) {
 	defer conn.Close()
+	// A client that never sends its request would otherwise keep the
+	// server from shutting down.
+	stop := gcas.closeOnShutdown(conn)
+	defer stop()
 
 	// Create a buffer to store incoming data
 	buf := make([]byte, 4)
@@ -102,26 +111,44 @@ func (gcas *GCAServer) managedHandleSyncConn(conn net.Conn) {
 		return
 	}
 
-	// Read the ShortID from the request.
+	// Read the ShortID from the request. Other servers open a sync
+	// session with a reserved ShortID, see peer_sync.go.
 	id := binary.LittleEndian.Uint32(buf)
+	if id == peerSyncMagic {
+		gcas.managedHandlePeerSync(conn)
+		return
+	}
+	gcas.shortIDTenant(id).managedWriteSyncBitfield(conn, id)
+}
 
+// managedWriteSyncBitfield writes the response to a device that asked for the
+// bitfield of its reports.
+func (gcas *GCAServer) managedWriteSyncBitfield(conn net.Conn, id uint32) {
 	// Fetch the corresponding data.
 	var bitfield [504]byte
-	gcas.mu.Lock()
+	gcas.mu.RLock()
 	reports, exists := gcas.equipmentReports[id]
 	if exists {
-		for i, report := range reports {
+		for i, output := range reports.PowerOutputs {
 			byteIndex := i / 8
 			bitIndex := i % 8
-			if report.PowerOutput > 0 {
+			if output > 0 {
 				bitfield[byteIndex] |= 1 << bitIndex
 			}
 		}
+		// Flagged reports have been received as well, even though
+		// they are not part of the state yet.
+		for slot := range gcas.flaggedReports {
+			if slot.ShortID == id && slot.Timeslot >= gcas.equipmentReportsOffset && slot.Timeslot < gcas.equipmentReportsOffset+4032 {
+				i := slot.Timeslot - gcas.equipmentReportsOffset
+				bitfield[i/8] |= 1 << (i % 8)
+			}
+		}
 	}
 	equipment, exists2 := gcas.equipment[id]
 	reportsOffset := gcas.equipmentReportsOffset
 	migration, migrationExists := gcas.equipmentMigrations[equipment.PublicKey]
-	gcas.mu.Unlock()
+	gcas.mu.RUnlock()
 
 	// If there is no hardware for the provided short id, write a zero byte
 	// and close the connection.
@@ -151,19 +178,7 @@ func (gcas *GCAServer) managedHandleSyncConn(conn net.Conn) {
 		// Add the list of gcaServers.
 		gcas.gcaServers.mu.Lock()
 		for _, s := range gcas.gcaServers.servers {
-			locationLen := len(s.Location)
-			sBytes := make([]byte, 104+locationLen)
-			copy(sBytes[:32], s.PublicKey[:])
-			if s.Banned {
-				sBytes[32] = 1
-			}
-			sBytes[33] = byte(locationLen)
-			copy(sBytes[34:], []byte(s.Location))
-			binary.LittleEndian.PutUint16(sBytes[34+locationLen:], s.HttpPort)
-			binary.LittleEndian.PutUint16(sBytes[36+locationLen:], s.TcpPort)
-			binary.LittleEndian.PutUint16(sBytes[38+locationLen:], s.UdpPort)
-			copy(sBytes[40+locationLen:], s.GCAAuthorization[:])
-			resp = append(resp, sBytes...)
+			resp = append(resp, s.Serialize()...)
 		}
 		// Copy in a blank GCA signature.
 		var newGCASig glow.Signature
@@ -172,7 +187,7 @@ func (gcas *GCAServer) managedHandleSyncConn(conn net.Conn) {
 	}
 	// Copy in the unix timestamp
 	var timeBytes [8]byte
-	timestamp := time.Now().Unix()
+	timestamp := gcas.now().Unix()
 	binary.LittleEndian.PutUint64(timeBytes[:], uint64(timestamp))
 	resp = append(resp, timeBytes[:]...)
 	// Create the signature
@@ -180,10 +195,14 @@ func (gcas *GCAServer) managedHandleSyncConn(conn net.Conn) {
 	resp = append(resp, sig[:]...)
 	respLen := len(resp) - 2 // subtract 2 because the length prefix doesn't count
 	binary.LittleEndian.PutUint16(resp[:2], uint16(respLen))
-	_, err = conn.Write(resp)
+	_, err := conn.Write(resp)
 	if err != nil {
 		gcas.logger.Errorf("Failed to write response: %v", err)
 		return
 	}
+	gcas.staticMetrics.RecordSync()
+	gcas.mu.Lock()
+	gcas.lastSyncTime = gcas.now()
+	gcas.mu.Unlock()
 	return
 }
@@ -18,8 +18,14 @@ import (
 // It returns the timeslot offset and the bitfield. If the operation
 // fails for any reason, it returns an error.
 func (gcas *GCAServer) requestEquipmentBitfield(shortID uint32) (timeslotOffset uint32, bitfield [504]byte, err error) {
+	return gcas.requestEquipmentBitfieldAt("127.0.0.1", shortID)
+}
+
+// requestEquipmentBitfieldAt is the same as requestEquipmentBitfield, except
+// that the server is dialed at the provided host.
+func (gcas *GCAServer) requestEquipmentBitfieldAt(host string, shortID uint32) (timeslotOffset uint32, bitfield [504]byte, err error) {
 	// Dial the server
-	conn, err := net.Dial("tcp", "127.0.0.1:"+fmt.Sprintf("%v", gcas.tcpPort))
+	conn, err := net.Dial("tcp", glow.HostPort(host, gcas.tcpPort))
 	if err != nil {
 		return 0, [504]byte{}, fmt.Errorf("unable to call net.Dail: %v", err)
 	}
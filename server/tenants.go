@@ -0,0 +1,291 @@
+package server
+
+// tenants.go lets a single server process host the servers of several GCAs,
+// which are called tenants. Every tenant is a full GCAServer of its own, with
+// its own server keys, GCA key, devices, ShortIDs, and persist files, which
+// live in tenants/<id> under the directory of the host. The host is the
+// server that was launched, and it is a GCA of its own, which keeps the
+// routes and the directory that it always had, so a deployment without
+// tenants behaves the same as before.
+//
+// The tenants don't open any listeners. The host shares its listeners with
+// them:
+//   - The HTTP API of a tenant is served under /gca/<id>/, so that
+//     /gca/<id>/api/v1/equipment is the equipment endpoint of the tenant.
+//     Signed requests sign the full path, including the prefix.
+//   - A report over UDP goes to the server that knows its ShortID. As every
+//     GCA allocates its own ShortIDs, several servers may know the same
+//     ShortID, in which case the report goes to the first server whose
+//     device signed it. A report that no device signed goes to the host,
+//     which rejects it.
+//   - A sync session of another server goes to the server whose key the
+//     other server addressed in its hello, see peer_sync.go. A device that
+//     asks for its bitfield gets the bitfield of the first server that knows
+//     its ShortID, devices with a ShortID that is known to several servers
+//     should use the report-bitfields endpoint of their GCA instead.
+//
+// The devices of one GCA can never report to another. A report is only ever
+// applied by the server whose device signed it, and the HTTP endpoints of a
+// tenant only know the devices of that tenant.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+const (
+	// TenantsDir is the directory of the host that contains the
+	// directories of its tenants.
+	TenantsDir = "tenants"
+
+	// tenantPathPrefix is the prefix of the HTTP routes of a tenant,
+	// which is followed by the id of the tenant.
+	tenantPathPrefix = "/gca/"
+)
+
+// tenantIDPattern is the pattern of the id of a tenant, which has to be
+// usable as both a directory name and a path segment.
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// tenant is a GCA that is hosted by another server.
+type tenant struct {
+	id     string
+	server *GCAServer
+}
+
+// tenantPrefixKey is the context key of the path prefix that got stripped
+// from a request to a tenant.
+type tenantPrefixKey struct{}
+
+// ParseTenantList parses a comma separated list of tenant ids, as it gets
+// passed to the --tenants flag and the GCA_TENANTS variable.
+func ParseTenantList(s string) []string {
+	var ids []string
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// validateTenants checks that every tenant id is valid and unique.
+func validateTenants(ids []string) error {
+	seen := make(map[string]struct{})
+	for _, id := range ids {
+		if !tenantIDPattern.MatchString(id) {
+			return fmt.Errorf("invalid tenant id %q, ids consist of up to 63 lowercase letters, digits, and dashes", id)
+		}
+		if _, exists := seen[id]; exists {
+			return fmt.Errorf("tenant %v is listed twice", id)
+		}
+		seen[id] = struct{}{}
+	}
+	return nil
+}
+
+// openTenants opens the servers of the tenants, which get closed after the
+// host has stopped. The tenants get the options of the host, except for the
+// storage, which every tenant opens in its own directory.
+func (server *GCAServer) openTenants(ids []string, internalTestMode bool, opts ServerOptions) error {
+	var tenants []tenant
+	for _, id := range ids {
+		topts := opts
+		topts.Tenants = nil
+		topts.Storage = nil
+		topts.NotifySocket = ""
+		topts.WatchdogInterval = 0
+		topts.tenantHost = server
+		t, err := NewGCAServerWithOptions(filepath.Join(server.baseDir, TenantsDir, id), internalTestMode, topts)
+		if err != nil {
+			for _, t := range tenants {
+				t.server.Close()
+			}
+			return fmt.Errorf("unable to open tenant %v: %v", id, err)
+		}
+		tenants = append(tenants, tenant{id: id, server: t})
+	}
+	server.staticTenants = tenants
+	server.tg.AfterStop(func() error {
+		var firstErr error
+		for _, t := range server.staticTenants {
+			if err := t.server.Close(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("unable to close tenant %v: %v", t.id, err)
+			}
+		}
+		return firstErr
+	})
+	return nil
+}
+
+// Tenant returns the server of the tenant with the provided id, nil if the
+// server doesn't host such a tenant.
+func (server *GCAServer) Tenant(id string) *GCAServer {
+	for _, t := range server.staticTenants {
+		if t.id == id {
+			return t.server
+		}
+	}
+	return nil
+}
+
+// tenantIDs returns the ids of the tenants in the order they were configured.
+func (server *GCAServer) tenantIDs() []string {
+	var ids []string
+	for _, t := range server.staticTenants {
+		ids = append(ids, t.id)
+	}
+	return ids
+}
+
+// hostedServers returns the host followed by its tenants.
+func (server *GCAServer) hostedServers() []*GCAServer {
+	servers := []*GCAServer{server}
+	for _, t := range server.staticTenants {
+		servers = append(servers, t.server)
+	}
+	return servers
+}
+
+// shareTenantPorts hands the ports of the listeners to the tenants, which
+// report them in their server info. It is called before the HTTP API starts
+// serving, which is the only place that the tenants read the ports.
+func (server *GCAServer) shareTenantPorts() {
+	for _, t := range server.staticTenants {
+		t.server.httpPort = server.httpPort
+		t.server.tcpPort = server.tcpPort
+		t.server.udpPort = server.udpPort
+	}
+}
+
+// routeTenants is the outermost middleware of the HTTP API of a host, which
+// hands the requests under /gca/<id>/ to the API of the tenant. The tenant
+// runs the request through its own middleware, so it gets logged, limited,
+// and authenticated by the tenant.
+func (server *GCAServer) routeTenants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, tenantPathPrefix)
+		if !ok || len(server.staticTenants) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, _, _ := strings.Cut(rest, "/")
+		t := server.Tenant(id)
+		if t == nil {
+			server.writeError(w, ErrCodeNotFound, fmt.Sprintf("This server does not host a GCA with the id %q.", id))
+			return
+		}
+		prefix := tenantPathPrefix + id
+		r = r.WithContext(context.WithValue(r.Context(), tenantPrefixKey{}, prefix))
+		http.StripPrefix(prefix, t.httpServer.Handler).ServeHTTP(w, r)
+	})
+}
+
+// signedRequestURI returns the URI that the signature of a signed request
+// covers, which is the URI that the client requested, including the prefix
+// of a tenant.
+func signedRequestURI(r *http.Request) string {
+	prefix, _ := r.Context().Value(tenantPrefixKey{}).(string)
+	return prefix + r.URL.RequestURI()
+}
+
+// reportCandidates returns the first of the servers that know the ShortID of
+// a report packet, the host first, along with all of them if there is more
+// than one. The host is the only candidate of a packet that doesn't decode,
+// or of a ShortID that no server knows. A host without tenants doesn't need
+// to look at the packet at all.
+func (server *GCAServer) reportCandidates(packet []byte) (*GCAServer, []*GCAServer) {
+	if len(server.staticTenants) == 0 {
+		return server, nil
+	}
+	report, _, err := glow.DecodeReportPacket(packet)
+	if err != nil {
+		return server, nil
+	}
+	var candidates []*GCAServer
+	for _, s := range server.hostedServers() {
+		s.mu.RLock()
+		_, exists := s.equipment[report.ShortID]
+		s.mu.RUnlock()
+		if exists {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return server, nil
+	}
+	return candidates[0], candidates
+}
+
+// managedRouteReportPacket hands a report packet with a ShortID that is known
+// to several servers to the first of them whose device signed it. It runs on
+// a report worker of the host, because finding the server takes a signature
+// check for every candidate.
+func (server *GCAServer) managedRouteReportPacket(pkt reportPacket) {
+	report, _, err := glow.DecodeReportPacket(pkt.data)
+	if err != nil {
+		return
+	}
+	data := report.Serialize()
+	target := pkt.candidates[0]
+	for _, s := range pkt.candidates {
+		if _, _, err := s.managedVerifyReport(data); err == nil {
+			target = s
+			break
+		}
+	}
+	data, err = target.admitReportPacket(pkt.data, nil)
+	if err != nil {
+		return
+	}
+	target.managedProcessReportPacket(reportPacket{conn: pkt.conn, addr: pkt.addr, data: data})
+}
+
+// shortIDTenant returns the first server that knows a ShortID, the host if no
+// server does.
+func (server *GCAServer) shortIDTenant(shortID uint32) *GCAServer {
+	for _, s := range server.hostedServers() {
+		s.mu.RLock()
+		_, exists := s.equipment[shortID]
+		s.mu.RUnlock()
+		if exists {
+			return s
+		}
+	}
+	return server
+}
+
+// peerHelloTenant returns the server that a sync hello is addressed to, the
+// host if the hello isn't signed for any of the servers.
+func (server *GCAServer) peerHelloTenant(hello peerSyncHello) *GCAServer {
+	for _, s := range server.hostedServers() {
+		if glow.Verify(hello.PublicKey, hello.SigningBytes(s.staticPublicKey), hello.Signature) {
+			return s
+		}
+	}
+	return server
+}
+
+// reloadTenants reloads the settings of every tenant, see reload.go. The
+// changes of a tenant are prefixed with its id.
+func (server *GCAServer) reloadTenants(res *ReloadResult) {
+	for _, t := range server.staticTenants {
+		tres, err := t.server.Reload()
+		if err != nil {
+			server.logger.Errorf("unable to reload tenant %v: %v", t.id, err)
+			continue
+		}
+		for _, change := range tres.Changed {
+			res.Changed = append(res.Changed, t.id+": "+change)
+		}
+		for _, key := range tres.Ignored {
+			res.Ignored = append(res.Ignored, t.id+": "+key)
+		}
+	}
+}
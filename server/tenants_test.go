@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// setupTenantHost launches a server that hosts the provided tenants, and
+// registers a GCA key with the host and with every tenant. The GCA keys are
+// returned by tenant id, with the keys of the host under the empty id.
+func setupTenantHost(t *testing.T, dir string, opts ServerOptions) (*GCAServer, map[string]glow.PublicKey, map[string]glow.PrivateKey) {
+	tempKeys := make(map[string]glow.PrivateKey)
+	for _, id := range opts.Tenants {
+		tempPrivKey, err := provisionTestServerDir(filepath.Join(dir, TenantsDir, id), ServerOptions{StorageBackend: opts.StorageBackend})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tempKeys[id] = tempPrivKey
+	}
+	host, hostTempKey, err := gcaServerWithTempKeyAndOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKeys[""] = hostTempKey
+
+	gcaPubKeys := make(map[string]glow.PublicKey)
+	gcaKeys := make(map[string]glow.PrivateKey)
+	for id, tempPrivKey := range tempKeys {
+		s := host
+		if id != "" {
+			s = host.Tenant(id)
+		}
+		gcaPubKey, gcaPrivKey, err := s.submitGCAKey(tempPrivKey)
+		if err != nil {
+			host.Close()
+			t.Fatal(err)
+		}
+		gcaPubKeys[id] = gcaPubKey
+		gcaKeys[id] = gcaPrivKey
+	}
+	return host, gcaPubKeys, gcaKeys
+}
+
+// fetchServerInfo returns the server info from the API of a server.
+func (gcas *GCAServer) fetchServerInfo() (ServerInfoResponse, error) {
+	var info ServerInfoResponse
+	resp, err := http.Get("http://" + gcas.httpDialAddr() + "/api/v1/server-info")
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	return info, json.NewDecoder(resp.Body).Decode(&info)
+}
+
+// reportedPower returns the power output that a server has for a device in a
+// timeslot.
+func (gcas *GCAServer) reportedPower(shortID uint32, timeslot uint32) uint64 {
+	gcas.mu.RLock()
+	defer gcas.mu.RUnlock()
+	reports, exists := gcas.equipmentReports[shortID]
+	if !exists || timeslot < gcas.equipmentReportsOffset {
+		return 0
+	}
+	return reports.PowerOutputs[timeslot-gcas.equipmentReportsOffset]
+}
+
+// TestTenants runs a server that hosts two other GCAs, and checks that every
+// GCA only ever sees its own devices, whichever listener their traffic
+// arrives on.
+func TestTenants(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	opts := DefaultServerOptions()
+	opts.Tenants = []string{"a", "b"}
+	host, gcaPubKeys, gcaKeys := setupTenantHost(t, dir, opts)
+	a, b := host.Tenant("a"), host.Tenant("b")
+	if a == nil || b == nil || host.Tenant("c") != nil {
+		t.Fatal("unexpected tenants:", a, b)
+	}
+	if a.staticPublicKey == host.staticPublicKey || a.staticPublicKey == b.staticPublicKey {
+		t.Fatal("tenants share the keys of another server")
+	}
+
+	// Every GCA gets a device with the same ShortID, and b gets one with a
+	// ShortID of its own.
+	servers := map[string]*GCAServer{"": host, "a": a, "b": b}
+	keys := make(map[string]glow.PrivateKey)
+	for id, s := range servers {
+		_, key, err := s.AuthorizeTestDevice(1, gcaKeys[id])
+		if err != nil {
+			t.Fatal(id, err)
+		}
+		keys[id] = key
+	}
+	_, onlyB, err := b.AuthorizeTestDevice(2, gcaKeys["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reports over UDP land with the GCA of the device that signed
+	// them, and get acked with the key of that server.
+	ts := host.currentTimeslot()
+	for id, power := range map[string]uint64{"": 10, "a": 20, "b": 30} {
+		ra, err := servers[id].SubmitTestReport(1, ts, power, keys[id])
+		if err != nil || ra.Status != glow.ReportAckAccepted {
+			t.Fatal("report was not accepted:", id, ra, err)
+		}
+	}
+	if _, err := b.SubmitTestReport(2, ts, 40, onlyB); err != nil {
+		t.Fatal(err)
+	}
+	for id, power := range map[string]uint64{"": 10, "a": 20, "b": 30} {
+		if got := servers[id].reportedPower(1, ts); got != power {
+			t.Fatalf("server %q has power %v for ShortID 1, expected %v", id, got, power)
+		}
+	}
+	if host.reportedPower(2, ts) != 0 || a.reportedPower(2, ts) != 0 || b.reportedPower(2, ts) != 40 {
+		t.Fatal("report of ShortID 2 landed on the wrong server")
+	}
+
+	// A device that reports to the HTTP API of another GCA is rejected,
+	// even though that GCA has a device with the same ShortID.
+	report := generateTestReport(1, ts+1, keys["a"])
+	ra, code, err := b.postReportPacket(report)
+	if err != nil || ra != nil || code != ErrCodeInvalidSignature {
+		t.Fatal("report of another GCA was accepted:", ra, code, err)
+	}
+	ra, code, err = a.postReportPacket(report)
+	if err != nil || ra == nil || ra.Status != glow.ReportAckAccepted {
+		t.Fatal("report was not accepted by its own GCA:", ra, code, err)
+	}
+	if b.reportedPower(1, ts+1) != 0 {
+		t.Fatal("report of another GCA was applied")
+	}
+
+	// Signed requests sign the full path, and only the GCA of the tenant
+	// is trusted by it.
+	aPub := gcaPubKeys["a"]
+	resp, code, err := a.signedRequest("GET", "/api/v1/audit-log", nil, aPub, gcaKeys["a"])
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("signed request of the GCA was refused:", code, err)
+	}
+	resp, code, err = b.signedRequest("GET", "/api/v1/audit-log", nil, aPub, gcaKeys["a"])
+	if err != nil || resp.StatusCode == http.StatusOK {
+		t.Fatal("signed request of another GCA was accepted:", code, err)
+	}
+
+	// The bitfield of a ShortID that only one GCA knows comes from that
+	// GCA, the host answers for the ShortIDs that it knows itself.
+	if _, bitfield, err := b.requestEquipmentBitfield(2); err != nil || bitfield == [504]byte{} {
+		t.Fatal("unexpected bitfield of the tenant:", err)
+	}
+	if _, _, err := host.requestEquipmentBitfield(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The host keeps its own routes, lists its tenants, and refuses the
+	// ids that it doesn't host.
+	info, err := host.fetchServerInfo()
+	if err != nil || info.PublicKey != hex.EncodeToString(host.staticPublicKey[:]) || !reflect.DeepEqual(info.Tenants, []string{"a", "b"}) {
+		t.Fatal("unexpected server info of the host:", info, err)
+	}
+	info, err = a.fetchServerInfo()
+	if err != nil || info.PublicKey != hex.EncodeToString(a.staticPublicKey[:]) || info.UdpPort != host.udpPort || len(info.Tenants) != 0 {
+		t.Fatal("unexpected server info of the tenant:", info, err)
+	}
+	resp, err = http.Get("http://" + host.httpDialAddr() + "/gca/c/api/v1/server-info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("unknown tenant got status", resp.StatusCode)
+	}
+
+	// The tenants keep their keys and their reports across a restart.
+	aKey := a.staticPublicKey
+	if err := host.Close(); err != nil {
+		t.Fatal(err)
+	}
+	host, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	a = host.Tenant("a")
+	if a.staticPublicKey != aKey || a.reportedPower(1, ts) != 20 || a.reportedPower(1, ts+1) == 0 {
+		t.Fatal("tenant lost its state in the restart")
+	}
+	if host.Tenant("b").reportedPower(2, ts) != 40 || host.reportedPower(1, ts) != 10 {
+		t.Fatal("reports were lost in the restart")
+	}
+}
+
+// TestTenantIDs checks that invalid and duplicate tenant ids are refused.
+func TestTenantIDs(t *testing.T) {
+	if ids := ParseTenantList(" a, b-2 ,,"); !reflect.DeepEqual(ids, []string{"a", "b-2"}) {
+		t.Fatal("unexpected ids:", ids)
+	}
+	for _, ids := range [][]string{{"A"}, {"-a"}, {"a/b"}, {".."}, {"a", "a"}} {
+		if err := validateTenants(ids); err == nil {
+			t.Fatal("invalid ids were accepted:", ids)
+		}
+	}
+}
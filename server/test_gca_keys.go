@@ -0,0 +1,95 @@
+package server
+
+// test_gca_keys.go lets a server in internal test mode run without being
+// provisioned. A production server gets its GCA temp key from the technician
+// before the first startup, see api_server_gca_auth.go. A server in internal
+// test mode that starts without a temp key generates a temp key and a GCA key
+// of its own instead, and serves both private keys on
+// /internal/test-gca-keys, so that demos and integration scripts can register
+// the GCA and authorize devices against a fresh server.
+//
+// The keys are generated once and kept in TestGCAKeysFile, so a script that
+// runs again against the same server gets the same keys, and registering the
+// same GCA key again succeeds. A server that was provisioned never has test
+// keys, and the endpoint answers with a 404.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestGCAKeysResponse contains the hex encoded keys that a server in internal
+// test mode generated for itself. The GCA key isn't registered until it gets
+// submitted to /api/v1/register-gca with a signature from the temp key.
+type TestGCAKeysResponse struct {
+	ServerPublicKey string `json:"server_public_key"`
+	TempPrivateKey  string `json:"temp_private_key"`
+	GCAPublicKey    string `json:"gca_public_key"`
+	GCAPrivateKey   string `json:"gca_private_key"`
+}
+
+// generateTestGCAKeys generates the test keys and writes the public temp key
+// to where a provisioned server would have it. It returns the public temp
+// key. The test keys are written first, so a server that dies in between
+// generates new ones at the next startup.
+func (gcas *GCAServer) generateTestGCAKeys() ([]byte, error) {
+	tempPub, tempPriv := glow.GenerateKeyPair()
+	gcaPub, gcaPriv := glow.GenerateKeyPair()
+	data := append(append(tempPriv[:], gcaPub[:]...), gcaPriv[:]...)
+	if err := gcas.staticStorage.WriteFile(TestGCAKeysFile, data, 0600); err != nil {
+		return nil, fmt.Errorf("unable to write test gca keys: %v", err)
+	}
+	if err := gcas.staticStorage.WriteFile(GCATempPubkeyFile, tempPub[:], 0644); err != nil {
+		return nil, fmt.Errorf("unable to write test temp key: %v", err)
+	}
+	gcas.logger.Info("generated test gca keys for internal test mode")
+	return tempPub[:], nil
+}
+
+// InternalTestGCAKeysHandler is an internal API that returns the keys that
+// the server generated for itself in internal test mode. The API is rejected
+// outside of internal test mode.
+func (gcas *GCAServer) InternalTestGCAKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !gcas.allowIntApis {
+		http.Error(w, "Not implemented in production", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := gcas.staticStorage.ReadFile(TestGCAKeysFile)
+	if os.IsNotExist(err) {
+		http.Error(w, "The server was provisioned with a temp key, there are no test keys", http.StatusNotFound)
+		return
+	}
+	if err != nil || len(data) != 96 {
+		http.Error(w, "Unable to read the test keys", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TestGCAKeysResponse{
+		ServerPublicKey: hex.EncodeToString(gcas.staticPublicKey[:]),
+		TempPrivateKey:  hex.EncodeToString(data[:32]),
+		GCAPublicKey:    hex.EncodeToString(data[32:64]),
+		GCAPrivateKey:   hex.EncodeToString(data[64:]),
+	})
+}
+
+// verifyNotTestKey refuses a key of the well-known test key space outside of
+// internal test mode. The private keys of that space are public, see
+// glow/seeded_keys.go, so such a key showing up at a production server means
+// that test tooling got pointed at it, and that gets logged as an error. The
+// kind is what the key is for, and goes in the log and the error.
+func (gcas *GCAServer) verifyNotTestKey(kind string, pk glow.PublicKey) error {
+	if gcas.allowIntApis || !glow.IsTestKey(pk) {
+		return nil
+	}
+	gcas.logger.WithFields("kind", kind, "pubkey", pk).Error("REFUSED A WELL-KNOWN TEST KEY, test keys must never be used outside of internal test mode")
+	return withCode(ErrCodeMalformedRequest, fmt.Errorf("the %v key %x is a well-known test key, which is only accepted in internal test mode", kind, pk))
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// getTestGCAKeys fetches the test keys of the server, and returns the status
+// of the call along with the decoded keys.
+func (gcas *GCAServer) getTestGCAKeys(t *testing.T) (int, TestGCAKeysResponse) {
+	t.Helper()
+	resp, err := http.Get("http://" + gcas.httpDialAddr() + "/internal/test-gca-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var tgk TestGCAKeysResponse
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&tgk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, tgk
+}
+
+// parseTestKey decodes a hex encoded key of the test keys.
+func parseTestKey(t *testing.T, s string) [32]byte {
+	t.Helper()
+	var key [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(key) {
+		t.Fatal("invalid key:", s, err)
+	}
+	copy(key[:], b)
+	return key
+}
+
+// TestTestGCAKeys checks that a server in internal test mode that wasn't
+// provisioned generates test keys which can register the GCA, that the keys
+// survive a restart, and that provisioned servers have no test keys.
+func TestTestGCAKeys(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	opts := DefaultServerOptions()
+	opts.WattTimeUsername, opts.WattTimePassword = "user", "pass"
+	if _, err := NewGCAServerWithOptions(dir, false, opts); err == nil {
+		t.Fatal("a server without a temp key was launched outside of internal test mode")
+	}
+	server, err := NewGCAServerWithOptions(dir, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, tgk := server.getTestGCAKeys(t)
+	if status != http.StatusOK {
+		t.Fatal("unable to fetch the test keys:", status)
+	}
+	if parseTestKey(t, tgk.ServerPublicKey) != server.staticPublicKey {
+		t.Fatal("wrong server key:", tgk.ServerPublicKey)
+	}
+	tempPriv := glow.PrivateKey(parseTestKey(t, tgk.TempPrivateKey))
+	gcaPub := glow.PublicKey(parseTestKey(t, tgk.GCAPublicKey))
+	gcaPriv := glow.PrivateKey(parseTestKey(t, tgk.GCAPrivateKey))
+	if !glow.Verify(gcaPub, []byte("test"), glow.Sign([]byte("test"), gcaPriv)) {
+		t.Fatal("the gca keys don't match")
+	}
+	if err := server.submitKnownGCAKey(tempPriv, gcaPub, gcaPriv); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.AuthorizeTestDevice(1, gcaPriv); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys survive a restart, and the registration can be repeated.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServerWithOptions(dir, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, again := server.getTestGCAKeys(t); status != http.StatusOK || again != tgk {
+		t.Fatal("the test keys changed:", status, again)
+	}
+	if err := server.submitKnownGCAKey(tempPriv, gcaPub, gcaPriv); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A provisioned server has no test keys, even in internal test mode.
+	server, dir, _, _, err = SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := server.getTestGCAKeys(t); status != http.StatusNotImplemented {
+		t.Fatal("test keys were served outside of internal test mode:", status)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if status, _ := server.getTestGCAKeys(t); status != http.StatusNotFound {
+		t.Fatal("a provisioned server served test keys:", status)
+	}
+}
+
+// TestTestKeySpace checks that a server outside of internal test mode refuses
+// to register a GCA key or authorize a device from the well-known test key
+// space, and that a server in internal test mode accepts both.
+func TestTestKeySpace(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	server, tempPrivKey, err := gcaServerWithTempKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGCAPub, testGCAPriv := glow.TestGCAKey(0)
+	if err := server.submitKnownGCAKey(tempPrivKey, testGCAPub, testGCAPriv); err == nil {
+		t.Fatal("a test gca key was registered outside of internal test mode")
+	}
+	gcaPubKey, gcaPrivKey, err := server.submitGCAKey(tempPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Devices with test keys are refused, one at a time and in a batch,
+	// and so is a rotation to a test gca key.
+	makeAuth := func(shortID uint32, pub glow.PublicKey) glow.EquipmentAuthorization {
+		ea := glow.EquipmentAuthorization{
+			Version:   glow.EquipmentAuthorizationVersion,
+			ShortID:   shortID,
+			PublicKey: pub,
+			Capacity:  1e6,
+			Nonce:     uint64(shortID),
+		}
+		ea.Signature = glow.Sign(ea.SigningBytes(), gcaPrivKey)
+		return ea
+	}
+	testDevicePub, _ := glow.TestDeviceKey(3)
+	if _, err := server.managedAuthorizeEquipment(makeAuth(1, testDevicePub)); errorCode(err, "") != ErrCodeMalformedRequest {
+		t.Fatal("a device with a test key was authorized:", err)
+	}
+	pub, _ := glow.GenerateKeyPair()
+	results, _, err := server.managedAuthorizeEquipmentBatch([]glow.EquipmentAuthorization{makeAuth(2, testDevicePub), makeAuth(3, pub)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != batchAuthRejected || results[1].Status != batchAuthAuthorized {
+		t.Fatalf("unexpected batch results: %+v", results)
+	}
+	rot := GCAKeyRotation{OldKey: gcaPubKey, NewKey: testGCAPub, ActivationTimeslot: glow.CurrentTimeslot() + 10}
+	rot.Signature = glow.Sign(rot.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedRotateGCAKey(rot); errorCode(err, "") != ErrCodeMalformedRequest {
+		t.Fatal("a rotation to a test gca key was accepted:", err)
+	}
+
+	// Internal test mode accepts the test keys.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if isNew, err := server.managedAuthorizeEquipment(makeAuth(1, testDevicePub)); err != nil || !isNew {
+		t.Fatal("a device with a test key was refused in internal test mode:", isNew, err)
+	}
+}
@@ -5,12 +5,23 @@ package server
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"github.com/glowlabs-org/gca-backend/glow"
 )
@@ -30,6 +41,22 @@ func (gcas *GCAServer) BaseDir() string {
 	return gcas.baseDir
 }
 
+// CheckComponentsStopped returns an error naming every background loop that is
+// still running. It's meant to be called after Close, to catch loops that
+// don't return during shutdown.
+func (gcas *GCAServer) CheckComponentsStopped() error {
+	var running []string
+	for _, cs := range gcas.componentStatuses() {
+		if cs.Running {
+			running = append(running, cs.Name)
+		}
+	}
+	if len(running) > 0 {
+		return fmt.Errorf("components still running after Close: %v", running)
+	}
+	return nil
+}
+
 // CheckInvariants is a function which will ensure that the data on the server
 // is self-consistent. If something is broken, it means the struct has corrupted
 // and a panic is necessary to prevent grey goo from infecting the system.
@@ -38,11 +65,11 @@ func (gcas *GCAServer) BaseDir() string {
 // occasionally in prod.
 func (gcas *GCAServer) CheckInvariants() {
 	// Lock the gcas for concurrency safety if needed
-	gcas.mu.Lock()
+	gcas.mu.RLock()
 
 	// Check if equipmentShortID has the same number of elements as equipment
 	if len(gcas.equipment) != len(gcas.equipmentShortID) {
-		gcas.mu.Unlock()
+		gcas.mu.RUnlock()
 		panic("equipment and equipmentShortID maps have different sizes")
 	}
 
@@ -52,37 +79,54 @@ func (gcas *GCAServer) CheckInvariants() {
 	for shortID, auth := range gcas.equipment {
 		// Check for unique PublicKey
 		if _, exists := pubKeys[auth.PublicKey]; exists {
-			gcas.mu.Unlock()
+			gcas.mu.RUnlock()
 			panic("duplicate PublicKey found in equipment map")
 		}
 		pubKeys[auth.PublicKey] = struct{}{}
 
 		// Check if equipmentShortID correctly maps to equipment
 		if mappedShortID, exists := gcas.equipmentShortID[auth.PublicKey]; !exists || mappedShortID != shortID {
-			gcas.mu.Unlock()
+			gcas.mu.RUnlock()
 			panic("mismatch between equipment and equipmentShortID maps")
 		}
 
 		// Check that an impact rate element exists for this equipment.
 		_, exists := gcas.equipmentImpactRate[shortID]
 		if !exists {
-			gcas.mu.Unlock()
+			gcas.mu.RUnlock()
 			panic("the equipment impact rate was not established for this equipment")
 		}
 	}
-	gcas.mu.Unlock()
+	gcas.mu.RUnlock()
+}
+
+// testAuthorizationNonce hands out the nonces for the authorizations that get
+// signed by SignEquipmentAuthorization.
+var testAuthorizationNonce atomic.Uint64
+
+// SignEquipmentAuthorization sets the authorization to the current format with
+// a fresh nonce, and then signs it with the provided GCA key.
+func SignEquipmentAuthorization(ea glow.EquipmentAuthorization, gcaPrivKey glow.PrivateKey) glow.EquipmentAuthorization {
+	ea.Version = glow.EquipmentAuthorizationVersion
+	ea.Nonce = testAuthorizationNonce.Add(1)
+	ea.Signature = glow.Sign(ea.SigningBytes(), gcaPrivKey)
+	return ea
 }
 
 // AuthorizeEquipment will submit an equipment authorization to the GCA server
-// for the provided equipment.
+// for the provided equipment. Legacy authorizations get a nonce from
+// SignEquipmentAuthorization, others are signed as they are.
 func (gcas *GCAServer) AuthorizeEquipment(ea glow.EquipmentAuthorization, gcaPrivKey glow.PrivateKey) error {
-	sb := ea.SigningBytes()
-	ea.Signature = glow.Sign(sb, gcaPrivKey)
+	if ea.Version == glow.EquipmentAuthorizationVersionLegacy {
+		ea = SignEquipmentAuthorization(ea, gcaPrivKey)
+	} else {
+		ea.Signature = glow.Sign(ea.SigningBytes(), gcaPrivKey)
+	}
 	j, err := json.Marshal(ea)
 	if err != nil {
 		return fmt.Errorf("unable to marshal equipment authorization: %v", err)
 	}
-	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%v/api/v1/authorize-equipment", gcas.httpPort), "application/json", bytes.NewBuffer(j))
+	resp, err := http.Post("http://"+gcas.httpDialAddr()+"/api/v1/authorize-equipment", "application/json", bytes.NewBuffer(j))
 	if err != nil {
 		return fmt.Errorf("failed to send request: %v", err)
 	}
@@ -97,19 +141,213 @@ func (gcas *GCAServer) AuthorizeEquipment(ea glow.EquipmentAuthorization, gcaPri
 	return nil
 }
 
+// AuthorizeTestDevice creates a keypair for a new piece of equipment with the
+// provided ShortID, authorizes it with the GCA key, and checks that the server
+// added it.
+func (gcas *GCAServer) AuthorizeTestDevice(shortID uint32, gcaPrivKey glow.PrivateKey) (ea glow.EquipmentAuthorization, equipmentKey glow.PrivateKey, err error) {
+	pubkey, equipmentKey := glow.GenerateKeyPair()
+	return gcas.AuthorizeTestDeviceWithKey(shortID, gcaPrivKey, pubkey, equipmentKey)
+}
+
+// AuthorizeTestDeviceWithKey is the same as AuthorizeTestDevice, except that
+// the equipment gets the provided keypair, which lets a test use a seeded
+// key, see glow/seeded_keys.go.
+func (gcas *GCAServer) AuthorizeTestDeviceWithKey(shortID uint32, gcaPrivKey glow.PrivateKey, pubkey glow.PublicKey, equipmentKey glow.PrivateKey) (ea glow.EquipmentAuthorization, _ glow.PrivateKey, err error) {
+	// Verify that the shortID is free. Even if the shortID is not free,
+	// we'll still make the web request because the caller may want the
+	// request to go through.
+	gcas.mu.Lock()
+	_, shortIDAlreadyUsed := gcas.equipment[shortID]
+	gcas.mu.Unlock()
+
+	// Create the equipment request body.
+	ea = glow.EquipmentAuthorization{
+		ShortID:    shortID,
+		PublicKey:  pubkey,
+		Capacity:   15400300,
+		Debt:       11223344,
+		Expiration: 100e6 + glow.CurrentTimeslot(), // ensure the hardware won't be invalid for a while, but leave enough room for tests to intentionally expire the hardware
+	}
+	ea = SignEquipmentAuthorization(ea, gcaPrivKey)
+
+	// Convert the request to json and post it.
+	jsonBody, _ := json.Marshal(ea)
+	resp, err := http.Post("http://"+gcas.httpDialAddr()+"/api/v1/authorize-equipment", "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("unable to send http request to submit new hardware: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Verify the response.
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("expected status 200, but got %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	var response map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("Failed to decode response: %v", err)
+	}
+	if status, exists := response["status"]; !exists || status != "success" {
+		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("Unexpected response: %v", response)
+	}
+
+	// Verify that the server sees the new equipment.
+	if shortIDAlreadyUsed {
+		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("shortID already in use")
+	}
+	gcas.mu.Lock()
+	_, exists := gcas.equipment[shortID]
+	gcas.mu.Unlock()
+	if !exists {
+		return glow.EquipmentAuthorization{}, glow.PrivateKey{}, fmt.Errorf("equipment does not appear to have been added to server correctly")
+	}
+	gcas.CheckInvariants()
+	return ea, equipmentKey, nil
+}
+
+// SubmitTestReport signs a report with the key of the equipment, sends it to
+// the server over UDP, and waits for the ack. An error is returned if no ack
+// arrives or if the ack isn't signed by the server.
+func (gcas *GCAServer) SubmitTestReport(shortID uint32, timeslot uint32, powerOutput uint64, equipmentKey glow.PrivateKey) (glow.ReportAck, error) {
+	er := glow.EquipmentReport{
+		ShortID:     shortID,
+		Timeslot:    timeslot,
+		PowerOutput: powerOutput,
+	}
+	er.Signature = glow.Sign(er.SigningBytes(), equipmentKey)
+	ra, err := gcas.sendReportReadAck(er.Serialize())
+	if err != nil {
+		return glow.ReportAck{}, err
+	}
+	if ra == nil {
+		return glow.ReportAck{}, fmt.Errorf("no ack received")
+	}
+	if ra.ShortID != shortID || ra.Timeslot != timeslot {
+		return glow.ReportAck{}, fmt.Errorf("ack is for the wrong report: %v %v", ra.ShortID, ra.Timeslot)
+	}
+	if !glow.Verify(gcas.staticPublicKey, ra.SigningBytes(), ra.Signature) {
+		return glow.ReportAck{}, fmt.Errorf("ack has a bad signature")
+	}
+	return *ra, nil
+}
+
+// localDialHost returns the host that reaches a listener bound to the
+// provided IP from the local machine, which is loopback if the listener is
+// bound to a wildcard address.
+func localDialHost(ip net.IP) string {
+	if ip == nil || ip.IsUnspecified() {
+		return "127.0.0.1"
+	}
+	return ip.String()
+}
+
+// httpDialAddr returns the address that reaches the http api from the local
+// machine. The address of a tenant ends in the path prefix of its API, which
+// points the helpers at the tenant when they append an endpoint to it.
+func (gcas *GCAServer) httpDialAddr() string {
+	host, _, _ := net.SplitHostPort(gcas.httpServer.Addr)
+	return glow.HostPort(localDialHost(net.ParseIP(host)), gcas.httpPort) + gcas.apiPathPrefix()
+}
+
+// apiPathPrefix returns the prefix of the routes of a tenant on the API of its
+// host, see tenants.go, and an empty string for every other server.
+func (gcas *GCAServer) apiPathPrefix() string {
+	if gcas.staticTenantHost == nil {
+		return ""
+	}
+	for _, t := range gcas.staticTenantHost.staticTenants {
+		if t.server == gcas {
+			return tenantPathPrefix + t.id
+		}
+	}
+	return ""
+}
+
+// udpDialAddr returns the address that reaches the UDP listener from the
+// local machine.
+func (gcas *GCAServer) udpDialAddr() string {
+	var ip net.IP
+	if conn := gcas.udpListener.managedConn(); conn != nil {
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			ip = addr.IP
+		}
+	}
+	return glow.HostPort(localDialHost(ip), gcas.udpPort)
+}
+
+// sendReportReadAck sends a raw report over a connected UDP socket and waits
+// briefly for an ack. A nil ack is returned if nothing arrives.
+func (gcas *GCAServer) sendReportReadAck(report []byte) (*glow.ReportAck, error) {
+	conn, err := net.Dial("udp", gcas.udpDialAddr())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(report); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, nil
+	}
+	if n > len(report) {
+		return nil, fmt.Errorf("ack is larger than the report: %v > %v", n, len(report))
+	}
+	ra, err := glow.DeserializeReportAck(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	return &ra, nil
+}
+
 // SetupTestEnvironment will return a fully initialized gca server that is
 // ready to be used.
 func SetupTestEnvironment(testName string) (gcas *GCAServer, dir string, gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, err error) {
+	return SetupTestEnvironmentWithOptions(testName, DefaultServerOptions())
+}
+
+// Same as SetupTestEnvironment except that the server is launched with the
+// provided options.
+func SetupTestEnvironmentWithOptions(testName string, opts ServerOptions) (gcas *GCAServer, dir string, gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, err error) {
 	dir = glow.GenerateTestDir(testName)
-	server, tempPrivKey, err := gcaServerWithTempKey(dir)
+	gcas, gcaPubKey, gcaPrivKey, err = SetupTestServer(dir, opts)
 	if err != nil {
-		return nil, "", glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to create gca server with temp key: %v", err)
+		return nil, "", glow.PublicKey{}, glow.PrivateKey{}, err
 	}
-	gcaPubKey, gcaPrivKey, err = server.submitGCAKey(tempPrivKey)
+	return gcas, dir, gcaPubKey, gcaPrivKey, nil
+}
+
+// SetupTestServer launches a gca server in the provided directory with the
+// provided options, and registers a freshly generated GCA key with it.
+func SetupTestServer(dir string, opts ServerOptions) (gcas *GCAServer, gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey, err error) {
+	gcas, tempPrivKey, err := gcaServerWithTempKeyAndOptions(dir, opts)
 	if err != nil {
-		return nil, "", glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to submit gca priv key: %v", err)
+		return nil, glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to create gca server with temp key: %v", err)
 	}
-	return server, dir, gcaPubKey, gcaPrivKey, nil
+	gcaPubKey, gcaPrivKey, err = gcas.submitGCAKey(tempPrivKey)
+	if err != nil {
+		gcas.Close()
+		return nil, glow.PublicKey{}, glow.PrivateKey{}, fmt.Errorf("unable to submit gca priv key: %v", err)
+	}
+	return gcas, gcaPubKey, gcaPrivKey, nil
+}
+
+// SetupTestServerKnownGCA is the same as SetupTestServer, except that the
+// provided GCA key gets registered.
+func SetupTestServerKnownGCA(dir string, opts ServerOptions, gcaPubKey glow.PublicKey, gcaPrivKey glow.PrivateKey) (gcas *GCAServer, err error) {
+	gcas, tempPrivKey, err := gcaServerWithTempKeyAndOptions(dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create gca server with temp key: %v", err)
+	}
+	if err := gcas.submitKnownGCAKey(tempPrivKey, gcaPubKey, gcaPrivKey); err != nil {
+		gcas.Close()
+		return nil, fmt.Errorf("unable to submit gca priv key: %v", err)
+	}
+	return gcas, nil
 }
 
 // Same as SetupTestEnvironment except that the GCA keys are already known.
@@ -133,40 +371,67 @@ func SetupTestEnvironmentKnownGCA(testName string, gcaPublicKey glow.PublicKey,
 // The function returns the created GCAServer instance and any errors that
 // occur.
 func gcaServerWithTempKey(dir string) (gcas *GCAServer, tempPrivKey glow.PrivateKey, err error) {
+	return gcaServerWithTempKeyAndOptions(dir, DefaultServerOptions())
+}
+
+// gcaServerWithTempKeyAndOptions is the same as gcaServerWithTempKey, except
+// that the server is launched with the provided options.
+func gcaServerWithTempKeyAndOptions(dir string, opts ServerOptions) (gcas *GCAServer, tempPrivKey glow.PrivateKey, err error) {
+	tempPrivKey, err = provisionTestServerDir(dir, opts)
+	if err != nil {
+		return nil, glow.PrivateKey{}, err
+	}
+
+	// Initialize and launch the GCAServer.
+	gcas, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		return nil, glow.PrivateKey{}, fmt.Errorf("failed to create gca server: %v", err)
+	}
+	return gcas, tempPrivKey, nil
+}
+
+// provisionTestServerDir prepares the directory of a server that hasn't been
+// launched yet, the way that an operator would before the first startup. It
+// returns the private key of the temp GCA key that it provisioned.
+func provisionTestServerDir(dir string, opts ServerOptions) (tempPrivKey glow.PrivateKey, err error) {
 	// Create the temp priv key, corresponding directory and file, and
-	// write the public key to disk where the GCAServer will look for it at
-	// startup.
+	// write the public key to the storage where the GCAServer will look for
+	// it at startup.
 	tempPubKey, tempPrivKey := glow.GenerateKeyPair()
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		err := os.MkdirAll(dir, 0755)
 		if err != nil {
-			return nil, glow.PrivateKey{}, fmt.Errorf("unable to create gca dir: %v", err)
+			return glow.PrivateKey{}, fmt.Errorf("unable to create gca dir: %v", err)
+		}
+	}
+	storage := opts.Storage
+	if storage == nil {
+		storage, err = openStorage(dir, opts.StorageBackend)
+		if err != nil {
+			return glow.PrivateKey{}, fmt.Errorf("unable to open the storage: %v", err)
 		}
 	}
-	pubKeyPath := filepath.Join(dir, "gcaTempPubKey.dat")
-	if err := ioutil.WriteFile(pubKeyPath, tempPubKey[:], 0644); err != nil {
-		return nil, glow.PrivateKey{}, fmt.Errorf("failed to write public key to file: %v", err)
+	err = storage.WriteFile(GCATempPubkeyFile, tempPubKey[:], 0644)
+	if c, ok := storage.(io.Closer); ok && opts.Storage == nil {
+		c.Close()
+	}
+	if err != nil {
+		return glow.PrivateKey{}, fmt.Errorf("failed to write public key to file: %v", err)
 	}
 
 	// Create empty username and password files for watttime.
 	if err := os.MkdirAll(filepath.Join(dir, "watttime_data"), 0755); err != nil {
-		return nil, glow.PrivateKey{}, fmt.Errorf("failed to create server basedir: %v", err)
+		return glow.PrivateKey{}, fmt.Errorf("failed to create server basedir: %v", err)
 	}
 	err = ioutil.WriteFile(filepath.Join(dir, "watttime_data", "username"), []byte("hi"), 0644)
 	if err != nil {
-		return nil, glow.PrivateKey{}, fmt.Errorf("failed to write watttime username: %v", err)
+		return glow.PrivateKey{}, fmt.Errorf("failed to write watttime username: %v", err)
 	}
 	err = ioutil.WriteFile(filepath.Join(dir, "watttime_data", "password"), []byte("ih"), 0644)
 	if err != nil {
-		return nil, glow.PrivateKey{}, fmt.Errorf("failed to write watttime password: %v", err)
-	}
-
-	// Initialize and launch the GCAServer.
-	gcas, err = NewGCAServer(dir, false)
-	if err != nil {
-		return nil, glow.PrivateKey{}, fmt.Errorf("failed to create gca server: %v", err)
+		return glow.PrivateKey{}, fmt.Errorf("failed to write watttime password: %v", err)
 	}
-	return gcas, tempPrivKey, nil
+	return tempPrivKey, nil
 }
 
 // submitKnownGCAKey will submit the GCA key to the GCA server using a known
@@ -182,7 +447,7 @@ func (gcas *GCAServer) submitKnownGCAKey(tempPrivKey glow.PrivateKey, publicKey
 	}
 
 	// Create a new HTTP request to submit the GCA key.
-	req, err := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%v/api/v1/register-gca", gcas.httpPort), bytes.NewBuffer(payloadBytes))
+	req, err := http.NewRequest("POST", "http://"+gcas.httpDialAddr()+"/api/v1/register-gca", bytes.NewBuffer(payloadBytes))
 	if err != nil {
 		return fmt.Errorf("error creating new http request: %v", err)
 	}
@@ -229,3 +494,46 @@ func (gcas *GCAServer) submitGCAKey(tempPrivKey glow.PrivateKey) (gcaPubKey glow
 	}
 	return publicKey, privateKey, nil
 }
+
+// GenerateTestCertificate writes a self-signed TLS certificate for 127.0.0.1
+// and localhost to certPath, and its key to keyPath. The certificate is
+// returned so that it can be added to the trusted roots of a client.
+func GenerateTestCertificate(certPath, keyPath string) (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate serial: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "gca-server test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode key: %v", err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certPath, certPem, 0644); err != nil {
+		return nil, fmt.Errorf("unable to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPem, 0600); err != nil {
+		return nil, fmt.Errorf("unable to write key: %v", err)
+	}
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,112 @@
+package server
+
+// tls.go adds native TLS to the HTTP API. If the server directory contains
+// cert.pem and key.pem, or if the paths of a certificate and a key are passed
+// in the server options, the HTTP listener serves TLS. Otherwise the API is
+// served over plain HTTP, the same as before TLS support was added.
+//
+// The certificate can be swapped while the server is running by calling
+// ReloadTLSCertificate, which the gca-server binary does on SIGHUP. The
+// listener stays up during the swap, new handshakes simply pick up the new
+// certificate, which means that certificate renewals don't need a restart.
+//
+// TLS only protects the connection. The identity of a GCA server is still its
+// signing key, clients that want to know that they are talking to a specific
+// server should request signed responses and check the key, see the client
+// package.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// TLSCertFile and TLSKeyFile are the names of the certificate and the
+	// key that get picked up from the server directory.
+	TLSCertFile = "cert.pem"
+	TLSKeyFile  = "key.pem"
+)
+
+// certReloader holds the certificate of the HTTP API, and can swap it for a
+// new one while the listener is running.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+
+	mu sync.Mutex
+}
+
+// newCertReloader loads the certificate and the key at the provided paths.
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload reads the certificate and the key from disk again. If either can't be
+// loaded, the current certificate stays in use.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return fmt.Errorf("unable to load tls certificate: %v", err)
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.cert, nil
+}
+
+// loadTLSCertificate figures out whether the HTTP API should serve TLS, and
+// if so, loads the certificate. Paths provided in the options must exist, the
+// files in the server directory are optional. A nil certReloader means that
+// the API is served over plain HTTP.
+func loadTLSCertificate(baseDir string, opts ServerOptions) (*certReloader, error) {
+	certPath, keyPath := opts.TLSCertFile, opts.TLSKeyFile
+	if (certPath == "") != (keyPath == "") {
+		return nil, fmt.Errorf("a tls certificate and key need to be provided together")
+	}
+	if certPath == "" {
+		certPath = filepath.Join(baseDir, TLSCertFile)
+		keyPath = filepath.Join(baseDir, TLSKeyFile)
+		_, certErr := os.Stat(certPath)
+		_, keyErr := os.Stat(keyPath)
+		if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+			return nil, nil
+		}
+	}
+	return newCertReloader(certPath, keyPath)
+}
+
+// TLSEnabled returns whether the HTTP API is served over TLS.
+func (gcas *GCAServer) TLSEnabled() bool {
+	return gcas.staticTLS != nil
+}
+
+// ReloadTLSCertificate reads the TLS certificate and key from disk again and
+// uses them for all new connections. Connections that are already open are
+// not affected. If the new files can't be loaded, the old certificate stays in
+// use and an error is returned.
+func (gcas *GCAServer) ReloadTLSCertificate() error {
+	if gcas.staticTLS == nil {
+		return fmt.Errorf("the http api is not using tls")
+	}
+	if err := gcas.staticTLS.reload(); err != nil {
+		gcas.logger.Errorf("tls certificate reload failed: %v", err)
+		return err
+	}
+	gcas.logger.Info("reloaded tls certificate")
+	return nil
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// tlsGet fetches the signed device stats over https, trusting only the
+// provided certificate, and returns the certificate that the server presented.
+func tlsGet(t *testing.T, gcas *GCAServer, trusted *x509.Certificate) *x509.Certificate {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(trusted)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		DisableKeepAlives: true,
+	}}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%v/api/v1/all-device-stats?timeslot_offset=0&signed=true", gcas.httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v: %s", resp.StatusCode, data)
+	}
+	if _, err := glow.VerifySignedResponse(data, gcas.staticPublicKey); err != nil {
+		t.Fatal(err)
+	}
+	return resp.TLS.PeerCertificates[0]
+}
+
+// TestTLS checks that a server with a certificate in its directory serves the
+// API over TLS, and that the certificate can be swapped without a restart.
+func TestTLS(t *testing.T) {
+	server, dir, _, _, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.TLSEnabled() {
+		t.Fatal("server without a certificate is using tls")
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart the server with a certificate in its directory.
+	certPath, keyPath := filepath.Join(dir, TLSCertFile), filepath.Join(dir, TLSKeyFile)
+	first, err := GenerateTestCertificate(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if !server.TLSEnabled() {
+		t.Fatal("server with a certificate is not using tls")
+	}
+	if cert := tlsGet(t, server, first); !cert.Equal(first) {
+		t.Error("server presented the wrong certificate")
+	}
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/api/v1/equipment", server.httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("tls server answered a plain http request")
+	}
+
+	// Renew the certificate and reload it, the listener stays the same.
+	port := server.httpPort
+	second, err := GenerateTestCertificate(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ReloadTLSCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if cert := tlsGet(t, server, second); !cert.Equal(second) || server.httpPort != port {
+		t.Error("reloaded certificate is not in use")
+	}
+
+	// A broken certificate doesn't replace the working one.
+	if err := os.WriteFile(certPath, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ReloadTLSCertificate(); err == nil {
+		t.Fatal("broken certificate was loaded")
+	}
+	if cert := tlsGet(t, server, second); !cert.Equal(second) {
+		t.Error("broken reload replaced the certificate")
+	}
+}
+
+// TestLoadTLSCertificate checks which combinations of files and options turn
+// on TLS.
+func TestLoadTLSCertificate(t *testing.T) {
+	dir := glow.GenerateTestDir(t.Name())
+	if cr, err := loadTLSCertificate(dir, ServerOptions{}); cr != nil || err != nil {
+		t.Fatal("tls was enabled without a certificate:", err)
+	}
+	certPath, keyPath := filepath.Join(dir, "other-cert.pem"), filepath.Join(dir, "other-key.pem")
+	if _, err := GenerateTestCertificate(certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTLSCertificate(dir, ServerOptions{TLSCertFile: certPath}); err == nil {
+		t.Error("certificate without a key was accepted")
+	}
+	if cr, err := loadTLSCertificate(dir, ServerOptions{TLSCertFile: certPath, TLSKeyFile: keyPath}); cr == nil || err != nil {
+		t.Error("certificate from the options was not loaded:", err)
+	}
+	if _, err := loadTLSCertificate(dir, ServerOptions{TLSCertFile: certPath + ".missing", TLSKeyFile: keyPath}); err == nil {
+		t.Error("missing certificate from the options was accepted")
+	}
+	// A certificate in the server directory without a key is an error
+	// rather than a silent fallback to plain http.
+	if err := os.Rename(certPath, filepath.Join(dir, TLSCertFile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTLSCertificate(dir, ServerOptions{}); err == nil {
+		t.Error("certificate without a key was accepted")
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+// validation_rules.go lets the operator roll out a validation rule in stages.
+// Every rule that a report has to pass has a name, see reportChecks, and the
+// configurable rules have a mode: enforce, the default, refuses the reports
+// that fail the rule, off skips the rule, and warn runs the rule but accepts
+// the reports that fail it anyway. Every report that would have been refused
+// in warn mode gets logged with the device and the rule, and counted both in
+// the metrics and per device.
+//
+// The per device counts are served by /api/v1/validation-warnings, which is
+// the list of devices that would lose reports if the rule got enforced. The
+// counts only live in memory and start over when the server restarts, the log
+// lines are the durable record.
+//
+// Only the rules in configurableRules have a mode. The checks of the
+// authorization are repeated by applyReport, the totals of a finalized period
+// have already been published, and a power output of 0 or 1 would corrupt the
+// reports of the device, so those checks are always enforced.
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// ValidationMode is how the server applies a validation rule.
+type ValidationMode int
+
+// The modes of a validation rule. The zero value enforces the rule, so a rule
+// that the options don't mention is enforced.
+const (
+	ValidationEnforce ValidationMode = iota // Reports that fail the rule are refused
+	ValidationWarn                          // Reports that fail the rule are counted and accepted
+	ValidationOff                           // The rule isn't checked
+)
+
+// String returns the name of the mode, as used on the command line.
+func (vm ValidationMode) String() string {
+	switch vm {
+	case ValidationWarn:
+		return "warn"
+	case ValidationOff:
+		return "off"
+	}
+	return "enforce"
+}
+
+// ParseValidationMode converts the name of a mode, as used on the command
+// line, into a ValidationMode.
+func ParseValidationMode(name string) (ValidationMode, error) {
+	switch name {
+	case "enforce":
+		return ValidationEnforce, nil
+	case "warn":
+		return ValidationWarn, nil
+	case "off":
+		return ValidationOff, nil
+	}
+	return ValidationEnforce, fmt.Errorf("unknown validation mode %q, must be 'enforce', 'warn' or 'off'", name)
+}
+
+// configurableRules are the names of the validation rules that have a mode,
+// in the order that they get listed in.
+var configurableRules = []string{"timeslot_window", "capacity"}
+
+// ParseValidationModes converts a comma separated list of rule=mode pairs, as
+// used on the command line, into the modes of the rules. The rules are checked
+// by NewGCAServer.
+func ParseValidationModes(s string) (map[string]ValidationMode, error) {
+	modes := make(map[string]ValidationMode)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		rule, name, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid validation mode %q, must be rule=mode", pair)
+		}
+		mode, err := ParseValidationMode(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		modes[strings.TrimSpace(rule)] = mode
+	}
+	return modes, nil
+}
+
+// FormatValidationModes is the inverse of ParseValidationModes, with the rules
+// in the order of configurableRules.
+func FormatValidationModes(modes map[string]ValidationMode) string {
+	var pairs []string
+	for _, rule := range configurableRules {
+		if mode, exists := modes[rule]; exists {
+			pairs = append(pairs, rule+"="+mode.String())
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// validateValidationModes checks that every rule in the modes exists and can
+// be configured.
+func validateValidationModes(modes map[string]ValidationMode) error {
+	for rule, mode := range modes {
+		if mode != ValidationEnforce && mode != ValidationWarn && mode != ValidationOff {
+			return fmt.Errorf("unknown validation mode %d for rule %q", mode, rule)
+		}
+		configurable := false
+		for _, name := range configurableRules {
+			configurable = configurable || name == rule
+		}
+		if !configurable {
+			return fmt.Errorf("the validation rule %q can't be configured, must be one of %v", rule, strings.Join(configurableRules, ", "))
+		}
+	}
+	return nil
+}
+
+// validationMode returns the mode of a rule. Rules that aren't configurable
+// are always enforced.
+func (gcas *GCAServer) validationMode(rule string) ValidationMode {
+	return gcas.staticValidationModes[rule]
+}
+
+// ValidationWarning is how often the reports of a device failed a rule that
+// is in warn mode.
+type ValidationWarning struct {
+	ShortID       uint32         `json:"short_id"`
+	PublicKey     glow.PublicKey `json:"public_key"`
+	Count         uint64         `json:"count"`
+	FirstTimeslot uint32         `json:"first_timeslot"` // The timeslot of the first report that failed the rule
+	LastTimeslot  uint32         `json:"last_timeslot"`  // The timeslot of the latest report that failed the rule
+	LastDetail    string         `json:"last_detail"`    // Why the latest report failed the rule
+}
+
+// recordValidationWarning records a report that failed a rule in warn mode,
+// and would have been refused if the rule was enforced. The mutex must be
+// held.
+func (gcas *GCAServer) recordValidationWarning(rule string, report glow.EquipmentReport, err error) {
+	pubkey := gcas.equipment[report.ShortID].PublicKey
+	gcas.logger.WithFields("short_id", report.ShortID, "pubkey", pubkey, "timeslot", report.Timeslot, "rule", rule).Warnf("Accepted report that fails a rule in warn mode: %v", err)
+	gcas.staticMetrics.RecordValidationWarning(rule)
+	devices := gcas.validationWarnings[rule]
+	if devices == nil {
+		devices = make(map[uint32]*ValidationWarning)
+		gcas.validationWarnings[rule] = devices
+	}
+	vw := devices[report.ShortID]
+	if vw == nil {
+		vw = &ValidationWarning{ShortID: report.ShortID, PublicKey: pubkey, FirstTimeslot: report.Timeslot}
+		devices[report.ShortID] = vw
+	}
+	vw.Count++
+	vw.LastTimeslot = report.Timeslot
+	vw.LastDetail = err.Error()
+}
+
+// ValidationRuleWarnings are the warnings of a single configurable rule.
+type ValidationRuleWarnings struct {
+	Rule     string              `json:"rule"`
+	Mode     string              `json:"mode"`
+	Warnings uint64              `json:"warnings"` // The sum of the counts of the devices
+	Devices  []ValidationWarning `json:"devices"`  // Sorted by ShortID
+}
+
+// ValidationWarningsResponse is the response of the validation warnings
+// endpoint.
+type ValidationWarningsResponse struct {
+	Rules []ValidationRuleWarnings `json:"rules"`
+}
+
+// ValidationWarningsHandler returns the mode of every configurable rule and
+// the devices whose reports failed the rule while it was in warn mode,
+// optionally filtered to a single rule with the 'rule' query parameter.
+func (gcas *GCAServer) ValidationWarningsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept GET requests
+	if r.Method != http.MethodGet {
+		gcas.writeError(w, ErrCodeMethodNotAllowed, "Only GET method is supported.")
+		gcas.requestLogger(r).Warn("Received non-GET request for validation warnings.")
+		return
+	}
+	filter := r.URL.Query().Get("rule")
+	if filter != "" {
+		if err := validateValidationModes(map[string]ValidationMode{filter: ValidationEnforce}); err != nil {
+			gcas.writeError(w, ErrCodeMalformedRequest, err.Error())
+			return
+		}
+	}
+
+	resp := ValidationWarningsResponse{Rules: []ValidationRuleWarnings{}}
+	gcas.mu.RLock()
+	for _, rule := range configurableRules {
+		if filter != "" && rule != filter {
+			continue
+		}
+		rw := ValidationRuleWarnings{Rule: rule, Mode: gcas.validationMode(rule).String(), Devices: []ValidationWarning{}}
+		for _, vw := range gcas.validationWarnings[rule] {
+			rw.Warnings += vw.Count
+			rw.Devices = append(rw.Devices, *vw)
+		}
+		sort.Slice(rw.Devices, func(i, j int) bool { return rw.Devices[i].ShortID < rw.Devices[j].ShortID })
+		resp.Rules = append(resp.Rules, rw)
+	}
+	gcas.mu.RUnlock()
+	gcas.writeJSONResponse(w, r, resp)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// TestValidationModes checks that the reports which fail a rule in warn mode
+// get accepted and counted by device, that a rule that is off isn't checked,
+// and that enforcing the rule after a restart only affects new reports.
+func TestValidationModes(t *testing.T) {
+	// Only the configurable rules can have a mode.
+	if _, err := ParseValidationModes("capacity=maybe"); err == nil {
+		t.Fatal("an unknown mode was accepted")
+	}
+	if _, err := ParseValidationModes("capacity"); err == nil {
+		t.Fatal("a rule without a mode was accepted")
+	}
+	modes, err := ParseValidationModes(" capacity=warn, timeslot_window=off ,")
+	if err != nil || len(modes) != 2 || modes["capacity"] != ValidationWarn || modes["timeslot_window"] != ValidationOff {
+		t.Fatal("unexpected modes:", modes, err)
+	}
+	if s := FormatValidationModes(modes); s != "timeslot_window=off,capacity=warn" {
+		t.Fatal("unexpected formatting of the modes:", s)
+	}
+	opts := DefaultServerOptions()
+	opts.ValidationModes = map[string]ValidationMode{"power_output": ValidationWarn}
+	if _, _, _, _, err := SetupTestEnvironmentWithOptions(t.Name(), opts); err == nil {
+		t.Fatal("a server relaxed a rule that isn't configurable")
+	}
+
+	glow.SetCurrentTimeslot(1000)
+	defer glow.SetCurrentTimeslot(0)
+	opts.ValidationModes = map[string]ValidationMode{"capacity": ValidationWarn, "timeslot_window": ValidationOff}
+	server, dir, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv := glow.GenerateKeyPair()
+	ea := glow.EquipmentAuthorization{ShortID: 1, PublicKey: pub, Capacity: 1000}
+	if err := server.AuthorizeEquipment(ea, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	sendReport := func(timeslot uint32, power uint64) reportOutcome {
+		er := glow.EquipmentReport{ShortID: 1, Timeslot: timeslot, PowerOutput: power}
+		er.Signature = glow.Sign(er.SigningBytes(), priv)
+		outcome, _ := server.managedHandleEquipmentReport(er.Serialize())
+		return outcome
+	}
+
+	// Reports above the capacity get accepted and counted, a stale report
+	// gets accepted without a warning.
+	if outcome := sendReport(990, 5000); outcome != reportAccepted {
+		t.Fatal("a report above the capacity was not accepted in warn mode:", outcome)
+	}
+	if outcome := sendReport(991, 6000); outcome != reportAccepted {
+		t.Fatal("a report above the capacity was not accepted in warn mode:", outcome)
+	}
+	if outcome := sendReport(991, 6000); outcome != reportDuplicate {
+		t.Fatal("a resent report was not a duplicate:", outcome)
+	}
+	if outcome := sendReport(100, 500); outcome != reportAccepted {
+		t.Fatal("a stale report was not accepted with the rule off:", outcome)
+	}
+	if flagged, err := server.getFlaggedReports(""); err != nil || len(flagged) != 0 {
+		t.Fatal("reports were flagged in warn mode:", flagged, err)
+	}
+	if server.staticMetrics.ValidationWarnings("capacity") != 2 || server.staticMetrics.ValidationWarnings("timeslot_window") != 0 {
+		t.Fatal("unexpected metrics:", server.staticMetrics.ValidationWarnings("capacity"), server.staticMetrics.ValidationWarnings("timeslot_window"))
+	}
+
+	// The warnings list the device for the rule.
+	var vwr ValidationWarningsResponse
+	if status, code, err := server.getPage("v1/validation-warnings", &vwr); err != nil || status != http.StatusOK {
+		t.Fatal("unable to get the validation warnings:", status, code, err)
+	}
+	if len(vwr.Rules) != 2 || vwr.Rules[0].Rule != "timeslot_window" || vwr.Rules[0].Mode != "off" || len(vwr.Rules[0].Devices) != 0 {
+		t.Fatalf("unexpected warnings: %+v", vwr)
+	}
+	capacity := vwr.Rules[1]
+	if capacity.Rule != "capacity" || capacity.Mode != "warn" || capacity.Warnings != 2 || len(capacity.Devices) != 1 {
+		t.Fatalf("unexpected warnings of the capacity: %+v", capacity)
+	}
+	if vw := capacity.Devices[0]; vw.ShortID != 1 || vw.PublicKey != pub || vw.Count != 2 || vw.FirstTimeslot != 990 || vw.LastTimeslot != 991 || vw.LastDetail == "" {
+		t.Fatalf("unexpected warning of the device: %+v", vw)
+	}
+	if status, code, _ := server.getPage("v1/validation-warnings?rule=power_output", &vwr); status != http.StatusBadRequest || code != ErrCodeMalformedRequest {
+		t.Fatal("an unknown rule was accepted:", status, code)
+	}
+
+	// The validation shows the failure without refusing the report.
+	er := glow.EquipmentReport{ShortID: 1, Timeslot: 992, PowerOutput: 7000}
+	er.Signature = glow.Sign(er.SigningBytes(), priv)
+	rv := server.managedValidateReport(er.Serialize())
+	if rv.Outcome != reportAccepted.String() {
+		t.Fatalf("unexpected validation: %+v", rv)
+	}
+	for _, res := range rv.Checks {
+		if res.Name == "capacity" && (res.Passed || res.Mode != "warn" || res.Outcome != "") {
+			t.Fatalf("unexpected result of the capacity: %+v", res)
+		}
+		if res.Name == "timeslot_window" && (!res.Passed || res.Mode != "off") {
+			t.Fatalf("unexpected result of the timeslot window: %+v", res)
+		}
+	}
+
+	// Enforcing the rules only takes a restart with the new modes. The
+	// reports that were accepted in warn mode stay accepted.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts.ValidationModes = map[string]ValidationMode{"capacity": ValidationEnforce}
+	server, err = NewGCAServerWithOptions(dir, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.mu.RLock()
+	powers := server.equipmentReports[1].PowerOutputs
+	server.mu.RUnlock()
+	if powers[990] != 5000 || powers[991] != 6000 || powers[100] != 500 {
+		t.Fatal("the reports that were accepted in warn mode were lost:", powers[990], powers[991], powers[100])
+	}
+	if outcome := sendReport(993, 7000); outcome != reportFlagged {
+		t.Fatal("a report above the capacity was not flagged:", outcome)
+	}
+	if outcome := sendReport(101, 500); outcome != reportStale {
+		t.Fatal("a stale report was accepted:", outcome)
+	}
+	if status, code, err := server.getPage("v1/validation-warnings?rule=capacity", &vwr); err != nil || status != http.StatusOK || len(vwr.Rules) != 1 || vwr.Rules[0].Mode != "enforce" || vwr.Rules[0].Warnings != 0 {
+		t.Fatalf("unexpected warnings after the restart: %v %v %v %+v", status, code, err, vwr)
+	}
+}
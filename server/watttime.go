@@ -10,6 +10,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -50,6 +51,19 @@ type DataPointsJSON struct {
 	} `json:"meta"`
 }
 
+// fakeWattTime returns whether the WattTime API should be faked, which is the
+// case during testing unless a test points the server at the mock WattTime API
+// in watttime/mock.
+func fakeWattTime(baseURL string) bool {
+	return testMode && baseURL == wattTimeAPIURL
+}
+
+// fakeWattTimeIndex returns the MOER value that the fake WattTime API reports
+// for the current timeslot.
+func fakeWattTimeIndex() float64 {
+	return 200 + float64(glow.CurrentTimeslot()%250)
+}
+
 // loadWattTimeCredentials is a helper function to load one of
 // the watttime credential files from disk.
 func loadWattTimeCredentials(filename string) (string, error) {
@@ -62,10 +76,10 @@ func loadWattTimeCredentials(filename string) (string, error) {
 
 // getBalancingAuthority makes an API call to watttime to get the ba that's associated
 // with a specific location
-func getBalancingAuthority(token string, latitude, longitude float64) (string, error) {
+func getBalancingAuthority(ctx context.Context, baseURL, token string, latitude, longitude float64) (string, error) {
 	client := &http.Client{}
-	regionURL := "https://api.watttime.org/v3/region-from-loc"
-	req, err := http.NewRequest("GET", regionURL, nil)
+	regionURL := baseURL + "/v3/region-from-loc"
+	req, err := http.NewRequestWithContext(ctx, "GET", regionURL, nil)
 	if err != nil {
 		return "", err
 	}
@@ -101,25 +115,41 @@ func getBalancingAuthority(token string, latitude, longitude float64) (string, e
 
 // getWattTimeIndex returns the MOER value for the provided lat+long at the
 // curernt time.
-func getWattTimeIndex(token string, latitude float64, longitude float64) (float64, int64, string, error) {
+func getWattTimeIndex(ctx context.Context, baseURL, token string, latitude float64, longitude float64) (float64, int64, string, error) {
 	// Since this code depends on external APIs, we return an arbitrary
-	// value during testing.
-	if testMode {
-		return latitude + longitude + 200 + float64(time.Now().UnixNano()%250), glow.TimeslotToUnix(glow.CurrentTimeslot()), "", nil
+	// value during testing. The value only depends on the timeslot and the
+	// location, so fetching it again in the same timeslot changes nothing.
+	if fakeWattTime(baseURL) {
+		return latitude + longitude + fakeWattTimeIndex(), glow.TimeslotToUnix(glow.CurrentTimeslot()), "", nil
 	}
 
 	// Get the region associated with these coordinates
-	region, err := getBalancingAuthority(token, latitude, longitude)
+	region, err := getBalancingAuthority(ctx, baseURL, token, latitude, longitude)
 	if err != nil {
 		return 0, 0, "", fmt.Errorf("unable to get watttime region: %v", err)
 	}
+	moer, date, err := getWattTimeRegionIndex(ctx, baseURL, token, region)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return moer, date, region, nil
+}
+
+// getWattTimeRegionIndex returns the MOER value for the provided region at the
+// current time.
+func getWattTimeRegionIndex(ctx context.Context, baseURL, token string, region string) (float64, int64, error) {
+	// Since this code depends on external APIs, we return an arbitrary
+	// value during testing.
+	if fakeWattTime(baseURL) {
+		return fakeWattTimeIndex(), glow.TimeslotToUnix(glow.CurrentTimeslot()), nil
+	}
 
 	// Create the base url
 	client := &http.Client{}
-	url := "https://api.watttime.org/v3/signal-index"
-	req, err := http.NewRequest("GET", url, nil)
+	url := baseURL + "/v3/signal-index"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return 0, 0, "", fmt.Errorf("unable to get watttime index: %v", err)
+		return 0, 0, fmt.Errorf("unable to get watttime index: %v", err)
 	}
 
 	// Set the parameters
@@ -132,29 +162,29 @@ func getWattTimeIndex(token string, latitude float64, longitude float64) (float6
 	// Make the API request
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, 0, "", fmt.Errorf("unable to make watttime api request")
+		return 0, 0, fmt.Errorf("unable to make watttime api request")
 	}
 	defer resp.Body.Close()
 	// Check for non-200 status code
 	if resp.StatusCode != http.StatusOK {
-		return 0, 0, "", fmt.Errorf("watttime API request failed with status code: %d", resp.StatusCode)
+		return 0, 0, fmt.Errorf("watttime API request failed with status code: %d", resp.StatusCode)
 	}
 
 	// Parse the JSON response.
 	var jr DataPointsJSON
 	err = json.NewDecoder(resp.Body).Decode(&jr)
 	if err != nil {
-		return 0, 0, "", fmt.Errorf("unable to decode watttime historical data: %v", err)
+		return 0, 0, fmt.Errorf("unable to decode watttime historical data: %v", err)
 	}
 
 	// WattTime API should have a single point in the response
 	if len(jr.Data) != 1 {
-		return 0, 0, "", fmt.Errorf("invalid api return: %v data items", len(jr.Data))
+		return 0, 0, fmt.Errorf("invalid api return: %v data items", len(jr.Data))
 	}
 	// Parse the string time.
 	t, err := time.Parse("2006-01-02T15:04:05Z07:00", jr.Data[0].PointTime)
 	if err != nil {
-		return 0, 0, "", fmt.Errorf("unable to parse watttime response time: %v", err)
+		return 0, 0, fmt.Errorf("unable to parse watttime response time: %v", err)
 	}
 	moer := jr.Data[0].Value
 
@@ -162,12 +192,12 @@ func getWattTimeIndex(token string, latitude float64, longitude float64) (float6
 	// pounds per megawatt hour. We multiply by 453.59237 to get from
 	// pounds per megawatt hour to grams per megawatt hour.
 	moer *= 453.59237
-	return moer, t.Unix(), region, nil
+	return moer, t.Unix(), nil
 }
 
 // getWattTimeHistoricalDataRaw returns uninterpreted WattTime historical data for a given
 // region and time range.
-func getWattTimeHistoricalDataRaw(token, region string, startTime, endTime int64) ([]byte, error) {
+func getWattTimeHistoricalDataRaw(ctx context.Context, baseURL, token, region string, startTime, endTime int64) ([]byte, error) {
 	// Convert the times to ISO 8601 UTC format
 	startTimeT := time.Unix(startTime, 0).UTC()
 	startTimeISO := startTimeT.Format("2006-01-02T15:04:05Z")
@@ -176,8 +206,8 @@ func getWattTimeHistoricalDataRaw(token, region string, startTime, endTime int64
 
 	// Create the base url
 	client := &http.Client{}
-	url := "https://api.watttime.org/v3/historical"
-	req, err := http.NewRequest("GET", url, nil)
+	url := baseURL + "/v3/historical"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get watttime index: %v", err)
 	}
@@ -208,30 +238,47 @@ func getWattTimeHistoricalDataRaw(token, region string, startTime, endTime int64
 	return rb, nil
 }
 
-// getWattTimeWeeklyData returns the MOER values for the provided lat+long from the
-// provided time to 1 week later.
-func getWattTimeWeeklyData(token string, latitude float64, longitude float64, startTime int64) ([]float64, []int64, error) {
+// getWattTimeHistoricalData returns the MOER values for the provided lat+long
+// and time range.
+func getWattTimeHistoricalData(ctx context.Context, baseURL, token string, latitude float64, longitude float64, startTime, endTime int64) ([]float64, []int64, error) {
+	// During testing we return blank values, that way it doesn't interfere
+	// with testing that's probing individual fields.
+	if fakeWattTime(baseURL) {
+		return nil, nil, nil
+	}
+
+	// Get the region and historical data
+	region, err := getBalancingAuthority(ctx, baseURL, token, latitude, longitude)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get watttime region: %v", err)
+	}
+	return getWattTimeRegionHistoricalData(ctx, baseURL, token, region, startTime, endTime)
+}
+
+// wattTimeWeekEnd returns the end of the range of weekly data that starts at
+// the provided time, given the current unix time.
+func wattTimeWeekEnd(startTime, now int64) int64 {
 	// Determine what data range can be requested. If the end time is
 	// within 5 days of the current time, WattTime will be asked for the
 	// full set of data that it has. In the WattTime API v3 the end time is
 	// required and will be set to current time in this case.
 	endTime := startTime + 604800 // Ideal end time, number of seconds in a week.
-	if endTime+432000 > time.Now().Unix() {
-		endTime = time.Now().Unix()
+	if endTime+432000 > now {
+		endTime = now
 	}
+	return endTime
+}
 
+// getWattTimeRegionHistoricalData returns the MOER values for the provided
+// region and time range.
+func getWattTimeRegionHistoricalData(ctx context.Context, baseURL, token, region string, startTime, endTime int64) ([]float64, []int64, error) {
 	// During testing we return blank values, that way it doesn't interfere
 	// with testing that's probing individual fields.
-	if testMode {
+	if fakeWattTime(baseURL) {
 		return nil, nil, nil
 	}
 
-	// Get the region and historical data
-	region, err := getBalancingAuthority(token, latitude, longitude)
-	if err != nil {
-		return nil, nil, fmt.Errorf("unable to get watttime region: %v", err)
-	}
-	raw, err := getWattTimeHistoricalDataRaw(token, region, startTime, endTime)
+	raw, err := getWattTimeHistoricalDataRaw(ctx, baseURL, token, region, startTime, endTime)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to get watttime historical data: %v", err)
 	}
@@ -268,14 +315,14 @@ func getWattTimeWeeklyData(token string, latitude float64, longitude float64, st
 // for the latest impact data for each device being tracked by the server. The
 // WattTime period is 5 minutes, so we'll be grabbing the same datapoint pretty
 // regularly.
-func (gcas *GCAServer) threadedCollectImpactData(username, password string) {
+func (gcas *GCAServer) threadedCollectImpactData() {
 	// Infinite loop to keep fetching data from WattTime.
 	for {
-		if !gcas.tg.Sleep(wattTimeFrequency) {
+		if !gcas.sleep(wattTimeFrequency) {
 			return
 		}
 
-		err := gcas.managedGetWattTimeIndexData(username, password)
+		err := gcas.managedGetWattTimeIndexData(gcas.managedWattTimeCredentials())
 		if err != nil {
 			gcas.logger.Errorf("unable to complete watttime data update: %v", err)
 			continue
@@ -286,63 +333,52 @@ func (gcas *GCAServer) threadedCollectImpactData(username, password string) {
 // managedGettWattTimeIndexData performs a single round of grabbing the current
 // index data from WattTime for every device.
 func (gcas *GCAServer) managedGetWattTimeIndexData(username, password string) error {
+	// Grab a list of series to loop over. We grab the list with a mutex
+	// so that we don't have to hold a lock while doing network operations
+	// for each series.
+	gcas.mu.RLock()
+	series := gcas.impactSeries()
+	gcas.mu.RUnlock()
+
 	// Get a new auth token. They expire relatively quickly so it's better
-	// to get a new token every time this function is called.
-	token, err := staticGetWattTimeToken(username, password)
+	// to get a new token every time this function is called. If WattTime
+	// can't be reached at all, every series falls back to stale data.
+	var token string
+	err := gcas.retryWattTime(func() (err error) {
+		token, err = staticGetWattTimeToken(gcas.staticShutdownCtx, gcas.staticWattTimeURL, username, password)
+		return err
+	})
 	if err != nil {
+		for _, s := range series {
+			gcas.managedFillStaleImpactRate(s)
+		}
 		return fmt.Errorf("unable to get watttime token: %v", err)
 	}
 
-	// Grab a list of devices to loop over. We grab the list with a mutex
-	// so that we don't have to hold a lock while doing network operations
-	// for each device.
-	gcas.mu.Lock()
-	var devices []uint32
-	var lats []float64
-	var longs []float64
-	for shortID, e := range gcas.equipment {
-		devices = append(devices, shortID)
-		lats = append(lats, e.Latitude)
-		longs = append(longs, e.Longitude)
-	}
-	gcas.mu.Unlock()
-
-	// Loop over the devices.
-	for i, shortID := range devices {
+	// Loop over the series.
+	for _, s := range series {
 		if !testMode {
 			// We don't want to hit the WattTime ratelimits, so we
 			// sleep a bit before making a request to ensure that
 			// we don't go too far.
-			time.Sleep(250 * time.Millisecond)
-		}
-		// Fetch the current results for this device.
-		moer, date, _, err := getWattTimeIndex(token, lats[i], longs[i])
-		if err != nil {
-			gcas.logger.Errorf("unable to get watttime data: %v", err)
-			gcas.logger.Errorf("watttime lat: %v, long: %v", lats[i], longs[i])
-			continue
+			if !gcas.sleep(250 * time.Millisecond) {
+				return nil
+			}
 		}
-		timeslot, err := glow.UnixToTimeslot(date)
+		// Fetch the current results for this series.
+		var moer float64
+		var date int64
+		err := gcas.retryWattTime(func() (err error) {
+			moer, date, err = s.fetchIndex(gcas.staticShutdownCtx, gcas.staticWattTimeURL, token)
+			return err
+		})
 		if err != nil {
-			gcas.logger.Errorf("watttime returned data at an invalid timeslot: %v", err)
-			gcas.logger.Errorf("watttime time: %v, genesis time: %v", date, glow.GenesisTime)
+			gcas.logger.Errorf("unable to get watttime data for %v: %v", s.key, err)
+			gcas.managedFillStaleImpactRate(s)
 			continue
 		}
-
-		// Update the struct which tracks the moer times. If the clock
-		// goes backwards in time for some reason, this can panic, so
-		// we have to double check the bounds.
-		//
-		// We also have to check that we aren't fetching data for a
-		// timeslot that is well beyond the current
-		// equipmentReportsOffset, which can happen if the server
-		// hasn't been online in a few weeks.
-		gcas.mu.Lock()
-		impactIndex := timeslot - gcas.equipmentReportsOffset
-		if timeslot >= gcas.equipmentReportsOffset && impactIndex < 4032 {
-			gcas.equipmentImpactRate[shortID][impactIndex] = moer
-		}
-		gcas.mu.Unlock()
+		gcas.managedSetImpactRate(s, date, moer)
+		gcas.managedBackfillImpactRates(s, token)
 	}
 	return nil
 }
@@ -351,90 +387,67 @@ func (gcas *GCAServer) managedGetWattTimeIndexData(username, password string) er
 // fill out the impact rates as much as possible.
 func (gcas *GCAServer) managedGetWattTimeWeekData(username, password string) error {
 	// Disable this during testing, as the testing does not have WattTime access.
-	if testMode {
+	if fakeWattTime(gcas.staticWattTimeURL) {
 		return nil
 	}
 
 	// Get a new auth token. They expire relatively quickly so it's better
 	// to get a new token every time this function is called.
-	token, err := staticGetWattTimeToken(username, password)
+	var token string
+	err := gcas.retryWattTime(func() (err error) {
+		token, err = staticGetWattTimeToken(gcas.staticShutdownCtx, gcas.staticWattTimeURL, username, password)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("unable to get watttime token: %v", err)
 	}
 
-	// Grab a list of devices to loop over. We grab the list with a mutex
+	// Grab a list of series to loop over. We grab the list with a mutex
 	// so that we don't have to hold a lock while doing network operations
-	// for each device.
-	gcas.mu.Lock()
-	var devices []uint32
-	var lats []float64
-	var longs []float64
-	for shortID, e := range gcas.equipment {
-		devices = append(devices, shortID)
-		lats = append(lats, e.Latitude)
-		longs = append(longs, e.Longitude)
-	}
+	// for each series.
+	gcas.mu.RLock()
+	series := gcas.impactSeries()
 	startTime := glow.TimeslotToUnix(gcas.equipmentReportsOffset)
-	gcas.mu.Unlock()
+	gcas.mu.RUnlock()
+	endTime := wattTimeWeekEnd(startTime, gcas.now().Unix())
 
-	// Loop over the devices.
-	for i, shortID := range devices {
+	// Loop over the series.
+	for _, s := range series {
 		if !testMode {
 			// We don't want to hit the WattTime ratelimits, so we
 			// sleep a bit before making a request to ensure that
 			// we don't go too far.
-			time.Sleep(250 * time.Millisecond)
+			if !gcas.sleep(250 * time.Millisecond) {
+				return nil
+			}
 		}
-		// Fetch the current results for this device.
-		moers, dates, err := getWattTimeWeeklyData(token, lats[i], longs[i], startTime)
+		// Fetch the results for this series.
+		var moers []float64
+		var dates []int64
+		err := gcas.retryWattTime(func() (err error) {
+			moers, dates, err = s.fetchHistory(gcas.staticShutdownCtx, gcas.staticWattTimeURL, token, startTime, endTime)
+			return err
+		})
 		if err != nil {
-			gcas.logger.Errorf("unable to get watttime data: %v", err)
-			gcas.logger.Errorf("watttime lat: %v, long: %v, startTime: %v", lats[i], longs[i], startTime)
+			gcas.logger.Errorf("unable to get watttime data for %v: %v", s.key, err)
+			gcas.logger.Errorf("watttime startTime: %v", startTime)
 			continue
 		}
-
-		// Integrate all the data in one loop with the lock held.
-		gcas.mu.Lock()
-		for i, date := range dates {
-			// There's an edge case where the 'ero' is more than 2
-			// weeks in the past, which means there will be a lot
-			// more data than what we can process, so the loop has
-			// to be aborted early.
-			if i >= 4032 {
-				break
-			}
-
-			timeslot, err := glow.UnixToTimeslot(date)
-			if err != nil {
-				gcas.logger.Errorf("watttime returned data at an invalid timeslot: %v", err)
-				gcas.logger.Errorf("watttime time: %v, genesis time: %v", date, glow.GenesisTime)
-				continue
-			}
-
-			// Update the struct which tracks the moer times. If the clock
-			// goes backwards in time for some reason, this can panic, so
-			// we have to double check.
-			impactIndex := timeslot - gcas.equipmentReportsOffset
-			if timeslot >= gcas.equipmentReportsOffset {
-				gcas.equipmentImpactRate[shortID][impactIndex] = moers[i]
-			}
-		}
-		gcas.mu.Unlock()
-
+		gcas.managedIntegrateImpactRates(s, moers, dates)
 	}
 	return nil
 }
 
 // staticGetWattTimeToken makes an API call to WattTime to authenticate and
 // retrieve an access token.
-func staticGetWattTimeToken(username, password string) (string, error) {
+func staticGetWattTimeToken(ctx context.Context, baseURL, username, password string) (string, error) {
 	// Don't hit the watttime api during testing.
-	if testMode {
+	if fakeWattTime(baseURL) {
 		return "fake-token", nil
 	}
 
 	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://api.watttime.org/login", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/login", nil)
 	if err != nil {
 		return "", err
 	}
@@ -465,15 +478,15 @@ func staticGetWattTimeToken(username, password string) (string, error) {
 
 // threadedGetWattTimeWeekData wakes up periodically and refreshes the weekly
 // WattTime data.
-func (gcas *GCAServer) threadedGetWattTimeWeekData(username, password string) {
+func (gcas *GCAServer) threadedGetWattTimeWeekData() {
 	for {
-		if !gcas.tg.Sleep(WattTimeWeekDataUpdateFrequency) {
+		if !gcas.sleep(WattTimeWeekDataUpdateFrequency) {
 			return
 		}
 
 		// This API is called during startup, so it is safe to sleep before calling it here. The
 		// intention is to call it periodically, most likely once per day.
-		err := gcas.managedGetWattTimeWeekData(username, password)
+		err := gcas.managedGetWattTimeWeekData(gcas.managedWattTimeCredentials())
 		if err != nil {
 			gcas.logger.Errorf("threaded call unable to get watttime data for the most recent week: %v", err)
 		}
@@ -0,0 +1,323 @@
+package server
+
+// watttime_series.go keeps the impact rates of the devices filled in when
+// WattTime is having trouble.
+//
+// The devices are grouped into series, where every device in a series gets
+// the same impact rates. Devices with a region share one series per region,
+// and devices without one each have a series for their coordinates. Every
+// request to WattTime is retried with exponential backoff. If a series still
+// can't be fetched, the current timeslot of its devices is filled with the
+// last impact rate that was fetched for the series, and the timeslot is
+// flagged as stale. Once WattTime recovers, the missed window is queried
+// again and the stale impact rates are replaced with the real ones.
+//
+// Every change to an impact rate and its flags is persisted, see
+// impact_rates.go. The stale impact rates of the timeslots in memory are
+// exposed by the all-device-stats endpoints, and the flags of every timeslot
+// are exposed by the impact rates endpoint. The health endpoint reports when
+// the last fetch succeeded and how many stale impact rates have been
+// backfilled.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// wattTimeSeries is a group of devices that share their impact rates.
+type wattTimeSeries struct {
+	key       string // The region, or the coordinates of the device
+	region    string // Empty if the region is looked up from the coordinates
+	latitude  float64
+	longitude float64
+	shortIDs  []uint32
+}
+
+// wattTimeCache holds the state of a series between fetches.
+type wattTimeCache struct {
+	moer      float64 // The last impact rate that was fetched
+	staleFrom uint32  // The first timeslot that was filled with stale data
+	stale     bool    // Whether there are stale impact rates to backfill
+}
+
+// impactSeries groups the devices into series, in a stable order. The mutex
+// must be held.
+func (gcas *GCAServer) impactSeries() []wattTimeSeries {
+	regions := make(map[string]*wattTimeSeries)
+	var series []wattTimeSeries
+	for shortID, e := range gcas.equipment {
+		region := gcas.equipmentRegion(e.PublicKey)
+		if region == "" {
+			series = append(series, wattTimeSeries{
+				key:       fmt.Sprintf("%v,%v", e.Latitude, e.Longitude),
+				latitude:  e.Latitude,
+				longitude: e.Longitude,
+				shortIDs:  []uint32{shortID},
+			})
+			continue
+		}
+		if _, exists := regions[region]; !exists {
+			regions[region] = &wattTimeSeries{key: region, region: region}
+		}
+		regions[region].shortIDs = append(regions[region].shortIDs, shortID)
+	}
+	for _, s := range regions {
+		series = append(series, *s)
+	}
+	for _, s := range series {
+		sort.Slice(s.shortIDs, func(i, j int) bool { return s.shortIDs[i] < s.shortIDs[j] })
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if (series[i].region == "") != (series[j].region == "") {
+			return series[i].region != ""
+		}
+		if series[i].region != series[j].region {
+			return series[i].region < series[j].region
+		}
+		return series[i].shortIDs[0] < series[j].shortIDs[0]
+	})
+	return series
+}
+
+// fetchIndex returns the current impact rate of the series.
+func (s wattTimeSeries) fetchIndex(ctx context.Context, baseURL, token string) (float64, int64, error) {
+	if s.region != "" {
+		return getWattTimeRegionIndex(ctx, baseURL, token, s.region)
+	}
+	moer, date, _, err := getWattTimeIndex(ctx, baseURL, token, s.latitude, s.longitude)
+	return moer, date, err
+}
+
+// fetchHistory returns the impact rates of the series in a time range.
+func (s wattTimeSeries) fetchHistory(ctx context.Context, baseURL, token string, startTime, endTime int64) ([]float64, []int64, error) {
+	if s.region != "" {
+		return getWattTimeRegionHistoricalData(ctx, baseURL, token, s.region, startTime, endTime)
+	}
+	return getWattTimeHistoricalData(ctx, baseURL, token, s.latitude, s.longitude, startTime, endTime)
+}
+
+// retryWattTime calls fn until it succeeds or runs out of attempts, doubling
+// the wait between attempts.
+func (gcas *GCAServer) retryWattTime(fn func() error) error {
+	err := fn()
+	backoff := wattTimeRetryBackoff
+	for attempt := 1; err != nil && attempt < wattTimeRetries; attempt++ {
+		if !gcas.sleep(backoff) {
+			return err
+		}
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+// wattTimeCacheFor returns the cache of a series, creating it if needed. The
+// mutex must be held.
+func (gcas *GCAServer) wattTimeCacheFor(key string) *wattTimeCache {
+	cache, exists := gcas.wattTimeCaches[key]
+	if !exists {
+		cache = new(wattTimeCache)
+		gcas.wattTimeCaches[key] = cache
+	}
+	return cache
+}
+
+// setImpactRate sets the impact rate of the provided devices at a timeslot,
+// marking any stale impact rates as backfilled. It returns how many stale
+// impact rates were replaced, along with the log records of the impact rates
+// that changed. The mutex must be held.
+func (gcas *GCAServer) setImpactRate(shortIDs []uint32, timeslot uint32, moer float64) (replaced uint64, records []byte) {
+	// Update the struct which tracks the moer times. If the clock goes
+	// backwards in time for some reason, this can panic, so we have to
+	// double check the bounds.
+	//
+	// We also have to check that we aren't fetching data for a timeslot
+	// that is well beyond the current equipmentReportsOffset, which can
+	// happen if the server hasn't been online in a few weeks.
+	impactIndex := timeslot - gcas.equipmentReportsOffset
+	if timeslot < gcas.equipmentReportsOffset || impactIndex >= 4032 {
+		return 0, nil
+	}
+	for _, shortID := range shortIDs {
+		// The device may have been banned since the series was built.
+		rates, exists := gcas.equipmentImpactRate[shortID]
+		if !exists {
+			continue
+		}
+		flags := gcas.impactFlags[shortID][timeslot]
+		newFlags := flags
+		if flags == impactRateStale {
+			newFlags = impactRateBackfilled
+			replaced++
+		}
+		if rates[impactIndex] == moer && newFlags == flags {
+			continue
+		}
+		rates[impactIndex] = moer
+		gcas.setImpactFlags(shortID, timeslot, newFlags)
+		records = append(records, encodeImpactRateRecord(shortID, timeslot, moer, newFlags)...)
+	}
+	return replaced, records
+}
+
+// managedSetImpactRate sets the impact rate of a series at the timeslot of the
+// provided date, and remembers it in case WattTime goes down.
+func (gcas *GCAServer) managedSetImpactRate(s wattTimeSeries, date int64, moer float64) {
+	timeslot, err := glow.UnixToTimeslot(date)
+	if err != nil {
+		gcas.logger.Errorf("watttime returned data at an invalid timeslot: %v", err)
+		gcas.logger.Errorf("watttime time: %v, genesis time: %v", date, glow.GenesisTime)
+		return
+	}
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	cache := gcas.wattTimeCacheFor(s.key)
+	cache.moer = moer
+	gcas.wattTimeLastSuccess = gcas.now()
+	replaced, records := gcas.setImpactRate(s.shortIDs, timeslot, moer)
+	gcas.wattTimeBackfilled += replaced
+	if len(records) == 0 {
+		// WattTime sent the datapoint that the server already had,
+		// which it does for most fetches.
+		return
+	}
+	gcas.saveImpactRates(records)
+	gcas.bumpStateVersion()
+}
+
+// managedFillStaleImpactRate fills the current timeslot of a series with the
+// last impact rate that was fetched for it, after a fetch failed. Timeslots
+// that already have a fresh impact rate are left alone.
+func (gcas *GCAServer) managedFillStaleImpactRate(s wattTimeSeries) {
+	timeslot := gcas.currentTimeslot()
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	cache, exists := gcas.wattTimeCaches[s.key]
+	if !exists {
+		// Nothing was ever fetched, so there is nothing to fill in.
+		return
+	}
+	impactIndex := timeslot - gcas.equipmentReportsOffset
+	if timeslot < gcas.equipmentReportsOffset || impactIndex >= 4032 {
+		return
+	}
+	var records []byte
+	for _, shortID := range s.shortIDs {
+		rates, exists := gcas.equipmentImpactRate[shortID]
+		if !exists {
+			continue
+		}
+		stale := gcas.impactFlags[shortID][timeslot] == impactRateStale
+		if rates[impactIndex] != 0 && !stale {
+			continue
+		}
+		rates[impactIndex] = cache.moer
+		gcas.setImpactFlags(shortID, timeslot, impactRateStale)
+		records = append(records, encodeImpactRateRecord(shortID, timeslot, cache.moer, impactRateStale)...)
+	}
+	if len(records) == 0 {
+		return
+	}
+	gcas.saveImpactRates(records)
+	if !cache.stale || timeslot < cache.staleFrom {
+		cache.staleFrom = timeslot
+	}
+	cache.stale = true
+	gcas.bumpStateVersion()
+}
+
+// managedBackfillImpactRates queries WattTime again for the window in which a
+// series was filled with stale data, after WattTime recovered.
+func (gcas *GCAServer) managedBackfillImpactRates(s wattTimeSeries, token string) {
+	gcas.mu.RLock()
+	cache, exists := gcas.wattTimeCaches[s.key]
+	if !exists || !cache.stale {
+		gcas.mu.RUnlock()
+		return
+	}
+	startTime := glow.TimeslotToUnix(cache.staleFrom)
+	gcas.mu.RUnlock()
+	endTime := glow.TimeslotToUnix(gcas.currentTimeslot() + 1)
+
+	var moers []float64
+	var dates []int64
+	err := gcas.retryWattTime(func() (err error) {
+		moers, dates, err = s.fetchHistory(gcas.staticShutdownCtx, gcas.staticWattTimeURL, token, startTime, endTime)
+		return err
+	})
+	if err != nil {
+		gcas.logger.Errorf("unable to backfill watttime data for %v: %v", s.key, err)
+		return
+	}
+	gcas.managedIntegrateImpactRates(s, moers, dates)
+}
+
+// managedIntegrateImpactRates integrates a series of impact rates into the
+// devices of the series, in one loop with the lock held.
+func (gcas *GCAServer) managedIntegrateImpactRates(s wattTimeSeries, moers []float64, dates []int64) {
+	gcas.mu.Lock()
+	defer gcas.mu.Unlock()
+	var records []byte
+	for i, date := range dates {
+		// There's an edge case where the 'ero' is more than 2 weeks in
+		// the past, which means there will be a lot more data than what
+		// we can process, so the loop has to be aborted early.
+		if i >= 4032 {
+			break
+		}
+
+		timeslot, err := glow.UnixToTimeslot(date)
+		if err != nil {
+			gcas.logger.Errorf("watttime returned data at an invalid timeslot: %v", err)
+			gcas.logger.Errorf("watttime time: %v, genesis time: %v", date, glow.GenesisTime)
+			continue
+		}
+		replaced, changed := gcas.setImpactRate(s.shortIDs, timeslot, moers[i])
+		gcas.wattTimeBackfilled += replaced
+		records = append(records, changed...)
+	}
+	gcas.saveImpactRates(records)
+
+	// The series stays in need of a backfill until none of its devices
+	// has a stale impact rate left in memory.
+	if cache, exists := gcas.wattTimeCaches[s.key]; exists && cache.stale {
+		cache.stale = false
+		for _, shortID := range s.shortIDs {
+			if len(gcas.staleImpactRates(shortID, gcas.equipmentReportsOffset, 4032)) > 0 {
+				cache.stale = true
+			}
+		}
+	}
+	gcas.bumpStateVersion()
+}
+
+// staleImpactRates returns the indexes of the stale impact rates of a device
+// within the provided number of timeslots after the provided timeslot. The
+// mutex must be held.
+func (gcas *GCAServer) staleImpactRates(shortID uint32, timeslotOffset uint32, timeslots uint32) []int {
+	var indexes []int
+	for timeslot, flags := range gcas.impactFlags[shortID] {
+		if flags == impactRateStale && timeslot >= timeslotOffset && timeslot < timeslotOffset+timeslots {
+			indexes = append(indexes, int(timeslot-timeslotOffset))
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// staleImpactSlots returns the number of impact rates in memory that are
+// filled with stale data. The mutex must be held.
+func (gcas *GCAServer) staleImpactSlots() int {
+	var n int
+	for _, slots := range gcas.impactFlags {
+		for timeslot, flags := range slots {
+			if flags == impactRateStale && timeslot >= gcas.equipmentReportsOffset {
+				n++
+			}
+		}
+	}
+	return n
+}
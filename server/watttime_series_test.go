@@ -0,0 +1,109 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/watttime/mock"
+)
+
+// waitForImpactRate waits until the impact rate of a device at a timeslot has
+// the expected value, and reports whether it got there.
+func (gcas *GCAServer) waitForImpactRate(shortID uint32, timeslot uint32, want float64) bool {
+	for i := 0; i < 200; i++ {
+		gcas.mu.RLock()
+		rate := gcas.equipmentImpactRate[shortID][timeslot-gcas.equipmentReportsOffset]
+		gcas.mu.RUnlock()
+		if rate == want {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// TestWattTimeOutage checks that the impact rates get filled from stale data
+// while WattTime is down, and backfilled once it comes back.
+func TestWattTimeOutage(t *testing.T) {
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+	wattTime := mock.NewServer()
+	defer wattTime.Close()
+
+	server, _, _, gcaPrivKey, err := SetupTestEnvironmentWithOptions(t.Name(), ServerOptions{WattTimeURL: wattTime.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, _, err := server.AuthorizeTestDevice(1, gcaPrivKey); err != nil {
+		t.Fatal(err)
+	}
+	grams := func(timeslot uint32) float64 { return mock.DefaultMOER(mock.DefaultRegion, timeslot) * 453.59237 }
+	if !server.waitForImpactRate(1, 10, grams(10)) {
+		t.Fatal("impact rate was not fetched")
+	}
+
+	// A few failures are absorbed by the retries.
+	wattTime.FailNext(wattTimeRetries - 1)
+	glow.SetCurrentTimeslot(11)
+	if !server.waitForImpactRate(1, 11, grams(11)) {
+		t.Fatal("impact rate was not fetched after a few failures")
+	}
+	_, hr, err := server.getHealthz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hr.WattTimeLastSuccess == 0 || hr.WattTimeStaleSlots != 0 {
+		t.Fatalf("unexpected healthz response: %+v", hr)
+	}
+
+	// While WattTime is down, the last known value gets used and flagged.
+	wattTime.SetDown(true)
+	glow.SetCurrentTimeslot(12)
+	if !server.waitForImpactRate(1, 12, grams(11)) {
+		t.Fatal("the stale impact rate was not filled in")
+	}
+	glow.SetCurrentTimeslot(13)
+	if !server.waitForImpactRate(1, 13, grams(11)) {
+		t.Fatal("the stale impact rate was not filled in")
+	}
+	_, ads, err := server.getAllDeviceStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices) != 1 || len(ads.Devices[0].StaleImpactRates) != 2 || ads.Devices[0].StaleImpactRates[0] != 12 || ads.Devices[0].StaleImpactRates[1] != 13 {
+		t.Fatalf("unexpected stale impact rates: %+v", ads.Devices[0].StaleImpactRates)
+	}
+	_, hr, err = server.getHealthz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hr.WattTimeStaleSlots != 2 || hr.WattTimeBackfilledSlots != 0 {
+		t.Fatalf("unexpected healthz response: %+v", hr)
+	}
+
+	// Once WattTime comes back, the missed window gets backfilled with
+	// the real values.
+	wattTime.SetDown(false)
+	if !server.waitForImpactRate(1, 12, grams(12)) || !server.waitForImpactRate(1, 13, grams(13)) {
+		t.Fatal("the stale impact rates were not backfilled")
+	}
+	_, hr, err = server.getHealthz()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hr.WattTimeStaleSlots != 0 || hr.WattTimeBackfilledSlots != 2 {
+		t.Fatalf("unexpected healthz response: %+v", hr)
+	}
+	_, ads, err = server.getAllDeviceStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads.Devices[0].StaleImpactRates) != 0 {
+		t.Fatal("stale impact rates were not cleared:", ads.Devices[0].StaleImpactRates)
+	}
+	if !server.waitForImpactRate(1, 10, grams(10)) || !server.waitForImpactRate(1, 11, grams(11)) {
+		t.Fatal("the backfill changed the fresh impact rates")
+	}
+}
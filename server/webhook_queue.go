@@ -0,0 +1,128 @@
+package server
+
+// webhook_queue.go contains the queue that every webhook event goes through.
+// When an event happens, one delivery per configured webhook gets added to the
+// queue, which is a retry queue, see retry_queue.go. A background thread posts
+// the deliveries, and a delivery only leaves the queue once its webhook
+// answered with a 2xx status, or once the queue dropped it because it was
+// full or the delivery was too old. Each webhook backs off on its own while
+// it is down, and the queue is loaded again at startup, which gives every
+// event at-least-once delivery as long as the webhook comes back in time.
+//
+// Every event is signed with the key of the server, see
+// glow.VerifyWebhookEvent. Besides the device status events from
+// offline_webhooks.go, the queue carries an event every time the GCA
+// authorizes or deauthorizes equipment, every time equipment gets banned, and
+// the persist events of persist_health.go. Which events reach the webhooks is
+// decided by the alert routes, see alerts.go.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// The equipment event types sent to the webhooks.
+const (
+	webhookEventAuthorized   = "equipment.authorized"
+	webhookEventDeauthorized = "equipment.deauthorized"
+	webhookEventBanned       = "equipment.banned"
+)
+
+// EquipmentEvent is the payload that gets posted to the webhooks when the
+// equipment of the GCA changes.
+type EquipmentEvent struct {
+	Event      string `json:"event"` // One of "equipment.authorized", "equipment.deauthorized", or "equipment.banned"
+	ShortID    uint32 `json:"short_id"`
+	PubkeyHex  string `json:"pubkey_hex"`
+	Timeslot   uint32 `json:"timeslot"`    // The timeslot from which on the change applies
+	GCAKeyHex  string `json:"gca_key_hex"` // The GCA key that the server accepted when the change was made
+	DetectedAt int64  `json:"detected_at"` // Unix time at which the change was made
+}
+
+// legacyWebhookDelivery is an entry of the webhook queue from before the
+// retry queues.
+type legacyWebhookDelivery struct {
+	URL      string          `json:"url"`
+	Event    json.RawMessage `json:"event"`
+	Attempts int             `json:"attempts"`
+}
+
+// webhookQueueConfig returns the settings of the webhook queue. A queue file
+// from before the retry queues is a list of deliveries, which are taken over
+// as if they were queued at startup.
+func (gcas *GCAServer) webhookQueueConfig() retryQueueConfig {
+	cfg := gcas.newRetryQueueConfig(alertBackendWebhooks, WebhookQueueFile)
+	cfg.legacy = func(data []byte, now time.Time) ([]*retryEntry, error) {
+		var deliveries []legacyWebhookDelivery
+		if err := json.Unmarshal(data, &deliveries); err != nil {
+			return nil, err
+		}
+		entries := make([]*retryEntry, 0, len(deliveries))
+		for _, d := range deliveries {
+			entries = append(entries, &retryEntry{Destination: d.URL, Payload: d.Event, Attempts: d.Attempts, Queued: now})
+		}
+		return entries, nil
+	}
+	return cfg
+}
+
+// alertType implements alertEvent.
+func (e EquipmentEvent) alertType() string { return e.Event }
+
+// alertSummary implements alertEvent.
+func (e EquipmentEvent) alertSummary() string {
+	switch e.Event {
+	case webhookEventAuthorized:
+		return fmt.Sprintf("equipment %v was authorized", e.ShortID)
+	case webhookEventDeauthorized:
+		return fmt.Sprintf("equipment %v was deauthorized from timeslot %v", e.ShortID, e.Timeslot)
+	}
+	return fmt.Sprintf("equipment %v was banned from timeslot %v", e.ShortID, e.Timeslot)
+}
+
+// queueEquipmentEvent sends an equipment event to the alert backends. The
+// mutex must be held.
+func (gcas *GCAServer) queueEquipmentEvent(event string, shortID uint32, pubkey glow.PublicKey, timeslot uint32) {
+	gcaKey := gcas.gcaKeyAt(gcas.currentTimeslot())
+	gcas.queueAlert(EquipmentEvent{
+		Event:      event,
+		ShortID:    shortID,
+		PubkeyHex:  hex.EncodeToString(pubkey[:]),
+		Timeslot:   timeslot,
+		GCAKeyHex:  hex.EncodeToString(gcaKey[:]),
+		DetectedAt: gcas.now().Unix(),
+	})
+}
+
+// threadedDeliverWebhooks posts the deliveries in the webhook queue as they
+// become due, until the server shuts down.
+func (gcas *GCAServer) threadedDeliverWebhooks() {
+	gcas.threadedDrainRetryQueue(gcas.staticWebhookQueue, gcas.deliverWebhook)
+}
+
+// deliverWebhook makes a single attempt at posting a delivery, signing the
+// event with the key of the server.
+func (gcas *GCAServer) deliverWebhook(e *retryEntry) error {
+	req, err := http.NewRequestWithContext(gcas.staticShutdownCtx, "POST", e.Destination, bytes.NewReader(e.Payload))
+	if err != nil {
+		return fmt.Errorf("unable to create webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(glow.WebhookSignatureHeader, glow.SignWebhookEvent(e.Payload, gcas.staticPrivateKey))
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %v", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// signedWebhookReceiver collects the raw bodies and signatures posted to it.
+// While failing is set, every request gets answered with a 500.
+type signedWebhookReceiver struct {
+	bodies     [][]byte
+	signatures []string
+	failures   int
+	failing    bool
+	attempts   int // Every request, including the failed ones
+
+	mu sync.Mutex
+}
+
+// ServeHTTP implements http.Handler.
+func (wr *signedWebhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.attempts++
+	body, err := io.ReadAll(r.Body)
+	if err != nil || wr.failing || wr.failures > 0 {
+		if wr.failures > 0 {
+			wr.failures--
+		}
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	wr.bodies = append(wr.bodies, body)
+	wr.signatures = append(wr.signatures, r.Header.Get(glow.WebhookSignatureHeader))
+}
+
+// waitForEvent waits until the receiver has collected at least n events, and
+// returns the nth one along with its signature.
+func (wr *signedWebhookReceiver) waitForEvent(t *testing.T, n int) (EquipmentEvent, []byte, string) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		wr.mu.Lock()
+		if len(wr.bodies) >= n {
+			body, sig := wr.bodies[n-1], wr.signatures[n-1]
+			wr.mu.Unlock()
+			var event EquipmentEvent
+			if err := json.Unmarshal(body, &event); err != nil {
+				t.Fatal(err)
+			}
+			return event, body, sig
+		}
+		wr.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("webhook event", n, "was not delivered")
+	return EquipmentEvent{}, nil, ""
+}
+
+// TestEquipmentWebhooks checks that authorizing, deauthorizing and banning
+// equipment each send a signed event to the webhooks, that a delivery that
+// failed with a 500 gets retried, and that an undelivered event survives a
+// restart.
+func TestEquipmentWebhooks(t *testing.T) {
+	server, dir, gcaPubKey, gcaPrivKey, err := SetupTestEnvironment(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &signedWebhookReceiver{failures: 1}
+	receiverServer := httptest.NewServer(receiver)
+	defer receiverServer.Close()
+	config, _ := json.Marshal(webhookConfig{URLs: []string{receiverServer.URL}})
+	if err := os.WriteFile(filepath.Join(dir, WebhooksConfigFile), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	glow.SetCurrentTimeslot(10)
+	defer glow.SetCurrentTimeslot(0)
+
+	// The authorization gets delivered after the first attempt fails, and
+	// the signature only verifies for the untouched body.
+	ea, _, err := server.AuthorizeTestDevice(1, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, body, sig := receiver.waitForEvent(t, 1)
+	expected := EquipmentEvent{
+		Event:      webhookEventAuthorized,
+		ShortID:    1,
+		PubkeyHex:  v2Hex(ea.PublicKey[:]),
+		Timeslot:   10,
+		GCAKeyHex:  v2Hex(gcaPubKey[:]),
+		DetectedAt: event.DetectedAt,
+	}
+	if event != expected || event.DetectedAt == 0 {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if err := glow.VerifyWebhookEvent(body, sig, server.staticPublicKey); err != nil {
+		t.Fatal(err)
+	}
+	body[len(body)-2] ^= 1
+	if err := glow.VerifyWebhookEvent(body, sig, server.staticPublicKey); err == nil {
+		t.Fatal("tampered event verified")
+	}
+
+	// Deauthorizing the device sends the cutoff timeslot.
+	ed := EquipmentDeauthorization{PublicKey: ea.PublicKey, Timestamp: glow.TimeslotToUnix(20)}
+	ed.Signature = glow.Sign(ed.SigningBytes(), gcaPrivKey)
+	if _, err := server.managedDeauthorizeEquipment(ed); err != nil {
+		t.Fatal(err)
+	}
+	event, _, _ = receiver.waitForEvent(t, 2)
+	if event.Event != webhookEventDeauthorized || event.ShortID != 1 || event.Timeslot != ed.CutoffTimeslot() {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	// A conflicting authorization bans the ShortID, and the event waits in
+	// the queue across a restart while the webhook is down.
+	ea2, _, err := server.AuthorizeTestDevice(2, gcaPrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.waitForEvent(t, 3)
+	receiver.mu.Lock()
+	receiver.failing = true
+	receiver.mu.Unlock()
+	conflict := ea2
+	conflict.Capacity++
+	conflict = SignEquipmentAuthorization(conflict, gcaPrivKey)
+	if err := server.AuthorizeEquipment(conflict, gcaPrivKey); err == nil {
+		t.Fatal("conflicting authorization was accepted")
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var queued retryQueueFile
+	data, err := serverStorage(dir).ReadFile(WebhookQueueFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &queued); err != nil || len(queued.Entries) != 1 {
+		t.Fatal("the ban was not queued:", len(queued.Entries), err)
+	}
+	receiver.mu.Lock()
+	receiver.failing = false
+	receiver.mu.Unlock()
+	server, err = NewGCAServer(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	event, body, sig = receiver.waitForEvent(t, 4)
+	if event.Event != webhookEventBanned || event.ShortID != 2 || event.PubkeyHex != v2Hex(ea2.PublicKey[:]) || event.Timeslot != 10 {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if err := glow.VerifyWebhookEvent(body, sig, server.staticPublicKey); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+// websocket.go contains a minimal implementation of the server side of the
+// WebSocket protocol (RFC 6455). It only supports what the report stream
+// needs: the opening handshake, unfragmented frames, and the ping and close
+// control frames.
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is the fixed value that the handshake key gets combined with,
+// as defined by the RFC.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The frame opcodes that the server understands.
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// The close codes sent by the server.
+const (
+	wsCloseGoingAway       = 1001
+	wsClosePolicyViolation = 1008
+)
+
+// wsMaxReadPayload is the largest frame that will be accepted from a client.
+// Clients of the report stream have no reason to send anything other than
+// control frames, which are limited to 125 bytes.
+const wsMaxReadPayload = 4096
+
+// wsConn is a WebSocket connection that has completed the handshake. Only one
+// thread may read from the connection, but any number of threads may write.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	mu sync.Mutex
+}
+
+// headerHasToken returns whether the comma separated header contains the
+// provided token, ignoring case.
+func headerHasToken(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketAccept computes the value of the Sec-WebSocket-Accept header for
+// the provided handshake key.
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// upgradeWebSocket performs the opening handshake for a WebSocket. If an
+// error is returned before the connection was hijacked, nothing has been
+// written to the response and the caller should respond with an error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("request is not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("unable to hijack connection: %v", err)
+	}
+
+	// The http server may have set deadlines on the connection, which
+	// would otherwise kill the stream after a few seconds.
+	conn.SetDeadline(time.Time{})
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to write handshake: %v", err)
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// writeFrame writes a single unfragmented frame to the connection. Slow
+// writes are cut off by the deadline so that a stuck client can't hold the
+// connection open forever.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	ws.conn.SetWriteDeadline(time.Now().Add(reportStreamWriteTimeout))
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// writeClose sends a close frame with the provided code and reason.
+func (ws *wsConn) writeClose(code uint16, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	payload = append(payload, reason...)
+	return ws.writeFrame(wsOpClose, payload)
+}
+
+// readFrame reads a single frame from the client. Clients are required to
+// mask every frame, so unmasked frames are treated as an error.
+func (ws *wsConn) readFrame() (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.br, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("client frame is not masked")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxReadPayload {
+		return 0, nil, fmt.Errorf("client frame is too large: %v", length)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// Close closes the underlying connection.
+func (ws *wsConn) Close() error {
+	return ws.conn.Close()
+}
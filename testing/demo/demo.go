@@ -0,0 +1,430 @@
+// Package demo walks a GCA server in internal test mode through the whole
+// lifecycle of a GCA, using only the public APIs of the server.
+//
+// The demo registers a GCA key, authorizes two synthetic devices, and has them
+// report for a few simulated hours, moving the clock of the server forward
+// with /internal/set-time after every timeslot. It then fetches the stats of
+// the week and the summary of each device, and checks that the server adds up
+// to what the devices sent. Every signature is checked along the way: the
+// acks, the signed responses and the stats are checked against the key of
+// the server, and the historical reports against the keys of the devices.
+//
+// The GCA key is the test key that a server in internal test mode generates
+// for itself when it wasn't provisioned, see server/test_gca_keys.go, unless a
+// GCA key that is already registered with the server is provided.
+package demo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/client"
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+const (
+	// demoDevices is the number of synthetic devices.
+	demoDevices = 2
+
+	// demoCapacity is the capacity of the synthetic devices, in milliwatt
+	// hours per timeslot, and demoPeak is the power output of the first
+	// device in the middle of the run. The second device is half as big.
+	demoCapacity = 1e6
+	demoPeak     = 500e3
+
+	// ackRetries is the number of times that a report gets sent before
+	// the demo gives up on the ack.
+	ackRetries = 3
+)
+
+// Config describes a demo run. Fields that are left at zero get a default,
+// except for the ports, which are always required.
+type Config struct {
+	Host     string // Defaults to 127.0.0.1
+	HttpPort uint16
+	UdpPort  uint16
+
+	// GCAKey is a GCA key that is already registered with the server,
+	// along with the key of the server that it's registered with. If it's
+	// left at zero, the demo registers the test GCA key of the server.
+	GCAKey    glow.PrivateKey
+	ServerKey glow.PublicKey
+
+	Hours        int    // Simulated hours of reports, defaults to 3
+	FirstShortID uint32 // The devices get consecutive ShortIDs starting here, random if zero
+
+	// Output gets the progress and the stats in a form that is meant for
+	// a terminal. Nil discards them.
+	Output io.Writer
+}
+
+// DeviceResult compares what a device sent with what the server credited
+// it with.
+type DeviceResult struct {
+	ShortID   uint32
+	PublicKey glow.PublicKey
+	Sent      int    // Reports that the server accepted
+	Energy    uint64 // The sum of the power outputs that were sent
+
+	Stats   server.V2DeviceStats
+	Summary server.V2DeviceSummary
+}
+
+// Result contains the outcome of a demo run.
+type Result struct {
+	ServerKey glow.PublicKey
+	WeekStart uint32 // The week of the stats
+	Start     uint32 // The first timeslot with a report
+	End       uint32 // The first timeslot after the last report
+	Devices   []DeviceResult
+}
+
+// device is a synthetic device.
+type device struct {
+	ea  glow.EquipmentAuthorization
+	key glow.PrivateKey
+}
+
+// Run performs the demo and returns what the server reported at the end. An
+// error is returned if any step fails, if a signature doesn't check out, or
+// if the totals of the server don't match what the devices sent.
+func Run(cfg Config) (Result, error) {
+	cfg = withDefaults(cfg)
+	out := cfg.Output
+	base := "http://" + glow.HostPort(cfg.Host, cfg.HttpPort)
+
+	// Get hold of a registered GCA key.
+	gcaKey, serverKey := cfg.GCAKey, cfg.ServerKey
+	if gcaKey == (glow.PrivateKey{}) {
+		var err error
+		gcaKey, serverKey, err = registerTestGCAKey(base)
+		if err != nil {
+			return Result{}, err
+		}
+		fmt.Fprintf(out, "registered the test gca key with server %x\n", serverKey)
+	}
+	api := client.NewAPIClient(serverKey, client.GCAServer{Location: cfg.Host, HttpPort: cfg.HttpPort}, client.APIClientOptions{})
+
+	// The reports start at the current timeslot of the server, or at the
+	// start of the next week if they would run into it, so that all of
+	// them end up in the stats of the same week, and that week is still
+	// the current one once the last report has been sent.
+	var tr server.TimeResponse
+	if err := api.GetSigned("/api/v1/time", &tr); err != nil {
+		return Result{}, fmt.Errorf("unable to fetch the time of the server: %v", err)
+	}
+	timeslots := uint32(cfg.Hours * 12)
+	res := Result{ServerKey: serverKey, Start: tr.Timeslot}
+	if res.Start%2016+timeslots >= 2016 {
+		res.Start = (res.Start/2016 + 1) * 2016
+	}
+	res.End = res.Start + timeslots
+	res.WeekStart = res.Start / 2016 * 2016
+
+	devices, err := authorizeDevices(base, cfg, gcaKey, res.Start)
+	if err != nil {
+		return Result{}, err
+	}
+	for _, d := range devices {
+		res.Devices = append(res.Devices, DeviceResult{ShortID: d.ea.ShortID, PublicKey: d.ea.PublicKey})
+		fmt.Fprintf(out, "authorized device %v with key %x\n", d.ea.ShortID, d.ea.PublicKey)
+	}
+
+	// Stream the reports, one simulated timeslot at a time. The clock of
+	// the server is moved to the end of each timeslot before its reports
+	// get sent, the way a device sends right after the timeslot ends.
+	location := glow.HostPort(cfg.Host, cfg.UdpPort)
+	for ts := res.Start; ts < res.End; ts++ {
+		if err := setTime(base, ts+1); err != nil {
+			return Result{}, err
+		}
+		for i, d := range devices {
+			output := powerOutput(i, ts-res.Start, timeslots)
+			if err := sendReport(location, serverKey, d, ts, output); err != nil {
+				return Result{}, err
+			}
+			res.Devices[i].Sent++
+			res.Devices[i].Energy += output
+		}
+		if (ts-res.Start+1)%12 == 0 {
+			fmt.Fprintf(out, "sent hour %v of %v\n", (ts-res.Start+1)/12, cfg.Hours)
+		}
+	}
+
+	if err := checkStats(api, &res); err != nil {
+		return Result{}, err
+	}
+	for i, d := range devices {
+		if err := checkDevice(api, &res.Devices[i], d, res); err != nil {
+			return Result{}, err
+		}
+	}
+	fmt.Fprint(out, res)
+	return res, nil
+}
+
+// withDefaults fills in the defaults for the fields of the config that were
+// left at zero.
+func withDefaults(cfg Config) Config {
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+	if cfg.Hours == 0 {
+		cfg.Hours = 3
+	}
+	if cfg.FirstShortID == 0 {
+		// Stay clear of the ShortIDs that real devices get, and of the
+		// ShortIDs of earlier runs against the same server.
+		var b [4]byte
+		rand.Read(b[:])
+		cfg.FirstShortID = 1<<30 + binary.LittleEndian.Uint32(b[:])>>4
+	}
+	if cfg.Output == nil {
+		cfg.Output = io.Discard
+	}
+	return cfg
+}
+
+// powerOutput returns the power output of a device for the nth of the
+// timeslots of the run, which follows the curve of a sunny day.
+func powerOutput(device int, n uint32, timeslots uint32) uint64 {
+	sun := math.Sin(math.Pi * (float64(n) + 0.5) / float64(timeslots))
+	return uint64(demoPeak * sun / float64(device+1))
+}
+
+// decodeKey decodes a hex encoded key.
+func decodeKey(s string) ([32]byte, error) {
+	var key [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(key) {
+		return key, fmt.Errorf("invalid key %q", s)
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// postJSON posts v to the provided url and decodes the response into resp, if
+// resp isn't nil. Any status other than 200 is an error.
+func postJSON(url string, v interface{}, resp interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("unable to marshal request: %v", err)
+	}
+	r, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to reach the server: %v", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(r.Body, 1e3))
+		return fmt.Errorf("%v failed with status %v: %s", url, r.StatusCode, bytes.TrimSpace(msg))
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+		return fmt.Errorf("unable to decode the response of %v: %v", url, err)
+	}
+	return nil
+}
+
+// registerTestGCAKey fetches the test keys of the server and registers the
+// test GCA key with the test temp key. It returns the GCA key and the key of
+// the server. Registering the same key again succeeds, so the demo can be run
+// any number of times against the same server.
+func registerTestGCAKey(base string) (glow.PrivateKey, glow.PublicKey, error) {
+	r, err := http.Get(base + "/internal/test-gca-keys")
+	if err != nil {
+		return glow.PrivateKey{}, glow.PublicKey{}, fmt.Errorf("unable to reach the server: %v", err)
+	}
+	var tgk server.TestGCAKeysResponse
+	err = json.NewDecoder(r.Body).Decode(&tgk)
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return glow.PrivateKey{}, glow.PublicKey{}, fmt.Errorf("the server has no test gca keys, status %v: is it running with --internal-test and without a provisioned temp key?", r.StatusCode)
+	}
+	if err != nil {
+		return glow.PrivateKey{}, glow.PublicKey{}, fmt.Errorf("unable to decode the test gca keys: %v", err)
+	}
+	var keys [4][32]byte
+	for i, s := range []string{tgk.ServerPublicKey, tgk.TempPrivateKey, tgk.GCAPublicKey, tgk.GCAPrivateKey} {
+		if keys[i], err = decodeKey(s); err != nil {
+			return glow.PrivateKey{}, glow.PublicKey{}, fmt.Errorf("bad test gca keys: %v", err)
+		}
+	}
+	serverKey, tempKey := glow.PublicKey(keys[0]), glow.PrivateKey(keys[1])
+	gr := server.GCARegistration{GCAKey: glow.PublicKey(keys[2])}
+	gr.Signature = glow.Sign(gr.SigningBytes(), tempKey)
+	var grr server.GCARegistrationResponse
+	if err := postJSON(base+"/api/v1/register-gca", gr, &grr); err != nil {
+		return glow.PrivateKey{}, glow.PublicKey{}, fmt.Errorf("unable to register the gca key: %v", err)
+	}
+	if grr.PublicKey != serverKey {
+		return glow.PrivateKey{}, glow.PublicKey{}, fmt.Errorf("the registration came back from a different server: %x", grr.PublicKey)
+	}
+	return glow.PrivateKey(keys[3]), serverKey, nil
+}
+
+// authorizeDevices creates the synthetic devices and authorizes them with the
+// server, one at a time.
+func authorizeDevices(base string, cfg Config, gcaKey glow.PrivateKey, start uint32) ([]device, error) {
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	devices := make([]device, demoDevices)
+	for i := range devices {
+		pub, priv := glow.GenerateKeyPair()
+		ea := glow.EquipmentAuthorization{
+			Version:    glow.EquipmentAuthorizationVersion,
+			ShortID:    cfg.FirstShortID + uint32(i),
+			PublicKey:  pub,
+			Latitude:   38.5 + float64(i)/100,
+			Longitude:  -121.5,
+			Capacity:   demoCapacity,
+			Expiration: start + 100e6,
+			Nonce:      binary.LittleEndian.Uint64(nonce[:])>>1 + uint64(i) + 1,
+		}
+		ea.Signature = glow.Sign(ea.SigningBytes(), gcaKey)
+		var resp map[string]string
+		if err := postJSON(base+"/api/v1/authorize-equipment", ea, &resp); err != nil {
+			return nil, fmt.Errorf("unable to authorize device %v: %v", ea.ShortID, err)
+		}
+		if resp["status"] != "success" {
+			return nil, fmt.Errorf("device %v was not authorized: %v", ea.ShortID, resp)
+		}
+		devices[i] = device{ea: ea, key: priv}
+	}
+	return devices, nil
+}
+
+// setTime moves the clock of the server to the start of the provided
+// timeslot.
+func setTime(base string, timeslot uint32) error {
+	var str server.SetTimeResponse
+	if err := postJSON(base+"/internal/set-time", server.SetTimeRequest{Timeslot: &timeslot}, &str); err != nil {
+		return fmt.Errorf("unable to move the clock of the server: %v", err)
+	}
+	if str.Timeslot != timeslot {
+		return fmt.Errorf("the clock of the server was moved to timeslot %v instead of %v", str.Timeslot, timeslot)
+	}
+	return nil
+}
+
+// sendReport signs a report and sends it over UDP until an ack comes back,
+// which has to be signed by the server and has to accept the report.
+func sendReport(location string, serverKey glow.PublicKey, d device, timeslot uint32, output uint64) error {
+	eqr := glow.EquipmentReport{ShortID: d.ea.ShortID, Timeslot: timeslot, PowerOutput: output}
+	eqr.Signature = glow.Sign(eqr.SigningBytes(), d.key)
+	for i := 0; i < ackRetries; i++ {
+		ack, acked, err := client.SendReportWithAck(eqr, location, serverKey, time.Second)
+		if err != nil {
+			return fmt.Errorf("unable to send the report of device %v: %v", d.ea.ShortID, err)
+		}
+		if acked {
+			if err := client.AckError(ack); err != nil {
+				return fmt.Errorf("the report of device %v for timeslot %v was not accepted: %v", d.ea.ShortID, timeslot, err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no signed ack for the report of device %v for timeslot %v", d.ea.ShortID, timeslot)
+}
+
+// checkStats fetches the stats of the week, both the binary encoding with its
+// signature and the signed v2 response, and checks that they credit every
+// device with what it sent.
+func checkStats(api *client.APIClient, res *Result) error {
+	ads, err := api.AllDeviceStats(res.WeekStart)
+	if err != nil {
+		return fmt.Errorf("unable to fetch the device stats: %v", err)
+	}
+	for i := range res.Devices {
+		dr := &res.Devices[i]
+		var found bool
+		for _, ds := range ads.Devices {
+			if ds.PublicKey != dr.PublicKey {
+				continue
+			}
+			found = true
+			var energy uint64
+			for _, po := range ds.PowerOutputs {
+				energy += po
+			}
+			if energy != dr.Energy {
+				return fmt.Errorf("the signed stats credit device %v with %v instead of %v", dr.ShortID, energy, dr.Energy)
+			}
+		}
+		if !found {
+			return fmt.Errorf("device %v is missing from the signed stats", dr.ShortID)
+		}
+
+		var stats server.V2AllDeviceStatsResponse
+		route := fmt.Sprintf("/api/v2/all-device-stats?timeslot_offset=%v&short_id=%v&fields=short_id,pubkey,totals,last_seen,online,uptime", res.WeekStart, dr.ShortID)
+		if err := api.GetSigned(route, &stats); err != nil {
+			return fmt.Errorf("unable to fetch the stats of device %v: %v", dr.ShortID, err)
+		}
+		if len(stats.Devices) != 1 || stats.Devices[0].Totals == nil {
+			return fmt.Errorf("unexpected stats for device %v: %+v", dr.ShortID, stats.Devices)
+		}
+		dr.Stats = stats.Devices[0]
+		if dr.Stats.Totals.Energy != int64(dr.Energy) || dr.Stats.Totals.Reports != uint32(dr.Sent) {
+			return fmt.Errorf("the stats credit device %v with %v reports and %v energy instead of %v and %v", dr.ShortID, dr.Stats.Totals.Reports, dr.Stats.Totals.Energy, dr.Sent, dr.Energy)
+		}
+	}
+	return nil
+}
+
+// checkDevice fetches the signed summary and the historical reports of a
+// device, and checks them against what the device sent. The historical
+// reports have to carry the signature of the device.
+func checkDevice(api *client.APIClient, dr *DeviceResult, d device, res Result) error {
+	if err := api.GetSigned(fmt.Sprintf("/api/v2/device-summary?short_id=%v", dr.ShortID), &dr.Summary); err != nil {
+		return fmt.Errorf("unable to fetch the summary of device %v: %v", dr.ShortID, err)
+	}
+	if dr.Summary.TotalEnergy != int64(dr.Energy) || dr.Summary.LastSeenTimeslot != res.End-1 {
+		return fmt.Errorf("unexpected summary for device %v: %+v", dr.ShortID, dr.Summary)
+	}
+
+	hr, err := api.HistoricalReports(d.ea.PublicKey, glow.TimeslotToUnix(res.Start), glow.TimeslotToUnix(res.End))
+	if err != nil {
+		return fmt.Errorf("unable to fetch the reports of device %v: %v", dr.ShortID, err)
+	}
+	if len(hr.Reports) != dr.Sent {
+		return fmt.Errorf("the server has %v reports of device %v instead of %v", len(hr.Reports), dr.ShortID, dr.Sent)
+	}
+	return nil
+}
+
+// String returns the stats and the summaries of the devices in a form that is
+// meant for a terminal.
+func (r Result) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "server:           %x\n", r.ServerKey)
+	fmt.Fprintf(&b, "reports:          timeslots %v to %v (%v to %v)\n", r.Start, r.End-1,
+		time.Unix(glow.TimeslotToUnix(r.Start), 0).UTC().Format(time.RFC3339),
+		time.Unix(glow.TimeslotToUnix(r.End), 0).UTC().Format(time.RFC3339))
+	for _, dr := range r.Devices {
+		fmt.Fprintf(&b, "\ndevice %v (%x)\n", dr.ShortID, dr.PublicKey)
+		fmt.Fprintf(&b, "  sent:           %v reports, %.3f kWh\n", dr.Sent, float64(dr.Energy)/1e6)
+		if t := dr.Stats.Totals; t != nil {
+			fmt.Fprintf(&b, "  credited:       %v reports, %.3f kWh, %.3f g impact\n", t.Reports, float64(t.Energy)/1e6, t.Impact/1e9)
+		}
+		if u := dr.Stats.Uptime; u != nil {
+			fmt.Fprintf(&b, "  uptime:         %.1f%% of %v timeslots\n", u.Percent, u.Timeslots)
+		}
+		s := dr.Summary
+		fmt.Fprintf(&b, "  average output: %.0f mWh per timeslot\n", s.AveragePower)
+		fmt.Fprintf(&b, "  last seen:      timeslot %v, online %v\n", s.LastSeenTimeslot, s.Online)
+		fmt.Fprintf(&b, "  missed:         %v timeslots this week\n", s.MissedTimeslots)
+	}
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package demo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/glowlabs-org/gca-backend/server"
+	"github.com/glowlabs-org/gca-backend/watttime/mock"
+)
+
+// TestRun runs the demo twice against an in-process server in internal test
+// mode that was never provisioned, and checks the final totals.
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	wattTime := mock.NewServer()
+	defer wattTime.Close()
+	opts := server.DefaultServerOptions()
+	opts.HttpPort, opts.TcpPort, opts.UdpPort = 0, 0, 0
+	opts.LocalOnly()
+	opts.WattTimeURL = wattTime.URL()
+	opts.WattTimeUsername, opts.WattTimePassword = "demo", "demo"
+	gcas, err := server.NewGCAServerWithOptions(dir, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gcas.Close()
+	httpPort, _, udpPort := gcas.Ports()
+
+	// Every device sends 12 reports per hour, on the curve of powerOutput.
+	var want [demoDevices]uint64
+	for i := range want {
+		for n := uint32(0); n < 24; n++ {
+			want[i] += powerOutput(i, n, 24)
+		}
+	}
+	var out strings.Builder
+	res, err := Run(Config{HttpPort: httpPort, UdpPort: udpPort, Hours: 2, FirstShortID: 1, Output: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("\n" + out.String())
+	if res.ServerKey != gcas.PublicKey() || res.End-res.Start != 24 || len(res.Devices) != demoDevices {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	for i, dr := range res.Devices {
+		if dr.Sent != 24 || dr.Energy != want[i] || dr.Stats.Totals.Energy != int64(want[i]) || dr.Summary.TotalEnergy != int64(want[i]) {
+			t.Fatalf("unexpected totals for device %v: %+v", i, dr)
+		}
+		if dr.Summary.ReportsReceived != 24 || !dr.Summary.Online {
+			t.Fatalf("unexpected summary for device %v: %+v", i, dr.Summary)
+		}
+	}
+	if want[0] == want[1] || !strings.Contains(out.String(), "credited:       24 reports") {
+		t.Fatal("unexpected output:", out.String())
+	}
+
+	// The demo can be run again against the same server, continuing from
+	// where the clock was left.
+	again, err := Run(Config{HttpPort: httpPort, UdpPort: udpPort, Hours: 1, FirstShortID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Start < res.End || again.Devices[0].Sent != 12 {
+		t.Fatalf("unexpected second run: %+v", again)
+	}
+}
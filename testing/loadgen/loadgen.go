@@ -0,0 +1,474 @@
+// Package loadgen generates synthetic device traffic against a GCA server.
+//
+// The load generator authorizes a set of fresh devices with the GCA key, and
+// then has those devices submit signed equipment reports over UDP at a fixed
+// rate. The reports are signed and sent with the same code that the client
+// uses, so the server can't tell the synthetic devices apart from real ones.
+// Some reports can be sent twice and every send can be delayed by a random
+// amount, which mimics devices that retry and networks that reorder packets.
+//
+// With a seed in the config, the run is reproducible: the keys of the devices
+// are the ones that glow.FleetDeviceKey derives from the seed, and so is the
+// nonce of the first authorization and the sequence of power outputs,
+// duplicates and delays. The devices of a seeded run against a server from
+// servertest.NewSeededTestServer with the same seed have the same keys as the
+// devices that the test authorizes itself. Seeded keys are for testing only,
+// and must never be authorized with a production server.
+//
+// Before and after the run, the load generator reads the metrics endpoint of
+// the server, so that the result shows how many of the reports the server
+// actually accepted and why the others were rejected.
+package loadgen
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/client"
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server"
+)
+
+// maxBatchSize is the number of authorizations that get submitted to the
+// server in a single batch. It matches the limit of the server.
+const maxBatchSize = 500
+
+// Config describes a load generation run. Fields that are left at zero get
+// a default, except for the keys and the ports, which are always required.
+type Config struct {
+	GCAKey    glow.PrivateKey // Used to authorize the synthetic devices
+	ServerKey glow.PublicKey  // Used to verify the acks of the server
+
+	Host     string // Defaults to 127.0.0.1
+	HttpPort uint16
+	UdpPort  uint16
+
+	Devices      int    // Number of synthetic devices, defaults to 100
+	FirstShortID uint32 // The devices get consecutive ShortIDs starting here
+
+	Rate     float64       // Reports per second across all devices, defaults to 100
+	Duration time.Duration // How long to send reports for, defaults to 10 seconds
+
+	// DuplicateRate is the probability that a report gets sent a second
+	// time. Jitter is the largest random delay that gets added to every
+	// send, which allows reports to arrive out of order.
+	DuplicateRate float64
+	Jitter        time.Duration
+
+	// Timeslots is the number of timeslots that every device reports for,
+	// ending at the current timeslot. Once a device has reported for all
+	// of them it starts over, and the server sees duplicates. Defaults to
+	// 288, which is one day.
+	Timeslots uint32
+
+	AckTimeout  time.Duration // How long to wait for each ack, defaults to 2 seconds
+	MaxInFlight int           // Limits the reports waiting for an ack, defaults to 1000
+	Nonce       uint64        // First nonce for the authorizations, random if zero
+	Seed        []byte        // Makes the run reproducible, random if nil
+}
+
+// ServerStats contains the report counters of the server over a run.
+type ServerStats struct {
+	Received    uint64            // Every report that the server processed
+	Duplicates  uint64            // Reports that the server already had
+	Rejected    map[string]uint64 // Rejected reports by reason
+	RateLimited uint64            // Packets dropped by the rate limiter
+	QueueFull   uint64            // Packets dropped because the workers fell behind
+}
+
+// Accepted returns the number of reports that the server accepted.
+func (ss ServerStats) Accepted() uint64 {
+	accepted := ss.Received - ss.Duplicates
+	for _, n := range ss.Rejected {
+		accepted -= n
+	}
+	return accepted
+}
+
+// Result contains the outcome of a load generation run.
+type Result struct {
+	Devices    int
+	Sent       uint64            // Reports that were sent, not counting duplicates
+	Duplicates uint64            // Extra copies of reports that were sent
+	Errors     uint64            // Sends that failed locally
+	Acks       map[string]uint64 // Acks by status
+	Unacked    uint64            // Sends that didn't get an ack in time
+	Elapsed    time.Duration     // Time spent sending, without waiting for the last acks
+	Server     ServerStats
+}
+
+// Throughput returns the number of packets per second that were sent,
+// including the duplicates.
+func (r Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Sent+r.Duplicates) / r.Elapsed.Seconds()
+}
+
+// String returns a summary of the result that is meant for a terminal.
+func (r Result) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "devices:          %v\n", r.Devices)
+	fmt.Fprintf(&b, "reports sent:     %v (+%v duplicates, %v errors)\n", r.Sent, r.Duplicates, r.Errors)
+	fmt.Fprintf(&b, "elapsed:          %v\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&b, "throughput:       %.1f packets/s\n", r.Throughput())
+	fmt.Fprintf(&b, "acks:             %v\n", formatCounts(r.Acks))
+	fmt.Fprintf(&b, "unacked:          %v\n", r.Unacked)
+	fmt.Fprintf(&b, "server received:  %v\n", r.Server.Received)
+	fmt.Fprintf(&b, "server accepted:  %v\n", r.Server.Accepted())
+	fmt.Fprintf(&b, "server duplicate: %v\n", r.Server.Duplicates)
+	fmt.Fprintf(&b, "server rejected:  %v\n", formatCounts(r.Server.Rejected))
+	fmt.Fprintf(&b, "rate limited:     %v\n", r.Server.RateLimited)
+	fmt.Fprintf(&b, "queue full:       %v\n", r.Server.QueueFull)
+	return b.String()
+}
+
+// formatCounts formats a set of counters in a stable order, leaving out the
+// counters that are zero.
+func formatCounts(counts map[string]uint64) string {
+	var keys []string
+	for k, n := range counts {
+		if n > 0 {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return "none"
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%v=%v", k, counts[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+// device is a synthetic device.
+type device struct {
+	shortID uint32
+	key     glow.PrivateKey
+}
+
+// Run authorizes the synthetic devices and then sends reports for them until
+// the duration of the run has passed. It waits for the last acks before
+// returning.
+func Run(cfg Config) (Result, error) {
+	cfg = withDefaults(cfg)
+	devices, err := authorizeDevices(cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	before, err := fetchServerStats(cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	res := sendReports(cfg, devices)
+	after, err := fetchServerStats(cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	res.Server = after.sub(before)
+	return res, nil
+}
+
+// withDefaults fills in the defaults for the fields of the config that were
+// left at zero.
+func withDefaults(cfg Config) Config {
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+	if cfg.Devices == 0 {
+		cfg.Devices = 100
+	}
+	if cfg.Rate == 0 {
+		cfg.Rate = 100
+	}
+	if cfg.Duration == 0 {
+		cfg.Duration = 10 * time.Second
+	}
+	if cfg.Timeslots == 0 {
+		cfg.Timeslots = 288
+	}
+	if cfg.AckTimeout == 0 {
+		cfg.AckTimeout = 2 * time.Second
+	}
+	if cfg.MaxInFlight == 0 {
+		cfg.MaxInFlight = 1000
+	}
+	if cfg.Nonce == 0 {
+		var b [8]byte
+		if cfg.Seed != nil {
+			copy(b[:], seedHash(cfg.Seed, "nonce"))
+		} else {
+			rand.Read(b[:])
+		}
+		// Keep the top bit clear so that the nonces can't wrap.
+		cfg.Nonce = binary.LittleEndian.Uint64(b[:])>>1 + 1
+	}
+	return cfg
+}
+
+// seedHash derives the randomness of a seeded run for the provided purpose.
+func seedHash(seed []byte, label string) []byte {
+	h := sha256.Sum256(glow.DeriveSeed(seed, label, 0))
+	return h[:]
+}
+
+// authorizeDevices creates the synthetic devices and authorizes them with the
+// server, in batches.
+func authorizeDevices(cfg Config) ([]device, error) {
+	devices := make([]device, cfg.Devices)
+	auths := make([]glow.EquipmentAuthorization, cfg.Devices)
+	for i := range devices {
+		shortID := cfg.FirstShortID + uint32(i)
+		var pub glow.PublicKey
+		var priv glow.PrivateKey
+		if cfg.Seed != nil {
+			pub, priv = glow.FleetDeviceKey(cfg.Seed, shortID)
+		} else {
+			pub, priv = glow.GenerateKeyPair()
+		}
+		devices[i] = device{shortID: shortID, key: priv}
+		ea := glow.EquipmentAuthorization{
+			Version:    glow.EquipmentAuthorizationVersion,
+			ShortID:    devices[i].shortID,
+			PublicKey:  pub,
+			Latitude:   38 + float64(i%1000)/1000,
+			Longitude:  -100 - float64(i/1000)/1000,
+			Capacity:   1e9,
+			Expiration: glow.CurrentTimeslot() + 100e6,
+			Nonce:      cfg.Nonce + uint64(i),
+		}
+		ea.Signature = glow.Sign(ea.SigningBytes(), cfg.GCAKey)
+		auths[i] = ea
+	}
+
+	url := "http://" + glow.HostPort(cfg.Host, cfg.HttpPort) + "/api/v1/authorize-equipment/batch"
+	for start := 0; start < len(auths); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(auths) {
+			end = len(auths)
+		}
+		body, err := json.Marshal(auths[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal authorizations: %v", err)
+		}
+		resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("unable to submit authorizations: %v", err)
+		}
+		var bar server.BatchAuthorizationResponse
+		err = json.NewDecoder(resp.Body).Decode(&bar)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("batch authorization failed with status %v", resp.StatusCode)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode batch authorization response: %v", err)
+		}
+		if len(bar.Results) != end-start {
+			return nil, fmt.Errorf("expected %v batch results, got %v", end-start, len(bar.Results))
+		}
+		// A seeded run that gets repeated against the same server sends
+		// the same authorizations, which the server already has.
+		for _, result := range bar.Results {
+			if result.Status != "authorized" && result.Status != "already-authorized" {
+				return nil, fmt.Errorf("device %v was not authorized: %v %v", result.ShortID, result.Status, result.Reason)
+			}
+		}
+	}
+	return devices, nil
+}
+
+// ackStatusName returns the name of an ack status, using the same names as the
+// rejection reasons in the metrics of the server.
+func ackStatusName(status byte) string {
+	switch status {
+	case glow.ReportAckAccepted:
+		return "accepted"
+	case glow.ReportAckDuplicate:
+		return "duplicate"
+	case glow.ReportAckBanned:
+		return "banned"
+	case glow.ReportAckStale:
+		return "stale_timeslot"
+	case glow.ReportAckInvalidPower:
+		return "invalid_power"
+	case glow.ReportAckDeauthorized:
+		return "deauthorized"
+	case glow.ReportAckFlagged:
+		return "flagged"
+	case glow.ReportAckExpired:
+		return "expired"
+	case glow.ReportAckFinalized:
+		return "period_finalized"
+	case glow.ReportAckRetryLater:
+		return "retry_later"
+	case glow.ReportAckOutsideAuthorization:
+		return "outside_authorization"
+	}
+	return "unknown"
+}
+
+// sendReports sends reports at the configured rate until the duration has
+// passed, cycling through the devices. Each report walks its device forward
+// by one timeslot.
+func sendReports(cfg Config, devices []device) Result {
+	res := Result{Devices: len(devices), Acks: make(map[string]uint64)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	inFlight := make(chan struct{}, cfg.MaxInFlight)
+	location := glow.HostPort(cfg.Host, cfg.UdpPort)
+
+	// The timeslots end at the current timeslot, and can't go below zero.
+	current := glow.CurrentTimeslot()
+	timeslots := cfg.Timeslots
+	if timeslots > current+1 {
+		timeslots = current + 1
+	}
+	first := current + 1 - timeslots
+
+	// send signs and sends a single report after the provided delay, and
+	// records the ack.
+	send := func(eqr glow.EquipmentReport, delay time.Duration) {
+		defer wg.Done()
+		defer func() { <-inFlight }()
+		time.Sleep(delay)
+		ack, acked, err := client.SendReportWithAck(eqr, location, cfg.ServerKey, cfg.AckTimeout)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			res.Errors++
+		} else if acked {
+			res.Acks[ackStatusName(ack.Status)]++
+		} else {
+			res.Unacked++
+		}
+	}
+	jitter := func(r *mrand.Rand) time.Duration {
+		if cfg.Jitter <= 0 {
+			return 0
+		}
+		return time.Duration(r.Int63n(int64(cfg.Jitter)))
+	}
+
+	source := time.Now().UnixNano()
+	if cfg.Seed != nil {
+		source = int64(binary.LittleEndian.Uint64(seedHash(cfg.Seed, "reports")))
+	}
+	r := mrand.New(mrand.NewSource(source))
+	start := time.Now()
+	for n := uint64(0); ; n++ {
+		next := start.Add(time.Duration(float64(n) / cfg.Rate * float64(time.Second)))
+		if next.Sub(start) >= cfg.Duration {
+			break
+		}
+		time.Sleep(time.Until(next))
+
+		d := devices[n%uint64(len(devices))]
+		step := n / uint64(len(devices))
+		eqr := glow.EquipmentReport{
+			ShortID:     d.shortID,
+			Timeslot:    first + uint32(step%uint64(timeslots)),
+			PowerOutput: 1000 + uint64(r.Int63n(50000)),
+		}
+		eqr.Signature = glow.Sign(eqr.SigningBytes(), d.key)
+
+		copies := 1
+		if r.Float64() < cfg.DuplicateRate {
+			copies = 2
+		}
+		for i := 0; i < copies; i++ {
+			inFlight <- struct{}{}
+			wg.Add(1)
+			go send(eqr, jitter(r))
+		}
+		mu.Lock()
+		res.Sent++
+		res.Duplicates += uint64(copies - 1)
+		mu.Unlock()
+	}
+	res.Elapsed = time.Since(start)
+	wg.Wait()
+	return res
+}
+
+// fetchServerStats reads the report counters from the metrics endpoint of the
+// server.
+func fetchServerStats(cfg Config) (ServerStats, error) {
+	resp, err := http.Get("http://" + glow.HostPort(cfg.Host, cfg.HttpPort) + "/metrics")
+	if err != nil {
+		return ServerStats{}, fmt.Errorf("unable to fetch server metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ServerStats{}, fmt.Errorf("unable to fetch server metrics: status %v", resp.StatusCode)
+	}
+
+	ss := ServerStats{Rejected: make(map[string]uint64)}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		name, label := fields[0], ""
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			label = name[i:]
+			name = name[:i]
+		}
+		switch name {
+		case "reports_received_total":
+			ss.Received = value
+		case "reports_duplicate_total":
+			ss.Duplicates = value
+		case "reports_rejected_total":
+			reason := strings.TrimSuffix(strings.TrimPrefix(label, `{reason="`), `"}`)
+			ss.Rejected[reason] = value
+		case "udp_packets_rate_limited_total":
+			ss.RateLimited += value
+		case "udp_packets_queue_full_total":
+			ss.QueueFull = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ServerStats{}, fmt.Errorf("unable to read server metrics: %v", err)
+	}
+	return ss, nil
+}
+
+// sub returns the difference between two snapshots of the server stats.
+func (ss ServerStats) sub(before ServerStats) ServerStats {
+	diff := ServerStats{
+		Received:    ss.Received - before.Received,
+		Duplicates:  ss.Duplicates - before.Duplicates,
+		Rejected:    make(map[string]uint64),
+		RateLimited: ss.RateLimited - before.RateLimited,
+		QueueFull:   ss.QueueFull - before.QueueFull,
+	}
+	for reason, n := range ss.Rejected {
+		diff.Rejected[reason] = n - before.Rejected[reason]
+	}
+	return diff
+}
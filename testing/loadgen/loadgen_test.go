@@ -0,0 +1,106 @@
+package loadgen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+	"github.com/glowlabs-org/gca-backend/server/servertest"
+)
+
+// TestRun sends a burst of reports from 50 devices to an in-process server and
+// checks that the counts of the load generator line up with the metrics of
+// the server.
+func TestRun(t *testing.T) {
+	glow.SetCurrentTimeslot(500)
+	defer glow.SetCurrentTimeslot(0)
+	s := servertest.NewTestServer(t)
+	httpPort, _, udpPort := s.GCAServer.Ports()
+
+	res, err := Run(Config{
+		GCAKey:        s.GCAPrivateKey,
+		ServerKey:     s.GCAServer.PublicKey(),
+		HttpPort:      httpPort,
+		UdpPort:       udpPort,
+		Devices:       50,
+		FirstShortID:  1,
+		Rate:          200,
+		Duration:      10 * time.Second,
+		DuplicateRate: 0.1,
+		Jitter:        20 * time.Millisecond,
+		AckTimeout:    time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("\n" + res.String())
+
+	// Every device reports for 40 timeslots, so every report is unique
+	// apart from the duplicates that were sent on purpose.
+	if res.Sent != 2000 || res.Duplicates == 0 || res.Errors != 0 {
+		t.Fatalf("unexpected sends: %+v", res)
+	}
+	if res.Throughput() < 150 {
+		t.Fatal("throughput is too low:", res.Throughput())
+	}
+	if res.Server.RateLimited != 0 || res.Server.QueueFull != 0 {
+		t.Fatalf("the server dropped packets: %+v", res.Server)
+	}
+	for _, n := range res.Server.Rejected {
+		if n != 0 {
+			t.Fatalf("unexpected rejections: %+v", res.Server.Rejected)
+		}
+	}
+
+	// Allow for a little packet loss, but nothing can be accepted twice.
+	accepted := res.Server.Accepted()
+	if accepted > res.Sent || accepted < res.Sent*99/100 {
+		t.Fatal("unexpected number of accepted reports:", accepted)
+	}
+	if res.Server.Duplicates > res.Duplicates {
+		t.Fatal("more duplicates were seen than were sent:", res.Server.Duplicates)
+	}
+	if res.Acks["accepted"] > accepted || res.Acks["accepted"]+res.Acks["duplicate"]+res.Unacked != res.Sent+res.Duplicates {
+		t.Fatalf("acks don't add up: %+v", res)
+	}
+}
+
+// TestSeededRun checks that a seeded run authorizes the devices of the fleet
+// of the seed, so that a test can sign reports for them, and that the run can
+// be repeated against the same server.
+func TestSeededRun(t *testing.T) {
+	glow.SetCurrentTimeslot(500)
+	defer glow.SetCurrentTimeslot(0)
+	seed := []byte(t.Name())
+	s := servertest.NewSeededTestServer(t, seed)
+	httpPort, _, udpPort := s.GCAServer.Ports()
+	cfg := Config{
+		GCAKey:       s.GCAPrivateKey,
+		ServerKey:    s.GCAServer.PublicKey(),
+		HttpPort:     httpPort,
+		UdpPort:      udpPort,
+		Devices:      5,
+		FirstShortID: 1,
+		Rate:         50,
+		Duration:     200 * time.Millisecond,
+		Seed:         seed,
+	}
+	if withDefaults(cfg).Nonce != withDefaults(cfg).Nonce {
+		t.Fatal("the nonce of a seeded run is not reproducible")
+	}
+	// The second run sends the same reports as the first one.
+	for i := 0; i < 2; i++ {
+		res, err := Run(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && res.Acks["accepted"] != 0 {
+			t.Fatalf("the repeated run sent different reports: %+v", res)
+		}
+	}
+	pub, priv := glow.FleetDeviceKey(seed, 3)
+	d := servertest.Device{ShortID: 3, PublicKey: pub, PrivateKey: priv}
+	if ack := s.SubmitTestReport(d, glow.CurrentTimeslot(), 5000); ack.Status != glow.ReportAckAccepted {
+		t.Fatal("a report of the seeded device was not accepted:", ack.Status)
+	}
+}
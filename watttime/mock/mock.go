@@ -0,0 +1,247 @@
+// Package mock provides a fake WattTime API for tests and local development.
+//
+// The fake implements the endpoints that the GCA server calls: login,
+// region-from-loc, signal-index, and historical. The responses can be
+// configured, and the fake can be slowed down or made to fail, which makes it
+// possible to exercise the impact rate code without WattTime credentials.
+//
+// Data points are aligned to the timeslots of the protocol, and the fake only
+// knows about timeslots up to and including the current one, the same way
+// that WattTime has no data for the future.
+package mock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// DefaultRegion is the region that the fake returns for every location,
+// unless SetRegion is used.
+const DefaultRegion = "MOCK"
+
+// Token is the access token that the fake hands out on login.
+const Token = "mock-token"
+
+// MOERFunc returns the MOER of a region at a timeslot, in pounds per megawatt
+// hour, which is the unit that WattTime uses.
+type MOERFunc func(region string, timeslot uint32) float64
+
+// RegionFunc returns the region of a location.
+type RegionFunc func(latitude, longitude float64) string
+
+// DefaultMOER is the MOERFunc of a new fake. The value depends on both the
+// region and the timeslot, so that tests can tell the data points apart.
+func DefaultMOER(region string, timeslot uint32) float64 {
+	moer := 100 + float64(timeslot)
+	for _, c := range region {
+		moer += float64(c)
+	}
+	return moer
+}
+
+// Server is a fake WattTime API. All of the settings can be changed while the
+// server is running.
+type Server struct {
+	moer      MOERFunc
+	region    RegionFunc
+	latency   time.Duration
+	down      bool
+	failures  int
+	requests  map[string]int
+	staticSrv *httptest.Server
+
+	mu sync.Mutex
+}
+
+// NewServer launches a fake WattTime API on a loopback address. The server
+// must be closed with Close.
+func NewServer() *Server {
+	s := &Server{
+		moer:     DefaultMOER,
+		region:   func(float64, float64) string { return DefaultRegion },
+		requests: make(map[string]int),
+	}
+	s.staticSrv = httptest.NewServer(s)
+	return s
+}
+
+// URL returns the base URL of the fake, which is what the GCA server needs to
+// be pointed at.
+func (s *Server) URL() string {
+	return s.staticSrv.URL
+}
+
+// Close shuts the fake down.
+func (s *Server) Close() {
+	s.staticSrv.Close()
+}
+
+// SetMOER changes the MOER values that the fake returns.
+func (s *Server) SetMOER(fn MOERFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.moer = fn
+}
+
+// SetRegion changes the regions that the fake returns for locations.
+func (s *Server) SetRegion(fn RegionFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.region = fn
+}
+
+// SetLatency makes the fake wait before answering every request.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// SetDown makes every request fail until the fake is brought back up.
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// FailNext makes the next n requests fail.
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// Requests returns how many requests were made to an endpoint, for example
+// "/v3/signal-index", including the ones that failed.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	latency := s.latency
+	fail := s.down || s.failures > 0
+	if !s.down && s.failures > 0 {
+		s.failures--
+	}
+	moer := s.moer
+	region := s.region
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fail {
+		http.Error(w, "mock watttime is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/login":
+		if _, _, ok := r.BasicAuth(); !ok {
+			http.Error(w, "missing credentials", http.StatusForbidden)
+			return
+		}
+		writeJSON(w, map[string]string{"token": Token})
+	case "/v3/region-from-loc":
+		if !authorized(w, r) {
+			return
+		}
+		latitude, err1 := strconv.ParseFloat(r.URL.Query().Get("latitude"), 64)
+		longitude, err2 := strconv.ParseFloat(r.URL.Query().Get("longitude"), 64)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "invalid location", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]string{"region": region(latitude, longitude)})
+	case "/v3/signal-index":
+		if !authorized(w, r) {
+			return
+		}
+		name := r.URL.Query().Get("region")
+		ts := glow.CurrentTimeslot()
+		writeJSON(w, dataPoints(name, []uint32{ts}, moer))
+	case "/v3/historical":
+		if !authorized(w, r) {
+			return
+		}
+		start, err1 := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+		end, err2 := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		if err1 != nil || err2 != nil || end.Before(start) {
+			http.Error(w, "invalid time range", http.StatusBadRequest)
+			return
+		}
+		var timeslots []uint32
+		first, err := glow.UnixToTimeslot(start.Unix())
+		if err != nil {
+			first = 0
+		}
+		for ts := first; ts <= glow.CurrentTimeslot() && glow.TimeslotToUnix(ts) <= end.Unix(); ts++ {
+			if glow.TimeslotToUnix(ts) >= start.Unix() {
+				timeslots = append(timeslots, ts)
+			}
+		}
+		writeJSON(w, dataPoints(r.URL.Query().Get("region"), timeslots, moer))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorized checks the token of a request, and writes an error if it is
+// missing.
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "Bearer "+Token {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// dataPoints builds the response of the data endpoints, in the format of the
+// WattTime v3 API.
+func dataPoints(region string, timeslots []uint32, moer MOERFunc) interface{} {
+	type point struct {
+		PointTime string  `json:"point_time"`
+		Value     float64 `json:"value"`
+	}
+	resp := struct {
+		Data []point `json:"data"`
+		Meta struct {
+			DataPointPeriodSeconds int    `json:"data_point_period_seconds"`
+			Region                 string `json:"region"`
+			SignalType             string `json:"signal_type"`
+			Units                  string `json:"units"`
+		} `json:"meta"`
+	}{Data: []point{}}
+	for _, ts := range timeslots {
+		resp.Data = append(resp.Data, point{
+			PointTime: time.Unix(glow.TimeslotToUnix(ts), 0).UTC().Format(time.RFC3339),
+			Value:     moer(region, ts),
+		})
+	}
+	resp.Meta.DataPointPeriodSeconds = 300
+	resp.Meta.Region = region
+	resp.Meta.SignalType = "co2_moer"
+	resp.Meta.Units = "lbs_co2_per_mwh"
+	return resp
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,117 @@
+package mock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/glowlabs-org/gca-backend/glow"
+)
+
+// get makes an authenticated request to the mock and decodes the response
+// into v.
+func get(s *Server, path string, q url.Values, v interface{}) (int, error) {
+	req, err := http.NewRequest("GET", s.URL()+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return 0, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// dataResponse is the part of a data response that the tests look at.
+type dataResponse struct {
+	Data []struct {
+		PointTime string  `json:"point_time"`
+		Value     float64 `json:"value"`
+	} `json:"data"`
+}
+
+// TestMock checks the responses and the error modes of the mock.
+func TestMock(t *testing.T) {
+	glow.SetCurrentTimeslot(20)
+	defer glow.SetCurrentTimeslot(0)
+	s := NewServer()
+	defer s.Close()
+
+	// The index returns the current timeslot, and the history stops at
+	// the current timeslot.
+	var index dataResponse
+	status, err := get(s, "/v3/signal-index", url.Values{"region": {"X"}}, &index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(index.Data) != 1 || index.Data[0].Value != DefaultMOER("X", 20) {
+		t.Fatalf("unexpected index: %v %+v", status, index)
+	}
+	var history dataResponse
+	start := time.Unix(glow.TimeslotToUnix(15), 0).UTC().Format(time.RFC3339)
+	end := time.Unix(glow.TimeslotToUnix(30), 0).UTC().Format(time.RFC3339)
+	status, err = get(s, "/v3/historical", url.Values{"region": {"X"}, "start": {start}, "end": {end}}, &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(history.Data) != 6 || history.Data[5].Value != DefaultMOER("X", 20) {
+		t.Fatalf("unexpected history: %v %+v", status, history)
+	}
+
+	// Canned responses.
+	s.SetMOER(func(string, uint32) float64 { return 7 })
+	s.SetRegion(func(float64, float64) string { return "CANNED" })
+	var region map[string]string
+	if _, err := get(s, "/v3/region-from-loc", url.Values{"latitude": {"1"}, "longitude": {"2"}}, &region); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(s, "/v3/signal-index", url.Values{"region": {"X"}}, &index); err != nil {
+		t.Fatal(err)
+	}
+	if region["region"] != "CANNED" || index.Data[0].Value != 7 {
+		t.Fatal("canned responses were not used:", region, index)
+	}
+
+	// Requests without a token are refused.
+	resp, err := http.Get(s.URL() + "/v3/signal-index?region=X")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("expected a request without a token to be refused:", resp.StatusCode)
+	}
+
+	// The error modes.
+	s.FailNext(2)
+	for i, want := range []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK} {
+		if status, err := get(s, "/v3/signal-index", nil, nil); err != nil || status != want {
+			t.Fatal("unexpected status after FailNext:", i, status, err)
+		}
+	}
+	s.SetDown(true)
+	if status, err := get(s, "/v3/signal-index", nil, nil); err != nil || status != http.StatusServiceUnavailable {
+		t.Fatal("expected the mock to be down:", status, err)
+	}
+	s.SetDown(false)
+	s.SetLatency(50 * time.Millisecond)
+	before := time.Now()
+	if status, err := get(s, "/v3/signal-index", nil, nil); err != nil || status != http.StatusOK {
+		t.Fatal("expected the mock to be up:", status, err)
+	}
+	if time.Since(before) < 50*time.Millisecond {
+		t.Fatal("latency was not applied")
+	}
+	if n := s.Requests("/v3/signal-index"); n != 8 {
+		t.Fatal("unexpected number of requests:", n)
+	}
+}